@@ -0,0 +1,178 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package attrcrypt implements field-level encryption of sensitive
+// identity attributes, so that they are encrypted when stored in the
+// identity server's database.
+package attrcrypt
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// prefix is prepended to every encrypted value. Unencrypted
+// extra-info values are always JSON encoded, so they cannot start with
+// this prefix.
+const prefix = "enc:"
+
+// An Encrypter encrypts and decrypts attribute values.
+type Encrypter interface {
+	// Encrypt encrypts the given plaintext. The returned value must
+	// start with "enc:".
+	Encrypt(plaintext []byte) (string, error)
+
+	// Decrypt decrypts a value previously returned from Encrypt.
+	Decrypt(ciphertext string) ([]byte, error)
+}
+
+// IsEncrypted reports whether the given stored value has been
+// encrypted.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// Params holds the configuration of attribute encryption.
+type Params struct {
+	// Attributes holds the names of the extra-info items that are
+	// encrypted at rest.
+	Attributes []string
+
+	// Encrypter holds the Encrypter used to encrypt the values of
+	// the attributes. This must be set if any attributes are
+	// specified.
+	Encrypter Encrypter
+}
+
+// IsSensitive reports whether the given extra-info item is encrypted
+// at rest.
+func (p Params) IsSensitive(attr string) bool {
+	for _, a := range p.Attributes {
+		if a == attr {
+			return true
+		}
+	}
+	return false
+}
+
+// Encode returns the value to store for the given extra-info item.
+// If the item is sensitive the value is encrypted, otherwise it is
+// returned unchanged.
+func (p Params) Encode(attr string, value []byte) (string, error) {
+	if !p.IsSensitive(attr) {
+		return string(value), nil
+	}
+	if p.Encrypter == nil {
+		return "", errgo.Newf("no encrypter configured for %q", attr)
+	}
+	ct, err := p.Encrypter.Encrypt(value)
+	if err != nil {
+		return "", errgo.Notef(err, "cannot encrypt %q", attr)
+	}
+	return ct, nil
+}
+
+// Decode returns the original value of a stored extra-info item.
+func (p Params) Decode(value string) ([]byte, error) {
+	if !IsEncrypted(value) {
+		return []byte(value), nil
+	}
+	if p.Encrypter == nil {
+		return nil, errgo.Newf("no encrypter configured")
+	}
+	pt, err := p.Encrypter.Decrypt(value)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return pt, nil
+}
+
+// A Key is an AES-256 key used to encrypt attributes.
+type Key struct {
+	// ID holds the identifier of the key, which is recorded with
+	// every value encrypted with the key.
+	ID string
+
+	// Key holds the key data.
+	Key [32]byte
+}
+
+// A KeyRing is an Encrypter that uses AES-GCM with a set of keys. The
+// first key is used to encrypt new values, values encrypted with any
+// of the keys can be decrypted. This allows keys to be rotated by
+// adding a new key to the front of the ring; existing values are
+// re-encrypted with the new key when they are next written, or by
+// Params.Reencrypt.
+type KeyRing struct {
+	primary string
+	aeads   map[string]cipher.AEAD
+}
+
+// NewKeyRing creates a new KeyRing holding the given keys. At least
+// one key must be specified.
+func NewKeyRing(keys ...Key) (*KeyRing, error) {
+	if len(keys) == 0 {
+		return nil, errgo.Newf("no keys specified")
+	}
+	kr := &KeyRing{
+		primary: keys[0].ID,
+		aeads:   make(map[string]cipher.AEAD, len(keys)),
+	}
+	for _, k := range keys {
+		if k.ID == "" || k.ID == "envelope" || strings.Contains(k.ID, ":") {
+			return nil, errgo.Newf("invalid key id %q", k.ID)
+		}
+		if _, ok := kr.aeads[k.ID]; ok {
+			return nil, errgo.Newf("duplicate key id %q", k.ID)
+		}
+		aead, err := newAEAD(k.Key[:])
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		kr.aeads[k.ID] = aead
+	}
+	return kr, nil
+}
+
+// Encrypt implements Encrypter.Encrypt. The returned value has the form
+// "enc:<key-id>:<base64 nonce and ciphertext>".
+func (kr *KeyRing) Encrypt(plaintext []byte) (string, error) {
+	aead := kr.aeads[kr.primary]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errgo.Mask(err)
+	}
+	data := aead.Seal(nonce, nonce, plaintext, []byte(kr.primary))
+	return prefix + kr.primary + ":" + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Decrypt implements Encrypter.Decrypt.
+func (kr *KeyRing) Decrypt(ciphertext string) ([]byte, error) {
+	if !IsEncrypted(ciphertext) {
+		return nil, errgo.Newf("value not encrypted")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(ciphertext, prefix), ":", 2)
+	if len(parts) != 2 {
+		return nil, errgo.Newf("invalid encrypted value")
+	}
+	aead, ok := kr.aeads[parts[0]]
+	if !ok {
+		return nil, errgo.Newf("unknown key id %q", parts[0])
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid encrypted value")
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errgo.Newf("invalid encrypted value")
+	}
+	pt, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(parts[0]))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot decrypt value")
+	}
+	return pt, nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package attrcrypt_test
+
+import (
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/attrcrypt"
+	"github.com/CanonicalLtd/candid/store"
+	"github.com/CanonicalLtd/candid/store/memstore"
+)
+
+func TestKeyRingRoundTrip(t *testing.T) {
+	c := qt.New(t)
+	kr, err := attrcrypt.NewKeyRing(attrcrypt.Key{ID: "k1", Key: [32]byte{1}})
+	c.Assert(err, qt.Equals, nil)
+	ct, err := kr.Encrypt([]byte(`"123-45-678"`))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(attrcrypt.IsEncrypted(ct), qt.Equals, true)
+	c.Assert(ct, qt.Not(qt.Contains), "123-45-678")
+	pt, err := kr.Decrypt(ct)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(pt), qt.Equals, `"123-45-678"`)
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	c := qt.New(t)
+	old, err := attrcrypt.NewKeyRing(attrcrypt.Key{ID: "k1", Key: [32]byte{1}})
+	c.Assert(err, qt.Equals, nil)
+	ct, err := old.Encrypt([]byte("secret"))
+	c.Assert(err, qt.Equals, nil)
+
+	kr, err := attrcrypt.NewKeyRing(
+		attrcrypt.Key{ID: "k2", Key: [32]byte{2}},
+		attrcrypt.Key{ID: "k1", Key: [32]byte{1}},
+	)
+	c.Assert(err, qt.Equals, nil)
+	pt, err := kr.Decrypt(ct)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(pt), qt.Equals, "secret")
+
+	ct, err = kr.Encrypt([]byte("secret"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ct, qt.Matches, `enc:k2:.*`)
+	_, err = old.Decrypt(ct)
+	c.Assert(err, qt.ErrorMatches, `unknown key id "k2"`)
+}
+
+func TestKeyRingWrongKey(t *testing.T) {
+	c := qt.New(t)
+	kr1, err := attrcrypt.NewKeyRing(attrcrypt.Key{ID: "k1", Key: [32]byte{1}})
+	c.Assert(err, qt.Equals, nil)
+	kr2, err := attrcrypt.NewKeyRing(attrcrypt.Key{ID: "k1", Key: [32]byte{2}})
+	c.Assert(err, qt.Equals, nil)
+	ct, err := kr1.Encrypt([]byte("secret"))
+	c.Assert(err, qt.Equals, nil)
+	_, err = kr2.Decrypt(ct)
+	c.Assert(err, qt.ErrorMatches, `cannot decrypt value: .*`)
+}
+
+func TestNewKeyRingErrors(t *testing.T) {
+	c := qt.New(t)
+	_, err := attrcrypt.NewKeyRing()
+	c.Assert(err, qt.ErrorMatches, `no keys specified`)
+	_, err = attrcrypt.NewKeyRing(attrcrypt.Key{ID: "a:b"})
+	c.Assert(err, qt.ErrorMatches, `invalid key id "a:b"`)
+	_, err = attrcrypt.NewKeyRing(attrcrypt.Key{ID: "k1"}, attrcrypt.Key{ID: "k1"})
+	c.Assert(err, qt.ErrorMatches, `duplicate key id "k1"`)
+}
+
+func TestParamsEncodeDecode(t *testing.T) {
+	c := qt.New(t)
+	kr, err := attrcrypt.NewKeyRing(attrcrypt.Key{ID: "k1", Key: [32]byte{1}})
+	c.Assert(err, qt.Equals, nil)
+	p := attrcrypt.Params{
+		Attributes: []string{"national-id"},
+		Encrypter:  kr,
+	}
+	v, err := p.Encode("team", []byte(`"blue"`))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(v, qt.Equals, `"blue"`)
+	v, err = p.Encode("national-id", []byte(`"123"`))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(attrcrypt.IsEncrypted(v), qt.Equals, true)
+	pt, err := p.Decode(v)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(pt), qt.Equals, `"123"`)
+	pt, err = p.Decode(`"blue"`)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(pt), qt.Equals, `"blue"`)
+}
+
+func TestReencrypt(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	old, err := attrcrypt.NewKeyRing(attrcrypt.Key{ID: "k1", Key: [32]byte{1}})
+	c.Assert(err, qt.Equals, nil)
+	ct, err := old.Encrypt([]byte(`"AB123456C"`))
+	c.Assert(err, qt.Equals, nil)
+
+	st := memstore.NewStore()
+	for _, id := range []store.Identity{{
+		ProviderID: "test:alice",
+		Username:   "alice",
+		ExtraInfo: map[string][]string{
+			"national-id": {ct},
+			"team":        {`"blue"`},
+		},
+	}, {
+		ProviderID: "test:bob",
+		Username:   "bob",
+		ExtraInfo: map[string][]string{
+			"national-id": {`"ZZ999999Z"`},
+		},
+	}, {
+		ProviderID: "test:carol",
+		Username:   "carol",
+	}} {
+		id := id
+		err := st.UpdateIdentity(ctx, &id, store.Update{
+			store.Username:  store.Set,
+			store.ExtraInfo: store.Set,
+		})
+		c.Assert(err, qt.Equals, nil)
+	}
+
+	kr, err := attrcrypt.NewKeyRing(
+		attrcrypt.Key{ID: "k2", Key: [32]byte{2}},
+		attrcrypt.Key{ID: "k1", Key: [32]byte{1}},
+	)
+	c.Assert(err, qt.Equals, nil)
+	p := attrcrypt.Params{
+		Attributes: []string{"national-id"},
+		Encrypter:  kr,
+	}
+	n, err := p.Reencrypt(ctx, st)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, 2)
+
+	// Every value can now be read without the old key.
+	kr, err = attrcrypt.NewKeyRing(attrcrypt.Key{ID: "k2", Key: [32]byte{2}})
+	c.Assert(err, qt.Equals, nil)
+	p.Encrypter = kr
+	for user, want := range map[string]string{
+		"alice": `"AB123456C"`,
+		"bob":   `"ZZ999999Z"`,
+	} {
+		id := store.Identity{Username: user}
+		err := st.Identity(ctx, &id)
+		c.Assert(err, qt.Equals, nil)
+		v := id.ExtraInfo["national-id"][0]
+		c.Assert(v, qt.Matches, `enc:k2:.*`)
+		pt, err := p.Decode(v)
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(string(pt), qt.Equals, want)
+	}
+	id := store.Identity{Username: "alice"}
+	err = st.Identity(ctx, &id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id.ExtraInfo["team"], qt.DeepEquals, []string{`"blue"`})
+}
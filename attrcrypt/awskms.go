@@ -0,0 +1,126 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package attrcrypt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/internal/awssig"
+)
+
+// AWSKMS is a KMS that uses the AWS Key Management Service to wrap
+// data keys.
+type AWSKMS struct {
+	// Region holds the AWS region of the KMS key.
+	Region string
+
+	// KeyID holds the ID or ARN of the KMS key used to wrap data
+	// keys.
+	KeyID string
+
+	// AccessKeyID, SecretAccessKey and SessionToken hold the
+	// credentials used to authenticate to AWS.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// Endpoint optionally holds the URL of the KMS endpoint. If this
+	// is empty, the standard endpoint for the region is used.
+	Endpoint string
+
+	// Client holds the HTTP client used to contact AWS. If this is
+	// nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+type awsEncryptRequest struct {
+	KeyId     string
+	Plaintext []byte
+}
+
+type awsEncryptResponse struct {
+	CiphertextBlob []byte
+}
+
+type awsDecryptRequest struct {
+	KeyId          string
+	CiphertextBlob []byte
+}
+
+type awsDecryptResponse struct {
+	Plaintext []byte
+}
+
+type awsError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+// WrapKey implements KMS.WrapKey.
+func (k *AWSKMS) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	var resp awsEncryptResponse
+	if err := k.call(ctx, "Encrypt", awsEncryptRequest{KeyId: k.KeyID, Plaintext: key}, &resp); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return resp.CiphertextBlob, nil
+}
+
+// UnwrapKey implements KMS.UnwrapKey.
+func (k *AWSKMS) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var resp awsDecryptResponse
+	if err := k.call(ctx, "Decrypt", awsDecryptRequest{KeyId: k.KeyID, CiphertextBlob: wrapped}, &resp); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return resp.Plaintext, nil
+}
+
+func (k *AWSKMS) call(ctx context.Context, op string, body, resp interface{}) error {
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	endpoint := k.Endpoint
+	if endpoint == "" {
+		endpoint = "https://kms." + k.Region + ".amazonaws.com/"
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(buf))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+op)
+	awssig.Sign(req, buf, "kms", k.Region, awssig.Credentials{
+		AccessKeyID:     k.AccessKeyID,
+		SecretAccessKey: k.SecretAccessKey,
+		SessionToken:    k.SessionToken,
+	}, time.Now())
+	client := k.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	hresp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errgo.Notef(err, "cannot contact AWS KMS")
+	}
+	defer hresp.Body.Close()
+	if hresp.StatusCode != http.StatusOK {
+		var aerr awsError
+		if err := httprequest.UnmarshalJSONResponse(hresp, &aerr); err != nil {
+			return errgo.Notef(err, "cannot %s with AWS KMS: %s", strings.ToLower(op), hresp.Status)
+		}
+		return errgo.Newf("cannot %s with AWS KMS: %s: %s", strings.ToLower(op), aerr.Type, aerr.Message)
+	}
+	if err := httprequest.UnmarshalJSONResponse(hresp, resp); err != nil {
+		return errgo.Notef(err, "cannot %s with AWS KMS", strings.ToLower(op))
+	}
+	return nil
+}
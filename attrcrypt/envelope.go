@@ -0,0 +1,189 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package attrcrypt
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// envelopePrefix is prepended to every value encrypted by an Envelope.
+const envelopePrefix = prefix + "envelope:"
+
+// kmsTimeout is the maximum time allowed for a request to a KMS.
+const kmsTimeout = 30 * time.Second
+
+// A KMS is a key management service that protects the data keys used
+// by an Envelope.
+type KMS interface {
+	// WrapKey encrypts the given data key.
+	WrapKey(ctx context.Context, key []byte) ([]byte, error)
+
+	// UnwrapKey decrypts a data key previously encrypted with
+	// WrapKey.
+	UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// An Envelope is an Encrypter that uses envelope encryption. Values
+// are encrypted using AES-GCM with a data key that is generated by the
+// Envelope. The data key is encrypted by a KMS and stored alongside
+// each value, so that the KMS is only needed to decrypt the data key
+// and never sees the values themselves.
+type Envelope struct {
+	kms KMS
+
+	mu         sync.Mutex
+	current    cipher.AEAD
+	currentKey string
+	keys       map[string]cipher.AEAD
+}
+
+// NewEnvelope returns a new Envelope that protects its data keys with
+// the given KMS.
+func NewEnvelope(kms KMS) *Envelope {
+	return &Envelope{
+		kms:  kms,
+		keys: make(map[string]cipher.AEAD),
+	}
+}
+
+// Encrypt implements Encrypter.Encrypt. The returned value has the form
+// "enc:envelope:<base64 wrapped key>:<base64 nonce and ciphertext>".
+func (e *Envelope) Encrypt(plaintext []byte) (string, error) {
+	aead, wrapped, err := e.dataKey()
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errgo.Mask(err)
+	}
+	data := aead.Seal(nonce, nonce, plaintext, []byte(wrapped))
+	return envelopePrefix + wrapped + ":" + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Decrypt implements Encrypter.Decrypt.
+func (e *Envelope) Decrypt(ciphertext string) ([]byte, error) {
+	if !strings.HasPrefix(ciphertext, envelopePrefix) {
+		return nil, errgo.Newf("value not envelope encrypted")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(ciphertext, envelopePrefix), ":", 2)
+	if len(parts) != 2 {
+		return nil, errgo.Newf("invalid encrypted value")
+	}
+	aead, err := e.unwrap(parts[0])
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid encrypted value")
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errgo.Newf("invalid encrypted value")
+	}
+	pt, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(parts[0]))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot decrypt value")
+	}
+	return pt, nil
+}
+
+// dataKey returns the current data key and its wrapped form, creating
+// a new key if necessary.
+func (e *Envelope) dataKey() (cipher.AEAD, string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.current != nil {
+		return e.current, e.currentKey, nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, "", errgo.Mask(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+	defer cancel()
+	wrapped, err := e.kms.WrapKey(ctx, key)
+	if err != nil {
+		return nil, "", errgo.Notef(err, "cannot wrap data key")
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, "", errgo.Mask(err)
+	}
+	e.current = aead
+	e.currentKey = base64.RawURLEncoding.EncodeToString(wrapped)
+	e.keys[e.currentKey] = aead
+	return e.current, e.currentKey, nil
+}
+
+// unwrap returns the data key with the given wrapped form.
+func (e *Envelope) unwrap(wrapped string) (cipher.AEAD, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if aead, ok := e.keys[wrapped]; ok {
+		return aead, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid encrypted value")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+	defer cancel()
+	key, err := e.kms.UnwrapKey(ctx, data)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot unwrap data key")
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	e.keys[wrapped] = aead
+	return aead, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return aead, nil
+}
+
+// LocalKMS is a KMS that wraps data keys using keys held by the
+// identity server, typically read from a local key file.
+type LocalKMS struct {
+	// KeyRing holds the keys used to wrap data keys.
+	KeyRing *KeyRing
+}
+
+// WrapKey implements KMS.WrapKey.
+func (k LocalKMS) WrapKey(_ context.Context, key []byte) ([]byte, error) {
+	s, err := k.KeyRing.Encrypt(key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return []byte(s), nil
+}
+
+// UnwrapKey implements KMS.UnwrapKey.
+func (k LocalKMS) UnwrapKey(_ context.Context, wrapped []byte) ([]byte, error) {
+	key, err := k.KeyRing.Decrypt(string(wrapped))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return key, nil
+}
@@ -0,0 +1,200 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package attrcrypt_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/attrcrypt"
+	"github.com/CanonicalLtd/candid/store/memstore"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	c := qt.New(t)
+	kms := newCountingKMS(c)
+	e := attrcrypt.NewEnvelope(kms)
+	ct1, err := e.Encrypt([]byte("refresh-token-1"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ct1, qt.Matches, `enc:envelope:.*`)
+	ct2, err := e.Encrypt([]byte("refresh-token-2"))
+	c.Assert(err, qt.Equals, nil)
+	// The data key is only wrapped once.
+	c.Assert(kms.wraps, qt.Equals, 1)
+
+	// A new envelope with the same KMS can decrypt the values,
+	// unwrapping the data key only once.
+	e = attrcrypt.NewEnvelope(kms)
+	pt, err := e.Decrypt(ct1)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(pt), qt.Equals, "refresh-token-1")
+	pt, err = e.Decrypt(ct2)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(pt), qt.Equals, "refresh-token-2")
+	c.Assert(kms.unwraps, qt.Equals, 1)
+}
+
+func TestEnvelopeTampered(t *testing.T) {
+	c := qt.New(t)
+	e := attrcrypt.NewEnvelope(newCountingKMS(c))
+	ct, err := e.Encrypt([]byte("secret"))
+	c.Assert(err, qt.Equals, nil)
+	ct = ct[:len(ct)-2] + "AA"
+	_, err = e.Decrypt(ct)
+	c.Assert(err, qt.ErrorMatches, `cannot decrypt value: .*`)
+}
+
+func TestVaultKMS(t *testing.T) {
+	c := qt.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Vault-Token") != "test-token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		var body map[string]string
+		json.NewDecoder(req.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/v1/transit/encrypt/candid":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]string{"ciphertext": "vault:v1:" + body["plaintext"]},
+			})
+		case "/v1/transit/decrypt/candid":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]string{"plaintext": strings.TrimPrefix(body["ciphertext"], "vault:v1:")},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+	defer srv.Close()
+
+	kms := &attrcrypt.VaultKMS{
+		Address: srv.URL,
+		Token:   "test-token",
+		KeyName: "candid",
+	}
+	wrapped, err := kms.WrapKey(context.Background(), []byte("key"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(wrapped), qt.Equals, "vault:v1:"+base64.StdEncoding.EncodeToString([]byte("key")))
+	key, err := kms.UnwrapKey(context.Background(), wrapped)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(key), qt.Equals, "key")
+
+	kms.Token = "bad-token"
+	_, err = kms.WrapKey(context.Background(), []byte("key"))
+	c.Assert(err, qt.ErrorMatches, `cannot encrypt with vault: permission denied`)
+}
+
+func TestAWSKMS(t *testing.T) {
+	c := qt.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.Header.Get("Authorization"), qt.Matches, `AWS4-HMAC-SHA256 Credential=AKID/[0-9]{8}/us-east-1/kms/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-target, Signature=[0-9a-f]{64}`)
+		var body map[string][]byte
+		json.NewDecoder(req.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch req.Header.Get("X-Amz-Target") {
+		case "TrentService.Encrypt":
+			json.NewEncoder(w).Encode(map[string][]byte{
+				"CiphertextBlob": append([]byte("wrapped:"), body["Plaintext"]...),
+			})
+		case "TrentService.Decrypt":
+			json.NewEncoder(w).Encode(map[string][]byte{
+				"Plaintext": []byte(strings.TrimPrefix(string(body["CiphertextBlob"]), "wrapped:")),
+			})
+		}
+	}))
+	defer srv.Close()
+
+	kms := &attrcrypt.AWSKMS{
+		Region:          "us-east-1",
+		KeyID:           "alias/candid",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+		Endpoint:        srv.URL + "/",
+	}
+	wrapped, err := kms.WrapKey(context.Background(), []byte("key"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(wrapped), qt.Equals, "wrapped:key")
+	key, err := kms.UnwrapKey(context.Background(), wrapped)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(key), qt.Equals, "key")
+}
+
+func TestProviderDataStore(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	underlying := memstore.NewProviderDataStore()
+	pds := attrcrypt.NewProviderDataStore(underlying, attrcrypt.NewEnvelope(newCountingKMS(c)))
+	kv, err := pds.KeyValueStore(ctx, "test")
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "key", []byte("refresh-token"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	v, err := kv.Get(ctx, "key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "refresh-token")
+
+	// The value is encrypted in the underlying store.
+	ukv, err := underlying.KeyValueStore(ctx, "test")
+	c.Assert(err, qt.Equals, nil)
+	v, err = ukv.Get(ctx, "key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(attrcrypt.IsEncrypted(string(v)), qt.Equals, true)
+
+	// Values stored before encryption was enabled can still be read.
+	err = ukv.Set(ctx, "old", []byte("plain"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	v, err = kv.Get(ctx, "old")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "plain")
+
+	err = kv.Update(ctx, "key", time.Time{}, func(old []byte) ([]byte, error) {
+		c.Check(string(old), qt.Equals, "refresh-token")
+		return []byte("refresh-token-2"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	v, err = kv.Get(ctx, "key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "refresh-token-2")
+
+	_, err = kv.Get(ctx, "not-there")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	err = simplekv.SetKeyOnce(ctx, kv, "key", []byte("x"), time.Time{})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrDuplicateKey)
+}
+
+type countingKMS struct {
+	attrcrypt.LocalKMS
+	wraps, unwraps int
+}
+
+func newCountingKMS(c *qt.C) *countingKMS {
+	kr, err := attrcrypt.NewKeyRing(attrcrypt.Key{ID: "k1", Key: [32]byte{1}})
+	c.Assert(err, qt.Equals, nil)
+	return &countingKMS{
+		LocalKMS: attrcrypt.LocalKMS{KeyRing: kr},
+	}
+}
+
+func (k *countingKMS) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	k.wraps++
+	return k.LocalKMS.WrapKey(ctx, key)
+}
+
+func (k *countingKMS) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	k.unwraps++
+	return k.LocalKMS.UnwrapKey(ctx, wrapped)
+}
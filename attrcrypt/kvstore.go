@@ -0,0 +1,101 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package attrcrypt
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// NewProviderDataStore returns a store.ProviderDataStore that encrypts
+// all values written to the key-value stores obtained from the given
+// store using the given Encrypter. Values that were written before
+// encryption was enabled are returned unchanged.
+func NewProviderDataStore(pds store.ProviderDataStore, e Encrypter) store.ProviderDataStore {
+	return &providerDataStore{
+		pds: pds,
+		e:   e,
+	}
+}
+
+type providerDataStore struct {
+	pds store.ProviderDataStore
+	e   Encrypter
+}
+
+// KeyValueStore implements store.ProviderDataStore.KeyValueStore.
+func (s *providerDataStore) KeyValueStore(ctx context.Context, idp string) (simplekv.Store, error) {
+	kv, err := s.pds.KeyValueStore(ctx, idp)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &kvStore{
+		Store: kv,
+		e:     s.e,
+	}, nil
+}
+
+// A kvStore is a simplekv.Store that encrypts the values held in an
+// underlying store.
+type kvStore struct {
+	simplekv.Store
+	e Encrypter
+}
+
+// Get implements simplekv.Store.Get.
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
+	v, err := s.Store.Get(ctx, key)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrNotFound))
+	}
+	return s.decrypt(v)
+}
+
+// Set implements simplekv.Store.Set.
+func (s *kvStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	ct, err := s.e.Encrypt(value)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(s.Store.Set(ctx, key, []byte(ct), expire))
+}
+
+// Update implements simplekv.Store.Update.
+func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	err := s.Store.Update(ctx, key, expire, func(old []byte) ([]byte, error) {
+		if old != nil {
+			var err error
+			old, err = s.decrypt(old)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
+		v, err := getVal(old)
+		if err != nil || v == nil {
+			return v, errgo.Mask(err, errgo.Any)
+		}
+		ct, err := s.e.Encrypt(v)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return []byte(ct), nil
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+func (s *kvStore) decrypt(v []byte) ([]byte, error) {
+	if !IsEncrypted(string(v)) {
+		return v, nil
+	}
+	pt, err := s.e.Decrypt(string(v))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return pt, nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package attrcrypt
+
+import (
+	"context"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// reencryptBatchSize holds the number of identities that Reencrypt
+// reads from the store at once.
+const reencryptBatchSize = 1000
+
+// Reencrypt rewrites the sensitive extra-info items of every identity
+// in the given store using the current Encrypter. With a KeyRing this
+// re-encrypts every value with the first key, after which the other
+// keys may be removed. Sensitive items that were stored before the
+// attribute was made sensitive are encrypted. Reencrypt returns the
+// number of identities that were updated.
+func (p Params) Reencrypt(ctx context.Context, st store.Store) (int, error) {
+	if len(p.Attributes) == 0 {
+		return 0, nil
+	}
+	if p.Encrypter == nil {
+		return 0, errgo.Newf("no encrypter configured")
+	}
+	sort := []store.Sort{{Field: store.Username}}
+	n := 0
+	for skip := 0; ; skip += reencryptBatchSize {
+		identities, err := st.FindIdentities(ctx, nil, store.Filter{}, sort, skip, reencryptBatchSize)
+		if err != nil {
+			return n, errgo.Notef(err, "cannot read identities")
+		}
+		for _, id := range identities {
+			extraInfo, err := p.reencode(id.ExtraInfo)
+			if err != nil {
+				return n, errgo.Notef(err, "cannot re-encrypt extra-info for %q", id.Username)
+			}
+			if len(extraInfo) == 0 {
+				continue
+			}
+			err = st.UpdateIdentity(ctx, &store.Identity{
+				ID:        id.ID,
+				ExtraInfo: extraInfo,
+			}, store.Update{
+				store.ExtraInfo: store.Set,
+			})
+			if err != nil {
+				return n, errgo.Notef(err, "cannot update %q", id.Username)
+			}
+			n++
+		}
+		if len(identities) < reencryptBatchSize {
+			return n, nil
+		}
+	}
+}
+
+// reencode returns the sensitive items in the given extra-info encoded
+// with the current Encrypter.
+func (p Params) reencode(extraInfo map[string][]string) (map[string][]string, error) {
+	var result map[string][]string
+	for _, attr := range p.Attributes {
+		vs := extraInfo[attr]
+		if len(vs) == 0 {
+			continue
+		}
+		nvs := make([]string, len(vs))
+		for i, v := range vs {
+			data, err := p.Decode(v)
+			if err != nil {
+				return nil, errgo.Notef(err, "cannot decrypt %q", attr)
+			}
+			nvs[i], err = p.Encode(attr, data)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
+		if result == nil {
+			result = make(map[string][]string)
+		}
+		result[attr] = nvs
+	}
+	return result, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package attrcrypt
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+)
+
+// VaultKMS is a KMS that uses the transit secrets engine of a
+// HashiCorp Vault server to wrap data keys.
+type VaultKMS struct {
+	// Address holds the URL of the Vault server.
+	Address string
+
+	// Token holds the token used to authenticate to Vault.
+	Token string
+
+	// Mount holds the path at which the transit secrets engine is
+	// mounted. If this is empty, "transit" is used.
+	Mount string
+
+	// KeyName holds the name of the transit key used to wrap data
+	// keys.
+	KeyName string
+
+	// Client holds the HTTP client used to contact Vault. If this is
+	// nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+type vaultResponse struct {
+	Data struct {
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// WrapKey implements KMS.WrapKey.
+func (k *VaultKMS) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	var resp vaultResponse
+	err := k.call(ctx, "encrypt", map[string]string{
+		"plaintext": base64.StdEncoding.EncodeToString(key),
+	}, &resp)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return []byte(resp.Data.Ciphertext), nil
+}
+
+// UnwrapKey implements KMS.UnwrapKey.
+func (k *VaultKMS) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var resp vaultResponse
+	err := k.call(ctx, "decrypt", map[string]string{
+		"ciphertext": string(wrapped),
+	}, &resp)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	key, err := base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid response from vault")
+	}
+	return key, nil
+}
+
+func (k *VaultKMS) call(ctx context.Context, op string, body interface{}, resp *vaultResponse) error {
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	mount := k.Mount
+	if mount == "" {
+		mount = "transit"
+	}
+	u := strings.TrimSuffix(k.Address, "/") + "/v1/" + mount + "/" + op + "/" + k.KeyName
+	req, err := http.NewRequest("POST", u, bytes.NewReader(buf))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", k.Token)
+	client := k.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	hresp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errgo.Notef(err, "cannot contact vault")
+	}
+	defer hresp.Body.Close()
+	if err := httprequest.UnmarshalJSONResponse(hresp, resp); err != nil {
+		return errgo.Notef(err, "cannot %s with vault", op)
+	}
+	if hresp.StatusCode != http.StatusOK {
+		return errgo.Newf("cannot %s with vault: %s", op, strings.Join(resp.Errors, "; "))
+	}
+	return nil
+}
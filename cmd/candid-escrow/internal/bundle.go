@@ -0,0 +1,156 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package internal implements the escrow bundles written and read by
+// the candid-escrow command.
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/candid/attrcrypt"
+	"github.com/CanonicalLtd/candid/config"
+)
+
+// bundleVersion is the version of the bundle format written by Seal.
+const bundleVersion = 1
+
+// escrowKeyID is the key ID recorded with the encrypted bundle data.
+const escrowKeyID = "escrow"
+
+// A Bundle is an encrypted escrow bundle holding the files needed to
+// restore a Candid server with its original keys.
+type Bundle struct {
+	// Version holds the version of the bundle format.
+	Version int `json:"version"`
+
+	// Created holds the time the bundle was created.
+	Created time.Time `json:"created"`
+
+	// Location and PublicKey identify the server the bundle was
+	// created for. They are not encrypted so that the correct
+	// bundle can be found without the escrow key.
+	Location  string            `json:"location"`
+	PublicKey *bakery.PublicKey `json:"public-key"`
+
+	// Data holds the encrypted files.
+	Data string `json:"data"`
+}
+
+// A File is a file held in an escrow bundle.
+type File struct {
+	// Path holds the path of the file when the bundle was created.
+	Path string `json:"path"`
+
+	// Mode holds the permissions of the file.
+	Mode os.FileMode `json:"mode"`
+
+	// Data holds the contents of the file.
+	Data []byte `json:"data"`
+}
+
+// Collect reads the server configuration at the given path and
+// returns the files that must be escrowed to restore the server. These
+// are the configuration file itself, which holds the server key pair,
+// and the key file of a local KMS if one is configured.
+func Collect(configPath string) ([]File, *config.Config, error) {
+	conf, err := config.Read(configPath)
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	paths := []string{configPath}
+	if conf.KMS != nil && conf.KMS.KeyFile != "" {
+		paths = append(paths, conf.KMS.KeyFile)
+	}
+	files := make([]File, len(paths))
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, errgo.Mask(err)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, nil, errgo.Mask(err)
+		}
+		files[i] = File{
+			Path: path,
+			Mode: info.Mode().Perm(),
+			Data: data,
+		}
+	}
+	return files, conf, nil
+}
+
+// Seal creates a new escrow bundle holding the given files encrypted
+// with the given key.
+func Seal(files []File, conf *config.Config, key [32]byte, now time.Time) (*Bundle, error) {
+	kr, err := attrcrypt.NewKeyRing(attrcrypt.Key{ID: escrowKeyID, Key: key})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	data, err := json.Marshal(files)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	ct, err := kr.Encrypt(data)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &Bundle{
+		Version:   bundleVersion,
+		Created:   now,
+		Location:  conf.Location,
+		PublicKey: conf.PublicKey,
+		Data:      ct,
+	}, nil
+}
+
+// Open decrypts the files held in the given bundle.
+func Open(b *Bundle, key [32]byte) ([]File, error) {
+	if b.Version != bundleVersion {
+		return nil, errgo.Newf("unsupported bundle version %d", b.Version)
+	}
+	kr, err := attrcrypt.NewKeyRing(attrcrypt.Key{ID: escrowKeyID, Key: key})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	data, err := kr.Decrypt(b.Data)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot decrypt bundle")
+	}
+	var files []File
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, errgo.Notef(err, "invalid bundle")
+	}
+	return files, nil
+}
+
+// Restore writes the given files into the given directory, using the
+// base name of each file's original path. Existing files are never
+// overwritten. Restore returns the paths of the files written.
+func Restore(files []File, dir string) ([]string, error) {
+	var paths []string
+	for _, f := range files {
+		path := filepath.Join(dir, filepath.Base(f.Path))
+		w, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, f.Mode)
+		if err != nil {
+			return paths, errgo.Mask(err)
+		}
+		_, err = w.Write(f.Data)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return paths, errgo.Notef(err, "cannot write %q", path)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package internal_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/cmd/candid-escrow/internal"
+	_ "github.com/CanonicalLtd/candid/store/memstore"
+)
+
+const testConfig = `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: memory
+kms:
+  type: local
+  key-file: %s
+`
+
+func TestSealOpenRestore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	dir := c.Mkdir()
+	keyPath := filepath.Join(dir, "kms.keys")
+	err := ioutil.WriteFile(keyPath, []byte("k1 AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\n"), 0600)
+	c.Assert(err, qt.Equals, nil)
+	confPath := filepath.Join(dir, "config.yaml")
+	confData := []byte(fmt.Sprintf(testConfig, keyPath))
+	err = ioutil.WriteFile(confPath, confData, 0640)
+	c.Assert(err, qt.Equals, nil)
+
+	files, conf, err := internal.Collect(confPath)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(files, qt.HasLen, 2)
+	c.Assert(files[0].Path, qt.Equals, confPath)
+	c.Assert(files[0].Mode, qt.Equals, os.FileMode(0640))
+	c.Assert(files[1].Path, qt.Equals, keyPath)
+
+	var key [32]byte
+	key[0] = 1
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	b, err := internal.Seal(files, conf, key, now)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(b.Location, qt.Equals, "http://foo.com:1234")
+	c.Assert(b.PublicKey.String(), qt.Equals, "CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=")
+	c.Assert(b.Created, qt.Equals, now)
+
+	var wrongKey [32]byte
+	_, err = internal.Open(b, wrongKey)
+	c.Assert(err, qt.ErrorMatches, `cannot decrypt bundle: .*`)
+
+	files1, err := internal.Open(b, key)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(files1, qt.DeepEquals, files)
+
+	restoreDir := c.Mkdir()
+	paths, err := internal.Restore(files1, restoreDir)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(paths, qt.DeepEquals, []string{
+		filepath.Join(restoreDir, "config.yaml"),
+		filepath.Join(restoreDir, "kms.keys"),
+	})
+	data, err := ioutil.ReadFile(paths[0])
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(data, qt.DeepEquals, confData)
+
+	// Restoring again does not overwrite the files.
+	_, err = internal.Restore(files1, restoreDir)
+	c.Assert(err, qt.ErrorMatches, `.*file exists`)
+}
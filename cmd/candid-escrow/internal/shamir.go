@@ -0,0 +1,157 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// A Share is one part of a secret that has been split using Shamir's
+// secret sharing scheme over GF(2^8).
+type Share struct {
+	// X holds the non-zero x coordinate of the share.
+	X byte
+
+	// Y holds the value of the polynomial at X for each byte of
+	// the secret.
+	Y []byte
+}
+
+// String returns the share in the form "<x>-<base64 y>", which is
+// parsed by ParseShare.
+func (s Share) String() string {
+	return strconv.Itoa(int(s.X)) + "-" + base64.RawURLEncoding.EncodeToString(s.Y)
+}
+
+// ParseShare parses a share in the format returned by Share.String.
+func ParseShare(s string) (Share, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return Share{}, errgo.Newf("invalid share %q", s)
+	}
+	x, err := strconv.Atoi(parts[0])
+	if err != nil || x < 1 || x > 255 {
+		return Share{}, errgo.Newf("invalid share %q", s)
+	}
+	y, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Share{}, errgo.Newf("invalid share %q", s)
+	}
+	return Share{X: byte(x), Y: y}, nil
+}
+
+// Split splits the given secret into n shares, any threshold of which
+// can be combined to recover the secret.
+func Split(secret []byte, n, threshold int) ([]Share, error) {
+	if threshold < 2 || threshold > n || n > 255 {
+		return nil, errgo.Newf("invalid share parameters: %d of %d", threshold, n)
+	}
+	// coeffs holds the coefficients of a random polynomial of
+	// degree threshold-1 for each byte of the secret. The constant
+	// term is the secret byte.
+	coeffs := make([]byte, threshold)
+	shares := make([]Share, n)
+	for i := range shares {
+		shares[i] = Share{X: byte(i + 1), Y: make([]byte, len(secret))}
+	}
+	for j, b := range secret {
+		coeffs[0] = b
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		for i := range shares {
+			shares[i].Y[j] = evaluate(coeffs, shares[i].X)
+		}
+	}
+	return shares, nil
+}
+
+// Combine recovers a secret from the given shares. The shares must
+// number at least the threshold used when the secret was split; if
+// there are too few the result is not the original secret.
+func Combine(shares []Share) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errgo.Newf("at least two shares required")
+	}
+	size := len(shares[0].Y)
+	seen := make(map[byte]bool)
+	for _, s := range shares {
+		if s.X == 0 || seen[s.X] {
+			return nil, errgo.Newf("invalid or duplicate share %d", s.X)
+		}
+		if len(s.Y) != size {
+			return nil, errgo.Newf("shares have inconsistent lengths")
+		}
+		seen[s.X] = true
+	}
+	secret := make([]byte, size)
+	for j := range secret {
+		// Lagrange interpolation at x=0.
+		var v byte
+		for i, si := range shares {
+			num, den := byte(1), byte(1)
+			for k, sk := range shares {
+				if k == i {
+					continue
+				}
+				num = mul(num, sk.X)
+				den = mul(den, si.X^sk.X)
+			}
+			v ^= mul(si.Y[j], div(num, den))
+		}
+		secret[j] = v
+	}
+	return secret, nil
+}
+
+// evaluate evaluates the polynomial with the given coefficients at x.
+func evaluate(coeffs []byte, x byte) byte {
+	var v byte
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		v = mul(v, x) ^ coeffs[i]
+	}
+	return v
+}
+
+var expTable, logTable [256]byte
+
+func init() {
+	// Build the tables using the generator 3 and the AES
+	// polynomial x^8 + x^4 + x^3 + x + 1.
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		expTable[i] = x
+		logTable[x] = byte(i)
+		x ^= x<<1 ^ reduce(x)
+	}
+	expTable[255] = expTable[0]
+}
+
+// reduce returns the reduction term to apply when x is multiplied by
+// two.
+func reduce(x byte) byte {
+	if x&0x80 != 0 {
+		return 0x1b
+	}
+	return 0
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])+int(logTable[b]))%255]
+}
+
+func div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])+255-int(logTable[b]))%255]
+}
@@ -0,0 +1,66 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package internal_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/cmd/candid-escrow/internal"
+)
+
+func TestSplitCombine(t *testing.T) {
+	c := qt.New(t)
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	shares, err := internal.Split(secret, 5, 3)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(shares, qt.HasLen, 5)
+
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		var ss []internal.Share
+		for _, i := range subset {
+			ss = append(ss, shares[i])
+		}
+		got, err := internal.Combine(ss)
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(got, qt.DeepEquals, secret, qt.Commentf("subset %v", subset))
+	}
+
+	// Too few shares do not recover the secret.
+	got, err := internal.Combine(shares[:2])
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(got, qt.Not(qt.DeepEquals), secret)
+}
+
+func TestSplitInvalidParameters(t *testing.T) {
+	c := qt.New(t)
+	_, err := internal.Split([]byte("secret"), 3, 4)
+	c.Assert(err, qt.ErrorMatches, `invalid share parameters: 4 of 3`)
+	_, err = internal.Split([]byte("secret"), 3, 1)
+	c.Assert(err, qt.ErrorMatches, `invalid share parameters: 1 of 3`)
+}
+
+func TestCombineDuplicateShares(t *testing.T) {
+	c := qt.New(t)
+	shares, err := internal.Split([]byte("secret"), 3, 2)
+	c.Assert(err, qt.Equals, nil)
+	_, err = internal.Combine([]internal.Share{shares[0], shares[0]})
+	c.Assert(err, qt.ErrorMatches, `invalid or duplicate share 1`)
+}
+
+func TestParseShare(t *testing.T) {
+	c := qt.New(t)
+	shares, err := internal.Split([]byte("secret"), 3, 2)
+	c.Assert(err, qt.Equals, nil)
+	for _, s := range shares {
+		s1, err := internal.ParseShare(s.String())
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(s1, qt.DeepEquals, s)
+	}
+	_, err = internal.ParseShare("0-AAAA")
+	c.Assert(err, qt.ErrorMatches, `invalid share "0-AAAA"`)
+	_, err = internal.ParseShare("nodash")
+	c.Assert(err, qt.ErrorMatches, `invalid share "nodash"`)
+}
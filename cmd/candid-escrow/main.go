@@ -0,0 +1,212 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juju/loggo"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/cmd/candid-escrow/internal"
+	_ "github.com/CanonicalLtd/candid/store/dynamodb"
+	_ "github.com/CanonicalLtd/candid/store/memstore"
+	_ "github.com/CanonicalLtd/candid/store/mgostore"
+	_ "github.com/CanonicalLtd/candid/store/sqlstore"
+)
+
+var loggingConfig = flag.String("logging-config", "<root>=INFO", "loggo `configuration` to use.")
+
+var logger = loggo.GetLogger("candid.escrow")
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if err := loggo.ConfigureLoggers(*loggingConfig); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot configure loggers: %v\n", err)
+		os.Exit(2)
+	}
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	var err error
+	switch flag.Arg(0) {
+	case "export":
+		err = export(flag.Args()[1:])
+	case "restore":
+		err = restore(flag.Args()[1:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		logger.Errorf("%s", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprint(os.Stderr, `
+	candid-escrow [-logging-config config] export [-o bundle] [-shares n -threshold k] <config path>
+	candid-escrow [-logging-config config] restore [-dir directory] [-key-file path] <bundle>
+
+The export command writes an encrypted escrow bundle holding the
+candidsrv configuration file, which contains the server key pair, and
+the key file of a local KMS if one is configured. The bundle is
+encrypted with a new random key which is printed on standard output.
+If -shares is specified the key is instead split into that many
+shares, any -threshold of which are needed to restore the bundle.
+The key or shares should be stored offline, separately from the
+bundle.
+
+The restore command decrypts a bundle using the key read from the
+-key-file, or otherwise at least the threshold number of shares read
+from standard input, one per line, and writes the escrowed files into
+the given directory. Existing files are never overwritten.
+
+See docs/escrow.md for the full recovery procedure.
+`)
+}
+
+func export(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("o", "candid-escrow.json", "`path` of the bundle to write.")
+	shares := fs.Int("shares", 0, "`number` of shares to split the key into.")
+	threshold := fs.Int("threshold", 0, "`number` of shares needed to restore the bundle.")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errgo.Newf("export requires a configuration path")
+	}
+	files, conf, err := internal.Collect(fs.Arg(0))
+	if err != nil {
+		return errgo.Notef(err, "cannot read configuration")
+	}
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return errgo.Mask(err)
+	}
+	var parts []internal.Share
+	if *shares > 0 {
+		parts, err = internal.Split(key[:], *shares, *threshold)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	b, err := internal.Seal(files, conf, key, time.Now().UTC())
+	if err != nil {
+		return errgo.Notef(err, "cannot create bundle")
+	}
+	data, err := json.MarshalIndent(b, "", "\t")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := ioutil.WriteFile(*out, data, 0600); err != nil {
+		return errgo.Mask(err)
+	}
+	if parts == nil {
+		fmt.Println(base64.StdEncoding.EncodeToString(key[:]))
+		return nil
+	}
+	for _, p := range parts {
+		fmt.Println(p)
+	}
+	return nil
+}
+
+func restore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dir := fs.String("dir", ".", "`directory` to write the restored files to.")
+	keyFile := fs.String("key-file", "", "`path` of a file holding the key. If this is not specified the shares are read from standard input, one per line.")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errgo.Newf("restore requires a bundle")
+	}
+	data, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var b internal.Bundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return errgo.Notef(err, "invalid bundle")
+	}
+	key, err := escrowKey(*keyFile, os.Stdin)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	files, err := internal.Open(&b, key)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	paths, err := internal.Restore(files, *dir)
+	for _, p := range paths {
+		fmt.Println(p)
+	}
+	if err != nil {
+		return errgo.Notef(err, "cannot restore files")
+	}
+	return nil
+}
+
+// escrowKey returns the escrow key, read as a base64 string from the
+// given key file if it is not empty, or otherwise combined from the
+// shares read from r, one per line. Keys and shares are never given as
+// arguments, so that they are not visible to other users of the
+// machine or recorded in shell history, and they are not included in
+// any errors.
+func escrowKey(keyFile string, r io.Reader) ([32]byte, error) {
+	var key [32]byte
+	var data []byte
+	if keyFile != "" {
+		buf, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return key, errgo.Notef(err, "cannot read key")
+		}
+		data, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf)))
+		if err != nil {
+			return key, errgo.Newf("invalid key in %q", keyFile)
+		}
+	} else {
+		var shares []internal.Share
+		scanner := bufio.NewScanner(r)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+			share, err := internal.ParseShare(text)
+			if err != nil {
+				return key, errgo.Newf("invalid share on line %d", line)
+			}
+			shares = append(shares, share)
+		}
+		if err := scanner.Err(); err != nil {
+			return key, errgo.Notef(err, "cannot read shares")
+		}
+		if len(shares) == 0 {
+			return key, errgo.Newf("no key file or shares specified")
+		}
+		var err error
+		data, err = internal.Combine(shares)
+		if err != nil {
+			return key, errgo.Mask(err)
+		}
+	}
+	if len(data) != len(key) {
+		return key, errgo.Newf("invalid key length %d", len(data))
+	}
+	copy(key[:], data)
+	return key, nil
+}
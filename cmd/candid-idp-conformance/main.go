@@ -0,0 +1,120 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/config"
+	"github.com/CanonicalLtd/candid/idp"
+	_ "github.com/CanonicalLtd/candid/idp/agent"
+	_ "github.com/CanonicalLtd/candid/idp/azure"
+	_ "github.com/CanonicalLtd/candid/idp/google"
+	"github.com/CanonicalLtd/candid/idp/idptest/conformance"
+	_ "github.com/CanonicalLtd/candid/idp/keystone"
+	_ "github.com/CanonicalLtd/candid/idp/ldap"
+	_ "github.com/CanonicalLtd/candid/idp/plugin"
+	_ "github.com/CanonicalLtd/candid/idp/static"
+	_ "github.com/CanonicalLtd/candid/idp/usso"
+	_ "github.com/CanonicalLtd/candid/idp/usso/ussodischarge"
+	_ "github.com/CanonicalLtd/candid/idp/usso/ussooauth"
+	_ "github.com/CanonicalLtd/candid/store/dynamodb"
+	_ "github.com/CanonicalLtd/candid/store/memstore"
+	_ "github.com/CanonicalLtd/candid/store/mgostore"
+	_ "github.com/CanonicalLtd/candid/store/sqlstore"
+)
+
+var (
+	idpName        = flag.String("idp", "", "only check the identity provider with this `name`")
+	username       = flag.String("username", "", "`username` to log in with using the login form")
+	password       = flag.String("password", "", "`password` to log in with using the login form")
+	expectUsername = flag.String("expect-username", "", "`username` expected after logging in; defaults to -username")
+)
+
+func main() {
+	testing.Init()
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+	if *username != "" && *idpName == "" {
+		fmt.Fprintln(os.Stderr, "-username requires -idp")
+		os.Exit(2)
+	}
+	if *expectUsername == "" {
+		*expectUsername = *username
+	}
+	path := flag.Arg(0)
+	conf, err := config.Read(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot read configuration: %v\n", err)
+		os.Exit(2)
+	}
+	var tests []testing.InternalTest
+	for i, c := range conf.IdentityProviders {
+		if *idpName != "" && c.Name() != *idpName {
+			continue
+		}
+		tests = append(tests, testing.InternalTest{
+			Name: c.Name(),
+			F:    conformanceTest(path, i),
+		})
+	}
+	if len(tests) == 0 {
+		fmt.Fprintln(os.Stderr, "no identity providers to check")
+		os.Exit(2)
+	}
+	matchAll := func(pat, str string) (bool, error) { return true, nil }
+	if !testing.RunTests(matchAll, tests) {
+		fmt.Println("FAIL")
+		os.Exit(1)
+	}
+	fmt.Println("PASS")
+}
+
+// conformanceTest returns a test that runs the conformance suite
+// against the i'th identity provider configured in the given
+// configuration file.
+func conformanceTest(path string, i int) func(*testing.T) {
+	return func(t *testing.T) {
+		c := qt.New(t)
+		p := conformance.Params{
+			// Read the configuration each time so that each test
+			// gets a new, uninitialised, identity provider.
+			New: func() idp.IdentityProvider {
+				conf, err := config.Read(path)
+				c.Assert(err, qt.Equals, nil)
+				return conf.IdentityProviders[i].IdentityProvider
+			},
+		}
+		if *username != "" {
+			p.Login = conformance.PostLoginForm(*username, *password)
+			p.ExpectUsername = *expectUsername
+			p.FailLogin = conformance.PostLoginForm(*username, *password+"-invalid")
+		}
+		conformance.Run(c, p)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] <config path>\n", os.Args[0])
+	fmt.Fprint(os.Stderr, `
+Run the identity provider conformance suite against the identity
+providers configured in the given candidsrv configuration file. If
+-username is given, a full login is performed with the identity
+provider named by -idp using the standard login form, and a login with
+an incorrect password is checked to fail.
+
+Use -test.v to see the result of each check.
+
+`)
+	flag.PrintDefaults()
+}
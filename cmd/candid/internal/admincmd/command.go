@@ -69,6 +69,7 @@ func New() cmd.Command {
 	supercmd.Register(newAddGroupCommand(c))
 	supercmd.Register(newCreateAgentCommand(c))
 	supercmd.Register(newFindCommand(c))
+	supercmd.Register(newImportCommand(c))
 	supercmd.Register(newRemoveGroupCommand(c))
 	supercmd.Register(newShowCommand(c))
 	return supercmd
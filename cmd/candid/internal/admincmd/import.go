@@ -0,0 +1,304 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/gnuflag"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+)
+
+// defaultImportChunkSize is the default maximum size of each chunk
+// uploaded by the import command.
+const defaultImportChunkSize = 4 * 1024 * 1024
+
+// importRetryDelay is the delay before a failed chunk upload is
+// retried.
+const importRetryDelay = 5 * time.Second
+
+type importCommand struct {
+	*candidCommand
+
+	chunkSize int64
+	resume    string
+	retries   int
+	path      string
+}
+
+func newImportCommand(c *candidCommand) cmd.Command {
+	return &importCommand{
+		candidCommand: c,
+	}
+}
+
+var importDoc = `
+The import command creates or updates users from a file containing one
+JSON object per line, for example:
+
+    {"username": "bob", "external-id": "ldap:bob", "email": "bob@example.com", "groups": ["staff"]}
+
+Recognised fields are username, external-id, name, email, groups and
+ssh-keys. Users are identified by their external-id, so importing the
+same file more than once is safe.
+
+The file is uploaded in chunks. Each chunk is validated separately and
+any records that cannot be imported are reported. If the upload is
+interrupted the import can be resumed by giving the import ID printed
+when it started; chunks that the server has already received are not
+uploaded again.
+
+    candid import users.json
+    candid import --resume 0123456789abcdef users.json
+`
+
+func (c *importCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "import",
+		Args:    "<file>",
+		Purpose: "import users",
+		Doc:     importDoc,
+	}
+}
+
+func (c *importCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.candidCommand.SetFlags(f)
+
+	f.Int64Var(&c.chunkSize, "chunk-size", defaultImportChunkSize, "maximum size of each uploaded chunk in bytes")
+	f.StringVar(&c.resume, "resume", "", "ID of an interrupted import to resume")
+	f.IntVar(&c.retries, "retries", 5, "number of times to retry uploading a chunk")
+}
+
+func (c *importCommand) Init(args []string) error {
+	if len(args) != 1 {
+		return errgo.New("import file not specified")
+	}
+	c.path = args[0]
+	if c.chunkSize <= 0 {
+		return errgo.Newf("invalid chunk size %d", c.chunkSize)
+	}
+	return errgo.Mask(c.candidCommand.Init(nil))
+}
+
+// importSession holds the status of an import, as returned by the
+// server.
+type importSession struct {
+	ID        string        `json:"id"`
+	ChunkSize int64         `json:"chunk-size"`
+	Chunks    int           `json:"chunks"`
+	Completed bool          `json:"completed"`
+	Reports   []chunkReport `json:"reports"`
+}
+
+// chunkReport holds the server's report on an uploaded chunk.
+type chunkReport struct {
+	Index    int    `json:"index"`
+	Digest   string `json:"digest"`
+	Records  int    `json:"records"`
+	Imported int    `json:"imported"`
+	Errors   []struct {
+		Line     int    `json:"line"`
+		Username string `json:"username"`
+		Message  string `json:"message"`
+	} `json:"errors"`
+}
+
+// importChunk holds the location of a chunk within the import file.
+type importChunk struct {
+	offset    int64
+	size      int64
+	firstLine int
+	digest    string
+}
+
+func (c *importCommand) Run(ctxt *cmd.Context) error {
+	defer c.Close(ctxt)
+	ctx := context.Background()
+	bClient, err := c.BakeryClient(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	client := &httprequest.Client{
+		BaseURL:        strings.TrimSuffix(candidURL(c.url), "/"),
+		Doer:           bClient,
+		UnmarshalError: httprequest.ErrorUnmarshaler(new(params.Error)),
+	}
+	f, err := os.Open(ctxt.AbsPath(c.path))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer f.Close()
+
+	var sess importSession
+	if c.resume != "" {
+		if err := client.Get(ctx, "/v1/import/"+c.resume, &sess); err != nil {
+			return errgo.Notef(err, "cannot get import %s", c.resume)
+		}
+		if sess.Completed {
+			return errgo.Newf("import %s has already completed", sess.ID)
+		}
+		if sess.ChunkSize > 0 {
+			// Split the file in the same way as when the
+			// import was started.
+			c.chunkSize = sess.ChunkSize
+		}
+	}
+	chunks, err := splitImportFile(f, c.chunkSize)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if c.resume == "" {
+		err := c.do(ctx, client, "POST", "/v1/import", map[string]interface{}{
+			"chunk-size": c.chunkSize,
+			"chunks":     len(chunks),
+		}, &sess)
+		if err != nil {
+			return errgo.Notef(err, "cannot start import")
+		}
+		fmt.Fprintf(ctxt.Stderr, "import %s started; use --resume %s to resume it if interrupted\n", sess.ID, sess.ID)
+	} else if sess.Chunks > 0 && sess.Chunks != len(chunks) {
+		return errgo.Newf("file has %d chunks but import %s expects %d", len(chunks), sess.ID, sess.Chunks)
+	}
+	uploaded := make(map[int]chunkReport)
+	for _, rep := range sess.Reports {
+		uploaded[rep.Index] = rep
+	}
+	var records, imported int
+	for i, ch := range chunks {
+		rep, ok := uploaded[i]
+		if !ok || rep.Digest != ch.digest {
+			buf := make([]byte, ch.size)
+			if _, err := f.ReadAt(buf, ch.offset); err != nil {
+				return errgo.Mask(err)
+			}
+			if err := c.upload(ctx, ctxt, client, sess.ID, i, buf, &rep); err != nil {
+				return errgo.Notef(err, "cannot upload chunk %d", i)
+			}
+		}
+		records += rep.Records
+		imported += rep.Imported
+		for _, e := range rep.Errors {
+			line := ch.firstLine + e.Line - 1
+			if e.Username != "" {
+				fmt.Fprintf(ctxt.Stdout, "line %d (%s): %s\n", line, e.Username, e.Message)
+			} else {
+				fmt.Fprintf(ctxt.Stdout, "line %d: %s\n", line, e.Message)
+			}
+		}
+	}
+	if err := c.do(ctx, client, "POST", "/v1/import/"+sess.ID+"/complete", nil, &sess); err != nil {
+		return errgo.Notef(err, "cannot complete import")
+	}
+	fmt.Fprintf(ctxt.Stdout, "imported %d of %d users\n", imported, records)
+	if imported < records {
+		return errgo.Newf("%d users could not be imported", records-imported)
+	}
+	return nil
+}
+
+// upload uploads a single chunk, retrying if the server cannot be
+// contacted.
+func (c *importCommand) upload(ctx context.Context, ctxt *cmd.Context, client *httprequest.Client, id string, index int, data []byte, rep *chunkReport) error {
+	path := fmt.Sprintf("/v1/import/%s/chunks/%d", id, index)
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("PUT", client.BaseURL+path, bytes.NewReader(data))
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		err = client.Do(ctx, req, rep)
+		if err == nil || !retryable(err) || attempt >= c.retries {
+			return errgo.Mask(err, errgo.Any)
+		}
+		fmt.Fprintf(ctxt.Stderr, "cannot upload chunk %d (retrying): %v\n", index, err)
+		time.Sleep(importRetryDelay)
+	}
+}
+
+func (c *importCommand) do(ctx context.Context, client *httprequest.Client, method, path string, body, resp interface{}) error {
+	var r io.ReadSeeker
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, client.BaseURL+path, r)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return errgo.Mask(client.Do(ctx, req, resp), errgo.Any)
+}
+
+// retryable reports whether a failed upload should be retried. Errors
+// returned by the identity server itself are not retried unless the
+// server is temporarily unavailable.
+func retryable(err error) bool {
+	perr, ok := errgo.Cause(err).(*params.Error)
+	if !ok {
+		return true
+	}
+	return perr.Code == params.ErrServiceUnavailable
+}
+
+// splitImportFile splits the given file into chunks of at most
+// chunkSize bytes, breaking only at the ends of lines.
+func splitImportFile(r io.Reader, chunkSize int64) ([]importChunk, error) {
+	var chunks []importChunk
+	br := bufio.NewReader(r)
+	var offset int64
+	line := 1
+	cur := importChunk{firstLine: 1}
+	h := sha256.New()
+	finish := func() {
+		if cur.size == 0 {
+			return
+		}
+		cur.digest = hex.EncodeToString(h.Sum(nil))
+		chunks = append(chunks, cur)
+		cur = importChunk{offset: offset, firstLine: line}
+		h.Reset()
+	}
+	for {
+		buf, err := br.ReadBytes('\n')
+		if len(buf) > 0 {
+			if int64(len(buf)) > chunkSize {
+				return nil, errgo.Newf("line %d is longer than the chunk size", line)
+			}
+			if cur.size+int64(len(buf)) > chunkSize {
+				finish()
+			}
+			h.Write(buf)
+			cur.size += int64(len(buf))
+			offset += int64(len(buf))
+			line++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	finish()
+	return chunks, nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+type importSuite struct {
+	fixture *fixture
+}
+
+func TestImport(t *testing.T) {
+	qtsuite.Run(qt.New(t), &importSuite{})
+}
+
+func (s *importSuite) Init(c *qt.C) {
+	s.fixture = newFixture(c)
+}
+
+const importUsers = `{"username": "alice", "external-id": "test:alice", "email": "alice@example.com"}
+{"username": "bob", "external-id": "test:bob", "groups": ["g1", "g2"]}
+{"username": "carol", "external-id": "test:carol"}
+`
+
+func (s *importSuite) TestImport(c *qt.C) {
+	path := filepath.Join(s.fixture.Dir, "users.json")
+	err := ioutil.WriteFile(path, []byte(importUsers), 0600)
+	c.Assert(err, qt.Equals, nil)
+	// Use a small chunk size so that the file is uploaded in
+	// several chunks.
+	code, stdout, stderr := s.fixture.Run("import", "-a", "admin.agent", "--chunk-size", "100", path)
+	c.Assert(code, qt.Equals, 0, qt.Commentf("stderr: %s", stderr))
+	c.Assert(stdout, qt.Equals, "imported 3 of 3 users\n")
+	c.Assert(stderr, qt.Matches, `import [0-9a-f]+ started; use --resume [0-9a-f]+ to resume it if interrupted\n`)
+
+	identity := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+	}
+	err = s.fixture.server.Store.Identity(context.Background(), &identity)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(identity.Username, qt.Equals, "bob")
+	c.Assert(identity.Groups, qt.DeepEquals, []string{"g1", "g2"})
+}
+
+func (s *importSuite) TestImportInvalidRecords(c *qt.C) {
+	path := filepath.Join(s.fixture.Dir, "users.json")
+	err := ioutil.WriteFile(path, []byte(importUsers+`{"username": "dave"}
+`), 0600)
+	c.Assert(err, qt.Equals, nil)
+	code, stdout, stderr := s.fixture.Run("import", "-a", "admin.agent", path)
+	c.Assert(code, qt.Equals, 1)
+	c.Assert(stdout, qt.Equals, `line 4 (dave): invalid external-id ""
+imported 3 of 4 users
+`)
+	c.Assert(stderr, qt.Matches, `(?s).*ERROR 1 users could not be imported\n`)
+}
+
+func (s *importSuite) TestImportNoFile(c *qt.C) {
+	s.fixture.CheckError(c, 2, `import file not specified`, "import", "-a", "admin.agent")
+}
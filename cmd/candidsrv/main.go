@@ -4,12 +4,18 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"html/template"
+	"io"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/handlers"
@@ -20,17 +26,29 @@ import (
 	"gopkg.in/natefinch/lumberjack.v2"
 
 	"github.com/CanonicalLtd/candid"
+	"github.com/CanonicalLtd/candid/attrcrypt"
 	"github.com/CanonicalLtd/candid/config"
 	"github.com/CanonicalLtd/candid/idp"
 	_ "github.com/CanonicalLtd/candid/idp/agent"
 	_ "github.com/CanonicalLtd/candid/idp/azure"
+	_ "github.com/CanonicalLtd/candid/idp/cloudinstance"
 	_ "github.com/CanonicalLtd/candid/idp/google"
 	_ "github.com/CanonicalLtd/candid/idp/keystone"
+	_ "github.com/CanonicalLtd/candid/idp/kubernetes"
 	_ "github.com/CanonicalLtd/candid/idp/ldap"
+	_ "github.com/CanonicalLtd/candid/idp/plugin"
 	_ "github.com/CanonicalLtd/candid/idp/static"
 	"github.com/CanonicalLtd/candid/idp/usso"
 	_ "github.com/CanonicalLtd/candid/idp/usso/ussodischarge"
 	_ "github.com/CanonicalLtd/candid/idp/usso/ussooauth"
+	_ "github.com/CanonicalLtd/candid/idp/x509"
+	"github.com/CanonicalLtd/candid/internal/accesslog"
+	"github.com/CanonicalLtd/candid/internal/clientip"
+	"github.com/CanonicalLtd/candid/internal/listener"
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/internal/systemd"
+	"github.com/CanonicalLtd/candid/store"
+	_ "github.com/CanonicalLtd/candid/store/dynamodb"
 	_ "github.com/CanonicalLtd/candid/store/memstore"
 	_ "github.com/CanonicalLtd/candid/store/mgostore"
 	_ "github.com/CanonicalLtd/candid/store/sqlstore"
@@ -38,6 +56,22 @@ import (
 
 var logger = loggo.GetLogger("candidsrv")
 
+// defaultShutdownTimeout is the time allowed for logins in progress to
+// complete when the server is shut down, if none is configured.
+const defaultShutdownTimeout = 30 * time.Second
+
+var (
+	migrateOnly    = flag.Bool("migrate-only", false, "apply storage schema migrations and exit without starting the server")
+	migrateVersion = flag.Int("migrate-version", -1, "with -migrate-only, migrate the storage schema to the given version rather than the latest")
+	checkOnly      = flag.Bool("check-config", false, "strictly validate the configuration, check that the storage and identity providers can be reached, and exit without starting the server")
+	reencryptOnly  = flag.Bool("reencrypt-extra-info", false, "re-encrypt the sensitive extra-info of every identity with the current key and exit without starting the server")
+)
+
+// defaultCheckTimeout is the time allowed for each check made by
+// -check-config, if no health check timeout is configured. It matches
+// the default timeout of the readiness checks.
+const defaultCheckTimeout = 5 * time.Second
+
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "usage: %s [options] <config path>\n", filepath.Base(os.Args[0]))
@@ -49,7 +83,14 @@ func main() {
 		flag.Usage()
 	}
 	confPath := flag.Arg(0)
-	conf, err := config.Read(confPath)
+	var conf *config.Config
+	var warnings []string
+	var err error
+	if *checkOnly {
+		conf, err = config.ReadStrict(confPath)
+	} else {
+		conf, warnings, err = config.ReadWithWarnings(confPath)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "STOP cannot read configuration: %v\n", err)
 		exit(2)
@@ -58,14 +99,64 @@ func main() {
 		fmt.Fprintf(os.Stderr, "STOP cannot configure loggers: %v", err)
 		exit(2)
 	}
+	if *checkOnly {
+		if err := checkConfig(conf); err != nil {
+			fmt.Fprintf(os.Stderr, "STOP %v\n", err)
+			exit(1)
+		}
+		fmt.Fprintln(os.Stderr, "STOP configuration ok")
+		exit(0)
+	}
+	if err := setUpLogging(conf); err != nil {
+		fmt.Fprintf(os.Stderr, "STOP cannot configure logging: %v\n", err)
+		exit(2)
+	}
+	for _, w := range warnings {
+		logger.Warningf("ignoring unrecognised configuration in %s: %s", confPath, w)
+	}
+	if *migrateOnly {
+		if err := migrate(conf, *migrateVersion); err != nil {
+			fmt.Fprintf(os.Stderr, "STOP %v\n", err)
+			exit(1)
+		}
+		fmt.Fprintln(os.Stderr, "STOP migrations complete")
+		exit(0)
+	}
+	if *reencryptOnly {
+		if err := reencrypt(conf); err != nil {
+			fmt.Fprintf(os.Stderr, "STOP %v\n", err)
+			exit(1)
+		}
+		fmt.Fprintln(os.Stderr, "STOP re-encryption complete")
+		exit(0)
+	}
 	if err := serve(conf); err != nil {
 		fmt.Fprintf(os.Stderr, "STOP %v\n", err)
 		exit(1)
 	}
-	fmt.Fprintln(os.Stderr, "STOP no error, weirdly")
+	fmt.Fprintln(os.Stderr, "STOP shut down")
 	exit(0)
 }
 
+// setUpLogging configures where, and in what format, log messages are
+// written.
+func setUpLogging(conf *config.Config) error {
+	if conf.LogFormat == "" && conf.LogFile == "" {
+		// Keep the default loggo writer.
+		return nil
+	}
+	var w io.Writer = os.Stderr
+	if conf.LogFile != "" {
+		w = &lumberjack.Logger{
+			Filename:   conf.LogFile,
+			MaxSize:    500, // megabytes
+			MaxBackups: 3,
+			MaxAge:     28, //days
+		}
+	}
+	return errgo.Mask(logging.SetDefaultWriter(conf.LogFormat, w))
+}
+
 // exit calls os.Exit, first sleeping for a bit to work
 // around an outrageous systemd bug which causes
 // final output lines to be lost if we exit immediately.
@@ -77,6 +168,128 @@ func exit(code int) {
 	os.Exit(code)
 }
 
+// migrate brings the storage schema to the given version, or the
+// latest version if version is negative. Storage backends without a
+// versioned schema are initialised by creating a backend.
+func migrate(conf *config.Config, version int) error {
+	if m, ok := conf.Storage.BackendFactory.(store.Migrator); ok {
+		logger.Infof("migrating storage schema")
+		if err := m.Migrate(version); err != nil {
+			return errgo.Notef(err, "cannot migrate storage")
+		}
+		return nil
+	}
+	if version >= 0 {
+		return errgo.Newf("storage backend does not support schema versions")
+	}
+	backend, err := conf.Storage.NewBackend()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	backend.Close()
+	return nil
+}
+
+// reencrypt re-encrypts the sensitive extra-info items of every
+// identity in the store configured in conf.
+func reencrypt(conf *config.Config) error {
+	p, err := extraInfoEncryption(conf)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	backend, err := conf.Storage.NewBackend()
+	if err != nil {
+		return errgo.Notef(err, "cannot connect to storage")
+	}
+	defer backend.Close()
+	st := backend.Store()
+	ctx, close := st.Context(context.Background())
+	defer close()
+	n, err := p.Reencrypt(ctx, st)
+	logger.Infof("re-encrypted extra-info of %d identities", n)
+	return errgo.Mask(err)
+}
+
+// extraInfoEncryption returns the extra-info encryption parameters
+// configured in conf. If no extra-info keys are configured the
+// envelope encryption of the configured KMS is used.
+func extraInfoEncryption(conf *config.Config) (attrcrypt.Params, error) {
+	p, err := conf.ExtraInfoEncryption.Params()
+	if err != nil {
+		return attrcrypt.Params{}, errgo.Mask(err)
+	}
+	if p.Encrypter == nil && conf.KMS != nil {
+		kms, err := conf.KMS.NewKMS()
+		if err != nil {
+			return attrcrypt.Params{}, errgo.Notef(err, "cannot create kms")
+		}
+		p.Encrypter = attrcrypt.NewEnvelope(kms)
+	}
+	return p, nil
+}
+
+// checkConfig checks that the storage and the identity providers
+// configured in conf can be reached, without starting the server. Every
+// identity provider is checked, even when an earlier one fails.
+func checkConfig(conf *config.Config) error {
+	if conf.HTTPProxy != "" {
+		os.Setenv("HTTP_PROXY", conf.HTTPProxy)
+	}
+	if conf.NoProxy != "" {
+		os.Setenv("NO_PROXY", conf.NoProxy)
+	}
+	timeout := conf.HealthCheckTimeout.Duration
+	if timeout == 0 {
+		timeout = defaultCheckTimeout
+	}
+	backend, err := conf.Storage.NewBackend()
+	if err != nil {
+		return errgo.Notef(err, "cannot connect to storage")
+	}
+	defer backend.Close()
+	if err := checkStore(backend.Store(), timeout); err != nil {
+		return errgo.Notef(err, "cannot query storage")
+	}
+	logger.Infof("storage ok")
+
+	var failed []string
+	for _, ic := range conf.IdentityProviders {
+		hc, ok := ic.IdentityProvider.(idp.HealthChecker)
+		if !ok {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := hc.CheckHealth(ctx)
+		cancel()
+		if err != nil {
+			logger.Errorf("identity provider %q: %v", ic.Name(), err)
+			failed = append(failed, ic.Name())
+			continue
+		}
+		logger.Infof("identity provider %q ok", ic.Name())
+	}
+	if len(failed) > 0 {
+		return errgo.Newf("cannot reach identity providers %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// checkStore checks that the given store can be queried by looking up
+// an identity that never exists.
+func checkStore(st store.Store, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ctx, close := st.Context(ctx)
+	defer close()
+	err := st.Identity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("candid-check", "check"),
+	})
+	if err != nil && errgo.Cause(err) != store.ErrNotFound {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
 // serve starts the identity service.
 func serve(conf *config.Config) error {
 	if conf.HTTPProxy != "" {
@@ -90,11 +303,26 @@ func serve(conf *config.Config) error {
 		return errgo.Mask(err)
 	}
 	defer backend.Close()
+	rootKeyStore := backend.BakeryRootKeyStore()
+	if conf.VaultRootKeys != nil {
+		policy, _ := conf.KeyRotation.RootKeyPolicy()
+		rootKeyStore = conf.VaultRootKeys.NewRootKeyStore(policy)
+	} else if policy, ok := conf.KeyRotation.RootKeyPolicy(); ok {
+		pb, ok := backend.(store.RootKeyPolicyBackend)
+		if !ok {
+			return errgo.Newf("storage backend does not support root key rotation")
+		}
+		rootKeyStore = pb.BakeryRootKeyStoreWithPolicy(policy)
+	}
+	providerDataStore := backend.ProviderDataStore()
+	if conf.EtcdProviderData != nil {
+		providerDataStore = conf.EtcdProviderData.NewProviderDataStore()
+	}
 	return serveIdentity(conf, candid.ServerParams{
 		Store:                   backend.Store(),
-		ProviderDataStore:       backend.ProviderDataStore(),
+		ProviderDataStore:       providerDataStore,
 		MeetingStore:            backend.MeetingStore(),
-		RootKeyStore:            backend.BakeryRootKeyStore(),
+		RootKeyStore:            rootKeyStore,
 		DebugStatusCheckerFuncs: backend.DebugStatusCheckerFuncs(),
 		ACLStore:                backend.ACLStore(),
 	})
@@ -112,10 +340,21 @@ func serveIdentity(conf *config.Config, params candid.ServerParams) error {
 	params.StaticFileSystem = http.Dir(filepath.Join(conf.ResourcePath, "static"))
 
 	var err error
-	params.Template, err = template.New("").ParseGlob(filepath.Join(conf.ResourcePath, "templates", "*"))
+	params.Template, err = template.New("").Funcs(idp.TemplateFuncs(nil)).ParseGlob(filepath.Join(conf.ResourcePath, "templates", "*"))
 	if err != nil {
 		return errgo.Notef(err, "cannot parse templates")
 	}
+	params.IDPBranding = make(map[string]idp.Branding)
+	for _, ip := range params.IdentityProviders {
+		b, err := idp.LoadBranding(filepath.Join(conf.ResourcePath, "idp", ip.Name()))
+		if os.IsNotExist(errgo.Cause(err)) {
+			continue
+		}
+		if err != nil {
+			return errgo.Notef(err, "cannot load branding for identity provider %q", ip.Name())
+		}
+		params.IDPBranding[ip.Name()] = b
+	}
 
 	params.AdminPassword = conf.AdminPassword
 	params.Key = &bakery.KeyPair{
@@ -123,22 +362,165 @@ func serveIdentity(conf *config.Config, params candid.ServerParams) error {
 		Public:  *conf.PublicKey,
 	}
 	params.RendezvousTimeout = conf.RendezvousTimeout.Duration
+	params.RendezvousExpiry = conf.RendezvousExpiry.Duration
+	params.RendezvousGCInterval = conf.RendezvousGCInterval.Duration
+	params.IdentityCache = candid.IdentityCacheParams{
+		Size: conf.IdentityCache.Size,
+		TTL:  conf.IdentityCache.TTL.Duration,
+	}
+	params.ResponseCacheTTL = conf.ResponseCacheTTL.Duration
+	params.CORS = candid.CORSParams{
+		AllowedOrigins:   conf.CORS.AllowedOrigins,
+		AllowedHeaders:   conf.CORS.AllowedHeaders,
+		ExposedHeaders:   conf.CORS.ExposedHeaders,
+		AllowCredentials: conf.CORS.AllowCredentials,
+		MaxAge:           conf.CORS.MaxAge.Duration,
+	}
+	params.SecurityHeaders = conf.SecurityHeaders.Params()
+	params.WaitLimit = conf.WaitLimit.Params()
+	params.DisableLegacyInteraction = conf.DisableLegacyInteraction
+	params.RememberBrowser = conf.RememberBrowser.Params()
+	params.Notifier, err = conf.Notify.Notifier()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	params.GeoIPDatabase = conf.GeoIPDatabase
+	params.TrustedProxies = conf.TrustedProxies
+	params.Attributes = conf.IdentityAttributes()
+	params.HealthCheckTimeout = conf.HealthCheckTimeout.Duration
+	params.DebugEndpoints = conf.DebugEndpoints
 	params.Location = conf.Location
 	params.PrivateAddr = conf.PrivateAddr
 	params.AdminAgentPublicKey = conf.AdminAgentPublicKey
 	params.RedirectLoginWhitelist = conf.RedirectLoginWhitelist
+	params.RedirectLoginPatterns = conf.RedirectLoginPatterns
 	params.APIMacaroonTimeout = conf.APIMacaroonTimeout.Duration
 	params.DischargeMacaroonTimeout = conf.DischargeMacaroonTimeout.Duration
 	params.DischargeTokenTimeout = conf.DischargeTokenTimeout.Duration
+	params.RequestDurationBuckets = conf.Metrics.RequestDurationBuckets
+	params.MeetingCompletedBuckets = conf.Metrics.MeetingCompletedBuckets
+	params.MetricExemplars = conf.Metrics.Exemplars
+	params.Canary = candid.CanaryParams{
+		Interval:      conf.Canary.Interval.Duration,
+		AgentUsername: conf.Canary.AgentUsername,
+		AgentKey:      conf.Canary.AgentKey,
+		LoginIDP:      conf.Canary.LoginIDP,
+		LoginUsername: conf.Canary.LoginUsername,
+		LoginPassword: conf.Canary.LoginPassword,
+	}
+	if len(conf.DeclaredAttributes) > 0 {
+		params.DeclaredAttributes = make(map[bakery.PublicKey][]string)
+		for _, da := range conf.DeclaredAttributes {
+			params.DeclaredAttributes[*da.PublicKey] = append(params.DeclaredAttributes[*da.PublicKey], da.Attributes...)
+		}
+	}
+	params.Consent = candid.ConsentParams{
+		Required: conf.Consent.Required,
+		Text:     conf.Consent.Text,
+	}
+	if len(conf.Consent.Services) > 0 {
+		params.Consent.Services = make(map[bakery.PublicKey]candid.ConsentService)
+		for _, svc := range conf.Consent.Services {
+			params.Consent.Services[*svc.PublicKey] = candid.ConsentService{
+				Name: svc.Name,
+				Text: svc.Text,
+			}
+		}
+	}
+	params.CookieDomains = conf.CookieDomains
+	params.CookieSameSite = conf.SameSite()
+	params.CookieSecure = conf.CookieSecure
+	params.EmailDomainIDPs = conf.EmailDomainIDPs
+	params.EditableProfileFields = conf.EditableProfileFields
+	params.RequestIDHeader = conf.RequestIDHeader
+	params.KeyRotation = candid.KeyRotationParams{
+		Enabled:  conf.KeyRotation.Enabled,
+		Interval: conf.KeyRotation.Interval.Duration,
+		Overlap:  conf.KeyRotation.Overlap.Duration,
+	}
+	params.JWT = candid.JWTParams{
+		Audiences: conf.JWT.Audiences,
+		Lifetime:  conf.JWT.Lifetime.Duration,
+		Claims:    conf.JWT.Claims,
+	}
+	params.MeetingDiscovery = candid.MeetingDiscoveryParams{
+		Enabled:           conf.MeetingDiscovery.Enabled,
+		AdvertiseAddr:     conf.MeetingDiscovery.AdvertiseAddr,
+		HeartbeatInterval: conf.MeetingDiscovery.HeartbeatInterval.Duration,
+	}
+	params.MeetingPoll = candid.MeetingPollParams{
+		Enabled:  conf.MeetingPoll.Enabled,
+		Interval: conf.MeetingPoll.Interval.Duration,
+	}
+	params.MeetingRPC.ServerTLSConfig, params.MeetingRPC.ClientTLSConfig, err = conf.MeetingRPC.TLSConfigs()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if conf.MeetingRPC.Secret != "" {
+		params.MeetingRPC.Secret = []byte(conf.MeetingRPC.Secret)
+	}
+	params.DischargeThrottle = candid.ThrottleParams{
+		MaxConcurrent: conf.DischargeThrottle.MaxConcurrent,
+		MaxQueue:      conf.DischargeThrottle.MaxQueue,
+		MaxWait:       conf.DischargeThrottle.MaxWait.Duration,
+	}
+	if len(conf.DischargeThrottle.Weights) > 0 {
+		params.DischargeThrottle.Weights = make(map[string]int)
+		for _, w := range conf.DischargeThrottle.Weights {
+			params.DischargeThrottle.Weights[w.PublicKey.String()] = w.Weight
+		}
+	}
+	params.LoginChallenge = candid.LoginChallengeParams{
+		Type:           conf.LoginChallenge.Type,
+		SiteKey:        conf.LoginChallenge.SiteKey,
+		SecretKey:      conf.LoginChallenge.SecretKey,
+		Difficulty:     conf.LoginChallenge.Difficulty,
+		MaxFailures:    conf.LoginChallenge.MaxFailures,
+		FailureWindow:  conf.LoginChallenge.FailureWindow.Duration,
+		TrustedProxies: conf.TrustedProxies,
+	}
+	params.LoginLockout = candid.LoginLockoutParams{
+		MaxFailures: conf.LoginLockout.MaxFailures,
+		Duration:    conf.LoginLockout.Duration.Duration,
+	}
+	var envelope attrcrypt.Encrypter
+	if conf.KMS != nil {
+		kms, err := conf.KMS.NewKMS()
+		if err != nil {
+			return errgo.Notef(err, "cannot create kms")
+		}
+		envelope = attrcrypt.NewEnvelope(kms)
+	}
+	params.ExtraInfoEncryption, err = conf.ExtraInfoEncryption.Params()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if params.ExtraInfoEncryption.Encrypter == nil {
+		params.ExtraInfoEncryption.Encrypter = envelope
+	}
+	if conf.EncryptProviderData {
+		params.ProviderDataEncrypter = envelope
+	}
+	defaultParams := params
+	if len(conf.Tenants) > 0 {
+		defaultParams = candid.DefaultTenantParams(params)
+	}
 	srv, err := candid.NewServer(
-		params,
+		defaultParams,
 		candid.V1,
+		candid.V2,
 		candid.Debug,
 		candid.Discharger,
 	)
 	if err != nil {
 		return errgo.Notef(err, "cannot create new server at %q", conf.ListenAddress)
 	}
+	if len(conf.Tenants) > 0 {
+		srv, err = newTenantServer(conf, params, srv)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
 	defer srv.Close()
 
 	// Cast the Server to an http.Handler so that it can be
@@ -146,27 +528,246 @@ func serveIdentity(conf *config.Config, params candid.ServerParams) error {
 	var server http.Handler = srv
 
 	if conf.AccessLog != "" {
-		accesslog := &lumberjack.Logger{
+		w := &lumberjack.Logger{
 			Filename:   conf.AccessLog,
 			MaxSize:    500, // megabytes
 			MaxBackups: 3,
 			MaxAge:     28, //days
 		}
-		server = handlers.CombinedLoggingHandler(accesslog, server)
+		if conf.AccessLogFormat == "json" {
+			p, err := conf.AccessLogParams()
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			server = accesslog.NewHandler(w, server, p)
+		} else {
+			server = handlers.CombinedLoggingHandler(w, server)
+		}
 	}
 
 	logger.Infof("starting the identity server")
 
-	httpServer := &http.Server{
+	httpServers := []*http.Server{{
 		Addr:      conf.ListenAddress,
-		Handler:   server,
+		Handler:   listener.Except(server, conf.ListenerPaths(), conf.TenantPathPrefixes()),
 		TLSConfig: conf.TLSConfig(),
+	}}
+	for _, lc := range conf.Listeners {
+		tlsConfig, err := lc.TLSConfig()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		httpServers = append(httpServers, &http.Server{
+			Addr:      lc.Address,
+			Handler:   listener.Authenticate(listener.Only(server, lc.Paths, conf.TenantPathPrefixes()), lc.AuthParams()),
+			TLSConfig: tlsConfig,
+		})
+	}
+	ls, err := listen(conf)
+	if err != nil {
+		return errgo.Mask(err)
 	}
 	fmt.Println("START")
-	if conf.TLSConfig() != nil {
-		return httpServer.ListenAndServeTLS("", "")
+	errc := make(chan error, len(httpServers)+1)
+	for i, httpServer := range httpServers {
+		httpServer, l := httpServer, ls[i]
+		go func() {
+			if httpServer.TLSConfig != nil {
+				errc <- httpServer.ServeTLS(l, "", "")
+				return
+			}
+			errc <- httpServer.Serve(l)
+		}()
+	}
+	if conf.ACME != nil && conf.ACME.HTTPAddress != "" {
+		acmeServer := &http.Server{
+			Addr:    conf.ACME.HTTPAddress,
+			Handler: conf.ACME.Manager().HTTPHandler(nil),
+		}
+		defer acmeServer.Close()
+		logger.Infof("serving ACME HTTP challenges on %s", conf.ACME.HTTPAddress)
+		go func() {
+			errc <- errgo.Notef(acmeServer.ListenAndServe(), "cannot serve ACME HTTP challenges")
+		}()
+	}
+	if _, err := systemd.Notify(systemd.Ready); err != nil {
+		logger.Warningf("cannot notify systemd: %s", err)
+	}
+	stopWatchdog := make(chan struct{})
+	defer close(stopWatchdog)
+	go systemd.RunWatchdog(stopWatchdog)
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigc)
+	select {
+	case err := <-errc:
+		return errgo.Mask(err)
+	case sig := <-sigc:
+		logger.Infof("received %s, shutting down", sig)
+	}
+	systemd.Notify(systemd.Stopping)
+	return shutdown(conf, srv, httpServers)
+}
+
+// newTenantServer returns a handler that serves each of the configured
+// tenants with its own server, and all other requests with srv. The
+// tenant servers are created from params, which hold the parameters of
+// srv. If there is an error srv is closed.
+func newTenantServer(conf *config.Config, params candid.ServerParams, srv candid.HandlerCloser) (candid.HandlerCloser, error) {
+	var tenants []candid.Tenant
+	closeAll := func() {
+		srv.Close()
+		for _, t := range tenants {
+			t.Handler.Close()
+		}
+	}
+	for _, tc := range conf.Tenants {
+		logger.Infof("setting up tenant %q", tc.Name)
+		tp := candid.TenantParams(params, tc.Name)
+		tp.IdentityProviders = make([]idp.IdentityProvider, len(tc.IdentityProviders))
+		tp.IDPBranding = make(map[string]idp.Branding)
+		for i, ic := range tc.IdentityProviders {
+			ip := ic.IdentityProvider
+			tp.IdentityProviders[i] = ip
+			b, err := idp.LoadBranding(filepath.Join(conf.ResourcePath, "idp", ip.Name()))
+			if os.IsNotExist(errgo.Cause(err)) {
+				continue
+			}
+			if err != nil {
+				closeAll()
+				return nil, errgo.Notef(err, "cannot load branding for identity provider %q", ip.Name())
+			}
+			tp.IDPBranding[ip.Name()] = b
+		}
+		tp.Location = tc.Location
+		tp.Key = &bakery.KeyPair{
+			Private: *tc.PrivateKey,
+			Public:  *tc.PublicKey,
+		}
+		tp.AdminPassword = tc.AdminPassword
+		tp.AdminAgentPublicKey = tc.AdminAgentPublicKey
+		// The canary and the email domains refer to the identity
+		// providers of the default tenant.
+		tp.Canary = candid.CanaryParams{}
+		tp.EmailDomainIDPs = nil
+		h, err := candid.NewServer(
+			tp,
+			candid.V1,
+			candid.V2,
+			candid.Debug,
+			candid.Discharger,
+		)
+		if err != nil {
+			closeAll()
+			return nil, errgo.Notef(err, "cannot create server for tenant %q", tc.Name)
+		}
+		tenants = append(tenants, candid.Tenant{
+			Name:       tc.Name,
+			Hostnames:  tc.Hostnames,
+			PathPrefix: tc.PathPrefix,
+			Handler:    h,
+		})
+	}
+	return candid.NewTenantHandler(srv, tenants), nil
+}
+
+// listen returns the listeners that the identity server should serve
+// on: first the listener for the public API, followed by each of the
+// additional configured listeners in order. If candidsrv has been
+// started by systemd socket activation the sockets passed by systemd
+// are used, matched to the listeners by name. A single socket passed by
+// systemd is always used for the public API when there are no
+// additional listeners. New listeners are created on the configured
+// addresses of listeners without a socket.
+func listen(conf *config.Config) (_ []net.Listener, err error) {
+	sockets, err := systemd.Listeners()
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot use systemd sockets")
+	}
+	named := make(map[string]net.Listener)
+	if len(sockets) == 1 && len(conf.Listeners) == 0 {
+		named[listener.APIName] = sockets[0].Listener
+	} else {
+		for _, s := range sockets {
+			if named[s.Name] != nil {
+				s.Close()
+				continue
+			}
+			named[s.Name] = s.Listener
+		}
+	}
+	var ls []net.Listener
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, l := range ls {
+			l.Close()
+		}
+		for _, l := range named {
+			l.Close()
+		}
+	}()
+	names := []string{listener.APIName}
+	addrs := []string{conf.ListenAddress}
+	for _, lc := range conf.Listeners {
+		names = append(names, lc.Name)
+		addrs = append(addrs, lc.Address)
+	}
+	for i, name := range names {
+		l := named[name]
+		delete(named, name)
+		if l != nil {
+			logger.Infof("using socket %s passed by systemd for %s listener", l.Addr(), name)
+		} else if l, err = net.Listen("tcp", addrs[i]); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		l, err = proxyListener(conf, l)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		ls = append(ls, l)
+	}
+	for name := range named {
+		return nil, errgo.Newf("systemd passed socket %q that does not match any listener", name)
+	}
+	return ls, nil
+}
+
+// proxyListener wraps l to read PROXY protocol headers sent by trusted
+// proxies, if that is configured.
+func proxyListener(conf *config.Config, l net.Listener) (net.Listener, error) {
+	if !conf.ProxyProtocol {
+		return l, nil
+	}
+	r, err := clientip.New(conf.TrustedProxies)
+	if err != nil {
+		l.Close()
+		return nil, errgo.Mask(err)
+	}
+	return r.ProxyListener(l), nil
+}
+
+// shutdown gracefully shuts down the identity server. Logins already in
+// progress are given until the shutdown timeout to complete before the
+// HTTP servers are stopped.
+func shutdown(conf *config.Config, srv candid.HandlerCloser, httpServers []*http.Server) error {
+	timeout := conf.ShutdownTimeout.Duration
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warningf("logins abandoned during shutdown: %s", err)
+	}
+	for _, httpServer := range httpServers {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			return errgo.Notef(err, "cannot shut down HTTP server")
+		}
 	}
-	return httpServer.ListenAndServe()
+	logger.Infof("identity server shut down")
+	return nil
 }
 
 var defaultIDPs = []idp.IdentityProvider{
@@ -4,15 +4,17 @@
 package internal
 
 import (
-	"log"
+	"context"
 	"strings"
 
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
-	mgo "gopkg.in/mgo.v2"
 
 	"github.com/CanonicalLtd/candid/cmd/migrate-db/internal/mongodoc"
 	"github.com/CanonicalLtd/candid/internal/auth"
+	"github.com/CanonicalLtd/candid/internal/logging"
 	"github.com/CanonicalLtd/candid/store"
 )
 
@@ -22,29 +24,43 @@ const (
 	legacySSHKeyGetterGroup = "sshkeygetter@idm"
 )
 
-// A LegacySource is a Source from a legacy mgo store.
+// A LegacySource is a Source from a legacy mongodb store.
 type LegacySource struct {
-	db       *mgo.Database
+	ctx      context.Context
+	db       *mongo.Database
 	identity *store.Identity
-	iter     *mgo.Iter
+	cursor   *mongo.Cursor
 	err      error
 }
 
 // NewLegacySource creates a LegacySource from the given database.
-func NewLegacySource(db *mgo.Database) *LegacySource {
+func NewLegacySource(ctx context.Context, db *mongo.Database) *LegacySource {
 	return &LegacySource{
-		db: db,
+		ctx: ctx,
+		db:  db,
 	}
 }
 
 // Next implements Source.Next.
 func (s *LegacySource) Next() bool {
-	if s.iter == nil {
-		s.iter = s.db.C("identities").Find(nil).Iter()
+	if s.err != nil {
+		return false
+	}
+	if s.cursor == nil {
+		s.cursor, s.err = s.db.Collection("identities").Find(s.ctx, bson.D{})
+		if s.err != nil {
+			return false
+		}
 	}
 	for {
+		if !s.cursor.Next(s.ctx) {
+			s.cursor.Close(s.ctx)
+			return false
+		}
 		var doc mongodoc.Identity
-		if !s.iter.Next(&doc) {
+		if err := s.cursor.Decode(&doc); err != nil {
+			s.err = err
+			s.cursor.Close(s.ctx)
 			return false
 		}
 		var err error
@@ -53,7 +69,7 @@ func (s *LegacySource) Next() bool {
 		}
 		s.identity, err = convert(&doc)
 		if err != nil {
-			log.Printf("cannot convert identity (skipping): %s", err)
+			logging.New(logger).With(logging.UserField, doc.Username).Warningf("cannot convert identity (skipping): %s", err)
 			continue
 		}
 		return true
@@ -132,5 +148,11 @@ func (s *LegacySource) Identity() *store.Identity {
 
 // Err implements Source.Err.
 func (s *LegacySource) Err() error {
-	return errgo.Mask(s.iter.Err())
+	if s.err != nil {
+		return errgo.Mask(s.err)
+	}
+	if s.cursor == nil {
+		return nil
+	}
+	return errgo.Mask(s.cursor.Err())
 }
@@ -9,14 +9,14 @@ import (
 	"time"
 
 	qt "github.com/frankban/quicktest"
-	"github.com/juju/mgotest"
+	"go.mongodb.org/mongo-driver/mongo"
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
-	mgo "gopkg.in/mgo.v2"
 
 	"github.com/CanonicalLtd/candid/cmd/migrate-db/internal"
 	"github.com/CanonicalLtd/candid/cmd/migrate-db/internal/mongodoc"
 	"github.com/CanonicalLtd/candid/internal/auth"
+	"github.com/CanonicalLtd/candid/internal/mongotest"
 	"github.com/CanonicalLtd/candid/store"
 	"github.com/CanonicalLtd/candid/store/memstore"
 )
@@ -26,15 +26,12 @@ func TestLegacySource(t *testing.T) {
 	defer c.Done()
 
 	ctx := context.Background()
-	db, err := mgotest.New()
-	if errgo.Cause(err) == mgotest.ErrDisabled {
-		c.Skip("mmgotest disabled")
+	db, err := mongotest.New()
+	if errgo.Cause(err) == mongotest.ErrDisabled {
+		c.Skip("mongotest disabled")
 	}
 	c.Assert(err, qt.Equals, nil)
 	defer db.Close()
-	// mgotest sets the SocketTimout to 1s. Restore it back to the
-	// default value.
-	db.Session.SetSocketTimeout(time.Minute)
 
 	t1 := time.Now().Add(-1 * time.Minute).Round(time.Millisecond)
 	t2 := t1.Add(-1 * time.Minute).Round(time.Millisecond)
@@ -75,7 +72,7 @@ func TestLegacySource(t *testing.T) {
 	})
 
 	st := memstore.NewStore()
-	err = internal.Copy(ctx, st, internal.NewLegacySource(db.Database))
+	err = internal.Copy(ctx, st, internal.NewLegacySource(ctx, db.Database), 0)
 	c.Assert(err, qt.Equals, nil)
 	identity1 := store.Identity{
 		Username: "test1",
@@ -137,7 +134,7 @@ func TestLegacySource(t *testing.T) {
 	})
 }
 
-func insert(c *qt.C, db *mgo.Database, identity *mongodoc.Identity) {
-	err := db.C("identities").Insert(identity)
+func insert(c *qt.C, db *mongo.Database, identity *mongodoc.Identity) {
+	_, err := db.Collection("identities").InsertOne(context.Background(), identity)
 	c.Assert(err, qt.Equals, nil)
 }
@@ -5,14 +5,17 @@ package internal
 
 import (
 	"context"
-	"log"
 	"strings"
 
+	"github.com/juju/loggo"
 	errgo "gopkg.in/errgo.v1"
 
+	"github.com/CanonicalLtd/candid/internal/logging"
 	"github.com/CanonicalLtd/candid/store"
 )
 
+var logger = loggo.GetLogger("candid.migrate-db")
+
 // SplitStoreSpecification splits a store specification string as
 // supplied in the command line arguments into a type and address.
 func SplitStoreSpecification(s string) (type_, addr string) {
@@ -40,8 +43,17 @@ type Source interface {
 	Err() error
 }
 
-// Copy creates a new identity in dst for every identity retreived from src.
-func Copy(ctx context.Context, dst store.Store, src Source) error {
+// DefaultBatchSize holds the number of identities that Copy writes to
+// the destination store at once if no batch size is specified.
+const DefaultBatchSize = 1000
+
+// Copy creates a new identity in dst for every identity retreived from
+// src. Identities are written to dst in batches of batchSize; if
+// batchSize is not positive DefaultBatchSize is used.
+func Copy(ctx context.Context, dst store.Store, src Source, batchSize int) error {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
 	var failed bool
 	update := store.Update{
 		store.Username:      store.Set,
@@ -55,8 +67,17 @@ func Copy(ctx context.Context, dst store.Store, src Source) error {
 		store.ExtraInfo:     store.Set,
 		store.Owner:         store.Set,
 	}
+	batch := make([]*store.Identity, 0, batchSize)
+	flush := func() {
+		if !writeBatch(ctx, dst, batch, update) {
+			failed = true
+		}
+		batch = batch[:0]
+	}
 	for src.Next() {
-		identity := src.Identity()
+		// The identity returned by the source is only valid until
+		// the next call to Next, so take a copy.
+		identity := *src.Identity()
 		// The ID field is store specific, so cannot be copied between them.
 		identity.ID = ""
 		destIdentity := store.Identity{
@@ -64,7 +85,7 @@ func Copy(ctx context.Context, dst store.Store, src Source) error {
 		}
 		if err := dst.Identity(ctx, &destIdentity); err != nil {
 			if errgo.Cause(err) != store.ErrNotFound {
-				log.Printf("error checking destination store: %s", err)
+				logging.New(logger).With(logging.UserField, identity.Username).Errorf("error checking destination store: %s", err)
 				failed = true
 				continue
 			}
@@ -73,13 +94,15 @@ func Copy(ctx context.Context, dst store.Store, src Source) error {
 		// stored in the destination. This is to make migrations
 		// on running systems safer.
 		if destIdentity.Username == "" || identity.LastLogin.After(destIdentity.LastLogin) {
-			err := dst.UpdateIdentity(ctx, identity, update)
-			if err != nil {
-				log.Printf("cannot update user %s: %s", identity.Username, err)
-				failed = true
+			batch = append(batch, &identity)
+			if len(batch) == batchSize {
+				flush()
 			}
 		}
 	}
+	if len(batch) > 0 {
+		flush()
+	}
 	if failed {
 		return errgo.Newf("some updates failed")
 	}
@@ -89,6 +112,26 @@ func Copy(ctx context.Context, dst store.Store, src Source) error {
 	return nil
 }
 
+// writeBatch writes the given identities to dst. If the batch cannot be
+// written as a whole then each identity is written individually so
+// that the failing identities can be reported. writeBatch returns
+// false if any identity could not be written.
+func writeBatch(ctx context.Context, dst store.Store, identities []*store.Identity, update store.Update) bool {
+	err := dst.UpdateIdentities(ctx, identities, update)
+	if err == nil {
+		return true
+	}
+	logger.Infof("cannot update batch of %d users, retrying individually: %s", len(identities), err)
+	ok := true
+	for _, identity := range identities {
+		if err := dst.UpdateIdentity(ctx, identity, update); err != nil {
+			logging.New(logger).With(logging.UserField, identity.Username).Errorf("cannot update user: %s", err)
+			ok = false
+		}
+	}
+	return ok
+}
+
 // A StoreSource is a Source that wraps a store.Store.
 type StoreSource struct {
 	index      int
@@ -119,7 +119,11 @@ func (s errorStore) Identity(_ context.Context, _ *store.Identity) error {
 	return s.err
 }
 
-func (s errorStore) FindIdentities(_ context.Context, _ *store.Identity, _ store.Filter, _ []store.Sort, _, _ int) ([]store.Identity, error) {
+func (s errorStore) FindIdentities(_ context.Context, _ *store.Identity, _ store.Filter, _ []store.Sort, _, _ int, _ ...store.Condition) ([]store.Identity, error) {
+	return nil, s.err
+}
+
+func (s errorStore) SearchIdentities(_ context.Context, _ string, _, _ int) ([]store.Identity, error) {
 	return nil, s.err
 }
 
@@ -127,6 +131,10 @@ func (s errorStore) UpdateIdentity(_ context.Context, _ *store.Identity, _ store
 	return s.err
 }
 
+func (s errorStore) UpdateIdentities(_ context.Context, _ []*store.Identity, _ store.Update) error {
+	return s.err
+}
+
 func (s errorStore) IdentityCounts(_ context.Context) (map[string]int, error) {
 	return nil, s.err
 }
@@ -177,7 +185,7 @@ func TestCopy(t *testing.T) {
 	c.Assert(err, qt.Equals, nil)
 
 	store2 := memstore.NewStore()
-	err = internal.Copy(ctx, store2, internal.NewStoreSource(ctx, store1))
+	err = internal.Copy(ctx, store2, internal.NewStoreSource(ctx, store1), 0)
 	c.Assert(err, qt.Equals, nil)
 
 	copiedIdentity1 := store.Identity{
@@ -223,7 +231,7 @@ func TestCopySrcError(t *testing.T) {
 	ctx := context.Background()
 
 	store2 := memstore.NewStore()
-	err := internal.Copy(ctx, store2, internal.NewStoreSource(ctx, store1))
+	err := internal.Copy(ctx, store2, internal.NewStoreSource(ctx, store1), 0)
 	c.Assert(err, qt.ErrorMatches, "cannot read identities: test error")
 }
 
@@ -264,6 +272,49 @@ func TestCopyDstError(t *testing.T) {
 	c.Assert(err, qt.Equals, nil)
 
 	store2 := errorStore{errgo.New("test error")}
-	err = internal.Copy(ctx, store2, internal.NewStoreSource(ctx, store1))
+	err = internal.Copy(ctx, store2, internal.NewStoreSource(ctx, store1), 0)
 	c.Assert(err, qt.ErrorMatches, "some updates failed")
 }
+
+func TestCopyBatchFailure(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	ctx := context.Background()
+	store1 := memstore.NewStore()
+	for _, name := range []string{"1", "2", "3"} {
+		err := store1.UpdateIdentity(ctx, &store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", name),
+			Username:   "test" + name,
+		}, store.Update{
+			store.Username: store.Set,
+		})
+		c.Assert(err, qt.Equals, nil)
+	}
+
+	store2 := memstore.NewStore()
+	err := store2.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("other", "2"),
+		Username:   "test2",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	err = internal.Copy(ctx, store2, internal.NewStoreSource(ctx, store1), 2)
+	c.Assert(err, qt.ErrorMatches, "some updates failed")
+
+	for _, name := range []string{"1", "3"} {
+		identity := store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", name),
+		}
+		err = store2.Identity(ctx, &identity)
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(identity.Username, qt.Equals, "test"+name)
+	}
+	identity := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "2"),
+	}
+	err = store2.Identity(ctx, &identity)
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+}
@@ -8,14 +8,17 @@ import (
 	"database/sql"
 	"flag"
 	"fmt"
-	"log"
 	"os"
 
+	"github.com/juju/loggo"
 	_ "github.com/lib/pq"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
 	errgo "gopkg.in/errgo.v1"
-	mgo "gopkg.in/mgo.v2"
 
 	"github.com/CanonicalLtd/candid/cmd/migrate-db/internal"
+	"github.com/CanonicalLtd/candid/internal/logging"
 	"github.com/CanonicalLtd/candid/store"
 	"github.com/CanonicalLtd/candid/store/mgostore"
 	"github.com/CanonicalLtd/candid/store/sqlstore"
@@ -24,13 +27,28 @@ import (
 var (
 	from = flag.String("from", "legacy:mongodb://localhost/identity", "store `specification` to copy the identities from.")
 	to   = flag.String("to", "mgo:mongodb://localhost/idm", "store `specification` to copy the identities to.")
+
+	batchSize = flag.Int("batch-size", internal.DefaultBatchSize, "`number` of identities to write to the destination store at once.")
+
+	loggingConfig = flag.String("logging-config", "<root>=INFO", "loggo `configuration` to use.")
+	logFormat     = flag.String("log-format", "text", "`format` of log messages, either text or json.")
 )
 
+var logger = loggo.GetLogger("candid.migrate-db")
+
 func main() {
 	flag.Usage = usage
 	flag.Parse()
+	if err := loggo.ConfigureLoggers(*loggingConfig); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot configure loggers: %v\n", err)
+		os.Exit(2)
+	}
+	if err := logging.SetDefaultWriter(*logFormat, os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot configure logging: %v\n", err)
+		os.Exit(2)
+	}
 	if err := migrate(context.Background()); err != nil {
-		log.Println(err)
+		logger.Errorf("%s", err)
 		os.Exit(1)
 	}
 }
@@ -43,16 +61,17 @@ specified by a string containing the store type, a colon, and connection
 information specific to the store type. For the -from store the valid
 prefixes are:
 
-	"legacy" - old style mgo based store
-	"mgo" - new style mgo based store 
+	"legacy" - old style mongodb based store
+	"mgo" - new style mongodb based store
 	"postgres" - postgres based store
 
 The -to store only supports "mgo" and "postgres".
 
-For "legacy" and "mgo" type stores the connection string is a mgo URL
-(see https://godoc.org/gopkg.in/mgo.v2#Dial). For "postgres" type
-stores the connection string is as documented in
-https://godoc.org/github.com/lib/pq.
+For "legacy" and "mgo" type stores the connection string is a mongodb://
+or mongodb+srv:// URI (see https://docs.mongodb.com/manual/reference/connection-string/).
+The database used is the one named in the URI, or "test" if there is
+none. For "postgres" type stores the connection string is as documented
+in https://godoc.org/github.com/lib/pq.
 
 `)
 	flag.PrintDefaults()
@@ -63,19 +82,19 @@ func migrate(ctx context.Context) error {
 	type_, addr := internal.SplitStoreSpecification(*from)
 	switch type_ {
 	case "legacy":
-		s, err := mgo.Dial(addr)
+		db, err := dialMongo(ctx, addr)
 		if err != nil {
-			return errgo.Notef(err, "cannot connnect to mongodb server")
+			return errgo.Mask(err)
 		}
-		defer s.Close()
-		source = internal.NewLegacySource(s.DB(""))
+		defer db.Client().Disconnect(ctx)
+		source = internal.NewLegacySource(ctx, db)
 	case "mgo":
-		s, err := mgo.Dial(addr)
+		db, err := dialMongo(ctx, addr)
 		if err != nil {
-			return errgo.Notef(err, "cannot connnect to mongodb server")
+			return errgo.Mask(err)
 		}
-		defer s.Close()
-		backend, err := mgostore.NewBackend(s.DB(""))
+		defer db.Client().Disconnect(ctx)
+		backend, err := mgostore.NewBackend(db)
 		if err != nil {
 			return errgo.Notef(err, "cannot initialize mgo store")
 		}
@@ -101,12 +120,12 @@ func migrate(ctx context.Context) error {
 	type_, addr = internal.SplitStoreSpecification(*to)
 	switch type_ {
 	case "mgo":
-		s, err := mgo.Dial(addr)
+		db, err := dialMongo(ctx, addr)
 		if err != nil {
-			return errgo.Notef(err, "cannot connnect to mongodb server")
+			return errgo.Mask(err)
 		}
-		defer s.Close()
-		backend, err := mgostore.NewBackend(s.DB(""))
+		defer db.Client().Disconnect(ctx)
+		backend, err := mgostore.NewBackend(db)
 		if err != nil {
 			return errgo.Notef(err, "cannot initialize mgo store")
 		}
@@ -131,5 +150,23 @@ func migrate(ctx context.Context) error {
 	ctx, close := store.Context(ctx)
 	defer close()
 
-	return errgo.Mask(internal.Copy(ctx, store, source))
+	return errgo.Mask(internal.Copy(ctx, store, source, *batchSize))
+}
+
+// dialMongo connects to the mongodb server at the given URI and returns
+// the database named in the URI.
+func dialMongo(ctx context.Context, uri string) (*mongo.Database, error) {
+	cs, err := connstring.Parse(uri)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid mongodb URI")
+	}
+	dbName := cs.Database
+	if dbName == "" {
+		dbName = "test"
+	}
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot connnect to mongodb server")
+	}
+	return client.Database(dbName), nil
 }
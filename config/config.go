@@ -5,19 +5,41 @@
 package config
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/juju/loggo"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 	"gopkg.in/yaml.v2"
 
+	"github.com/CanonicalLtd/candid/attrcrypt"
 	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/internal/accesslog"
+	"github.com/CanonicalLtd/candid/internal/attrschema"
+	"github.com/CanonicalLtd/candid/internal/clientip"
+	"github.com/CanonicalLtd/candid/internal/cors"
+	"github.com/CanonicalLtd/candid/internal/listener"
+	"github.com/CanonicalLtd/candid/internal/remember"
+	"github.com/CanonicalLtd/candid/internal/returnto"
+	"github.com/CanonicalLtd/candid/internal/secheaders"
+	"github.com/CanonicalLtd/candid/internal/waitlimit"
+	"github.com/CanonicalLtd/candid/notify"
 	"github.com/CanonicalLtd/candid/store"
+	"github.com/CanonicalLtd/candid/store/etcd"
+	"github.com/CanonicalLtd/candid/store/vault"
 )
 
 var logger = loggo.GetLogger("candid.config")
@@ -34,6 +56,18 @@ type Config struct {
 	// LoggingConfig holds the loggo configuration to use.
 	LoggingConfig string `yaml:"logging-config"`
 
+	// LogFormat holds the format of log messages, either "text" (the
+	// default) or "json".
+	LogFormat string `yaml:"log-format"`
+
+	// LogFile holds the name of a file to write log messages to. If
+	// this is empty, log messages are written to stderr.
+	LogFile string `yaml:"log-file"`
+
+	// RequestIDHeader holds the name of the HTTP header that carries
+	// request IDs. If this is empty, "X-Request-Id" is used.
+	RequestIDHeader string `yaml:"request-id-header"`
+
 	// ListenAddress holds the address to listen on for HTTP connections to the Candid API
 	// formatted as hostname:port.
 	ListenAddress string `yaml:"listen-address"`
@@ -45,21 +79,99 @@ type Config struct {
 	// AccessLog holds the name of a file to use to write logs of API accesses.
 	AccessLog string `yaml:"access-log"`
 
+	// AccessLogFormat holds the format of the access log, either
+	// "combined" (the default) for the Apache combined log format, or
+	// "json" for JSON lines that include the route, latency and user
+	// of each request, with credentials redacted.
+	AccessLogFormat string `yaml:"access-log-format"`
+
+	// AccessLogRoutes configures how groups of routes are written to
+	// a JSON access log.
+	AccessLogRoutes []AccessLogRouteConfig `yaml:"access-log-routes"`
+
 	// RendezvousTimeout holds length of time that an interactive authentication
 	// request can be active before it is forgotten.
 	RendezvousTimeout DurationString `yaml:"rendezvous-timeout"`
 
+	// RendezvousExpiry holds the length of time after which an
+	// interactive authentication request that has not completed is
+	// removed.
+	RendezvousExpiry DurationString `yaml:"rendezvous-expiry"`
+
+	// RendezvousGCInterval holds the interval at which expired
+	// interactive authentication requests are removed.
+	RendezvousGCInterval DurationString `yaml:"rendezvous-gc-interval"`
+
+	// WaitLimit holds the limits on requests that wait for
+	// interactive authentication requests to complete.
+	WaitLimit WaitLimitConfig `yaml:"wait-limit"`
+
+	// DisableLegacyInteraction holds whether clients are prevented
+	// from using the legacy visit-wait interaction protocol.
+	DisableLegacyInteraction bool `yaml:"disable-legacy-interaction"`
+
+	// RememberBrowser holds the configuration of the persistent
+	// sessions of browsers that users ask to be remembered.
+	RememberBrowser RememberBrowserConfig `yaml:"remember-browser"`
+
+	// HealthCheckTimeout holds the maximum time that each readiness
+	// check run by the /readyz endpoint may take.
+	HealthCheckTimeout DurationString `yaml:"health-check-timeout"`
+
+	// DebugEndpoints enables the runtime debug endpoints under
+	// /debug, which may be used by users in the debug ACL.
+	DebugEndpoints bool `yaml:"debug-endpoints"`
+
+	// ShutdownTimeout holds the maximum time that the server waits
+	// for logins in progress to complete when it is shut down.
+	ShutdownTimeout DurationString `yaml:"shutdown-timeout"`
+
 	// PrivateAddr holds the hostname where this instance of the Candid server
 	// can be contacted. This is used by instances of the Candid server
-	// to communicate directly with one another.
+	// to communicate directly with one another. It may be omitted if
+	// MeetingDiscovery or MeetingPoll is enabled.
 	PrivateAddr string `yaml:"private-addr"`
 
+	// MeetingDiscovery holds the configuration of the discovery of
+	// other instances of the Candid server through the store.
+	MeetingDiscovery MeetingDiscoveryConfig `yaml:"meeting-discovery"`
+
+	// MeetingPoll holds the configuration of the completion of
+	// interactive logins through the store rather than by instances
+	// of the Candid server contacting one another.
+	MeetingPoll MeetingPollConfig `yaml:"meeting-poll"`
+
+	// MeetingRPC holds the configuration of the security of the
+	// requests that instances of the Candid server make to one
+	// another to complete interactive logins.
+	MeetingRPC MeetingRPCConfig `yaml:"meeting-rpc"`
+
+	// IdentityCache holds the configuration of the cache of
+	// identities fetched from the store.
+	IdentityCache IdentityCacheConfig `yaml:"identity-cache"`
+
+	// ResponseCacheTTL holds the length of time for which responses
+	// to requests for a user and their groups are cached.
+	ResponseCacheTTL DurationString `yaml:"response-cache-ttl"`
+
 	// TLSCert and TLSKey hold a TLS server certificate for the HTTP
 	// server to use. If these are specified, Candid will serve its API
 	// over HTTPS using them.
 	TLSCert string `yaml:"tls-cert"`
 	TLSKey  string `yaml:"tls-key"`
 
+	// Listeners holds additional listeners that serve some of the
+	// paths of the server, such as the admin and metrics endpoints,
+	// separately from the public API. Paths served by an additional
+	// listener are not served on ListenAddress.
+	Listeners []ListenerConfig `yaml:"listeners"`
+
+	// ACME configures Candid to serve its API over HTTPS using
+	// certificates obtained automatically from an ACME certificate
+	// authority, such as Let's Encrypt. It may not be used with
+	// TLSCert and TLSKey.
+	ACME *ACMEConfig `yaml:"acme"`
+
 	// PublicKey and PrivateKey holds the key pair used by the Candid
 	// server for encryption and decryption of third party caveats.
 	// These must be specified.
@@ -97,6 +209,33 @@ type Config struct {
 	// login.
 	RedirectLoginWhitelist []string `yaml:"redirect-login-whitelist"`
 
+	// RedirectLoginPatterns contains patterns that match further
+	// URLs that are trusted to be used as return_to URLs, such as
+	// "https://*.example.com/callback".
+	RedirectLoginPatterns []string `yaml:"redirect-login-patterns"`
+
+	// CookieDomains holds the domains that cookies may be scoped to
+	// when Candid is reached by more than one host name.
+	CookieDomains []string `yaml:"cookie-domains"`
+
+	// CookieSameSite holds the SameSite attribute of the cookies
+	// set during login, one of "lax", "strict" or "none". If it is
+	// empty the attribute is not set.
+	CookieSameSite string `yaml:"cookie-same-site"`
+
+	// CookieSecure holds whether the cookies set during login are
+	// only sent over HTTPS.
+	CookieSecure bool `yaml:"cookie-secure"`
+
+	// EmailDomainIDPs maps email domains to the names of the
+	// identity providers used by users with email addresses in
+	// those domains.
+	EmailDomainIDPs map[string]string `yaml:"email-domain-idps"`
+
+	// EditableProfileFields holds the fields of their own identity
+	// that users may change on their profile page.
+	EditableProfileFields []string `yaml:"editable-profile-fields"`
+
 	// APIMacaroonTimeout is the maximum age an API macaroon can get
 	// before requiring re-authorization.
 	APIMacaroonTimeout DurationString `yaml:"api-macaroon-timeout"`
@@ -108,35 +247,325 @@ type Config struct {
 	// DischargeTokenTimeout is the maximum age a discharge token can
 	// get before it becomes invalid.
 	DischargeTokenTimeout DurationString `yaml:"discharge-token-timeout"`
+
+	// Metrics holds the configuration of the prometheus metrics
+	// recorded by the server.
+	Metrics MetricsConfig `yaml:"metrics"`
+
+	// Canary holds the configuration of the synthetic login
+	// monitor.
+	Canary CanaryConfig `yaml:"canary"`
+
+	// DeclaredAttributes holds the identity attributes that are
+	// declared in discharge macaroons issued to particular relying
+	// services.
+	DeclaredAttributes []DeclaredAttributesConfig `yaml:"declared-attributes"`
+
+	// Attributes holds the definitions of the custom identity
+	// attributes, which may also be declared in discharge
+	// macaroons.
+	Attributes []AttributeConfig `yaml:"attributes"`
+
+	// Consent holds the configuration of the consent users must
+	// give before the first discharge for a relying service.
+	Consent ConsentConfig `yaml:"consent"`
+
+	// ExtraInfoEncryption holds the configuration of the extra-info
+	// items that are encrypted at rest.
+	ExtraInfoEncryption ExtraInfoEncryptionConfig `yaml:"extra-info-encryption"`
+
+	// KMS holds the configuration of the key management service
+	// used for envelope encryption of sensitive data.
+	KMS *KMSConfig `yaml:"kms"`
+
+	// EncryptProviderData holds whether data stored by identity
+	// providers is encrypted using the configured KMS.
+	EncryptProviderData bool `yaml:"encrypt-provider-data"`
+
+	// DischargeThrottle holds the configuration of the limit on
+	// concurrent discharge requests.
+	DischargeThrottle DischargeThrottleConfig `yaml:"discharge-throttle"`
+
+	// LoginChallenge holds the configuration of the challenge that
+	// users of login forms must complete after repeated failed
+	// logins.
+	LoginChallenge LoginChallengeConfig `yaml:"login-challenge"`
+
+	// TrustedProxies holds the addresses, in CIDR notation, of
+	// reverse proxies whose X-Forwarded-For headers are trusted
+	// when determining the address of a client.
+	TrustedProxies []string `yaml:"trusted-proxies"`
+
+	// ProxyProtocol allows connections from trusted proxies to start
+	// with a PROXY protocol header holding the address of the
+	// client.
+	ProxyProtocol bool `yaml:"proxy-protocol"`
+
+	// LoginLockout holds the configuration of the lockout of
+	// usernames after repeated failed password logins.
+	LoginLockout LoginLockoutConfig `yaml:"login-lockout"`
+
+	// KeyRotation holds the configuration of the rotation of the
+	// bakery key pair and macaroon root keys.
+	KeyRotation KeyRotationConfig `yaml:"key-rotation"`
+
+	// VaultRootKeys holds the configuration of a HashiCorp Vault
+	// server used to store macaroon root keys instead of the
+	// identity database.
+	VaultRootKeys *VaultRootKeysConfig `yaml:"vault-root-keys"`
+
+	// EtcdProviderData holds the configuration of an etcd cluster
+	// used to store the data of identity providers instead of the
+	// storage backend.
+	EtcdProviderData *EtcdProviderDataConfig `yaml:"etcd-provider-data"`
+
+	// JWT holds the configuration of the JSON Web Tokens issued in
+	// exchange for Candid macaroons.
+	JWT JWTConfig `yaml:"jwt"`
+
+	// CORS holds the cross-origin resource sharing policy of the
+	// server.
+	CORS CORSConfig `yaml:"cors"`
+
+	// SecurityHeaders holds the security headers of the HTML pages
+	// served by the server.
+	SecurityHeaders SecurityHeadersConfig `yaml:"security-headers"`
+
+	// Notify holds the configuration of the notifications, such as
+	// email verification and password reset messages, sent by the
+	// server.
+	Notify NotifyConfig `yaml:"notify"`
+
+	// GeoIPDatabase holds the path of a MaxMind GeoIP2 or GeoLite2
+	// database used to find the country of clients.
+	GeoIPDatabase string `yaml:"geoip-database"`
+
+	// Tenants holds the configuration of the organisations that are
+	// served by the server in addition to the default one. Each
+	// tenant has its own identities, identity providers and
+	// administrators.
+	Tenants []TenantConfig `yaml:"tenants"`
 }
 
-// TLSConfig returns a TLS configuration to be used for serving
-// the API. If the TLS certficate and key are not specified, it returns nil.
-func (c *Config) TLSConfig() *tls.Config {
-	if c.TLSCert == "" || c.TLSKey == "" {
-		return nil
+// CORSConfig holds the cross-origin resource sharing policy of the
+// server.
+type CORSConfig struct {
+	// AllowedOrigins holds the origins from which browsers may make
+	// cross-origin requests. If it is empty, requests are allowed
+	// from any origin without credentials.
+	AllowedOrigins []string `yaml:"allowed-origins"`
+
+	// AllowedHeaders holds additional request headers that may be
+	// sent in cross-origin requests.
+	AllowedHeaders []string `yaml:"allowed-headers"`
+
+	// ExposedHeaders holds the response headers that are made
+	// available to cross-origin applications.
+	ExposedHeaders []string `yaml:"exposed-headers"`
+
+	// AllowCredentials holds whether browsers send cookies with
+	// requests from the allowed origins.
+	AllowCredentials bool `yaml:"allow-credentials"`
+
+	// MaxAge holds the length of time for which browsers may cache
+	// the response to a preflight request.
+	MaxAge DurationString `yaml:"max-age"`
+}
+
+func (c *CORSConfig) validate() error {
+	for _, o := range c.AllowedOrigins {
+		if err := cors.ParseOrigin(o); err != nil {
+			return errgo.Notef(err, "invalid cors config")
+		}
+	}
+	if c.MaxAge.Duration < 0 {
+		return errgo.Newf("negative cors max-age")
 	}
+	if len(c.AllowedOrigins) == 0 && (c.AllowCredentials || len(c.ExposedHeaders) > 0) {
+		return errgo.Newf("cors allowed-origins not specified")
+	}
+	return nil
+}
 
-	cert, err := tls.X509KeyPair([]byte(c.TLSCert), []byte(c.TLSKey))
-	if err != nil {
-		logger.Errorf("cannot create certificate: %s", err)
-		return nil
+// SecurityHeadersConfig holds the security headers of the HTML pages
+// served by the server.
+type SecurityHeadersConfig struct {
+	// ContentSecurityPolicy holds the Content-Security-Policy header.
+	// Any occurrence of "{nonce}" is replaced with a nonce that is
+	// different for every page.
+	ContentSecurityPolicy string `yaml:"content-security-policy"`
+
+	// HSTSMaxAge holds the max-age of the Strict-Transport-Security
+	// header. If it is zero the header is not sent.
+	HSTSMaxAge DurationString `yaml:"hsts-max-age"`
+
+	// HSTSIncludeSubdomains holds whether the
+	// Strict-Transport-Security header applies to subdomains.
+	HSTSIncludeSubdomains bool `yaml:"hsts-include-subdomains"`
+
+	// FrameOptions holds the X-Frame-Options header, either DENY or
+	// SAMEORIGIN.
+	FrameOptions string `yaml:"frame-options"`
+
+	// ReferrerPolicy holds the Referrer-Policy header.
+	ReferrerPolicy string `yaml:"referrer-policy"`
+}
+
+// Params returns the security headers as secheaders.Params.
+func (c *SecurityHeadersConfig) Params() secheaders.Params {
+	return secheaders.Params{
+		ContentSecurityPolicy: c.ContentSecurityPolicy,
+		HSTSMaxAge:            c.HSTSMaxAge.Duration,
+		HSTSIncludeSubdomains: c.HSTSIncludeSubdomains,
+		FrameOptions:          c.FrameOptions,
+		ReferrerPolicy:        c.ReferrerPolicy,
 	}
-	return &tls.Config{
-		Certificates: []tls.Certificate{
-			cert,
-		},
+}
+
+func (c *SecurityHeadersConfig) validate() error {
+	if _, err := secheaders.New(c.Params()); err != nil {
+		return errgo.Notef(err, "invalid security-headers config")
 	}
+	return nil
 }
 
-func (c *Config) validate() error {
+// NotifyConfig holds the configuration of the notifications sent by
+// the server. Notifications are sent by SMTP, to a webhook, or both.
+type NotifyConfig struct {
+	// SMTP holds the configuration of the SMTP server used to send
+	// notifications as email.
+	SMTP *SMTPConfig `yaml:"smtp"`
+
+	// Webhook holds the configuration of the webhook that
+	// notifications are posted to.
+	Webhook *WebhookConfig `yaml:"webhook"`
+
+	// AdminAddresses holds the email addresses that administrator
+	// notifications are sent to.
+	AdminAddresses []string `yaml:"admin-addresses"`
+
+	// Templates holds a pattern matching files holding templates
+	// that override the default notification templates.
+	Templates string `yaml:"templates"`
+}
+
+// SMTPConfig holds the configuration of an SMTP server.
+type SMTPConfig struct {
+	// Address holds the host:port address of the server.
+	Address string `yaml:"address"`
+
+	// From holds the address that email is sent from.
+	From string `yaml:"from"`
+
+	// Username and Password hold the credentials used to
+	// authenticate to the server, if any.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// WebhookConfig holds the configuration of a webhook.
+type WebhookConfig struct {
+	// URL holds the URL that notifications are posted to.
+	URL string `yaml:"url"`
+
+	// Secret holds the key used to sign the requests.
+	Secret string `yaml:"secret"`
+}
+
+// Notifier returns the notifier described by the configuration. If no
+// SMTP server or webhook is configured it returns nil.
+func (c *NotifyConfig) Notifier() (*notify.Notifier, error) {
+	var senders []notify.Sender
+	if c.SMTP != nil {
+		s, err := notify.NewSMTPSender(notify.SMTPParams{
+			Address:  c.SMTP.Address,
+			From:     c.SMTP.From,
+			Username: c.SMTP.Username,
+			Password: c.SMTP.Password,
+		})
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid notify config")
+		}
+		senders = append(senders, s)
+	}
+	if c.Webhook != nil {
+		s, err := notify.NewWebhookSender(notify.WebhookParams{
+			URL:    c.Webhook.URL,
+			Secret: c.Webhook.Secret,
+		})
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid notify config")
+		}
+		senders = append(senders, s)
+	}
+	p := notify.Params{
+		Senders:        senders,
+		AdminAddresses: c.AdminAddresses,
+	}
+	if c.Templates != "" {
+		t, err := notify.ParseTemplates(c.Templates)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid notify config")
+		}
+		p.Templates = t
+	}
+	return notify.New(p), nil
+}
+
+func (c *NotifyConfig) validate() error {
+	if c.SMTP == nil && c.Webhook == nil && (len(c.AdminAddresses) > 0 || c.Templates != "") {
+		return errgo.Newf("notify smtp or webhook not specified")
+	}
+	_, err := c.Notifier()
+	return errgo.Mask(err)
+}
+
+// TenantConfig holds the configuration of a tenant.
+type TenantConfig struct {
+	// Name holds the name of the tenant. This is used to keep the
+	// data of the tenant separate in the store, so it should not be
+	// changed.
+	Name string `yaml:"name"`
+
+	// Hostnames holds the host names that requests for the tenant
+	// are sent to.
+	Hostnames []string `yaml:"hostnames"`
+
+	// PathPrefix holds the path prefix of requests for the tenant
+	// that are sent to a host name that does not select a tenant.
+	PathPrefix string `yaml:"path-prefix"`
+
+	// Location holds the external address of the tenant, which
+	// should include PathPrefix if that is used.
+	Location string `yaml:"location"`
+
+	// IdentityProviders holds the identity providers of the tenant.
+	IdentityProviders []idp.Config `yaml:"identity-providers"`
+
+	// PublicKey and PrivateKey hold the key pair used by the tenant
+	// for encryption and decryption of third party caveats. This
+	// must be different from the key pair of the server.
+	PublicKey  *bakery.PublicKey  `yaml:"public-key"`
+	PrivateKey *bakery.PrivateKey `yaml:"private-key"`
+
+	// AdminAgentPublicKey and AdminPassword hold the credentials of
+	// the admin user of the tenant.
+	AdminAgentPublicKey *bakery.PublicKey `yaml:"admin-agent-public-key"`
+	AdminPassword       string            `yaml:"admin-password"`
+}
+
+var validTenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+func (c *TenantConfig) validate() error {
+	if !validTenantName.MatchString(c.Name) {
+		return errgo.Newf("invalid tenant name %q", c.Name)
+	}
 	var missing []string
-	if c.Storage == nil {
-		// TODO default to in-memory storage?
-		missing = append(missing, "storage")
+	if c.Location == "" {
+		missing = append(missing, "location")
 	}
-	if c.ListenAddress == "" {
-		missing = append(missing, "listen-address")
+	if len(c.IdentityProviders) == 0 {
+		missing = append(missing, "identity-providers")
 	}
 	if c.PrivateKey == nil {
 		missing = append(missing, "private-key")
@@ -144,33 +573,1537 @@ func (c *Config) validate() error {
 	if c.PublicKey == nil {
 		missing = append(missing, "public-key")
 	}
-	if c.Location == "" {
-		// TODO check it's a valid URL
-		missing = append(missing, "location")
+	if len(c.Hostnames) == 0 && c.PathPrefix == "" {
+		missing = append(missing, "hostnames")
 	}
-	if c.PrivateAddr == "" {
-		missing = append(missing, "private-addr")
+	if len(missing) > 0 {
+		return errgo.Newf("missing fields %s in tenant %q config", strings.Join(missing, ", "), c.Name)
 	}
-	if len(missing) != 0 {
-		return errgo.Newf("missing fields %s in config file", strings.Join(missing, ", "))
+	if c.PathPrefix != "" && (!strings.HasPrefix(c.PathPrefix, "/") || strings.HasSuffix(c.PathPrefix, "/")) {
+		return errgo.Newf("invalid path-prefix %q in tenant %q config", c.PathPrefix, c.Name)
 	}
 	return nil
 }
 
-// Read reads an identity configuration file from the given path.
-func Read(path string) (*Config, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, errgo.Notef(err, "cannot open config file")
+// validateTenants checks that the tenants can be told apart from one
+// another and from the default tenant.
+func (c *Config) validateTenants() error {
+	names := make(map[string]bool)
+	hosts := make(map[string]bool)
+	prefixes := make(map[string]bool)
+	for i := range c.Tenants {
+		t := &c.Tenants[i]
+		if err := t.validate(); err != nil {
+			return errgo.Mask(err)
+		}
+		if names[t.Name] {
+			return errgo.Newf("duplicate tenant %q", t.Name)
+		}
+		names[t.Name] = true
+		for _, h := range t.Hostnames {
+			h = strings.ToLower(h)
+			if hosts[h] {
+				return errgo.Newf("hostname %q used by more than one tenant", h)
+			}
+			hosts[h] = true
+		}
+		if t.PathPrefix != "" {
+			if prefixes[t.PathPrefix] {
+				return errgo.Newf("path-prefix %q used by more than one tenant", t.PathPrefix)
+			}
+			prefixes[t.PathPrefix] = true
+		}
+		if c.PublicKey != nil && *t.PublicKey == *c.PublicKey {
+			return errgo.Newf("tenant %q uses the public key of the server", t.Name)
+		}
 	}
-	defer f.Close()
-	data, err := ioutil.ReadAll(f)
+	return nil
+}
+
+// EtcdProviderDataConfig holds the configuration of the etcd identity
+// provider data store.
+type EtcdProviderDataConfig struct {
+	// Endpoints holds the URLs of the etcd servers.
+	Endpoints []string `yaml:"endpoints"`
+
+	// Prefix holds the prefix of the keys written to etcd.
+	Prefix string `yaml:"prefix"`
+
+	// Username and Password hold the credentials used to
+	// authenticate to etcd. If Password is empty the ETCD_PASSWORD
+	// environment variable is used.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// CACert holds the PEM encoded certificates of the certificate
+	// authorities that issue the etcd server certificates. If it is
+	// empty the system roots are used.
+	CACert string `yaml:"ca-cert"`
+}
+
+func (c *EtcdProviderDataConfig) validate() error {
+	if len(c.Endpoints) == 0 {
+		return errgo.Newf("missing fields endpoints in etcd-provider-data config")
+	}
+	if c.CACert != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(c.CACert)) {
+		return errgo.Newf("invalid etcd-provider-data ca-cert")
+	}
+	return nil
+}
+
+// NewProviderDataStore creates the configured etcd identity provider
+// data store.
+func (c *EtcdProviderDataConfig) NewProviderDataStore() *etcd.ProviderDataStore {
+	password := c.Password
+	if password == "" {
+		password = os.Getenv("ETCD_PASSWORD")
+	}
+	var client *http.Client
+	if c.CACert != "" {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM([]byte(c.CACert))
+		client = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+	return etcd.NewProviderDataStore(etcd.Params{
+		Endpoints: c.Endpoints,
+		Prefix:    c.Prefix,
+		Username:  c.Username,
+		Password:  password,
+		Client:    client,
+	})
+}
+
+// KMSConfig holds the configuration of a key management service.
+type KMSConfig struct {
+	// Type holds the type of the KMS, one of "local", "vault" or
+	// "aws-kms".
+	Type string `yaml:"type"`
+
+	// KeyFile holds the path of the key file used by the local KMS.
+	// Each line of the file holds a key ID and a base64 encoded 32
+	// byte key separated by white space. The first key is used to
+	// wrap new data keys.
+	KeyFile string `yaml:"key-file"`
+
+	// Address, Token, Mount and KeyName hold the configuration of
+	// the vault KMS.
+	Address string `yaml:"address"`
+	Token   string `yaml:"token"`
+	Mount   string `yaml:"mount"`
+	KeyName string `yaml:"key-name"`
+
+	// Region and KeyID hold the configuration of the aws-kms KMS.
+	// The credentials are read from the standard AWS environment
+	// variables.
+	Region string `yaml:"region"`
+	KeyID  string `yaml:"key-id"`
+}
+
+func (c *KMSConfig) validate() error {
+	var missing []string
+	switch c.Type {
+	case "local":
+		if c.KeyFile == "" {
+			missing = append(missing, "key-file")
+		}
+	case "vault":
+		if c.Address == "" {
+			missing = append(missing, "address")
+		}
+		if c.KeyName == "" {
+			missing = append(missing, "key-name")
+		}
+	case "aws-kms":
+		if c.Region == "" {
+			missing = append(missing, "region")
+		}
+		if c.KeyID == "" {
+			missing = append(missing, "key-id")
+		}
+	default:
+		return errgo.Newf("unknown kms type %q", c.Type)
+	}
+	if len(missing) > 0 {
+		return errgo.Newf("missing fields %s in kms config", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// NewKMS creates the configured KMS.
+func (c *KMSConfig) NewKMS() (attrcrypt.KMS, error) {
+	switch c.Type {
+	case "local":
+		keys, err := readKeyFile(c.KeyFile)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		kr, err := attrcrypt.NewKeyRing(keys...)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid key file %q", c.KeyFile)
+		}
+		return attrcrypt.LocalKMS{KeyRing: kr}, nil
+	case "vault":
+		token := c.Token
+		if token == "" {
+			token = os.Getenv("VAULT_TOKEN")
+		}
+		return &attrcrypt.VaultKMS{
+			Address: c.Address,
+			Token:   token,
+			Mount:   c.Mount,
+			KeyName: c.KeyName,
+		}, nil
+	case "aws-kms":
+		return &attrcrypt.AWSKMS{
+			Region:          c.Region,
+			KeyID:           c.KeyID,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	return nil, errgo.Newf("unknown kms type %q", c.Type)
+}
+
+// VaultRootKeysConfig holds the configuration of the Vault root key
+// store.
+type VaultRootKeysConfig struct {
+	// Address holds the URL of the Vault server.
+	Address string `yaml:"address"`
+
+	// Token holds the token used to authenticate to Vault. If this
+	// is empty the VAULT_TOKEN environment variable is used.
+	Token string `yaml:"token"`
+
+	// Mount holds the path at which the KV version 2 secrets engine
+	// is mounted.
+	Mount string `yaml:"mount"`
+
+	// Path holds the path within the secrets engine under which root
+	// keys are stored.
+	Path string `yaml:"path"`
+}
+
+func (c *VaultRootKeysConfig) validate() error {
+	if c.Address == "" {
+		return errgo.Newf("missing fields address in vault-root-keys config")
+	}
+	return nil
+}
+
+// NewRootKeyStore creates the configured Vault root key store using
+// the given policy.
+func (c *VaultRootKeysConfig) NewRootKeyStore(policy store.RootKeyPolicy) *vault.RootKeyStore {
+	token := c.Token
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	return vault.NewRootKeyStore(vault.Params{
+		Address: c.Address,
+		Token:   token,
+		Mount:   c.Mount,
+		Path:    c.Path,
+		Policy:  policy,
+	})
+}
+
+// sameSiteModes holds the valid values of the cookie-same-site field.
+var sameSiteModes = map[string]http.SameSite{
+	"":       http.SameSiteDefaultMode,
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+// SameSite returns the SameSite attribute of cookies given by the
+// cookie-same-site field.
+func (c *Config) SameSite() http.SameSite {
+	return sameSiteModes[c.CookieSameSite]
+}
+
+// isValidCookieDomain reports whether d may be used as the domain of
+// a cookie. Browsers refuse cookies scoped to a top level domain, so
+// the domain must have at least two labels.
+func isValidCookieDomain(d string) bool {
+	d = strings.TrimPrefix(d, ".")
+	labels := strings.Split(d, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, l := range labels {
+		if l == "" || strings.Trim(l, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// readKeyFile reads the keys held in a local KMS key file.
+func readKeyFile(path string) ([]attrcrypt.Key, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, errgo.Notef(err, "cannot read %q", path)
+		return nil, errgo.Notef(err, "cannot read key file")
 	}
-	var conf Config
-	err = yaml.Unmarshal(data, &conf)
+	var keys []attrcrypt.Key
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, errgo.Newf("invalid line in key file %q", path)
+		}
+		var k attrcrypt.Key
+		kd, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(kd) != len(k.Key) {
+			return nil, errgo.Newf("invalid key %q in key file %q", fields[0], path)
+		}
+		k.ID = fields[0]
+		copy(k.Key[:], kd)
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// ExtraInfoEncryptionConfig holds the configuration of the extra-info
+// items that are encrypted at rest.
+type ExtraInfoEncryptionConfig struct {
+	// Attributes holds the names of the extra-info items to encrypt.
+	Attributes []string `yaml:"attributes"`
+
+	// Keys holds the keys used to encrypt the items. The first key
+	// is used to encrypt new values, the others are only used to
+	// decrypt existing values.
+	Keys []EncryptionKeyConfig `yaml:"keys"`
+}
+
+// EncryptionKeyConfig holds an attribute encryption key.
+type EncryptionKeyConfig struct {
+	// ID holds the identifier of the key.
+	ID string `yaml:"id"`
+
+	// Key holds the base64 encoded 32 byte key.
+	Key string `yaml:"key"`
+}
+
+func (c *ExtraInfoEncryptionConfig) validate() error {
+	if _, err := c.Params(); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// Params returns the attribute encryption parameters for the server.
+// If no keys are specified the returned Encrypter is nil, and the
+// server's envelope encrypter should be used.
+func (c *ExtraInfoEncryptionConfig) Params() (attrcrypt.Params, error) {
+	p := attrcrypt.Params{
+		Attributes: c.Attributes,
+	}
+	if len(c.Keys) == 0 {
+		return p, nil
+	}
+	keys := make([]attrcrypt.Key, len(c.Keys))
+	for i, k := range c.Keys {
+		data, err := base64.StdEncoding.DecodeString(k.Key)
+		if err != nil || len(data) != len(keys[i].Key) {
+			return attrcrypt.Params{}, errgo.Newf("invalid extra-info-encryption key %q", k.ID)
+		}
+		keys[i].ID = k.ID
+		copy(keys[i].Key[:], data)
+	}
+	kr, err := attrcrypt.NewKeyRing(keys...)
 	if err != nil {
+		return attrcrypt.Params{}, errgo.Notef(err, "invalid extra-info-encryption keys")
+	}
+	p.Encrypter = kr
+	return p, nil
+}
+
+// DeclaredAttributesConfig holds the identity attributes that are
+// declared in discharge macaroons issued to a relying service.
+type DeclaredAttributesConfig struct {
+	// PublicKey holds the public key of the relying service.
+	PublicKey *bakery.PublicKey `yaml:"public-key"`
+
+	// Attributes holds the attributes to declare.
+	Attributes []string `yaml:"attributes"`
+}
+
+// validDeclaredAttributes holds the identity attributes that may be
+// declared in discharge macaroons.
+var validDeclaredAttributes = map[string]bool{
+	"username":  true,
+	"email":     true,
+	"groups":    true,
+	"full-name": true,
+}
+
+// validate checks the declared attributes, which may also include the
+// given custom attributes.
+func (c *DeclaredAttributesConfig) validate(custom map[string]bool) error {
+	if c.PublicKey == nil {
+		return errgo.Newf("declared-attributes public-key not specified")
+	}
+	for _, attr := range c.Attributes {
+		if !validDeclaredAttributes[attr] && !custom[attr] {
+			return errgo.Newf("invalid declared attribute %q", attr)
+		}
+	}
+	return nil
+}
+
+// AttributeConfig holds the definition of a custom identity attribute.
+type AttributeConfig struct {
+	// Name holds the name of the attribute, which is also the name
+	// of the extra-info item that holds its value.
+	Name string `yaml:"name"`
+
+	// Type holds the type of the attribute's value: "string"
+	// (the default), "number" or "boolean".
+	Type string `yaml:"type"`
+
+	// Required holds whether relying services that are declared
+	// the attribute refuse users that do not have it.
+	Required bool `yaml:"required"`
+
+	// Pattern holds a regular expression that string values must
+	// match.
+	Pattern string `yaml:"pattern"`
+
+	// Visibility holds who may read the attribute: "public" (the
+	// default) or "private".
+	Visibility string `yaml:"visibility"`
+}
+
+// IdentityAttributes returns the definitions of the custom identity
+// attributes.
+func (c *Config) IdentityAttributes() []attrschema.Attribute {
+	if len(c.Attributes) == 0 {
+		return nil
+	}
+	attrs := make([]attrschema.Attribute, len(c.Attributes))
+	for i, a := range c.Attributes {
+		attrs[i] = attrschema.Attribute{
+			Name:       a.Name,
+			Type:       a.Type,
+			Required:   a.Required,
+			Pattern:    a.Pattern,
+			Visibility: a.Visibility,
+		}
+	}
+	return attrs
+}
+
+// ConsentConfig holds the configuration of the consent users must give
+// before the first discharge for a relying service.
+type ConsentConfig struct {
+	// Required holds whether consent is required for all relying
+	// services, rather than just those listed in Services.
+	Required bool `yaml:"required"`
+
+	// Text holds the text shown to users for services that do not
+	// have their own text.
+	Text string `yaml:"text"`
+
+	// Services holds the consent configuration of individual
+	// relying services.
+	Services []ConsentServiceConfig `yaml:"services"`
+}
+
+// ConsentServiceConfig holds the consent configuration of a relying
+// service.
+type ConsentServiceConfig struct {
+	// PublicKey holds the public key of the relying service.
+	PublicKey *bakery.PublicKey `yaml:"public-key"`
+
+	// Name holds the name of the service shown to users.
+	Name string `yaml:"name"`
+
+	// Text holds the text shown to users when asking for their
+	// consent.
+	Text string `yaml:"text"`
+}
+
+func (c *ConsentConfig) validate() error {
+	for _, svc := range c.Services {
+		if svc.PublicKey == nil {
+			return errgo.Newf("consent service public-key not specified")
+		}
+	}
+	return nil
+}
+
+// MetricsConfig holds the configuration of the prometheus metrics
+// recorded by the server.
+type MetricsConfig struct {
+	// RequestDurationBuckets holds the histogram buckets, in
+	// seconds, used to record the duration of web requests.
+	RequestDurationBuckets []float64 `yaml:"request-duration-buckets"`
+
+	// MeetingCompletedBuckets holds the histogram buckets, in
+	// microseconds, used to record the time taken to complete
+	// interactive login rendezvous.
+	MeetingCompletedBuckets []float64 `yaml:"meeting-completed-buckets"`
+
+	// Exemplars holds whether request IDs are recorded as exemplars
+	// in the request duration histogram.
+	Exemplars bool `yaml:"exemplars"`
+}
+
+func (c *MetricsConfig) validate() error {
+	if err := validateBuckets(c.RequestDurationBuckets); err != nil {
+		return errgo.Notef(err, "invalid request-duration-buckets")
+	}
+	if err := validateBuckets(c.MeetingCompletedBuckets); err != nil {
+		return errgo.Notef(err, "invalid meeting-completed-buckets")
+	}
+	return nil
+}
+
+// validateBuckets checks that the given histogram buckets are in
+// strictly increasing order.
+func validateBuckets(buckets []float64) error {
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return errgo.Newf("buckets not in increasing order")
+		}
+	}
+	return nil
+}
+
+// KeyRotationConfig holds the configuration of key rotation.
+type KeyRotationConfig struct {
+	// Enabled holds whether the bakery key pair is stored in the
+	// database so that it can be rotated.
+	Enabled bool `yaml:"enabled"`
+
+	// Interval holds the age at which the bakery key pair is
+	// automatically rotated. If this is zero the key pair is only
+	// rotated on demand.
+	Interval DurationString `yaml:"interval"`
+
+	// Overlap holds the length of time for which a replaced bakery
+	// key pair continues to be accepted.
+	Overlap DurationString `yaml:"overlap"`
+
+	// RootKeyInterval holds the length of time for which a macaroon
+	// root key is used to mint new macaroons.
+	RootKeyInterval DurationString `yaml:"root-key-interval"`
+
+	// RootKeyExpiry holds the length of time for which a macaroon
+	// root key remains valid.
+	RootKeyExpiry DurationString `yaml:"root-key-expiry"`
+}
+
+func (c *KeyRotationConfig) validate() error {
+	if c.Enabled && c.Overlap.Duration <= 0 {
+		return errgo.Newf("key-rotation overlap not specified")
+	}
+	if !c.Enabled && c.Interval.Duration != 0 {
+		return errgo.Newf("key-rotation interval specified but rotation not enabled")
+	}
+	if c.RootKeyInterval.Duration != 0 && c.RootKeyExpiry.Duration < c.RootKeyInterval.Duration {
+		return errgo.Newf("key-rotation root-key-expiry must not be less than root-key-interval")
+	}
+	return nil
+}
+
+// RootKeyPolicy returns the configured macaroon root key policy. It
+// returns false if no policy has been configured.
+func (c *KeyRotationConfig) RootKeyPolicy() (store.RootKeyPolicy, bool) {
+	if c.RootKeyExpiry.Duration == 0 {
+		return store.RootKeyPolicy{}, false
+	}
+	return store.RootKeyPolicy{
+		GenerateInterval: c.RootKeyInterval.Duration,
+		ExpiryDuration:   c.RootKeyExpiry.Duration,
+	}, true
+}
+
+// MeetingDiscoveryConfig holds the configuration of the discovery of
+// other instances of the Candid server through the store.
+type MeetingDiscoveryConfig struct {
+	// Enabled holds whether instances record that they are alive
+	// in the store, so that the logins in progress on instances
+	// that have stopped can be removed.
+	Enabled bool `yaml:"enabled"`
+
+	// AdvertiseAddr holds the hostname that other instances use to
+	// contact this one. If it is empty, private-addr is used or,
+	// if that is also empty, the address of the first non-loopback
+	// network interface.
+	AdvertiseAddr string `yaml:"advertise-addr"`
+
+	// HeartbeatInterval holds the interval at which instances
+	// record that they are alive.
+	HeartbeatInterval DurationString `yaml:"heartbeat-interval"`
+}
+
+func (c *MeetingDiscoveryConfig) validate() error {
+	if c.HeartbeatInterval.Duration < 0 {
+		return errgo.Newf("negative meeting-discovery heartbeat-interval")
+	}
+	return nil
+}
+
+// MeetingPollConfig holds the configuration of the completion of
+// interactive logins through the store.
+type MeetingPollConfig struct {
+	// Enabled holds whether interactive logins are completed
+	// through the store.
+	Enabled bool `yaml:"enabled"`
+
+	// Interval holds the interval at which instances waiting for
+	// an interactive login to complete check the store.
+	Interval DurationString `yaml:"interval"`
+}
+
+func (c *MeetingPollConfig) validate() error {
+	if c.Interval.Duration < 0 {
+		return errgo.Newf("negative meeting-poll interval")
+	}
+	return nil
+}
+
+// MeetingRPCConfig holds the configuration of the security of the
+// requests that instances of the Candid server make to one another.
+type MeetingRPCConfig struct {
+	// TLSCert and TLSKey hold the PEM encoded certificate and key
+	// used by each instance both to serve requests from other
+	// instances and to authenticate itself to them. If they are not
+	// set, requests are made without TLS.
+	TLSCert string `yaml:"tls-cert"`
+	TLSKey  string `yaml:"tls-key"`
+
+	// CACert holds the PEM encoded certificates of the certificate
+	// authorities that issue instance certificates. If it is set,
+	// instances must present a certificate signed by one of them.
+	// If it is not set, the system roots are used to verify
+	// servers and client certificates are not required.
+	CACert string `yaml:"ca-cert"`
+
+	// ServerName holds the name that instance certificates are
+	// verified against. If it is not set, the host name used to
+	// contact the instance is used.
+	ServerName string `yaml:"server-name"`
+
+	// Secret holds a secret shared by all instances that is used
+	// to authenticate requests between them.
+	Secret string `yaml:"secret"`
+}
+
+func (c *MeetingRPCConfig) validate() error {
+	if c.Secret != "" && len(c.Secret) < 16 {
+		return errgo.Newf("meeting-rpc secret too short")
+	}
+	if _, _, err := c.TLSConfigs(); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// TLSConfigs returns the TLS configurations used to serve and make
+// requests between instances. Both are nil if TLS is not configured.
+func (c *MeetingRPCConfig) TLSConfigs() (server, client *tls.Config, err error) {
+	if c.TLSCert == "" && c.TLSKey == "" {
+		if c.CACert != "" || c.ServerName != "" {
+			return nil, nil, errgo.Newf("meeting-rpc tls-cert and tls-key not specified")
+		}
+		return nil, nil, nil
+	}
+	cert, err := tls.X509KeyPair([]byte(c.TLSCert), []byte(c.TLSKey))
+	if err != nil {
+		return nil, nil, errgo.Notef(err, "invalid meeting-rpc certificate")
+	}
+	server = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	client = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ServerName:   c.ServerName,
+	}
+	if c.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(c.CACert)) {
+			return nil, nil, errgo.Newf("invalid meeting-rpc ca-cert")
+		}
+		server.ClientAuth = tls.RequireAndVerifyClientCert
+		server.ClientCAs = pool
+		client.RootCAs = pool
+	}
+	return server, client, nil
+}
+
+// IdentityCacheConfig holds the configuration of the cache of
+// identities fetched from the store.
+type IdentityCacheConfig struct {
+	// Size holds the maximum number of identities held in the
+	// cache. If it is zero identities are not cached.
+	Size int `yaml:"size"`
+
+	// TTL holds the maximum length of time for which an identity
+	// is cached. If it is zero, identities are cached until they
+	// are changed or evicted to make room for others.
+	TTL DurationString `yaml:"ttl"`
+}
+
+func (c *IdentityCacheConfig) validate() error {
+	if c.Size < 0 {
+		return errgo.Newf("negative identity-cache size")
+	}
+	if c.TTL.Duration < 0 {
+		return errgo.Newf("negative identity-cache ttl")
+	}
+	return nil
+}
+
+// JWTConfig holds the configuration of the JSON Web Tokens issued in
+// exchange for Candid macaroons.
+type JWTConfig struct {
+	// Audiences holds the audiences for which tokens may be issued.
+	// If this is empty, tokens are not issued.
+	Audiences []string `yaml:"audiences"`
+
+	// Lifetime holds the lifetime of issued tokens.
+	Lifetime DurationString `yaml:"lifetime"`
+
+	// Claims holds the identity attributes that are included as
+	// claims in issued tokens.
+	Claims []string `yaml:"claims"`
+}
+
+func (c *JWTConfig) validate() error {
+	if len(c.Audiences) == 0 && (c.Lifetime.Duration != 0 || len(c.Claims) > 0) {
+		return errgo.Newf("jwt audiences not specified")
+	}
+	for _, aud := range c.Audiences {
+		if aud == "" {
+			return errgo.Newf("empty jwt audience")
+		}
+	}
+	if c.Lifetime.Duration < 0 {
+		return errgo.Newf("negative jwt lifetime")
+	}
+	for _, claim := range c.Claims {
+		switch claim {
+		case "name", "email", "groups":
+		default:
+			return errgo.Newf("invalid jwt claim %q", claim)
+		}
+	}
+	return nil
+}
+
+// DischargeThrottleConfig holds the configuration of the limit on
+// concurrent discharge requests.
+type DischargeThrottleConfig struct {
+	// MaxConcurrent holds the maximum number of discharge requests
+	// that are processed concurrently. If this is zero then
+	// discharge requests are not limited.
+	MaxConcurrent int `yaml:"max-concurrent"`
+
+	// MaxQueue holds the maximum number of discharge requests from
+	// each relying service that may wait to be processed.
+	MaxQueue int `yaml:"max-queue"`
+
+	// MaxWait holds the maximum time that a discharge request waits
+	// to be processed.
+	MaxWait DurationString `yaml:"max-wait"`
+
+	// Weights holds the relative share of discharge capacity given
+	// to particular relying services.
+	Weights []DischargeWeightConfig `yaml:"weights"`
+}
+
+// DischargeWeightConfig holds the weight given to a relying service.
+type DischargeWeightConfig struct {
+	// PublicKey holds the public key of the relying service.
+	PublicKey *bakery.PublicKey `yaml:"public-key"`
+
+	// Weight holds the weight given to the service. Services that
+	// are not listed have a weight of 1.
+	Weight int `yaml:"weight"`
+}
+
+func (c *DischargeThrottleConfig) validate() error {
+	if c.MaxConcurrent < 0 || c.MaxQueue < 0 || c.MaxWait.Duration < 0 {
+		return errgo.Newf("invalid discharge-throttle")
+	}
+	for _, w := range c.Weights {
+		if w.PublicKey == nil {
+			return errgo.Newf("discharge-throttle weight public-key not specified")
+		}
+		if w.Weight <= 0 {
+			return errgo.Newf("invalid discharge-throttle weight %d for %s", w.Weight, w.PublicKey)
+		}
+	}
+	return nil
+}
+
+// WaitLimitConfig holds the limits on requests that wait for
+// interactive authentication requests to complete.
+type WaitLimitConfig struct {
+	// Timeout holds the maximum time that a single wait request
+	// waits before the client is told to wait again. If it is zero,
+	// requests wait until the interactive authentication request
+	// completes or expires.
+	Timeout DurationString `yaml:"timeout"`
+
+	// MaxWaiters holds the maximum number of requests that may wait
+	// for a single interactive authentication request at the same
+	// time. If it is zero, the number is not limited.
+	MaxWaiters int `yaml:"max-waiters"`
+
+	// RetryAfter holds the delay suggested to a client the first
+	// time its wait request is rejected or times out.
+	RetryAfter DurationString `yaml:"retry-after"`
+
+	// MaxRetryAfter holds the maximum delay suggested to a client.
+	MaxRetryAfter DurationString `yaml:"max-retry-after"`
+}
+
+// Params returns the limits as waitlimit.Params.
+func (c *WaitLimitConfig) Params() waitlimit.Params {
+	return waitlimit.Params{
+		Timeout:       c.Timeout.Duration,
+		MaxWaiters:    c.MaxWaiters,
+		RetryAfter:    c.RetryAfter.Duration,
+		MaxRetryAfter: c.MaxRetryAfter.Duration,
+	}
+}
+
+func (c *WaitLimitConfig) validate() error {
+	if c.Timeout.Duration < 0 || c.MaxWaiters < 0 || c.RetryAfter.Duration < 0 || c.MaxRetryAfter.Duration < 0 {
+		return errgo.Newf("invalid wait-limit")
+	}
+	return nil
+}
+
+// RememberBrowserConfig holds the configuration of the persistent
+// sessions of remembered browsers.
+type RememberBrowserConfig struct {
+	// Lifetime holds the time for which a browser is remembered. If
+	// it is zero users cannot ask for their browser to be
+	// remembered.
+	Lifetime DurationString `yaml:"lifetime"`
+
+	// DeniedGroups holds groups whose members may not have their
+	// browsers remembered.
+	DeniedGroups []string `yaml:"denied-groups"`
+}
+
+// Params returns the configuration as remember.Params.
+func (c *RememberBrowserConfig) Params() remember.Params {
+	return remember.Params{
+		Lifetime:     c.Lifetime.Duration,
+		DeniedGroups: c.DeniedGroups,
+	}
+}
+
+func (c *RememberBrowserConfig) validate() error {
+	if c.Lifetime.Duration < 0 {
+		return errgo.Newf("negative remember-browser lifetime")
+	}
+	return nil
+}
+
+// AccessLogRouteConfig configures how a group of routes is written to
+// the JSON access log.
+type AccessLogRouteConfig struct {
+	// Prefix holds the path prefix of the routes in the group.
+	Prefix string `yaml:"prefix"`
+
+	// Disable prevents requests to the routes from being logged.
+	Disable bool `yaml:"disable"`
+
+	// DisableRedaction logs requests to the routes without redacting
+	// credentials.
+	DisableRedaction bool `yaml:"disable-redaction"`
+
+	// Bodies logs the JSON and form bodies of requests to the
+	// routes.
+	Bodies bool `yaml:"bodies"`
+}
+
+// AccessLogParams returns the configuration of the JSON access log as
+// accesslog.Params.
+func (c *Config) AccessLogParams() (accesslog.Params, error) {
+	clientIP, err := clientip.New(c.TrustedProxies)
+	if err != nil {
+		return accesslog.Params{}, errgo.Mask(err)
+	}
+	p := accesslog.Params{
+		RequestIDHeader: c.RequestIDHeader,
+		ClientIP:        clientIP,
+	}
+	for _, r := range c.AccessLogRoutes {
+		p.Routes = append(p.Routes, accesslog.RouteParams{
+			Prefix:           r.Prefix,
+			Disable:          r.Disable,
+			DisableRedaction: r.DisableRedaction,
+			Bodies:           r.Bodies,
+		})
+	}
+	return p, nil
+}
+
+func (c *Config) validateAccessLog() error {
+	switch c.AccessLogFormat {
+	case "", "combined":
+		if len(c.AccessLogRoutes) > 0 {
+			return errgo.Newf("access-log-routes requires access-log-format json")
+		}
+	case "json":
+	default:
+		return errgo.Newf("invalid access-log-format %q", c.AccessLogFormat)
+	}
+	prefixes := make(map[string]bool)
+	for _, r := range c.AccessLogRoutes {
+		if !strings.HasPrefix(r.Prefix, "/") {
+			return errgo.Newf("invalid access-log-routes prefix %q", r.Prefix)
+		}
+		if prefixes[r.Prefix] {
+			return errgo.Newf("duplicate access-log-routes prefix %q", r.Prefix)
+		}
+		prefixes[r.Prefix] = true
+	}
+	return nil
+}
+
+// ListenerConfig holds the configuration of an additional listener.
+type ListenerConfig struct {
+	// Name holds the name of the listener. When candidsrv is started
+	// by systemd socket activation, the socket with this name is
+	// used.
+	Name string `yaml:"name"`
+
+	// Address holds the address to listen on when the socket is not
+	// passed by systemd.
+	Address string `yaml:"address"`
+
+	// Paths holds the path prefixes that are served by the listener.
+	Paths []string `yaml:"paths"`
+
+	// TLSCert and TLSKey hold a TLS server certificate for the
+	// listener. If they are not specified the listener serves plain
+	// HTTP.
+	TLSCert string `yaml:"tls-cert"`
+	TLSKey  string `yaml:"tls-key"`
+
+	// ClientCA holds the PEM encoded certificates of the authorities
+	// that issue client certificates for the listener. If it is
+	// specified every client must present a certificate signed by
+	// one of them.
+	ClientCA string `yaml:"client-ca"`
+
+	// ClientCertUsers maps the common names of client certificates
+	// to the users that they authenticate as.
+	ClientCertUsers map[string]string `yaml:"client-cert-users"`
+
+	// BearerTokens holds static bearer tokens that authenticate
+	// requests made to the listener.
+	BearerTokens []BearerTokenConfig `yaml:"bearer-tokens"`
+}
+
+// BearerTokenConfig holds a bearer token that authenticates as a user.
+// Only the hash of the token is held, so that the configuration does
+// not reveal it.
+type BearerTokenConfig struct {
+	// Username holds the user that the token authenticates as.
+	Username string `yaml:"username"`
+
+	// TokenSHA256 holds the hex encoded SHA-256 hash of the token.
+	TokenSHA256 string `yaml:"token-sha256"`
+}
+
+// TLSConfig returns the TLS configuration of the listener, or nil if
+// it does not use TLS.
+func (c *ListenerConfig) TLSConfig() (*tls.Config, error) {
+	if c.TLSCert == "" && c.TLSKey == "" {
+		if c.ClientCA != "" {
+			return nil, errgo.Newf("listener %q client-ca specified without tls-cert and tls-key", c.Name)
+		}
+		return nil, nil
+	}
+	cert, err := tls.X509KeyPair([]byte(c.TLSCert), []byte(c.TLSKey))
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid certificate for listener %q", c.Name)
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if c.ClientCA != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(c.ClientCA)) {
+			return nil, errgo.Newf("invalid client-ca for listener %q", c.Name)
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+		conf.ClientCAs = pool
+	}
+	return conf, nil
+}
+
+// AuthParams returns the additional authentication methods accepted by
+// the listener.
+func (c *ListenerConfig) AuthParams() listener.AuthParams {
+	p := listener.AuthParams{
+		ClientCertUsers: c.ClientCertUsers,
+	}
+	if len(c.BearerTokens) > 0 {
+		p.BearerTokens = make(map[string]string, len(c.BearerTokens))
+		for _, t := range c.BearerTokens {
+			p.BearerTokens[strings.ToLower(t.TokenSHA256)] = t.Username
+		}
+	}
+	return p
+}
+
+func (c *ListenerConfig) validate() error {
+	var missing []string
+	if c.Name == "" {
+		missing = append(missing, "name")
+	}
+	if c.Address == "" {
+		missing = append(missing, "address")
+	}
+	if len(c.Paths) == 0 {
+		missing = append(missing, "paths")
+	}
+	if len(missing) != 0 {
+		return errgo.Newf("missing fields %s in listener config", strings.Join(missing, ", "))
+	}
+	if c.Name == listener.APIName {
+		return errgo.Newf("listener name %q is reserved", c.Name)
+	}
+	for _, p := range c.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return errgo.Newf("invalid path %q in listener %q", p, c.Name)
+		}
+	}
+	if _, err := c.TLSConfig(); err != nil {
+		return errgo.Mask(err)
+	}
+	if len(c.ClientCertUsers) > 0 && c.ClientCA == "" {
+		return errgo.Newf("listener %q client-cert-users specified without client-ca", c.Name)
+	}
+	for _, t := range c.BearerTokens {
+		if t.Username == "" {
+			return errgo.Newf("missing username in bearer token for listener %q", c.Name)
+		}
+		if b, err := hex.DecodeString(t.TokenSHA256); err != nil || len(b) != sha256.Size {
+			return errgo.Newf("invalid token-sha256 for user %q in listener %q", t.Username, c.Name)
+		}
+	}
+	return nil
+}
+
+// ListenerPaths returns the path prefixes served by all the additional
+// listeners.
+func (c *Config) ListenerPaths() []string {
+	var paths []string
+	for _, l := range c.Listeners {
+		paths = append(paths, l.Paths...)
+	}
+	return paths
+}
+
+// TenantPathPrefixes returns the path prefixes of the tenants that are
+// selected by path prefix.
+func (c *Config) TenantPathPrefixes() []string {
+	var prefixes []string
+	for _, t := range c.Tenants {
+		if t.PathPrefix != "" {
+			prefixes = append(prefixes, t.PathPrefix)
+		}
+	}
+	return prefixes
+}
+
+func (c *Config) validateListeners() error {
+	names := make(map[string]bool)
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		if err := l.validate(); err != nil {
+			return errgo.Mask(err)
+		}
+		if names[l.Name] {
+			return errgo.Newf("duplicate listener %q", l.Name)
+		}
+		names[l.Name] = true
+	}
+	return nil
+}
+
+// ACMEConfig holds the configuration of the automatic acquisition and
+// renewal of the HTTP server's certificates from an ACME certificate
+// authority.
+type ACMEConfig struct {
+	// Hostnames holds the hostnames for which certificates are
+	// obtained. Certificates are not requested for any other names.
+	Hostnames []string `yaml:"hostnames"`
+
+	// CacheDir holds the directory in which the account key and
+	// certificates are stored, so that they are kept when the
+	// server restarts.
+	CacheDir string `yaml:"cache-dir"`
+
+	// Email holds an optional contact address that the certificate
+	// authority may use to notify of problems with certificates.
+	Email string `yaml:"email"`
+
+	// DirectoryURL holds the URL of the ACME directory of the
+	// certificate authority. If it is empty Let's Encrypt is used.
+	DirectoryURL string `yaml:"directory-url"`
+
+	// AcceptTOS records that the terms of service of the
+	// certificate authority have been accepted. It must be true.
+	AcceptTOS bool `yaml:"accept-tos"`
+
+	// HTTPAddress holds an address on which to serve the ACME
+	// HTTP-01 challenge, which usually needs to be port 80. Other
+	// requests to the address are redirected to HTTPS. If it is
+	// empty only the TLS-ALPN-01 challenge, served on the HTTPS
+	// listener, is used.
+	HTTPAddress string `yaml:"http-address"`
+
+	once    sync.Once
+	manager *autocert.Manager
+}
+
+// Manager returns the manager that obtains certificates. The same
+// manager is returned every time it is called.
+func (c *ACMEConfig) Manager() *autocert.Manager {
+	c.once.Do(func() {
+		c.manager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(c.CacheDir),
+			HostPolicy: autocert.HostWhitelist(c.Hostnames...),
+			Email:      c.Email,
+		}
+		if c.DirectoryURL != "" {
+			c.manager.Client = &acme.Client{
+				DirectoryURL: c.DirectoryURL,
+			}
+		}
+	})
+	return c.manager
+}
+
+func (c *ACMEConfig) validate() error {
+	var missing []string
+	if len(c.Hostnames) == 0 {
+		missing = append(missing, "hostnames")
+	}
+	if c.CacheDir == "" {
+		missing = append(missing, "cache-dir")
+	}
+	if len(missing) != 0 {
+		return errgo.Newf("missing fields %s in acme config", strings.Join(missing, ", "))
+	}
+	if !c.AcceptTOS {
+		return errgo.Newf("acme accept-tos must be true")
+	}
+	return nil
+}
+
+// LoginChallengeConfig holds the configuration of the challenge that
+// users of login forms must complete after repeated failed logins.
+type LoginChallengeConfig struct {
+	// Type holds the type of challenge, one of "hcaptcha",
+	// "recaptcha" or "proof-of-work". If this is empty then no
+	// challenge is used.
+	Type string `yaml:"type"`
+
+	// SiteKey and SecretKey hold the keys issued by the CAPTCHA
+	// service.
+	SiteKey   string `yaml:"site-key"`
+	SecretKey string `yaml:"secret-key"`
+
+	// Difficulty holds the number of leading zero bits required in
+	// a proof of work.
+	Difficulty int `yaml:"difficulty"`
+
+	// MaxFailures holds the number of failed logins from an
+	// address, or for a username, after which the challenge is
+	// required.
+	MaxFailures int `yaml:"max-failures"`
+
+	// FailureWindow holds the time for which failed logins are
+	// remembered.
+	FailureWindow DurationString `yaml:"failure-window"`
+}
+
+func (c *LoginChallengeConfig) validate() error {
+	switch c.Type {
+	case "":
+		return nil
+	case "hcaptcha", "recaptcha":
+		if c.SiteKey == "" || c.SecretKey == "" {
+			return errgo.Newf("login-challenge site-key and secret-key must be specified for %s", c.Type)
+		}
+	case "proof-of-work":
+		if c.Difficulty < 0 || c.Difficulty > 32 {
+			return errgo.Newf("invalid login-challenge difficulty %d", c.Difficulty)
+		}
+	default:
+		return errgo.Newf("unknown login-challenge type %q", c.Type)
+	}
+	if c.MaxFailures < 0 || c.FailureWindow.Duration < 0 {
+		return errgo.Newf("invalid login-challenge")
+	}
+	return nil
+}
+
+// LoginLockoutConfig holds the configuration of the lockout of
+// usernames after repeated failed password logins.
+type LoginLockoutConfig struct {
+	// MaxFailures holds the number of consecutive failed logins
+	// after which a username is locked out. If this is zero then
+	// usernames are never locked out.
+	MaxFailures int `yaml:"max-failures"`
+
+	// Duration holds the time for which a username is locked out.
+	Duration DurationString `yaml:"duration"`
+}
+
+func (c *LoginLockoutConfig) validate() error {
+	if c.MaxFailures < 0 {
+		return errgo.Newf("invalid login-lockout max-failures %d", c.MaxFailures)
+	}
+	if c.Duration.Duration < 0 {
+		return errgo.Newf("invalid login-lockout duration %v", c.Duration.Duration)
+	}
+	return nil
+}
+
+// CanaryConfig holds the configuration of the synthetic login monitor.
+type CanaryConfig struct {
+	// Interval holds the time between synthetic logins. If this is
+	// zero then the monitor is disabled.
+	Interval DurationString `yaml:"interval"`
+
+	// AgentUsername holds the username of the canary agent. If this
+	// is empty then "canary@candid" is used.
+	AgentUsername string `yaml:"agent-username"`
+
+	// AgentKey holds the key pair used by the canary agent.
+	AgentKey *bakery.KeyPair `yaml:"agent-key"`
+
+	// LoginIDP, LoginUsername and LoginPassword optionally hold the
+	// name of an identity provider that uses a login form, and the
+	// credentials to use with it, for a scripted interactive login.
+	LoginIDP      string `yaml:"login-idp"`
+	LoginUsername string `yaml:"login-username"`
+	LoginPassword string `yaml:"login-password"`
+}
+
+func (c *CanaryConfig) validate() error {
+	if c.Interval.Duration == 0 {
+		return nil
+	}
+	if c.AgentKey == nil {
+		return errgo.Newf("canary agent-key not specified")
+	}
+	if c.LoginIDP != "" && c.LoginUsername == "" {
+		return errgo.Newf("canary login-username not specified")
+	}
+	return nil
+}
+
+// TLSConfig returns a TLS configuration to be used for serving
+// the API. If neither ACME nor the TLS certficate and key are
+// specified, it returns nil.
+func (c *Config) TLSConfig() *tls.Config {
+	var conf *tls.Config
+	switch {
+	case c.ACME != nil:
+		conf = c.ACME.Manager().TLSConfig()
+	case c.TLSCert != "" && c.TLSKey != "":
+		cert, err := tls.X509KeyPair([]byte(c.TLSCert), []byte(c.TLSKey))
+		if err != nil {
+			logger.Errorf("cannot create certificate: %s", err)
+			return nil
+		}
+		conf = &tls.Config{
+			Certificates: []tls.Certificate{
+				cert,
+			},
+		}
+	default:
+		return nil
+	}
+	for _, ip := range c.IdentityProviders {
+		if cca, ok := ip.IdentityProvider.(idp.ClientCertificateAuthenticator); ok && cca.RequestClientCertificate() {
+			conf.ClientAuth = tls.RequestClientCert
+		}
+	}
+	return conf
+}
+
+// hasIdentityProvider reports whether an identity provider with the
+// given name is configured.
+func (c *Config) hasIdentityProvider(name string) bool {
+	for _, ip := range c.IdentityProviders {
+		if ip.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) validate() error {
+	var missing []string
+	if c.Storage == nil {
+		// TODO default to in-memory storage?
+		missing = append(missing, "storage")
+	}
+	if c.ListenAddress == "" {
+		missing = append(missing, "listen-address")
+	}
+	if c.PrivateKey == nil {
+		missing = append(missing, "private-key")
+	}
+	if c.PublicKey == nil {
+		missing = append(missing, "public-key")
+	}
+	if c.Location == "" {
+		// TODO check it's a valid URL
+		missing = append(missing, "location")
+	}
+	if c.PrivateAddr == "" && !c.MeetingDiscovery.Enabled && !c.MeetingPoll.Enabled {
+		missing = append(missing, "private-addr")
+	}
+	if len(missing) != 0 {
+		return errgo.Newf("missing fields %s in config file", strings.Join(missing, ", "))
+	}
+	if err := c.Metrics.validate(); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := c.Canary.validate(); err != nil {
+		return errgo.Mask(err)
+	}
+	switch c.LogFormat {
+	case "", "text", "json":
+	default:
+		return errgo.Newf("invalid log-format %q", c.LogFormat)
+	}
+	if err := c.validateAccessLog(); err != nil {
+		return errgo.Mask(err)
+	}
+	for _, p := range c.RedirectLoginPatterns {
+		if _, err := returnto.ParsePattern(p); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	for _, d := range c.CookieDomains {
+		if !isValidCookieDomain(d) {
+			return errgo.Newf("invalid cookie domain %q", d)
+		}
+	}
+	if _, ok := sameSiteModes[c.CookieSameSite]; !ok {
+		return errgo.Newf("invalid cookie-same-site %q", c.CookieSameSite)
+	}
+	if c.CookieSameSite == "none" && !c.CookieSecure {
+		return errgo.Newf("cookie-same-site none requires cookie-secure")
+	}
+	for domain, name := range c.EmailDomainIDPs {
+		if domain == "" || strings.Contains(domain, "@") {
+			return errgo.Newf("invalid email domain %q", domain)
+		}
+		if len(c.IdentityProviders) > 0 && !c.hasIdentityProvider(name) {
+			return errgo.Newf("email domain %q refers to unknown identity provider %q", domain, name)
+		}
+	}
+	for _, f := range c.EditableProfileFields {
+		switch f {
+		case "name", "email":
+		default:
+			return errgo.Newf("invalid editable profile field %q", f)
+		}
+	}
+	if err := c.DischargeThrottle.validate(); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := c.LoginChallenge.validate(); err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := clientip.New(c.TrustedProxies); err != nil {
+		return errgo.Notef(err, "invalid trusted-proxies")
+	}
+	if c.ProxyProtocol && len(c.TrustedProxies) == 0 {
+		return errgo.Newf("proxy-protocol requires trusted-proxies")
+	}
+	if err := c.LoginLockout.validate(); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := c.Consent.validate(); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := c.KeyRotation.validate(); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := c.JWT.validate(); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := c.MeetingDiscovery.validate(); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := c.MeetingPoll.validate(); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := c.MeetingRPC.validate(); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := c.IdentityCache.validate(); err != nil {
+		return errgo.Mask(err)
+	}
+	if c.ResponseCacheTTL.Duration < 0 {
+		return errgo.Newf("negative response-cache-ttl")
+	}
+	if c.RendezvousExpiry.Duration < 0 {
+		return errgo.Newf("negative rendezvous-expiry")
+	}
+	if c.RendezvousGCInterval.Duration < 0 {
+		return errgo.Newf("negative rendezvous-gc-interval")
+	}
+	if err := c.WaitLimit.validate(); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := c.validateListeners(); err != nil {
+		return errgo.Mask(err)
+	}
+	if c.ACME != nil {
+		if c.TLSCert != "" || c.TLSKey != "" {
+			return errgo.Newf("acme cannot be used with tls-cert and tls-key")
+		}
+		if err := c.ACME.validate(); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if err := c.RememberBrowser.validate(); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := c.ExtraInfoEncryption.validate(); err != nil {
+		return errgo.Mask(err)
+	}
+	if c.KMS != nil {
+		if err := c.KMS.validate(); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if c.VaultRootKeys != nil {
+		if err := c.VaultRootKeys.validate(); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if c.EtcdProviderData != nil {
+		if err := c.EtcdProviderData.validate(); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if c.KMS == nil && len(c.ExtraInfoEncryption.Attributes) > 0 && len(c.ExtraInfoEncryption.Keys) == 0 {
+		return errgo.Newf("extra-info-encryption keys not specified")
+	}
+	if c.KMS == nil && c.EncryptProviderData {
+		return errgo.Newf("encrypt-provider-data requires kms")
+	}
+	if _, err := attrschema.New(c.IdentityAttributes()); err != nil {
+		return errgo.Notef(err, "invalid attributes")
+	}
+	custom := make(map[string]bool)
+	for _, a := range c.Attributes {
+		custom[a.Name] = true
+	}
+	for i := range c.DeclaredAttributes {
+		if err := c.DeclaredAttributes[i].validate(custom); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if err := c.CORS.validate(); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := c.SecurityHeaders.validate(); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := c.Notify.validate(); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := c.validateTenants(); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// Read reads an identity configuration file from the given path.
+// Fields that are not recognised are ignored.
+func Read(path string) (*Config, error) {
+	data, err := readFile(path)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return parse(path, data, yaml.Unmarshal)
+}
+
+// ReadWithWarnings is like Read except that it also returns a
+// description of each field that is not recognised, including those in
+// the configuration of identity providers and storage backends, so
+// that they can be logged as warnings.
+func ReadWithWarnings(path string) (*Config, []string, error) {
+	data, err := readFile(path)
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	conf, err := parse(path, data, yaml.Unmarshal)
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	// Decode the file again strictly, just to find the fields that
+	// are not recognised. As the lenient decode succeeded, any
+	// errors are about unrecognised fields.
+	var strict Config
+	err = yaml.UnmarshalStrict(data, &strict)
+	if terr, ok := err.(*yaml.TypeError); ok {
+		return conf, terr.Errors, nil
+	}
+	if err != nil {
+		return conf, []string{err.Error()}, nil
+	}
+	return conf, nil, nil
+}
+
+// ReadStrict is like Read except that fields that are not recognised,
+// including those in the configuration of identity providers and
+// storage backends, are an error.
+func ReadStrict(path string) (*Config, error) {
+	data, err := readFile(path)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return parse(path, data, yaml.UnmarshalStrict)
+}
+
+func readFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open config file")
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read %q", path)
+	}
+	return data, nil
+}
+
+func parse(path string, data []byte, unmarshal func([]byte, interface{}) error) (*Config, error) {
+	var conf Config
+	if err := unmarshal(data, &conf); err != nil {
 		return nil, errgo.Notef(err, "cannot parse %q", path)
 	}
 	if err := conf.validate(); err != nil {
@@ -14,6 +14,8 @@ import (
 
 	"github.com/CanonicalLtd/candid/config"
 	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/internal/attrschema"
+	"github.com/CanonicalLtd/candid/internal/listener"
 	"github.com/CanonicalLtd/candid/store"
 	_ "github.com/CanonicalLtd/candid/store/memstore"
 )
@@ -91,9 +93,14 @@ no-proxy: localhost,.example.com
 redirect-login-whitelist:
 - https://example.com/1
 - https://example.com/2
+redirect-login-patterns:
+- https://*.example.com/callback
 api-macaroon-timeout: 2h
 discharge-macaroon-timeout: 24h
 discharge-token-timeout: 6h
+metrics:
+  request-duration-buckets: [0.001, 0.005, 0.01, 0.1, 1]
+  exemplars: true
 `
 
 func readConfig(c *qt.C, content string) (*config.Config, error) {
@@ -106,6 +113,61 @@ func readConfig(c *qt.C, content string) (*config.Config, error) {
 	return config.Read(path)
 }
 
+func TestReadStrictErrorUnknownField(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	path := path.Join(c.Mkdir(), "config.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+listen-adress: 1.2.3.4:5679
+`), 0666)
+	c.Assert(err, qt.Equals, nil)
+
+	cfg, err := config.Read(path)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cfg.ListenAddress, qt.Equals, "1.2.3.4:5678")
+
+	cfg, err = config.ReadStrict(path)
+	c.Assert(err, qt.ErrorMatches, `cannot parse ".*": yaml: unmarshal errors:\n  line 9: field listen-adress not found in type config.Config`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadWithWarnings(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	path := path.Join(c.Mkdir(), "config.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+listen-adress: 1.2.3.4:5679
+logging-confg: <root>=DEBUG
+`), 0666)
+	c.Assert(err, qt.Equals, nil)
+
+	cfg, warnings, err := config.ReadWithWarnings(path)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cfg.ListenAddress, qt.Equals, "1.2.3.4:5678")
+	c.Assert(warnings, qt.DeepEquals, []string{
+		"line 9: field listen-adress not found in type config.Config",
+		"line 10: field logging-confg not found in type config.Config",
+	})
+}
+
 func TestRead(t *testing.T) {
 	c := qt.New(t)
 	defer c.Done()
@@ -170,9 +232,16 @@ func TestRead(t *testing.T) {
 			"https://example.com/1",
 			"https://example.com/2",
 		},
+		RedirectLoginPatterns: []string{
+			"https://*.example.com/callback",
+		},
 		APIMacaroonTimeout:       config.DurationString{Duration: 2 * time.Hour},
 		DischargeMacaroonTimeout: config.DurationString{Duration: 24 * time.Hour},
 		DischargeTokenTimeout:    config.DurationString{Duration: 6 * time.Hour},
+		Metrics: config.MetricsConfig{
+			RequestDurationBuckets: []float64{0.001, 0.005, 0.01, 0.1, 1},
+			Exemplars:              true,
+		},
 	})
 }
 
@@ -194,6 +263,65 @@ func TestReadErrorEmpty(t *testing.T) {
 	c.Assert(cfg, qt.IsNil)
 }
 
+func TestReadErrorInvalidBuckets(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+metrics:
+  meeting-completed-buckets: [10, 5]
+`)
+	c.Assert(err, qt.ErrorMatches, "invalid meeting-completed-buckets: buckets not in increasing order")
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorEncryptProviderDataWithoutKMS(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+encrypt-provider-data: true
+`)
+	c.Assert(err, qt.ErrorMatches, "encrypt-provider-data requires kms")
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorInvalidKMS(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+kms:
+  type: vault
+`)
+	c.Assert(err, qt.ErrorMatches, "missing fields address, key-name in kms config")
+	c.Assert(cfg, qt.IsNil)
+}
+
 func TestReadErrorInvalidYAML(t *testing.T) {
 	c := qt.New(t)
 	defer c.Done()
@@ -220,6 +348,10 @@ type identityProvider struct {
 	Params map[string]string
 }
 
+func (p identityProvider) Name() string {
+	return p.Params["name"]
+}
+
 func testIdentityProvider(unmarshal func(interface{}) error) (idp.IdentityProvider, error) {
 	idp := identityProvider{
 		Params: make(map[string]string),
@@ -244,3 +376,720 @@ func testStorageBackend(unmarshal func(interface{}) error) (store.BackendFactory
 	}
 	return backend, nil
 }
+
+func TestReadErrorInvalidDischargeThrottleWeight(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+discharge-throttle:
+  max-concurrent: 10
+  weights:
+    - public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+      weight: 0
+`)
+	c.Assert(err, qt.ErrorMatches, `invalid discharge-throttle weight 0 for CIdWcEUN\+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorInvalidVaultRootKeys(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+vault-root-keys:
+  mount: kv
+`)
+	c.Assert(err, qt.ErrorMatches, "missing fields address in vault-root-keys config")
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorInvalidEtcdProviderData(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+etcd-provider-data:
+  prefix: candid/
+`)
+	c.Assert(err, qt.ErrorMatches, "missing fields endpoints in etcd-provider-data config")
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorInvalidRedirectLoginPattern(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+redirect-login-patterns:
+  - https://*/callback
+`)
+	c.Assert(err, qt.ErrorMatches, `invalid return_to pattern "https://\*/callback"`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorInvalidCookieDomain(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+cookie-domains:
+  - example.com
+  - com
+`)
+	c.Assert(err, qt.ErrorMatches, `invalid cookie domain "com"`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorInvalidCookieSameSite(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+cookie-same-site: none
+`)
+	c.Assert(err, qt.ErrorMatches, `cookie-same-site none requires cookie-secure`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorInvalidSecurityHeaders(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+security-headers:
+  frame-options: ALLOW
+`)
+	c.Assert(err, qt.ErrorMatches, `invalid security-headers config: invalid frame options "ALLOW"`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorInvalidNotify(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+notify:
+  smtp:
+    address: smtp.example.com
+    from: candid@example.com
+`)
+	c.Assert(err, qt.ErrorMatches, `invalid notify config: invalid SMTP address: .*`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorInvalidAttribute(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+attributes:
+  - name: employee-id
+    type: date
+`)
+	c.Assert(err, qt.ErrorMatches, `invalid attributes: invalid type "date" for attribute "employee-id"`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadDeclaredCustomAttribute(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+attributes:
+  - name: employee-id
+    required: true
+    pattern: E[0-9]+
+declared-attributes:
+  - public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+    attributes: [email, employee-id]
+`)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cfg.IdentityAttributes(), qt.DeepEquals, []attrschema.Attribute{{
+		Name:     "employee-id",
+		Required: true,
+		Pattern:  "E[0-9]+",
+	}})
+}
+
+func TestReadErrorInvalidLogFormat(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+log-format: xml
+`)
+	c.Assert(err, qt.ErrorMatches, `invalid log-format "xml"`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorAccessLogRoutesWithoutJSON(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+access-log: /var/log/candid/access.log
+access-log-routes:
+  - prefix: /debug
+    disable: true
+`)
+	c.Assert(err, qt.ErrorMatches, `access-log-routes requires access-log-format json`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorEmailDomainUnknownIDP(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	idp.Register("usso", testIdentityProvider)
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+identity-providers:
+ - type: usso
+email-domain-idps:
+  example.com: ldap
+`)
+	c.Assert(err, qt.ErrorMatches, `email domain "example.com" refers to unknown identity provider "ldap"`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorLoginChallengeNoSecretKey(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+login-challenge:
+  type: hcaptcha
+  site-key: 10000000-ffff-ffff-ffff-000000000001
+`)
+	c.Assert(err, qt.ErrorMatches, `login-challenge site-key and secret-key must be specified for hcaptcha`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorInvalidTrustedProxies(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+trusted-proxies:
+  - 10.0.0.0/8
+  - proxy.example.com
+`)
+	c.Assert(err, qt.ErrorMatches, `invalid trusted-proxies: invalid address "proxy.example.com"`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorProxyProtocolWithoutTrustedProxies(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+proxy-protocol: true
+`)
+	c.Assert(err, qt.ErrorMatches, `proxy-protocol requires trusted-proxies`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadListeners(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+listeners:
+  - name: admin
+    address: 10.0.0.5:8082
+    paths: [/acl, /debug]
+  - name: metrics
+    address: 10.0.0.5:9090
+    paths: [/metrics]
+`)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cfg.ListenerPaths(), qt.DeepEquals, []string{"/acl", "/debug", "/metrics"})
+}
+
+func TestReadErrorDuplicateListener(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+listeners:
+  - name: admin
+    address: 10.0.0.5:8082
+    paths: [/acl]
+  - name: admin
+    address: 10.0.0.5:8083
+    paths: [/metrics]
+`)
+	c.Assert(err, qt.ErrorMatches, `duplicate listener "admin"`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadListenerBearerTokens(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+listeners:
+  - name: admin
+    address: 10.0.0.5:8082
+    paths: [/acl, /v1/u]
+    bearer-tokens:
+      - username: admin@candid
+        token-sha256: 1EC1C26B50D5D3C58D9583181AF8076655FE00756BF7285940BA3670F99FCBA0
+`)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cfg.Listeners[0].AuthParams(), qt.DeepEquals, listener.AuthParams{
+		BearerTokens: map[string]string{
+			"1ec1c26b50d5d3c58d9583181af8076655fe00756bf7285940ba3670f99fcba0": "admin@candid",
+		},
+	})
+}
+
+func TestReadErrorListenerInvalidTokenSHA256(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+listeners:
+  - name: admin
+    address: 10.0.0.5:8082
+    paths: [/acl]
+    bearer-tokens:
+      - username: admin@candid
+        token-sha256: s3cret
+`)
+	c.Assert(err, qt.ErrorMatches, `invalid token-sha256 for user "admin@candid" in listener "admin"`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadACME(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+acme:
+  hostnames: [candid.example.com]
+  cache-dir: /var/lib/candid/acme
+  accept-tos: true
+`)
+	c.Assert(err, qt.Equals, nil)
+	tlsConfig := cfg.TLSConfig()
+	c.Assert(tlsConfig, qt.Not(qt.IsNil))
+	c.Assert(tlsConfig.GetCertificate, qt.Not(qt.IsNil))
+	c.Assert(cfg.ACME.Manager(), qt.Equals, cfg.ACME.Manager())
+}
+
+func TestReadErrorACMEWithoutAcceptTOS(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+acme:
+  hostnames: [candid.example.com]
+  cache-dir: /var/lib/candid/acme
+`)
+	c.Assert(err, qt.ErrorMatches, `acme accept-tos must be true`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorLoginLockoutNegativeDuration(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+login-lockout:
+  max-failures: 5
+  duration: -1m
+`)
+	c.Assert(err, qt.ErrorMatches, `invalid login-lockout duration -1m0s`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorConsentServiceNoPublicKey(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+consent:
+  services:
+    - name: Example Service
+`)
+	c.Assert(err, qt.ErrorMatches, `consent service public-key not specified`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorInvalidEditableProfileField(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+editable-profile-fields:
+  - name
+  - username
+`)
+	c.Assert(err, qt.ErrorMatches, `invalid editable profile field "username"`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorInvalidJWTClaim(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+jwt:
+  audiences:
+    - https://service.example.com
+  claims:
+    - email
+    - password
+`)
+	c.Assert(err, qt.ErrorMatches, `invalid jwt claim "password"`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadMeetingDiscoveryWithoutPrivateAddr(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+storage:
+  type: test
+meeting-discovery:
+  enabled: true
+  advertise-addr: candid-0.candid
+  heartbeat-interval: 5s
+`)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cfg.PrivateAddr, qt.Equals, "")
+	c.Assert(cfg.MeetingDiscovery, qt.DeepEquals, config.MeetingDiscoveryConfig{
+		Enabled:       true,
+		AdvertiseAddr: "candid-0.candid",
+		HeartbeatInterval: config.DurationString{
+			Duration: 5 * time.Second,
+		},
+	})
+}
+
+func TestReadErrorMeetingRPCCACertWithoutCertificate(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+meeting-rpc:
+  server-name: candid.internal
+  secret: 0123456789abcdef
+`)
+	c.Assert(err, qt.ErrorMatches, `meeting-rpc tls-cert and tls-key not specified`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorIdentityCacheNegativeSize(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+identity-cache:
+  size: -1
+`)
+	c.Assert(err, qt.ErrorMatches, `negative identity-cache size`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorTenantWithServerKey(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	idp.Register("usso", testIdentityProvider)
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+tenants:
+ - name: acme
+   hostnames: [acme.foo.com]
+   location: http://acme.foo.com:1234
+   private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+   public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+   identity-providers:
+    - type: usso
+`)
+	c.Assert(err, qt.ErrorMatches, `tenant "acme" uses the public key of the server`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorTenantWithoutHostnames(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	idp.Register("usso", testIdentityProvider)
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+tenants:
+ - name: acme
+   location: http://acme.foo.com:1234
+   identity-providers:
+    - type: usso
+`)
+	c.Assert(err, qt.ErrorMatches, `missing fields private-key, public-key, hostnames in tenant "acme" config`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorInvalidCORSOrigin(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+cors:
+  allowed-origins: [app.example.com]
+`)
+	c.Assert(err, qt.ErrorMatches, `invalid cors config: invalid origin "app.example.com"`)
+	c.Assert(cfg, qt.IsNil)
+}
@@ -2,8 +2,8 @@ module github.com/CanonicalLtd/candid
 
 require (
 	github.com/BurntSushi/toml v0.3.1 // indirect
-	github.com/beorn7/perks v0.0.0-20160229213445-3ac7bf7a47d1 // indirect
-	github.com/coreos/go-oidc v0.0.0-20170119174436-2cc7913f9f6f
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/coreos/go-oidc v2.2.1+incompatible
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/frankban/quicktest v1.5.0
 	github.com/garyburd/go-oauth v0.0.0-20150329160146-3131beb69b81
@@ -17,7 +17,6 @@ require (
 	github.com/juju/go4 v0.0.0-20160222163258-40d72ab9641a // indirect
 	github.com/juju/httpprof v0.0.0-20141217160036-14bf14c30767 // indirect
 	github.com/juju/loggo v0.0.0-20190212223446-d976af380377
-	github.com/juju/mgotest v1.0.1
 	github.com/juju/names v0.0.0-20160330150533-8a0aa0963bba
 	github.com/juju/persistent-cookiejar v0.0.0-20170428161559-d67418f14c93
 	github.com/juju/postgrestest v1.1.0
@@ -33,18 +32,21 @@ require (
 	github.com/mattn/go-isatty v0.0.4 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
 	github.com/mhilton/openid v0.0.0-20150511103207-7922a4e937d8
+	github.com/oschwald/maxminddb-golang v1.5.0
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/pquerna/cachecontrol v0.0.0-20160421231612-c97913dcbd76 // indirect
-	github.com/prometheus/client_golang v0.0.0-20180319131721-d49167c4b9f3
-	github.com/prometheus/client_model v0.0.0-20150212101744-fa8ad6fec335 // indirect
-	github.com/prometheus/common v0.0.0-20160503220532-dd586c1c5abb // indirect
-	github.com/prometheus/procfs v0.0.0-20160411190841-abf152e5f3e9 // indirect
+	github.com/prometheus/client_golang v1.4.1
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.9.1 // indirect
+	github.com/prometheus/procfs v0.0.8 // indirect
 	github.com/stretchr/testify v1.2.2 // indirect
 	github.com/yohcop/openid-go v1.0.0
+	go.mongodb.org/mongo-driver v1.1.2
 	golang.org/x/crypto v0.0.0-20190404164418-38d8ce5564a5
 	golang.org/x/net v0.0.0-20191002035440-2ec189313ef0
-	golang.org/x/oauth2 v0.0.0-20161219192954-314dd2c0bf3e
+	golang.org/x/oauth2 v0.0.0-20180821212333-d2e6202438be
 	google.golang.org/appengine v1.2.0 // indirect
+	google.golang.org/grpc v1.24.0
 	gopkg.in/CanonicalLtd/candidclient.v1 v1.2.0
 	gopkg.in/asn1-ber.v1 v1.0.0-20170511165959-379148ca0225
 	gopkg.in/errgo.v1 v1.0.0
@@ -55,7 +57,6 @@ require (
 	gopkg.in/ldap.v2 v2.5.0
 	gopkg.in/macaroon-bakery.v2 v2.1.0
 	gopkg.in/macaroon.v2 v2.1.0
-	gopkg.in/mgo.v2 v2.0.0-20180705113604-9856a29383ce
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0-20170531180850-df99d62fd42d
 	gopkg.in/retry.v1 v1.0.3 // indirect
 	gopkg.in/square/go-jose.v2 v2.0.1 // indirect
@@ -55,6 +55,24 @@ type Params struct {
 	// Hidden is set if the IDP should be hidden from interactive
 	// prompts.
 	Hidden bool `yaml:"hidden"`
+
+	// Tenant contains the ID of an Azure AD tenant. If this is set
+	// then users log in with accounts in that tenant, rather than
+	// with personal Microsoft accounts, and the groups that they
+	// are members of are available in candid.
+	Tenant string `yaml:"tenant"`
+
+	// GraphURL contains the base URL of the Microsoft Graph API that
+	// is used to retrieve the groups of users who are members of
+	// too many groups for them to be included in the ID token. If
+	// this is not set then https://graph.microsoft.com is used.
+	GraphURL string `yaml:"graph-url"`
+
+	// TokenURL contains the URL used to obtain access tokens for the
+	// Graph API using the client credentials. If this is not set
+	// then the token endpoint for the tenant at
+	// https://login.microsoftonline.com is used.
+	TokenURL string `yaml:"token-url"`
 }
 
 // NewIdentityProvider creates an azure identity provider with the
@@ -67,7 +85,7 @@ func NewIdentityProvider(p Params) idp.IdentityProvider {
 		p.Domain = "azure"
 	}
 
-	return openid.NewOpenIDConnectIdentityProvider(openid.OpenIDConnectParams{
+	oidcParams := openid.OpenIDConnectParams{
 		Name:         p.Name,
 		Issuer:       "https://login.live.com",
 		Description:  p.Description,
@@ -77,5 +95,10 @@ func NewIdentityProvider(p Params) idp.IdentityProvider {
 		ClientID:     p.ClientID,
 		ClientSecret: p.ClientSecret,
 		Hidden:       p.Hidden,
-	})
+	}
+	if p.Tenant != "" {
+		oidcParams.Issuer = loginURL + "/" + p.Tenant + "/v2.0"
+		oidcParams.GroupsFunc = newGraphClient(p).groups
+	}
+	return openid.NewOpenIDConnectIdentityProvider(oidcParams)
 }
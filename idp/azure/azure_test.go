@@ -24,6 +24,15 @@ identity-providers:
    client-id: client-001
    client-secret: secret-001
 `,
+}, {
+	about: "tenant",
+	yaml: `
+identity-providers:
+ - type: azure
+   client-id: client-001
+   client-secret: secret-001
+   tenant: 9188040d-6c67-4c5b-b112-36a304b66dad
+`,
 }, {
 	about: "no client-id",
 	yaml: `
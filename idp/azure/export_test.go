@@ -0,0 +1,19 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package azure
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// ClaimGroups returns the groups for the given JSON encoded ID token
+// claims using a graph client created with the given parameters.
+func ClaimGroups(ctx context.Context, p Params, claims string) ([]string, error) {
+	var c groupClaims
+	if err := json.Unmarshal([]byte(claims), &c); err != nil {
+		return nil, err
+	}
+	return newGraphClient(p).claimGroups(ctx, &c)
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	oidc "github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+)
+
+const (
+	defaultGraphURL = "https://graph.microsoft.com"
+	loginURL        = "https://login.microsoftonline.com"
+)
+
+// groupClaims contains the claims in an Azure AD ID token that are
+// relevant to group membership. See
+// https://docs.microsoft.com/en-us/azure/active-directory/develop/id-tokens
+// for more information.
+type groupClaims struct {
+	// ObjectID holds the object ID of the user in the directory.
+	ObjectID string `json:"oid"`
+
+	// Groups holds the object IDs of the groups the user is a
+	// member of. It is not present if the user is a member of too
+	// many groups for them all to be included in the token.
+	Groups []string `json:"groups"`
+
+	// HasGroups is set in place of the groups claim if the groups
+	// would make the token too large for a URL.
+	HasGroups bool `json:"hasgroups"`
+
+	// ClaimNames holds the names of claims that must be retrieved
+	// from another source. If it contains "groups" then the groups
+	// claim was not included because there are too many groups.
+	ClaimNames map[string]string `json:"_claim_names"`
+}
+
+// overage reports whether the token indicates that the user's groups
+// must be retrieved from the directory.
+func (c *groupClaims) overage() bool {
+	if c.HasGroups {
+		return true
+	}
+	_, ok := c.ClaimNames["groups"]
+	return ok
+}
+
+// A graphClient retrieves group memberships from the Microsoft Graph
+// API, authenticating as the application using its client credentials.
+type graphClient struct {
+	// url holds the base URL of the Graph API.
+	url string
+
+	// config holds the client credentials configuration used to
+	// obtain access tokens.
+	config *clientcredentials.Config
+}
+
+func newGraphClient(p Params) *graphClient {
+	graphURL := p.GraphURL
+	if graphURL == "" {
+		graphURL = defaultGraphURL
+	}
+	tokenURL := p.TokenURL
+	if tokenURL == "" {
+		tokenURL = loginURL + "/" + url.PathEscape(p.Tenant) + "/oauth2/v2.0/token"
+	}
+	return &graphClient{
+		url: graphURL,
+		config: &clientcredentials.Config{
+			ClientID:     p.ClientID,
+			ClientSecret: p.ClientSecret,
+			TokenURL:     tokenURL,
+			Scopes:       []string{graphURL + "/.default"},
+		},
+	}
+}
+
+// groups implements openid.OpenIDConnectParams.GroupsFunc. The groups
+// are taken from the ID token if possible, otherwise they are
+// retrieved from the Graph API.
+func (c *graphClient) groups(ctx context.Context, _ *oauth2.Token, id *oidc.IDToken) ([]string, error) {
+	var claims groupClaims
+	if err := id.Claims(&claims); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return c.claimGroups(ctx, &claims)
+}
+
+// claimGroups returns the groups held in the given claims, retrieving
+// them from the Graph API if there are too many for the claims to hold.
+func (c *graphClient) claimGroups(ctx context.Context, claims *groupClaims) ([]string, error) {
+	if !claims.overage() {
+		return claims.Groups, nil
+	}
+	if claims.ObjectID == "" {
+		return nil, errgo.Newf("no oid claim in ID token")
+	}
+	return c.memberGroups(ctx, claims.ObjectID)
+}
+
+// memberGroupsRequest is the body of a getMemberGroups request. See
+// https://docs.microsoft.com/en-us/graph/api/directoryobject-getmembergroups
+// for more information.
+type memberGroupsRequest struct {
+	SecurityEnabledOnly bool `json:"securityEnabledOnly"`
+}
+
+// memberGroupsResponse is the response to a getMemberGroups request.
+type memberGroupsResponse struct {
+	Value []string `json:"value"`
+}
+
+// graphError is an error response from the Graph API.
+type graphError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// memberGroups returns the object IDs of all the groups, including
+// nested groups, that the user with the given object ID is a member
+// of.
+func (c *graphClient) memberGroups(ctx context.Context, userID string) ([]string, error) {
+	body, err := json.Marshal(memberGroupsRequest{})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	req, err := http.NewRequest("POST", c.url+"/v1.0/users/"+url.PathEscape(userID)+"/getMemberGroups", bytes.NewReader(body))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.config.Client(ctx).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get groups from graph API")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var gerr graphError
+		if err := httprequest.UnmarshalJSONResponse(resp, &gerr); err != nil || gerr.Error.Message == "" {
+			return nil, errgo.Newf("cannot get groups from graph API: %s", resp.Status)
+		}
+		return nil, errgo.Newf("cannot get groups from graph API: %s", gerr.Error.Message)
+	}
+	var mgresp memberGroupsResponse
+	if err := httprequest.UnmarshalJSONResponse(resp, &mgresp); err != nil {
+		return nil, errgo.Notef(err, "cannot get groups from graph API")
+	}
+	return mgresp.Value, nil
+}
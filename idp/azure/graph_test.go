@@ -0,0 +1,104 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package azure_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/idp/azure"
+)
+
+var claimGroupsTests = []struct {
+	about        string
+	claims       string
+	expectGroups []string
+	expectError  string
+}{{
+	about:        "groups in token",
+	claims:       `{"oid": "user1", "groups": ["g1", "g2"]}`,
+	expectGroups: []string{"g1", "g2"},
+}, {
+	about:  "no groups",
+	claims: `{"oid": "user1"}`,
+}, {
+	about:        "groups overage",
+	claims:       `{"oid": "user1", "_claim_names": {"groups": "src1"}, "_claim_sources": {"src1": {"endpoint": "https://graph.windows.net/tenant/users/user1/getMemberObjects"}}}`,
+	expectGroups: []string{"g1", "g2", "g3"},
+}, {
+	about:        "hasgroups",
+	claims:       `{"oid": "user1", "hasgroups": true}`,
+	expectGroups: []string{"g1", "g2", "g3"},
+}, {
+	about:       "graph error",
+	claims:      `{"oid": "user2", "hasgroups": true}`,
+	expectError: `cannot get groups from graph API: Resource 'user2' does not exist.`,
+}, {
+	about:       "no oid",
+	claims:      `{"hasgroups": true}`,
+	expectError: `no oid claim in ID token`,
+}}
+
+func TestClaimGroups(t *testing.T) {
+	c := qt.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(graphHandler))
+	defer srv.Close()
+	p := azure.Params{
+		ClientID:     "client-001",
+		ClientSecret: "secret-001",
+		Tenant:       "tenant-001",
+		GraphURL:     srv.URL,
+		TokenURL:     srv.URL + "/token",
+	}
+	for _, test := range claimGroupsTests {
+		c.Run(test.about, func(c *qt.C) {
+			groups, err := azure.ClaimGroups(context.Background(), p, test.claims)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(groups, qt.DeepEquals, test.expectGroups)
+		})
+	}
+}
+
+func graphHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch req.URL.Path {
+	case "/token":
+		req.ParseForm()
+		if req.Form.Get("grant_type") != "client_credentials" || req.Form.Get("scope") != "http://"+req.Host+"/.default" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_request"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "graph-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	case "/v1.0/users/user1/getMemberGroups":
+		if req.Header.Get("Authorization") != "Bearer graph-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error": map[string]string{"code": "InvalidAuthenticationToken", "message": "Access token is empty."},
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"value": []string{"g1", "g2", "g3"},
+		})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": map[string]string{"code": "Request_ResourceNotFound", "message": "Resource 'user2' does not exist."},
+		})
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idp
+
+import (
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// Branding holds the customisations of the pages shown to users logging
+// in through a particular identity provider.
+type Branding struct {
+	// Template holds templates that replace the identity server's
+	// templates of the same name when rendering pages for the
+	// identity provider. Templates that are not defined here are
+	// taken from the identity server's templates.
+	Template *template.Template
+
+	// Static holds static assets, such as logos and style sheets,
+	// for the identity provider. They are served under
+	// /static/idp/<name>/.
+	Static http.FileSystem
+
+	// Strings holds text, such as headings and labels in the
+	// language of the identity provider's users, keyed by name.
+	// Templates look these up using the "text" function.
+	Strings map[string]string
+}
+
+// TemplateFuncs returns the functions available to templates rendered
+// with the given strings. All templates used by the identity server
+// must be parsed with these functions available.
+//
+// The "text" function returns the string with the name given as its
+// first argument. If there is no such string, the second argument is
+// returned if there is one, otherwise the name.
+//
+// The "cspNonce" function returns the nonce that script and style
+// elements must hold to be allowed by the content security policy of
+// the page. It returns an empty string here; the nonce is provided
+// when the template is executed.
+func TemplateFuncs(strs map[string]string) template.FuncMap {
+	return template.FuncMap{
+		"text": func(name string, dflt ...string) string {
+			if s, ok := strs[name]; ok {
+				return s
+			}
+			if len(dflt) > 0 {
+				return dflt[0]
+			}
+			return name
+		},
+		"cspNonce": func() string {
+			return ""
+		},
+	}
+}
+
+// BrandedTemplate returns the template set to use for pages rendered for
+// an identity provider with the given branding. The result contains all
+// the templates in t, except for any replaced by b.Template, and its
+// "text" function uses b.Strings, falling back to the given default
+// strings. If b has no templates or strings then t is returned
+// unchanged.
+func BrandedTemplate(t *template.Template, b Branding, defaultStrings map[string]string) (*template.Template, error) {
+	if b.Template == nil && len(b.Strings) == 0 {
+		return t, nil
+	}
+	if t == nil {
+		t = template.New("").Funcs(TemplateFuncs(defaultStrings))
+	}
+	t, err := t.Clone()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if b.Template != nil {
+		for _, bt := range b.Template.Templates() {
+			if bt.Tree == nil || bt.Tree.Root == nil {
+				continue
+			}
+			if _, err := t.AddParseTree(bt.Name(), bt.Tree); err != nil {
+				return nil, errgo.Notef(err, "cannot add template %q", bt.Name())
+			}
+		}
+	}
+	strs := make(map[string]string, len(defaultStrings)+len(b.Strings))
+	for k, v := range defaultStrings {
+		strs[k] = v
+	}
+	for k, v := range b.Strings {
+		strs[k] = v
+	}
+	return t.Funcs(TemplateFuncs(strs)), nil
+}
+
+// LoadBranding loads the branding for an identity provider from the
+// given directory. Templates are read from the "templates"
+// subdirectory, static assets are served from the "static"
+// subdirectory and strings are read from the YAML map in
+// "strings.yaml". Any of these may be absent. If the directory does not
+// exist, an error with a cause satisfying os.IsNotExist is returned.
+func LoadBranding(dir string) (Branding, error) {
+	var b Branding
+	if _, err := os.Stat(dir); err != nil {
+		return b, errgo.Mask(err, os.IsNotExist)
+	}
+	tdir := filepath.Join(dir, "templates")
+	if files, err := filepath.Glob(filepath.Join(tdir, "*")); err != nil {
+		return b, errgo.Mask(err)
+	} else if len(files) > 0 {
+		t, err := template.New("").Funcs(TemplateFuncs(nil)).ParseFiles(files...)
+		if err != nil {
+			return b, errgo.Notef(err, "cannot parse templates")
+		}
+		b.Template = t
+	}
+	sdir := filepath.Join(dir, "static")
+	if fi, err := os.Stat(sdir); err == nil && fi.IsDir() {
+		b.Static = http.Dir(sdir)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "strings.yaml"))
+	if err == nil {
+		if err := yaml.Unmarshal(data, &b.Strings); err != nil {
+			return b, errgo.Notef(err, "cannot parse strings.yaml")
+		}
+	} else if !os.IsNotExist(err) {
+		return b, errgo.Mask(err)
+	}
+	return b, nil
+}
+
+// BrandedFileSystem returns an http.FileSystem that serves files from
+// fs, except for files under /idp/<name>/, which are served from the
+// Static file system of the branding for the named identity provider.
+func BrandedFileSystem(fs http.FileSystem, branding map[string]Branding) http.FileSystem {
+	return brandedFileSystem{
+		fs:       fs,
+		branding: branding,
+	}
+}
+
+type brandedFileSystem struct {
+	fs       http.FileSystem
+	branding map[string]Branding
+}
+
+// Open implements http.FileSystem.Open.
+func (fs brandedFileSystem) Open(name string) (http.File, error) {
+	p := path.Clean("/" + name)
+	if !strings.HasPrefix(p, "/idp/") {
+		if fs.fs == nil {
+			return nil, os.ErrNotExist
+		}
+		return fs.fs.Open(name)
+	}
+	p = strings.TrimPrefix(p, "/idp/")
+	idpName, rest := p, "/"
+	if i := strings.IndexByte(p, '/'); i >= 0 {
+		idpName, rest = p[:i], p[i:]
+	}
+	b, ok := fs.branding[idpName]
+	if !ok || b.Static == nil {
+		return nil, os.ErrNotExist
+	}
+	return b.Static.Open(rest)
+}
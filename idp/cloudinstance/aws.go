@@ -0,0 +1,266 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cloudinstance
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/idputil"
+)
+
+// AWSInteractionMethod is the name of the interaction method used by
+// the AWS instance identity provider.
+const AWSInteractionMethod = "aws_instance"
+
+func init() {
+	idp.Register("aws_instance", func(unmarshal func(interface{}) error) (idp.IdentityProvider, error) {
+		var p AWSParams
+		if err := unmarshal(&p); err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal aws_instance parameters")
+		}
+		if p.Name == "" {
+			p.Name = "aws"
+		}
+		i, err := NewAWSIdentityProvider(p)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid aws_instance parameters")
+		}
+		return i, nil
+	})
+}
+
+// AWSParams holds the parameters of the AWS instance identity provider.
+type AWSParams struct {
+	CommonParams `yaml:",inline"`
+
+	// Certificates holds the PEM encoded AWS certificates used to
+	// verify the signatures of instance identity documents. AWS
+	// publishes a certificate for each region.
+	Certificates string `yaml:"certificates"`
+
+	// Accounts holds the IDs of the AWS accounts whose instances may
+	// log in.
+	Accounts []string `yaml:"accounts"`
+
+	// MaxInstanceAge holds the maximum time since the instance was
+	// launched for which it may log in. Instance identity documents
+	// never change, so this limits the time for which a disclosed
+	// document may be used.
+	MaxInstanceAge time.Duration `yaml:"max-instance-age"`
+
+	// GroupTag, if set, holds the key of an instance tag whose value
+	// holds a comma separated list of groups that the instance is a
+	// member of. Reading tags requires AccessKeyID and
+	// SecretAccessKey to hold credentials that allow the
+	// ec2:DescribeTags action.
+	GroupTag string `yaml:"group-tag"`
+
+	// AccessKeyID and SecretAccessKey hold the AWS credentials used
+	// to read instance tags.
+	AccessKeyID     string `yaml:"access-key-id"`
+	SecretAccessKey string `yaml:"secret-access-key"`
+
+	// EC2Endpoint, if set, holds the URL of the EC2 API endpoint used
+	// to read instance tags. By default the regional endpoint of the
+	// instance is used.
+	EC2Endpoint string `yaml:"ec2-endpoint"`
+}
+
+// NewAWSIdentityProvider creates an identity provider that
+// authenticates AWS EC2 instances using their instance identity
+// documents.
+func NewAWSIdentityProvider(p AWSParams) (idp.IdentityProvider, error) {
+	if len(p.Accounts) == 0 {
+		return nil, errgo.Newf("accounts not specified")
+	}
+	if p.MaxInstanceAge <= 0 {
+		return nil, errgo.Newf("max-instance-age not specified")
+	}
+	if p.GroupTag != "" && (p.AccessKeyID == "" || p.SecretAccessKey == "") {
+		return nil, errgo.Newf("group-tag specified without credentials")
+	}
+	var keys []*rsa.PublicKey
+	rest := []byte(p.Certificates)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid certificate")
+		}
+		key, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, errgo.Newf("certificate does not hold an RSA key")
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errgo.Newf("certificates not specified")
+	}
+	aidp := &awsIdentityProvider{
+		params: p,
+		keys:   keys,
+		now:    time.Now,
+	}
+	if p.GroupTag != "" {
+		aidp.ec2 = &ec2Client{
+			endpoint:        p.EC2Endpoint,
+			accessKeyID:     p.AccessKeyID,
+			secretAccessKey: p.SecretAccessKey,
+			client:          http.DefaultClient,
+			now:             time.Now,
+		}
+	}
+	aidp.identityProvider = identityProvider{
+		params:            p.CommonParams,
+		interactionMethod: AWSInteractionMethod,
+		login:             aidp.login,
+	}
+	return aidp, nil
+}
+
+// awsIdentityProvider is an identity provider that authenticates AWS
+// EC2 instances.
+type awsIdentityProvider struct {
+	identityProvider
+	params AWSParams
+	keys   []*rsa.PublicKey
+	ec2    *ec2Client
+	now    func() time.Time
+}
+
+// AWSLoginRequest is the request sent by an instance to log in.
+type AWSLoginRequest struct {
+	httprequest.Route `httprequest:"POST"`
+	Body              AWSLoginBody `httprequest:",body"`
+}
+
+// AWSLoginBody holds the instance identity document of an instance
+// and its signature, as returned by the instance metadata service at
+// /latest/dynamic/instance-identity/document and
+// /latest/dynamic/instance-identity/signature.
+//
+// Nonce holds a secret chosen by the instance. It is recorded when
+// the instance first logs in, and every later login by the instance
+// must use the same nonce, so that a copy of the instance identity
+// document cannot be used to log in as an instance that has already
+// logged in.
+type AWSLoginBody struct {
+	Document  string `json:"document"`
+	Signature string `json:"signature"`
+	Nonce     string `json:"nonce"`
+}
+
+// awsIdentityDocument holds the fields of an instance identity
+// document that are used.
+type awsIdentityDocument struct {
+	AccountID   string    `json:"accountId"`
+	InstanceID  string    `json:"instanceId"`
+	Region      string    `json:"region"`
+	PendingTime time.Time `json:"pendingTime"`
+}
+
+func (idp *awsIdentityProvider) login(ctx context.Context, req *http.Request) (*instanceIdentity, error) {
+	var lr AWSLoginRequest
+	if err := httprequest.Unmarshal(idputil.RequestParams(ctx, nil, req), &lr); err != nil {
+		return nil, errgo.WithCausef(err, params.ErrBadRequest, "cannot unmarshal login request")
+	}
+	if lr.Body.Nonce == "" {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "nonce not specified")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lr.Body.Signature))
+	if err != nil {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid signature")
+	}
+	if !idp.verify([]byte(lr.Body.Document), sig) {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "invalid instance identity document signature")
+	}
+	var doc awsIdentityDocument
+	if err := json.Unmarshal([]byte(lr.Body.Document), &doc); err != nil {
+		return nil, errgo.WithCausef(err, params.ErrBadRequest, "invalid instance identity document")
+	}
+	if doc.InstanceID == "" || doc.AccountID == "" {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid instance identity document")
+	}
+	if !contains(idp.params.Accounts, doc.AccountID) {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "account %q not allowed", doc.AccountID)
+	}
+	expires := doc.PendingTime.Add(idp.params.MaxInstanceAge)
+	if idp.now().After(expires) {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "instance launched too long ago")
+	}
+	if err := idp.checkNonce(ctx, doc.AccountID+"/"+doc.InstanceID, lr.Body.Nonce, expires); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
+	}
+	groups := []string{doc.AccountID}
+	if idp.ec2 != nil {
+		tags, err := idp.ec2.instanceTags(ctx, doc.Region, doc.InstanceID)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot get instance tags")
+		}
+		for _, g := range strings.Split(tags[idp.params.GroupTag], ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				groups = append(groups, g)
+			}
+		}
+	}
+	return &instanceIdentity{
+		id:     doc.AccountID + "/" + doc.InstanceID,
+		name:   doc.InstanceID,
+		groups: groups,
+	}, nil
+}
+
+var errNonceMismatch = errgo.New("nonce mismatch")
+
+// checkNonce checks that the given nonce is the one used when the
+// instance with the given ID first logged in, recording it if this is
+// the first login. The nonce is kept until the given time, after which
+// the instance can no longer log in.
+func (idp *awsIdentityProvider) checkNonce(ctx context.Context, id, nonce string, expires time.Time) error {
+	err := idp.initParams.KeyValueStore.Update(ctx, "nonce-"+id, expires, func(old []byte) ([]byte, error) {
+		if old == nil {
+			return []byte(nonce), nil
+		}
+		if subtle.ConstantTimeCompare(old, []byte(nonce)) != 1 {
+			return nil, errNonceMismatch
+		}
+		return old, nil
+	})
+	if errgo.Cause(err) == errNonceMismatch {
+		return errgo.WithCausef(nil, params.ErrUnauthorized, "nonce does not match the first login of instance %q", id)
+	}
+	return errgo.Mask(err)
+}
+
+// verify reports whether sig is a signature of doc by one of the
+// configured AWS keys.
+func (idp *awsIdentityProvider) verify(doc, sig []byte) bool {
+	sum := sha256.Sum256(doc)
+	for _, key := range idp.keys {
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,317 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cloudinstance_test
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	"gopkg.in/yaml.v2"
+
+	"github.com/CanonicalLtd/candid/config"
+	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/cloudinstance"
+	"github.com/CanonicalLtd/candid/idp/idptest"
+	"github.com/CanonicalLtd/candid/internal/candidtest"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+const idpPrefix = "https://idp.example.com"
+
+type awsSuite struct {
+	idptest *idptest.Fixture
+	key     *rsa.PrivateKey
+	cert    string
+}
+
+func TestAWS(t *testing.T) {
+	qtsuite.Run(qt.New(t), &awsSuite{})
+}
+
+func (s *awsSuite) Init(c *qt.C) {
+	s.idptest = idptest.NewFixture(c, candidtest.NewStore())
+	var err error
+	s.key, err = rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, qt.Equals, nil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Amazon Web Services LLC"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &s.key.PublicKey, s.key)
+	c.Assert(err, qt.Equals, nil)
+	s.cert = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func (s *awsSuite) setupIdp(c *qt.C, p cloudinstance.AWSParams) idp.IdentityProvider {
+	if p.Name == "" {
+		p.Name = "aws"
+	}
+	p.Certificates = s.cert
+	if p.Accounts == nil {
+		p.Accounts = []string{"123456789012"}
+	}
+	if p.MaxInstanceAge == 0 {
+		p.MaxInstanceAge = time.Hour
+	}
+	i, err := cloudinstance.NewAWSIdentityProvider(p)
+	c.Assert(err, qt.Equals, nil)
+	err = i.Init(context.Background(), s.idptest.InitParams(c, idpPrefix))
+	c.Assert(err, qt.Equals, nil)
+	return i
+}
+
+// loginRequest returns a login request holding a signed identity
+// document with the given fields and the given nonce.
+func (s *awsSuite) loginRequest(c *qt.C, path, nonce string, doc map[string]interface{}) *http.Request {
+	docData, err := json.MarshalIndent(doc, "", "  ")
+	c.Assert(err, qt.Equals, nil)
+	sum := sha256.Sum256(docData)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, sum[:])
+	c.Assert(err, qt.Equals, nil)
+	body, err := json.Marshal(cloudinstance.AWSLoginBody{
+		Document:  string(docData),
+		Signature: base64.StdEncoding.EncodeToString(sig),
+		Nonce:     nonce,
+	})
+	c.Assert(err, qt.Equals, nil)
+	return postRequest(c, path, body)
+}
+
+func (s *awsSuite) TestInteractive(c *qt.C) {
+	i := s.setupIdp(c, cloudinstance.AWSParams{})
+	c.Assert(i.Interactive(), qt.Equals, false)
+	c.Assert(i.Name(), qt.Equals, "aws")
+}
+
+func (s *awsSuite) TestLogin(c *qt.C) {
+	i := s.setupIdp(c, cloudinstance.AWSParams{
+		CommonParams: cloudinstance.CommonParams{
+			Name:   "aws",
+			Domain: "aws",
+		},
+	})
+	req := s.loginRequest(c, "/login", "nonce-1", map[string]interface{}{
+		"accountId":   "123456789012",
+		"instanceId":  "i-0123456789abcdef0",
+		"region":      "eu-west-2",
+		"pendingTime": time.Now().Format(time.RFC3339),
+	})
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), req)
+	s.idptest.AssertLoginSuccess(c, "i-0123456789abcdef0@aws")
+	s.idptest.Store.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("aws", "123456789012/i-0123456789abcdef0"),
+		Username:   "i-0123456789abcdef0@aws",
+		ProviderInfo: map[string][]string{
+			"groups": {"123456789012@aws"},
+		},
+	})
+}
+
+func (s *awsSuite) TestInteract(c *qt.C) {
+	i := s.setupIdp(c, cloudinstance.AWSParams{})
+	req := s.loginRequest(c, "/interact", "nonce-1", map[string]interface{}{
+		"accountId":   "123456789012",
+		"instanceId":  "i-0123456789abcdef0",
+		"pendingTime": time.Now().Format(time.RFC3339),
+	})
+	rr := httptest.NewRecorder()
+	i.Handle(s.idptest.Ctx, rr, req)
+	c.Assert(rr.Code, qt.Equals, http.StatusOK, qt.Commentf("%s", rr.Body))
+	var resp cloudinstance.LoginResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &resp)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(resp.DischargeToken, qt.Not(qt.IsNil))
+}
+
+func (s *awsSuite) TestLoginInvalidSignature(c *qt.C) {
+	i := s.setupIdp(c, cloudinstance.AWSParams{})
+	body, err := json.Marshal(cloudinstance.AWSLoginBody{
+		Document:  `{"accountId":"123456789012","instanceId":"i-1"}`,
+		Signature: base64.StdEncoding.EncodeToString([]byte("not a signature")),
+		Nonce:     "nonce-1",
+	})
+	c.Assert(err, qt.Equals, nil)
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), postRequest(c, "/login", body))
+	s.idptest.AssertLoginFailureMatches(c, `invalid instance identity document signature`)
+}
+
+func (s *awsSuite) TestLoginAccountNotAllowed(c *qt.C) {
+	i := s.setupIdp(c, cloudinstance.AWSParams{})
+	req := s.loginRequest(c, "/login", "nonce-1", map[string]interface{}{
+		"accountId":   "210987654321",
+		"instanceId":  "i-0123456789abcdef0",
+		"pendingTime": time.Now().Format(time.RFC3339),
+	})
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), req)
+	s.idptest.AssertLoginFailureMatches(c, `account "210987654321" not allowed`)
+}
+
+func (s *awsSuite) TestLoginInstanceTooOld(c *qt.C) {
+	i := s.setupIdp(c, cloudinstance.AWSParams{
+		MaxInstanceAge: time.Hour,
+	})
+	req := s.loginRequest(c, "/login", "nonce-1", map[string]interface{}{
+		"accountId":   "123456789012",
+		"instanceId":  "i-0123456789abcdef0",
+		"pendingTime": time.Now().Add(-2 * time.Hour).Format(time.RFC3339),
+	})
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), req)
+	s.idptest.AssertLoginFailureMatches(c, `instance launched too long ago`)
+}
+
+func (s *awsSuite) TestLoginNoPendingTime(c *qt.C) {
+	i := s.setupIdp(c, cloudinstance.AWSParams{})
+	req := s.loginRequest(c, "/login", "nonce-1", map[string]interface{}{
+		"accountId":  "123456789012",
+		"instanceId": "i-0123456789abcdef0",
+	})
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), req)
+	s.idptest.AssertLoginFailureMatches(c, `instance launched too long ago`)
+}
+
+func (s *awsSuite) TestLoginNoNonce(c *qt.C) {
+	i := s.setupIdp(c, cloudinstance.AWSParams{})
+	req := s.loginRequest(c, "/login", "", map[string]interface{}{
+		"accountId":   "123456789012",
+		"instanceId":  "i-0123456789abcdef0",
+		"pendingTime": time.Now().Format(time.RFC3339),
+	})
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), req)
+	s.idptest.AssertLoginFailureMatches(c, `nonce not specified`)
+}
+
+func (s *awsSuite) TestLoginNonce(c *qt.C) {
+	i := s.setupIdp(c, cloudinstance.AWSParams{})
+	doc := map[string]interface{}{
+		"accountId":   "123456789012",
+		"instanceId":  "i-0123456789abcdef0",
+		"pendingTime": time.Now().Format(time.RFC3339),
+	}
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), s.loginRequest(c, "/login", "nonce-1", doc))
+	s.idptest.AssertLoginSuccess(c, "i-0123456789abcdef0")
+
+	// A second login with the same nonce succeeds.
+	s.idptest.Reset()
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), s.loginRequest(c, "/login", "nonce-1", doc))
+	s.idptest.AssertLoginSuccess(c, "i-0123456789abcdef0")
+
+	// A login replaying the same document with a different
+	// nonce fails.
+	s.idptest.Reset()
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), s.loginRequest(c, "/login", "nonce-2", doc))
+	s.idptest.AssertLoginFailureMatches(c, `nonce does not match the first login of instance "123456789012/i-0123456789abcdef0"`)
+}
+
+func (s *awsSuite) TestLoginGroupTag(c *qt.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		q := req.URL.Query()
+		if q.Get("Action") != "DescribeTags" || q.Get("Filter.1.Value.1") != "i-0123456789abcdef0" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `<DescribeTagsResponse>
+  <tagSet>
+    <item><resourceId>i-0123456789abcdef0</resourceId><key>Name</key><value>web</value></item>
+    <item><resourceId>i-0123456789abcdef0</resourceId><key>candid-groups</key><value>web, deploy</value></item>
+  </tagSet>
+</DescribeTagsResponse>`)
+	}))
+	defer srv.Close()
+	i := s.setupIdp(c, cloudinstance.AWSParams{
+		GroupTag:        "candid-groups",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+		EC2Endpoint:     srv.URL,
+	})
+	req := s.loginRequest(c, "/login", "nonce-1", map[string]interface{}{
+		"accountId":   "123456789012",
+		"instanceId":  "i-0123456789abcdef0",
+		"region":      "eu-west-2",
+		"pendingTime": time.Now().Format(time.RFC3339),
+	})
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), req)
+	s.idptest.AssertLoginSuccess(c, "i-0123456789abcdef0")
+	groups, err := i.GetGroups(s.idptest.Ctx, s.idptest.LoginIdentity())
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups, qt.DeepEquals, []string{"123456789012", "web", "deploy"})
+}
+
+func (s *awsSuite) TestRegisterConfig(c *qt.C) {
+	input := `
+identity-providers:
+ - type: aws_instance
+   accounts: ["123456789012"]
+   max-instance-age: 10m
+   certificates: |
+` + indent(s.cert, "     ")
+	var conf config.Config
+	err := yaml.Unmarshal([]byte(input), &conf)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(conf.IdentityProviders, qt.HasLen, 1)
+	c.Assert(conf.IdentityProviders[0].Name(), qt.Equals, "aws")
+}
+
+func (s *awsSuite) TestRegisterConfigNoAccounts(c *qt.C) {
+	input := `
+identity-providers:
+ - type: aws_instance
+   max-instance-age: 10m
+   certificates: |
+` + indent(s.cert, "     ")
+	var conf config.Config
+	err := yaml.Unmarshal([]byte(input), &conf)
+	c.Assert(err, qt.ErrorMatches, `cannot unmarshal aws_instance configuration: invalid aws_instance parameters: accounts not specified`)
+}
+
+func (s *awsSuite) TestRegisterConfigNoMaxInstanceAge(c *qt.C) {
+	input := `
+identity-providers:
+ - type: aws_instance
+   accounts: ["123456789012"]
+   certificates: |
+` + indent(s.cert, "     ")
+	var conf config.Config
+	err := yaml.Unmarshal([]byte(input), &conf)
+	c.Assert(err, qt.ErrorMatches, `cannot unmarshal aws_instance configuration: invalid aws_instance parameters: max-instance-age not specified`)
+}
+
+func postRequest(c *qt.C, path string, body []byte) *http.Request {
+	req, err := http.NewRequest("POST", idpPrefix+path+"?id=1", bytes.NewReader(body))
+	c.Assert(err, qt.Equals, nil)
+	req.Header.Set("Content-Type", "application/json")
+	req.ParseForm()
+	return req
+}
+
+func indent(s, prefix string) string {
+	var out string
+	for _, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+		out += prefix + line + "\n"
+	}
+	return out
+}
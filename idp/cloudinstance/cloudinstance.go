@@ -0,0 +1,212 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package cloudinstance contains identity providers that authenticate
+// cloud compute instances using the signed identity documents provided
+// by their cloud's metadata service, so that workloads running on them
+// can log in without being given agent keys.
+package cloudinstance
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/idputil"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// CommonParams holds the parameters common to all cloud instance
+// identity providers.
+type CommonParams struct {
+	// Name is the name that will be given to the identity provider.
+	Name string `yaml:"name"`
+
+	// Description is the description of the IDP shown to the user on
+	// the IDP selection page.
+	Description string `yaml:"description"`
+
+	// Icon contains the URL or path of an icon.
+	Icon string `yaml:"icon"`
+
+	// Domain is the domain with which all identities created by this
+	// identity provider will be tagged (not including the @ separator).
+	Domain string `yaml:"domain"`
+
+	// Hidden is set if the IDP should be hidden from interactive
+	// prompts.
+	Hidden bool `yaml:"hidden"`
+}
+
+// A loginFunc authenticates the instance that made the given login
+// request, returning the identity it logs in as.
+type loginFunc func(ctx context.Context, req *http.Request) (*instanceIdentity, error)
+
+// instanceIdentity holds the details of an authenticated instance.
+type instanceIdentity struct {
+	// id holds a unique identifier for the instance.
+	id string
+
+	// name holds the unqualified username of the instance.
+	name string
+
+	// groups holds the groups the instance is a member of.
+	groups []string
+}
+
+// identityProvider holds the implementation common to the cloud
+// instance identity providers.
+type identityProvider struct {
+	params            CommonParams
+	interactionMethod string
+	initParams        idp.InitParams
+	login             loginFunc
+}
+
+// Name implements idp.IdentityProvider.Name.
+func (idp *identityProvider) Name() string {
+	return idp.params.Name
+}
+
+// Domain implements idp.IdentityProvider.Domain.
+func (idp *identityProvider) Domain() string {
+	return idp.params.Domain
+}
+
+// Description implements idp.IdentityProvider.Description.
+func (idp *identityProvider) Description() string {
+	if idp.params.Description == "" {
+		return idp.params.Name
+	}
+	return idp.params.Description
+}
+
+// IconURL returns the URL of an icon for the identity provider.
+func (idp *identityProvider) IconURL() string {
+	return idputil.ServiceURL(idp.initParams.Location, idp.params.Icon)
+}
+
+// Interactive implements idp.IdentityProvider.Interactive.
+func (*identityProvider) Interactive() bool {
+	return false
+}
+
+// Hidden implements idp.IdentityProvider.Hidden.
+func (idp *identityProvider) Hidden() bool {
+	return idp.params.Hidden
+}
+
+// Init implements idp.IdentityProvider.Init.
+func (idp *identityProvider) Init(_ context.Context, params idp.InitParams) error {
+	idp.initParams = params
+	return nil
+}
+
+// URL implements idp.IdentityProvider.URL.
+func (idp *identityProvider) URL(state string) string {
+	return idputil.RedirectURL(idp.initParams.URLPrefix, "/login", state)
+}
+
+// SetInteraction implements idp.IdentityProvider.SetInteraction.
+func (idp *identityProvider) SetInteraction(ierr *httpbakery.Error, dischargeID string) {
+	ierr.SetInteraction(idp.interactionMethod, InteractionInfo{
+		URL: idputil.URL(idp.initParams.URLPrefix, "/interact", dischargeID),
+	})
+}
+
+// GetGroups implements idp.IdentityProvider.GetGroups.
+func (*identityProvider) GetGroups(_ context.Context, identity *store.Identity) ([]string, error) {
+	return identity.ProviderInfo["groups"], nil
+}
+
+// Handle implements idp.IdentityProvider.Handle.
+func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	user, err := idp.loginInstance(ctx, req)
+	if err != nil {
+		idp.initParams.VisitCompleter.Failure(ctx, w, req, idputil.DischargeID(req), err)
+		return
+	}
+	if strings.TrimPrefix(req.URL.Path, idp.initParams.URLPrefix) == "/interact" {
+		dt, err := idp.initParams.DischargeTokenCreator.DischargeToken(ctx, user)
+		if err != nil {
+			idp.initParams.VisitCompleter.Failure(ctx, w, req, idputil.DischargeID(req), err)
+			return
+		}
+		httprequest.WriteJSON(w, http.StatusOK, LoginResponse{
+			DischargeToken: dt,
+		})
+	} else {
+		idp.initParams.VisitCompleter.Success(ctx, w, req, idputil.DischargeID(req), user)
+	}
+}
+
+// loginInstance authenticates the instance making the given request
+// and updates its identity.
+func (idp *identityProvider) loginInstance(ctx context.Context, req *http.Request) (*store.Identity, error) {
+	if req.Method != "POST" {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "unsupported method %q", req.Method)
+	}
+	inst, err := idp.login(ctx, req)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest), errgo.Is(params.ErrUnauthorized))
+	}
+	groups := make([]string, len(inst.groups))
+	for i, g := range inst.groups {
+		groups[i] = idp.qualifiedName(g)
+	}
+	user := &store.Identity{
+		ProviderID: store.MakeProviderIdentity(idp.Name(), inst.id),
+		Username:   idp.qualifiedName(inst.name),
+		ProviderInfo: map[string][]string{
+			"groups": groups,
+		},
+	}
+	if err := idp.initParams.Store.UpdateIdentity(
+		ctx,
+		user,
+		store.Update{
+			store.Username:     store.Set,
+			store.ProviderInfo: store.Set,
+		},
+	); err != nil {
+		return nil, errgo.Notef(err, "cannot update identity")
+	}
+	return user, nil
+}
+
+// qualifiedName returns the given name qualified as appropriate with
+// the provider's configured domain.
+func (idp *identityProvider) qualifiedName(name string) string {
+	if idp.params.Domain != "" {
+		return name + "@" + idp.params.Domain
+	}
+	return name
+}
+
+// InteractionInfo is the interaction info for the cloud instance
+// interaction methods. To log in the client POSTs its login request to
+// URL.
+type InteractionInfo struct {
+	URL string `json:"url"`
+}
+
+// LoginResponse is the response sent for a successful login.
+type LoginResponse struct {
+	DischargeToken *httpbakery.DischargeToken `json:"discharge-token"`
+}
+
+// contains reports whether ss contains s.
+func contains(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cloudinstance
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// ec2APIVersion holds the version of the EC2 API that is used.
+const ec2APIVersion = "2016-11-15"
+
+// ec2Client is a minimal client for the EC2 query API, sufficient to
+// read instance tags.
+type ec2Client struct {
+	endpoint        string
+	accessKeyID     string
+	secretAccessKey string
+	client          *http.Client
+	now             func() time.Time
+}
+
+// describeTagsResponse holds the parts of the response to a
+// DescribeTags request that are used.
+type describeTagsResponse struct {
+	Tags []struct {
+		Key   string `xml:"key"`
+		Value string `xml:"value"`
+	} `xml:"tagSet>item"`
+	NextToken string `xml:"nextToken"`
+}
+
+// instanceTags returns the tags of the given instance.
+func (c *ec2Client) instanceTags(ctx context.Context, region, instanceID string) (map[string]string, error) {
+	tags := make(map[string]string)
+	nextToken := ""
+	for {
+		q := url.Values{
+			"Action":           {"DescribeTags"},
+			"Version":          {ec2APIVersion},
+			"Filter.1.Name":    {"resource-id"},
+			"Filter.1.Value.1": {instanceID},
+		}
+		if nextToken != "" {
+			q.Set("NextToken", nextToken)
+		}
+		var resp describeTagsResponse
+		if err := c.do(ctx, region, q, &resp); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		for _, t := range resp.Tags {
+			tags[t.Key] = t.Value
+		}
+		if resp.NextToken == "" {
+			return tags, nil
+		}
+		nextToken = resp.NextToken
+	}
+}
+
+// do makes a signed GET request to the EC2 API in the given region and
+// unmarshals the XML response into v.
+func (c *ec2Client) do(ctx context.Context, region string, q url.Values, v interface{}) error {
+	endpoint := c.endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://ec2.%s.amazonaws.com/", region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	u.RawQuery = awsQueryString(q)
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	c.sign(req, region)
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Code    string `xml:"Errors>Error>Code"`
+			Message string `xml:"Errors>Error>Message"`
+		}
+		if err := xml.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Code == "" {
+			return errgo.Newf("EC2 request failed: %s", resp.Status)
+		}
+		return errgo.Newf("EC2 request failed: %s: %s", errResp.Code, errResp.Message)
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errgo.Notef(err, "cannot decode EC2 response")
+	}
+	return nil
+}
+
+// sign adds an AWS signature version 4 authorization header to the
+// given request, which must not have a body.
+func (c *ec2Client) sign(req *http.Request, region string) {
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		"/",
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-date:" + amzDate,
+		"",
+		"host;x-amz-date",
+		hexSHA256(""),
+	}, "\n")
+	scope := date + "/" + region + "/ec2/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSHA256(canonicalRequest),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+c.secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "ec2")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=host;x-amz-date, Signature=%s",
+		c.accessKeyID,
+		scope,
+		sig,
+	))
+}
+
+// awsQueryString encodes the given query parameters in the canonical
+// form required by AWS signatures: sorted by key and percent encoded
+// as described in RFC 3986.
+func awsQueryString(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func awsEscape(s string) string {
+	s = url.QueryEscape(s)
+	s = strings.Replace(s, "+", "%20", -1)
+	return strings.Replace(s, "%7E", "~", -1)
+}
+
+func hexSHA256(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
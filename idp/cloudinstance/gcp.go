@@ -0,0 +1,173 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cloudinstance
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/idputil"
+)
+
+// GCPInteractionMethod is the name of the interaction method used by
+// the GCP instance identity provider.
+const GCPInteractionMethod = "gcp_instance"
+
+const (
+	// googleIssuer is the issuer of Google identity tokens.
+	googleIssuer = "https://accounts.google.com"
+
+	// googleCertsURL is the location of the keys used to sign Google
+	// identity tokens.
+	googleCertsURL = "https://www.googleapis.com/oauth2/v3/certs"
+)
+
+func init() {
+	idp.Register("gcp_instance", func(unmarshal func(interface{}) error) (idp.IdentityProvider, error) {
+		var p GCPParams
+		if err := unmarshal(&p); err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal gcp_instance parameters")
+		}
+		if p.Name == "" {
+			p.Name = "gcp"
+		}
+		i, err := NewGCPIdentityProvider(p)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid gcp_instance parameters")
+		}
+		return i, nil
+	})
+}
+
+// GCPParams holds the parameters of the GCP instance identity provider.
+type GCPParams struct {
+	CommonParams `yaml:",inline"`
+
+	// Audience holds the audience that instance identity tokens
+	// must be requested for. If this is empty the location of the
+	// identity server is used.
+	Audience string `yaml:"audience"`
+
+	// Projects holds the IDs of the GCP projects whose instances
+	// may log in.
+	Projects []string `yaml:"projects"`
+
+	// CertsURL holds the location of the keys used to sign identity
+	// tokens. It is only intended to be set for testing.
+	CertsURL string `yaml:"-"`
+
+	// Issuer holds the issuer of identity tokens. It is only
+	// intended to be set for testing.
+	Issuer string `yaml:"-"`
+}
+
+// NewGCPIdentityProvider creates an identity provider that
+// authenticates GCP compute engine instances using their instance
+// identity tokens.
+func NewGCPIdentityProvider(p GCPParams) (idp.IdentityProvider, error) {
+	if len(p.Projects) == 0 {
+		return nil, errgo.Newf("projects not specified")
+	}
+	if p.CertsURL == "" {
+		p.CertsURL = googleCertsURL
+	}
+	if p.Issuer == "" {
+		p.Issuer = googleIssuer
+	}
+	gidp := &gcpIdentityProvider{
+		params: p,
+		keys:   oidc.NewRemoteKeySet(context.Background(), p.CertsURL),
+		now:    time.Now,
+	}
+	gidp.identityProvider = identityProvider{
+		params:            p.CommonParams,
+		interactionMethod: GCPInteractionMethod,
+		login:             gidp.login,
+	}
+	return gidp, nil
+}
+
+// gcpIdentityProvider is an identity provider that authenticates GCP
+// compute engine instances.
+type gcpIdentityProvider struct {
+	identityProvider
+	params GCPParams
+	keys   oidc.KeySet
+	now    func() time.Time
+}
+
+// GCPLoginRequest is the request sent by an instance to log in.
+type GCPLoginRequest struct {
+	httprequest.Route `httprequest:"POST"`
+	Body              GCPLoginBody `httprequest:",body"`
+}
+
+// GCPLoginBody holds an instance identity token, as returned by the
+// metadata service at
+// /computeMetadata/v1/instance/service-accounts/default/identity with
+// format=full and the configured audience.
+type GCPLoginBody struct {
+	Token string `json:"token"`
+}
+
+// gcpClaims holds the claims of an instance identity token that are
+// used.
+type gcpClaims struct {
+	Email  string `json:"email"`
+	Google struct {
+		ComputeEngine struct {
+			ProjectID    string `json:"project_id"`
+			InstanceID   string `json:"instance_id"`
+			InstanceName string `json:"instance_name"`
+		} `json:"compute_engine"`
+	} `json:"google"`
+}
+
+func (idp *gcpIdentityProvider) login(ctx context.Context, req *http.Request) (*instanceIdentity, error) {
+	var lr GCPLoginRequest
+	if err := httprequest.Unmarshal(idputil.RequestParams(ctx, nil, req), &lr); err != nil {
+		return nil, errgo.WithCausef(err, params.ErrBadRequest, "cannot unmarshal login request")
+	}
+	aud := idp.params.Audience
+	if aud == "" {
+		aud = idp.initParams.Location
+	}
+	verifier := oidc.NewVerifier(idp.params.Issuer, idp.keys, &oidc.Config{
+		ClientID: aud,
+		Now:      idp.now,
+	})
+	tok, err := verifier.Verify(ctx, lr.Body.Token)
+	if err != nil {
+		return nil, errgo.WithCausef(err, params.ErrUnauthorized, "invalid identity token")
+	}
+	var claims gcpClaims
+	if err := tok.Claims(&claims); err != nil {
+		return nil, errgo.WithCausef(err, params.ErrBadRequest, "invalid identity token")
+	}
+	ce := claims.Google.ComputeEngine
+	if ce.InstanceID == "" || ce.ProjectID == "" {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "identity token does not identify an instance")
+	}
+	if !contains(idp.params.Projects, ce.ProjectID) {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "project %q not allowed", ce.ProjectID)
+	}
+	groups := []string{ce.ProjectID}
+	if claims.Email != "" {
+		groups = append(groups, claims.Email)
+	}
+	// Instance names may be reused, so the instance ID is included
+	// in the username.
+	return &instanceIdentity{
+		id:     ce.ProjectID + "/" + ce.InstanceID,
+		name:   ce.InstanceName + "." + ce.InstanceID,
+		groups: groups,
+	}, nil
+}
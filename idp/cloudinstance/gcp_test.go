@@ -0,0 +1,157 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cloudinstance_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+
+	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/cloudinstance"
+	"github.com/CanonicalLtd/candid/idp/idptest"
+	"github.com/CanonicalLtd/candid/internal/candidtest"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+const (
+	testIssuer   = "https://accounts.google.com"
+	testAudience = "https://candid.example.com"
+)
+
+type gcpSuite struct {
+	idptest *idptest.Fixture
+	key     *rsa.PrivateKey
+	srv     *httptest.Server
+}
+
+func TestGCP(t *testing.T) {
+	qtsuite.Run(qt.New(t), &gcpSuite{})
+}
+
+func (s *gcpSuite) Init(c *qt.C) {
+	s.idptest = idptest.NewFixture(c, candidtest.NewStore())
+	var err error
+	s.key, err = rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, qt.Equals, nil)
+	s.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "key-1",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+			}},
+		})
+	}))
+	c.Defer(s.srv.Close)
+}
+
+func (s *gcpSuite) setupIdp(c *qt.C) idp.IdentityProvider {
+	i, err := cloudinstance.NewGCPIdentityProvider(cloudinstance.GCPParams{
+		CommonParams: cloudinstance.CommonParams{
+			Name: "gcp",
+		},
+		Audience: testAudience,
+		Projects: []string{"my-project"},
+		CertsURL: s.srv.URL,
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = i.Init(context.Background(), s.idptest.InitParams(c, idpPrefix))
+	c.Assert(err, qt.Equals, nil)
+	return i
+}
+
+// token returns an identity token holding the standard claims for
+// an instance in the given project, modified by the given claims.
+func (s *gcpSuite) token(c *qt.C, project string, claims map[string]interface{}) []byte {
+	all := map[string]interface{}{
+		"iss":   testIssuer,
+		"aud":   testAudience,
+		"sub":   "112233445566778899",
+		"email": "worker@my-project.iam.gserviceaccount.com",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"google": map[string]interface{}{
+			"compute_engine": map[string]interface{}{
+				"project_id":    project,
+				"instance_id":   "4567",
+				"instance_name": "worker-1",
+				"zone":          "europe-west2-a",
+			},
+		},
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": "key-1", "typ": "JWT"})
+	c.Assert(err, qt.Equals, nil)
+	payload, err := json.Marshal(all)
+	c.Assert(err, qt.Equals, nil)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, sum[:])
+	c.Assert(err, qt.Equals, nil)
+	body, err := json.Marshal(cloudinstance.GCPLoginBody{
+		Token: input + "." + base64.RawURLEncoding.EncodeToString(sig),
+	})
+	c.Assert(err, qt.Equals, nil)
+	return body
+}
+
+func (s *gcpSuite) TestLogin(c *qt.C) {
+	i := s.setupIdp(c)
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), postRequest(c, "/login", s.token(c, "my-project", nil)))
+	s.idptest.AssertLoginSuccess(c, "worker-1.4567")
+	s.idptest.Store.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("gcp", "my-project/4567"),
+		Username:   "worker-1.4567",
+		ProviderInfo: map[string][]string{
+			"groups": {"my-project", "worker@my-project.iam.gserviceaccount.com"},
+		},
+	})
+}
+
+func (s *gcpSuite) TestLoginProjectNotAllowed(c *qt.C) {
+	i := s.setupIdp(c)
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), postRequest(c, "/login", s.token(c, "other-project", nil)))
+	s.idptest.AssertLoginFailureMatches(c, `project "other-project" not allowed`)
+}
+
+func (s *gcpSuite) TestLoginWrongAudience(c *qt.C) {
+	i := s.setupIdp(c)
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), postRequest(c, "/login", s.token(c, "my-project", map[string]interface{}{
+		"aud": "https://other.example.com",
+	})))
+	s.idptest.AssertLoginFailureMatches(c, `invalid identity token: oidc: expected audience .*`)
+}
+
+func (s *gcpSuite) TestLoginExpired(c *qt.C) {
+	i := s.setupIdp(c)
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), postRequest(c, "/login", s.token(c, "my-project", map[string]interface{}{
+		"exp": time.Now().Add(-time.Hour).Unix(),
+	})))
+	s.idptest.AssertLoginFailureMatches(c, `invalid identity token: oidc: token is expired .*`)
+}
+
+func (s *gcpSuite) TestLoginNotInstance(c *qt.C) {
+	i := s.setupIdp(c)
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), postRequest(c, "/login", s.token(c, "my-project", map[string]interface{}{
+		"google": map[string]interface{}{},
+	})))
+	s.idptest.AssertLoginFailureMatches(c, `identity token does not identify an instance`)
+}
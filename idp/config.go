@@ -2,6 +2,8 @@ package idp
 
 import (
 	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/internal/typedyaml"
 )
 
 // idps holds the registry of identity providers, indexed by idp type.
@@ -15,21 +17,19 @@ type Config struct {
 }
 
 func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	var t struct {
-		Type string
-	}
-	if err := unmarshal(&t); err != nil {
+	m, err := typedyaml.Unmarshal(unmarshal)
+	if err != nil {
 		return errgo.Notef(err, "cannot unmarshal identity provider type")
 	}
-	if idpf, ok := idps[t.Type]; ok {
-		provider, err := idpf(unmarshal)
+	if idpf, ok := idps[m.Type]; ok {
+		provider, err := idpf(m.Unmarshal)
 		if err != nil {
-			return errgo.Notef(err, "cannot unmarshal %s configuration", t.Type)
+			return errgo.Notef(err, "cannot unmarshal %s configuration", m.Type)
 		}
 		c.IdentityProvider = provider
-		return nil
+		return m.Err()
 	}
-	return errgo.Newf("unrecognised identity provider type %q", t.Type)
+	return errgo.Newf("unrecognised identity provider type %q", m.Type)
 }
 
 // Register is used by identity providers to register a function that
@@ -0,0 +1,190 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package google
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	oidc "github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jwt"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+)
+
+const (
+	defaultDirectoryURL = "https://admin.googleapis.com"
+	defaultTokenURL     = "https://oauth2.googleapis.com/token"
+
+	// directoryScope is the scope required to list the groups a
+	// user is a member of.
+	directoryScope = "https://www.googleapis.com/auth/admin.directory.group.readonly"
+)
+
+// hostedDomainClaims contains the claims in a Google ID token that
+// identify the account's G Suite domain.
+type hostedDomainClaims struct {
+	HostedDomain string `json:"hd"`
+}
+
+// hostedDomainChecker returns a function suitable for use as an
+// openid.OpenIDConnectParams.CheckFunc that only allows accounts in
+// one of the given hosted domains to log in.
+func hostedDomainChecker(domains []string) func(context.Context, *oidc.IDToken) error {
+	return func(_ context.Context, id *oidc.IDToken) error {
+		var claims hostedDomainClaims
+		if err := id.Claims(&claims); err != nil {
+			return errgo.Mask(err)
+		}
+		return errgo.Mask(checkHostedDomain(domains, claims.HostedDomain))
+	}
+}
+
+// checkHostedDomain checks that hd is one of the given domains.
+func checkHostedDomain(domains []string, hd string) error {
+	if hd == "" {
+		return errgo.Newf("account is not in a permitted domain")
+	}
+	for _, d := range domains {
+		if strings.EqualFold(d, hd) {
+			return nil
+		}
+	}
+	return errgo.Newf("account domain %q is not permitted", hd)
+}
+
+// serviceAccountKey holds the fields of a service account key file
+// that are required to obtain access tokens.
+type serviceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// A directoryClient retrieves group memberships using the Admin SDK
+// Directory API. It authenticates as a service account with domain
+// wide delegation acting as a domain administrator.
+type directoryClient struct {
+	// url holds the base URL of the Directory API.
+	url string
+
+	// config holds the configuration used to obtain access tokens.
+	config *jwt.Config
+}
+
+// newDirectoryClient creates a new directoryClient using the given
+// service account key, which must be in the JSON format created by the
+// Google API console.
+func newDirectoryClient(key []byte, adminEmail string) (*directoryClient, error) {
+	var k serviceAccountKey
+	if err := json.Unmarshal(key, &k); err != nil {
+		return nil, errgo.Notef(err, "cannot parse service account key")
+	}
+	if k.ClientEmail == "" || k.PrivateKey == "" {
+		return nil, errgo.Newf("invalid service account key")
+	}
+	if k.TokenURI == "" {
+		k.TokenURI = defaultTokenURL
+	}
+	return &directoryClient{
+		url: defaultDirectoryURL,
+		config: &jwt.Config{
+			Email:      k.ClientEmail,
+			PrivateKey: []byte(k.PrivateKey),
+			Subject:    adminEmail,
+			Scopes:     []string{directoryScope},
+			TokenURL:   k.TokenURI,
+		},
+	}, nil
+}
+
+// emailClaims contains the email claim of a Google ID token.
+type emailClaims struct {
+	Email string `json:"email"`
+}
+
+// groups implements openid.OpenIDConnectParams.GroupsFunc by listing
+// the groups that the user is a member of.
+func (c *directoryClient) groups(ctx context.Context, _ *oauth2.Token, id *oidc.IDToken) ([]string, error) {
+	var claims emailClaims
+	if err := id.Claims(&claims); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if claims.Email == "" {
+		return nil, errgo.Newf("no email claim in ID token")
+	}
+	return c.userGroups(ctx, claims.Email)
+}
+
+// groupsResponse is a response from the Directory API groups list
+// endpoint. See
+// https://developers.google.com/admin-sdk/directory/v1/reference/groups/list
+// for more information.
+type groupsResponse struct {
+	Groups []struct {
+		Email string `json:"email"`
+	} `json:"groups"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+// directoryError is an error response from the Directory API.
+type directoryError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// userGroups returns the email addresses of the groups that the user
+// with the given email address is a member of.
+func (c *directoryClient) userGroups(ctx context.Context, email string) ([]string, error) {
+	client := c.config.Client(ctx)
+	var groups []string
+	pageToken := ""
+	for {
+		v := url.Values{
+			"userKey":    {email},
+			"maxResults": {"200"},
+		}
+		if pageToken != "" {
+			v.Set("pageToken", pageToken)
+		}
+		req, err := http.NewRequest("GET", c.url+"/admin/directory/v1/groups?"+v.Encode(), nil)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot get groups from directory")
+		}
+		var gresp groupsResponse
+		err = unmarshalDirectoryResponse(resp, &gresp)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot get groups from directory")
+		}
+		for _, g := range gresp.Groups {
+			groups = append(groups, g.Email)
+		}
+		if gresp.NextPageToken == "" {
+			return groups, nil
+		}
+		pageToken = gresp.NextPageToken
+	}
+}
+
+func unmarshalDirectoryResponse(resp *http.Response, v interface{}) error {
+	if resp.StatusCode == http.StatusOK {
+		return errgo.Mask(httprequest.UnmarshalJSONResponse(resp, v))
+	}
+	var derr directoryError
+	if err := httprequest.UnmarshalJSONResponse(resp, &derr); err != nil || derr.Error.Message == "" {
+		return errgo.Newf("%s", resp.Status)
+	}
+	return errgo.Newf("%s", derr.Error.Message)
+}
@@ -0,0 +1,128 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package google_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/idp/google"
+)
+
+var checkHostedDomainTests = []struct {
+	about       string
+	domains     []string
+	hd          string
+	expectError string
+}{{
+	about:   "permitted domain",
+	domains: []string{"example.com", "example.org"},
+	hd:      "example.org",
+}, {
+	about:   "case insensitive",
+	domains: []string{"example.com"},
+	hd:      "Example.COM",
+}, {
+	about:       "other domain",
+	domains:     []string{"example.com"},
+	hd:          "example.net",
+	expectError: `account domain "example.net" is not permitted`,
+}, {
+	about:       "consumer account",
+	domains:     []string{"example.com"},
+	expectError: `account is not in a permitted domain`,
+}}
+
+func TestCheckHostedDomain(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range checkHostedDomainTests {
+		c.Run(test.about, func(c *qt.C) {
+			err := google.CheckHostedDomain(test.domains, test.hd)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+		})
+	}
+}
+
+func TestUserGroups(t *testing.T) {
+	c := qt.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(directoryHandler))
+	defer srv.Close()
+	key := serviceAccountKey(c, srv.URL+"/token")
+
+	groups, err := google.UserGroups(context.Background(), key, srv.URL, "bob@example.com")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups, qt.DeepEquals, []string{"g1@example.com", "g2@example.com", "g3@example.com"})
+
+	_, err = google.UserGroups(context.Background(), key, srv.URL, "alice@example.com")
+	c.Assert(err, qt.ErrorMatches, `cannot get groups from directory: Resource Not Found: userKey`)
+}
+
+func serviceAccountKey(c *qt.C, tokenURL string) []byte {
+	pk, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err, qt.Equals, nil)
+	b, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "candid@example.iam.gserviceaccount.com",
+		"private_key": string(pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(pk),
+		})),
+		"token_uri": tokenURL,
+	})
+	c.Assert(err, qt.Equals, nil)
+	return b
+}
+
+func directoryHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if req.URL.Path == "/token" {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "directory-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+		return
+	}
+	if req.URL.Path != "/admin/directory/v1/groups" || req.Header.Get("Authorization") != "Bearer directory-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": map[string]interface{}{"code": 401, "message": "Login Required."},
+		})
+		return
+	}
+	if req.URL.Query().Get("userKey") != "bob@example.com" {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": map[string]interface{}{"code": 404, "message": "Resource Not Found: userKey"},
+		})
+		return
+	}
+	type group struct {
+		Email string `json:"email"`
+	}
+	switch req.URL.Query().Get("pageToken") {
+	case "":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"groups":        []group{{"g1@example.com"}, {"g2@example.com"}},
+			"nextPageToken": "page2",
+		})
+	case "page2":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"groups": []group{{"g3@example.com"}},
+		})
+	}
+}
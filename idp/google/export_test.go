@@ -0,0 +1,19 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package google
+
+import "context"
+
+var CheckHostedDomain = checkHostedDomain
+
+// UserGroups lists the groups of the user with the given email address
+// using a directoryClient created with the given key and directory URL.
+func UserGroups(ctx context.Context, key []byte, directoryURL, email string) ([]string, error) {
+	dc, err := newDirectoryClient(key, "admin@example.com")
+	if err != nil {
+		return nil, err
+	}
+	dc.url = directoryURL
+	return dc.userGroups(ctx, email)
+}
@@ -5,7 +5,10 @@
 package google
 
 import (
+	"io/ioutil"
+
 	oidc "github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
 	"gopkg.in/errgo.v1"
 
 	"github.com/CanonicalLtd/candid/idp"
@@ -24,7 +27,21 @@ func init() {
 		if p.ClientSecret == "" {
 			return nil, errgo.Newf("client-secret not specified")
 		}
-		return NewIdentityProvider(p), nil
+		if p.ServiceAccountKeyFile == "" {
+			return NewIdentityProvider(p), nil
+		}
+		if p.AdminEmail == "" {
+			return nil, errgo.Newf("admin-email not specified")
+		}
+		key, err := ioutil.ReadFile(p.ServiceAccountKeyFile)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot read service account key")
+		}
+		dc, err := newDirectoryClient(key, p.AdminEmail)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return newIdentityProvider(p, dc), nil
 	})
 }
 
@@ -56,18 +73,41 @@ type Params struct {
 	// Hidden is set if the IDP should be hidden from interactive
 	// prompts.
 	Hidden bool `yaml:"hidden"`
+
+	// HostedDomains, if set, restricts logins to accounts in the
+	// given G Suite domains.
+	HostedDomains []string `yaml:"hosted-domains"`
+
+	// ServiceAccountKeyFile contains the path of a JSON key file for
+	// a service account with domain-wide delegation. If this is set
+	// then the user's groups are retrieved from the Admin SDK
+	// Directory API when they log in.
+	ServiceAccountKeyFile string `yaml:"service-account-key-file"`
+
+	// AdminEmail contains the email address of a domain
+	// administrator that the service account acts as when
+	// retrieving groups. It must be set if ServiceAccountKeyFile is
+	// set.
+	AdminEmail string `yaml:"admin-email"`
 }
 
 // NewIdentityProvider creates a google identity provider with the
 // configuration defined by p.
 func NewIdentityProvider(p Params) idp.IdentityProvider {
+	return newIdentityProvider(p, nil)
+}
+
+// newIdentityProvider creates a google identity provider with the
+// configuration defined by p. If dc is not nil it is used to retrieve
+// the groups of users when they log in.
+func newIdentityProvider(p Params, dc *directoryClient) idp.IdentityProvider {
 	if p.Name == "" {
 		p.Name = "google"
 	}
 	if p.Domain == "" {
 		p.Domain = "google"
 	}
-	return openid.NewOpenIDConnectIdentityProvider(openid.OpenIDConnectParams{
+	oidcParams := openid.OpenIDConnectParams{
 		Name:         p.Name,
 		Issuer:       "https://accounts.google.com",
 		Domain:       p.Domain,
@@ -77,5 +117,19 @@ func NewIdentityProvider(p Params) idp.IdentityProvider {
 		ClientID:     p.ClientID,
 		ClientSecret: p.ClientSecret,
 		Hidden:       p.Hidden,
-	})
+	}
+	if len(p.HostedDomains) > 0 {
+		oidcParams.CheckFunc = hostedDomainChecker(p.HostedDomains)
+		// Google only supports a single domain hint, "*" asks
+		// the user to choose a G Suite account.
+		hd := "*"
+		if len(p.HostedDomains) == 1 {
+			hd = p.HostedDomains[0]
+		}
+		oidcParams.AuthCodeOptions = []oauth2.AuthCodeOption{oauth2.SetAuthURLParam("hd", hd)}
+	}
+	if dc != nil {
+		oidcParams.GroupsFunc = dc.groups
+	}
+	return openid.NewOpenIDConnectIdentityProvider(oidcParams)
 }
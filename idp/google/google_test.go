@@ -40,6 +40,36 @@ identity-providers:
    client-id: client-001
 `,
 	expectError: `cannot unmarshal google configuration: client-secret not specified`,
+}, {
+	about: "hosted domains",
+	yaml: `
+identity-providers:
+ - type: google
+   client-id: client-001
+   client-secret: secret-001
+   hosted-domains: [example.com]
+`,
+}, {
+	about: "no admin-email",
+	yaml: `
+identity-providers:
+ - type: google
+   client-id: client-001
+   client-secret: secret-001
+   service-account-key-file: /nonexistent/key.json
+`,
+	expectError: `cannot unmarshal google configuration: admin-email not specified`,
+}, {
+	about: "missing service account key",
+	yaml: `
+identity-providers:
+ - type: google
+   client-id: client-001
+   client-secret: secret-001
+   service-account-key-file: /nonexistent/key.json
+   admin-email: admin@example.com
+`,
+	expectError: `cannot unmarshal google configuration: cannot read service account key: open /nonexistent/key.json: no such file or directory`,
 }}
 
 func TestConfig(t *testing.T) {
@@ -13,7 +13,10 @@ import (
 	"gopkg.in/macaroon-bakery.v2/bakery"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 
+	"github.com/CanonicalLtd/candid/idp/idputil/challenge"
+	"github.com/CanonicalLtd/candid/idp/idputil/lockout"
 	"github.com/CanonicalLtd/candid/idp/idputil/secret"
+	"github.com/CanonicalLtd/candid/notify"
 	"github.com/CanonicalLtd/candid/store"
 )
 
@@ -81,6 +84,20 @@ type InitParams struct {
 
 	// Template contains the templates loaded in the identity server.
 	Template *template.Template
+
+	// LoginChallenger, if set, is used by identity providers with a
+	// login form to require a challenge after repeated failed
+	// logins.
+	LoginChallenger *challenge.Challenger
+
+	// LoginLocker, if set, is used by identity providers that check
+	// passwords to lock out usernames after repeated failed logins.
+	LoginLocker *lockout.Locker
+
+	// Notifier, if set, is used by identity providers to send
+	// notifications, such as email verification and password reset
+	// messages, to users.
+	Notifier *notify.Notifier
 }
 
 // IdentityProvider is the interface that is satisfied by all identity providers.
@@ -143,3 +160,37 @@ type IdentityProvider interface {
 	// TODO define what happens when the identity doesn't exist.
 	GetGroups(ctx context.Context, id *store.Identity) (groups []string, err error)
 }
+
+// A HealthChecker is an IdentityProvider that depends on an external
+// service and can check whether it is reachable. Identity providers
+// that implement HealthChecker are included in the server's readiness
+// checks.
+type HealthChecker interface {
+	// CheckHealth returns an error if the services that the
+	// identity provider depends on cannot currently be reached.
+	CheckHealth(ctx context.Context) error
+}
+
+// A ClientCertificateAuthenticator is an IdentityProvider that
+// authenticates clients using TLS client certificates. When the
+// server serves TLS itself, it requests, but does not require, a
+// client certificate if any identity provider asks for one. The
+// identity provider is responsible for verifying the certificate.
+type ClientCertificateAuthenticator interface {
+	// RequestClientCertificate reports whether TLS clients should
+	// be asked for a certificate.
+	RequestClientCertificate() bool
+}
+
+// A LogoutRedirector is an IdentityProvider that can end the user's
+// session with an upstream identity service. When a browser logs out
+// of Candid and asks for an upstream logout, it is redirected to the
+// URL returned by LogoutURL.
+type LogoutRedirector interface {
+	// LogoutURL returns the URL of the upstream logout page. If the
+	// upstream service supports it, the browser will be returned
+	// to the given returnTo address with the given state added as
+	// the "state" query parameter once the logout is complete. If
+	// the identity provider cannot log out upstream it returns "".
+	LogoutURL(returnTo, state string) string
+}
@@ -0,0 +1,288 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package conformance provides a test suite that checks that an
+// idp.IdentityProvider implementation meets the contract that the
+// identity server relies on. Authors of identity providers can run it
+// from their own tests, for example:
+//
+//	func TestConformance(t *testing.T) {
+//		conformance.Run(qt.New(t), conformance.Params{
+//			New: func() idp.IdentityProvider {
+//				return myidp.NewIdentityProvider(myidp.Params{...})
+//			},
+//			Login:          conformance.PostLoginForm("user1", "pass1"),
+//			ExpectUsername: "user1@mydomain",
+//			FailLogin:      conformance.PostLoginForm("user1", "wrong"),
+//		})
+//	}
+//
+// The candid-idp-conformance command runs the same suite against the
+// identity providers configured in a candidsrv configuration file.
+package conformance
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/juju/names.v2"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/idptest"
+	"github.com/CanonicalLtd/candid/idp/idputil"
+	"github.com/CanonicalLtd/candid/internal/candidtest"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// Location is the location of the identity server that identity
+// providers are initialised with.
+const Location = "https://candid.example.com"
+
+// returnTo is the return_to address of logins performed by the suite.
+const returnTo = "https://relying-party.example.com/callback"
+
+// A LoginFunc completes an interactive login. It is given the client
+// used for the login and the response to the request for the identity
+// provider's login URL, and returns the final response from the
+// identity provider.
+type LoginFunc func(client *http.Client, resp *http.Response) (*http.Response, error)
+
+// PostLoginForm returns a LoginFunc that completes a login by
+// submitting the standard login form with the given username and
+// password.
+func PostLoginForm(username, password string) LoginFunc {
+	return LoginFunc(candidtest.PostLoginForm(username, password))
+}
+
+// Params holds the parameters for Run.
+type Params struct {
+	// New returns a new, uninitialised, instance of the identity
+	// provider under test. It is called once for each test.
+	New func() idp.IdentityProvider
+
+	// Login, if not nil, completes a successful interactive login.
+	// If it is nil, successful logins are not tested.
+	Login LoginFunc
+
+	// ExpectUsername holds the username of the identity that Login
+	// is expected to log in as.
+	ExpectUsername string
+
+	// FailLogin, if not nil, completes an interactive login that is
+	// expected to fail, for example by using the wrong password.
+	FailLogin LoginFunc
+}
+
+// Run runs the conformance suite against the identity provider
+// created by p.New. Each part of the contract is run as a separate
+// subtest.
+func Run(c *qt.C, p Params) {
+	c.Run("Metadata", func(c *qt.C) {
+		newSuite(c, p).testMetadata(c)
+	})
+	c.Run("URL", func(c *qt.C) {
+		newSuite(c, p).testURL(c)
+	})
+	c.Run("SetInteraction", func(c *qt.C) {
+		newSuite(c, p).testSetInteraction(c)
+	})
+	c.Run("InvalidLoginState", func(c *qt.C) {
+		newSuite(c, p).testInvalidLoginState(c)
+	})
+	c.Run("UnknownPath", func(c *qt.C) {
+		newSuite(c, p).testUnknownPath(c)
+	})
+	if p.Login != nil {
+		c.Run("Login", func(c *qt.C) {
+			newSuite(c, p).testLogin(c)
+		})
+	}
+	if p.FailLogin != nil {
+		c.Run("LoginFailure", func(c *qt.C) {
+			newSuite(c, p).testLoginFailure(c)
+		})
+	}
+}
+
+type suite struct {
+	p       Params
+	fixture *idptest.Fixture
+	idp     idp.IdentityProvider
+	prefix  string
+}
+
+// newSuite creates and initialises a new instance of the identity
+// provider under test.
+func newSuite(c *qt.C, p Params) *suite {
+	s := &suite{
+		p:       p,
+		fixture: idptest.NewFixture(c, candidtest.NewStore()),
+		idp:     p.New(),
+	}
+	c.Assert(s.idp, qt.Not(qt.IsNil), qt.Commentf("New returned nil"))
+	s.prefix = Location + "/login/" + s.idp.Name()
+	ip := s.fixture.InitParams(c, s.prefix)
+	ip.Location = Location
+	err := s.idp.Init(s.fixture.Ctx, ip)
+	c.Assert(err, qt.Equals, nil, qt.Commentf("Init failed"))
+	return s
+}
+
+func (s *suite) testMetadata(c *qt.C) {
+	name := s.idp.Name()
+	c.Assert(name, qt.Not(qt.Equals), "", qt.Commentf("Name must not be empty"))
+	c.Assert(url.PathEscape(name), qt.Equals, name, qt.Commentf("Name must be usable in a URL path"))
+	c.Check(s.idp.Description(), qt.Not(qt.Equals), "", qt.Commentf("Description must not be empty"))
+	if d := s.idp.Domain(); d != "" {
+		c.Check(names.IsValidUserDomain(d), qt.Equals, true, qt.Commentf("Domain %q is not a valid user domain", d))
+	}
+	if icon := s.idp.IconURL(); icon != "" {
+		u, err := url.Parse(icon)
+		c.Check(err, qt.Equals, nil, qt.Commentf("IconURL %q does not parse", icon))
+		if err == nil {
+			c.Check(u.IsAbs(), qt.Equals, true, qt.Commentf("IconURL %q is not absolute", icon))
+		}
+	}
+}
+
+func (s *suite) testURL(c *qt.C) {
+	const state = "conformance-state-1234"
+	u := s.idp.URL(state)
+	if !s.idp.Interactive() && u == "" {
+		// Non-interactive identity providers need not have a
+		// login URL.
+		return
+	}
+	c.Assert(strings.HasPrefix(u, s.prefix+"/"), qt.Equals, true, qt.Commentf("URL %q is not within the URL prefix %q", u, s.prefix))
+	pu, err := url.Parse(u)
+	c.Assert(err, qt.Equals, nil)
+	if s.idp.Interactive() {
+		c.Assert(pu.Query().Get("state"), qt.Equals, state, qt.Commentf("URL %q does not include the state", u))
+	}
+}
+
+func (s *suite) testSetInteraction(c *qt.C) {
+	req, err := http.NewRequest("GET", Location+"/discharge", nil)
+	c.Assert(err, qt.Equals, nil)
+	ierr := httpbakery.NewInteractionRequiredError(nil, req)
+	s.idp.SetInteraction(ierr, "conformance-discharge-id")
+	c.Assert(ierr.Code, qt.Equals, httpbakery.ErrInteractionRequired)
+	_, err = json.Marshal(ierr)
+	c.Assert(err, qt.Equals, nil, qt.Commentf("interaction information cannot be marshaled"))
+}
+
+func (s *suite) testInvalidLoginState(c *qt.C) {
+	if !s.idp.Interactive() {
+		c.Skip("identity provider is not interactive")
+	}
+	// Request the login URL without a login state cookie, as if the
+	// state had been forged.
+	resp := s.get(c, s.idp.URL("forged-state"), false)
+	defer resp.Body.Close()
+	c.Check(resp.StatusCode < http.StatusInternalServerError, qt.Equals, true, qt.Commentf("unexpected status %q", resp.Status))
+	c.Assert(s.fixture.LoginIdentity(), qt.IsNil, qt.Commentf("login completed with invalid login state"))
+}
+
+func (s *suite) testUnknownPath(c *qt.C) {
+	resp := s.get(c, s.prefix+"/conformance-no-such-path", true)
+	defer resp.Body.Close()
+	c.Check(resp.StatusCode < http.StatusInternalServerError, qt.Equals, true, qt.Commentf("unexpected status %q", resp.Status))
+	c.Assert(s.fixture.LoginIdentity(), qt.IsNil, qt.Commentf("login completed at unknown path"))
+}
+
+func (s *suite) testLogin(c *qt.C) {
+	id, err := s.login(c, s.p.Login)
+	c.Assert(err, qt.Equals, nil, qt.Commentf("login failed"))
+	c.Assert(id, qt.Not(qt.IsNil))
+	c.Assert(id.Username, qt.Equals, s.p.ExpectUsername)
+	c.Assert(id.ProviderID.Provider(), qt.Equals, s.idp.Name(), qt.Commentf("ProviderID %q is not in the identity provider's namespace", id.ProviderID))
+	if d := s.idp.Domain(); d != "" {
+		c.Assert(strings.HasSuffix(id.Username, "@"+d), qt.Equals, true, qt.Commentf("username %q is not in domain %q", id.Username, d))
+	}
+
+	// The identity must have been stored.
+	stored := store.Identity{
+		ProviderID: id.ProviderID,
+	}
+	err = s.fixture.Store.Store.Identity(s.fixture.Ctx, &stored)
+	c.Assert(err, qt.Equals, nil, qt.Commentf("identity not stored"))
+	c.Assert(stored.Username, qt.Equals, id.Username)
+
+	_, err = s.idp.GetGroups(s.fixture.Ctx, &stored)
+	c.Assert(err, qt.Equals, nil, qt.Commentf("GetGroups failed for logged in identity"))
+}
+
+func (s *suite) testLoginFailure(c *qt.C) {
+	id, err := s.login(c, s.p.FailLogin)
+	c.Assert(err, qt.Not(qt.IsNil), qt.Commentf("login did not fail"))
+	c.Assert(id, qt.IsNil)
+	c.Assert(s.fixture.LoginIdentity(), qt.IsNil)
+}
+
+// login performs an interactive login with the identity provider,
+// using f to complete the login.
+func (s *suite) login(c *qt.C, f LoginFunc) (*store.Identity, error) {
+	srv := s.server(c)
+	client := s.fixture.Client(c, Location, srv.URL, returnTo)
+	state := s.setLoginState(c, client)
+	u, err := url.Parse(s.idp.URL(state))
+	c.Assert(err, qt.Equals, nil)
+	resp, err := client.Get(u.String())
+	c.Assert(err, qt.Equals, nil)
+	resp, err = f(client, resp)
+	c.Assert(err, qt.Equals, nil)
+	defer resp.Body.Close()
+	return s.fixture.ParseResponse(c, resp)
+}
+
+// get performs a GET request for the given URL, which must be within
+// the identity provider's URL prefix. If withState is true a valid
+// login state cookie is sent with the request.
+func (s *suite) get(c *qt.C, u string, withState bool) *http.Response {
+	srv := s.server(c)
+	client := s.fixture.Client(c, Location, srv.URL, returnTo)
+	if withState {
+		state := s.setLoginState(c, client)
+		pu, err := url.Parse(u)
+		c.Assert(err, qt.Equals, nil)
+		v := pu.Query()
+		v.Set("state", state)
+		pu.RawQuery = v.Encode()
+		u = pu.String()
+	}
+	resp, err := client.Get(u)
+	c.Assert(err, qt.Equals, nil)
+	return resp
+}
+
+// setLoginState adds a login state cookie to the given client and
+// returns the corresponding state value.
+func (s *suite) setLoginState(c *qt.C, client *http.Client) string {
+	cookie, state := s.fixture.LoginState(c, idputil.LoginState{
+		ReturnTo: returnTo,
+		State:    "conformance",
+		Expires:  time.Now().Add(10 * time.Minute),
+	})
+	lu, err := url.Parse(Location)
+	c.Assert(err, qt.Equals, nil)
+	client.Jar.SetCookies(lu, []*http.Cookie{cookie})
+	return state
+}
+
+// server starts a server that passes requests to the identity
+// provider in the same way as the identity server.
+func (s *suite) server(c *qt.C) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL.Path = strings.TrimPrefix(req.URL.Path, "/login/"+s.idp.Name())
+		req.ParseForm()
+		s.idp.Handle(s.fixture.Ctx, w, req)
+	}))
+	c.Defer(srv.Close)
+	return srv
+}
@@ -0,0 +1,36 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package conformance_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/idptest/conformance"
+	"github.com/CanonicalLtd/candid/idp/static"
+)
+
+func TestStaticConformance(t *testing.T) {
+	conformance.Run(qt.New(t), conformance.Params{
+		New: func() idp.IdentityProvider {
+			return static.NewIdentityProvider(static.Params{
+				Name:   "static",
+				Domain: "example",
+				Users: map[string]static.UserInfo{
+					"user1": {
+						Password: "pass1",
+						Name:     "User One",
+						Email:    "user1@example.com",
+						Groups:   []string{"group1"},
+					},
+				},
+			})
+		},
+		Login:          conformance.PostLoginForm("user1", "pass1"),
+		ExpectUsername: "user1@example",
+		FailLogin:      conformance.PostLoginForm("user1", "wrong"),
+	})
+}
@@ -239,6 +239,13 @@ func (s *Fixture) AssertLoginRedirectFailureMatches(c *qt.C, rurl, returnTo, sta
 	c.Assert(v.Get("error"), qt.ErrorMatches, regex)
 }
 
+// LoginIdentity returns the identity that the most recent login
+// completed successfully with, or nil if no login has succeeded since
+// the fixture was created or Reset.
+func (s *Fixture) LoginIdentity() *store.Identity {
+	return s.visitCompleter.id
+}
+
 // AssertLoginNotComplete asserts that the login attempt has not yet
 // completed.
 func (s *Fixture) AssertLoginNotComplete(c *qt.C) {
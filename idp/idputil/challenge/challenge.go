@@ -0,0 +1,347 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package challenge implements the challenge, either a CAPTCHA or a
+// proof of work, that users of login forms must complete after
+// repeated failed login attempts.
+package challenge
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/internal/clientip"
+)
+
+var logger = loggo.GetLogger("candid.idp.idputil.challenge")
+
+// Challenge types.
+const (
+	HCaptcha    = "hcaptcha"
+	ReCaptcha   = "recaptcha"
+	ProofOfWork = "proof-of-work"
+)
+
+const (
+	defaultMaxFailures   = 3
+	defaultFailureWindow = 15 * time.Minute
+	defaultDifficulty    = 20
+
+	// nonceExpiry is the time for which a proof of work nonce is
+	// valid.
+	nonceExpiry = 10 * time.Minute
+)
+
+var verifyURLs = map[string]string{
+	HCaptcha:  "https://hcaptcha.com/siteverify",
+	ReCaptcha: "https://www.google.com/recaptcha/api/siteverify",
+}
+
+var responseFields = map[string]string{
+	HCaptcha:  "h-captcha-response",
+	ReCaptcha: "g-recaptcha-response",
+}
+
+// Params holds the configuration of a Challenger.
+type Params struct {
+	// Type holds the type of challenge, one of HCaptcha, ReCaptcha
+	// or ProofOfWork. If this is empty then no challenge is used.
+	Type string
+
+	// SiteKey and SecretKey hold the keys issued by the CAPTCHA
+	// service.
+	SiteKey   string
+	SecretKey string
+
+	// VerifyURL, if set, overrides the URL used to verify CAPTCHA
+	// responses.
+	VerifyURL string
+
+	// Difficulty holds the number of leading zero bits required in
+	// a proof of work. If this is zero a default of 20 is used.
+	Difficulty int
+
+	// MaxFailures holds the number of failed logins, either from a
+	// single address or for a single username, after which the
+	// challenge must be completed. If this is zero a default of 3
+	// is used.
+	MaxFailures int
+
+	// FailureWindow holds the time for which failed logins are
+	// remembered after the last failure. If this is zero a default
+	// of 15 minutes is used.
+	FailureWindow time.Duration
+
+	// TrustedProxies holds the addresses, in CIDR notation, of
+	// reverse proxies whose X-Forwarded-For headers are trusted
+	// when determining the address of a client. If this is empty
+	// the address of the peer is always used.
+	TrustedProxies []string
+}
+
+// A Challenger tracks failed logins and issues and verifies the
+// challenges. A nil Challenger never requires a challenge.
+type Challenger struct {
+	p        Params
+	kv       simplekv.Store
+	client   *http.Client
+	resolver *clientip.Resolver
+}
+
+// New creates a new Challenger with the given parameters that stores
+// its state in the given store. If p.Type is empty then New returns
+// nil.
+func New(p Params, kv simplekv.Store) (*Challenger, error) {
+	switch p.Type {
+	case "":
+		return nil, nil
+	case HCaptcha, ReCaptcha:
+		if p.SiteKey == "" || p.SecretKey == "" {
+			return nil, errgo.Newf("%s challenge requires site-key and secret-key", p.Type)
+		}
+		if p.VerifyURL == "" {
+			p.VerifyURL = verifyURLs[p.Type]
+		}
+	case ProofOfWork:
+		if p.Difficulty == 0 {
+			p.Difficulty = defaultDifficulty
+		}
+		if p.Difficulty < 0 || p.Difficulty > 32 {
+			return nil, errgo.Newf("invalid proof-of-work difficulty %d", p.Difficulty)
+		}
+	default:
+		return nil, errgo.Newf("unknown challenge type %q", p.Type)
+	}
+	if p.MaxFailures == 0 {
+		p.MaxFailures = defaultMaxFailures
+	}
+	if p.FailureWindow == 0 {
+		p.FailureWindow = defaultFailureWindow
+	}
+	resolver, err := clientip.New(p.TrustedProxies)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid trusted proxies")
+	}
+	return &Challenger{
+		p:        p,
+		kv:       kv,
+		client:   http.DefaultClient,
+		resolver: resolver,
+	}, nil
+}
+
+// Form holds the information needed to display a challenge in a login
+// form.
+type Form struct {
+	// Type holds the type of the challenge.
+	Type string
+
+	// SiteKey holds the CAPTCHA site key.
+	SiteKey string
+
+	// Nonce holds the proof of work nonce.
+	Nonce string
+
+	// Difficulty holds the number of leading zero bits required in
+	// the proof of work.
+	Difficulty int
+}
+
+// Required reports whether a login for the given username from the
+// client that made the given request must complete a challenge. The
+// username may be empty if it is not yet known.
+func (c *Challenger) Required(ctx context.Context, req *http.Request, username string) bool {
+	if c == nil {
+		return false
+	}
+	if c.failures(ctx, c.addrKey(req)) >= c.p.MaxFailures {
+		return true
+	}
+	return username != "" && c.failures(ctx, userKey(username)) >= c.p.MaxFailures
+}
+
+// Form creates a new challenge to display in a login form.
+func (c *Challenger) Form(ctx context.Context) (*Form, error) {
+	f := &Form{
+		Type:    c.p.Type,
+		SiteKey: c.p.SiteKey,
+	}
+	if c.p.Type != ProofOfWork {
+		return f, nil
+	}
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	f.Nonce = base64.RawURLEncoding.EncodeToString(buf[:])
+	f.Difficulty = c.p.Difficulty
+	if err := c.kv.Set(ctx, nonceKey(f.Nonce), []byte{1}, time.Now().Add(nonceExpiry)); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return f, nil
+}
+
+// Verify checks that the response to a challenge in the given login
+// form request is correct.
+func (c *Challenger) Verify(ctx context.Context, req *http.Request) error {
+	if c.p.Type == ProofOfWork {
+		return errgo.Mask(c.verifyProofOfWork(ctx, req.Form.Get("pow-nonce"), req.Form.Get("pow-solution")))
+	}
+	return errgo.Mask(c.verifyCaptcha(ctx, req.Form.Get(responseFields[c.p.Type]), c.resolver.Address(req)))
+}
+
+// errChallengeFailed is the error returned when a challenge has not
+// been completed.
+var errChallengeFailed = errgo.New("please complete the challenge to log in")
+
+func (c *Challenger) verifyProofOfWork(ctx context.Context, nonce, solution string) error {
+	if nonce == "" || solution == "" {
+		return errChallengeFailed
+	}
+	// Each nonce may only be used once.
+	err := c.kv.Update(ctx, nonceKey(nonce), time.Now().Add(nonceExpiry), func(old []byte) ([]byte, error) {
+		if len(old) != 1 || old[0] != 1 {
+			return nil, errChallengeFailed
+		}
+		return []byte{0}, nil
+	})
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(errChallengeFailed))
+	}
+	if !CheckProofOfWork(nonce, solution, c.p.Difficulty) {
+		return errChallengeFailed
+	}
+	return nil
+}
+
+// CheckProofOfWork reports whether the SHA-256 hash of nonce + ":" +
+// solution has at least the given number of leading zero bits.
+func CheckProofOfWork(nonce, solution string, difficulty int) bool {
+	sum := sha256.Sum256([]byte(nonce + ":" + solution))
+	zeros := 0
+	for _, b := range sum {
+		if b != 0 {
+			zeros += bits.LeadingZeros8(b)
+			break
+		}
+		zeros += 8
+	}
+	return zeros >= difficulty
+}
+
+// captchaResponse is the response from a CAPTCHA verification
+// endpoint. hCaptcha and reCAPTCHA use the same format.
+type captchaResponse struct {
+	Success    bool     `json:"success"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+func (c *Challenger) verifyCaptcha(ctx context.Context, response, remoteIP string) error {
+	if response == "" {
+		return errChallengeFailed
+	}
+	v := url.Values{
+		"secret":   {c.p.SecretKey},
+		"response": {response},
+	}
+	if remoteIP != "" {
+		v.Set("remoteip", remoteIP)
+	}
+	req, err := http.NewRequest("POST", c.p.VerifyURL, strings.NewReader(v.Encode()))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errgo.Notef(err, "cannot verify challenge")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errgo.Newf("cannot verify challenge: %s", resp.Status)
+	}
+	var cresp captchaResponse
+	if err := json.NewDecoder(resp.Body).Decode(&cresp); err != nil {
+		return errgo.Notef(err, "cannot verify challenge")
+	}
+	if !cresp.Success {
+		logger.Debugf("challenge failed: %v", cresp.ErrorCodes)
+		return errChallengeFailed
+	}
+	return nil
+}
+
+// Failed records a failed login for the given username from the client
+// that made the given request.
+func (c *Challenger) Failed(ctx context.Context, req *http.Request, username string) {
+	if c == nil {
+		return
+	}
+	c.incr(ctx, c.addrKey(req))
+	if username != "" {
+		c.incr(ctx, userKey(username))
+	}
+}
+
+// Succeeded records a successful login for the given username, which
+// resets the failure count for that username. The failure count for
+// the client's address is deliberately not reset: otherwise an
+// attacker trying many usernames from one address could avoid the
+// challenge by interleaving logins to an account they control, and
+// many users share an address behind NAT. Address failures expire
+// after the failure window instead.
+func (c *Challenger) Succeeded(ctx context.Context, username string) {
+	if c == nil {
+		return
+	}
+	if err := c.kv.Set(ctx, userKey(username), nil, time.Now()); err != nil {
+		logger.Errorf("cannot reset login failures: %s", err)
+	}
+}
+
+func (c *Challenger) failures(ctx context.Context, key string) int {
+	v, err := c.kv.Get(ctx, key)
+	if err != nil {
+		if errgo.Cause(err) != simplekv.ErrNotFound {
+			logger.Errorf("cannot get login failures: %s", err)
+		}
+		return 0
+	}
+	n, _ := strconv.Atoi(string(v))
+	return n
+}
+
+func (c *Challenger) incr(ctx context.Context, key string) {
+	err := c.kv.Update(ctx, key, time.Now().Add(c.p.FailureWindow), func(old []byte) ([]byte, error) {
+		n, _ := strconv.Atoi(string(old))
+		return []byte(strconv.Itoa(n + 1)), nil
+	})
+	if err != nil {
+		logger.Errorf("cannot record login failure: %s", err)
+	}
+}
+
+func (c *Challenger) addrKey(req *http.Request) string {
+	return "addr:" + c.resolver.Address(req)
+}
+
+func userKey(username string) string {
+	return "user:" + username
+}
+
+func nonceKey(nonce string) string {
+	return "nonce:" + nonce
+}
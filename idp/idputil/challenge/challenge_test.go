@@ -0,0 +1,192 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package challenge_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/simplekv/memsimplekv"
+
+	"github.com/CanonicalLtd/candid/idp/idputil/challenge"
+)
+
+func newRequest(remoteAddr string, form url.Values) *http.Request {
+	req := httptest.NewRequest("POST", "/login", nil)
+	req.RemoteAddr = remoteAddr
+	req.Form = form
+	return req
+}
+
+func TestNilChallenger(t *testing.T) {
+	c := qt.New(t)
+	ch, err := challenge.New(challenge.Params{}, memsimplekv.NewStore())
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ch, qt.IsNil)
+	req := newRequest("192.0.2.1:1234", nil)
+	ch.Failed(context.Background(), req, "bob")
+	c.Assert(ch.Required(context.Background(), req, "bob"), qt.Equals, false)
+}
+
+func TestRequiredAfterFailures(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	ch, err := challenge.New(challenge.Params{
+		Type:        challenge.ProofOfWork,
+		MaxFailures: 2,
+	}, memsimplekv.NewStore())
+	c.Assert(err, qt.Equals, nil)
+
+	req1 := newRequest("192.0.2.1:1234", nil)
+	req2 := newRequest("192.0.2.2:1234", nil)
+	c.Assert(ch.Required(ctx, req1, "bob"), qt.Equals, false)
+	ch.Failed(ctx, req1, "bob")
+	c.Assert(ch.Required(ctx, req1, "bob"), qt.Equals, false)
+	ch.Failed(ctx, req1, "bob")
+
+	// Both the address and the username now require a challenge.
+	c.Assert(ch.Required(ctx, req1, ""), qt.Equals, true)
+	c.Assert(ch.Required(ctx, req2, "bob"), qt.Equals, true)
+	c.Assert(ch.Required(ctx, req2, "alice"), qt.Equals, false)
+
+	// A successful login resets the username count, but not the
+	// address count.
+	ch.Succeeded(ctx, "bob")
+	c.Assert(ch.Required(ctx, req2, "bob"), qt.Equals, false)
+	c.Assert(ch.Required(ctx, req1, "bob"), qt.Equals, true)
+}
+
+func TestRequiredBehindTrustedProxy(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	ch, err := challenge.New(challenge.Params{
+		Type:           challenge.ProofOfWork,
+		MaxFailures:    1,
+		TrustedProxies: []string{"10.0.0.0/8"},
+	}, memsimplekv.NewStore())
+	c.Assert(err, qt.Equals, nil)
+
+	req1 := newRequest("10.0.0.1:1234", nil)
+	req1.Header.Set("X-Forwarded-For", "192.0.2.1")
+	req2 := newRequest("10.0.0.1:1234", nil)
+	req2.Header.Set("X-Forwarded-For", "192.0.2.2")
+	ch.Failed(ctx, req1, "")
+
+	// Failures are counted against the client address, not the
+	// address of the proxy.
+	c.Assert(ch.Required(ctx, req1, ""), qt.Equals, true)
+	c.Assert(ch.Required(ctx, req2, ""), qt.Equals, false)
+
+	// A forwarded address from an untrusted peer is ignored.
+	req3 := newRequest("192.0.2.3:1234", nil)
+	req3.Header.Set("X-Forwarded-For", "192.0.2.1")
+	c.Assert(ch.Required(ctx, req3, ""), qt.Equals, false)
+}
+
+func TestProofOfWork(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	ch, err := challenge.New(challenge.Params{
+		Type:       challenge.ProofOfWork,
+		Difficulty: 8,
+	}, memsimplekv.NewStore())
+	c.Assert(err, qt.Equals, nil)
+
+	f, err := ch.Form(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(f.Type, qt.Equals, challenge.ProofOfWork)
+	c.Assert(f.Difficulty, qt.Equals, 8)
+	solution := ""
+	for i := 0; ; i++ {
+		if challenge.CheckProofOfWork(f.Nonce, strconv.Itoa(i), f.Difficulty) {
+			solution = strconv.Itoa(i)
+			break
+		}
+	}
+	form := url.Values{
+		"pow-nonce":    {f.Nonce},
+		"pow-solution": {solution},
+	}
+	err = ch.Verify(ctx, newRequest("192.0.2.1:1234", form))
+	c.Assert(err, qt.Equals, nil)
+
+	// The nonce cannot be reused.
+	err = ch.Verify(ctx, newRequest("192.0.2.1:1234", form))
+	c.Assert(err, qt.ErrorMatches, `please complete the challenge to log in`)
+}
+
+func TestProofOfWorkUnknownNonce(t *testing.T) {
+	c := qt.New(t)
+	ch, err := challenge.New(challenge.Params{Type: challenge.ProofOfWork}, memsimplekv.NewStore())
+	c.Assert(err, qt.Equals, nil)
+	err = ch.Verify(context.Background(), newRequest("192.0.2.1:1234", url.Values{
+		"pow-nonce":    {"unknown"},
+		"pow-solution": {"0"},
+	}))
+	c.Assert(err, qt.ErrorMatches, `please complete the challenge to log in`)
+}
+
+func TestCaptcha(t *testing.T) {
+	c := qt.New(t)
+	var form url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		form = req.PostForm
+		w.Header().Set("Content-Type", "application/json")
+		if req.PostForm.Get("response") == "good" {
+			w.Write([]byte(`{"success": true}`))
+			return
+		}
+		w.Write([]byte(`{"success": false, "error-codes": ["invalid-input-response"]}`))
+	}))
+	defer srv.Close()
+
+	ch, err := challenge.New(challenge.Params{
+		Type:      challenge.HCaptcha,
+		SiteKey:   "site-key",
+		SecretKey: "secret-key",
+		VerifyURL: srv.URL,
+	}, memsimplekv.NewStore())
+	c.Assert(err, qt.Equals, nil)
+
+	f, err := ch.Form(context.Background())
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(f, qt.DeepEquals, &challenge.Form{
+		Type:    challenge.HCaptcha,
+		SiteKey: "site-key",
+	})
+
+	err = ch.Verify(context.Background(), newRequest("192.0.2.1:1234", url.Values{
+		"h-captcha-response": {"good"},
+	}))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(form, qt.DeepEquals, url.Values{
+		"secret":   {"secret-key"},
+		"response": {"good"},
+		"remoteip": {"192.0.2.1"},
+	})
+
+	err = ch.Verify(context.Background(), newRequest("192.0.2.1:1234", url.Values{
+		"h-captcha-response": {"bad"},
+	}))
+	c.Assert(err, qt.ErrorMatches, `please complete the challenge to log in`)
+}
+
+func TestNewErrors(t *testing.T) {
+	c := qt.New(t)
+	_, err := challenge.New(challenge.Params{Type: "puzzle"}, memsimplekv.NewStore())
+	c.Assert(err, qt.ErrorMatches, `unknown challenge type "puzzle"`)
+	_, err = challenge.New(challenge.Params{Type: challenge.ReCaptcha}, memsimplekv.NewStore())
+	c.Assert(err, qt.ErrorMatches, `recaptcha challenge requires site-key and secret-key`)
+	_, err = challenge.New(challenge.Params{
+		Type:           challenge.ProofOfWork,
+		TrustedProxies: []string{"10.0.0.0/33"},
+	}, memsimplekv.NewStore())
+	c.Assert(err, qt.ErrorMatches, `invalid trusted proxies: invalid CIDR "10.0.0.0/33"`)
+}
@@ -7,6 +7,7 @@ package idputil
 
 import (
 	"context"
+	"crypto/subtle"
 	"fmt"
 	"html/template"
 	"net/http"
@@ -19,11 +20,19 @@ import (
 	"gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
 
+	"github.com/CanonicalLtd/candid/idp/idputil/challenge"
+	"github.com/CanonicalLtd/candid/idp/idputil/lockout"
+	"github.com/CanonicalLtd/candid/internal/secheaders"
 	"github.com/CanonicalLtd/candid/store"
 )
 
 var logger = loggo.GetLogger("candid.idp.idputil")
 
+// ErrLoginCancelled is the error cause used by identity providers when
+// the user cancels a login, or refuses to allow Candid access to their
+// details, at an upstream identity provider.
+var ErrLoginCancelled = errgo.New("login cancelled")
+
 var ReservedUsernames = map[string]bool{
 	"admin":    true,
 	"everyone": true,
@@ -111,17 +120,20 @@ type RegistrationParams struct {
 	// Email contains the email address of the user. This is used to
 	// populate the email input.
 	Email string
+
+	// CSRFToken contains the token that must be posted with the
+	// form in the CSRFTokenField field.
+	CSRFToken string
 }
 
 // RegistrationForm writes a registration form to the given writer using
 // the given parameters.
 func RegistrationForm(ctx context.Context, w http.ResponseWriter, params RegistrationParams, t *template.Template) error {
-	t = t.Lookup("register")
-	if t == nil {
-		errgo.New("registration template not found")
+	if t.Lookup("register") == nil {
+		return errgo.New("registration template not found")
 	}
 	w.Header().Set("Content-Type", "text/html;charset=utf-8")
-	if err := t.Execute(w, params); err != nil {
+	if err := secheaders.ExecuteTemplate(ctx, w, t, "register", params); err != nil {
 		return errgo.Notef(err, "cannot process registration template")
 	}
 	return nil
@@ -136,6 +148,29 @@ func NameWithDomain(name, domain string) string {
 	return name + "@" + domain
 }
 
+// MFAProviderInfo is the ProviderInfo key in which identity providers
+// record whether an identity last authenticated using multiple
+// factors.
+const MFAProviderInfo = "mfa"
+
+// MFAInfo returns the value to store in ProviderInfo[MFAProviderInfo]
+// for an identity that has just logged in. The value is cleared when
+// the login used a single factor, so that it is updated with a
+// store.Set operation.
+func MFAInfo(mfa bool) []string {
+	if !mfa {
+		return nil
+	}
+	return []string{"true"}
+}
+
+// AuthLevelStrong is the authentication level requested by relying
+// services that need the user to have authenticated using multiple
+// factors. When a login requires it, identity providers should make
+// the user authenticate again, with multiple factors if possible, even
+// if they have an existing session with the provider.
+const AuthLevelStrong = "strong"
+
 // LoginCookieName is the name of the cookie used to store LoginState
 // whilst a login is being processed.
 const LoginCookieName = "candid-login"
@@ -154,10 +189,30 @@ type LoginState struct {
 	// Expires holds the time that this login attempt should expire.
 	Expires time.Time
 
+	// CodeChallenge and CodeChallengeMethod hold the PKCE (RFC 7636)
+	// code challenge sent by the requesting server, if any. The
+	// code sent back to the ReturnTo URL can only be exchanged by a
+	// client that holds the corresponding code verifier.
+	CodeChallenge       string
+	CodeChallengeMethod string
+
+	// RememberBrowser records whether the user asked for their
+	// browser to be remembered once they have logged in.
+	RememberBrowser bool
+
+	// AuthLevel holds the authentication level required by the
+	// relying service, if any. See AuthLevelStrong.
+	AuthLevel string
+
 	// ProvideID holds the ProviderID of an authenticated user. It is
 	// only used when the user that has authenticaated requires
 	// registration.
 	ProviderID store.ProviderIdentity
+
+	// MultiFactor records whether the authenticated user used
+	// multiple factors. Like ProviderID it is only used when the
+	// user requires registration.
+	MultiFactor bool
 }
 
 // BadRequestf writes the given bad request message to the given
@@ -179,35 +234,98 @@ type LoginFormParams struct {
 	// Error contains an error message from the previous, failed,
 	// login attempt.
 	Error string
+
+	// Challenge, if set, contains a challenge that must be
+	// completed along with the form.
+	Challenge *challenge.Form
+
+	// CSRFToken contains the token that must be posted with the
+	// form in the CSRFTokenField field.
+	CSRFToken string
 }
 
+// CSRFTokenField is the name of the form field that holds the CSRF
+// token in the forms generated by identity providers.
+const CSRFTokenField = "csrf_token"
+
+// errFormExpired is the error shown when a form is posted without a
+// valid CSRF token.
+const errFormExpired = "login form expired, please try again"
+
 // HandleLoginForm is a handler that displays and process a standard login form.
+// The form must be posted with the given CSRF token, which should be
+// obtained from the Codec.CSRFToken of the identity provider for the
+// login state. If challenger is not nil, the user must also complete a challenge
+// after repeated failed login attempts. If locker is not nil, usernames
+// with too many failed login attempts are locked out.
 func HandleLoginForm(
 	ctx context.Context,
 	w http.ResponseWriter,
 	req *http.Request,
 	idpChoice params.IDPChoiceDetails,
+	csrfToken string,
 	tmpl *template.Template,
+	challenger *challenge.Challenger,
+	locker *lockout.Locker,
 	loginUser func(ctx context.Context, username, password string) (*store.Identity, error),
 ) (*store.Identity, error) {
 	var errorMessage string
+	var needChallenge bool
 	switch req.Method {
 	default:
 		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "unsupported method %q", req.Method)
 	case "POST":
-		id, err := loginUser(ctx, req.Form.Get("username"), req.Form.Get("password"))
+		if !checkCSRFToken(req, csrfToken) {
+			logger.Infof("login form posted without a valid CSRF token")
+			errorMessage = errFormExpired
+			needChallenge = challenger.Required(ctx, req, "")
+			break
+		}
+		username := req.Form.Get("username")
+		if challenger.Required(ctx, req, username) {
+			if err := challenger.Verify(ctx, req); err != nil {
+				needChallenge = true
+				errorMessage = err.Error()
+				break
+			}
+		}
+		if err := locker.Check(ctx, idpChoice.Name, username); err != nil {
+			errorMessage = err.Error()
+			break
+		}
+		id, err := loginUser(ctx, username, req.Form.Get("password"))
 		if err == nil {
+			challenger.Succeeded(ctx, username)
+			locker.Succeeded(ctx, idpChoice.Name, username)
 			return id, nil
 		}
+		challenger.Failed(ctx, req, username)
+		locker.Failed(ctx, idpChoice.Name, username)
 		errorMessage = err.Error()
+		needChallenge = challenger.Required(ctx, req, username)
 	case "GET":
+		needChallenge = challenger.Required(ctx, req, "")
 	}
 	data := LoginFormParams{
 		IDPChoiceDetails: idpChoice,
 		Action:           idpChoice.URL,
 		Error:            errorMessage,
+		CSRFToken:        csrfToken,
+	}
+	if needChallenge {
+		var err error
+		data.Challenge, err = challenger.Form(ctx)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
 	}
-	return nil, errgo.Mask(tmpl.ExecuteTemplate(w, "login-form", data))
+	return nil, errgo.Mask(secheaders.ExecuteTemplate(ctx, w, tmpl, "login-form", data))
+}
+
+// checkCSRFToken reports whether the given request was posted with the
+// given CSRF token.
+func checkCSRFToken(req *http.Request, csrfToken string) bool {
+	return csrfToken != "" && subtle.ConstantTimeCompare([]byte(req.PostForm.Get(CSRFTokenField)), []byte(csrfToken)) == 1
 }
 
 // ServiceURL determines the URL within the specified location. If the
@@ -236,3 +354,23 @@ func ServiceURL(location, dest string) string {
 	lu.Path = path.Join(lu.Path, u.Path)
 	return lu.String()
 }
+
+// CheckURL checks that the given URL is reachable, for use in
+// implementations of idp.HealthChecker. The URL is considered
+// reachable if a GET request to it returns a response that does not
+// have a server error status.
+func CheckURL(ctx context.Context, u string) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errgo.Notef(err, "cannot contact %s", u)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return errgo.Newf("%s returned status %q", u, resp.Status)
+	}
+	return nil
+}
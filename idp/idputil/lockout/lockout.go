@@ -0,0 +1,173 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package lockout tracks failed password logins for each username and
+// locks out usernames that have too many failures.
+package lockout
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
+)
+
+var logger = loggo.GetLogger("candid.idp.idputil.lockout")
+
+// StoreName is the name of the provider data key-value store that
+// holds the failed login counts.
+const StoreName = "_lockout"
+
+const defaultDuration = 15 * time.Minute
+
+// ErrLockedOut is the error cause returned when a username is locked
+// out.
+var ErrLockedOut = errgo.New("too many failed login attempts, try again later")
+
+// Params holds the configuration of a Locker.
+type Params struct {
+	// MaxFailures holds the number of consecutive failed logins for
+	// a username after which the username is locked out. If this is
+	// zero then usernames are never locked out.
+	MaxFailures int
+
+	// Duration holds the time for which a username is locked out.
+	// Failed logins are also forgotten once this time has passed
+	// since the last failure. If this is zero a default of 15
+	// minutes is used.
+	Duration time.Duration
+}
+
+// A Locker tracks failed logins and locks out usernames. A nil Locker
+// never locks out any username.
+type Locker struct {
+	p  Params
+	kv simplekv.Store
+}
+
+// New creates a new Locker with the given parameters that stores its
+// state in the given store. If p.MaxFailures is zero then New returns
+// nil.
+func New(p Params, kv simplekv.Store) (*Locker, error) {
+	if p.MaxFailures == 0 {
+		return nil, nil
+	}
+	if p.MaxFailures < 0 || p.Duration < 0 {
+		return nil, errgo.Newf("invalid lockout parameters")
+	}
+	if p.Duration == 0 {
+		p.Duration = defaultDuration
+	}
+	return &Locker{
+		p:  p,
+		kv: kv,
+	}, nil
+}
+
+// NewStore returns a Locker that may only be used to inspect and clear
+// the lockout state held in the given store. It may be used when the
+// lockout configuration is not known.
+func NewStore(kv simplekv.Store) *Locker {
+	return &Locker{kv: kv}
+}
+
+// Status holds the lockout state of a username.
+type Status struct {
+	// Failures holds the number of consecutive failed logins.
+	Failures int `json:"failures"`
+
+	// LockedUntil holds the time at which the lockout ends. It is
+	// zero if the username is not locked out.
+	LockedUntil time.Time `json:"locked-until"`
+}
+
+// Check returns an error with a cause of ErrLockedOut if the given
+// username is locked out of the given identity provider.
+func (l *Locker) Check(ctx context.Context, idpName, username string) error {
+	if l == nil {
+		return nil
+	}
+	st, err := l.Status(ctx, idpName, username)
+	if err != nil {
+		// Don't prevent logins because the lockout state is
+		// unavailable.
+		logger.Errorf("cannot get lockout status: %s", err)
+		return nil
+	}
+	if time.Now().Before(st.LockedUntil) {
+		return ErrLockedOut
+	}
+	return nil
+}
+
+// Status returns the lockout status of the given username in the given
+// identity provider.
+func (l *Locker) Status(ctx context.Context, idpName, username string) (Status, error) {
+	var st Status
+	v, err := l.kv.Get(ctx, key(idpName, username))
+	if err != nil {
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			return st, nil
+		}
+		return st, errgo.Mask(err)
+	}
+	if len(v) == 0 {
+		// The status has been reset.
+		return st, nil
+	}
+	if err := json.Unmarshal(v, &st); err != nil {
+		return st, errgo.Mask(err)
+	}
+	return st, nil
+}
+
+// Failed records a failed login for the given username in the given
+// identity provider, locking it out if there have been too many.
+func (l *Locker) Failed(ctx context.Context, idpName, username string) {
+	if l == nil || username == "" {
+		return
+	}
+	now := time.Now()
+	err := l.kv.Update(ctx, key(idpName, username), now.Add(l.p.Duration), func(old []byte) ([]byte, error) {
+		var st Status
+		if len(old) > 0 {
+			if err := json.Unmarshal(old, &st); err != nil {
+				logger.Errorf("invalid lockout status for %q: %s", username, err)
+			}
+		}
+		st.Failures++
+		if st.Failures >= l.p.MaxFailures {
+			logger.Infof("locking out %q in %s after %d failed logins", username, idpName, st.Failures)
+			st.LockedUntil = now.Add(l.p.Duration)
+			st.Failures = 0
+		}
+		return json.Marshal(st)
+	})
+	if err != nil {
+		logger.Errorf("cannot record login failure: %s", err)
+	}
+}
+
+// Succeeded records a successful login for the given username in the
+// given identity provider, which resets its failure count.
+func (l *Locker) Succeeded(ctx context.Context, idpName, username string) {
+	if l == nil {
+		return
+	}
+	if err := l.Unlock(ctx, idpName, username); err != nil {
+		logger.Errorf("cannot reset login failures: %s", err)
+	}
+}
+
+// Unlock removes any lockout of the given username in the given
+// identity provider and resets its failure count.
+func (l *Locker) Unlock(ctx context.Context, idpName, username string) error {
+	return errgo.Mask(l.kv.Set(ctx, key(idpName, username), nil, time.Now()))
+}
+
+func key(idpName, username string) string {
+	return idpName + ":" + username
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package lockout_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/simplekv/memsimplekv"
+
+	"github.com/CanonicalLtd/candid/idp/idputil/lockout"
+)
+
+func TestNilLocker(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	l, err := lockout.New(lockout.Params{}, memsimplekv.NewStore())
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(l, qt.IsNil)
+	l.Failed(ctx, "test", "bob")
+	c.Assert(l.Check(ctx, "test", "bob"), qt.Equals, nil)
+}
+
+func TestLockedOutAfterFailures(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	l, err := lockout.New(lockout.Params{
+		MaxFailures: 3,
+		Duration:    time.Hour,
+	}, memsimplekv.NewStore())
+	c.Assert(err, qt.Equals, nil)
+	for i := 0; i < 2; i++ {
+		l.Failed(ctx, "test", "bob")
+		c.Assert(l.Check(ctx, "test", "bob"), qt.Equals, nil)
+	}
+	l.Failed(ctx, "test", "bob")
+	c.Assert(l.Check(ctx, "test", "bob"), qt.Equals, lockout.ErrLockedOut)
+
+	// Other usernames and identity providers are unaffected.
+	c.Assert(l.Check(ctx, "test", "alice"), qt.Equals, nil)
+	c.Assert(l.Check(ctx, "other", "bob"), qt.Equals, nil)
+
+	st, err := l.Status(ctx, "test", "bob")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(st.LockedUntil.After(time.Now().Add(59*time.Minute)), qt.Equals, true)
+
+	err = l.Unlock(ctx, "test", "bob")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(l.Check(ctx, "test", "bob"), qt.Equals, nil)
+}
+
+func TestSucceededResetsFailures(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	l, err := lockout.New(lockout.Params{
+		MaxFailures: 2,
+	}, memsimplekv.NewStore())
+	c.Assert(err, qt.Equals, nil)
+	l.Failed(ctx, "test", "bob")
+	l.Succeeded(ctx, "test", "bob")
+	l.Failed(ctx, "test", "bob")
+	c.Assert(l.Check(ctx, "test", "bob"), qt.Equals, nil)
+	st, err := l.Status(ctx, "test", "bob")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(st.Failures, qt.Equals, 1)
+}
+
+func TestInvalidParams(t *testing.T) {
+	c := qt.New(t)
+	_, err := lockout.New(lockout.Params{MaxFailures: -1}, memsimplekv.NewStore())
+	c.Assert(err, qt.ErrorMatches, `invalid lockout parameters`)
+}
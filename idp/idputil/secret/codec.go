@@ -4,11 +4,14 @@
 package secret
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"net"
 	"net/http"
+	"strings"
 
 	"golang.org/x/crypto/nacl/box"
 	"gopkg.in/errgo.v1"
@@ -16,8 +19,9 @@ import (
 )
 
 var (
-	ErrDecryption    = errgo.New("decryption error")
-	ErrInvalidCookie = errgo.New("invalid cookie")
+	ErrDecryption       = errgo.New("decryption error")
+	ErrInvalidCookie    = errgo.New("invalid cookie")
+	ErrInvalidCSRFToken = errgo.New("invalid CSRF token")
 )
 
 // Codec is used to create an encrypted messages that will be decrypted
@@ -26,18 +30,32 @@ var (
 // originally coming from this service.
 type Codec struct {
 	public, shared *[bakery.KeyLen]byte
+	cookieDomains  []string
+	sameSite       http.SameSite
+	secure         bool
 }
 
-// NewCodec creates a new Codec using the given key.
-func NewCodec(key *bakery.KeyPair) *Codec {
+// NewCodec creates a new Codec using the given key. Cookies set by the
+// codec are scoped to the longest of the given cookie domains that
+// contains the host of the request, see CookieDomain.
+func NewCodec(key *bakery.KeyPair, cookieDomains ...string) *Codec {
 	shared := new([bakery.KeyLen]byte)
 	box.Precompute(shared, (*[bakery.KeyLen]byte)(&key.Public.Key), (*[bakery.KeyLen]byte)(&key.Private.Key))
 	return &Codec{
-		public: (*[bakery.KeyLen]byte)(&key.Public.Key),
-		shared: shared,
+		public:        (*[bakery.KeyLen]byte)(&key.Public.Key),
+		shared:        shared,
+		cookieDomains: cookieDomains,
 	}
 }
 
+// SetCookieAttributes sets the SameSite and Secure attributes of the
+// cookies set by the codec. It must be called before the codec is
+// used.
+func (c *Codec) SetCookieAttributes(sameSite http.SameSite, secure bool) {
+	c.sameSite = sameSite
+	c.secure = secure
+}
+
 // Encode marshals the given value in such a way that it can only be
 // unmarshaled by a Codec using the same key. The encoded output will be
 // in the base64 url safe alphabet.
@@ -116,36 +134,102 @@ func (c *Codec) decrypt(out, in []byte) ([]byte, error) {
 }
 
 // SetCookie encodes the given value as a session cookie with the given
-// name. The returned value is used the verify the cookie later - it
-// should be passed to Cookie when the cookie is retrieved.
-func (c *Codec) SetCookie(w http.ResponseWriter, name string, v interface{}) (string, error) {
+// name in the response to the given request. The returned value is
+// used the verify the cookie later - it should be passed to Cookie
+// when the cookie is retrieved.
+func (c *Codec) SetCookie(w http.ResponseWriter, req *http.Request, name string, v interface{}) (string, error) {
 	out, err := c.encode(v)
 	if err != nil {
 		return "", errgo.Mask(err)
 	}
 	hash := sha256.Sum256(out)
 	http.SetCookie(w, &http.Cookie{
-		Name:  name,
-		Value: base64.URLEncoding.EncodeToString(out),
+		Name:     name,
+		Value:    base64.URLEncoding.EncodeToString(out),
+		Domain:   CookieDomain(req, c.cookieDomains),
+		HttpOnly: true,
+		SameSite: c.sameSite,
+		Secure:   c.secure,
 	})
 	return base64.RawURLEncoding.EncodeToString(hash[:]), nil
 }
 
+// CSRFToken returns a token that can be included in a form to show
+// that the form was generated by this service for the holder of the
+// cookie with the given verification string. As the token cannot be
+// computed without the key of the codec, a form posted by another site
+// will not contain a valid token.
+func (c *Codec) CSRFToken(verification string) string {
+	mac := hmac.New(sha256.New, c.shared[:])
+	mac.Write([]byte("csrf\x00"))
+	mac.Write([]byte(verification))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// CheckCSRFToken checks that the given token was returned by CSRFToken
+// for the given verification string.
+func (c *Codec) CheckCSRFToken(verification, token string) error {
+	if verification == "" || !hmac.Equal([]byte(c.CSRFToken(verification)), []byte(token)) {
+		return ErrInvalidCSRFToken
+	}
+	return nil
+}
+
 // Cookie decodes the cookie with the given name from the given request
 // into v. The given verification string is used to ensure the cookie is
-// valid.
+// valid. If the request holds more than one cookie with the given name,
+// for example because cookies have been set for both a host and one of
+// its parent domains, the one matching the verification string is used.
 func (c *Codec) Cookie(req *http.Request, name, verification string, v interface{}) error {
-	cookie, err := req.Cookie(name)
-	if err != nil {
-		return errgo.WithCausef(err, ErrInvalidCookie, "invalid cookie")
+	var buf []byte
+	err := error(http.ErrNoCookie)
+	for _, cookie := range req.Cookies() {
+		if cookie.Name != name {
+			continue
+		}
+		b, decodeErr := base64.URLEncoding.DecodeString(cookie.Value)
+		if decodeErr != nil {
+			err = decodeErr
+			continue
+		}
+		hash := sha256.Sum256(b)
+		if base64.RawURLEncoding.EncodeToString(hash[:]) != verification {
+			err = nil
+			continue
+		}
+		buf = b
+		break
 	}
-	buf, err := base64.URLEncoding.DecodeString(cookie.Value)
-	if err != nil {
+	if buf == nil {
 		return errgo.WithCausef(err, ErrInvalidCookie, "invalid cookie")
 	}
-	hash := sha256.Sum256(buf)
-	if base64.RawURLEncoding.EncodeToString(hash[:]) != verification {
-		return errgo.WithCausef(nil, ErrInvalidCookie, "invalid cookie")
-	}
 	return errgo.Mask(c.decode(buf, v), errgo.Is(ErrDecryption))
 }
+
+// CookieDomain returns the domain that a cookie set in response to the
+// given request should be scoped to. This is the longest of the given
+// domains that is the request host or one of its parent domains. If no
+// domain matches then an empty string is returned and the cookie
+// should be scoped to the request host only, so that cookies set on one
+// host name are never sent to another.
+func CookieDomain(req *http.Request, domains []string) string {
+	if req == nil || len(domains) == 0 {
+		return ""
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	domain := ""
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimPrefix(d, "."))
+		if d == "" || len(d) <= len(domain) {
+			continue
+		}
+		if host == d || strings.HasSuffix(host, "."+d) {
+			domain = d
+		}
+	}
+	return domain
+}
@@ -145,7 +145,7 @@ func TestCookieRoundTrip(t *testing.T) {
 	}
 	a.A = 1
 	a.B = "test"
-	verification, err := codec.SetCookie(w, "test-cookie", a)
+	verification, err := codec.SetCookie(w, nil, "test-cookie", a)
 	c.Assert(err, qt.Equals, nil)
 	resp := w.Result()
 	defer resp.Body.Close()
@@ -160,6 +160,34 @@ func TestCookieRoundTrip(t *testing.T) {
 	c.Assert(b, qt.DeepEquals, a)
 }
 
+func TestCookieAttributes(t *testing.T) {
+	c := qt.New(t)
+	codec := secret.NewCodec(bakery.MustGenerateKey())
+	codec.SetCookieAttributes(http.SameSiteStrictMode, true)
+	w := httptest.NewRecorder()
+	_, err := codec.SetCookie(w, nil, "test-cookie", 1)
+	c.Assert(err, qt.Equals, nil)
+	cookies := w.Result().Cookies()
+	c.Assert(cookies, qt.HasLen, 1)
+	c.Assert(cookies[0].SameSite, qt.Equals, http.SameSiteStrictMode)
+	c.Assert(cookies[0].Secure, qt.Equals, true)
+}
+
+func TestCSRFToken(t *testing.T) {
+	c := qt.New(t)
+	codec := secret.NewCodec(bakery.MustGenerateKey())
+	token := codec.CSRFToken("1234")
+	c.Assert(token, qt.Not(qt.Equals), "")
+	c.Assert(codec.CheckCSRFToken("1234", token), qt.Equals, nil)
+	c.Assert(codec.CheckCSRFToken("5678", token), qt.Equals, secret.ErrInvalidCSRFToken)
+	c.Assert(codec.CheckCSRFToken("1234", ""), qt.Equals, secret.ErrInvalidCSRFToken)
+	c.Assert(codec.CheckCSRFToken("", codec.CSRFToken("")), qt.Equals, secret.ErrInvalidCSRFToken)
+
+	// A token from a codec with a different key is not valid.
+	other := secret.NewCodec(bakery.MustGenerateKey())
+	c.Assert(codec.CheckCSRFToken("1234", other.CSRFToken("1234")), qt.Equals, secret.ErrInvalidCSRFToken)
+}
+
 func TestCookieNoCookie(t *testing.T) {
 	c := qt.New(t)
 	codec := secret.NewCodec(testKey)
@@ -180,7 +208,7 @@ func TestCookieDecodeError(t *testing.T) {
 	}
 	a.A = 1
 	a.B = "test"
-	_, err := codec.SetCookie(w, "test-cookie", a)
+	_, err := codec.SetCookie(w, nil, "test-cookie", a)
 	c.Assert(err, qt.Equals, nil)
 	resp := w.Result()
 	defer resp.Body.Close()
@@ -206,7 +234,7 @@ func TestCookieValidationError(t *testing.T) {
 	}
 	a.A = 1
 	a.B = "test"
-	_, err := codec.SetCookie(w, "test-cookie", a)
+	_, err := codec.SetCookie(w, nil, "test-cookie", a)
 	c.Assert(err, qt.Equals, nil)
 	resp := w.Result()
 	defer resp.Body.Close()
@@ -220,3 +248,92 @@ func TestCookieValidationError(t *testing.T) {
 	c.Assert(err, qt.ErrorMatches, `invalid cookie`)
 	c.Assert(errgo.Cause(err), qt.Equals, secret.ErrInvalidCookie)
 }
+
+func TestCookieScopedToDomain(t *testing.T) {
+	c := qt.New(t)
+	codec := secret.NewCodec(testKey, "example.com", ".login.example.com")
+	req, err := http.NewRequest("GET", "https://id.login.example.com:8443/login", nil)
+	c.Assert(err, qt.Equals, nil)
+	w := httptest.NewRecorder()
+	_, err = codec.SetCookie(w, req, "test-cookie", 1)
+	c.Assert(err, qt.Equals, nil)
+	resp := w.Result()
+	defer resp.Body.Close()
+	cookies := resp.Cookies()
+	c.Assert(cookies, qt.HasLen, 1)
+	c.Assert(cookies[0].Domain, qt.Equals, "login.example.com")
+	c.Assert(cookies[0].HttpOnly, qt.Equals, true)
+}
+
+func TestCookieMultipleWithSameName(t *testing.T) {
+	c := qt.New(t)
+	codec := secret.NewCodec(testKey)
+	w := httptest.NewRecorder()
+	_, err := codec.SetCookie(w, nil, "test-cookie", "other")
+	c.Assert(err, qt.Equals, nil)
+	verification, err := codec.SetCookie(w, nil, "test-cookie", "this")
+	c.Assert(err, qt.Equals, nil)
+	resp := w.Result()
+	defer resp.Body.Close()
+	cookies := resp.Cookies()
+	c.Assert(cookies, qt.HasLen, 2)
+	req, err := http.NewRequest("", "", nil)
+	c.Assert(err, qt.Equals, nil)
+	req.AddCookie(cookies[0])
+	req.AddCookie(cookies[1])
+	var s string
+	err = codec.Cookie(req, "test-cookie", verification, &s)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(s, qt.Equals, "this")
+}
+
+var cookieDomainTests = []struct {
+	about   string
+	host    string
+	domains []string
+	expect  string
+}{{
+	about:  "no domains",
+	host:   "candid.example.com",
+	expect: "",
+}, {
+	about:   "exact match",
+	host:    "candid.example.com",
+	domains: []string{"candid.example.com"},
+	expect:  "candid.example.com",
+}, {
+	about:   "parent domain",
+	host:    "candid.example.com:8081",
+	domains: []string{"example.org", ".example.com"},
+	expect:  "example.com",
+}, {
+	about:   "longest match",
+	host:    "a.b.example.com",
+	domains: []string{"example.com", "b.example.com"},
+	expect:  "b.example.com",
+}, {
+	about:   "no match for vanity domain",
+	host:    "login.vanity.org",
+	domains: []string{"example.com"},
+	expect:  "",
+}, {
+	about:   "suffix is not a parent domain",
+	host:    "notexample.com",
+	domains: []string{"example.com"},
+	expect:  "",
+}, {
+	about:   "case insensitive",
+	host:    "Candid.Example.COM",
+	domains: []string{"example.com"},
+	expect:  "example.com",
+}}
+
+func TestCookieDomain(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range cookieDomainTests {
+		c.Run(test.about, func(c *qt.C) {
+			req := &http.Request{Host: test.host}
+			c.Assert(secret.CookieDomain(req, test.domains), qt.Equals, test.expect)
+		})
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package keystone
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/juju/schema"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/juju/environschema.v1"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+	"gopkg.in/macaroon-bakery.v2/httpbakery/form"
+
+	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/idputil"
+	"github.com/CanonicalLtd/candid/idp/keystone/internal/keystone"
+)
+
+func init() {
+	idp.Register("keystonev3_appcred", constructor(NewV3AppCredIdentityProvider))
+}
+
+// NewV3AppCredIdentityProvider creates a idp.IdentityProvider which
+// will authenticate against a keystone (version 3) server using an
+// application credential provided through a httpbakery.form compatible
+// login method.
+func NewV3AppCredIdentityProvider(p Params) idp.IdentityProvider {
+	return &v3appcredIdentityProvider{
+		identityProvider: newIdentityProvider(p),
+	}
+}
+
+// v3appcredIdentityProvider is an identity provider that uses a
+// configured keystone instance to authenticate against using an
+// application credential passed as httpbakery.form login parameters.
+// The identity that logs in is the user that owns the application
+// credential.
+type v3appcredIdentityProvider struct {
+	identityProvider
+}
+
+// Interactive implements idp.IdentityProvider.Interactive.
+func (*v3appcredIdentityProvider) Interactive() bool {
+	return false
+}
+
+// SetInteraction implements idp.IdentityProvider.SetInteraction.
+func (idp *v3appcredIdentityProvider) SetInteraction(ierr *httpbakery.Error, dischargeID string) {
+	ierr.SetInteraction(form.InteractionMethod, form.InteractionInfo{
+		URL: idputil.URL(idp.initParams.URLPrefix, "/interact", dischargeID),
+	})
+}
+
+// Handle implements idp.IdentityProvider.Handle.
+func (idp *v3appcredIdentityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		httprequest.WriteJSON(w, http.StatusOK, appcredSchemaResponse)
+		return
+	}
+	var lr form.LoginRequest
+	if err := httprequest.Unmarshal(idputil.RequestParams(ctx, w, req), &lr); err != nil {
+		idp.initParams.VisitCompleter.Failure(ctx, w, req, idputil.DischargeID(req), errgo.WithCausef(err, params.ErrBadRequest, "cannot unmarshal login request"))
+		return
+	}
+	frm, err := appcredFieldsChecker.Coerce(lr.Body.Form, nil)
+	if err != nil {
+		idp.initParams.VisitCompleter.Failure(ctx, w, req, idputil.DischargeID(req), errgo.Notef(err, "cannot validate form"))
+		return
+	}
+	m := frm.(map[string]interface{})
+	user, err := idp.doLoginV3(ctx, keystone.AuthV3{
+		Identity: keystone.Identity{
+			Methods: []string{"application_credential"},
+			ApplicationCredential: &keystone.ApplicationCredential{
+				ID:     m["id"].(string),
+				Secret: m["secret"].(string),
+			},
+		},
+	})
+	if err != nil {
+		idp.initParams.VisitCompleter.Failure(ctx, w, req, idputil.DischargeID(req), err)
+		return
+	}
+	if strings.TrimPrefix(req.URL.Path, idp.initParams.URLPrefix) == "/interact" {
+		dt, err := idp.initParams.DischargeTokenCreator.DischargeToken(ctx, user)
+		if err != nil {
+			idp.initParams.VisitCompleter.Failure(ctx, w, req, idputil.DischargeID(req), err)
+			return
+		}
+		httprequest.WriteJSON(w, http.StatusOK, form.LoginResponse{
+			Token: dt,
+		})
+	} else {
+		idp.initParams.VisitCompleter.Success(ctx, w, req, idputil.DischargeID(req), user)
+	}
+}
+
+var appcredSchemaResponse = form.SchemaResponse{
+	Schema: appcredFields,
+}
+
+var appcredFields = environschema.Fields{
+	"id": environschema.Attr{
+		Description: "application credential ID",
+		Type:        environschema.Tstring,
+		Mandatory:   true,
+		EnvVars:     []string{"OS_APPLICATION_CREDENTIAL_ID"},
+	},
+	"secret": environschema.Attr{
+		Description: "application credential secret",
+		Type:        environschema.Tstring,
+		Mandatory:   true,
+		Secret:      true,
+		EnvVars:     []string{"OS_APPLICATION_CREDENTIAL_SECRET"},
+	},
+}
+
+var appcredFieldsChecker = schema.FieldMap(mustValidationSchema(appcredFields))
@@ -0,0 +1,130 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package keystone_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	"github.com/juju/qthttptest"
+	"gopkg.in/macaroon-bakery.v2/httpbakery/form"
+	"gopkg.in/yaml.v2"
+
+	"github.com/CanonicalLtd/candid/config"
+	keystoneidp "github.com/CanonicalLtd/candid/idp/keystone"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+func TestAppCred(t *testing.T) {
+	qtsuite.Run(qt.New(t), &appcredSuite{})
+}
+
+type appcredSuite struct {
+	*fixture
+}
+
+func (s *appcredSuite) Init(c *qt.C) {
+	s.fixture = newFixture(c, fixtureParams{
+		newIDP:              keystoneidp.NewV3AppCredIdentityProvider,
+		roleGroupTemplate:   "{{.Project}}-{{.Role}}",
+		authTokensFunc:      testAuthTokens,
+		userGroupsFunc:      testUserGroups,
+		roleAssignmentsFunc: testRoleAssignments,
+	})
+}
+
+func (s *appcredSuite) TestKeystoneV3AppCredIdentityProviderInteractive(c *qt.C) {
+	c.Assert(s.idp.Interactive(), qt.Equals, false)
+}
+
+func (s *appcredSuite) TestKeystoneV3AppCredIdentityProviderSchema(c *qt.C) {
+	req, err := http.NewRequest("GET", "https://idp.test/login?did=1", nil)
+	c.Assert(err, qt.Equals, nil)
+	rr := httptest.NewRecorder()
+	s.idp.Handle(s.idptest.Ctx, rr, req)
+	s.idptest.AssertLoginNotComplete(c)
+	qthttptest.AssertJSONResponse(c, rr, http.StatusOK, keystoneidp.AppCredSchemaResponse)
+}
+
+func (s *appcredSuite) TestKeystoneV3AppCredIdentityProviderHandle(c *qt.C) {
+	s.login(c, "appcred1", "s3cret")
+	s.idptest.AssertLoginSuccess(c, "testuser@openstack")
+	s.idptest.Store.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("openstack", "123@openstack"),
+		Username:   "testuser@openstack",
+		ProviderInfo: map[string][]string{
+			// The application credential token is scoped to
+			// a project, so the roles in the token are used.
+			"groups": {"abc_group", "myproject-member", "myproject-reader"},
+		},
+	})
+}
+
+func (s *appcredSuite) TestKeystoneV3AppCredIdentityProviderHandleBadSecret(c *qt.C) {
+	s.login(c, "appcred1", "wrong")
+	s.idptest.AssertLoginFailureMatches(c, `cannot log in: Post http.*: The request you have made requires authentication.`)
+}
+
+func (s *appcredSuite) TestKeystoneV3AppCredIdentityProviderHandleNoSecret(c *qt.C) {
+	body, err := json.Marshal(form.LoginBody{
+		Form: map[string]interface{}{
+			"id": "appcred1",
+		},
+	})
+	c.Assert(err, qt.Equals, nil)
+	req, err := http.NewRequest("POST", "https://idp.test/login?did=1", bytes.NewReader(body))
+	c.Assert(err, qt.Equals, nil)
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	s.idp.Handle(s.idptest.Ctx, rr, req)
+	s.idptest.AssertLoginFailureMatches(c, `cannot validate form: secret: expected string, got nothing`)
+}
+
+func (s *appcredSuite) TestRegisterConfig(c *qt.C) {
+	input := `
+identity-providers:
+ - type: keystonev3_appcred
+   name: openstackv3_appcred
+   url: https://example.com/keystone
+   role-group-template: "{{.Project}}-{{.Role}}"
+`
+	var conf config.Config
+	err := yaml.Unmarshal([]byte(input), &conf)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(conf.IdentityProviders, qt.HasLen, 1)
+	c.Assert(conf.IdentityProviders[0].Name(), qt.Equals, "openstackv3_appcred")
+}
+
+func (s *appcredSuite) TestRegisterConfigInvalidTemplate(c *qt.C) {
+	input := `
+identity-providers:
+ - type: keystonev3_appcred
+   name: openstackv3_appcred
+   url: https://example.com/keystone
+   role-group-template: "{{.Tenant}}"
+`
+	var conf config.Config
+	err := yaml.Unmarshal([]byte(input), &conf)
+	c.Assert(err, qt.ErrorMatches, `.*cannot unmarshal keystonev3_appcred configuration: invalid role-group-template: .*`)
+}
+
+func (s *appcredSuite) login(c *qt.C, id, secret string) {
+	body, err := json.Marshal(form.LoginBody{
+		Form: map[string]interface{}{
+			"id":     id,
+			"secret": secret,
+		},
+	})
+	c.Assert(err, qt.Equals, nil)
+	req, err := http.NewRequest("POST", "/login?did=1", bytes.NewReader(body))
+	c.Assert(err, qt.Equals, nil)
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	s.idp.Handle(s.idptest.Ctx, rr, req)
+}
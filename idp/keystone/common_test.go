@@ -26,13 +26,18 @@ type fixture struct {
 type fixtureParams struct {
 	newIDP func(p keystoneidp.Params) idp.IdentityProvider
 
+	// roleGroupTemplate is used as the RoleGroupTemplate parameter
+	// of the identity provider.
+	roleGroupTemplate string
+
 	// The folllowing fields correspond with similarly named
 	// fields in mockkeystone.Server, which will be initialized
 	// with the values there.
-	tokensFunc     func(*keystone.TokensRequest) (*keystone.TokensResponse, error)
-	authTokensFunc func(*keystone.AuthTokensRequest) (*keystone.AuthTokensResponse, error)
-	tenantsFunc    func(*keystone.TenantsRequest) (*keystone.TenantsResponse, error)
-	userGroupsFunc func(*keystone.UserGroupsRequest) (*keystone.UserGroupsResponse, error)
+	tokensFunc          func(*keystone.TokensRequest) (*keystone.TokensResponse, error)
+	authTokensFunc      func(*keystone.AuthTokensRequest) (*keystone.AuthTokensResponse, error)
+	tenantsFunc         func(*keystone.TenantsRequest) (*keystone.TenantsResponse, error)
+	userGroupsFunc      func(*keystone.UserGroupsRequest) (*keystone.UserGroupsResponse, error)
+	roleAssignmentsFunc func(*keystone.RoleAssignmentsRequest) (*keystone.RoleAssignmentsResponse, error)
 }
 
 func newFixture(c *qt.C, p fixtureParams) *fixture {
@@ -42,15 +47,17 @@ func newFixture(c *qt.C, p fixtureParams) *fixture {
 	s.server = mockkeystone.NewServer()
 	c.Defer(s.server.Close)
 	s.params = keystoneidp.Params{
-		Name:        "openstack",
-		Description: "OpenStack",
-		Domain:      "openstack",
-		URL:         s.server.URL,
+		Name:              "openstack",
+		Description:       "OpenStack",
+		Domain:            "openstack",
+		URL:               s.server.URL,
+		RoleGroupTemplate: p.roleGroupTemplate,
 	}
 	s.server.TokensFunc = p.tokensFunc
 	s.server.AuthTokensFunc = p.authTokensFunc
 	s.server.TenantsFunc = p.tenantsFunc
 	s.server.UserGroupsFunc = p.userGroupsFunc
+	s.server.RoleAssignmentsFunc = p.roleAssignmentsFunc
 	s.idp = p.newIDP(s.params)
 	err := s.idp.Init(s.idptest.Ctx, s.idptest.InitParams(c, idpPrefix))
 	c.Assert(err, qt.Equals, nil)
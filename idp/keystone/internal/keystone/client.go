@@ -87,6 +87,20 @@ func (c *Client) UserGroups(ctx context.Context, r *UserGroupsRequest) (*UserGro
 	return &resp, nil
 }
 
+// RoleAssignments provides access to the /v3/role_assignments
+// endpoint. See
+// https://docs.openstack.org/api-ref/identity/v3/index.html#list-role-assignments
+// for more information. This uses version 3 of the keystone protocol and
+// therefore cannot be used with older keystone servers that don't
+// support it.
+func (c *Client) RoleAssignments(ctx context.Context, r *RoleAssignmentsRequest) (*RoleAssignmentsResponse, error) {
+	var resp RoleAssignmentsResponse
+	if err := c.client.Call(ctx, r, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // Error represents an error from a keystone server.
 type Error struct {
 	Code    int    `json:"code"`
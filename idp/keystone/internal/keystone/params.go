@@ -125,9 +125,10 @@ type AuthV3 struct {
 
 // Identity contains the identity information sent in a v3 login request.
 type Identity struct {
-	Methods  []string       `json:"methods"`
-	Password *Password      `json:"password,omitempty"`
-	Token    *IdentityToken `json:"token,omitempty"`
+	Methods               []string               `json:"methods"`
+	Password              *Password              `json:"password,omitempty"`
+	Token                 *IdentityToken         `json:"token,omitempty"`
+	ApplicationCredential *ApplicationCredential `json:"application_credential,omitempty"`
 }
 
 // Password contains the password based identity information sent in a
@@ -142,6 +143,19 @@ type IdentityToken struct {
 	ID string `json:"id"`
 }
 
+// ApplicationCredential contains the application credential based
+// identity information sent in a v3 login request. An application
+// credential is identified either by its ID, or by its name along
+// with the user that owns it. See
+// https://docs.openstack.org/api-ref/identity/v3/index.html#authenticating-with-an-application-credential
+// for more information.
+type ApplicationCredential struct {
+	ID     string `json:"id,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Secret string `json:"secret"`
+	User   *User  `json:"user,omitempty"`
+}
+
 // Domain contains the domain of a user in the v3 API.
 type Domain struct {
 	ID   string `json:"id,omitempty"`
@@ -170,6 +184,25 @@ type TokenV3 struct {
 	Methods   []string `json:"methods,omitempty"`
 	ExpiresAt *Time    `json:"expires_at,omitempty"`
 	User      User     `json:"user"`
+
+	// Project and Roles are only set if the token is scoped to a
+	// project, as is always the case for tokens obtained with an
+	// application credential.
+	Project *Project `json:"project,omitempty"`
+	Roles   []Role   `json:"roles,omitempty"`
+}
+
+// Project contains information on a keystone project.
+type Project struct {
+	ID     string  `json:"id"`
+	Name   string  `json:"name"`
+	Domain *Domain `json:"domain,omitempty"`
+}
+
+// Role contains information on a keystone role.
+type Role struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
 }
 
 // UserGroupsRequest represents a request to the /v3/users/:id/groups
@@ -197,3 +230,40 @@ type Group struct {
 	Name        string `json:"name"`
 	Description string `json:"description"`
 }
+
+// RoleAssignmentsRequest represents a request to the
+// /v3/role_assignments endpoint. See
+// https://docs.openstack.org/api-ref/identity/v3/index.html#list-role-assignments
+// for more information.
+type RoleAssignmentsRequest struct {
+	httprequest.Route `httprequest:"GET /v3/role_assignments"`
+	UserID            string `httprequest:"user.id,form"`
+
+	// Effective and IncludeNames should be set to "true" to
+	// include roles inherited through group membership and the
+	// names of the projects and roles respectively.
+	Effective    string `httprequest:"effective,form,omitempty"`
+	IncludeNames string `httprequest:"include_names,form,omitempty"`
+	AuthToken    string `httprequest:"X-Auth-Token,header"`
+}
+
+// RoleAssignmentsResponse represents a response to the
+// /v3/role_assignments endpoint. See
+// https://docs.openstack.org/api-ref/identity/v3/index.html#list-role-assignments
+// for more information.
+type RoleAssignmentsResponse struct {
+	RoleAssignments []RoleAssignment `json:"role_assignments"`
+}
+
+// RoleAssignment contains information on a single role assignment.
+type RoleAssignment struct {
+	Role  Role  `json:"role"`
+	Scope Scope `json:"scope"`
+}
+
+// Scope contains the scope of a role assignment. Only one of Project
+// and Domain will be set.
+type Scope struct {
+	Project *Project `json:"project,omitempty"`
+	Domain  *Domain  `json:"domain,omitempty"`
+}
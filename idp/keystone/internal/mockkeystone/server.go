@@ -33,6 +33,10 @@ type Server struct {
 	// UserGroupsFunc handles the /v3/users/:id/groups endpoint. This must be set
 	// before the endpoint can be used.
 	UserGroupsFunc func(*keystone.UserGroupsRequest) (*keystone.UserGroupsResponse, error)
+
+	// RoleAssignmentsFunc handles the /v3/role_assignments endpoint.
+	// This must be set before the endpoint can be used.
+	RoleAssignmentsFunc func(*keystone.RoleAssignmentsRequest) (*keystone.RoleAssignmentsResponse, error)
 }
 
 // NewServer creates a new Server for use in tests.
@@ -49,10 +53,11 @@ func NewServer() *Server {
 // handler creates a new handler for a request.
 func (s *Server) handler(p httprequest.Params) (*handler, context.Context, error) {
 	return &handler{
-		tokens:     s.TokensFunc,
-		authTokens: s.AuthTokensFunc,
-		tenants:    s.TenantsFunc,
-		userGroups: s.UserGroupsFunc,
+		tokens:          s.TokensFunc,
+		authTokens:      s.AuthTokensFunc,
+		tenants:         s.TenantsFunc,
+		userGroups:      s.UserGroupsFunc,
+		roleAssignments: s.RoleAssignmentsFunc,
 	}, p.Context, nil
 }
 
@@ -72,10 +77,11 @@ var reqServer = httprequest.Server{
 }
 
 type handler struct {
-	tokens     func(*keystone.TokensRequest) (*keystone.TokensResponse, error)
-	authTokens func(*keystone.AuthTokensRequest) (*keystone.AuthTokensResponse, error)
-	tenants    func(*keystone.TenantsRequest) (*keystone.TenantsResponse, error)
-	userGroups func(*keystone.UserGroupsRequest) (*keystone.UserGroupsResponse, error)
+	tokens          func(*keystone.TokensRequest) (*keystone.TokensResponse, error)
+	authTokens      func(*keystone.AuthTokensRequest) (*keystone.AuthTokensResponse, error)
+	tenants         func(*keystone.TenantsRequest) (*keystone.TenantsResponse, error)
+	userGroups      func(*keystone.UserGroupsRequest) (*keystone.UserGroupsResponse, error)
+	roleAssignments func(*keystone.RoleAssignmentsRequest) (*keystone.RoleAssignmentsResponse, error)
 }
 
 func (h *handler) Tokens(r *keystone.TokensRequest) (*keystone.TokensResponse, error) {
@@ -93,3 +99,7 @@ func (h *handler) Tenants(r *keystone.TenantsRequest) (*keystone.TenantsResponse
 func (h *handler) UserGroups(r *keystone.UserGroupsRequest) (*keystone.UserGroupsResponse, error) {
 	return h.userGroups(r)
 }
+
+func (h *handler) RoleAssignments(r *keystone.RoleAssignmentsRequest) (*keystone.RoleAssignmentsResponse, error) {
+	return h.roleAssignments(r)
+}
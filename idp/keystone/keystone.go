@@ -6,9 +6,12 @@
 package keystone
 
 import (
+	"bytes"
 	"context"
+	"io/ioutil"
 	"net/http"
 	"strings"
+	"text/template"
 
 	"github.com/juju/loggo"
 	"gopkg.in/CanonicalLtd/candidclient.v1/params"
@@ -18,6 +21,7 @@ import (
 	"github.com/CanonicalLtd/candid/idp"
 	"github.com/CanonicalLtd/candid/idp/idputil"
 	"github.com/CanonicalLtd/candid/idp/keystone/internal/keystone"
+	"github.com/CanonicalLtd/candid/internal/logging"
 	"github.com/CanonicalLtd/candid/store"
 )
 
@@ -42,6 +46,9 @@ func constructor(f func(Params) idp.IdentityProvider) func(func(interface{}) err
 		if p.URL == "" {
 			return nil, errgo.Newf("url not specified")
 		}
+		if _, err := parseRoleGroupTemplate(p.RoleGroupTemplate); err != nil {
+			return nil, errgo.Mask(err)
+		}
 		return f(p), nil
 	}
 }
@@ -71,6 +78,31 @@ type Params struct {
 	// Hidden is set if the IDP should be hidden from interactive
 	// prompts.
 	Hidden bool `yaml:"hidden"`
+
+	// RoleGroupTemplate, if set, is a text/template that is used to
+	// create additional groups from the role assignments of users
+	// logging in with the keystone v3 protocol. The template is
+	// executed once for each role assignment with a RoleAssignment
+	// value, for example "{{.Project}}-{{.Role}}". Empty results
+	// are ignored.
+	RoleGroupTemplate string `yaml:"role-group-template"`
+}
+
+// RoleAssignment holds the details of a keystone role assignment
+// that are available to a RoleGroupTemplate.
+type RoleAssignment struct {
+	// Role holds the name of the assigned role.
+	Role string
+
+	// Project and ProjectID hold the name and ID of the project
+	// the role is assigned in. They are empty if the role is
+	// assigned on a domain.
+	Project   string
+	ProjectID string
+
+	// Domain holds the name of the domain that contains the
+	// project, or of the domain that the role is assigned on.
+	Domain string
 }
 
 // NewIdentityProvider creates an interactive keystone identity provider
@@ -95,9 +127,10 @@ func newIdentityProvider(p Params) identityProvider {
 // identityProvider is an idp.IdentityProvider that authenticates against
 // a keystone server.
 type identityProvider struct {
-	params     Params
-	initParams idp.InitParams
-	client     *keystone.Client
+	params        Params
+	initParams    idp.InitParams
+	client        *keystone.Client
+	groupTemplate *template.Template
 }
 
 // Name implements idp.IdentityProvider.Name.
@@ -133,6 +166,11 @@ func (idp *identityProvider) Hidden() bool {
 // Init implements idp.IdentityProvider.Init.
 func (idp *identityProvider) Init(_ context.Context, params idp.InitParams) error {
 	idp.initParams = params
+	t, err := parseRoleGroupTemplate(idp.params.RoleGroupTemplate)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	idp.groupTemplate = t
 	return nil
 }
 
@@ -152,11 +190,17 @@ func (*identityProvider) GetGroups(ctx context.Context, identity *store.Identity
 	return identity.ProviderInfo["groups"], nil
 }
 
+// CheckHealth implements idp.HealthChecker.CheckHealth by checking
+// that the keystone server is reachable.
+func (idp *identityProvider) CheckHealth(ctx context.Context) error {
+	return errgo.Mask(idputil.CheckURL(ctx, idp.params.URL))
+}
+
 // Handle implements idp.IdentityProvider.Handle.
 func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	var ls idputil.LoginState
 	if err := idp.initParams.Codec.Cookie(req, idputil.LoginCookieName, req.Form.Get("state"), &ls); err != nil {
-		logger.Infof("Invalid login state: %s", err)
+		logging.FromContext(ctx, logger).Infof("Invalid login state: %s", err)
 		idputil.BadRequestf(w, "Login failed: invalid login state")
 		return
 	}
@@ -169,7 +213,7 @@ func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter,
 			Name:        idp.params.Name,
 			URL:         idp.URL(req.Form.Get("state")),
 		}
-		id, err := idputil.HandleLoginForm(ctx, w, req, idpChoice, idp.initParams.Template, idp.loginUser)
+		id, err := idputil.HandleLoginForm(ctx, w, req, idpChoice, idp.initParams.Codec.CSRFToken(req.Form.Get("state")), idp.initParams.Template, idp.initParams.LoginChallenger, idp.initParams.LoginLocker, idp.loginUser)
 		if err != nil {
 			idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
 		}
@@ -254,6 +298,11 @@ func (idp *identityProvider) doLoginV3(ctx context.Context, a keystone.AuthV3) (
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	roleGroups, err := idp.getRoleGroups(ctx, resp)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	groups = append(groups, roleGroups...)
 	user := &store.Identity{
 		ProviderID: store.MakeProviderIdentity(idp.Name(), idp.qualifiedName(resp.Token.User.ID)),
 		Username:   idp.qualifiedName(resp.Token.User.Name),
@@ -293,6 +342,90 @@ func (idp *identityProvider) getGroupsV3(ctx context.Context, token, user string
 	return groups, nil
 }
 
+// getRoleGroups determines the role assignments of the user that
+// logged in to create resp and converts them to group names using the
+// configured RoleGroupTemplate. If resp holds a project scoped token
+// the roles in the token are used, otherwise the user's effective
+// role assignments are retrieved from keystone.
+func (idp *identityProvider) getRoleGroups(ctx context.Context, resp *keystone.AuthTokensResponse) ([]string, error) {
+	if idp.groupTemplate == nil {
+		return nil, nil
+	}
+	var ras []RoleAssignment
+	if p := resp.Token.Project; p != nil && len(resp.Token.Roles) > 0 {
+		for _, r := range resp.Token.Roles {
+			ras = append(ras, RoleAssignment{
+				Role:      r.Name,
+				Project:   p.Name,
+				ProjectID: p.ID,
+				Domain:    domainName(p.Domain),
+			})
+		}
+	} else {
+		raResp, err := idp.client.RoleAssignments(ctx, &keystone.RoleAssignmentsRequest{
+			UserID:       resp.Token.User.ID,
+			Effective:    "true",
+			IncludeNames: "true",
+			AuthToken:    resp.SubjectToken,
+		})
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot get role assignments")
+		}
+		for _, a := range raResp.RoleAssignments {
+			ra := RoleAssignment{
+				Role: a.Role.Name,
+			}
+			if p := a.Scope.Project; p != nil {
+				ra.Project = p.Name
+				ra.ProjectID = p.ID
+				ra.Domain = domainName(p.Domain)
+			} else {
+				ra.Domain = domainName(a.Scope.Domain)
+			}
+			ras = append(ras, ra)
+		}
+	}
+	var groups []string
+	seen := make(map[string]bool)
+	for _, ra := range ras {
+		var buf bytes.Buffer
+		if err := idp.groupTemplate.Execute(&buf, ra); err != nil {
+			return nil, errgo.Notef(err, "cannot create group for role assignment")
+		}
+		g := strings.TrimSpace(buf.String())
+		if g == "" || seen[g] {
+			continue
+		}
+		seen[g] = true
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+func domainName(d *keystone.Domain) string {
+	if d == nil {
+		return ""
+	}
+	return d.Name
+}
+
+// parseRoleGroupTemplate parses the given RoleGroupTemplate. If s is
+// empty then a nil template is returned.
+func parseRoleGroupTemplate(s string) (*template.Template, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := template.New("").Parse(s)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid role-group-template")
+	}
+	// Check that the template only refers to fields that exist.
+	if err := t.Execute(ioutil.Discard, RoleAssignment{}); err != nil {
+		return nil, errgo.Notef(err, "invalid role-group-template")
+	}
+	return t, nil
+}
+
 // qualifiedName returns the given name qualified as appropriate with
 // the provider's configured domain.
 func (idp *identityProvider) qualifiedName(name string) string {
@@ -251,12 +251,39 @@ func testTenants(r *keystone.TenantsRequest) (*keystone.TenantsResponse, error)
 func testAuthTokens(req *keystone.AuthTokensRequest) (*keystone.AuthTokensResponse, error) {
 	var id string
 	var username string
+	var project *keystone.Project
+	var roles []keystone.Role
 	if req.Body.Auth.Identity.Password != nil {
 		return nil, &keystone.Error{
 			Code:    http.StatusUnauthorized,
 			Message: "password authentication not yet supported.",
 			Title:   "Not Authorized",
 		}
+	} else if ac := req.Body.Auth.Identity.ApplicationCredential; ac != nil {
+		if ac.ID != "appcred1" || ac.Secret != "s3cret" {
+			return nil, &keystone.Error{
+				Code:    http.StatusUnauthorized,
+				Message: "The request you have made requires authentication.",
+				Title:   "Not Authorized",
+			}
+		}
+		id = "123"
+		username = "testuser"
+		project = &keystone.Project{
+			ID:   "p1",
+			Name: "myproject",
+			Domain: &keystone.Domain{
+				ID:   "default",
+				Name: "Default",
+			},
+		}
+		roles = []keystone.Role{{
+			ID:   "r1",
+			Name: "member",
+		}, {
+			ID:   "r2",
+			Name: "reader",
+		}}
 	} else {
 		if req.Body.Auth.Identity.Token.ID != "789" {
 			return nil, &keystone.Error{
@@ -279,6 +306,8 @@ func testAuthTokens(req *keystone.AuthTokensRequest) (*keystone.AuthTokensRespon
 					Name: "Default",
 				},
 			},
+			Project: project,
+			Roles:   roles,
 		},
 	}, nil
 }
@@ -299,3 +328,37 @@ func testUserGroups(req *keystone.UserGroupsRequest) (*keystone.UserGroupsRespon
 		}},
 	}, nil
 }
+
+func testRoleAssignments(req *keystone.RoleAssignmentsRequest) (*keystone.RoleAssignmentsResponse, error) {
+	if req.AuthToken != "abcd" {
+		return nil, &keystone.Error{
+			Code:    http.StatusUnauthorized,
+			Message: "bad token",
+			Title:   "Unauthorized",
+		}
+	}
+	if req.UserID != "123" || req.Effective != "true" || req.IncludeNames != "true" {
+		return nil, &keystone.Error{
+			Code:    http.StatusBadRequest,
+			Message: "unexpected request",
+			Title:   "Bad Request",
+		}
+	}
+	return &keystone.RoleAssignmentsResponse{
+		RoleAssignments: []keystone.RoleAssignment{{
+			Role: keystone.Role{ID: "r1", Name: "admin"},
+			Scope: keystone.Scope{
+				Project: &keystone.Project{
+					ID:     "p1",
+					Name:   "myproject",
+					Domain: &keystone.Domain{ID: "default", Name: "Default"},
+				},
+			},
+		}, {
+			Role: keystone.Role{ID: "r2", Name: "reader"},
+			Scope: keystone.Scope{
+				Domain: &keystone.Domain{ID: "default", Name: "Default"},
+			},
+		}},
+	}, nil
+}
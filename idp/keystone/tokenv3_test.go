@@ -66,6 +66,35 @@ func (s *tokenV3Suite) TestKeystoneV3TokenIdentityProviderHandle(c *qt.C) {
 	})
 }
 
+func (s *tokenV3Suite) TestKeystoneV3TokenIdentityProviderHandleRoleGroups(c *qt.C) {
+	s.fixture = newFixture(c, fixtureParams{
+		newIDP:              keystoneidp.NewV3TokenIdentityProvider,
+		roleGroupTemplate:   "{{if .Project}}{{.Domain}}/{{.Project}}/{{.Role}}{{end}}",
+		authTokensFunc:      testAuthTokens,
+		userGroupsFunc:      testUserGroups,
+		roleAssignmentsFunc: testRoleAssignments,
+	})
+	var tok keystoneidp.Token
+	tok.Login.ID = "789"
+	body, err := json.Marshal(tok)
+	c.Assert(err, qt.Equals, nil)
+	req, err := http.NewRequest("POST", "/login?did=1", bytes.NewReader(body))
+	c.Assert(err, qt.Equals, nil)
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	s.idp.Handle(s.idptest.Ctx, rr, req)
+	s.idptest.AssertLoginSuccess(c, "testuser@openstack")
+	s.idptest.Store.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("openstack", "123@openstack"),
+		Username:   "testuser@openstack",
+		ProviderInfo: map[string][]string{
+			// The domain scoped assignment produces an
+			// empty group name, which is ignored.
+			"groups": {"abc_group", "Default/myproject/admin"},
+		},
+	})
+}
+
 func (s *tokenV3Suite) TestKeystoneV3TokenIdentityProviderHandleBadToken(c *qt.C) {
 	var tok keystoneidp.Token
 	tok.Login.ID = "012"
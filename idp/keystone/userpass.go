@@ -71,16 +71,24 @@ func (idp *userpassIdentityProvider) Handle(ctx context.Context, w http.Response
 		return
 	}
 	m := frm.(map[string]interface{})
+	username := m["username"].(string)
+	locker := idp.initParams.LoginLocker
+	if err := locker.Check(ctx, idp.Name(), username); err != nil {
+		idp.initParams.VisitCompleter.Failure(ctx, w, req, idputil.DischargeID(req), errgo.Mask(err))
+		return
+	}
 	user, err := idp.doLogin(ctx, keystone.Auth{
 		PasswordCredentials: &keystone.PasswordCredentials{
-			Username: m["username"].(string),
+			Username: username,
 			Password: m["password"].(string),
 		},
 	})
 	if err != nil {
+		locker.Failed(ctx, idp.Name(), username)
 		idp.initParams.VisitCompleter.Failure(ctx, w, req, idputil.DischargeID(req), errgo.Notef(err, "cannot validate form"))
 		return
 	}
+	locker.Succeeded(ctx, idp.Name(), username)
 	if strings.TrimPrefix(req.URL.Path, idp.initParams.URLPrefix) == "/interact" {
 		dt, err := idp.initParams.DischargeTokenCreator.DischargeToken(ctx, user)
 		if err != nil {
@@ -0,0 +1,401 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package kubernetes is an identity provider that authenticates
+// Kubernetes workloads using their service account tokens, so that
+// they can log in without being given agent keys.
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/go-oidc"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/idputil"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// InteractionMethod is the name of the interaction method used by the
+// kubernetes identity provider.
+const InteractionMethod = "kubernetes"
+
+// serviceAccountDir holds the directory in which the credentials of
+// the pod's service account are mounted.
+var serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+func init() {
+	idp.Register("kubernetes", func(unmarshal func(interface{}) error) (idp.IdentityProvider, error) {
+		var p Params
+		if err := unmarshal(&p); err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal kubernetes parameters")
+		}
+		if p.Name == "" {
+			p.Name = "kubernetes"
+		}
+		i, err := NewIdentityProvider(p)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid kubernetes parameters")
+		}
+		return i, nil
+	})
+}
+
+// Params holds the parameters of the kubernetes identity provider.
+// Tokens are validated either by the cluster's TokenReview API, when
+// InCluster or APIServer is set, or against the keys published at
+// JWKSURL.
+type Params struct {
+	// Name is the name that will be given to the identity provider.
+	Name string `yaml:"name"`
+
+	// Description is the description of the IDP shown to the user on
+	// the IDP selection page.
+	Description string `yaml:"description"`
+
+	// Icon contains the URL or path of an icon.
+	Icon string `yaml:"icon"`
+
+	// Domain is the domain with which all identities created by this
+	// identity provider will be tagged (not including the @ separator).
+	Domain string `yaml:"domain"`
+
+	// Hidden is set if the IDP should be hidden from interactive
+	// prompts.
+	Hidden bool `yaml:"hidden"`
+
+	// Audience holds the audience that service account tokens must
+	// be issued for. If this is empty the location of the identity
+	// server is used.
+	Audience string `yaml:"audience"`
+
+	// Namespaces, if set, holds the namespaces whose service
+	// accounts may log in.
+	Namespaces []string `yaml:"namespaces"`
+
+	// InCluster holds whether the identity server is running in the
+	// cluster, in which case the TokenReview API is reached using
+	// the pod's own service account.
+	InCluster bool `yaml:"in-cluster"`
+
+	// APIServer holds the URL of the cluster's API server, used to
+	// review tokens when the identity server runs outside the
+	// cluster.
+	APIServer string `yaml:"api-server"`
+
+	// Token holds the bearer token used to authenticate to
+	// APIServer. The token must be allowed to create TokenReviews,
+	// for example by the system:auth-delegator cluster role.
+	Token string `yaml:"token"`
+
+	// CACert holds the PEM encoded certificate of the certificate
+	// authority of APIServer. If it is empty the system roots are
+	// used.
+	CACert string `yaml:"ca-cert"`
+
+	// JWKSURL holds the URL of the keys used to sign service
+	// account tokens, used when the TokenReview API is not.
+	JWKSURL string `yaml:"jwks-url"`
+
+	// Issuer holds the issuer of service account tokens, which must
+	// be set with JWKSURL.
+	Issuer string `yaml:"issuer"`
+}
+
+// NewIdentityProvider creates a new kubernetes identity provider with
+// the given parameters.
+func NewIdentityProvider(p Params) (idp.IdentityProvider, error) {
+	if p.Description == "" {
+		p.Description = p.Name
+	}
+	n := 0
+	for _, set := range []bool{p.InCluster, p.APIServer != "", p.JWKSURL != ""} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return nil, errgo.Newf("exactly one of in-cluster, api-server and jwks-url must be specified")
+	}
+	if p.JWKSURL != "" && p.Issuer == "" {
+		return nil, errgo.Newf("issuer not specified")
+	}
+	if p.APIServer != "" && p.Token == "" {
+		return nil, errgo.Newf("token not specified")
+	}
+	return &identityProvider{
+		params: p,
+	}, nil
+}
+
+// identityProvider is an idp.IdentityProvider that authenticates
+// kubernetes service accounts.
+type identityProvider struct {
+	params     Params
+	initParams idp.InitParams
+	review     *tokenReviewer
+	verifier   *oidc.IDTokenVerifier
+}
+
+// Name implements idp.IdentityProvider.Name.
+func (idp *identityProvider) Name() string {
+	return idp.params.Name
+}
+
+// Domain implements idp.IdentityProvider.Domain.
+func (idp *identityProvider) Domain() string {
+	return idp.params.Domain
+}
+
+// Description implements idp.IdentityProvider.Description.
+func (idp *identityProvider) Description() string {
+	return idp.params.Description
+}
+
+// IconURL returns the URL of an icon for the identity provider.
+func (idp *identityProvider) IconURL() string {
+	return idputil.ServiceURL(idp.initParams.Location, idp.params.Icon)
+}
+
+// Interactive implements idp.IdentityProvider.Interactive.
+func (*identityProvider) Interactive() bool {
+	return false
+}
+
+// Hidden implements idp.IdentityProvider.Hidden.
+func (idp *identityProvider) Hidden() bool {
+	return idp.params.Hidden
+}
+
+// Init implements idp.IdentityProvider.Init.
+func (idp *identityProvider) Init(_ context.Context, params idp.InitParams) error {
+	idp.initParams = params
+	if idp.params.Audience == "" {
+		idp.params.Audience = params.Location
+	}
+	switch {
+	case idp.params.JWKSURL != "":
+		keys := oidc.NewRemoteKeySet(context.Background(), idp.params.JWKSURL)
+		idp.verifier = oidc.NewVerifier(idp.params.Issuer, keys, &oidc.Config{
+			ClientID:             idp.params.Audience,
+			SupportedSigningAlgs: []string{oidc.RS256, oidc.ES256},
+		})
+		return nil
+	case idp.params.InCluster:
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return errgo.Newf("not running in a kubernetes cluster")
+		}
+		ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		client, err := newClient(string(ca))
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		idp.review = &tokenReviewer{
+			url:       "https://" + net.JoinHostPort(host, port),
+			tokenFile: filepath.Join(serviceAccountDir, "token"),
+			client:    client,
+		}
+	default:
+		client, err := newClient(idp.params.CACert)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		idp.review = &tokenReviewer{
+			url:    strings.TrimSuffix(idp.params.APIServer, "/"),
+			token:  idp.params.Token,
+			client: client,
+		}
+	}
+	return nil
+}
+
+// URL implements idp.IdentityProvider.URL.
+func (idp *identityProvider) URL(state string) string {
+	return idputil.RedirectURL(idp.initParams.URLPrefix, "/login", state)
+}
+
+// SetInteraction implements idp.IdentityProvider.SetInteraction.
+func (idp *identityProvider) SetInteraction(ierr *httpbakery.Error, dischargeID string) {
+	ierr.SetInteraction(InteractionMethod, InteractionInfo{
+		URL: idputil.URL(idp.initParams.URLPrefix, "/interact", dischargeID),
+	})
+}
+
+// GetGroups implements idp.IdentityProvider.GetGroups.
+func (*identityProvider) GetGroups(_ context.Context, identity *store.Identity) ([]string, error) {
+	return identity.ProviderInfo["groups"], nil
+}
+
+// Handle implements idp.IdentityProvider.Handle.
+func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	user, err := idp.login(ctx, req)
+	if err != nil {
+		idp.initParams.VisitCompleter.Failure(ctx, w, req, idputil.DischargeID(req), err)
+		return
+	}
+	if strings.TrimPrefix(req.URL.Path, idp.initParams.URLPrefix) == "/interact" {
+		dt, err := idp.initParams.DischargeTokenCreator.DischargeToken(ctx, user)
+		if err != nil {
+			idp.initParams.VisitCompleter.Failure(ctx, w, req, idputil.DischargeID(req), err)
+			return
+		}
+		httprequest.WriteJSON(w, http.StatusOK, LoginResponse{
+			DischargeToken: dt,
+		})
+	} else {
+		idp.initParams.VisitCompleter.Success(ctx, w, req, idputil.DischargeID(req), user)
+	}
+}
+
+// LoginRequest is the request sent by a workload to log in.
+type LoginRequest struct {
+	httprequest.Route `httprequest:"POST"`
+	Body              LoginBody `httprequest:",body"`
+}
+
+// LoginBody holds the service account token of a workload.
+type LoginBody struct {
+	Token string `json:"token"`
+}
+
+// login authenticates the service account token sent with the given
+// request and updates the identity of the service account.
+func (idp *identityProvider) login(ctx context.Context, req *http.Request) (*store.Identity, error) {
+	var lr LoginRequest
+	if err := httprequest.Unmarshal(idputil.RequestParams(ctx, nil, req), &lr); err != nil {
+		return nil, errgo.WithCausef(err, params.ErrBadRequest, "cannot unmarshal login request")
+	}
+	if lr.Body.Token == "" {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "token not specified")
+	}
+	var sa *serviceAccount
+	var err error
+	if idp.verifier != nil {
+		sa, err = idp.verifyToken(ctx, lr.Body.Token)
+	} else {
+		sa, err = idp.review.review(ctx, lr.Body.Token, idp.params.Audience)
+	}
+	if err != nil {
+		return nil, errgo.WithCausef(err, params.ErrUnauthorized, "invalid service account token")
+	}
+	if len(idp.params.Namespaces) > 0 && !contains(idp.params.Namespaces, sa.namespace) {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "namespace %q not allowed", sa.namespace)
+	}
+	user := &store.Identity{
+		ProviderID: store.MakeProviderIdentity(idp.Name(), sa.namespace+"/"+sa.name),
+		Username:   idp.qualifiedName(sa.name + "." + sa.namespace),
+		ProviderInfo: map[string][]string{
+			"groups": {idp.qualifiedName(sa.namespace)},
+		},
+	}
+	if err := idp.initParams.Store.UpdateIdentity(
+		ctx,
+		user,
+		store.Update{
+			store.Username:     store.Set,
+			store.ProviderInfo: store.Set,
+		},
+	); err != nil {
+		return nil, errgo.Notef(err, "cannot update identity")
+	}
+	return user, nil
+}
+
+// serviceAccount identifies a kubernetes service account.
+type serviceAccount struct {
+	namespace string
+	name      string
+}
+
+// tokenClaims holds the claims of a projected service account token.
+type tokenClaims struct {
+	Kubernetes struct {
+		Namespace      string `json:"namespace"`
+		ServiceAccount struct {
+			Name string `json:"name"`
+		} `json:"serviceaccount"`
+	} `json:"kubernetes.io"`
+}
+
+// verifyToken verifies the given token against the configured keys.
+func (idp *identityProvider) verifyToken(ctx context.Context, token string) (*serviceAccount, error) {
+	tok, err := idp.verifier.Verify(ctx, token)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var claims tokenClaims
+	if err := tok.Claims(&claims); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	sa := serviceAccount{
+		namespace: claims.Kubernetes.Namespace,
+		name:      claims.Kubernetes.ServiceAccount.Name,
+	}
+	if sa.namespace == "" || sa.name == "" {
+		return nil, errgo.Newf("token does not identify a service account")
+	}
+	return &sa, nil
+}
+
+// qualifiedName returns the given name qualified as appropriate with
+// the provider's configured domain.
+func (idp *identityProvider) qualifiedName(name string) string {
+	if idp.params.Domain != "" {
+		return name + "@" + idp.params.Domain
+	}
+	return name
+}
+
+// newClient returns an HTTP client that trusts the given PEM encoded
+// CA certificate, or the system roots if it is empty.
+func newClient(caCert string) (*http.Client, error) {
+	if caCert == "" {
+		return http.DefaultClient, nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(caCert)) {
+		return nil, errgo.Newf("no certificates found in ca-cert")
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}, nil
+}
+
+// InteractionInfo is the interaction info for the kubernetes
+// interaction method. To log in the client POSTs a LoginBody to URL.
+type InteractionInfo struct {
+	URL string `json:"url"`
+}
+
+// LoginResponse is the response sent for a successful login.
+type LoginResponse struct {
+	DischargeToken *httpbakery.DischargeToken `json:"discharge-token"`
+}
+
+func contains(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
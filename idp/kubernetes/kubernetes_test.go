@@ -0,0 +1,256 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package kubernetes_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	"github.com/juju/simplekv/memsimplekv"
+	"gopkg.in/yaml.v2"
+
+	"github.com/CanonicalLtd/candid/config"
+	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/idptest"
+	"github.com/CanonicalLtd/candid/idp/kubernetes"
+	"github.com/CanonicalLtd/candid/internal/candidtest"
+	"github.com/CanonicalLtd/candid/internal/jwt"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+const (
+	idpPrefix    = "https://idp.example.com"
+	testAudience = "https://candid.example.com"
+	testIssuer   = "https://kubernetes.default.svc"
+)
+
+type kubernetesSuite struct {
+	idptest *idptest.Fixture
+}
+
+func TestKubernetes(t *testing.T) {
+	qtsuite.Run(qt.New(t), &kubernetesSuite{})
+}
+
+func (s *kubernetesSuite) Init(c *qt.C) {
+	s.idptest = idptest.NewFixture(c, candidtest.NewStore())
+}
+
+func (s *kubernetesSuite) setupIdp(c *qt.C, p kubernetes.Params) idp.IdentityProvider {
+	p.Name = "k8s"
+	p.Audience = testAudience
+	i, err := kubernetes.NewIdentityProvider(p)
+	c.Assert(err, qt.Equals, nil)
+	err = i.Init(context.Background(), s.idptest.InitParams(c, idpPrefix))
+	c.Assert(err, qt.Equals, nil)
+	return i
+}
+
+// tokenReviewServer returns an API server that authenticates the
+// token "good-token" as the given user.
+func tokenReviewServer(c *qt.C, username string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/apis/authentication.k8s.io/v1/tokenreviews" || req.Header.Get("Authorization") != "Bearer reviewer-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var review map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&review); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		spec := review["spec"].(map[string]interface{})
+		status := map[string]interface{}{
+			"authenticated": false,
+			"error":         "invalid bearer token",
+		}
+		if spec["token"] == "good-token" && len(spec["audiences"].([]interface{})) == 1 && spec["audiences"].([]interface{})[0] == testAudience {
+			status = map[string]interface{}{
+				"authenticated": true,
+				"user": map[string]interface{}{
+					"username": username,
+					"groups":   []string{"system:serviceaccounts"},
+				},
+			}
+		}
+		review["status"] = status
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(review)
+	}))
+	c.Defer(srv.Close)
+	return srv
+}
+
+func (s *kubernetesSuite) TestTokenReviewLogin(c *qt.C) {
+	srv := tokenReviewServer(c, "system:serviceaccount:ci:builder")
+	i := s.setupIdp(c, kubernetes.Params{
+		APIServer: srv.URL,
+		Token:     "reviewer-token",
+	})
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), loginRequest(c, "/login", "good-token"))
+	s.idptest.AssertLoginSuccess(c, "builder.ci")
+	s.idptest.Store.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("k8s", "ci/builder"),
+		Username:   "builder.ci",
+		ProviderInfo: map[string][]string{
+			"groups": {"ci"},
+		},
+	})
+}
+
+func (s *kubernetesSuite) TestTokenReviewInteract(c *qt.C) {
+	srv := tokenReviewServer(c, "system:serviceaccount:ci:builder")
+	i := s.setupIdp(c, kubernetes.Params{
+		APIServer: srv.URL,
+		Token:     "reviewer-token",
+	})
+	rr := httptest.NewRecorder()
+	i.Handle(s.idptest.Ctx, rr, loginRequest(c, "/interact", "good-token"))
+	c.Assert(rr.Code, qt.Equals, http.StatusOK, qt.Commentf("%s", rr.Body))
+	var resp kubernetes.LoginResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &resp)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(resp.DischargeToken, qt.Not(qt.IsNil))
+}
+
+func (s *kubernetesSuite) TestTokenReviewRejected(c *qt.C) {
+	srv := tokenReviewServer(c, "system:serviceaccount:ci:builder")
+	i := s.setupIdp(c, kubernetes.Params{
+		APIServer: srv.URL,
+		Token:     "reviewer-token",
+	})
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), loginRequest(c, "/login", "bad-token"))
+	s.idptest.AssertLoginFailureMatches(c, `invalid service account token: invalid bearer token`)
+}
+
+func (s *kubernetesSuite) TestTokenReviewNotServiceAccount(c *qt.C) {
+	srv := tokenReviewServer(c, "alice")
+	i := s.setupIdp(c, kubernetes.Params{
+		APIServer: srv.URL,
+		Token:     "reviewer-token",
+	})
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), loginRequest(c, "/login", "good-token"))
+	s.idptest.AssertLoginFailureMatches(c, `invalid service account token: token does not identify a service account`)
+}
+
+func (s *kubernetesSuite) TestNamespaceNotAllowed(c *qt.C) {
+	srv := tokenReviewServer(c, "system:serviceaccount:ci:builder")
+	i := s.setupIdp(c, kubernetes.Params{
+		APIServer:  srv.URL,
+		Token:      "reviewer-token",
+		Namespaces: []string{"prod"},
+	})
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), loginRequest(c, "/login", "good-token"))
+	s.idptest.AssertLoginFailureMatches(c, `namespace "ci" not allowed`)
+}
+
+func (s *kubernetesSuite) TestJWKSLogin(c *qt.C) {
+	issuer, err := jwt.NewIssuer(context.Background(), memsimplekv.NewStore())
+	c.Assert(err, qt.Equals, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []jwt.JWK{issuer.JWK()},
+		})
+	}))
+	defer srv.Close()
+	i := s.setupIdp(c, kubernetes.Params{
+		JWKSURL: srv.URL,
+		Issuer:  testIssuer,
+	})
+	claims := map[string]interface{}{
+		"iss": testIssuer,
+		"aud": []string{testAudience},
+		"sub": "system:serviceaccount:ci:builder",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"kubernetes.io": map[string]interface{}{
+			"namespace": "ci",
+			"serviceaccount": map[string]interface{}{
+				"name": "builder",
+				"uid":  "b1d2f6a0-0000-0000-0000-000000000000",
+			},
+		},
+	}
+	tok, err := issuer.Sign(claims)
+	c.Assert(err, qt.Equals, nil)
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), loginRequest(c, "/login", tok))
+	s.idptest.AssertLoginSuccess(c, "builder.ci")
+
+	s.idptest.Reset()
+	claims["aud"] = []string{"https://other.example.com"}
+	tok, err = issuer.Sign(claims)
+	c.Assert(err, qt.Equals, nil)
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), loginRequest(c, "/login", tok))
+	s.idptest.AssertLoginFailureMatches(c, `invalid service account token: oidc: expected audience .*`)
+}
+
+var configTests = []struct {
+	about       string
+	yaml        string
+	expectError string
+}{{
+	about: "token review",
+	yaml: `
+identity-providers:
+ - type: kubernetes
+   api-server: https://k8s.example.com:6443
+   token: reviewer-token
+`,
+}, {
+	about: "jwks",
+	yaml: `
+identity-providers:
+ - type: kubernetes
+   jwks-url: https://k8s.example.com/openid/v1/jwks
+   issuer: https://kubernetes.default.svc
+`,
+}, {
+	about: "no validation method",
+	yaml: `
+identity-providers:
+ - type: kubernetes
+`,
+	expectError: `cannot unmarshal kubernetes configuration: invalid kubernetes parameters: exactly one of in-cluster, api-server and jwks-url must be specified`,
+}, {
+	about: "jwks without issuer",
+	yaml: `
+identity-providers:
+ - type: kubernetes
+   jwks-url: https://k8s.example.com/openid/v1/jwks
+`,
+	expectError: `cannot unmarshal kubernetes configuration: invalid kubernetes parameters: issuer not specified`,
+}}
+
+func TestConfig(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range configTests {
+		c.Run(test.about, func(c *qt.C) {
+			var conf config.Config
+			err := yaml.Unmarshal([]byte(test.yaml), &conf)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(conf.IdentityProviders, qt.HasLen, 1)
+			c.Assert(conf.IdentityProviders[0].Name(), qt.Equals, "kubernetes")
+		})
+	}
+}
+
+func loginRequest(c *qt.C, path, token string) *http.Request {
+	body, err := json.Marshal(kubernetes.LoginBody{Token: token})
+	c.Assert(err, qt.Equals, nil)
+	req, err := http.NewRequest("POST", idpPrefix+path+"?id=1", bytes.NewReader(body))
+	c.Assert(err, qt.Equals, nil)
+	req.Header.Set("Content-Type", "application/json")
+	req.ParseForm()
+	return req
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// serviceAccountPrefix is the prefix of the usernames of service
+// accounts.
+const serviceAccountPrefix = "system:serviceaccount:"
+
+// tokenReviewer validates tokens using the TokenReview API.
+type tokenReviewer struct {
+	url string
+
+	// token holds the bearer token used to authenticate to the API
+	// server. If it is empty the token is read from tokenFile, as
+	// mounted service account tokens are rotated.
+	token     string
+	tokenFile string
+
+	client *http.Client
+}
+
+// tokenReview holds the parts of a TokenReview that are used.
+type tokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       tokenReviewSpec   `json:"spec"`
+	Status     tokenReviewStatus `json:"status"`
+}
+
+type tokenReviewSpec struct {
+	Token     string   `json:"token"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool   `json:"authenticated"`
+	Error         string `json:"error"`
+	User          struct {
+		Username string `json:"username"`
+	} `json:"user"`
+}
+
+// review asks the API server to validate the given token for the given
+// audience and returns the service account it identifies.
+func (r *tokenReviewer) review(ctx context.Context, token, audience string) (*serviceAccount, error) {
+	body, err := json.Marshal(tokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec: tokenReviewSpec{
+			Token:     token,
+			Audiences: []string{audience},
+		},
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	req, err := http.NewRequest("POST", r.url+"/apis/authentication.k8s.io/v1/tokenreviews", bytes.NewReader(body))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	bearer := r.token
+	if bearer == "" {
+		data, err := ioutil.ReadFile(r.tokenFile)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot read service account token")
+		}
+		bearer = strings.TrimSpace(string(data))
+	}
+	req.Header.Set("Authorization", "Bearer "+bearer)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot review token")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return nil, errgo.Newf("cannot review token: %s", resp.Status)
+	}
+	var result tokenReview
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, errgo.Notef(err, "cannot decode token review")
+	}
+	if !result.Status.Authenticated {
+		if result.Status.Error != "" {
+			return nil, errgo.New(result.Status.Error)
+		}
+		return nil, errgo.Newf("token not authenticated")
+	}
+	parts := strings.Split(strings.TrimPrefix(result.Status.User.Username, serviceAccountPrefix), ":")
+	if !strings.HasPrefix(result.Status.User.Username, serviceAccountPrefix) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, errgo.Newf("token does not identify a service account")
+	}
+	return &serviceAccount{
+		namespace: parts[0],
+		name:      parts[1],
+	}, nil
+}
@@ -4,6 +4,8 @@
 package ldap
 
 import (
+	"time"
+
 	"github.com/CanonicalLtd/candid/idp"
 )
 
@@ -11,7 +13,7 @@ type LDAPConn ldapConn
 type LDAPDialer func(network, address string) (LDAPConn, error)
 
 func SetLDAP(p idp.IdentityProvider, dialer LDAPDialer) {
-	p.(*identityProvider).dialLDAP = func(netw, addr string) (ldapConn, error) {
-		return dialer(netw, addr)
+	p.(*identityProvider).dialLDAP = func(s *server, _ time.Duration) (ldapConn, error) {
+		return dialer(s.network, s.address)
 	}
 }
@@ -16,6 +16,7 @@ import (
 	"net/url"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/juju/loggo"
 	"gopkg.in/CanonicalLtd/candidclient.v1/params"
@@ -25,6 +26,7 @@ import (
 
 	"github.com/CanonicalLtd/candid/idp"
 	"github.com/CanonicalLtd/candid/idp/idputil"
+	"github.com/CanonicalLtd/candid/internal/logging"
 	"github.com/CanonicalLtd/candid/store"
 )
 
@@ -64,8 +66,36 @@ type Params struct {
 	Domain string `yaml:"domain"`
 
 	// URL contains an LDAP URL indicating the server to connect to.
+	// URLs with the "ldap" scheme use StartTLS to secure the
+	// connection, URLs with the "ldaps" scheme use TLS from the
+	// start of the connection.
 	URL string `yaml:"url"`
 
+	// FailoverURLs contains the URLs of additional LDAP servers that
+	// are used, in order, when the server at URL cannot be reached.
+	// All the servers must use the same base DN.
+	FailoverURLs []string `yaml:"failover-urls"`
+
+	// DialTimeout holds the maximum time to wait when connecting to
+	// an LDAP server. If this is zero, a default of 10 seconds is
+	// used.
+	DialTimeout time.Duration `yaml:"dial-timeout"`
+
+	// RequestTimeout holds the maximum time to wait for the response
+	// to an LDAP request. If this is zero, a default of 30 seconds
+	// is used.
+	RequestTimeout time.Duration `yaml:"request-timeout"`
+
+	// MaxIdleConnections holds the maximum number of idle
+	// connections that are kept open for reuse. If this is zero, a
+	// default of 10 is used.
+	MaxIdleConnections int `yaml:"max-idle-connections"`
+
+	// RetryInterval holds the time for which a server that cannot be
+	// reached is not used, in favour of the other servers. If this
+	// is zero, a default of 30 seconds is used.
+	RetryInterval time.Duration `yaml:"retry-interval"`
+
 	// CACertificate contains a PEM encoded CA certificate to verify
 	// the ldap connection against.
 	CACertificate string `yaml:"ca-cert"`
@@ -92,6 +122,21 @@ type Params struct {
 	//    (&(objectClass=groupOfNames)(member={{.User}}))
 	GroupQueryFilter string `yaml:"group-query-filter"`
 
+	// NestedGroupDepth holds the number of levels of nested groups
+	// that are followed when finding the groups that a user belongs
+	// to. At each level GroupQueryFilter is used to find the groups
+	// that have a group found at the previous level as a member, with
+	// .User holding the DN of that group. If this is zero only the
+	// groups that the user is a direct member of are found.
+	NestedGroupDepth int `yaml:"nested-group-depth"`
+
+	// PageSize holds the number of entries to request in each page
+	// of results when searching for groups, using the simple paged
+	// results control (RFC 2696). If this is zero then paging is
+	// not used and the results may be truncated by any size limit
+	// imposed by the server.
+	PageSize uint32 `yaml:"page-size"`
+
 	// Hidden is set if the IDP should be hidden from interactive
 	// prompts.
 	Hidden bool `yaml:"hidden"`
@@ -151,52 +196,98 @@ func NewIdentityProvider(p Params) (idp.IdentityProvider, error) {
 	if _, err = ldap.CompileFilter(testFilter); err != nil {
 		return nil, errgo.Notef(err, "invalid 'group-query-filter' config parameter")
 	}
+	if p.NestedGroupDepth < 0 {
+		return nil, errgo.Newf("invalid 'nested-group-depth' config parameter: must not be negative")
+	}
+
+	if p.DialTimeout == 0 {
+		p.DialTimeout = defaultDialTimeout
+	}
+	if p.RequestTimeout == 0 {
+		p.RequestTimeout = defaultRequestTimeout
+	}
+	if p.MaxIdleConnections == 0 {
+		p.MaxIdleConnections = defaultMaxIdleConnections
+	}
+	if p.RetryInterval == 0 {
+		p.RetryInterval = defaultRetryInterval
+	}
+
+	var rootCAs *x509.CertPool
+	if p.CACertificate != "" {
+		rootCAs = x509.NewCertPool()
+		rootCAs.AppendCertsFromPEM([]byte(p.CACertificate))
+	}
+	var servers []*server
+	baseDN := ""
+	for i, u := range append([]string{p.URL}, p.FailoverURLs...) {
+		s, dn, err := parseServer(u, rootCAs)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if i == 0 {
+			baseDN = dn
+		} else if dn != baseDN {
+			return nil, errgo.Newf("base DN of %q does not match %q", u, p.URL)
+		}
+		servers = append(servers, s)
+	}
 
 	idp := &identityProvider{
 		params:                   p,
 		dialLDAP:                 dialLDAP,
+		baseDN:                   baseDN,
 		userQueryAttrs:           userQueryAttrs,
 		groupQueryFilterTemplate: groupQueryFilterTemplate,
 	}
+	idp.pool = newConnPool(servers, idp)
+	return idp, nil
+}
 
-	u, err := url.Parse(p.URL)
+// parseServer parses the given LDAP URL, returning the server it
+// refers to and the base DN specified in the path.
+func parseServer(ldapURL string, rootCAs *x509.CertPool) (*server, string, error) {
+	u, err := url.Parse(ldapURL)
 	if err != nil {
-		return nil, errgo.Notef(err, "cannot parse URL")
+		return nil, "", errgo.Notef(err, "cannot parse URL")
+	}
+	s := &server{
+		url:     ldapURL,
+		network: "tcp",
 	}
+	defaultPort := "ldap"
 	switch u.Scheme {
 	case "ldap":
-		idp.network = "tcp"
-		// It would be nice to use u.Host and u.Port here, but
-		// these aren't available in go 1.6.
-		host, port, _ := net.SplitHostPort(u.Host)
-		if host == "" {
-			// Asume that the URL didn't specify a port.
-			host = u.Host
-			port = "ldap"
-		}
-		idp.address = net.JoinHostPort(host, port)
-		idp.tlsConfig.ServerName = host
+	case "ldaps":
+		s.tls = true
+		defaultPort = "ldaps"
 	default:
 		// No other schemes are currently supported.
-		return nil, errgo.Newf("unsupported scheme %q", u.Scheme)
-	}
-	idp.baseDN = strings.TrimPrefix(u.Path, "/")
-	if p.CACertificate != "" {
-		idp.tlsConfig.RootCAs = x509.NewCertPool()
-		idp.tlsConfig.RootCAs.AppendCertsFromPEM([]byte(p.CACertificate))
-	}
-	return idp, nil
+		return nil, "", errgo.Newf("unsupported scheme %q", u.Scheme)
+	}
+	// It would be nice to use u.Host and u.Port here, but
+	// these aren't available in go 1.6.
+	host, port, _ := net.SplitHostPort(u.Host)
+	if host == "" {
+		// Asume that the URL didn't specify a port.
+		host = u.Host
+		port = defaultPort
+	}
+	s.address = net.JoinHostPort(host, port)
+	s.tlsConfig = &tls.Config{
+		ServerName: host,
+		RootCAs:    rootCAs,
+	}
+	return s, strings.TrimPrefix(u.Path, "/"), nil
 }
 
 type identityProvider struct {
 	params     Params
 	initParams idp.InitParams
 
-	dialLDAP  func(network, addr string) (ldapConn, error)
-	network   string
-	address   string
-	baseDN    string
-	tlsConfig tls.Config
+	dialLDAP func(s *server, timeout time.Duration) (ldapConn, error)
+	pool     *connPool
+	baseDN   string
 
 	userQueryAttrs           []string
 	groupQueryFilterTemplate *template.Template
@@ -247,17 +338,65 @@ func (idp *identityProvider) URL(state string) string {
 func (idp *identityProvider) SetInteraction(ierr *httpbakery.Error, dischargeID string) {
 }
 
+// CheckHealth implements idp.HealthChecker.CheckHealth by connecting
+// to an LDAP server and binding as the search user. A new connection
+// is always made so that the availability of the servers is
+// rechecked.
+func (idp *identityProvider) CheckHealth(ctx context.Context) error {
+	conn, err := idp.pool.dial()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	idp.pool.put(conn)
+	return nil
+}
+
 //  GetGroups implements idp.IdentityProvider.GetGroups.
 func (idp *identityProvider) GetGroups(ctx context.Context, identity *store.Identity) ([]string, error) {
-	conn, err := idp.dial()
+	conn, err := idp.pool.get()
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	defer conn.Close()
+	defer idp.pool.put(conn)
 
 	_, uid := identity.ProviderID.Split()
+	// Find the groups the user is a member of directly, then follow
+	// the chain of groups that those groups are members of, up to
+	// the configured depth.
+	groups := []string{}
+	seen := make(map[string]bool)
+	members := []string{uid}
+	for depth := 0; len(members) > 0 && depth <= idp.params.NestedGroupDepth; depth++ {
+		var next []string
+		for _, member := range members {
+			entries, err := idp.searchGroups(conn, member)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			for _, entry := range entries {
+				if entry == nil || len(entry.Attributes) == 0 || len(entry.Attributes[0].Values) == 0 {
+					continue
+				}
+				if entry.DN != "" {
+					if seen[entry.DN] {
+						continue
+					}
+					seen[entry.DN] = true
+					next = append(next, entry.DN)
+				}
+				groups = append(groups, entry.Attributes[0].Values[0])
+			}
+		}
+		members = next
+	}
+	return groups, nil
+}
+
+// searchGroups returns the entries for the groups that have the given
+// member DN as a direct member.
+func (idp *identityProvider) searchGroups(conn ldapConn, member string) ([]*ldap.Entry, error) {
 	filter, err := renderTemplate(
-		idp.groupQueryFilterTemplate, groupQueryArg{User: ldap.EscapeFilter(uid)})
+		idp.groupQueryFilterTemplate, groupQueryArg{User: ldap.EscapeFilter(member)})
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -270,28 +409,25 @@ func (idp *identityProvider) GetGroups(ctx context.Context, identity *store.Iden
 		Filter:       filter,
 		Attributes:   []string{"cn"},
 	}
-	res, err := conn.Search(req)
+	var res *ldap.SearchResult
+	if idp.params.PageSize > 0 {
+		res, err = conn.SearchWithPaging(req, idp.params.PageSize)
+	} else {
+		res, err = conn.Search(req)
+	}
 	if err != nil {
 		logger.Tracef("LDAP search error: %s", err)
 		return nil, errgo.Mask(err)
 	}
 	logResults(res)
-
-	groups := []string{}
-	for _, entry := range res.Entries {
-		if entry == nil || len(entry.Attributes) == 0 || len(entry.Attributes[0].Values) == 0 {
-			continue
-		}
-		groups = append(groups, entry.Attributes[0].Values[0])
-	}
-	return groups, nil
+	return res.Entries, nil
 }
 
 // Handle implements idp.IdentityProvider.Handle.
 func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	var ls idputil.LoginState
 	if err := idp.initParams.Codec.Cookie(req, idputil.LoginCookieName, req.Form.Get("state"), &ls); err != nil {
-		logger.Infof("Invalid login state: %s", err)
+		logging.FromContext(ctx, logger).Infof("Invalid login state: %s", err)
 		idputil.BadRequestf(w, "Login failed: invalid login state")
 		return
 	}
@@ -303,7 +439,7 @@ func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter,
 			Name:        idp.params.Name,
 			URL:         idp.URL(req.Form.Get("state")),
 		}
-		id, err := idputil.HandleLoginForm(ctx, w, req, idpChoice, idp.initParams.Template, idp.loginUser)
+		id, err := idputil.HandleLoginForm(ctx, w, req, idpChoice, idp.initParams.Codec.CSRFToken(req.Form.Get("state")), idp.initParams.Template, idp.initParams.LoginChallenger, idp.initParams.LoginLocker, idp.loginUser)
 		if err != nil {
 			idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
 		}
@@ -314,11 +450,11 @@ func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter,
 }
 
 func (idp *identityProvider) loginUser(ctx context.Context, username, password string) (*store.Identity, error) {
-	conn, err := idp.dial()
+	conn, err := idp.pool.get()
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	defer conn.Close()
+	defer idp.pool.put(conn)
 
 	dn, err := idp.resolveUsername(conn, username)
 	if err != nil {
@@ -415,27 +551,6 @@ func (idp *identityProvider) resolveUsername(conn ldapConn, username string) (st
 	return res.Entries[0].DN, nil
 }
 
-// dial establishes a connection to the LDAP server and binds as the
-// search user (if specified).
-func (idp *identityProvider) dial() (ldapConn, error) {
-	conn, err := idp.dialLDAP(idp.network, idp.address)
-	if err != nil {
-		return nil, errgo.Mask(err)
-	}
-	if err = conn.StartTLS(&idp.tlsConfig); err != nil {
-		return nil, errgo.Mask(err)
-	}
-	if idp.params.DN != "" {
-		logger.Tracef("LDAP bind: dn=%s", idp.params.DN)
-		if err := conn.Bind(idp.params.DN, idp.params.Password); err != nil {
-			logger.Tracef("LDAP bind error: %s", err)
-			return nil, errgo.Mask(err)
-		}
-		logger.Tracef("LDAP bind success", err)
-	}
-	return conn, nil
-}
-
 func renderTemplate(tmpl *template.Template, ctx interface{}) (string, error) {
 	var buf bytes.Buffer
 	if err := tmpl.Execute(&buf, ctx); err != nil {
@@ -444,20 +559,14 @@ func renderTemplate(tmpl *template.Template, ctx interface{}) (string, error) {
 	return buf.String(), nil
 }
 
-func dialLDAP(network, addr string) (ldapConn, error) {
-	c, err := ldap.Dial(network, addr)
-	if err != nil {
-		return nil, err
-	}
-	return c, nil
-}
-
 // ldapConn represents the subset of ldap connection methods used
 // by the provider. It is defined so that it can be replaced for testing.
 type ldapConn interface {
 	StartTLS(config *tls.Config) error
 	Bind(username, password string) error
 	Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
+	SearchWithPaging(searchRequest *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error)
+	SetTimeout(time.Duration)
 	Close()
 }
 
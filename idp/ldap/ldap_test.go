@@ -5,7 +5,9 @@ package ldap_test
 
 import (
 	"context"
+	"fmt"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/frankban/quicktest/qtsuite"
@@ -55,15 +57,46 @@ var newTests = []struct {
 	},
 	expectError: `cannot parse URL: parse "?://"?: missing protocol scheme`,
 }, {
-	about: "unsupported scheme",
+	about: "ldaps url",
 	params: ldap.Params{
 		Name:             "ldaps",
-		URL:              "ldaps://",
+		URL:              "ldaps://localhost",
+		UserQueryFilter:  "(userAttr=val)",
+		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter: "(groupAttr=val)",
+	},
+}, {
+	about: "unsupported scheme",
+	params: ldap.Params{
+		Name:             "ldap",
+		URL:              "http://localhost",
 		UserQueryFilter:  "(userAttr=val)",
 		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
 		GroupQueryFilter: "(groupAttr=val)",
 	},
-	expectError: `unsupported scheme "ldaps"`,
+	expectError: `unsupported scheme "http"`,
+}, {
+	about: "unsupported failover scheme",
+	params: ldap.Params{
+		Name:             "ldap",
+		URL:              "ldap://localhost",
+		FailoverURLs:     []string{"http://localhost"},
+		UserQueryFilter:  "(userAttr=val)",
+		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter: "(groupAttr=val)",
+	},
+	expectError: `unsupported scheme "http"`,
+}, {
+	about: "mismatched failover base DN",
+	params: ldap.Params{
+		Name:             "ldap",
+		URL:              "ldap://localhost/dc=example,dc=com",
+		FailoverURLs:     []string{"ldap://localhost2/dc=example,dc=org"},
+		UserQueryFilter:  "(userAttr=val)",
+		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter: "(groupAttr=val)",
+	},
+	expectError: `base DN of "ldap://localhost2/dc=example,dc=org" does not match "ldap://localhost/dc=example,dc=com"`,
 }, {
 	about: "missing user query filter",
 	params: ldap.Params{
@@ -111,6 +144,17 @@ var newTests = []struct {
 		GroupQueryFilter: "{{.User",
 	},
 	expectError: `invalid 'group-query-filter' config parameter.*`,
+}, {
+	about: "negative nested group depth",
+	params: ldap.Params{
+		Name:             "ldap",
+		URL:              "ldap://localhost",
+		UserQueryFilter:  "(userAttr=val)",
+		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter: "(groupAttr=val)",
+		NestedGroupDepth: -1,
+	},
+	expectError: `invalid 'nested-group-depth' config parameter: must not be negative`,
 }, {
 	about: "invalid group query filter expression",
 	params: ldap.Params{
@@ -349,6 +393,132 @@ func (s *ldapSuite) TestHandleWithGroups(c *qt.C) {
 	c.Assert(groups, qt.DeepEquals, []string{"group1", "group2"})
 }
 
+var nestedGroupDocs = []ldapDoc{{
+	"dn":          {"cn=group1,ou=groups,dc=example,dc=com"},
+	"objectClass": {"groupOfNames"},
+	"cn":          {"group1"},
+	"member":      {"uid=user1,ou=users,dc=example,dc=com"},
+}, {
+	"dn":          {"cn=group2,ou=groups,dc=example,dc=com"},
+	"objectClass": {"groupOfNames"},
+	"cn":          {"group2"},
+	"member": {
+		"cn=group1,ou=groups,dc=example,dc=com",
+		"cn=group3,ou=groups,dc=example,dc=com",
+	},
+}, {
+	"dn":          {"cn=group3,ou=groups,dc=example,dc=com"},
+	"objectClass": {"groupOfNames"},
+	"cn":          {"group3"},
+	"member":      {"cn=group2,ou=groups,dc=example,dc=com"},
+}, {
+	"dn":          {"cn=group4,ou=groups,dc=example,dc=com"},
+	"objectClass": {"groupOfNames"},
+	"cn":          {"group4"},
+	"member":      {"cn=group3,ou=groups,dc=example,dc=com"},
+}}
+
+var nestedGroupTests = []struct {
+	depth        int
+	expectGroups []string
+}{{
+	depth:        0,
+	expectGroups: []string{"group1"},
+}, {
+	depth:        1,
+	expectGroups: []string{"group1", "group2"},
+}, {
+	depth:        2,
+	expectGroups: []string{"group1", "group2", "group3"},
+}, {
+	// group2 and group3 are members of each other, the cycle must
+	// not be followed forever.
+	depth:        10,
+	expectGroups: []string{"group1", "group2", "group3", "group4"},
+}}
+
+func (s *ldapSuite) TestGetGroupsNested(c *qt.C) {
+	for _, test := range nestedGroupTests {
+		c.Run(fmt.Sprintf("depth-%d", test.depth), func(c *qt.C) {
+			params := getSampleParams()
+			params.NestedGroupDepth = test.depth
+			i := s.setupIdp(c, params, append(getSampleLdapDB(), nestedGroupDocs...))
+			groups, err := i.GetGroups(s.idptest.Ctx, &store.Identity{
+				ProviderID: store.MakeProviderIdentity("test", "uid=user1,ou=users,dc=example,dc=com"),
+			})
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(groups, qt.DeepEquals, test.expectGroups)
+		})
+	}
+}
+
+func (s *ldapSuite) TestGetGroupsPaged(c *qt.C) {
+	params := getSampleParams()
+	params.PageSize = 500
+	i, err := ldap.NewIdentityProvider(params)
+	c.Assert(err, qt.Equals, nil)
+	dialer := newMockLDAPDialer(append(getSampleLdapDB(), nestedGroupDocs...))
+	ldap.SetLDAP(i, dialer.Dial)
+	i.Init(context.TODO(), s.idptest.InitParams(c, idpPrefix))
+	groups, err := i.GetGroups(s.idptest.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "uid=user1,ou=users,dc=example,dc=com"),
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups, qt.DeepEquals, []string{"group1"})
+	c.Assert(dialer.conns, qt.HasLen, 1)
+	c.Assert(dialer.conns[0].pagingSize, qt.Equals, uint32(500))
+}
+
+func (s *ldapSuite) TestConnectionReuse(c *qt.C) {
+	i, err := ldap.NewIdentityProvider(getSampleParams())
+	c.Assert(err, qt.Equals, nil)
+	dialer := newMockLDAPDialer(append(getSampleLdapDB(), nestedGroupDocs...))
+	ldap.SetLDAP(i, dialer.Dial)
+	i.Init(context.TODO(), s.idptest.InitParams(c, idpPrefix))
+
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "pass1"))
+	c.Assert(err, qt.Equals, nil)
+	for j := 0; j < 2; j++ {
+		groups, err := i.GetGroups(s.idptest.Ctx, &store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", "uid=user1,ou=users,dc=example,dc=com"),
+		})
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(groups, qt.DeepEquals, []string{"group1"})
+	}
+	// The connection used for the login is rebound as the search
+	// user and reused.
+	c.Assert(dialer.conns, qt.HasLen, 1)
+	c.Assert(dialer.conns[0].closed, qt.Equals, false)
+	c.Assert(dialer.conns[0].boundUsername, qt.Equals, "cn=test,dc=example,dc=com")
+	c.Assert(dialer.conns[0].timeout, qt.Equals, 30*time.Second)
+}
+
+func (s *ldapSuite) TestFailover(c *qt.C) {
+	params := getSampleParams()
+	params.FailoverURLs = []string{"ldap://ldap2.example.com", "ldaps://ldap3.example.com"}
+	i, err := ldap.NewIdentityProvider(params)
+	c.Assert(err, qt.Equals, nil)
+	dialer := newMockLDAPDialer(append(getSampleLdapDB(), nestedGroupDocs...))
+	dialer.fail = map[string]bool{
+		"localhost:ldap":         true,
+		"ldap2.example.com:ldap": true,
+	}
+	ldap.SetLDAP(i, dialer.Dial)
+	i.Init(context.TODO(), s.idptest.InitParams(c, idpPrefix))
+
+	err = i.(idp.HealthChecker).CheckHealth(s.idptest.Ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(dialer.conns, qt.HasLen, 1)
+	c.Assert(dialer.conns[0].address, qt.Equals, "ldap3.example.com:ldaps")
+	// ldaps connections do not use StartTLS.
+	c.Assert(dialer.conns[0].tlsConfig, qt.IsNil)
+
+	// When all servers are down the health check fails.
+	dialer.fail["ldap3.example.com:ldaps"] = true
+	err = i.(idp.HealthChecker).CheckHealth(s.idptest.Ctx)
+	c.Assert(err, qt.ErrorMatches, `.*cannot connect to ldap3.example.com:ldaps`)
+}
+
 func (s *ldapSuite) TestHandleCustomGroupFilter(c *qt.C) {
 	params := getSampleParams()
 	params.GroupQueryFilter = "(&(customAttr=customValue)(user={{.User}}))"
@@ -6,6 +6,7 @@ package ldap_test
 import (
 	"crypto/tls"
 	"fmt"
+	"time"
 
 	"gopkg.in/asn1-ber.v1"
 	errgo "gopkg.in/errgo.v1"
@@ -17,6 +18,9 @@ import (
 type mockLDAPDialer struct {
 	db    ldapDB
 	conns []*mockLDAPConn
+
+	// fail holds the addresses for which Dial will fail.
+	fail map[string]bool
 }
 
 func newMockLDAPDialer(db ldapDB) *mockLDAPDialer {
@@ -26,6 +30,9 @@ func newMockLDAPDialer(db ldapDB) *mockLDAPDialer {
 }
 
 func (d *mockLDAPDialer) Dial(network, address string) (idpldap.LDAPConn, error) {
+	if d.fail[address] {
+		return nil, ldap.NewError(ldap.ErrorNetwork, errgo.Newf("cannot connect to %s", address))
+	}
 	conn := &mockLDAPConn{network: network, address: address, db: d.db}
 	d.conns = append(d.conns, conn)
 	return conn, nil
@@ -42,9 +49,13 @@ type mockLDAPConn struct {
 	tlsConfig *tls.Config
 	// searchReq is set when Search is called.
 	searchReq *ldap.SearchRequest
+	// pagingSize is set when SearchWithPaging is called.
+	pagingSize uint32
 	// boundUsername and boundPassword are set when Bind is called.
 	boundUsername string
 	boundPassword string
+	// timeout is set when SetTimeout is called.
+	timeout time.Duration
 	// closed is set when Close is called.
 	closed bool
 }
@@ -84,6 +95,11 @@ func (c *mockLDAPConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, erro
 	return &ldap.SearchResult{Entries: entries}, nil
 }
 
+func (c *mockLDAPConn) SearchWithPaging(req *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	c.pagingSize = pagingSize
+	return c.Search(req)
+}
+
 func (c *mockLDAPConn) Bind(username, password string) error {
 	for _, entry := range c.db {
 		dn, ok := entry["dn"]
@@ -104,6 +120,10 @@ func (c *mockLDAPConn) Bind(username, password string) error {
 	return ldap.NewError(ldap.LDAPResultInvalidCredentials, errgo.New("invalid credentials"))
 }
 
+func (c *mockLDAPConn) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
 func (c *mockLDAPConn) Close() {
 	c.closed = true
 }
@@ -0,0 +1,250 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package ldap
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/ldap.v2"
+)
+
+const (
+	defaultDialTimeout        = 10 * time.Second
+	defaultRequestTimeout     = 30 * time.Second
+	defaultMaxIdleConnections = 10
+	defaultRetryInterval      = 30 * time.Second
+)
+
+// A server holds the details of a single LDAP server.
+type server struct {
+	url     string
+	network string
+	address string
+
+	// tls is set if the connection uses TLS from the start (ldaps),
+	// otherwise StartTLS is used.
+	tls       bool
+	tlsConfig *tls.Config
+}
+
+// A pooledConn is a connection to an LDAP server that is managed by a
+// connPool.
+type pooledConn struct {
+	ldapConn
+	server *server
+
+	// userBound is set when the connection has been bound as a
+	// user other than the search user.
+	userBound bool
+
+	// broken is set when a request on the connection failed because
+	// of a network error.
+	broken bool
+}
+
+// Bind implements ldapConn.Bind by recording that the connection is no
+// longer bound as the search user.
+func (c *pooledConn) Bind(username, password string) error {
+	c.userBound = true
+	err := c.ldapConn.Bind(username, password)
+	c.checkError(err)
+	return err
+}
+
+// Search implements ldapConn.Search.
+func (c *pooledConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	res, err := c.ldapConn.Search(req)
+	c.checkError(err)
+	return res, err
+}
+
+// SearchWithPaging implements ldapConn.SearchWithPaging.
+func (c *pooledConn) SearchWithPaging(req *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	res, err := c.ldapConn.SearchWithPaging(req, pagingSize)
+	c.checkError(err)
+	return res, err
+}
+
+func (c *pooledConn) checkError(err error) {
+	if err != nil && ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+		c.broken = true
+	}
+}
+
+// A connPool holds a pool of connections to a set of equivalent LDAP
+// servers. New connections are made to the first server in the set
+// that is available. A server that cannot be reached is not tried
+// again until the retry interval has passed, unless no other server
+// can be reached.
+type connPool struct {
+	idp     *identityProvider
+	servers []*server
+
+	mu   sync.Mutex
+	idle []*pooledConn
+	down map[*server]time.Time
+}
+
+func newConnPool(servers []*server, idp *identityProvider) *connPool {
+	return &connPool{
+		idp:     idp,
+		servers: servers,
+		down:    make(map[*server]time.Time),
+	}
+}
+
+// get returns a connection that is bound as the search user. The
+// connection must be returned to the pool with put when it is no
+// longer required.
+func (p *connPool) get() (*pooledConn, error) {
+	for {
+		c := p.popIdle()
+		if c == nil {
+			break
+		}
+		if !c.userBound {
+			return c, nil
+		}
+		if err := p.bindSearchUser(c.ldapConn); err != nil {
+			c.Close()
+			continue
+		}
+		c.userBound = false
+		return c, nil
+	}
+	return p.dial()
+}
+
+// put returns the given connection to the pool. Connections that are
+// broken, or that cannot be returned to the search user's binding,
+// are closed rather than reused.
+func (p *connPool) put(c *pooledConn) {
+	if c.broken || c.userBound && p.idp.params.DN == "" {
+		c.Close()
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) >= p.idp.params.MaxIdleConnections {
+		c.Close()
+		return
+	}
+	p.idle = append(p.idle, c)
+}
+
+func (p *connPool) popIdle() *pooledConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) == 0 {
+		return nil
+	}
+	c := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	return c
+}
+
+// dial makes a new connection to the first available server.
+func (p *connPool) dial() (*pooledConn, error) {
+	var lastErr error
+	for _, s := range p.candidates() {
+		conn, err := p.dialServer(s)
+		if err != nil {
+			logger.Warningf("cannot connect to LDAP server %s: %s", s.url, err)
+			p.setDown(s, true)
+			lastErr = err
+			continue
+		}
+		p.setDown(s, false)
+		if err := p.bindSearchUser(conn); err != nil {
+			conn.Close()
+			return nil, errgo.Mask(err)
+		}
+		return &pooledConn{
+			ldapConn: conn,
+			server:   s,
+		}, nil
+	}
+	return nil, errgo.Mask(lastErr)
+}
+
+// candidates returns the servers in the order in which they should be
+// tried. Servers that are not known to be down are returned first.
+func (p *connPool) candidates() []*server {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	up := make([]*server, 0, len(p.servers))
+	var down []*server
+	for _, s := range p.servers {
+		if t, ok := p.down[s]; ok && now.Before(t) {
+			down = append(down, s)
+			continue
+		}
+		up = append(up, s)
+	}
+	return append(up, down...)
+}
+
+func (p *connPool) setDown(s *server, down bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if down {
+		p.down[s] = time.Now().Add(p.idp.params.RetryInterval)
+	} else {
+		delete(p.down, s)
+	}
+}
+
+// dialServer connects to the given server and secures the connection
+// with TLS.
+func (p *connPool) dialServer(s *server) (ldapConn, error) {
+	conn, err := p.idp.dialLDAP(s, p.idp.params.DialTimeout)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if !s.tls {
+		if err = conn.StartTLS(s.tlsConfig); err != nil {
+			conn.Close()
+			return nil, errgo.Mask(err)
+		}
+	}
+	conn.SetTimeout(p.idp.params.RequestTimeout)
+	return conn, nil
+}
+
+// bindSearchUser binds the given connection as the search user (if
+// specified).
+func (p *connPool) bindSearchUser(conn ldapConn) error {
+	if p.idp.params.DN == "" {
+		return nil
+	}
+	logger.Tracef("LDAP bind: dn=%s", p.idp.params.DN)
+	if err := conn.Bind(p.idp.params.DN, p.idp.params.Password); err != nil {
+		logger.Tracef("LDAP bind error: %s", err)
+		return errgo.Mask(err)
+	}
+	logger.Tracef("LDAP bind success")
+	return nil
+}
+
+func dialLDAP(s *server, timeout time.Duration) (ldapConn, error) {
+	d := net.Dialer{Timeout: timeout}
+	var c net.Conn
+	var err error
+	if s.tls {
+		c, err = tls.DialWithDialer(&d, s.network, s.address, s.tlsConfig)
+	} else {
+		c, err = d.Dial(s.network, s.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn := ldap.NewConn(c, s.tls)
+	conn.Start()
+	return conn, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package openid
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+var (
+	PKCEContext   = pkceContext
+	TokenRejected = tokenRejected
+)
+
+// SetRefreshToken stores the refresh token for the given identity.
+func SetRefreshToken(ctx context.Context, i idp.IdentityProvider, id store.ProviderIdentity, token string) error {
+	return i.(*openidConnectIdentityProvider).setRefreshToken(ctx, id, token)
+}
+
+// RefreshToken returns the refresh token stored for the given identity.
+func RefreshToken(ctx context.Context, i idp.IdentityProvider, id store.ProviderIdentity) (string, error) {
+	return i.(*openidConnectIdentityProvider).refreshToken(ctx, id)
+}
+
+// LeaseRefreshToken takes a lease on the refresh token for the given
+// identity, as if another server were refreshing it.
+func LeaseRefreshToken(ctx context.Context, i idp.IdentityProvider, id store.ProviderIdentity) (string, error) {
+	return i.(*openidConnectIdentityProvider).leaseRefreshToken(ctx, id, time.Now())
+}
+
+// RefreshIdentity refreshes the given identity using its stored
+// refresh token.
+func RefreshIdentity(ctx context.Context, i idp.IdentityProvider, u *store.Identity) error {
+	return i.(*openidConnectIdentityProvider).refreshIdentity(ctx, u)
+}
+
+// RefreshAll refreshes all the identities of the given identity
+// provider, which must have been configured with a refresh interval.
+func RefreshAll(i idp.IdentityProvider) {
+	i.(*openidConnectIdentityProvider).refresher.refreshAll()
+}
+
+// MapClaims applies the given claim mapping to the given claims. Any
+// fields without a template are returned empty.
+func MapClaims(m ClaimMapping, claims map[string]interface{}) (username, name, email string, groups []string, err error) {
+	cm, err := newClaimMapper(m)
+	if err != nil {
+		return "", "", "", nil, err
+	}
+	if cm.username != nil {
+		if username, err = execute(cm.username, claims); err != nil {
+			return "", "", "", nil, err
+		}
+	}
+	if cm.name != nil {
+		if name, err = execute(cm.name, claims); err != nil {
+			return "", "", "", nil, err
+		}
+	}
+	if cm.email != nil {
+		if email, err = execute(cm.email, claims); err != nil {
+			return "", "", "", nil, err
+		}
+	}
+	if cm.groups != nil {
+		if groups, err = cm.groupList(claims); err != nil {
+			return "", "", "", nil, err
+		}
+	}
+	return username, name, email, groups, nil
+}
+
+// MultiFactor reports whether the given identity provider considers the
+// given claims to show a multi-factor authentication.
+func MultiFactor(i idp.IdentityProvider, claims map[string]interface{}) bool {
+	return i.(*openidConnectIdentityProvider).multiFactor(claims)
+}
+
+// StepUpURL returns the authorization URL that the given identity
+// provider would use, without an authorization endpoint, when the user
+// must authenticate strongly.
+func StepUpURL(i idp.IdentityProvider) string {
+	var config oauth2.Config
+	return config.AuthCodeURL("test-state", i.(*openidConnectIdentityProvider).stepUpOptions()...)
+}
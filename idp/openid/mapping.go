@@ -0,0 +1,91 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package openid
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+
+	"gopkg.in/errgo.v1"
+)
+
+// ClaimMapping holds templates that determine the details of an
+// identity from the claims in an ID token. Each template is a Go
+// text/template that is executed with a map holding all of the claims
+// in the token. Claims that might not be present in every token should
+// be accessed with the index function, for example
+// `{{index . "groups"}}`.
+type ClaimMapping struct {
+	// Username, if set, is used to create the username of new users,
+	// which are then registered without being asked to choose a
+	// username. If the result is not a valid or available username
+	// then the user is asked to choose one.
+	Username string `yaml:"username"`
+
+	// Name, if set, is used to determine the user's full name on
+	// every login.
+	Name string `yaml:"name"`
+
+	// Email, if set, is used to determine the user's email address
+	// on every login.
+	Email string `yaml:"email"`
+
+	// Groups, if set, is used to determine the user's groups on
+	// every login. The result is split on white space and each
+	// resulting word is a group.
+	Groups string `yaml:"groups"`
+}
+
+// claimMapper holds the parsed templates from a ClaimMapping.
+type claimMapper struct {
+	username *template.Template
+	name     *template.Template
+	email    *template.Template
+	groups   *template.Template
+}
+
+// newClaimMapper parses the templates in the given ClaimMapping.
+func newClaimMapper(m ClaimMapping) (*claimMapper, error) {
+	var cm claimMapper
+	for _, t := range []struct {
+		name string
+		text string
+		t    **template.Template
+	}{
+		{"username", m.Username, &cm.username},
+		{"name", m.Name, &cm.name},
+		{"email", m.Email, &cm.email},
+		{"groups", m.Groups, &cm.groups},
+	} {
+		if t.text == "" {
+			continue
+		}
+		var err error
+		*t.t, err = template.New(t.name).Option("missingkey=error").Parse(t.text)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid %s claim mapping", t.name)
+		}
+	}
+	return &cm, nil
+}
+
+// execute executes the given template with the given claims. The
+// result has any leading and trailing white space removed.
+func execute(t *template.Template, claims map[string]interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, claims); err != nil {
+		return "", errgo.Notef(err, "cannot map claims")
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// groupList returns the groups determined from the given claims.
+func (m *claimMapper) groupList(claims map[string]interface{}) ([]string, error) {
+	s, err := execute(m.groups, claims)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return strings.Fields(s), nil
+}
@@ -7,11 +7,16 @@ package openid
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/coreos/go-oidc"
 	"github.com/juju/loggo"
+	"github.com/juju/simplekv"
 	"golang.org/x/oauth2"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/names.v2"
@@ -19,6 +24,7 @@ import (
 
 	"github.com/CanonicalLtd/candid/idp"
 	"github.com/CanonicalLtd/candid/idp/idputil"
+	"github.com/CanonicalLtd/candid/internal/logging"
 	"github.com/CanonicalLtd/candid/store"
 )
 
@@ -42,6 +48,9 @@ func init() {
 		if p.ClientSecret == "" {
 			return nil, errgo.Newf("client-secret not specified")
 		}
+		if _, err := newClaimMapper(p.ClaimMapping); err != nil {
+			return nil, errgo.Mask(err)
+		}
 		return NewOpenIDConnectIdentityProvider(p), nil
 	})
 }
@@ -77,6 +86,43 @@ type OpenIDConnectParams struct {
 	// Hidden is set if the IDP should be hidden from interactive
 	// prompts.
 	Hidden bool `yaml:"hidden"`
+
+	// ClaimMapping holds templates that determine the details of
+	// identities from the claims in the ID token.
+	ClaimMapping ClaimMapping `yaml:"claim-mapping"`
+
+	// RefreshInterval, if non-zero, is the interval at which the
+	// details and groups of every user are refreshed using the
+	// refresh token obtained when they last logged in. The
+	// configured scopes must cause the OpenID provider to issue
+	// refresh tokens.
+	RefreshInterval time.Duration `yaml:"refresh-interval"`
+
+	// MultiFactorACRs holds values of the acr claim in the ID token
+	// that indicate that the user authenticated using multiple
+	// factors. Users are also considered to have done so when the
+	// amr claim contains "mfa" (see RFC 8176).
+	MultiFactorACRs []string `yaml:"multi-factor-acrs"`
+
+	// GroupsFunc, if set, is called after every successful login to
+	// determine the groups that the user is a member of. If it is
+	// not set, but ClaimMapping.Groups is, then the groups are
+	// determined from the ID token claims. The groups
+	// are stored with the identity and returned by GetGroups. This
+	// cannot be set in the configuration file, it is intended for
+	// use by identity providers built on this one.
+	GroupsFunc func(ctx context.Context, tok *oauth2.Token, id *oidc.IDToken) ([]string, error) `yaml:"-"`
+
+	// CheckFunc, if set, is called with every verified ID token
+	// before the user is logged in. If it returns an error then
+	// the login fails. This cannot be set in the configuration
+	// file.
+	CheckFunc func(ctx context.Context, id *oidc.IDToken) error `yaml:"-"`
+
+	// AuthCodeOptions holds any additional options to add to the
+	// authorization request. This cannot be set in the
+	// configuration file.
+	AuthCodeOptions []oauth2.AuthCodeOption `yaml:"-"`
 }
 
 // NewOpenIDConnectIdentityProvider creates a new identity provider using
@@ -98,6 +144,12 @@ type openidConnectIdentityProvider struct {
 	initParams idp.InitParams
 	provider   *oidc.Provider
 	config     *oauth2.Config
+	mapper     *claimMapper
+	refresher  *refresher
+
+	// endSessionEndpoint holds the address of the issuer's
+	// RP-initiated logout endpoint, if it has one.
+	endSessionEndpoint string
 }
 
 // Name implements idp.IdentityProvider.Name.
@@ -135,10 +187,24 @@ func (idp *openidConnectIdentityProvider) Hidden() bool {
 func (idp *openidConnectIdentityProvider) Init(ctx context.Context, params idp.InitParams) error {
 	idp.initParams = params
 	var err error
+	idp.mapper, err = newClaimMapper(idp.params.ClaimMapping)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if idp.mapper.groups != nil && idp.params.GroupsFunc == nil {
+		idp.params.GroupsFunc = idp.mappedGroups
+	}
 	idp.provider, err = oidc.NewProvider(ctx, idp.params.Issuer)
 	if err != nil {
 		return errgo.Mask(err)
 	}
+	var discovery struct {
+		EndSessionEndpoint string `json:"end_session_endpoint"`
+	}
+	if err := idp.provider.Claims(&discovery); err != nil {
+		return errgo.Notef(err, "cannot read discovery document")
+	}
+	idp.endSessionEndpoint = discovery.EndSessionEndpoint
 	idp.config = &oauth2.Config{
 		ClientID:     idp.params.ClientID,
 		ClientSecret: idp.params.ClientSecret,
@@ -146,6 +212,18 @@ func (idp *openidConnectIdentityProvider) Init(ctx context.Context, params idp.I
 		RedirectURL:  idp.initParams.URLPrefix + "/callback",
 		Scopes:       idp.params.Scopes,
 	}
+	if idp.params.RefreshInterval > 0 {
+		idp.refresher = newRefresher(idp, idp.params.RefreshInterval)
+	}
+	return nil
+}
+
+// Close implements io.Closer by stopping any background refresh of
+// user details.
+func (idp *openidConnectIdentityProvider) Close() error {
+	if idp.refresher != nil {
+		idp.refresher.Close()
+	}
 	return nil
 }
 
@@ -154,20 +232,50 @@ func (idp *openidConnectIdentityProvider) URL(state string) string {
 	return idputil.RedirectURL(idp.initParams.URLPrefix, "/login", state)
 }
 
+// LogoutURL implements idp.LogoutRedirector.LogoutURL using OpenID
+// Connect RP-Initiated Logout. The given returnTo address must be
+// registered with the issuer as a post-logout redirect URI.
+func (idp *openidConnectIdentityProvider) LogoutURL(returnTo, state string) string {
+	if idp.endSessionEndpoint == "" {
+		return ""
+	}
+	u, err := url.Parse(idp.endSessionEndpoint)
+	if err != nil {
+		logger.Errorf("invalid end_session_endpoint %q: %s", idp.endSessionEndpoint, err)
+		return ""
+	}
+	q := u.Query()
+	q.Set("client_id", idp.params.ClientID)
+	if returnTo != "" {
+		q.Set("post_logout_redirect_uri", returnTo)
+	}
+	if state != "" {
+		q.Set("state", state)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
 // SetInteraction implements idp.IdentityProvider.SetInteraction.
 func (idp *openidConnectIdentityProvider) SetInteraction(ierr *httpbakery.Error, dischargeID string) {
 }
 
 //  GetGroups implements idp.IdentityProvider.GetGroups.
-func (*openidConnectIdentityProvider) GetGroups(context.Context, *store.Identity) ([]string, error) {
-	return nil, nil
+func (*openidConnectIdentityProvider) GetGroups(_ context.Context, identity *store.Identity) ([]string, error) {
+	return identity.ProviderInfo["groups"], nil
+}
+
+// CheckHealth implements idp.HealthChecker.CheckHealth by checking
+// that the issuer's discovery document can be retrieved.
+func (idp *openidConnectIdentityProvider) CheckHealth(ctx context.Context) error {
+	return errgo.Mask(idputil.CheckURL(ctx, strings.TrimSuffix(idp.params.Issuer, "/")+"/.well-known/openid-configuration"))
 }
 
 // Handle implements idp.IdentityProvider.Handle.
 func (idp *openidConnectIdentityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	var ls idputil.LoginState
 	if err := idp.initParams.Codec.Cookie(req, idputil.LoginCookieName, req.Form.Get("state"), &ls); err != nil {
-		logger.Infof("Invalid login state: %s", err)
+		logging.FromContext(ctx, logger).Infof("Invalid login state: %s", err)
 		idputil.BadRequestf(w, "Login failed: invalid login state")
 		return
 	}
@@ -181,16 +289,70 @@ func (idp *openidConnectIdentityProvider) Handle(ctx context.Context, w http.Res
 			idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
 		}
 	default:
-		idp.login(ctx, w, req)
+		if err := idp.login(ctx, w, req, ls); err != nil {
+			idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
+		}
 	}
 }
 
-func (idp *openidConnectIdentityProvider) login(ctx context.Context, w http.ResponseWriter, req *http.Request) {
-	http.Redirect(w, req, idp.config.AuthCodeURL(idputil.State(req)), http.StatusFound)
+// login redirects the user to the OpenID provider's authorization
+// endpoint. A PKCE code verifier is created for every login attempt so
+// that an intercepted authorization code cannot be used.
+func (idp *openidConnectIdentityProvider) login(ctx context.Context, w http.ResponseWriter, req *http.Request, ls idputil.LoginState) error {
+	verifier, err := newPKCEVerifier()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	state := idputil.State(req)
+	if err := idp.initParams.KeyValueStore.Set(ctx, pkceKey(state), []byte(verifier), ls.Expires); err != nil {
+		return errgo.Notef(err, "cannot store PKCE verifier")
+	}
+	opts := append(pkceOptions(verifier), idp.params.AuthCodeOptions...)
+	if ls.AuthLevel == idputil.AuthLevelStrong {
+		opts = append(opts, idp.stepUpOptions()...)
+	}
+	http.Redirect(w, req, idp.config.AuthCodeURL(state, opts...), http.StatusFound)
+	return nil
+}
+
+// stepUpOptions returns the options to add to an authorization request
+// when the user must authenticate strongly. The user is made to
+// authenticate again even if they have a session with the OpenID
+// provider and, if multi-factor ACR values are configured, they are
+// requested.
+func (idp *openidConnectIdentityProvider) stepUpOptions() []oauth2.AuthCodeOption {
+	opts := []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("prompt", "login"),
+		oauth2.SetAuthURLParam("max_age", "0"),
+	}
+	if len(idp.params.MultiFactorACRs) > 0 {
+		opts = append(opts, oauth2.SetAuthURLParam("acr_values", strings.Join(idp.params.MultiFactorACRs, " ")))
+	}
+	return opts
+}
+
+// pkceKey returns the key used to hold the PKCE code verifier for the
+// login attempt with the given state.
+func pkceKey(state string) string {
+	return "pkce:" + state
 }
 
 func (idp *openidConnectIdentityProvider) callback(ctx context.Context, w http.ResponseWriter, req *http.Request, ls idputil.LoginState) error {
-	tok, err := idp.config.Exchange(ctx, req.Form.Get("code"))
+	switch e := req.Form.Get("error"); e {
+	case "":
+	case "access_denied":
+		return errgo.WithCausef(nil, idputil.ErrLoginCancelled, "login cancelled by user")
+	default:
+		return errgo.Newf("OpenID provider returned error %q: %s", e, req.Form.Get("error_description"))
+	}
+	verifier, err := idp.initParams.KeyValueStore.Get(ctx, pkceKey(idputil.State(req)))
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return errgo.Newf("login attempt not found")
+	}
+	if err != nil {
+		return errgo.Notef(err, "cannot retrieve PKCE verifier")
+	}
+	tok, err := idp.config.Exchange(pkceContext(ctx, string(verifier)), req.Form.Get("code"))
 	if err != nil {
 		return errgo.Mask(err)
 	}
@@ -206,11 +368,48 @@ func (idp *openidConnectIdentityProvider) callback(ctx context.Context, w http.R
 	if err != nil {
 		return errgo.Mask(err)
 	}
+	if idp.params.CheckFunc != nil {
+		if err := idp.params.CheckFunc(ctx, id); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+	}
 	user := store.Identity{
 		ProviderID: store.MakeProviderIdentity(idp.Name(), fmt.Sprintf("%s:%s", id.Issuer, id.Subject)),
 	}
+	if idp.refresher != nil && tok.RefreshToken != "" {
+		if err := idp.setRefreshToken(ctx, user.ProviderID, tok.RefreshToken); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	var groups []string
+	if idp.params.GroupsFunc != nil {
+		groups, err = idp.params.GroupsFunc(ctx, tok, id)
+		if err != nil {
+			return errgo.Notef(err, "cannot get groups")
+		}
+	}
+	var claimValues map[string]interface{}
+	if err := id.Claims(&claimValues); err != nil {
+		return errgo.Mask(err)
+	}
+	mfa := idp.multiFactor(claimValues)
 	err = idp.initParams.Store.Identity(ctx, &user)
 	if err == nil {
+		user.ProviderInfo = map[string][]string{
+			idputil.MFAProviderInfo: idputil.MFAInfo(mfa),
+		}
+		update := store.Update{
+			store.ProviderInfo: store.Set,
+		}
+		if idp.params.GroupsFunc != nil {
+			user.ProviderInfo["groups"] = groups
+		}
+		if err := idp.mapDetails(claimValues, &user, &update); err != nil {
+			return errgo.Mask(err)
+		}
+		if err := idp.initParams.Store.UpdateIdentity(ctx, &user, update); err != nil {
+			return errgo.Notef(err, "cannot update identity")
+		}
 		idp.initParams.VisitCompleter.RedirectSuccess(ctx, w, req, ls.ReturnTo, ls.State, &user)
 		return nil
 	}
@@ -218,35 +417,125 @@ func (idp *openidConnectIdentityProvider) callback(ctx context.Context, w http.R
 	if errgo.Cause(err) != store.ErrNotFound {
 		return errgo.Mask(err)
 	}
+	if idp.params.GroupsFunc != nil {
+		// Hold on to the groups until the user has registered.
+		// The list may be too large to keep in the login cookie.
+		if err := idp.setPendingGroups(ctx, user.ProviderID, groups, ls.Expires); err != nil {
+			return errgo.Mask(err)
+		}
+	}
 	var claims claims
 	if err := id.Claims(&claims); err != nil {
 		return errgo.Mask(err)
 	}
-	ls.ProviderID = user.ProviderID
-	state, err := idp.initParams.Codec.SetCookie(w, idputil.LoginCookieName, ls)
-	if err != nil {
+	user.Name = claims.FullName
+	user.Email = claims.Email
+	if err := idp.mapDetails(claimValues, &user, new(store.Update)); err != nil {
 		return errgo.Mask(err)
 	}
 	preferredUsername := ""
 	if names.IsValidUserName(claims.PreferredUsername) {
 		preferredUsername = claims.PreferredUsername
 	}
+	var registrationError string
+	if idp.mapper.username != nil {
+		username, err := execute(idp.mapper.username, claimValues)
+		if err != nil {
+			return errgo.Notef(err, "cannot determine username")
+		}
+		err = idp.registerUser(ctx, username, mfa, &user)
+		if err == nil {
+			idp.initParams.VisitCompleter.RedirectSuccess(ctx, w, req, ls.ReturnTo, ls.State, &user)
+			return nil
+		}
+		if errgo.Cause(err) != errInvalidUser {
+			return errgo.Mask(err)
+		}
+		// The user will have to choose a different username.
+		registrationError = err.Error()
+		preferredUsername = username
+	}
+	ls.ProviderID = user.ProviderID
+	ls.MultiFactor = mfa
+	state, err := idp.initParams.Codec.SetCookie(w, req, idputil.LoginCookieName, ls)
+	if err != nil {
+		return errgo.Mask(err)
+	}
 	return errgo.Mask(idputil.RegistrationForm(ctx, w, idputil.RegistrationParams{
-		State:    state,
-		Username: preferredUsername,
-		Domain:   idp.params.Domain,
-		FullName: claims.FullName,
-		Email:    claims.Email,
+		State:     state,
+		Error:     registrationError,
+		Username:  preferredUsername,
+		Domain:    idp.params.Domain,
+		FullName:  user.Name,
+		Email:     user.Email,
+		CSRFToken: idp.initParams.Codec.CSRFToken(state),
 	}, idp.initParams.Template))
 }
 
+// mapDetails sets the name and email address of the given identity
+// from the given claims using the configured claim mapping. Any fields
+// that are set are added to the given update.
+func (idp *openidConnectIdentityProvider) mapDetails(claims map[string]interface{}, u *store.Identity, update *store.Update) error {
+	if idp.mapper.name != nil {
+		name, err := execute(idp.mapper.name, claims)
+		if err != nil {
+			return errgo.Notef(err, "cannot determine name")
+		}
+		u.Name = name
+		update[store.Name] = store.Set
+	}
+	if idp.mapper.email != nil {
+		email, err := execute(idp.mapper.email, claims)
+		if err != nil {
+			return errgo.Notef(err, "cannot determine email")
+		}
+		u.Email = email
+		update[store.Email] = store.Set
+	}
+	return nil
+}
+
+// multiFactor reports whether the given ID token claims show that the
+// user authenticated using multiple factors.
+func (idp *openidConnectIdentityProvider) multiFactor(claims map[string]interface{}) bool {
+	if amr, ok := claims["amr"].([]interface{}); ok {
+		for _, m := range amr {
+			if m == "mfa" {
+				return true
+			}
+		}
+	}
+	if acr, ok := claims["acr"].(string); ok {
+		for _, v := range idp.params.MultiFactorACRs {
+			if acr == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mappedGroups implements OpenIDConnectParams.GroupsFunc using the
+// configured groups claim mapping.
+func (idp *openidConnectIdentityProvider) mappedGroups(_ context.Context, _ *oauth2.Token, id *oidc.IDToken) ([]string, error) {
+	var claims map[string]interface{}
+	if err := id.Claims(&claims); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return idp.mapper.groupList(claims)
+}
+
 func (idp *openidConnectIdentityProvider) register(ctx context.Context, w http.ResponseWriter, req *http.Request, ls idputil.LoginState) error {
+	state := req.Form.Get("state")
+	if err := idp.initParams.Codec.CheckCSRFToken(state, req.PostForm.Get(idputil.CSRFTokenField)); err != nil {
+		return errgo.New("registration form expired, please try again")
+	}
 	u := &store.Identity{
 		ProviderID: ls.ProviderID,
 		Name:       req.Form.Get("fullname"),
 		Email:      req.Form.Get("email"),
 	}
-	err := idp.registerUser(ctx, req.Form.Get("username"), u)
+	err := idp.registerUser(ctx, req.Form.Get("username"), ls.MultiFactor, u)
 	if err == nil {
 		idp.initParams.VisitCompleter.RedirectSuccess(ctx, w, req, ls.ReturnTo, ls.State, u)
 		return nil
@@ -255,18 +544,19 @@ func (idp *openidConnectIdentityProvider) register(ctx context.Context, w http.R
 		return errgo.Mask(err)
 	}
 	return errgo.Mask(idputil.RegistrationForm(ctx, w, idputil.RegistrationParams{
-		State:    req.Form.Get("state"),
-		Error:    err.Error(),
-		Username: req.Form.Get("username"),
-		Domain:   idp.params.Domain,
-		FullName: req.Form.Get("fullname"),
-		Email:    req.Form.Get("email"),
+		State:     state,
+		Error:     err.Error(),
+		Username:  req.Form.Get("username"),
+		Domain:    idp.params.Domain,
+		FullName:  req.Form.Get("fullname"),
+		Email:     req.Form.Get("email"),
+		CSRFToken: idp.initParams.Codec.CSRFToken(state),
 	}, idp.initParams.Template))
 }
 
 var errInvalidUser = errgo.New("invalid user")
 
-func (idp *openidConnectIdentityProvider) registerUser(ctx context.Context, username string, u *store.Identity) error {
+func (idp *openidConnectIdentityProvider) registerUser(ctx context.Context, username string, mfa bool, u *store.Identity) error {
 	if !names.IsValidUserName(username) {
 		return errgo.WithCausef(nil, errInvalidUser, "invalid user name. The username must contain only A-Z, a-z, 0-9, '.', '-', & '+', and must start and end with a letter or number.")
 	}
@@ -274,11 +564,23 @@ func (idp *openidConnectIdentityProvider) registerUser(ctx context.Context, user
 		return errgo.WithCausef(nil, errInvalidUser, "username %s is not allowed, please choose another.", username)
 	}
 	u.Username = joinDomain(username, idp.params.Domain)
-	err := idp.initParams.Store.UpdateIdentity(ctx, u, store.Update{
-		store.Username: store.Set,
-		store.Name:     store.Set,
-		store.Email:    store.Set,
-	})
+	update := store.Update{
+		store.Username:     store.Set,
+		store.Name:         store.Set,
+		store.Email:        store.Set,
+		store.ProviderInfo: store.Set,
+	}
+	u.ProviderInfo = map[string][]string{
+		idputil.MFAProviderInfo: idputil.MFAInfo(mfa),
+	}
+	if idp.params.GroupsFunc != nil {
+		groups, err := idp.pendingGroups(ctx, u.ProviderID)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		u.ProviderInfo["groups"] = groups
+	}
+	err := idp.initParams.Store.UpdateIdentity(ctx, u, update)
 	if err == nil {
 		return nil
 	}
@@ -288,6 +590,43 @@ func (idp *openidConnectIdentityProvider) registerUser(ctx context.Context, user
 	return errgo.WithCausef(nil, errInvalidUser, "Username already taken, please pick a different one.")
 }
 
+// pendingGroupsKey returns the key used to hold the groups of a user
+// that has not yet completed registration.
+func pendingGroupsKey(id store.ProviderIdentity) string {
+	return "pending-groups:" + string(id)
+}
+
+// setPendingGroups stores the groups determined for the given user
+// until they have completed registration, or until the given expiry
+// time.
+func (idp *openidConnectIdentityProvider) setPendingGroups(ctx context.Context, id store.ProviderIdentity, groups []string, expire time.Time) error {
+	b, err := json.Marshal(groups)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := idp.initParams.KeyValueStore.Set(ctx, pendingGroupsKey(id), b, expire); err != nil {
+		return errgo.Notef(err, "cannot store groups")
+	}
+	return nil
+}
+
+// pendingGroups retrieves the groups stored by setPendingGroups. If
+// there are no stored groups then no groups are returned.
+func (idp *openidConnectIdentityProvider) pendingGroups(ctx context.Context, id store.ProviderIdentity) ([]string, error) {
+	b, err := idp.initParams.KeyValueStore.Get(ctx, pendingGroupsKey(id))
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot retrieve groups")
+	}
+	var groups []string
+	if err := json.Unmarshal(b, &groups); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal groups")
+	}
+	return groups, nil
+}
+
 // claims contains the set of claims possibly returned in the OpenID
 // token.
 type claims struct {
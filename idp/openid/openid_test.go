@@ -0,0 +1,256 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package openid_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"golang.org/x/oauth2"
+	"gopkg.in/yaml.v2"
+
+	"github.com/CanonicalLtd/candid/config"
+	"github.com/CanonicalLtd/candid/idp/openid"
+)
+
+var configTests = []struct {
+	about       string
+	yaml        string
+	expectError string
+}{{
+	about: "good config",
+	yaml: `
+identity-providers:
+ - type: openid-connect
+   name: op
+   issuer: https://op.example.com
+   client-id: client-001
+   client-secret: secret-001
+   claim-mapping:
+     username: '{{.preferred_username}}'
+     groups: '{{range index . "groups"}}{{.}} {{end}}'
+   refresh-interval: 5m
+`,
+}, {
+	about: "no issuer",
+	yaml: `
+identity-providers:
+ - type: openid-connect
+   name: op
+   client-id: client-001
+   client-secret: secret-001
+`,
+	expectError: `cannot unmarshal openid-connect configuration: issuer not specified`,
+}, {
+	about: "invalid claim mapping",
+	yaml: `
+identity-providers:
+ - type: openid-connect
+   name: op
+   issuer: https://op.example.com
+   client-id: client-001
+   client-secret: secret-001
+   claim-mapping:
+     email: '{{.email'
+`,
+	expectError: `cannot unmarshal openid-connect configuration: invalid email claim mapping: .*`,
+}}
+
+func TestConfig(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range configTests {
+		c.Run(test.about, func(c *qt.C) {
+			var conf config.Config
+			err := yaml.Unmarshal([]byte(test.yaml), &conf)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(conf.IdentityProviders, qt.HasLen, 1)
+			c.Assert(conf.IdentityProviders[0].Name(), qt.Equals, "op")
+		})
+	}
+}
+
+var mapClaimsTests = []struct {
+	about          string
+	mapping        openid.ClaimMapping
+	claims         map[string]interface{}
+	expectUsername string
+	expectName     string
+	expectEmail    string
+	expectGroups   []string
+	expectError    string
+}{{
+	about: "simple claims",
+	mapping: openid.ClaimMapping{
+		Username: "{{.preferred_username}}",
+		Name:     "{{.given_name}} {{.family_name}}",
+		Email:    "{{.email}}",
+		Groups:   `{{range index . "groups"}}{{.}} {{end}}`,
+	},
+	claims: map[string]interface{}{
+		"preferred_username": "bob",
+		"given_name":         "Bob",
+		"family_name":        "Robertson",
+		"email":              "bob@example.com",
+		"groups":             []interface{}{"g1", "g2"},
+	},
+	expectUsername: "bob",
+	expectName:     "Bob Robertson",
+	expectEmail:    "bob@example.com",
+	expectGroups:   []string{"g1", "g2"},
+}, {
+	about: "absent optional claim",
+	mapping: openid.ClaimMapping{
+		Groups: `{{range index . "groups"}}{{.}} {{end}}`,
+	},
+	claims:       map[string]interface{}{},
+	expectGroups: []string{},
+}, {
+	about: "nested claims",
+	mapping: openid.ClaimMapping{
+		Groups: `{{range .realm_access.roles}}role-{{.}} {{end}}`,
+	},
+	claims: map[string]interface{}{
+		"realm_access": map[string]interface{}{
+			"roles": []interface{}{"admin", "user"},
+		},
+	},
+	expectGroups: []string{"role-admin", "role-user"},
+}, {
+	about: "missing claim",
+	mapping: openid.ClaimMapping{
+		Username: "{{.preferred_username}}",
+	},
+	claims:      map[string]interface{}{},
+	expectError: `cannot map claims: .*map has no entry for key "preferred_username"`,
+}}
+
+func TestMapClaims(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range mapClaimsTests {
+		c.Run(test.about, func(c *qt.C) {
+			username, name, email, groups, err := openid.MapClaims(test.mapping, test.claims)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(username, qt.Equals, test.expectUsername)
+			c.Assert(name, qt.Equals, test.expectName)
+			c.Assert(email, qt.Equals, test.expectEmail)
+			c.Assert(groups, qt.DeepEquals, test.expectGroups)
+		})
+	}
+}
+
+var multiFactorTests = []struct {
+	about  string
+	acrs   []string
+	claims map[string]interface{}
+	expect bool
+}{{
+	about:  "no claims",
+	claims: map[string]interface{}{},
+	expect: false,
+}, {
+	about: "amr with mfa",
+	claims: map[string]interface{}{
+		"amr": []interface{}{"pwd", "mfa"},
+	},
+	expect: true,
+}, {
+	about: "amr without mfa",
+	claims: map[string]interface{}{
+		"amr": []interface{}{"pwd"},
+	},
+	expect: false,
+}, {
+	about: "multi-factor acr",
+	acrs:  []string{"silver", "gold"},
+	claims: map[string]interface{}{
+		"acr": "gold",
+	},
+	expect: true,
+}, {
+	about: "other acr",
+	acrs:  []string{"gold"},
+	claims: map[string]interface{}{
+		"acr": "bronze",
+	},
+	expect: false,
+}}
+
+func TestMultiFactor(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range multiFactorTests {
+		c.Run(test.about, func(c *qt.C) {
+			i := openid.NewOpenIDConnectIdentityProvider(openid.OpenIDConnectParams{
+				Name:            "test",
+				MultiFactorACRs: test.acrs,
+			})
+			c.Assert(openid.MultiFactor(i, test.claims), qt.Equals, test.expect)
+		})
+	}
+}
+
+func TestStepUpOptions(t *testing.T) {
+	c := qt.New(t)
+	i := openid.NewOpenIDConnectIdentityProvider(openid.OpenIDConnectParams{
+		Name: "test",
+	})
+	u, err := url.Parse(openid.StepUpURL(i))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(u.Query().Get("prompt"), qt.Equals, "login")
+	c.Assert(u.Query().Get("max_age"), qt.Equals, "0")
+	c.Assert(u.Query()["acr_values"], qt.IsNil)
+
+	i = openid.NewOpenIDConnectIdentityProvider(openid.OpenIDConnectParams{
+		Name:            "test",
+		MultiFactorACRs: []string{"gold", "silver"},
+	})
+	u, err = url.Parse(openid.StepUpURL(i))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(u.Query().Get("acr_values"), qt.Equals, "gold silver")
+}
+
+func TestPKCEContext(t *testing.T) {
+	c := qt.New(t)
+	var form url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		form = req.PostForm
+	}))
+	defer srv.Close()
+	ctx := openid.PKCEContext(context.Background(), "test-verifier")
+	client := ctx.Value(oauth2.HTTPClient).(*http.Client)
+	resp, err := client.PostForm(srv.URL, url.Values{"code": {"test-code"}})
+	c.Assert(err, qt.Equals, nil)
+	resp.Body.Close()
+	c.Assert(form, qt.DeepEquals, url.Values{
+		"code":          {"test-code"},
+		"code_verifier": {"test-verifier"},
+	})
+}
+
+func TestTokenRejected(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(openid.TokenRejected(&oauth2.RetrieveError{
+		Body: []byte(`{"error":"invalid_grant","error_description":"token expired"}`),
+	}), qt.Equals, true)
+	c.Assert(openid.TokenRejected(&oauth2.RetrieveError{
+		Body: []byte(`{"error":"invalid_client"}`),
+	}), qt.Equals, false)
+	c.Assert(openid.TokenRejected(&oauth2.RetrieveError{
+		Body: []byte(`<html>Bad Gateway</html>`),
+	}), qt.Equals, false)
+	c.Assert(openid.TokenRejected(errors.New("oauth2: cannot fetch token: 400 Bad Request\nResponse: {\"error\":\"invalid_grant\"}")), qt.Equals, false)
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package openid
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"gopkg.in/errgo.v1"
+)
+
+// newPKCEVerifier creates a new random PKCE code verifier. See
+// https://tools.ietf.org/html/rfc7636#section-4.1.
+func newPKCEVerifier() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// pkceOptions returns the options to add to an authorization request
+// for the given code verifier using the S256 challenge method.
+func pkceOptions(verifier string) []oauth2.AuthCodeOption {
+	sum := sha256.Sum256([]byte(verifier))
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(sum[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	}
+}
+
+// pkceContext returns a context that can be used with
+// oauth2.Config.Exchange to add the given code verifier to the token
+// request. The version of the oauth2 package in use has no other way
+// to add parameters to the token request.
+func pkceContext(ctx context.Context, verifier string) context.Context {
+	base := http.DefaultTransport
+	if c, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok && c.Transport != nil {
+		base = c.Transport
+	}
+	return context.WithValue(ctx, oauth2.HTTPClient, &http.Client{
+		Transport: &pkceTransport{
+			verifier: verifier,
+			base:     base,
+		},
+	})
+}
+
+// pkceTransport is an http.RoundTripper that adds a code_verifier
+// parameter to form encoded POST requests.
+type pkceTransport struct {
+	verifier string
+	base     http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *pkceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "POST" || req.Body == nil || req.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+		return t.base.RoundTrip(req)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	v, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	v.Set("code_verifier", t.verifier)
+	enc := v.Encode()
+	req1 := new(http.Request)
+	*req1 = *req
+	req1.Body = ioutil.NopCloser(strings.NewReader(enc))
+	req1.ContentLength = int64(len(enc))
+	return t.base.RoundTrip(req1)
+}
@@ -0,0 +1,388 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package openid
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"github.com/juju/simplekv"
+	"golang.org/x/oauth2"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// refreshPageSize is the number of identities read from the store at a
+// time when refreshing.
+const refreshPageSize = 100
+
+// refreshLeaseDuration is the length of time for which a server has
+// exclusive use of an identity's refresh token while refreshing it.
+// This stops servers sharing the same store from using, and so
+// rotating, the same refresh token concurrently.
+const refreshLeaseDuration = time.Minute
+
+var (
+	// errNoRefreshToken is the cause of the error returned by
+	// leaseRefreshToken when there is no stored refresh token.
+	errNoRefreshToken = errgo.New("no refresh token")
+
+	// errRefreshLeased is the cause of the error returned by
+	// leaseRefreshToken when another server is refreshing the
+	// identity.
+	errRefreshLeased = errgo.New("refresh token leased by another server")
+
+	// errRefreshTokenChanged is the cause of the error returned by
+	// replaceRefreshToken when the stored refresh token is not the
+	// one that was used.
+	errRefreshTokenChanged = errgo.New("refresh token changed")
+)
+
+// refreshRecord is the value stored for each identity that has a
+// refresh token.
+type refreshRecord struct {
+	// RefreshToken holds the refresh token encrypted with the
+	// server's codec. An empty value means that there is no token.
+	RefreshToken string `json:"refresh-token"`
+
+	// LeaseExpires holds the time until which a server refreshing
+	// the identity has exclusive use of the token.
+	LeaseExpires time.Time `json:"lease-expires,omitempty"`
+}
+
+// refreshKey returns the key used to hold the refresh token of the
+// given identity.
+func refreshKey(id store.ProviderIdentity) string {
+	return "refresh:" + string(id)
+}
+
+// encodeRefreshRecord encodes a refreshRecord holding the given token
+// and lease expiry time. Refresh tokens are long-lived credentials, so
+// they are always encrypted before being stored.
+func (idp *openidConnectIdentityProvider) encodeRefreshRecord(token string, leaseExpires time.Time) ([]byte, error) {
+	r := refreshRecord{
+		LeaseExpires: leaseExpires,
+	}
+	if token != "" {
+		var err error
+		r.RefreshToken, err = idp.initParams.Codec.Encode(token)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot encrypt refresh token")
+		}
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return b, nil
+}
+
+// decodeRefreshRecord decodes a refreshRecord encoded with
+// encodeRefreshRecord. A nil value decodes to an empty token.
+func (idp *openidConnectIdentityProvider) decodeRefreshRecord(b []byte) (token string, leaseExpires time.Time, _ error) {
+	if len(b) == 0 {
+		return "", time.Time{}, nil
+	}
+	var r refreshRecord
+	if err := json.Unmarshal(b, &r); err != nil {
+		return "", time.Time{}, errgo.Notef(err, "cannot unmarshal refresh token")
+	}
+	if r.RefreshToken != "" {
+		if err := idp.initParams.Codec.Decode(r.RefreshToken, &token); err != nil {
+			return "", time.Time{}, errgo.Notef(err, "cannot decrypt refresh token")
+		}
+	}
+	return token, r.LeaseExpires, nil
+}
+
+// setRefreshToken stores the refresh token for the given identity,
+// replacing any existing token and lease. An empty token removes any
+// stored token.
+func (idp *openidConnectIdentityProvider) setRefreshToken(ctx context.Context, id store.ProviderIdentity, token string) error {
+	b, err := idp.encodeRefreshRecord(token, time.Time{})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := idp.initParams.KeyValueStore.Set(ctx, refreshKey(id), b, time.Time{}); err != nil {
+		return errgo.Notef(err, "cannot store refresh token")
+	}
+	return nil
+}
+
+// refreshToken retrieves the refresh token stored for the given
+// identity. If there is no token then an empty string is returned.
+func (idp *openidConnectIdentityProvider) refreshToken(ctx context.Context, id store.ProviderIdentity) (string, error) {
+	b, err := idp.initParams.KeyValueStore.Get(ctx, refreshKey(id))
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", errgo.Notef(err, "cannot retrieve refresh token")
+	}
+	token, _, err := idp.decodeRefreshRecord(b)
+	return token, errgo.Mask(err)
+}
+
+// leaseRefreshToken atomically takes a lease on the refresh token of
+// the given identity and returns the token. If there is no token then
+// an error with a cause of errNoRefreshToken is returned. If another
+// server holds an unexpired lease then an error with a cause of
+// errRefreshLeased is returned.
+func (idp *openidConnectIdentityProvider) leaseRefreshToken(ctx context.Context, id store.ProviderIdentity, now time.Time) (string, error) {
+	var token string
+	err := idp.initParams.KeyValueStore.Update(ctx, refreshKey(id), time.Time{}, func(old []byte) ([]byte, error) {
+		var leaseExpires time.Time
+		var err error
+		token, leaseExpires, err = idp.decodeRefreshRecord(old)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if token == "" {
+			return nil, errNoRefreshToken
+		}
+		if now.Before(leaseExpires) {
+			return nil, errRefreshLeased
+		}
+		return idp.encodeRefreshRecord(token, now.Add(refreshLeaseDuration))
+	})
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Is(errNoRefreshToken), errgo.Is(errRefreshLeased))
+	}
+	return token, nil
+}
+
+// replaceRefreshToken atomically replaces the refresh token of the
+// given identity, releasing any lease, but only if the stored token is
+// still oldToken. If it is not, for example because the user has
+// logged in again, then an error with a cause of
+// errRefreshTokenChanged is returned and the stored token is left
+// unchanged. An empty newToken removes the stored token.
+func (idp *openidConnectIdentityProvider) replaceRefreshToken(ctx context.Context, id store.ProviderIdentity, oldToken, newToken string) error {
+	err := idp.initParams.KeyValueStore.Update(ctx, refreshKey(id), time.Time{}, func(old []byte) ([]byte, error) {
+		token, _, err := idp.decodeRefreshRecord(old)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if token != oldToken {
+			return nil, errRefreshTokenChanged
+		}
+		return idp.encodeRefreshRecord(newToken, time.Time{})
+	})
+	return errgo.Mask(err, errgo.Is(errRefreshTokenChanged))
+}
+
+// A refresher periodically uses the stored refresh tokens to update the
+// details of the identities created by an identity provider.
+type refresher struct {
+	idp      *openidConnectIdentityProvider
+	interval time.Duration
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	done      chan struct{}
+}
+
+func newRefresher(idp *openidConnectIdentityProvider, interval time.Duration) *refresher {
+	r := &refresher{
+		idp:      idp,
+		interval: interval,
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// Close stops the refresher and waits for any refresh in progress to
+// complete.
+func (r *refresher) Close() {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+	})
+	<-r.done
+}
+
+func (r *refresher) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.refreshAll()
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+// refreshAll refreshes every identity belonging to the identity
+// provider that has a stored refresh token.
+func (r *refresher) refreshAll() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	ctx, close := r.idp.initParams.Store.Context(ctx)
+	defer close()
+
+	// Identities are read in ProviderID order, continuing from the
+	// last identity seen, so that identities created during the
+	// refresh cannot cause any to be missed.
+	prefix := r.idp.Name() + ":"
+	var filter store.Filter
+	filter[store.ProviderID] = store.GreaterThanOrEqual
+	ref := store.Identity{
+		ProviderID: store.ProviderIdentity(prefix),
+	}
+	for {
+		ids, err := r.idp.initParams.Store.FindIdentities(ctx, &ref, filter, []store.Sort{{Field: store.ProviderID}}, 0, refreshPageSize)
+		if err != nil {
+			logger.Errorf("cannot find identities to refresh: %s", err)
+			return
+		}
+		for i := range ids {
+			if !strings.HasPrefix(string(ids[i].ProviderID), prefix) {
+				return
+			}
+			if err := r.idp.refreshIdentity(ctx, &ids[i]); err != nil {
+				logger.Errorf("cannot refresh identity %q: %s", ids[i].Username, err)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+		}
+		if len(ids) < refreshPageSize {
+			return
+		}
+		ref.ProviderID = ids[len(ids)-1].ProviderID
+		filter[store.ProviderID] = store.GreaterThan
+	}
+}
+
+// refreshIdentity uses the stored refresh token for the given identity
+// to obtain a new ID token and updates the identity's details. If the
+// OpenID provider rejects the refresh token, for example because the
+// user's account has been disabled, then the user's groups are removed.
+//
+// The refresh token is leased for the duration of the refresh so that
+// other servers do not use it at the same time. If the provider
+// rotates the token, the new token is only stored if the token used is
+// still current, and groups are only removed on rejection if no newer
+// token has been stored in the meantime.
+func (idp *openidConnectIdentityProvider) refreshIdentity(ctx context.Context, u *store.Identity) error {
+	rt, err := idp.leaseRefreshToken(ctx, u.ProviderID, time.Now())
+	switch errgo.Cause(err) {
+	case nil:
+	case errNoRefreshToken:
+		return nil
+	case errRefreshLeased:
+		logger.Debugf("not refreshing %q: %s", u.Username, err)
+		return nil
+	default:
+		return errgo.Mask(err)
+	}
+	tok, err := idp.config.TokenSource(ctx, &oauth2.Token{RefreshToken: rt}).Token()
+	if err != nil {
+		if !tokenRejected(err) {
+			// Release the lease so that the next refresh
+			// can try again.
+			if err := idp.replaceRefreshToken(ctx, u.ProviderID, rt, rt); err != nil {
+				logger.Infof("cannot release refresh token lease for %q: %s", u.Username, err)
+			}
+			return errgo.Mask(err)
+		}
+		err1 := idp.replaceRefreshToken(ctx, u.ProviderID, rt, "")
+		if errgo.Cause(err1) == errRefreshTokenChanged {
+			logger.Infof("refresh token for %q rejected, but a newer token has been stored: %s", u.Username, err)
+			return nil
+		}
+		if err1 != nil {
+			return errgo.Mask(err1)
+		}
+		logger.Infof("refresh token for %q rejected, removing groups: %s", u.Username, err)
+		return errgo.Mask(idp.initParams.Store.UpdateIdentity(ctx, &store.Identity{
+			ProviderID: u.ProviderID,
+			ProviderInfo: map[string][]string{
+				"groups": nil,
+			},
+		}, store.Update{
+			store.ProviderInfo: store.Set,
+		}))
+	}
+	newrt := rt
+	if tok.RefreshToken != "" {
+		newrt = tok.RefreshToken
+	}
+	if err := idp.replaceRefreshToken(ctx, u.ProviderID, rt, newrt); err != nil {
+		if errgo.Cause(err) == errRefreshTokenChanged {
+			// The user has logged in again while the
+			// refresh was in progress, their details
+			// are already up to date.
+			return nil
+		}
+		return errgo.Mask(err)
+	}
+	idtoks, _ := tok.Extra("id_token").(string)
+	if idtoks == "" {
+		// Not all providers issue a new ID token on refresh, the
+		// successful refresh shows that the account is still
+		// active, but there are no new claims.
+		return nil
+	}
+	id, err := idp.provider.Verifier(&oidc.Config{ClientID: idp.config.ClientID}).Verify(ctx, idtoks)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var update store.Update
+	if idp.params.GroupsFunc != nil {
+		groups, err := idp.params.GroupsFunc(ctx, tok, id)
+		if err != nil {
+			return errgo.Notef(err, "cannot get groups")
+		}
+		u.ProviderInfo = map[string][]string{
+			"groups": groups,
+		}
+		update[store.ProviderInfo] = store.Set
+	}
+	var claims map[string]interface{}
+	if err := id.Claims(&claims); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := idp.mapDetails(claims, u, &update); err != nil {
+		return errgo.Mask(err)
+	}
+	if update == (store.Update{}) {
+		return nil
+	}
+	return errgo.Mask(idp.initParams.Store.UpdateIdentity(ctx, u, update))
+}
+
+// tokenRejected reports whether the given error from a token refresh
+// indicates that the OpenID provider rejected the refresh token, rather
+// than that it could not be contacted or that the client is
+// misconfigured. See RFC 6749 section 5.2.
+func tokenRejected(err error) bool {
+	rerr, ok := errgo.Cause(err).(*oauth2.RetrieveError)
+	if !ok {
+		return false
+	}
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(rerr.Body, &resp); err != nil {
+		return false
+	}
+	return resp.Error == "invalid_grant"
+}
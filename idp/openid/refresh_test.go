@@ -0,0 +1,284 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package openid_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+
+	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/idptest"
+	"github.com/CanonicalLtd/candid/idp/openid"
+	"github.com/CanonicalLtd/candid/internal/candidtest"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+type refreshSuite struct {
+	idptest *idptest.Fixture
+	op      *tokenServer
+	idp     idp.IdentityProvider
+}
+
+func TestRefresh(t *testing.T) {
+	qtsuite.Run(qt.New(t), &refreshSuite{})
+}
+
+func (s *refreshSuite) Init(c *qt.C) {
+	s.idptest = idptest.NewFixture(c, candidtest.NewStore())
+	s.op = newTokenServer()
+	c.Defer(s.op.Close)
+	s.idp = openid.NewOpenIDConnectIdentityProvider(openid.OpenIDConnectParams{
+		Name:            "op",
+		Issuer:          s.op.URL,
+		ClientID:        "client-001",
+		ClientSecret:    "secret-001",
+		RefreshInterval: time.Hour,
+	})
+	err := s.idp.Init(s.idptest.Ctx, s.idptest.InitParams(c, "https://idp.example.com"))
+	c.Assert(err, qt.Equals, nil)
+	c.Defer(func() {
+		s.idp.(interface{ Close() error }).Close()
+	})
+}
+
+func (s *refreshSuite) TestRefreshIdentity(c *qt.C) {
+	id := s.addIdentity(c, "bob", "rt-1")
+	s.op.respond("rt-1", http.StatusOK, `{"access_token":"at","token_type":"Bearer","expires_in":3600}`)
+	err := openid.RefreshIdentity(s.idptest.Ctx, s.idp, id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(s.op.used(), qt.DeepEquals, []string{"rt-1"})
+	s.assertRefreshToken(c, id, "rt-1")
+	s.assertGroups(c, id, []string{"group1"})
+
+	// The lease has been released, so the token can be used
+	// again.
+	err = openid.RefreshIdentity(s.idptest.Ctx, s.idp, id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(s.op.used(), qt.DeepEquals, []string{"rt-1", "rt-1"})
+}
+
+func (s *refreshSuite) TestRefreshIdentityRotatesToken(c *qt.C) {
+	id := s.addIdentity(c, "bob", "rt-1")
+	s.op.respond("rt-1", http.StatusOK, `{"access_token":"at","token_type":"Bearer","refresh_token":"rt-2","expires_in":3600}`)
+	err := openid.RefreshIdentity(s.idptest.Ctx, s.idp, id)
+	c.Assert(err, qt.Equals, nil)
+	s.assertRefreshToken(c, id, "rt-2")
+	s.assertGroups(c, id, []string{"group1"})
+}
+
+func (s *refreshSuite) TestRefreshIdentityRejected(c *qt.C) {
+	id := s.addIdentity(c, "bob", "rt-1")
+	s.op.respond("rt-1", http.StatusBadRequest, `{"error":"invalid_grant"}`)
+	err := openid.RefreshIdentity(s.idptest.Ctx, s.idp, id)
+	c.Assert(err, qt.Equals, nil)
+	s.assertRefreshToken(c, id, "")
+	s.assertGroups(c, id, nil)
+}
+
+func (s *refreshSuite) TestRefreshIdentityServerError(c *qt.C) {
+	id := s.addIdentity(c, "bob", "rt-1")
+	s.op.respond("rt-1", http.StatusBadRequest, `{"error":"invalid_client"}`)
+	err := openid.RefreshIdentity(s.idptest.Ctx, s.idp, id)
+	c.Assert(err, qt.ErrorMatches, `oauth2: cannot fetch token: .*`)
+	s.assertRefreshToken(c, id, "rt-1")
+	s.assertGroups(c, id, []string{"group1"})
+
+	// The lease has been released, so the next refresh tries
+	// again.
+	s.op.respond("rt-1", http.StatusOK, `{"access_token":"at","token_type":"Bearer","refresh_token":"rt-2","expires_in":3600}`)
+	err = openid.RefreshIdentity(s.idptest.Ctx, s.idp, id)
+	c.Assert(err, qt.Equals, nil)
+	s.assertRefreshToken(c, id, "rt-2")
+}
+
+func (s *refreshSuite) TestRefreshIdentityLeased(c *qt.C) {
+	id := s.addIdentity(c, "bob", "rt-1")
+	rt, err := openid.LeaseRefreshToken(s.idptest.Ctx, s.idp, id.ProviderID)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rt, qt.Equals, "rt-1")
+	err = openid.RefreshIdentity(s.idptest.Ctx, s.idp, id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(s.op.used(), qt.HasLen, 0)
+}
+
+func (s *refreshSuite) TestRefreshIdentityRejectedAfterLogin(c *qt.C) {
+	id := s.addIdentity(c, "bob", "rt-1")
+	// The user logs in again while the refresh is in progress,
+	// which stores a new token. The rejection of the old token
+	// must not remove the user's groups or the new token.
+	s.op.respondFunc("rt-1", func() {
+		err := openid.SetRefreshToken(s.idptest.Ctx, s.idp, id.ProviderID, "rt-login")
+		c.Check(err, qt.Equals, nil)
+	}, http.StatusBadRequest, `{"error":"invalid_grant"}`)
+	err := openid.RefreshIdentity(s.idptest.Ctx, s.idp, id)
+	c.Assert(err, qt.Equals, nil)
+	s.assertRefreshToken(c, id, "rt-login")
+	s.assertGroups(c, id, []string{"group1"})
+}
+
+func (s *refreshSuite) TestRefreshAll(c *qt.C) {
+	alice := s.addIdentity(c, "alice", "rt-alice")
+	bob := s.addIdentity(c, "bob", "rt-bob")
+	charlie := s.addIdentity(c, "charlie", "")
+	s.op.respond("rt-alice", http.StatusOK, `{"access_token":"at","token_type":"Bearer","refresh_token":"rt-alice-2","expires_in":3600}`)
+	s.op.respond("rt-bob", http.StatusBadRequest, `{"error":"invalid_grant"}`)
+	openid.RefreshAll(s.idp)
+	c.Assert(s.op.used(), qt.DeepEquals, []string{"rt-alice", "rt-bob"})
+	s.assertRefreshToken(c, alice, "rt-alice-2")
+	s.assertGroups(c, alice, []string{"group1"})
+	s.assertRefreshToken(c, bob, "")
+	s.assertGroups(c, bob, nil)
+	s.assertRefreshToken(c, charlie, "")
+	s.assertGroups(c, charlie, []string{"group1"})
+}
+
+// addIdentity adds an identity with the given username, in group1,
+// with the given stored refresh token.
+func (s *refreshSuite) addIdentity(c *qt.C, username, refreshToken string) *store.Identity {
+	id := &store.Identity{
+		ProviderID: store.MakeProviderIdentity("op", s.op.URL+":"+username),
+		Username:   username,
+		ProviderInfo: map[string][]string{
+			"groups": {"group1"},
+		},
+	}
+	err := s.idptest.Store.Store.UpdateIdentity(s.idptest.Ctx, id, store.Update{
+		store.Username:     store.Set,
+		store.ProviderInfo: store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+	if refreshToken != "" {
+		err = openid.SetRefreshToken(s.idptest.Ctx, s.idp, id.ProviderID, refreshToken)
+		c.Assert(err, qt.Equals, nil)
+	}
+	return id
+}
+
+func (s *refreshSuite) assertRefreshToken(c *qt.C, id *store.Identity, want string) {
+	rt, err := openid.RefreshToken(s.idptest.Ctx, s.idp, id.ProviderID)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rt, qt.Equals, want)
+}
+
+func (s *refreshSuite) assertGroups(c *qt.C, id *store.Identity, want []string) {
+	id1 := store.Identity{
+		ProviderID: id.ProviderID,
+	}
+	err := s.idptest.Store.Store.Identity(s.idptest.Ctx, &id1)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id1.ProviderInfo["groups"], qt.DeepEquals, want)
+}
+
+func TestLogoutURL(t *testing.T) {
+	c := qt.New(t)
+	f := idptest.NewFixture(c, candidtest.NewStore())
+	op := newTokenServer()
+	defer op.Close()
+	i := openid.NewOpenIDConnectIdentityProvider(openid.OpenIDConnectParams{
+		Name:         "op",
+		Issuer:       op.URL,
+		ClientID:     "client-001",
+		ClientSecret: "secret-001",
+	})
+	err := i.Init(f.Ctx, f.InitParams(c, "https://idp.example.com"))
+	c.Assert(err, qt.Equals, nil)
+	u, err := url.Parse(i.(idp.LogoutRedirector).LogoutURL("https://idp.example.com/logout-complete", "test-state"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(u.Scheme+"://"+u.Host+u.Path, qt.Equals, op.URL+"/logout")
+	c.Assert(u.Query(), qt.DeepEquals, url.Values{
+		"client_id":                {"client-001"},
+		"post_logout_redirect_uri": {"https://idp.example.com/logout-complete"},
+		"state":                    {"test-state"},
+	})
+}
+
+// tokenServer is a minimal OpenID provider that serves a discovery
+// document and a token endpoint with configurable responses to refresh
+// token grants.
+type tokenServer struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	responses map[string]tokenResponse
+	tokens    []string
+}
+
+type tokenResponse struct {
+	f      func()
+	status int
+	body   string
+}
+
+func newTokenServer() *tokenServer {
+	s := &tokenServer{
+		responses: make(map[string]tokenResponse),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 s.URL,
+			"authorization_endpoint": s.URL + "/auth",
+			"token_endpoint":         s.URL + "/token",
+			"jwks_uri":               s.URL + "/keys",
+			"end_session_endpoint":   s.URL + "/logout",
+		})
+	})
+	mux.HandleFunc("/token", s.serveToken)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func (s *tokenServer) serveToken(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	rt := req.PostForm.Get("refresh_token")
+	s.mu.Lock()
+	s.tokens = append(s.tokens, rt)
+	resp, ok := s.responses[rt]
+	s.mu.Unlock()
+	if !ok {
+		resp = tokenResponse{
+			status: http.StatusBadRequest,
+			body:   `{"error":"invalid_grant"}`,
+		}
+	}
+	if resp.f != nil {
+		resp.f()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.status)
+	w.Write([]byte(resp.body))
+}
+
+// respond sets the response to a refresh using the given token.
+func (s *tokenServer) respond(rt string, status int, body string) {
+	s.respondFunc(rt, nil, status, body)
+}
+
+// respondFunc sets the response to a refresh using the given token.
+// The given function is called before the response is written.
+func (s *tokenServer) respondFunc(rt string, f func(), status int, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses[rt] = tokenResponse{
+		f:      f,
+		status: status,
+		body:   body,
+	}
+}
+
+// used returns the refresh tokens that have been used, in order.
+func (s *tokenServer) used() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.tokens...)
+}
@@ -0,0 +1,419 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package plugin is an identity provider that delegates to an external
+// plugin process using the API defined in package pluginapi. This
+// allows identity providers to be developed and shipped separately from
+// candid.
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/juju/names"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/idputil"
+	"github.com/CanonicalLtd/candid/idp/plugin/pluginapi"
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+var logger = loggo.GetLogger("candid.idp.plugin")
+
+const (
+	// defaultStartTimeout is the default time to wait for a plugin
+	// to start serving.
+	defaultStartTimeout = 10 * time.Second
+
+	// requestTimeout is the maximum time to wait for a plugin to
+	// respond to a request.
+	requestTimeout = 30 * time.Second
+)
+
+func init() {
+	idp.Register("plugin", func(unmarshal func(interface{}) error) (idp.IdentityProvider, error) {
+		var p Params
+		if err := unmarshal(&p); err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal plugin parameters")
+		}
+		if p.Name == "" {
+			return nil, errgo.Newf("name not specified")
+		}
+		if p.Command == "" {
+			return nil, errgo.Newf("command not specified")
+		}
+		return NewIdentityProvider(p), nil
+	})
+}
+
+type Params struct {
+	// Name is the name that will be given to the identity provider.
+	Name string `yaml:"name"`
+
+	// Description is the description of the IDP shown to the user on
+	// the IDP selection page.
+	Description string `yaml:"description"`
+
+	// Icon contains the URL or path of an icon.
+	Icon string `yaml:"icon"`
+
+	// Domain is the domain with which all identities created by this
+	// identity provider will be tagged (not including the @ separator).
+	Domain string `yaml:"domain"`
+
+	// Hidden is set if the IDP should be hidden from interactive
+	// prompts.
+	Hidden bool `yaml:"hidden"`
+
+	// Command holds the path of the plugin executable.
+	Command string `yaml:"command"`
+
+	// Args holds any arguments to pass to the plugin executable.
+	Args []string `yaml:"args"`
+
+	// Config holds plugin specific configuration that is passed to
+	// the plugin when it is initialised.
+	Config interface{} `yaml:"config"`
+
+	// StartTimeout holds the maximum time to wait for the plugin to
+	// start serving. If this is zero a default of 10 seconds is used.
+	StartTimeout time.Duration `yaml:"start-timeout"`
+}
+
+// NewIdentityProvider creates a new identity provider that uses the
+// plugin described by the given parameters. The plugin is started when
+// the identity provider is initialised.
+func NewIdentityProvider(p Params) idp.IdentityProvider {
+	if p.Description == "" {
+		p.Description = p.Name
+	}
+	if p.StartTimeout == 0 {
+		p.StartTimeout = defaultStartTimeout
+	}
+	return &identityProvider{params: p}
+}
+
+type identityProvider struct {
+	params     Params
+	initParams idp.InitParams
+
+	dir    string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	conn   *grpc.ClientConn
+	client *pluginapi.Client
+}
+
+// Name implements idp.IdentityProvider.Name.
+func (idp *identityProvider) Name() string {
+	return idp.params.Name
+}
+
+// Domain implements idp.IdentityProvider.Domain.
+func (idp *identityProvider) Domain() string {
+	return idp.params.Domain
+}
+
+// Description implements idp.IdentityProvider.Description.
+func (idp *identityProvider) Description() string {
+	return idp.params.Description
+}
+
+// IconURL returns the URL of an icon for the identity provider.
+func (idp *identityProvider) IconURL() string {
+	return idputil.ServiceURL(idp.initParams.Location, idp.params.Icon)
+}
+
+// Interactive implements idp.IdentityProvider.Interactive.
+func (*identityProvider) Interactive() bool {
+	return true
+}
+
+// Hidden implements idp.IdentityProvider.Hidden.
+func (idp *identityProvider) Hidden() bool {
+	return idp.params.Hidden
+}
+
+// Init implements idp.IdentityProvider.Init by starting the plugin
+// process and initialising it.
+func (idp *identityProvider) Init(ctx context.Context, params idp.InitParams) error {
+	idp.initParams = params
+	config, err := json.Marshal(jsonValue(idp.params.Config))
+	if err != nil {
+		return errgo.Notef(err, "invalid plugin configuration")
+	}
+	if err := idp.start(ctx); err != nil {
+		return errgo.Notef(err, "cannot start plugin %q", idp.params.Name)
+	}
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	_, err = idp.client.Init(ctx, &pluginapi.InitRequest{
+		Config:    config,
+		Location:  params.Location,
+		URLPrefix: params.URLPrefix,
+	})
+	if err != nil {
+		idp.Close()
+		return errgo.Notef(err, "cannot initialise plugin %q", idp.params.Name)
+	}
+	return nil
+}
+
+// start starts the plugin process and connects to it.
+func (idp *identityProvider) start(ctx context.Context) error {
+	dir, err := ioutil.TempDir("", "candid-plugin")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	idp.dir = dir
+	path := filepath.Join(dir, "plugin.sock")
+	cmd := exec.Command(idp.params.Command, idp.params.Args...)
+	cmd.Env = append(os.Environ(), pluginapi.SocketEnvVar+"="+path)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		idp.Close()
+		return errgo.Mask(err)
+	}
+	if err := cmd.Start(); err != nil {
+		stdin.Close()
+		idp.Close()
+		return errgo.Mask(err)
+	}
+	idp.cmd = cmd
+	idp.stdin = stdin
+
+	ctx, cancel := context.WithTimeout(ctx, idp.params.StartTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, path,
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", addr)
+		}),
+	)
+	if err != nil {
+		idp.Close()
+		return errgo.Notef(err, "cannot connect to plugin")
+	}
+	idp.conn = conn
+	idp.client = pluginapi.NewClient(conn)
+	return nil
+}
+
+// Close stops the plugin process. The plugin is asked to exit by
+// closing its standard input, if it has not exited after a short time
+// it is killed.
+func (idp *identityProvider) Close() error {
+	if idp.conn != nil {
+		idp.conn.Close()
+		idp.conn = nil
+	}
+	if idp.cmd != nil {
+		idp.stdin.Close()
+		done := make(chan struct{})
+		go func() {
+			idp.cmd.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			idp.cmd.Process.Kill()
+			<-done
+		}
+		idp.cmd = nil
+	}
+	if idp.dir != "" {
+		os.RemoveAll(idp.dir)
+		idp.dir = ""
+	}
+	return nil
+}
+
+// URL implements idp.IdentityProvider.URL.
+func (idp *identityProvider) URL(state string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := idp.client.URL(ctx, &pluginapi.URLRequest{State: state})
+	if err != nil {
+		logger.Errorf("cannot get URL from plugin %q: %s", idp.params.Name, err)
+	} else if resp.URL != "" {
+		return resp.URL
+	}
+	return idputil.RedirectURL(idp.initParams.URLPrefix, "/login", state)
+}
+
+// SetInteraction implements idp.IdentityProvider.SetInteraction.
+func (idp *identityProvider) SetInteraction(ierr *httpbakery.Error, dischargeID string) {
+}
+
+// GetGroups implements idp.IdentityProvider.GetGroups by asking the
+// plugin. If the plugin does not implement GetGroups then the groups
+// returned when the user logged in are used.
+func (idp *identityProvider) GetGroups(ctx context.Context, identity *store.Identity) ([]string, error) {
+	_, id := identity.ProviderID.Split()
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	resp, err := idp.client.GetGroups(ctx, &pluginapi.GetGroupsRequest{
+		ID:       id,
+		Username: identity.Username,
+		Groups:   identity.ProviderInfo["groups"],
+	})
+	if status.Code(err) == codes.Unimplemented {
+		groups := make([]string, len(identity.ProviderInfo["groups"]))
+		copy(groups, identity.ProviderInfo["groups"])
+		return groups, nil
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get groups from plugin %q", idp.params.Name)
+	}
+	return resp.Groups, nil
+}
+
+// Handle implements idp.IdentityProvider.Handle by forwarding the
+// request to the plugin.
+func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	hctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	resp, err := idp.client.Handle(hctx, &pluginapi.HandleRequest{
+		Method: req.Method,
+		Path:   strings.TrimPrefix(req.URL.Path, idp.initParams.URLPrefix),
+		Header: pluginHeader(req.Header),
+		Form:   req.Form,
+	})
+	if err != nil {
+		logging.FromContext(ctx, logger).Errorf("plugin %q cannot handle request: %s", idp.params.Name, err)
+		http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	if resp.Login != nil {
+		idp.completeLogin(ctx, w, req, resp.Login)
+		return
+	}
+	for k, v := range resp.Header {
+		w.Header()[http.CanonicalHeaderKey(k)] = v
+	}
+	if resp.StatusCode != 0 {
+		w.WriteHeader(resp.StatusCode)
+	}
+	w.Write(resp.Body)
+}
+
+// forwardedHeaders holds the request headers that are forwarded to a
+// plugin. Anything else, in particular headers holding credentials such
+// as Cookie, Authorization and Macaroons, is removed.
+var forwardedHeaders = []string{
+	"Accept",
+	"Accept-Language",
+	"Content-Type",
+	"Referer",
+	"User-Agent",
+}
+
+// pluginHeader returns the subset of h that is sent to a plugin.
+func pluginHeader(h http.Header) map[string][]string {
+	ph := make(map[string][]string)
+	for _, k := range forwardedHeaders {
+		if v, ok := h[k]; ok {
+			ph[k] = v
+		}
+	}
+	return ph
+}
+
+// completeLogin completes the current login attempt with the given
+// result from the plugin.
+func (idp *identityProvider) completeLogin(ctx context.Context, w http.ResponseWriter, req *http.Request, result *pluginapi.LoginResult) {
+	var ls idputil.LoginState
+	if err := idp.initParams.Codec.Cookie(req, idputil.LoginCookieName, req.Form.Get("state"), &ls); err != nil {
+		logging.FromContext(ctx, logger).Infof("Invalid login state: %s", err)
+		idputil.BadRequestf(w, "Login failed: invalid login state")
+		return
+	}
+	id, err := idp.updateIdentity(ctx, result)
+	if err != nil {
+		idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
+		return
+	}
+	idp.initParams.VisitCompleter.RedirectSuccess(ctx, w, req, ls.ReturnTo, ls.State, id)
+}
+
+// updateIdentity stores the identity returned by the plugin in a
+// successful login.
+func (idp *identityProvider) updateIdentity(ctx context.Context, result *pluginapi.LoginResult) (*store.Identity, error) {
+	if result.Identity == nil {
+		if result.Error == "" {
+			result.Error = "login failed"
+		}
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "%s", result.Error)
+	}
+	pid := result.Identity
+	if pid.ID == "" {
+		return nil, errgo.Newf("plugin returned identity with no id")
+	}
+	if !names.IsValidUserName(pid.Username) {
+		return nil, errgo.Newf("invalid username %q", pid.Username)
+	}
+	id := &store.Identity{
+		ProviderID: store.MakeProviderIdentity(idp.params.Name, pid.ID),
+		Username:   idputil.NameWithDomain(pid.Username, idp.params.Domain),
+		Name:       pid.Name,
+		Email:      pid.Email,
+		ProviderInfo: map[string][]string{
+			"groups": pid.Groups,
+		},
+	}
+	err := idp.initParams.Store.UpdateIdentity(ctx, id, store.Update{
+		store.Username:     store.Set,
+		store.Name:         store.Set,
+		store.Email:        store.Set,
+		store.ProviderInfo: store.Set,
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return id, nil
+}
+
+// jsonValue converts a value unmarshaled from YAML into one that can be
+// marshaled as JSON. YAML mappings are unmarshaled with interface{}
+// keys, which are converted to strings.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, v1 := range v {
+			m[fmt.Sprint(k)] = jsonValue(v1)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, v1 := range v {
+			s[i] = jsonValue(v1)
+		}
+		return s
+	}
+	return v
+}
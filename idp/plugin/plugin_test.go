@@ -0,0 +1,250 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package plugin_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v2"
+
+	"github.com/CanonicalLtd/candid/config"
+	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/idptest"
+	"github.com/CanonicalLtd/candid/idp/plugin"
+	"github.com/CanonicalLtd/candid/idp/plugin/pluginapi"
+	"github.com/CanonicalLtd/candid/internal/candidtest"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// testPluginEnvVar is set when the test binary is run as a plugin.
+const testPluginEnvVar = "CANDID_TEST_PLUGIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(testPluginEnvVar) != "" {
+		if err := pluginapi.Serve(&testPlugin{}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// testPlugin is a plugin that allows any user to log in with the
+// password configured in the plugin configuration.
+type testPlugin struct {
+	config struct {
+		Password string `json:"password"`
+	}
+}
+
+func (p *testPlugin) Init(_ context.Context, req *pluginapi.InitRequest) (*pluginapi.InitResponse, error) {
+	if err := json.Unmarshal(req.Config, &p.config); err != nil {
+		return nil, err
+	}
+	return &pluginapi.InitResponse{}, nil
+}
+
+func (p *testPlugin) URL(_ context.Context, req *pluginapi.URLRequest) (*pluginapi.URLResponse, error) {
+	return &pluginapi.URLResponse{}, nil
+}
+
+func (p *testPlugin) Handle(_ context.Context, req *pluginapi.HandleRequest) (*pluginapi.HandleResponse, error) {
+	if req.Method != "POST" {
+		// An empty first line causes candidtest.PostLoginForm
+		// to post back to the same URL.
+		return &pluginapi.HandleResponse{
+			Header: map[string][]string{"Content-Type": {"text/plain"}},
+			Body:   []byte("\n"),
+		}, nil
+	}
+	username := first(req.Form["username"])
+	if first(req.Form["password"]) != p.config.Password {
+		return &pluginapi.HandleResponse{
+			Login: &pluginapi.LoginResult{
+				Error: fmt.Sprintf("incorrect password for %s", username),
+			},
+		}, nil
+	}
+	return &pluginapi.HandleResponse{
+		Login: &pluginapi.LoginResult{
+			Identity: &pluginapi.Identity{
+				ID:       "id-" + username,
+				Username: username,
+				Name:     "Test User",
+				Email:    username + "@example.com",
+				Groups:   []string{"group1"},
+			},
+		},
+	}, nil
+}
+
+func (p *testPlugin) GetGroups(_ context.Context, req *pluginapi.GetGroupsRequest) (*pluginapi.GetGroupsResponse, error) {
+	if req.Username == "nogroups" {
+		return nil, status.Error(codes.Unimplemented, "not implemented")
+	}
+	return &pluginapi.GetGroupsResponse{
+		Groups: append(req.Groups, "group2"),
+	}, nil
+}
+
+func first(ss []string) string {
+	if len(ss) == 0 {
+		return ""
+	}
+	return ss[0]
+}
+
+const idpPrefix = "https://idp.example.com"
+
+type pluginSuite struct {
+	idptest *idptest.Fixture
+	idp     idp.IdentityProvider
+}
+
+func TestPlugin(t *testing.T) {
+	qtsuite.Run(qt.New(t), &pluginSuite{})
+}
+
+func (s *pluginSuite) Init(c *qt.C) {
+	c.Setenv(testPluginEnvVar, "1")
+	s.idptest = idptest.NewFixture(c, candidtest.NewStore())
+	s.idp = plugin.NewIdentityProvider(plugin.Params{
+		Name:    "test",
+		Domain:  "example",
+		Command: os.Args[0],
+		Config: map[interface{}]interface{}{
+			"password": "pass",
+		},
+	})
+	err := s.idp.Init(s.idptest.Ctx, s.idptest.InitParams(c, idpPrefix))
+	c.Assert(err, qt.Equals, nil)
+	c.Defer(func() {
+		s.idp.(interface{ Close() error }).Close()
+	})
+}
+
+func (s *pluginSuite) TestURL(c *qt.C) {
+	c.Assert(s.idp.URL("1"), qt.Equals, idpPrefix+"/login?state=1")
+}
+
+func (s *pluginSuite) TestLogin(c *qt.C) {
+	id, err := s.idptest.DoInteractiveLogin(c, s.idp, idpPrefix+"/login", candidtest.PostLoginForm("bob", "pass"))
+	c.Assert(err, qt.Equals, nil)
+	candidtest.AssertEqualIdentity(c, id, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "id-bob"),
+		Username:   "bob@example",
+		Name:       "Test User",
+		Email:      "bob@example.com",
+		ProviderInfo: map[string][]string{
+			"groups": {"group1"},
+		},
+	})
+	groups, err := s.idp.GetGroups(s.idptest.Ctx, id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups, qt.DeepEquals, []string{"group1", "group2"})
+}
+
+func (s *pluginSuite) TestLoginFailure(c *qt.C) {
+	id, err := s.idptest.DoInteractiveLogin(c, s.idp, idpPrefix+"/login", candidtest.PostLoginForm("bob", "wrong"))
+	c.Assert(err, qt.ErrorMatches, `incorrect password for bob`)
+	c.Assert(id, qt.IsNil)
+}
+
+func (s *pluginSuite) TestGetGroupsUnimplemented(c *qt.C) {
+	groups, err := s.idp.GetGroups(s.idptest.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "id-nogroups"),
+		Username:   "nogroups",
+		ProviderInfo: map[string][]string{
+			"groups": {"group1"},
+		},
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups, qt.DeepEquals, []string{"group1"})
+}
+
+func (s *pluginSuite) TestHandleResponse(c *qt.C) {
+	client := idptest.NewClient(s.idp, s.idptest.Codec)
+	resp, err := client.Get("/login")
+	c.Assert(err, qt.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("Content-Type"), qt.Equals, "text/plain")
+}
+
+func TestPluginHeaderRemovesCredentials(t *testing.T) {
+	c := qt.New(t)
+	h := http.Header{
+		"Accept":                  {"text/html"},
+		"User-Agent":              {"test"},
+		"Cookie":                  {"session=secret"},
+		"Authorization":           {"Bearer secret"},
+		"Macaroons":               {"secret"},
+		"Macaroons-Example":       {"secret"},
+		"X-Forwarded-For":         {"10.0.0.1"},
+		"Bakery-Protocol-Version": {"3"},
+	}
+	c.Assert(plugin.PluginHeader(h), qt.DeepEquals, map[string][]string{
+		"Accept":     {"text/html"},
+		"User-Agent": {"test"},
+	})
+}
+
+var configTests = []struct {
+	about       string
+	yaml        string
+	expectError string
+}{{
+	about: "good config",
+	yaml: `
+identity-providers:
+ - type: plugin
+   name: example
+   command: /usr/lib/candid/example-plugin
+   config:
+     server: https://example.com
+`,
+}, {
+	about: "no name",
+	yaml: `
+identity-providers:
+ - type: plugin
+   command: /usr/lib/candid/example-plugin
+`,
+	expectError: `cannot unmarshal plugin configuration: name not specified`,
+}, {
+	about: "no command",
+	yaml: `
+identity-providers:
+ - type: plugin
+   name: example
+`,
+	expectError: `cannot unmarshal plugin configuration: command not specified`,
+}}
+
+func TestConfig(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range configTests {
+		c.Run(test.about, func(c *qt.C) {
+			var conf config.Config
+			err := yaml.Unmarshal([]byte(test.yaml), &conf)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(conf.IdentityProviders, qt.HasLen, 1)
+			c.Assert(conf.IdentityProviders[0].Name(), qt.Equals, "example")
+		})
+	}
+}
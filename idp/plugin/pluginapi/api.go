@@ -0,0 +1,172 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package pluginapi defines the gRPC API between candid and identity
+// providers that run as separate plugin processes.
+//
+// A plugin is an executable that is started by candid. It must listen
+// for gRPC connections on the unix socket named by the
+// CANDID_PLUGIN_SOCKET environment variable and serve the
+// candid.plugin.IdentityProvider service. Messages are encoded as JSON
+// using the "json" content subtype, so plugins may be written in any
+// language with a gRPC implementation. Plugins written in Go can
+// implement Server and call Serve.
+//
+// A login proceeds as follows. The user is redirected to the URL
+// returned by the URL method. Every HTTP request to the plugin's
+// endpoints is forwarded to the Handle method, and the plugin returns
+// the HTTP response to send. When the plugin has authenticated the user,
+// or decided that the login has failed, it returns a HandleResponse
+// with Login set, and candid completes the login. The state passed to
+// URL must be included as the "state" form parameter of the request that
+// completes the login.
+package pluginapi
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// ServiceName is the full name of the gRPC service implemented by
+// plugins.
+const ServiceName = "candid.plugin.IdentityProvider"
+
+// Server is the interface implemented by identity provider plugins.
+type Server interface {
+	// Init is called once when candid starts, before any other
+	// method.
+	Init(ctx context.Context, req *InitRequest) (*InitResponse, error)
+
+	// URL returns the URL to which the user is sent to start a
+	// login.
+	URL(ctx context.Context, req *URLRequest) (*URLResponse, error)
+
+	// Handle handles an HTTP request made to the plugin's
+	// endpoints.
+	Handle(ctx context.Context, req *HandleRequest) (*HandleResponse, error)
+
+	// GetGroups returns the groups that an identity created by the
+	// plugin is a member of. A plugin that returns a gRPC
+	// Unimplemented error causes candid to use the groups that were
+	// returned when the user logged in.
+	GetGroups(ctx context.Context, req *GetGroupsRequest) (*GetGroupsResponse, error)
+}
+
+// InitRequest is the request sent to the Init method.
+type InitRequest struct {
+	// Config holds the plugin specific configuration from the
+	// candid configuration file.
+	Config json.RawMessage `json:"config,omitempty"`
+
+	// Location holds the root URL of the candid server.
+	Location string `json:"location"`
+
+	// URLPrefix holds the URL under which the plugin's endpoints are
+	// served. The paths in HandleRequests are relative to this.
+	URLPrefix string `json:"url-prefix"`
+}
+
+// InitResponse is the response from the Init method.
+type InitResponse struct{}
+
+// URLRequest is the request sent to the URL method.
+type URLRequest struct {
+	// State holds the state of the login attempt. It must be
+	// returned in the "state" form parameter of the request that
+	// completes the login.
+	State string `json:"state"`
+}
+
+// URLResponse is the response from the URL method.
+type URLResponse struct {
+	// URL holds the URL at which the login starts. If it is empty
+	// then the login starts at the "/login" endpoint of the plugin.
+	URL string `json:"url"`
+}
+
+// HandleRequest is the request sent to the Handle method. It holds an
+// HTTP request made by the user's browser.
+type HandleRequest struct {
+	// Method holds the HTTP method of the request.
+	Method string `json:"method"`
+
+	// Path holds the path of the request, relative to the plugin's
+	// URLPrefix.
+	Path string `json:"path"`
+
+	// Header holds the headers of the request. Only a fixed set of
+	// headers is forwarded; headers that may hold credentials, such
+	// as Cookie and Authorization, are never sent to the plugin.
+	Header map[string][]string `json:"header,omitempty"`
+
+	// Form holds the parsed query and form parameters of the
+	// request.
+	Form map[string][]string `json:"form,omitempty"`
+}
+
+// HandleResponse is the response from the Handle method.
+type HandleResponse struct {
+	// StatusCode holds the status code of the HTTP response. If it
+	// is zero then 200 is used.
+	StatusCode int `json:"status-code,omitempty"`
+
+	// Header holds the headers of the HTTP response.
+	Header map[string][]string `json:"header,omitempty"`
+
+	// Body holds the body of the HTTP response.
+	Body []byte `json:"body,omitempty"`
+
+	// Login, if set, completes the login attempt. The other fields
+	// are ignored.
+	Login *LoginResult `json:"login,omitempty"`
+}
+
+// LoginResult holds the result of a login attempt.
+type LoginResult struct {
+	// Identity holds the identity of the user that has logged in.
+	// If it is nil then the login has failed.
+	Identity *Identity `json:"identity,omitempty"`
+
+	// Error holds the reason that the login failed.
+	Error string `json:"error,omitempty"`
+}
+
+// Identity holds the details of a user authenticated by a plugin.
+type Identity struct {
+	// ID holds an identifier for the user that is unique within the
+	// plugin and never changes.
+	ID string `json:"id"`
+
+	// Username holds the username of the user. The domain of the
+	// identity provider, if any, is added by candid.
+	Username string `json:"username"`
+
+	// Name holds the full name of the user.
+	Name string `json:"name,omitempty"`
+
+	// Email holds the email address of the user.
+	Email string `json:"email,omitempty"`
+
+	// Groups holds the groups that the user is a member of.
+	Groups []string `json:"groups,omitempty"`
+}
+
+// GetGroupsRequest is the request sent to the GetGroups method.
+type GetGroupsRequest struct {
+	// ID holds the identifier of the user, as returned in
+	// Identity.ID.
+	ID string `json:"id"`
+
+	// Username holds the username of the user.
+	Username string `json:"username"`
+
+	// Groups holds the groups that were returned when the user last
+	// logged in.
+	Groups []string `json:"groups,omitempty"`
+}
+
+// GetGroupsResponse is the response from the GetGroups method.
+type GetGroupsResponse struct {
+	// Groups holds the groups that the user is a member of.
+	Groups []string `json:"groups"`
+}
@@ -0,0 +1,172 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package pluginapi
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	"gopkg.in/errgo.v1"
+)
+
+// SocketEnvVar is the environment variable that holds the path of the
+// unix socket on which a plugin must serve.
+const SocketEnvVar = "CANDID_PLUGIN_SOCKET"
+
+// CodecName is the gRPC content subtype used for all messages.
+const CodecName = "json"
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// jsonCodec is a gRPC codec that encodes messages as JSON.
+type jsonCodec struct{}
+
+// Marshal implements encoding.Codec.Marshal.
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal implements encoding.Codec.Unmarshal.
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// Name implements encoding.Codec.Name.
+func (jsonCodec) Name() string {
+	return CodecName
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*Server)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Init",
+		Handler: unaryHandler("Init", func() interface{} { return new(InitRequest) }, func(ctx context.Context, srv Server, req interface{}) (interface{}, error) {
+			return srv.Init(ctx, req.(*InitRequest))
+		}),
+	}, {
+		MethodName: "URL",
+		Handler: unaryHandler("URL", func() interface{} { return new(URLRequest) }, func(ctx context.Context, srv Server, req interface{}) (interface{}, error) {
+			return srv.URL(ctx, req.(*URLRequest))
+		}),
+	}, {
+		MethodName: "Handle",
+		Handler: unaryHandler("Handle", func() interface{} { return new(HandleRequest) }, func(ctx context.Context, srv Server, req interface{}) (interface{}, error) {
+			return srv.Handle(ctx, req.(*HandleRequest))
+		}),
+	}, {
+		MethodName: "GetGroups",
+		Handler: unaryHandler("GetGroups", func() interface{} { return new(GetGroupsRequest) }, func(ctx context.Context, srv Server, req interface{}) (interface{}, error) {
+			return srv.GetGroups(ctx, req.(*GetGroupsRequest))
+		}),
+	}},
+	Metadata: "candid/idp/plugin/pluginapi",
+}
+
+// unaryHandler creates a grpc.MethodDesc handler for the given method.
+// newReq returns a new request value to decode into, and call calls the
+// method on the server.
+func unaryHandler(method string, newReq func() interface{}, call func(context.Context, Server, interface{}) (interface{}, error)) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := newReq()
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return call(ctx, srv.(Server), req)
+		}
+		info := &grpc.UnaryServerInfo{
+			Server:     srv,
+			FullMethod: "/" + ServiceName + "/" + method,
+		}
+		return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return call(ctx, srv.(Server), req)
+		})
+	}
+}
+
+// RegisterServer registers the given plugin implementation with the
+// given gRPC server.
+func RegisterServer(s *grpc.Server, srv Server) {
+	s.RegisterService(&serviceDesc, srv)
+}
+
+// Serve serves the given plugin implementation on the socket given by
+// candid. It returns when candid closes the plugin's standard input,
+// which it does when it shuts down.
+func Serve(srv Server) error {
+	path := os.Getenv(SocketEnvVar)
+	if path == "" {
+		return errgo.Newf("%s not set, plugins must be started by candid", SocketEnvVar)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	s := grpc.NewServer()
+	RegisterServer(s, srv)
+	go func() {
+		io.Copy(ioutil.Discard, os.Stdin)
+		s.GracefulStop()
+	}()
+	return errgo.Mask(s.Serve(l))
+}
+
+// A Client is a client of a plugin.
+type Client struct {
+	conn *grpc.ClientConn
+}
+
+// NewClient creates a new Client that uses the given connection.
+func NewClient(conn *grpc.ClientConn) *Client {
+	return &Client{conn: conn}
+}
+
+// Init calls the plugin's Init method.
+func (c *Client) Init(ctx context.Context, req *InitRequest) (*InitResponse, error) {
+	var resp InitResponse
+	if err := c.invoke(ctx, "Init", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// URL calls the plugin's URL method.
+func (c *Client) URL(ctx context.Context, req *URLRequest) (*URLResponse, error) {
+	var resp URLResponse
+	if err := c.invoke(ctx, "URL", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Handle calls the plugin's Handle method.
+func (c *Client) Handle(ctx context.Context, req *HandleRequest) (*HandleResponse, error) {
+	var resp HandleResponse
+	if err := c.invoke(ctx, "Handle", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetGroups calls the plugin's GetGroups method.
+func (c *Client) GetGroups(ctx context.Context, req *GetGroupsRequest) (*GetGroupsResponse, error) {
+	var resp GetGroupsResponse
+	if err := c.invoke(ctx, "GetGroups", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) invoke(ctx context.Context, method string, req, resp interface{}) error {
+	return c.conn.Invoke(ctx, "/"+ServiceName+"/"+method, req, resp, grpc.CallContentSubtype(CodecName))
+}
@@ -2,21 +2,26 @@
 // Licensed under the AGPLv3, see LICENCE file for details.
 
 // Package static contains identity providers that validate against a static list of users.
-// This provider is only intended for testing purposes.
+// This provider is intended for testing and for small deployments where
+// the users can be listed in the configuration.
 package static
 
 import (
 	"context"
+	"crypto/subtle"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/juju/loggo"
+	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/CanonicalLtd/candidclient.v1/params"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 
 	"github.com/CanonicalLtd/candid/idp"
 	"github.com/CanonicalLtd/candid/idp/idputil"
+	"github.com/CanonicalLtd/candid/internal/logging"
 	"github.com/CanonicalLtd/candid/store"
 )
 
@@ -31,6 +36,9 @@ func init() {
 		if p.Name == "" {
 			p.Name = "static"
 		}
+		if err := p.validate(); err != nil {
+			return nil, errgo.Notef(err, "invalid static parameters")
+		}
 
 		return NewIdentityProvider(p), nil
 	})
@@ -63,12 +71,47 @@ type Params struct {
 type UserInfo struct {
 	// Password is the password for the user.
 	Password string `yaml:"password"`
+	// PasswordHash is a bcrypt hash of the password for the user. If
+	// this is set then Password must not be.
+	PasswordHash string `yaml:"password-hash"`
 	// Name is the full name of the user.
 	Name string `yaml:"name"`
 	// Email is the user e-mail.
 	Email string `yaml:"email"`
 	// Groups is the list of groups the user belongs to.
 	Groups []string `yaml:"groups"`
+	// Expires, if set, is the time after which the user can no
+	// longer log in.
+	Expires time.Time `yaml:"expires"`
+}
+
+// validate checks that the given parameters are consistent.
+func (p Params) validate() error {
+	for name, u := range p.Users {
+		if u.Password != "" && u.PasswordHash != "" {
+			return errgo.Newf("user %q has both password and password-hash", name)
+		}
+		if u.PasswordHash == "" {
+			continue
+		}
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return errgo.Notef(err, "invalid password-hash for user %q", name)
+		}
+	}
+	return nil
+}
+
+// checkPassword reports whether password is the password of the user.
+func (u UserInfo) checkPassword(password string) bool {
+	if u.PasswordHash != "" {
+		return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1
+}
+
+// expired reports whether the user has expired at the given time.
+func (u UserInfo) expired(now time.Time) bool {
+	return !u.Expires.IsZero() && !now.Before(u.Expires)
 }
 
 // NewIdentityProvider creates a new static identity provider.
@@ -134,7 +177,7 @@ func (idp *identityProvider) SetInteraction(ierr *httpbakery.Error, dischargeID
 func (idp *identityProvider) GetGroups(ctx context.Context, identity *store.Identity) ([]string, error) {
 	_, fulluser := identity.ProviderID.Split()
 	username := strings.SplitN(fulluser, "@", 2)[0]
-	if user, ok := idp.params.Users[username]; ok {
+	if user, ok := idp.params.Users[username]; ok && !user.expired(time.Now()) {
 		groups := make([]string, len(user.Groups))
 		copy(groups, user.Groups)
 		return groups, nil
@@ -146,7 +189,7 @@ func (idp *identityProvider) GetGroups(ctx context.Context, identity *store.Iden
 func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	var ls idputil.LoginState
 	if err := idp.initParams.Codec.Cookie(req, idputil.LoginCookieName, req.Form.Get("state"), &ls); err != nil {
-		logger.Infof("Invalid login state: %s", err)
+		logging.FromContext(ctx, logger).Infof("Invalid login state: %s", err)
 		idputil.BadRequestf(w, "Login failed: invalid login state")
 		return
 	}
@@ -159,7 +202,7 @@ func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter,
 			Name:        idp.params.Name,
 			URL:         idp.URL(req.Form.Get("state")),
 		}
-		id, err := idputil.HandleLoginForm(ctx, w, req, idpChoice, idp.initParams.Template, idp.loginUser)
+		id, err := idputil.HandleLoginForm(ctx, w, req, idpChoice, idp.initParams.Codec.CSRFToken(req.Form.Get("state")), idp.initParams.Template, idp.initParams.LoginChallenger, idp.initParams.LoginLocker, idp.loginUser)
 		if err != nil {
 			idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
 		}
@@ -171,7 +214,10 @@ func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter,
 
 func (idp *identityProvider) loginUser(ctx context.Context, user, password string) (*store.Identity, error) {
 	if userData, ok := idp.params.Users[user]; ok {
-		if userData.Password == password {
+		if userData.checkPassword(password) {
+			if userData.expired(time.Now()) {
+				return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "account %q has expired", user)
+			}
 			username := idputil.NameWithDomain(user, idp.params.Domain)
 			id := &store.Identity{
 				ProviderID: store.MakeProviderIdentity(idp.params.Name, username),
@@ -5,11 +5,17 @@ package static_test
 
 import (
 	"context"
+	"net/http"
+	"net/url"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/frankban/quicktest/qtsuite"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
 
+	"github.com/CanonicalLtd/candid/config"
 	"github.com/CanonicalLtd/candid/idp"
 	"github.com/CanonicalLtd/candid/idp/idptest"
 	"github.com/CanonicalLtd/candid/idp/static"
@@ -199,3 +205,124 @@ func (s *staticSuite) TestHandleFailedLoginUnknownUser(c *qt.C) {
 	_, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("unknown", "pass"))
 	c.Assert(err, qt.ErrorMatches, `authentication failed for user &#34;unknown&#34;`)
 }
+
+func (s *staticSuite) TestHandleFailedLoginWithoutCSRFToken(c *qt.C) {
+	i := s.setupIdp(c, getSampleParams())
+	_, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", func(client *http.Client, resp *http.Response) (*http.Response, error) {
+		defer resp.Body.Close()
+		purl, err := candidtest.LoginFormAction(resp)
+		c.Assert(err, qt.Equals, nil)
+		return client.PostForm(purl, url.Values{
+			"username": {"user1"},
+			"password": {"pass1"},
+		})
+	})
+	c.Assert(err, qt.ErrorMatches, `login form expired, please try again`)
+	s.idptest.AssertLoginNotComplete(c)
+}
+
+func (s *staticSuite) TestHandleWithPasswordHash(c *qt.C) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("pass2"), bcrypt.MinCost)
+	c.Assert(err, qt.Equals, nil)
+	params := getSampleParams()
+	params.Users["user2"] = static.UserInfo{
+		PasswordHash: string(hash),
+		Name:         "User Two",
+		Email:        "user2@example.com",
+	}
+	i := s.setupIdp(c, params)
+	id, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user2", "pass2"))
+	c.Assert(err, qt.Equals, nil)
+	candidtest.AssertEqualIdentity(c, id, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "user2"),
+		Username:   "user2",
+		Name:       "User Two",
+		Email:      "user2@example.com",
+	})
+
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user2", string(hash)))
+	c.Assert(err, qt.ErrorMatches, `authentication failed for user &#34;user2&#34;`)
+}
+
+func (s *staticSuite) TestExpiredUser(c *qt.C) {
+	params := getSampleParams()
+	u := params.Users["user1"]
+	u.Expires = time.Now().Add(-time.Minute)
+	params.Users["user1"] = u
+	i := s.setupIdp(c, params)
+	_, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "pass1"))
+	c.Assert(err, qt.ErrorMatches, `account &#34;user1&#34; has expired`)
+
+	groups, err := i.GetGroups(s.idptest.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "user1"),
+		Username:   "user1",
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups, qt.HasLen, 0)
+}
+
+func (s *staticSuite) TestNotYetExpiredUser(c *qt.C) {
+	params := getSampleParams()
+	u := params.Users["user1"]
+	u.Expires = time.Now().Add(time.Hour)
+	params.Users["user1"] = u
+	i := s.setupIdp(c, params)
+	id, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "pass1"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id.Username, qt.Equals, "user1")
+}
+
+var configTests = []struct {
+	about       string
+	yaml        string
+	expectError string
+}{{
+	about: "full user",
+	yaml: `
+identity-providers:
+ - type: static
+   users:
+     user1:
+       name: User One
+       email: user1@example.com
+       password-hash: $2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy
+       groups: [group1]
+       expires: 2030-01-01T00:00:00Z
+`,
+}, {
+	about: "password and hash",
+	yaml: `
+identity-providers:
+ - type: static
+   users:
+     user1:
+       password: pass1
+       password-hash: $2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy
+`,
+	expectError: `invalid static parameters: user "user1" has both password and password-hash`,
+}, {
+	about: "invalid hash",
+	yaml: `
+identity-providers:
+ - type: static
+   users:
+     user1:
+       password-hash: not-a-hash
+`,
+	expectError: `invalid static parameters: invalid password-hash for user "user1": .*`,
+}}
+
+func (s *staticSuite) TestConfig(c *qt.C) {
+	for _, test := range configTests {
+		c.Run(test.about, func(c *qt.C) {
+			var conf config.Config
+			err := yaml.Unmarshal([]byte(test.yaml), &conf)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(conf.IdentityProviders, qt.HasLen, 1)
+		})
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package usso
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/juju/usso/openid"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+)
+
+const (
+	// papeNamespace is the namespace of the OpenID Provider
+	// Authentication Policy Extension, see
+	// http://openid.net/specs/openid-provider-authentication-policy-extension-1_0.html.
+	papeNamespace = "http://specs.openid.net/extensions/pape/1.0"
+
+	// multiFactorPolicy is the PAPE policy that indicates the user
+	// authenticated using more than one factor.
+	multiFactorPolicy = "http://schemas.openid.net/pape/policies/2007/06/multi-factor"
+)
+
+// checkAccess checks that the user described by the given OpenID
+// response is allowed to log in. The form holds the parameters of the
+// OpenID response, which must already have been verified.
+func (idp *identityProvider) checkAccess(resp *openid.Response, form url.Values) error {
+	if idp.params.RequireMultiFactor && !contains(authPolicies(form), multiFactorPolicy) {
+		return errgo.WithCausef(nil, params.ErrForbidden, "two-factor authentication required")
+	}
+	for _, t := range idp.params.DeniedTeams {
+		if contains(resp.Teams, t) {
+			return errgo.WithCausef(nil, params.ErrForbidden, "user is a member of denied team %q", t)
+		}
+	}
+	if len(idp.params.AllowedTeams) == 0 {
+		return nil
+	}
+	for _, t := range idp.params.AllowedTeams {
+		if contains(resp.Teams, t) {
+			return nil
+		}
+	}
+	return errgo.WithCausef(nil, params.ErrForbidden, "user is not a member of an allowed team")
+}
+
+// authPolicies returns the PAPE authentication policies that the
+// OpenID provider reports were satisfied by the login. Policies are only
+// returned if they are covered by the signature of the response.
+func authPolicies(form url.Values) []string {
+	signed := make(map[string]bool)
+	for _, f := range strings.Split(form.Get("openid.signed"), ",") {
+		signed[f] = true
+	}
+	for k, v := range form {
+		if !strings.HasPrefix(k, "openid.ns.") || len(v) == 0 || v[0] != papeNamespace {
+			continue
+		}
+		alias := strings.TrimPrefix(k, "openid.ns.")
+		if !signed["ns."+alias] || !signed[alias+".auth_policies"] {
+			return nil
+		}
+		return strings.Fields(form.Get("openid." + alias + ".auth_policies"))
+	}
+	return nil
+}
+
+func contains(ss []string, s string) bool {
+	for _, s1 := range ss {
+		if s1 == s {
+			return true
+		}
+	}
+	return false
+}
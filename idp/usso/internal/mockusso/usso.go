@@ -22,6 +22,10 @@ type User struct {
 	Email    string
 	Groups   []string
 
+	// MultiFactor is set if the user logs in using two-factor
+	// authentication.
+	MultiFactor bool
+
 	// OAuth Credentials
 	ConsumerSecret string
 	TokenKey       string
@@ -87,6 +91,12 @@ func (h *Handler) Login(_ http.ResponseWriter, _ *http.Request, lr *openid2.Logi
 			Params: map[string]string{
 				"is_member": strings.Join(u.Groups, ","),
 			},
+		}, {
+			Namespace: "http://specs.openid.net/extensions/pape/1.0",
+			Prefix:    "pape",
+			Params: map[string]string{
+				"auth_policies": authPolicy(u),
+			},
 		}}
 	}
 	return &openid2.LoginResponse{
@@ -97,6 +107,15 @@ func (h *Handler) Login(_ http.ResponseWriter, _ *http.Request, lr *openid2.Logi
 	}, nil
 }
 
+// authPolicy returns the PAPE authentication policy that is reported
+// when the given user logs in.
+func authPolicy(u *User) string {
+	if u.MultiFactor {
+		return "http://schemas.openid.net/pape/policies/2007/06/multi-factor"
+	}
+	return "http://schemas.openid.net/pape/policies/2007/06/none"
+}
+
 // AddUser adds u to the handles user database.
 func (h *Handler) AddUser(u *User) {
 	h.users[u.ID] = u
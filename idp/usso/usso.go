@@ -8,6 +8,7 @@ package usso
 import (
 	"context"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -25,6 +26,7 @@ import (
 	"github.com/CanonicalLtd/candid/idp"
 	"github.com/CanonicalLtd/candid/idp/idputil"
 	"github.com/CanonicalLtd/candid/idp/usso/internal/kvnoncestore"
+	"github.com/CanonicalLtd/candid/internal/logging"
 	"github.com/CanonicalLtd/candid/store"
 )
 
@@ -52,6 +54,20 @@ type Params struct {
 
 	// Staging enables using the staging login and launchpad servers.
 	Staging bool
+
+	// AllowedTeams, if set, contains the launchpad teams that are
+	// allowed to log in. A user must be a member of at least one of
+	// the teams to log in.
+	AllowedTeams []string `yaml:"allowed-teams"`
+
+	// DeniedTeams contains launchpad teams that are not allowed to
+	// log in. A user that is a member of any of these teams cannot
+	// log in, even if they are also a member of an allowed team.
+	DeniedTeams []string `yaml:"denied-teams"`
+
+	// RequireMultiFactor requires that users authenticate to Ubuntu
+	// SSO using two-factor authentication.
+	RequireMultiFactor bool `yaml:"require-multi-factor"`
 }
 
 // NewIdentityProvider creates a new LDAP identity provider.
@@ -127,6 +143,16 @@ func (idp *identityProvider) URL(state string) string {
 	return idputil.RedirectURL(idp.initParams.URLPrefix, "/login", state)
 }
 
+// LogoutURL implements idp.LogoutRedirector.LogoutURL. Ubuntu SSO
+// does not return to the caller after logging out, so the given
+// returnTo address and state are not used.
+func (idp *identityProvider) LogoutURL(returnTo, state string) string {
+	if idp.params.Staging {
+		return "https://login.staging.ubuntu.com/+logout"
+	}
+	return "https://login.ubuntu.com/+logout"
+}
+
 // SetInteraction sets the interaction information for
 func (idp *identityProvider) SetInteraction(ierr *httpbakery.Error, dischargeID string) {
 }
@@ -145,19 +171,76 @@ func (idp *identityProvider) login(ctx context.Context, w http.ResponseWriter, r
 	query := "?state=" + idputil.State(req)
 	realm := idp.initParams.URLPrefix + "/callback"
 	callback := realm + query
-	url := idp.client.RedirectURL(&openid.Request{
+	redirectURL := idp.client.RedirectURL(&openid.Request{
 		ReturnTo:     callback,
 		Realm:        realm,
-		Teams:        idp.params.LaunchpadTeams,
+		Teams:        idp.queryTeams(),
 		SRegRequired: []string{openid.SRegEmail, openid.SRegFullName, openid.SRegNickname},
 	})
-	http.Redirect(w, req, url, http.StatusFound)
+	if idp.params.RequireMultiFactor {
+		redirectURL = requestMultiFactor(redirectURL)
+	}
+	var ls idputil.LoginState
+	if err := idp.initParams.Codec.Cookie(req, idputil.LoginCookieName, idputil.State(req), &ls); err == nil && ls.AuthLevel == idputil.AuthLevelStrong {
+		// An invalid login state is reported when the login
+		// completes.
+		redirectURL = requestStepUp(redirectURL)
+	}
+	http.Redirect(w, req, redirectURL, http.StatusFound)
+}
+
+// queryTeams returns the launchpad teams for which membership is
+// queried when logging in. This includes the private teams that are
+// configured and any teams used to restrict access.
+func (idp *identityProvider) queryTeams() []string {
+	var teams []string
+	seen := make(map[string]bool)
+	for _, tl := range [][]string{idp.params.LaunchpadTeams, idp.params.AllowedTeams, idp.params.DeniedTeams} {
+		for _, t := range tl {
+			if seen[t] {
+				continue
+			}
+			seen[t] = true
+			teams = append(teams, t)
+		}
+	}
+	return teams
+}
+
+// requestMultiFactor adds a PAPE request for multi-factor
+// authentication to the given OpenID redirect URL.
+func requestMultiFactor(redirectURL string) string {
+	u, err := url.Parse(redirectURL)
+	if err != nil {
+		// This should be impossible as the URL was created
+		// by the openid client.
+		return redirectURL
+	}
+	q := u.Query()
+	q.Set("openid.ns.pape", papeNamespace)
+	q.Set("openid.pape.preferred_auth_policies", multiFactorPolicy)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// requestStepUp adds a PAPE request to the given OpenID redirect URL
+// for the user to authenticate again, using multiple factors, even if
+// they are already logged in to Ubuntu SSO.
+func requestStepUp(redirectURL string) string {
+	u, err := url.Parse(requestMultiFactor(redirectURL))
+	if err != nil {
+		return redirectURL
+	}
+	q := u.Query()
+	q.Set("openid.pape.max_auth_age", "0")
+	u.RawQuery = q.Encode()
+	return u.String()
 }
 
 func (idp *identityProvider) callback(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	var ls idputil.LoginState
 	if err := idp.initParams.Codec.Cookie(req, idputil.LoginCookieName, req.Form.Get("state"), &ls); err != nil {
-		logger.Infof("Invalid login state: %s", err)
+		logging.FromContext(ctx, logger).Infof("Invalid login state: %s", err)
 		idputil.BadRequestf(w, "Login failed: invalid login state")
 		return
 	}
@@ -169,6 +252,10 @@ func (idp *identityProvider) callback(ctx context.Context, w http.ResponseWriter
 		idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
 	}
 
+	if req.Form.Get("openid.mode") == "cancel" {
+		errorf(errgo.WithCausef(nil, idputil.ErrLoginCancelled, "login cancelled by user"))
+		return
+	}
 	resp, err := idp.client.Verify(idp.initParams.URLPrefix + req.URL.String())
 	if err != nil {
 		errorf(err)
@@ -180,6 +267,11 @@ func (idp *identityProvider) callback(ctx context.Context, w http.ResponseWriter
 		resp.Teams = nil
 	}
 
+	if err := idp.checkAccess(resp, req.Form); err != nil {
+		errorf(err)
+		return
+	}
+
 	username := resp.SReg[openid.SRegNickname]
 	identity := store.Identity{
 		ProviderID: store.MakeProviderIdentity("usso", resp.ID),
@@ -187,7 +279,8 @@ func (idp *identityProvider) callback(ctx context.Context, w http.ResponseWriter
 		Email:      resp.SReg[openid.SRegEmail],
 		Name:       resp.SReg[openid.SRegFullName],
 		ProviderInfo: map[string][]string{
-			"groups": resp.Teams,
+			"groups":                resp.Teams,
+			idputil.MFAProviderInfo: idputil.MFAInfo(contains(authPolicies(req.Form), multiFactorPolicy)),
 		},
 	}
 	switch {
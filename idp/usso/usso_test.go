@@ -101,6 +101,10 @@ func (s *ussoSuite) TestHidden(c *qt.C) {
 	c.Assert(s.idp.Hidden(), qt.Equals, false)
 }
 
+func (s *ussoSuite) TestLogoutURL(c *qt.C) {
+	c.Assert(s.idp.(idp.LogoutRedirector).LogoutURL("http://idp.example.com/logout-complete", "state"), qt.Equals, "https://login.ubuntu.com/+logout")
+}
+
 func (s *ussoSuite) TestURL(c *qt.C) {
 	c.Assert(s.idp.URL("1"), qt.Equals, "http://idp.example.com/login?state=1")
 }
@@ -420,3 +424,89 @@ func (s *ussoSuite) TestWithDomain(c *qt.C) {
 		Email:      "test@example.com",
 	})
 }
+
+func (s *ussoSuite) TestRedirectWithMultiFactor(c *qt.C) {
+	s.idp = usso.NewIdentityProvider(usso.Params{
+		AllowedTeams:       []string{"team1"},
+		DeniedTeams:        []string{"team2"},
+		RequireMultiFactor: true,
+	})
+	err := s.idp.Init(s.idptest.Ctx, s.idptest.InitParams(c, idpPrefix))
+	c.Assert(err, qt.Equals, nil)
+
+	u := s.getRedirectURL(c, "/login")
+	q := u.Query()
+	c.Assert(q.Get("openid.lp.query_membership"), qt.Equals, "team1,team2")
+	c.Assert(q.Get("openid.ns.pape"), qt.Equals, "http://specs.openid.net/extensions/pape/1.0")
+	c.Assert(q.Get("openid.pape.preferred_auth_policies"), qt.Equals, "http://schemas.openid.net/pape/policies/2007/06/multi-factor")
+}
+
+var accessTests = []struct {
+	about       string
+	params      usso.Params
+	user        mockusso.User
+	expectError string
+	expectMFA   []string
+}{{
+	about:  "allowed team",
+	params: usso.Params{AllowedTeams: []string{"team1", "team2"}},
+	user:   mockusso.User{Groups: []string{"team2"}},
+}, {
+	about:       "not in allowed team",
+	params:      usso.Params{AllowedTeams: []string{"team1", "team2"}},
+	user:        mockusso.User{Groups: []string{"team3"}},
+	expectError: `user is not a member of an allowed team`,
+}, {
+	about:       "denied team",
+	params:      usso.Params{AllowedTeams: []string{"team1"}, DeniedTeams: []string{"team2"}},
+	user:        mockusso.User{Groups: []string{"team1", "team2"}},
+	expectError: `user is a member of denied team "team2"`,
+}, {
+	about:  "not in denied team",
+	params: usso.Params{DeniedTeams: []string{"team2"}},
+	user:   mockusso.User{Groups: []string{"team1"}},
+}, {
+	about:     "multi-factor",
+	params:    usso.Params{RequireMultiFactor: true},
+	user:      mockusso.User{MultiFactor: true},
+	expectMFA: []string{"true"},
+}, {
+	about:     "multi-factor not required",
+	user:      mockusso.User{MultiFactor: true},
+	expectMFA: []string{"true"},
+}, {
+	about:       "no multi-factor",
+	params:      usso.Params{RequireMultiFactor: true},
+	user:        mockusso.User{},
+	expectError: `two-factor authentication required`,
+}}
+
+func (s *ussoSuite) TestAccess(c *qt.C) {
+	ussoSrv := mockusso.NewServer()
+	defer ussoSrv.Close()
+	for _, test := range accessTests {
+		c.Run(test.about, func(c *qt.C) {
+			ussoSrv.MockUSSO.Reset()
+			u := test.user
+			u.ID = "test"
+			u.NickName = "test"
+			u.FullName = "Test User"
+			u.Email = "test@example.com"
+			ussoSrv.MockUSSO.AddUser(&u)
+			ussoSrv.MockUSSO.SetLoginUser("test")
+
+			idp := usso.NewIdentityProvider(test.params)
+			err := idp.Init(s.idptest.Ctx, s.idptest.InitParams(c, idpPrefix))
+			c.Assert(err, qt.Equals, nil)
+			id, err := s.idptest.DoInteractiveLogin(c, idp, idpPrefix+"/login", nil)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				c.Assert(id, qt.IsNil)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(id.Username, qt.Equals, "test")
+			c.Assert(id.ProviderInfo["mfa"], qt.DeepEquals, test.expectMFA)
+		})
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package x509 is an identity provider that authenticates machine
+// clients using TLS client certificates issued by trusted certificate
+// authorities.
+package x509
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/idputil"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// InteractionMethod is the name of the interaction method used by the
+// x509 identity provider.
+const InteractionMethod = "x509"
+
+func init() {
+	idp.Register("x509", func(unmarshal func(interface{}) error) (idp.IdentityProvider, error) {
+		var p Params
+		if err := unmarshal(&p); err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal x509 parameters")
+		}
+		if p.Name == "" {
+			p.Name = "x509"
+		}
+		i, err := NewIdentityProvider(p)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid x509 parameters")
+		}
+		return i, nil
+	})
+}
+
+// Params holds the parameters to use with x509 identity providers.
+type Params struct {
+	// Name is the name that will be given to the identity provider.
+	Name string `yaml:"name"`
+
+	// Description is the description of the IDP shown to the user on
+	// the IDP selection page.
+	Description string `yaml:"description"`
+
+	// Icon contains the URL or path of an icon.
+	Icon string `yaml:"icon"`
+
+	// Domain is the domain with which all identities created by this
+	// identity provider will be tagged (not including the @ separator).
+	Domain string `yaml:"domain"`
+
+	// Hidden is set if the IDP should be hidden from interactive
+	// prompts.
+	Hidden bool `yaml:"hidden"`
+
+	// CACerts holds the PEM encoded certificates of the certificate
+	// authorities that are trusted to issue client certificates.
+	CACerts string `yaml:"ca-certs"`
+
+	// UsernameField holds the field of the client certificate that
+	// is used as the username, one of "common-name" (the default),
+	// "dns-name" or "email". The first subject alternative name of
+	// the chosen type is used.
+	UsernameField string `yaml:"username-field"`
+
+	// OrganizationalUnitGroups holds whether the organizational
+	// units in the certificate subject are used as the groups of
+	// the identity.
+	OrganizationalUnitGroups bool `yaml:"organizational-unit-groups"`
+
+	// CertificateHeader, if set, holds the name of an HTTP header in
+	// which a TLS terminating proxy passes the URL escaped PEM
+	// encoded client certificate, for example the $ssl_client_escaped_cert
+	// variable in nginx. The proxy must remove the header from
+	// requests that it receives.
+	CertificateHeader string `yaml:"certificate-header"`
+}
+
+// NewIdentityProvider creates a new x509 identity provider with the
+// given parameters.
+func NewIdentityProvider(p Params) (idp.IdentityProvider, error) {
+	if p.Description == "" {
+		p.Description = p.Name
+	}
+	switch p.UsernameField {
+	case "":
+		p.UsernameField = "common-name"
+	case "common-name", "dns-name", "email":
+	default:
+		return nil, errgo.Newf("invalid username-field %q", p.UsernameField)
+	}
+	if p.CACerts == "" {
+		return nil, errgo.Newf("ca-certs not specified")
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(p.CACerts)) {
+		return nil, errgo.Newf("no certificates found in ca-certs")
+	}
+	return &identityProvider{
+		params: p,
+		roots:  roots,
+	}, nil
+}
+
+// identityProvider is an idp.IdentityProvider that authenticates
+// clients using TLS client certificates.
+type identityProvider struct {
+	params     Params
+	initParams idp.InitParams
+	roots      *x509.CertPool
+}
+
+// Name implements idp.IdentityProvider.Name.
+func (idp *identityProvider) Name() string {
+	return idp.params.Name
+}
+
+// Domain implements idp.IdentityProvider.Domain.
+func (idp *identityProvider) Domain() string {
+	return idp.params.Domain
+}
+
+// Description implements idp.IdentityProvider.Description.
+func (idp *identityProvider) Description() string {
+	return idp.params.Description
+}
+
+// IconURL returns the URL of an icon for the identity provider.
+func (idp *identityProvider) IconURL() string {
+	return idputil.ServiceURL(idp.initParams.Location, idp.params.Icon)
+}
+
+// Interactive implements idp.IdentityProvider.Interactive.
+func (*identityProvider) Interactive() bool {
+	return false
+}
+
+// Hidden implements idp.IdentityProvider.Hidden.
+func (idp *identityProvider) Hidden() bool {
+	return idp.params.Hidden
+}
+
+// Init implements idp.IdentityProvider.Init.
+func (idp *identityProvider) Init(_ context.Context, params idp.InitParams) error {
+	idp.initParams = params
+	return nil
+}
+
+// URL implements idp.IdentityProvider.URL.
+func (idp *identityProvider) URL(state string) string {
+	return idputil.RedirectURL(idp.initParams.URLPrefix, "/login", state)
+}
+
+// SetInteraction implements idp.IdentityProvider.SetInteraction.
+func (idp *identityProvider) SetInteraction(ierr *httpbakery.Error, dischargeID string) {
+	ierr.SetInteraction(InteractionMethod, InteractionInfo{
+		URL: idputil.URL(idp.initParams.URLPrefix, "/interact", dischargeID),
+	})
+}
+
+// RequestClientCertificate implements
+// idp.ClientCertificateAuthenticator.RequestClientCertificate.
+func (*identityProvider) RequestClientCertificate() bool {
+	return true
+}
+
+// GetGroups implements idp.IdentityProvider.GetGroups.
+func (*identityProvider) GetGroups(_ context.Context, identity *store.Identity) ([]string, error) {
+	return identity.ProviderInfo["groups"], nil
+}
+
+// Handle implements idp.IdentityProvider.Handle.
+func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	user, err := idp.login(ctx, req)
+	if err != nil {
+		idp.initParams.VisitCompleter.Failure(ctx, w, req, idputil.DischargeID(req), err)
+		return
+	}
+	if strings.TrimPrefix(req.URL.Path, idp.initParams.URLPrefix) == "/interact" {
+		dt, err := idp.initParams.DischargeTokenCreator.DischargeToken(ctx, user)
+		if err != nil {
+			idp.initParams.VisitCompleter.Failure(ctx, w, req, idputil.DischargeID(req), err)
+			return
+		}
+		httprequest.WriteJSON(w, http.StatusOK, LoginResponse{
+			DischargeToken: dt,
+		})
+	} else {
+		idp.initParams.VisitCompleter.Success(ctx, w, req, idputil.DischargeID(req), user)
+	}
+}
+
+// login verifies the client certificate presented with the given
+// request and updates the identity it maps to.
+func (idp *identityProvider) login(ctx context.Context, req *http.Request) (*store.Identity, error) {
+	certs, err := idp.clientCertificates(req)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         idp.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return nil, errgo.WithCausef(err, params.ErrUnauthorized, "invalid client certificate")
+	}
+	name := idp.username(certs[0])
+	if name == "" {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "client certificate has no %s", idp.params.UsernameField)
+	}
+	var groups []string
+	if idp.params.OrganizationalUnitGroups {
+		for _, ou := range certs[0].Subject.OrganizationalUnit {
+			groups = append(groups, idp.qualifiedName(ou))
+		}
+	}
+	var email string
+	if len(certs[0].EmailAddresses) > 0 {
+		email = certs[0].EmailAddresses[0]
+	}
+	user := &store.Identity{
+		ProviderID: store.MakeProviderIdentity(idp.Name(), name),
+		Username:   idp.qualifiedName(name),
+		Email:      email,
+		ProviderInfo: map[string][]string{
+			"groups": groups,
+		},
+	}
+	if err := idp.initParams.Store.UpdateIdentity(
+		ctx,
+		user,
+		store.Update{
+			store.Username:     store.Set,
+			store.Email:        store.Set,
+			store.ProviderInfo: store.Set,
+		},
+	); err != nil {
+		return nil, errgo.Notef(err, "cannot update identity")
+	}
+	return user, nil
+}
+
+// clientCertificates returns the certificate chain presented by the
+// client, leaf first.
+func (idp *identityProvider) clientCertificates(req *http.Request) ([]*x509.Certificate, error) {
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		return req.TLS.PeerCertificates, nil
+	}
+	if idp.params.CertificateHeader == "" {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "no client certificate")
+	}
+	h := req.Header.Get(idp.params.CertificateHeader)
+	if h == "" {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "no client certificate")
+	}
+	data, err := url.QueryUnescape(h)
+	if err != nil {
+		return nil, errgo.WithCausef(err, params.ErrUnauthorized, "invalid client certificate")
+	}
+	var certs []*x509.Certificate
+	rest := []byte(data)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errgo.WithCausef(err, params.ErrUnauthorized, "invalid client certificate")
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "invalid client certificate")
+	}
+	return certs, nil
+}
+
+// username returns the name of the identity that authenticates with the
+// given certificate, or "" if the certificate does not contain the
+// configured field.
+func (idp *identityProvider) username(cert *x509.Certificate) string {
+	switch idp.params.UsernameField {
+	case "dns-name":
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+	return ""
+}
+
+// qualifiedName returns the given name qualified as appropriate with
+// the provider's configured domain.
+func (idp *identityProvider) qualifiedName(name string) string {
+	if idp.params.Domain != "" {
+		return name + "@" + idp.params.Domain
+	}
+	return name
+}
+
+// InteractionInfo is the interaction info for the x509 interaction
+// method. To log in the client makes a POST request to URL over a TLS
+// connection that presents its client certificate.
+type InteractionInfo struct {
+	URL string `json:"url"`
+}
+
+// LoginResponse is the response sent for a successful login.
+type LoginResponse struct {
+	DischargeToken *httpbakery.DischargeToken `json:"discharge-token"`
+}
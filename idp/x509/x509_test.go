@@ -0,0 +1,268 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package x509_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+	"gopkg.in/yaml.v2"
+
+	"github.com/CanonicalLtd/candid/config"
+	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/idptest"
+	x509idp "github.com/CanonicalLtd/candid/idp/x509"
+	"github.com/CanonicalLtd/candid/internal/candidtest"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+const idpPrefix = "https://idp.example.com"
+
+type x509Suite struct {
+	idptest *idptest.Fixture
+	ca      *testCA
+}
+
+func TestX509(t *testing.T) {
+	qtsuite.Run(qt.New(t), &x509Suite{})
+}
+
+func (s *x509Suite) Init(c *qt.C) {
+	s.idptest = idptest.NewFixture(c, candidtest.NewStore())
+	s.ca = newTestCA(c)
+}
+
+func (s *x509Suite) setupIdp(c *qt.C, params x509idp.Params) idp.IdentityProvider {
+	if params.CACerts == "" {
+		params.CACerts = s.ca.pem
+	}
+	i, err := x509idp.NewIdentityProvider(params)
+	c.Assert(err, qt.Equals, nil)
+	err = i.Init(context.Background(), s.idptest.InitParams(c, idpPrefix))
+	c.Assert(err, qt.Equals, nil)
+	return i
+}
+
+func (s *x509Suite) TestInteractive(c *qt.C) {
+	i := s.setupIdp(c, x509idp.Params{Name: "test"})
+	c.Assert(i.Interactive(), qt.Equals, false)
+	c.Assert(i.Description(), qt.Equals, "test")
+}
+
+func (s *x509Suite) TestSetInteraction(c *qt.C) {
+	i := s.setupIdp(c, x509idp.Params{Name: "test"})
+	ierr := httpbakery.NewInteractionRequiredError(nil, s.request(c, "/discharge"))
+	i.SetInteraction(ierr, "1")
+	var info x509idp.InteractionInfo
+	err := ierr.InteractionMethod(x509idp.InteractionMethod, &info)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(info.URL, qt.Equals, idpPrefix+"/interact?id=1")
+}
+
+func (s *x509Suite) TestLogin(c *qt.C) {
+	i := s.setupIdp(c, x509idp.Params{
+		Name:                     "test",
+		Domain:                   "machines",
+		OrganizationalUnitGroups: true,
+	})
+	cert := s.ca.issue(c, &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         "build-1",
+			OrganizationalUnit: []string{"ci"},
+		},
+		EmailAddresses: []string{"build-1@example.com"},
+	})
+	req := s.request(c, "/login")
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), req)
+	s.idptest.AssertLoginSuccess(c, "build-1@machines")
+	s.idptest.Store.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "build-1"),
+		Username:   "build-1@machines",
+		Email:      "build-1@example.com",
+		ProviderInfo: map[string][]string{
+			"groups": {"ci@machines"},
+		},
+	})
+}
+
+func (s *x509Suite) TestInteract(c *qt.C) {
+	i := s.setupIdp(c, x509idp.Params{
+		Name:          "test",
+		UsernameField: "dns-name",
+	})
+	cert := s.ca.issue(c, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "ignored"},
+		DNSNames: []string{"host.example.com"},
+	})
+	req := s.request(c, "/interact")
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	rr := httptest.NewRecorder()
+	i.Handle(s.idptest.Ctx, rr, req)
+	c.Assert(rr.Code, qt.Equals, http.StatusOK)
+	var resp x509idp.LoginResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &resp)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(resp.DischargeToken, qt.Not(qt.IsNil))
+	s.idptest.Store.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "host.example.com"),
+		Username:   "host.example.com",
+	})
+}
+
+func (s *x509Suite) TestLoginWithCertificateHeader(c *qt.C) {
+	i := s.setupIdp(c, x509idp.Params{
+		Name:              "test",
+		CertificateHeader: "X-Client-Cert",
+	})
+	cert := s.ca.issue(c, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "build-2"},
+	})
+	req := s.request(c, "/login")
+	req.Header.Set("X-Client-Cert", url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert.Raw,
+	}))))
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), req)
+	s.idptest.AssertLoginSuccess(c, "build-2")
+}
+
+func (s *x509Suite) TestLoginNoCertificate(c *qt.C) {
+	i := s.setupIdp(c, x509idp.Params{Name: "test"})
+	req := s.request(c, "/login")
+	req.Header.Set("X-Client-Cert", "ignored")
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), req)
+	s.idptest.AssertLoginFailureMatches(c, `no client certificate`)
+}
+
+func (s *x509Suite) TestLoginUntrustedCertificate(c *qt.C) {
+	i := s.setupIdp(c, x509idp.Params{Name: "test"})
+	cert := newTestCA(c).issue(c, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "build-1"},
+	})
+	req := s.request(c, "/login")
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), req)
+	s.idptest.AssertLoginFailureMatches(c, `invalid client certificate: x509: certificate signed by unknown authority.*`)
+}
+
+func (s *x509Suite) TestLoginMissingUsernameField(c *qt.C) {
+	i := s.setupIdp(c, x509idp.Params{
+		Name:          "test",
+		UsernameField: "email",
+	})
+	cert := s.ca.issue(c, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "build-1"},
+	})
+	req := s.request(c, "/login")
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	i.Handle(s.idptest.Ctx, httptest.NewRecorder(), req)
+	s.idptest.AssertLoginFailureMatches(c, `client certificate has no email`)
+}
+
+func (s *x509Suite) TestRegisterConfig(c *qt.C) {
+	input := `
+identity-providers:
+ - type: x509
+   name: machines
+   ca-certs: |
+` + indent(s.ca.pem, "     ")
+	var conf config.Config
+	err := yaml.Unmarshal([]byte(input), &conf)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(conf.IdentityProviders, qt.HasLen, 1)
+	c.Assert(conf.IdentityProviders[0].Name(), qt.Equals, "machines")
+}
+
+func (s *x509Suite) TestRegisterConfigInvalidUsernameField(c *qt.C) {
+	input := `
+identity-providers:
+ - type: x509
+   username-field: uri
+   ca-certs: |
+` + indent(s.ca.pem, "     ")
+	var conf config.Config
+	err := yaml.Unmarshal([]byte(input), &conf)
+	c.Assert(err, qt.ErrorMatches, `cannot unmarshal x509 configuration: invalid x509 parameters: invalid username-field "uri"`)
+}
+
+func (s *x509Suite) request(c *qt.C, path string) *http.Request {
+	req, err := http.NewRequest("POST", idpPrefix+path+"?id=1", nil)
+	c.Assert(err, qt.Equals, nil)
+	req.ParseForm()
+	return req
+}
+
+// testCA is a certificate authority used to issue test client
+// certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  string
+}
+
+func newTestCA(c *qt.C) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, qt.Equals, nil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, qt.Equals, nil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, qt.Equals, nil)
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+	}
+}
+
+// issue issues a client certificate with the subject and subject
+// alternative names in the given template.
+func (ca *testCA) issue(c *qt.C, template *x509.Certificate) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, qt.Equals, nil)
+	template.SerialNumber = big.NewInt(2)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	c.Assert(err, qt.Equals, nil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, qt.Equals, nil)
+	return cert
+}
+
+func indent(s, prefix string) string {
+	var out string
+	for _, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+		out += prefix + line + "\n"
+	}
+	return out
+}
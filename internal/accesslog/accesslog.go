@@ -0,0 +1,381 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package accesslog provides an HTTP handler that writes a JSON access
+// log. Each request is logged as a single line holding its method,
+// address, route, status, size and latency, along with the user that
+// made it, once that is known. Credentials such as tokens, macaroons
+// and passwords are redacted from the logged URLs and bodies.
+package accesslog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CanonicalLtd/candid/internal/clientip"
+)
+
+// Redacted is the value that replaces redacted credentials.
+const Redacted = "REDACTED"
+
+// maxBodySize is the maximum number of bytes of a request body that
+// are logged.
+const maxBodySize = 4096
+
+// sensitiveNames holds the substrings of the names of query parameters,
+// form fields and JSON members whose values are redacted.
+var sensitiveNames = []string{
+	"token",
+	"password",
+	"secret",
+	"macaroon",
+	"code",
+	"verifier",
+}
+
+// Params holds the parameters of an access log handler.
+type Params struct {
+	// RequestIDHeader holds the name of the response header that
+	// holds the ID of the request. If it is empty "X-Request-Id" is
+	// used.
+	RequestIDHeader string
+
+	// ClientIP determines the address of the client that made a
+	// request. If it is nil the address of the peer is used.
+	ClientIP *clientip.Resolver
+
+	// Routes configures how groups of routes are logged. Routes
+	// that are not in any group are logged with redaction and
+	// without bodies.
+	Routes []RouteParams
+}
+
+// RouteParams configures how a group of routes is logged.
+type RouteParams struct {
+	// Prefix holds the path prefix of the routes in the group. If
+	// a path matches more than one group the group with the longest
+	// prefix is used.
+	Prefix string
+
+	// Disable, if true, prevents requests to the routes from being
+	// logged.
+	Disable bool
+
+	// DisableRedaction, if true, logs the URLs and bodies of
+	// requests to the routes without redacting credentials.
+	DisableRedaction bool
+
+	// Bodies, if true, logs the bodies of requests to the routes.
+	// Only JSON and form bodies are logged.
+	Bodies bool
+}
+
+// An Entry is a line in the access log.
+type Entry struct {
+	Time       time.Time        `json:"time"`
+	RequestID  string           `json:"request-id,omitempty"`
+	RemoteAddr string           `json:"remote-addr,omitempty"`
+	Method     string           `json:"method"`
+	URL        string           `json:"url"`
+	Route      string           `json:"route,omitempty"`
+	Status     int              `json:"status"`
+	Size       int64            `json:"size"`
+	Duration   float64          `json:"duration"`
+	User       string           `json:"user,omitempty"`
+	UserAgent  string           `json:"user-agent,omitempty"`
+	Referer    string           `json:"referer,omitempty"`
+	Body       *json.RawMessage `json:"body,omitempty"`
+}
+
+// NewHandler returns a handler that serves requests with h and writes
+// an Entry for each request to w.
+func NewHandler(w io.Writer, h http.Handler, p Params) http.Handler {
+	if p.RequestIDHeader == "" {
+		p.RequestIDHeader = "X-Request-Id"
+	}
+	return &handler{
+		p:       p,
+		handler: h,
+		w:       w,
+	}
+}
+
+type handler struct {
+	p       Params
+	handler http.Handler
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// ServeHTTP implements http.Handler.
+func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rp := h.routeParams(req.URL.Path)
+	if rp.Disable {
+		h.handler.ServeHTTP(w, req)
+		return
+	}
+	start := time.Now()
+	redact := !rp.DisableRedaction
+	var body *bodyRecorder
+	if rp.Bodies && req.Body != nil {
+		body = &bodyRecorder{ReadCloser: req.Body}
+		req.Body = body
+	}
+	e := &entry{}
+	req = req.WithContext(context.WithValue(req.Context(), entryKey{}, e))
+	rw := &responseWriter{ResponseWriter: w}
+	h.handler.ServeHTTP(rw, req)
+
+	e.mu.Lock()
+	le := Entry{
+		Time:       start.UTC(),
+		RequestID:  rw.Header().Get(h.p.RequestIDHeader),
+		RemoteAddr: h.p.ClientIP.Address(req),
+		Method:     req.Method,
+		URL:        redactURL(req.URL.RequestURI(), redact),
+		Route:      e.route,
+		Status:     rw.status(),
+		Size:       rw.size,
+		Duration:   float64(time.Since(start)) / float64(time.Second),
+		User:       e.user,
+		UserAgent:  req.UserAgent(),
+		Referer:    redactURL(req.Referer(), redact),
+	}
+	e.mu.Unlock()
+	if body != nil {
+		le.Body = body.entry(req.Header.Get("Content-Type"), redact)
+	}
+	h.write(le)
+}
+
+func (h *handler) write(e Entry) {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		// This should never happen.
+		return
+	}
+	buf = append(buf, '\n')
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.w.Write(buf)
+}
+
+// routeParams returns the parameters of the route group that the given
+// path is in.
+func (h *handler) routeParams(path string) RouteParams {
+	var rp RouteParams
+	n := -1
+	for _, r := range h.p.Routes {
+		if strings.HasPrefix(path, r.Prefix) && len(r.Prefix) > n {
+			rp = r
+			n = len(r.Prefix)
+		}
+	}
+	return rp
+}
+
+// entry holds the details of a request that are only known to the
+// handlers that serve it.
+type entry struct {
+	mu    sync.Mutex
+	route string
+	user  string
+}
+
+type entryKey struct{}
+
+// SetRoute records the route, usually the path pattern, used to serve
+// the request with the given context. It does nothing if the request is
+// not being logged.
+func SetRoute(ctx context.Context, route string) {
+	if e, _ := ctx.Value(entryKey{}).(*entry); e != nil {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.route = route
+	}
+}
+
+// SetUser records the user that made the request with the given
+// context. It does nothing if the request is not being logged.
+func SetUser(ctx context.Context, user string) {
+	if e, _ := ctx.Value(entryKey{}).(*entry); e != nil {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.user = user
+	}
+}
+
+// redactURL returns the given URL with the values of any sensitive
+// query parameters redacted, if redact is true.
+func redactURL(s string, redact bool) string {
+	if !redact || !strings.Contains(s, "?") {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		// Log nothing of a URL that cannot be parsed, as it
+		// cannot be redacted.
+		return Redacted
+	}
+	v, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		u.RawQuery = Redacted
+		return u.String()
+	}
+	redactValues(v)
+	u.RawQuery = v.Encode()
+	return u.String()
+}
+
+// redactValues redacts the values of any sensitive names in v.
+func redactValues(v url.Values) {
+	for k, vs := range v {
+		if !sensitive(k) {
+			continue
+		}
+		for i := range vs {
+			vs[i] = Redacted
+		}
+	}
+}
+
+// redactJSON redacts the values of any members with sensitive names in
+// the given JSON value.
+func redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, mv := range v {
+			if sensitive(k) {
+				v[k] = Redacted
+			} else {
+				v[k] = redactJSON(mv)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactJSON(v[i])
+		}
+	}
+	return v
+}
+
+// sensitive reports whether the value of a parameter with the given
+// name should be redacted.
+func sensitive(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range sensitiveNames {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyRecorder records the start of a request body as it is read.
+type bodyRecorder struct {
+	io.ReadCloser
+	buf       bytes.Buffer
+	truncated bool
+}
+
+// Read implements io.Reader.
+func (r *bodyRecorder) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if remaining := maxBodySize - r.buf.Len(); remaining > 0 {
+		m := n
+		if m > remaining {
+			m = remaining
+			r.truncated = true
+		}
+		r.buf.Write(p[:m])
+	} else if n > 0 {
+		r.truncated = true
+	}
+	return n, err
+}
+
+// entry returns the logged form of the recorded body, which has the
+// given content type. Bodies that are truncated, or that are not JSON
+// or form encoded, are not logged.
+func (r *bodyRecorder) entry(contentType string, redact bool) *json.RawMessage {
+	if r.buf.Len() == 0 || r.truncated {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	var v interface{}
+	switch mediaType {
+	case "application/json":
+		if err := json.Unmarshal(r.buf.Bytes(), &v); err != nil {
+			return nil
+		}
+		if redact {
+			v = redactJSON(v)
+		}
+	case "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(r.buf.String())
+		if err != nil {
+			return nil
+		}
+		if redact {
+			redactValues(form)
+		}
+		v = form
+	default:
+		return nil
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	m := json.RawMessage(buf)
+	return &m
+}
+
+// responseWriter records the status and size of a response.
+type responseWriter struct {
+	http.ResponseWriter
+	code int
+	size int64
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *responseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter.
+func (w *responseWriter) Write(buf []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(buf)
+	w.size += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher, so that streamed responses are not
+// buffered by the access log.
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
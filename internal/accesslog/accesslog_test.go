@@ -0,0 +1,173 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package accesslog_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/internal/accesslog"
+	"github.com/CanonicalLtd/candid/internal/clientip"
+)
+
+func TestHandler(t *testing.T) {
+	c := qt.New(t)
+	var buf bytes.Buffer
+	h := accesslog.NewHandler(&buf, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		accesslog.SetRoute(req.Context(), "/v1/u/:username")
+		accesslog.SetUser(req.Context(), "bob")
+		w.Header().Set("X-Request-Id", "1234")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}), accesslog.Params{})
+
+	req := httptest.NewRequest("GET", "/v1/u/bob?token=xyz&name=bob", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("User-Agent", "test-agent")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	e := readEntry(c, &buf)
+	c.Assert(e.RequestID, qt.Equals, "1234")
+	c.Assert(e.RemoteAddr, qt.Equals, "192.0.2.1")
+	c.Assert(e.Method, qt.Equals, "GET")
+	c.Assert(e.URL, qt.Equals, "/v1/u/bob?name=bob&token=REDACTED")
+	c.Assert(e.Route, qt.Equals, "/v1/u/:username")
+	c.Assert(e.Status, qt.Equals, http.StatusCreated)
+	c.Assert(e.Size, qt.Equals, int64(5))
+	c.Assert(e.User, qt.Equals, "bob")
+	c.Assert(e.UserAgent, qt.Equals, "test-agent")
+	c.Assert(e.Body, qt.IsNil)
+}
+
+func TestClientIP(t *testing.T) {
+	c := qt.New(t)
+	r, err := clientip.New([]string{"10.0.0.0/8"})
+	c.Assert(err, qt.Equals, nil)
+	var buf bytes.Buffer
+	h := accesslog.NewHandler(&buf, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}), accesslog.Params{
+		ClientIP: r,
+	})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	e := readEntry(c, &buf)
+	c.Assert(e.RemoteAddr, qt.Equals, "192.0.2.1")
+}
+
+var bodyTests = []struct {
+	about       string
+	contentType string
+	body        string
+	params      accesslog.RouteParams
+	expectBody  string
+}{{
+	about:       "bodies not logged",
+	contentType: "application/json",
+	body:        `{"user":"bob"}`,
+}, {
+	about:       "json body",
+	contentType: "application/json",
+	body:        `{"user":"bob","password":"hunter2","macaroons":[["x"]],"info":{"access_token":"xyz"}}`,
+	params: accesslog.RouteParams{
+		Bodies: true,
+	},
+	expectBody: `{"info":{"access_token":"REDACTED"},"macaroons":"REDACTED","password":"REDACTED","user":"bob"}`,
+}, {
+	about:       "form body",
+	contentType: "application/x-www-form-urlencoded",
+	body:        `username=bob&password=hunter2`,
+	params: accesslog.RouteParams{
+		Bodies: true,
+	},
+	expectBody: `{"password":["REDACTED"],"username":["bob"]}`,
+}, {
+	about:       "redaction disabled",
+	contentType: "application/x-www-form-urlencoded",
+	body:        `username=bob&password=hunter2`,
+	params: accesslog.RouteParams{
+		Bodies:           true,
+		DisableRedaction: true,
+	},
+	expectBody: `{"password":["hunter2"],"username":["bob"]}`,
+}, {
+	about:       "other content type",
+	contentType: "text/plain",
+	body:        `password=hunter2`,
+	params: accesslog.RouteParams{
+		Bodies: true,
+	},
+}, {
+	about:       "truncated body",
+	contentType: "application/json",
+	body:        `{"user":"` + strings.Repeat("x", 5000) + `"}`,
+	params: accesslog.RouteParams{
+		Bodies: true,
+	},
+}}
+
+func TestBodies(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range bodyTests {
+		c.Run(test.about, func(c *qt.C) {
+			var buf bytes.Buffer
+			test.params.Prefix = "/login"
+			h := accesslog.NewHandler(&buf, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				ioutil.ReadAll(req.Body)
+			}), accesslog.Params{
+				Routes: []accesslog.RouteParams{test.params},
+			})
+			req := httptest.NewRequest("POST", "/login", strings.NewReader(test.body))
+			req.Header.Set("Content-Type", test.contentType)
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			e := readEntry(c, &buf)
+			if test.expectBody == "" {
+				c.Assert(e.Body, qt.IsNil)
+				return
+			}
+			c.Assert(e.Body, qt.Not(qt.IsNil))
+			c.Assert(string(*e.Body), qt.Equals, test.expectBody)
+		})
+	}
+}
+
+func TestRouteGroups(t *testing.T) {
+	c := qt.New(t)
+	var buf bytes.Buffer
+	h := accesslog.NewHandler(&buf, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}), accesslog.Params{
+		Routes: []accesslog.RouteParams{{
+			Prefix:  "/debug",
+			Disable: true,
+		}, {
+			Prefix:           "/debug/info",
+			DisableRedaction: true,
+		}},
+	})
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/debug/pprof?secret=1", nil))
+	c.Assert(buf.Len(), qt.Equals, 0)
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/debug/info?secret=1", nil))
+	e := readEntry(c, &buf)
+	c.Assert(e.URL, qt.Equals, "/debug/info?secret=1")
+}
+
+func readEntry(c *qt.C, buf *bytes.Buffer) accesslog.Entry {
+	line, err := buf.ReadBytes('\n')
+	c.Assert(err, qt.Equals, nil)
+	var e accesslog.Entry
+	err = json.Unmarshal(line, &e)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(buf.Len(), qt.Equals, 0)
+	return e
+}
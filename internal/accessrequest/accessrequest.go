@@ -0,0 +1,176 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package accessrequest stores the pending requests made by users for
+// membership of Candid-local groups. Requests are held until they are
+// approved or denied, after which only the audit log records them.
+package accessrequest
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
+)
+
+// StoreName is the name of the provider data key-value store that
+// holds the pending requests.
+const StoreName = "_access_requests"
+
+// requestsKey is the key under which all pending requests are stored,
+// so that they can be listed.
+const requestsKey = "requests"
+
+var (
+	// ErrNotFound is the error cause returned when a request does
+	// not exist.
+	ErrNotFound = errgo.New("access request not found")
+
+	// ErrDuplicate is the error cause returned when a user makes a
+	// request for a group that they already have a pending request
+	// for.
+	ErrDuplicate = errgo.New("duplicate access request")
+)
+
+// A Request is a request by a user for membership of a group.
+type Request struct {
+	// Username holds the username of the user that made the
+	// request.
+	Username string `json:"username"`
+
+	// Group holds the group the user asked to be a member of.
+	Group string `json:"group"`
+
+	// Reason holds the reason given by the user, if any.
+	Reason string `json:"reason,omitempty"`
+
+	// Created holds the time the request was made.
+	Created time.Time `json:"created"`
+}
+
+// key returns the key of the request in the stored requests.
+func (r Request) key() string {
+	return r.Username + " " + r.Group
+}
+
+// A Store stores pending access requests.
+type Store struct {
+	kv simplekv.Store
+}
+
+// NewStore returns a new Store that keeps requests in the given
+// key-value store.
+func NewStore(kv simplekv.Store) *Store {
+	return &Store{kv: kv}
+}
+
+// List returns all pending requests, oldest first.
+func (s *Store) List(ctx context.Context) ([]Request, error) {
+	rs, err := s.get(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	l := make([]Request, 0, len(rs))
+	for _, r := range rs {
+		l = append(l, r)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if !l[i].Created.Equal(l[j].Created) {
+			return l[i].Created.Before(l[j].Created)
+		}
+		return l[i].key() < l[j].key()
+	})
+	return l, nil
+}
+
+// Get returns the pending request by the given user for the given
+// group. If there is no such request an error with a cause of
+// ErrNotFound is returned.
+func (s *Store) Get(ctx context.Context, username, group string) (*Request, error) {
+	rs, err := s.get(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	r, ok := rs[Request{Username: username, Group: group}.key()]
+	if !ok {
+		return nil, errgo.WithCausef(nil, ErrNotFound, "%s has no request for %s", username, group)
+	}
+	return &r, nil
+}
+
+// Add adds the given request. If the user already has a pending
+// request for the group an error with a cause of ErrDuplicate is
+// returned.
+func (s *Store) Add(ctx context.Context, r Request) error {
+	if r.Username == "" || r.Group == "" {
+		return errgo.Newf("username and group must be specified")
+	}
+	err := s.update(ctx, func(rs map[string]Request) error {
+		if _, ok := rs[r.key()]; ok {
+			return errgo.WithCausef(nil, ErrDuplicate, "%s already has a request for %s", r.Username, r.Group)
+		}
+		rs[r.key()] = r
+		return nil
+	})
+	return errgo.Mask(err, errgo.Is(ErrDuplicate))
+}
+
+// Remove removes the pending request by the given user for the given
+// group. If there is no such request an error with a cause of
+// ErrNotFound is returned.
+func (s *Store) Remove(ctx context.Context, username, group string) error {
+	err := s.update(ctx, func(rs map[string]Request) error {
+		k := Request{Username: username, Group: group}.key()
+		if _, ok := rs[k]; !ok {
+			return errgo.WithCausef(nil, ErrNotFound, "%s has no request for %s", username, group)
+		}
+		delete(rs, k)
+		return nil
+	})
+	return errgo.Mask(err, errgo.Is(ErrNotFound))
+}
+
+func (s *Store) get(ctx context.Context) (map[string]Request, error) {
+	v, err := s.kv.Get(ctx, requestsKey)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return map[string]Request{}, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return unmarshal(v)
+}
+
+func (s *Store) update(ctx context.Context, f func(map[string]Request) error) error {
+	var ferr error
+	err := s.kv.Update(ctx, requestsKey, time.Time{}, func(old []byte) ([]byte, error) {
+		rs := make(map[string]Request)
+		if len(old) > 0 {
+			var err error
+			rs, err = unmarshal(old)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
+		ferr = f(rs)
+		if ferr != nil {
+			return nil, ferr
+		}
+		return json.Marshal(rs)
+	})
+	if ferr != nil {
+		return ferr
+	}
+	return errgo.Mask(err)
+}
+
+func unmarshal(v []byte) (map[string]Request, error) {
+	rs := make(map[string]Request)
+	if err := json.Unmarshal(v, &rs); err != nil {
+		return nil, errgo.Notef(err, "invalid access requests")
+	}
+	return rs, nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package accessrequest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/simplekv/memsimplekv"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/internal/accessrequest"
+)
+
+func TestStore(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	s := accessrequest.NewStore(memsimplekv.NewStore())
+
+	rs, err := s.List(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rs, qt.HasLen, 0)
+
+	now := time.Now().Round(time.Second)
+	err = s.Add(ctx, accessrequest.Request{
+		Username: "bob",
+		Group:    "prod",
+		Reason:   "on call",
+		Created:  now.Add(time.Minute),
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = s.Add(ctx, accessrequest.Request{
+		Username: "alice",
+		Group:    "prod",
+		Created:  now,
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	err = s.Add(ctx, accessrequest.Request{
+		Username: "bob",
+		Group:    "prod",
+		Created:  now,
+	})
+	c.Assert(err, qt.ErrorMatches, `bob already has a request for prod`)
+	c.Assert(errgo.Cause(err), qt.Equals, accessrequest.ErrDuplicate)
+
+	rs, err = s.List(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rs, qt.HasLen, 2)
+	c.Assert(rs[0].Username, qt.Equals, "alice")
+	c.Assert(rs[1].Username, qt.Equals, "bob")
+
+	r, err := s.Get(ctx, "bob", "prod")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r.Reason, qt.Equals, "on call")
+	c.Assert(r.Created.Equal(now.Add(time.Minute)), qt.Equals, true)
+
+	err = s.Remove(ctx, "bob", "prod")
+	c.Assert(err, qt.Equals, nil)
+	_, err = s.Get(ctx, "bob", "prod")
+	c.Assert(errgo.Cause(err), qt.Equals, accessrequest.ErrNotFound)
+	err = s.Remove(ctx, "bob", "prod")
+	c.Assert(err, qt.ErrorMatches, `bob has no request for prod`)
+	c.Assert(errgo.Cause(err), qt.Equals, accessrequest.ErrNotFound)
+
+	rs, err = s.List(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rs, qt.HasLen, 1)
+}
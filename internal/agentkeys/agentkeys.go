@@ -0,0 +1,117 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package agentkeys records expiry times for the public keys held by
+// agent identities. This allows an agent to hold several keys with
+// independent lifetimes so that its credentials can be rotated without
+// downtime.
+package agentkeys
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+)
+
+// StoreName is the name of the provider data key-value store that
+// holds agent key expiry times.
+const StoreName = "_agent_keys"
+
+// Store stores the expiry times of agent public keys. It wraps a
+// KeyValueStore.
+type Store struct {
+	store simplekv.Store
+}
+
+// NewStore creates a new Store using the given KeyValueStore for
+// backing storage.
+func NewStore(store simplekv.Store) *Store {
+	return &Store{store: store}
+}
+
+// Expiries returns the expiry times of the public keys held by the
+// identity with the given username. Keys that do not expire are not
+// included.
+func (s *Store) Expiries(ctx context.Context, username string) (map[bakery.PublicKey]time.Time, error) {
+	r, err := s.get(ctx, username)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
+	}
+	expiries := make(map[bakery.PublicKey]time.Time, len(r))
+	for k, t := range r {
+		var pk bakery.PublicKey
+		if err := pk.UnmarshalText([]byte(k)); err != nil {
+			// Ignore any key that cannot be parsed, it can't
+			// match any key the identity holds.
+			continue
+		}
+		expiries[pk] = t
+	}
+	return expiries, nil
+}
+
+// Expired reports whether the given public key held by the identity
+// with the given username expired at or before the given time.
+func (s *Store) Expired(ctx context.Context, username string, pk *bakery.PublicKey, now time.Time) (bool, error) {
+	r, err := s.get(ctx, username)
+	if err != nil {
+		return false, errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
+	}
+	t, ok := r[pk.String()]
+	return ok && !now.Before(t), nil
+}
+
+// SetExpiry sets the time at which the given public key held by the
+// identity with the given username expires. If t is the zero time the
+// key will not expire.
+func (s *Store) SetExpiry(ctx context.Context, username string, pk *bakery.PublicKey, t time.Time) error {
+	return s.update(ctx, username, func(r record) {
+		if t.IsZero() {
+			delete(r, pk.String())
+			return
+		}
+		r[pk.String()] = t.UTC()
+	})
+}
+
+// record is the value stored for each identity. It maps the text
+// form of each public key to its expiry time.
+type record map[string]time.Time
+
+func (s *Store) get(ctx context.Context, username string) (record, error) {
+	b, err := s.store.Get(ctx, username)
+	if err != nil {
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			return record{}, nil
+		}
+		return nil, errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
+	}
+	r := make(record)
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return r, nil
+}
+
+func (s *Store) update(ctx context.Context, username string, f func(record)) error {
+	err := s.store.Update(ctx, username, time.Time{}, func(old []byte) ([]byte, error) {
+		r := make(record)
+		if old != nil {
+			if err := json.Unmarshal(old, &r); err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
+		f(r)
+		b, err := json.Marshal(r)
+		if err != nil {
+			// This should be impossible.
+			panic(err)
+		}
+		return b, nil
+	})
+	return errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package agentkeys_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/candid/internal/agentkeys"
+	"github.com/CanonicalLtd/candid/internal/candidtest"
+)
+
+func TestStore(t *testing.T) {
+	qtsuite.Run(qt.New(t), &storeSuite{})
+}
+
+type storeSuite struct {
+	store *agentkeys.Store
+}
+
+func (s *storeSuite) Init(c *qt.C) {
+	kv, err := candidtest.NewStore().ProviderDataStore.KeyValueStore(context.Background(), "test")
+	c.Assert(err, qt.Equals, nil)
+	s.store = agentkeys.NewStore(kv)
+}
+
+var epoch = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func (s *storeSuite) TestSetExpiry(c *qt.C) {
+	ctx := context.Background()
+	pk1 := bakery.MustGenerateKey().Public
+	pk2 := bakery.MustGenerateKey().Public
+
+	err := s.store.SetExpiry(ctx, "agent@candid", &pk1, epoch)
+	c.Assert(err, qt.Equals, nil)
+
+	expiries, err := s.store.Expiries(ctx, "agent@candid")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(expiries, qt.DeepEquals, map[bakery.PublicKey]time.Time{pk1: epoch})
+
+	expired, err := s.store.Expired(ctx, "agent@candid", &pk1, epoch.Add(-time.Second))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(expired, qt.Equals, false)
+	expired, err = s.store.Expired(ctx, "agent@candid", &pk1, epoch)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(expired, qt.Equals, true)
+
+	// A key with no expiry never expires.
+	expired, err = s.store.Expired(ctx, "agent@candid", &pk2, epoch.AddDate(10, 0, 0))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(expired, qt.Equals, false)
+
+	// Setting the zero time removes the expiry.
+	err = s.store.SetExpiry(ctx, "agent@candid", &pk1, time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	expired, err = s.store.Expired(ctx, "agent@candid", &pk1, epoch)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(expired, qt.Equals, false)
+}
+
+func (s *storeSuite) TestExpiriesUnknownUser(c *qt.C) {
+	expiries, err := s.store.Expiries(context.Background(), "nobody")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(expiries, qt.HasLen, 0)
+}
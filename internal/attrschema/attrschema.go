@@ -0,0 +1,224 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package attrschema holds the schema of the custom identity
+// attributes declared by the operator of the identity server. Custom
+// attributes are stored as JSON encoded extra-info items and the
+// schema is used to validate their values, to restrict who may read
+// them and to declare them in discharge macaroons.
+package attrschema
+
+import (
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// The types of attribute values.
+const (
+	TypeString  = "string"
+	TypeNumber  = "number"
+	TypeBoolean = "boolean"
+)
+
+// The visibilities of attributes.
+const (
+	// VisibilityPublic attributes may be read by anyone allowed to
+	// read the user's extra-info.
+	VisibilityPublic = "public"
+
+	// VisibilityPrivate attributes may only be read by members of
+	// the read-sensitive-extra-info ACL.
+	VisibilityPrivate = "private"
+)
+
+// ErrInvalidValue is the error cause returned when an attribute value
+// does not conform to the schema.
+var ErrInvalidValue = errgo.New("invalid attribute value")
+
+// reservedNames holds the names that cannot be used for custom
+// attributes because they are already used for standard attributes.
+var reservedNames = map[string]bool{
+	"username":  true,
+	"email":     true,
+	"groups":    true,
+	"full-name": true,
+	"sshkeys":   true,
+}
+
+// An Attribute is the definition of a custom identity attribute.
+type Attribute struct {
+	// Name holds the name of the attribute, which is also the key
+	// of the extra-info item that holds its value.
+	Name string `json:"name"`
+
+	// Type holds the type of the attribute's value, one of
+	// TypeString, TypeNumber or TypeBoolean. If this is empty
+	// TypeString is used.
+	Type string `json:"type"`
+
+	// Required holds whether the attribute must have a value for
+	// an identity to be given discharges that declare it.
+	Required bool `json:"required,omitempty"`
+
+	// Pattern holds a regular expression that string values must
+	// match in their entirety, if any.
+	Pattern string `json:"pattern,omitempty"`
+
+	// Visibility holds who may read the attribute, either
+	// VisibilityPublic or VisibilityPrivate. If this is empty
+	// VisibilityPublic is used.
+	Visibility string `json:"visibility"`
+}
+
+// A Schema holds the definitions of the custom attributes. A nil
+// *Schema has no attributes.
+type Schema struct {
+	attrs   []Attribute
+	byName  map[string]int
+	regexps map[string]*regexp.Regexp
+}
+
+// New returns a schema holding the given attributes. It returns an
+// error if any of the attributes are invalid. If there are no
+// attributes New returns nil.
+func New(attrs []Attribute) (*Schema, error) {
+	if len(attrs) == 0 {
+		return nil, nil
+	}
+	s := &Schema{
+		byName:  make(map[string]int),
+		regexps: make(map[string]*regexp.Regexp),
+	}
+	for _, a := range attrs {
+		if a.Name == "" {
+			return nil, errgo.Newf("attribute name not specified")
+		}
+		if reservedNames[a.Name] || strings.ContainsAny(a.Name, "./$ ") {
+			return nil, errgo.Newf("invalid attribute name %q", a.Name)
+		}
+		if _, ok := s.byName[a.Name]; ok {
+			return nil, errgo.Newf("duplicate attribute %q", a.Name)
+		}
+		switch a.Type {
+		case "":
+			a.Type = TypeString
+		case TypeString, TypeNumber, TypeBoolean:
+		default:
+			return nil, errgo.Newf("invalid type %q for attribute %q", a.Type, a.Name)
+		}
+		switch a.Visibility {
+		case "":
+			a.Visibility = VisibilityPublic
+		case VisibilityPublic, VisibilityPrivate:
+		default:
+			return nil, errgo.Newf("invalid visibility %q for attribute %q", a.Visibility, a.Name)
+		}
+		if a.Pattern != "" {
+			if a.Type != TypeString {
+				return nil, errgo.Newf("pattern specified for %s attribute %q", a.Type, a.Name)
+			}
+			re, err := regexp.Compile("^(?:" + a.Pattern + ")$")
+			if err != nil {
+				return nil, errgo.Notef(err, "invalid pattern for attribute %q", a.Name)
+			}
+			s.regexps[a.Name] = re
+		}
+		s.byName[a.Name] = len(s.attrs)
+		s.attrs = append(s.attrs, a)
+	}
+	return s, nil
+}
+
+// Attributes returns the definitions of all the attributes in the
+// schema, ordered by name.
+func (s *Schema) Attributes() []Attribute {
+	if s == nil {
+		return nil
+	}
+	attrs := make([]Attribute, len(s.attrs))
+	copy(attrs, s.attrs)
+	sort.Slice(attrs, func(i, j int) bool {
+		return attrs[i].Name < attrs[j].Name
+	})
+	return attrs
+}
+
+// Attribute returns the definition of the attribute with the given
+// name, and reports whether there is one.
+func (s *Schema) Attribute(name string) (Attribute, bool) {
+	if s == nil {
+		return Attribute{}, false
+	}
+	i, ok := s.byName[name]
+	if !ok {
+		return Attribute{}, false
+	}
+	return s.attrs[i], true
+}
+
+// IsPrivate reports whether the attribute with the given name may only
+// be read by members of the read-sensitive-extra-info ACL.
+func (s *Schema) IsPrivate(name string) bool {
+	a, ok := s.Attribute(name)
+	return ok && a.Visibility == VisibilityPrivate
+}
+
+// Validate checks that the given JSON encoded value is valid for the
+// attribute with the given name. Values of extra-info items that are
+// not in the schema are always valid. If the value is not valid an
+// error with a cause of ErrInvalidValue is returned.
+func (s *Schema) Validate(name string, value []byte) error {
+	a, ok := s.Attribute(name)
+	if !ok {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(value, &v); err != nil {
+		return errgo.WithCausef(nil, ErrInvalidValue, "invalid value for attribute %q", name)
+	}
+	switch a.Type {
+	case TypeString:
+		str, ok := v.(string)
+		if !ok {
+			return errgo.WithCausef(nil, ErrInvalidValue, "attribute %q must be a string", name)
+		}
+		if re := s.regexps[name]; re != nil && !re.MatchString(str) {
+			return errgo.WithCausef(nil, ErrInvalidValue, "attribute %q does not match pattern %q", name, a.Pattern)
+		}
+	case TypeNumber:
+		if _, ok := v.(float64); !ok {
+			return errgo.WithCausef(nil, ErrInvalidValue, "attribute %q must be a number", name)
+		}
+	case TypeBoolean:
+		if _, ok := v.(bool); !ok {
+			return errgo.WithCausef(nil, ErrInvalidValue, "attribute %q must be a boolean", name)
+		}
+	}
+	return nil
+}
+
+// Format returns the given JSON encoded attribute value formatted as a
+// string suitable for a declared caveat. Strings are returned
+// unquoted, and numbers and booleans in their JSON form.
+func Format(value []byte) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal(value, &v); err != nil {
+		return "", errgo.Mask(err)
+	}
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case nil:
+		return "", nil
+	}
+	return "", errgo.Newf("unexpected attribute value %s", value)
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package attrschema_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/internal/attrschema"
+)
+
+func TestValidate(t *testing.T) {
+	c := qt.New(t)
+	s, err := attrschema.New([]attrschema.Attribute{{
+		Name:     "employee-id",
+		Required: true,
+		Pattern:  `E[0-9]+`,
+	}, {
+		Name:       "cost-centre",
+		Type:       attrschema.TypeNumber,
+		Visibility: attrschema.VisibilityPrivate,
+	}, {
+		Name: "contractor",
+		Type: attrschema.TypeBoolean,
+	}})
+	c.Assert(err, qt.Equals, nil)
+
+	a, ok := s.Attribute("employee-id")
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(a, qt.DeepEquals, attrschema.Attribute{
+		Name:       "employee-id",
+		Type:       attrschema.TypeString,
+		Required:   true,
+		Pattern:    `E[0-9]+`,
+		Visibility: attrschema.VisibilityPublic,
+	})
+	c.Assert(s.IsPrivate("employee-id"), qt.Equals, false)
+	c.Assert(s.IsPrivate("cost-centre"), qt.Equals, true)
+	c.Assert(s.Attributes()[0].Name, qt.Equals, "contractor")
+
+	c.Assert(s.Validate("employee-id", []byte(`"E1234"`)), qt.Equals, nil)
+	c.Assert(s.Validate("cost-centre", []byte(`42`)), qt.Equals, nil)
+	c.Assert(s.Validate("contractor", []byte(`false`)), qt.Equals, nil)
+	c.Assert(s.Validate("unknown", []byte(`{"a": 1}`)), qt.Equals, nil)
+
+	err = s.Validate("employee-id", []byte(`"XE1234"`))
+	c.Assert(err, qt.ErrorMatches, `attribute "employee-id" does not match pattern "E\[0-9\]\+"`)
+	c.Assert(errgo.Cause(err), qt.Equals, attrschema.ErrInvalidValue)
+	err = s.Validate("employee-id", []byte(`1234`))
+	c.Assert(err, qt.ErrorMatches, `attribute "employee-id" must be a string`)
+	err = s.Validate("cost-centre", []byte(`"42"`))
+	c.Assert(err, qt.ErrorMatches, `attribute "cost-centre" must be a number`)
+	err = s.Validate("contractor", []byte(`"yes"`))
+	c.Assert(err, qt.ErrorMatches, `attribute "contractor" must be a boolean`)
+}
+
+func TestNilSchema(t *testing.T) {
+	c := qt.New(t)
+	s, err := attrschema.New(nil)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(s, qt.IsNil)
+	c.Assert(s.Attributes(), qt.HasLen, 0)
+	c.Assert(s.Validate("employee-id", []byte(`1`)), qt.Equals, nil)
+	c.Assert(s.IsPrivate("employee-id"), qt.Equals, false)
+}
+
+var newErrorTests = []struct {
+	about       string
+	attr        attrschema.Attribute
+	expectError string
+}{{
+	about:       "no name",
+	attr:        attrschema.Attribute{},
+	expectError: `attribute name not specified`,
+}, {
+	about:       "reserved name",
+	attr:        attrschema.Attribute{Name: "email"},
+	expectError: `invalid attribute name "email"`,
+}, {
+	about:       "invalid type",
+	attr:        attrschema.Attribute{Name: "a", Type: "date"},
+	expectError: `invalid type "date" for attribute "a"`,
+}, {
+	about:       "invalid visibility",
+	attr:        attrschema.Attribute{Name: "a", Visibility: "secret"},
+	expectError: `invalid visibility "secret" for attribute "a"`,
+}, {
+	about:       "pattern for number",
+	attr:        attrschema.Attribute{Name: "a", Type: "number", Pattern: "1"},
+	expectError: `pattern specified for number attribute "a"`,
+}, {
+	about:       "invalid pattern",
+	attr:        attrschema.Attribute{Name: "a", Pattern: "("},
+	expectError: `invalid pattern for attribute "a": .*`,
+}}
+
+func TestNewError(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range newErrorTests {
+		c.Run(test.about, func(c *qt.C) {
+			_, err := attrschema.New([]attrschema.Attribute{test.attr})
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+		})
+	}
+}
+
+func TestFormat(t *testing.T) {
+	c := qt.New(t)
+	for value, expect := range map[string]string{
+		`"E1234"`: "E1234",
+		`42`:      "42",
+		`1.5`:     "1.5",
+		`true`:    "true",
+		`null`:    "",
+	} {
+		s, err := attrschema.Format([]byte(value))
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(s, qt.Equals, expect)
+	}
+}
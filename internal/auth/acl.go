@@ -0,0 +1,94 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package auth
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/juju/aclstore/v2"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/internal/auth/expr"
+)
+
+// NewACLStore returns an aclstore.ACLStore that stores ACLs in the
+// given store, but refuses to store any ACL entry that is not a valid
+// policy expression (see ExprPrefix). An attempt to store an invalid
+// entry returns an error with a cause of params.ErrBadRequest.
+func NewACLStore(s aclstore.ACLStore) aclstore.ACLStore {
+	return validatingACLStore{s}
+}
+
+type validatingACLStore struct {
+	aclstore.ACLStore
+}
+
+// CreateACL implements aclstore.ACLStore.CreateACL.
+func (s validatingACLStore) CreateACL(ctx context.Context, aclName string, initialUsers []string) error {
+	if err := ValidateACL(initialUsers); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	return errgo.Mask(s.ACLStore.CreateACL(ctx, aclName, initialUsers), errgo.Any)
+}
+
+// Add implements aclstore.ACLStore.Add.
+func (s validatingACLStore) Add(ctx context.Context, aclName string, users []string) error {
+	if err := ValidateACL(users); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	return errgo.Mask(s.ACLStore.Add(ctx, aclName, users), errgo.Any)
+}
+
+// Set implements aclstore.ACLStore.Set.
+func (s validatingACLStore) Set(ctx context.Context, aclName string, users []string) error {
+	if err := ValidateACL(users); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	return errgo.Mask(s.ACLStore.Set(ctx, aclName, users), errgo.Any)
+}
+
+// ValidateACL checks that every policy expression in the given ACL
+// parses. The returned error has a cause of params.ErrBadRequest.
+func ValidateACL(acl []string) error {
+	for _, a := range acl {
+		if !strings.HasPrefix(a, ExprPrefix) {
+			continue
+		}
+		if _, err := expr.Parse(strings.TrimPrefix(a, ExprPrefix)); err != nil {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "invalid ACL entry %q: %s", a, err)
+		}
+	}
+	return nil
+}
+
+// exprCache holds the parsed form of the policy expressions that have
+// been found in ACLs, so that they are not parsed every time an ACL is
+// checked.
+type exprCache struct {
+	mu    sync.Mutex
+	exprs map[string]exprResult
+}
+
+type exprResult struct {
+	expr *expr.Expr
+	err  error
+}
+
+// parse returns the parsed form of the given expression.
+func (c *exprCache) parse(s string) (*expr.Expr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if r, ok := c.exprs[s]; ok {
+		return r.expr, r.err
+	}
+	e, err := expr.Parse(s)
+	if c.exprs == nil {
+		c.exprs = make(map[string]exprResult)
+	}
+	c.exprs[s] = exprResult{e, err}
+	return e, err
+}
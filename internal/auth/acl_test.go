@@ -0,0 +1,47 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package auth_test
+
+import (
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/aclstore/v2"
+	"github.com/juju/simplekv/memsimplekv"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/internal/auth"
+)
+
+func TestNewACLStore(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	s := auth.NewACLStore(aclstore.NewACLStore(memsimplekv.NewStore()))
+
+	err := s.CreateACL(ctx, "test", []string{"alice", `expr:provider == "ldap"`})
+	c.Assert(err, qt.Equals, nil)
+
+	err = s.Add(ctx, "test", []string{"expr:mfa &&"})
+	c.Assert(err, qt.ErrorMatches, `invalid ACL entry "expr:mfa &&": .*`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+
+	err = s.Set(ctx, "test", []string{"bob", "expr:provider =="})
+	c.Assert(err, qt.ErrorMatches, `invalid ACL entry "expr:provider ==": .*`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+
+	err = s.CreateACL(ctx, "test2", []string{"expr:("})
+	c.Assert(err, qt.ErrorMatches, `invalid ACL entry "expr:\(": .*`)
+
+	acl, err := s.Get(ctx, "test")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(acl, qt.DeepEquals, []string{"alice", `expr:provider == "ldap"`})
+
+	err = s.Set(ctx, "test", []string{"bob", "expr:mfa"})
+	c.Assert(err, qt.Equals, nil)
+	acl, err = s.Get(ctx, "test")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(acl, qt.DeepEquals, []string{"bob", "expr:mfa"})
+}
@@ -7,6 +7,7 @@ import (
 	"context"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/juju/aclstore/v2"
 	"github.com/juju/loggo"
@@ -18,6 +19,12 @@ import (
 	macaroon "gopkg.in/macaroon.v2"
 
 	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/idputil"
+	"github.com/CanonicalLtd/candid/internal/agentkeys"
+	"github.com/CanonicalLtd/candid/internal/auth/expr"
+	"github.com/CanonicalLtd/candid/internal/groupowner"
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/internal/revocation"
 	"github.com/CanonicalLtd/candid/store"
 )
 
@@ -32,9 +39,23 @@ const (
 
 var AdminProviderID = store.MakeProviderIdentity("idm", "admin")
 
+// ExprPrefix is the prefix of ACL entries that hold a policy expression
+// rather than a user or group name, for example
+// `expr:provider == "ldap" && mfa`. See package expr for the syntax of
+// the expressions. The attributes available to expressions are
+// username, email, email_domain, provider, mfa and groups.
+const ExprPrefix = "expr:"
+
+// MFAProviderInfo is the ProviderInfo key that identity providers
+// set to "true" to record that an identity authenticated using
+// multiple factors. It provides the mfa attribute of policy
+// expressions.
+const MFAProviderInfo = idputil.MFAProviderInfo
+
 const (
 	kindGlobal = "global"
 	kindUser   = "u"
+	kindGroup  = "group"
 )
 
 // The following constants define possible operation actions.
@@ -53,22 +74,56 @@ const (
 	ActionWriteSSHKeys       = "writeSSHKeys"
 	ActionLogin              = "login"
 	ActionReadDischargeToken = "read-discharge-token"
+	ActionImpersonate        = "impersonate"
+	ActionReadSensitive      = "readSensitive"
+	ActionWriteSensitive     = "writeSensitive"
+	ActionReadKeys           = "readKeys"
+	ActionRotateKeys         = "rotateKeys"
+	ActionExplain            = "explain"
+	ActionImport             = "import"
+	ActionRevokeAccess       = "revokeAccess"
+	ActionWriteAgentKeys     = "writeAgentKeys"
+	ActionUnlock             = "unlock"
+	ActionIntrospect         = "introspect"
+	ActionRevoke             = "revoke"
+	ActionWritePolicy        = "writePolicy"
+	ActionSetReadOnly        = "setReadOnly"
+	ActionSetDeviceAlerts    = "setDeviceAlerts"
+	ActionRequestAccess      = "requestAccess"
+	ActionWriteMembers       = "writeMembers"
+	ActionWriteGroupOwners   = "writeGroupOwners"
+	ActionWriteServices      = "writeServices"
+	ActionDebug              = "debug"
 )
 
 const (
+	debugACL            = "debug"
 	dischargeForUserACL = "discharge-for-user"
+	explainACL          = "explain-authorization"
+	impersonateUserACL  = "impersonate-user"
+	introspectACL       = "introspect"
+	manageKeysACL       = "manage-keys"
+	readSensitiveACL    = "read-sensitive-extra-info"
 	readUserACL         = "read-user"
 	readUserGroupsACL   = "read-user-groups"
 	readUserSSHKeysACL  = "read-user-ssh-keys"
+	writeSensitiveACL   = "write-sensitive-extra-info"
 	writeUserACL        = "write-user"
 	writeUserSSHKeysACL = "write-user-ssh-keys"
 )
 
 var aclDefaults = map[string][]string{
+	debugACL:            {AdminUsername},
 	dischargeForUserACL: {AdminUsername},
+	explainACL:          {AdminUsername},
+	impersonateUserACL:  {AdminUsername},
+	introspectACL:       {AdminUsername},
+	manageKeysACL:       {AdminUsername},
+	readSensitiveACL:    {AdminUsername},
 	readUserACL:         {AdminUsername, UserInformationGroup},
 	readUserGroupsACL:   {AdminUsername, GroupListGroup, UserInformationGroup},
 	readUserSSHKeysACL:  {AdminUsername, SSHKeyGetterGroup, UserInformationGroup},
+	writeSensitiveACL:   {AdminUsername},
 	writeUserACL:        {AdminUsername},
 	writeUserSSHKeysACL: {AdminUsername},
 }
@@ -81,6 +136,10 @@ type Authorizer struct {
 	store          store.Store
 	groupResolvers map[string]groupResolver
 	aclManager     *aclstore.Manager
+	agentKeys      *agentkeys.Store
+	revocations    *revocation.Store
+	groupOwners    *groupowner.Store
+	exprs          exprCache
 }
 
 // Params specifify the configuration parameters for a new Authroizer.
@@ -108,6 +167,20 @@ type Params struct {
 
 	// ACLStore is the acl store.
 	ACLManager *aclstore.Manager
+
+	// AgentKeys holds the expiry times of agent public keys. If
+	// this is nil then agent public keys never expire.
+	AgentKeys *agentkeys.Store
+
+	// Revocations holds the IDs of revoked macaroons. Macaroons
+	// that have been revoked are ignored when authorizing
+	// operations. If this is nil then no macaroons are revoked.
+	Revocations *revocation.Store
+
+	// GroupOwners holds the owners of groups, who may change the
+	// members of the groups they own. If this is nil then groups
+	// have no owners.
+	GroupOwners *groupowner.Store
 }
 
 // New creates a new Authorizer for authorizing identity server
@@ -123,6 +196,9 @@ func New(params Params) (*Authorizer, error) {
 		location:      params.Location,
 		store:         params.Store,
 		aclManager:    params.ACLManager,
+		agentKeys:     params.AgentKeys,
+		revocations:   params.Revocations,
+		groupOwners:   params.GroupOwners,
 	}
 	resolvers := make(map[string]groupResolver)
 	for _, idp := range params.IdentityProviders {
@@ -177,9 +253,18 @@ func (a *Authorizer) aclForOp(ctx context.Context, op bakery.Op) (acl []string,
 			// Anyone can create an agent, as long as they've authenticated
 			// themselves.
 			return []string{identchecker.Everyone}, false, nil
-		case ActionCreateParentAgent:
+		case ActionCreateParentAgent, ActionImport, ActionUnlock, ActionRevoke, ActionWritePolicy, ActionSetReadOnly, ActionSetDeviceAlerts, ActionWriteGroupOwners, ActionWriteServices:
 			acl, err := a.aclManager.ACL(ctx, writeUserACL)
 			return acl, false, errgo.Mask(err)
+		case ActionReadKeys, ActionRotateKeys:
+			acl, err := a.aclManager.ACL(ctx, manageKeysACL)
+			return acl, false, errgo.Mask(err)
+		case ActionIntrospect:
+			acl, err := a.aclManager.ACL(ctx, introspectACL)
+			return acl, false, errgo.Mask(err)
+		case ActionDebug:
+			acl, err := a.aclManager.ACL(ctx, debugACL)
+			return acl, false, errgo.Mask(err)
 		}
 	case kindUser:
 		if name == "" {
@@ -208,6 +293,58 @@ func (a *Authorizer) aclForOp(ctx context.Context, op bakery.Op) (acl []string,
 		case ActionWriteSSHKeys:
 			acl, err := a.aclManager.ACL(ctx, writeUserSSHKeysACL)
 			return append(acl, username), false, errgo.Mask(err)
+		case ActionImpersonate:
+			acl, err := a.aclManager.ACL(ctx, impersonateUserACL)
+			return acl, false, errgo.Mask(err)
+		case ActionReadSensitive:
+			acl, err := a.aclManager.ACL(ctx, readSensitiveACL)
+			return acl, false, errgo.Mask(err)
+		case ActionWriteSensitive:
+			acl, err := a.aclManager.ACL(ctx, writeSensitiveACL)
+			return acl, false, errgo.Mask(err)
+		case ActionExplain:
+			acl, err := a.aclManager.ACL(ctx, explainACL)
+			return append(acl, username), false, errgo.Mask(err)
+		case ActionRevokeAccess, ActionRequestAccess:
+			acl, err := a.aclManager.ACL(ctx, writeUserACL)
+			return append(acl, username), false, errgo.Mask(err)
+		case ActionWriteAgentKeys:
+			// An agent may rotate its own keys, as may the
+			// owner of the agent.
+			acl, err := a.aclManager.ACL(ctx, writeUserACL)
+			if err != nil {
+				return nil, false, errgo.Mask(err)
+			}
+			acl = append(acl, username)
+			owner, err := a.ownerUsername(ctx, username)
+			if err != nil {
+				return nil, false, errgo.Mask(err)
+			}
+			if owner != "" {
+				acl = append(acl, owner)
+			}
+			return acl, false, nil
+		}
+	case kindGroup:
+		if name == "" {
+			return nil, false, nil
+		}
+		switch op.Action {
+		case ActionWriteMembers:
+			// The owners of a group may change its members, as
+			// may anyone allowed to change any user's groups.
+			acl, err := a.aclManager.ACL(ctx, writeUserACL)
+			if err != nil {
+				return nil, false, errgo.Mask(err)
+			}
+			if a.groupOwners == nil {
+				return acl, false, nil
+			}
+			owners, err := a.groupOwners.Owners(ctx, name)
+			if err != nil {
+				return nil, false, errgo.Mask(err)
+			}
+			return append(acl, owners...), false, nil
 		}
 	case "groups":
 		switch op.Action {
@@ -219,6 +356,44 @@ func (a *Authorizer) aclForOp(ctx context.Context, op bakery.Op) (acl []string,
 	return nil, false, nil
 }
 
+// Allow reports whether the given identity is allowed to perform the
+// given operation. This is used to check operations that only apply
+// to part of a request, such as access to sensitive extra-info items.
+func (a *Authorizer) Allow(ctx context.Context, id *Identity, op bakery.Op) (bool, error) {
+	if id == nil {
+		return false, nil
+	}
+	acl, _, err := a.aclForOp(ctx, op)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	ok, err := id.Allow(ctx, acl)
+	return ok, errgo.Mask(err)
+}
+
+// SensitiveAllowed returns a function that reports whether the given
+// identity may perform the given action (ActionReadSensitive or
+// ActionWriteSensitive) on the sensitive extra-info items of the given
+// user. The check is only performed once, when the returned function
+// is first called, so that requests that touch no sensitive items do
+// not need to check the ACL.
+func (a *Authorizer) SensitiveAllowed(ctx context.Context, id *Identity, username params.Username, action string) func() bool {
+	var checked, allowed bool
+	return func() bool {
+		if checked {
+			return allowed
+		}
+		checked = true
+		var err error
+		allowed, err = a.Allow(ctx, id, UserOp(username, action))
+		if err != nil {
+			logging.FromContext(ctx, logger).Errorf("cannot check sensitive extra-info access: %s", err)
+			allowed = false
+		}
+		return allowed
+	}
+}
+
 // SetAdminPublicKey configures the public key on the admin user. This is
 // to allow agent login as the admin user.
 func (a *Authorizer) SetAdminPublicKey(ctx context.Context, pk *bakery.PublicKey) error {
@@ -247,6 +422,13 @@ func (a *Authorizer) SetAdminPublicKey(ctx context.Context, pk *bakery.PublicKey
 // required, or params.ErrUnauthorized if the user is authenticated but
 // does not have the required authorization.
 func (a *Authorizer) Auth(ctx context.Context, mss []macaroon.Slice, ops ...bakery.Op) (*identchecker.AuthInfo, error) {
+	if a.revocations != nil {
+		var err error
+		mss, err = a.revocations.Filter(ctx, mss)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
 	authInfo, err := a.checker.Auth(mss...).Allow(ctx, ops...)
 	if err != nil {
 		if errgo.Cause(err) == bakery.ErrPermissionDenied {
@@ -257,6 +439,34 @@ func (a *Authorizer) Auth(ctx context.Context, mss []macaroon.Slice, ops ...bake
 	return authInfo, nil
 }
 
+// ownerUsername returns the username of the owner of the identity with
+// the given username. If the identity does not exist or has no owner
+// then "" is returned.
+func (a *Authorizer) ownerUsername(ctx context.Context, username string) (string, error) {
+	id := store.Identity{
+		Username: username,
+	}
+	if err := a.store.Identity(ctx, &id); err != nil {
+		if errgo.Cause(err) == store.ErrNotFound {
+			return "", nil
+		}
+		return "", errgo.Mask(err)
+	}
+	if id.Owner == "" {
+		return "", nil
+	}
+	owner := store.Identity{
+		ProviderID: id.Owner,
+	}
+	if err := a.store.Identity(ctx, &owner); err != nil {
+		if errgo.Cause(err) == store.ErrNotFound {
+			return "", nil
+		}
+		return "", errgo.Mask(err)
+	}
+	return owner.Username, nil
+}
+
 func isDischargeRequiredError(err error) bool {
 	_, ok := errgo.Cause(err).(*bakery.DischargeRequiredError)
 	return ok
@@ -348,7 +558,8 @@ func (c identityClient) DeclaredIdentity(ctx context.Context, declared map[strin
 		id: store.Identity{
 			Username: username,
 		},
-		authorizer: c.authorizer,
+		authorizer:   c.authorizer,
+		impersonator: declared[ImpersonatedByAttribute],
 	}, nil
 }
 
@@ -361,6 +572,10 @@ type Identity struct {
 	id             store.Identity
 	authorizer     *Authorizer
 	resolvedGroups []string
+
+	// impersonator holds the username of the user that is
+	// impersonating this identity, if any.
+	impersonator string
 }
 
 // Id implements identchecker.Identity.Id.
@@ -373,8 +588,16 @@ func (id *Identity) Domain() string {
 	return ""
 }
 
+// Impersonator returns the username of the user that is impersonating
+// the identity. If the identity is not being impersonated then an empty
+// string is returned.
+func (id *Identity) Impersonator() string {
+	return id.impersonator
+}
+
 // Allow implements identchecker.ACLIdentity.Allow by checking whether the
-// given identity is in any of the required groups or users.
+// given identity is in any of the required groups or users, or
+// satisfies any of the policy expressions in the ACL.
 func (id *Identity) Allow(ctx context.Context, acl []string) (bool, error) {
 	if ok, isTrivial := trivialAllow(id.id.Username, acl); isTrivial {
 		return ok, nil
@@ -384,6 +607,12 @@ func (id *Identity) Allow(ctx context.Context, acl []string) (bool, error) {
 		return false, errgo.Mask(err)
 	}
 	for _, a := range acl {
+		if strings.HasPrefix(a, ExprPrefix) {
+			if id.allowExpr(strings.TrimPrefix(a, ExprPrefix), groups) {
+				return true, nil
+			}
+			continue
+		}
 		for _, g := range groups {
 			if g == a {
 				return true, nil
@@ -393,6 +622,50 @@ func (id *Identity) Allow(ctx context.Context, acl []string) (bool, error) {
 	return false, nil
 }
 
+// allowExpr reports whether the identity, which has the given groups,
+// satisfies the given policy expression. Expressions that are invalid,
+// which can only be the case for ACLs stored before they were
+// validated, are logged and never satisfied.
+func (id *Identity) allowExpr(s string, groups []string) bool {
+	e, err := id.authorizer.exprs.parse(s)
+	if err != nil {
+		logger.Errorf("invalid ACL expression: %s", err)
+		return false
+	}
+	ok, err := e.Eval(id.attributes(groups))
+	if err != nil {
+		logger.Errorf("%s", err)
+		return false
+	}
+	return ok
+}
+
+// attributes returns the attributes of the identity that may be used
+// in policy expressions.
+func (id *Identity) attributes(groups []string) expr.Attributes {
+	var emailDomain string
+	if i := strings.LastIndex(id.id.Email, "@"); i >= 0 {
+		emailDomain = id.id.Email[i+1:]
+	}
+	mfa := false
+	for _, v := range id.id.ProviderInfo[MFAProviderInfo] {
+		if v == "true" {
+			mfa = true
+		}
+	}
+	if groups == nil {
+		groups = []string{}
+	}
+	return expr.Attributes{
+		"username":     id.id.Username,
+		"email":        id.id.Email,
+		"email_domain": emailDomain,
+		"provider":     id.id.ProviderID.Provider(),
+		"mfa":          mfa,
+		"groups":       groups,
+	}
+}
+
 // Groups returns all the groups associated with the user. The groups
 // include those stored in the identity server's database along with any
 // retrieved by the relevent identity provider's GetGroups method. Once
@@ -472,6 +745,12 @@ func UserOp(u params.Username, action string) bakery.Op {
 	return op(kindUser+"-"+string(u), action)
 }
 
+// GroupOp returns the operation that performs the given action on the
+// Candid-local group with the given name.
+func GroupOp(group string, action string) bakery.Op {
+	return op(kindGroup+"-"+group, action)
+}
+
 func GlobalOp(action string) bakery.Op {
 	return op(kindGlobal, action)
 }
@@ -500,6 +779,30 @@ type groupResolver interface {
 	resolveGroups(context.Context, *store.Identity) ([]string, error)
 }
 
+// AgentExpiresInfo is the ProviderInfo key that holds the time, in
+// RFC3339 format, at which a short-lived agent expires.
+const AgentExpiresInfo = "expires"
+
+// agentExpired reports whether the given identity is an agent that
+// has expired by the given time.
+func agentExpired(identity *store.Identity, now time.Time) bool {
+	if identity.ProviderID.Provider() != "idm" {
+		return false
+	}
+	v := identity.ProviderInfo[AgentExpiresInfo]
+	if len(v) == 0 {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339, v[0])
+	if err != nil {
+		// Treat an agent with an invalid expiry time as
+		// expired rather than risk it living forever.
+		logger.Errorf("invalid expiry time for agent %q: %s", identity.Username, err)
+		return true
+	}
+	return !now.Before(t)
+}
+
 // candidGroupResolver is the group resolver used for identities using
 // the "idm" provider type. These are the agent identites.
 type candidGroupResolver struct {
@@ -513,6 +816,10 @@ type candidGroupResolver struct {
 // owner is also still a member are returned. The result is effectively
 // the union between the agent's groups and the owner's groups.
 func (r candidGroupResolver) resolveGroups(ctx context.Context, identity *store.Identity) ([]string, error) {
+	if agentExpired(identity, time.Now()) {
+		// An expired agent is not a member of any groups.
+		return nil, nil
+	}
 	if identity.Owner == "" {
 		// No owner implies a parent agent. These agents are
 		// members of only the specified groups.
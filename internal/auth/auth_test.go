@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"sort"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/frankban/quicktest/qtsuite"
@@ -22,8 +23,10 @@ import (
 
 	"github.com/CanonicalLtd/candid/idp"
 	"github.com/CanonicalLtd/candid/idp/static"
+	"github.com/CanonicalLtd/candid/internal/agentkeys"
 	"github.com/CanonicalLtd/candid/internal/auth"
 	"github.com/CanonicalLtd/candid/internal/candidtest"
+	"github.com/CanonicalLtd/candid/internal/groupowner"
 	"github.com/CanonicalLtd/candid/store"
 )
 
@@ -38,6 +41,8 @@ type authSuite struct {
 	authorizer    *auth.Authorizer
 	context       context.Context
 	adminAgentKey *bakery.KeyPair
+	agentKeys     *agentkeys.Store
+	groupOwners   *groupowner.Store
 }
 
 const identityLocation = "https://identity.test/id"
@@ -65,6 +70,12 @@ func (s *authSuite) Init(c *qt.C) {
 	ctx, close := s.store.Store.Context(context.Background())
 	c.Defer(close)
 	s.context = ctx
+	kv, err := s.store.ProviderDataStore.KeyValueStore(ctx, agentkeys.StoreName)
+	c.Assert(err, qt.Equals, nil)
+	s.agentKeys = agentkeys.NewStore(kv)
+	kv, err = s.store.ProviderDataStore.KeyValueStore(ctx, groupowner.StoreName)
+	c.Assert(err, qt.Equals, nil)
+	s.groupOwners = groupowner.NewStore(kv)
 	s.authorizer, err = auth.New(auth.Params{
 		AdminPassword:    "password",
 		Location:         identityLocation,
@@ -81,7 +92,9 @@ func (s *authSuite) Init(c *qt.C) {
 				},
 			}),
 		},
-		ACLManager: aclManager,
+		ACLManager:  aclManager,
+		AgentKeys:   s.agentKeys,
+		GroupOwners: s.groupOwners,
 	})
 	c.Assert(err, qt.Equals, nil)
 	s.adminAgentKey, err = bakery.GenerateKey()
@@ -209,6 +222,55 @@ func (s *authSuite) TestUserHasPublicKeyChecker(c *qt.C) {
 	c.Assert(err, qt.ErrorMatches, `caveat.*not satisfied: invalid public key ".*": .*`)
 }
 
+func (s *authSuite) TestUserHasPublicKeyCheckerExpiredKey(c *qt.C) {
+	key1 := bakery.MustGenerateKey()
+	key2 := bakery.MustGenerateKey()
+	s.createIdentity(c, "test-user", &key1.Public)
+	err := s.store.Store.UpdateIdentity(s.context, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "test-user"),
+		PublicKeys: []bakery.PublicKey{key2.Public},
+	}, store.Update{
+		store.PublicKeys: store.Push,
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = s.agentKeys.SetExpiry(s.context, "test-user", &key1.Public, time.Now().Add(-time.Minute))
+	c.Assert(err, qt.Equals, nil)
+	err = s.agentKeys.SetExpiry(s.context, "test-user", &key2.Public, time.Now().Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+
+	checker := auth.NewChecker(s.authorizer)
+	checkCaveat := func(cav checkers.Caveat) error {
+		cav = checker.Namespace().ResolveCaveat(cav)
+		return checker.CheckFirstPartyCaveat(s.context, cav.Condition)
+	}
+	err = checkCaveat(auth.UserHasPublicKeyCaveat("test-user", &key1.Public))
+	c.Assert(err, qt.ErrorMatches, "caveat.*not satisfied: public key expired")
+	err = checkCaveat(auth.UserHasPublicKeyCaveat("test-user", &key2.Public))
+	c.Assert(err, qt.Equals, nil)
+}
+
+func (s *authSuite) TestUserHasPublicKeyCheckerExpiredAgent(c *qt.C) {
+	key := bakery.MustGenerateKey()
+	err := s.store.Store.UpdateIdentity(s.context, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("idm", "a-agent"),
+		Username:   "a-agent@candid",
+		PublicKeys: []bakery.PublicKey{key.Public},
+		ProviderInfo: map[string][]string{
+			auth.AgentExpiresInfo: {time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)},
+		},
+	}, store.Update{
+		store.Username:     store.Set,
+		store.PublicKeys:   store.Set,
+		store.ProviderInfo: store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	checker := auth.NewChecker(s.authorizer)
+	cav := checker.Namespace().ResolveCaveat(auth.UserHasPublicKeyCaveat("a-agent@candid", &key.Public))
+	err = checker.CheckFirstPartyCaveat(s.context, cav.Condition)
+	c.Assert(err, qt.ErrorMatches, "caveat.*not satisfied: agent expired")
+}
+
 var aclForOpTests = []struct {
 	op           bakery.Op
 	expect       []string
@@ -234,6 +296,18 @@ var aclForOpTests = []struct {
 }, {
 	op:     auth.GlobalOp("createAgent"),
 	expect: []string{identchecker.Everyone},
+}, {
+	op:     auth.GlobalOp("readKeys"),
+	expect: []string{auth.AdminUsername},
+}, {
+	op:     auth.GlobalOp("rotateKeys"),
+	expect: []string{auth.AdminUsername},
+}, {
+	op:     auth.GlobalOp("import"),
+	expect: []string{auth.AdminUsername},
+}, {
+	op:     auth.GlobalOp("debug"),
+	expect: []string{auth.AdminUsername},
 }, {
 	op: op("global-foo", "login"),
 }, {
@@ -263,6 +337,31 @@ var aclForOpTests = []struct {
 }, {
 	op:     auth.UserOp("bob", "writeSSHKeys"),
 	expect: []string{"bob", auth.AdminUsername},
+}, {
+	op:     auth.UserOp("bob", "revokeAccess"),
+	expect: []string{"bob", auth.AdminUsername},
+}, {
+	op:     auth.UserOp("bob", "writeAgentKeys"),
+	expect: []string{"bob", auth.AdminUsername},
+}, {
+	op:     auth.UserOp("bob", "readSensitive"),
+	expect: []string{auth.AdminUsername},
+}, {
+	op:     auth.UserOp("bob", "writeSensitive"),
+	expect: []string{auth.AdminUsername},
+}, {
+	op:     auth.UserOp("bob", "explain"),
+	expect: []string{"bob", auth.AdminUsername},
+}, {
+	op: auth.GroupOp("", "writeMembers"),
+}, {
+	op:     auth.GroupOp("prod", "writeMembers"),
+	expect: []string{auth.AdminUsername},
+}, {
+	op: auth.GroupOp("prod", "unknown"),
+}, {
+	op:     auth.GlobalOp("writeGroupOwners"),
+	expect: []string{auth.AdminUsername},
 }}
 
 func (s *authSuite) TestACLForOp(c *qt.C) {
@@ -278,6 +377,72 @@ func (s *authSuite) TestACLForOp(c *qt.C) {
 	}
 }
 
+func (s *authSuite) TestGroupOwners(c *qt.C) {
+	err := s.groupOwners.SetOwners(s.context, "prod", []string{"bob", "ops-leads"})
+	c.Assert(err, qt.Equals, nil)
+	acl, _, err := auth.AuthorizerACLForOp(s.authorizer, s.context, auth.GroupOp("prod", auth.ActionWriteMembers))
+	c.Assert(err, qt.Equals, nil)
+	sort.Strings(acl)
+	c.Assert(acl, qt.DeepEquals, []string{auth.AdminUsername, "bob", "ops-leads"})
+
+	bob := s.createIdentity(c, "bob", nil)
+	ok, err := s.authorizer.Allow(s.context, bob, auth.GroupOp("prod", auth.ActionWriteMembers))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ok, qt.Equals, true)
+	ok, err = s.authorizer.Allow(s.context, bob, auth.GroupOp("db", auth.ActionWriteMembers))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ok, qt.Equals, false)
+}
+
+func (s *authSuite) TestAllow(c *qt.C) {
+	bob := s.createIdentity(c, "bob", nil)
+	ok, err := s.authorizer.Allow(s.context, bob, auth.UserOp("bob", auth.ActionReadSSHKeys))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ok, qt.Equals, true)
+	ok, err = s.authorizer.Allow(s.context, bob, auth.UserOp("bob", auth.ActionReadSensitive))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ok, qt.Equals, false)
+	ok, err = s.authorizer.Allow(s.context, nil, auth.UserOp("bob", auth.ActionReadSSHKeys))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ok, qt.Equals, false)
+}
+
+func (s *authSuite) TestExplain(c *qt.C) {
+	id := s.createIdentity(c, "testuser", nil)
+	e, err := id.Explain(s.context, []string{"othergroup", "somegroup"})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(e, qt.DeepEquals, &auth.Explanation{
+		Allowed:     true,
+		Rule:        auth.RuleGroup,
+		Match:       "somegroup",
+		ACL:         []string{"othergroup", "somegroup"},
+		Groups:      []string{"somegroup"},
+		GroupSource: "identity provider test",
+	})
+	c.Assert(e.String(), qt.Equals, "access granted by membership of group somegroup (groups from identity provider test)")
+
+	e, err = id.Explain(s.context, []string{"othergroup"})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(e.Allowed, qt.Equals, false)
+	c.Assert(e.Rule, qt.Equals, auth.RuleNoMatch)
+	c.Assert(e.String(), qt.Equals, "access denied: none of the groups [somegroup] (from identity provider test) match [othergroup]")
+
+	e, err = id.Explain(s.context, []string{"testuser"})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(e.Allowed, qt.Equals, true)
+	c.Assert(e.Rule, qt.Equals, auth.RuleUsername)
+
+	e, err = id.Explain(s.context, []string{"everyone"})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(e.Allowed, qt.Equals, true)
+	c.Assert(e.Rule, qt.Equals, auth.RuleEveryone)
+
+	e, err = id.Explain(s.context, nil)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(e.Allowed, qt.Equals, false)
+	c.Assert(e.Rule, qt.Equals, auth.RuleEmptyACL)
+}
+
 func (s *authSuite) TestAdminUserGroups(c *qt.C) {
 	ctx := auth.ContextWithUserCredentials(context.Background(), "admin", "password")
 	authInfo, err := s.authorizer.Auth(ctx, nil, identchecker.LoginOp)
@@ -360,6 +525,19 @@ var identityAllowTests = []struct {
 	acl:           []string{"othergroup"},
 	groups:        []string{"somegroup"},
 	expectAllowed: false,
+}, {
+	about:         "user is allowed if they satisfy an expression",
+	acl:           []string{"othergroup", `expr:provider == "test" && "x" in groups`},
+	groups:        []string{"x"},
+	expectAllowed: true,
+}, {
+	about:         "user is not allowed if they don't satisfy an expression",
+	acl:           []string{`expr:provider == "test" && mfa`},
+	expectAllowed: false,
+}, {
+	about:         "invalid expressions are never satisfied",
+	acl:           []string{`expr:provider ==`},
+	expectAllowed: false,
 }}
 
 func (s *authSuite) TestIdentityAllow(c *qt.C) {
@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"context"
 	"strings"
+	"time"
 
 	"gopkg.in/CanonicalLtd/candidclient.v1/params"
 	"gopkg.in/errgo.v1"
@@ -14,6 +15,7 @@ import (
 	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 
+	"github.com/CanonicalLtd/candid/idp/idputil"
 	"github.com/CanonicalLtd/candid/store"
 )
 
@@ -22,6 +24,20 @@ const (
 	userHasPublicKeyCondition = "user-has-public-key"
 )
 
+// ImpersonatedByAttribute is the declared attribute that holds the
+// username of the user that is impersonating the declared user.
+const ImpersonatedByAttribute = "impersonated-by"
+
+// AuthLevelAttribute is the declared attribute that holds the level at
+// which the declared user authenticated. It is only declared for users
+// that authenticated using multiple factors, when it holds
+// AuthLevelStrong.
+const AuthLevelAttribute = "auth-level"
+
+// AuthLevelStrong is the value of AuthLevelAttribute for users that
+// authenticated using multiple factors.
+const AuthLevelStrong = idputil.AuthLevelStrong
+
 // Namespace contains the checkers.Namespace supported by the identity
 // service.
 var Namespace = checkers.NewNamespace(map[string]string{
@@ -65,10 +81,32 @@ func (a *Authorizer) checkUserHasPublicKey(ctx context.Context, cond, arg string
 		}
 		return errgo.Newf("public key not valid for user")
 	}
+	if agentExpired(&identity, time.Now()) {
+		return errgo.Newf("agent expired")
+	}
 	for _, pk := range identity.PublicKeys {
-		if bytes.Equal(pk.Key[:], publicKey.Key[:]) {
+		if !bytes.Equal(pk.Key[:], publicKey.Key[:]) {
+			continue
+		}
+		if a.agentKeys == nil {
 			return nil
 		}
+		expired, err := a.agentKeys.Expired(ctx, identity.Username, &publicKey, time.Now())
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if expired {
+			return errgo.Newf("public key expired")
+		}
+		return nil
 	}
 	return errgo.Newf("public key not valid for user")
 }
+
+// ImpersonationCaveat creates a first-party caveat that declares that
+// the authenticated user is being impersonated by the given user.
+// Relying services can detect impersonated sessions by checking for the
+// ImpersonatedByAttribute in the declared attributes.
+func ImpersonationCaveat(impersonator string) checkers.Caveat {
+	return checkers.DeclaredCaveat(ImpersonatedByAttribute, impersonator)
+}
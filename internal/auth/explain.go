@@ -0,0 +1,114 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+)
+
+// The following constants define the rules that can decide an
+// authorization check.
+const (
+	RuleEmptyACL = "empty-acl"
+	RuleEveryone = "everyone"
+	RuleUsername = "username"
+	RuleGroup    = "group"
+	RuleNoMatch  = "no-match"
+)
+
+// An Explanation describes why an identity was, or was not, granted
+// access by an ACL.
+type Explanation struct {
+	// Allowed holds whether access was granted.
+	Allowed bool `json:"allowed"`
+
+	// Rule holds the rule that decided the check.
+	Rule string `json:"rule"`
+
+	// Match holds the ACL entry that granted access, if any.
+	Match string `json:"match,omitempty"`
+
+	// ACL holds the ACL that was checked.
+	ACL []string `json:"acl"`
+
+	// Groups holds the groups of the identity that were considered.
+	Groups []string `json:"groups,omitempty"`
+
+	// GroupSource describes where the groups of the identity came
+	// from.
+	GroupSource string `json:"group-source,omitempty"`
+}
+
+// String returns a human readable form of the explanation.
+func (e *Explanation) String() string {
+	switch e.Rule {
+	case RuleEmptyACL:
+		return "access denied by an empty ACL"
+	case RuleEveryone:
+		return "access granted to everyone"
+	case RuleUsername:
+		return fmt.Sprintf("access granted to user %s", e.Match)
+	case RuleGroup:
+		return fmt.Sprintf("access granted by membership of group %s (groups from %s)", e.Match, e.GroupSource)
+	}
+	return fmt.Sprintf("access denied: none of the groups [%s] (from %s) match [%s]", strings.Join(e.Groups, " "), e.GroupSource, strings.Join(e.ACL, " "))
+}
+
+// Explain performs the same check as Allow, returning an explanation of
+// the decision.
+func (id *Identity) Explain(ctx context.Context, acl []string) (*Explanation, error) {
+	e := &Explanation{
+		ACL: acl,
+	}
+	if len(acl) == 0 {
+		e.Rule = RuleEmptyACL
+		return e, nil
+	}
+	for _, name := range acl {
+		if name == "everyone" || name == id.id.Username {
+			e.Allowed = true
+			e.Match = name
+			e.Rule = RuleUsername
+			if name == "everyone" {
+				e.Rule = RuleEveryone
+			}
+			return e, nil
+		}
+	}
+	groups, err := id.Groups(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	e.Groups = groups
+	e.GroupSource = id.groupSource()
+	e.Rule = RuleNoMatch
+	for _, a := range acl {
+		for _, g := range groups {
+			if g == a {
+				e.Allowed = true
+				e.Match = g
+				e.Rule = RuleGroup
+				return e, nil
+			}
+		}
+	}
+	return e, nil
+}
+
+// groupSource describes where the groups returned by Groups come from.
+func (id *Identity) groupSource() string {
+	provider := id.id.ProviderID.Provider()
+	if id.authorizer.groupResolvers[provider] == nil {
+		return "the identity database"
+	}
+	if provider == "idm" {
+		return "the agent and its owner"
+	}
+	return "identity provider " + provider
+}
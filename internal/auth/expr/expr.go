@@ -0,0 +1,420 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package expr implements the policy expressions that may be used in
+// ACLs. The expressions use a subset of the Common Expression Language
+// (CEL) syntax, for example:
+//
+//	provider == "ldap" && mfa
+//	"ops" in groups || email_domain in ["example.com", "example.org"]
+//
+// An expression is made up of string literals (in single or double
+// quotes), the literals true and false, lists of string literals,
+// attribute names, the comparison operators == and !=, the membership
+// operator in, the logical operators &&, || and !, and parentheses.
+// Every expression must evaluate to a boolean.
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gopkg.in/errgo.v1"
+)
+
+// Attributes holds the attributes that an expression is evaluated
+// against. Each value must be a string, bool or []string.
+type Attributes map[string]interface{}
+
+// An Expr is a parsed expression.
+type Expr struct {
+	src  string
+	root node
+}
+
+// Parse parses the given expression.
+func Parse(s string) (*Expr, error) {
+	toks, err := tokenize(s)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot parse %q", s)
+	}
+	p := &parser{toks: toks}
+	n, err := p.parseOr()
+	if err == nil && p.peek().kind != tokEOF {
+		err = errgo.Newf("unexpected %s", p.peek())
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot parse %q", s)
+	}
+	return &Expr{src: s, root: n}, nil
+}
+
+// String returns the source of the expression.
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Eval evaluates the expression against the given attributes.
+func (e *Expr) Eval(attrs Attributes) (bool, error) {
+	v, err := e.root.eval(attrs)
+	if err != nil {
+		return false, errgo.Notef(err, "cannot evaluate %q", e.src)
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, errgo.Newf("cannot evaluate %q: result is %s not bool", e.src, typeName(v))
+	}
+	return b, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+var operators = []string{"==", "!=", "&&", "||", "!", "(", ")", "[", "]", ","}
+
+func tokenize(s string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			j := strings.IndexByte(s[i+1:], c)
+			if j < 0 {
+				return nil, errgo.Newf("unterminated string")
+			}
+			toks = append(toks, token{tokString, s[i+1 : i+1+j]})
+			i += j + 2
+		case isIdentChar(rune(c)):
+			j := i
+			for j < len(s) && isIdentChar(rune(s[j])) {
+				j++
+			}
+			toks = append(toks, token{tokIdent, s[i:j]})
+			i = j
+		default:
+			found := false
+			for _, op := range operators {
+				if strings.HasPrefix(s[i:], op) {
+					toks = append(toks, token{tokOp, op})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, errgo.Newf("unexpected character %q", c)
+			}
+		}
+	}
+	return append(toks, token{kind: tokEOF}), nil
+}
+
+func isIdentChar(r rune) bool {
+	return r == '_' || r == '.' || r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.text == op
+}
+
+func (p *parser) expect(op string) error {
+	if !p.isOp(op) {
+		return errgo.Newf("expected %q, found %s", op, p.peek())
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	n, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.next()
+		m, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		n = orNode{n, m}
+	}
+	return n, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	n, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.next()
+		m, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		n = andNode{n, m}
+	}
+	return n, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.isOp("!") {
+		p.next()
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	n, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	switch {
+	case t.kind == tokOp && (t.text == "==" || t.text == "!="):
+	case t.kind == tokIdent && t.text == "in":
+	default:
+		return n, nil
+	}
+	p.next()
+	m, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	switch t.text {
+	case "==":
+		return eqNode{n, m}, nil
+	case "!=":
+		return notNode{eqNode{n, m}}, nil
+	}
+	return inNode{n, m}, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return literal{t.text}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return literal{true}, nil
+		case "false":
+			return literal{false}, nil
+		case "in":
+			return nil, errgo.Newf("unexpected %s", t)
+		}
+		return attr(t.text), nil
+	case tokOp:
+		switch t.text {
+		case "(":
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return n, nil
+		case "[":
+			var l []string
+			for !p.isOp("]") {
+				if len(l) > 0 {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+				s := p.next()
+				if s.kind != tokString {
+					return nil, errgo.Newf("expected string in list, found %s", s)
+				}
+				l = append(l, s.text)
+			}
+			p.next()
+			return literal{l}, nil
+		}
+	}
+	return nil, errgo.Newf("unexpected %s", t)
+}
+
+type node interface {
+	eval(Attributes) (interface{}, error)
+}
+
+type literal struct {
+	v interface{}
+}
+
+func (n literal) eval(Attributes) (interface{}, error) {
+	return n.v, nil
+}
+
+type attr string
+
+func (n attr) eval(attrs Attributes) (interface{}, error) {
+	v, ok := attrs[string(n)]
+	if !ok {
+		return nil, errgo.Newf("unknown attribute %q", string(n))
+	}
+	return v, nil
+}
+
+type notNode struct {
+	n node
+}
+
+func (n notNode) eval(attrs Attributes) (interface{}, error) {
+	b, err := evalBool(n.n, attrs)
+	if err != nil {
+		return nil, err
+	}
+	return !b, nil
+}
+
+type andNode struct {
+	a, b node
+}
+
+func (n andNode) eval(attrs Attributes) (interface{}, error) {
+	a, err := evalBool(n.a, attrs)
+	if err != nil || !a {
+		return false, err
+	}
+	return evalBool(n.b, attrs)
+}
+
+type orNode struct {
+	a, b node
+}
+
+func (n orNode) eval(attrs Attributes) (interface{}, error) {
+	a, err := evalBool(n.a, attrs)
+	if err != nil || a {
+		return a, err
+	}
+	return evalBool(n.b, attrs)
+}
+
+type eqNode struct {
+	a, b node
+}
+
+func (n eqNode) eval(attrs Attributes) (interface{}, error) {
+	a, err := n.a.eval(attrs)
+	if err != nil {
+		return nil, err
+	}
+	b, err := n.b.eval(attrs)
+	if err != nil {
+		return nil, err
+	}
+	switch a := a.(type) {
+	case string:
+		if b, ok := b.(string); ok {
+			return a == b, nil
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			return a == b, nil
+		}
+	}
+	return nil, errgo.Newf("cannot compare %s with %s", typeName(a), typeName(b))
+}
+
+type inNode struct {
+	a, b node
+}
+
+func (n inNode) eval(attrs Attributes) (interface{}, error) {
+	a, err := n.a.eval(attrs)
+	if err != nil {
+		return nil, err
+	}
+	b, err := n.b.eval(attrs)
+	if err != nil {
+		return nil, err
+	}
+	s, ok1 := a.(string)
+	l, ok2 := b.([]string)
+	if !ok1 || !ok2 {
+		return nil, errgo.Newf("cannot use %s in %s", typeName(a), typeName(b))
+	}
+	for _, v := range l {
+		if v == s {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func evalBool(n node, attrs Attributes) (bool, error) {
+	v, err := n.eval(attrs)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, errgo.Newf("%s is not bool", typeName(v))
+	}
+	return b, nil
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case []string:
+		return "list"
+	}
+	return fmt.Sprintf("%T", v)
+}
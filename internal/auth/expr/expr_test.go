@@ -0,0 +1,117 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package expr_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/internal/auth/expr"
+)
+
+var testAttributes = expr.Attributes{
+	"username":     "bob",
+	"email_domain": "example.com",
+	"provider":     "ldap",
+	"mfa":          true,
+	"groups":       []string{"ops", "dev"},
+}
+
+var evalTests = []struct {
+	about       string
+	expr        string
+	expect      bool
+	expectError string
+}{{
+	about:  "equality",
+	expr:   `provider == "ldap"`,
+	expect: true,
+}, {
+	about:  "inequality",
+	expr:   `provider != 'ldap'`,
+	expect: false,
+}, {
+	about:  "bool attribute",
+	expr:   `provider == "ldap" && mfa`,
+	expect: true,
+}, {
+	about:  "group membership",
+	expr:   `"ops" in groups`,
+	expect: true,
+}, {
+	about:  "list literal",
+	expr:   `email_domain in ["example.org", "example.com"]`,
+	expect: true,
+}, {
+	about:  "precedence",
+	expr:   `username == "alice" || "dev" in groups && !mfa`,
+	expect: false,
+}, {
+	about:  "parentheses",
+	expr:   `(username == "alice" || "dev" in groups) && mfa == true`,
+	expect: true,
+}, {
+	about:       "unknown attribute",
+	expr:        `country == "uk"`,
+	expectError: `cannot evaluate "country == \\"uk\\"": unknown attribute "country"`,
+}, {
+	about:       "type mismatch",
+	expr:        `mfa == "true"`,
+	expectError: `cannot evaluate .*: cannot compare bool with string`,
+}, {
+	about:       "non-bool result",
+	expr:        `provider`,
+	expectError: `cannot evaluate "provider": result is string not bool`,
+}}
+
+func TestEval(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range evalTests {
+		c.Run(test.about, func(c *qt.C) {
+			e, err := expr.Parse(test.expr)
+			c.Assert(err, qt.Equals, nil)
+			ok, err := e.Eval(testAttributes)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(ok, qt.Equals, test.expect)
+		})
+	}
+}
+
+var parseErrorTests = []struct {
+	expr        string
+	expectError string
+}{{
+	expr:        `provider == `,
+	expectError: `cannot parse "provider == ": unexpected end of expression`,
+}, {
+	expr:        `(mfa`,
+	expectError: `cannot parse "\(mfa": expected "\)", found end of expression`,
+}, {
+	expr:        `"ldap`,
+	expectError: `cannot parse "\\"ldap": unterminated string`,
+}, {
+	expr:        `mfa mfa`,
+	expectError: `cannot parse "mfa mfa": unexpected "mfa"`,
+}, {
+	expr:        `provider in [mfa]`,
+	expectError: `cannot parse .*: expected string in list, found "mfa"`,
+}, {
+	expr:        `provider = "ldap"`,
+	expectError: `cannot parse .*: unexpected character '='`,
+}}
+
+func TestParseError(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range parseErrorTests {
+		c.Run(test.expr, func(c *qt.C) {
+			_, err := expr.Parse(test.expr)
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+		})
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package awssig_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/internal/awssig"
+)
+
+func TestSign(t *testing.T) {
+	c := qt.New(t)
+	// This is the example request from the AWS signature version 4
+	// documentation.
+	req, err := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	c.Assert(err, qt.Equals, nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	awssig.Sign(req, nil, "iam", "us-east-1", awssig.Credentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	c.Assert(req.Header.Get("X-Amz-Date"), qt.Equals, "20150830T123600Z")
+	c.Assert(req.Header.Get("Authorization"), qt.Equals, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7")
+}
+
+func TestSignSessionToken(t *testing.T) {
+	c := qt.New(t)
+	req, err := http.NewRequest("POST", "https://dynamodb.us-east-1.amazonaws.com", nil)
+	c.Assert(err, qt.Equals, nil)
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "DynamoDB_20120810.GetItem")
+	awssig.Sign(req, []byte("{}"), "dynamodb", "us-east-1", awssig.Credentials{
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+		SessionToken:    "token",
+	}, time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC))
+	c.Assert(req.Header.Get("X-Amz-Security-Token"), qt.Equals, "token")
+	c.Assert(req.Header.Get("Authorization"), qt.Matches, `AWS4-HMAC-SHA256 Credential=AKID/20191001/us-east-1/dynamodb/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-security-token;x-amz-target, Signature=[0-9a-f]{64}`)
+}
@@ -0,0 +1,349 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package canary implements a synthetic monitor that periodically logs
+// in to the identity server, so that outages are detected by the server
+// itself rather than by its users.
+package canary
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/CanonicalLtd/candidclient.v1/redirect"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+	"gopkg.in/macaroon-bakery.v2/httpbakery/agent"
+	macaroon "gopkg.in/macaroon.v2"
+
+	"github.com/CanonicalLtd/candid/internal/auth"
+	"github.com/CanonicalLtd/candid/internal/monitoring"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+var logger = loggo.GetLogger("candid.internal.canary")
+
+// DefaultAgentUsername is the username of the canary agent if none is
+// specified.
+const DefaultAgentUsername = "canary@candid"
+
+// The names of the checks performed by the monitor, as recorded in the
+// metrics.
+const (
+	AgentCheck = "agent"
+	LoginCheck = "login"
+)
+
+// Params holds the configuration of the canary monitor.
+type Params struct {
+	// Interval holds the time between checks. If this is zero then
+	// the canary monitor is disabled.
+	Interval time.Duration
+
+	// AgentUsername holds the username of the canary agent. The
+	// username must be in the @candid domain. If this is empty then
+	// DefaultAgentUsername will be used.
+	AgentUsername string
+
+	// AgentKey holds the key of the canary agent. This must be
+	// specified if the monitor is enabled.
+	AgentKey *bakery.KeyPair
+
+	// LoginIDP, LoginUsername and LoginPassword optionally hold the
+	// name of an identity provider that uses a username & password
+	// login form (such as the static identity provider) and the
+	// credentials to use with it. If these are set then each check
+	// also performs a scripted interactive login.
+	LoginIDP      string
+	LoginUsername string
+	LoginPassword string
+}
+
+// MonitorParams holds the parameters for a new Monitor.
+type MonitorParams struct {
+	Params
+
+	// Location holds the externally accessible URL of the identity
+	// server.
+	Location string
+
+	// Oven holds the oven used to mint macaroons in the identity
+	// server.
+	Oven *bakery.Oven
+
+	// Authorizer holds the authorizer used to verify macaroons in
+	// the identity server.
+	Authorizer *auth.Authorizer
+
+	// Store holds the identity store.
+	Store store.Store
+
+	// Metrics holds the metrics that record the results of the
+	// checks.
+	Metrics *monitoring.CanaryMetrics
+}
+
+// A Monitor periodically performs synthetic logins to the identity
+// server.
+type Monitor struct {
+	p      MonitorParams
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// New creates a new Monitor with the given parameters.
+func New(p MonitorParams) (*Monitor, error) {
+	if p.AgentUsername == "" {
+		p.AgentUsername = DefaultAgentUsername
+	}
+	if !strings.HasSuffix(p.AgentUsername, "@candid") {
+		return nil, errgo.Newf("canary agent username %q not in @candid domain", p.AgentUsername)
+	}
+	if p.AgentKey == nil {
+		return nil, errgo.Newf("no canary agent key specified")
+	}
+	return &Monitor{
+		p:      p,
+		closed: make(chan struct{}),
+	}, nil
+}
+
+// Start ensures that the canary agent exists and then starts performing
+// checks in the background. The checks continue until Close is called.
+func (m *Monitor) Start(ctx context.Context) error {
+	name := strings.TrimSuffix(m.p.AgentUsername, "@candid")
+	err := m.p.Store.UpdateIdentity(
+		ctx,
+		&store.Identity{
+			ProviderID: store.MakeProviderIdentity("idm", name),
+			Username:   m.p.AgentUsername,
+			Name:       "Canary Agent",
+			PublicKeys: []bakery.PublicKey{m.p.AgentKey.Public},
+		},
+		store.Update{
+			store.Username:   store.Set,
+			store.Name:       store.Set,
+			store.PublicKeys: store.Set,
+		},
+	)
+	if err != nil {
+		return errgo.Notef(err, "cannot create canary agent")
+	}
+	m.wg.Add(1)
+	go m.run()
+	return nil
+}
+
+// Close stops the monitor and waits for any check in progress to
+// complete.
+func (m *Monitor) Close() {
+	close(m.closed)
+	m.wg.Wait()
+}
+
+func (m *Monitor) run() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(m.p.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.check()
+		case <-m.closed:
+			return
+		}
+	}
+}
+
+// check performs a single round of checks.
+func (m *Monitor) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.p.Interval)
+	defer cancel()
+	ctx, closeStore := m.p.Store.Context(ctx)
+	defer closeStore()
+
+	start := time.Now()
+	err := m.CheckAgent(ctx)
+	m.p.Metrics.CheckCompleted(AgentCheck, start, err)
+	if err != nil {
+		logger.Errorf("canary agent check failed: %s", err)
+	}
+	if m.p.LoginIDP == "" {
+		return
+	}
+	start = time.Now()
+	err = m.CheckLogin(ctx)
+	m.p.Metrics.CheckCompleted(LoginCheck, start, err)
+	if err != nil {
+		logger.Errorf("canary login check failed: %s", err)
+	}
+}
+
+// CheckAgent performs a complete discharge of a third-party caveat
+// addressed to the identity server using the canary agent, and checks
+// that the discharged macaroon authenticates the agent.
+func (m *Monitor) CheckAgent(ctx context.Context) error {
+	mac, err := m.p.Oven.NewMacaroon(
+		ctx,
+		bakery.LatestVersion,
+		[]checkers.Caveat{
+			checkers.TimeBeforeCaveat(time.Now().Add(m.p.Interval)),
+			{
+				Location:  m.p.Location,
+				Condition: "is-authenticated-user",
+			},
+		},
+		identchecker.LoginOp,
+	)
+	if err != nil {
+		return errgo.Notef(err, "cannot create macaroon")
+	}
+	client := &httpbakery.Client{
+		Client: httpbakery.NewHTTPClient(),
+		Key:    m.p.AgentKey,
+	}
+	agent.SetUpAuth(client, &agent.AuthInfo{
+		Key: m.p.AgentKey,
+		Agents: []agent.Agent{{
+			URL:      m.p.Location,
+			Username: m.p.AgentUsername,
+		}},
+	})
+	ms, err := client.DischargeAll(ctx, mac)
+	if err != nil {
+		return errgo.Notef(err, "cannot discharge macaroon")
+	}
+	return errgo.Mask(m.checkIdentity(ctx, ms, m.p.AgentUsername))
+}
+
+// CheckLogin performs a scripted interactive login with the configured
+// identity provider and checks that the resulting discharge token
+// authenticates the user.
+func (m *Monitor) CheckLogin(ctx context.Context) error {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	// Find the login URL for the identity provider.
+	v := url.Values{
+		"return_to": {m.p.Location + "/login-complete"},
+		"state":     {"canary"},
+	}
+	req, err := http.NewRequest("GET", m.p.Location+"/login-redirect?"+v.Encode(), nil)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	var choice params.IDPChoice
+	if err := do(ctx, client, req, http.StatusOK, &choice); err != nil {
+		return errgo.Notef(err, "cannot get login methods")
+	}
+	var loginURL string
+	for _, idp := range choice.IDPs {
+		if idp.Name == m.p.LoginIDP {
+			loginURL = idp.URL
+		}
+	}
+	if loginURL == "" {
+		return errgo.Newf("identity provider %q not found", m.p.LoginIDP)
+	}
+
+	// Log in to the identity provider.
+	req, err = http.NewRequest("POST", loginURL, strings.NewReader(url.Values{
+		"username": {m.p.LoginUsername},
+		"password": {m.p.LoginPassword},
+	}.Encode()))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errgo.Notef(err, "cannot log in")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		return errgo.Newf("cannot log in: unexpected status %q", resp.Status)
+	}
+	u, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return errgo.Notef(err, "cannot log in")
+	}
+	if msg := u.Query().Get("error"); msg != "" {
+		return errgo.Newf("cannot log in: %s", msg)
+	}
+
+	// Collect the discharge token.
+	body, err := json.Marshal(map[string]string{"code": u.Query().Get("code")})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req, err = http.NewRequest("POST", m.p.Location+"/discharge-token", bytes.NewReader(body))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var dtresp redirect.DischargeTokenResponse
+	if err := do(ctx, client, req, http.StatusOK, &dtresp); err != nil {
+		return errgo.Notef(err, "cannot get discharge token")
+	}
+	if dtresp.DischargeToken == nil || dtresp.DischargeToken.Kind != "macaroon" {
+		return errgo.Newf("unexpected discharge token")
+	}
+	var mac macaroon.Macaroon
+	if err := mac.UnmarshalBinary(dtresp.DischargeToken.Value); err != nil {
+		return errgo.Notef(err, "invalid discharge token")
+	}
+	return errgo.Mask(m.checkIdentity(ctx, macaroon.Slice{&mac}, ""))
+}
+
+// checkIdentity checks that the given macaroons authenticate a user. If
+// username is not empty then the authenticated user must have that
+// username.
+func (m *Monitor) checkIdentity(ctx context.Context, ms macaroon.Slice, username string) error {
+	authInfo, err := m.p.Authorizer.Auth(ctx, []macaroon.Slice{ms}, identchecker.LoginOp)
+	if err != nil {
+		return errgo.Notef(err, "cannot verify macaroon")
+	}
+	if authInfo.Identity == nil {
+		return errgo.Newf("macaroon does not authenticate a user")
+	}
+	if username != "" && authInfo.Identity.Id() != username {
+		return errgo.Newf("authenticated as %q, expected %q", authInfo.Identity.Id(), username)
+	}
+	return nil
+}
+
+// do performs the given request and unmarshals the JSON response into
+// v. The response must have the given status code.
+func do(ctx context.Context, client *http.Client, req *http.Request, status int, v interface{}) error {
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		return errgo.Newf("unexpected status %q", resp.Status)
+	}
+	return errgo.Mask(httprequest.UnmarshalJSONResponse(resp, v))
+}
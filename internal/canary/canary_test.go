@@ -0,0 +1,89 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package canary_test
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/static"
+	"github.com/CanonicalLtd/candid/internal/canary"
+	"github.com/CanonicalLtd/candid/internal/candidtest"
+	"github.com/CanonicalLtd/candid/internal/discharger"
+	"github.com/CanonicalLtd/candid/internal/identity"
+)
+
+func TestCanary(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store := candidtest.NewStore()
+	sp := store.ServerParams()
+	sp.IdentityProviders = []idp.IdentityProvider{
+		static.NewIdentityProvider(static.Params{
+			Name: "test",
+			Users: map[string]static.UserInfo{
+				"canary": {
+					Password: "canarypassword",
+				},
+			},
+		}),
+	}
+	sp.Canary = canary.Params{
+		Interval:      10 * time.Millisecond,
+		AgentKey:      bakery.MustGenerateKey(),
+		LoginIDP:      "test",
+		LoginUsername: "canary",
+		LoginPassword: "canarypassword",
+	}
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+
+	for _, check := range []string{canary.AgentCheck, canary.LoginCheck} {
+		metric := `candid_canary_checks_total{check="` + check + `",result="success"}`
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			resp := srv.Get(c, "/metrics")
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			c.Assert(err, qt.Equals, nil)
+			if strings.Contains(string(body), metric) {
+				break
+			}
+			if time.Now().After(deadline) {
+				c.Fatalf("no successful %s check recorded", check)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestNewInvalidUsername(t *testing.T) {
+	c := qt.New(t)
+	_, err := canary.New(canary.MonitorParams{
+		Params: canary.Params{
+			Interval:      time.Minute,
+			AgentUsername: "canary",
+			AgentKey:      bakery.MustGenerateKey(),
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `canary agent username "canary" not in @candid domain`)
+}
+
+func TestNewNoKey(t *testing.T) {
+	c := qt.New(t)
+	_, err := canary.New(canary.MonitorParams{
+		Params: canary.Params{
+			Interval: time.Minute,
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `no canary agent key specified`)
+}
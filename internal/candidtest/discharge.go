@@ -157,13 +157,14 @@ func OpenWebBrowser(c *qt.C, rh ResponseHandler) func(u *url.URL) error {
 func PostLoginForm(username, password string) ResponseHandler {
 	return func(client *http.Client, resp *http.Response) (*http.Response, error) {
 		defer resp.Body.Close()
-		purl, err := LoginFormAction(resp)
+		purl, csrfToken, err := parseLoginForm(resp)
 		if err != nil {
 			return nil, errgo.Mask(err)
 		}
 		resp, err = client.PostForm(purl, url.Values{
-			"username": {username},
-			"password": {password},
+			"username":   {username},
+			"password":   {password},
+			"csrf_token": {csrfToken},
 		})
 		return resp, errgo.Mask(err, errgo.Any)
 	}
@@ -215,20 +216,30 @@ func SelectInteractiveLogin(rh ResponseHandler) ResponseHandler {
 
 // LoginFormAction gets the action parameter (POST URL) of a login form.
 func LoginFormAction(resp *http.Response) (string, error) {
+	purl, _, err := parseLoginForm(resp)
+	return purl, errgo.Mask(err, errgo.Any)
+}
+
+// parseLoginForm returns the action and CSRF token of the login form
+// in the given response.
+func parseLoginForm(resp *http.Response) (action, csrfToken string, _ error) {
 	buf, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", errgo.Mask(err, errgo.Any)
+		return "", "", errgo.Mask(err, errgo.Any)
 	}
 	// It is expected that the "login-form" template in this
 	// package will have been used to generate the response.
 	// This puts the "Action" (POST URL) parameter on the
-	// first line by itself.
+	// first line by itself and the CSRF token on the third.
 	parts := bytes.Split(buf, []byte("\n"))
-	purl := string(parts[0])
-	if len(purl) == 0 {
-		purl = resp.Request.URL.String()
+	action = string(parts[0])
+	if len(action) == 0 {
+		action = resp.Request.URL.String()
+	}
+	if len(parts) > 2 {
+		csrfToken = string(parts[2])
 	}
-	return purl, nil
+	return action, csrfToken, nil
 }
 
 // PasswordLogin return a function that can be used with
@@ -31,13 +31,15 @@ func init() {
 	template.Must(DefaultTemplate.New("authentication-required").Parse(authenticationRequiredTemplate))
 	template.Must(DefaultTemplate.New("login").Parse(loginTemplate))
 	template.Must(DefaultTemplate.New("login-form").Parse(loginFormTemplate))
+	template.Must(DefaultTemplate.New("logout-confirm").Parse(logoutConfirmTemplate))
 }
 
 const (
 	// This format is interpretted by SelectInteractiveLogin.
 	authenticationRequiredTemplate = "{{range .IDPs}}{{.URL}}\n{{end}}"
 	loginTemplate                  = "login successful as user {{.Username}}\n"
-	loginFormTemplate              = "{{.Action}}\n{{.Error}}\n"
+	loginFormTemplate              = "{{.Action}}\n{{.Error}}\n{{.CSRFToken}}\n"
+	logoutConfirmTemplate          = "{{.Action}}\n{{.CSRFToken}}\n"
 )
 
 // Server implements a test fixture that contains a candid server.
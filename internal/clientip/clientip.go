@@ -0,0 +1,119 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package clientip determines the IP address of the client that made
+// an HTTP request when the server may be running behind trusted
+// reverse proxies.
+package clientip
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// A Resolver determines the addresses of clients. A nil Resolver
+// trusts no proxies and always uses the address of the peer.
+type Resolver struct {
+	trusted []*net.IPNet
+}
+
+// New returns a Resolver that trusts the X-Forwarded-For header added
+// by proxies with addresses in any of the given CIDR ranges. A plain IP
+// address is treated as a range holding only that address. If no
+// ranges are given then New returns nil.
+func New(cidrs []string) (*Resolver, error) {
+	if len(cidrs) == 0 {
+		return nil, nil
+	}
+	r := new(Resolver)
+	for _, s := range cidrs {
+		n, err := ParseCIDR(s)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		r.trusted = append(r.trusted, n)
+	}
+	return r, nil
+}
+
+// ParseCIDR parses s as a CIDR range, or as a single IP address.
+func ParseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errgo.Newf("invalid address %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, errgo.Newf("invalid CIDR %q", s)
+	}
+	return n, nil
+}
+
+// Address returns the IP address of the client that made the given
+// request. If the peer is a trusted proxy then the X-Forwarded-For
+// header is read from right to left, skipping the addresses of trusted
+// proxies; the first untrusted address is the client. Addresses added
+// by untrusted peers are never used, so a client cannot choose its own
+// address by sending the header itself.
+func (r *Resolver) Address(req *http.Request) string {
+	addr := peerAddress(req)
+	if r == nil || !r.isTrusted(addr) {
+		return addr
+	}
+	forwarded := forwardedFor(req.Header)
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr = forwarded[i]
+		if !r.isTrusted(addr) {
+			break
+		}
+	}
+	return addr
+}
+
+// isTrusted reports whether addr is the address of a trusted proxy.
+func (r *Resolver) isTrusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range r.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerAddress returns the IP address of the peer that made the given
+// request.
+func peerAddress(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// forwardedFor returns the addresses held in all X-Forwarded-For
+// headers in h, in order.
+func forwardedFor(h http.Header) []string {
+	var addrs []string
+	for _, v := range h["X-Forwarded-For"] {
+		for _, a := range strings.Split(v, ",") {
+			if a = strings.TrimSpace(a); a != "" {
+				addrs = append(addrs, a)
+			}
+		}
+	}
+	return addrs
+}
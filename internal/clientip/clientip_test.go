@@ -0,0 +1,89 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package clientip_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/internal/clientip"
+)
+
+var addressTests = []struct {
+	about         string
+	trusted       []string
+	remoteAddr    string
+	forwardedFor  []string
+	expectAddress string
+}{{
+	about:         "no trusted proxies",
+	remoteAddr:    "192.0.2.1:1234",
+	forwardedFor:  []string{"198.51.100.1"},
+	expectAddress: "192.0.2.1",
+}, {
+	about:         "untrusted peer",
+	trusted:       []string{"10.0.0.0/8"},
+	remoteAddr:    "192.0.2.1:1234",
+	forwardedFor:  []string{"198.51.100.1"},
+	expectAddress: "192.0.2.1",
+}, {
+	about:         "trusted peer",
+	trusted:       []string{"10.0.0.0/8"},
+	remoteAddr:    "10.0.0.1:1234",
+	forwardedFor:  []string{"198.51.100.1"},
+	expectAddress: "198.51.100.1",
+}, {
+	about:         "spoofed header",
+	trusted:       []string{"10.0.0.0/8"},
+	remoteAddr:    "10.0.0.1:1234",
+	forwardedFor:  []string{"203.0.113.1, 198.51.100.1"},
+	expectAddress: "198.51.100.1",
+}, {
+	about:         "chain of trusted proxies",
+	trusted:       []string{"10.0.0.0/8", "192.0.2.7"},
+	remoteAddr:    "10.0.0.1:1234",
+	forwardedFor:  []string{"203.0.113.1, 198.51.100.1", "192.0.2.7, 10.1.1.1"},
+	expectAddress: "198.51.100.1",
+}, {
+	about:         "trusted peer without header",
+	trusted:       []string{"10.0.0.0/8"},
+	remoteAddr:    "10.0.0.1:1234",
+	expectAddress: "10.0.0.1",
+}, {
+	about:         "all addresses trusted",
+	trusted:       []string{"10.0.0.0/8"},
+	remoteAddr:    "10.0.0.1:1234",
+	forwardedFor:  []string{"10.0.0.2"},
+	expectAddress: "10.0.0.2",
+}, {
+	about:         "IPv6",
+	trusted:       []string{"2001:db8::/32"},
+	remoteAddr:    "[2001:db8::1]:1234",
+	forwardedFor:  []string{"2001:db9::1"},
+	expectAddress: "2001:db9::1",
+}}
+
+func TestAddress(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range addressTests {
+		c.Run(test.about, func(c *qt.C) {
+			r, err := clientip.New(test.trusted)
+			c.Assert(err, qt.Equals, nil)
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = test.remoteAddr
+			req.Header["X-Forwarded-For"] = test.forwardedFor
+			c.Assert(r.Address(req), qt.Equals, test.expectAddress)
+		})
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	c := qt.New(t)
+	_, err := clientip.New([]string{"10.0.0.0/8", "not-an-address"})
+	c.Assert(err, qt.ErrorMatches, `invalid address "not-an-address"`)
+	_, err = clientip.New([]string{"10.0.0.0/33"})
+	c.Assert(err, qt.ErrorMatches, `invalid CIDR "10.0.0.0/33"`)
+}
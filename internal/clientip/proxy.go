@@ -0,0 +1,211 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package clientip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+	errgo "gopkg.in/errgo.v1"
+)
+
+var logger = loggo.GetLogger("candid.internal.clientip")
+
+// proxyHeaderTimeout holds the time allowed for a trusted proxy to send
+// its PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// maxProxyV1HeaderLen holds the maximum length of a version 1 PROXY
+// protocol header, including the terminating CRLF.
+const maxProxyV1HeaderLen = 107
+
+// proxyV2Signature holds the signature that starts a version 2 PROXY
+// protocol header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyListener returns a listener that accepts connections from l.
+// Connections from trusted proxies may start with a PROXY protocol
+// header, version 1 or 2, in which case the remote address of the
+// connection is the client address held in the header. Headers sent by
+// other peers are not interpreted.
+func (r *Resolver) ProxyListener(l net.Listener) net.Listener {
+	return &proxyListener{
+		Listener: l,
+		resolver: r,
+	}
+}
+
+type proxyListener struct {
+	net.Listener
+	resolver *Resolver
+}
+
+// Accept implements net.Listener.Accept.
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if l.resolver == nil || !l.resolver.isTrusted(hostAddress(c.RemoteAddr())) {
+		return c, nil
+	}
+	return &proxyConn{
+		Conn: c,
+		br:   bufio.NewReader(c),
+	}, nil
+}
+
+// proxyConn is a connection from a trusted proxy. The PROXY protocol
+// header is read when the connection is first used, so that a slow
+// proxy does not hold up the accepting of other connections.
+type proxyConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+// Read implements net.Conn.Read.
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(p)
+}
+
+// RemoteAddr implements net.Conn.RemoteAddr.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		// The HTTP server sets its own deadlines after it has
+		// first asked for the remote address, so the deadline
+		// can safely be cleared afterwards.
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.br)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil && errgo.Cause(c.err) != io.EOF {
+			logger.Infof("invalid PROXY protocol header from %s: %s", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+// readProxyHeader reads a PROXY protocol header from br, if there is
+// one, and returns the client address it holds. If the connection does
+// not start with a header, or the header does not hold an address, a
+// nil address is returned.
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	b, err := br.Peek(1)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(io.EOF))
+	}
+	switch b[0] {
+	case 'P':
+		if b, err := br.Peek(6); err != nil || string(b) != "PROXY " {
+			return nil, nil
+		}
+		return readProxyV1Header(br)
+	case proxyV2Signature[0]:
+		if b, err := br.Peek(len(proxyV2Signature)); err != nil || !bytes.Equal(b, proxyV2Signature) {
+			return nil, nil
+		}
+		return readProxyV2Header(br)
+	}
+	return nil, nil
+}
+
+// readProxyV1Header reads a version 1, text, PROXY protocol header.
+func readProxyV1Header(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxProxyV1HeaderLen {
+			return nil, errgo.Newf("header too long")
+		}
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errgo.Newf("invalid header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, errgo.Newf("invalid source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errgo.Newf("invalid source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2Header reads a version 2, binary, PROXY protocol header.
+func readProxyV2Header(br *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	verCmd, family := hdr[12], hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if verCmd>>4 != 2 {
+		return nil, errgo.Newf("unsupported version %d", verCmd>>4)
+	}
+	if verCmd&0xf == 0 {
+		// A LOCAL command is sent by the proxy on its own
+		// behalf, for example for a health check.
+		return nil, nil
+	}
+	var ipLen int
+	switch family >> 4 {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, errgo.Newf("address block too short")
+	}
+	return &net.TCPAddr{
+		IP:   net.IP(body[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+	}, nil
+}
+
+// hostAddress returns the IP address held in the given network
+// address.
+func hostAddress(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package clientip_test
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/internal/clientip"
+)
+
+var proxyListenerTests = []struct {
+	about        string
+	trusted      []string
+	send         string
+	expectRemote string
+	expectData   string
+}{{
+	about:        "version 1 header",
+	trusted:      []string{"127.0.0.1"},
+	send:         "PROXY TCP4 198.51.100.1 192.0.2.1 5678 443\r\nGET / HTTP/1.1\r\n",
+	expectRemote: "198.51.100.1:5678",
+	expectData:   "GET / HTTP/1.1\r\n",
+}, {
+	about:        "version 1 unknown",
+	trusted:      []string{"127.0.0.1"},
+	send:         "PROXY UNKNOWN\r\nGET / HTTP/1.1\r\n",
+	expectRemote: "127.0.0.1",
+	expectData:   "GET / HTTP/1.1\r\n",
+}, {
+	about:   "version 2 header",
+	trusted: []string{"127.0.0.1"},
+	send: "\r\n\r\n\x00\r\nQUIT\n" + // signature
+		"\x21\x11\x00\x0c" + // PROXY, TCP over IPv4, length 12
+		"\xc6\x33\x64\x01" + "\xc0\x00\x02\x01" + // 198.51.100.1, 192.0.2.1
+		"\x16\x2e" + "\x01\xbb" + // 5678, 443
+		"GET / HTTP/1.1\r\n",
+	expectRemote: "198.51.100.1:5678",
+	expectData:   "GET / HTTP/1.1\r\n",
+}, {
+	about:   "version 2 local",
+	trusted: []string{"127.0.0.1"},
+	send: "\r\n\r\n\x00\r\nQUIT\n" + // signature
+		"\x20\x00\x00\x00" + // LOCAL, unspecified, length 0
+		"GET / HTTP/1.1\r\n",
+	expectRemote: "127.0.0.1",
+	expectData:   "GET / HTTP/1.1\r\n",
+}, {
+	about:        "no header",
+	trusted:      []string{"127.0.0.1"},
+	send:         "POST / HTTP/1.1\r\n",
+	expectRemote: "127.0.0.1",
+	expectData:   "POST / HTTP/1.1\r\n",
+}, {
+	about:        "untrusted peer",
+	trusted:      []string{"10.0.0.0/8"},
+	send:         "PROXY TCP4 198.51.100.1 192.0.2.1 5678 443\r\n",
+	expectRemote: "127.0.0.1",
+	expectData:   "PROXY TCP4 198.51.100.1 192.0.2.1 5678 443\r\n",
+}}
+
+func TestProxyListener(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range proxyListenerTests {
+		c.Run(test.about, func(c *qt.C) {
+			r, err := clientip.New(test.trusted)
+			c.Assert(err, qt.Equals, nil)
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assert(err, qt.Equals, nil)
+			l = r.ProxyListener(l)
+			defer l.Close()
+
+			go func() {
+				conn, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				conn.Write([]byte(test.send))
+			}()
+			conn, err := l.Accept()
+			c.Assert(err, qt.Equals, nil)
+			defer conn.Close()
+			remote := conn.RemoteAddr().String()
+			if host, _, err := net.SplitHostPort(remote); err == nil && host == test.expectRemote {
+				remote = host
+			}
+			c.Assert(remote, qt.Equals, test.expectRemote)
+			data, err := ioutil.ReadAll(conn)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(string(data), qt.Equals, test.expectData)
+		})
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package consent records the consent given by users to the release of
+// their identity attributes to relying services.
+package consent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+)
+
+// StoreName is the name of the provider data key-value store that
+// holds consent records.
+const StoreName = "_consent"
+
+// Service holds the consent configuration of a relying service.
+type Service struct {
+	// Name holds the name of the service shown to users.
+	Name string
+
+	// Text holds the text shown to users when asking for their
+	// consent, for example the terms of service.
+	Text string
+}
+
+// Params holds the consent configuration of the server.
+type Params struct {
+	// Required holds whether consent is required before the first
+	// discharge for every relying service. If it is false consent is
+	// only required for the services in Services.
+	Required bool
+
+	// Text holds the text shown to users for services that do not
+	// have their own text.
+	Text string
+
+	// Services holds the consent configuration of relying services,
+	// keyed by public key.
+	Services map[bakery.PublicKey]Service
+}
+
+// Service returns the consent configuration of the relying service with
+// the given public key and reports whether the service requires
+// consent.
+func (p Params) Service(pk bakery.PublicKey) (Service, bool) {
+	svc, ok := p.Services[pk]
+	if !ok && !p.Required {
+		return Service{}, false
+	}
+	if svc.Text == "" {
+		svc.Text = p.Text
+	}
+	return svc, true
+}
+
+// A Record records a user's consent to release their attributes to a
+// relying service.
+type Record struct {
+	// Time holds the time that consent was given.
+	Time time.Time `json:"time"`
+
+	// TextHash holds a hash of the text that the user consented
+	// to. If the text changes the user must consent again.
+	TextHash string `json:"text-hash"`
+}
+
+// Store stores consent records. It wraps a KeyValueStore.
+type Store struct {
+	store simplekv.Store
+}
+
+// NewStore creates a new Store using the given KeyValueStore for
+// backing storage.
+func NewStore(store simplekv.Store) *Store {
+	return &Store{store: store}
+}
+
+// Given reports whether the user with the given username has consented
+// to the given text for the relying service with the given public key.
+func (s *Store) Given(ctx context.Context, username string, pk bakery.PublicKey, text string) (bool, error) {
+	v, err := s.store.Get(ctx, key(username, pk))
+	if err != nil {
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			return false, nil
+		}
+		return false, errgo.Mask(err)
+	}
+	var r Record
+	if err := json.Unmarshal(v, &r); err != nil {
+		return false, errgo.Mask(err)
+	}
+	return r.TextHash == textHash(text), nil
+}
+
+// Record records that the user with the given username consented to the
+// given text for the relying service with the given public key at the
+// given time.
+func (s *Store) Record(ctx context.Context, username string, pk bakery.PublicKey, text string, t time.Time) error {
+	v, err := json.Marshal(Record{
+		Time:     t,
+		TextHash: textHash(text),
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(s.store.Set(ctx, key(username, pk), v, time.Time{}))
+}
+
+func key(username string, pk bakery.PublicKey) string {
+	return username + " " + pk.String()
+}
+
+func textHash(text string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(text)))
+}
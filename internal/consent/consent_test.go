@@ -0,0 +1,65 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package consent_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/simplekv/memsimplekv"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/candid/internal/consent"
+)
+
+func TestService(t *testing.T) {
+	c := qt.New(t)
+	pk1 := bakery.MustGenerateKey().Public
+	pk2 := bakery.MustGenerateKey().Public
+	p := consent.Params{
+		Text: "default text",
+		Services: map[bakery.PublicKey]consent.Service{
+			pk1: {Name: "service one"},
+		},
+	}
+	svc, ok := p.Service(pk1)
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(svc, qt.Equals, consent.Service{Name: "service one", Text: "default text"})
+	_, ok = p.Service(pk2)
+	c.Assert(ok, qt.Equals, false)
+
+	p.Required = true
+	svc, ok = p.Service(pk2)
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(svc, qt.Equals, consent.Service{Text: "default text"})
+}
+
+func TestStore(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	s := consent.NewStore(memsimplekv.NewStore())
+	pk := bakery.MustGenerateKey().Public
+
+	given, err := s.Given(ctx, "bob", pk, "terms")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(given, qt.Equals, false)
+
+	err = s.Record(ctx, "bob", pk, "terms", time.Now())
+	c.Assert(err, qt.Equals, nil)
+
+	given, err = s.Given(ctx, "bob", pk, "terms")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(given, qt.Equals, true)
+
+	// A change to the text requires consent again.
+	given, err = s.Given(ctx, "bob", pk, "new terms")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(given, qt.Equals, false)
+
+	given, err = s.Given(ctx, "alice", pk, "terms")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(given, qt.Equals, false)
+}
@@ -0,0 +1,184 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package cors implements the cross-origin resource sharing policy of
+// the identity server, which allows browser-based applications served
+// from other origins to use the Candid API.
+package cors
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// defaultAllowedHeaders holds the request headers that are always
+// allowed in cross-origin requests.
+var defaultAllowedHeaders = []string{
+	"Bakery-Protocol-Version",
+	"Macaroons",
+	"X-Requested-With",
+	"Content-Type",
+}
+
+// allowedMethods holds the methods allowed in cross-origin requests.
+const allowedMethods = "GET, HEAD, POST, PUT, PATCH, DELETE"
+
+// Params holds the parameters of a Policy.
+type Params struct {
+	// AllowedOrigins holds the origins from which cross-origin
+	// requests are allowed, such as "https://app.example.com". An
+	// origin may use "*" in place of the leftmost labels of its
+	// host name to allow all subdomains, for example
+	// "https://*.example.com", and the origin "*" allows requests
+	// from any origin. If this is empty, requests from any origin
+	// are allowed without credentials, which is the behaviour of
+	// earlier versions of Candid.
+	AllowedOrigins []string
+
+	// AllowedHeaders holds request headers that are allowed in
+	// cross-origin requests in addition to those used by the
+	// bakery protocol.
+	AllowedHeaders []string
+
+	// ExposedHeaders holds the response headers that browsers make
+	// available to cross-origin applications, in addition to the
+	// CORS-safelisted response headers.
+	ExposedHeaders []string
+
+	// AllowCredentials holds whether browsers send cookies with
+	// cross-origin requests from the allowed origins.
+	AllowCredentials bool
+
+	// MaxAge holds the length of time for which browsers may cache
+	// the response to a preflight request. If this is zero, a
+	// default of 10 minutes is used.
+	MaxAge time.Duration
+}
+
+// A Policy sets the CORS headers of responses.
+type Policy struct {
+	origins          []origin
+	allowedHeaders   string
+	exposedHeaders   string
+	allowCredentials bool
+	maxAge           string
+}
+
+// origin holds an allowed origin.
+type origin struct {
+	scheme string
+	host   string
+	// subdomains holds whether host is a domain whose subdomains
+	// are allowed, rather than a single host.
+	subdomains bool
+	any        bool
+}
+
+// New returns a new Policy with the given parameters.
+func New(p Params) (*Policy, error) {
+	if p.MaxAge == 0 {
+		p.MaxAge = 10 * time.Minute
+	}
+	pol := &Policy{
+		allowedHeaders:   strings.Join(append(append([]string(nil), defaultAllowedHeaders...), p.AllowedHeaders...), ", "),
+		exposedHeaders:   strings.Join(p.ExposedHeaders, ", "),
+		allowCredentials: p.AllowCredentials,
+		maxAge:           strconv.Itoa(int(p.MaxAge / time.Second)),
+	}
+	for _, s := range p.AllowedOrigins {
+		o, err := parseOrigin(s)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		pol.origins = append(pol.origins, o)
+	}
+	return pol, nil
+}
+
+// ParseOrigin checks that the given allowed origin is valid.
+func ParseOrigin(s string) error {
+	_, err := parseOrigin(s)
+	return errgo.Mask(err)
+}
+
+func parseOrigin(s string) (origin, error) {
+	if s == "*" {
+		return origin{any: true}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+		return origin{}, errgo.Newf("invalid origin %q", s)
+	}
+	o := origin{
+		scheme: strings.ToLower(u.Scheme),
+		host:   strings.ToLower(u.Host),
+	}
+	if strings.HasPrefix(o.host, "*.") {
+		o.host = o.host[1:]
+		o.subdomains = true
+	}
+	if strings.Contains(o.host, "*") {
+		return origin{}, errgo.Newf("invalid origin %q", s)
+	}
+	return o, nil
+}
+
+func (o origin) matches(scheme, host string) bool {
+	switch {
+	case o.any:
+		return true
+	case o.scheme != scheme:
+		return false
+	case o.subdomains:
+		return strings.HasSuffix(host, o.host)
+	}
+	return host == o.host
+}
+
+// SetHeaders sets the CORS headers of the response to the given
+// request.
+func (p *Policy) SetHeaders(h http.Header, req *http.Request) {
+	if len(p.origins) == 0 {
+		h.Set("Access-Control-Allow-Origin", "*")
+		h.Set("Access-Control-Allow-Headers", p.allowedHeaders)
+		h.Set("Access-Control-Cache-Max-Age", p.maxAge)
+		return
+	}
+	h.Add("Vary", "Origin")
+	origin := req.Header.Get("Origin")
+	if origin == "" || !p.allowed(origin) {
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if p.allowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if p.exposedHeaders != "" {
+		h.Set("Access-Control-Expose-Headers", p.exposedHeaders)
+	}
+	if req.Method == "OPTIONS" && req.Header.Get("Access-Control-Request-Method") != "" {
+		// This is a preflight request.
+		h.Set("Access-Control-Allow-Methods", allowedMethods)
+		h.Set("Access-Control-Allow-Headers", p.allowedHeaders)
+		h.Set("Access-Control-Max-Age", p.maxAge)
+	}
+}
+
+func (p *Policy) allowed(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	scheme, host := strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+	for _, o := range p.origins {
+		if o.matches(scheme, host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cors_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/internal/cors"
+)
+
+func TestDefaultPolicy(t *testing.T) {
+	c := qt.New(t)
+	p, err := cors.New(cors.Params{})
+	c.Assert(err, qt.Equals, nil)
+	req := httptest.NewRequest("GET", "/v1/whoami", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	h := make(http.Header)
+	p.SetHeaders(h, req)
+	c.Assert(h, qt.DeepEquals, http.Header{
+		"Access-Control-Allow-Origin":  {"*"},
+		"Access-Control-Allow-Headers": {"Bakery-Protocol-Version, Macaroons, X-Requested-With, Content-Type"},
+		"Access-Control-Cache-Max-Age": {"600"},
+	})
+}
+
+var policyTests = []struct {
+	about        string
+	method       string
+	origin       string
+	expectHeader http.Header
+}{{
+	about:  "no origin",
+	method: "GET",
+	expectHeader: http.Header{
+		"Vary": {"Origin"},
+	},
+}, {
+	about:  "origin not allowed",
+	method: "GET",
+	origin: "https://evil.example.org",
+	expectHeader: http.Header{
+		"Vary": {"Origin"},
+	},
+}, {
+	about:  "scheme not allowed",
+	method: "GET",
+	origin: "http://app.example.com",
+	expectHeader: http.Header{
+		"Vary": {"Origin"},
+	},
+}, {
+	about:  "allowed origin",
+	method: "POST",
+	origin: "https://app.example.com",
+	expectHeader: http.Header{
+		"Vary":                             {"Origin"},
+		"Access-Control-Allow-Origin":      {"https://app.example.com"},
+		"Access-Control-Allow-Credentials": {"true"},
+		"Access-Control-Expose-Headers":    {"X-Request-Id"},
+	},
+}, {
+	about:  "allowed subdomain",
+	method: "GET",
+	origin: "https://a.b.example.net",
+	expectHeader: http.Header{
+		"Vary":                             {"Origin"},
+		"Access-Control-Allow-Origin":      {"https://a.b.example.net"},
+		"Access-Control-Allow-Credentials": {"true"},
+		"Access-Control-Expose-Headers":    {"X-Request-Id"},
+	},
+}, {
+	about:  "preflight",
+	method: "OPTIONS",
+	origin: "https://app.example.com",
+	expectHeader: http.Header{
+		"Vary":                             {"Origin"},
+		"Access-Control-Allow-Origin":      {"https://app.example.com"},
+		"Access-Control-Allow-Credentials": {"true"},
+		"Access-Control-Expose-Headers":    {"X-Request-Id"},
+		"Access-Control-Allow-Methods":     {"GET, HEAD, POST, PUT, PATCH, DELETE"},
+		"Access-Control-Allow-Headers":     {"Bakery-Protocol-Version, Macaroons, X-Requested-With, Content-Type, X-Request-Id"},
+		"Access-Control-Max-Age":           {"3600"},
+	},
+}}
+
+func TestPolicy(t *testing.T) {
+	c := qt.New(t)
+	p, err := cors.New(cors.Params{
+		AllowedOrigins:   []string{"https://app.example.com", "https://*.example.net"},
+		AllowedHeaders:   []string{"X-Request-Id"},
+		ExposedHeaders:   []string{"X-Request-Id"},
+		AllowCredentials: true,
+		MaxAge:           time.Hour,
+	})
+	c.Assert(err, qt.Equals, nil)
+	for _, test := range policyTests {
+		c.Run(test.about, func(c *qt.C) {
+			req := httptest.NewRequest(test.method, "/discharge", nil)
+			if test.origin != "" {
+				req.Header.Set("Origin", test.origin)
+			}
+			if test.method == "OPTIONS" {
+				req.Header.Set("Access-Control-Request-Method", "POST")
+			}
+			h := make(http.Header)
+			p.SetHeaders(h, req)
+			c.Assert(h, qt.DeepEquals, test.expectHeader)
+		})
+	}
+}
+
+func TestInvalidOrigin(t *testing.T) {
+	c := qt.New(t)
+	_, err := cors.New(cors.Params{
+		AllowedOrigins: []string{"https://app.example.com/path"},
+	})
+	c.Assert(err, qt.ErrorMatches, `invalid origin "https://app.example.com/path"`)
+}
@@ -9,10 +9,16 @@ import (
 
 	"github.com/juju/loggo"
 	"github.com/juju/utils/debugstatus"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 
+	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/internal/auth/httpauth"
+	"github.com/CanonicalLtd/candid/internal/health"
 	"github.com/CanonicalLtd/candid/internal/identity"
+	"github.com/CanonicalLtd/candid/store"
 	"github.com/CanonicalLtd/candid/version"
 )
 
@@ -32,18 +38,78 @@ func NewAPIHandler(params identity.HandlerParams) ([]httprequest.Handler, error)
 		Method: "POST",
 		Path:   "/debug/login",
 		Handle: h.login,
+	}, {
+		Method: "GET",
+		Path:   "/healthz",
+		Handle: handle(health.LivenessHandler()),
+	}, {
+		Method: "GET",
+		Path:   "/readyz",
+		Handle: handle(health.ReadinessHandler(readinessChecks(params))),
 	}}
+	if params.DebugEndpoints {
+		handlers = append(handlers, h.runtimeHandlers()...)
+	}
 	for _, hnd := range identity.ReqServer.Handlers(h.handler) {
 		handlers = append(handlers, hnd)
 	}
 	return handlers, nil
 }
 
+// readinessChecks returns the checks of the dependencies of the server
+// that are run by the /readyz endpoint.
+func readinessChecks(params identity.HandlerParams) []health.Check {
+	checks := []health.Check{{
+		Name:    "store",
+		Timeout: params.HealthCheckTimeout,
+		Check: func(ctx context.Context) error {
+			ctx, close := params.Store.Context(ctx)
+			defer close()
+			// Look up an identity that never exists to check that
+			// the store can be queried.
+			err := params.Store.Identity(ctx, &store.Identity{
+				ProviderID: store.MakeProviderIdentity("candid-health", "check"),
+			})
+			if err != nil && errgo.Cause(err) != store.ErrNotFound {
+				return errgo.Mask(err)
+			}
+			return nil
+		},
+	}}
+	if params.MeetingPlace != nil {
+		checks = append(checks, health.Check{
+			Name:    "meeting",
+			Timeout: params.HealthCheckTimeout,
+			Check:   params.MeetingPlace.CheckHealth,
+		})
+	}
+	for _, p := range params.IdentityProviders {
+		if hc, ok := p.(idp.HealthChecker); ok {
+			checks = append(checks, health.Check{
+				Name:    "idp-" + p.Name(),
+				Timeout: params.HealthCheckTimeout,
+				Check:   hc.CheckHealth,
+			})
+		}
+	}
+	return checks
+}
+
+func handle(h http.Handler) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		h.ServeHTTP(w, req)
+	}
+}
+
 func newDebugAPIHandler(params identity.HandlerParams) *debugAPIHandler {
 	h := &debugAPIHandler{
 		key:      params.Key,
 		location: params.Location,
 		teams:    params.DebugTeams,
+		store:    params.Store,
+	}
+	if params.DebugEndpoints {
+		h.reqAuth = httpauth.New(params.Oven, params.Authorizer, params.APIMacaroonTimeout)
 	}
 	checkerFuncs := append(stdCheckers, params.DebugStatusCheckerFuncs...)
 	h.hnd = debugstatus.Handler{
@@ -52,7 +118,7 @@ func newDebugAPIHandler(params identity.HandlerParams) *debugAPIHandler {
 			return debugstatus.Check(ctx, checkerFuncs...)
 		},
 		Version:           debugstatus.Version(version.VersionInfo),
-		CheckPprofAllowed: h.checkLogin,
+		CheckPprofAllowed: h.checkPprofAllowed,
 		CheckTraceAllowed: func(r *http.Request) (bool, error) {
 			return false, h.checkLogin(r)
 		},
@@ -64,6 +130,8 @@ type debugAPIHandler struct {
 	key      *bakery.KeyPair
 	location string
 	teams    []string
+	store    store.Store
+	reqAuth  *httpauth.Authorizer
 	hnd      debugstatus.Handler
 }
 
@@ -12,7 +12,6 @@ import (
 
 	qt "github.com/frankban/quicktest"
 	"github.com/frankban/quicktest/qtsuite"
-	"github.com/juju/mgotest"
 	"github.com/juju/qthttptest"
 	"github.com/juju/utils/debugstatus"
 	errgo "gopkg.in/errgo.v1"
@@ -20,6 +19,7 @@ import (
 	"github.com/CanonicalLtd/candid/internal/candidtest"
 	"github.com/CanonicalLtd/candid/internal/debug"
 	"github.com/CanonicalLtd/candid/internal/identity"
+	"github.com/CanonicalLtd/candid/internal/mongotest"
 	"github.com/CanonicalLtd/candid/store/mgostore"
 	buildver "github.com/CanonicalLtd/candid/version"
 )
@@ -81,24 +81,50 @@ func (s *debugSuite) TestServeDebugInfo(c *qt.C) {
 	})
 }
 
+func (s *debugSuite) TestHealthz(c *qt.C) {
+	resp, err := http.Get(s.srv.URL + "/healthz")
+	c.Assert(err, qt.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+}
+
+func (s *debugSuite) TestReadyz(c *qt.C) {
+	qthttptest.AssertJSONCall(c, qthttptest.JSONCallParams{
+		URL:          s.srv.URL + "/readyz",
+		ExpectStatus: http.StatusOK,
+		ExpectBody: qthttptest.BodyAsserter(func(c *qt.C, body json.RawMessage) {
+			var result struct {
+				OK     bool
+				Checks []struct {
+					Name string
+					OK   bool
+				}
+			}
+			err := json.Unmarshal(body, &result)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(result.OK, qt.Equals, true)
+			var names []string
+			for _, check := range result.Checks {
+				c.Assert(check.OK, qt.Equals, true, qt.Commentf("%s", check.Name))
+				names = append(names, check.Name)
+			}
+			c.Assert(names, qt.DeepEquals, []string{"meeting", "store"})
+		}),
+	})
+}
+
 type fixture struct {
 	srv *candidtest.Server
 }
 
 func newFixture(c *qt.C) *fixture {
-	db, err := mgotest.New()
-	if errgo.Cause(err) == mgotest.ErrDisabled {
-		c.Skip("mgotest disabled")
+	db, err := mongotest.New()
+	if errgo.Cause(err) == mongotest.ErrDisabled {
+		c.Skip("mongotest disabled")
 	}
 	c.Assert(err, qt.Equals, nil)
-	// mgotest sets the SocketTimout to 1s. Restore it back to the
-	// default value.
-	db.Session.SetSocketTimeout(time.Minute)
+	c.Defer(db.Close)
 	backend, err := mgostore.NewBackend(db.Database)
-	if err != nil {
-		db.Close()
-		c.Fatal(err)
-	}
 	c.Assert(err, qt.Equals, nil)
 	c.Defer(backend.Close)
 
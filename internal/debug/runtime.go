@@ -0,0 +1,72 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package debug
+
+import (
+	"expvar"
+	"net/http"
+	"runtime/pprof"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/internal/auth"
+	"github.com/CanonicalLtd/candid/internal/identity"
+)
+
+// runtimeHandlers returns the handlers of the runtime debug endpoints,
+// which may only be used by users in the debug ACL.
+func (h *debugAPIHandler) runtimeHandlers() []httprequest.Handler {
+	return []httprequest.Handler{{
+		Method: "GET",
+		Path:   "/debug/vars",
+		Handle: h.debugACLOnly(expvar.Handler()),
+	}, {
+		Method: "GET",
+		Path:   "/debug/goroutines",
+		Handle: h.debugACLOnly(http.HandlerFunc(serveGoroutines)),
+	}}
+}
+
+// debugACLOnly returns a handle that serves requests with hnd if they
+// are made by a user in the debug ACL.
+func (h *debugAPIHandler) debugACLOnly(hnd http.Handler) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		if err := h.checkDebugACL(req); err != nil {
+			identity.WriteError(req.Context(), w, err)
+			return
+		}
+		hnd.ServeHTTP(w, req)
+	}
+}
+
+// checkDebugACL checks that the given request is made by a user in the
+// debug ACL. It must only be called when the runtime debug endpoints
+// are enabled.
+func (h *debugAPIHandler) checkDebugACL(req *http.Request) error {
+	ctx, close := h.store.Context(req.Context())
+	defer close()
+	_, err := h.reqAuth.Auth(ctx, req, auth.GlobalOp(auth.ActionDebug))
+	return errgo.Mask(err, errgo.Any)
+}
+
+// checkPprofAllowed checks that the given request may use the pprof
+// endpoints. Users in the debug ACL may use them when the runtime debug
+// endpoints are enabled, otherwise the user must be logged in to the
+// debug endpoints as a member of a debug team.
+func (h *debugAPIHandler) checkPprofAllowed(req *http.Request) error {
+	if h.reqAuth != nil && h.checkDebugACL(req) == nil {
+		return nil
+	}
+	return h.checkLogin(req)
+}
+
+// serveGoroutines writes the stacks of all the current goroutines.
+func serveGoroutines(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := pprof.Lookup("goroutine").WriteTo(w, 2); err != nil {
+		logger.Errorf("cannot write goroutines: %s", err)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package debug_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/internal/candidtest"
+	"github.com/CanonicalLtd/candid/internal/debug"
+	"github.com/CanonicalLtd/candid/internal/discharger"
+	"github.com/CanonicalLtd/candid/internal/identity"
+)
+
+func TestRuntimeEndpoints(t *testing.T) {
+	c := qt.New(t)
+	sp := candidtest.NewStore().ServerParams()
+	sp.DebugEndpoints = true
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"debug":      debug.NewAPIHandler,
+		"discharger": discharger.NewAPIHandler,
+	})
+
+	for _, path := range []string{"/debug/vars", "/debug/goroutines"} {
+		c.Run(path, func(c *qt.C) {
+			// Anonymous users are asked to authenticate.
+			req, err := http.NewRequest("GET", srv.URL+path, nil)
+			c.Assert(err, qt.Equals, nil)
+			req.Header.Set("Bakery-Protocol-Version", "3")
+			resp, err := http.DefaultClient.Do(req)
+			c.Assert(err, qt.Equals, nil)
+			resp.Body.Close()
+			c.Assert(resp.StatusCode, qt.Equals, http.StatusUnauthorized)
+
+			req, err = http.NewRequest("GET", srv.URL+path, nil)
+			c.Assert(err, qt.Equals, nil)
+			resp, err = srv.AdminClient().Do(req)
+			c.Assert(err, qt.Equals, nil)
+			defer resp.Body.Close()
+			c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+			body, err := ioutil.ReadAll(resp.Body)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(len(body), qt.Not(qt.Equals), 0)
+		})
+	}
+}
+
+func TestRuntimeEndpointsDisabled(t *testing.T) {
+	c := qt.New(t)
+	srv := candidtest.NewMemServer(c, map[string]identity.NewAPIHandlerFunc{
+		"debug":      debug.NewAPIHandler,
+		"discharger": discharger.NewAPIHandler,
+	})
+	req, err := http.NewRequest("GET", srv.URL+"/debug/vars", nil)
+	c.Assert(err, qt.Equals, nil)
+	resp, err := srv.AdminClient().Do(req)
+	c.Assert(err, qt.Equals, nil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusNotFound)
+}
@@ -0,0 +1,295 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package devicealert detects logins from devices and locations that
+// have not been seen before for an identity. Each such login is
+// recorded as an audit event and, for users in the groups chosen by an
+// administrator, an alert is sent to the user by email.
+package devicealert
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
+
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/internal/sessions"
+	"github.com/CanonicalLtd/candid/notify"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+var logger = loggo.GetLogger("candid.internal.devicealert")
+
+// auditLogger is the logger used to record logins from new devices.
+var auditLogger = loggo.GetLogger("candid.audit")
+
+// StoreName is the name of the provider data key-value store that
+// holds the devices seen for each identity and the alert settings.
+const StoreName = "_devices"
+
+const (
+	// settingsKey is the key under which the alert settings are
+	// held.
+	settingsKey = "settings"
+
+	// devicesKeyPrefix is the prefix of the keys under which the
+	// devices seen for each identity are held.
+	devicesKeyPrefix = "devices:"
+)
+
+const (
+	// maxDevices holds the maximum number of devices recorded for
+	// each identity. When it is exceeded the least recently seen
+	// device is forgotten.
+	maxDevices = 20
+
+	// lastSeenInterval holds the minimum interval between updates
+	// of the time a device was last seen.
+	lastSeenInterval = 24 * time.Hour
+
+	// notifyTimeout holds the maximum time allowed to send an
+	// alert.
+	notifyTimeout = time.Minute
+)
+
+// Params holds the parameters of an Alerter.
+type Params struct {
+	// Store holds the store in which the devices seen for each
+	// identity and the alert settings are kept.
+	Store simplekv.Store
+
+	// Notifier holds the notifier used to send alerts to users. If
+	// it is nil, logins from new devices are only recorded as audit
+	// events.
+	Notifier *notify.Notifier
+
+	// Location returns a coarse location for the given IP address,
+	// so that logins from a new location can be detected. If this is
+	// nil, the network containing the address (a /16 for IPv4 or a
+	// /32 for IPv6) is used.
+	Location func(ip net.IP) string
+}
+
+// Settings holds the settings of the alerts sent to users.
+type Settings struct {
+	// Groups holds the groups whose members are sent an alert when
+	// they log in from a new device. The group "everyone" includes
+	// all users.
+	Groups []string `json:"groups"`
+}
+
+// A Device is a combination of user agent and location from which an
+// identity has logged in.
+type Device struct {
+	// ID holds a hash of the user agent and location.
+	ID string `json:"id"`
+
+	// FirstSeen holds the time of the first login from the device.
+	FirstSeen time.Time `json:"first-seen"`
+
+	// LastSeen holds the time of the most recent login from the
+	// device. It is updated at most once a day.
+	LastSeen time.Time `json:"last-seen"`
+}
+
+// An Alerter records the devices that identities log in from and
+// alerts users to logins from new devices.
+type Alerter struct {
+	p Params
+}
+
+// New returns a new Alerter with the given parameters.
+func New(p Params) *Alerter {
+	if p.Location == nil {
+		p.Location = networkLocation
+	}
+	return &Alerter{p: p}
+}
+
+// Login records a login by the given identity from the client
+// associated with the context. If the identity has logged in before
+// but never from the same device, an audit event is logged and, if the
+// identity is in one of the groups in the alert settings, an alert is
+// sent to its email address in the background. Failures are logged
+// rather than returned so that they do not prevent the login.
+func (a *Alerter) Login(ctx context.Context, id *store.Identity) {
+	if a == nil || id.Username == "" {
+		return
+	}
+	log := logging.FromContext(ctx, logger)
+	client := sessions.ClientFromContext(ctx)
+	now := time.Now()
+	deviceID := a.DeviceID(client)
+	isNew, err := a.recordDevice(ctx, id.Username, deviceID, now)
+	if err != nil {
+		log.Errorf("cannot record device: %s", err)
+		return
+	}
+	if !isNew {
+		return
+	}
+	logging.FromContext(ctx, auditLogger).Infof("%s logged in from new device (address %s, user agent %q)", id.Username, client.Address, client.UserAgent)
+	if a.p.Notifier == nil || id.Email == "" {
+		return
+	}
+	settings, err := a.Settings(ctx)
+	if err != nil {
+		log.Errorf("cannot get device alert settings: %s", err)
+		return
+	}
+	if !inGroups(id, settings.Groups) {
+		return
+	}
+	data := struct {
+		Name      string
+		Username  string
+		Time      string
+		Address   string
+		UserAgent string
+	}{
+		Name:      id.Name,
+		Username:  id.Username,
+		Time:      now.UTC().Format(time.RFC1123),
+		Address:   client.Address,
+		UserAgent: client.UserAgent,
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+		if err := a.p.Notifier.Notify(ctx, notify.KindNewDeviceLogin, []string{id.Email}, data); err != nil {
+			logger.Errorf("cannot send new device alert to %s: %s", id.Username, err)
+		}
+	}()
+}
+
+// DeviceID returns the ID of the device used by the given client, a
+// hash of its user agent and the coarse location of its address.
+func (a *Alerter) DeviceID(client sessions.Client) string {
+	location := ""
+	if ip := net.ParseIP(client.Address); ip != nil {
+		location = a.p.Location(ip)
+	}
+	h := sha256.Sum256([]byte(client.UserAgent + "\x00" + location))
+	return base64.RawURLEncoding.EncodeToString(h[:16])
+}
+
+// Devices returns the devices from which the given user has logged in.
+func (a *Alerter) Devices(ctx context.Context, username string) ([]Device, error) {
+	var devices []Device
+	data, err := a.p.Store.Get(ctx, devicesKeyPrefix+username)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := json.Unmarshal(data, &devices); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return devices, nil
+}
+
+// recordDevice records a login by the given user from the device with
+// the given ID, and reports whether the device is new. The first device
+// seen for a user is not considered new, as there is nothing to compare
+// it with.
+func (a *Alerter) recordDevice(ctx context.Context, username, deviceID string, now time.Time) (bool, error) {
+	isNew := false
+	err := a.p.Store.Update(ctx, devicesKeyPrefix+username, time.Time{}, func(old []byte) ([]byte, error) {
+		var devices []Device
+		if len(old) > 0 {
+			if err := json.Unmarshal(old, &devices); err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
+		for i := range devices {
+			if devices[i].ID != deviceID {
+				continue
+			}
+			if now.Sub(devices[i].LastSeen) < lastSeenInterval {
+				return old, nil
+			}
+			devices[i].LastSeen = now
+			return json.Marshal(devices)
+		}
+		isNew = len(devices) > 0
+		if len(devices) >= maxDevices {
+			oldest := 0
+			for i := range devices {
+				if devices[i].LastSeen.Before(devices[oldest].LastSeen) {
+					oldest = i
+				}
+			}
+			devices = append(devices[:oldest], devices[oldest+1:]...)
+		}
+		devices = append(devices, Device{
+			ID:        deviceID,
+			FirstSeen: now,
+			LastSeen:  now,
+		})
+		return json.Marshal(devices)
+	})
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return isNew, nil
+}
+
+// Settings returns the current alert settings.
+func (a *Alerter) Settings(ctx context.Context) (*Settings, error) {
+	var s Settings
+	data, err := a.p.Store.Get(ctx, settingsKey)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return &s, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &s, nil
+}
+
+// SetSettings changes the alert settings. The settings are shared by
+// all servers using the same store.
+func (a *Alerter) SetSettings(ctx context.Context, s *Settings) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(a.p.Store.Set(ctx, settingsKey, data, time.Time{}))
+}
+
+// inGroups reports whether the given identity is a member of any of the
+// given groups.
+func inGroups(id *store.Identity, groups []string) bool {
+	for _, g := range groups {
+		if g == identchecker.Everyone {
+			return true
+		}
+		for _, ig := range id.Groups {
+			if ig == g {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// networkLocation returns the network containing the given address as
+// its location.
+func networkLocation(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 32)).String() + "/16"
+	}
+	return ip.Mask(net.CIDRMask(32, 128)).String() + "/32"
+}
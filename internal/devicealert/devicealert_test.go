@@ -0,0 +1,124 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package devicealert_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/simplekv/memsimplekv"
+
+	"github.com/CanonicalLtd/candid/internal/devicealert"
+	"github.com/CanonicalLtd/candid/internal/sessions"
+	"github.com/CanonicalLtd/candid/notify"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+type chanSender chan *notify.Message
+
+func (s chanSender) Send(ctx context.Context, m *notify.Message) error {
+	s <- m
+	return nil
+}
+
+func TestLogin(t *testing.T) {
+	c := qt.New(t)
+	sent := make(chanSender, 10)
+	a := devicealert.New(devicealert.Params{
+		Store: memsimplekv.NewStore(),
+		Notifier: notify.New(notify.Params{
+			Senders: []notify.Sender{sent},
+		}),
+	})
+	ctx := context.Background()
+	err := a.SetSettings(ctx, &devicealert.Settings{
+		Groups: []string{"alerted"},
+	})
+	c.Assert(err, qt.Equals, nil)
+	bob := &store.Identity{
+		Username: "bob",
+		Name:     "Bob",
+		Email:    "bob@example.com",
+		Groups:   []string{"alerted"},
+	}
+	login := func(id *store.Identity, addr, ua string) {
+		a.Login(sessions.ContextWithClient(ctx, sessions.Client{
+			Address:   addr,
+			UserAgent: ua,
+		}), id)
+	}
+
+	// The first login is not from a new device.
+	login(bob, "10.0.1.1", "browser 1")
+	// Nor is a login from the same browser in the same network.
+	login(bob, "10.0.2.1", "browser 1")
+	assertNotSent(c, sent)
+	devices, err := a.Devices(ctx, "bob")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(devices, qt.HasLen, 1)
+
+	// A new browser is a new device.
+	login(bob, "10.0.1.1", "browser 2")
+	m := <-sent
+	c.Assert(m.Kind, qt.Equals, notify.KindNewDeviceLogin)
+	c.Assert(m.To, qt.DeepEquals, []string{"bob@example.com"})
+
+	// As is a new location.
+	login(bob, "192.168.1.1", "browser 1")
+	m = <-sent
+	c.Assert(m.Kind, qt.Equals, notify.KindNewDeviceLogin)
+	devices, err = a.Devices(ctx, "bob")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(devices, qt.HasLen, 3)
+
+	// Users that are not in the alerted groups are not sent alerts.
+	alice := &store.Identity{
+		Username: "alice",
+		Email:    "alice@example.com",
+	}
+	login(alice, "10.0.1.1", "browser 1")
+	login(alice, "10.0.1.1", "browser 2")
+	assertNotSent(c, sent)
+	devices, err = a.Devices(ctx, "alice")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(devices, qt.HasLen, 2)
+
+	// Unless everyone is alerted.
+	err = a.SetSettings(ctx, &devicealert.Settings{
+		Groups: []string{"everyone"},
+	})
+	c.Assert(err, qt.Equals, nil)
+	login(alice, "10.0.1.1", "browser 3")
+	m = <-sent
+	c.Assert(m.To, qt.DeepEquals, []string{"alice@example.com"})
+}
+
+func TestDeviceID(t *testing.T) {
+	c := qt.New(t)
+	a := devicealert.New(devicealert.Params{
+		Store: memsimplekv.NewStore(),
+		Location: func(ip net.IP) string {
+			if ip.Equal(net.ParseIP("192.0.2.1")) {
+				return "GB"
+			}
+			return "FR"
+		},
+	})
+	id1 := a.DeviceID(sessions.Client{Address: "192.0.2.1", UserAgent: "browser"})
+	id2 := a.DeviceID(sessions.Client{Address: "198.51.100.1", UserAgent: "browser"})
+	id3 := a.DeviceID(sessions.Client{Address: "203.0.113.1", UserAgent: "browser"})
+	c.Assert(id1, qt.Not(qt.Equals), id2)
+	c.Assert(id2, qt.Equals, id3)
+}
+
+func assertNotSent(c *qt.C, sent chanSender) {
+	select {
+	case m := <-sent:
+		c.Fatalf("unexpected message %#v", m)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
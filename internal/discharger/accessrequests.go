@@ -0,0 +1,87 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/candid/internal/accessrequest"
+	"github.com/CanonicalLtd/candid/internal/auth"
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/internal/secheaders"
+)
+
+// accessRequestsPageRequest is a request for the page on which users
+// request group membership and approvers decide on requests.
+type accessRequestsPageRequest struct {
+	httprequest.Route `httprequest:"GET /access-requests"`
+}
+
+// accessRequestsPage holds the data used to render the
+// "access-requests" template.
+type accessRequestsPage struct {
+	// Username holds the username of the logged in user. It is
+	// empty if the browser is not logged in.
+	Username string
+
+	// Requests holds the pending requests made by the user.
+	Requests []accessrequest.Request
+
+	// Pending holds the pending requests of all users for groups
+	// whose members the user may change.
+	Pending []accessrequest.Request
+}
+
+// AccessRequestsPage shows the pending access requests of the user that
+// the browser is logged in as, and a form with which to make new ones.
+// Users that own groups, or may change the members of any group, are
+// also shown the pending requests that they can approve. Requests are
+// made, approved and denied using the /v1 API, which authorizes every
+// action again.
+func (h *handler) AccessRequestsPage(p httprequest.Params, _ *accessRequestsPageRequest) error {
+	var page accessRequestsPage
+	mss := httpbakery.RequestMacaroons(p.Request)
+	authInfo, err := h.params.Authorizer.Auth(p.Context, mss, identchecker.LoginOp)
+	if err == nil {
+		page.Username = authInfo.Identity.Id()
+		kv, err := h.params.ProviderDataStore.KeyValueStore(p.Context, accessrequest.StoreName)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		rs, err := accessrequest.NewStore(kv).List(p.Context)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		for _, r := range rs {
+			if r.Username == page.Username {
+				page.Requests = append(page.Requests, r)
+			}
+		}
+		id, _ := authInfo.Identity.(*auth.Identity)
+		allowed := make(map[string]bool)
+		for _, r := range rs {
+			ok, seen := allowed[r.Group]
+			if !seen {
+				ok, err = h.params.Authorizer.Allow(p.Context, id, auth.GroupOp(r.Group, auth.ActionWriteMembers))
+				if err != nil {
+					return errgo.Mask(err)
+				}
+				allowed[r.Group] = ok
+			}
+			if ok {
+				page.Pending = append(page.Pending, r)
+			}
+		}
+	} else {
+		logging.FromContext(p.Context, logger).Debugf("access requests page not authenticated: %s", err)
+	}
+	p.Response.Header().Set("Cache-Control", "no-store")
+	if err := secheaders.ExecuteTemplate(p.Context, p.Response, h.params.Template, "access-requests", page); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/candid/internal/auth"
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/internal/secheaders"
+)
+
+// adminPageRequest is a request for the administration dashboard.
+type adminPageRequest struct {
+	httprequest.Route `httprequest:"GET /admin"`
+}
+
+// adminPage holds the data used to render the "admin" template.
+type adminPage struct {
+	// Username holds the username of the logged in user. It is
+	// empty if the browser is not logged in.
+	Username string
+
+	// Allowed holds whether the logged in user may use the
+	// dashboard.
+	Allowed bool
+}
+
+// AdminPage serves the administration dashboard to users that are
+// allowed to read user information, using the identity cookie set when
+// the user logged in. The dashboard itself is a single page that uses
+// the /v1 API, so every action it performs is authorized again by the
+// endpoint that performs it.
+func (h *handler) AdminPage(p httprequest.Params, _ *adminPageRequest) error {
+	var page adminPage
+	mss := httpbakery.RequestMacaroons(p.Request)
+	authInfo, err := h.params.Authorizer.Auth(p.Context, mss, identchecker.LoginOp)
+	if err == nil {
+		page.Username = authInfo.Identity.Id()
+		_, err = h.params.Authorizer.Auth(p.Context, mss, auth.GlobalOp(auth.ActionRead))
+		page.Allowed = err == nil
+	}
+	if err != nil {
+		logging.FromContext(p.Context, logger).Debugf("admin page not authorized: %s", err)
+	}
+	p.Response.Header().Set("Cache-Control", "no-store")
+	if err := secheaders.ExecuteTemplate(p.Context, p.Response, h.params.Template, "admin", page); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
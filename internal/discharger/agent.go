@@ -107,6 +107,19 @@ type legacyAgentLoginRequest struct {
 // LegacyAgentLogin is the endpoint used when performing agent login
 // using the legacy agent-login cookie based protocols.
 func (h *handler) LegacyAgentLogin(p httprequest.Params, req *legacyAgentLoginRequest) (interface{}, error) {
+	if err := h.params.checker.checkInteractionProtocol(true, "agent-login"); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	resp, err := h.legacyAgentLoginCookie(p, req.DischargeID)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return resp, nil
+}
+
+// legacyAgentLoginCookie performs a legacy agent login using the
+// agent-login cookie in the request.
+func (h *handler) legacyAgentLoginCookie(p httprequest.Params, dischargeID string) (*agent.LegacyAgentResponse, error) {
 	user, key, err := agent.LoginCookie(p.Request)
 	if err != nil {
 		if errgo.Cause(err) == agent.ErrNoAgentLoginCookie {
@@ -114,7 +127,7 @@ func (h *handler) LegacyAgentLogin(p httprequest.Params, req *legacyAgentLoginRe
 		}
 		return nil, errgo.Mask(err)
 	}
-	resp, err := h.legacyAgentLogin(p.Context, p.Request, req.DischargeID, user, key)
+	resp, err := h.legacyAgentLogin(p.Context, p.Request, dischargeID, user, key)
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Any)
 	}
@@ -132,6 +145,9 @@ type legacyAgentLoginPostRequest struct {
 // LegacyAgentLoginPost is the endpoint used when performing an agent login
 // using the POST protocol.
 func (h *handler) LegacyAgentLoginPost(p httprequest.Params, req *legacyAgentLoginPostRequest) (*agent.LegacyAgentResponse, error) {
+	if err := h.params.checker.checkInteractionProtocol(true, "agent-login"); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
 	resp, err := h.legacyAgentLogin(p.Context, p.Request, req.DischargeID, string(req.AgentLogin.Username), req.AgentLogin.PublicKey)
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Any)
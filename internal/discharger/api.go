@@ -13,13 +13,24 @@ import (
 	"gopkg.in/CanonicalLtd/candidclient.v1/params"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
-	"gopkg.in/macaroon-bakery.v2/httpbakery"
 
 	"github.com/CanonicalLtd/candid/idp/idputil/secret"
+	"github.com/CanonicalLtd/candid/internal/accesslog"
 	"github.com/CanonicalLtd/candid/internal/auth/httpauth"
+	"github.com/CanonicalLtd/candid/internal/consent"
+	"github.com/CanonicalLtd/candid/internal/devicealert"
 	"github.com/CanonicalLtd/candid/internal/discharger/internal"
 	"github.com/CanonicalLtd/candid/internal/identity"
 	"github.com/CanonicalLtd/candid/internal/monitoring"
+	"github.com/CanonicalLtd/candid/internal/policy"
+	"github.com/CanonicalLtd/candid/internal/remember"
+	"github.com/CanonicalLtd/candid/internal/returnto"
+	"github.com/CanonicalLtd/candid/internal/revocation"
+	"github.com/CanonicalLtd/candid/internal/rpaccess"
+	"github.com/CanonicalLtd/candid/internal/services"
+	"github.com/CanonicalLtd/candid/internal/sessions"
+	"github.com/CanonicalLtd/candid/internal/throttle"
+	"github.com/CanonicalLtd/candid/internal/waitlimit"
 )
 
 var logger = loggo.GetLogger("candid.internal.discharger")
@@ -27,52 +38,119 @@ var logger = loggo.GetLogger("candid.internal.discharger")
 // NewAPIHandler is an identity.NewAPIHandlerFunc.
 func NewAPIHandler(params identity.HandlerParams) ([]httprequest.Handler, error) {
 	reqAuth := httpauth.New(params.Oven, params.Authorizer, params.APIMacaroonTimeout)
-	place := &place{params.MeetingPlace}
+	place := &place{
+		place:   params.MeetingPlace,
+		limiter: waitlimit.New(params.WaitLimit),
+	}
+	sks, err := params.ProviderDataStore.KeyValueStore(context.Background(), sessions.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	rks, err := params.ProviderDataStore.KeyValueStore(context.Background(), revocation.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	daks, err := params.ProviderDataStore.KeyValueStore(context.Background(), devicealert.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
 	dt := &dischargeTokenCreator{
-		params: params,
+		params:      params,
+		sessions:    sessions.NewStore(sks),
+		revocations: revocation.NewStore(rks),
+		alerter: devicealert.New(devicealert.Params{
+			Store:    daks,
+			Notifier: params.Notifier,
+		}),
+		metrics: monitoring.NewLoginMetrics(),
 	}
 	dtks, err := params.ProviderDataStore.KeyValueStore(context.Background(), "_discharge_tokens")
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
 	dts := internal.NewDischargeTokenStore(dtks)
+	lks, err := params.ProviderDataStore.KeyValueStore(context.Background(), "_identity_links")
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	ils := internal.NewIdentityLinkStore(lks)
+	rpks, err := params.ProviderDataStore.KeyValueStore(context.Background(), rpaccess.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	cks, err := params.ProviderDataStore.KeyValueStore(context.Background(), consent.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	pks, err := params.ProviderDataStore.KeyValueStore(context.Background(), policy.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	svks, err := params.ProviderDataStore.KeyValueStore(context.Background(), services.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	svcs := services.NewStore(svks)
+	rbks, err := params.ProviderDataStore.KeyValueStore(context.Background(), remember.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	rtv, err := returnto.New(params.RedirectLoginPatterns)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid redirect login patterns")
+	}
+	codec := secret.NewCodec(params.Key, params.CookieDomains...)
+	codec.SetCookieAttributes(params.CookieSameSite, params.CookieSecure)
+	templates, err := brandedTemplates(params)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
 	vc := &visitCompleter{
 		params:                params,
 		dischargeTokenCreator: dt,
 		dischargeTokenStore:   dts,
+		identityLinkStore:     ils,
+		codec:                 codec,
 		place:                 place,
+		templates:             templates,
+		services:              svcs,
+		returnTo:              rtv,
+		remembered:            remember.NewStore(rbks),
 	}
-	codec := secret.NewCodec(params.Key)
 	err = initIDPs(context.Background(), initIDPParams{
 		HandlerParams:         params,
 		Codec:                 codec,
 		DischargeTokenCreator: dt,
 		VisitCompleter:        vc,
+		Templates:             templates,
 	})
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
 	checker := &thirdPartyCaveatChecker{
-		params:  params,
-		place:   place,
-		reqAuth: reqAuth,
+		params:   params,
+		place:    place,
+		reqAuth:  reqAuth,
+		limiter:  throttle.New(params.DischargeThrottle),
+		rpAccess: rpaccess.NewStore(rpks),
+		consent:  consent.NewStore(cks),
+		codec:    codec,
+		policies: policy.NewStore(pks),
+		services: svcs,
+		metrics:  monitoring.NewInteractionMetrics(),
 	}
 	handlers := identity.ReqServer.Handlers(handlerCreator(handlerParams{
 		HandlerParams:         params,
 		checker:               checker,
 		dischargeTokenCreator: dt,
 		dischargeTokenStore:   dts,
+		identityLinkStore:     ils,
 		visitCompleter:        vc,
 		place:                 place,
 		reqAuth:               reqAuth,
 		codec:                 codec,
 	}))
-	d := httpbakery.NewDischarger(httpbakery.DischargerParams{
-		CheckerP:        checker,
-		Key:             params.Key,
-		ErrorToResponse: identity.ReqServer.ErrorMapper,
-	})
-	for _, h := range d.Handlers() {
+	for _, h := range dischargerHandlers(params.KeyRing, checker) {
 		handlers = append(handlers, h)
 
 		// also add the discharger endpoint at the legacy location.
@@ -91,6 +169,7 @@ type handlerParams struct {
 	checker               *thirdPartyCaveatChecker
 	dischargeTokenCreator *dischargeTokenCreator
 	dischargeTokenStore   *internal.DischargeTokenStore
+	identityLinkStore     *internal.IdentityLinkStore
 	visitCompleter        *visitCompleter
 	place                 *place
 	reqAuth               *httpauth.Authorizer
@@ -101,13 +180,14 @@ type handlerParams struct {
 func handlerCreator(hParams handlerParams) func(p httprequest.Params, arg interface{}) (*handler, context.Context, error) {
 	return func(p httprequest.Params, arg interface{}) (*handler, context.Context, error) {
 		t := trace.New(p.Request.URL.Path, p.PathPattern)
+		accesslog.SetRoute(p.Context, p.PathPattern)
 		ctx := trace.NewContext(p.Context, t)
 		ctx, close1 := hParams.Store.Context(ctx)
 		ctx, close2 := hParams.MeetingStore.Context(ctx)
 		hnd := &handler{
 			params: hParams,
 			trace:  t,
-			monReq: monitoring.NewRequest(&p),
+			monReq: hParams.RequestMetrics.NewRequest(&p),
 			close: func() {
 				close2()
 				close1()
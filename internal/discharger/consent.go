@@ -0,0 +1,156 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"time"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/candid/idp/idputil"
+	"github.com/CanonicalLtd/candid/internal/secheaders"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// consentStateExpiry is the time for which a user may respond to the
+// consent page.
+const consentStateExpiry = 15 * time.Minute
+
+// A consentState holds the state of a discharge that is waiting for
+// the user to consent to the release of their attributes to a relying
+// service.
+type consentState struct {
+	// Username holds the username of the user being asked for
+	// consent.
+	Username string
+
+	// RelyingParty holds the public key of the relying service.
+	RelyingParty bakery.PublicKey
+
+	// DischargeID holds the discharge ID of the waiting discharge.
+	DischargeID string
+
+	// Expires holds the time after which consent can no longer be
+	// given.
+	Expires time.Time
+}
+
+// consentPageRequest is a request for the page that asks the user for
+// consent to release their attributes to a relying service.
+type consentPageRequest struct {
+	httprequest.Route `httprequest:"GET /consent"`
+
+	// State holds the encoded consentState.
+	State string `httprequest:"state,form"`
+}
+
+// consentParams holds the parameters passed to the consent template.
+type consentParams struct {
+	// Action contains the action parameter for the form.
+	Action string
+
+	// State contains the encoded consentState that must be sent
+	// back in the form.
+	State string
+
+	// Username contains the username of the user.
+	Username string
+
+	// Service contains the name of the relying service, if known.
+	Service string
+
+	// Text contains the text the user is asked to consent to.
+	Text string
+
+	// Attributes contains the names of the attributes that will be
+	// released to the relying service.
+	Attributes []string
+}
+
+// ConsentPage shows the page asking the user to consent to the release
+// of their attributes to a relying service.
+func (h *handler) ConsentPage(p httprequest.Params, req *consentPageRequest) error {
+	var cs consentState
+	if err := h.params.codec.Decode(req.State, &cs); err != nil {
+		logger.Infof("invalid consent state: %s", err)
+		idputil.BadRequestf(p.Response, "invalid consent state")
+		return nil
+	}
+	svc, _ := h.params.Consent.Service(cs.RelyingParty)
+	released, err := h.params.checker.releasedAttributes(p.Context, cs.RelyingParty)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	attrs := []string{"username"}
+	for _, attr := range released {
+		if attr != "username" {
+			attrs = append(attrs, attr)
+		}
+	}
+	p.Response.Header().Set("Content-Type", "text/html;charset=utf-8")
+	p.Response.Header().Set("Cache-Control", "no-store")
+	err = secheaders.ExecuteTemplate(p.Context, p.Response, h.params.Template, "consent", consentParams{
+		Action:     h.params.Location + "/consent",
+		State:      req.State,
+		Username:   cs.Username,
+		Service:    svc.Name,
+		Text:       svc.Text,
+		Attributes: attrs,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// consentRequest is a request to complete a discharge that is waiting
+// for the user's consent.
+type consentRequest struct {
+	httprequest.Route `httprequest:"POST /consent"`
+
+	// State holds the encoded consentState from the consent page.
+	State string `httprequest:"state,form"`
+
+	// Accept is non-empty if the user has given their consent.
+	Accept string `httprequest:"accept,form"`
+}
+
+// Consent handles the response from the consent page. If the user
+// consented then the consent is recorded and the waiting discharge
+// completes, otherwise the discharge fails.
+func (h *handler) Consent(p httprequest.Params, req *consentRequest) {
+	ctx := p.Context
+	vc := h.params.visitCompleter
+	var cs consentState
+	if err := h.params.codec.Decode(req.State, &cs); err != nil {
+		logger.Infof("invalid consent state: %s", err)
+		idputil.BadRequestf(p.Response, "invalid consent state")
+		return
+	}
+	if cs.Expires.Before(time.Now()) {
+		vc.Failure(ctx, p.Response, p.Request, cs.DischargeID, errgo.WithCausef(nil, params.ErrBadRequest, "login expired"))
+		return
+	}
+	if req.Accept == "" {
+		vc.Failure(ctx, p.Response, p.Request, cs.DischargeID, errgo.WithCausef(nil, params.ErrForbidden, "consent declined"))
+		return
+	}
+	svc, _ := h.params.Consent.Service(cs.RelyingParty)
+	if err := h.params.checker.consent.Record(ctx, cs.Username, cs.RelyingParty, svc.Text, time.Now()); err != nil {
+		vc.Failure(ctx, p.Response, p.Request, cs.DischargeID, errgo.Mask(err))
+		return
+	}
+	id := store.Identity{
+		Username: cs.Username,
+	}
+	if err := h.params.Store.Identity(ctx, &id); err != nil {
+		vc.Failure(ctx, p.Response, p.Request, cs.DischargeID, errgo.Mask(err))
+		return
+	}
+	logger.Infof("%q consented to release attributes to %s", cs.Username, cs.RelyingParty)
+	vc.success(ctx, p.Response, p.Request, cs.DischargeID, &id)
+}
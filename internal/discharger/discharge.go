@@ -8,6 +8,7 @@ import (
 	"crypto/rand"
 	"encoding"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -22,13 +23,27 @@ import (
 	"gopkg.in/juju/names.v2"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 	"gopkg.in/macaroon-bakery.v2/httpbakery/agent"
 	"gopkg.in/macaroon.v2"
 
+	"github.com/CanonicalLtd/candid/idp/idputil/secret"
+	"github.com/CanonicalLtd/candid/internal/accesslog"
+	"github.com/CanonicalLtd/candid/internal/attrschema"
 	"github.com/CanonicalLtd/candid/internal/auth"
 	"github.com/CanonicalLtd/candid/internal/auth/httpauth"
+	"github.com/CanonicalLtd/candid/internal/consent"
+	"github.com/CanonicalLtd/candid/internal/discharger/internal"
 	"github.com/CanonicalLtd/candid/internal/identity"
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/internal/monitoring"
+	"github.com/CanonicalLtd/candid/internal/policy"
+	"github.com/CanonicalLtd/candid/internal/rpaccess"
+	"github.com/CanonicalLtd/candid/internal/services"
+	"github.com/CanonicalLtd/candid/internal/sessions"
+	"github.com/CanonicalLtd/candid/internal/throttle"
+	"github.com/CanonicalLtd/candid/meeting"
 	"github.com/CanonicalLtd/candid/store"
 )
 
@@ -39,6 +54,29 @@ type thirdPartyCaveatChecker struct {
 	reqAuth *httpauth.Authorizer
 	checker *bakery.Checker
 	place   *place
+	limiter *throttle.Limiter
+
+	// metrics records the interaction protocols used by clients.
+	metrics *monitoring.InteractionMetrics
+
+	// rpAccess records the relying parties that each identity
+	// has obtained discharges for.
+	rpAccess *rpaccess.Store
+
+	// consent records the relying services that each identity has
+	// consented to release its attributes to.
+	consent *consent.Store
+
+	// codec is used to encode the state of the consent page.
+	codec *secret.Codec
+
+	// policies holds the policies that restrict which users may
+	// obtain discharges for each relying service.
+	policies *policy.Store
+
+	// services holds the registered relying services, which may
+	// be released identity attributes.
+	services *services.Store
 }
 
 // CheckThirdPartyCaveat implements httpbakery.ThirdPartyCaveatChecker.
@@ -47,6 +85,12 @@ type thirdPartyCaveatChecker struct {
 func (c *thirdPartyCaveatChecker) CheckThirdPartyCaveat(ctx context.Context, p httpbakery.ThirdPartyCaveatCheckerParams) ([]checkers.Caveat, error) {
 	t := trace.New(p.Request.URL.Path, "")
 	defer t.Finish()
+	release, err := c.limiter.Acquire(ctx, p.Caveat.FirstPartyPublicKey.String())
+	if err != nil {
+		t.LazyPrintf("throttled: %v", err)
+		return nil, errgo.Mask(err, errgo.Is(throttle.ErrThrottled))
+	}
+	defer release()
 	return c.checkThirdPartyCaveat(trace.NewContext(ctx, t), p)
 }
 
@@ -72,20 +116,37 @@ func (c *thirdPartyCaveatChecker) checkThirdPartyCaveat(ctx context.Context, p h
 		forceLegacy = true
 	}
 	var op bakery.Op
+	var idpName, authLevel string
 	switch cond {
 	case "is-authenticated-user":
+		// The relying service may restrict the discharge to users
+		// in a particular domain ("@domain"), or to users that
+		// log in with a particular identity provider
+		// ("idp=name"), or both. It may also require the user
+		// to have authenticated strongly ("auth-level=strong").
 		op = auth.GlobalOp(auth.ActionDischarge)
-		if len(args) == 0 {
-			break
-		}
-		if args[0] != '@' {
-			return nil, checkers.ErrCaveatNotRecognized
+		for _, arg := range strings.Fields(args) {
+			switch {
+			case strings.HasPrefix(arg, "@"):
+				if !names.IsValidUserDomain(arg[1:]) {
+					return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid domain %q", arg[1:])
+				}
+				domain = arg[1:]
+				ctx = auth.ContextWithRequiredDomain(ctx, domain)
+			case strings.HasPrefix(arg, "idp="):
+				idpName = strings.TrimPrefix(arg, "idp=")
+				if !c.hasIdentityProvider(idpName) {
+					return nil, errgo.WithCausef(nil, params.ErrBadRequest, "unknown identity provider %q", idpName)
+				}
+			case strings.HasPrefix(arg, "auth-level="):
+				authLevel = strings.TrimPrefix(arg, "auth-level=")
+				if authLevel != auth.AuthLevelStrong {
+					return nil, errgo.WithCausef(nil, params.ErrBadRequest, "unknown authentication level %q", authLevel)
+				}
+			default:
+				return nil, checkers.ErrCaveatNotRecognized
+			}
 		}
-		if !names.IsValidUserDomain(args[1:]) {
-			return nil, errgo.WithCausef(err, params.ErrBadRequest, "invalid domain %q", args[1:])
-		}
-		domain = args[1:]
-		ctx = auth.ContextWithRequiredDomain(ctx, domain)
 	case "is-member-of":
 		op = auth.GroupsDischargeOp(strings.Fields(args))
 	default:
@@ -113,6 +174,16 @@ func (c *thirdPartyCaveatChecker) checkThirdPartyCaveat(ctx context.Context, p h
 	}
 
 	authInfo, err := c.params.Authorizer.Auth(ctx, mss, op)
+	if err == nil && idpName != "" {
+		err = c.checkIdentityProvider(ctx, authInfo.Identity, idpName)
+	}
+	if err == nil && authLevel != "" {
+		err = c.checkAuthLevel(ctx, authInfo, authLevel, p.Token == nil && p.Request.Form.Get("discharge-for-user") == "")
+		if errgo.Cause(err) == params.ErrForbidden {
+			logging.FromContext(ctx, logger).Infof("discharge of %q failed: %s", cond, err)
+			return nil, errgo.Mask(err, errgo.Is(params.ErrForbidden))
+		}
+	}
 	if _, ok := errgo.Cause(err).(*bakery.DischargeRequiredError); ok {
 		return nil, c.interactionRequiredError(ctx, interactionRequiredParams{
 			why:         err,
@@ -123,32 +194,227 @@ func (c *thirdPartyCaveatChecker) checkThirdPartyCaveat(ctx context.Context, p h
 				CaveatId:  p.Caveat.Id,
 				Condition: string(p.Caveat.Condition),
 				Origin:    p.Request.Header.Get("Origin"),
+				Service:   c.serviceName(p),
 			},
-			domain: domain,
+			domain:    domain,
+			idp:       idpName,
+			authLevel: authLevel,
 		})
 	}
+	// Clients may ask for an explanation of group membership
+	// checks, which is returned in a response header.
+	explain := cond == "is-member-of" && p.Request.Form.Get("explain") == "true"
 	if err != nil {
+		if explain {
+			if authInfo, err := c.params.Authorizer.Auth(ctx, mss, identchecker.LoginOp); err == nil {
+				if e := c.explainMembership(ctx, p.Response, authInfo.Identity, strings.Fields(args)); e != nil {
+					return nil, errgo.Notef(err, "%s", e)
+				}
+			}
+		}
+		logging.FromContext(ctx, logger).Infof("discharge of %q failed: %s", cond, err)
 		// TODO return appropriate error code when permission denied.
 		return nil, errgo.Mask(err)
 	}
-	logger.Debugf("authorization for %#v succeeded", authInfo.Identity)
+	ctx = logging.ContextWithUser(ctx, authInfo.Identity.Id())
+	accesslog.SetUser(ctx, authInfo.Identity.Id())
+	log := logging.FromContext(ctx, logger)
+	log.Debugf("authorization for %#v succeeded", authInfo.Identity)
+	policyCaveats, err := c.checkPolicy(ctx, p, authInfo.Identity)
+	if stepUp, ok := errgo.Cause(err).(*policy.StepUpRequiredError); ok {
+		// The user must log in again with a stronger identity
+		// provider.
+		log.Infof("discharge of %q requires step-up: %s", cond, err)
+		return nil, c.interactionRequiredError(ctx, interactionRequiredParams{
+			why:         err,
+			forceLegacy: forceLegacy,
+			req:         p.Request,
+			info: &dischargeRequestInfo{
+				Caveat:    p.Caveat.Caveat,
+				CaveatId:  p.Caveat.Id,
+				Condition: string(p.Caveat.Condition),
+				Origin:    p.Request.Header.Get("Origin"),
+				Service:   c.serviceName(p),
+			},
+			domain:    domain,
+			idp:       stepUp.IdentityProvider,
+			authLevel: authLevel,
+		})
+	}
+	if err != nil {
+		log.Infof("discharge of %q failed: %s", cond, err)
+		return nil, errgo.Mask(err, errgo.Is(params.ErrForbidden))
+	}
+	if p.Request.Form.Get("discharge-for-user") == "" {
+		if err := c.checkConsent(ctx, p, authInfo.Identity, forceLegacy); err != nil {
+			return nil, err
+		}
+	}
 	c.updateDischargeTime(ctx, authInfo.Identity.Id())
+	c.recordAccess(ctx, authInfo.Identity.Id(), p.Caveat.FirstPartyPublicKey)
 	if cond == "is-member-of" {
-		return nil, nil
+		if explain {
+			c.explainMembership(ctx, p.Response, authInfo.Identity, strings.Fields(args))
+		}
+		return policyCaveats, nil
 	}
 	if p.Token != nil && len(mss) > 0 {
 		// As well as discharging the original third party caveat, also
 		// set the discharge token macaroon as a cookie
 		// so that it may be used for future discharges if appropriate
 		// (it will be ignored otherwise).
-		if err := setIdentityCookie(p.Response, mss[0]); err != nil {
+		if err := setIdentityCookie(p.Response, p.Request, c.params.ServerParams, mss[0]); err != nil {
 			return nil, errgo.Mask(err)
 		}
 	}
-	return []checkers.Caveat{
+	caveats := []checkers.Caveat{
 		candidclient.UserDeclaration(authInfo.Identity.Id()),
 		checkers.TimeBeforeCaveat(time.Now().Add(c.params.DischargeMacaroonTimeout)),
-	}, nil
+	}
+	if level := achievedAuthLevel(authInfo); level != "" {
+		caveats = append(caveats, checkers.DeclaredCaveat(auth.AuthLevelAttribute, level))
+	}
+	caveats = append(caveats, policyCaveats...)
+	if id, ok := authInfo.Identity.(*auth.Identity); ok {
+		if id.Impersonator() != "" {
+			// Mark the discharge so that relying services can tell that
+			// the user is being impersonated.
+			log.Infof("%s discharging as impersonated user %s", id.Impersonator(), id.Id())
+			caveats = append(caveats, auth.ImpersonationCaveat(id.Impersonator()))
+		}
+		attrs, err := c.releasedAttributes(ctx, p.Caveat.FirstPartyPublicKey)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		attrCaveats, err := c.declaredAttributeCaveats(ctx, id, attrs)
+		if err != nil {
+			log.Infof("discharge of %q failed: %s", cond, err)
+			return nil, errgo.Mask(err, errgo.Is(params.ErrForbidden))
+		}
+		caveats = append(caveats, attrCaveats...)
+	}
+	return caveats, nil
+}
+
+// explanationHeader holds the name of the response header in which
+// the explanation of a group membership check is returned.
+const explanationHeader = "Candid-Explanation"
+
+// explainMembership explains whether the given identity is a member of
+// any of the given groups, setting the explanation in the response
+// header. It returns nil if no explanation could be made.
+func (c *thirdPartyCaveatChecker) explainMembership(ctx context.Context, w http.ResponseWriter, identity identchecker.Identity, groups []string) *auth.Explanation {
+	id, ok := identity.(*auth.Identity)
+	if !ok {
+		return nil
+	}
+	e, err := id.Explain(ctx, groups)
+	if err != nil {
+		logging.FromContext(ctx, logger).Warningf("cannot explain membership of %s: %s", id.Id(), err)
+		return nil
+	}
+	w.Header().Set(explanationHeader, e.String())
+	return e
+}
+
+// releasedAttributes returns the identity attributes that are released
+// to the relying service with the given public key. These are the
+// attributes configured for it in DeclaredAttributes along with those
+// of any registered service with the same public key.
+func (c *thirdPartyCaveatChecker) releasedAttributes(ctx context.Context, pk bakery.PublicKey) ([]string, error) {
+	attrs := c.params.DeclaredAttributes[pk]
+	if c.services == nil {
+		return attrs, nil
+	}
+	svcs, err := c.services.List(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	attrs = append([]string(nil), attrs...)
+	released := make(map[string]bool)
+	for _, attr := range attrs {
+		released[attr] = true
+	}
+	for _, svc := range svcs {
+		if svc.PublicKey == nil || *svc.PublicKey != pk {
+			continue
+		}
+		for _, attr := range svc.Attributes {
+			if !released[attr] {
+				released[attr] = true
+				attrs = append(attrs, attr)
+			}
+		}
+	}
+	return attrs, nil
+}
+
+// declaredAttributeCaveats returns caveats declaring the given
+// attributes of the given identity. Attributes with no value are not
+// declared, unless they are custom attributes that the schema requires,
+// in which case an error with a cause of params.ErrForbidden is
+// returned.
+func (c *thirdPartyCaveatChecker) declaredAttributeCaveats(ctx context.Context, id *auth.Identity, attrs []string) ([]checkers.Caveat, error) {
+	if len(attrs) == 0 {
+		return nil, nil
+	}
+	sid, err := id.StoreIdentity(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var caveats []checkers.Caveat
+	for _, attr := range attrs {
+		var value string
+		switch attr {
+		case "username":
+			// The username is always declared.
+		case "email":
+			value = sid.Email
+		case "full-name":
+			value = sid.Name
+		case "groups":
+			groups, err := id.Groups(ctx)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			value = strings.Join(groups, " ")
+		default:
+			a, ok := c.params.AttributeSchema.Attribute(attr)
+			if !ok {
+				logger.Warningf("unknown declared attribute %q", attr)
+				break
+			}
+			value, err = c.customAttribute(sid, attr)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			if value == "" && a.Required {
+				return nil, errgo.WithCausef(nil, params.ErrForbidden, "user %s has no %s, which is required by the relying service", sid.Username, attr)
+			}
+		}
+		if value != "" {
+			caveats = append(caveats, checkers.DeclaredCaveat(attr, value))
+		}
+	}
+	return caveats, nil
+}
+
+// customAttribute returns the value of the given custom attribute of
+// the given identity, formatted for a declared caveat, or "" if it has
+// no value.
+func (c *thirdPartyCaveatChecker) customAttribute(id *store.Identity, attr string) (string, error) {
+	if len(id.ExtraInfo[attr]) != 1 {
+		return "", nil
+	}
+	data, err := c.params.ExtraInfoEncryption.Decode(id.ExtraInfo[attr][0])
+	if err != nil {
+		return "", errgo.Notef(err, "cannot decode extra-info %q", attr)
+	}
+	value, err := attrschema.Format(data)
+	if err != nil {
+		return "", errgo.Notef(err, "invalid value for attribute %q", attr)
+	}
+	return value, nil
 }
 
 func macaroonsFromDischargeToken(ctx context.Context, token *httpbakery.DischargeToken) (macaroon.Slice, error) {
@@ -183,7 +449,50 @@ func (c *thirdPartyCaveatChecker) updateDischargeTime(ctx context.Context, usern
 		},
 	)
 	if err != nil {
-		logger.Infof("unexpected error updating last discharge time: %s", err)
+		logging.FromContext(ctx, logger).Infof("unexpected error updating last discharge time: %s", err)
+	}
+}
+
+// recordAccess records that the given user has obtained a discharge for
+// the relying party with the given public key.
+func (c *thirdPartyCaveatChecker) recordAccess(ctx context.Context, username string, rp bakery.PublicKey) {
+	if c.rpAccess == nil {
+		return
+	}
+	if err := c.rpAccess.Record(ctx, username, rp.String(), time.Now()); err != nil {
+		logging.FromContext(ctx, logger).Infof("unexpected error recording relying party access: %s", err)
+	}
+}
+
+// hasIdentityProvider reports whether an identity provider with the
+// given name is configured.
+func (c *thirdPartyCaveatChecker) hasIdentityProvider(name string) bool {
+	for _, idp := range c.params.IdentityProviders {
+		if idp.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIdentityProvider checks that the given identity logged in with
+// the named identity provider. If it did not, the returned error is a
+// *bakery.DischargeRequiredError so that the user is asked to log in
+// again with the correct identity provider.
+func (c *thirdPartyCaveatChecker) checkIdentityProvider(ctx context.Context, identity identchecker.Identity, name string) error {
+	id, ok := identity.(*auth.Identity)
+	if !ok {
+		return errgo.Newf("unexpected identity type %T", identity)
+	}
+	sid, err := id.StoreIdentity(ctx)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if sid.ProviderID.Provider() == name {
+		return nil
+	}
+	return &bakery.DischargeRequiredError{
+		Message: fmt.Sprintf("identity provider %q required", name),
 	}
 }
 
@@ -194,19 +503,28 @@ type interactionRequiredParams struct {
 	info        *dischargeRequestInfo
 	dischargeID string
 	domain      string
+
+	// idp holds the name of the identity provider the user must
+	// log in with, if any.
+	idp string
+
+	// authLevel holds the authentication level that the login must
+	// achieve, if any.
+	authLevel string
 }
 
 // interactionRequiredError returns an error suitable for returning from
 // a discharge request that can only be satisfied if the user logs in.
 func (c *thirdPartyCaveatChecker) interactionRequiredError(ctx context.Context, p interactionRequiredParams) error {
-	dischargeID, err := newDischargeID()
-	if err != nil {
-		return errgo.Mask(err)
+	legacy := isLegacyRequest(p.req, p.forceLegacy)
+	if err := c.checkInteractionProtocol(legacy, "discharge"); err != nil {
+		return err
 	}
 	// TODO(rog) If the user is already logged in (username != ""),
 	// we should perhaps just return an error here.
-	if err := c.place.NewRendezvous(ctx, dischargeID, p.info); err != nil {
-		return errgo.Notef(err, "cannot make rendezvous")
+	dischargeID, err := c.newRendezvous(ctx, p.info)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrServiceUnavailable))
 	}
 	ierr := httpbakery.NewInteractionRequiredError(p.why, p.req)
 	agent.SetInteraction(ierr, agentURL(c.params.Location, dischargeID))
@@ -216,13 +534,26 @@ func (c *thirdPartyCaveatChecker) interactionRequiredError(ctx context.Context,
 			// so omit it.
 			continue
 		}
+		if p.idp != "" && idp.Name() != p.idp {
+			continue
+		}
 		idp.SetInteraction(ierr, dischargeID)
 	}
+	v := make(url.Values)
+	if p.domain != "" {
+		v.Set("domain", p.domain)
+	}
+	if p.idp != "" {
+		v.Set("idp", p.idp)
+	}
+	if p.authLevel != "" {
+		v.Set("auth_level", p.authLevel)
+	}
 	visitParams := "?did=" + dischargeID
 	redirectVisitParams := ""
-	if p.domain != "" {
-		visitParams += "&domain=" + url.QueryEscape(p.domain)
-		redirectVisitParams = "?domain=" + url.QueryEscape(p.domain)
+	if len(v) > 0 {
+		visitParams += "&" + v.Encode()
+		redirectVisitParams = "?" + v.Encode()
 	}
 	visitURL := c.params.Location + "/login" + visitParams
 	waitTokenURL := c.params.Location + "/wait-token?did=" + dischargeID
@@ -230,6 +561,10 @@ func (c *thirdPartyCaveatChecker) interactionRequiredError(ctx context.Context,
 
 	redirect.SetInteraction(ierr, c.params.Location+"/login-redirect"+redirectVisitParams, c.params.Location+"/discharge-token")
 
+	if c.params.DisableLegacyInteraction {
+		return ierr
+	}
+
 	// Set the URLs used by old clients for backward compatibility.
 	legacyVisitURL := c.params.Location + "/login-legacy" + visitParams
 	legacyWaitURL := c.params.Location + "/wait-legacy?did=" + dischargeID
@@ -244,6 +579,210 @@ func (c *thirdPartyCaveatChecker) interactionRequiredError(ctx context.Context,
 	return ierr
 }
 
+// checkAuthLevel checks that the user authenticated by the given
+// authInfo achieved the given authentication level when they logged
+// in. If they did not, and interact is true, a
+// *bakery.DischargeRequiredError is returned as the error cause so that
+// the user is asked to log in again. Otherwise the login that has just
+// completed did not achieve the required level, so an error with a
+// cause of params.ErrForbidden is returned.
+func (c *thirdPartyCaveatChecker) checkAuthLevel(ctx context.Context, authInfo *identchecker.AuthInfo, level string, interact bool) error {
+	if achievedAuthLevel(authInfo) == level {
+		return nil
+	}
+	if interact {
+		logging.FromContext(ctx, logger).Infof("user %q must log in again to authenticate at level %q", authInfo.Identity.Id(), level)
+		return &bakery.DischargeRequiredError{
+			Message: fmt.Sprintf("authentication level %q required", level),
+		}
+	}
+	return errgo.WithCausef(nil, params.ErrForbidden, "user %q did not authenticate at level %q", authInfo.Identity.Id(), level)
+}
+
+// achievedAuthLevel returns the authentication level declared in the
+// discharge token used to authenticate the given authInfo, or "" if
+// none was declared.
+func achievedAuthLevel(authInfo *identchecker.AuthInfo) string {
+	for _, ms := range authInfo.Macaroons {
+		if level := checkers.InferDeclared(auth.Namespace, ms)[auth.AuthLevelAttribute]; level != "" {
+			return level
+		}
+	}
+	return ""
+}
+
+// checkPolicy checks that the policies for the relying service that
+// added the caveat being discharged allow the given identity a
+// discharge, and returns any caveats the policies add to the
+// discharge.
+func (c *thirdPartyCaveatChecker) checkPolicy(ctx context.Context, p httpbakery.ThirdPartyCaveatCheckerParams, identity identchecker.Identity) ([]checkers.Caveat, error) {
+	if c.policies == nil {
+		return nil, nil
+	}
+	client := sessions.ClientFromContext(ctx)
+	if client.Address == "" {
+		client = sessions.ClientFromRequest(p.Request)
+	}
+	caveats, err := c.policies.Check(ctx, policy.Request{
+		PublicKey: p.Caveat.FirstPartyPublicKey,
+		Origin:    p.Request.Header.Get("Origin"),
+		Username:  identity.Id(),
+		Groups: func() ([]string, error) {
+			if id, ok := identity.(*auth.Identity); ok {
+				return id.Groups(ctx)
+			}
+			return nil, nil
+		},
+		ClientIP: net.ParseIP(client.Address),
+		Country:  client.Country,
+		IdentityProvider: func() (string, error) {
+			id, ok := identity.(*auth.Identity)
+			if !ok {
+				return "", nil
+			}
+			sid, err := id.StoreIdentity(ctx)
+			if err != nil {
+				return "", errgo.Mask(err)
+			}
+			return sid.ProviderID.Provider(), nil
+		},
+		Time: time.Now(),
+	})
+	if errgo.Cause(err) == policy.ErrDenied {
+		return nil, errgo.WithCausef(err, params.ErrForbidden, "")
+	}
+	if err != nil {
+		return nil, errgo.Mask(err, isStepUpRequired)
+	}
+	return caveats, nil
+}
+
+// checkConsent checks that the given identity has consented to release
+// its attributes to the relying service that added the caveat being
+// discharged. If consent is required but has not been given, an
+// interaction-required error is returned that directs the user to the
+// consent page.
+func (c *thirdPartyCaveatChecker) checkConsent(ctx context.Context, p httpbakery.ThirdPartyCaveatCheckerParams, identity identchecker.Identity, forceLegacy bool) error {
+	if c.consent == nil {
+		return nil
+	}
+	rp := p.Caveat.FirstPartyPublicKey
+	svc, ok := c.params.Consent.Service(rp)
+	if !ok {
+		return nil
+	}
+	if id, ok := identity.(*auth.Identity); ok {
+		sid, err := id.StoreIdentity(ctx)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if !linkable(sid.ProviderID) {
+			// Agents cannot use the consent page.
+			return nil
+		}
+	}
+	given, err := c.consent.Given(ctx, identity.Id(), rp, svc.Text)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if given {
+		return nil
+	}
+	if err := c.checkInteractionProtocol(isLegacyRequest(p.Request, forceLegacy), "consent"); err != nil {
+		return err
+	}
+	info := &dischargeRequestInfo{
+		Caveat:    p.Caveat.Caveat,
+		CaveatId:  p.Caveat.Id,
+		Condition: string(p.Caveat.Condition),
+		Origin:    p.Request.Header.Get("Origin"),
+		Service:   c.serviceName(p),
+	}
+	dischargeID, err := c.newRendezvous(ctx, info)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrServiceUnavailable))
+	}
+	state, err := c.codec.Encode(consentState{
+		Username:     identity.Id(),
+		RelyingParty: rp,
+		DischargeID:  dischargeID,
+		Expires:      time.Now().Add(consentStateExpiry),
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	ierr := httpbakery.NewInteractionRequiredError(errgo.Newf("consent required for %s", svc.Name), p.Request)
+	visitURL := c.params.Location + "/consent?state=" + url.QueryEscape(state)
+	httpbakery.SetWebBrowserInteraction(ierr, visitURL, c.params.Location+"/wait-token?did="+dischargeID)
+	if !c.params.DisableLegacyInteraction {
+		httpbakery.SetLegacyInteraction(ierr, visitURL, c.params.Location+"/wait-legacy?did="+dischargeID)
+		if forceLegacy {
+			ierr.Info.InteractionMethods = nil
+		}
+	}
+	return ierr
+}
+
+// isLegacyRequest reports whether the client that made the given
+// discharge request can only use the legacy visit-wait interaction
+// protocol. Interaction methods were introduced in version 3 of the
+// bakery protocol.
+func isLegacyRequest(req *http.Request, forceLegacy bool) bool {
+	return forceLegacy || httpbakery.RequestVersion(req) < bakery.Version3
+}
+
+// checkInteractionProtocol records an interaction request of the given
+// kind, and returns an error if it uses the legacy protocol while that
+// is disabled.
+func (c *thirdPartyCaveatChecker) checkInteractionProtocol(legacy bool, request string) error {
+	if !legacy {
+		c.metrics.Request(monitoring.ProtocolCurrent, request)
+		return nil
+	}
+	c.metrics.Request(monitoring.ProtocolLegacy, request)
+	if c.params.DisableLegacyInteraction {
+		return errgo.WithCausef(nil, identity.ErrLegacyInteractionDisabled, "legacy interaction protocol is disabled, please upgrade your client")
+	}
+	return nil
+}
+
+// serviceName returns the name used for the relying service that added
+// the caveat being discharged. This is the name in the consent
+// configuration if there is one, otherwise the origin of the request,
+// otherwise the public key of the relying service.
+func (c *thirdPartyCaveatChecker) serviceName(p httpbakery.ThirdPartyCaveatCheckerParams) string {
+	if svc, ok := c.params.Consent.Services[p.Caveat.FirstPartyPublicKey]; ok && svc.Name != "" {
+		return svc.Name
+	}
+	if origin := p.Request.Header.Get("Origin"); origin != "" {
+		return origin
+	}
+	return p.Caveat.FirstPartyPublicKey.String()
+}
+
+// newRendezvous creates a new rendezvous for a discharge request with
+// the given information and returns its discharge ID.
+func (c *thirdPartyCaveatChecker) newRendezvous(ctx context.Context, info *dischargeRequestInfo) (string, error) {
+	dischargeID, err := newDischargeID()
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	if err := c.place.NewRendezvous(ctx, dischargeID, info); err != nil {
+		if errgo.Cause(err) == meeting.ErrDraining {
+			// This server is shutting down, the client should
+			// retry and will be sent to another server.
+			return "", errgo.WithCausef(err, params.ErrServiceUnavailable, "server shutting down")
+		}
+		return "", errgo.Notef(err, "cannot make rendezvous")
+	}
+	return dischargeID, nil
+}
+
+func isStepUpRequired(err error) bool {
+	_, ok := err.(*policy.StepUpRequiredError)
+	return ok
+}
+
 func isDischargeRequiredError(err error) bool {
 	cause, ok := errgo.Cause(err).(*httpbakery.Error)
 	return ok && cause.Code == httpbakery.ErrDischargeRequired
@@ -259,18 +798,55 @@ func newDischargeID() (string, error) {
 
 type dischargeTokenRequest struct {
 	httprequest.Route `httprequest:"POST /discharge-token"`
-	redirect.DischargeTokenRequest
+	Body              dischargeTokenRequestBody `httprequest:",body"`
+}
+
+// dischargeTokenRequestBody holds the body of a
+// redirect.DischargeTokenRequest, along with the PKCE code verifier.
+type dischargeTokenRequestBody struct {
+	// Code holds the authorization code returned at the end of the
+	// login.
+	Code string `json:"code"`
+
+	// CodeVerifier holds the code verifier corresponding to the
+	// code challenge sent with the login request, if any.
+	CodeVerifier string `json:"code_verifier,omitempty"`
 }
 
 // DischargeToken is used to collect a DischargeToken when redirect based
-// login is being used.
+// login is being used. Each authorization code can only be used once. A
+// code requested with a PKCE code challenge can only be used with the
+// matching code verifier. A code issued to a registered relying service
+// can, in addition, only be used by that service, which authenticates
+// using HTTP basic authentication with its name and client secret.
 func (h *handler) DischargeToken(p httprequest.Params, req *dischargeTokenRequest) (*redirect.DischargeTokenResponse, error) {
-	dt, err := h.params.dischargeTokenStore.Get(p.Context, req.Body.Code)
+	dt, err := h.params.dischargeTokenStore.Redeem(p.Context, req.Body.Code, req.Body.CodeVerifier, func(service string) error {
+		name, secret, ok := p.Request.BasicAuth()
+		if !ok || name != service {
+			return errgo.WithCausef(nil, params.ErrUnauthorized, "authorization code issued to another client")
+		}
+		if err := h.params.checker.services.Authenticate(p.Context, name, secret); err != nil {
+			if errgo.Cause(err) == services.ErrUnauthorized {
+				return errgo.WithCausef(err, params.ErrUnauthorized, "")
+			}
+			return errgo.Mask(err)
+		}
+		return nil
+	})
 	if err != nil {
-		if errgo.Cause(err) == store.ErrNotFound {
+		switch errgo.Cause(err) {
+		case store.ErrNotFound:
 			return nil, errgo.WithCausef(err, params.ErrNotFound, "")
+		case internal.ErrCodeReused:
+			// The code has been intercepted, so revoke the
+			// discharge token that was obtained with it.
+			logging.FromContext(p.Context, logger).Warningf("authorization code reused, revoking discharge token")
+			h.params.dischargeTokenCreator.revoke(p.Context, dt)
+			return nil, errgo.WithCausef(err, params.ErrBadRequest, "")
+		case internal.ErrInvalidVerifier:
+			return nil, errgo.WithCausef(err, params.ErrBadRequest, "")
 		}
-		return nil, errgo.Mask(err)
+		return nil, errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
 	}
 	return &redirect.DischargeTokenResponse{DischargeToken: dt}, nil
 }
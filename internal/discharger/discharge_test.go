@@ -33,10 +33,12 @@ import (
 
 	"github.com/CanonicalLtd/candid/idp"
 	"github.com/CanonicalLtd/candid/idp/static"
+	"github.com/CanonicalLtd/candid/internal/attrschema"
 	"github.com/CanonicalLtd/candid/internal/auth"
 	"github.com/CanonicalLtd/candid/internal/candidtest"
 	"github.com/CanonicalLtd/candid/internal/discharger"
 	"github.com/CanonicalLtd/candid/internal/identity"
+	"github.com/CanonicalLtd/candid/internal/services"
 	"github.com/CanonicalLtd/candid/store"
 )
 
@@ -669,6 +671,29 @@ func (s *dischargeSuite) TestPublicKey(c *qt.C) {
 	})
 }
 
+func (s *dischargeSuite) TestJWKS(c *qt.C) {
+	info, err := s.srv.ThirdPartyInfo(testContext, s.srv.URL)
+	c.Assert(err, qt.Equals, nil)
+	resp, err := http.Get(s.srv.URL + "/.well-known/jwks.json")
+	c.Assert(err, qt.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	var jwks struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&jwks)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(jwks.Keys, qt.HasLen, 2)
+	c.Assert(jwks.Keys[0]["kty"], qt.Equals, "OKP")
+	c.Assert(jwks.Keys[0]["crv"], qt.Equals, "X25519")
+	c.Assert(jwks.Keys[0]["use"], qt.Equals, "enc")
+	c.Assert(jwks.Keys[0]["x"], qt.Equals, base64.RawURLEncoding.EncodeToString(info.PublicKey.Key[:]))
+	c.Assert(jwks.Keys[0]["kid"], qt.Not(qt.Equals), "")
+	// The key used to sign logout tokens is always published.
+	c.Assert(jwks.Keys[1]["kty"], qt.Equals, "EC")
+	c.Assert(jwks.Keys[1]["use"], qt.Equals, "sig")
+}
+
 func (s *dischargeSuite) TestIdentityCookieParameters(c *qt.C) {
 	client := s.srv.Client(s.interactor)
 	jar := new(testCookieJar)
@@ -799,6 +824,71 @@ func (s *dischargeSuite) TestDischargeWithDomainWithExistingNonDomainAuth(c *qt.
 	s.dischargeCreator.AssertMacaroon(c, ms, identchecker.LoginOp, "test@test-domain")
 }
 
+func (s *dischargeSuite) TestDischargeWithIDP(c *qt.C) {
+	ms, err := s.dischargeCreator.Discharge(c, "is-authenticated-user idp=test-domain", s.srv.Client(s.interactor))
+	c.Assert(err, qt.Equals, nil)
+	s.dischargeCreator.AssertMacaroon(c, ms, identchecker.LoginOp, "test@test-domain")
+}
+
+func (s *dischargeSuite) TestDischargeWithIDPWithExistingAuth(c *qt.C) {
+	client := s.srv.Client(s.interactor)
+	ms, err := s.dischargeCreator.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.Equals, nil)
+	s.dischargeCreator.AssertMacaroon(c, ms, identchecker.LoginOp, "test")
+
+	// An existing login with the requested identity provider is used.
+	ms, err = s.dischargeCreator.Discharge(c, "is-authenticated-user idp=test", client)
+	c.Assert(err, qt.Equals, nil)
+	s.dischargeCreator.AssertMacaroon(c, ms, identchecker.LoginOp, "test")
+
+	// A different identity provider requires the user to log in again.
+	ms, err = s.dischargeCreator.Discharge(c, "is-authenticated-user idp=test-domain", client)
+	c.Assert(err, qt.Equals, nil)
+	s.dischargeCreator.AssertMacaroon(c, ms, identchecker.LoginOp, "test@test-domain")
+}
+
+func (s *dischargeSuite) TestDischargeWithDomainAndIDP(c *qt.C) {
+	ms, err := s.dischargeCreator.Discharge(c, "is-authenticated-user @test-domain idp=test-domain", s.srv.Client(s.interactor))
+	c.Assert(err, qt.Equals, nil)
+	s.dischargeCreator.AssertMacaroon(c, ms, identchecker.LoginOp, "test@test-domain")
+}
+
+func (s *dischargeSuite) TestDischargeWithUnknownIDP(c *qt.C) {
+	_, err := s.dischargeCreator.Discharge(c, "is-authenticated-user idp=nothing", s.srv.Client(s.interactor))
+	c.Assert(err, qt.ErrorMatches, `.*unknown identity provider "nothing"`)
+}
+
+func (s *dischargeSuite) TestDischargeWithUnrecognizedArgument(c *qt.C) {
+	_, err := s.dischargeCreator.Discharge(c, "is-authenticated-user test-domain", s.srv.Client(s.interactor))
+	c.Assert(err, qt.ErrorMatches, `.*caveat not recognized`)
+}
+
+func (s *dischargeSuite) TestDischargeWithStrongAuthLevel(c *qt.C) {
+	v := &valueSavingOpenWebBrowser{
+		openWebBrowser: s.interactor.OpenWebBrowser,
+	}
+	client := s.srv.Client(httpbakery.WebBrowserInteractor{
+		OpenWebBrowser: v.OpenWebBrowser,
+	})
+	ms, err := s.dischargeCreator.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.Equals, nil)
+	s.dischargeCreator.AssertMacaroon(c, ms, identchecker.LoginOp, "test")
+
+	// The existing login did not use multiple factors, so the user
+	// must log in again. The static identity provider cannot use
+	// multiple factors, so the discharge is then refused.
+	v.url = nil
+	_, err = s.dischargeCreator.Discharge(c, "is-authenticated-user auth-level=strong", client)
+	c.Assert(err, qt.ErrorMatches, `.*user "test" did not authenticate at level "strong"`)
+	c.Assert(v.url, qt.Not(qt.IsNil))
+	c.Assert(v.url.Query().Get("auth_level"), qt.Equals, "strong")
+}
+
+func (s *dischargeSuite) TestDischargeWithUnknownAuthLevel(c *qt.C) {
+	_, err := s.dischargeCreator.Discharge(c, "is-authenticated-user auth-level=weak", s.srv.Client(s.interactor))
+	c.Assert(err, qt.ErrorMatches, `.*unknown authentication level "weak"`)
+}
+
 type valueSavingOpenWebBrowser struct {
 	url            *url.URL
 	openWebBrowser func(u *url.URL) error
@@ -848,6 +938,162 @@ func (s *dischargeSuite) TestDischargeBrowserRedirectLogin(c *qt.C) {
 	ms, err := s.dischargeCreator.Discharge(c, "is-authenticated-user", s.srv.Client(interactor))
 	c.Assert(err, qt.Equals, nil)
 	s.dischargeCreator.AssertMacaroon(c, ms, identchecker.LoginOp, "")
+
+	// The code can only be used once.
+	_, err = rerr.InteractionInfo.GetDischargeToken(context.Background(), code)
+	c.Assert(err, qt.ErrorMatches, `.*authorization code already used`)
+}
+
+func (s *dischargeSuite) TestDischargeBrowserRedirectLoginRegisteredService(c *qt.C) {
+	ctx := context.Background()
+	kv, err := s.store.ProviderDataStore.KeyValueStore(ctx, services.StoreName)
+	c.Assert(err, qt.Equals, nil)
+	svcs := services.NewStore(kv)
+	err = svcs.Set(ctx, services.Service{
+		Name:    "app",
+		Origins: []string{"https://app.example.com"},
+	})
+	c.Assert(err, qt.Equals, nil)
+	secret, err := svcs.NewSecret(ctx, "app")
+	c.Assert(err, qt.Equals, nil)
+
+	interactor := new(redirect.Interactor)
+	_, err = s.dischargeCreator.Discharge(c, "is-authenticated-user", s.srv.Client(interactor))
+	ierr := errgo.Cause(err).(*httpbakery.InteractionError)
+	rerr := errgo.Cause(ierr.Reason).(*redirect.RedirectRequiredError)
+
+	jar, err := cookiejar.New(nil)
+	c.Assert(err, qt.Equals, nil)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Host == "app.example.com" {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	resp, err := client.Get(rerr.InteractionInfo.RedirectURL("https://app.example.com/login", "123456"))
+	c.Assert(err, qt.Equals, nil)
+	f := candidtest.SelectInteractiveLogin(candidtest.PostLoginForm("test", "password"))
+	resp, err = f(client, resp)
+	c.Assert(err, qt.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther, qt.Commentf("unexpected response %q", resp.Status))
+	_, code, err := redirect.ParseLoginResult(resp.Header.Get("Location"))
+	c.Assert(err, qt.Equals, nil)
+
+	exchange := func(name, password string) *http.Response {
+		req, err := http.NewRequest("POST", s.srv.URL+"/discharge-token", strings.NewReader(`{"code":"`+code+`"}`))
+		c.Assert(err, qt.Equals, nil)
+		req.Header.Set("Content-Type", "application/json")
+		if name != "" {
+			req.SetBasicAuth(name, password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, qt.Equals, nil)
+		c.Defer(func() { resp.Body.Close() })
+		return resp
+	}
+
+	// The code can only be exchanged by the service it was issued to.
+	resp = exchange("", "")
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusUnauthorized)
+	resp = exchange("app", "wrong")
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusUnauthorized)
+
+	resp = exchange("app", secret)
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	var dtr redirect.DischargeTokenResponse
+	err = httprequest.UnmarshalJSONResponse(resp, &dtr)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(dtr.DischargeToken, qt.Not(qt.IsNil))
+
+	resp = exchange("app", secret)
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+func (s *dischargeSuite) TestDischargeBrowserRedirectLoginPKCE(c *qt.C) {
+	ctx := context.Background()
+	kv, err := s.store.ProviderDataStore.KeyValueStore(ctx, services.StoreName)
+	c.Assert(err, qt.Equals, nil)
+	svcs := services.NewStore(kv)
+	err = svcs.Set(ctx, services.Service{
+		Name:    "app",
+		Origins: []string{"https://app.example.com"},
+	})
+	c.Assert(err, qt.Equals, nil)
+	secret, err := svcs.NewSecret(ctx, "app")
+	c.Assert(err, qt.Equals, nil)
+
+	interactor := new(redirect.Interactor)
+	_, err = s.dischargeCreator.Discharge(c, "is-authenticated-user", s.srv.Client(interactor))
+	ierr := errgo.Cause(err).(*httpbakery.InteractionError)
+	rerr := errgo.Cause(ierr.Reason).(*redirect.RedirectRequiredError)
+
+	jar, err := cookiejar.New(nil)
+	c.Assert(err, qt.Equals, nil)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Host == "app.example.com" {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	// The code verifier and challenge from RFC 7636 appendix B.
+	const verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	const challenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	u := rerr.InteractionInfo.RedirectURL("https://app.example.com/login", "123456") + "&code_challenge=" + challenge + "&code_challenge_method=S256"
+	resp, err := client.Get(u)
+	c.Assert(err, qt.Equals, nil)
+	f := candidtest.SelectInteractiveLogin(candidtest.PostLoginForm("test", "password"))
+	resp, err = f(client, resp)
+	c.Assert(err, qt.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther, qt.Commentf("unexpected response %q", resp.Status))
+	_, code, err := redirect.ParseLoginResult(resp.Header.Get("Location"))
+	c.Assert(err, qt.Equals, nil)
+
+	exchange := func(verifier, password string) *http.Response {
+		req, err := http.NewRequest("POST", s.srv.URL+"/discharge-token", strings.NewReader(`{"code":"`+code+`","code_verifier":"`+verifier+`"}`))
+		c.Assert(err, qt.Equals, nil)
+		req.Header.Set("Content-Type", "application/json")
+		if password != "" {
+			req.SetBasicAuth("app", password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, qt.Equals, nil)
+		c.Defer(func() { resp.Body.Close() })
+		return resp
+	}
+
+	// The code can only be exchanged with the code verifier, and
+	// as it was issued to a registered service, the service's
+	// client secret is needed too.
+	resp = exchange("", secret)
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+	resp = exchange(challenge, secret)
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+	resp = exchange(verifier, "")
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusUnauthorized)
+	resp = exchange(verifier, "wrong")
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusUnauthorized)
+
+	resp = exchange(verifier, secret)
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	var dtr redirect.DischargeTokenResponse
+	err = httprequest.UnmarshalJSONResponse(resp, &dtr)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(dtr.DischargeToken, qt.Not(qt.IsNil))
+}
+
+func (s *dischargeSuite) TestDischargeBrowserRedirectLoginInvalidCodeChallenge(c *qt.C) {
+	resp, err := http.Get(s.srv.URL + "/login-redirect?return_to=https://app.example.com/login&code_challenge=abc&code_challenge_method=S256")
+	c.Assert(err, qt.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
 }
 
 func (s *dischargeSuite) TestDischargeBrowserRedirectLoginNotWhitelisted(c *qt.C) {
@@ -883,3 +1129,136 @@ func (s *dischargeSuite) TestDischargeBrowserRedirectLoginNotWhitelisted(c *qt.C
 	c.Assert(err, qt.Equals, nil)
 	c.Assert(&perr, qt.ErrorMatches, "invalid return_to")
 }
+
+func TestDischargeDeclaredAttributes(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	key := bakery.MustGenerateKey()
+	store := candidtest.NewStore()
+	sp := store.ServerParams()
+	sp.IdentityProviders = []idp.IdentityProvider{
+		static.NewIdentityProvider(static.Params{
+			Name: "test",
+			Users: map[string]static.UserInfo{
+				"test": {
+					Password: "password",
+					Name:     "Test User",
+					Email:    "test@example.com",
+					Groups:   []string{"test1", "test2"},
+				},
+			},
+		}),
+	}
+	sp.DeclaredAttributes = map[bakery.PublicKey][]string{
+		key.Public: {"email", "groups", "full-name"},
+	}
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	client := srv.Client(httpbakery.WebBrowserInteractor{
+		OpenWebBrowser: candidtest.PasswordLogin(c, "test", "password"),
+	})
+	ns := checkers.New(nil).Namespace()
+
+	for _, test := range []struct {
+		name   string
+		key    *bakery.KeyPair
+		expect map[string]string
+	}{{
+		name: "Configured",
+		key:  key,
+		expect: map[string]string{
+			"username":  "test",
+			"email":     "test@example.com",
+			"groups":    "test1 test2",
+			"full-name": "Test User",
+		},
+	}, {
+		name: "NotConfigured",
+		key:  bakery.MustGenerateKey(),
+		expect: map[string]string{
+			"username": "test",
+		},
+	}} {
+		c.Run(test.name, func(c *qt.C) {
+			oven := bakery.NewOven(bakery.OvenParams{
+				Key:      test.key,
+				Locator:  srv,
+				Location: "discharge-test",
+			})
+			m, err := oven.NewMacaroon(context.Background(), bakery.LatestVersion, []checkers.Caveat{{
+				Location:  srv.URL,
+				Condition: "is-authenticated-user",
+			}}, identchecker.LoginOp)
+			c.Assert(err, qt.Equals, nil)
+			ms, err := client.DischargeAll(context.Background(), m)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(checkers.InferDeclared(ns, ms), qt.DeepEquals, test.expect)
+		})
+	}
+}
+
+func TestDischargeCustomDeclaredAttributes(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	key := bakery.MustGenerateKey()
+	st := candidtest.NewStore()
+	sp := st.ServerParams()
+	sp.IdentityProviders = []idp.IdentityProvider{
+		static.NewIdentityProvider(static.Params{
+			Name: "test",
+			Users: map[string]static.UserInfo{
+				"test": {
+					Password: "password",
+				},
+			},
+		}),
+	}
+	sp.Attributes = []attrschema.Attribute{{
+		Name:     "employee-id",
+		Required: true,
+	}}
+	sp.DeclaredAttributes = map[bakery.PublicKey][]string{
+		key.Public: {"employee-id"},
+	}
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	client := srv.Client(httpbakery.WebBrowserInteractor{
+		OpenWebBrowser: candidtest.PasswordLogin(c, "test", "password"),
+	})
+	oven := bakery.NewOven(bakery.OvenParams{
+		Key:      key,
+		Locator:  srv,
+		Location: "discharge-test",
+	})
+	m, err := oven.NewMacaroon(context.Background(), bakery.LatestVersion, []checkers.Caveat{{
+		Location:  srv.URL,
+		Condition: "is-authenticated-user",
+	}}, identchecker.LoginOp)
+	c.Assert(err, qt.Equals, nil)
+
+	// The discharge is refused until the user has the required
+	// attribute.
+	_, err = client.DischargeAll(context.Background(), m)
+	c.Assert(err, qt.ErrorMatches, `.*user test has no employee-id, which is required by the relying service`)
+
+	err = st.Store.UpdateIdentity(context.Background(), &store.Identity{
+		Username: "test",
+		ExtraInfo: map[string][]string{
+			"employee-id": {`"E1234"`},
+		},
+	}, store.Update{
+		store.ExtraInfo: store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	ms, err := client.DischargeAll(context.Background(), m)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(checkers.InferDeclared(checkers.New(nil).Namespace(), ms), qt.DeepEquals, map[string]string{
+		"username":    "test",
+		"employee-id": "E1234",
+	})
+}
@@ -4,11 +4,21 @@
 package discharger
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
 	"github.com/juju/simplekv"
+	"gopkg.in/macaroon-bakery.v2/bakery"
 
 	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/idputil"
+	"github.com/CanonicalLtd/candid/idp/idputil/secret"
 	"github.com/CanonicalLtd/candid/internal/discharger/internal"
 	"github.com/CanonicalLtd/candid/internal/identity"
+	"github.com/CanonicalLtd/candid/internal/services"
+	"github.com/CanonicalLtd/candid/store"
 )
 
 var NewIDPHandler = newIDPHandler
@@ -20,6 +30,42 @@ func NewVisitCompleter(params identity.HandlerParams, store simplekv.Store) idp.
 		params:                params,
 		dischargeTokenCreator: &dischargeTokenCreator{params: params},
 		dischargeTokenStore:   internal.NewDischargeTokenStore(store),
-		place:                 &place{params.MeetingPlace},
+		identityLinkStore:     internal.NewIdentityLinkStore(store),
+		codec:                 secret.NewCodec(bakery.MustGenerateKey()),
+		place:                 &place{place: params.MeetingPlace},
+		services:              services.NewStore(store),
+	}
+}
+
+// LoginRequest returns a request that carries the given login state in
+// the way the given visit completer expects to find it.
+func LoginRequest(vc idp.VisitCompleter, ls idputil.LoginState) (*http.Request, error) {
+	rr := httptest.NewRecorder()
+	state, err := vc.(*visitCompleter).codec.SetCookie(rr, httptest.NewRequest("GET", "/", nil), idputil.LoginCookieName, ls)
+	if err != nil {
+		return nil, err
+	}
+	req := httptest.NewRequest("GET", "/?state="+url.QueryEscape(state), nil)
+	for _, c := range rr.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	if err := req.ParseForm(); err != nil {
+		return nil, err
 	}
+	return req, nil
+}
+
+// SetBrandedTemplates sets the templates used by the given visit
+// completer from the identity provider branding in params.
+func SetBrandedTemplates(vc idp.VisitCompleter, params identity.HandlerParams) error {
+	templates, err := brandedTemplates(params)
+	if err != nil {
+		return err
+	}
+	vc.(*visitCompleter).templates = templates
+	return nil
+}
+
+func LinkIdentities(ctx context.Context, vc idp.VisitCompleter, primary, secondary store.ProviderIdentity) error {
+	return vc.(*visitCompleter).identityLinkStore.Link(ctx, primary, secondary)
 }
@@ -5,7 +5,9 @@ package discharger
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
+	"html/template"
 	"net/http"
 	"net/url"
 	"strings"
@@ -23,10 +25,22 @@ import (
 	macaroon "gopkg.in/macaroon.v2"
 
 	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/idputil"
+	"github.com/CanonicalLtd/candid/idp/idputil/challenge"
+	"github.com/CanonicalLtd/candid/idp/idputil/lockout"
 	"github.com/CanonicalLtd/candid/idp/idputil/secret"
 	"github.com/CanonicalLtd/candid/internal/auth"
+	"github.com/CanonicalLtd/candid/internal/devicealert"
 	"github.com/CanonicalLtd/candid/internal/discharger/internal"
 	"github.com/CanonicalLtd/candid/internal/identity"
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/internal/monitoring"
+	"github.com/CanonicalLtd/candid/internal/remember"
+	"github.com/CanonicalLtd/candid/internal/returnto"
+	"github.com/CanonicalLtd/candid/internal/revocation"
+	"github.com/CanonicalLtd/candid/internal/secheaders"
+	"github.com/CanonicalLtd/candid/internal/services"
+	"github.com/CanonicalLtd/candid/internal/sessions"
 	"github.com/CanonicalLtd/candid/store"
 )
 
@@ -35,10 +49,35 @@ type initIDPParams struct {
 	Codec                 *secret.Codec
 	DischargeTokenCreator *dischargeTokenCreator
 	VisitCompleter        *visitCompleter
+
+	// Templates holds the templates to use for each identity
+	// provider, keyed by name. Identity providers without an entry
+	// use the server's templates.
+	Templates map[string]*template.Template
 }
 
 func initIDPs(ctx context.Context, params initIDPParams) error {
+	challengeStore, err := params.ProviderDataStore.KeyValueStore(ctx, "_login_challenge")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	challenger, err := challenge.New(params.LoginChallenge, challengeStore)
+	if err != nil {
+		return errgo.Notef(err, "cannot create login challenge")
+	}
+	lockoutStore, err := params.ProviderDataStore.KeyValueStore(ctx, lockout.StoreName)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	locker, err := lockout.New(params.LoginLockout, lockoutStore)
+	if err != nil {
+		return errgo.Notef(err, "cannot create login lockout")
+	}
 	for _, ip := range params.IdentityProviders {
+		t := params.Template
+		if bt, ok := params.Templates[ip.Name()]; ok {
+			t = bt
+		}
 		kvStore, err := params.ProviderDataStore.KeyValueStore(ctx, ip.Name())
 		if err != nil {
 			return errgo.Mask(err)
@@ -52,7 +91,10 @@ func initIDPs(ctx context.Context, params initIDPParams) error {
 			URLPrefix:             params.Location + "/login/" + ip.Name(),
 			DischargeTokenCreator: params.DischargeTokenCreator,
 			VisitCompleter:        params.VisitCompleter,
-			Template:              params.Template,
+			Template:              t,
+			LoginChallenger:       challenger,
+			LoginLocker:           locker,
+			Notifier:              params.Notifier,
 		}); err != nil {
 			return errgo.Mask(err)
 		}
@@ -60,11 +102,35 @@ func initIDPs(ctx context.Context, params initIDPParams) error {
 	return nil
 }
 
+// brandedTemplates returns the templates to use for each identity
+// provider that has branding configured.
+func brandedTemplates(params identity.HandlerParams) (map[string]*template.Template, error) {
+	templates := make(map[string]*template.Template)
+	for name, b := range params.IDPBranding {
+		t, err := idp.BrandedTemplate(params.Template, b, nil)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot create templates for identity provider %q", name)
+		}
+		templates[name] = t
+	}
+	return templates, nil
+}
+
 func newIDPHandler(params identity.HandlerParams, idp idp.IdentityProvider) httprouter.Handle {
 	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
 		t := trace.New("identity.internal.v1.idp", idp.Name())
 		defer t.Finish()
-		ctx := trace.NewContext(context.Background(), t)
+		// Only the request ID, client details and CSP nonce are
+		// taken from the request context so that logins are not
+		// interrupted if the client goes away.
+		ctx := logging.ContextWithRequestID(context.Background(), logging.RequestIDFromContext(req.Context()))
+		ctx = sessions.ContextWithClient(ctx, sessions.ClientFromContext(req.Context()))
+		ctx = secheaders.ContextWithNonce(ctx, secheaders.Nonce(req.Context()))
+		ctx = trace.NewContext(ctx, t)
+		ctx = contextWithLoginAttempt(ctx, &loginAttempt{
+			idp:   idp.Name(),
+			start: time.Now(),
+		})
 		ctx, close := params.Store.Context(ctx)
 		defer close()
 		ctx, close = params.MeetingStore.Context(ctx)
@@ -75,18 +141,60 @@ func newIDPHandler(params identity.HandlerParams, idp idp.IdentityProvider) http
 	}
 }
 
+// A loginAttempt records a request to an identity provider that may
+// complete a login, so that the outcome of the login can be recorded in
+// the login metrics.
+type loginAttempt struct {
+	idp      string
+	start    time.Time
+	recorded bool
+}
+
+type loginAttemptKey struct{}
+
+// contextWithLoginAttempt returns a context associated with the given
+// login attempt.
+func contextWithLoginAttempt(ctx context.Context, a *loginAttempt) context.Context {
+	return context.WithValue(ctx, loginAttemptKey{}, a)
+}
+
+// loginOutcome returns the outcome recorded in the login metrics for a
+// login that failed with the given error, or succeeded if err is nil.
+func loginOutcome(err error) string {
+	switch errgo.Cause(err) {
+	case nil:
+		return monitoring.LoginSuccess
+	case idputil.ErrLoginCancelled:
+		return monitoring.LoginUserCancel
+	case params.ErrForbidden:
+		return monitoring.LoginPolicyDenied
+	}
+	return monitoring.LoginUpstreamError
+}
+
 type dischargeTokenCreator struct {
-	params identity.HandlerParams
+	params      identity.HandlerParams
+	sessions    *sessions.Store
+	revocations *revocation.Store
+	alerter     *devicealert.Alerter
+	metrics     *monitoring.LoginMetrics
 }
 
 func (d *dischargeTokenCreator) DischargeToken(ctx context.Context, id *store.Identity) (*httpbakery.DischargeToken, error) {
+	caveats := []checkers.Caveat{
+		checkers.TimeBeforeCaveat(time.Now().Add(d.params.DischargeTokenTimeout)),
+		candidclient.UserDeclaration(id.Username),
+	}
+	if multiFactor(id) {
+		// Record that the login used multiple factors so that
+		// the token can be used to discharge caveats that
+		// require strong authentication.
+		caveats = append(caveats, checkers.DeclaredCaveat(auth.AuthLevelAttribute, auth.AuthLevelStrong))
+	}
 	m, err := d.params.Oven.NewMacaroon(
 		ctx,
 		bakery.LatestVersion,
-		[]checkers.Caveat{
-			checkers.TimeBeforeCaveat(time.Now().Add(d.params.DischargeTokenTimeout)),
-			candidclient.UserDeclaration(id.Username),
-		},
+		caveats,
 		identchecker.LoginOp,
 	)
 	if err != nil {
@@ -100,24 +208,162 @@ func (d *dischargeTokenCreator) DischargeToken(ctx context.Context, id *store.Id
 	if err := d.params.Store.UpdateIdentity(ctx, id, store.Update{
 		store.LastLogin: store.Set,
 	}); err != nil {
-		logger.Errorf("cannot update last login time: %s", err)
+		logging.FromContext(ctx, logger).Errorf("cannot update last login time: %s", err)
 	}
+	d.recordSession(ctx, id, m.M())
+	d.alerter.Login(ctx, id)
+	d.metrics.Login(sessions.ClientFromContext(ctx).Country)
 	return &httpbakery.DischargeToken{
 		Kind:  "macaroon",
 		Value: v,
 	}, nil
 }
 
+// multiFactor reports whether the identity provider that has just
+// authenticated the given identity recorded that it used multiple
+// factors.
+func multiFactor(id *store.Identity) bool {
+	for _, v := range id.ProviderInfo[auth.MFAProviderInfo] {
+		if v == "true" {
+			return true
+		}
+	}
+	return false
+}
+
+// recordSession records that the given discharge token macaroon has
+// been issued to the given identity.
+func (d *dischargeTokenCreator) recordSession(ctx context.Context, id *store.Identity, m *macaroon.Macaroon) {
+	if d.sessions == nil {
+		return
+	}
+	client := sessions.ClientFromContext(ctx)
+	removed, err := d.sessions.Add(ctx, id.Username, sessions.Session{
+		ID:               base64.RawURLEncoding.EncodeToString(m.Id()),
+		IdentityProvider: id.ProviderID.Provider(),
+		Client:           client.UserAgent,
+		Address:          client.Address,
+		Issued:           id.LastLogin,
+		Expires:          id.LastLogin.Add(d.params.DischargeTokenTimeout),
+	})
+	if err != nil {
+		logging.FromContext(ctx, logger).Errorf("cannot record session: %s", err)
+		return
+	}
+	// Sessions that no longer fit in the session list are revoked,
+	// so that every valid discharge token is visible to the user.
+	for _, session := range removed {
+		mid, err := base64.RawURLEncoding.DecodeString(session.ID)
+		if err != nil {
+			logging.FromContext(ctx, logger).Errorf("invalid session id %q", session.ID)
+			continue
+		}
+		if err := d.revocations.Revoke(ctx, mid, session.Expires); err != nil {
+			logging.FromContext(ctx, logger).Errorf("cannot revoke session %q: %s", session.ID, err)
+		}
+	}
+}
+
+// revoke revokes the given discharge token. It is used when the
+// authorization code for the token has been reused, in which case the
+// token may have been obtained by an attacker.
+func (d *dischargeTokenCreator) revoke(ctx context.Context, dt *httpbakery.DischargeToken) {
+	if d.revocations == nil || dt == nil || dt.Kind != "macaroon" {
+		return
+	}
+	var m macaroon.Macaroon
+	if err := m.UnmarshalBinary(dt.Value); err != nil {
+		return
+	}
+	if err := d.revocations.Revoke(ctx, m.Id(), time.Now().Add(d.params.DischargeTokenTimeout)); err != nil {
+		logging.FromContext(ctx, logger).Errorf("cannot revoke discharge token: %s", err)
+	}
+}
+
+// recordSessionService records the relying service for which the given
+// discharge token was issued in the token's session.
+func (d *dischargeTokenCreator) recordSessionService(ctx context.Context, dt *httpbakery.DischargeToken, service string) {
+	if d.sessions == nil || service == "" || dt == nil || dt.Kind != "macaroon" {
+		return
+	}
+	var m macaroon.Macaroon
+	if err := m.UnmarshalBinary(dt.Value); err != nil {
+		return
+	}
+	username := checkers.InferDeclared(auth.Namespace, macaroon.Slice{&m})["username"]
+	if username == "" {
+		return
+	}
+	if err := d.sessions.SetService(ctx, username, base64.RawURLEncoding.EncodeToString(m.Id()), service); err != nil {
+		logging.FromContext(ctx, logger).Infof("cannot record session service: %s", err)
+	}
+}
+
+// loginCompleted records the outcome of the login attempt associated
+// with the given context, if there is one. Only the first outcome
+// reported by the identity provider is recorded, so a failure to
+// complete a login after the identity provider has authenticated the
+// user is still recorded as a success.
+func (d *dischargeTokenCreator) loginCompleted(ctx context.Context, err error) {
+	a, _ := ctx.Value(loginAttemptKey{}).(*loginAttempt)
+	if a == nil || a.recorded {
+		return
+	}
+	a.recorded = true
+	d.metrics.LoginCompleted(a.idp, loginOutcome(err), a.start)
+}
+
 // A visitCompleter is an implementation of idp.VisitCompleter.
 type visitCompleter struct {
 	params                identity.HandlerParams
 	dischargeTokenCreator *dischargeTokenCreator
 	dischargeTokenStore   *internal.DischargeTokenStore
+	identityLinkStore     *internal.IdentityLinkStore
+	codec                 *secret.Codec
 	place                 *place
+	templates             map[string]*template.Template
+
+	// services holds the registered relying services, whose
+	// origins may be used as return_to addresses.
+	services *services.Store
+
+	// returnTo holds the patterns that other return_to addresses
+	// must match.
+	returnTo *returnto.Validator
+
+	// remembered holds the browsers that users have asked to be
+	// remembered.
+	remembered *remember.Store
+}
+
+// template returns the template set to use when rendering pages for
+// the given identity. If the identity provider that the identity comes
+// from has its own templates they are used, otherwise the server's
+// templates are used.
+func (c *visitCompleter) template(id *store.Identity) *template.Template {
+	if id != nil {
+		if t, ok := c.templates[id.ProviderID.Provider()]; ok {
+			return t
+		}
+	}
+	return c.params.Template
 }
 
 // Success implements idp.VisitCompleter.Success.
 func (c *visitCompleter) Success(ctx context.Context, w http.ResponseWriter, req *http.Request, dischargeID string, id *store.Identity) {
+	c.dischargeTokenCreator.loginCompleted(ctx, nil)
+	lid, err := c.linkedIdentity(ctx, id)
+	if err != nil {
+		c.Failure(ctx, w, req, dischargeID, errgo.Mask(err))
+		return
+	}
+	if lid == id && c.offerLink(ctx, w, req, linkState{DischargeID: dischargeID}, id) {
+		return
+	}
+	c.success(ctx, w, req, dischargeID, lid)
+}
+
+func (c *visitCompleter) success(ctx context.Context, w http.ResponseWriter, req *http.Request, dischargeID string, id *store.Identity) {
 	dt, err := c.dischargeTokenCreator.DischargeToken(ctx, id)
 	if err != nil {
 		c.Failure(ctx, w, req, dischargeID, errgo.Mask(err))
@@ -139,22 +385,24 @@ func (c *visitCompleter) successToken(ctx context.Context, w http.ResponseWriter
 		}
 		if err := c.params.Store.Identity(ctx, id); err != nil {
 			// Log, but otherwise ignore this error, the username is probably enough.
-			logger.Errorf("cannot look up user identity: %s", err)
+			logging.FromContext(ctx, logger).Errorf("cannot look up user identity: %s", err)
 		}
 	}
-	t := c.params.Template.Lookup("login")
-	if t == nil {
+	t := c.template(id)
+	if t.Lookup("login") == nil {
 		fmt.Fprintf(w, "Login successful as %s", id.Username)
 		return
 	}
 	w.Header().Set("Content-Type", "text/html;charset=utf-8")
-	if err := t.Execute(w, id); err != nil {
-		logger.Errorf("error processing login template: %s", err)
+	if err := secheaders.ExecuteTemplate(ctx, w, t, "login", id); err != nil {
+		logging.FromContext(ctx, logger).Errorf("error processing login template: %s", err)
 	}
 }
 
 // Failure implements idp.VisitCompleter.Failure.
 func (c *visitCompleter) Failure(ctx context.Context, w http.ResponseWriter, req *http.Request, dischargeID string, err error) {
+	c.dischargeTokenCreator.loginCompleted(ctx, err)
+	logging.FromContext(ctx, logger).Infof("login failed: %s", err)
 	_, bakeryErr := httpbakery.ErrorToResponse(ctx, err)
 	if dischargeID != "" {
 		c.place.Done(ctx, dischargeID, &loginInfo{
@@ -166,12 +414,64 @@ func (c *visitCompleter) Failure(ctx context.Context, w http.ResponseWriter, req
 
 // RedirectSuccess implements idp.VisitCompleter.RedirectSuccess.
 func (c *visitCompleter) RedirectSuccess(ctx context.Context, w http.ResponseWriter, req *http.Request, returnTo, state string, id *store.Identity) {
+	c.dischargeTokenCreator.loginCompleted(ctx, nil)
+	lid, err := c.linkedIdentity(ctx, id)
+	if err != nil {
+		c.RedirectFailure(ctx, w, req, returnTo, state, errgo.Mask(err))
+		return
+	}
+	ls, err := c.loginState(req)
+	if err != nil {
+		// The login state may hold a code challenge, so the
+		// login cannot be completed without it.
+		c.RedirectFailure(ctx, w, req, returnTo, state, errgo.Mask(err, errgo.Is(params.ErrBadRequest)))
+		return
+	}
+	cc := internal.CodeChallenge{
+		Challenge: ls.CodeChallenge,
+		Method:    ls.CodeChallengeMethod,
+	}
+	if lid == id && c.offerLink(ctx, w, req, linkState{ReturnTo: returnTo, State: state, CodeChallenge: cc, RememberBrowser: ls.RememberBrowser}, id) {
+		return
+	}
+	if ls.RememberBrowser {
+		c.rememberBrowser(ctx, w, req, lid)
+	}
+	c.redirectSuccess(ctx, w, req, returnTo, state, cc, lid)
+}
+
+// loginState returns the state, such as the PKCE code challenge, that
+// was recorded by the redirect login request that started the login
+// being completed by the given request. Identity providers find the
+// login state from the state parameter of the request, so the same is
+// done here. An error is returned if the login state cannot be read.
+func (c *visitCompleter) loginState(req *http.Request) (idputil.LoginState, error) {
+	var ls idputil.LoginState
+	if req == nil || c.codec == nil {
+		return ls, nil
+	}
+	if err := c.codec.Cookie(req, idputil.LoginCookieName, req.Form.Get("state"), &ls); err != nil {
+		return idputil.LoginState{}, errgo.WithCausef(err, params.ErrBadRequest, "invalid login state")
+	}
+	return ls, nil
+}
+
+func (c *visitCompleter) redirectSuccess(ctx context.Context, w http.ResponseWriter, req *http.Request, returnTo, state string, cc internal.CodeChallenge, id *store.Identity) {
+	u, service, err := c.parseReturnTo(ctx, returnTo)
+	if err != nil {
+		identity.WriteError(ctx, w, err)
+		return
+	}
 	dt, err := c.dischargeTokenCreator.DischargeToken(ctx, id)
 	if err != nil {
 		c.RedirectFailure(ctx, w, req, returnTo, state, errgo.Mask(err))
 		return
 	}
-	code, err := c.dischargeTokenStore.Put(ctx, dt, time.Now().Add(10*time.Minute))
+	c.dischargeTokenCreator.recordSessionService(ctx, dt, u.Host)
+	code, err := c.dischargeTokenStore.PutBound(ctx, dt, internal.Binding{
+		Service:       service,
+		CodeChallenge: cc,
+	}, time.Now().Add(authCodeExpiry))
 	if err != nil {
 		c.RedirectFailure(ctx, w, req, returnTo, state, errgo.Mask(err))
 		return
@@ -182,14 +482,18 @@ func (c *visitCompleter) RedirectSuccess(ctx context.Context, w http.ResponseWri
 	if state != "" {
 		v.Set("state", state)
 	}
-	if err := c.redirect(w, req, returnTo, v); err != nil {
-		identity.WriteError(ctx, w, err)
-	}
-	return
+	redirectTo(w, req, u, v)
 }
 
+// authCodeExpiry holds the time for which the authorization code sent
+// to a relying service at the end of a redirect-based login may be
+// exchanged for a discharge token.
+const authCodeExpiry = time.Minute
+
 // RedirectFailure implements idp.VisitCompleter.RedirectFailure.
 func (c *visitCompleter) RedirectFailure(ctx context.Context, w http.ResponseWriter, req *http.Request, returnTo, state string, err error) {
+	c.dischargeTokenCreator.loginCompleted(ctx, err)
+	logging.FromContext(ctx, logger).Infof("login failed: %s", err)
 	v := url.Values{
 		"error": {err.Error()},
 	}
@@ -199,41 +503,69 @@ func (c *visitCompleter) RedirectFailure(ctx context.Context, w http.ResponseWri
 	if ec, ok := errgo.Cause(err).(params.ErrorCode); ok {
 		v.Set("error_code", string(ec))
 	}
-	if rerr := c.redirect(w, req, returnTo, v); rerr == nil {
+	if u, _, rerr := c.parseReturnTo(ctx, returnTo); rerr == nil {
+		redirectTo(w, req, u, v)
 		return
 	}
 	identity.WriteError(ctx, w, err)
 }
 
-// redirect writes a redirect response addressed the the given returnTo
-// address with the given query parameters. If an error is returned it
-// will be because the returnTo address is invalid and therefore it will
-// not be possible to redirect to it.
-func (c *visitCompleter) redirect(w http.ResponseWriter, req *http.Request, returnTo string, query url.Values) error {
-	// Check the return to is a whitelisted address, and is a valid URL.
-	var validReturnTo bool
+// parseReturnTo parses and checks the given returnTo address. If the
+// address has the origin of a registered relying service the name of
+// the service is also returned. If an error is returned it will be
+// because the returnTo address is invalid and therefore it will not be
+// possible to redirect to it.
+func (c *visitCompleter) parseReturnTo(ctx context.Context, returnTo string) (*url.URL, string, error) {
+	u, err := returnto.Parse(returnTo)
+	if err != nil {
+		logging.FromContext(ctx, logger).Infof("rejected return_to %q: %s", returnTo, err)
+		return nil, "", errgo.WithCausef(err, params.ErrBadRequest, "invalid return_to")
+	}
+	service, err := c.checkReturnTo(ctx, returnTo, u)
+	if err != nil {
+		logging.FromContext(ctx, logger).Infof("rejected return_to %q: %s", returnTo, err)
+		return nil, "", errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	return u, service, nil
+}
+
+// checkReturnTo checks that the given return_to address, parsed as u,
+// has the origin of a registered relying service, is whitelisted, or
+// matches one of the configured redirect login patterns. If the
+// address belongs to a registered service its name is returned.
+func (c *visitCompleter) checkReturnTo(ctx context.Context, returnTo string, u *url.URL) (string, error) {
 	if returnTo == c.params.Location+"/login-complete" {
-		validReturnTo = true
-	} else {
-		for _, rurl := range c.params.RedirectLoginWhitelist {
-			if returnTo == rurl {
-				validReturnTo = true
-				break
-			}
+		return "", nil
+	}
+	if c.services != nil {
+		svc, err := c.services.ForURL(ctx, u)
+		if err == nil {
+			return svc.Name, nil
+		}
+		if errgo.Cause(err) != services.ErrNotFound {
+			return "", errgo.Mask(err)
 		}
 	}
-	u, err := url.Parse(returnTo)
-	if !validReturnTo || err != nil {
-		return errgo.WithCausef(err, params.ErrBadRequest, "invalid return_to")
+	for _, rurl := range c.params.RedirectLoginWhitelist {
+		if returnTo == rurl {
+			return "", nil
+		}
 	}
+	if c.returnTo.Allowed(u) {
+		return "", nil
+	}
+	return "", errgo.WithCausef(nil, params.ErrBadRequest, "invalid return_to")
+}
 
+// redirectTo writes a redirect response addressed to the given URL with
+// the given query parameters added.
+func redirectTo(w http.ResponseWriter, req *http.Request, u *url.URL, query url.Values) {
 	q := u.Query()
 	for k, v := range query {
 		q[k] = append(q[k], v...)
 	}
 	u.RawQuery = q.Encode()
 	http.Redirect(w, req, u.String(), http.StatusSeeOther)
-	return nil
 }
 
 func usernameFromDischargeToken(dt *httpbakery.DischargeToken) string {
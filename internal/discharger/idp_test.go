@@ -18,11 +18,13 @@ import (
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 
 	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/idputil"
 	"github.com/CanonicalLtd/candid/internal/auth"
 	"github.com/CanonicalLtd/candid/internal/candidtest"
 	"github.com/CanonicalLtd/candid/internal/discharger"
 	"github.com/CanonicalLtd/candid/internal/identity"
 	"github.com/CanonicalLtd/candid/internal/monitoring"
+	"github.com/CanonicalLtd/candid/internal/services"
 	"github.com/CanonicalLtd/candid/meeting"
 	"github.com/CanonicalLtd/candid/store"
 )
@@ -35,6 +37,7 @@ type idpSuite struct {
 	// template then it will be processed and the output returned.
 	template     *template.Template
 	meetingPlace *meeting.Place
+	services     *services.Store
 
 	vc idp.VisitCompleter
 }
@@ -55,7 +58,7 @@ func (s *idpSuite) Init(c *qt.C) {
 	var err error
 	s.meetingPlace, err = meeting.NewPlace(meeting.Params{
 		Store:      s.store.MeetingStore,
-		Metrics:    monitoring.NewMeetingMetrics(),
+		Metrics:    monitoring.NewMeetingMetrics(nil),
 		ListenAddr: "localhost",
 	})
 	c.Assert(err, qt.Equals, nil)
@@ -63,6 +66,7 @@ func (s *idpSuite) Init(c *qt.C) {
 
 	kvs, err := s.store.ProviderDataStore.KeyValueStore(context.Background(), "test-discharge-tokens")
 	c.Assert(err, qt.Equals, nil)
+	s.services = services.NewStore(kvs)
 	s.vc = discharger.NewVisitCompleter(identity.HandlerParams{
 		ServerParams: identity.ServerParams{
 			Store:        s.store.Store,
@@ -144,10 +148,70 @@ func (s *idpSuite) TestLoginSuccessWithTemplate(c *qt.C) {
 	c.Assert(rr.Body.String(), qt.Equals, "<h1>Login successful as test-user</h1>")
 }
 
-func (s *idpSuite) TestLoginRedirectSuccess(c *qt.C) {
+func (s *idpSuite) TestLoginSuccessWithBrandedTemplate(c *qt.C) {
+	_, err := s.template.New("login").Parse("<h1>Login successful as {{.Username}}</h1>")
+	c.Assert(err, qt.Equals, nil)
+	bt, err := template.New("").Funcs(idp.TemplateFuncs(nil)).New("login").Parse(`<p>{{text "welcome" "Welcome"}} {{.Username}}</p>`)
+	c.Assert(err, qt.Equals, nil)
+	err = discharger.SetBrandedTemplates(s.vc, identity.HandlerParams{
+		ServerParams: identity.ServerParams{
+			Template: s.template,
+			IDPBranding: map[string]idp.Branding{
+				"usso": {
+					Template: bt,
+					Strings:  map[string]string{"welcome": "Bienvenue"},
+				},
+			},
+		},
+	})
+	c.Assert(err, qt.Equals, nil)
+
 	req, err := http.NewRequest("GET", "", nil)
 	c.Assert(err, qt.Equals, nil)
 	rr := httptest.NewRecorder()
+	s.vc.Success(context.Background(), rr, req, "", &store.Identity{
+		ProviderID: store.MakeProviderIdentity("usso", "test-user"),
+		Username:   "test-user",
+	})
+	c.Assert(rr.Code, qt.Equals, http.StatusOK)
+	c.Assert(rr.Body.String(), qt.Equals, "<p>Bienvenue test-user</p>")
+
+	rr = httptest.NewRecorder()
+	s.vc.Success(context.Background(), rr, req, "", &store.Identity{
+		ProviderID: store.MakeProviderIdentity("azure", "test-user"),
+		Username:   "test-user",
+	})
+	c.Assert(rr.Code, qt.Equals, http.StatusOK)
+	c.Assert(rr.Body.String(), qt.Equals, "<h1>Login successful as test-user</h1>")
+}
+
+func (s *idpSuite) TestLoginSuccessLinkedIdentity(c *qt.C) {
+	ctx := context.Background()
+	err := s.store.Store.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("usso", "test-user"),
+		Username:   "test-user",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = discharger.LinkIdentities(ctx, s.vc, store.MakeProviderIdentity("usso", "test-user"), store.MakeProviderIdentity("azure", "test-user"))
+	c.Assert(err, qt.Equals, nil)
+
+	req, err := http.NewRequest("GET", "", nil)
+	c.Assert(err, qt.Equals, nil)
+	rr := httptest.NewRecorder()
+	s.vc.Success(ctx, rr, req, "", &store.Identity{
+		ProviderID: store.MakeProviderIdentity("azure", "test-user"),
+		Username:   "test-user@azure",
+	})
+	c.Assert(rr.Code, qt.Equals, http.StatusOK)
+	c.Assert(rr.Body.String(), qt.Equals, "Login successful as test-user")
+}
+
+func (s *idpSuite) TestLoginRedirectSuccess(c *qt.C) {
+	req, err := discharger.LoginRequest(s.vc, idputil.LoginState{})
+	c.Assert(err, qt.Equals, nil)
+	rr := httptest.NewRecorder()
 	s.vc.RedirectSuccess(context.Background(), rr, req, "http://example.com/callback", "1234", &store.Identity{
 		Username: "test-user",
 	})
@@ -163,7 +227,7 @@ func (s *idpSuite) TestLoginRedirectSuccess(c *qt.C) {
 }
 
 func (s *idpSuite) TestLoginRedirectSuccessInvalidReturnTo(c *qt.C) {
-	req, err := http.NewRequest("GET", "", nil)
+	req, err := discharger.LoginRequest(s.vc, idputil.LoginState{})
 	c.Assert(err, qt.Equals, nil)
 	rr := httptest.NewRecorder()
 	s.vc.RedirectSuccess(context.Background(), rr, req, "::", "1234", &store.Identity{
@@ -180,7 +244,7 @@ func (s *idpSuite) TestLoginRedirectSuccessInvalidReturnTo(c *qt.C) {
 }
 
 func (s *idpSuite) TestLoginRedirectSuccessReturnToNotInWhitelist(c *qt.C) {
-	req, err := http.NewRequest("GET", "", nil)
+	req, err := discharger.LoginRequest(s.vc, idputil.LoginState{})
 	c.Assert(err, qt.Equals, nil)
 	rr := httptest.NewRecorder()
 	s.vc.RedirectSuccess(context.Background(), rr, req, "https://example.com", "1234", &store.Identity{
@@ -196,6 +260,61 @@ func (s *idpSuite) TestLoginRedirectSuccessReturnToNotInWhitelist(c *qt.C) {
 	})
 }
 
+func (s *idpSuite) TestLoginRedirectSuccessRegisteredService(c *qt.C) {
+	ctx := context.Background()
+	err := s.services.Set(ctx, services.Service{
+		Name:    "dashboard",
+		Origins: []string{"https://dashboard.example.com"},
+	})
+	c.Assert(err, qt.Equals, nil)
+	req, err := discharger.LoginRequest(s.vc, idputil.LoginState{})
+	c.Assert(err, qt.Equals, nil)
+	rr := httptest.NewRecorder()
+	s.vc.RedirectSuccess(ctx, rr, req, "https://dashboard.example.com/callback", "1234", &store.Identity{
+		Username: "test-user",
+	})
+	resp := rr.Result()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther)
+	loc, err := resp.Location()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(loc.Query().Get("code"), qt.Not(qt.Equals), "")
+	loc.RawQuery = ""
+	c.Assert(loc.String(), qt.Equals, "https://dashboard.example.com/callback")
+
+	// Other origins are still refused.
+	for _, returnTo := range []string{
+		"http://dashboard.example.com/callback",
+		"https://evil.example.com/callback",
+		"https://user@dashboard.example.com/callback",
+	} {
+		rr := httptest.NewRecorder()
+		s.vc.RedirectSuccess(ctx, rr, req, returnTo, "1234", &store.Identity{
+			Username: "test-user",
+		})
+		c.Check(rr.Code, qt.Equals, http.StatusBadRequest, qt.Commentf("%s", returnTo))
+	}
+}
+
+func (s *idpSuite) TestLoginRedirectSuccessInvalidLoginState(c *qt.C) {
+	req, err := http.NewRequest("GET", "/?state=1234", nil)
+	c.Assert(err, qt.Equals, nil)
+	err = req.ParseForm()
+	c.Assert(err, qt.Equals, nil)
+	rr := httptest.NewRecorder()
+	s.vc.RedirectSuccess(context.Background(), rr, req, "http://example.com/callback", "5678", &store.Identity{
+		Username: "test-user",
+	})
+	resp := rr.Result()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusTemporaryRedirect)
+	loc, err := resp.Location()
+	c.Assert(err, qt.Equals, nil)
+	v := loc.Query()
+	c.Assert(v.Get("code"), qt.Equals, "")
+	c.Assert(v.Get("state"), qt.Equals, "5678")
+	c.Assert(v.Get("error_code"), qt.Equals, string(params.ErrBadRequest))
+	c.Assert(v.Get("error"), qt.Matches, `invalid login state: .*`)
+}
+
 func (s *idpSuite) TestLoginRedirectFailureInvalidReturnTo(c *qt.C) {
 	req, err := http.NewRequest("GET", "", nil)
 	c.Assert(err, qt.Equals, nil)
@@ -0,0 +1,160 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// ErrAlreadyLinked is the error cause used when an attempt is made to
+// link a provider identity that is already linked to a different
+// identity.
+var ErrAlreadyLinked = errgo.New("already linked")
+
+// IdentityLinkStore is a store for links between provider identities.
+// A link associates a secondary provider identity (for example an
+// azure login) with a primary provider identity that owns the
+// store.Identity record that should be used whenever the secondary
+// identity logs in. It wraps a KeyValueStore.
+type IdentityLinkStore struct {
+	store simplekv.Store
+}
+
+// NewIdentityLinkStore creates a new IdentityLinkStore using the given
+// KeyValueStore for backing storage.
+func NewIdentityLinkStore(store simplekv.Store) *IdentityLinkStore {
+	return &IdentityLinkStore{store: store}
+}
+
+// Link records that the given secondary provider identity should be
+// treated as the given primary provider identity. Linking an identity
+// to itself is an error, as is linking a secondary identity that is
+// already linked to a different primary. If the secondary identity is
+// already linked to the given primary then Link does nothing.
+func (s *IdentityLinkStore) Link(ctx context.Context, primary, secondary store.ProviderIdentity) error {
+	if primary == secondary {
+		return errgo.Newf("cannot link %q to itself", primary)
+	}
+	if p, err := s.Primary(ctx, primary); err == nil {
+		return errgo.WithCausef(nil, ErrAlreadyLinked, "%q is linked to %q", primary, p)
+	} else if errgo.Cause(err) != store.ErrNotFound {
+		return errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
+	}
+	if links, err := s.Links(ctx, secondary); err != nil {
+		return errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
+	} else if len(links) > 0 {
+		return errgo.WithCausef(nil, ErrAlreadyLinked, "%q has linked identities", secondary)
+	}
+	err := s.store.Update(ctx, primaryKey(secondary), time.Time{}, func(old []byte) ([]byte, error) {
+		if old != nil && store.ProviderIdentity(old) != primary {
+			return nil, errgo.WithCausef(nil, ErrAlreadyLinked, "%q is linked to %q", secondary, old)
+		}
+		return []byte(primary), nil
+	})
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrAlreadyLinked), errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
+	}
+	err = s.updateLinks(ctx, primary, func(links []store.ProviderIdentity) []store.ProviderIdentity {
+		for _, l := range links {
+			if l == secondary {
+				return links
+			}
+		}
+		return append(links, secondary)
+	})
+	return errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
+}
+
+// Unlink removes any link from the given secondary provider identity.
+// It is not an error to unlink an identity that is not linked.
+func (s *IdentityLinkStore) Unlink(ctx context.Context, secondary store.ProviderIdentity) error {
+	primary, err := s.Primary(ctx, secondary)
+	if errgo.Cause(err) == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
+	}
+	// simplekv has no delete operation, so removed links are
+	// recorded as an empty value.
+	if err := s.store.Set(ctx, primaryKey(secondary), nil, time.Time{}); err != nil {
+		return errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
+	}
+	err = s.updateLinks(ctx, primary, func(links []store.ProviderIdentity) []store.ProviderIdentity {
+		links1 := links[:0]
+		for _, l := range links {
+			if l != secondary {
+				links1 = append(links1, l)
+			}
+		}
+		return links1
+	})
+	return errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
+}
+
+// Primary returns the primary provider identity that the given
+// provider identity is linked to. If the given identity is not linked
+// then the returned error will have a cause of store.ErrNotFound.
+func (s *IdentityLinkStore) Primary(ctx context.Context, secondary store.ProviderIdentity) (store.ProviderIdentity, error) {
+	b, err := s.store.Get(ctx, primaryKey(secondary))
+	if err != nil {
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			return "", errgo.WithCausef(err, store.ErrNotFound, "")
+		}
+		return "", errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
+	}
+	if len(b) == 0 {
+		return "", errgo.WithCausef(nil, store.ErrNotFound, "%q not linked", secondary)
+	}
+	return store.ProviderIdentity(b), nil
+}
+
+// Links returns all the provider identities that are linked to the
+// given primary provider identity.
+func (s *IdentityLinkStore) Links(ctx context.Context, primary store.ProviderIdentity) ([]store.ProviderIdentity, error) {
+	b, err := s.store.Get(ctx, linksKey(primary))
+	if err != nil {
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			return nil, nil
+		}
+		return nil, errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
+	}
+	var links []store.ProviderIdentity
+	if err := json.Unmarshal(b, &links); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return links, nil
+}
+
+func (s *IdentityLinkStore) updateLinks(ctx context.Context, primary store.ProviderIdentity, f func([]store.ProviderIdentity) []store.ProviderIdentity) error {
+	return s.store.Update(ctx, linksKey(primary), time.Time{}, func(old []byte) ([]byte, error) {
+		var links []store.ProviderIdentity
+		if old != nil {
+			if err := json.Unmarshal(old, &links); err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
+		b, err := json.Marshal(f(links))
+		if err != nil {
+			// This should be impossible.
+			panic(err)
+		}
+		return b, nil
+	})
+}
+
+func primaryKey(pid store.ProviderIdentity) string {
+	return "primary:" + string(pid)
+}
+
+func linksKey(pid store.ProviderIdentity) string {
+	return "links:" + string(pid)
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package internal_test
+
+import (
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/internal/candidtest"
+	"github.com/CanonicalLtd/candid/internal/discharger/internal"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+func TestIdentityLinkStore(t *testing.T) {
+	qtsuite.Run(qt.New(t), &linkStoreSuite{})
+}
+
+type linkStoreSuite struct {
+	links *internal.IdentityLinkStore
+}
+
+func (s *linkStoreSuite) Init(c *qt.C) {
+	kv, err := candidtest.NewStore().ProviderDataStore.KeyValueStore(context.Background(), "test")
+	c.Assert(err, qt.Equals, nil)
+	s.links = internal.NewIdentityLinkStore(kv)
+}
+
+var (
+	usso  = store.MakeProviderIdentity("usso", "bob")
+	azure = store.MakeProviderIdentity("azure", "bob")
+	ldap  = store.MakeProviderIdentity("ldap", "bob")
+)
+
+func (s *linkStoreSuite) TestLink(c *qt.C) {
+	ctx := context.Background()
+	err := s.links.Link(ctx, usso, azure)
+	c.Assert(err, qt.Equals, nil)
+	err = s.links.Link(ctx, usso, ldap)
+	c.Assert(err, qt.Equals, nil)
+
+	primary, err := s.links.Primary(ctx, azure)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(primary, qt.Equals, usso)
+	links, err := s.links.Links(ctx, usso)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(links, qt.DeepEquals, []store.ProviderIdentity{azure, ldap})
+
+	// Linking again is a no-op.
+	err = s.links.Link(ctx, usso, azure)
+	c.Assert(err, qt.Equals, nil)
+	links, err = s.links.Links(ctx, usso)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(links, qt.DeepEquals, []store.ProviderIdentity{azure, ldap})
+}
+
+func (s *linkStoreSuite) TestPrimaryNotFound(c *qt.C) {
+	_, err := s.links.Primary(context.Background(), usso)
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+}
+
+func (s *linkStoreSuite) TestLinkToSelf(c *qt.C) {
+	err := s.links.Link(context.Background(), usso, usso)
+	c.Assert(err, qt.ErrorMatches, `cannot link "usso:bob" to itself`)
+}
+
+func (s *linkStoreSuite) TestLinkAlreadyLinked(c *qt.C) {
+	ctx := context.Background()
+	err := s.links.Link(ctx, usso, azure)
+	c.Assert(err, qt.Equals, nil)
+	err = s.links.Link(ctx, ldap, azure)
+	c.Assert(err, qt.ErrorMatches, `"azure:bob" is linked to "usso:bob"`)
+	c.Assert(errgo.Cause(err), qt.Equals, internal.ErrAlreadyLinked)
+	err = s.links.Link(ctx, azure, ldap)
+	c.Assert(err, qt.ErrorMatches, `"azure:bob" is linked to "usso:bob"`)
+	c.Assert(errgo.Cause(err), qt.Equals, internal.ErrAlreadyLinked)
+	err = s.links.Link(ctx, ldap, usso)
+	c.Assert(err, qt.ErrorMatches, `"usso:bob" has linked identities`)
+	c.Assert(errgo.Cause(err), qt.Equals, internal.ErrAlreadyLinked)
+}
+
+func (s *linkStoreSuite) TestUnlink(c *qt.C) {
+	ctx := context.Background()
+	err := s.links.Link(ctx, usso, azure)
+	c.Assert(err, qt.Equals, nil)
+	err = s.links.Unlink(ctx, azure)
+	c.Assert(err, qt.Equals, nil)
+	_, err = s.links.Primary(ctx, azure)
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	links, err := s.links.Links(ctx, usso)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(links, qt.HasLen, 0)
+
+	// Unlinking an identity that isn't linked is not an error.
+	err = s.links.Unlink(ctx, azure)
+	c.Assert(err, qt.Equals, nil)
+
+	// The identity can now be linked elsewhere.
+	err = s.links.Link(ctx, ldap, azure)
+	c.Assert(err, qt.Equals, nil)
+}
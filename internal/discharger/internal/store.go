@@ -5,9 +5,12 @@ package internal
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
+	"strings"
 	"time"
 
 	"github.com/juju/simplekv"
@@ -17,7 +20,98 @@ import (
 	"github.com/CanonicalLtd/candid/store"
 )
 
-// DischargeTokenStore is a store for discharge tokens. It wraps a
+var (
+	// ErrCodeReused is the error cause returned from Redeem when an
+	// authorization code has already been redeemed.
+	ErrCodeReused = errgo.New("authorization code already used")
+
+	// ErrInvalidVerifier is the error cause returned from Redeem
+	// when the code verifier does not match the code challenge of
+	// an authorization code.
+	ErrInvalidVerifier = errgo.New("invalid code verifier")
+)
+
+// Code challenge methods defined by RFC 7636.
+const (
+	CodeChallengePlain = "plain"
+	CodeChallengeS256  = "S256"
+)
+
+// A CodeChallenge holds a code challenge, as defined by RFC 7636
+// (PKCE), that binds an authorization code to the client that started
+// the login.
+type CodeChallenge struct {
+	Challenge string `json:",omitempty"`
+	Method    string `json:",omitempty"`
+}
+
+// NewCodeChallenge validates the given code challenge and method, as
+// sent with a login request, and returns the corresponding
+// CodeChallenge. If the method is not specified then the plain method
+// is used, as required by RFC 7636. If challenge is empty then the zero
+// CodeChallenge is returned.
+func NewCodeChallenge(challenge, method string) (CodeChallenge, error) {
+	if challenge == "" {
+		if method != "" {
+			return CodeChallenge{}, errgo.Newf("code_challenge_method specified without code_challenge")
+		}
+		return CodeChallenge{}, nil
+	}
+	if method == "" {
+		method = CodeChallengePlain
+	}
+	if method != CodeChallengePlain && method != CodeChallengeS256 {
+		return CodeChallenge{}, errgo.Newf("unsupported code_challenge_method %q", method)
+	}
+	if !validCodeVerifier(challenge) {
+		return CodeChallenge{}, errgo.Newf("invalid code_challenge")
+	}
+	return CodeChallenge{
+		Challenge: challenge,
+		Method:    method,
+	}, nil
+}
+
+// Verify reports whether the given code verifier matches the code
+// challenge.
+func (c CodeChallenge) Verify(verifier string) bool {
+	if c.Challenge == "" || !validCodeVerifier(verifier) {
+		return false
+	}
+	v := verifier
+	if c.Method == CodeChallengeS256 {
+		sum := sha256.Sum256([]byte(verifier))
+		v = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(v), []byte(c.Challenge)) == 1
+}
+
+// validCodeVerifier reports whether s is a valid code verifier, or
+// code challenge, which RFC 7636 requires to be between 43 and 128
+// unreserved URL characters.
+func validCodeVerifier(s string) bool {
+	if len(s) < 43 || len(s) > 128 {
+		return false
+	}
+	return strings.IndexFunc(s, func(r rune) bool {
+		return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || strings.ContainsRune("-._~", r))
+	}) == -1
+}
+
+// A Binding restricts the clients that may redeem an authorization
+// code.
+type Binding struct {
+	// Service holds the name of the registered relying service
+	// that the code was issued to, if any.
+	Service string
+
+	// CodeChallenge holds the code challenge sent with the login
+	// request, if any.
+	CodeChallenge CodeChallenge
+}
+
+// DischargeTokenStore is a store for discharge tokens, which are
+// retrieved using single-use authorization codes. It wraps a
 // KeyValueStore.
 type DischargeTokenStore struct {
 	store simplekv.Store
@@ -29,12 +123,21 @@ func NewDischargeTokenStore(store simplekv.Store) *DischargeTokenStore {
 	return &DischargeTokenStore{store: store}
 }
 
-// Put adds the given DischargeToken to the store, returning the key that
-// should be used to later retrieve the token. The DischargeToken will
-// only be available in the store until the given expire time.
+// Put adds the given DischargeToken to the store, returning the
+// authorization code that should be used to later retrieve the token.
+// The DischargeToken will only be available in the store until the
+// given expire time.
 func (s *DischargeTokenStore) Put(ctx context.Context, dt *httpbakery.DischargeToken, expire time.Time) (string, error) {
+	return s.PutBound(ctx, dt, Binding{}, expire)
+}
+
+// PutBound is like Put except that the returned code may only be
+// redeemed by the clients allowed by the given binding.
+func (s *DischargeTokenStore) PutBound(ctx context.Context, dt *httpbakery.DischargeToken, binding Binding, expire time.Time) (string, error) {
 	entry := dischargeTokenEntry{
 		DischargeToken: dt,
+		Service:        binding.Service,
+		CodeChallenge:  binding.CodeChallenge,
 		Expire:         expire,
 	}
 	b, err := json.Marshal(entry)
@@ -42,19 +145,35 @@ func (s *DischargeTokenStore) Put(ctx context.Context, dt *httpbakery.DischargeT
 		// This should be impossible.
 		panic(err)
 	}
-	hash := sha256.Sum256(b)
-	key := base64.RawURLEncoding.EncodeToString(hash[:])
-	if err := s.store.Set(ctx, key, b, expire); err != nil {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errgo.Mask(err)
+	}
+	code := base64.RawURLEncoding.EncodeToString(buf)
+	if err := s.store.Set(ctx, key(code), b, expire); err != nil {
 		return "", errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
 	}
-	return key, nil
+	return code, nil
 }
 
-// Get retrieves the DischargeToken with the given key from the store. If
-// there is no such token, or the token has expired, then the returned
-// error will have a cause of store.ErrNotFound.
-func (s *DischargeTokenStore) Get(ctx context.Context, key string) (*httpbakery.DischargeToken, error) {
-	b, err := s.store.Get(ctx, key)
+// Redeem retrieves the DischargeToken with the given authorization code
+// from the store. Each code can only be redeemed once. If there is no
+// such code, or it has expired, then the returned error will have a
+// cause of store.ErrNotFound. If the code has already been redeemed
+// the returned error will have a cause of ErrCodeReused and the
+// DischargeToken is also returned, so that it can be revoked.
+//
+// If the code is bound to a code challenge then the given verifier
+// must match it, otherwise the returned error will have a cause of
+// ErrInvalidVerifier; a verifier is not accepted for a code that has no
+// code challenge. If the code is bound to a service, whether or not it
+// also has a code challenge, authenticate is called with the name of
+// the service to check that the client redeeming the code is that
+// service; if authenticate is nil, or returns an error, the code is not
+// redeemed.
+func (s *DischargeTokenStore) Redeem(ctx context.Context, code, verifier string, authenticate func(service string) error) (*httpbakery.DischargeToken, error) {
+	k := key(code)
+	b, err := s.store.Get(ctx, k)
 	if err != nil {
 		if errgo.Cause(err) == simplekv.ErrNotFound {
 			return nil, errgo.WithCausef(err, store.ErrNotFound, "")
@@ -66,12 +185,66 @@ func (s *DischargeTokenStore) Get(ctx context.Context, key string) (*httpbakery.
 		return nil, errgo.Mask(err)
 	}
 	if entry.Expire.Before(time.Now()) {
-		return nil, errgo.WithCausef(nil, store.ErrNotFound, "%q not found", key)
+		return nil, errgo.WithCausef(nil, store.ErrNotFound, "%q not found", code)
+	}
+	if entry.Used {
+		return entry.DischargeToken, errgo.WithCausef(nil, ErrCodeReused, "")
+	}
+	if entry.CodeChallenge.Challenge != "" {
+		if !entry.CodeChallenge.Verify(verifier) {
+			return nil, errgo.WithCausef(nil, ErrInvalidVerifier, "")
+		}
+	} else if verifier != "" {
+		return nil, errgo.WithCausef(nil, ErrInvalidVerifier, "authorization code has no code challenge")
+	}
+	if entry.Service != "" {
+		if authenticate == nil {
+			return nil, errgo.Newf("authorization code issued to service %q", entry.Service)
+		}
+		if err := authenticate(entry.Service); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+	}
+	var reused bool
+	var ferr error
+	err = s.store.Update(ctx, k, entry.Expire, func(old []byte) ([]byte, error) {
+		if len(old) == 0 {
+			// The entry has expired since it was read.
+			ferr = errgo.WithCausef(nil, store.ErrNotFound, "%q not found", code)
+			return nil, ferr
+		}
+		var entry dischargeTokenEntry
+		if err := json.Unmarshal(old, &entry); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		reused = entry.Used
+		entry.Used = true
+		return json.Marshal(entry)
+	})
+	if ferr != nil {
+		return nil, ferr
+	}
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
+	}
+	if reused {
+		return entry.DischargeToken, errgo.WithCausef(nil, ErrCodeReused, "")
 	}
 	return entry.DischargeToken, nil
 }
 
+// key returns the key under which the discharge token for the given
+// code is stored. Only a hash of the code is stored so that the codes
+// cannot be read from the database.
+func key(code string) string {
+	hash := sha256.Sum256([]byte(code))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
 type dischargeTokenEntry struct {
 	DischargeToken *httpbakery.DischargeToken
+	Service        string `json:",omitempty"`
+	CodeChallenge  CodeChallenge
 	Expire         time.Time
+	Used           bool `json:",omitempty"`
 }
@@ -40,13 +40,198 @@ func (s *storeSuite) TestRoundTrip(c *qt.C) {
 		Kind:  "test",
 		Value: []byte("test-value"),
 	}
-	key, err := store.Put(ctx, &dt, time.Now().Add(time.Minute))
+	code, err := store.Put(ctx, &dt, time.Now().Add(time.Minute))
 	c.Assert(err, qt.Equals, nil)
-	dt1, err := store.Get(ctx, key)
+	dt1, err := store.Redeem(ctx, code, "", nil)
 	c.Assert(err, qt.Equals, nil)
 	c.Assert(dt1, qt.DeepEquals, &dt)
 }
 
+func (s *storeSuite) TestRedeemTwice(c *qt.C) {
+	ctx := context.Background()
+	kv, err := s.store.ProviderDataStore.KeyValueStore(ctx, "test")
+	c.Assert(err, qt.Equals, nil)
+	store := internal.NewDischargeTokenStore(kv)
+	dt := httpbakery.DischargeToken{
+		Kind:  "test",
+		Value: []byte("test-value"),
+	}
+	code, err := store.Put(ctx, &dt, time.Now().Add(time.Minute))
+	c.Assert(err, qt.Equals, nil)
+	_, err = store.Redeem(ctx, code, "", nil)
+	c.Assert(err, qt.Equals, nil)
+	dt1, err := store.Redeem(ctx, code, "", nil)
+	c.Assert(errgo.Cause(err), qt.Equals, internal.ErrCodeReused)
+	c.Assert(dt1, qt.DeepEquals, &dt)
+}
+
+func (s *storeSuite) TestRedeemForService(c *qt.C) {
+	ctx := context.Background()
+	kv, err := s.store.ProviderDataStore.KeyValueStore(ctx, "test")
+	c.Assert(err, qt.Equals, nil)
+	store := internal.NewDischargeTokenStore(kv)
+	dt := httpbakery.DischargeToken{
+		Kind:  "test",
+		Value: []byte("test-value"),
+	}
+	code, err := store.PutBound(ctx, &dt, internal.Binding{Service: "dashboard"}, time.Now().Add(time.Minute))
+	c.Assert(err, qt.Equals, nil)
+
+	_, err = store.Redeem(ctx, code, "", nil)
+	c.Assert(err, qt.ErrorMatches, `authorization code issued to service "dashboard"`)
+
+	testErr := errgo.New("test error")
+	_, err = store.Redeem(ctx, code, "", func(service string) error {
+		c.Check(service, qt.Equals, "dashboard")
+		return testErr
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, testErr)
+
+	// Failed attempts do not use the code.
+	dt1, err := store.Redeem(ctx, code, "", func(service string) error {
+		return nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(dt1, qt.DeepEquals, &dt)
+}
+
+// The code verifier and challenge from RFC 7636 appendix B.
+const (
+	testCodeVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	testCodeChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+func (s *storeSuite) TestRedeemWithCodeChallenge(c *qt.C) {
+	ctx := context.Background()
+	kv, err := s.store.ProviderDataStore.KeyValueStore(ctx, "test")
+	c.Assert(err, qt.Equals, nil)
+	store := internal.NewDischargeTokenStore(kv)
+	dt := httpbakery.DischargeToken{
+		Kind:  "test",
+		Value: []byte("test-value"),
+	}
+	cc, err := internal.NewCodeChallenge(testCodeChallenge, "S256")
+	c.Assert(err, qt.Equals, nil)
+	code, err := store.PutBound(ctx, &dt, internal.Binding{
+		Service:       "dashboard",
+		CodeChallenge: cc,
+	}, time.Now().Add(time.Minute))
+	c.Assert(err, qt.Equals, nil)
+
+	_, err = store.Redeem(ctx, code, "", nil)
+	c.Assert(errgo.Cause(err), qt.Equals, internal.ErrInvalidVerifier)
+	_, err = store.Redeem(ctx, code, testCodeChallenge, nil)
+	c.Assert(errgo.Cause(err), qt.Equals, internal.ErrInvalidVerifier)
+
+	// The service must still authenticate.
+	_, err = store.Redeem(ctx, code, testCodeVerifier, nil)
+	c.Assert(err, qt.ErrorMatches, `authorization code issued to service "dashboard"`)
+
+	dt1, err := store.Redeem(ctx, code, testCodeVerifier, func(service string) error {
+		c.Check(service, qt.Equals, "dashboard")
+		return nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(dt1, qt.DeepEquals, &dt)
+}
+
+func (s *storeSuite) TestRedeemWithCodeChallengeWithoutService(c *qt.C) {
+	ctx := context.Background()
+	kv, err := s.store.ProviderDataStore.KeyValueStore(ctx, "test")
+	c.Assert(err, qt.Equals, nil)
+	store := internal.NewDischargeTokenStore(kv)
+	dt := httpbakery.DischargeToken{
+		Kind:  "test",
+		Value: []byte("test-value"),
+	}
+	cc, err := internal.NewCodeChallenge(testCodeChallenge, "S256")
+	c.Assert(err, qt.Equals, nil)
+	code, err := store.PutBound(ctx, &dt, internal.Binding{
+		CodeChallenge: cc,
+	}, time.Now().Add(time.Minute))
+	c.Assert(err, qt.Equals, nil)
+
+	// Without a service the verifier is enough.
+	dt1, err := store.Redeem(ctx, code, testCodeVerifier, nil)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(dt1, qt.DeepEquals, &dt)
+}
+
+func (s *storeSuite) TestRedeemVerifierWithoutCodeChallenge(c *qt.C) {
+	ctx := context.Background()
+	kv, err := s.store.ProviderDataStore.KeyValueStore(ctx, "test")
+	c.Assert(err, qt.Equals, nil)
+	store := internal.NewDischargeTokenStore(kv)
+	dt := httpbakery.DischargeToken{
+		Kind:  "test",
+		Value: []byte("test-value"),
+	}
+	code, err := store.Put(ctx, &dt, time.Now().Add(time.Minute))
+	c.Assert(err, qt.Equals, nil)
+	_, err = store.Redeem(ctx, code, testCodeVerifier, nil)
+	c.Assert(err, qt.ErrorMatches, `authorization code has no code challenge`)
+	c.Assert(errgo.Cause(err), qt.Equals, internal.ErrInvalidVerifier)
+}
+
+var codeChallengeTests = []struct {
+	about       string
+	challenge   string
+	method      string
+	verifier    string
+	expectError string
+	expectMatch bool
+}{{
+	about:       "S256",
+	challenge:   testCodeChallenge,
+	method:      "S256",
+	verifier:    testCodeVerifier,
+	expectMatch: true,
+}, {
+	about:       "plain by default",
+	challenge:   testCodeVerifier,
+	verifier:    testCodeVerifier,
+	expectMatch: true,
+}, {
+	about:     "S256 mismatch",
+	challenge: testCodeChallenge,
+	method:    "S256",
+	verifier:  testCodeVerifier + "x",
+}, {
+	about:       "unsupported method",
+	challenge:   testCodeChallenge,
+	method:      "S512",
+	expectError: `unsupported code_challenge_method "S512"`,
+}, {
+	about:       "short challenge",
+	challenge:   "abc",
+	method:      "S256",
+	expectError: `invalid code_challenge`,
+}, {
+	about:       "invalid characters",
+	challenge:   testCodeChallenge[1:] + "+",
+	method:      "S256",
+	expectError: `invalid code_challenge`,
+}, {
+	about:       "method without challenge",
+	method:      "S256",
+	expectError: `code_challenge_method specified without code_challenge`,
+}}
+
+func TestCodeChallenge(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range codeChallengeTests {
+		c.Run(test.about, func(c *qt.C) {
+			cc, err := internal.NewCodeChallenge(test.challenge, test.method)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(cc.Verify(test.verifier), qt.Equals, test.expectMatch)
+		})
+	}
+}
+
 func (s *storeSuite) TestPutCanceled(c *qt.C) {
 	ctx := context.Background()
 	kv, err := s.store.ProviderDataStore.KeyValueStore(ctx, "test")
@@ -79,50 +264,50 @@ func (s *storeSuite) TestPutDeadlineExceeded(c *qt.C) {
 	c.Assert(errgo.Cause(err), qt.Equals, context.DeadlineExceeded)
 }
 
-func (s *storeSuite) TestGetNotFound(c *qt.C) {
+func (s *storeSuite) TestRedeemNotFound(c *qt.C) {
 	ctx := context.Background()
 	kv, err := s.store.ProviderDataStore.KeyValueStore(ctx, "test")
 	c.Assert(err, qt.Equals, nil)
 	st := internal.NewDischargeTokenStore(withGet(kv, func(context.Context, string) ([]byte, error) {
 		return nil, simplekv.ErrNotFound
 	}))
-	_, err = st.Get(ctx, "")
+	_, err = st.Redeem(ctx, "", "", nil)
 	c.Assert(err, qt.ErrorMatches, "not found")
 	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
 }
 
-func (s *storeSuite) TestGetCanceled(c *qt.C) {
+func (s *storeSuite) TestRedeemCanceled(c *qt.C) {
 	ctx := context.Background()
 	kv, err := s.store.ProviderDataStore.KeyValueStore(ctx, "test")
 	c.Assert(err, qt.Equals, nil)
 	st := internal.NewDischargeTokenStore(withGet(kv, func(context.Context, string) ([]byte, error) {
 		return nil, context.Canceled
 	}))
-	_, err = st.Get(ctx, "")
+	_, err = st.Redeem(ctx, "", "", nil)
 	c.Assert(err, qt.ErrorMatches, "context canceled")
 	c.Assert(errgo.Cause(err), qt.Equals, context.Canceled)
 }
 
-func (s *storeSuite) TestGetDeadlineExceeded(c *qt.C) {
+func (s *storeSuite) TestRedeemDeadlineExceeded(c *qt.C) {
 	ctx := context.Background()
 	kv, err := s.store.ProviderDataStore.KeyValueStore(ctx, "test")
 	c.Assert(err, qt.Equals, nil)
 	st := internal.NewDischargeTokenStore(withGet(kv, func(context.Context, string) ([]byte, error) {
 		return nil, context.DeadlineExceeded
 	}))
-	_, err = st.Get(ctx, "")
+	_, err = st.Redeem(ctx, "", "", nil)
 	c.Assert(err, qt.ErrorMatches, "context deadline exceeded")
 	c.Assert(errgo.Cause(err), qt.Equals, context.DeadlineExceeded)
 }
 
-func (s *storeSuite) TestGetInvalidJSON(c *qt.C) {
+func (s *storeSuite) TestRedeemInvalidJSON(c *qt.C) {
 	ctx := context.Background()
 	kv, err := s.store.ProviderDataStore.KeyValueStore(ctx, "test")
 	c.Assert(err, qt.Equals, nil)
 	st := internal.NewDischargeTokenStore(withGet(kv, func(context.Context, string) ([]byte, error) {
 		return []byte("}"), nil
 	}))
-	_, err = st.Get(ctx, "")
+	_, err = st.Redeem(ctx, "", "", nil)
 	c.Assert(err, qt.ErrorMatches, "invalid character '}' looking for beginning of value")
 }
 
@@ -135,9 +320,9 @@ func (s *storeSuite) TestExpiredEntry(c *qt.C) {
 		Kind:  "test",
 		Value: []byte("test-value"),
 	}
-	key, err := st.Put(ctx, &dt, time.Now())
+	code, err := st.Put(ctx, &dt, time.Now())
 	c.Assert(err, qt.Equals, nil)
-	_, err = st.Get(ctx, key)
+	_, err = st.Redeem(ctx, code, "", nil)
 	c.Assert(err, qt.ErrorMatches, `".*" not found`)
 	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
 }
@@ -0,0 +1,60 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"encoding/base64"
+
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/candid/internal/jwt"
+)
+
+// jwksRequest is a request for the server's public keys as a JSON Web
+// Key Set.
+type jwksRequest struct {
+	httprequest.Route `httprequest:"GET /.well-known/jwks.json"`
+}
+
+// A jwks is a JSON Web Key Set, as defined in RFC 7517.
+type jwks struct {
+	Keys []jwt.JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of the key pairs currently accepted by
+// the server, the current key first. Bakery key pairs are X25519 keys
+// that are used to encrypt third-party caveats, so they are published
+// as OKP keys for encryption, as described in RFC 8037. The key used
+// to sign JSON Web Tokens and back-channel logout tokens is also
+// published.
+func (h *handler) JWKS(p httprequest.Params, _ *jwksRequest) (*jwks, error) {
+	var resp jwks
+	for _, k := range h.params.KeyRing.Keys() {
+		resp.Keys = append(resp.Keys, bakeryJWK(&k.KeyPair.Public))
+	}
+	switch {
+	case h.params.JWTIssuer != nil:
+		resp.Keys = append(resp.Keys, h.params.JWTIssuer.JWK())
+	case h.params.LogoutNotifier != nil:
+		resp.Keys = append(resp.Keys, h.params.LogoutNotifier.JWK())
+	}
+	return &resp, nil
+}
+
+// bakeryJWK returns the JWK form of the given bakery public key.
+func bakeryJWK(pk *bakery.PublicKey) jwt.JWK {
+	k := jwt.JWK{
+		KeyType: "OKP",
+		Use:     "enc",
+		Curve:   "X25519",
+		X:       base64.RawURLEncoding.EncodeToString(pk.Key[:]),
+	}
+	k.KeyID = jwt.Thumbprint(map[string]string{
+		"crv": k.Curve,
+		"kty": k.KeyType,
+		"x":   k.X,
+	})
+	return k
+}
@@ -0,0 +1,72 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+	"gopkg.in/macaroon.v2"
+
+	"github.com/CanonicalLtd/candid/internal/identity"
+	"github.com/CanonicalLtd/candid/internal/keyring"
+)
+
+// dischargerHandlers returns the handlers for the standard bakery
+// discharger endpoints. Each request is handled by a discharger using
+// the key pair that the requested caveat was encrypted for, so that
+// caveats encrypted for a recently rotated key can still be
+// discharged. Requests that do not contain a caveat, such as those for
+// the public key, use the current key pair.
+func dischargerHandlers(keys *keyring.Ring, checker httpbakery.ThirdPartyCaveatChecker) []httprequest.Handler {
+	newDischarger := func(key *bakery.KeyPair) *httpbakery.Discharger {
+		return httpbakery.NewDischarger(httpbakery.DischargerParams{
+			CheckerP:        checker,
+			Key:             key,
+			ErrorToResponse: identity.ReqServer.ErrorMapper,
+		})
+	}
+	handlers := newDischarger(keys.Current()).Handlers()
+	for i := range handlers {
+		i := i
+		handlers[i].Handle = func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+			key := keys.Current()
+			if caveat := requestCaveat(req); caveat != nil {
+				key = keys.KeyForCaveat(caveat)
+			}
+			newDischarger(key).Handlers()[i].Handle(w, req, p)
+		}
+	}
+	return handlers
+}
+
+// requestCaveat returns the encoded third-party caveat held in a
+// discharge request, or nil if there is none.
+func requestCaveat(req *http.Request) []byte {
+	if err := req.ParseForm(); err != nil {
+		return nil
+	}
+	if c := req.Form.Get("caveat64"); c != "" {
+		caveat, err := macaroon.Base64Decode([]byte(c))
+		if err != nil {
+			return nil
+		}
+		return caveat
+	}
+	// Older clients send the caveat as the caveat id.
+	if id := req.Form.Get("id64"); id != "" {
+		caveat, err := macaroon.Base64Decode([]byte(id))
+		if err != nil {
+			return nil
+		}
+		return caveat
+	}
+	if id := req.Form.Get("id"); id != "" {
+		return []byte(id)
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/candid/idp/idputil"
+	"github.com/CanonicalLtd/candid/internal/auth"
+	"github.com/CanonicalLtd/candid/internal/discharger/internal"
+	"github.com/CanonicalLtd/candid/internal/secheaders"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// A linkState holds the state of a login that is waiting for the user
+// to decide whether the identity they have just authenticated as
+// should be linked to the identity they were already logged in as.
+type linkState struct {
+	// Primary holds the provider identity that the user was
+	// already logged in as.
+	Primary store.ProviderIdentity
+
+	// Secondary holds the provider identity that the user has just
+	// authenticated as.
+	Secondary store.ProviderIdentity
+
+	// DischargeID holds the discharge ID of an interactive login,
+	// if any.
+	DischargeID string
+
+	// ReturnTo and State hold the return_to address and state of a
+	// redirect based login, if any.
+	ReturnTo string
+	State    string
+
+	// CodeChallenge holds the PKCE code challenge of a redirect
+	// based login, if any.
+	CodeChallenge internal.CodeChallenge
+
+	// RememberBrowser records whether the user asked for their
+	// browser to be remembered.
+	RememberBrowser bool
+
+	// Expires holds the time after which the decision can no longer
+	// be made.
+	Expires time.Time
+}
+
+// linkIdentityParams holds the parameters passed to the link-identity
+// template.
+type linkIdentityParams struct {
+	// Action contains the action parameter for the form.
+	Action string
+
+	// State contains the encoded linkState that must be sent back
+	// in the form.
+	State string
+
+	// Current contains the identity that the user is currently
+	// logged in as.
+	Current *store.Identity
+
+	// New contains the identity that the user has just
+	// authenticated as.
+	New *store.Identity
+}
+
+// linkedIdentity returns the identity that should be used when the
+// given identity logs in. If the provider identity of id has been linked
+// to another identity then that identity is returned, otherwise id is
+// returned unchanged.
+func (c *visitCompleter) linkedIdentity(ctx context.Context, id *store.Identity) (*store.Identity, error) {
+	if c.identityLinkStore == nil || id.ProviderID == "" {
+		return id, nil
+	}
+	primary, err := c.identityLinkStore.Primary(ctx, id.ProviderID)
+	if errgo.Cause(err) == store.ErrNotFound {
+		return id, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	lid := store.Identity{
+		ProviderID: primary,
+	}
+	if err := c.params.Store.Identity(ctx, &lid); err != nil {
+		return nil, errgo.Notef(err, "cannot get linked identity")
+	}
+	// The linked identity has authenticated with the same factors
+	// as the identity that has just logged in, not those recorded
+	// at its own last login.
+	if lid.ProviderInfo == nil {
+		lid.ProviderInfo = make(map[string][]string)
+	}
+	lid.ProviderInfo[auth.MFAProviderInfo] = id.ProviderInfo[auth.MFAProviderInfo]
+	logger.Debugf("%q logging in as linked identity %q", id.ProviderID, primary)
+	return &lid, nil
+}
+
+// offerLink determines whether the user completing a login as the given
+// identity is already logged in to candid as a different user and, if
+// so, writes a page asking whether the two identities should be linked.
+// It reports whether such a page was written.
+func (c *visitCompleter) offerLink(ctx context.Context, w http.ResponseWriter, req *http.Request, ls linkState, id *store.Identity) bool {
+	t := c.template(id)
+	if t.Lookup("link-identity") == nil || c.identityLinkStore == nil || req == nil || !linkable(id.ProviderID) {
+		return false
+	}
+	current := c.currentIdentity(ctx, req)
+	if current == nil || current.ProviderID == id.ProviderID || !linkable(current.ProviderID) {
+		return false
+	}
+	ls.Primary = current.ProviderID
+	ls.Secondary = id.ProviderID
+	ls.Expires = time.Now().Add(15 * time.Minute)
+	state, err := c.codec.Encode(ls)
+	if err != nil {
+		logger.Errorf("cannot encode link state: %s", err)
+		return false
+	}
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	if err := secheaders.ExecuteTemplate(ctx, w, t, "link-identity", linkIdentityParams{
+		Action:  c.params.Location + "/link-identity",
+		State:   state,
+		Current: current,
+		New:     id,
+	}); err != nil {
+		logger.Errorf("error processing link-identity template: %s", err)
+	}
+	return true
+}
+
+// currentIdentity returns the identity that the given request is
+// authenticated as by any identity cookie it holds. If the request is
+// not authenticated then nil is returned.
+func (c *visitCompleter) currentIdentity(ctx context.Context, req *http.Request) *store.Identity {
+	mss := httpbakery.RequestMacaroons(req)
+	if len(mss) == 0 {
+		return nil
+	}
+	authInfo, err := c.params.Authorizer.Auth(ctx, mss, identchecker.LoginOp)
+	if err != nil || authInfo.Identity == nil {
+		return nil
+	}
+	aid, ok := authInfo.Identity.(*auth.Identity)
+	if !ok {
+		return nil
+	}
+	id, err := aid.StoreIdentity(ctx)
+	if err != nil {
+		logger.Infof("cannot get current identity: %s", err)
+		return nil
+	}
+	return id
+}
+
+// complete completes the login described by the given linkState as the
+// given identity.
+func (c *visitCompleter) complete(ctx context.Context, w http.ResponseWriter, req *http.Request, ls linkState, id *store.Identity) {
+	if ls.ReturnTo != "" {
+		if ls.RememberBrowser {
+			c.rememberBrowser(ctx, w, req, id)
+		}
+		c.redirectSuccess(ctx, w, req, ls.ReturnTo, ls.State, ls.CodeChallenge, id)
+		return
+	}
+	c.success(ctx, w, req, ls.DischargeID, id)
+}
+
+// fail fails the login described by the given linkState with the given
+// error.
+func (c *visitCompleter) fail(ctx context.Context, w http.ResponseWriter, req *http.Request, ls linkState, err error) {
+	if ls.ReturnTo != "" {
+		c.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
+		return
+	}
+	c.Failure(ctx, w, req, ls.DischargeID, err)
+}
+
+// linkable reports whether identities with the given provider identity
+// may be linked. Agent identities, including the admin identity, are
+// never linked.
+func linkable(pid store.ProviderIdentity) bool {
+	return pid != "" && pid.Provider() != "idm"
+}
+
+// linkIdentityRequest is a request to complete a login that is waiting
+// for the user to decide whether to link two identities.
+type linkIdentityRequest struct {
+	httprequest.Route `httprequest:"POST /link-identity"`
+
+	// State holds the encoded linkState from the link-identity page.
+	State string `httprequest:"state,form"`
+
+	// Link is non-empty if the user has chosen to link the
+	// identities.
+	Link string `httprequest:"link,form"`
+}
+
+// LinkIdentity handles the response from the link-identity page. If the
+// user chose to link the identities then the newly authenticated
+// identity will be linked to the identity the user was already logged
+// in as and the login will complete as that identity. Otherwise the
+// login completes as the newly authenticated identity.
+func (h *handler) LinkIdentity(p httprequest.Params, req *linkIdentityRequest) {
+	ctx := p.Context
+	vc := h.params.visitCompleter
+	var ls linkState
+	if err := h.params.codec.Decode(req.State, &ls); err != nil {
+		logger.Infof("invalid link state: %s", err)
+		idputil.BadRequestf(p.Response, "invalid link state")
+		return
+	}
+	if ls.Expires.Before(time.Now()) {
+		vc.fail(ctx, p.Response, p.Request, ls, errgo.WithCausef(nil, params.ErrBadRequest, "login expired"))
+		return
+	}
+	if req.Link == "" {
+		id := store.Identity{
+			ProviderID: ls.Secondary,
+		}
+		if err := h.params.Store.Identity(ctx, &id); err != nil {
+			vc.fail(ctx, p.Response, p.Request, ls, errgo.Mask(err))
+			return
+		}
+		vc.complete(ctx, p.Response, p.Request, ls, &id)
+		return
+	}
+	// Check that the user is still logged in as the identity that
+	// was offered the link.
+	current := vc.currentIdentity(ctx, p.Request)
+	if current == nil || current.ProviderID != ls.Primary {
+		vc.fail(ctx, p.Response, p.Request, ls, errgo.WithCausef(nil, params.ErrUnauthorized, "not logged in as %q", ls.Primary))
+		return
+	}
+	if err := h.params.identityLinkStore.Link(ctx, ls.Primary, ls.Secondary); err != nil {
+		if errgo.Cause(err) == internal.ErrAlreadyLinked {
+			err = errgo.WithCausef(err, params.ErrForbidden, "")
+		}
+		vc.fail(ctx, p.Response, p.Request, ls, errgo.Mask(err, errgo.Is(params.ErrForbidden)))
+		return
+	}
+	logger.Infof("linked %q to %q", ls.Secondary, ls.Primary)
+	vc.complete(ctx, p.Response, p.Request, ls, current)
+}
@@ -6,6 +6,7 @@ package discharger
 import (
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"gopkg.in/CanonicalLtd/candidclient.v1/params"
@@ -14,6 +15,10 @@ import (
 	"gopkg.in/macaroon-bakery.v2/httpbakery/agent"
 
 	"github.com/CanonicalLtd/candid/idp/idputil"
+	"github.com/CanonicalLtd/candid/idp/idputil/secret"
+	"github.com/CanonicalLtd/candid/internal/discharger/internal"
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/internal/secheaders"
 )
 
 // legacyLoginRequest is a request to start a login to the identity manager
@@ -21,12 +26,17 @@ import (
 type legacyLoginRequest struct {
 	httprequest.Route `httprequest:"GET /login-legacy"`
 	Domain            string `httprequest:"domain,form"`
+	IDP               string `httprequest:"idp,form"`
 	DischargeID       string `httprequest:"did,form"`
+	AuthLevel         string `httprequest:"auth_level,form"`
 }
 
 // LoginLegacy handles the GET /login-legacy endpoint that is used to log in to Candid
 // when the legacy visit-wait protocol is used.
 func (h *handler) LoginLegacy(p httprequest.Params, req *legacyLoginRequest) error {
+	if err := h.params.checker.checkInteractionProtocol(true, "login"); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
 	// We should really be parsing the accept header properly here, but
 	// it's really complicated http://www.w3.org/Protocols/rfc2616/rfc2616-sec14.html#sec14.1
 	// perhaps use http://godoc.org/bitbucket.org/ww/goautoneg for this.
@@ -34,6 +44,9 @@ func (h *handler) LoginLegacy(p httprequest.Params, req *legacyLoginRequest) err
 	if p.Request.Header.Get("Accept") == "application/json" {
 		methods := map[string]string{"agent": legacyAgentURL(h.params.Location, req.DischargeID)}
 		for _, idp := range h.params.IdentityProviders {
+			if req.IDP != "" && idp.Name() != req.IDP {
+				continue
+			}
 			methods[idp.Name()] = idp.URL(req.DischargeID)
 		}
 		err := httprequest.WriteJSON(p.Response, http.StatusOK, methods)
@@ -46,9 +59,7 @@ func (h *handler) LoginLegacy(p httprequest.Params, req *legacyLoginRequest) err
 	_, _, err := agent.LoginCookie(p.Request)
 	if errgo.Cause(err) != agent.ErrNoAgentLoginCookie {
 
-		resp, err := h.LegacyAgentLogin(p, &legacyAgentLoginRequest{
-			DischargeID: req.DischargeID,
-		})
+		resp, err := h.legacyAgentLoginCookie(p, req.DischargeID)
 		if err != nil {
 			return errgo.Mask(err, errgo.Any)
 		}
@@ -64,7 +75,9 @@ func (h *handler) LoginLegacy(p httprequest.Params, req *legacyLoginRequest) err
 type loginRequest struct {
 	httprequest.Route `httprequest:"GET /login"`
 	Domain            string `httprequest:"domain,form"`
+	IDP               string `httprequest:"idp,form"`
 	DischargeID       string `httprequest:"did,form"`
+	AuthLevel         string `httprequest:"auth_level,form"`
 }
 
 // Login handles the GET /v1/login endpoint that is used to log in to Candid.
@@ -73,7 +86,7 @@ func (h *handler) Login(p httprequest.Params, req *loginRequest) error {
 	// Store the requested discharge ID in a session cookie so that
 	// when the redirect comes back to login-complete we know the
 	// login was initiated in this session.
-	state, err := h.params.codec.SetCookie(p.Response, waitCookieName, waitState{
+	state, err := h.params.codec.SetCookie(p.Response, p.Request, waitCookieName, waitState{
 		DischargeID: req.DischargeID,
 	})
 	if err != nil {
@@ -86,6 +99,12 @@ func (h *handler) Login(p httprequest.Params, req *loginRequest) error {
 	if req.Domain != "" {
 		v.Set("domain", req.Domain)
 	}
+	if req.IDP != "" {
+		v.Set("idp", req.IDP)
+	}
+	if req.AuthLevel != "" {
+		v.Set("auth_level", req.AuthLevel)
+	}
 	http.Redirect(p.Response, p.Request, h.params.Location+"/login-redirect?"+v.Encode(), http.StatusTemporaryRedirect)
 	return nil
 }
@@ -106,17 +125,121 @@ type redirectLoginRequest struct {
 	// requesting service so the service can check that it initiated
 	// the original login request.
 	State string `httprequest:"state,form"`
+
+	// IDP holds the name of the identity provider chosen by the
+	// user, if any. If it is set the login continues with that
+	// identity provider rather than showing the choice of identity
+	// providers.
+	IDP string `httprequest:"idp,form"`
+
+	// Remember holds whether the chosen identity provider should be
+	// remembered and used automatically for subsequent logins from
+	// the same browser. Any non-empty value is treated as true.
+	Remember string `httprequest:"remember,form"`
+
+	// LoginHint holds the email address of the user logging in, if
+	// known. If its domain is associated with an identity provider
+	// the login continues with that identity provider.
+	LoginHint string `httprequest:"login_hint,form"`
+
+	// Choose, if non-empty, causes the choice of identity providers
+	// to be shown even if the user has a remembered choice.
+	Choose string `httprequest:"choose,form"`
+
+	// CodeChallenge holds the PKCE (RFC 7636) code challenge of a
+	// client that cannot keep a client secret, if any. The code
+	// returned at the end of the login can then only be exchanged
+	// for a discharge token with the matching code verifier.
+	CodeChallenge string `httprequest:"code_challenge,form"`
+
+	// CodeChallengeMethod holds the method used to derive the code
+	// challenge from the code verifier, either "S256" or "plain".
+	// If it is not specified "plain" is assumed.
+	CodeChallengeMethod string `httprequest:"code_challenge_method,form"`
+
+	// RememberBrowser, if non-empty, asks for the browser to be
+	// remembered once the user has logged in, so that later logins
+	// complete without visiting the identity provider.
+	RememberBrowser string `httprequest:"remember_browser,form"`
+
+	// AuthLevel holds the authentication level required by the
+	// relying service, if any. The only level currently supported
+	// is "strong", which makes the user authenticate again with
+	// their identity provider, using multiple factors if possible.
+	AuthLevel string `httprequest:"auth_level,form"`
+}
+
+// idpCookieName is the name of the cookie that holds the identity
+// provider remembered for a browser.
+const idpCookieName = "candid-idp"
+
+// idpCookieMaxAge is the maximum age of a remembered identity
+// provider choice.
+const idpCookieMaxAge = 365 * 24 * time.Hour
+
+// idpChoicePage holds the data used to render the
+// "authentication-required" template.
+type idpChoicePage struct {
+	params.IDPChoice
+
+	// ReturnTo, State, Domain, CodeChallenge,
+	// CodeChallengeMethod and AuthLevel hold the parameters of the
+	// login request so that they can be included in forms that
+	// choose an identity provider by submitting to /login-redirect
+	// again.
+	ReturnTo            string
+	State               string
+	Domain              string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	AuthLevel           string
+
+	// OfferRememberBrowser holds whether the user may ask for their
+	// browser to be remembered.
+	OfferRememberBrowser bool
+
+	// Remembered holds the name of the identity provider remembered
+	// for the browser, if any.
+	Remembered string
+
+	// AskEmail holds whether the user should be asked for their
+	// email address so that an identity provider can be chosen
+	// from its domain.
+	AskEmail bool
 }
 
 // RedirectLogin handles starting a redirect based login request for a
 // domain (if specified). It produces a page with the possible choices of
 // identity provider which the user must then choose to start the login
-// process.
+// process. Browsers are sent straight to an identity provider if one
+// has been chosen, if the domain of the login hint is associated with
+// one, or if one has been remembered from an earlier login. If the
+// browser itself has been remembered for a user, the login completes
+// straight away as that user, unless strong authentication is
+// required.
 func (h *handler) RedirectLogin(p httprequest.Params, req *redirectLoginRequest) error {
-	state, err := h.params.codec.SetCookie(p.Response, idputil.LoginCookieName, idputil.LoginState{
-		ReturnTo: req.ReturnTo,
-		State:    req.State,
-		Expires:  time.Now().Add(15 * time.Minute),
+	cc, err := internal.NewCodeChallenge(req.CodeChallenge, req.CodeChallengeMethod)
+	if err != nil {
+		return errgo.WithCausef(err, params.ErrBadRequest, "")
+	}
+	if req.AuthLevel != "" && req.AuthLevel != idputil.AuthLevelStrong {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "unknown authentication level %q", req.AuthLevel)
+	}
+	if req.Choose == "" && req.IDP == "" && req.AuthLevel == "" {
+		if id := h.params.visitCompleter.rememberedIdentity(p.Context, p.Request); id != nil {
+			logging.FromContext(p.Context, logger).Infof("login as %q from remembered browser", id.Username)
+			h.params.visitCompleter.redirectSuccess(p.Context, p.Response, p.Request, req.ReturnTo, req.State, cc, id)
+			return nil
+		}
+	}
+	state, err := h.params.codec.SetCookie(p.Response, p.Request, idputil.LoginCookieName, idputil.LoginState{
+		ReturnTo:            req.ReturnTo,
+		State:               req.State,
+		Expires:             time.Now().Add(15 * time.Minute),
+		CodeChallenge:       cc.Challenge,
+		CodeChallengeMethod: cc.Method,
+		RememberBrowser:     req.RememberBrowser != "",
+		AuthLevel:           req.AuthLevel,
 	})
 	if err != nil {
 		return errgo.Mask(err)
@@ -139,7 +262,7 @@ func (h *handler) RedirectLogin(p httprequest.Params, req *redirectLoginRequest)
 		if !idp.Hidden() {
 			allIDPs = append(allIDPs, choice)
 		}
-		if req.Domain != "" && idp.Domain() == req.Domain {
+		if req.Domain != "" && idp.Domain() == req.Domain || req.IDP != "" && idp.Name() == req.IDP {
 			idps = append(idps, choice)
 		}
 	}
@@ -149,17 +272,103 @@ func (h *handler) RedirectLogin(p httprequest.Params, req *redirectLoginRequest)
 	if len(idps) == 0 {
 		idps = allIDPs
 	}
+	if req.IDP != "" {
+		// Only the requested identity provider may be used.
+		var chosen []params.IDPChoiceDetails
+		for _, choice := range idps {
+			if choice.Name == req.IDP {
+				chosen = append(chosen, choice)
+			}
+		}
+		if len(chosen) == 0 {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "unknown identity provider %q", req.IDP)
+		}
+		idps = chosen
+	}
 	idpChoices := params.IDPChoice{IDPs: idps}
 	if p.Request.Header.Get("Accept") == "application/json" {
 		httprequest.WriteJSON(p.Response, http.StatusOK, idpChoices)
 		return nil
 	}
-	if err := h.params.Template.ExecuteTemplate(p.Response, "authentication-required", idpChoices); err != nil {
+	remembered := ""
+	if c, err := p.Request.Cookie(idpCookieName); err == nil {
+		remembered = c.Value
+	}
+	choiceURL := func(name string) string {
+		for _, choice := range idps {
+			if choice.Name == name {
+				return choice.URL
+			}
+		}
+		return ""
+	}
+	var u string
+	switch {
+	case req.IDP != "":
+		u = choiceURL(req.IDP)
+		if req.Remember != "" {
+			h.setIDPCookie(p.Response, p.Request, req.IDP)
+		}
+	case req.LoginHint != "":
+		if name := h.emailDomainIDP(req.LoginHint); name != "" {
+			u = choiceURL(name)
+		}
+	case remembered != "" && req.Choose == "":
+		u = choiceURL(remembered)
+	}
+	if u != "" {
+		http.Redirect(p.Response, p.Request, u, http.StatusSeeOther)
+		return nil
+	}
+	page := idpChoicePage{
+		IDPChoice:            idpChoices,
+		ReturnTo:             req.ReturnTo,
+		State:                req.State,
+		Domain:               req.Domain,
+		CodeChallenge:        req.CodeChallenge,
+		CodeChallengeMethod:  req.CodeChallengeMethod,
+		AuthLevel:            req.AuthLevel,
+		OfferRememberBrowser: h.params.RememberBrowser.Lifetime > 0,
+		Remembered:           remembered,
+		AskEmail:             len(h.params.EmailDomainIDPs) > 0,
+	}
+	if err := secheaders.ExecuteTemplate(p.Context, p.Response, h.params.Template, "authentication-required", page); err != nil {
 		return errgo.Mask(err)
 	}
 	return nil
 }
 
+// setIDPCookie sets the cookie that remembers the identity provider
+// chosen by the user.
+func (h *handler) setIDPCookie(w http.ResponseWriter, req *http.Request, name string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     idpCookieName,
+		Value:    name,
+		Path:     "/",
+		Domain:   secret.CookieDomain(req, h.params.CookieDomains),
+		MaxAge:   int(idpCookieMaxAge / time.Second),
+		HttpOnly: true,
+		SameSite: h.params.CookieSameSite,
+		Secure:   h.params.CookieSecure,
+	})
+}
+
+// emailDomainIDP returns the name of the identity provider associated
+// with the domain of the given email address, or "" if there is none.
+func (h *handler) emailDomainIDP(email string) string {
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return ""
+	}
+	domain := email[i+1:]
+	for d, name := range h.params.EmailDomainIDPs {
+		if strings.EqualFold(d, domain) {
+			return name
+		}
+	}
+	return ""
+}
+
 // loginCompleteRequest is a request that completes a login attempt.
 type loginCompleteRequest struct {
 	httprequest.Route `httprequest:"GET /login-complete"`
@@ -202,7 +411,10 @@ func (h *handler) LoginComplete(p httprequest.Params, req *loginCompleteRequest)
 		return
 	}
 
-	dt, err := h.params.dischargeTokenStore.Get(ctx, req.Code)
+	dt, err := h.params.dischargeTokenStore.Redeem(ctx, req.Code, "", nil)
+	if errgo.Cause(err) == internal.ErrCodeReused {
+		h.params.dischargeTokenCreator.revoke(ctx, dt)
+	}
 	if err != nil {
 		h.params.visitCompleter.Failure(ctx, p.Response, p.Request, ws.DischargeID, err)
 		return
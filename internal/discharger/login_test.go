@@ -13,6 +13,7 @@ import (
 
 	qt "github.com/frankban/quicktest"
 	"github.com/frankban/quicktest/qtsuite"
+	"github.com/prometheus/client_golang/prometheus"
 	"gopkg.in/CanonicalLtd/candidclient.v1/params"
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
@@ -43,6 +44,9 @@ func (s *loginSuite) Init(c *qt.C) {
 	sp.RedirectLoginWhitelist = []string{
 		"https://example.com/callback",
 	}
+	sp.EmailDomainIDPs = map[string]string{
+		"example.com": "test2",
+	}
 	sp.IdentityProviders = []idp.IdentityProvider{
 		static.NewIdentityProvider(static.Params{
 			Name: "test",
@@ -124,6 +128,46 @@ func (s *loginSuite) TestLoginFailure(c *qt.C) {
 	c.Assert(err, qt.ErrorMatches, `cannot get discharge from ".*": cannot acquire discharge token: unsupported method "PUT"`)
 }
 
+func (s *loginSuite) TestLoginMetrics(c *qt.C) {
+	successes := idpLoginCount(c, "test", "success")
+	errors := idpLoginCount(c, "test", "upstream-error")
+
+	client := s.srv.Client(s.interactor)
+	_, err := s.dischargeCreator.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(idpLoginCount(c, "test", "success"), qt.Equals, successes+1)
+
+	client = s.srv.Client(httpbakery.WebBrowserInteractor{
+		OpenWebBrowser: candidtest.OpenWebBrowser(c, candidtest.SelectInteractiveLogin(badLoginFormRequestMethod)),
+	})
+	_, err = s.dischargeCreator.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.Not(qt.IsNil))
+	c.Assert(idpLoginCount(c, "test", "upstream-error"), qt.Equals, errors+1)
+	c.Assert(idpLoginCount(c, "test", "success"), qt.Equals, successes+1)
+}
+
+// idpLoginCount returns the number of login attempts with the given
+// identity provider and outcome recorded in the login metrics.
+func idpLoginCount(c *qt.C, idp, outcome string) float64 {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	c.Assert(err, qt.Equals, nil)
+	for _, mf := range mfs {
+		if mf.GetName() != "candid_discharger_idp_logins_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["idp"] == idp && labels["outcome"] == outcome {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
 func (s *loginSuite) TestLoginMethodsIncludesAgent(c *qt.C) {
 	req, err := http.NewRequest("GET", "/login-legacy", nil)
 	c.Assert(err, qt.Equals, nil)
@@ -139,6 +183,52 @@ func (s *loginSuite) TestLoginMethodsIncludesAgent(c *qt.C) {
 	c.Assert(lm.Agent, qt.Equals, s.srv.URL+"/login/legacy-agent")
 }
 
+func TestDisableLegacyInteraction(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	store := candidtest.NewStore()
+	sp := store.ServerParams()
+	sp.DisableLegacyInteraction = true
+	sp.IdentityProviders = []idp.IdentityProvider{
+		static.NewIdentityProvider(static.Params{
+			Name: "test",
+			Users: map[string]static.UserInfo{
+				"test": {
+					Password: "testpassword",
+				},
+			},
+		}),
+	}
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	dischargeCreator := candidtest.NewDischargeCreator(srv)
+	client := srv.Client(httpbakery.WebBrowserInteractor{
+		OpenWebBrowser: candidtest.PasswordLogin(c, "test", "testpassword"),
+	})
+
+	// Use "<is-authenticated-user" to force legacy interaction
+	_, err := dischargeCreator.Discharge(c, "<is-authenticated-user", client)
+	c.Assert(err, qt.ErrorMatches, `cannot get discharge from ".*": .*legacy interaction protocol is disabled, please upgrade your client`)
+
+	for _, path := range []string{"/login-legacy?did=1", "/wait-legacy?did=1", "/login/legacy-agent?did=1"} {
+		req, err := http.NewRequest("GET", path, nil)
+		c.Assert(err, qt.Equals, nil)
+		resp := srv.Do(c, req)
+		var perr params.Error
+		err = json.NewDecoder(resp.Body).Decode(&perr)
+		resp.Body.Close()
+		c.Assert(err, qt.Equals, nil)
+		c.Check(resp.StatusCode, qt.Equals, http.StatusGone, qt.Commentf("%s", path))
+		c.Check(perr.Code, qt.Equals, identity.ErrLegacyInteractionDisabled)
+	}
+
+	// The current protocol is still available.
+	ms, err := dischargeCreator.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.Equals, nil)
+	dischargeCreator.AssertMacaroon(c, ms, identchecker.LoginOp, "test")
+}
+
 func badLoginFormRequestMethod(client *http.Client, resp *http.Response) (*http.Response, error) {
 	defer resp.Body.Close()
 	purl, err := candidtest.LoginFormAction(resp)
@@ -218,6 +308,74 @@ func (s *loginSuite) TestLoginIDPChoiceHidden(c *qt.C) {
 	})
 }
 
+func (s *loginSuite) TestLoginRedirectChooseIDP(c *qt.C) {
+	req, err := http.NewRequest("GET", "/login-redirect?return_to=https://example.com/callback&state=12345&idp=test2&remember=1", nil)
+	c.Assert(err, qt.Equals, nil)
+	resp := s.srv.RoundTrip(c, req)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther)
+	assertLocationPath(c, resp, "/login/test2/login")
+	var idpCookie *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "candid-idp" {
+			idpCookie = cookie
+		}
+	}
+	c.Assert(idpCookie, qt.Not(qt.IsNil))
+	c.Assert(idpCookie.Value, qt.Equals, "test2")
+
+	// The remembered choice is used for the next login.
+	req, err = http.NewRequest("GET", "/login-redirect?return_to=https://example.com/callback&state=12345", nil)
+	c.Assert(err, qt.Equals, nil)
+	req.AddCookie(idpCookie)
+	resp = s.srv.RoundTrip(c, req)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther)
+	assertLocationPath(c, resp, "/login/test2/login")
+
+	// Unless the user asks to choose again.
+	req, err = http.NewRequest("GET", "/login-redirect?return_to=https://example.com/callback&state=12345&choose=1", nil)
+	c.Assert(err, qt.Equals, nil)
+	req.AddCookie(idpCookie)
+	resp = s.srv.RoundTrip(c, req)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+}
+
+func (s *loginSuite) TestLoginRedirectChooseUnknownIDP(c *qt.C) {
+	req, err := http.NewRequest("GET", "/login-redirect?return_to=https://example.com/callback&state=12345&idp=nope&remember=1", nil)
+	c.Assert(err, qt.Equals, nil)
+	resp := s.srv.RoundTrip(c, req)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+	for _, cookie := range resp.Cookies() {
+		c.Assert(cookie.Name, qt.Not(qt.Equals), "candid-idp")
+	}
+}
+
+func (s *loginSuite) TestLoginRedirectLoginHint(c *qt.C) {
+	req, err := http.NewRequest("GET", "/login-redirect?return_to=https://example.com/callback&state=12345&login_hint=bob@Example.COM", nil)
+	c.Assert(err, qt.Equals, nil)
+	resp := s.srv.RoundTrip(c, req)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther)
+	assertLocationPath(c, resp, "/login/test2/login")
+
+	// An email address in an unknown domain shows the choice.
+	req, err = http.NewRequest("GET", "/login-redirect?return_to=https://example.com/callback&state=12345&login_hint=bob@example.org", nil)
+	c.Assert(err, qt.Equals, nil)
+	resp = s.srv.RoundTrip(c, req)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+}
+
+func assertLocationPath(c *qt.C, resp *http.Response, path string) {
+	u, err := url.Parse(resp.Header.Get("Location"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(u.Path, qt.Equals, path)
+	c.Assert(u.Query().Get("state"), qt.Not(qt.Equals), "")
+}
+
 func (s *loginSuite) TestLoginRedirectNotWhitelisted(c *qt.C) {
 	req, err := http.NewRequest("GET", "/login-redirect?return_to=https://example.com/bad-callback&state=12345", nil)
 	c.Assert(err, qt.Equals, nil)
@@ -0,0 +1,331 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/idputil"
+	"github.com/CanonicalLtd/candid/idp/idputil/secret"
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/internal/secheaders"
+	"github.com/CanonicalLtd/candid/internal/sessions"
+)
+
+// sessionCookieNames holds the names of the cookies that hold
+// Candid's own browser session state. They are all removed when the
+// browser logs out.
+var sessionCookieNames = []string{
+	"macaroon-identity",
+	"macaroon-candid",
+	idputil.LoginCookieName,
+	waitCookieName,
+}
+
+// logoutStateExpiry holds the time allowed for an upstream identity
+// provider to complete its logout and return to Candid.
+const logoutStateExpiry = 15 * time.Minute
+
+// logoutPageRequest is a request for the page that asks the user to
+// confirm that they want to log out of Candid.
+type logoutPageRequest struct {
+	httprequest.Route `httprequest:"GET /logout"`
+
+	// ReturnTo holds the address to which the browser is sent once
+	// the logout is complete, if any. It must be acceptable as a
+	// return_to address for a redirect login.
+	ReturnTo string `httprequest:"return_to,form"`
+
+	// State holds an opaque value that is sent back to the ReturnTo
+	// address.
+	State string `httprequest:"state,form"`
+
+	// Upstream, if non-empty, requests that the user is also logged
+	// out of the identity provider that they used to log in, if it
+	// supports that.
+	Upstream string `httprequest:"upstream,form"`
+}
+
+// logoutConfirmParams holds the parameters passed to the
+// logout-confirm template.
+type logoutConfirmParams struct {
+	// Action contains the action parameter for the form.
+	Action string
+
+	// ReturnTo, State and Upstream contain the parameters of the
+	// logout, which must be sent back in the form.
+	ReturnTo string
+	State    string
+	Upstream string
+
+	// CSRFToken contains the token that must be posted with the
+	// form in the idputil.CSRFTokenField field.
+	CSRFToken string
+}
+
+// LogoutPage handles the GET /logout endpoint. It shows a page asking
+// the user to confirm the logout, which posts the logout form to
+// POST /logout. Nothing is changed until the form is posted, so other
+// sites cannot log the user out by linking to the page.
+func (h *handler) LogoutPage(p httprequest.Params, req *logoutPageRequest) error {
+	if req.ReturnTo != "" {
+		if _, _, err := h.params.visitCompleter.parseReturnTo(p.Context, req.ReturnTo); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+	}
+	p.Response.Header().Set("Content-Type", "text/html;charset=utf-8")
+	p.Response.Header().Set("Cache-Control", "no-store")
+	err := secheaders.ExecuteTemplate(p.Context, p.Response, h.params.Template, "logout-confirm", logoutConfirmParams{
+		Action:    h.params.Location + "/logout",
+		ReturnTo:  req.ReturnTo,
+		State:     req.State,
+		Upstream:  req.Upstream,
+		CSRFToken: h.params.codec.CSRFToken(logoutVerification(p.Request)),
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// logoutRequest is a request to log the browser out of Candid, posted
+// from the logout-confirm page.
+type logoutRequest struct {
+	httprequest.Route `httprequest:"POST /logout"`
+
+	// ReturnTo, State and Upstream hold the parameters given in the
+	// logoutPageRequest.
+	ReturnTo string `httprequest:"return_to,form"`
+	State    string `httprequest:"state,form"`
+	Upstream string `httprequest:"upstream,form"`
+
+	// CSRFToken holds the CSRF token from the logout-confirm page.
+	CSRFToken string `httprequest:"csrf_token,form"`
+}
+
+// logoutState holds the state of a logout that is being completed by
+// an upstream identity provider.
+type logoutState struct {
+	ReturnTo string
+	State    string
+	Expires  time.Time
+}
+
+// Logout handles the POST /logout endpoint. It ends the browser's
+// Candid session by revoking the discharge token held in its identity
+// cookie, forgetting the browser if it was remembered, and removing
+// Candid's session cookies. The form must hold the CSRF token from the
+// logout-confirm page unless the browser holds none of the cookies
+// that a logout removes. If requested, the browser is then sent to the
+// logout page of the identity provider that was used to log in.
+// Finally the browser is returned to the requested return_to address,
+// if any.
+func (h *handler) Logout(p httprequest.Params, req *logoutRequest) error {
+	var returnTo *url.URL
+	if req.ReturnTo != "" {
+		u, _, err := h.params.visitCompleter.parseReturnTo(p.Context, req.ReturnTo)
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+		returnTo = u
+	}
+	if v := logoutVerification(p.Request); v != "" {
+		if err := h.params.codec.CheckCSRFToken(v, req.CSRFToken); err != nil {
+			logging.FromContext(p.Context, logger).Infof("logout form posted without a valid CSRF token")
+			return errgo.WithCausef(err, params.ErrForbidden, "invalid logout request")
+		}
+	}
+	session := h.endBrowserSession(p.Context, p.Request)
+	h.params.visitCompleter.forgetBrowser(p.Context, p.Response, p.Request)
+	h.clearSessionCookies(p.Response, p.Request)
+	if req.Upstream != "" && session != nil {
+		if u := h.upstreamLogoutURL(session.IdentityProvider, req.ReturnTo, req.State); u != "" {
+			http.Redirect(p.Response, p.Request, u, http.StatusSeeOther)
+			return nil
+		}
+	}
+	return errgo.Mask(h.logoutComplete(p, returnTo, req.State))
+}
+
+// logoutVerification returns the verification string for the CSRF
+// token of a logout form, made from the values of the cookies sent
+// with the given request that a logout removes. It returns "" if there
+// are no such cookies.
+func logoutVerification(req *http.Request) string {
+	var buf strings.Builder
+	for _, cookie := range req.Cookies() {
+		if cookie.Value == "" || cookie.Name != rememberCookieName && !isSessionCookie(cookie.Name) {
+			continue
+		}
+		buf.WriteString(cookie.Name)
+		buf.WriteByte(0)
+		buf.WriteString(cookie.Value)
+		buf.WriteByte(0)
+	}
+	return buf.String()
+}
+
+// isSessionCookie reports whether the cookie with the given name holds
+// Candid's own browser session state.
+func isSessionCookie(name string) bool {
+	for _, n := range sessionCookieNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// logoutCompleteRequest is the request made when an upstream identity
+// provider returns to Candid after logging the user out.
+type logoutCompleteRequest struct {
+	httprequest.Route `httprequest:"GET /logout-complete"`
+
+	// State holds the encoded logoutState.
+	State string `httprequest:"state,form"`
+}
+
+// LogoutComplete handles the GET /logout-complete endpoint, which
+// returns the browser to the address requested when the logout
+// started.
+func (h *handler) LogoutComplete(p httprequest.Params, req *logoutCompleteRequest) error {
+	var ls logoutState
+	if err := h.params.codec.Decode(req.State, &ls); err != nil {
+		return errgo.WithCausef(err, params.ErrBadRequest, "invalid logout state")
+	}
+	if time.Now().After(ls.Expires) {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "logout state expired")
+	}
+	var returnTo *url.URL
+	if ls.ReturnTo != "" {
+		u, _, err := h.params.visitCompleter.parseReturnTo(p.Context, ls.ReturnTo)
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+		returnTo = u
+	}
+	return errgo.Mask(h.logoutComplete(p, returnTo, ls.State))
+}
+
+// logoutComplete finishes a logout by redirecting to the given
+// returnTo address, or showing the "logout" page if there is none.
+func (h *handler) logoutComplete(p httprequest.Params, returnTo *url.URL, state string) error {
+	if returnTo != nil {
+		v := url.Values{}
+		if state != "" {
+			v.Set("state", state)
+		}
+		redirectTo(p.Response, p.Request, returnTo, v)
+		return nil
+	}
+	p.Response.Header().Set("Cache-Control", "no-store")
+	if h.params.Template.Lookup("logout") == nil {
+		fmt.Fprintf(p.Response, "Logged out")
+		return nil
+	}
+	if err := secheaders.ExecuteTemplate(p.Context, p.Response, h.params.Template, "logout", nil); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// endBrowserSession revokes the discharge tokens held in the identity
+// cookies sent with the given request, and ends their sessions. The
+// session of the first token is returned, if it is known.
+func (h *handler) endBrowserSession(ctx context.Context, req *http.Request) *sessions.Session {
+	authInfo, err := h.params.Authorizer.Auth(ctx, httpbakery.RequestMacaroons(req), identchecker.LoginOp)
+	if err != nil {
+		logging.FromContext(ctx, logger).Debugf("logout not authenticated: %s", err)
+		return nil
+	}
+	username := authInfo.Identity.Id()
+	dt := h.params.dischargeTokenCreator
+	var first *sessions.Session
+	for _, ms := range authInfo.Macaroons {
+		if len(ms) == 0 {
+			continue
+		}
+		id := ms[0].Id()
+		expires := time.Now().Add(h.params.DischargeTokenTimeout)
+		var session *sessions.Session
+		if dt.sessions != nil {
+			session, err = dt.sessions.Remove(ctx, username, base64.RawURLEncoding.EncodeToString(id))
+			if err != nil && errgo.Cause(err) != sessions.ErrNotFound {
+				logging.FromContext(ctx, logger).Errorf("cannot remove session: %s", err)
+			}
+		}
+		if session != nil {
+			expires = session.Expires
+			h.params.LogoutNotifier.SessionEnded(ctx, username, *session)
+			if first == nil {
+				first = session
+			}
+		}
+		if dt.revocations != nil {
+			if err := dt.revocations.Revoke(ctx, id, expires); err != nil {
+				logging.FromContext(ctx, logger).Errorf("cannot revoke discharge token: %s", err)
+			}
+		}
+	}
+	logging.FromContext(ctx, logger).Infof("user %q logged out", username)
+	return first
+}
+
+// clearSessionCookies removes Candid's session cookies from the
+// browser.
+func (h *handler) clearSessionCookies(w http.ResponseWriter, req *http.Request) {
+	domain := secret.CookieDomain(req, h.params.CookieDomains)
+	for _, name := range sessionCookieNames {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			Path:     "/",
+			Domain:   domain,
+			MaxAge:   -1,
+			HttpOnly: true,
+			SameSite: h.params.CookieSameSite,
+			Secure:   h.params.CookieSecure,
+		})
+	}
+}
+
+// upstreamLogoutURL returns the address of the logout page of the
+// identity provider with the given name, or "" if it does not have
+// one. If the identity provider returns to Candid, the browser will be
+// sent on to the given returnTo address with the given state.
+func (h *handler) upstreamLogoutURL(name, returnTo, state string) string {
+	for _, i := range h.params.IdentityProviders {
+		if i.Name() != name {
+			continue
+		}
+		lr, ok := i.(idp.LogoutRedirector)
+		if !ok {
+			return ""
+		}
+		ls, err := h.params.codec.Encode(logoutState{
+			ReturnTo: returnTo,
+			State:    state,
+			Expires:  time.Now().Add(logoutStateExpiry),
+		})
+		if err != nil {
+			logger.Errorf("cannot encode logout state: %s", err)
+			return ""
+		}
+		return lr.LogoutURL(h.params.Location+"/logout-complete", ls)
+	}
+	return ""
+}
@@ -0,0 +1,136 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
+
+	"github.com/CanonicalLtd/candid/internal/revocation"
+	"github.com/CanonicalLtd/candid/internal/sessions"
+)
+
+func (s *dischargeSuite) TestLogout(c *qt.C) {
+	ctx := context.Background()
+	client := s.srv.Client(s.interactor)
+	ms, err := s.dischargeCreator.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.Equals, nil)
+	s.dischargeCreator.AssertMacaroon(c, ms, identchecker.LoginOp, "test")
+
+	srvURL, err := url.Parse(s.srv.URL)
+	c.Assert(err, qt.Equals, nil)
+	mss := cookiesToMacaroons(client.Client.Jar.Cookies(srvURL))
+	c.Assert(mss, qt.HasLen, 1)
+
+	hc := &http.Client{
+		Jar: client.Client.Jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	action, csrfToken := getLogoutPage(c, hc, s.srv.URL+"/logout?"+url.Values{
+		"return_to": {"https://www.example.com/callback"},
+		"state":     {"123456"},
+	}.Encode())
+	c.Assert(action, qt.Equals, s.srv.URL+"/logout")
+
+	// Showing the page does not log the browser out.
+	c.Assert(cookiesToMacaroons(client.Client.Jar.Cookies(srvURL)), qt.HasLen, 1)
+
+	resp, err := hc.PostForm(action, url.Values{
+		"return_to":  {"https://www.example.com/callback"},
+		"state":      {"123456"},
+		"csrf_token": {csrfToken},
+	})
+	c.Assert(err, qt.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther)
+	c.Assert(resp.Header.Get("Location"), qt.Equals, "https://www.example.com/callback?state=123456")
+
+	// The identity cookie has been removed.
+	c.Assert(cookiesToMacaroons(client.Client.Jar.Cookies(srvURL)), qt.HasLen, 0)
+
+	// The discharge token has been revoked and its session ended.
+	rkv, err := s.store.ProviderDataStore.KeyValueStore(ctx, revocation.StoreName)
+	c.Assert(err, qt.Equals, nil)
+	revoked, err := revocation.NewStore(rkv).Revoked(ctx, mss[0][0].Id())
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(revoked, qt.Equals, true)
+	skv, err := s.store.ProviderDataStore.KeyValueStore(ctx, sessions.StoreName)
+	c.Assert(err, qt.Equals, nil)
+	ss, err := sessions.NewStore(skv).List(ctx, "test")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ss, qt.HasLen, 0)
+}
+
+func (s *dischargeSuite) TestLogoutInvalidCSRFToken(c *qt.C) {
+	client := s.srv.Client(s.interactor)
+	_, err := s.dischargeCreator.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.Equals, nil)
+	srvURL, err := url.Parse(s.srv.URL)
+	c.Assert(err, qt.Equals, nil)
+
+	hc := &http.Client{
+		Jar: client.Client.Jar,
+	}
+	// A token for another browser is not accepted.
+	_, csrfToken := getLogoutPage(c, http.DefaultClient, s.srv.URL+"/logout")
+	for _, token := range []string{"", csrfToken} {
+		resp, err := hc.PostForm(s.srv.URL+"/logout", url.Values{
+			"csrf_token": {token},
+		})
+		c.Assert(err, qt.Equals, nil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusForbidden)
+	}
+
+	// The browser is still logged in.
+	c.Assert(cookiesToMacaroons(client.Client.Jar.Cookies(srvURL)), qt.HasLen, 1)
+}
+
+func (s *dischargeSuite) TestLogoutNotLoggedIn(c *qt.C) {
+	action, _ := getLogoutPage(c, http.DefaultClient, s.srv.URL+"/logout")
+	resp, err := http.PostForm(action, nil)
+	c.Assert(err, qt.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+}
+
+func (s *dischargeSuite) TestLogoutInvalidReturnTo(c *qt.C) {
+	resp, err := http.Get(s.srv.URL + "/logout?" + url.Values{
+		"return_to": {"https://evil.example.com/callback"},
+	}.Encode())
+	c.Assert(err, qt.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+func (s *dischargeSuite) TestLogoutCompleteInvalidState(c *qt.C) {
+	resp, err := http.Get(s.srv.URL + "/logout-complete?state=invalid")
+	c.Assert(err, qt.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+// getLogoutPage gets the logout confirmation page at the given address
+// and returns the action and CSRF token of its form.
+func getLogoutPage(c *qt.C, hc *http.Client, u string) (action, csrfToken string) {
+	resp, err := hc.Get(u)
+	c.Assert(err, qt.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, qt.Equals, nil)
+	// The test logout-confirm template writes the action and the
+	// CSRF token on separate lines.
+	parts := strings.Split(string(body), "\n")
+	c.Assert(len(parts) >= 2, qt.Equals, true)
+	return parts[0], parts[1]
+}
@@ -10,6 +10,7 @@ import (
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 
+	"github.com/CanonicalLtd/candid/internal/waitlimit"
 	"github.com/CanonicalLtd/candid/meeting"
 )
 
@@ -18,6 +19,11 @@ type dischargeRequestInfo struct {
 	Caveat    []byte
 	Condition string
 	Origin    string
+
+	// Service holds the name of the relying service that added
+	// the caveat, which is recorded in the session created if the
+	// user logs in.
+	Service string `json:",omitempty"`
 }
 
 type loginInfo struct {
@@ -31,8 +37,10 @@ type loginInfo struct {
 }
 
 // place layers our desired types onto the general meeting.Place,
+// and limits the requests that wait on it.
 type place struct {
-	place *meeting.Place
+	place   *meeting.Place
+	limiter *waitlimit.Limiter
 }
 
 func (p *place) NewRendezvous(ctx context.Context, id string, info *dischargeRequestInfo) error {
@@ -51,10 +59,21 @@ func (p *place) Done(ctx context.Context, id string, info *loginInfo) error {
 	return p.place.Done(ctx, id, data)
 }
 
+// Wait waits for the rendezvous with the given id to complete. If the
+// wait is rejected or times out, the returned error has a cause of type
+// *waitlimit.Error.
 func (p *place) Wait(ctx context.Context, id string) (*dischargeRequestInfo, *loginInfo, error) {
-	reqData, loginData, err := p.place.Wait(ctx, id)
+	var reqData, loginData []byte
+	err := p.limiter.Wait(ctx, id, func(ctx context.Context) error {
+		var err error
+		reqData, loginData, err = p.place.Wait(ctx, id)
+		if errgo.Cause(err) == meeting.ErrTimeout {
+			return errgo.WithCausef(err, waitlimit.ErrTimeout, "")
+		}
+		return errgo.Mask(err, errgo.Is(meeting.ErrExpired))
+	})
 	if err != nil {
-		return nil, nil, errgo.Notef(err, "cannot wait")
+		return nil, nil, errgo.NoteMask(err, "cannot wait", isWaitError)
 	}
 	var info dischargeRequestInfo
 	if err := json.Unmarshal(reqData, &info); err != nil {
@@ -66,3 +85,12 @@ func (p *place) Wait(ctx context.Context, id string) (*dischargeRequestInfo, *lo
 	}
 	return &info, &login, nil
 }
+
+// isWaitError reports whether the given error cause may be returned
+// from place.Wait.
+func isWaitError(err error) bool {
+	if _, ok := err.(*waitlimit.Error); ok {
+		return true
+	}
+	return err == meeting.ErrExpired
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/internal/secheaders"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// profilePageRequest is a request for the page that shows the logged
+// in user's profile.
+type profilePageRequest struct {
+	httprequest.Route `httprequest:"GET /me"`
+}
+
+// profilePage holds the data used to render the "me" template.
+type profilePage struct {
+	// Identity holds the stored identity of the logged in user. It
+	// is nil if the browser is not logged in.
+	Identity *store.Identity
+
+	// Groups holds the groups the user is a member of.
+	Groups []string
+
+	// Linked holds the provider identities that are linked to the
+	// user's identity.
+	Linked []store.ProviderIdentity
+
+	// Editable holds the fields of the profile that the user may
+	// change.
+	Editable map[string]bool
+}
+
+// ProfilePage shows the profile of the user that the browser is logged
+// in as, using the identity cookie set when the user logged in. The
+// page allows the user to change the fields of their profile that the
+// server allows using the PUT /v1/me endpoint.
+func (h *handler) ProfilePage(p httprequest.Params, _ *profilePageRequest) error {
+	page := profilePage{
+		Editable: make(map[string]bool),
+	}
+	mss := httpbakery.RequestMacaroons(p.Request)
+	authInfo, err := h.params.Authorizer.Auth(p.Context, mss, identchecker.LoginOp)
+	if err == nil {
+		if err := h.completeProfile(p, &page, authInfo.Identity.Id()); err != nil {
+			return errgo.Mask(err)
+		}
+	} else {
+		logging.FromContext(p.Context, logger).Debugf("profile page not authenticated: %s", err)
+	}
+	p.Response.Header().Set("Cache-Control", "no-store")
+	if err := secheaders.ExecuteTemplate(p.Context, p.Response, h.params.Template, "me", page); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// completeProfile fills in the given page with the profile of the
+// given user.
+func (h *handler) completeProfile(p httprequest.Params, page *profilePage, username string) error {
+	identity := store.Identity{
+		Username: username,
+	}
+	if err := h.params.Store.Identity(p.Context, &identity); err != nil {
+		return errgo.Mask(err)
+	}
+	page.Identity = &identity
+	authID, err := h.params.Authorizer.Identity(p.Context, username)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	page.Groups, err = authID.Groups(p.Context)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if ils := h.params.identityLinkStore; ils != nil {
+		page.Linked, err = ils.Links(p.Context, identity.ProviderID)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	for _, f := range h.params.EditableProfileFields {
+		page.Editable[f] = true
+	}
+	return nil
+}
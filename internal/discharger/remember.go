@@ -0,0 +1,164 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/idp/idputil/secret"
+	"github.com/CanonicalLtd/candid/internal/auth"
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/internal/sessions"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// rememberCookieName is the name of the cookie that identifies a
+// remembered browser.
+const rememberCookieName = "candid-remember"
+
+// rememberCookie holds the contents of the remember cookie. It is
+// encrypted with the server's key.
+type rememberCookie struct {
+	Username string
+	ID       string
+}
+
+// rememberBrowser remembers the browser that made the given request for
+// the given identity, if the identity is allowed to have its browser
+// remembered, and sets the remember cookie.
+func (c *visitCompleter) rememberBrowser(ctx context.Context, w http.ResponseWriter, req *http.Request, id *store.Identity) {
+	p := c.params.RememberBrowser
+	if c.remembered == nil || p.Lifetime <= 0 {
+		return
+	}
+	allowed, err := c.rememberAllowed(ctx, id.Username)
+	if err != nil {
+		logging.FromContext(ctx, logger).Errorf("cannot remember browser: %s", err)
+		return
+	}
+	if !allowed {
+		logging.FromContext(ctx, logger).Infof("browser of %q not remembered by policy", id.Username)
+		return
+	}
+	client := sessions.ClientFromContext(ctx)
+	b, err := c.remembered.Add(ctx, id.Username, req.Header.Get("User-Agent"), client.Address, time.Now().Add(p.Lifetime))
+	if err != nil {
+		logging.FromContext(ctx, logger).Errorf("cannot remember browser: %s", err)
+		return
+	}
+	v, err := c.codec.Encode(rememberCookie{
+		Username: id.Username,
+		ID:       b.ID,
+	})
+	if err != nil {
+		logging.FromContext(ctx, logger).Errorf("cannot remember browser: %s", err)
+		return
+	}
+	c.setRememberCookie(w, req, v, b.Expires)
+}
+
+// rememberedIdentity returns the identity for which the browser that
+// made the given request is remembered, or nil if it is not
+// remembered.
+func (c *visitCompleter) rememberedIdentity(ctx context.Context, req *http.Request) *store.Identity {
+	rc, ok := c.rememberCookie(req)
+	if !ok || c.params.RememberBrowser.Lifetime <= 0 {
+		return nil
+	}
+	if _, err := c.remembered.Get(ctx, rc.Username, rc.ID, req.Header.Get("User-Agent")); err != nil {
+		logging.FromContext(ctx, logger).Debugf("browser not remembered: %s", err)
+		return nil
+	}
+	// The groups of the user may have changed since the browser
+	// was remembered, so the policy is checked again.
+	allowed, err := c.rememberAllowed(ctx, rc.Username)
+	if err != nil {
+		logging.FromContext(ctx, logger).Errorf("cannot check remembered browser: %s", err)
+		return nil
+	}
+	if !allowed {
+		c.remembered.Remove(ctx, rc.Username, rc.ID)
+		return nil
+	}
+	id := store.Identity{
+		Username: rc.Username,
+	}
+	if err := c.params.Store.Identity(ctx, &id); err != nil {
+		logging.FromContext(ctx, logger).Errorf("cannot get remembered identity: %s", err)
+		return nil
+	}
+	// A remembered browser has not authenticated with multiple
+	// factors, whatever happened at the user's last login.
+	delete(id.ProviderInfo, auth.MFAProviderInfo)
+	return &id
+}
+
+// forgetBrowser forgets the browser that made the given request, if it
+// is remembered, and removes its remember cookie.
+func (c *visitCompleter) forgetBrowser(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	rc, ok := c.rememberCookie(req)
+	if !ok {
+		return
+	}
+	if err := c.remembered.Remove(ctx, rc.Username, rc.ID); err != nil {
+		logging.FromContext(ctx, logger).Debugf("cannot forget browser: %s", err)
+	}
+	c.setRememberCookie(w, req, "", time.Time{})
+}
+
+// rememberCookie returns the decoded remember cookie sent with the
+// given request, if there is one.
+func (c *visitCompleter) rememberCookie(req *http.Request) (rememberCookie, bool) {
+	var rc rememberCookie
+	if c.remembered == nil {
+		return rc, false
+	}
+	cookie, err := req.Cookie(rememberCookieName)
+	if err != nil {
+		return rc, false
+	}
+	if err := c.codec.Decode(cookie.Value, &rc); err != nil {
+		logger.Debugf("invalid remember cookie: %s", err)
+		return rc, false
+	}
+	return rc, true
+}
+
+// rememberAllowed reports whether the browsers of the user with the
+// given username may be remembered.
+func (c *visitCompleter) rememberAllowed(ctx context.Context, username string) (bool, error) {
+	id, err := c.params.Authorizer.Identity(ctx, username)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	groups, err := id.Groups(ctx)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return c.params.RememberBrowser.Allowed(groups), nil
+}
+
+// setRememberCookie sets the remember cookie to the given value until
+// the given expiry time. If the value is empty the cookie is removed.
+func (c *visitCompleter) setRememberCookie(w http.ResponseWriter, req *http.Request, value string, expires time.Time) {
+	cookie := &http.Cookie{
+		Name:     rememberCookieName,
+		Value:    value,
+		Path:     "/",
+		Domain:   secret.CookieDomain(req, c.params.CookieDomains),
+		HttpOnly: true,
+		SameSite: c.params.CookieSameSite,
+		Secure:   c.params.CookieSecure,
+	}
+	if value == "" {
+		cookie.MaxAge = -1
+	} else {
+		cookie.Expires = expires
+	}
+	http.SetCookie(w, cookie)
+}
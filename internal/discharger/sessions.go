@@ -0,0 +1,65 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"encoding/base64"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/internal/secheaders"
+	"github.com/CanonicalLtd/candid/internal/sessions"
+)
+
+// sessionsPageRequest is a request for the page that shows the
+// logged in user's sessions.
+type sessionsPageRequest struct {
+	httprequest.Route `httprequest:"GET /sessions"`
+}
+
+// sessionsPage holds the data used to render the "sessions" template.
+type sessionsPage struct {
+	// Username holds the username of the logged in user. It is
+	// empty if the browser is not logged in.
+	Username string
+
+	// Sessions holds the user's sessions, most recent first.
+	Sessions []sessions.Session
+
+	// Current holds the ID of the session used to view the page.
+	Current string
+}
+
+// SessionsPage shows the sessions of the user that the browser is
+// logged in as, using the identity cookie set when the user logged in.
+// The page allows the user to end sessions using the
+// DELETE /v1/u/:username/sessions/:id endpoint.
+func (h *handler) SessionsPage(p httprequest.Params, _ *sessionsPageRequest) error {
+	var page sessionsPage
+	mss := httpbakery.RequestMacaroons(p.Request)
+	authInfo, err := h.params.Authorizer.Auth(p.Context, mss, identchecker.LoginOp)
+	if err == nil {
+		page.Username = authInfo.Identity.Id()
+		if len(authInfo.Macaroons) > 0 && len(authInfo.Macaroons[0]) > 0 {
+			page.Current = base64.RawURLEncoding.EncodeToString(authInfo.Macaroons[0][0].Id())
+		}
+		if s := h.params.dischargeTokenCreator.sessions; s != nil {
+			page.Sessions, err = s.List(p.Context, page.Username)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+		}
+	} else {
+		logging.FromContext(p.Context, logger).Debugf("sessions page not authenticated: %s", err)
+	}
+	p.Response.Header().Set("Cache-Control", "no-store")
+	if err := secheaders.ExecuteTemplate(p.Context, p.Response, h.params.Template, "sessions", page); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
@@ -16,7 +16,11 @@ import (
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 	macaroon "gopkg.in/macaroon.v2"
 
+	"github.com/CanonicalLtd/candid/idp/idputil/secret"
 	"github.com/CanonicalLtd/candid/internal/auth"
+	"github.com/CanonicalLtd/candid/internal/identity"
+	"github.com/CanonicalLtd/candid/internal/monitoring"
+	"github.com/CanonicalLtd/candid/meeting"
 )
 
 // waitTokenRequest is the request sent to the server to wait for logins to
@@ -30,6 +34,7 @@ type waitTokenRequest struct {
 // WaitToken waits on the rendezvous place for a discharge token and
 // returns it.
 func (h *handler) WaitToken(p httprequest.Params, req *waitTokenRequest) (*httpbakery.WaitTokenResponse, error) {
+	h.params.checker.metrics.Request(monitoring.ProtocolCurrent, "wait")
 	_, dt, err := h.waitToken(p, req.DischargeID)
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Any)
@@ -44,14 +49,17 @@ func (h *handler) waitToken(p httprequest.Params, dischargeID string) (*discharg
 	if dischargeID == "" {
 		return nil, nil, errgo.WithCausef(nil, params.ErrBadRequest, "discharge id parameter not found")
 	}
-	// TODO don't wait forever here.
 	reqInfo, login, err := h.params.place.Wait(p.Context, dischargeID)
+	if errgo.Cause(err) == meeting.ErrExpired {
+		return nil, nil, errgo.WithCausef(err, identity.ErrRendezvousExpired, "cannot wait")
+	}
 	if err != nil {
 		return nil, nil, errgo.Notef(err, "cannot wait")
 	}
 	if login.Error != nil {
 		return nil, nil, errgo.NoteMask(login.Error, "login failed", errgo.Any)
 	}
+	h.params.dischargeTokenCreator.recordSessionService(p.Context, login.DischargeToken, reqInfo.Service)
 	return reqInfo, login.DischargeToken, nil
 }
 
@@ -80,6 +88,9 @@ type waitResponse struct {
 // This is part of the legacy visit-wait protocol; newer clients will use WaitToken
 // instead.
 func (h *handler) WaitLegacy(p httprequest.Params, req *waitRequest) (*waitResponse, error) {
+	if err := h.params.checker.checkInteractionProtocol(true, "wait"); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
 	ctx := p.Context
 	reqInfo, dt, err := h.wait(p.Context, req.DischargeID)
 	if err != nil {
@@ -96,10 +107,15 @@ func (h *handler) WaitLegacy(p httprequest.Params, req *waitRequest) (*waitRespo
 	// (because they might be creating the token in response to a callback
 	// from an external identity provider, for example).
 
+	caveat := reqInfo.Caveat
+	if len(caveat) == 0 {
+		// The caveat is held in the id.
+		caveat = reqInfo.CaveatId
+	}
 	m, err := bakery.Discharge(p.Context, bakery.DischargeParams{
 		Id:     reqInfo.CaveatId,
 		Caveat: reqInfo.Caveat,
-		Key:    h.params.Key,
+		Key:    h.params.KeyRing.KeyForCaveat(caveat),
 		Checker: bakery.ThirdPartyCaveatCheckerFunc(func(ctx context.Context, ci *bakery.ThirdPartyCaveatInfo) ([]checkers.Caveat, error) {
 			return h.params.checker.checkThirdPartyCaveat(ctx, httpbakery.ThirdPartyCaveatCheckerParams{
 				Caveat:   ci,
@@ -118,7 +134,7 @@ func (h *handler) WaitLegacy(p httprequest.Params, req *waitRequest) (*waitRespo
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	if err := setIdentityCookie(p.Response, dtMacaroon); err != nil {
+	if err := setIdentityCookie(p.Response, p.Request, h.params.ServerParams, dtMacaroon); err != nil {
 		return nil, errgo.Mask(err)
 	}
 	return &waitResponse{
@@ -133,14 +149,17 @@ func (h *handler) wait(ctx context.Context, dischargeID string) (*dischargeReque
 	if dischargeID == "" {
 		return nil, nil, errgo.WithCausef(nil, params.ErrBadRequest, "discharge id parameter not found")
 	}
-	// TODO don't wait forever here.
 	reqInfo, login, err := h.params.place.Wait(ctx, dischargeID)
+	if errgo.Cause(err) == meeting.ErrExpired {
+		return nil, nil, errgo.WithCausef(err, identity.ErrRendezvousExpired, "cannot wait")
+	}
 	if err != nil {
 		return nil, nil, errgo.Notef(err, "cannot wait")
 	}
 	if login.Error != nil {
 		return nil, nil, errgo.NoteMask(login.Error, "login failed", errgo.Any)
 	}
+	h.params.dischargeTokenCreator.recordSessionService(ctx, login.DischargeToken, reqInfo.Service)
 	return reqInfo, login.DischargeToken, nil
 }
 
@@ -154,13 +173,20 @@ func (h *handler) wait(ctx context.Context, dischargeID string) (*dischargeReque
 // TODO distinguish between the two cases by looking at the
 // X-Requested-With header, return the identity cookie only when it's
 // not present (i.e. when /wait is not called from an AJAX request).
-func setIdentityCookie(resp http.ResponseWriter, m macaroon.Slice) error {
+//
+// The cookie is scoped to the domain of the request chosen from the
+// cookie domains in the given parameters, and has the SameSite and
+// Secure attributes given in the parameters.
+func setIdentityCookie(resp http.ResponseWriter, req *http.Request, p identity.ServerParams, m macaroon.Slice) error {
 	cookie, err := httpbakery.NewCookie(auth.Namespace, m)
 	if err != nil {
 		return errgo.Notef(err, "cannot make cookie")
 	}
 	cookie.Path = "/"
+	cookie.Domain = secret.CookieDomain(req, p.CookieDomains)
 	cookie.Name = "macaroon-identity"
+	cookie.SameSite = p.CookieSameSite
+	cookie.Secure = p.CookieSecure
 	http.SetCookie(resp, cookie)
 	return nil
 }
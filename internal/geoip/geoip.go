@@ -0,0 +1,63 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package geoip finds the country of client IP addresses using a
+// MaxMind GeoIP2 or GeoLite2 database.
+package geoip
+
+import (
+	"net"
+
+	"github.com/juju/loggo"
+	"github.com/oschwald/maxminddb-golang"
+	"gopkg.in/errgo.v1"
+)
+
+var logger = loggo.GetLogger("candid.internal.geoip")
+
+// A DB is an open GeoIP database. A nil *DB knows the country of no
+// addresses, so that country lookups can be made whether or not a
+// database has been configured.
+type DB struct {
+	reader *maxminddb.Reader
+}
+
+// Open opens the MaxMind database in the file at the given path. Both
+// country and city databases may be used.
+func Open(path string) (*DB, error) {
+	r, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open GeoIP database")
+	}
+	return &DB{reader: r}, nil
+}
+
+// record holds the part of a database record that is used.
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// Country returns the ISO 3166-1 alpha-2 code of the country of the
+// given address, for example "GB". It returns "" if the country is not
+// known.
+func (db *DB) Country(ip net.IP) string {
+	if db == nil || ip == nil {
+		return ""
+	}
+	var r record
+	if err := db.reader.Lookup(ip, &r); err != nil {
+		logger.Debugf("cannot look up %s: %s", ip, err)
+		return ""
+	}
+	return r.Country.ISOCode
+}
+
+// Close closes the database.
+func (db *DB) Close() error {
+	if db == nil {
+		return nil
+	}
+	return errgo.Mask(db.reader.Close())
+}
@@ -0,0 +1,328 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package groupgrant implements time-boxed grants of membership in
+// Candid-local groups, for example to give an engineer temporary access
+// to production during an incident. A grant adds the group to the
+// identity's stored groups and a background job removes it again when
+// the grant expires.
+package groupgrant
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+var logger = loggo.GetLogger("candid.internal.groupgrant")
+
+// auditLogger is the logger used to record the expiry of grants.
+var auditLogger = loggo.GetLogger("candid.audit")
+
+// StoreName is the name of the provider data key-value store that
+// holds the grants.
+const StoreName = "_group_grants"
+
+// grantsKey is the key under which all grants are stored. The number
+// of outstanding grants is expected to be small, so they are kept
+// together in order that they can be listed.
+const grantsKey = "grants"
+
+// defaultExpiryInterval is the default interval between checks for
+// expired grants.
+const defaultExpiryInterval = time.Minute
+
+var (
+	// ErrNotFound is the error cause returned when a grant does not
+	// exist.
+	ErrNotFound = errgo.New("group grant not found")
+
+	// ErrAlreadyMember is the error cause returned when a grant is
+	// made to a user that is already a permanent member of the
+	// group.
+	ErrAlreadyMember = errgo.New("already a member of group")
+)
+
+// A Grant is a grant of membership in a group until a specified time.
+type Grant struct {
+	// Username holds the username of the identity that is granted
+	// membership.
+	Username string `json:"username"`
+
+	// Group holds the group the identity is granted membership in.
+	Group string `json:"group"`
+
+	// Expires holds the time at which the membership is removed.
+	Expires time.Time `json:"expires"`
+
+	// GrantedBy holds the username of the identity that made the
+	// grant.
+	GrantedBy string `json:"granted-by,omitempty"`
+
+	// Reason holds the reason given for the grant, if any.
+	Reason string `json:"reason,omitempty"`
+}
+
+// key returns the key of the grant in the stored grants.
+func (g Grant) key() string {
+	return g.Username + " " + g.Group
+}
+
+// Params holds the parameters of a Store.
+type Params struct {
+	// Store holds the key-value store in which grants are kept.
+	Store simplekv.Store
+
+	// Identities holds the store of identities whose groups are
+	// changed.
+	Identities store.Store
+
+	// ExpiryInterval holds the interval between checks for expired
+	// grants. If this is zero a default of one minute is used.
+	ExpiryInterval time.Duration
+}
+
+// A Store stores grants and removes group memberships when their
+// grants expire.
+type Store struct {
+	p Params
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	wg        sync.WaitGroup
+}
+
+// New returns a new Store with the given parameters.
+func New(p Params) *Store {
+	if p.ExpiryInterval == 0 {
+		p.ExpiryInterval = defaultExpiryInterval
+	}
+	return &Store{
+		p:      p,
+		closed: make(chan struct{}),
+	}
+}
+
+// List returns all outstanding grants, ordered by expiry time.
+func (s *Store) List(ctx context.Context) ([]Grant, error) {
+	v, err := s.p.Store.Get(ctx, grantsKey)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	gs, err := unmarshal(v)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return sorted(gs), nil
+}
+
+// Grant grants membership in g.Group to g.Username until g.Expires. If
+// the user already has a grant for the group, its expiry time is
+// changed. If the user is already a member of the group without a
+// grant an error with a cause of ErrAlreadyMember is returned, so that
+// permanent memberships are never removed by expiry.
+func (s *Store) Grant(ctx context.Context, g Grant) error {
+	if g.Username == "" || g.Group == "" {
+		return errgo.Newf("username and group must be specified")
+	}
+	id := store.Identity{Username: g.Username}
+	if err := s.p.Identities.Identity(ctx, &id); err != nil {
+		return errgo.Mask(err, errgo.Is(store.ErrNotFound))
+	}
+	err := s.update(ctx, func(gs map[string]Grant) error {
+		if _, ok := gs[g.key()]; !ok && contains(id.Groups, g.Group) {
+			return errgo.WithCausef(nil, ErrAlreadyMember, "%s is already a member of %s", g.Username, g.Group)
+		}
+		gs[g.key()] = g
+		return nil
+	})
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrAlreadyMember))
+	}
+	// The grant is recorded before the group is added so that a
+	// membership is never left without a grant to remove it.
+	err = s.p.Identities.UpdateIdentity(ctx, &store.Identity{
+		Username: g.Username,
+		Groups:   []string{g.Group},
+	}, store.Update{
+		store.Groups: store.Push,
+	})
+	return errgo.Mask(err, errgo.Is(store.ErrNotFound), errgo.Is(store.ErrReadOnly))
+}
+
+// Revoke removes the grant of membership in the given group to the
+// given user, and removes the user from the group. If there is no such
+// grant an error with a cause of ErrNotFound is returned.
+func (s *Store) Revoke(ctx context.Context, username, group string) error {
+	err := s.update(ctx, func(gs map[string]Grant) error {
+		k := Grant{Username: username, Group: group}.key()
+		if _, ok := gs[k]; !ok {
+			return errgo.WithCausef(nil, ErrNotFound, "%s has no grant for %s", username, group)
+		}
+		delete(gs, k)
+		return nil
+	})
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	return errgo.Mask(s.removeMember(ctx, username, group), errgo.Is(store.ErrReadOnly))
+}
+
+// Expire removes the memberships of all grants that have expired by
+// the given time.
+func (s *Store) Expire(ctx context.Context, now time.Time) error {
+	gs, err := s.List(ctx)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, g := range gs {
+		if g.Expires.After(now) {
+			break
+		}
+		// Remove the membership before the grant, so that it is
+		// tried again if it fails.
+		if err := s.removeMember(ctx, g.Username, g.Group); err != nil {
+			return errgo.Notef(err, "cannot remove %s from %s", g.Username, g.Group)
+		}
+		removed := false
+		err := s.update(ctx, func(gs map[string]Grant) error {
+			// The grant may have been extended in the meantime.
+			if cur, ok := gs[g.key()]; ok && !cur.Expires.After(now) {
+				delete(gs, g.key())
+				removed = true
+			}
+			return nil
+		})
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if removed {
+			auditLogger.Infof("membership of %s in %s granted by %s expired", g.Username, g.Group, g.GrantedBy)
+		} else {
+			// Restore the membership of the extended grant.
+			err := s.p.Identities.UpdateIdentity(ctx, &store.Identity{
+				Username: g.Username,
+				Groups:   []string{g.Group},
+			}, store.Update{
+				store.Groups: store.Push,
+			})
+			if err != nil {
+				return errgo.Mask(err)
+			}
+		}
+	}
+	return nil
+}
+
+// Start starts a goroutine that periodically removes the memberships of
+// expired grants.
+func (s *Store) Start() {
+	s.wg.Add(1)
+	go s.run()
+}
+
+// Close stops any goroutine started by Start.
+func (s *Store) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	s.wg.Wait()
+}
+
+func (s *Store) run() {
+	defer s.wg.Done()
+	t := time.NewTicker(s.p.ExpiryInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-s.closed:
+			return
+		}
+		// Expired memberships cannot be removed while the server
+		// is read-only, so they are tried again later.
+		if err := s.Expire(context.Background(), time.Now()); err != nil {
+			logger.Errorf("cannot expire group grants: %s", err)
+		}
+	}
+}
+
+func (s *Store) removeMember(ctx context.Context, username, group string) error {
+	err := s.p.Identities.UpdateIdentity(ctx, &store.Identity{
+		Username: username,
+		Groups:   []string{group},
+	}, store.Update{
+		store.Groups: store.Pull,
+	})
+	if errgo.Cause(err) == store.ErrNotFound {
+		// The identity has been removed, so there is no
+		// membership to remove.
+		return nil
+	}
+	return errgo.Mask(err, errgo.Is(store.ErrReadOnly))
+}
+
+func (s *Store) update(ctx context.Context, f func(map[string]Grant) error) error {
+	var ferr error
+	err := s.p.Store.Update(ctx, grantsKey, time.Time{}, func(old []byte) ([]byte, error) {
+		gs := make(map[string]Grant)
+		if len(old) > 0 {
+			var err error
+			gs, err = unmarshal(old)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
+		ferr = f(gs)
+		if ferr != nil {
+			return nil, ferr
+		}
+		return json.Marshal(gs)
+	})
+	if ferr != nil {
+		return ferr
+	}
+	return errgo.Mask(err)
+}
+
+func unmarshal(v []byte) (map[string]Grant, error) {
+	gs := make(map[string]Grant)
+	if err := json.Unmarshal(v, &gs); err != nil {
+		return nil, errgo.Notef(err, "invalid group grants")
+	}
+	return gs, nil
+}
+
+func sorted(gs map[string]Grant) []Grant {
+	l := make([]Grant, 0, len(gs))
+	for _, g := range gs {
+		l = append(l, g)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if !l[i].Expires.Equal(l[j].Expires) {
+			return l[i].Expires.Before(l[j].Expires)
+		}
+		return l[i].key() < l[j].key()
+	})
+	return l
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package groupgrant_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/simplekv/memsimplekv"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/internal/groupgrant"
+	"github.com/CanonicalLtd/candid/store"
+	"github.com/CanonicalLtd/candid/store/memstore"
+)
+
+func TestGrantAndExpire(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := newIdentityStore(c)
+	s := groupgrant.New(groupgrant.Params{
+		Store:      memsimplekv.NewStore(),
+		Identities: st,
+	})
+	now := time.Now().Round(time.Second)
+
+	err := s.Grant(ctx, groupgrant.Grant{
+		Username:  "bob",
+		Group:     "prod",
+		Expires:   now.Add(time.Hour),
+		GrantedBy: "admin",
+		Reason:    "incident 42",
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = s.Grant(ctx, groupgrant.Grant{
+		Username: "bob",
+		Group:    "db",
+		Expires:  now.Add(time.Minute),
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups(c, st, "bob"), qt.DeepEquals, []string{"a", "prod", "db"})
+
+	gs, err := s.List(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(gs, qt.HasLen, 2)
+	c.Assert(gs[0].Group, qt.Equals, "db")
+	c.Assert(gs[1].Group, qt.Equals, "prod")
+	c.Assert(gs[1].Reason, qt.Equals, "incident 42")
+
+	// Nothing has expired yet.
+	err = s.Expire(ctx, now)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups(c, st, "bob"), qt.DeepEquals, []string{"a", "prod", "db"})
+
+	err = s.Expire(ctx, now.Add(30*time.Minute))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups(c, st, "bob"), qt.DeepEquals, []string{"a", "prod"})
+	gs, err = s.List(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(gs, qt.HasLen, 1)
+
+	// Extending a grant changes its expiry time.
+	err = s.Grant(ctx, groupgrant.Grant{
+		Username: "bob",
+		Group:    "prod",
+		Expires:  now.Add(2 * time.Hour),
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = s.Expire(ctx, now.Add(90*time.Minute))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups(c, st, "bob"), qt.DeepEquals, []string{"a", "prod"})
+
+	err = s.Expire(ctx, now.Add(3*time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups(c, st, "bob"), qt.DeepEquals, []string{"a"})
+	gs, err = s.List(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(gs, qt.HasLen, 0)
+}
+
+func TestGrantPermanentMember(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := newIdentityStore(c)
+	s := groupgrant.New(groupgrant.Params{
+		Store:      memsimplekv.NewStore(),
+		Identities: st,
+	})
+	err := s.Grant(ctx, groupgrant.Grant{
+		Username: "bob",
+		Group:    "a",
+		Expires:  time.Now().Add(time.Hour),
+	})
+	c.Assert(err, qt.ErrorMatches, `bob is already a member of a`)
+	c.Assert(errgo.Cause(err), qt.Equals, groupgrant.ErrAlreadyMember)
+
+	err = s.Grant(ctx, groupgrant.Grant{
+		Username: "alice",
+		Group:    "a",
+		Expires:  time.Now().Add(time.Hour),
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+}
+
+func TestRevoke(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := newIdentityStore(c)
+	s := groupgrant.New(groupgrant.Params{
+		Store:      memsimplekv.NewStore(),
+		Identities: st,
+	})
+	err := s.Grant(ctx, groupgrant.Grant{
+		Username: "bob",
+		Group:    "prod",
+		Expires:  time.Now().Add(time.Hour),
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = s.Revoke(ctx, "bob", "prod")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups(c, st, "bob"), qt.DeepEquals, []string{"a"})
+
+	err = s.Revoke(ctx, "bob", "prod")
+	c.Assert(err, qt.ErrorMatches, `bob has no grant for prod`)
+	c.Assert(errgo.Cause(err), qt.Equals, groupgrant.ErrNotFound)
+
+	// Permanent memberships cannot be revoked.
+	err = s.Revoke(ctx, "bob", "a")
+	c.Assert(errgo.Cause(err), qt.Equals, groupgrant.ErrNotFound)
+	c.Assert(groups(c, st, "bob"), qt.DeepEquals, []string{"a"})
+}
+
+func TestStart(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := newIdentityStore(c)
+	s := groupgrant.New(groupgrant.Params{
+		Store:          memsimplekv.NewStore(),
+		Identities:     st,
+		ExpiryInterval: time.Millisecond,
+	})
+	err := s.Grant(ctx, groupgrant.Grant{
+		Username: "bob",
+		Group:    "prod",
+		Expires:  time.Now().Add(10 * time.Millisecond),
+	})
+	c.Assert(err, qt.Equals, nil)
+	s.Start()
+	defer s.Close()
+	for i := 0; len(groups(c, st, "bob")) > 1; i++ {
+		c.Assert(i < 1000, qt.Equals, true)
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(groups(c, st, "bob"), qt.DeepEquals, []string{"a"})
+}
+
+func newIdentityStore(c *qt.C) store.Store {
+	st := memstore.NewStore()
+	err := st.UpdateIdentity(context.Background(), &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Groups:     []string{"a"},
+	}, store.Update{
+		store.Username: store.Set,
+		store.Groups:   store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+	return st
+}
+
+func groups(c *qt.C, st store.Store, username string) []string {
+	id := store.Identity{Username: username}
+	err := st.Identity(context.Background(), &id)
+	c.Assert(err, qt.Equals, nil)
+	return id.Groups
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package groupowner records the owners of Candid-local groups. The
+// owners of a group may add and remove its members, and approve
+// requests for membership of it, without being administrators of the
+// identity server.
+package groupowner
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "gopkg.in/errgo.v1"
+)
+
+// StoreName is the name of the provider data key-value store that
+// holds the group owners.
+const StoreName = "_group_owners"
+
+// ownersKey is the key under which the owners of all groups are
+// stored, so that the groups owned by a user can be found.
+const ownersKey = "owners"
+
+// Store stores the owners of groups. It wraps a KeyValueStore.
+type Store struct {
+	store simplekv.Store
+}
+
+// NewStore creates a new Store using the given KeyValueStore for
+// backing storage.
+func NewStore(store simplekv.Store) *Store {
+	return &Store{store: store}
+}
+
+// Owners returns the owners of the given group. Each owner is either a
+// username or the name of a group whose members are all owners.
+func (s *Store) Owners(ctx context.Context, group string) ([]string, error) {
+	r, err := s.get(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return r[group], nil
+}
+
+// All returns the owners of every group that has any.
+func (s *Store) All(ctx context.Context) (map[string][]string, error) {
+	r, err := s.get(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return r, nil
+}
+
+// SetOwners sets the owners of the given group. If owners is empty,
+// the group no longer has any owners.
+func (s *Store) SetOwners(ctx context.Context, group string, owners []string) error {
+	err := s.store.Update(ctx, ownersKey, time.Time{}, func(old []byte) ([]byte, error) {
+		r := make(map[string][]string)
+		if len(old) > 0 {
+			if err := json.Unmarshal(old, &r); err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
+		if len(owners) == 0 {
+			delete(r, group)
+		} else {
+			owners = append([]string(nil), owners...)
+			sort.Strings(owners)
+			r[group] = owners
+		}
+		return json.Marshal(r)
+	})
+	return errgo.Mask(err)
+}
+
+func (s *Store) get(ctx context.Context) (map[string][]string, error) {
+	r := make(map[string][]string)
+	data, err := s.store.Get(ctx, ownersKey)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return r, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, errgo.Notef(err, "invalid group owners")
+	}
+	return r, nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package groupowner_test
+
+import (
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/simplekv/memsimplekv"
+
+	"github.com/CanonicalLtd/candid/internal/groupowner"
+)
+
+func TestStore(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	s := groupowner.NewStore(memsimplekv.NewStore())
+
+	owners, err := s.Owners(ctx, "prod")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(owners, qt.HasLen, 0)
+
+	err = s.SetOwners(ctx, "prod", []string{"ops-leads", "bob"})
+	c.Assert(err, qt.Equals, nil)
+	err = s.SetOwners(ctx, "db", []string{"alice"})
+	c.Assert(err, qt.Equals, nil)
+
+	owners, err = s.Owners(ctx, "prod")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(owners, qt.DeepEquals, []string{"bob", "ops-leads"})
+
+	all, err := s.All(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(all, qt.DeepEquals, map[string][]string{
+		"db":   {"alice"},
+		"prod": {"bob", "ops-leads"},
+	})
+
+	err = s.SetOwners(ctx, "prod", nil)
+	c.Assert(err, qt.Equals, nil)
+	all, err = s.All(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(all, qt.DeepEquals, map[string][]string{
+		"db": {"alice"},
+	})
+}
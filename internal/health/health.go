@@ -0,0 +1,144 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package health implements liveness and readiness checks for the
+// identity server, suitable for use as Kubernetes probes.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+	"gopkg.in/errgo.v1"
+)
+
+var logger = loggo.GetLogger("candid.internal.health")
+
+// defaultTimeout is the timeout used for a check that does not specify
+// one.
+const defaultTimeout = 5 * time.Second
+
+// A Check is a single readiness check of a dependency of the server.
+type Check struct {
+	// Name holds the name of the check, as it appears in the
+	// results.
+	Name string
+
+	// Timeout holds the maximum time the check may take. If this is
+	// zero a default of five seconds is used.
+	Timeout time.Duration
+
+	// Check performs the check, returning an error if the
+	// dependency is not available.
+	Check func(ctx context.Context) error
+}
+
+// A Result holds the result of a single Check.
+type Result struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Run runs all the given checks concurrently, each with its own
+// timeout, and returns their results in name order. The returned bool
+// reports whether all checks passed.
+func Run(ctx context.Context, checks []Check) ([]Result, bool) {
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		i, c := i, c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = run(ctx, c)
+		}()
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	ok := true
+	for _, r := range results {
+		ok = ok && r.OK
+	}
+	return results, ok
+}
+
+func run(ctx context.Context, c Check) Result {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.Check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		err = errgo.Newf("timed out after %v", timeout)
+	}
+	r := Result{
+		Name:     c.Name,
+		OK:       err == nil,
+		Duration: time.Since(start).String(),
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// LivenessHandler returns a handler that reports that the server is
+// running. It does not check any dependencies, so that an orchestrator
+// does not restart the server when, for example, the database is
+// temporarily unavailable.
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// ReadinessHandler returns a handler that runs the given checks and
+// responds with a 200 status if all of them pass, or a 503 status
+// otherwise. The body of the response holds the results of the checks
+// as JSON.
+func ReadinessHandler(checks []Check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		results, ok := Run(req.Context(), checks)
+		status := http.StatusOK
+		if !ok {
+			status = http.StatusServiceUnavailable
+			for _, r := range results {
+				if !r.OK {
+					logger.Warningf("readiness check %s failed: %s", r.Name, r.Error)
+				}
+			}
+		}
+		data, err := json.Marshal(struct {
+			OK     bool     `json:"ok"`
+			Checks []Result `json:"checks"`
+		}{ok, results})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(data)
+	})
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/internal/health"
+)
+
+func TestRun(t *testing.T) {
+	c := qt.New(t)
+	results, ok := health.Run(context.Background(), []health.Check{{
+		Name:  "b",
+		Check: func(context.Context) error { return nil },
+	}, {
+		Name:  "a",
+		Check: func(context.Context) error { return errgo.New("broken") },
+	}})
+	c.Assert(ok, qt.Equals, false)
+	c.Assert(results, qt.HasLen, 2)
+	c.Assert(results[0].Name, qt.Equals, "a")
+	c.Assert(results[0].OK, qt.Equals, false)
+	c.Assert(results[0].Error, qt.Equals, "broken")
+	c.Assert(results[1].Name, qt.Equals, "b")
+	c.Assert(results[1].OK, qt.Equals, true)
+}
+
+func TestRunTimeout(t *testing.T) {
+	c := qt.New(t)
+	block := make(chan struct{})
+	defer close(block)
+	results, ok := health.Run(context.Background(), []health.Check{{
+		Name:    "slow",
+		Timeout: 10 * time.Millisecond,
+		Check: func(context.Context) error {
+			// Ignore the context to check that a check that does
+			// not return still times out.
+			<-block
+			return nil
+		},
+	}})
+	c.Assert(ok, qt.Equals, false)
+	c.Assert(results[0].Error, qt.Equals, "timed out after 10ms")
+}
+
+func TestReadinessHandler(t *testing.T) {
+	c := qt.New(t)
+	var err error
+	h := health.ReadinessHandler([]health.Check{{
+		Name:  "store",
+		Check: func(context.Context) error { return err },
+	}})
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+	c.Assert(rr.Code, qt.Equals, http.StatusOK)
+
+	err = errgo.New("database down")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+	c.Assert(rr.Code, qt.Equals, http.StatusServiceUnavailable)
+	var body struct {
+		OK     bool
+		Checks []health.Result
+	}
+	c.Assert(json.Unmarshal(rr.Body.Bytes(), &body), qt.Equals, nil)
+	c.Assert(body.OK, qt.Equals, false)
+	c.Assert(body.Checks, qt.HasLen, 1)
+	c.Assert(body.Checks[0].Error, qt.Equals, "database down")
+}
+
+func TestLivenessHandler(t *testing.T) {
+	c := qt.New(t)
+	rr := httptest.NewRecorder()
+	health.LivenessHandler().ServeHTTP(rr, httptest.NewRequest("GET", "/healthz", nil))
+	c.Assert(rr.Code, qt.Equals, http.StatusOK)
+	c.Assert(rr.Body.String(), qt.Equals, "ok\n")
+}
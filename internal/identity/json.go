@@ -11,12 +11,22 @@ import (
 	"gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/candid/internal/waitlimit"
 )
 
 // ErrLoginRequired is returned by the /debug/* endpoints when OpenID
 // authentication is required.
 const ErrLoginRequired params.ErrorCode = "login required"
 
+// ErrRendezvousExpired is returned by the wait endpoints when the
+// interactive login being waited for has expired.
+const ErrRendezvousExpired params.ErrorCode = "rendezvous expired"
+
+// ErrLegacyInteractionDisabled is returned when a client uses the
+// legacy visit-wait interaction protocol and it has been disabled.
+const ErrLegacyInteractionDisabled params.ErrorCode = "legacy interaction disabled"
+
 var (
 	ReqServer = httprequest.Server{
 		ErrorMapper: errToResp,
@@ -49,6 +59,12 @@ func errToResp(ctx context.Context, err error) (int, interface{}) {
 		status = http.StatusMethodNotAllowed
 	case params.ErrServiceUnavailable:
 		status = http.StatusServiceUnavailable
+	case ErrRendezvousExpired, ErrLegacyInteractionDisabled:
+		status = http.StatusGone
+	case waitlimit.ErrTooManyWaiters:
+		status = http.StatusTooManyRequests
+	case waitlimit.ErrWaitTimeout:
+		status = http.StatusRequestTimeout
 	}
 
 	if status == http.StatusInternalServerError {
@@ -7,27 +7,57 @@ import (
 	"context"
 	"fmt"
 	"html/template"
+	"io"
+	"net"
 	"net/http"
 	"runtime/debug"
 	"time"
 
 	"github.com/juju/aclstore/v2"
 	"github.com/juju/loggo"
+	"github.com/juju/simplekv"
 	"github.com/juju/utils/debugstatus"
 	"github.com/julienschmidt/httprouter"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gopkg.in/CanonicalLtd/candidclient.v1/params"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
 
+	"github.com/CanonicalLtd/candid/attrcrypt"
 	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/idputil/challenge"
+	"github.com/CanonicalLtd/candid/idp/idputil/lockout"
+	"github.com/CanonicalLtd/candid/internal/agentkeys"
+	"github.com/CanonicalLtd/candid/internal/attrschema"
 	"github.com/CanonicalLtd/candid/internal/auth"
 	"github.com/CanonicalLtd/candid/internal/auth/httpauth"
+	"github.com/CanonicalLtd/candid/internal/canary"
+	"github.com/CanonicalLtd/candid/internal/clientip"
+	"github.com/CanonicalLtd/candid/internal/consent"
+	"github.com/CanonicalLtd/candid/internal/cors"
+	"github.com/CanonicalLtd/candid/internal/geoip"
+	"github.com/CanonicalLtd/candid/internal/groupgrant"
+	"github.com/CanonicalLtd/candid/internal/groupowner"
+	"github.com/CanonicalLtd/candid/internal/jwt"
+	"github.com/CanonicalLtd/candid/internal/keyring"
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/internal/logout"
 	"github.com/CanonicalLtd/candid/internal/monitoring"
+	"github.com/CanonicalLtd/candid/internal/readonly"
+	"github.com/CanonicalLtd/candid/internal/remember"
+	"github.com/CanonicalLtd/candid/internal/revocation"
+	"github.com/CanonicalLtd/candid/internal/secheaders"
+	"github.com/CanonicalLtd/candid/internal/services"
+	"github.com/CanonicalLtd/candid/internal/sessions"
+	"github.com/CanonicalLtd/candid/internal/throttle"
+	"github.com/CanonicalLtd/candid/internal/waitlimit"
 	"github.com/CanonicalLtd/candid/meeting"
+	"github.com/CanonicalLtd/candid/notify"
 	"github.com/CanonicalLtd/candid/store"
+	"github.com/CanonicalLtd/candid/store/cachestore"
 )
 
 const (
@@ -48,6 +78,45 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 	if len(versions) == 0 {
 		return nil, errgo.Newf("identity server must serve at least one version of the API")
 	}
+	if len(sp.ExtraInfoEncryption.Attributes) > 0 && sp.ExtraInfoEncryption.Encrypter == nil {
+		return nil, errgo.Newf("no encrypter specified for sensitive extra-info attributes")
+	}
+	if sp.ProviderDataEncrypter != nil {
+		sp.ProviderDataStore = attrcrypt.NewProviderDataStore(sp.ProviderDataStore, sp.ProviderDataEncrypter)
+	}
+	if sp.EditableProfileFields == nil {
+		sp.EditableProfileFields = []string{"name", "email"}
+	}
+	attributeSchema, err := attrschema.New(sp.Attributes)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid identity attributes")
+	}
+	// The identity cache does not implement store.Watcher, so find
+	// the watcher before the store is wrapped.
+	identityWatcher, _ := sp.Store.(store.Watcher)
+	var identityCache *cachestore.Store
+	if sp.IdentityCache.Size > 0 {
+		identityCache = cachestore.New(sp.Store, sp.IdentityCache)
+		sp.Store = identityCache
+		defer func() {
+			// identityCache is cleared once it is owned by
+			// the server.
+			if identityCache != nil {
+				identityCache.Close()
+			}
+		}()
+	}
+	readOnlyStore, err := sp.ProviderDataStore.KeyValueStore(context.Background(), readonly.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	readOnly, err := readonly.New(context.Background(), readonly.Params{
+		Store: readOnlyStore,
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	sp.Store = readonly.NewStore(sp.Store, readOnly)
 
 	// Create the bakery parts.
 	if sp.Key == nil {
@@ -57,10 +126,50 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 			return nil, errgo.Notef(err, "cannot generate key")
 		}
 	}
-	locator := bakery.NewThirdPartyStore()
-	locator.AddInfo(sp.Location, bakery.ThirdPartyInfo{
-		PublicKey: sp.Key.Public,
-		Version:   bakery.LatestVersion,
+	var keyStore simplekv.Store
+	if sp.KeyRotation.Enabled {
+		var err error
+		keyStore, err = sp.ProviderDataStore.KeyValueStore(context.Background(), "_bakery_keys")
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	keyRing, err := keyring.New(context.Background(), keyring.Params{
+		Store:            keyStore,
+		InitialKey:       sp.Key,
+		Location:         sp.Location,
+		RotationInterval: sp.KeyRotation.Interval,
+		Overlap:          sp.KeyRotation.Overlap,
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot initialize keys")
+	}
+	// The token signing key is always needed to sign back-channel
+	// logout tokens, but JSON Web Tokens are only issued to users
+	// if audiences are configured.
+	jwtStore, err := sp.ProviderDataStore.KeyValueStore(context.Background(), jwt.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	tokenSigner, err := jwt.NewIssuer(context.Background(), jwtStore)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot initialize token issuer")
+	}
+	var jwtIssuer *jwt.Issuer
+	if len(sp.JWT.Audiences) > 0 {
+		if sp.JWT.Lifetime == 0 {
+			sp.JWT.Lifetime = jwt.DefaultLifetime
+		}
+		jwtIssuer = tokenSigner
+	}
+	servicesStore, err := sp.ProviderDataStore.KeyValueStore(context.Background(), services.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	logoutNotifier := logout.New(logout.Params{
+		Location: sp.Location,
+		Issuer:   tokenSigner,
+		Services: services.NewStore(servicesStore),
 	})
 	var rksf func([]bakery.Op) bakery.RootKeyStore
 	if sp.RootKeyStore != nil {
@@ -72,7 +181,7 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 		Namespace:          auth.Namespace,
 		RootKeyStoreForOps: rksf,
 		Key:                sp.Key,
-		Locator:            locator,
+		Locator:            keyRing,
 		Location:           "identity",
 	})
 	if sp.APIMacaroonTimeout == 0 {
@@ -85,12 +194,32 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 		sp.DischargeTokenTimeout = defaultDischargeTokenTimeout
 	}
 	aclManager, err := aclstore.NewManager(context.Background(), aclstore.Params{
-		Store:             sp.ACLStore,
+		Store:             auth.NewACLStore(sp.ACLStore),
 		InitialAdminUsers: []string{auth.AdminUsername},
 	})
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	agentKeyStore, err := sp.ProviderDataStore.KeyValueStore(context.Background(), agentkeys.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	revocationStore, err := sp.ProviderDataStore.KeyValueStore(context.Background(), revocation.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	groupOwnerStore, err := sp.ProviderDataStore.KeyValueStore(context.Background(), groupowner.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	groupGrantStore, err := sp.ProviderDataStore.KeyValueStore(context.Background(), groupgrant.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	groupGrants := groupgrant.New(groupgrant.Params{
+		Store:      groupGrantStore,
+		Identities: sp.Store,
+	})
 	auth, err := auth.New(auth.Params{
 		AdminPassword:     sp.AdminPassword,
 		Location:          sp.Location,
@@ -98,6 +227,9 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 		Store:             sp.Store,
 		IdentityProviders: sp.IdentityProviders,
 		ACLManager:        aclManager,
+		AgentKeys:         agentkeys.NewStore(agentKeyStore),
+		Revocations:       revocation.NewStore(revocationStore),
+		GroupOwners:       groupowner.NewStore(groupOwnerStore),
 	})
 	if err != nil {
 		return nil, errgo.Mask(err)
@@ -120,16 +252,63 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 		return nil, errgo.Mask(err)
 	}
 
+	corsPolicy, err := cors.New(sp.CORS)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid CORS policy")
+	}
+	securityHeaders, err := secheaders.New(sp.SecurityHeaders)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid security headers")
+	}
+	clientIP, err := clientip.New(sp.TrustedProxies)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid trusted proxies")
+	}
+
 	place, err := meeting.NewPlace(meeting.Params{
 		Store:       sp.MeetingStore,
-		Metrics:     monitoring.NewMeetingMetrics(),
+		Metrics:     monitoring.NewMeetingMetrics(sp.MeetingCompletedBuckets),
 		ListenAddr:  sp.PrivateAddr,
 		WaitTimeout: sp.RendezvousTimeout,
+		Discovery:   sp.MeetingDiscovery,
+		Poll:        sp.MeetingPoll,
+		RPC:         sp.MeetingRPC,
+
+		ExpiryDuration: sp.RendezvousExpiry,
+		GCInterval:     sp.RendezvousGCInterval,
 	})
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot create meeting place")
 	}
 
+	var canaryMonitor *canary.Monitor
+	if sp.Canary.Interval > 0 {
+		canaryMonitor, err = canary.New(canary.MonitorParams{
+			Params:     sp.Canary,
+			Location:   sp.Location,
+			Oven:       oven,
+			Authorizer: auth,
+			Store:      sp.Store,
+			Metrics:    monitoring.NewCanaryMetrics(),
+		})
+		if err != nil {
+			place.Close()
+			return nil, errgo.Mask(err)
+		}
+	}
+
+	var geoDB *geoip.DB
+	if sp.GeoIPDatabase != "" {
+		geoDB, err = geoip.Open(sp.GeoIPDatabase)
+		if err != nil {
+			place.Close()
+			if canaryMonitor != nil {
+				canaryMonitor.Close()
+			}
+			return nil, errgo.Mask(err)
+		}
+	}
+
 	storeCollector := monitoring.StoreCollector{Store: sp.Store}
 	prometheus.Register(storeCollector)
 
@@ -138,6 +317,21 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 		router:         httprouter.New(),
 		meetingPlace:   place,
 		storeCollector: storeCollector,
+		canary:         canaryMonitor,
+		keyRing:        keyRing,
+		identityCache:  identityCache,
+		readOnly:       readOnly,
+		groupGrants:    groupGrants,
+		cors:           corsPolicy,
+		secHeaders:     securityHeaders,
+		clientIP:       clientIP,
+		geoIP:          geoDB,
+		idps:           sp.IdentityProviders,
+
+		requestIDHeader: sp.RequestIDHeader,
+	}
+	if srv.requestIDHeader == "" {
+		srv.requestIDHeader = "X-Request-Id"
 	}
 	// Disable the automatic rerouting in order to maintain
 	// compatibility. It might be worthwhile relaxing this in the
@@ -148,17 +342,31 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 	srv.router.MethodNotAllowed = http.HandlerFunc(srv.methodNotAllowed)
 
 	srv.router.Handle("OPTIONS", "/*path", srv.options)
-	srv.router.Handler("GET", "/metrics", prometheus.Handler())
+	srv.router.Handler("GET", "/metrics", promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+			EnableOpenMetrics: sp.MetricExemplars,
+		}),
+	))
 	srv.router.Handler("GET", "/acl/*path", aclHandler)
 	srv.router.Handler("PUT", "/acl/*path", aclHandler)
 	srv.router.Handler("POST", "/acl/*path", aclHandler)
-	srv.router.Handler("GET", "/static/*path", http.StripPrefix("/static", http.FileServer(sp.StaticFileSystem)))
+	srv.router.Handler("GET", "/static/*path", http.StripPrefix("/static", http.FileServer(idp.BrandedFileSystem(sp.StaticFileSystem, sp.IDPBranding))))
+	requestMetrics := monitoring.NewRequestMetrics(sp.RequestDurationBuckets, sp.MetricExemplars)
 	for name, newAPI := range versions {
 		handlers, err := newAPI(HandlerParams{
-			ServerParams: sp,
-			Oven:         oven,
-			Authorizer:   auth,
-			MeetingPlace: place,
+			ServerParams:    sp,
+			Oven:            oven,
+			Authorizer:      auth,
+			MeetingPlace:    place,
+			RequestMetrics:  requestMetrics,
+			KeyRing:         keyRing,
+			JWTIssuer:       jwtIssuer,
+			LogoutNotifier:  logoutNotifier,
+			IdentityWatcher: identityWatcher,
+			ReadOnly:        readOnly,
+			AttributeSchema: attributeSchema,
+			GroupGrants:     groupGrants,
 		})
 		if err != nil {
 			return nil, errgo.Notef(err, "cannot create API %s", name)
@@ -167,6 +375,17 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 			srv.router.Handle(h.Method, h.Path, h.Handle)
 		}
 	}
+	keyRing.Start()
+	readOnly.Start()
+	groupGrants.Start()
+	identityCache = nil
+	if srv.canary != nil {
+		if err := srv.canary.Start(context.Background()); err != nil {
+			srv.canary = nil
+			srv.Close()
+			return nil, errgo.Mask(err)
+		}
+	}
 	return srv, nil
 }
 
@@ -175,29 +394,81 @@ type Server struct {
 	router         *httprouter.Router
 	meetingPlace   *meeting.Place
 	storeCollector monitoring.StoreCollector
+	canary         *canary.Monitor
+	keyRing        *keyring.Ring
+	identityCache  *cachestore.Store
+	readOnly       *readonly.Mode
+	groupGrants    *groupgrant.Store
+	cors           *cors.Policy
+	secHeaders     *secheaders.Policy
+	clientIP       *clientip.Resolver
+	geoIP          *geoip.DB
+	idps           []idp.IdentityProvider
+
+	requestIDHeader string
 }
 
 // ServeHTTP implements http.Handler.
 func (srv *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	defer func() {
 		if v := recover(); v != nil {
-			logger.Errorf("PANIC!: %v\n%s", v, debug.Stack())
+			logging.FromContext(req.Context(), logger).Errorf("PANIC!: %v\n%s", v, debug.Stack())
 			httprequest.WriteJSON(w, http.StatusInternalServerError, params.Error{
 				Code:    "panic",
 				Message: fmt.Sprintf("%v", v),
 			})
 		}
 	}()
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Bakery-Protocol-Version, Macaroons, X-Requested-With, Content-Type")
-	w.Header().Set("Access-Control-Cache-Max-Age", "600")
+	srv.cors.SetHeaders(w.Header(), req)
+	w, req = srv.secHeaders.Wrap(w, req)
+	id := req.Header.Get(srv.requestIDHeader)
+	if !logging.ValidRequestID(id) {
+		id = logging.NewRequestID()
+	}
+	w.Header().Set(srv.requestIDHeader, id)
+	ctx := logging.ContextWithRequestID(req.Context(), id)
+	client := sessions.ClientFromRequest(req)
+	client.Address = srv.clientIP.Address(req)
+	client.Country = srv.geoIP.Country(net.ParseIP(client.Address))
+	if client.Country != "" {
+		ctx = logging.ContextWithCountry(ctx, client.Country)
+	}
+	ctx = sessions.ContextWithClient(ctx, client)
+	req = req.WithContext(ctx)
 	srv.router.ServeHTTP(w, req)
 }
 
+// Shutdown stops the server accepting new logins and waits until the
+// given context is done for the logins already in progress to
+// complete. The server continues to serve other requests, including
+// those needed to complete the logins in progress, so it should be
+// called before the HTTP server is shut down. Close must still be
+// called once the HTTP server has stopped.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return errgo.Mask(s.meetingPlace.Drain(ctx))
+}
+
 // Close  closes any resources held by this Handler.
 func (s *Server) Close() {
 	logger.Debugf("Closing Server")
+	if s.canary != nil {
+		s.canary.Close()
+	}
+	s.keyRing.Close()
+	s.readOnly.Close()
+	s.groupGrants.Close()
 	s.meetingPlace.Close()
+	s.geoIP.Close()
+	if s.identityCache != nil {
+		s.identityCache.Close()
+	}
+	// Some identity providers run background tasks that need to be
+	// stopped.
+	for _, ip := range s.idps {
+		if c, ok := ip.(io.Closer); ok {
+			c.Close()
+		}
+	}
 	prometheus.Unregister(s.storeCollector)
 }
 
@@ -243,6 +514,10 @@ type ServerParams struct {
 	// TODO remove this.
 	DebugTeams []string
 
+	// DebugEndpoints enables the runtime debug endpoints, and allows
+	// users in the debug ACL to use the pprof endpoints.
+	DebugEndpoints bool
+
 	// AdminAgentPublicKey contains the public key of the admin agent.
 	AdminAgentPublicKey *bakery.PublicKey
 
@@ -258,6 +533,11 @@ type ServerParams struct {
 	// executed as part of a /debug/status check.
 	DebugStatusCheckerFuncs []debugstatus.CheckerFunc
 
+	// HealthCheckTimeout holds the maximum time that each readiness
+	// check run by the /readyz endpoint may take. If this is zero, a
+	// default of five seconds is used.
+	HealthCheckTimeout time.Duration
+
 	// RendezvousTimeout holds the time after which an interactive discharge wait
 	// request will time out.
 	RendezvousTimeout time.Duration
@@ -267,9 +547,17 @@ type ServerParams struct {
 
 	// RedirectLoginWhitelist contains a list of URLs that are
 	// trusted to be used as return_to URLs during an interactive
-	// login.
+	// login. URLs with the origin of a registered relying service
+	// are also trusted.
 	RedirectLoginWhitelist []string
 
+	// RedirectLoginPatterns contains patterns, of the form
+	// scheme://host[:port][/path], that match further URLs that are
+	// trusted to be used as return_to URLs. The host may start with
+	// "*." to match all its subdomains, and URLs match if their path
+	// is at or below the pattern's path.
+	RedirectLoginPatterns []string
+
 	// APIMacaroonTimeout is the maximum life of an API macaroon.
 	APIMacaroonTimeout time.Duration
 
@@ -280,6 +568,202 @@ type ServerParams struct {
 	// DischargeTokenTimeout is the maximum life of a Discharge
 	// token.
 	DischargeTokenTimeout time.Duration
+
+	// RequestDurationBuckets holds the buckets, in seconds, of the
+	// histogram used to record the duration of web requests. If
+	// this is empty then a default set of buckets will be used.
+	RequestDurationBuckets []float64
+
+	// MeetingCompletedBuckets holds the buckets, in microseconds, of
+	// the histogram used to record the time taken to complete
+	// interactive login rendezvous. If this is empty then a default
+	// set of buckets will be used.
+	MeetingCompletedBuckets []float64
+
+	// MetricExemplars holds whether the ID of each web request is
+	// recorded as an exemplar in the request duration histogram. If
+	// this is set the metrics are served in the OpenMetrics format
+	// to clients that request it, as exemplars cannot be served in
+	// any other format.
+	MetricExemplars bool
+
+	// Canary holds the configuration of the synthetic login monitor.
+	// If Canary.Interval is zero then the monitor is not run.
+	Canary canary.Params
+
+	// DeclaredAttributes holds, for each relying service identified
+	// by its public key, the identity attributes that are declared
+	// in discharge macaroons issued to that service. Valid
+	// attributes are "email", "groups" and "full-name". The username
+	// is always declared. Services not listed only receive the
+	// username.
+	DeclaredAttributes map[bakery.PublicKey][]string
+
+	// Consent holds the configuration of the consent users must
+	// give before the first discharge for a relying service.
+	Consent consent.Params
+
+	// ExtraInfoEncryption holds the configuration of the extra-info
+	// items that are encrypted at rest. Access to these items is
+	// restricted to members of the read-sensitive-extra-info and
+	// write-sensitive-extra-info ACLs.
+	ExtraInfoEncryption attrcrypt.Params
+
+	// ProviderDataEncrypter, if set, is used to encrypt all values
+	// written to the ProviderDataStore, such as OAuth refresh tokens
+	// held by identity providers.
+	ProviderDataEncrypter attrcrypt.Encrypter
+
+	// DischargeThrottle holds the configuration of the limit on
+	// concurrent discharge requests. When the limit is reached,
+	// requests are queued per relying service, identified by the
+	// string form of its public key, and admitted fairly according
+	// to the configured weights.
+	DischargeThrottle throttle.Params
+
+	// LoginChallenge holds the configuration of the challenge that
+	// users of login forms must complete after repeated failed
+	// logins, from a single address or for a single username. If
+	// LoginChallenge.Type is empty no challenge is required.
+	LoginChallenge challenge.Params
+
+	// LoginLockout holds the configuration of the lockout of
+	// usernames after repeated failed password logins. If
+	// LoginLockout.MaxFailures is zero usernames are never locked
+	// out.
+	LoginLockout lockout.Params
+
+	// KeyRotation holds the configuration of rotation of the bakery
+	// key pair. When enabled, Key is only used if no key pairs have
+	// been stored.
+	KeyRotation keyring.RotationParams
+
+	// CookieDomains holds the domains that cookies set by the server
+	// may be scoped to. When the server is reached by more than one
+	// host name, a cookie is scoped to the longest of these domains
+	// that contains the request host, or to the request host alone
+	// if there is none.
+	CookieDomains []string
+
+	// RequestIDHeader holds the name of the HTTP header used to
+	// carry request IDs. A valid ID in this header of an incoming
+	// request, for example one set by a load balancer, is used as
+	// the ID of the request; otherwise a new ID is generated. The ID
+	// is returned in the same header of the response and is included
+	// in log messages about the request. If this is empty,
+	// "X-Request-Id" is used.
+	RequestIDHeader string
+
+	// IDPBranding holds the branding, such as replacement templates
+	// and static assets, used on the pages shown when logging in
+	// through an identity provider, keyed by identity provider name.
+	// Identity providers without an entry use Template and
+	// StaticFileSystem unchanged.
+	IDPBranding map[string]idp.Branding
+
+	// EmailDomainIDPs maps email domains to the names of the
+	// identity providers that users with email addresses in those
+	// domains log in with. When a browser login is started with a
+	// login hint holding such an email address, the user is sent
+	// straight to the identity provider instead of being asked to
+	// choose one.
+	EmailDomainIDPs map[string]string
+
+	// EditableProfileFields holds the fields of their own identity
+	// that users may change on their profile page, any of "name"
+	// and "email". If this is nil, both fields may be changed.
+	EditableProfileFields []string
+
+	// JWT holds the configuration of the JSON Web Tokens issued in
+	// exchange for Candid macaroons. If JWT.Audiences is empty no
+	// tokens are issued.
+	JWT jwt.Params
+
+	// MeetingDiscovery holds the configuration of the discovery of
+	// other identity servers through the meeting store. When it is
+	// enabled PrivateAddr may be empty.
+	MeetingDiscovery meeting.DiscoveryParams
+
+	// MeetingPoll holds the configuration of the completion of
+	// interactive logins through the meeting store, for
+	// deployments where identity servers cannot contact one
+	// another directly. When it is enabled PrivateAddr may be
+	// empty.
+	MeetingPoll meeting.PollParams
+
+	// MeetingRPC holds the configuration of the security of the
+	// requests that identity servers make to one another to
+	// complete interactive logins.
+	MeetingRPC meeting.RPCParams
+
+	// RendezvousExpiry holds the time after which an interactive
+	// login that has not completed is removed. If it is zero, a
+	// default of one hour is used.
+	RendezvousExpiry time.Duration
+
+	// RendezvousGCInterval holds the interval at which interactive
+	// logins that have expired are removed. If it is zero, a
+	// default of 30 seconds is used.
+	RendezvousGCInterval time.Duration
+
+	// IdentityCache holds the configuration of the cache of
+	// identities fetched from Store. If its Size is zero,
+	// identities are not cached.
+	IdentityCache cachestore.Params
+
+	// ResponseCacheTTL holds the length of time for which responses
+	// to requests for a user and their groups are cached. If it is
+	// zero, responses are not cached.
+	ResponseCacheTTL time.Duration
+
+	// CORS holds the cross-origin resource sharing policy of the
+	// server.
+	CORS cors.Params
+
+	// CookieSameSite holds the SameSite attribute of the cookies set
+	// by the server during login.
+	CookieSameSite http.SameSite
+
+	// CookieSecure holds whether the cookies set by the server
+	// during login are only sent over HTTPS.
+	CookieSecure bool
+
+	// SecurityHeaders holds the security headers, such as the
+	// content security policy, of HTML pages served by the server.
+	SecurityHeaders secheaders.Params
+
+	// WaitLimit holds the limits on requests that wait for
+	// interactive logins to complete.
+	WaitLimit waitlimit.Params
+
+	// DisableLegacyInteraction holds whether clients are prevented
+	// from using the legacy visit-wait interaction protocol.
+	DisableLegacyInteraction bool
+
+	// RememberBrowser holds the policy for remembering the browsers
+	// of users that ask for it, so that they can log in again
+	// without visiting their identity provider.
+	RememberBrowser remember.Params
+
+	// Notifier holds the notifier used to send notifications, such
+	// as email verification and password reset messages. If it is
+	// nil no notifications are sent.
+	Notifier *notify.Notifier
+
+	// GeoIPDatabase holds the path of a MaxMind database used to
+	// find the country of clients. If it is empty the country of
+	// clients is not known.
+	GeoIPDatabase string
+
+	// TrustedProxies holds the addresses, in CIDR notation, of
+	// reverse proxies whose X-Forwarded-For headers are trusted when
+	// determining the address of a client.
+	TrustedProxies []string
+
+	// Attributes holds the definitions of the custom identity
+	// attributes, which are stored as extra-info items and may be
+	// declared in discharge macaroons.
+	Attributes []attrschema.Attribute
 }
 
 type HandlerParams struct {
@@ -296,6 +780,39 @@ type HandlerParams struct {
 	// MeetingPlace contains the meeting place that should be used by
 	// handlers to complete rendezvous.
 	MeetingPlace *meeting.Place
+
+	// RequestMetrics contains the metrics that should be used by
+	// handlers to record request metrics.
+	RequestMetrics *monitoring.RequestMetrics
+
+	// KeyRing contains the key pairs that should be used by handlers
+	// to discharge third-party caveats.
+	KeyRing *keyring.Ring
+
+	// JWTIssuer contains the issuer that should be used by handlers
+	// to sign JSON Web Tokens. It is nil if tokens are not issued.
+	JWTIssuer *jwt.Issuer
+
+	// LogoutNotifier contains the notifier that should be used by
+	// handlers to send back-channel logout notifications to
+	// registered relying services when sessions end.
+	LogoutNotifier *logout.Notifier
+
+	// IdentityWatcher contains the watcher that should be used by
+	// handlers to report changes to identities. It is nil if the
+	// store cannot report changes.
+	IdentityWatcher store.Watcher
+
+	// ReadOnly contains the read-only mode of the server.
+	ReadOnly *readonly.Mode
+
+	// AttributeSchema contains the schema of the custom identity
+	// attributes. It is nil if there are none.
+	AttributeSchema *attrschema.Schema
+
+	// GroupGrants contains the store of time-limited group
+	// memberships.
+	GroupGrants *groupgrant.Store
 }
 
 // notFound is the handler that is called when a handler cannot be found
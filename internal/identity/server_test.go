@@ -32,6 +32,7 @@ import (
 	"github.com/CanonicalLtd/candid/internal/debug"
 	"github.com/CanonicalLtd/candid/internal/discharger"
 	"github.com/CanonicalLtd/candid/internal/identity"
+	"github.com/CanonicalLtd/candid/internal/logging"
 	"github.com/CanonicalLtd/candid/internal/v1"
 	"github.com/CanonicalLtd/candid/store"
 )
@@ -169,6 +170,97 @@ func (s *serverSuite) TestServerHasAccessControlAllowHeaders(c *qt.C) {
 	c.Assert(rec.HeaderMap["Access-Control-Allow-Origin"][0], qt.Equals, "*")
 }
 
+func (s *serverSuite) TestServerRequestID(c *qt.C) {
+	var gotID string
+	impl := map[string]identity.NewAPIHandlerFunc{
+		"/a": func(identity.HandlerParams) ([]httprequest.Handler, error) {
+			return []httprequest.Handler{{
+				Method: "GET",
+				Path:   "/a",
+				Handle: func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+					gotID = logging.RequestIDFromContext(req.Context())
+				},
+			}}, nil
+		},
+	}
+	h, err := identity.New(identity.ServerParams{
+		Store:           s.store.Store,
+		MeetingStore:    s.store.MeetingStore,
+		ACLStore:        s.store.ACLStore,
+		RequestIDHeader: "X-Trace-Id",
+	}, impl)
+	c.Assert(err, qt.Equals, nil)
+	defer h.Close()
+
+	// A new request ID is generated if there is none.
+	rec := qthttptest.DoRequest(c, qthttptest.DoRequestParams{
+		Handler: h,
+		URL:     "/a",
+	})
+	c.Assert(rec.Code, qt.Equals, http.StatusOK)
+	c.Assert(gotID, qt.Not(qt.Equals), "")
+	c.Assert(rec.Header().Get("X-Trace-Id"), qt.Equals, gotID)
+
+	// A valid incoming request ID is used.
+	rec = qthttptest.DoRequest(c, qthttptest.DoRequestParams{
+		Handler: h,
+		URL:     "/a",
+		Header:  http.Header{"X-Trace-Id": {"lb-1234"}},
+	})
+	c.Assert(gotID, qt.Equals, "lb-1234")
+	c.Assert(rec.Header().Get("X-Trace-Id"), qt.Equals, "lb-1234")
+
+	// An invalid incoming request ID is replaced.
+	rec = qthttptest.DoRequest(c, qthttptest.DoRequestParams{
+		Handler: h,
+		URL:     "/a",
+		Header:  http.Header{"X-Trace-Id": {"bad id"}},
+	})
+	c.Assert(gotID, qt.Not(qt.Equals), "bad id")
+	c.Assert(rec.Header().Get("X-Trace-Id"), qt.Equals, gotID)
+}
+
+func (s *serverSuite) TestServerMetricExemplars(c *qt.C) {
+	impl := map[string]identity.NewAPIHandlerFunc{
+		"/a": func(hp identity.HandlerParams) ([]httprequest.Handler, error) {
+			return []httprequest.Handler{{
+				Method: "GET",
+				Path:   "/exemplar",
+				Handle: func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+					hp.RequestMetrics.NewRequest(&httprequest.Params{
+						Request:     req,
+						Context:     req.Context(),
+						PathPattern: "/exemplar",
+					}).ObserveMetric()
+				},
+			}}, nil
+		},
+	}
+	h, err := identity.New(identity.ServerParams{
+		Store:           s.store.Store,
+		MeetingStore:    s.store.MeetingStore,
+		ACLStore:        s.store.ACLStore,
+		MetricExemplars: true,
+	}, impl)
+	c.Assert(err, qt.Equals, nil)
+	defer h.Close()
+
+	rec := qthttptest.DoRequest(c, qthttptest.DoRequestParams{
+		Handler: h,
+		URL:     "/exemplar",
+		Header:  http.Header{"X-Request-Id": {"exemplar-1234"}},
+	})
+	c.Assert(rec.Code, qt.Equals, http.StatusOK)
+
+	rec = qthttptest.DoRequest(c, qthttptest.DoRequestParams{
+		Handler: h,
+		URL:     "/metrics",
+		Header:  http.Header{"Accept": {"application/openmetrics-text; version=0.0.1"}},
+	})
+	c.Assert(rec.Code, qt.Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), qt.Matches, `(?s).*candid_handler_request_duration_seconds_bucket\{path_pattern="/exemplar",le="[^"]+"\} 1 # \{request_id="exemplar-1234"\}.*`)
+}
+
 func (s *serverSuite) TestServerPanicRecovery(c *qt.C) {
 	candidtest.LogTo(c)
 	w := new(loggo.TestWriter)
@@ -248,6 +340,49 @@ func (s *serverSuite) TestServerStaticFiles(c *qt.C) {
 	c.Assert(rr.Body.String(), qt.Equals, "test file")
 }
 
+func (s *serverSuite) TestServerIDPStaticFiles(c *qt.C) {
+	path := c.Mkdir()
+	idpPath := c.Mkdir()
+	err := ioutil.WriteFile(filepath.Join(path, "file"), []byte("global file"), 0666)
+	c.Assert(err, qt.Equals, nil)
+	err = ioutil.WriteFile(filepath.Join(idpPath, "logo.svg"), []byte("idp logo"), 0666)
+	c.Assert(err, qt.Equals, nil)
+	h, err := identity.New(identity.ServerParams{
+		Store:            s.store.Store,
+		MeetingStore:     s.store.MeetingStore,
+		StaticFileSystem: http.Dir(path),
+		ACLStore:         s.store.ACLStore,
+		IDPBranding: map[string]idp.Branding{
+			"test": {Static: http.Dir(idpPath)},
+		},
+	}, map[string]identity.NewAPIHandlerFunc{
+		"version1": func(identity.HandlerParams) ([]httprequest.Handler, error) {
+			return nil, nil
+		},
+	})
+	c.Assert(err, qt.Equals, nil)
+	defer h.Close()
+
+	for url, expect := range map[string]string{
+		"/static/file":              "global file",
+		"/static/idp/test/logo.svg": "idp logo",
+	} {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", url, nil)
+		c.Assert(err, qt.Equals, nil)
+		h.ServeHTTP(rr, req)
+		c.Assert(rr.Code, qt.Equals, http.StatusOK, qt.Commentf("%s: %d: %s", url, rr.Code, rr.Body.String()))
+		c.Assert(rr.Body.String(), qt.Equals, expect)
+	}
+	for _, url := range []string{"/static/idp/other/logo.svg", "/static/idp/test/file"} {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", url, nil)
+		c.Assert(err, qt.Equals, nil)
+		h.ServeHTTP(rr, req)
+		c.Assert(rr.Code, qt.Equals, http.StatusNotFound, qt.Commentf(url))
+	}
+}
+
 func assertServesVersion(c *qt.C, h http.Handler, vers string) {
 	path := vers
 	if path != "" {
@@ -0,0 +1,174 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package jwt issues JSON Web Tokens signed by the identity server, so
+// that services that only understand JWTs can rely on Candid
+// identities. Tokens are signed with ES256 using a key pair that is
+// kept in the identity database, so that all servers in a deployment
+// issue tokens that can be verified with the same key.
+package jwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"time"
+
+	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
+)
+
+// StoreName is the name of the key value store used to hold the
+// signing key.
+const StoreName = "_jwt_keys"
+
+// storeKey is the key in the store under which the signing key is
+// held.
+const storeKey = "signing-key"
+
+// DefaultLifetime is the lifetime of tokens when Params.Lifetime is
+// zero.
+const DefaultLifetime = 5 * time.Minute
+
+// Params holds the configuration of the tokens issued by the identity
+// server.
+type Params struct {
+	// Audiences holds the audiences for which tokens may be issued.
+	// A token request may choose any of these, the first is used if
+	// the request does not specify an audience. If this is empty,
+	// tokens are not issued.
+	Audiences []string
+
+	// Lifetime holds the lifetime of issued tokens. If this is zero
+	// DefaultLifetime is used.
+	Lifetime time.Duration
+
+	// Claims holds the identity attributes that are included as
+	// claims in issued tokens, any of "name", "email" and "groups".
+	// The username is always included as the "sub" claim.
+	Claims []string
+}
+
+// An Issuer issues signed tokens.
+type Issuer struct {
+	key   *ecdsa.PrivateKey
+	keyID string
+}
+
+// NewIssuer returns an Issuer that signs tokens with the key held in
+// the given store. If the store does not yet hold a key a new one is
+// generated and stored.
+func NewIssuer(ctx context.Context, store simplekv.Store) (*Issuer, error) {
+	err := store.Update(ctx, storeKey, time.Time{}, func(old []byte) ([]byte, error) {
+		if old != nil {
+			return old, nil
+		}
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return x509.MarshalECPrivateKey(key)
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot create signing key")
+	}
+	data, err := store.Get(ctx, storeKey)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read signing key")
+	}
+	key, err := x509.ParseECPrivateKey(data)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid signing key")
+	}
+	i := &Issuer{key: key}
+	i.keyID = i.JWK().KeyID
+	return i, nil
+}
+
+// Sign returns a signed token holding the given claims.
+func (i *Issuer) Sign(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": "ES256",
+		"typ": "JWT",
+		"kid": i.keyID,
+	})
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	signingInput := encode(header) + "." + encode(payload)
+	sum := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, i.key, sum[:])
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	// The signature is the concatenation of r and s, each padded
+	// to the size of the curve, as described in RFC 7518 section
+	// 3.4.
+	sig := append(padded(r), padded(s)...)
+	return signingInput + "." + encode(sig), nil
+}
+
+// A JWK is a JSON Web Key, as defined in RFC 7517.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// JWK returns the public key used to verify the issuer's tokens. The
+// key ID is the key's JWK thumbprint, as defined in RFC 7638.
+func (i *Issuer) JWK() JWK {
+	k := JWK{
+		KeyType:   "EC",
+		Use:       "sig",
+		Algorithm: "ES256",
+		Curve:     "P-256",
+		X:         encode(padded(i.key.X)),
+		Y:         encode(padded(i.key.Y)),
+	}
+	k.KeyID = Thumbprint(map[string]string{
+		"crv": k.Curve,
+		"kty": k.KeyType,
+		"x":   k.X,
+		"y":   k.Y,
+	})
+	return k
+}
+
+// Thumbprint returns the JWK thumbprint of a key with the given
+// required members.
+func Thumbprint(members map[string]string) string {
+	// encoding/json writes map keys in sorted order, as the
+	// thumbprint requires.
+	data, err := json.Marshal(members)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(data)
+	return encode(sum[:])
+}
+
+// padded returns the big-endian representation of n padded to the
+// 32 byte size of the P-256 curve.
+func padded(n *big.Int) []byte {
+	b := n.Bytes()
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package jwt_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/simplekv/memsimplekv"
+
+	"github.com/CanonicalLtd/candid/internal/jwt"
+)
+
+func TestNewIssuerReusesKey(t *testing.T) {
+	c := qt.New(t)
+	store := memsimplekv.NewStore()
+	i1, err := jwt.NewIssuer(context.Background(), store)
+	c.Assert(err, qt.Equals, nil)
+	i2, err := jwt.NewIssuer(context.Background(), store)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(i2.JWK(), qt.DeepEquals, i1.JWK())
+
+	i3, err := jwt.NewIssuer(context.Background(), memsimplekv.NewStore())
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(i3.JWK().KeyID, qt.Not(qt.Equals), i1.JWK().KeyID)
+}
+
+func TestSign(t *testing.T) {
+	c := qt.New(t)
+	i, err := jwt.NewIssuer(context.Background(), memsimplekv.NewStore())
+	c.Assert(err, qt.Equals, nil)
+	tok, err := i.Sign(map[string]interface{}{
+		"sub": "bob",
+		"aud": "https://service.example.com",
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	parts := strings.Split(tok, ".")
+	c.Assert(parts, qt.HasLen, 3)
+	var header map[string]string
+	decodePart(c, parts[0], &header)
+	c.Assert(header, qt.DeepEquals, map[string]string{
+		"alg": "ES256",
+		"typ": "JWT",
+		"kid": i.JWK().KeyID,
+	})
+	var claims map[string]interface{}
+	decodePart(c, parts[1], &claims)
+	c.Assert(claims, qt.DeepEquals, map[string]interface{}{
+		"sub": "bob",
+		"aud": "https://service.example.com",
+	})
+
+	k := i.JWK()
+	c.Assert(k.KeyType, qt.Equals, "EC")
+	c.Assert(k.Algorithm, qt.Equals, "ES256")
+	pub := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     decodeInt(c, k.X),
+		Y:     decodeInt(c, k.Y),
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(sig, qt.HasLen, 64)
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	ok := ecdsa.Verify(pub, sum[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	c.Assert(ok, qt.Equals, true)
+}
+
+func decodePart(c *qt.C, s string, v interface{}) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	c.Assert(err, qt.Equals, nil)
+	err = json.Unmarshal(data, v)
+	c.Assert(err, qt.Equals, nil)
+}
+
+func decodeInt(c *qt.C, s string) *big.Int {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(data, qt.HasLen, 32)
+	return new(big.Int).SetBytes(data)
+}
@@ -0,0 +1,11 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package keyring
+
+import "context"
+
+// Refresh reloads the keys held in r, rotating them if due.
+func Refresh(r *Ring) error {
+	return r.refresh(context.Background())
+}
@@ -0,0 +1,374 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package keyring manages the bakery key pairs used by the identity
+// server. Key pairs can be rotated, either on a schedule or on demand,
+// and retired key pairs continue to be accepted for discharging
+// third-party caveats for an overlap period, so that relying services
+// that have cached the old public key continue to work.
+package keyring
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+)
+
+var logger = loggo.GetLogger("candid.internal.keyring")
+
+// storeKey is the key in the simplekv store under which the key pairs
+// are held.
+const storeKey = "keys"
+
+// defaultRefreshInterval is the default interval between reloading the
+// key pairs from the store.
+const defaultRefreshInterval = time.Minute
+
+// ErrRotationNotEnabled is returned by Rotate when the ring does not
+// have a store.
+var ErrRotationNotEnabled = errgo.New("key rotation not enabled")
+
+// RotationParams holds the configuration of key rotation for the
+// identity server.
+type RotationParams struct {
+	// Enabled holds whether the key pairs are kept in the store so
+	// that they can be rotated. When rotation is first enabled the
+	// configured key pair becomes the current key pair; after that
+	// the configured key pair is ignored.
+	Enabled bool
+
+	// Interval holds the age at which the current key pair is
+	// automatically replaced. If this is zero, key pairs are only
+	// rotated on demand.
+	Interval time.Duration
+
+	// Overlap holds the length of time for which a replaced key pair
+	// continues to be accepted.
+	Overlap time.Duration
+}
+
+// Params holds the parameters for a Ring.
+type Params struct {
+	// Store holds the store in which the key pairs are kept, so that
+	// all servers sharing the store use the same keys. If this is
+	// nil, the ring only ever holds InitialKey and cannot be rotated.
+	Store simplekv.Store
+
+	// InitialKey holds the key pair used when the store does not
+	// yet hold any keys.
+	InitialKey *bakery.KeyPair
+
+	// Location holds the location of the identity server. The ring
+	// acts as a bakery.ThirdPartyLocator for this location.
+	Location string
+
+	// RotationInterval holds the age at which the current key pair
+	// is automatically replaced. If this is zero, key pairs are only
+	// rotated on demand.
+	RotationInterval time.Duration
+
+	// Overlap holds the length of time for which a key pair
+	// continues to be accepted after it has been replaced.
+	Overlap time.Duration
+
+	// RefreshInterval holds the interval between reloading the key
+	// pairs from the store. If this is zero, one minute is used.
+	RefreshInterval time.Duration
+
+	// Now returns the current time. If this is nil, time.Now is
+	// used.
+	Now func() time.Time
+}
+
+// A Key is a key pair held in a Ring.
+type Key struct {
+	// KeyPair holds the key pair.
+	KeyPair *bakery.KeyPair `json:"key"`
+
+	// Created holds the time the key pair was created.
+	Created time.Time `json:"created"`
+
+	// Retired holds the time the key pair was replaced. It is zero
+	// for the current key pair.
+	Retired time.Time `json:"retired,omitempty"`
+}
+
+// A Ring holds the bakery key pairs of the identity server.
+type Ring struct {
+	p Params
+
+	mu   sync.RWMutex
+	keys []Key
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	wg        sync.WaitGroup
+}
+
+// New creates a new Ring.
+func New(ctx context.Context, p Params) (*Ring, error) {
+	if p.InitialKey == nil {
+		return nil, errgo.Newf("no initial key specified")
+	}
+	if p.RefreshInterval == 0 {
+		p.RefreshInterval = defaultRefreshInterval
+	}
+	if p.Now == nil {
+		p.Now = time.Now
+	}
+	r := &Ring{
+		p:      p,
+		closed: make(chan struct{}),
+	}
+	initial := []Key{{
+		KeyPair: p.InitialKey,
+		Created: p.Now(),
+	}}
+	if p.Store == nil {
+		r.keys = initial
+		return r, nil
+	}
+	err := r.update(ctx, func(keys []Key) ([]Key, error) {
+		if len(keys) == 0 {
+			return initial, nil
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return r, nil
+}
+
+// Start starts a goroutine that periodically reloads the key pairs
+// from the store and rotates the current key pair when it reaches
+// the rotation interval. It does nothing if the ring has no store.
+func (r *Ring) Start() {
+	if r.p.Store == nil {
+		return
+	}
+	r.wg.Add(1)
+	go r.run()
+}
+
+// Close stops any goroutine started by Start.
+func (r *Ring) Close() {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+	})
+	r.wg.Wait()
+}
+
+func (r *Ring) run() {
+	defer r.wg.Done()
+	t := time.NewTicker(r.p.RefreshInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-r.closed:
+			return
+		}
+		if err := r.refresh(context.Background()); err != nil {
+			logger.Errorf("cannot refresh keys: %s", err)
+		}
+	}
+}
+
+// refresh reloads the key pairs from the store, rotating the current
+// key pair if it is due.
+func (r *Ring) refresh(ctx context.Context) error {
+	if err := r.load(ctx); err != nil {
+		return errgo.Mask(err)
+	}
+	if r.p.RotationInterval == 0 || r.p.Now().Sub(r.created()) < r.p.RotationInterval {
+		return nil
+	}
+	return r.update(ctx, func(keys []Key) ([]Key, error) {
+		// Another server may have rotated the key since we loaded
+		// it, so check again.
+		if len(keys) > 0 && r.p.Now().Sub(keys[0].Created) < r.p.RotationInterval {
+			return nil, nil
+		}
+		return r.rotate(keys)
+	})
+}
+
+// load reads the key pairs from the store.
+func (r *Ring) load(ctx context.Context) error {
+	data, err := r.p.Store.Get(ctx, storeKey)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var keys []Key
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return errgo.Notef(err, "invalid stored keys")
+	}
+	if len(keys) == 0 {
+		return errgo.Newf("no stored keys")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = keys
+	return nil
+}
+
+// created returns the creation time of the current key pair.
+func (r *Ring) created() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keys[0].Created
+}
+
+// Rotate replaces the current key pair with a newly generated one.
+// The replaced key pair continues to be accepted for the overlap
+// period.
+func (r *Ring) Rotate(ctx context.Context) error {
+	if r.p.Store == nil {
+		return ErrRotationNotEnabled
+	}
+	return errgo.Mask(r.update(ctx, r.rotate))
+}
+
+func (r *Ring) rotate(keys []Key) ([]Key, error) {
+	key, err := bakery.GenerateKey()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	now := r.p.Now()
+	newKeys := []Key{{
+		KeyPair: key,
+		Created: now,
+	}}
+	for i, k := range keys {
+		if i == 0 {
+			k.Retired = now
+		}
+		if now.Sub(k.Retired) <= r.p.Overlap {
+			newKeys = append(newKeys, k)
+		}
+	}
+	logger.Infof("rotated bakery key, new public key %s", key.Public)
+	return newKeys, nil
+}
+
+// update atomically updates the key pairs held in the store. The
+// given function is called with the stored keys; if it returns nil the
+// stored keys are left unchanged. The ring is updated with the
+// resulting keys.
+func (r *Ring) update(ctx context.Context, f func([]Key) ([]Key, error)) error {
+	var keys []Key
+	err := r.p.Store.Update(ctx, storeKey, time.Time{}, func(old []byte) ([]byte, error) {
+		keys = nil
+		if old != nil {
+			if err := json.Unmarshal(old, &keys); err != nil {
+				return nil, errgo.Notef(err, "invalid stored keys")
+			}
+		}
+		newKeys, err := f(keys)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if newKeys == nil {
+			return old, nil
+		}
+		keys = newKeys
+		return json.Marshal(keys)
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = keys
+	return nil
+}
+
+// Current returns the current key pair.
+func (r *Ring) Current() *bakery.KeyPair {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keys[0].KeyPair
+}
+
+// Keys returns all the key pairs that are currently accepted, the
+// current key pair first.
+func (r *Ring) Keys() []Key {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	now := r.p.Now()
+	keys := make([]Key, 0, len(r.keys))
+	for _, k := range r.keys {
+		if k.Retired.IsZero() || now.Sub(k.Retired) <= r.p.Overlap {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// KeyForCaveat returns the key pair that the given encoded third-party
+// caveat was encrypted for. If the caveat was encrypted for a key pair
+// that is not accepted, or cannot be parsed, the current key pair is
+// returned, so that the caller reports the error in the usual way.
+func (r *Ring) KeyForCaveat(caveat []byte) *bakery.KeyPair {
+	keys := r.Keys()
+	if pk, ok := caveatPublicKey(caveat); ok {
+		for _, k := range keys {
+			if bytes.HasPrefix(k.KeyPair.Public.Key[:], pk) {
+				return k.KeyPair
+			}
+		}
+	}
+	return keys[0].KeyPair
+}
+
+// ThirdPartyInfo implements bakery.ThirdPartyLocator by returning the
+// current public key for the identity server's own location.
+func (r *Ring) ThirdPartyInfo(ctx context.Context, loc string) (bakery.ThirdPartyInfo, error) {
+	if loc != r.p.Location {
+		return bakery.ThirdPartyInfo{}, bakery.ErrNotFound
+	}
+	return bakery.ThirdPartyInfo{
+		PublicKey: r.Current().Public,
+		Version:   bakery.LatestVersion,
+	}, nil
+}
+
+// caveatPublicKey returns the public key, or the prefix of the public
+// key, that the given encoded third-party caveat was encrypted for.
+func caveatPublicKey(caveat []byte) ([]byte, bool) {
+	if len(caveat) == 0 {
+		return nil, false
+	}
+	switch caveat[0] {
+	case byte(bakery.Version2), byte(bakery.Version3):
+		// The version is followed by a prefix of the public key.
+		const publicKeyPrefixLen = 4
+		if len(caveat) < 1+publicKeyPrefixLen {
+			return nil, false
+		}
+		return caveat[1 : 1+publicKeyPrefixLen], true
+	case 'e':
+		// A version 1 caveat is a base64 encoded JSON object.
+		data, err := base64.StdEncoding.DecodeString(string(caveat))
+		if err != nil {
+			return nil, false
+		}
+		var cav struct {
+			ThirdPartyPublicKey *bakery.PublicKey
+		}
+		if err := json.Unmarshal(data, &cav); err != nil || cav.ThirdPartyPublicKey == nil {
+			return nil, false
+		}
+		return cav.ThirdPartyPublicKey.Key[:], true
+	}
+	return nil, false
+}
@@ -0,0 +1,161 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package keyring_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/simplekv/memsimplekv"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+
+	"github.com/CanonicalLtd/candid/internal/keyring"
+)
+
+var epoch = time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func TestRingWithoutStore(t *testing.T) {
+	c := qt.New(t)
+	key := bakery.MustGenerateKey()
+	r, err := keyring.New(context.Background(), keyring.Params{
+		InitialKey: key,
+		Location:   "https://candid.example.com",
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r.Current(), qt.Equals, key)
+	c.Assert(r.Keys(), qt.HasLen, 1)
+
+	err = r.Rotate(context.Background())
+	c.Assert(err, qt.Equals, keyring.ErrRotationNotEnabled)
+
+	info, err := r.ThirdPartyInfo(context.Background(), "https://candid.example.com")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(info.PublicKey, qt.Equals, key.Public)
+	_, err = r.ThirdPartyInfo(context.Background(), "https://other.example.com")
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+}
+
+func TestRotate(t *testing.T) {
+	c := qt.New(t)
+	clk := &clock{now: epoch}
+	key := bakery.MustGenerateKey()
+	r, err := keyring.New(context.Background(), keyring.Params{
+		Store:      memsimplekv.NewStore(),
+		InitialKey: key,
+		Overlap:    time.Hour,
+		Now:        clk.Now,
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r.Current(), qt.DeepEquals, key)
+
+	// Create caveats for the initial key in each format.
+	firstParty := bakery.MustGenerateKey()
+	var caveats [][]byte
+	for _, v := range []bakery.Version{bakery.Version1, bakery.Version2, bakery.Version3} {
+		cav, err := bakery.EncodeCaveat("is-authenticated-user", []byte("root key"), bakery.ThirdPartyInfo{
+			PublicKey: key.Public,
+			Version:   v,
+		}, firstParty, checkers.New(nil).Namespace())
+		c.Assert(err, qt.Equals, nil)
+		caveats = append(caveats, cav)
+	}
+
+	clk.now = epoch.Add(time.Minute)
+	err = r.Rotate(context.Background())
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r.Current(), qt.Not(qt.DeepEquals), key)
+	keys := r.Keys()
+	c.Assert(keys, qt.HasLen, 2)
+	c.Assert(keys[0].Created, qt.DeepEquals, epoch.Add(time.Minute))
+	c.Assert(keys[0].Retired.IsZero(), qt.Equals, true)
+	c.Assert(keys[1].KeyPair, qt.DeepEquals, key)
+	c.Assert(keys[1].Retired, qt.DeepEquals, epoch.Add(time.Minute))
+
+	// Caveats for the old key are matched to it during the overlap.
+	for _, cav := range caveats {
+		c.Assert(r.KeyForCaveat(cav), qt.DeepEquals, key)
+	}
+	// Unrecognised caveats use the current key.
+	c.Assert(r.KeyForCaveat([]byte("bad caveat")), qt.DeepEquals, r.Current())
+
+	// After the overlap, the old key is no longer accepted.
+	clk.now = epoch.Add(2 * time.Hour)
+	c.Assert(r.Keys(), qt.HasLen, 1)
+	for _, cav := range caveats {
+		c.Assert(r.KeyForCaveat(cav), qt.DeepEquals, r.Current())
+	}
+
+	// The old key is removed from the store on the next rotation.
+	err = r.Rotate(context.Background())
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r.Keys(), qt.HasLen, 2)
+}
+
+func TestSharedStore(t *testing.T) {
+	c := qt.New(t)
+	store := memsimplekv.NewStore()
+	r1, err := keyring.New(context.Background(), keyring.Params{
+		Store:      store,
+		InitialKey: bakery.MustGenerateKey(),
+		Overlap:    time.Hour,
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = r1.Rotate(context.Background())
+	c.Assert(err, qt.Equals, nil)
+
+	// A new ring using the same store ignores its initial key.
+	r2, err := keyring.New(context.Background(), keyring.Params{
+		Store:      store,
+		InitialKey: bakery.MustGenerateKey(),
+		Overlap:    time.Hour,
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r2.Current(), qt.DeepEquals, r1.Current())
+
+	// Rotations made by one ring are seen by the other when it
+	// refreshes.
+	err = r2.Rotate(context.Background())
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r1.Current(), qt.Not(qt.DeepEquals), r2.Current())
+	err = keyring.Refresh(r1)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r1.Current(), qt.DeepEquals, r2.Current())
+	c.Assert(r1.Keys(), qt.HasLen, 3)
+}
+
+func TestScheduledRotation(t *testing.T) {
+	c := qt.New(t)
+	clk := &clock{now: epoch}
+	key := bakery.MustGenerateKey()
+	r, err := keyring.New(context.Background(), keyring.Params{
+		Store:            memsimplekv.NewStore(),
+		InitialKey:       key,
+		RotationInterval: 24 * time.Hour,
+		Overlap:          time.Hour,
+		Now:              clk.Now,
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	clk.now = epoch.Add(23 * time.Hour)
+	err = keyring.Refresh(r)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r.Current(), qt.DeepEquals, key)
+
+	clk.now = epoch.Add(24 * time.Hour)
+	err = keyring.Refresh(r)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r.Current(), qt.Not(qt.DeepEquals), key)
+	c.Assert(r.Keys(), qt.HasLen, 2)
+}
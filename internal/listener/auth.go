@@ -0,0 +1,86 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package listener
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/internal/auth"
+	"github.com/CanonicalLtd/candid/internal/logging"
+)
+
+// AuthParams holds the authentication methods that a listener accepts
+// in addition to those used by the public API.
+type AuthParams struct {
+	// BearerTokens maps the hex encoded SHA-256 hashes of bearer
+	// tokens to the usernames that they authenticate.
+	BearerTokens map[string]string
+
+	// ClientCertUsers maps the common names of verified client
+	// certificates to the usernames that they authenticate.
+	ClientCertUsers map[string]string
+}
+
+// Authenticate returns a handler that authenticates requests that hold
+// a bearer token or a verified client certificate known to p, and serves
+// them with h as the user they authenticate. A request with an unknown
+// bearer token is rejected. Other requests are served by h unchanged,
+// so they may still authenticate in the usual ways.
+func Authenticate(h http.Handler, p AuthParams) http.Handler {
+	if len(p.BearerTokens) == 0 && len(p.ClientCertUsers) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		username, ok := p.username(req)
+		if !ok {
+			logging.FromContext(req.Context(), logger).Infof("invalid bearer token from %s", req.RemoteAddr)
+			httprequest.WriteJSON(w, http.StatusUnauthorized, params.Error{
+				Code:    params.ErrUnauthorized,
+				Message: "invalid bearer token",
+			})
+			return
+		}
+		if username != "" {
+			ctx := auth.ContextWithUsername(req.Context(), username)
+			ctx = logging.ContextWithUser(ctx, username)
+			logging.FromContext(ctx, logger).Debugf("authenticated by listener")
+			req = req.WithContext(ctx)
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// username returns the user authenticated by the given request, or ""
+// if it is not authenticated by p. It returns false if the request
+// holds a bearer token that is not known.
+func (p AuthParams) username(req *http.Request) (string, bool) {
+	if len(p.BearerTokens) > 0 {
+		if token := bearerToken(req); token != "" {
+			sum := sha256.Sum256([]byte(token))
+			username, ok := p.BearerTokens[hex.EncodeToString(sum[:])]
+			return username, ok
+		}
+	}
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		return p.ClientCertUsers[req.TLS.VerifiedChains[0][0].Subject.CommonName], true
+	}
+	return "", true
+}
+
+// bearerToken returns the bearer token held in the Authorization
+// header of the given request, if any.
+func bearerToken(req *http.Request) string {
+	const prefix = "bearer "
+	h := req.Header.Get("Authorization")
+	if len(h) <= len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(h[len(prefix):])
+}
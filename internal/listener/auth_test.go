@@ -0,0 +1,112 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package listener_test
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/internal/listener"
+	"github.com/CanonicalLtd/candid/internal/logging"
+)
+
+var authenticateTests = []struct {
+	about        string
+	token        string
+	clientCN     string
+	expectStatus int
+	expectUser   string
+}{{
+	about:        "no credentials",
+	expectStatus: http.StatusOK,
+}, {
+	about:        "bearer token",
+	token:        "Bearer s3cret",
+	expectStatus: http.StatusOK,
+	expectUser:   "admin@candid",
+}, {
+	about:        "lower case scheme",
+	token:        "bearer s3cret",
+	expectStatus: http.StatusOK,
+	expectUser:   "admin@candid",
+}, {
+	about:        "unknown bearer token",
+	token:        "Bearer wrong",
+	expectStatus: http.StatusUnauthorized,
+}, {
+	about:        "other authorization scheme",
+	token:        "Basic YWRtaW46cGFzc3dvcmQ=",
+	expectStatus: http.StatusOK,
+}, {
+	about:        "client certificate",
+	clientCN:     "ops",
+	expectStatus: http.StatusOK,
+	expectUser:   "bob@candid",
+}, {
+	about:        "unknown client certificate",
+	clientCN:     "other",
+	expectStatus: http.StatusOK,
+}, {
+	about:        "bearer token takes precedence",
+	token:        "Bearer s3cret",
+	clientCN:     "ops",
+	expectStatus: http.StatusOK,
+	expectUser:   "admin@candid",
+}}
+
+func TestAuthenticate(t *testing.T) {
+	c := qt.New(t)
+	sum := sha256.Sum256([]byte("s3cret"))
+	var user string
+	h := listener.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user = logging.UserFromContext(req.Context())
+	}), listener.AuthParams{
+		BearerTokens: map[string]string{
+			hex.EncodeToString(sum[:]): "admin@candid",
+		},
+		ClientCertUsers: map[string]string{
+			"ops": "bob@candid",
+		},
+	})
+	for _, test := range authenticateTests {
+		c.Run(test.about, func(c *qt.C) {
+			user = ""
+			req := httptest.NewRequest("GET", "/v1/whoami", nil)
+			if test.token != "" {
+				req.Header.Set("Authorization", test.token)
+			}
+			if test.clientCN != "" {
+				cert := &x509.Certificate{
+					Subject: pkix.Name{CommonName: test.clientCN},
+				}
+				req.TLS = &tls.ConnectionState{
+					PeerCertificates: []*x509.Certificate{cert},
+					VerifiedChains:   [][]*x509.Certificate{{cert}},
+				}
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			c.Assert(rr.Code, qt.Equals, test.expectStatus)
+			c.Assert(user, qt.Equals, test.expectUser)
+		})
+	}
+}
+
+func TestAuthenticateWithoutParams(t *testing.T) {
+	c := qt.New(t)
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer anything")
+	rr := httptest.NewRecorder()
+	listener.Authenticate(h, listener.AuthParams{}).ServeHTTP(rr, req)
+	c.Assert(rr.Code, qt.Equals, http.StatusOK)
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package listener divides the paths served by Candid between several
+// listeners, so that, for example, the admin and metrics endpoints can
+// be served only on an internal interface.
+package listener
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/juju/loggo"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/httprequest.v1"
+)
+
+var logger = loggo.GetLogger("candid.internal.listener")
+
+// APIName is the name of the listener that serves the public API. It
+// is the name used to find its socket when candidsrv is started by
+// systemd socket activation.
+const APIName = "api"
+
+// Only returns a handler that serves requests for paths that have any
+// of the given prefixes with h. Requests for other paths are not found.
+// Any tenant path prefix is removed from the path before it is matched,
+// so that each tenant's paths are divided between the listeners in the
+// same way as those of the default server.
+func Only(h http.Handler, prefixes, tenantPrefixes []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !HasPrefix(TrimTenant(req.URL.Path, tenantPrefixes), prefixes) {
+			notFound(w, req)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// Except returns a handler that serves requests with h, except for
+// requests for paths that have any of the given prefixes, which are not
+// found. As with Only, any tenant path prefix is removed from the path
+// before it is matched. If there are no prefixes h is returned.
+func Except(h http.Handler, prefixes, tenantPrefixes []string) http.Handler {
+	if len(prefixes) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if HasPrefix(TrimTenant(req.URL.Path, tenantPrefixes), prefixes) {
+			notFound(w, req)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// TrimTenant returns the given path with the first of the given tenant
+// path prefixes that it has removed, in the same way that the tenant
+// handler removes it before passing the request to the tenant's server.
+func TrimTenant(path string, tenantPrefixes []string) string {
+	for _, p := range tenantPrefixes {
+		if path == p {
+			return "/"
+		}
+		if strings.HasPrefix(path, p+"/") {
+			return strings.TrimPrefix(path, p)
+		}
+	}
+	return path
+}
+
+// HasPrefix reports whether the given path has any of the given
+// prefixes. A prefix only matches whole path elements, so "/debug"
+// matches "/debug" and "/debug/info" but not "/debugger".
+func HasPrefix(path string, prefixes []string) bool {
+	for _, p := range prefixes {
+		p = strings.TrimSuffix(p, "/")
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func notFound(w http.ResponseWriter, req *http.Request) {
+	httprequest.WriteJSON(w, http.StatusNotFound, params.Error{
+		Code:    params.ErrNotFound,
+		Message: "not found: " + req.URL.Path,
+	})
+}
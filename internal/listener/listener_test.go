@@ -0,0 +1,148 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package listener_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid"
+	"github.com/CanonicalLtd/candid/internal/listener"
+)
+
+var hasPrefixTests = []struct {
+	path   string
+	expect bool
+}{{
+	path:   "/metrics",
+	expect: true,
+}, {
+	path:   "/debug",
+	expect: true,
+}, {
+	path:   "/debug/pprof/heap",
+	expect: true,
+}, {
+	path:   "/debugger",
+	expect: false,
+}, {
+	path:   "/v1/whoami",
+	expect: false,
+}, {
+	path:   "/",
+	expect: false,
+}}
+
+func TestHasPrefix(t *testing.T) {
+	c := qt.New(t)
+	prefixes := []string{"/metrics", "/debug/"}
+	for _, test := range hasPrefixTests {
+		c.Check(listener.HasPrefix(test.path, prefixes), qt.Equals, test.expect, qt.Commentf("%s", test.path))
+	}
+}
+
+func TestOnlyAndExcept(t *testing.T) {
+	c := qt.New(t)
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	prefixes := []string{"/metrics"}
+
+	only := listener.Only(h, prefixes, nil)
+	except := listener.Except(h, prefixes, nil)
+	for _, test := range []struct {
+		path         string
+		expectOnly   int
+		expectExcept int
+	}{{
+		path:         "/metrics",
+		expectOnly:   http.StatusOK,
+		expectExcept: http.StatusNotFound,
+	}, {
+		path:         "/v1/whoami",
+		expectOnly:   http.StatusNotFound,
+		expectExcept: http.StatusOK,
+	}} {
+		rr := httptest.NewRecorder()
+		only.ServeHTTP(rr, httptest.NewRequest("GET", test.path, nil))
+		c.Check(rr.Code, qt.Equals, test.expectOnly, qt.Commentf("only %s", test.path))
+		rr = httptest.NewRecorder()
+		except.ServeHTTP(rr, httptest.NewRequest("GET", test.path, nil))
+		c.Check(rr.Code, qt.Equals, test.expectExcept, qt.Commentf("except %s", test.path))
+	}
+}
+
+func TestOnlyAndExceptWithTenants(t *testing.T) {
+	c := qt.New(t)
+	th := candid.NewTenantHandler(testHandler("default"), []candid.Tenant{{
+		Name:       "acme",
+		PathPrefix: "/acme",
+		Handler:    testHandler("acme"),
+	}})
+	prefixes := []string{"/admin", "/debug"}
+	tenantPrefixes := []string{"/acme"}
+
+	public := listener.Except(th, prefixes, tenantPrefixes)
+	internal := listener.Only(th, prefixes, tenantPrefixes)
+	for _, test := range []struct {
+		path           string
+		expectPublic   string
+		expectInternal string
+	}{{
+		path:           "/v1/whoami",
+		expectPublic:   "default",
+		expectInternal: "",
+	}, {
+		path:           "/debug/pprof/heap",
+		expectPublic:   "",
+		expectInternal: "default",
+	}, {
+		path:           "/acme/v1/whoami",
+		expectPublic:   "acme",
+		expectInternal: "",
+	}, {
+		path:           "/acme/debug/pprof/heap",
+		expectPublic:   "",
+		expectInternal: "acme",
+	}, {
+		path:           "/acme/admin",
+		expectPublic:   "",
+		expectInternal: "acme",
+	}, {
+		path:           "/acmeco/debug",
+		expectPublic:   "default",
+		expectInternal: "",
+	}} {
+		c.Check(serve(public, test.path), qt.Equals, test.expectPublic, qt.Commentf("public %s", test.path))
+		c.Check(serve(internal, test.path), qt.Equals, test.expectInternal, qt.Commentf("internal %s", test.path))
+	}
+}
+
+// serve serves a GET request for the given path with h and returns the
+// name of the testHandler that served it, or "" if the path was not
+// found.
+func serve(h http.Handler, path string) string {
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+	if rr.Code == http.StatusNotFound {
+		return ""
+	}
+	return rr.Body.String()
+}
+
+// testHandler is a candid.HandlerCloser that writes its name in the
+// response.
+type testHandler string
+
+func (h testHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte(h))
+}
+
+func (testHandler) Shutdown(context.Context) error {
+	return nil
+}
+
+func (testHandler) Close() {}
@@ -0,0 +1,275 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package logging provides structured logging on top of loggo. Log
+// messages can be annotated with fields, such as the ID of the request
+// being processed and the identity making it, so that the log entries
+// for a single request can be correlated across server replicas.
+//
+// Fields are appended to the message in logfmt format, after a " | "
+// separator, so they remain readable with the standard loggo writer.
+// The writer returned by NewJSONWriter separates them out again into
+// JSON object members.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/juju/loggo"
+)
+
+// Standard field names.
+const (
+	RequestIDField = "request-id"
+	UserField      = "user"
+	CountryField   = "country"
+)
+
+// fieldSeparator separates the message from the fields in a log
+// entry.
+const fieldSeparator = " | "
+
+// A Field is a single key-value annotation on a log message.
+type Field struct {
+	Key   string
+	Value string
+}
+
+// A Logger logs messages, annotated with a set of fields, to an
+// underlying loggo.Logger.
+type Logger struct {
+	logger loggo.Logger
+	fields []Field
+}
+
+// New returns a Logger that logs to the given loggo.Logger with no
+// fields.
+func New(logger loggo.Logger) Logger {
+	return Logger{logger: logger}
+}
+
+// FromContext returns a Logger that logs to the given loggo.Logger
+// with fields for the request ID, identity and client country
+// associated with the given context, if any.
+func FromContext(ctx context.Context, logger loggo.Logger) Logger {
+	l := New(logger)
+	if id := RequestIDFromContext(ctx); id != "" {
+		l = l.With(RequestIDField, id)
+	}
+	if u := UserFromContext(ctx); u != "" {
+		l = l.With(UserField, u)
+	}
+	if c := CountryFromContext(ctx); c != "" {
+		l = l.With(CountryField, c)
+	}
+	return l
+}
+
+// With returns a Logger that adds the given field to all messages.
+func (l Logger) With(key, value string) Logger {
+	fields := make([]Field, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	l.fields = append(fields, Field{Key: key, Value: value})
+	return l
+}
+
+// Criticalf logs a message at the CRITICAL level.
+func (l Logger) Criticalf(format string, args ...interface{}) {
+	l.logf(loggo.CRITICAL, format, args)
+}
+
+// Errorf logs a message at the ERROR level.
+func (l Logger) Errorf(format string, args ...interface{}) {
+	l.logf(loggo.ERROR, format, args)
+}
+
+// Warningf logs a message at the WARNING level.
+func (l Logger) Warningf(format string, args ...interface{}) {
+	l.logf(loggo.WARNING, format, args)
+}
+
+// Infof logs a message at the INFO level.
+func (l Logger) Infof(format string, args ...interface{}) {
+	l.logf(loggo.INFO, format, args)
+}
+
+// Debugf logs a message at the DEBUG level.
+func (l Logger) Debugf(format string, args ...interface{}) {
+	l.logf(loggo.DEBUG, format, args)
+}
+
+// Tracef logs a message at the TRACE level.
+func (l Logger) Tracef(format string, args ...interface{}) {
+	l.logf(loggo.TRACE, format, args)
+}
+
+func (l Logger) logf(level loggo.Level, format string, args []interface{}) {
+	if !l.logger.IsLevelEnabled(level) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if len(l.fields) > 0 {
+		msg += fieldSeparator + formatFields(l.fields)
+	}
+	// The call depth skips logf and the exported method so that
+	// the location of the caller is logged.
+	l.logger.LogCallf(2, level, "%s", msg)
+}
+
+// formatFields formats the given fields in logfmt format.
+func formatFields(fields []Field) string {
+	var buf strings.Builder
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(f.Key)
+		buf.WriteByte('=')
+		if needsQuote(f.Value) {
+			buf.WriteString(strconv.Quote(f.Value))
+		} else {
+			buf.WriteString(f.Value)
+		}
+	}
+	return buf.String()
+}
+
+func needsQuote(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '=' || r == '"' || r == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+// splitFields splits a logged message into the original message and
+// its fields. If the message does not end in a valid set of fields
+// then it is returned unchanged.
+func splitFields(msg string) (string, []Field) {
+	i := strings.LastIndex(msg, fieldSeparator)
+	if i < 0 {
+		return msg, nil
+	}
+	fields, ok := parseFields(msg[i+len(fieldSeparator):])
+	if !ok {
+		return msg, nil
+	}
+	return msg[:i], fields
+}
+
+// parseFields parses fields formatted by formatFields.
+func parseFields(s string) ([]Field, bool) {
+	var fields []Field
+	for s != "" {
+		i := strings.IndexByte(s, '=')
+		if i <= 0 || strings.ContainsAny(s[:i], " \"") {
+			return nil, false
+		}
+		f := Field{Key: s[:i]}
+		s = s[i+1:]
+		if strings.HasPrefix(s, `"`) {
+			v, err := strconv.QuotedPrefix(s)
+			if err != nil {
+				return nil, false
+			}
+			f.Value, _ = strconv.Unquote(v)
+			s = s[len(v):]
+		} else {
+			i := strings.IndexByte(s, ' ')
+			if i < 0 {
+				i = len(s)
+			}
+			f.Value = s[:i]
+			s = s[i:]
+		}
+		fields = append(fields, f)
+		if s == "" {
+			break
+		}
+		if s[0] != ' ' {
+			return nil, false
+		}
+		s = s[1:]
+	}
+	return fields, len(fields) > 0
+}
+
+type requestIDKey struct{}
+
+// ContextWithRequestID returns a context associated with the given
+// request ID.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID associated with the
+// given context, or "" if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+type userKey struct{}
+
+// ContextWithUser returns a context associated with the given
+// username, which is logged as the user making the request.
+func ContextWithUser(ctx context.Context, username string) context.Context {
+	return context.WithValue(ctx, userKey{}, username)
+}
+
+// UserFromContext returns the username associated with the given
+// context, or "" if there is none.
+func UserFromContext(ctx context.Context) string {
+	u, _ := ctx.Value(userKey{}).(string)
+	return u
+}
+
+type countryKey struct{}
+
+// ContextWithCountry returns a context associated with the given
+// country code, which is logged as the country of the client making the
+// request.
+func ContextWithCountry(ctx context.Context, country string) context.Context {
+	return context.WithValue(ctx, countryKey{}, country)
+}
+
+// CountryFromContext returns the country code associated with the
+// given context, or "" if there is none.
+func CountryFromContext(ctx context.Context) string {
+	c, _ := ctx.Value(countryKey{}).(string)
+	return c
+}
+
+// NewRequestID returns a new random request ID.
+func NewRequestID() string {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		// This should never happen, but a missing request ID
+		// should not stop a request being processed.
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
+
+// ValidRequestID reports whether the given request ID, usually
+// provided by a client or proxy, is acceptable for logging.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		if r <= ' ' || r > '~' || r == '"' || r == '=' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/loggo"
+
+	"github.com/CanonicalLtd/candid/internal/logging"
+)
+
+func TestFromContext(t *testing.T) {
+	c := qt.New(t)
+	logger, w := newLogger(c)
+	ctx := logging.ContextWithRequestID(context.Background(), "abc123")
+	ctx = logging.ContextWithUser(ctx, "bob")
+	ctx = logging.ContextWithCountry(ctx, "GB")
+	logging.FromContext(ctx, logger).Infof("hello %s", "world")
+	logs := w.Log()
+	c.Assert(logs, qt.HasLen, 1)
+	c.Assert(logs[0].Message, qt.Equals, "hello world | request-id=abc123 user=bob country=GB")
+	c.Assert(logs[0].Level, qt.Equals, loggo.INFO)
+	c.Assert(logs[0].Filename, qt.Matches, `.*logging_test\.go`)
+}
+
+func TestFromContextNoFields(t *testing.T) {
+	c := qt.New(t)
+	logger, w := newLogger(c)
+	logging.FromContext(context.Background(), logger).Errorf("hello")
+	logs := w.Log()
+	c.Assert(logs, qt.HasLen, 1)
+	c.Assert(logs[0].Message, qt.Equals, "hello")
+}
+
+func TestWithQuotesValues(t *testing.T) {
+	c := qt.New(t)
+	logger, w := newLogger(c)
+	l := logging.New(logger).With("a", "x y").With("b", "")
+	l.With("c", "z").Warningf("msg")
+	l.Warningf("msg")
+	logs := w.Log()
+	c.Assert(logs, qt.HasLen, 2)
+	c.Assert(logs[0].Message, qt.Equals, `msg | a="x y" b="" c=z`)
+	c.Assert(logs[1].Message, qt.Equals, `msg | a="x y" b=""`)
+}
+
+func TestLevelDisabled(t *testing.T) {
+	c := qt.New(t)
+	logger, w := newLogger(c)
+	logger.SetLogLevel(loggo.INFO)
+	logging.New(logger).Debugf("hidden")
+	c.Assert(w.Log(), qt.HasLen, 0)
+}
+
+var jsonWriterTests = []struct {
+	about   string
+	message string
+	expect  map[string]string
+}{{
+	about:   "no fields",
+	message: "hello",
+	expect: map[string]string{
+		"message": "hello",
+	},
+}, {
+	about:   "fields",
+	message: `hello | request-id=abc123 user="bob smith"`,
+	expect: map[string]string{
+		"message":    "hello",
+		"request-id": "abc123",
+		"user":       "bob smith",
+	},
+}, {
+	about:   "not fields",
+	message: "a | b",
+	expect: map[string]string{
+		"message": "a | b",
+	},
+}, {
+	about:   "invalid quoting",
+	message: `a | b="c`,
+	expect: map[string]string{
+		"message": `a | b="c`,
+	},
+}}
+
+func TestJSONWriter(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range jsonWriterTests {
+		c.Run(test.about, func(c *qt.C) {
+			var buf bytes.Buffer
+			w := logging.NewJSONWriter(&buf)
+			w.Write(loggo.Entry{
+				Level:    loggo.WARNING,
+				Module:   "candid.test",
+				Filename: "/src/candid/test.go",
+				Line:     42,
+				Message:  test.message,
+			})
+			var obj map[string]string
+			err := json.Unmarshal(buf.Bytes(), &obj)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(obj["level"], qt.Equals, "WARNING")
+			c.Assert(obj["module"], qt.Equals, "candid.test")
+			c.Assert(obj["location"], qt.Equals, "test.go:42")
+			delete(obj, "level")
+			delete(obj, "module")
+			delete(obj, "location")
+			delete(obj, "time")
+			c.Assert(obj, qt.DeepEquals, test.expect)
+		})
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(logging.ValidRequestID(logging.NewRequestID()), qt.Equals, true)
+	c.Assert(logging.ValidRequestID("0f1e-2d3c"), qt.Equals, true)
+	c.Assert(logging.ValidRequestID(""), qt.Equals, false)
+	c.Assert(logging.ValidRequestID("a b"), qt.Equals, false)
+	c.Assert(logging.ValidRequestID("a\nb"), qt.Equals, false)
+	c.Assert(logging.ValidRequestID(string(make([]byte, 129))), qt.Equals, false)
+}
+
+func newLogger(c *qt.C) (loggo.Logger, *loggo.TestWriter) {
+	ctx := loggo.NewContext(loggo.TRACE)
+	w := new(loggo.TestWriter)
+	err := ctx.AddWriter("test", w)
+	c.Assert(err, qt.Equals, nil)
+	return ctx.GetLogger("candid.test"), w
+}
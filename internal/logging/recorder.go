@@ -0,0 +1,95 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package logging
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+)
+
+// A RecordedEntry is a log entry held by a Recorder.
+type RecordedEntry struct {
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level"`
+	Module  string            `json:"module"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// A Recorder is a loggo.Writer that holds the most recent entries
+// logged to a module, and its sub-modules, in memory.
+type Recorder struct {
+	module string
+
+	mu      sync.Mutex
+	entries []RecordedEntry
+	next    int
+	full    bool
+}
+
+// NewRecorder returns a Recorder that holds at most size of the most
+// recent entries logged to the given module.
+func NewRecorder(module string, size int) *Recorder {
+	return &Recorder{
+		module:  module,
+		entries: make([]RecordedEntry, size),
+	}
+}
+
+// Write implements loggo.Writer.Write.
+func (r *Recorder) Write(entry loggo.Entry) {
+	if entry.Module != r.module && !strings.HasPrefix(entry.Module, r.module+".") {
+		return
+	}
+	if len(r.entries) == 0 {
+		return
+	}
+	msg, fields := splitFields(entry.Message)
+	e := RecordedEntry{
+		Time:    entry.Timestamp.UTC(),
+		Level:   entry.Level.String(),
+		Module:  entry.Module,
+		Message: msg,
+	}
+	if len(fields) > 0 {
+		e.Fields = make(map[string]string, len(fields))
+		for _, f := range fields {
+			e.Fields[f.Key] = f.Value
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[r.next] = e
+	r.next++
+	if r.next == len(r.entries) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// Entries returns at most limit of the recorded entries, most recent
+// first. If limit is 0 all recorded entries are returned.
+func (r *Recorder) Entries(limit int) []RecordedEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := r.next
+	if r.full {
+		n = len(r.entries)
+	}
+	if limit > 0 && limit < n {
+		n = limit
+	}
+	entries := make([]RecordedEntry, n)
+	for i := range entries {
+		j := r.next - 1 - i
+		if j < 0 {
+			j += len(r.entries)
+		}
+		entries[i] = r.entries[j]
+	}
+	return entries
+}
@@ -0,0 +1,39 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package logging_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/loggo"
+
+	"github.com/CanonicalLtd/candid/internal/logging"
+)
+
+func TestRecorder(t *testing.T) {
+	c := qt.New(t)
+	r := logging.NewRecorder("candid.audit", 2)
+	r.Write(loggo.Entry{Level: loggo.INFO, Module: "candid.audit", Message: "one"})
+	r.Write(loggo.Entry{Level: loggo.INFO, Module: "candid.other", Message: "ignored"})
+	r.Write(loggo.Entry{Level: loggo.INFO, Module: "candid.audit.sub", Message: "two | user=bob"})
+
+	entries := r.Entries(0)
+	c.Assert(entries, qt.HasLen, 2)
+	c.Assert(entries[0].Message, qt.Equals, "two")
+	c.Assert(entries[0].Module, qt.Equals, "candid.audit.sub")
+	c.Assert(entries[0].Fields, qt.DeepEquals, map[string]string{"user": "bob"})
+	c.Assert(entries[1].Message, qt.Equals, "one")
+
+	r.Write(loggo.Entry{Level: loggo.WARNING, Module: "candid.audit", Message: "three"})
+	entries = r.Entries(0)
+	c.Assert(entries, qt.HasLen, 2)
+	c.Assert(entries[0].Message, qt.Equals, "three")
+	c.Assert(entries[0].Level, qt.Equals, "WARNING")
+	c.Assert(entries[1].Message, qt.Equals, "two")
+
+	entries = r.Entries(1)
+	c.Assert(entries, qt.HasLen, 1)
+	c.Assert(entries[0].Message, qt.Equals, "three")
+}
@@ -0,0 +1,68 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+	"gopkg.in/errgo.v1"
+)
+
+// NewJSONWriter returns a loggo.Writer that writes each log entry to w
+// as a single line JSON object. Any fields added to the message by a
+// Logger are written as separate members of the object.
+func NewJSONWriter(w io.Writer) loggo.Writer {
+	return &jsonWriter{w: w}
+}
+
+type jsonWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Write implements loggo.Writer.Write.
+func (w *jsonWriter) Write(entry loggo.Entry) {
+	msg, fields := splitFields(entry.Message)
+	obj := make(map[string]string, len(fields)+5)
+	for _, f := range fields {
+		obj[f.Key] = f.Value
+	}
+	obj["time"] = entry.Timestamp.UTC().Format(time.RFC3339Nano)
+	obj["level"] = entry.Level.String()
+	obj["module"] = entry.Module
+	obj["location"] = fmt.Sprintf("%s:%d", filepath.Base(entry.Filename), entry.Line)
+	obj["message"] = msg
+	data, err := json.Marshal(obj)
+	if err != nil {
+		// This cannot happen as all the values are strings.
+		return
+	}
+	data = append(data, '\n')
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.w.Write(data)
+}
+
+// SetDefaultWriter replaces loggo's default writer with one that writes
+// to w in the given format, which must be "text" or "json". If format
+// is empty, "text" is used.
+func SetDefaultWriter(format string, w io.Writer) error {
+	var lw loggo.Writer
+	switch format {
+	case "", "text":
+		lw = loggo.NewSimpleWriter(w, loggo.DefaultFormatter)
+	case "json":
+		lw = NewJSONWriter(w)
+	default:
+		return errgo.Newf("unknown log format %q", format)
+	}
+	_, err := loggo.ReplaceDefaultWriter(lw)
+	return errgo.Mask(err)
+}
@@ -0,0 +1,231 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package logout sends back-channel logout notifications to registered
+// relying services, as described in OpenID Connect Back-Channel Logout
+// 1.0, so that sessions that the services have derived from Candid
+// discharges can be ended promptly. Each notification is a POST
+// request holding a logout token, a JSON Web Token signed with the
+// identity server's token signing key.
+package logout
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/juju/loggo"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/internal/jwt"
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/internal/services"
+	"github.com/CanonicalLtd/candid/internal/sessions"
+)
+
+var logger = loggo.GetLogger("candid.internal.logout")
+
+// EventType is the type of the event held in logout tokens.
+const EventType = "http://schemas.openid.net/event/backchannel-logout"
+
+const (
+	// tokenLifetime holds the lifetime of logout tokens.
+	tokenLifetime = 2 * time.Minute
+
+	// notifyTimeout holds the maximum time allowed to send a
+	// notification.
+	notifyTimeout = 30 * time.Second
+)
+
+// Params holds the parameters of a Notifier.
+type Params struct {
+	// Location holds the URL of the identity server, which is the
+	// issuer of logout tokens.
+	Location string
+
+	// Issuer holds the issuer used to sign logout tokens.
+	Issuer *jwt.Issuer
+
+	// Services holds the registered relying services.
+	Services *services.Store
+
+	// Client holds the HTTP client used to send notifications. If
+	// it is nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// An Event describes the end of one or more sessions of a user.
+type Event struct {
+	// Username holds the username of the user whose sessions have
+	// ended.
+	Username string
+
+	// SessionID holds the ID of the session that has ended. If it
+	// is empty all the user's sessions with the service have ended.
+	SessionID string
+}
+
+// A Notifier sends logout notifications to registered relying
+// services.
+type Notifier struct {
+	p Params
+}
+
+// New returns a new Notifier with the given parameters.
+func New(p Params) *Notifier {
+	if p.Client == nil {
+		p.Client = http.DefaultClient
+	}
+	return &Notifier{p: p}
+}
+
+// JWK returns the public key that services use to verify logout
+// tokens.
+func (n *Notifier) JWK() jwt.JWK {
+	return n.p.Issuer.JWK()
+}
+
+// SessionEnded notifies the registered service for which the given
+// session of the user with the given username was created that the
+// session has ended. The session's service may be recorded as the name
+// of a registered service, one of its origins, the host of one of its
+// origins or its public key. Notifications are sent in the background
+// and failures are logged.
+func (n *Notifier) SessionEnded(ctx context.Context, username string, session sessions.Session) {
+	if n == nil || session.Service == "" {
+		return
+	}
+	n.notify(ctx, func(svc services.Service) bool {
+		return matchesSession(svc, session.Service)
+	}, Event{
+		Username:  username,
+		SessionID: session.ID,
+	})
+}
+
+// AccessRevoked notifies the registered services with the given public
+// key that the access of the user with the given username has been
+// revoked, so that all the user's sessions with them should end.
+// Notifications are sent in the background and failures are logged.
+func (n *Notifier) AccessRevoked(ctx context.Context, username, publicKey string) {
+	if n == nil || publicKey == "" {
+		return
+	}
+	n.notify(ctx, func(svc services.Service) bool {
+		return svc.PublicKey != nil && svc.PublicKey.String() == publicKey
+	}, Event{
+		Username: username,
+	})
+}
+
+// notify sends the given event to all the registered services with a
+// logout URI for which match returns true.
+func (n *Notifier) notify(ctx context.Context, match func(services.Service) bool, ev Event) {
+	svcs, err := n.p.Services.List(ctx)
+	if err != nil {
+		logging.FromContext(ctx, logger).Errorf("cannot list services: %s", err)
+		return
+	}
+	for _, svc := range svcs {
+		if svc.LogoutURI == "" || !match(svc) {
+			continue
+		}
+		go func(svc services.Service) {
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+			if err := n.Send(ctx, svc, ev); err != nil {
+				logger.Errorf("cannot send logout notification to service %q: %s", svc.Name, err)
+			}
+		}(svc)
+	}
+}
+
+// Send sends a logout notification for the given event to the given
+// service's logout URI.
+func (n *Notifier) Send(ctx context.Context, svc services.Service, ev Event) error {
+	token, err := n.Token(svc, ev)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req, err := http.NewRequest("POST", svc.LogoutURI, strings.NewReader(url.Values{
+		"logout_token": {token},
+	}.Encode()))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := n.p.Client.Do(req)
+	if err != nil {
+		return errgo.Notef(err, "cannot post to logout URI")
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errgo.Newf("logout URI returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Token returns a signed logout token for the given event, addressed
+// to the given service.
+func (n *Notifier) Token(svc services.Service, ev Event) (string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": n.p.Location,
+		"sub": ev.Username,
+		"aud": svc.Name,
+		"iat": now.Unix(),
+		"exp": now.Add(tokenLifetime).Unix(),
+		"jti": jti,
+		"events": map[string]interface{}{
+			EventType: map[string]interface{}{},
+		},
+	}
+	if ev.SessionID != "" {
+		claims["sid"] = ev.SessionID
+	}
+	token, err := n.p.Issuer.Sign(claims)
+	if err != nil {
+		return "", errgo.Notef(err, "cannot sign logout token")
+	}
+	return token, nil
+}
+
+// matchesSession reports whether the given service is the one recorded
+// as the service of a session.
+func matchesSession(svc services.Service, service string) bool {
+	if svc.Name == service {
+		return true
+	}
+	if svc.PublicKey != nil && svc.PublicKey.String() == service {
+		return true
+	}
+	for _, o := range svc.Origins {
+		if strings.EqualFold(o, service) {
+			return true
+		}
+		if u, err := url.Parse(o); err == nil && strings.EqualFold(u.Host, service) {
+			return true
+		}
+	}
+	return false
+}
+
+func newTokenID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return fmt.Sprintf("%x", buf), nil
+}
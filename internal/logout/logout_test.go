@@ -0,0 +1,175 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package logout_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/simplekv/memsimplekv"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/candid/internal/jwt"
+	"github.com/CanonicalLtd/candid/internal/logout"
+	"github.com/CanonicalLtd/candid/internal/services"
+	"github.com/CanonicalLtd/candid/internal/sessions"
+)
+
+func TestToken(t *testing.T) {
+	c := qt.New(t)
+	n, _ := newNotifier(c)
+	tok, err := n.Token(services.Service{Name: "dashboard"}, logout.Event{
+		Username:  "bob",
+		SessionID: "session-1",
+	})
+	c.Assert(err, qt.Equals, nil)
+	claims := tokenClaims(c, tok)
+	c.Assert(claims["iss"], qt.Equals, "https://candid.example.com")
+	c.Assert(claims["aud"], qt.Equals, "dashboard")
+	c.Assert(claims["sub"], qt.Equals, "bob")
+	c.Assert(claims["sid"], qt.Equals, "session-1")
+	c.Assert(claims["jti"], qt.Not(qt.Equals), "")
+	c.Assert(claims["events"], qt.DeepEquals, map[string]interface{}{
+		logout.EventType: map[string]interface{}{},
+	})
+
+	tok, err = n.Token(services.Service{Name: "dashboard"}, logout.Event{
+		Username: "bob",
+	})
+	c.Assert(err, qt.Equals, nil)
+	_, ok := tokenClaims(c, tok)["sid"]
+	c.Assert(ok, qt.Equals, false)
+}
+
+func TestSendError(t *testing.T) {
+	c := qt.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	n, _ := newNotifier(c)
+	err := n.Send(context.Background(), services.Service{
+		Name:      "dashboard",
+		LogoutURI: srv.URL,
+	}, logout.Event{
+		Username: "bob",
+	})
+	c.Assert(err, qt.ErrorMatches, `logout URI returned 400 Bad Request`)
+}
+
+func TestSessionEnded(t *testing.T) {
+	c := qt.New(t)
+	tokens := make(chan string, 2)
+	srv := newLogoutServer(c, tokens)
+	n, svcs := newNotifier(c)
+	ctx := context.Background()
+	err := svcs.Set(ctx, services.Service{
+		Name:      "dashboard",
+		Origins:   []string{"https://dashboard.example.com"},
+		LogoutURI: srv.URL,
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = svcs.Set(ctx, services.Service{
+		Name:      "other",
+		Origins:   []string{"https://other.example.com"},
+		LogoutURI: srv.URL,
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	n.SessionEnded(ctx, "bob", sessions.Session{
+		ID:      "session-1",
+		Service: "dashboard.example.com",
+	})
+	claims := tokenClaims(c, receive(c, tokens))
+	c.Assert(claims["aud"], qt.Equals, "dashboard")
+	c.Assert(claims["sid"], qt.Equals, "session-1")
+
+	// Sessions without a registered service are not notified.
+	n.SessionEnded(ctx, "bob", sessions.Session{
+		ID:      "session-2",
+		Service: "unknown.example.com",
+	})
+	select {
+	case tok := <-tokens:
+		c.Fatalf("unexpected logout token %q", tok)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestAccessRevoked(t *testing.T) {
+	c := qt.New(t)
+	tokens := make(chan string, 1)
+	srv := newLogoutServer(c, tokens)
+	n, svcs := newNotifier(c)
+	ctx := context.Background()
+	key := bakery.MustGenerateKey()
+	err := svcs.Set(ctx, services.Service{
+		Name:      "dashboard",
+		PublicKey: &key.Public,
+		LogoutURI: srv.URL,
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	n.AccessRevoked(ctx, "bob", key.Public.String())
+	claims := tokenClaims(c, receive(c, tokens))
+	c.Assert(claims["aud"], qt.Equals, "dashboard")
+	c.Assert(claims["sub"], qt.Equals, "bob")
+}
+
+func TestNilNotifier(t *testing.T) {
+	var n *logout.Notifier
+	n.SessionEnded(context.Background(), "bob", sessions.Session{ID: "session-1", Service: "dashboard"})
+	n.AccessRevoked(context.Background(), "bob", "key")
+}
+
+func newNotifier(c *qt.C) (*logout.Notifier, *services.Store) {
+	issuer, err := jwt.NewIssuer(context.Background(), memsimplekv.NewStore())
+	c.Assert(err, qt.Equals, nil)
+	svcs := services.NewStore(memsimplekv.NewStore())
+	return logout.New(logout.Params{
+		Location: "https://candid.example.com",
+		Issuer:   issuer,
+		Services: svcs,
+	}), svcs
+}
+
+// newLogoutServer starts a server that sends the logout tokens posted
+// to it on the given channel.
+func newLogoutServer(c *qt.C, tokens chan<- string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.Method, qt.Equals, "POST")
+		c.Check(req.Header.Get("Content-Type"), qt.Equals, "application/x-www-form-urlencoded")
+		tokens <- req.PostFormValue("logout_token")
+	}))
+	c.Defer(srv.Close)
+	return srv
+}
+
+func receive(c *qt.C, tokens <-chan string) string {
+	select {
+	case tok := <-tokens:
+		return tok
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for logout notification")
+	}
+	panic("unreachable")
+}
+
+func tokenClaims(c *qt.C, tok string) map[string]interface{} {
+	parts := strings.Split(tok, ".")
+	c.Assert(parts, qt.HasLen, 3)
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	c.Assert(err, qt.Equals, nil)
+	var claims map[string]interface{}
+	err = json.Unmarshal(data, &claims)
+	c.Assert(err, qt.Equals, nil)
+	return claims
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package mongotest provides temporary MongoDB databases for use in
+// tests.
+package mongotest
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	errgo "gopkg.in/errgo.v1"
+)
+
+// ErrDisabled is returned by New when MongoDB testing has been disabled
+// by setting the MGOTESTDISABLE environment variable.
+var ErrDisabled = errgo.New("MongoDB testing is disabled")
+
+// Database holds a temporary database.
+type Database struct {
+	*mongo.Database
+
+	// URI holds the connection URI used to connect to the
+	// database's server.
+	URI string
+
+	client *mongo.Client
+}
+
+// New connects to the MongoDB server specified by the
+// MGOCONNECTIONSTRING environment variable (default "localhost") and
+// returns a newly created database with a random name. The database
+// should be removed after use by calling Close.
+//
+// If the MGOTESTDISABLE environment variable is set to a non-empty
+// value, New returns ErrDisabled.
+func New() (*Database, error) {
+	if os.Getenv("MGOTESTDISABLE") != "" {
+		return nil, ErrDisabled
+	}
+	uri := os.Getenv("MGOCONNECTIONSTRING")
+	if uri == "" {
+		uri = "localhost"
+	}
+	if !strings.HasPrefix(uri, "mongodb://") && !strings.HasPrefix(uri, "mongodb+srv://") {
+		uri = "mongodb://" + uri
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot connect to %q", uri)
+	}
+	if err := client.Ping(ctx, readpref.Primary()); err != nil {
+		client.Disconnect(context.Background())
+		return nil, errgo.Notef(err, "cannot connect to %q", uri)
+	}
+	return &Database{
+		Database: client.Database(randomName()),
+		URI:      uri,
+		client:   client,
+	}, nil
+}
+
+// Close drops the database and disconnects from the server.
+func (db *Database) Close() {
+	ctx := context.Background()
+	db.Drop(ctx)
+	db.client.Disconnect(ctx)
+}
+
+func randomName() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("mongotest-%x", buf)
+}
@@ -0,0 +1,58 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package monitoring
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CanaryMetrics records the results of the synthetic checks performed
+// by the canary monitor.
+type CanaryMetrics struct {
+	checks      *prometheus.CounterVec
+	duration    *prometheus.HistogramVec
+	lastSuccess *prometheus.GaugeVec
+}
+
+// NewCanaryMetrics creates a new CanaryMetrics.
+func NewCanaryMetrics() *CanaryMetrics {
+	return &CanaryMetrics{
+		checks: registerCollector(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "candid",
+			Subsystem: "canary",
+			Name:      "checks_total",
+			Help:      "The number of synthetic login checks performed.",
+		}, []string{"check", "result"})).(*prometheus.CounterVec),
+		duration: registerCollector(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "candid",
+			Subsystem: "canary",
+			Name:      "check_duration_seconds",
+			Help:      "The time taken to perform a synthetic login check.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"check"})).(*prometheus.HistogramVec),
+		lastSuccess: registerCollector(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "candid",
+			Subsystem: "canary",
+			Name:      "last_success_timestamp_seconds",
+			Help:      "The time of the last successful synthetic login check.",
+		}, []string{"check"})).(*prometheus.GaugeVec),
+	}
+}
+
+// CheckCompleted records the result of a check with the given name
+// that was started at the given time. If err is nil the check is
+// considered successful.
+func (m *CanaryMetrics) CheckCompleted(check string, startTime time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.checks.WithLabelValues(check, result).Inc()
+	m.duration.WithLabelValues(check).Observe(float64(time.Since(startTime)) / float64(time.Second))
+	if err == nil {
+		m.lastSuccess.WithLabelValues(check).Set(float64(time.Now().UnixNano()) / float64(time.Second))
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package monitoring
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// ProtocolLegacy is the protocol label of requests made with
+	// the legacy visit-wait interaction protocol.
+	ProtocolLegacy = "legacy"
+
+	// ProtocolCurrent is the protocol label of requests made with
+	// the current interaction protocol.
+	ProtocolCurrent = "current"
+)
+
+// InteractionMetrics records which interaction protocols clients use to
+// log in.
+type InteractionMetrics struct {
+	requests *prometheus.CounterVec
+}
+
+// NewInteractionMetrics creates a new InteractionMetrics. Requests are
+// counted in the candid_discharger_interaction_requests_total counter,
+// labelled with the protocol and the kind of request.
+func NewInteractionMetrics() *InteractionMetrics {
+	return &InteractionMetrics{
+		requests: registerCollector(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "candid",
+			Subsystem: "discharger",
+			Name:      "interaction_requests_total",
+			Help:      "The number of interaction requests by protocol.",
+		}, []string{"protocol", "request"})).(*prometheus.CounterVec),
+	}
+}
+
+// Request records a request of the given kind made with the given
+// protocol, either ProtocolLegacy or ProtocolCurrent. Requests are
+// recorded even if they are rejected, so that the use of a disabled
+// protocol can be seen.
+func (m *InteractionMetrics) Request(protocol, request string) {
+	if m == nil {
+		return
+	}
+	m.requests.WithLabelValues(protocol, request).Inc()
+}
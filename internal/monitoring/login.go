@@ -0,0 +1,93 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package monitoring
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The outcomes of login attempts recorded by LoginMetrics.LoginCompleted.
+const (
+	// LoginSuccess is the outcome of a login in which the identity
+	// provider authenticated the user.
+	LoginSuccess = "success"
+
+	// LoginUserCancel is the outcome of a login that the user
+	// cancelled at the identity provider.
+	LoginUserCancel = "user-cancel"
+
+	// LoginPolicyDenied is the outcome of a login in which the user
+	// authenticated but was refused by policy, for example because
+	// they are not a member of an allowed group.
+	LoginPolicyDenied = "policy-denied"
+
+	// LoginUpstreamError is the outcome of a login that failed for
+	// any other reason, usually an error from the identity provider
+	// or the upstream service that it uses.
+	LoginUpstreamError = "upstream-error"
+)
+
+// LoginMetrics records the interactive logins made by users.
+type LoginMetrics struct {
+	logins   *prometheus.CounterVec
+	attempts *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+// NewLoginMetrics creates a new LoginMetrics. Logins are counted in the
+// candid_discharger_logins_total counter, labelled with the country of
+// the client. Login attempts are counted in the
+// candid_discharger_idp_logins_total counter and timed in the
+// candid_discharger_idp_login_duration_seconds histogram, both
+// labelled with the name of the identity provider and the outcome of
+// the attempt.
+func NewLoginMetrics() *LoginMetrics {
+	return &LoginMetrics{
+		logins: registerCollector(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "candid",
+			Subsystem: "discharger",
+			Name:      "logins_total",
+			Help:      "The number of logins by client country.",
+		}, []string{"country"})).(*prometheus.CounterVec),
+		attempts: registerCollector(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "candid",
+			Subsystem: "discharger",
+			Name:      "idp_logins_total",
+			Help:      "The number of login attempts by identity provider and outcome.",
+		}, []string{"idp", "outcome"})).(*prometheus.CounterVec),
+		duration: registerCollector(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "candid",
+			Subsystem: "discharger",
+			Name:      "idp_login_duration_seconds",
+			Help:      "The time taken to complete a login attempt by identity provider and outcome.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"idp", "outcome"})).(*prometheus.HistogramVec),
+	}
+}
+
+// Login records a login from the given country. Logins from unknown
+// countries are recorded with the country "unknown".
+func (m *LoginMetrics) Login(country string) {
+	if m == nil {
+		return
+	}
+	if country == "" {
+		country = "unknown"
+	}
+	m.logins.WithLabelValues(country).Inc()
+}
+
+// LoginCompleted records the outcome of a login attempt with the
+// identity provider with the given name, which started at the given
+// time. The outcome should be one of LoginSuccess, LoginUserCancel,
+// LoginPolicyDenied or LoginUpstreamError.
+func (m *LoginMetrics) LoginCompleted(idp, outcome string, startTime time.Time) {
+	if m == nil {
+		return
+	}
+	m.attempts.WithLabelValues(idp, outcome).Inc()
+	m.duration.WithLabelValues(idp, outcome).Observe(float64(time.Since(startTime)) / float64(time.Second))
+}
@@ -1,52 +1,136 @@
 package monitoring
 
 import (
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// DefaultMeetingCompletedBuckets holds the default buckets, in
+// microseconds, used for the histogram of rendezvous completion times.
+var DefaultMeetingCompletedBuckets = []float64{1e5, 5e5, 1e6, 2.5e6, 5e6, 1e7, 3e7, 6e7, 1.2e8, 3e8, 6e8}
+
 type MeetingMetrics struct {
-	meetingCompleted prometheus.Summary
-	meetingsExpired  prometheus.Counter
+	meetingCompleted          prometheus.Summary
+	meetingCompletedHistogram prometheus.Histogram
+	meetingsExpired           prometheus.Counter
+	meetingsAbandoned         prometheus.Counter
 }
 
-func NewMeetingMetrics() *MeetingMetrics {
-	meetingCompleted := prometheus.NewSummary(prometheus.SummaryOpts{
+// NewMeetingMetrics creates a new MeetingMetrics. The time taken to
+// complete each rendezvous is recorded, in microseconds, both in the
+// candid_rendevous_meetings_completed_times summary and in the
+// candid_rendevous_meetings_completed_microseconds histogram with the
+// given buckets. If no buckets are specified then
+// DefaultMeetingCompletedBuckets will be used.
+func NewMeetingMetrics(buckets []float64) *MeetingMetrics {
+	if len(buckets) == 0 {
+		buckets = DefaultMeetingCompletedBuckets
+	}
+	meetingCompleted := registerCollector(prometheus.NewSummary(prometheus.SummaryOpts{
+		Namespace:  "candid",
+		Subsystem:  "rendevous",
+		Name:       "meetings_completed_times",
+		Help:       "The time between rendevous creation and its completion.",
+		Objectives: summaryObjectives,
+	})).(prometheus.Summary)
+	opts := prometheus.HistogramOpts{
 		Namespace: "candid",
 		Subsystem: "rendevous",
-		Name:      "meetings_completed_times",
+		Name:      "meetings_completed_microseconds",
 		Help:      "The time between rendevous creation and its completion.",
-	})
-	mustRegisterPrometheusCollector(meetingCompleted)
-	meetingsExpired := prometheus.NewCounter(prometheus.CounterOpts{
+		Buckets:   buckets,
+	}
+	checkBuckets(opts)
+	meetingCompletedHistogram := registerCollector(prometheus.NewHistogram(opts)).(prometheus.Histogram)
+	meetingsExpired := registerCollector(prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "candid",
 		Subsystem: "rendevous",
 		Name:      "meetings_expired_count",
 		Help:      "Count of rendevous which were never completed.",
-	})
-	mustRegisterPrometheusCollector(meetingsExpired)
+	})).(prometheus.Counter)
+	meetingsAbandoned := registerCollector(prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "candid",
+		Subsystem: "rendevous",
+		Name:      "meetings_abandoned_count",
+		Help:      "Count of rendevous which were removed after the server holding them stopped.",
+	})).(prometheus.Counter)
 	return &MeetingMetrics{
-		meetingCompleted: meetingCompleted,
-		meetingsExpired:  meetingsExpired,
+		meetingCompleted:          meetingCompleted,
+		meetingCompletedHistogram: meetingCompletedHistogram,
+		meetingsExpired:           meetingsExpired,
+		meetingsAbandoned:         meetingsAbandoned,
 	}
 }
 
-func mustRegisterPrometheusCollector(c prometheus.Collector) {
+// summaryObjectives holds the quantiles recorded by summaries. Newer
+// versions of the prometheus client no longer record any quantiles by
+// default, these are the quantiles that were previously recorded.
+var summaryObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+
+// registerCollector registers the given collector with the default
+// prometheus registerer. If an equivalent collector has already been
+// registered then the existing collector is returned so that all
+// observations are recorded in the same place. Histograms should be
+// checked with checkBuckets before being registered, as the existing
+// collector may have been created with different buckets.
+func registerCollector(c prometheus.Collector) prometheus.Collector {
 	err := prometheus.DefaultRegisterer.Register(c)
 	if err == nil {
-		return
+		return c
 	}
-	if _, ok := err.(prometheus.AlreadyRegisteredError); ok {
-		return
+	if err, ok := err.(prometheus.AlreadyRegisteredError); ok {
+		return err.ExistingCollector
 	}
 	panic(err)
 }
 
+var (
+	bucketsMu         sync.Mutex
+	registeredBuckets = make(map[string][]float64)
+)
+
+// checkBuckets records the buckets of the histogram with the given
+// options. If a histogram with the same name has previously been
+// created with different buckets then a warning is logged, because
+// registerCollector will continue to use the original histogram.
+func checkBuckets(opts prometheus.HistogramOpts) {
+	name := prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name)
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+	old, ok := registeredBuckets[name]
+	if !ok {
+		registeredBuckets[name] = opts.Buckets
+		return
+	}
+	if !equalBuckets(old, opts.Buckets) {
+		logger.Warningf("histogram %s already registered with buckets %v; ignoring new buckets %v", name, old, opts.Buckets)
+	}
+}
+
+func equalBuckets(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func (m *MeetingMetrics) RequestCompleted(startTime time.Time) {
-	m.meetingCompleted.Observe(float64(time.Since(startTime)) / float64(time.Microsecond))
+	d := float64(time.Since(startTime)) / float64(time.Microsecond)
+	m.meetingCompleted.Observe(d)
+	m.meetingCompletedHistogram.Observe(d)
 }
 
 func (m *MeetingMetrics) RequestsExpired(count int) {
 	m.meetingsExpired.Add(float64(count))
 }
+
+func (m *MeetingMetrics) RequestsAbandoned(count int) {
+	m.meetingsAbandoned.Add(float64(count))
+}
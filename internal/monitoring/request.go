@@ -8,33 +8,90 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/internal/logging"
 )
 
-var (
-	requestDuration = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+// DefaultRequestDurationBuckets holds the default buckets, in seconds,
+// used for the histogram of web request durations.
+var DefaultRequestDurationBuckets = []float64{.0005, .001, .0025, .005, .0075, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// RequestMetrics records metrics about web requests.
+type RequestMetrics struct {
+	requestDuration          *prometheus.SummaryVec
+	requestDurationHistogram *prometheus.HistogramVec
+	exemplars                bool
+}
+
+// NewRequestMetrics creates a new RequestMetrics. The duration of each
+// request is recorded, in seconds, both in the
+// candid_handler_request_duration summary and in the
+// candid_handler_request_duration_seconds histogram with the given
+// buckets. If no buckets are specified then
+// DefaultRequestDurationBuckets will be used. If exemplars is true then
+// each observation in the histogram is recorded with the ID of the
+// request as an exemplar.
+func NewRequestMetrics(buckets []float64, exemplars bool) *RequestMetrics {
+	if len(buckets) == 0 {
+		buckets = DefaultRequestDurationBuckets
+	}
+	requestDuration := registerCollector(prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Namespace:  "candid",
+		Subsystem:  "handler",
+		Name:       "request_duration",
+		Help:       "The duration of a web request.",
+		Objectives: summaryObjectives,
+	}, []string{"path_pattern"})).(*prometheus.SummaryVec)
+	opts := prometheus.HistogramOpts{
 		Namespace: "candid",
 		Subsystem: "handler",
-		Name:      "request_duration",
+		Name:      "request_duration_seconds",
 		Help:      "The duration of a web request.",
-	}, []string{"path_pattern"})
-)
-
-func init() {
-	prometheus.MustRegister(requestDuration)
+		Buckets:   buckets,
+	}
+	checkBuckets(opts)
+	requestDurationHistogram := registerCollector(prometheus.NewHistogramVec(opts, []string{"path_pattern"})).(*prometheus.HistogramVec)
+	return &RequestMetrics{
+		requestDuration:          requestDuration,
+		requestDurationHistogram: requestDurationHistogram,
+		exemplars:                exemplars,
+	}
 }
 
 type Request struct {
 	startTime time.Time
 	params    *httprequest.Params
+	metrics   *RequestMetrics
 }
 
-func NewRequest(p *httprequest.Params) Request {
+// NewRequest starts recording metrics for the request with the given
+// parameters.
+func (m *RequestMetrics) NewRequest(p *httprequest.Params) Request {
 	return Request{
 		startTime: time.Now(),
 		params:    p,
+		metrics:   m,
 	}
 }
 
 func (r Request) ObserveMetric() {
-	requestDuration.WithLabelValues(r.params.PathPattern).Observe(float64(time.Since(r.startTime)) / float64(time.Second))
+	if r.metrics == nil {
+		return
+	}
+	d := float64(time.Since(r.startTime)) / float64(time.Second)
+	r.metrics.requestDuration.WithLabelValues(r.params.PathPattern).Observe(d)
+	h := r.metrics.requestDurationHistogram.WithLabelValues(r.params.PathPattern)
+	if r.metrics.exemplars {
+		if id := logging.RequestIDFromContext(r.params.Context); id != "" && len(requestIDLabel)+len(id) <= prometheus.ExemplarMaxRunes {
+			h.(prometheus.ExemplarObserver).ObserveWithExemplar(d, prometheus.Labels{requestIDLabel: id})
+			return
+		}
+	}
+	h.Observe(d)
 }
+
+// requestIDLabel holds the name of the exemplar label that holds the
+// request ID. Request IDs are ASCII, so an exemplar is valid as long as
+// the length of the label name and the ID together is no more than
+// prometheus.ExemplarMaxRunes.
+const requestIDLabel = "request_id"
@@ -0,0 +1,539 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package policy holds the authorization policies that restrict which
+// users may obtain discharges for each relying service, and when and
+// where they may do so.
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+)
+
+// StoreName is the name of the provider data key-value store that
+// holds the policies.
+const StoreName = "_policies"
+
+// policiesKey is the key under which all policies are stored. The
+// number of policies is expected to be small, so they are kept
+// together in order that they can be listed.
+const policiesKey = "policies"
+
+var (
+	// ErrNotFound is the error cause returned when a policy does
+	// not exist.
+	ErrNotFound = errgo.New("policy not found")
+
+	// ErrDenied is the error cause returned from Check when a user
+	// is not allowed a discharge by a policy.
+	ErrDenied = errgo.New("discharge denied by policy")
+)
+
+// A StepUpRequiredError is returned as the error cause from Check when
+// a user must log in again with a stronger identity provider, usually
+// one that requires multi-factor authentication, before they are
+// allowed a discharge.
+type StepUpRequiredError struct {
+	// IdentityProvider holds the name of the identity provider
+	// that the user must log in with.
+	IdentityProvider string
+}
+
+// Error implements error.
+func (e *StepUpRequiredError) Error() string {
+	return fmt.Sprintf("login with identity provider %q required", e.IdentityProvider)
+}
+
+// A Policy restricts discharges for a relying service to members of a
+// set of groups, and may further restrict when and where those
+// discharges can be obtained and used.
+type Policy struct {
+	// Name holds the name of the policy.
+	Name string `json:"name"`
+
+	// PublicKey holds the public key of the relying service that
+	// the policy applies to, as used in the third-party caveats it
+	// creates. If this is nil the policy applies to relying
+	// services with any public key.
+	PublicKey *bakery.PublicKey `json:"public-key,omitempty"`
+
+	// Origin holds the origin of discharge requests that the policy
+	// applies to. If this is empty the policy applies to requests
+	// from any origin.
+	Origin string `json:"origin,omitempty"`
+
+	// Groups holds the groups whose members are allowed to obtain
+	// discharges. A username may also be given to allow that user.
+	// If this is empty any user may obtain a discharge, subject to
+	// the policy's restrictions.
+	Groups []string `json:"groups,omitempty"`
+
+	// Restrictions holds further restrictions on the discharges.
+	Restrictions []Restriction `json:"restrictions,omitempty"`
+}
+
+// A Restriction limits the times at which, and the network addresses
+// and countries from which, members of a set of groups may obtain and
+// use discharges. Discharges are only given inside the restriction and
+// caveats are added to them, where possible, so that they cannot be
+// used outside it.
+type Restriction struct {
+	// Groups holds the groups whose members are restricted. If
+	// this is empty all users are restricted.
+	Groups []string `json:"groups,omitempty"`
+
+	// Hours holds the daily time window in which discharges are
+	// valid, if any.
+	Hours *Hours `json:"hours,omitempty"`
+
+	// Networks holds the CIDRs of the networks that discharges may
+	// be obtained and used from, for example an office or VPN range.
+	// If this is empty discharges may be used from any address.
+	Networks []string `json:"networks,omitempty"`
+
+	// Countries holds the ISO 3166-1 alpha-2 codes of the countries
+	// that discharges may be obtained from. If this is empty
+	// discharges may be obtained from any country. Countries are
+	// only known when a GeoIP database has been configured.
+	Countries []string `json:"countries,omitempty"`
+
+	// DenyCountries holds the codes of the countries that
+	// discharges may not be obtained from.
+	DenyCountries []string `json:"deny-countries,omitempty"`
+
+	// StepUpCountries holds the codes of the countries that
+	// discharges may only be obtained from by users that logged in
+	// with StepUpIdentityProvider.
+	StepUpCountries []string `json:"step-up-countries,omitempty"`
+
+	// StepUpIdentityProvider holds the name of the identity
+	// provider, usually one that requires multi-factor
+	// authentication, that users must log in with to obtain
+	// discharges from the StepUpCountries.
+	StepUpIdentityProvider string `json:"step-up-identity-provider,omitempty"`
+}
+
+// Hours holds a daily time window.
+type Hours struct {
+	// From and Until hold the start and end of the window as HH:MM.
+	// If Until is earlier than From the window spans midnight.
+	From  string `json:"from"`
+	Until string `json:"until"`
+
+	// TimeZone holds the name of the time zone of the window, for
+	// example "Europe/London". If this is empty UTC is used.
+	TimeZone string `json:"time-zone,omitempty"`
+}
+
+// Validate checks that the policy is well formed.
+func (p Policy) Validate() error {
+	if p.Name == "" {
+		return errgo.Newf("policy name not specified")
+	}
+	if p.PublicKey == nil && p.Origin == "" {
+		return errgo.Newf("policy must specify public-key or origin")
+	}
+	if len(p.Groups) == 0 && len(p.Restrictions) == 0 {
+		return errgo.Newf("policy must specify groups or restrictions")
+	}
+	for _, r := range p.Restrictions {
+		if err := r.validate(); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+func (r Restriction) validate() error {
+	if r.Hours == nil && len(r.Networks) == 0 && len(r.Countries) == 0 && len(r.DenyCountries) == 0 && len(r.StepUpCountries) == 0 {
+		return errgo.Newf("restriction must specify hours, networks or countries")
+	}
+	if r.Hours != nil {
+		if _, _, err := r.Hours.parse(); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	for _, n := range r.Networks {
+		if _, _, err := net.ParseCIDR(n); err != nil {
+			return errgo.Newf("invalid network %q", n)
+		}
+	}
+	for _, cs := range [][]string{r.Countries, r.DenyCountries, r.StepUpCountries} {
+		for _, c := range cs {
+			if !validCountry(c) {
+				return errgo.Newf("invalid country %q", c)
+			}
+		}
+	}
+	if len(r.StepUpCountries) > 0 && r.StepUpIdentityProvider == "" {
+		return errgo.Newf("restriction with step-up-countries must specify step-up-identity-provider")
+	}
+	return nil
+}
+
+// validCountry reports whether the given string is an ISO 3166-1
+// alpha-2 country code.
+func validCountry(c string) bool {
+	if len(c) != 2 {
+		return false
+	}
+	for _, r := range c {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches reports whether the policy applies to discharges for the
+// relying service with the given public key requested from the given
+// origin.
+func (p Policy) Matches(pk bakery.PublicKey, origin string) bool {
+	if p.PublicKey != nil && *p.PublicKey != pk {
+		return false
+	}
+	if p.Origin != "" && p.Origin != origin {
+		return false
+	}
+	return true
+}
+
+// Store stores policies. It wraps a KeyValueStore.
+type Store struct {
+	store simplekv.Store
+}
+
+// NewStore creates a new Store using the given KeyValueStore for
+// backing storage.
+func NewStore(store simplekv.Store) *Store {
+	return &Store{store: store}
+}
+
+// List returns all policies, ordered by name.
+func (s *Store) List(ctx context.Context) ([]Policy, error) {
+	v, err := s.store.Get(ctx, policiesKey)
+	if err != nil {
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			return nil, nil
+		}
+		return nil, errgo.Mask(err)
+	}
+	ps, err := unmarshal(v)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return sorted(ps), nil
+}
+
+// Get returns the policy with the given name. If there is no such
+// policy an error with a cause of ErrNotFound is returned.
+func (s *Store) Get(ctx context.Context, name string) (Policy, error) {
+	ps, err := s.List(ctx)
+	if err != nil {
+		return Policy{}, errgo.Mask(err)
+	}
+	for _, p := range ps {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return Policy{}, errgo.WithCausef(nil, ErrNotFound, "policy %q not found", name)
+}
+
+// Set creates or replaces the given policy.
+func (s *Store) Set(ctx context.Context, p Policy) error {
+	if err := p.Validate(); err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(s.update(ctx, func(ps map[string]Policy) error {
+		ps[p.Name] = p
+		return nil
+	}), errgo.Any)
+}
+
+// Remove removes the policy with the given name. If there is no such
+// policy an error with a cause of ErrNotFound is returned.
+func (s *Store) Remove(ctx context.Context, name string) error {
+	return errgo.Mask(s.update(ctx, func(ps map[string]Policy) error {
+		if _, ok := ps[name]; !ok {
+			return errgo.WithCausef(nil, ErrNotFound, "policy %q not found", name)
+		}
+		delete(ps, name)
+		return nil
+	}), errgo.Is(ErrNotFound))
+}
+
+// A Request holds the details of a discharge request that are checked
+// against the policies.
+type Request struct {
+	// PublicKey holds the public key of the relying service.
+	PublicKey bakery.PublicKey
+
+	// Origin holds the origin of the request.
+	Origin string
+
+	// Username holds the username of the user that is to be given
+	// the discharge.
+	Username string
+
+	// Groups is called to find the groups of the user. It is only
+	// called if a policy matches.
+	Groups func() ([]string, error)
+
+	// ClientIP holds the IP address of the client making the
+	// request, if known.
+	ClientIP net.IP
+
+	// Country holds the country code of the client making the
+	// request, if known.
+	Country string
+
+	// IdentityProvider is called to find the name of the identity
+	// provider the user logged in with. It is only called if the
+	// request is from one of the StepUpCountries of a restriction.
+	IdentityProvider func() (string, error)
+
+	// Time holds the time of the request.
+	Time time.Time
+}
+
+// Check checks that the given request is allowed a discharge. The user
+// must be a member of one of the groups of every matching policy and
+// must be inside every restriction of those policies that applies to
+// them. The returned caveats should be added to the discharge so that
+// it cannot be used outside the restrictions. If the request is not
+// allowed a discharge an error with a cause of ErrDenied is returned.
+// If the user must log in again with a different identity provider the
+// error cause is a *StepUpRequiredError.
+func (s *Store) Check(ctx context.Context, req Request) ([]checkers.Caveat, error) {
+	ps, err := s.List(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var member map[string]bool
+	var caveats []checkers.Caveat
+	for _, p := range ps {
+		if !p.Matches(req.PublicKey, req.Origin) {
+			continue
+		}
+		if member == nil {
+			gs, err := req.Groups()
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			member = map[string]bool{req.Username: true}
+			for _, g := range gs {
+				member[g] = true
+			}
+		}
+		if len(p.Groups) > 0 && !isMember(member, p.Groups) {
+			return nil, errgo.WithCausef(nil, ErrDenied, "user %q is not allowed a discharge by policy %q", req.Username, p.Name)
+		}
+		for _, r := range p.Restrictions {
+			if len(r.Groups) > 0 && !isMember(member, r.Groups) {
+				continue
+			}
+			cavs, err := r.check(req)
+			if err != nil {
+				return nil, errgo.NoteMask(err, fmt.Sprintf("user %q is not allowed a discharge by policy %q", req.Username, p.Name), errgo.Is(ErrDenied), isStepUpRequired)
+			}
+			caveats = append(caveats, cavs...)
+		}
+	}
+	return caveats, nil
+}
+
+// check checks that the given request is inside the restriction and
+// returns the caveats that keep discharges inside it.
+func (r Restriction) check(req Request) ([]checkers.Caveat, error) {
+	var caveats []checkers.Caveat
+	if len(r.Networks) > 0 {
+		if req.ClientIP == nil {
+			return nil, errgo.WithCausef(nil, ErrDenied, "client address unknown")
+		}
+		allowed := false
+		for _, n := range r.Networks {
+			_, ipnet, err := net.ParseCIDR(n)
+			if err == nil && ipnet.Contains(req.ClientIP) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, errgo.WithCausef(nil, ErrDenied, "address %s not allowed", req.ClientIP)
+		}
+		caveats = append(caveats, httpbakery.ClientIPAddrCaveat(req.ClientIP))
+	}
+	if len(r.Countries) > 0 {
+		if req.Country == "" {
+			return nil, errgo.WithCausef(nil, ErrDenied, "client country unknown")
+		}
+		if !contains(r.Countries, req.Country) {
+			return nil, errgo.WithCausef(nil, ErrDenied, "country %s not allowed", req.Country)
+		}
+	}
+	if contains(r.DenyCountries, req.Country) {
+		return nil, errgo.WithCausef(nil, ErrDenied, "country %s not allowed", req.Country)
+	}
+	if contains(r.StepUpCountries, req.Country) {
+		idp, err := req.IdentityProvider()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if idp != r.StepUpIdentityProvider {
+			return nil, errgo.WithCausef(nil, &StepUpRequiredError{
+				IdentityProvider: r.StepUpIdentityProvider,
+			}, "login from %s requires identity provider %q", req.Country, r.StepUpIdentityProvider)
+		}
+	}
+	if r.Hours != nil {
+		end, ok, err := r.Hours.end(req.Time)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if !ok {
+			return nil, errgo.WithCausef(nil, ErrDenied, "outside permitted hours %s-%s", r.Hours.From, r.Hours.Until)
+		}
+		caveats = append(caveats, checkers.TimeBeforeCaveat(end))
+	}
+	return caveats, nil
+}
+
+// end reports whether the given time is inside the window and, if so,
+// returns the time at which the window ends.
+func (h *Hours) end(t time.Time) (time.Time, bool, error) {
+	from, until, err := h.parse()
+	if err != nil {
+		return time.Time{}, false, errgo.Mask(err)
+	}
+	loc := time.UTC
+	if h.TimeZone != "" {
+		loc, err = time.LoadLocation(h.TimeZone)
+		if err != nil {
+			return time.Time{}, false, errgo.Mask(err)
+		}
+	}
+	t = t.In(loc)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	now := t.Sub(midnight)
+	switch {
+	case from <= until && now >= from && now < until:
+		return midnight.Add(until), true, nil
+	case from > until && now >= from:
+		return midnight.AddDate(0, 0, 1).Add(until), true, nil
+	case from > until && now < until:
+		return midnight.Add(until), true, nil
+	}
+	return time.Time{}, false, nil
+}
+
+// parse returns the start and end of the window as durations since
+// midnight.
+func (h *Hours) parse() (from, until time.Duration, err error) {
+	if h.TimeZone != "" {
+		if _, err := time.LoadLocation(h.TimeZone); err != nil {
+			return 0, 0, errgo.Newf("invalid time-zone %q", h.TimeZone)
+		}
+	}
+	from, err = parseTimeOfDay(h.From)
+	if err != nil {
+		return 0, 0, errgo.Mask(err)
+	}
+	until, err = parseTimeOfDay(h.Until)
+	if err != nil {
+		return 0, 0, errgo.Mask(err)
+	}
+	if from == until {
+		return 0, 0, errgo.Newf("empty hours %s-%s", h.From, h.Until)
+	}
+	return from, until, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errgo.Newf("invalid time %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func isMember(member map[string]bool, groups []string) bool {
+	for _, g := range groups {
+		if member[g] {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Store) update(ctx context.Context, f func(map[string]Policy) error) error {
+	var ferr error
+	err := s.store.Update(ctx, policiesKey, time.Time{}, func(old []byte) ([]byte, error) {
+		ps := make(map[string]Policy)
+		if len(old) > 0 {
+			var err error
+			ps, err = unmarshal(old)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
+		ferr = f(ps)
+		if ferr != nil {
+			return nil, ferr
+		}
+		return json.Marshal(ps)
+	})
+	if ferr != nil {
+		return ferr
+	}
+	return errgo.Mask(err)
+}
+
+func unmarshal(v []byte) (map[string]Policy, error) {
+	ps := make(map[string]Policy)
+	if err := json.Unmarshal(v, &ps); err != nil {
+		return nil, errgo.Notef(err, "invalid policies")
+	}
+	return ps, nil
+}
+
+func sorted(ps map[string]Policy) []Policy {
+	l := make([]Policy, 0, len(ps))
+	for _, p := range ps {
+		l = append(l, p)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Name < l[j].Name
+	})
+	return l
+}
+
+// contains reports whether the given country is one of the given
+// countries. An unknown country is in none of them.
+func contains(countries []string, country string) bool {
+	if country == "" {
+		return false
+	}
+	for _, c := range countries {
+		if c == country {
+			return true
+		}
+	}
+	return false
+}
+
+func isStepUpRequired(err error) bool {
+	_, ok := err.(*StepUpRequiredError)
+	return ok
+}
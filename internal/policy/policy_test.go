@@ -0,0 +1,339 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package policy_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/candid/internal/candidtest"
+	"github.com/CanonicalLtd/candid/internal/policy"
+)
+
+func TestStore(t *testing.T) {
+	qtsuite.Run(qt.New(t), &storeSuite{})
+}
+
+type storeSuite struct {
+	store *policy.Store
+}
+
+func (s *storeSuite) Init(c *qt.C) {
+	kv, err := candidtest.NewStore().ProviderDataStore.KeyValueStore(context.Background(), "test")
+	c.Assert(err, qt.Equals, nil)
+	s.store = policy.NewStore(kv)
+}
+
+func (s *storeSuite) TestSetGetRemove(c *qt.C) {
+	ctx := context.Background()
+	ps, err := s.store.List(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ps, qt.HasLen, 0)
+
+	pk := bakery.MustGenerateKey().Public
+	p1 := policy.Policy{
+		Name:      "prod",
+		PublicKey: &pk,
+		Groups:    []string{"ops"},
+	}
+	p2 := policy.Policy{
+		Name:   "dashboard",
+		Origin: "https://dashboard.example.com",
+		Groups: []string{"staff"},
+	}
+	err = s.store.Set(ctx, p1)
+	c.Assert(err, qt.Equals, nil)
+	err = s.store.Set(ctx, p2)
+	c.Assert(err, qt.Equals, nil)
+
+	ps, err = s.store.List(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ps, qt.DeepEquals, []policy.Policy{p2, p1})
+
+	p, err := s.store.Get(ctx, "prod")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(p, qt.DeepEquals, p1)
+
+	err = s.store.Remove(ctx, "prod")
+	c.Assert(err, qt.Equals, nil)
+	_, err = s.store.Get(ctx, "prod")
+	c.Assert(errgo.Cause(err), qt.Equals, policy.ErrNotFound)
+	err = s.store.Remove(ctx, "prod")
+	c.Assert(errgo.Cause(err), qt.Equals, policy.ErrNotFound)
+}
+
+func (s *storeSuite) TestSetInvalid(c *qt.C) {
+	err := s.store.Set(context.Background(), policy.Policy{
+		Name:   "prod",
+		Groups: []string{"ops"},
+	})
+	c.Assert(err, qt.ErrorMatches, `policy must specify public-key or origin`)
+}
+
+func (s *storeSuite) TestCheck(c *qt.C) {
+	ctx := context.Background()
+	pk1 := bakery.MustGenerateKey().Public
+	pk2 := bakery.MustGenerateKey().Public
+	err := s.store.Set(ctx, policy.Policy{
+		Name:      "prod",
+		PublicKey: &pk1,
+		Groups:    []string{"ops", "bob"},
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	groupsCalled := 0
+	req := func(pk bakery.PublicKey, username string, gs ...string) policy.Request {
+		return policy.Request{
+			PublicKey: pk,
+			Username:  username,
+			Groups: func() ([]string, error) {
+				groupsCalled++
+				return gs, nil
+			},
+		}
+	}
+	_, err = s.store.Check(ctx, req(pk2, "alice"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groupsCalled, qt.Equals, 0)
+
+	_, err = s.store.Check(ctx, req(pk1, "alice", "ops"))
+	c.Assert(err, qt.Equals, nil)
+
+	_, err = s.store.Check(ctx, req(pk1, "bob"))
+	c.Assert(err, qt.Equals, nil)
+
+	_, err = s.store.Check(ctx, req(pk1, "alice", "dev"))
+	c.Assert(err, qt.ErrorMatches, `user "alice" is not allowed a discharge by policy "prod"`)
+	c.Assert(errgo.Cause(err), qt.Equals, policy.ErrDenied)
+}
+
+func (s *storeSuite) TestCheckRestrictions(c *qt.C) {
+	ctx := context.Background()
+	pk := bakery.MustGenerateKey().Public
+	err := s.store.Set(ctx, policy.Policy{
+		Name:      "prod",
+		PublicKey: &pk,
+		Restrictions: []policy.Restriction{{
+			Groups: []string{"contractors"},
+			Hours: &policy.Hours{
+				From:  "09:00",
+				Until: "17:00",
+			},
+			Networks: []string{"10.0.0.0/8"},
+		}},
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	req := func(t time.Time, ip string, gs ...string) policy.Request {
+		return policy.Request{
+			PublicKey: pk,
+			Username:  "alice",
+			Groups: func() ([]string, error) {
+				return gs, nil
+			},
+			ClientIP: net.ParseIP(ip),
+			Time:     t,
+		}
+	}
+	day := time.Date(2019, 6, 3, 0, 0, 0, 0, time.UTC)
+
+	// Users not in the restricted groups are not restricted.
+	cavs, err := s.store.Check(ctx, req(day, "192.168.0.1", "staff"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cavs, qt.HasLen, 0)
+
+	cavs, err = s.store.Check(ctx, req(day.Add(10*time.Hour), "10.1.2.3", "contractors"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cavs, qt.DeepEquals, []checkers.Caveat{
+		httpbakery.ClientIPAddrCaveat(net.ParseIP("10.1.2.3")),
+		checkers.TimeBeforeCaveat(day.Add(17 * time.Hour)),
+	})
+
+	_, err = s.store.Check(ctx, req(day.Add(18*time.Hour), "10.1.2.3", "contractors"))
+	c.Assert(err, qt.ErrorMatches, `user "alice" is not allowed a discharge by policy "prod": outside permitted hours 09:00-17:00`)
+	c.Assert(errgo.Cause(err), qt.Equals, policy.ErrDenied)
+
+	_, err = s.store.Check(ctx, req(day.Add(10*time.Hour), "192.168.0.1", "contractors"))
+	c.Assert(err, qt.ErrorMatches, `user "alice" is not allowed a discharge by policy "prod": address 192.168.0.1 not allowed`)
+	c.Assert(errgo.Cause(err), qt.Equals, policy.ErrDenied)
+}
+
+func (s *storeSuite) TestCheckCountries(c *qt.C) {
+	ctx := context.Background()
+	pk := bakery.MustGenerateKey().Public
+	err := s.store.Set(ctx, policy.Policy{
+		Name:      "prod",
+		PublicKey: &pk,
+		Restrictions: []policy.Restriction{{
+			DenyCountries: []string{"AQ"},
+		}, {
+			Groups:                 []string{"admin"},
+			Countries:              []string{"GB", "FR", "US"},
+			StepUpCountries:        []string{"US"},
+			StepUpIdentityProvider: "mfa",
+		}},
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	req := func(country, idp string, gs ...string) policy.Request {
+		return policy.Request{
+			PublicKey: pk,
+			Username:  "alice",
+			Groups: func() ([]string, error) {
+				return gs, nil
+			},
+			Country: country,
+			IdentityProvider: func() (string, error) {
+				return idp, nil
+			},
+		}
+	}
+
+	// Users are allowed from unknown countries unless the countries
+	// they are allowed from are restricted.
+	_, err = s.store.Check(ctx, req("", "ldap"))
+	c.Assert(err, qt.Equals, nil)
+	_, err = s.store.Check(ctx, req("", "ldap", "admin"))
+	c.Assert(err, qt.ErrorMatches, `user "alice" is not allowed a discharge by policy "prod": client country unknown`)
+	c.Assert(errgo.Cause(err), qt.Equals, policy.ErrDenied)
+
+	_, err = s.store.Check(ctx, req("AQ", "ldap"))
+	c.Assert(err, qt.ErrorMatches, `user "alice" is not allowed a discharge by policy "prod": country AQ not allowed`)
+	c.Assert(errgo.Cause(err), qt.Equals, policy.ErrDenied)
+
+	_, err = s.store.Check(ctx, req("GB", "ldap", "admin"))
+	c.Assert(err, qt.Equals, nil)
+
+	_, err = s.store.Check(ctx, req("DE", "ldap", "admin"))
+	c.Assert(err, qt.ErrorMatches, `user "alice" is not allowed a discharge by policy "prod": country DE not allowed`)
+	c.Assert(errgo.Cause(err), qt.Equals, policy.ErrDenied)
+
+	_, err = s.store.Check(ctx, req("US", "ldap", "admin"))
+	c.Assert(err, qt.ErrorMatches, `user "alice" is not allowed a discharge by policy "prod": login from US requires identity provider "mfa"`)
+	c.Assert(errgo.Cause(err), qt.DeepEquals, &policy.StepUpRequiredError{
+		IdentityProvider: "mfa",
+	})
+
+	_, err = s.store.Check(ctx, req("US", "mfa", "admin"))
+	c.Assert(err, qt.Equals, nil)
+}
+
+func TestHoursSpanningMidnight(t *testing.T) {
+	c := qt.New(t)
+	kv, err := candidtest.NewStore().ProviderDataStore.KeyValueStore(context.Background(), "test")
+	c.Assert(err, qt.Equals, nil)
+	store := policy.NewStore(kv)
+	pk := bakery.MustGenerateKey().Public
+	err = store.Set(context.Background(), policy.Policy{
+		Name:      "night",
+		PublicKey: &pk,
+		Restrictions: []policy.Restriction{{
+			Hours: &policy.Hours{
+				From:  "22:00",
+				Until: "06:00",
+			},
+		}},
+	})
+	c.Assert(err, qt.Equals, nil)
+	day := time.Date(2019, 6, 3, 0, 0, 0, 0, time.UTC)
+	cavs, err := store.Check(context.Background(), policy.Request{
+		PublicKey: pk,
+		Username:  "alice",
+		Groups:    func() ([]string, error) { return nil, nil },
+		Time:      day.Add(23 * time.Hour),
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cavs, qt.DeepEquals, []checkers.Caveat{
+		checkers.TimeBeforeCaveat(day.Add(30 * time.Hour)),
+	})
+}
+
+var validateTests = []struct {
+	about       string
+	policy      policy.Policy
+	expectError string
+}{{
+	about: "no groups or restrictions",
+	policy: policy.Policy{
+		Name:   "p",
+		Origin: "https://example.com",
+	},
+	expectError: `policy must specify groups or restrictions`,
+}, {
+	about: "empty restriction",
+	policy: policy.Policy{
+		Name:         "p",
+		Origin:       "https://example.com",
+		Restrictions: []policy.Restriction{{}},
+	},
+	expectError: `restriction must specify hours, networks or countries`,
+}, {
+	about: "invalid network",
+	policy: policy.Policy{
+		Name:   "p",
+		Origin: "https://example.com",
+		Restrictions: []policy.Restriction{{
+			Networks: []string{"10.0.0.1"},
+		}},
+	},
+	expectError: `invalid network "10.0.0.1"`,
+}, {
+	about: "invalid country",
+	policy: policy.Policy{
+		Name:   "p",
+		Origin: "https://example.com",
+		Restrictions: []policy.Restriction{{
+			DenyCountries: []string{"gb"},
+		}},
+	},
+	expectError: `invalid country "gb"`,
+}, {
+	about: "step-up without identity provider",
+	policy: policy.Policy{
+		Name:   "p",
+		Origin: "https://example.com",
+		Restrictions: []policy.Restriction{{
+			StepUpCountries: []string{"GB"},
+		}},
+	},
+	expectError: `restriction with step-up-countries must specify step-up-identity-provider`,
+}, {
+	about: "invalid time",
+	policy: policy.Policy{
+		Name:   "p",
+		Origin: "https://example.com",
+		Restrictions: []policy.Restriction{{
+			Hours: &policy.Hours{From: "9am", Until: "17:00"},
+		}},
+	},
+	expectError: `invalid time "9am"`,
+}, {
+	about: "invalid time zone",
+	policy: policy.Policy{
+		Name:   "p",
+		Origin: "https://example.com",
+		Restrictions: []policy.Restriction{{
+			Hours: &policy.Hours{From: "09:00", Until: "17:00", TimeZone: "Nowhere/Special"},
+		}},
+	},
+	expectError: `invalid time-zone "Nowhere/Special"`,
+}}
+
+func TestValidate(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range validateTests {
+		c.Run(test.about, func(c *qt.C) {
+			c.Assert(test.policy.Validate(), qt.ErrorMatches, test.expectError)
+		})
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package readonly implements the read-only mode of the identity
+// server. While the server is read-only, users with existing identities
+// can continue to log in and obtain discharges, but identities cannot
+// be created or changed. This allows the identity database to be
+// migrated or failed over without losing updates.
+package readonly
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
+)
+
+var logger = loggo.GetLogger("candid.internal.readonly")
+
+// StoreName is the name of the provider data key-value store that
+// holds the read-only state, so that it is shared by all servers using
+// the same store.
+const StoreName = "_read_only"
+
+// storeKey is the key in the simplekv store under which the read-only
+// state is held.
+const storeKey = "read-only"
+
+// defaultRefreshInterval is the default interval between reloading the
+// read-only state from the store.
+const defaultRefreshInterval = 10 * time.Second
+
+// Params holds the parameters for a Mode.
+type Params struct {
+	// Store holds the store in which the read-only state is kept.
+	Store simplekv.Store
+
+	// RefreshInterval holds the interval between reloading the
+	// read-only state from the store, so that changes made through
+	// other servers are seen. If this is zero a default of 10
+	// seconds is used.
+	RefreshInterval time.Duration
+}
+
+// A Mode holds whether the identity server is read-only.
+type Mode struct {
+	p        Params
+	readOnly int32
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	wg        sync.WaitGroup
+}
+
+// New creates a new Mode, reading the current state from the store.
+func New(ctx context.Context, p Params) (*Mode, error) {
+	if p.RefreshInterval == 0 {
+		p.RefreshInterval = defaultRefreshInterval
+	}
+	m := &Mode{
+		p:      p,
+		closed: make(chan struct{}),
+	}
+	if err := m.refresh(ctx); err != nil {
+		return nil, errgo.Notef(err, "cannot read read-only state")
+	}
+	return m, nil
+}
+
+// ReadOnly reports whether the identity server is read-only.
+func (m *Mode) ReadOnly() bool {
+	return atomic.LoadInt32(&m.readOnly) != 0
+}
+
+// SetReadOnly sets whether the identity server is read-only. Other
+// servers sharing the store see the change when they next refresh
+// their state.
+func (m *Mode) SetReadOnly(ctx context.Context, readOnly bool) error {
+	v := []byte{0}
+	if readOnly {
+		v = []byte{1}
+	}
+	if err := m.p.Store.Set(ctx, storeKey, v, time.Time{}); err != nil {
+		return errgo.Mask(err)
+	}
+	m.set(readOnly)
+	if readOnly {
+		logger.Infof("identity server is now read-only")
+	} else {
+		logger.Infof("identity server is no longer read-only")
+	}
+	return nil
+}
+
+// Start starts a goroutine that periodically reloads the read-only
+// state from the store.
+func (m *Mode) Start() {
+	m.wg.Add(1)
+	go m.run()
+}
+
+// Close stops any goroutine started by Start.
+func (m *Mode) Close() {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+	})
+	m.wg.Wait()
+}
+
+func (m *Mode) run() {
+	defer m.wg.Done()
+	t := time.NewTicker(m.p.RefreshInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-m.closed:
+			return
+		}
+		// The store may well be unavailable while the server is
+		// read-only, in which case the current state is kept.
+		if err := m.refresh(context.Background()); err != nil {
+			logger.Errorf("cannot refresh read-only state: %s", err)
+		}
+	}
+}
+
+func (m *Mode) refresh(ctx context.Context) error {
+	v, err := m.p.Store.Get(ctx, storeKey)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		m.set(false)
+		return nil
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	m.set(len(v) > 0 && v[0] != 0)
+	return nil
+}
+
+func (m *Mode) set(readOnly bool) {
+	var v int32
+	if readOnly {
+		v = 1
+	}
+	atomic.StoreInt32(&m.readOnly, v)
+}
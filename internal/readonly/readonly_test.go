@@ -0,0 +1,135 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package readonly_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/simplekv/memsimplekv"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/internal/readonly"
+	"github.com/CanonicalLtd/candid/store"
+	"github.com/CanonicalLtd/candid/store/memstore"
+)
+
+func TestModeShared(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore()
+	m1, err := readonly.New(ctx, readonly.Params{Store: kv})
+	c.Assert(err, qt.Equals, nil)
+	defer m1.Close()
+	m2, err := readonly.New(ctx, readonly.Params{
+		Store:           kv,
+		RefreshInterval: time.Millisecond,
+	})
+	c.Assert(err, qt.Equals, nil)
+	m2.Start()
+	defer m2.Close()
+
+	c.Assert(m1.ReadOnly(), qt.Equals, false)
+	err = m1.SetReadOnly(ctx, true)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(m1.ReadOnly(), qt.Equals, true)
+	for i := 0; !m2.ReadOnly(); i++ {
+		c.Assert(i < 1000, qt.Equals, true)
+		time.Sleep(time.Millisecond)
+	}
+
+	// A new Mode reads the current state.
+	m3, err := readonly.New(ctx, readonly.Params{Store: kv})
+	c.Assert(err, qt.Equals, nil)
+	defer m3.Close()
+	c.Assert(m3.ReadOnly(), qt.Equals, true)
+}
+
+func TestStore(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	m, err := readonly.New(ctx, readonly.Params{Store: memsimplekv.NewStore()})
+	c.Assert(err, qt.Equals, nil)
+	defer m.Close()
+	underlying := memstore.NewStore()
+	st := readonly.NewStore(underlying, m)
+
+	bob := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Name:       "Bob",
+		Groups:     []string{"a", "b"},
+	}
+	err = st.UpdateIdentity(ctx, &bob, store.Update{
+		store.Username: store.Set,
+		store.Name:     store.Set,
+		store.Groups:   store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	err = m.SetReadOnly(ctx, true)
+	c.Assert(err, qt.Equals, nil)
+
+	// Recording a discharge succeeds but is not written.
+	err = st.UpdateIdentity(ctx, &store.Identity{
+		Username:      "bob",
+		LastDischarge: time.Now(),
+	}, store.Update{
+		store.LastDischarge: store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+	id := store.Identity{Username: "bob"}
+	err = underlying.Identity(ctx, &id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id.LastDischarge.IsZero(), qt.Equals, true)
+
+	// Logging in again with the same details succeeds.
+	id = store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Name:       "Bob",
+		Groups:     []string{"b", "a"},
+		LastLogin:  time.Now(),
+	}
+	err = st.UpdateIdentity(ctx, &id, store.Update{
+		store.Username:  store.Set,
+		store.Name:      store.Set,
+		store.Groups:    store.Set,
+		store.LastLogin: store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id.ID, qt.Equals, bob.ID)
+
+	// Changing an identity fails.
+	err = st.UpdateIdentity(ctx, &store.Identity{
+		Username: "bob",
+		Groups:   []string{"c"},
+	}, store.Update{
+		store.Groups: store.Push,
+	})
+	c.Assert(err, qt.ErrorMatches, `cannot update identity "bob": identity server is read-only`)
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrReadOnly)
+
+	// Creating an identity fails.
+	err = st.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Username:   "alice",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.ErrorMatches, `cannot create identity "test:alice": identity server is read-only`)
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrReadOnly)
+
+	err = m.SetReadOnly(ctx, false)
+	c.Assert(err, qt.Equals, nil)
+	err = st.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Username:   "alice",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+}
@@ -0,0 +1,185 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package readonly
+
+import (
+	"context"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// NewStore returns a store that rejects updates to identities in the
+// given store while m is read-only.
+//
+// While read-only, updates that only record login or discharge times
+// are discarded, so that logins and discharges continue to succeed.
+// Other updates that would not change the identity, such as those made
+// by identity providers when an existing user logs in again, succeed
+// without writing to the store. All other updates, including those
+// that would create a new identity, fail with an error with a cause of
+// store.ErrReadOnly.
+func NewStore(st store.Store, m *Mode) store.Store {
+	return &readOnlyStore{
+		Store: st,
+		mode:  m,
+	}
+}
+
+type readOnlyStore struct {
+	store.Store
+	mode *Mode
+}
+
+// UpdateIdentity implements store.Store.UpdateIdentity.
+func (s *readOnlyStore) UpdateIdentity(ctx context.Context, identity *store.Identity, update store.Update) error {
+	if !s.mode.ReadOnly() {
+		return errgo.Mask(s.Store.UpdateIdentity(ctx, identity, update), errgo.Any)
+	}
+	if onlyTimes(update) {
+		return nil
+	}
+	return errgo.Mask(s.check(ctx, identity, update), errgo.Is(store.ErrReadOnly))
+}
+
+// UpdateIdentities implements store.Store.UpdateIdentities.
+func (s *readOnlyStore) UpdateIdentities(ctx context.Context, identities []*store.Identity, update store.Update) error {
+	if !s.mode.ReadOnly() {
+		return errgo.Mask(s.Store.UpdateIdentities(ctx, identities, update), errgo.Any)
+	}
+	if onlyTimes(update) {
+		return nil
+	}
+	for _, identity := range identities {
+		if err := s.check(ctx, identity, update); err != nil {
+			return errgo.Mask(err, errgo.Is(store.ErrReadOnly))
+		}
+	}
+	return nil
+}
+
+// check checks that the given update would not change the given
+// identity. If it would not, the ID of the identity is set.
+func (s *readOnlyStore) check(ctx context.Context, identity *store.Identity, update store.Update) error {
+	current := store.Identity{
+		ID:         identity.ID,
+		ProviderID: identity.ProviderID,
+		Username:   identity.Username,
+	}
+	if err := s.Store.Identity(ctx, &current); err != nil {
+		if errgo.Cause(err) == store.ErrNotFound && identity.ID == "" && identity.ProviderID != "" {
+			return readOnlyError("cannot create identity %q", identity.ProviderID)
+		}
+		return readOnlyError("cannot update identity: %s", err)
+	}
+	if changes(&current, identity, update) {
+		return readOnlyError("cannot update identity %q", current.Username)
+	}
+	identity.ID = current.ID
+	return nil
+}
+
+func readOnlyError(f string, a ...interface{}) error {
+	err := errgo.WithCausef(nil, store.ErrReadOnly, f+": identity server is read-only", a...)
+	err.(*errgo.Err).SetLocation(1)
+	return err
+}
+
+// onlyTimes reports whether the given update only changes the last
+// login and discharge times.
+func onlyTimes(update store.Update) bool {
+	for f, op := range update {
+		if op != store.NoUpdate && store.Field(f) != store.LastLogin && store.Field(f) != store.LastDischarge {
+			return false
+		}
+	}
+	return true
+}
+
+// changes reports whether applying the given update to the identity
+// old with the values in new would change anything other than the
+// last login and discharge times.
+func changes(old, new *store.Identity, update store.Update) bool {
+	return stringChanges(string(old.ProviderID), string(new.ProviderID), update[store.ProviderID]) ||
+		stringChanges(old.Username, new.Username, update[store.Username]) ||
+		stringChanges(old.Name, new.Name, update[store.Name]) ||
+		stringChanges(old.Email, new.Email, update[store.Email]) ||
+		stringChanges(string(old.Owner), string(new.Owner), update[store.Owner]) ||
+		stringsChange(old.Groups, new.Groups, update[store.Groups]) ||
+		keysChange(old.PublicKeys, new.PublicKeys, update[store.PublicKeys]) ||
+		mapChanges(old.ProviderInfo, new.ProviderInfo, update[store.ProviderInfo]) ||
+		mapChanges(old.ExtraInfo, new.ExtraInfo, update[store.ExtraInfo])
+}
+
+func stringChanges(old, new string, op store.Operation) bool {
+	switch op {
+	case store.NoUpdate:
+		return false
+	case store.Set:
+		return old != new
+	case store.Clear:
+		return old != ""
+	}
+	return true
+}
+
+func stringsChange(old, new []string, op store.Operation) bool {
+	contains := func(ss []string, s string) bool {
+		for _, t := range ss {
+			if s == t {
+				return true
+			}
+		}
+		return false
+	}
+	switch op {
+	case store.NoUpdate:
+		return false
+	case store.Set:
+		if len(old) != len(new) {
+			return true
+		}
+		fallthrough
+	case store.Push:
+		for _, s := range new {
+			if !contains(old, s) {
+				return true
+			}
+		}
+		return false
+	case store.Pull:
+		for _, s := range new {
+			if contains(old, s) {
+				return true
+			}
+		}
+		return false
+	case store.Clear:
+		return len(old) > 0
+	}
+	return true
+}
+
+func keysChange(old, new []bakery.PublicKey, op store.Operation) bool {
+	return stringsChange(keyStrings(old), keyStrings(new), op)
+}
+
+func keyStrings(ks []bakery.PublicKey) []string {
+	ss := make([]string, len(ks))
+	for i, k := range ks {
+		ss[i] = k.String()
+	}
+	return ss
+}
+
+func mapChanges(old, new map[string][]string, op store.Operation) bool {
+	for k, v := range new {
+		if stringsChange(old[k], v, op) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package remember records the browsers that users have asked Candid to
+// remember, so that they can log in again without being sent to their
+// identity provider until the remembered session expires. Each
+// remembered browser is bound to the user agent that was used when it
+// was remembered, and may be revoked at any time.
+package remember
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
+)
+
+// StoreName is the name of the provider data key-value store that
+// holds remembered browsers.
+const StoreName = "_remembered_browsers"
+
+// maxBrowsers is the maximum number of browsers remembered for each
+// identity. When it is exceeded the oldest are forgotten.
+const maxBrowsers = 20
+
+// ErrNotFound is the error cause returned when a remembered browser
+// does not exist, has expired, or is being used by a different user
+// agent.
+var ErrNotFound = errgo.New("remembered browser not found")
+
+// Params holds the policy for remembering browsers.
+type Params struct {
+	// Lifetime holds the time for which a browser is remembered. If
+	// it is zero browsers are never remembered.
+	Lifetime time.Duration
+
+	// DeniedGroups holds groups whose members may not have their
+	// browsers remembered. This is usually used for privileged
+	// users, who should always authenticate with their identity
+	// provider.
+	DeniedGroups []string
+}
+
+// Allowed reports whether a user that is a member of the given groups
+// may have their browser remembered.
+func (p Params) Allowed(groups []string) bool {
+	if p.Lifetime <= 0 {
+		return false
+	}
+	for _, g := range groups {
+		for _, dg := range p.DeniedGroups {
+			if g == dg {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// A Browser records a browser that is remembered for an identity.
+type Browser struct {
+	// ID holds the ID of the remembered browser. It is held in the
+	// browser's cookie.
+	ID string `json:"id"`
+
+	// UserAgent holds the user agent of the browser.
+	UserAgent string `json:"user-agent,omitempty"`
+
+	// Address holds the IP address of the browser when it was
+	// remembered.
+	Address string `json:"address,omitempty"`
+
+	// Created holds the time the browser was remembered.
+	Created time.Time `json:"created"`
+
+	// Expires holds the time after which the browser is no longer
+	// remembered.
+	Expires time.Time `json:"expires"`
+}
+
+// Store stores remembered browsers. It wraps a KeyValueStore.
+type Store struct {
+	store simplekv.Store
+}
+
+// NewStore creates a new Store using the given KeyValueStore for
+// backing storage.
+func NewStore(store simplekv.Store) *Store {
+	return &Store{store: store}
+}
+
+// Add remembers a browser with the given user agent and address for
+// the identity with the given username until the given expiry time.
+// The new Browser is returned.
+func (s *Store) Add(ctx context.Context, username, userAgent, address string, expires time.Time) (*Browser, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	now := time.Now()
+	b := Browser{
+		ID:        id,
+		UserAgent: userAgent,
+		Address:   address,
+		Created:   now,
+		Expires:   expires,
+	}
+	err = s.update(ctx, username, now, func(bs []Browser) []Browser {
+		bs = append(bs, b)
+		if len(bs) > maxBrowsers {
+			bs = bs[len(bs)-maxBrowsers:]
+		}
+		return bs
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &b, nil
+}
+
+// Get returns the unexpired browser with the given ID remembered for
+// the identity with the given username. The browser is only returned if
+// it is being used by the same user agent as when it was remembered,
+// otherwise, or if there is no such browser, an error with a cause of
+// ErrNotFound is returned.
+func (s *Store) Get(ctx context.Context, username, id, userAgent string) (*Browser, error) {
+	bs, err := s.List(ctx, username)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	for _, b := range bs {
+		if b.ID != id {
+			continue
+		}
+		if !sameUserAgent(b.UserAgent, userAgent) {
+			break
+		}
+		return &b, nil
+	}
+	return nil, errgo.WithCausef(nil, ErrNotFound, "browser %q not remembered", id)
+}
+
+// List returns the unexpired browsers remembered for the identity with
+// the given username, most recent first.
+func (s *Store) List(ctx context.Context, username string) ([]Browser, error) {
+	v, err := s.store.Get(ctx, username)
+	if err != nil {
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			return nil, nil
+		}
+		return nil, errgo.Mask(err)
+	}
+	var bs []Browser
+	if err := json.Unmarshal(v, &bs); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	bs = unexpired(bs, time.Now())
+	sort.SliceStable(bs, func(i, j int) bool {
+		return bs[i].Created.After(bs[j].Created)
+	})
+	return bs, nil
+}
+
+// Remove forgets the browser with the given ID remembered for the
+// identity with the given username. If there is no such browser an
+// error with a cause of ErrNotFound is returned.
+func (s *Store) Remove(ctx context.Context, username, id string) error {
+	found := false
+	err := s.update(ctx, username, time.Now(), func(bs []Browser) []Browser {
+		found = false
+		for i, b := range bs {
+			if b.ID == id {
+				found = true
+				return append(bs[:i], bs[i+1:]...)
+			}
+		}
+		return bs
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if !found {
+		return errgo.WithCausef(nil, ErrNotFound, "browser %q not remembered", id)
+	}
+	return nil
+}
+
+// update atomically updates the browsers remembered for the given
+// user. Expired browsers are removed before f is called.
+func (s *Store) update(ctx context.Context, username string, now time.Time, f func([]Browser) []Browser) error {
+	err := s.store.Update(ctx, username, time.Time{}, func(old []byte) ([]byte, error) {
+		var bs []Browser
+		if len(old) > 0 {
+			if err := json.Unmarshal(old, &bs); err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
+		return json.Marshal(f(unexpired(bs, now)))
+	})
+	return errgo.Mask(err)
+}
+
+func unexpired(bs []Browser, now time.Time) []Browser {
+	var result []Browser
+	for _, b := range bs {
+		if b.Expires.After(now) {
+			result = append(result, b)
+		}
+	}
+	return result
+}
+
+func sameUserAgent(a, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+func newID() (string, error) {
+	buf := make([]byte, 18)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package remember_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/simplekv/memsimplekv"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/internal/remember"
+)
+
+func TestStore(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	s := remember.NewStore(memsimplekv.NewStore())
+
+	b1, err := s.Add(ctx, "bob", "browser-1", "192.0.2.1", time.Now().Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	b2, err := s.Add(ctx, "bob", "browser-2", "192.0.2.2", time.Now().Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	_, err = s.Add(ctx, "bob", "browser-3", "192.0.2.3", time.Now().Add(-time.Minute))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(b1.ID, qt.Not(qt.Equals), b2.ID)
+
+	bs, err := s.List(ctx, "bob")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(bs, qt.HasLen, 2)
+	c.Assert(bs[0].ID, qt.Equals, b2.ID)
+	c.Assert(bs[1].ID, qt.Equals, b1.ID)
+
+	b, err := s.Get(ctx, "bob", b1.ID, "browser-1")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(b.Address, qt.Equals, "192.0.2.1")
+
+	// A remembered browser cannot be used by another user agent or
+	// another user.
+	_, err = s.Get(ctx, "bob", b1.ID, "browser-2")
+	c.Assert(errgo.Cause(err), qt.Equals, remember.ErrNotFound)
+	_, err = s.Get(ctx, "alice", b1.ID, "browser-1")
+	c.Assert(errgo.Cause(err), qt.Equals, remember.ErrNotFound)
+
+	err = s.Remove(ctx, "bob", b1.ID)
+	c.Assert(err, qt.Equals, nil)
+	_, err = s.Get(ctx, "bob", b1.ID, "browser-1")
+	c.Assert(errgo.Cause(err), qt.Equals, remember.ErrNotFound)
+	err = s.Remove(ctx, "bob", b1.ID)
+	c.Assert(errgo.Cause(err), qt.Equals, remember.ErrNotFound)
+}
+
+func TestAllowed(t *testing.T) {
+	c := qt.New(t)
+	p := remember.Params{
+		Lifetime:     24 * time.Hour,
+		DeniedGroups: []string{"admins"},
+	}
+	c.Assert(p.Allowed(nil), qt.Equals, true)
+	c.Assert(p.Allowed([]string{"users"}), qt.Equals, true)
+	c.Assert(p.Allowed([]string{"users", "admins"}), qt.Equals, false)
+	c.Assert(remember.Params{}.Allowed(nil), qt.Equals, false)
+}
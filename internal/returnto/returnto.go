@@ -0,0 +1,139 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package returnto validates the addresses that users are redirected to
+// at the end of a redirect-based login, so that the identity server
+// cannot be used as an open redirector.
+package returnto
+
+import (
+	"net"
+	"net/url"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// A Pattern matches return_to addresses with a given scheme, a host
+// that is either a given host or one of its subdomains, and a path
+// with a given prefix.
+type Pattern struct {
+	scheme string
+	host   string
+	port   string
+	// subdomains holds whether host is a domain whose subdomains
+	// are matched, rather than a single host.
+	subdomains bool
+	path       string
+}
+
+// ParsePattern parses a pattern of the form scheme://host[:port][/path].
+// The host may start with "*." to match all subdomains of the rest of
+// the host name, for example "https://*.example.com". The pattern
+// matches addresses whose path is the given path or is below it; if no
+// path is given all paths match.
+func ParsePattern(s string) (*Pattern, error) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return nil, errgo.Newf("invalid return_to pattern %q", s)
+	}
+	p := &Pattern{
+		scheme: u.Scheme,
+		host:   strings.ToLower(u.Hostname()),
+		port:   u.Port(),
+		path:   strings.TrimSuffix(u.Path, "/"),
+	}
+	if strings.HasPrefix(p.host, "*.") {
+		p.host = p.host[1:]
+		p.subdomains = true
+	}
+	if p.host == "" || strings.Contains(p.host, "*") {
+		return nil, errgo.Newf("invalid return_to pattern %q", s)
+	}
+	return p, nil
+}
+
+// Match reports whether the given address, which should have been
+// returned by Parse, matches the pattern.
+func (p *Pattern) Match(u *url.URL) bool {
+	if u.Scheme != p.scheme || u.Port() != p.port {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if p.subdomains {
+		if !strings.HasSuffix(host, p.host) || len(host) == len(p.host) {
+			return false
+		}
+	} else if host != p.host {
+		return false
+	}
+	if p.path == "" {
+		return true
+	}
+	return u.Path == p.path || strings.HasPrefix(u.Path, p.path+"/")
+}
+
+// Parse parses the given return_to address. Only absolute http and https
+// URLs are allowed, and URLs that browsers might interpret differently
+// from Go, such as those containing user information, backslashes or
+// control characters, are rejected.
+func Parse(returnTo string) (*url.URL, error) {
+	if strings.ContainsAny(returnTo, "\\") || strings.IndexFunc(returnTo, isControl) != -1 {
+		return nil, errgo.Newf("invalid characters in return_to")
+	}
+	u, err := url.Parse(returnTo)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errgo.Newf("return_to must be an http or https URL")
+	}
+	if u.Host == "" || u.Opaque != "" {
+		return nil, errgo.Newf("return_to has no host")
+	}
+	if u.User != nil {
+		return nil, errgo.Newf("return_to may not contain user information")
+	}
+	if h := u.Hostname(); h == "" || strings.ContainsAny(h, "%@") || (strings.Contains(h, ":") && net.ParseIP(h) == nil) {
+		return nil, errgo.Newf("invalid return_to host %q", u.Host)
+	}
+	return u, nil
+}
+
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+// A Validator checks return_to addresses against a set of patterns.
+type Validator struct {
+	patterns []*Pattern
+}
+
+// New returns a Validator that allows return_to addresses matching any
+// of the given patterns. See ParsePattern for the form of a pattern.
+func New(patterns []string) (*Validator, error) {
+	v := new(Validator)
+	for _, s := range patterns {
+		p, err := ParsePattern(s)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		v.patterns = append(v.patterns, p)
+	}
+	return v, nil
+}
+
+// Allowed reports whether the given address, which should have been
+// returned by Parse, matches any of the validator's patterns. A nil
+// Validator allows nothing.
+func (v *Validator) Allowed(u *url.URL) bool {
+	if v == nil {
+		return false
+	}
+	for _, p := range v.patterns {
+		if p.Match(u) {
+			return true
+		}
+	}
+	return false
+}
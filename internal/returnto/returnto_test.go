@@ -0,0 +1,149 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package returnto_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/internal/returnto"
+)
+
+var parseTests = []struct {
+	returnTo    string
+	expectError string
+}{{
+	returnTo: "https://example.com/callback?x=1",
+}, {
+	returnTo: "http://[::1]:8080/callback",
+}, {
+	returnTo:    "//evil.example.com/callback",
+	expectError: `return_to must be an http or https URL`,
+}, {
+	returnTo:    "/callback",
+	expectError: `return_to must be an http or https URL`,
+}, {
+	returnTo:    "javascript:alert(1)",
+	expectError: `return_to must be an http or https URL`,
+}, {
+	returnTo:    "https:evil.example.com",
+	expectError: `return_to has no host`,
+}, {
+	returnTo:    "https://example.com@evil.example.com/",
+	expectError: `return_to may not contain user information`,
+}, {
+	returnTo:    "https://example.com\\@evil.example.com/",
+	expectError: `invalid characters in return_to`,
+}, {
+	returnTo:    "https://example.com/\ncallback",
+	expectError: `invalid characters in return_to`,
+}}
+
+func TestParse(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range parseTests {
+		c.Run(test.returnTo, func(c *qt.C) {
+			u, err := returnto.Parse(test.returnTo)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(u.String(), qt.Equals, test.returnTo)
+		})
+	}
+}
+
+var validatorTests = []struct {
+	about    string
+	patterns []string
+	allowed  []string
+	refused  []string
+}{{
+	about:    "exact host",
+	patterns: []string{"https://example.com"},
+	allowed: []string{
+		"https://example.com",
+		"https://EXAMPLE.com/any/path",
+	},
+	refused: []string{
+		"http://example.com/",
+		"https://example.com:8443/",
+		"https://www.example.com/",
+		"https://example.com.evil.com/",
+	},
+}, {
+	about:    "subdomains",
+	patterns: []string{"https://*.example.com"},
+	allowed: []string{
+		"https://www.example.com/",
+		"https://a.b.example.com/callback",
+	},
+	refused: []string{
+		"https://example.com/",
+		"https://evilexample.com/",
+	},
+}, {
+	about:    "path prefix",
+	patterns: []string{"https://example.com/app/"},
+	allowed: []string{
+		"https://example.com/app",
+		"https://example.com/app/callback",
+	},
+	refused: []string{
+		"https://example.com/",
+		"https://example.com/application",
+	},
+}, {
+	about:    "port",
+	patterns: []string{"http://localhost:8080/callback"},
+	allowed: []string{
+		"http://localhost:8080/callback",
+	},
+	refused: []string{
+		"http://localhost/callback",
+		"http://localhost:8081/callback",
+	},
+}, {
+	about: "no patterns",
+	refused: []string{
+		"https://example.com/",
+	},
+}}
+
+func TestValidator(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range validatorTests {
+		c.Run(test.about, func(c *qt.C) {
+			v, err := returnto.New(test.patterns)
+			c.Assert(err, qt.Equals, nil)
+			for _, s := range test.allowed {
+				u, err := returnto.Parse(s)
+				c.Assert(err, qt.Equals, nil)
+				c.Check(v.Allowed(u), qt.Equals, true, qt.Commentf("%s", s))
+			}
+			for _, s := range test.refused {
+				u, err := returnto.Parse(s)
+				c.Assert(err, qt.Equals, nil)
+				c.Check(v.Allowed(u), qt.Equals, false, qt.Commentf("%s", s))
+			}
+		})
+	}
+}
+
+func TestParsePatternError(t *testing.T) {
+	c := qt.New(t)
+	for _, p := range []string{
+		"example.com",
+		"ftp://example.com",
+		"https://*",
+		"https://www.*.example.com",
+		"https://user@example.com",
+		"https://example.com/?x=1",
+	} {
+		_, err := returnto.ParsePattern(p)
+		c.Check(err, qt.ErrorMatches, `invalid return_to pattern .*`, qt.Commentf("%s", p))
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package revocation records macaroons issued by candid, such as
+// discharge tokens, that have been revoked before they expire.
+package revocation
+
+import (
+	"context"
+	"encoding/base64"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "gopkg.in/errgo.v1"
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+// StoreName is the name of the provider data key-value store that
+// holds revoked macaroon IDs.
+const StoreName = "_revocations"
+
+// Store stores the IDs of revoked macaroons. It wraps a KeyValueStore.
+type Store struct {
+	store simplekv.Store
+}
+
+// NewStore creates a new Store using the given KeyValueStore for
+// backing storage.
+func NewStore(store simplekv.Store) *Store {
+	return &Store{store: store}
+}
+
+// Revoke records that the macaroon with the given ID has been revoked.
+// The record is kept until the given expiry time, after which the
+// macaroon is no longer valid anyway. If expires is the zero time the
+// record is kept forever.
+func (s *Store) Revoke(ctx context.Context, id []byte, expires time.Time) error {
+	return errgo.Mask(s.store.Set(ctx, key(id), []byte{1}, expires))
+}
+
+// Revoked reports whether the macaroon with the given ID has been
+// revoked.
+func (s *Store) Revoked(ctx context.Context, id []byte) (bool, error) {
+	v, err := s.store.Get(ctx, key(id))
+	if err != nil {
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			return false, nil
+		}
+		return false, errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
+	}
+	return len(v) > 0, nil
+}
+
+// Filter returns the given macaroon slices with any slice that
+// contains a revoked macaroon removed.
+func (s *Store) Filter(ctx context.Context, mss []macaroon.Slice) ([]macaroon.Slice, error) {
+	filtered := make([]macaroon.Slice, 0, len(mss))
+	for _, ms := range mss {
+		revoked, err := s.anyRevoked(ctx, ms)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
+		}
+		if !revoked {
+			filtered = append(filtered, ms)
+		}
+	}
+	return filtered, nil
+}
+
+func (s *Store) anyRevoked(ctx context.Context, ms macaroon.Slice) (bool, error) {
+	for _, m := range ms {
+		revoked, err := s.Revoked(ctx, m.Id())
+		if err != nil {
+			return false, errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
+		}
+		if revoked {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func key(id []byte) string {
+	return base64.RawURLEncoding.EncodeToString(id)
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package revocation_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	macaroon "gopkg.in/macaroon.v2"
+
+	"github.com/CanonicalLtd/candid/internal/candidtest"
+	"github.com/CanonicalLtd/candid/internal/revocation"
+)
+
+func TestStore(t *testing.T) {
+	qtsuite.Run(qt.New(t), &storeSuite{})
+}
+
+type storeSuite struct {
+	store *revocation.Store
+}
+
+func (s *storeSuite) Init(c *qt.C) {
+	kv, err := candidtest.NewStore().ProviderDataStore.KeyValueStore(context.Background(), "test")
+	c.Assert(err, qt.Equals, nil)
+	s.store = revocation.NewStore(kv)
+}
+
+func (s *storeSuite) TestRevoke(c *qt.C) {
+	ctx := context.Background()
+	revoked, err := s.store.Revoked(ctx, []byte("id1"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(revoked, qt.Equals, false)
+
+	err = s.store.Revoke(ctx, []byte("id1"), time.Now().Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+
+	revoked, err = s.store.Revoked(ctx, []byte("id1"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(revoked, qt.Equals, true)
+
+	revoked, err = s.store.Revoked(ctx, []byte("id2"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(revoked, qt.Equals, false)
+}
+
+func (s *storeSuite) TestFilter(c *qt.C) {
+	ctx := context.Background()
+	m1 := newMacaroon(c, "id1")
+	m2 := newMacaroon(c, "id2")
+	d2 := newMacaroon(c, "discharge2")
+	err := s.store.Revoke(ctx, []byte("discharge2"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	mss, err := s.store.Filter(ctx, []macaroon.Slice{{m1}, {m2, d2}})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(mss, qt.HasLen, 1)
+	c.Assert(mss[0][0].Id(), qt.DeepEquals, []byte("id1"))
+}
+
+func newMacaroon(c *qt.C, id string) *macaroon.Macaroon {
+	m, err := macaroon.New([]byte("key"), []byte(id), "loc", macaroon.LatestVersion)
+	c.Assert(err, qt.Equals, nil)
+	return m
+}
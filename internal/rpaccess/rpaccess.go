@@ -0,0 +1,202 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package rpaccess records which relying parties each identity has
+// recently obtained discharges for, so that users can see the
+// services they have signed in to.
+package rpaccess
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "gopkg.in/errgo.v1"
+)
+
+// StoreName is the name of the provider data key-value store that
+// holds relying party access records.
+const StoreName = "_rp_access"
+
+const (
+	// maxRelyingParties is the maximum number of relying parties
+	// recorded for each identity. When it is exceeded the least
+	// recently accessed relying party is forgotten.
+	maxRelyingParties = 100
+
+	// rollupDays is the number of days for which daily access counts
+	// are kept.
+	rollupDays = 30
+
+	// dayFormat is the format of the day in a DayCount.
+	dayFormat = "2006-01-02"
+)
+
+// An Access records the accesses made by an identity to a single
+// relying party.
+type Access struct {
+	// ID identifies the relying party. It holds the public key that
+	// the relying party uses to add third-party caveats.
+	ID string `json:"id"`
+
+	// First holds the time of the first recorded access.
+	First time.Time `json:"first"`
+
+	// Last holds the time of the most recent access.
+	Last time.Time `json:"last"`
+
+	// Count holds the total number of recorded accesses.
+	Count int `json:"count"`
+
+	// Daily holds the number of accesses made on each of the most
+	// recent days with any accesses, oldest first.
+	Daily []DayCount `json:"daily,omitempty"`
+}
+
+// A DayCount holds the number of accesses made on a single day.
+type DayCount struct {
+	// Day holds the UTC date in YYYY-MM-DD format.
+	Day   string `json:"day"`
+	Count int    `json:"count"`
+}
+
+// record is the value stored for each identity.
+type record struct {
+	Access []Access `json:"access"`
+
+	// Revoked holds the time at which the user last revoked
+	// access to each relying party.
+	Revoked map[string]time.Time `json:"revoked,omitempty"`
+}
+
+// Store stores relying party access records for identities. It wraps
+// a KeyValueStore.
+type Store struct {
+	store simplekv.Store
+}
+
+// NewStore creates a new Store using the given KeyValueStore for
+// backing storage.
+func NewStore(store simplekv.Store) *Store {
+	return &Store{store: store}
+}
+
+// Record records that the identity with the given username accessed
+// the relying party with the given ID at the given time.
+func (s *Store) Record(ctx context.Context, username, id string, t time.Time) error {
+	return s.update(ctx, username, func(r *record) {
+		t = t.UTC()
+		day := t.Format(dayFormat)
+		var a *Access
+		for i := range r.Access {
+			if r.Access[i].ID == id {
+				a = &r.Access[i]
+				break
+			}
+		}
+		if a == nil {
+			r.Access = append(r.Access, Access{ID: id, First: t})
+			a = &r.Access[len(r.Access)-1]
+		}
+		if t.After(a.Last) {
+			a.Last = t
+		}
+		a.Count++
+		if n := len(a.Daily); n > 0 && a.Daily[n-1].Day == day {
+			a.Daily[n-1].Count++
+		} else {
+			a.Daily = append(a.Daily, DayCount{Day: day, Count: 1})
+		}
+		cutoff := t.AddDate(0, 0, -rollupDays).Format(dayFormat)
+		for len(a.Daily) > 0 && a.Daily[0].Day <= cutoff {
+			a.Daily = a.Daily[1:]
+		}
+		if len(r.Access) > maxRelyingParties {
+			sortAccess(r.Access)
+			r.Access = r.Access[:maxRelyingParties]
+		}
+	})
+}
+
+// List returns the relying parties accessed by the identity with the
+// given username, most recently accessed first.
+func (s *Store) List(ctx context.Context, username string) ([]Access, error) {
+	r, err := s.get(ctx, username)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
+	}
+	sortAccess(r.Access)
+	return r.Access, nil
+}
+
+// Revoke removes the record of accesses by the identity with the given
+// username to the relying party with the given ID and records the time
+// of the revocation, which can be retrieved with Revoked.
+func (s *Store) Revoke(ctx context.Context, username, id string, t time.Time) error {
+	return s.update(ctx, username, func(r *record) {
+		access := r.Access[:0]
+		for _, a := range r.Access {
+			if a.ID != id {
+				access = append(access, a)
+			}
+		}
+		r.Access = access
+		if r.Revoked == nil {
+			r.Revoked = make(map[string]time.Time)
+		}
+		r.Revoked[id] = t.UTC()
+	})
+}
+
+// Revoked returns the time at which the identity with the given
+// username last revoked access to the relying party with the given ID.
+// If access has never been revoked the zero time is returned.
+func (s *Store) Revoked(ctx context.Context, username, id string) (time.Time, error) {
+	r, err := s.get(ctx, username)
+	if err != nil {
+		return time.Time{}, errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
+	}
+	return r.Revoked[id], nil
+}
+
+func (s *Store) get(ctx context.Context, username string) (*record, error) {
+	var r record
+	b, err := s.store.Get(ctx, username)
+	if err != nil {
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			return &r, nil
+		}
+		return nil, errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
+	}
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &r, nil
+}
+
+func (s *Store) update(ctx context.Context, username string, f func(*record)) error {
+	err := s.store.Update(ctx, username, time.Time{}, func(old []byte) ([]byte, error) {
+		var r record
+		if old != nil {
+			if err := json.Unmarshal(old, &r); err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
+		f(&r)
+		b, err := json.Marshal(r)
+		if err != nil {
+			// This should be impossible.
+			panic(err)
+		}
+		return b, nil
+	})
+	return errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
+}
+
+func sortAccess(access []Access) {
+	sort.SliceStable(access, func(i, j int) bool {
+		return access[i].Last.After(access[j].Last)
+	})
+}
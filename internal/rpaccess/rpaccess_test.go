@@ -0,0 +1,121 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rpaccess_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+
+	"github.com/CanonicalLtd/candid/internal/candidtest"
+	"github.com/CanonicalLtd/candid/internal/rpaccess"
+)
+
+func TestStore(t *testing.T) {
+	qtsuite.Run(qt.New(t), &storeSuite{})
+}
+
+type storeSuite struct {
+	store *rpaccess.Store
+}
+
+func (s *storeSuite) Init(c *qt.C) {
+	kv, err := candidtest.NewStore().ProviderDataStore.KeyValueStore(context.Background(), "test")
+	c.Assert(err, qt.Equals, nil)
+	s.store = rpaccess.NewStore(kv)
+}
+
+var epoch = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func (s *storeSuite) TestRecordAndList(c *qt.C) {
+	ctx := context.Background()
+	err := s.store.Record(ctx, "bob", "rp1", epoch)
+	c.Assert(err, qt.Equals, nil)
+	err = s.store.Record(ctx, "bob", "rp2", epoch.Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	err = s.store.Record(ctx, "bob", "rp1", epoch.Add(2*time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	err = s.store.Record(ctx, "bob", "rp1", epoch.Add(24*time.Hour))
+	c.Assert(err, qt.Equals, nil)
+
+	access, err := s.store.List(ctx, "bob")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(access, qt.DeepEquals, []rpaccess.Access{{
+		ID:    "rp1",
+		First: epoch,
+		Last:  epoch.Add(24 * time.Hour),
+		Count: 3,
+		Daily: []rpaccess.DayCount{
+			{Day: "2019-06-01", Count: 2},
+			{Day: "2019-06-02", Count: 1},
+		},
+	}, {
+		ID:    "rp2",
+		First: epoch.Add(time.Hour),
+		Last:  epoch.Add(time.Hour),
+		Count: 1,
+		Daily: []rpaccess.DayCount{
+			{Day: "2019-06-01", Count: 1},
+		},
+	}})
+
+	access, err = s.store.List(ctx, "alice")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(access, qt.HasLen, 0)
+}
+
+func (s *storeSuite) TestOldDailyCountsDiscarded(c *qt.C) {
+	ctx := context.Background()
+	err := s.store.Record(ctx, "bob", "rp1", epoch)
+	c.Assert(err, qt.Equals, nil)
+	err = s.store.Record(ctx, "bob", "rp1", epoch.AddDate(0, 0, 31))
+	c.Assert(err, qt.Equals, nil)
+	access, err := s.store.List(ctx, "bob")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(access, qt.HasLen, 1)
+	c.Assert(access[0].Count, qt.Equals, 2)
+	c.Assert(access[0].Daily, qt.DeepEquals, []rpaccess.DayCount{
+		{Day: "2019-07-02", Count: 1},
+	})
+}
+
+func (s *storeSuite) TestLeastRecentForgotten(c *qt.C) {
+	ctx := context.Background()
+	for i := 0; i < 101; i++ {
+		err := s.store.Record(ctx, "bob", fmt.Sprintf("rp%d", i), epoch.Add(time.Duration(i)*time.Minute))
+		c.Assert(err, qt.Equals, nil)
+	}
+	access, err := s.store.List(ctx, "bob")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(access, qt.HasLen, 100)
+	c.Assert(access[0].ID, qt.Equals, "rp100")
+	c.Assert(access[99].ID, qt.Equals, "rp1")
+}
+
+func (s *storeSuite) TestRevoke(c *qt.C) {
+	ctx := context.Background()
+	err := s.store.Record(ctx, "bob", "rp1", epoch)
+	c.Assert(err, qt.Equals, nil)
+	err = s.store.Record(ctx, "bob", "rp2", epoch)
+	c.Assert(err, qt.Equals, nil)
+
+	t, err := s.store.Revoked(ctx, "bob", "rp1")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(t.IsZero(), qt.Equals, true)
+
+	err = s.store.Revoke(ctx, "bob", "rp1", epoch.Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	access, err := s.store.List(ctx, "bob")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(access, qt.HasLen, 1)
+	c.Assert(access[0].ID, qt.Equals, "rp2")
+
+	t, err = s.store.Revoked(ctx, "bob", "rp1")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(t, qt.DeepEquals, epoch.Add(time.Hour))
+}
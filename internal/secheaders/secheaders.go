@@ -0,0 +1,233 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package secheaders adds security headers, such as a Content Security
+// Policy, to the HTML pages served by the identity server.
+package secheaders
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// NoncePlaceholder is replaced by the nonce of each response wherever
+// it appears in a content security policy.
+const NoncePlaceholder = "{nonce}"
+
+// Params holds the parameters of a Policy.
+type Params struct {
+	// ContentSecurityPolicy holds the value of the
+	// Content-Security-Policy header of HTML responses. Each
+	// occurrence of NoncePlaceholder is replaced with a nonce that
+	// is different for every response and that templates can
+	// include in script and style elements with the "cspNonce"
+	// function, for example "script-src 'self' 'nonce-{nonce}'".
+	ContentSecurityPolicy string
+
+	// HSTSMaxAge holds the max-age of the Strict-Transport-Security
+	// header of HTML responses. If this is zero, the header is not
+	// set.
+	HSTSMaxAge time.Duration
+
+	// HSTSIncludeSubdomains holds whether the
+	// Strict-Transport-Security header also applies to all
+	// subdomains.
+	HSTSIncludeSubdomains bool
+
+	// FrameOptions holds the value of the X-Frame-Options header of
+	// HTML responses, either "DENY" or "SAMEORIGIN".
+	FrameOptions string
+
+	// ReferrerPolicy holds the value of the Referrer-Policy header
+	// of HTML responses.
+	ReferrerPolicy string
+}
+
+// A Policy sets the security headers of HTML responses.
+type Policy struct {
+	csp            string
+	nonce          bool
+	hsts           string
+	frameOptions   string
+	referrerPolicy string
+}
+
+// referrerPolicies holds the valid values of the Referrer-Policy
+// header.
+var referrerPolicies = map[string]bool{
+	"no-referrer":                     true,
+	"no-referrer-when-downgrade":      true,
+	"origin":                          true,
+	"origin-when-cross-origin":        true,
+	"same-origin":                     true,
+	"strict-origin":                   true,
+	"strict-origin-when-cross-origin": true,
+	"unsafe-url":                      true,
+}
+
+// New returns a new Policy that sets the security headers described by
+// the given parameters.
+func New(p Params) (*Policy, error) {
+	if strings.ContainsAny(p.ContentSecurityPolicy, "\r\n") {
+		return nil, errgo.Newf("invalid content security policy %q", p.ContentSecurityPolicy)
+	}
+	if p.HSTSMaxAge < 0 {
+		return nil, errgo.Newf("negative HSTS max-age")
+	}
+	frameOptions := strings.ToUpper(p.FrameOptions)
+	switch frameOptions {
+	case "", "DENY", "SAMEORIGIN":
+	default:
+		return nil, errgo.Newf("invalid frame options %q", p.FrameOptions)
+	}
+	if p.ReferrerPolicy != "" && !referrerPolicies[p.ReferrerPolicy] {
+		return nil, errgo.Newf("invalid referrer policy %q", p.ReferrerPolicy)
+	}
+	pol := &Policy{
+		csp:            p.ContentSecurityPolicy,
+		nonce:          strings.Contains(p.ContentSecurityPolicy, NoncePlaceholder),
+		frameOptions:   frameOptions,
+		referrerPolicy: p.ReferrerPolicy,
+	}
+	if p.HSTSMaxAge > 0 {
+		pol.hsts = "max-age=" + strconv.FormatInt(int64(p.HSTSMaxAge/time.Second), 10)
+		if p.HSTSIncludeSubdomains {
+			pol.hsts += "; includeSubDomains"
+		}
+	}
+	return pol, nil
+}
+
+// Wrap returns a ResponseWriter that adds the security headers to the
+// given response if it is an HTML page, and a request whose context
+// holds the nonce to use in the page.
+func (p *Policy) Wrap(w http.ResponseWriter, req *http.Request) (http.ResponseWriter, *http.Request) {
+	if p.csp == "" && p.hsts == "" && p.frameOptions == "" && p.referrerPolicy == "" {
+		return w, req
+	}
+	rw := &responseWriter{
+		ResponseWriter: w,
+		policy:         p,
+	}
+	if p.nonce {
+		rw.nonce = newNonce()
+		req = req.WithContext(ContextWithNonce(req.Context(), rw.nonce))
+	}
+	return rw, req
+}
+
+// setHeaders sets the security headers in h, using the given nonce in
+// the content security policy.
+func (p *Policy) setHeaders(h http.Header, nonce string) {
+	if p.csp != "" {
+		h.Set("Content-Security-Policy", strings.Replace(p.csp, NoncePlaceholder, nonce, -1))
+	}
+	if p.hsts != "" {
+		h.Set("Strict-Transport-Security", p.hsts)
+	}
+	if p.frameOptions != "" {
+		h.Set("X-Frame-Options", p.frameOptions)
+	}
+	if p.referrerPolicy != "" {
+		h.Set("Referrer-Policy", p.referrerPolicy)
+	}
+}
+
+// responseWriter adds the security headers to HTML responses.
+type responseWriter struct {
+	http.ResponseWriter
+	policy      *Policy
+	nonce       string
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter.WriteHeader.
+func (w *responseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if isHTML(w.Header().Get("Content-Type")) {
+			w.policy.setHeaders(w.Header(), w.nonce)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter.Write.
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			// Detect the content type as the http package
+			// would, so that the type is known here.
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher.Flush.
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func isHTML(contentType string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(contentType)), "text/html")
+}
+
+// newNonce returns a new random nonce.
+func newNonce() string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(errgo.Notef(err, "cannot generate nonce"))
+	}
+	return base64.StdEncoding.EncodeToString(buf[:])
+}
+
+type nonceKey struct{}
+
+// ContextWithNonce returns a context holding the given nonce, for use
+// by ExecuteTemplate.
+func ContextWithNonce(ctx context.Context, nonce string) context.Context {
+	return context.WithValue(ctx, nonceKey{}, nonce)
+}
+
+// Nonce returns the nonce held in the given context, or "" if there is
+// none.
+func Nonce(ctx context.Context) string {
+	nonce, _ := ctx.Value(nonceKey{}).(string)
+	return nonce
+}
+
+// ExecuteTemplate executes the template with the given name from t,
+// in which the "cspNonce" function returns the nonce held in the given
+// context.
+//
+// As a template cannot be cloned once it has been executed, when the
+// context holds a nonce t is cloned and never executed itself.
+func ExecuteTemplate(ctx context.Context, w io.Writer, t *template.Template, name string, data interface{}) error {
+	nonce := Nonce(ctx)
+	if nonce == "" {
+		return errgo.Mask(t.ExecuteTemplate(w, name, data), errgo.Any)
+	}
+	t, err := t.Clone()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	t.Funcs(template.FuncMap{
+		"cspNonce": func() string {
+			return nonce
+		},
+	})
+	return errgo.Mask(t.ExecuteTemplate(w, name, data), errgo.Any)
+}
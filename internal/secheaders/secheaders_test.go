@@ -0,0 +1,135 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package secheaders_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/internal/secheaders"
+)
+
+var newErrorTests = []struct {
+	about       string
+	params      secheaders.Params
+	expectError string
+}{{
+	about: "invalid frame options",
+	params: secheaders.Params{
+		FrameOptions: "ALLOW-FROM https://example.com",
+	},
+	expectError: `invalid frame options "ALLOW-FROM https://example.com"`,
+}, {
+	about: "invalid referrer policy",
+	params: secheaders.Params{
+		ReferrerPolicy: "sometimes",
+	},
+	expectError: `invalid referrer policy "sometimes"`,
+}, {
+	about: "negative max-age",
+	params: secheaders.Params{
+		HSTSMaxAge: -time.Second,
+	},
+	expectError: `negative HSTS max-age`,
+}, {
+	about: "newline in policy",
+	params: secheaders.Params{
+		ContentSecurityPolicy: "default-src 'self'\r\nX-Other: 1",
+	},
+	expectError: `invalid content security policy .*`,
+}}
+
+func TestNewError(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range newErrorTests {
+		c.Run(test.about, func(c *qt.C) {
+			_, err := secheaders.New(test.params)
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+		})
+	}
+}
+
+func TestHTMLResponse(t *testing.T) {
+	c := qt.New(t)
+	p, err := secheaders.New(secheaders.Params{
+		ContentSecurityPolicy: "default-src 'self'; script-src 'self' 'nonce-{nonce}'",
+		HSTSMaxAge:            365 * 24 * time.Hour,
+		HSTSIncludeSubdomains: true,
+		FrameOptions:          "deny",
+		ReferrerPolicy:        "same-origin",
+	})
+	c.Assert(err, qt.Equals, nil)
+	var nonce string
+	rr := httptest.NewRecorder()
+	w, req := p.Wrap(rr, httptest.NewRequest("GET", "/login", nil))
+	nonce = secheaders.Nonce(req.Context())
+	c.Assert(nonce, qt.Not(qt.Equals), "")
+	fmt.Fprintf(w, "<!DOCTYPE html><html></html>")
+	h := rr.Result().Header
+	c.Assert(h.Get("Content-Security-Policy"), qt.Equals, "default-src 'self'; script-src 'self' 'nonce-"+nonce+"'")
+	c.Assert(h.Get("Strict-Transport-Security"), qt.Equals, "max-age=31536000; includeSubDomains")
+	c.Assert(h.Get("X-Frame-Options"), qt.Equals, "DENY")
+	c.Assert(h.Get("Referrer-Policy"), qt.Equals, "same-origin")
+
+	// Each response has a different nonce.
+	_, req = p.Wrap(httptest.NewRecorder(), httptest.NewRequest("GET", "/login", nil))
+	c.Assert(secheaders.Nonce(req.Context()), qt.Not(qt.Equals), nonce)
+}
+
+func TestNonHTMLResponse(t *testing.T) {
+	c := qt.New(t)
+	p, err := secheaders.New(secheaders.Params{
+		ContentSecurityPolicy: "default-src 'self'",
+		FrameOptions:          "SAMEORIGIN",
+	})
+	c.Assert(err, qt.Equals, nil)
+	rr := httptest.NewRecorder()
+	w, _ := p.Wrap(rr, httptest.NewRequest("GET", "/v1/u/bob", nil))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"username":"bob"}`)
+	h := rr.Result().Header
+	c.Assert(h.Get("Content-Security-Policy"), qt.Equals, "")
+	c.Assert(h.Get("X-Frame-Options"), qt.Equals, "")
+}
+
+func TestNoHeaders(t *testing.T) {
+	c := qt.New(t)
+	p, err := secheaders.New(secheaders.Params{})
+	c.Assert(err, qt.Equals, nil)
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/login", nil)
+	w, req1 := p.Wrap(rr, req)
+	c.Assert(w, qt.Equals, http.ResponseWriter(rr))
+	c.Assert(req1, qt.Equals, req)
+}
+
+func TestExecuteTemplate(t *testing.T) {
+	c := qt.New(t)
+	tmpl := template.Must(template.New("").Funcs(template.FuncMap{
+		"cspNonce": func() string { return "" },
+	}).Parse(`{{define "page"}}<script nonce="{{cspNonce}}">{{.}}</script>{{end}}`))
+
+	var buf bytes.Buffer
+	ctx := secheaders.ContextWithNonce(context.Background(), "abc123")
+	err := secheaders.ExecuteTemplate(ctx, &buf, tmpl, "page", "1")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(buf.String(), qt.Equals, `<script nonce="abc123">"1"</script>`)
+
+	// The template can be executed again with a different nonce.
+	buf.Reset()
+	ctx = secheaders.ContextWithNonce(context.Background(), "def456")
+	err = secheaders.ExecuteTemplate(ctx, &buf, tmpl, "page", "2")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(strings.Contains(buf.String(), `nonce="def456"`), qt.Equals, true)
+}
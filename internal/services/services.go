@@ -0,0 +1,300 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package services holds the registry of relying services that use
+// Candid for authentication. The registry records the origins that a
+// service may be returned to after a redirect-based login.
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+)
+
+// StoreName is the name of the provider data key-value store that
+// holds the registered services.
+const StoreName = "_services"
+
+// servicesKey is the key under which all services are stored. The
+// number of services is expected to be small, so they are kept
+// together in order that they can be listed and searched by origin.
+const servicesKey = "services"
+
+// secretsKey is the key under which the hashes of the client secrets
+// of all services are stored. They are kept apart from the services
+// so that they are never returned with them.
+const secretsKey = "secrets"
+
+var (
+	// ErrNotFound is the error cause returned when a service does
+	// not exist.
+	ErrNotFound = errgo.New("service not found")
+
+	// ErrUnauthorized is the error cause returned from
+	// Authenticate when the client secret is wrong.
+	ErrUnauthorized = errgo.New("invalid service credentials")
+)
+
+// A Service holds the registration of a relying service.
+type Service struct {
+	// Name holds the name of the service.
+	Name string `json:"name"`
+
+	// Origins holds the origins, in the form scheme://host[:port],
+	// that users may be returned to after a redirect-based login
+	// for the service.
+	Origins []string `json:"origins,omitempty"`
+
+	// PublicKey holds the public key the service uses in the
+	// third-party caveats it creates, if known.
+	PublicKey *bakery.PublicKey `json:"public-key,omitempty"`
+
+	// Attributes holds the names of the identity attributes that
+	// may be released to the service.
+	Attributes []string `json:"attributes,omitempty"`
+
+	// Contact holds the contact details of the people responsible
+	// for the service.
+	Contact string `json:"contact,omitempty"`
+
+	// LogoutURI holds the address to which back-channel logout
+	// notifications are sent when a session of a user of the
+	// service ends, if any.
+	LogoutURI string `json:"logout-uri,omitempty"`
+}
+
+// Validate checks that the service is well formed.
+func (s Service) Validate() error {
+	if s.Name == "" {
+		return errgo.New("service name not specified")
+	}
+	for _, o := range s.Origins {
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || Origin(u) != strings.ToLower(o) {
+			return errgo.Newf("invalid origin %q", o)
+		}
+	}
+	if s.LogoutURI != "" {
+		u, err := url.Parse(s.LogoutURI)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil || u.Fragment != "" {
+			return errgo.Newf("invalid logout URI %q", s.LogoutURI)
+		}
+	}
+	return nil
+}
+
+// Origin returns the origin, in the form scheme://host[:port], of the
+// given URL. The origin is returned in lower case.
+func Origin(u *url.URL) string {
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// Store stores registered services. It wraps a KeyValueStore.
+type Store struct {
+	store simplekv.Store
+}
+
+// NewStore creates a new Store using the given KeyValueStore for
+// backing storage.
+func NewStore(store simplekv.Store) *Store {
+	return &Store{store: store}
+}
+
+// List returns all services, ordered by name.
+func (s *Store) List(ctx context.Context) ([]Service, error) {
+	v, err := s.store.Get(ctx, servicesKey)
+	if err != nil {
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			return nil, nil
+		}
+		return nil, errgo.Mask(err)
+	}
+	svcs, err := unmarshal(v)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return sorted(svcs), nil
+}
+
+// Get returns the service with the given name. If there is no such
+// service an error with a cause of ErrNotFound is returned.
+func (s *Store) Get(ctx context.Context, name string) (Service, error) {
+	svcs, err := s.List(ctx)
+	if err != nil {
+		return Service{}, errgo.Mask(err)
+	}
+	for _, svc := range svcs {
+		if svc.Name == name {
+			return svc, nil
+		}
+	}
+	return Service{}, errgo.WithCausef(nil, ErrNotFound, "service %q not found", name)
+}
+
+// ForURL returns the service that has registered the origin of the
+// given URL. If no service has registered it an error with a cause of
+// ErrNotFound is returned.
+func (s *Store) ForURL(ctx context.Context, u *url.URL) (Service, error) {
+	svcs, err := s.List(ctx)
+	if err != nil {
+		return Service{}, errgo.Mask(err)
+	}
+	origin := Origin(u)
+	for _, svc := range svcs {
+		for _, o := range svc.Origins {
+			if strings.ToLower(o) == origin {
+				return svc, nil
+			}
+		}
+	}
+	return Service{}, errgo.WithCausef(nil, ErrNotFound, "no service registered for %q", origin)
+}
+
+// Set registers the given service, replacing any existing registration
+// with the same name.
+func (s *Store) Set(ctx context.Context, svc Service) error {
+	if err := svc.Validate(); err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(s.update(ctx, func(svcs map[string]Service) error {
+		svcs[svc.Name] = svc
+		return nil
+	}), errgo.Any)
+}
+
+// Remove removes the service with the given name, along with its
+// client secret. If there is no such service an error with a cause of
+// ErrNotFound is returned.
+func (s *Store) Remove(ctx context.Context, name string) error {
+	err := s.update(ctx, func(svcs map[string]Service) error {
+		if _, ok := svcs[name]; !ok {
+			return errgo.WithCausef(nil, ErrNotFound, "service %q not found", name)
+		}
+		delete(svcs, name)
+		return nil
+	})
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	return errgo.Mask(s.setSecretHash(ctx, name, ""))
+}
+
+// NewSecret generates a new client secret for the service with the
+// given name, replacing any previous secret, and returns it. Only a
+// hash of the secret is stored, so it cannot be retrieved again. If
+// there is no such service an error with a cause of ErrNotFound is
+// returned.
+func (s *Store) NewSecret(ctx context.Context, name string) (string, error) {
+	if _, err := s.Get(ctx, name); err != nil {
+		return "", errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errgo.Mask(err)
+	}
+	secret := base64.RawURLEncoding.EncodeToString(buf)
+	if err := s.setSecretHash(ctx, name, hashSecret(secret)); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return secret, nil
+}
+
+// Authenticate checks that the given secret is the client secret of
+// the service with the given name. If it is not, or the service has no
+// secret, an error with a cause of ErrUnauthorized is returned.
+func (s *Store) Authenticate(ctx context.Context, name, secret string) error {
+	var hashes map[string]string
+	v, err := s.store.Get(ctx, secretsKey)
+	if err != nil && errgo.Cause(err) != simplekv.ErrNotFound {
+		return errgo.Mask(err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(v, &hashes); err != nil {
+			return errgo.Notef(err, "invalid service secrets")
+		}
+	}
+	hash, ok := hashes[name]
+	if !ok || subtle.ConstantTimeCompare([]byte(hash), []byte(hashSecret(secret))) != 1 {
+		return errgo.WithCausef(nil, ErrUnauthorized, "invalid credentials for service %q", name)
+	}
+	return nil
+}
+
+// setSecretHash sets the hash of the client secret of the service with
+// the given name. If hash is empty the service no longer has a secret.
+func (s *Store) setSecretHash(ctx context.Context, name, hash string) error {
+	err := s.store.Update(ctx, secretsKey, time.Time{}, func(old []byte) ([]byte, error) {
+		hashes := make(map[string]string)
+		if len(old) > 0 {
+			if err := json.Unmarshal(old, &hashes); err != nil {
+				return nil, errgo.Notef(err, "invalid service secrets")
+			}
+		}
+		if hash == "" {
+			delete(hashes, name)
+		} else {
+			hashes[name] = hash
+		}
+		return json.Marshal(hashes)
+	})
+	return errgo.Mask(err)
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (s *Store) update(ctx context.Context, f func(map[string]Service) error) error {
+	var ferr error
+	err := s.store.Update(ctx, servicesKey, time.Time{}, func(old []byte) ([]byte, error) {
+		svcs := make(map[string]Service)
+		if len(old) > 0 {
+			var err error
+			svcs, err = unmarshal(old)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
+		ferr = f(svcs)
+		if ferr != nil {
+			return nil, ferr
+		}
+		return json.Marshal(svcs)
+	})
+	if ferr != nil {
+		return ferr
+	}
+	return errgo.Mask(err)
+}
+
+func unmarshal(v []byte) (map[string]Service, error) {
+	svcs := make(map[string]Service)
+	if err := json.Unmarshal(v, &svcs); err != nil {
+		return nil, errgo.Notef(err, "invalid services")
+	}
+	return svcs, nil
+}
+
+func sorted(svcs map[string]Service) []Service {
+	l := make([]Service, 0, len(svcs))
+	for _, svc := range svcs {
+		l = append(l, svc)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Name < l[j].Name
+	})
+	return l
+}
@@ -0,0 +1,187 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package services_test
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/simplekv/memsimplekv"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/internal/services"
+)
+
+func TestStore(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	s := services.NewStore(memsimplekv.NewStore())
+
+	svcs, err := s.List(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(svcs, qt.HasLen, 0)
+
+	dashboard := services.Service{
+		Name:       "dashboard",
+		Origins:    []string{"https://dashboard.example.com", "http://localhost:8080"},
+		Attributes: []string{"email"},
+		Contact:    "ops@example.com",
+	}
+	err = s.Set(ctx, dashboard)
+	c.Assert(err, qt.Equals, nil)
+	err = s.Set(ctx, services.Service{
+		Name: "api",
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	svcs, err = s.List(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(svcs, qt.DeepEquals, []services.Service{{
+		Name: "api",
+	}, dashboard})
+
+	svc, err := s.Get(ctx, "dashboard")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(svc, qt.DeepEquals, dashboard)
+
+	_, err = s.Get(ctx, "nothing")
+	c.Assert(errgo.Cause(err), qt.Equals, services.ErrNotFound)
+
+	err = s.Remove(ctx, "api")
+	c.Assert(err, qt.Equals, nil)
+	err = s.Remove(ctx, "api")
+	c.Assert(errgo.Cause(err), qt.Equals, services.ErrNotFound)
+}
+
+func TestSecrets(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	s := services.NewStore(memsimplekv.NewStore())
+
+	_, err := s.NewSecret(ctx, "dashboard")
+	c.Assert(errgo.Cause(err), qt.Equals, services.ErrNotFound)
+
+	err = s.Set(ctx, services.Service{
+		Name: "dashboard",
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = s.Authenticate(ctx, "dashboard", "")
+	c.Assert(errgo.Cause(err), qt.Equals, services.ErrUnauthorized)
+
+	secret, err := s.NewSecret(ctx, "dashboard")
+	c.Assert(err, qt.Equals, nil)
+	err = s.Authenticate(ctx, "dashboard", secret)
+	c.Assert(err, qt.Equals, nil)
+	err = s.Authenticate(ctx, "dashboard", secret+"x")
+	c.Assert(errgo.Cause(err), qt.Equals, services.ErrUnauthorized)
+	err = s.Authenticate(ctx, "other", secret)
+	c.Assert(errgo.Cause(err), qt.Equals, services.ErrUnauthorized)
+
+	// A new secret replaces the old one.
+	secret1, err := s.NewSecret(ctx, "dashboard")
+	c.Assert(err, qt.Equals, nil)
+	err = s.Authenticate(ctx, "dashboard", secret)
+	c.Assert(errgo.Cause(err), qt.Equals, services.ErrUnauthorized)
+
+	// Removing the service removes its secret.
+	err = s.Remove(ctx, "dashboard")
+	c.Assert(err, qt.Equals, nil)
+	err = s.Set(ctx, services.Service{
+		Name: "dashboard",
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = s.Authenticate(ctx, "dashboard", secret1)
+	c.Assert(errgo.Cause(err), qt.Equals, services.ErrUnauthorized)
+}
+
+func TestForURL(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	s := services.NewStore(memsimplekv.NewStore())
+	err := s.Set(ctx, services.Service{
+		Name:    "dashboard",
+		Origins: []string{"https://dashboard.example.com"},
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	u, err := url.Parse("https://Dashboard.example.com/callback?x=1")
+	c.Assert(err, qt.Equals, nil)
+	svc, err := s.ForURL(ctx, u)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(svc.Name, qt.Equals, "dashboard")
+
+	for _, rurl := range []string{
+		"http://dashboard.example.com/callback",
+		"https://dashboard.example.com:8443/callback",
+		"https://evil.example.com/callback",
+	} {
+		u, err := url.Parse(rurl)
+		c.Assert(err, qt.Equals, nil)
+		_, err = s.ForURL(ctx, u)
+		c.Check(errgo.Cause(err), qt.Equals, services.ErrNotFound, qt.Commentf("%s", rurl))
+	}
+}
+
+var validateTests = []struct {
+	about       string
+	service     services.Service
+	expectError string
+}{{
+	about: "no name",
+	service: services.Service{
+		Origins: []string{"https://example.com"},
+	},
+	expectError: `service name not specified`,
+}, {
+	about: "origin with path",
+	service: services.Service{
+		Name:    "test",
+		Origins: []string{"https://example.com/callback"},
+	},
+	expectError: `invalid origin "https://example.com/callback"`,
+}, {
+	about: "origin with unsupported scheme",
+	service: services.Service{
+		Name:    "test",
+		Origins: []string{"javascript://example.com"},
+	},
+	expectError: `invalid origin "javascript://example.com"`,
+}, {
+	about: "relative logout URI",
+	service: services.Service{
+		Name:      "test",
+		LogoutURI: "/logout",
+	},
+	expectError: `invalid logout URI "/logout"`,
+}, {
+	about: "logout URI with unsupported scheme",
+	service: services.Service{
+		Name:      "test",
+		LogoutURI: "mailto:ops@example.com",
+	},
+	expectError: `invalid logout URI "mailto:ops@example.com"`,
+}, {
+	about: "valid",
+	service: services.Service{
+		Name:      "test",
+		Origins:   []string{"https://example.com", "http://localhost:8080"},
+		LogoutURI: "https://example.com/backchannel-logout",
+	},
+}}
+
+func TestValidate(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range validateTests {
+		c.Run(test.about, func(c *qt.C) {
+			err := test.service.Validate()
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+		})
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package sessions records the discharge tokens issued to each
+// identity, so that users can see where they are logged in and end
+// sessions they do not recognise.
+package sessions
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "gopkg.in/errgo.v1"
+)
+
+// StoreName is the name of the provider data key-value store that
+// holds session records.
+const StoreName = "_sessions"
+
+// maxSessions is the maximum number of sessions recorded for each
+// identity. When it is exceeded the oldest sessions are removed and
+// returned by Add so that their discharge tokens can be revoked.
+const maxSessions = 50
+
+// ErrNotFound is the error cause returned when a session does not
+// exist.
+var ErrNotFound = errgo.New("session not found")
+
+// A Session records a discharge token issued to an identity.
+type Session struct {
+	// ID holds the ID of the discharge token macaroon, encoded as
+	// base64url.
+	ID string `json:"id"`
+
+	// IdentityProvider holds the name of the identity provider used
+	// to log in.
+	IdentityProvider string `json:"identity-provider,omitempty"`
+
+	// Client holds the user agent of the client that logged in.
+	Client string `json:"client,omitempty"`
+
+	// Address holds the IP address of the client that logged in.
+	Address string `json:"address,omitempty"`
+
+	// Service holds the name of the relying service that the user
+	// was logging in to, if it is known.
+	Service string `json:"service,omitempty"`
+
+	// Issued holds the time the discharge token was issued.
+	Issued time.Time `json:"issued"`
+
+	// Expires holds the time the discharge token expires.
+	Expires time.Time `json:"expires"`
+}
+
+// Store stores sessions. It wraps a KeyValueStore.
+type Store struct {
+	store simplekv.Store
+}
+
+// NewStore creates a new Store using the given KeyValueStore for
+// backing storage.
+func NewStore(store simplekv.Store) *Store {
+	return &Store{store: store}
+}
+
+// Add records a new session for the identity with the given username.
+// If the identity then has more than the maximum number of sessions,
+// the oldest are removed and returned. The caller should revoke the
+// discharge tokens of the removed sessions, otherwise they would
+// remain valid without being visible to the user.
+func (s *Store) Add(ctx context.Context, username string, session Session) (removed []Session, _ error) {
+	err := s.update(ctx, username, session.Issued, func(ss []Session) []Session {
+		ss = append(ss, session)
+		removed = nil
+		if len(ss) > maxSessions {
+			removed = append(removed, ss[:len(ss)-maxSessions]...)
+			ss = ss[len(ss)-maxSessions:]
+		}
+		return ss
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return removed, nil
+}
+
+// SetService records the relying service that the session with the
+// given ID, belonging to the identity with the given username, was
+// created for. If there is no such session an error with a cause of
+// ErrNotFound is returned.
+func (s *Store) SetService(ctx context.Context, username, id, service string) error {
+	found := false
+	err := s.update(ctx, username, time.Now(), func(ss []Session) []Session {
+		found = false
+		for i := range ss {
+			if ss[i].ID == id {
+				ss[i].Service = service
+				found = true
+			}
+		}
+		return ss
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if !found {
+		return errgo.WithCausef(nil, ErrNotFound, "session %q not found", id)
+	}
+	return nil
+}
+
+// List returns the sessions of the identity with the given username
+// that have not expired, most recent first.
+func (s *Store) List(ctx context.Context, username string) ([]Session, error) {
+	ss, err := s.get(ctx, username)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	ss = unexpired(ss, time.Now())
+	sort.SliceStable(ss, func(i, j int) bool {
+		return ss[i].Issued.After(ss[j].Issued)
+	})
+	return ss, nil
+}
+
+// Remove removes the session with the given ID from the sessions of
+// the identity with the given username and returns it. If there is no
+// such session an error with a cause of ErrNotFound is returned.
+func (s *Store) Remove(ctx context.Context, username, id string) (*Session, error) {
+	var removed *Session
+	err := s.update(ctx, username, time.Now(), func(ss []Session) []Session {
+		removed = nil
+		for i, session := range ss {
+			if session.ID == id {
+				removed = &session
+				return append(ss[:i], ss[i+1:]...)
+			}
+		}
+		return ss
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if removed == nil {
+		return nil, errgo.WithCausef(nil, ErrNotFound, "session %q not found", id)
+	}
+	return removed, nil
+}
+
+func (s *Store) get(ctx context.Context, username string) ([]Session, error) {
+	v, err := s.store.Get(ctx, username)
+	if err != nil {
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			return nil, nil
+		}
+		return nil, errgo.Mask(err)
+	}
+	var ss []Session
+	if err := json.Unmarshal(v, &ss); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return ss, nil
+}
+
+// update atomically updates the sessions of the given user. Expired
+// sessions are removed before f is called.
+func (s *Store) update(ctx context.Context, username string, now time.Time, f func([]Session) []Session) error {
+	err := s.store.Update(ctx, username, time.Time{}, func(old []byte) ([]byte, error) {
+		var ss []Session
+		if len(old) > 0 {
+			if err := json.Unmarshal(old, &ss); err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
+		return json.Marshal(f(unexpired(ss, now)))
+	})
+	return errgo.Mask(err)
+}
+
+func unexpired(ss []Session, now time.Time) []Session {
+	var result []Session
+	for _, session := range ss {
+		if session.Expires.After(now) {
+			result = append(result, session)
+		}
+	}
+	return result
+}
+
+// A Client holds the details of the client making a request.
+type Client struct {
+	// Address holds the IP address of the client.
+	Address string
+
+	// UserAgent holds the user agent of the client.
+	UserAgent string
+
+	// Country holds the ISO 3166-1 alpha-2 code of the country of
+	// the client's address, if it is known.
+	Country string
+}
+
+// ClientFromRequest returns the details of the client that made the
+// given request.
+func ClientFromRequest(req *http.Request) Client {
+	addr, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		addr = req.RemoteAddr
+	}
+	return Client{
+		Address:   addr,
+		UserAgent: req.Header.Get("User-Agent"),
+	}
+}
+
+type clientKey struct{}
+
+// ContextWithClient returns a context associated with the given client
+// details.
+func ContextWithClient(ctx context.Context, c Client) context.Context {
+	return context.WithValue(ctx, clientKey{}, c)
+}
+
+// ClientFromContext returns the client details associated with the
+// given context. If there are none the zero Client is returned.
+func ClientFromContext(ctx context.Context) Client {
+	c, _ := ctx.Value(clientKey{}).(Client)
+	return c
+}
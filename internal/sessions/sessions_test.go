@@ -0,0 +1,143 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package sessions_test
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/internal/candidtest"
+	"github.com/CanonicalLtd/candid/internal/sessions"
+)
+
+func TestStore(t *testing.T) {
+	qtsuite.Run(qt.New(t), &storeSuite{})
+}
+
+type storeSuite struct {
+	store *sessions.Store
+}
+
+func (s *storeSuite) Init(c *qt.C) {
+	kv, err := candidtest.NewStore().ProviderDataStore.KeyValueStore(context.Background(), "test")
+	c.Assert(err, qt.Equals, nil)
+	s.store = sessions.NewStore(kv)
+}
+
+func (s *storeSuite) TestAddList(c *qt.C) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	for i, id := range []string{"s1", "s2", "expired"} {
+		expires := now.Add(time.Hour)
+		if id == "expired" {
+			expires = now.Add(-time.Minute)
+		}
+		removed, err := s.store.Add(ctx, "bob", sessions.Session{
+			ID:      id,
+			Client:  "test-client",
+			Issued:  now.Add(time.Duration(i-10) * time.Minute),
+			Expires: expires,
+		})
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(removed, qt.HasLen, 0)
+	}
+	ss, err := s.store.List(ctx, "bob")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ss, qt.HasLen, 2)
+	c.Assert(ss[0].ID, qt.Equals, "s2")
+	c.Assert(ss[1].ID, qt.Equals, "s1")
+
+	ss, err = s.store.List(ctx, "alice")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ss, qt.HasLen, 0)
+}
+
+func (s *storeSuite) TestRemove(c *qt.C) {
+	ctx := context.Background()
+	now := time.Now()
+	_, err := s.store.Add(ctx, "bob", sessions.Session{
+		ID:      "s1",
+		Issued:  now,
+		Expires: now.Add(time.Hour),
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	session, err := s.store.Remove(ctx, "bob", "s1")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(session.ID, qt.Equals, "s1")
+
+	_, err = s.store.Remove(ctx, "bob", "s1")
+	c.Assert(err, qt.ErrorMatches, `session "s1" not found`)
+	c.Assert(errgo.Cause(err), qt.Equals, sessions.ErrNotFound)
+}
+
+func (s *storeSuite) TestAddRemovesOldest(c *qt.C) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	for i := 0; i < sessions.MaxSessions; i++ {
+		removed, err := s.store.Add(ctx, "bob", sessions.Session{
+			ID:      fmt.Sprintf("s%d", i),
+			Issued:  now.Add(time.Duration(i) * time.Second),
+			Expires: now.Add(time.Hour),
+		})
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(removed, qt.HasLen, 0)
+	}
+	removed, err := s.store.Add(ctx, "bob", sessions.Session{
+		ID:      "new",
+		Issued:  now.Add(time.Hour),
+		Expires: now.Add(2 * time.Hour),
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(removed, qt.HasLen, 1)
+	c.Assert(removed[0].ID, qt.Equals, "s0")
+
+	ss, err := s.store.List(ctx, "bob")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ss, qt.HasLen, sessions.MaxSessions)
+	c.Assert(ss[0].ID, qt.Equals, "new")
+	c.Assert(ss[len(ss)-1].ID, qt.Equals, "s1")
+}
+
+func (s *storeSuite) TestSetService(c *qt.C) {
+	ctx := context.Background()
+	now := time.Now()
+	_, err := s.store.Add(ctx, "bob", sessions.Session{
+		ID:      "s1",
+		Issued:  now,
+		Expires: now.Add(time.Hour),
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	err = s.store.SetService(ctx, "bob", "s1", "https://service.example.com")
+	c.Assert(err, qt.Equals, nil)
+	ss, err := s.store.List(ctx, "bob")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ss, qt.HasLen, 1)
+	c.Assert(ss[0].Service, qt.Equals, "https://service.example.com")
+
+	err = s.store.SetService(ctx, "bob", "s2", "https://service.example.com")
+	c.Assert(errgo.Cause(err), qt.Equals, sessions.ErrNotFound)
+}
+
+func TestClientFromRequest(t *testing.T) {
+	c := qt.New(t)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("User-Agent", "test-agent")
+	client := sessions.ClientFromRequest(req)
+	c.Assert(client, qt.Equals, sessions.Client{
+		Address:   "192.0.2.1",
+		UserAgent: "test-agent",
+	})
+	ctx := sessions.ContextWithClient(context.Background(), client)
+	c.Assert(sessions.ClientFromContext(ctx), qt.Equals, client)
+}
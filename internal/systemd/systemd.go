@@ -0,0 +1,149 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package systemd implements the parts of the systemd service protocol
+// used by candidsrv: socket activation (see sd_listen_fds(3)) and
+// service status notification (see sd_notify(3)).
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// Notification states understood by systemd.
+const (
+	// Ready tells systemd that the service has finished starting.
+	Ready = "READY=1"
+
+	// Stopping tells systemd that the service is shutting down.
+	Stopping = "STOPPING=1"
+
+	// Watchdog resets the systemd watchdog timer.
+	Watchdog = "WATCHDOG=1"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// A Listener is a listening socket passed by systemd.
+type Listener struct {
+	net.Listener
+
+	// Name holds the name of the socket, which is set with
+	// FileDescriptorName in the socket unit.
+	Name string
+}
+
+// Listeners returns the listening sockets passed to the process by
+// systemd socket activation, in the order they are configured in the
+// socket unit. If the process was not socket activated, no listeners
+// are returned. The environment variables used to pass the sockets are
+// unset so that they are not inherited by child processes.
+func Listeners() ([]Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	listeners := make([]Listener, 0, n)
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i := fd - listenFDsStart; i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		// FileListener duplicates the file descriptor so the
+		// original can always be closed.
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, errgo.Notef(err, "cannot use socket %q", name)
+		}
+		listeners = append(listeners, Listener{
+			Listener: l,
+			Name:     name,
+		})
+	}
+	return listeners, nil
+}
+
+// Notify sends the given state to systemd. It reports whether the
+// notification was sent, which it will not be if the process is not
+// running under a systemd service that expects notifications.
+func Notify(state string) (bool, error) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return false, nil
+	}
+	if addr[0] == '@' {
+		// An abstract socket.
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{
+		Name: addr,
+		Net:  "unixgram",
+	})
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, errgo.Mask(err)
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the interval within which systemd expects
+// to receive Watchdog notifications. If the watchdog is not enabled
+// for the process, it returns zero.
+func WatchdogInterval() time.Duration {
+	if s := os.Getenv("WATCHDOG_PID"); s != "" {
+		pid, err := strconv.Atoi(s)
+		if err != nil || pid != os.Getpid() {
+			return 0
+		}
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// RunWatchdog sends Watchdog notifications to systemd at half the
+// watchdog interval until the given channel is closed. If the watchdog
+// is not enabled, it returns immediately.
+func RunWatchdog(stop <-chan struct{}) {
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			Notify(Watchdog)
+		case <-stop:
+			return
+		}
+	}
+}
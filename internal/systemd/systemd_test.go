@@ -0,0 +1,79 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package systemd_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/internal/systemd"
+)
+
+func TestNotify(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	path := filepath.Join(c.Mkdir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	c.Assert(err, qt.Equals, nil)
+	defer conn.Close()
+	c.Setenv("NOTIFY_SOCKET", path)
+
+	sent, err := systemd.Notify(systemd.Ready)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(sent, qt.Equals, true)
+
+	buf := make([]byte, 100)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(buf[:n]), qt.Equals, "READY=1")
+}
+
+func TestNotifyNoSocket(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	c.Setenv("NOTIFY_SOCKET", "")
+	sent, err := systemd.Notify(systemd.Ready)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(sent, qt.Equals, false)
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	c.Setenv("WATCHDOG_USEC", "30000000")
+	c.Setenv("WATCHDOG_PID", "")
+	c.Assert(systemd.WatchdogInterval(), qt.Equals, 30*time.Second)
+
+	c.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	c.Assert(systemd.WatchdogInterval(), qt.Equals, 30*time.Second)
+
+	c.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	c.Assert(systemd.WatchdogInterval(), qt.Equals, time.Duration(0))
+
+	c.Setenv("WATCHDOG_PID", "")
+	c.Setenv("WATCHDOG_USEC", "")
+	c.Assert(systemd.WatchdogInterval(), qt.Equals, time.Duration(0))
+}
+
+func TestListenersNotActivated(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	c.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	c.Setenv("LISTEN_FDS", "1")
+	ls, err := systemd.Listeners()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ls, qt.HasLen, 0)
+	c.Assert(os.Getenv("LISTEN_FDS"), qt.Equals, "")
+}
@@ -0,0 +1,228 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package throttle implements a concurrency limiter that shares its
+// capacity fairly between keys using weighted fair queueing. When the
+// limit is reached, waiting requests are admitted in order of their
+// virtual finish time, so a single key that makes many requests cannot
+// starve the other keys.
+package throttle
+
+import (
+	"container/heap"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+)
+
+// ErrThrottled is the error cause returned when a request cannot be
+// admitted.
+var ErrThrottled error = throttledError{}
+
+type throttledError struct{}
+
+// Error implements error.
+func (throttledError) Error() string {
+	return "too many requests"
+}
+
+// ErrorCode returns the code used when the error is returned from the
+// API.
+func (throttledError) ErrorCode() params.ErrorCode {
+	return params.ErrServiceUnavailable
+}
+
+// SetHeader implements httprequest.HeaderSetter by asking the client
+// to retry later.
+func (throttledError) SetHeader(h http.Header) {
+	h.Set("Retry-After", "1")
+}
+
+// Params holds the configuration of a Limiter.
+type Params struct {
+	// MaxConcurrent holds the maximum number of requests that are
+	// processed concurrently. If this is zero then requests are
+	// never throttled.
+	MaxConcurrent int
+
+	// MaxQueue holds the maximum number of requests for each key
+	// that may wait to be processed. Further requests are rejected
+	// immediately. If this is zero then requests are rejected
+	// whenever the limit is reached.
+	MaxQueue int
+
+	// MaxWait holds the maximum time that a request waits to be
+	// processed before it is rejected. If this is zero then
+	// requests wait until their context is done.
+	MaxWait time.Duration
+
+	// Weights holds the relative share of capacity given to each
+	// key when requests are waiting. Keys that are not listed have a
+	// weight of 1.
+	Weights map[string]int
+}
+
+// A Limiter limits the number of requests that are processed
+// concurrently.
+type Limiter struct {
+	p Params
+
+	mu      sync.Mutex
+	active  int
+	vtime   float64
+	finish  map[string]float64
+	queued  map[string]int
+	waiters waiterHeap
+	seq     uint64
+}
+
+// New returns a new Limiter with the given parameters.
+func New(p Params) *Limiter {
+	return &Limiter{
+		p:      p,
+		finish: make(map[string]float64),
+		queued: make(map[string]int),
+	}
+}
+
+// Acquire waits until a request with the given key may be processed.
+// If the request is admitted, the returned function must be called
+// when the request is complete. If the request cannot be admitted, an
+// error with a cause of ErrThrottled is returned.
+func (l *Limiter) Acquire(ctx context.Context, key string) (release func(), _ error) {
+	if l.p.MaxConcurrent <= 0 {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	if l.active < l.p.MaxConcurrent && len(l.waiters) == 0 {
+		l.active++
+		l.mu.Unlock()
+		return l.release, nil
+	}
+	if l.queued[key] >= l.p.MaxQueue {
+		l.mu.Unlock()
+		return nil, errgo.WithCausef(nil, ErrThrottled, "too many requests for %s", key)
+	}
+	start := l.vtime
+	if f := l.finish[key]; f > start {
+		start = f
+	}
+	w := &waiter{
+		key:   key,
+		tag:   start + 1/float64(l.weight(key)),
+		seq:   l.seq,
+		ready: make(chan struct{}),
+	}
+	l.seq++
+	l.finish[key] = w.tag
+	l.queued[key]++
+	heap.Push(&l.waiters, w)
+	l.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if l.p.MaxWait > 0 {
+		t := time.NewTimer(l.p.MaxWait)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-w.ready:
+		return l.release, nil
+	case <-timeout:
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w.index < 0 {
+		// The request was admitted while we were timing out.
+		return l.release, nil
+	}
+	heap.Remove(&l.waiters, w.index)
+	l.queued[key]--
+	l.cleanup(key)
+	return nil, errgo.WithCausef(nil, ErrThrottled, "timed out waiting to process request for %s", key)
+}
+
+// release marks a request as complete, passing its slot to the next
+// waiting request if there is one.
+func (l *Limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiters) == 0 {
+		l.active--
+		return
+	}
+	w := heap.Pop(&l.waiters).(*waiter)
+	l.vtime = w.tag
+	l.queued[w.key]--
+	l.cleanup(w.key)
+	close(w.ready)
+}
+
+// cleanup removes the state held for the given key if there are no
+// longer any requests waiting for it.
+func (l *Limiter) cleanup(key string) {
+	if l.queued[key] > 0 {
+		return
+	}
+	delete(l.queued, key)
+	if l.finish[key] <= l.vtime {
+		delete(l.finish, key)
+	}
+}
+
+func (l *Limiter) weight(key string) int {
+	if w := l.p.Weights[key]; w > 0 {
+		return w
+	}
+	return 1
+}
+
+// A waiter is a request waiting to be processed.
+type waiter struct {
+	key   string
+	tag   float64
+	seq   uint64
+	ready chan struct{}
+	index int
+}
+
+// waiterHeap implements heap.Interface, ordering waiters by their
+// finish tag.
+type waiterHeap []*waiter
+
+func (h waiterHeap) Len() int {
+	return len(h)
+}
+
+func (h waiterHeap) Less(i, j int) bool {
+	if h[i].tag != h[j].tag {
+		return h[i].tag < h[j].tag
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *waiterHeap) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *waiterHeap) Pop() interface{} {
+	old := *h
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*h = old[:len(old)-1]
+	return w
+}
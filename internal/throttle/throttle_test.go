@@ -0,0 +1,154 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package throttle_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/internal/throttle"
+)
+
+func TestUnlimited(t *testing.T) {
+	c := qt.New(t)
+	l := throttle.New(throttle.Params{})
+	for i := 0; i < 100; i++ {
+		_, err := l.Acquire(context.Background(), "a")
+		c.Assert(err, qt.Equals, nil)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	c := qt.New(t)
+	l := throttle.New(throttle.Params{
+		MaxConcurrent: 1,
+		MaxQueue:      1,
+	})
+	release, err := l.Acquire(context.Background(), "a")
+	c.Assert(err, qt.Equals, nil)
+	done := make(chan error)
+	go func() {
+		release, err := l.Acquire(context.Background(), "a")
+		if err == nil {
+			release()
+		}
+		done <- err
+	}()
+	waitQueued(c, l, 1)
+
+	_, err = l.Acquire(context.Background(), "a")
+	c.Assert(err, qt.ErrorMatches, `too many requests for a`)
+	c.Assert(errgo.Cause(err), qt.Equals, throttle.ErrThrottled)
+
+	release()
+	c.Assert(<-done, qt.Equals, nil)
+}
+
+func TestMaxWait(t *testing.T) {
+	c := qt.New(t)
+	l := throttle.New(throttle.Params{
+		MaxConcurrent: 1,
+		MaxQueue:      1,
+		MaxWait:       10 * time.Millisecond,
+	})
+	release, err := l.Acquire(context.Background(), "a")
+	c.Assert(err, qt.Equals, nil)
+	_, err = l.Acquire(context.Background(), "b")
+	c.Assert(err, qt.ErrorMatches, `timed out waiting to process request for b`)
+	c.Assert(errgo.Cause(err), qt.Equals, throttle.ErrThrottled)
+	c.Assert(throttle.Queued(l), qt.Equals, 0)
+	release()
+
+	// The slot is available again.
+	release, err = l.Acquire(context.Background(), "b")
+	c.Assert(err, qt.Equals, nil)
+	release()
+}
+
+func TestContextDone(t *testing.T) {
+	c := qt.New(t)
+	l := throttle.New(throttle.Params{
+		MaxConcurrent: 1,
+		MaxQueue:      1,
+	})
+	release, err := l.Acquire(context.Background(), "a")
+	c.Assert(err, qt.Equals, nil)
+	defer release()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = l.Acquire(ctx, "a")
+	c.Assert(errgo.Cause(err), qt.Equals, throttle.ErrThrottled)
+	c.Assert(throttle.Queued(l), qt.Equals, 0)
+}
+
+var fairnessTests = []struct {
+	about   string
+	weights map[string]int
+	keys    []string
+	expect  []string
+}{{
+	about:  "equal weights",
+	keys:   []string{"a", "a", "a", "a", "b"},
+	expect: []string{"a", "b", "a", "a", "a"},
+}, {
+	about:   "weighted",
+	weights: map[string]int{"b": 2},
+	keys:    []string{"a", "a", "a", "b", "b", "b"},
+	expect:  []string{"b", "a", "b", "b", "a", "a"},
+}, {
+	about:  "three keys",
+	keys:   []string{"a", "a", "a", "b", "b", "c"},
+	expect: []string{"a", "b", "c", "a", "b", "a"},
+}}
+
+func TestFairness(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range fairnessTests {
+		c.Run(test.about, func(c *qt.C) {
+			l := throttle.New(throttle.Params{
+				MaxConcurrent: 1,
+				MaxQueue:      len(test.keys),
+				Weights:       test.weights,
+			})
+			release, err := l.Acquire(context.Background(), "x")
+			c.Assert(err, qt.Equals, nil)
+
+			got := make(chan string)
+			for i, key := range test.keys {
+				key := key
+				go func() {
+					release, err := l.Acquire(context.Background(), key)
+					if err != nil {
+						got <- err.Error()
+						return
+					}
+					got <- key
+					release()
+				}()
+				waitQueued(c, l, i+1)
+			}
+			release()
+			var keys []string
+			for range test.keys {
+				keys = append(keys, <-got)
+			}
+			c.Assert(keys, qt.DeepEquals, test.expect)
+		})
+	}
+}
+
+// waitQueued waits until n requests are waiting in l.
+func waitQueued(c *qt.C, l *throttle.Limiter, n int) {
+	for i := 0; i < 1000; i++ {
+		if throttle.Queued(l) == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Fatalf("timed out waiting for %d queued requests", n)
+}
@@ -0,0 +1,196 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package typedyaml helps to unmarshal YAML mappings whose "type" field
+// selects a registered implementation, such as the configuration of
+// identity providers and storage backends.
+package typedyaml
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// A Mapping holds a YAML mapping whose "type" field selects the value
+// that its other fields are decoded into.
+type Mapping struct {
+	// Type holds the value of the "type" field.
+	Type string
+
+	unmarshal func(interface{}) error
+	strict    bool
+	rest      yaml.MapSlice
+	data      []byte
+	errors    []string
+}
+
+// Unmarshal reads the "type" field of the mapping decoded by the given
+// unmarshal function, as passed to an UnmarshalYAML method, and returns
+// a Mapping that decodes the mapping's other fields.
+//
+// When the document is being decoded strictly, as by
+// yaml.UnmarshalStrict, the Mapping reports the fields that are not
+// known to the value it decodes into, along with those that are, from
+// its Err method. Otherwise it decodes the whole mapping, including
+// "type", as before.
+func Unmarshal(unmarshal func(interface{}) error) (*Mapping, error) {
+	var fields yaml.MapSlice
+	if err := unmarshal(&fields); err != nil {
+		return nil, err
+	}
+	m := &Mapping{
+		unmarshal: unmarshal,
+	}
+	for _, f := range fields {
+		if f.Key != "type" {
+			m.rest = append(m.rest, f)
+			continue
+		}
+		if f.Value != nil {
+			m.Type = fmt.Sprint(f.Value)
+		}
+	}
+	// A strict decoder will not decode a non-empty mapping into an
+	// empty struct.
+	if len(fields) == 0 || unmarshal(&struct{}{}) == nil {
+		return m, nil
+	}
+	data, err := yaml.Marshal(m.rest)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	m.strict = true
+	m.data = data
+	return m, nil
+}
+
+// Unmarshal decodes the fields of the mapping other than "type" into
+// v. When the mapping is decoded strictly, fields that are not known to
+// v are recorded to be returned by Err, and the known fields are still
+// decoded so that the rest of the configuration can be checked.
+func (m *Mapping) Unmarshal(v interface{}) error {
+	if !m.strict {
+		return m.unmarshal(v)
+	}
+	strictErr := yaml.UnmarshalStrict(m.data, v)
+	if strictErr == nil {
+		return nil
+	}
+	terr, ok := strictErr.(*yaml.TypeError)
+	if !ok {
+		return strictErr
+	}
+	if err := yaml.Unmarshal(m.data, v); err != nil {
+		return err
+	}
+	if unknown, known := unknownFields(m.rest, v); len(unknown) > 0 {
+		m.errors = append(m.errors, m.unknownFieldsMessage(unknown, known))
+	} else {
+		m.errors = append(m.errors, terr.Errors...)
+	}
+	return nil
+}
+
+// Err returns a *yaml.TypeError describing the fields that were not
+// recognised by Unmarshal, or nil if there were none. It should be
+// returned from the UnmarshalYAML method once the mapping has been
+// decoded. The decoding of a document continues after an
+// UnmarshalYAML method returns a *yaml.TypeError, so every
+// unrecognised field in the document is reported together.
+func (m *Mapping) Err() error {
+	if len(m.errors) == 0 {
+		return nil
+	}
+	return &yaml.TypeError{
+		Errors: m.errors,
+	}
+}
+
+// unknownFields returns the names of the given fields that are not
+// known to the struct that v points to, and the names of those that
+// are known. It returns no unknown fields if v does not point to a
+// struct or if the struct accepts any field.
+func unknownFields(fields yaml.MapSlice, v interface{}) (unknown, known []string) {
+	t := reflect.TypeOf(v)
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return nil, nil
+	}
+	names := make(map[string]bool)
+	if !fieldNames(t.Elem(), names) {
+		return nil, nil
+	}
+	for _, f := range fields {
+		name := fmt.Sprint(f.Key)
+		if !names[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	for name := range names {
+		known = append(known, name)
+	}
+	sort.Strings(known)
+	return unknown, known
+}
+
+// fieldNames adds the YAML field names of the given struct type to
+// names, following the rules of gopkg.in/yaml.v2. It returns false if
+// the struct has an inline map, and so accepts any field.
+func fieldNames(t reflect.Type, names map[string]bool) bool {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		tag := f.Tag.Get("yaml")
+		if tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		inline := false
+		for _, flag := range parts[1:] {
+			if flag == "inline" {
+				inline = true
+			}
+		}
+		if inline {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() != reflect.Struct {
+				return false
+			}
+			if !fieldNames(ft, names) {
+				return false
+			}
+			continue
+		}
+		if parts[0] != "" {
+			names[parts[0]] = true
+		} else {
+			names[strings.ToLower(f.Name)] = true
+		}
+	}
+	return true
+}
+
+func (m *Mapping) unknownFieldsMessage(unknown, known []string) string {
+	quoted := make([]string, len(unknown))
+	for i, name := range unknown {
+		quoted[i] = fmt.Sprintf("%q", name)
+	}
+	field := "field"
+	if len(unknown) > 1 {
+		field = "fields"
+	}
+	msg := fmt.Sprintf("unknown %s %s (valid fields are %s)", field, strings.Join(quoted, ", "), strings.Join(known, ", "))
+	if m.Type != "" {
+		msg = m.Type + " configuration: " + msg
+	}
+	return msg
+}
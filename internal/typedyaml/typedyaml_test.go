@@ -0,0 +1,117 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package typedyaml_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/yaml.v2"
+
+	"github.com/CanonicalLtd/candid/internal/typedyaml"
+)
+
+type params struct {
+	Name   string `yaml:"name"`
+	URL    string `yaml:"url"`
+	Hidden string `yaml:"-"`
+}
+
+type section struct {
+	Type   string
+	Params params
+}
+
+func (s *section) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	m, err := typedyaml.Unmarshal(unmarshal)
+	if err != nil {
+		return err
+	}
+	s.Type = m.Type
+	if err := m.Unmarshal(&s.Params); err != nil {
+		return err
+	}
+	return m.Err()
+}
+
+var unmarshalTests = []struct {
+	about       string
+	strict      bool
+	data        string
+	expect      section
+	expectError string
+}{{
+	about: "lenient",
+	data:  "type: test\nname: a\nurl: http://example.com\nother: b\n",
+	expect: section{
+		Type: "test",
+		Params: params{
+			Name: "a",
+			URL:  "http://example.com",
+		},
+	},
+}, {
+	about:  "strict",
+	strict: true,
+	data:   "type: test\nname: a\nurl: http://example.com\n",
+	expect: section{
+		Type: "test",
+		Params: params{
+			Name: "a",
+			URL:  "http://example.com",
+		},
+	},
+}, {
+	about:  "strict type only",
+	strict: true,
+	data:   "type: test\n",
+	expect: section{
+		Type: "test",
+	},
+}, {
+	about:       "strict unknown field",
+	strict:      true,
+	data:        "type: test\nname: a\nusr: http://example.com\n",
+	expectError: `yaml: unmarshal errors:\n  test configuration: unknown field "usr" \(valid fields are name, url\)`,
+}, {
+	about:       "strict unknown fields",
+	strict:      true,
+	data:        "type: test\nnmae: a\nusr: http://example.com\n",
+	expectError: `yaml: unmarshal errors:\n  test configuration: unknown fields "nmae", "usr" \(valid fields are name, url\)`,
+}}
+
+func TestUnmarshal(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range unmarshalTests {
+		c.Run(test.about, func(c *qt.C) {
+			unmarshal := yaml.Unmarshal
+			if test.strict {
+				unmarshal = yaml.UnmarshalStrict
+			}
+			var s section
+			err := unmarshal([]byte(test.data), &s)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(s, qt.DeepEquals, test.expect)
+		})
+	}
+}
+
+func TestUnmarshalStrictReportsAllUnknownFields(t *testing.T) {
+	c := qt.New(t)
+	var doc struct {
+		A section `yaml:"a"`
+		B section `yaml:"b"`
+	}
+	err := yaml.UnmarshalStrict([]byte("a:\n  type: x\n  nmae: a\n  url: http://a.example.com\nb:\n  type: y\n  usr: b\nc: d\n"), &doc)
+	c.Assert(err, qt.ErrorMatches, `yaml: unmarshal errors:
+  x configuration: unknown field "nmae" \(valid fields are name, url\)
+  y configuration: unknown field "usr" \(valid fields are name, url\)
+  line 8: field c not found in type .*`)
+	// The known fields are still decoded.
+	c.Assert(doc.A.Params.URL, qt.Equals, "http://a.example.com")
+}
@@ -0,0 +1,336 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/internal/accessrequest"
+	"github.com/CanonicalLtd/candid/internal/groupgrant"
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/notify"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// notifyTimeout holds the maximum time allowed to send a notification.
+const notifyTimeout = time.Minute
+
+// accessRequestsRequest is a request for all pending requests for
+// group membership.
+type accessRequestsRequest struct {
+	httprequest.Route `httprequest:"GET /v1/access-requests"`
+}
+
+// userAccessRequestsRequest is a request for the pending requests for
+// group membership made by a user.
+type userAccessRequestsRequest struct {
+	httprequest.Route `httprequest:"GET /v1/u/:username/access-requests"`
+	Username          params.Username `httprequest:"username,path"`
+}
+
+// accessRequestsResponse holds pending requests for group membership,
+// oldest first.
+type accessRequestsResponse struct {
+	Requests []accessrequest.Request `json:"requests"`
+}
+
+// requestAccessRequest is a request by a user to be made a member of
+// a group.
+type requestAccessRequest struct {
+	httprequest.Route `httprequest:"PUT /v1/u/:username/access-requests/:group"`
+	Username          params.Username   `httprequest:"username,path"`
+	Group             string            `httprequest:"group,path"`
+	Body              requestAccessBody `httprequest:",body"`
+}
+
+// requestAccessBody holds the body of a requestAccessRequest.
+type requestAccessBody struct {
+	// Reason holds the reason the user needs membership of the
+	// group, which is shown to the approvers.
+	Reason string `json:"reason,omitempty"`
+}
+
+// approveAccessRequest is a request to approve a pending request for
+// group membership.
+type approveAccessRequest struct {
+	httprequest.Route `httprequest:"POST /v1/u/:username/access-requests/:group/approve"`
+	Username          params.Username   `httprequest:"username,path"`
+	Group             string            `httprequest:"group,path"`
+	Body              approveAccessBody `httprequest:",body"`
+}
+
+// approveAccessBody holds the body of an approveAccessRequest.
+type approveAccessBody struct {
+	// Expires, if set, holds the time at which the membership is
+	// removed. See GrantGroup.
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// denyAccessRequest is a request to deny a pending request for group
+// membership.
+type denyAccessRequest struct {
+	httprequest.Route `httprequest:"POST /v1/u/:username/access-requests/:group/deny"`
+	Username          params.Username `httprequest:"username,path"`
+	Group             string          `httprequest:"group,path"`
+}
+
+// AccessRequests returns all pending requests for group membership.
+func (h *handler) AccessRequests(p httprequest.Params, r *accessRequestsRequest) (*accessRequestsResponse, error) {
+	s, err := h.accessRequestStore(p.Context)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	rs, err := s.List(p.Context)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &accessRequestsResponse{Requests: rs}, nil
+}
+
+// UserAccessRequests returns the pending requests for group membership
+// made by the given user.
+func (h *handler) UserAccessRequests(p httprequest.Params, r *userAccessRequestsRequest) (*accessRequestsResponse, error) {
+	s, err := h.accessRequestStore(p.Context)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	rs, err := s.List(p.Context)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp := accessRequestsResponse{
+		Requests: []accessrequest.Request{},
+	}
+	for _, ar := range rs {
+		if ar.Username == string(r.Username) {
+			resp.Requests = append(resp.Requests, ar)
+		}
+	}
+	return &resp, nil
+}
+
+// RequestAccess records a request by the user for membership of the
+// group and notifies the owners of the group, or the administrators if
+// it has none, who may approve or deny it.
+func (h *handler) RequestAccess(p httprequest.Params, r *requestAccessRequest) error {
+	id := store.Identity{Username: string(r.Username)}
+	if err := h.params.Store.Identity(p.Context, &id); err != nil {
+		return translateStoreError(err)
+	}
+	for _, g := range id.Groups {
+		if g == r.Group {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "%s is already a member of %s", r.Username, r.Group)
+		}
+	}
+	s, err := h.accessRequestStore(p.Context)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	err = s.Add(p.Context, accessrequest.Request{
+		Username: string(r.Username),
+		Group:    r.Group,
+		Reason:   r.Body.Reason,
+		Created:  time.Now(),
+	})
+	if errgo.Cause(err) == accessrequest.ErrDuplicate {
+		return errgo.WithCausef(err, params.ErrAlreadyExists, "")
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	logging.FromContext(p.Context, auditLogger).Infof("%s requested membership of %s: %s", r.Username, r.Group, r.Body.Reason)
+	h.notifyApprovers(p.Context, string(r.Username), r.Group, r.Body.Reason)
+	return nil
+}
+
+// notifyApprovers sends an access request to the owners of the group
+// that have email addresses, or to the administrators if there are
+// none.
+func (h *handler) notifyApprovers(ctx context.Context, username, group, reason string) {
+	if h.params.Notifier == nil {
+		return
+	}
+	url := h.params.Location + "/access-requests"
+	var to []string
+	owners, err := h.owners(ctx, group)
+	if err != nil {
+		// Send the request to the administrators instead.
+		logging.FromContext(ctx, logger).Errorf("cannot get owners of %s: %s", group, err)
+	}
+	for _, owner := range owners {
+		// Owners that are groups are not expanded, their
+		// members are expected to look at the access requests
+		// page.
+		id := store.Identity{Username: owner}
+		if err := h.params.Store.Identity(ctx, &id); err == nil && id.Email != "" {
+			to = append(to, id.Email)
+		}
+	}
+	if len(to) == 0 {
+		subject := fmt.Sprintf("%s requests membership of %s", username, group)
+		text := fmt.Sprintf("%s has requested membership of the group %s.\n\nReason: %s\n\nApprove or deny the request at %s\n", username, group, reason, url)
+		h.sendNotification("access request", func(ctx context.Context) error {
+			return h.params.Notifier.NotifyAdmins(ctx, subject, text)
+		})
+		return
+	}
+	data := struct {
+		Username string
+		Group    string
+		Reason   string
+		URL      string
+	}{
+		Username: username,
+		Group:    group,
+		Reason:   reason,
+		URL:      url,
+	}
+	h.sendNotification("access request", func(ctx context.Context) error {
+		return h.params.Notifier.Notify(ctx, notify.KindAccessRequest, to, data)
+	})
+}
+
+// ApproveAccess approves a pending request for group membership and
+// makes the user a member of the group. If an expiry time is given the
+// membership is time-limited, as if made by GrantGroup.
+func (h *handler) ApproveAccess(p httprequest.Params, r *approveAccessRequest) error {
+	if !r.Body.Expires.IsZero() && !r.Body.Expires.After(time.Now()) {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "expiry time must be in the future")
+	}
+	s, err := h.accessRequestStore(p.Context)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := s.Get(p.Context, string(r.Username), r.Group); err != nil {
+		if errgo.Cause(err) == accessrequest.ErrNotFound {
+			return errgo.WithCausef(err, params.ErrNotFound, "")
+		}
+		return errgo.Mask(err)
+	}
+	var approvedBy string
+	if id := identityFromContext(p.Context); id != nil {
+		approvedBy = id.Id()
+	}
+	if r.Body.Expires.IsZero() {
+		err = h.params.Store.UpdateIdentity(p.Context, &store.Identity{
+			Username: string(r.Username),
+			Groups:   []string{r.Group},
+		}, store.Update{
+			store.Groups: store.Push,
+		})
+	} else {
+		err = h.params.GroupGrants.Grant(p.Context, groupgrant.Grant{
+			Username:  string(r.Username),
+			Group:     r.Group,
+			Expires:   r.Body.Expires,
+			GrantedBy: approvedBy,
+			Reason:    "access request",
+		})
+	}
+	if errgo.Cause(err) == groupgrant.ErrAlreadyMember {
+		// The user has been made a permanent member since making
+		// the request, so there is nothing to do.
+		err = nil
+	}
+	if err != nil {
+		return translateStoreError(err)
+	}
+	// The membership is added before the request is removed so that a
+	// failure leaves the request to be approved again.
+	if err := s.Remove(p.Context, string(r.Username), r.Group); err != nil && errgo.Cause(err) != accessrequest.ErrNotFound {
+		return errgo.Mask(err)
+	}
+	h.responses.invalidate(string(r.Username))
+	expires := ""
+	if !r.Body.Expires.IsZero() {
+		expires = r.Body.Expires.UTC().Format(time.RFC3339)
+		logging.FromContext(p.Context, auditLogger).Infof("%s approved %s membership of %s until %s", approvedBy, r.Username, r.Group, expires)
+	} else {
+		logging.FromContext(p.Context, auditLogger).Infof("%s approved %s membership of %s", approvedBy, r.Username, r.Group)
+	}
+	h.notifyDecision(p.Context, string(r.Username), r.Group, true, approvedBy, expires)
+	return nil
+}
+
+// DenyAccess denies a pending request for group membership.
+func (h *handler) DenyAccess(p httprequest.Params, r *denyAccessRequest) error {
+	s, err := h.accessRequestStore(p.Context)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.Remove(p.Context, string(r.Username), r.Group); err != nil {
+		if errgo.Cause(err) == accessrequest.ErrNotFound {
+			return errgo.WithCausef(err, params.ErrNotFound, "")
+		}
+		return errgo.Mask(err)
+	}
+	var deniedBy string
+	if id := identityFromContext(p.Context); id != nil {
+		deniedBy = id.Id()
+	}
+	logging.FromContext(p.Context, auditLogger).Infof("%s denied %s membership of %s", deniedBy, r.Username, r.Group)
+	h.notifyDecision(p.Context, string(r.Username), r.Group, false, deniedBy, "")
+	return nil
+}
+
+// notifyDecision tells the user that made an access request whether it
+// was approved.
+func (h *handler) notifyDecision(ctx context.Context, username, group string, approved bool, decidedBy, expires string) {
+	if h.params.Notifier == nil {
+		return
+	}
+	id := store.Identity{Username: username}
+	if err := h.params.Store.Identity(ctx, &id); err != nil {
+		logging.FromContext(ctx, logger).Errorf("cannot get identity %q: %s", username, err)
+		return
+	}
+	if id.Email == "" {
+		return
+	}
+	data := struct {
+		Name      string
+		Group     string
+		Approved  bool
+		DecidedBy string
+		Expires   string
+	}{
+		Name:      id.Name,
+		Group:     group,
+		Approved:  approved,
+		DecidedBy: decidedBy,
+		Expires:   expires,
+	}
+	h.sendNotification("access request decision", func(ctx context.Context) error {
+		return h.params.Notifier.Notify(ctx, notify.KindAccessRequestDecision, []string{id.Email}, data)
+	})
+}
+
+// sendNotification calls f in the background to send a notification,
+// if notifications are configured, logging any error.
+func (h *handler) sendNotification(what string, f func(context.Context) error) {
+	if h.params.Notifier == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+		if err := f(ctx); err != nil {
+			logger.Errorf("cannot send %s notification: %s", what, err)
+		}
+	}()
+}
+
+func (h *handler) accessRequestStore(ctx context.Context) (*accessrequest.Store, error) {
+	kv, err := h.params.ProviderDataStore.KeyValueStore(ctx, accessrequest.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return accessrequest.NewStore(kv), nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"net/http"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+)
+
+type accessRequestsBody struct {
+	Requests []struct {
+		Username string `json:"username"`
+		Group    string `json:"group"`
+		Reason   string `json:"reason"`
+	} `json:"requests"`
+}
+
+func (s *usersSuite) TestAccessRequestApproved(c *qt.C) {
+	client := s.srv.Client(s.interactor)
+	r := s.doBody(c, client, "PUT", "/v1/u/bob/access-requests/prod", `{"reason":"on call"}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+
+	// A second request for the same group is refused.
+	r = s.doBody(c, client, "PUT", "/v1/u/bob/access-requests/prod", `{"reason":"on call"}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusForbidden)
+
+	var body accessRequestsBody
+	s.unmarshal(c, s.doBody(c, client, "GET", "/v1/u/bob/access-requests", ""), http.StatusOK, &body)
+	c.Assert(body.Requests, qt.HasLen, 1)
+	c.Assert(body.Requests[0].Group, qt.Equals, "prod")
+	c.Assert(body.Requests[0].Reason, qt.Equals, "on call")
+
+	// The user cannot approve their own request.
+	r = s.doBody(c, client, "POST", "/v1/u/bob/access-requests/prod/approve", `{}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusUnauthorized)
+
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/access-requests", ""), http.StatusOK, &body)
+	c.Assert(body.Requests, qt.HasLen, 1)
+	c.Assert(body.Requests[0].Username, qt.Equals, "bob")
+
+	r = s.doBody(c, s.srv.AdminClient(), "POST", "/v1/u/bob/access-requests/prod/approve", `{}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+	groups, err := s.adminClient.UserGroups(s.srv.Ctx, &params.UserGroupsRequest{
+		Username: "bob",
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups, qt.Contains, "prod")
+
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/access-requests", ""), http.StatusOK, &body)
+	c.Assert(body.Requests, qt.HasLen, 0)
+
+	// Now the user is a member, they cannot request membership
+	// again.
+	r = s.doBody(c, client, "PUT", "/v1/u/bob/access-requests/prod", `{}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+func (s *usersSuite) TestAccessRequestApprovedWithExpiry(c *qt.C) {
+	client := s.srv.Client(s.interactor)
+	r := s.doBody(c, client, "PUT", "/v1/u/bob/access-requests/prod", `{}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	r = s.doBody(c, s.srv.AdminClient(), "POST", "/v1/u/bob/access-requests/prod/approve", `{"expires":"`+expires+`"}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+
+	var body groupGrantsBody
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/group-grants", ""), http.StatusOK, &body)
+	c.Assert(body.Grants, qt.HasLen, 1)
+	c.Assert(body.Grants[0].Username, qt.Equals, "bob")
+	c.Assert(body.Grants[0].Group, qt.Equals, "prod")
+}
+
+func (s *usersSuite) TestAccessRequestDenied(c *qt.C) {
+	client := s.srv.Client(s.interactor)
+	r := s.doBody(c, client, "PUT", "/v1/u/bob/access-requests/prod", `{}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+
+	r = s.doBody(c, s.srv.AdminClient(), "POST", "/v1/u/bob/access-requests/prod/deny", `{}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+	groups, err := s.adminClient.UserGroups(s.srv.Ctx, &params.UserGroupsRequest{
+		Username: "bob",
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups, qt.Not(qt.Contains), "prod")
+
+	r = s.doBody(c, s.srv.AdminClient(), "POST", "/v1/u/bob/access-requests/prod/approve", `{}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusNotFound)
+}
+
+func (s *usersSuite) TestRequestAccessForOtherUser(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+	})
+	r := s.doBody(c, s.srv.Client(s.interactor), "PUT", "/v1/u/jbloggs/access-requests/prod", `{}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusUnauthorized)
+}
@@ -0,0 +1,184 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/candid/internal/agentkeys"
+	"github.com/CanonicalLtd/candid/internal/auth"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// agentKeysRequest is a request for the public keys held by an agent.
+type agentKeysRequest struct {
+	httprequest.Route `httprequest:"GET /v1/u/:username/agent-keys"`
+	Username          params.Username `httprequest:"username,path"`
+}
+
+// agentKeysResponse holds the public keys held by an agent.
+type agentKeysResponse struct {
+	Keys []agentKey `json:"keys"`
+}
+
+// agentKey holds a public key held by an agent.
+type agentKey struct {
+	PublicKey *bakery.PublicKey `json:"public-key"`
+
+	// Expires holds the time after which the key can no longer be
+	// used to log in. If it is nil the key does not expire.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// addAgentKeyRequest is a request to add a public key to an agent. If
+// the agent already holds the key then its expiry time is updated.
+type addAgentKeyRequest struct {
+	httprequest.Route `httprequest:"POST /v1/u/:username/agent-keys"`
+	Username          params.Username `httprequest:"username,path"`
+	Key               agentKey        `httprequest:",body"`
+}
+
+// removeAgentKeyRequest is a request to remove a public key from an
+// agent. The key is specified as a form value because its text form
+// may contain characters that are not allowed in a path element.
+type removeAgentKeyRequest struct {
+	httprequest.Route `httprequest:"DELETE /v1/u/:username/agent-keys"`
+	Username          params.Username   `httprequest:"username,path"`
+	PublicKey         *bakery.PublicKey `httprequest:"public-key,form"`
+}
+
+// AgentKeys returns the public keys held by the given agent, along
+// with their expiry times.
+func (h *handler) AgentKeys(p httprequest.Params, r *agentKeysRequest) (*agentKeysResponse, error) {
+	id, err := h.agentIdentity(p.Context, r.Username)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(params.ErrBadRequest))
+	}
+	s, err := h.agentKeyStore(p.Context)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	expiries, err := s.Expiries(p.Context, id.Username)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp := &agentKeysResponse{
+		Keys: make([]agentKey, len(id.PublicKeys)),
+	}
+	for i, pk := range id.PublicKeys {
+		pk := pk
+		resp.Keys[i].PublicKey = &pk
+		if t, ok := expiries[pk]; ok {
+			resp.Keys[i].Expires = &t
+		}
+	}
+	return resp, nil
+}
+
+// AddAgentKey adds a public key to the given agent, or updates the
+// expiry time of a key that the agent already holds. Adding a new key
+// before removing an old one allows agent credentials to be rotated
+// without any loss of service.
+func (h *handler) AddAgentKey(p httprequest.Params, r *addAgentKeyRequest) error {
+	if r.Key.PublicKey == nil {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "public key not specified")
+	}
+	id, err := h.agentIdentity(p.Context, r.Username)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(params.ErrBadRequest))
+	}
+	var expires time.Time
+	if r.Key.Expires != nil {
+		expires = *r.Key.Expires
+		if !expires.After(time.Now()) {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "expiry time is in the past")
+		}
+	}
+	s, err := h.agentKeyStore(p.Context)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	// Set the expiry time before adding the key so that the key is
+	// never usable for longer than requested.
+	if err := s.SetExpiry(p.Context, id.Username, r.Key.PublicKey, expires); err != nil {
+		return errgo.Mask(err)
+	}
+	err = h.params.Store.UpdateIdentity(p.Context, &store.Identity{
+		ProviderID: id.ProviderID,
+		PublicKeys: []bakery.PublicKey{*r.Key.PublicKey},
+	}, store.Update{
+		store.PublicKeys: store.Push,
+	})
+	return errgo.Mask(translateStoreError(err), errgo.Is(params.ErrNotFound))
+}
+
+// RemoveAgentKey removes a public key from the given agent. The last
+// key held by an agent cannot be removed.
+func (h *handler) RemoveAgentKey(p httprequest.Params, r *removeAgentKeyRequest) error {
+	if r.PublicKey == nil {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "public key not specified")
+	}
+	id, err := h.agentIdentity(p.Context, r.Username)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(params.ErrBadRequest))
+	}
+	found := false
+	for _, pk := range id.PublicKeys {
+		if bytes.Equal(pk.Key[:], r.PublicKey.Key[:]) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errgo.WithCausef(nil, params.ErrNotFound, "public key not found")
+	}
+	if len(id.PublicKeys) == 1 {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "cannot remove the last public key")
+	}
+	err = h.params.Store.UpdateIdentity(p.Context, &store.Identity{
+		ProviderID: id.ProviderID,
+		PublicKeys: []bakery.PublicKey{*r.PublicKey},
+	}, store.Update{
+		store.PublicKeys: store.Pull,
+	})
+	if err != nil {
+		return errgo.Mask(translateStoreError(err), errgo.Is(params.ErrNotFound))
+	}
+	s, err := h.agentKeyStore(p.Context)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(s.SetExpiry(p.Context, id.Username, r.PublicKey, time.Time{}))
+}
+
+// agentIdentity returns the identity of the agent with the given
+// username. The admin user's public key is set from the server
+// configuration, so it cannot be managed as an agent.
+func (h *handler) agentIdentity(ctx context.Context, username params.Username) (*store.Identity, error) {
+	id := store.Identity{
+		Username: string(username),
+	}
+	if err := h.params.Store.Identity(ctx, &id); err != nil {
+		return nil, errgo.Mask(translateStoreError(err), errgo.Is(params.ErrNotFound))
+	}
+	if id.ProviderID.Provider() != "idm" || id.ProviderID == auth.AdminProviderID {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "%q is not an agent", username)
+	}
+	return &id, nil
+}
+
+func (h *handler) agentKeyStore(ctx context.Context) (*agentkeys.Store, error) {
+	kv, err := h.params.ProviderDataStore.KeyValueStore(ctx, agentkeys.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return agentkeys.NewStore(kv), nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/CanonicalLtd/candidclient.v1"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+type agentKeysResponse struct {
+	Keys []struct {
+		PublicKey *bakery.PublicKey `json:"public-key"`
+		Expires   *time.Time        `json:"expires"`
+	} `json:"keys"`
+}
+
+func (s *usersSuite) TestAgentKeyRotation(c *qt.C) {
+	ownerClient := s.srv.Client(s.interactor)
+	client, err := candidclient.New(candidclient.NewParams{
+		BaseURL: s.srv.URL,
+		Client:  ownerClient,
+	})
+	c.Assert(err, qt.Equals, nil)
+	resp, err := client.CreateAgent(s.srv.Ctx, &params.CreateAgentRequest{
+		CreateAgentBody: params.CreateAgentBody{
+			FullName:   "my agent",
+			PublicKeys: []*bakery.PublicKey{&pk1},
+		},
+	})
+	c.Assert(err, qt.Equals, nil)
+	path := "/v1/u/" + string(resp.Username) + "/agent-keys"
+
+	// The owner adds a new key with an expiry time.
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	body, err := json.Marshal(map[string]interface{}{
+		"public-key": &pk2,
+		"expires":    expires,
+	})
+	c.Assert(err, qt.Equals, nil)
+	r := s.doBody(c, ownerClient, "POST", path, string(body))
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+
+	var keys agentKeysResponse
+	s.unmarshal(c, s.doAdminBody(c, "GET", path, ""), http.StatusOK, &keys)
+	c.Assert(keys.Keys, qt.HasLen, 2)
+	c.Assert(*keys.Keys[0].PublicKey, qt.Equals, pk1)
+	c.Assert(keys.Keys[0].Expires, qt.IsNil)
+	c.Assert(*keys.Keys[1].PublicKey, qt.Equals, pk2)
+	c.Assert(keys.Keys[1].Expires.Equal(expires), qt.Equals, true)
+
+	// Both keys can be used to log in.
+	s.assertAgentLogin(c, resp.Username, privKey1)
+	s.assertAgentLogin(c, resp.Username, privKey2)
+
+	// The owner removes the old key.
+	r = s.doBody(c, ownerClient, "DELETE", path+"?public-key="+url.QueryEscape(pk1.String()), "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+
+	s.unmarshal(c, s.doAdminBody(c, "GET", path, ""), http.StatusOK, &keys)
+	c.Assert(keys.Keys, qt.HasLen, 1)
+	c.Assert(*keys.Keys[0].PublicKey, qt.Equals, pk2)
+
+	s.assertAgentLogin(c, resp.Username, privKey2)
+	agentClient := s.agentClient(c, resp.Username, privKey1)
+	_, err = agentClient.WhoAmI(s.srv.Ctx, nil)
+	c.Assert(err, qt.Not(qt.IsNil))
+
+	// The last key cannot be removed.
+	r = s.doBody(c, ownerClient, "DELETE", path+"?public-key="+url.QueryEscape(pk2.String()), "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+func (s *usersSuite) TestAddAgentKeyExpiryInPast(c *qt.C) {
+	s.addAgent(c, "agent@candid", &pk1)
+	body, err := json.Marshal(map[string]interface{}{
+		"public-key": &pk2,
+		"expires":    time.Now().Add(-time.Hour),
+	})
+	c.Assert(err, qt.Equals, nil)
+	r := s.doAdminBody(c, "POST", "/v1/u/agent@candid/agent-keys", string(body))
+	c.Assert(r.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+func (s *usersSuite) TestAgentKeysNotAgent(c *qt.C) {
+	s.addRelyingPartyUser(c, "bob")
+	r := s.doAdminBody(c, "GET", "/v1/u/bob/agent-keys", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusBadRequest)
+	r = s.doAdminBody(c, "GET", "/v1/u/nobody/agent-keys", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusNotFound)
+}
+
+func (s *usersSuite) TestAddAgentKeyUnauthorized(c *qt.C) {
+	s.addAgent(c, "agent@candid", &pk1)
+	body, err := json.Marshal(map[string]interface{}{
+		"public-key": &pk2,
+	})
+	c.Assert(err, qt.Equals, nil)
+	r := s.doBody(c, s.srv.Client(s.interactor), "POST", "/v1/u/agent@candid/agent-keys", string(body))
+	c.Assert(r.StatusCode, qt.Equals, http.StatusUnauthorized)
+}
+
+func (s *usersSuite) addAgent(c *qt.C, username string, pk *bakery.PublicKey) {
+	err := s.store.Store.UpdateIdentity(s.srv.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("idm", strings.TrimSuffix(username, "@candid")),
+		Username:   username,
+		PublicKeys: []bakery.PublicKey{*pk},
+	}, store.Update{
+		store.Username:   store.Set,
+		store.PublicKeys: store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+}
+
+func (s *usersSuite) agentClient(c *qt.C, username params.Username, key *bakery.KeyPair) *candidclient.Client {
+	client, err := candidclient.New(candidclient.NewParams{
+		BaseURL: s.srv.URL,
+		Client: &httpbakery.Client{
+			Client: httpbakery.NewHTTPClient(),
+			Key:    key,
+		},
+		AgentUsername: string(username),
+	})
+	c.Assert(err, qt.Equals, nil)
+	return client
+}
+
+func (s *usersSuite) assertAgentLogin(c *qt.C, username params.Username, key *bakery.KeyPair) {
+	resp, err := s.agentClient(c, username, key).WhoAmI(s.srv.Ctx, nil)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(resp.User, qt.Equals, string(username))
+}
+
+func (s *usersSuite) doBody(c *qt.C, client *httpbakery.Client, method, path, body string) *http.Response {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, s.srv.URL+path, r)
+	c.Assert(err, qt.Equals, nil)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	c.Assert(err, qt.Equals, nil)
+	c.Defer(func() { resp.Body.Close() })
+	return resp
+}
@@ -12,9 +12,11 @@ import (
 	"gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
 
+	"github.com/CanonicalLtd/candid/internal/accesslog"
 	"github.com/CanonicalLtd/candid/internal/auth"
 	"github.com/CanonicalLtd/candid/internal/auth/httpauth"
 	"github.com/CanonicalLtd/candid/internal/identity"
+	"github.com/CanonicalLtd/candid/internal/logging"
 	"github.com/CanonicalLtd/candid/internal/monitoring"
 )
 
@@ -22,6 +24,7 @@ var logger = loggo.GetLogger("candid.internal.v1")
 
 // NewAPIHandler is an identity.NewAPIHandlerFunc.
 func NewAPIHandler(params identity.HandlerParams) ([]httprequest.Handler, error) {
+	registerAuditRecorder()
 	return identity.ReqServer.Handlers(new(params)), nil
 }
 
@@ -29,15 +32,18 @@ func NewAPIHandler(params identity.HandlerParams) ([]httprequest.Handler, error)
 // handler for a request.
 func new(hParams identity.HandlerParams) func(p httprequest.Params, arg interface{}) (*handler, context.Context, error) {
 	reqAuth := httpauth.New(hParams.Oven, hParams.Authorizer, hParams.APIMacaroonTimeout)
+	responses := newResponseCache(hParams.ResponseCacheTTL)
 	return func(p httprequest.Params, arg interface{}) (*handler, context.Context, error) {
 		t := trace.New("identity.internal.v1", p.PathPattern)
+		accesslog.SetRoute(p.Context, p.PathPattern)
 		ctx := trace.NewContext(p.Context, t)
 		ctx, close1 := hParams.Store.Context(p.Context)
 		ctx, close2 := hParams.MeetingStore.Context(ctx)
 		hnd := &handler{
-			params: hParams,
-			trace:  t,
-			monReq: monitoring.NewRequest(&p),
+			params:    hParams,
+			responses: responses,
+			trace:     t,
+			monReq:    hParams.RequestMetrics.NewRequest(&p),
 			close: func() {
 				close2()
 				close1()
@@ -61,6 +67,8 @@ func new(hParams identity.HandlerParams) func(p httprequest.Params, arg interfac
 				return nil, nil, errgo.Newf("unexpected identity type %T", authInfo.Identity)
 			}
 			ctx = contextWithIdentity(ctx, id)
+			ctx = logging.ContextWithUser(ctx, id.Id())
+			accesslog.SetUser(ctx, id.Id())
 		}
 		return hnd, ctx, nil
 	}
@@ -68,7 +76,8 @@ func new(hParams identity.HandlerParams) func(p httprequest.Params, arg interfac
 
 // A handler is a handler for a request to a /v1 endpoint.
 type handler struct {
-	params identity.HandlerParams
+	params    identity.HandlerParams
+	responses *responseCache
 
 	trace  trace.Trace
 	monReq monitoring.Request
@@ -0,0 +1,34 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/internal/attrschema"
+)
+
+// attributesRequest is a request for the schema of the custom identity
+// attributes.
+type attributesRequest struct {
+	httprequest.Route `httprequest:"GET /v1/attributes"`
+}
+
+// attributesResponse holds the schema of the custom identity
+// attributes.
+type attributesResponse struct {
+	Attributes []attrschema.Attribute `json:"attributes"`
+}
+
+// Attributes returns the definitions of the custom identity attributes,
+// which are stored as extra-info items with the same names.
+func (h *handler) Attributes(p httprequest.Params, r *attributesRequest) (*attributesResponse, error) {
+	attrs := h.params.AttributeSchema.Attributes()
+	if attrs == nil {
+		attrs = []attrschema.Attribute{}
+	}
+	return &attributesResponse{
+		Attributes: attrs,
+	}, nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"sync"
+
+	"github.com/juju/loggo"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/internal/logging"
+)
+
+// auditHistory holds the number of audit events held in memory for
+// the audit endpoint.
+const auditHistory = 1000
+
+var (
+	auditRecorderOnce sync.Once
+	auditRecorder     = logging.NewRecorder("candid.audit", auditHistory)
+)
+
+// registerAuditRecorder starts recording the audit events logged by this
+// process. Only events that are enabled by the logging configuration,
+// which requires candid.audit to log at INFO level, are recorded.
+func registerAuditRecorder() {
+	auditRecorderOnce.Do(func() {
+		if err := loggo.RegisterWriter("candid-audit-recorder", auditRecorder); err != nil {
+			logger.Errorf("cannot record audit events: %s", err)
+		}
+	})
+}
+
+// auditRequest is a request for the most recent audit events.
+type auditRequest struct {
+	httprequest.Route `httprequest:"GET /v1/audit"`
+	Limit             int `httprequest:"limit,form"`
+}
+
+// Audit returns the most recent audit events recorded by this server,
+// most recent first. Each server records its own events, so in a
+// deployment with several servers this only shows part of the audit
+// log.
+func (h *handler) Audit(p httprequest.Params, r *auditRequest) ([]logging.RecordedEntry, error) {
+	if r.Limit < 0 {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid limit %d", r.Limit)
+	}
+	return auditRecorder.Entries(r.Limit), nil
+}
@@ -0,0 +1,34 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"net/http"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/loggo"
+
+	"github.com/CanonicalLtd/candid/internal/logging"
+)
+
+func (s *usersSuite) TestAudit(c *qt.C) {
+	auditLogger := loggo.GetLogger("candid.audit")
+	level := auditLogger.LogLevel()
+	auditLogger.SetLogLevel(loggo.INFO)
+	c.Defer(func() { auditLogger.SetLogLevel(level) })
+
+	r := s.doBody(c, s.srv.AdminClient(), "PUT", "/v1/policies/audited", `{"public-key":"CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=","groups":["ops"]}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+
+	var entries []logging.RecordedEntry
+	s.unmarshal(c, s.doAdmin(c, "GET", "/v1/audit?limit=1"), http.StatusOK, &entries)
+	c.Assert(entries, qt.HasLen, 1)
+	c.Assert(entries[0].Module, qt.Equals, "candid.audit")
+	c.Assert(entries[0].Message, qt.Equals, `admin@candid set policy "audited"`)
+}
+
+func (s *usersSuite) TestAuditUnauthorized(c *qt.C) {
+	r := s.doBody(c, s.srv.Client(s.interactor), "GET", "/v1/audit", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusUnauthorized)
+}
@@ -44,10 +44,12 @@ func opForRequest(r interface{}) bakery.Op {
 		return auth.UserOp(r.Username, auth.ActionWriteGroups)
 	case *params.UserIDPGroupsRequest:
 		return auth.UserOp(r.Username, auth.ActionReadGroups)
-	case *params.WhoAmIRequest:
+	case *params.WhoAmIRequest, *profileRequest, *setProfileRequest, *tokenRequest, *attributesRequest:
 		return identchecker.LoginOp
 	case *params.SSHKeysRequest:
 		return auth.UserOp(r.Username, auth.ActionReadSSHKeys)
+	case *authorizedKeysRequest:
+		return auth.UserOp(r.Username, auth.ActionReadSSHKeys)
 	case *params.PutSSHKeysRequest:
 		return auth.UserOp(r.Username, auth.ActionWriteSSHKeys)
 	case *params.DeleteSSHKeysRequest:
@@ -56,6 +58,10 @@ func opForRequest(r interface{}) bakery.Op {
 		return auth.UserOp(r.Username, auth.ActionReadAdmin)
 	case *params.VerifyTokenRequest:
 		return auth.GlobalOp(auth.ActionVerify)
+	case *introspectRequest:
+		return auth.GlobalOp(auth.ActionIntrospect)
+	case *revokeRequest:
+		return auth.GlobalOp(auth.ActionRevoke)
 	case *params.UserExtraInfoRequest:
 		return auth.UserOp(r.Username, auth.ActionReadAdmin)
 	case *params.SetUserExtraInfoRequest:
@@ -66,6 +72,80 @@ func opForRequest(r interface{}) bakery.Op {
 		return auth.UserOp(r.Username, auth.ActionWriteAdmin)
 	case *params.DischargeTokenForUserRequest:
 		return auth.GlobalOp(auth.ActionDischargeFor)
+	case *impersonateRequest:
+		return auth.UserOp(r.Username, auth.ActionImpersonate)
+	case *verifyMembershipRequest:
+		return auth.UserOp(r.Username, auth.ActionReadGroups)
+	case *keysRequest:
+		return auth.GlobalOp(auth.ActionReadKeys)
+	case *rotateKeysRequest:
+		return auth.GlobalOp(auth.ActionRotateKeys)
+	case *createImportRequest, *importRequest, *putImportChunkRequest, *completeImportRequest:
+		return auth.GlobalOp(auth.ActionImport)
+	case *relyingPartiesRequest:
+		return auth.UserOp(r.Username, auth.ActionRead)
+	case *revokeRelyingPartyRequest:
+		return auth.UserOp(r.Username, auth.ActionRevokeAccess)
+	case *sessionsRequest:
+		return auth.UserOp(r.Username, auth.ActionRead)
+	case *endSessionRequest:
+		return auth.UserOp(r.Username, auth.ActionRevokeAccess)
+	case *rememberedBrowsersRequest:
+		return auth.UserOp(r.Username, auth.ActionRead)
+	case *forgetBrowserRequest:
+		return auth.UserOp(r.Username, auth.ActionRevokeAccess)
+	case *lockoutRequest:
+		return auth.GlobalOp(auth.ActionRead)
+	case *unlockRequest:
+		return auth.GlobalOp(auth.ActionUnlock)
+	case *searchUsersRequest, *auditRequest, *groupAuthorizedKeysRequest, *identityEventsRequest:
+		return auth.GlobalOp(auth.ActionRead)
+	case *policiesRequest, *policyRequest:
+		return auth.GlobalOp(auth.ActionRead)
+	case *setPolicyRequest, *removePolicyRequest:
+		return auth.GlobalOp(auth.ActionWritePolicy)
+	case *readOnlyRequest:
+		return auth.GlobalOp(auth.ActionRead)
+	case *setReadOnlyRequest:
+		return auth.GlobalOp(auth.ActionSetReadOnly)
+	case *deviceAlertsRequest:
+		return auth.GlobalOp(auth.ActionRead)
+	case *setDeviceAlertsRequest:
+		return auth.GlobalOp(auth.ActionSetDeviceAlerts)
+	case *agentKeysRequest:
+		return auth.UserOp(r.Username, auth.ActionRead)
+	case *addAgentKeyRequest:
+		return auth.UserOp(r.Username, auth.ActionWriteAgentKeys)
+	case *removeAgentKeyRequest:
+		return auth.UserOp(r.Username, auth.ActionWriteAgentKeys)
+	case *groupGrantsRequest:
+		return auth.GlobalOp(auth.ActionRead)
+	case *grantGroupRequest:
+		return auth.GroupOp(r.Group, auth.ActionWriteMembers)
+	case *revokeGroupGrantRequest:
+		return auth.GroupOp(r.Group, auth.ActionWriteMembers)
+	case *accessRequestsRequest:
+		return auth.GlobalOp(auth.ActionRead)
+	case *userAccessRequestsRequest:
+		return auth.UserOp(r.Username, auth.ActionRead)
+	case *requestAccessRequest:
+		return auth.UserOp(r.Username, auth.ActionRequestAccess)
+	case *approveAccessRequest:
+		return auth.GroupOp(r.Group, auth.ActionWriteMembers)
+	case *denyAccessRequest:
+		return auth.GroupOp(r.Group, auth.ActionWriteMembers)
+	case *groupOwnersRequest:
+		return auth.GlobalOp(auth.ActionRead)
+	case *setGroupOwnersRequest:
+		return auth.GlobalOp(auth.ActionWriteGroupOwners)
+	case *addGroupMemberRequest:
+		return auth.GroupOp(r.Group, auth.ActionWriteMembers)
+	case *removeGroupMemberRequest:
+		return auth.GroupOp(r.Group, auth.ActionWriteMembers)
+	case *servicesRequest, *serviceRequest:
+		return auth.GlobalOp(auth.ActionRead)
+	case *setServiceRequest, *removeServiceRequest, *newServiceSecretRequest:
+		return auth.GlobalOp(auth.ActionWriteServices)
 	default:
 		logger.Infof("unknown API argument type %#v", r)
 	}
@@ -0,0 +1,69 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/internal/devicealert"
+	"github.com/CanonicalLtd/candid/internal/logging"
+)
+
+// deviceAlertsRequest is a request for the settings of the alerts sent
+// to users when they log in from a new device.
+type deviceAlertsRequest struct {
+	httprequest.Route `httprequest:"GET /v1/device-alerts"`
+}
+
+// setDeviceAlertsRequest is a request to change the settings of the
+// alerts sent to users when they log in from a new device.
+type setDeviceAlertsRequest struct {
+	httprequest.Route `httprequest:"PUT /v1/device-alerts"`
+	Body              devicealert.Settings `httprequest:",body"`
+}
+
+// DeviceAlerts returns the settings of the new device alerts.
+func (h *handler) DeviceAlerts(p httprequest.Params, r *deviceAlertsRequest) (*devicealert.Settings, error) {
+	a, err := h.deviceAlerter(p)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	s, err := a.Settings(p.Context)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if s.Groups == nil {
+		s.Groups = []string{}
+	}
+	return s, nil
+}
+
+// SetDeviceAlerts changes the groups whose members are sent an alert
+// when they log in from a new device.
+func (h *handler) SetDeviceAlerts(p httprequest.Params, r *setDeviceAlertsRequest) error {
+	a, err := h.deviceAlerter(p)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := a.SetSettings(p.Context, &r.Body); err != nil {
+		return errgo.Mask(err)
+	}
+	var setBy string
+	if id := identityFromContext(p.Context); id != nil {
+		setBy = id.Id()
+	}
+	logging.FromContext(p.Context, auditLogger).Infof("%s set new device alert groups to [%s]", setBy, strings.Join(r.Body.Groups, ", "))
+	return nil
+}
+
+func (h *handler) deviceAlerter(p httprequest.Params) (*devicealert.Alerter, error) {
+	kv, err := h.params.ProviderDataStore.KeyValueStore(p.Context, devicealert.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return devicealert.New(devicealert.Params{Store: kv}), nil
+}
@@ -0,0 +1,30 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"net/http"
+
+	qt "github.com/frankban/quicktest"
+)
+
+type deviceAlertsBody struct {
+	Groups []string `json:"groups"`
+}
+
+func (s *usersSuite) TestDeviceAlerts(c *qt.C) {
+	var body deviceAlertsBody
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/device-alerts", ""), http.StatusOK, &body)
+	c.Assert(body.Groups, qt.DeepEquals, []string{})
+
+	r := s.doBody(c, s.srv.AdminClient(), "PUT", "/v1/device-alerts", `{"groups":["admins","ops"]}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/device-alerts", ""), http.StatusOK, &body)
+	c.Assert(body.Groups, qt.DeepEquals, []string{"admins", "ops"})
+}
+
+func (s *usersSuite) TestSetDeviceAlertsUnauthorized(c *qt.C) {
+	r := s.doBody(c, s.srv.Client(s.interactor), "PUT", "/v1/device-alerts", `{"groups":["everyone"]}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusUnauthorized)
+}
@@ -4,5 +4,18 @@
 package v1
 
 var (
-	GravatarHash = gravatarHash
+	GravatarHash     = gravatarHash
+	NewResponseCache = newResponseCache
 )
+
+// Get returns the body and entity tag of the cached response for the
+// given user and kind.
+func (c *responseCache) Get(username, kind string, f func() (interface{}, error)) ([]byte, string, error) {
+	resp, err := c.get(username, kind, f)
+	return resp.body, resp.etag, err
+}
+
+// Invalidate removes the cached responses for the given user.
+func (c *responseCache) Invalidate(username string) {
+	c.invalidate(username)
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"time"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/internal/groupgrant"
+	"github.com/CanonicalLtd/candid/internal/logging"
+)
+
+// groupGrantsRequest is a request for all outstanding time-limited
+// group memberships.
+type groupGrantsRequest struct {
+	httprequest.Route `httprequest:"GET /v1/group-grants"`
+}
+
+// groupGrantsResponse holds the outstanding time-limited group
+// memberships, ordered by expiry time.
+type groupGrantsResponse struct {
+	Grants []groupgrant.Grant `json:"grants"`
+}
+
+// grantGroupRequest is a request to make a user a member of a
+// Candid-local group until a specified time. If the user already has a
+// grant for the group, its expiry time is changed.
+type grantGroupRequest struct {
+	httprequest.Route `httprequest:"PUT /v1/u/:username/group-grants/:group"`
+	Username          params.Username `httprequest:"username,path"`
+	Group             string          `httprequest:"group,path"`
+	Body              grantGroupBody  `httprequest:",body"`
+}
+
+// grantGroupBody holds the body of a grantGroupRequest.
+type grantGroupBody struct {
+	// Expires holds the time at which the membership is removed.
+	Expires time.Time `json:"expires"`
+
+	// Reason holds the reason for the grant, for example an
+	// incident reference.
+	Reason string `json:"reason,omitempty"`
+}
+
+// revokeGroupGrantRequest is a request to end a time-limited group
+// membership before it expires.
+type revokeGroupGrantRequest struct {
+	httprequest.Route `httprequest:"DELETE /v1/u/:username/group-grants/:group"`
+	Username          params.Username `httprequest:"username,path"`
+	Group             string          `httprequest:"group,path"`
+}
+
+// GroupGrants returns all outstanding time-limited group memberships.
+func (h *handler) GroupGrants(p httprequest.Params, r *groupGrantsRequest) (*groupGrantsResponse, error) {
+	gs, err := h.params.GroupGrants.List(p.Context)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if gs == nil {
+		gs = []groupgrant.Grant{}
+	}
+	return &groupGrantsResponse{Grants: gs}, nil
+}
+
+// GrantGroup makes the user a member of the group until the requested
+// time, after which the membership is removed automatically.
+func (h *handler) GrantGroup(p httprequest.Params, r *grantGroupRequest) error {
+	if !r.Body.Expires.After(time.Now()) {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "expiry time must be in the future")
+	}
+	var grantedBy string
+	if id := identityFromContext(p.Context); id != nil {
+		grantedBy = id.Id()
+	}
+	err := h.params.GroupGrants.Grant(p.Context, groupgrant.Grant{
+		Username:  string(r.Username),
+		Group:     r.Group,
+		Expires:   r.Body.Expires,
+		GrantedBy: grantedBy,
+		Reason:    r.Body.Reason,
+	})
+	if errgo.Cause(err) == groupgrant.ErrAlreadyMember {
+		return errgo.WithCausef(err, params.ErrBadRequest, "")
+	}
+	if err != nil {
+		return translateStoreError(err)
+	}
+	h.responses.invalidate(string(r.Username))
+	logging.FromContext(p.Context, auditLogger).Infof("%s granted %s membership of %s until %s: %s", grantedBy, r.Username, r.Group, r.Body.Expires.UTC().Format(time.RFC3339), r.Body.Reason)
+	return nil
+}
+
+// RevokeGroupGrant removes a time-limited group membership before it
+// expires.
+func (h *handler) RevokeGroupGrant(p httprequest.Params, r *revokeGroupGrantRequest) error {
+	err := h.params.GroupGrants.Revoke(p.Context, string(r.Username), r.Group)
+	if errgo.Cause(err) == groupgrant.ErrNotFound {
+		return errgo.WithCausef(err, params.ErrNotFound, "")
+	}
+	if err != nil {
+		return translateStoreError(err)
+	}
+	h.responses.invalidate(string(r.Username))
+	var revokedBy string
+	if id := identityFromContext(p.Context); id != nil {
+		revokedBy = id.Id()
+	}
+	logging.FromContext(p.Context, auditLogger).Infof("%s revoked %s membership of %s", revokedBy, r.Username, r.Group)
+	return nil
+}
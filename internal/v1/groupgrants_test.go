@@ -0,0 +1,83 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"net/http"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+)
+
+type groupGrantsBody struct {
+	Grants []struct {
+		Username string    `json:"username"`
+		Group    string    `json:"group"`
+		Expires  time.Time `json:"expires"`
+		Reason   string    `json:"reason"`
+	} `json:"grants"`
+}
+
+func (s *usersSuite) TestGroupGrants(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+		IDPGroups:  []string{"g1"},
+	})
+	var body groupGrantsBody
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/group-grants", ""), http.StatusOK, &body)
+	c.Assert(body.Grants, qt.HasLen, 0)
+
+	expires := time.Now().Add(time.Hour).UTC().Round(time.Second)
+	r := s.doBody(c, s.srv.AdminClient(), "PUT", "/v1/u/jbloggs/group-grants/prod", `{"expires":"`+expires.Format(time.RFC3339)+`","reason":"incident 42"}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/group-grants", ""), http.StatusOK, &body)
+	c.Assert(body.Grants, qt.HasLen, 1)
+	c.Assert(body.Grants[0].Username, qt.Equals, "jbloggs")
+	c.Assert(body.Grants[0].Group, qt.Equals, "prod")
+	c.Assert(body.Grants[0].Expires.Equal(expires), qt.Equals, true)
+	c.Assert(body.Grants[0].Reason, qt.Equals, "incident 42")
+
+	groups, err := s.adminClient.UserGroups(s.srv.Ctx, &params.UserGroupsRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups, qt.DeepEquals, []string{"g1", "prod"})
+
+	r = s.doAdminBody(c, "DELETE", "/v1/u/jbloggs/group-grants/prod", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+	groups, err = s.adminClient.UserGroups(s.srv.Ctx, &params.UserGroupsRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups, qt.DeepEquals, []string{"g1"})
+
+	r = s.doAdminBody(c, "DELETE", "/v1/u/jbloggs/group-grants/prod", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusNotFound)
+}
+
+func (s *usersSuite) TestGrantGroupBadRequest(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+		IDPGroups:  []string{"g1"},
+	})
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	r := s.doBody(c, s.srv.AdminClient(), "PUT", "/v1/u/jbloggs/group-grants/prod", `{"expires":"2000-01-01T00:00:00Z"}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusBadRequest)
+
+	// Permanent members cannot be given a grant.
+	r = s.doBody(c, s.srv.AdminClient(), "PUT", "/v1/u/jbloggs/group-grants/g1", `{"expires":"`+expires+`"}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusBadRequest)
+
+	r = s.doBody(c, s.srv.AdminClient(), "PUT", "/v1/u/nobody/group-grants/prod", `{"expires":"`+expires+`"}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusNotFound)
+}
+
+func (s *usersSuite) TestGrantGroupUnauthorized(c *qt.C) {
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	r := s.doBody(c, s.srv.Client(s.interactor), "PUT", "/v1/u/jbloggs/group-grants/prod", `{"expires":"`+expires+`"}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusUnauthorized)
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"context"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/internal/groupowner"
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// groupOwnersRequest is a request for the owners of a group.
+type groupOwnersRequest struct {
+	httprequest.Route `httprequest:"GET /v1/g/:group/owners"`
+	Group             string `httprequest:"group,path"`
+}
+
+// groupOwners holds the owners of a group. Each owner is either a
+// username or the name of a group whose members are all owners.
+type groupOwners struct {
+	Owners []string `json:"owners"`
+}
+
+// setGroupOwnersRequest is a request to set the owners of a group.
+type setGroupOwnersRequest struct {
+	httprequest.Route `httprequest:"PUT /v1/g/:group/owners"`
+	Group             string      `httprequest:"group,path"`
+	Body              groupOwners `httprequest:",body"`
+}
+
+// addGroupMemberRequest is a request to add a user to a group.
+type addGroupMemberRequest struct {
+	httprequest.Route `httprequest:"PUT /v1/g/:group/members/:username"`
+	Group             string          `httprequest:"group,path"`
+	Username          params.Username `httprequest:"username,path"`
+}
+
+// removeGroupMemberRequest is a request to remove a user from a group.
+type removeGroupMemberRequest struct {
+	httprequest.Route `httprequest:"DELETE /v1/g/:group/members/:username"`
+	Group             string          `httprequest:"group,path"`
+	Username          params.Username `httprequest:"username,path"`
+}
+
+// GroupOwners returns the owners of the given group.
+func (h *handler) GroupOwners(p httprequest.Params, r *groupOwnersRequest) (*groupOwners, error) {
+	owners, err := h.owners(p.Context, r.Group)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if owners == nil {
+		owners = []string{}
+	}
+	return &groupOwners{Owners: owners}, nil
+}
+
+// SetGroupOwners sets the owners of the given group. The owners of a
+// group may add and remove its members.
+func (h *handler) SetGroupOwners(p httprequest.Params, r *setGroupOwnersRequest) error {
+	s, err := h.groupOwnerStore(p.Context)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.SetOwners(p.Context, r.Group, r.Body.Owners); err != nil {
+		return errgo.Mask(err)
+	}
+	var setBy string
+	if id := identityFromContext(p.Context); id != nil {
+		setBy = id.Id()
+	}
+	logging.FromContext(p.Context, auditLogger).Infof("%s set owners of %s to %v", setBy, r.Group, r.Body.Owners)
+	return nil
+}
+
+// AddGroupMember adds the given user to the given group.
+func (h *handler) AddGroupMember(p httprequest.Params, r *addGroupMemberRequest) error {
+	err := h.params.Store.UpdateIdentity(p.Context, &store.Identity{
+		Username: string(r.Username),
+		Groups:   []string{r.Group},
+	}, store.Update{
+		store.Groups: store.Push,
+	})
+	if err != nil {
+		return translateStoreError(err)
+	}
+	h.responses.invalidate(string(r.Username))
+	var addedBy string
+	if id := identityFromContext(p.Context); id != nil {
+		addedBy = id.Id()
+	}
+	logging.FromContext(p.Context, auditLogger).Infof("%s added %s to %s", addedBy, r.Username, r.Group)
+	return nil
+}
+
+// RemoveGroupMember removes the given user from the given group.
+func (h *handler) RemoveGroupMember(p httprequest.Params, r *removeGroupMemberRequest) error {
+	err := h.params.Store.UpdateIdentity(p.Context, &store.Identity{
+		Username: string(r.Username),
+		Groups:   []string{r.Group},
+	}, store.Update{
+		store.Groups: store.Pull,
+	})
+	if err != nil {
+		return translateStoreError(err)
+	}
+	h.responses.invalidate(string(r.Username))
+	var removedBy string
+	if id := identityFromContext(p.Context); id != nil {
+		removedBy = id.Id()
+	}
+	logging.FromContext(p.Context, auditLogger).Infof("%s removed %s from %s", removedBy, r.Username, r.Group)
+	return nil
+}
+
+// owners returns the owners of the given group.
+func (h *handler) owners(ctx context.Context, group string) ([]string, error) {
+	s, err := h.groupOwnerStore(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	owners, err := s.Owners(ctx, group)
+	return owners, errgo.Mask(err)
+}
+
+func (h *handler) groupOwnerStore(ctx context.Context) (*groupowner.Store, error) {
+	kv, err := h.params.ProviderDataStore.KeyValueStore(ctx, groupowner.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return groupowner.NewStore(kv), nil
+}
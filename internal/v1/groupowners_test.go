@@ -0,0 +1,87 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"net/http"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+)
+
+func (s *usersSuite) TestGroupOwners(c *qt.C) {
+	var body struct {
+		Owners []string `json:"owners"`
+	}
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/g/prod/owners", ""), http.StatusOK, &body)
+	c.Assert(body.Owners, qt.DeepEquals, []string{})
+
+	r := s.doBody(c, s.srv.AdminClient(), "PUT", "/v1/g/prod/owners", `{"owners":["bob","ops-leads"]}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/g/prod/owners", ""), http.StatusOK, &body)
+	c.Assert(body.Owners, qt.DeepEquals, []string{"bob", "ops-leads"})
+
+	// Only administrators can set owners.
+	r = s.doBody(c, s.srv.Client(s.interactor), "PUT", "/v1/g/prod/owners", `{"owners":["bob"]}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusUnauthorized)
+}
+
+func (s *usersSuite) TestGroupOwnerChangesMembers(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+		IDPGroups:  []string{"g1"},
+	})
+	r := s.doBody(c, s.srv.AdminClient(), "PUT", "/v1/g/prod/owners", `{"owners":["bob"]}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+
+	client := s.srv.Client(s.interactor)
+	r = s.doBody(c, client, "PUT", "/v1/g/prod/members/jbloggs", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+	groups, err := s.adminClient.UserGroups(s.srv.Ctx, &params.UserGroupsRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups, qt.DeepEquals, []string{"g1", "prod"})
+
+	// The owner of one group cannot change the members of another.
+	r = s.doBody(c, client, "PUT", "/v1/g/db/members/jbloggs", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusUnauthorized)
+	r = s.doBody(c, client, "DELETE", "/v1/g/g1/members/jbloggs", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusUnauthorized)
+
+	r = s.doBody(c, client, "DELETE", "/v1/g/prod/members/jbloggs", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+	groups, err = s.adminClient.UserGroups(s.srv.Ctx, &params.UserGroupsRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups, qt.DeepEquals, []string{"g1"})
+
+	r = s.doBody(c, client, "PUT", "/v1/g/prod/members/nobody", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusNotFound)
+}
+
+func (s *usersSuite) TestGroupOwnerApprovesAccessRequest(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+	})
+	r := s.doBody(c, s.srv.AdminClient(), "PUT", "/v1/u/jbloggs/access-requests/prod", `{}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+
+	client := s.srv.Client(s.interactor)
+	r = s.doBody(c, client, "POST", "/v1/u/jbloggs/access-requests/prod/approve", `{}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusUnauthorized)
+
+	r = s.doBody(c, s.srv.AdminClient(), "PUT", "/v1/g/prod/owners", `{"owners":["bob"]}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+	r = s.doBody(c, client, "POST", "/v1/u/jbloggs/access-requests/prod/approve", `{}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+	groups, err := s.adminClient.UserGroups(s.srv.Ctx, &params.UserGroupsRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups, qt.DeepEquals, []string{"prod"})
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// identityEventsKeepAlive holds the interval at which comments are sent
+// on an idle identity event stream, so that proxies do not close the
+// connection.
+var identityEventsKeepAlive = 30 * time.Second
+
+// identityEventsRequest is a request for a stream of the changes made
+// to identities.
+type identityEventsRequest struct {
+	httprequest.Route `httprequest:"GET /v1/identity-events"`
+}
+
+// IdentityEvents streams the identities that are created, updated and
+// deleted as server-sent events, so that other systems can mirror the
+// identity data without polling. The name of each event is the type of
+// change and its data is the JSON encoded store.IdentityEvent. An event
+// of type "missed" means that the mirror should be resynchronized.
+func (h *handler) IdentityEvents(p httprequest.Params, r *identityEventsRequest) error {
+	if h.params.IdentityWatcher == nil {
+		return errgo.WithCausef(nil, params.ErrNotFound, "identity events are not supported by the store")
+	}
+	flusher, ok := p.Response.(http.Flusher)
+	if !ok {
+		return errgo.New("cannot stream identity events")
+	}
+	ctx, cancel := context.WithCancel(p.Context)
+	defer cancel()
+	events := make(chan store.IdentityEvent)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- h.params.IdentityWatcher.WatchIdentities(ctx, events)
+	}()
+
+	w := p.Response
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	ticker := time.NewTicker(identityEventsKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev := <-events:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case err := <-errc:
+			if ctx.Err() == nil {
+				// The response has already started, so the
+				// error can only be reported as an event.
+				logger.Errorf("cannot watch identities: %s", err)
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+				flusher.Flush()
+			}
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+func (s *usersSuite) TestIdentityEvents(c *qt.C) {
+	r := s.doAdmin(c, "GET", "/v1/identity-events")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(r.Header.Get("Content-Type"), qt.Equals, "text/event-stream")
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		sc := bufio.NewScanner(r.Body)
+		for sc.Scan() {
+			lines <- sc.Text()
+		}
+	}()
+
+	// The server starts watching the store after the response
+	// headers are sent, so keep updating the identity until an
+	// event is received.
+	id := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "watched"),
+		Username:   "watched",
+	}
+	var line string
+	for line == "" {
+		err := s.store.Store.UpdateIdentity(context.Background(), &id, store.Update{
+			store.Username: store.Set,
+		})
+		c.Assert(err, qt.Equals, nil)
+		select {
+		case line = <-lines:
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	c.Assert(line, qt.Matches, `event: (create|update)`)
+	data := <-lines
+	c.Assert(strings.HasPrefix(data, "data: "), qt.Equals, true)
+	var ev store.IdentityEvent
+	err := json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &ev)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ev.ID, qt.Equals, id.ID)
+	c.Assert("event: "+string(ev.Type), qt.Equals, line)
+}
+
+func (s *usersSuite) TestIdentityEventsUnauthorized(c *qt.C) {
+	r := s.doBody(c, s.srv.Client(s.interactor), "GET", "/v1/identity-events", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusUnauthorized)
+}
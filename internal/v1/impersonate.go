@@ -0,0 +1,94 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"time"
+
+	"github.com/juju/loggo"
+	"gopkg.in/CanonicalLtd/candidclient.v1"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/candid/internal/auth"
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// auditLogger is the logger used to record privileged operations. It
+// has a distinct name so that the audit log can be configured
+// independently of the other logs.
+var auditLogger = loggo.GetLogger("candid.audit")
+
+// impersonateRequest is a request for a discharge token that allows
+// the requesting user to act as another user.
+type impersonateRequest struct {
+	httprequest.Route `httprequest:"POST /v1/u/:username/impersonate"`
+	Username          params.Username        `httprequest:"username,path"`
+	Body              impersonateRequestBody `httprequest:",body"`
+}
+
+// impersonateRequestBody holds the body of an impersonateRequest.
+type impersonateRequestBody struct {
+	// Reason holds the reason the user is being impersonated. This
+	// must be specified and is recorded in the audit log.
+	Reason string `json:"reason"`
+}
+
+// impersonateResponse holds the response from an impersonateRequest.
+type impersonateResponse struct {
+	// DischargeToken holds a discharge token that will discharge
+	// third-party caveats as the impersonated user.
+	DischargeToken *bakery.Macaroon `json:"discharge-token"`
+}
+
+// Impersonate allows a member of the impersonate-user ACL to obtain a
+// discharge token that acts as the specified user. Any discharge
+// macaroons obtained with the token declare the impersonating user in
+// the "impersonated-by" attribute, so that relying services can detect
+// impersonated sessions.
+func (h *handler) Impersonate(p httprequest.Params, req *impersonateRequest) (*impersonateResponse, error) {
+	logger.Tracef("Impersonate %#v", req)
+	if req.Body.Reason == "" {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "reason not specified")
+	}
+	impersonator := identityFromContext(p.Context)
+	if impersonator == nil {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "")
+	}
+	if impersonator.Impersonator() != "" {
+		return nil, errgo.WithCausef(nil, params.ErrForbidden, "cannot impersonate while impersonating another user")
+	}
+	if string(req.Username) == impersonator.Id() || string(req.Username) == auth.AdminUsername {
+		return nil, errgo.WithCausef(nil, params.ErrForbidden, "cannot impersonate %s", req.Username)
+	}
+	err := h.params.Store.Identity(p.Context, &store.Identity{
+		Username: string(req.Username),
+	})
+	if err != nil {
+		return nil, errgo.Mask(translateStoreError(err), errgo.Is(params.ErrNotFound))
+	}
+	m, err := h.params.Oven.NewMacaroon(
+		p.Context,
+		httpbakery.RequestVersion(p.Request),
+		[]checkers.Caveat{
+			checkers.TimeBeforeCaveat(time.Now().Add(h.params.DischargeTokenTimeout)),
+			candidclient.UserDeclaration(string(req.Username)),
+			auth.ImpersonationCaveat(impersonator.Id()),
+		},
+		identchecker.LoginOp,
+	)
+	if err != nil {
+		return nil, errgo.NoteMask(err, "cannot create discharge token", errgo.Any)
+	}
+	logging.FromContext(p.Context, auditLogger).Infof("%s impersonating %s (reason %q)", impersonator.Id(), req.Username, req.Body.Reason)
+	return &impersonateResponse{
+		DischargeToken: m,
+	}, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+type impersonateRequest struct {
+	httprequest.Route `httprequest:"POST /v1/u/:username/impersonate"`
+	Username          params.Username `httprequest:"username,path"`
+	Body              struct {
+		Reason string `json:"reason"`
+	} `httprequest:",body"`
+}
+
+type impersonateResponse struct {
+	DischargeToken *bakery.Macaroon `json:"discharge-token"`
+}
+
+func (s *usersSuite) TestImpersonate(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+	})
+	client := &httprequest.Client{
+		BaseURL: s.srv.URL,
+		Doer:    s.srv.AdminClient(),
+	}
+	req := &impersonateRequest{
+		Username: "jbloggs",
+	}
+	req.Body.Reason = "investigating support ticket"
+	var resp impersonateResponse
+	err := client.Call(s.srv.Ctx, req, &resp)
+	c.Assert(err, qt.Equals, nil)
+
+	declared, err := s.adminClient.VerifyToken(s.srv.Ctx, &params.VerifyTokenRequest{
+		Macaroons: macaroon.Slice{resp.DischargeToken.M()},
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(declared, qt.DeepEquals, map[string]string{
+		"username":        "jbloggs",
+		"impersonated-by": "admin@candid",
+	})
+}
+
+func (s *usersSuite) TestImpersonateNoReason(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+	})
+	client := &httprequest.Client{
+		BaseURL: s.srv.URL,
+		Doer:    s.srv.AdminClient(),
+	}
+	err := client.Call(s.srv.Ctx, &impersonateRequest{Username: "jbloggs"}, nil)
+	c.Assert(err, qt.ErrorMatches, `Post http://.*/v1/u/jbloggs/impersonate: reason not specified`)
+}
+
+func (s *usersSuite) TestImpersonateNotFound(c *qt.C) {
+	client := &httprequest.Client{
+		BaseURL: s.srv.URL,
+		Doer:    s.srv.AdminClient(),
+	}
+	req := &impersonateRequest{
+		Username: "not-there",
+	}
+	req.Body.Reason = "testing"
+	err := client.Call(s.srv.Ctx, req, nil)
+	c.Assert(err, qt.ErrorMatches, `Post http://.*/v1/u/not-there/impersonate: user not-there not found`)
+}
+
+func (s *usersSuite) TestImpersonateUnauthorized(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+	})
+	client := &httprequest.Client{
+		BaseURL: s.srv.URL,
+		Doer:    s.srv.Client(s.interactor),
+	}
+	req := &impersonateRequest{
+		Username: "jbloggs",
+	}
+	req.Body.Reason = "testing"
+	err := client.Call(s.srv.Ctx, req, nil)
+	c.Assert(err, qt.ErrorMatches, `Post http://.*/v1/u/jbloggs/impersonate: permission denied`)
+}
@@ -0,0 +1,443 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/juju/simplekv"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/juju/names.v2"
+
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+const (
+	// importStoreName is the name of the provider data key-value
+	// store that holds import sessions.
+	importStoreName = "_import"
+
+	// importSessionTimeout is the time after its last update that an
+	// import session is discarded.
+	importSessionTimeout = 7 * 24 * time.Hour
+
+	// maxImportChunkSize is the maximum size of a single chunk of
+	// an import.
+	maxImportChunkSize = 16 * 1024 * 1024
+)
+
+// createImportRequest is a request to start a new bulk import of
+// identities.
+type createImportRequest struct {
+	httprequest.Route `httprequest:"POST /v1/import"`
+	Body              createImportBody `httprequest:",body"`
+}
+
+type createImportBody struct {
+	// ChunkSize optionally records the size of the chunks the client
+	// is splitting the import into, so that a client resuming the
+	// import can split the data in the same way.
+	ChunkSize int64 `json:"chunk-size,omitempty"`
+
+	// Chunks optionally holds the total number of chunks in the
+	// import. If it is set the import cannot be completed until all
+	// the chunks have been uploaded.
+	Chunks int `json:"chunks,omitempty"`
+}
+
+// importRequest is a request for the status of an import session.
+type importRequest struct {
+	httprequest.Route `httprequest:"GET /v1/import/:id"`
+	ID                string `httprequest:"id,path"`
+}
+
+// putImportChunkRequest is a request to upload a chunk of an import.
+// The body of the request holds the identities to import as
+// newline-separated JSON objects (see importIdentity).
+type putImportChunkRequest struct {
+	httprequest.Route `httprequest:"PUT /v1/import/:id/chunks/:index"`
+	ID                string `httprequest:"id,path"`
+	Index             int    `httprequest:"index,path"`
+}
+
+// completeImportRequest is a request to mark an import as complete.
+type completeImportRequest struct {
+	httprequest.Route `httprequest:"POST /v1/import/:id/complete"`
+	ID                string `httprequest:"id,path"`
+}
+
+// importSession holds the state of a bulk import. It is stored in the
+// provider data store so that an import can be resumed after the
+// connection to, or even the instance of, the identity server is lost.
+type importSession struct {
+	ID        string        `json:"id"`
+	Creator   string        `json:"creator"`
+	Created   time.Time     `json:"created"`
+	Updated   time.Time     `json:"updated"`
+	Expires   time.Time     `json:"expires"`
+	ChunkSize int64         `json:"chunk-size,omitempty"`
+	Chunks    int           `json:"chunks,omitempty"`
+	Completed bool          `json:"completed"`
+	Reports   []chunkReport `json:"reports"`
+}
+
+// chunkReport holds the validation report for a single uploaded chunk.
+type chunkReport struct {
+	Index    int           `json:"index"`
+	Digest   string        `json:"digest"`
+	Records  int           `json:"records"`
+	Imported int           `json:"imported"`
+	Errors   []recordError `json:"errors,omitempty"`
+}
+
+// recordError describes a record in a chunk that could not be imported.
+type recordError struct {
+	// Line holds the line number of the record within the chunk,
+	// starting at 1.
+	Line     int    `json:"line"`
+	Username string `json:"username,omitempty"`
+	Message  string `json:"message"`
+}
+
+// importIdentity is the format of an identity in an import chunk.
+type importIdentity struct {
+	Username   string   `json:"username"`
+	ExternalID string   `json:"external-id"`
+	Name       string   `json:"name,omitempty"`
+	Email      string   `json:"email,omitempty"`
+	Groups     []string `json:"groups,omitempty"`
+	SSHKeys    []string `json:"ssh-keys,omitempty"`
+}
+
+// CreateImport starts a new import session.
+func (h *handler) CreateImport(p httprequest.Params, r *createImportRequest) (*importSession, error) {
+	if r.Body.ChunkSize < 0 || r.Body.ChunkSize > maxImportChunkSize {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid chunk size %d", r.Body.ChunkSize)
+	}
+	if r.Body.Chunks < 0 {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid chunk count %d", r.Body.Chunks)
+	}
+	kv, err := h.importStore(p)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	id, err := newImportID()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	now := time.Now()
+	s := &importSession{
+		ID:        id,
+		Created:   now,
+		ChunkSize: r.Body.ChunkSize,
+		Chunks:    r.Body.Chunks,
+		Reports:   []chunkReport{},
+	}
+	if authID := identityFromContext(p.Context); authID != nil {
+		s.Creator = authID.Id()
+	}
+	if err := putImportSession(p, kv, s, now); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	logging.FromContext(p.Context, logger).Infof("import %s started", s.ID)
+	return s, nil
+}
+
+// Import returns the status of an import session, including the
+// reports for all the chunks uploaded so far. A client resuming an
+// interrupted import can use the digests in the reports to determine
+// which chunks need to be uploaded again.
+func (h *handler) Import(p httprequest.Params, r *importRequest) (*importSession, error) {
+	kv, err := h.importStore(p)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	s, err := getImportSession(p, kv, r.ID)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return s, nil
+}
+
+// PutImportChunk imports the identities in a chunk of an import and
+// returns a report of any records that could not be imported. Uploading
+// a chunk with the same index and content as one that has already been
+// uploaded returns the original report without importing the records
+// again. Uploading a chunk with the same index but different content
+// imports the records and replaces the report for the chunk; as
+// identities are keyed by their external ID this is safe to do after
+// correcting errors in the chunk.
+func (h *handler) PutImportChunk(p httprequest.Params, r *putImportChunkRequest) (*chunkReport, error) {
+	if r.Index < 0 {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid chunk index %d", r.Index)
+	}
+	kv, err := h.importStore(p)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	s, err := getImportSession(p, kv, r.ID)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if s.Completed {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "import %s has already completed", s.ID)
+	}
+	if s.Chunks > 0 && r.Index >= s.Chunks {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "chunk index %d out of range (import has %d chunks)", r.Index, s.Chunks)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(p.Request.Body, maxImportChunkSize+1))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read chunk")
+	}
+	if len(data) > maxImportChunkSize {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "chunk too large (maximum %d bytes)", maxImportChunkSize)
+	}
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	if rep := s.report(r.Index); rep != nil && rep.Digest == digest {
+		return rep, nil
+	}
+	rep := h.importChunk(p, data)
+	rep.Index = r.Index
+	rep.Digest = digest
+	logging.FromContext(p.Context, logger).Infof("import %s chunk %d: %d records, %d imported", s.ID, r.Index, rep.Records, rep.Imported)
+	err = updateImportSession(p, kv, r.ID, func(s *importSession) error {
+		if s.Completed {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "import %s has already completed", s.ID)
+		}
+		s.setReport(*rep)
+		return nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(params.ErrBadRequest))
+	}
+	return rep, nil
+}
+
+// CompleteImport marks an import as complete, after which no more
+// chunks can be uploaded. If the number of chunks was given when the
+// import was created then the import can only be completed once every
+// chunk has been uploaded.
+func (h *handler) CompleteImport(p httprequest.Params, r *completeImportRequest) (*importSession, error) {
+	kv, err := h.importStore(p)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var result *importSession
+	err = updateImportSession(p, kv, r.ID, func(s *importSession) error {
+		if s.Chunks > 0 {
+			var missing []int
+			for i := 0; i < s.Chunks; i++ {
+				if s.report(i) == nil {
+					missing = append(missing, i)
+				}
+			}
+			if len(missing) > 0 {
+				return errgo.WithCausef(nil, params.ErrBadRequest, "import %s is missing chunks %v", s.ID, missing)
+			}
+		}
+		s.Completed = true
+		result = s
+		return nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(params.ErrBadRequest))
+	}
+	logging.FromContext(p.Context, logger).Infof("import %s completed", result.ID)
+	return result, nil
+}
+
+// importChunk imports all the valid identities in the given chunk.
+func (h *handler) importChunk(p httprequest.Params, data []byte) *chunkReport {
+	rep := &chunkReport{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, maxImportChunkSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		buf := bytes.TrimSpace(scanner.Bytes())
+		if len(buf) == 0 {
+			continue
+		}
+		rep.Records++
+		var id importIdentity
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&id); err != nil {
+			rep.Errors = append(rep.Errors, recordError{
+				Line:    line,
+				Message: "cannot parse record: " + err.Error(),
+			})
+			continue
+		}
+		if err := h.importIdentity(p, &id); err != nil {
+			rep.Errors = append(rep.Errors, recordError{
+				Line:     line,
+				Username: id.Username,
+				Message:  err.Error(),
+			})
+			continue
+		}
+		rep.Imported++
+	}
+	if err := scanner.Err(); err != nil {
+		rep.Errors = append(rep.Errors, recordError{
+			Line:    line + 1,
+			Message: "cannot read record: " + err.Error(),
+		})
+	}
+	return rep
+}
+
+// importIdentity validates the given identity and then creates or
+// updates it in the store.
+func (h *handler) importIdentity(p httprequest.Params, id *importIdentity) error {
+	if id.Username == "" {
+		return errgo.New("missing username")
+	}
+	if !names.IsValidUser(id.Username) {
+		return errgo.Newf("invalid username %q", id.Username)
+	}
+	if blacklistUsernames[params.Username(id.Username)] {
+		return errgo.Newf("username %q is reserved", id.Username)
+	}
+	provider, pid := store.ProviderIdentity(id.ExternalID).Split()
+	if provider == "" || pid == "" {
+		return errgo.Newf("invalid external-id %q", id.ExternalID)
+	}
+	if provider == "idm" {
+		return errgo.Newf("cannot import agent identity %q", id.ExternalID)
+	}
+	for _, g := range id.Groups {
+		if g == "" {
+			return errgo.New("empty group name")
+		}
+	}
+	identity := &store.Identity{
+		ProviderID: store.ProviderIdentity(id.ExternalID),
+		Username:   id.Username,
+		Name:       id.Name,
+		Email:      id.Email,
+		Groups:     id.Groups,
+	}
+	update := store.Update{
+		store.Username: store.Set,
+		store.Name:     store.Set,
+		store.Email:    store.Set,
+		store.Groups:   store.Set,
+	}
+	if len(id.SSHKeys) > 0 {
+		// SSH keys are added to any that the user has already
+		// uploaded, in the same way as PutSSHKeys.
+		identity.ExtraInfo = map[string][]string{
+			"sshkeys": id.SSHKeys,
+		}
+		update[store.ExtraInfo] = store.Push
+	}
+	err := h.params.Store.UpdateIdentity(p.Context, identity, update)
+	if errgo.Cause(err) == store.ErrDuplicateUsername {
+		return errgo.Newf("username %q is already in use by another identity", id.Username)
+	}
+	return errgo.Mask(err)
+}
+
+func (h *handler) importStore(p httprequest.Params) (simplekv.Store, error) {
+	kv, err := h.params.ProviderDataStore.KeyValueStore(p.Context, importStoreName)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open import store")
+	}
+	return kv, nil
+}
+
+func getImportSession(p httprequest.Params, kv simplekv.Store, id string) (*importSession, error) {
+	data, err := kv.Get(p.Context, id)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "import %q not found", id)
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var s importSession
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, errgo.Notef(err, "invalid import session")
+	}
+	return &s, nil
+}
+
+func putImportSession(p httprequest.Params, kv simplekv.Store, s *importSession, now time.Time) error {
+	s.Updated = now
+	s.Expires = now.Add(importSessionTimeout)
+	data, err := json.Marshal(s)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(kv.Set(p.Context, s.ID, data, s.Expires))
+}
+
+// updateImportSession atomically updates the import session with the
+// given ID using f.
+func updateImportSession(p httprequest.Params, kv simplekv.Store, id string, f func(*importSession) error) error {
+	now := time.Now()
+	expires := now.Add(importSessionTimeout)
+	err := kv.Update(p.Context, id, expires, func(old []byte) ([]byte, error) {
+		if old == nil {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "import %q not found", id)
+		}
+		var s importSession
+		if err := json.Unmarshal(old, &s); err != nil {
+			return nil, errgo.Notef(err, "invalid import session")
+		}
+		if err := f(&s); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		s.Updated = now
+		s.Expires = expires
+		return json.Marshal(s)
+	})
+	return errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(params.ErrBadRequest))
+}
+
+// report returns the report for the chunk with the given index, or nil
+// if that chunk has not been uploaded.
+func (s *importSession) report(index int) *chunkReport {
+	for i := range s.Reports {
+		if s.Reports[i].Index == index {
+			return &s.Reports[i]
+		}
+	}
+	return nil
+}
+
+// setReport adds the given report to the session, replacing any
+// existing report for the same chunk.
+func (s *importSession) setReport(rep chunkReport) {
+	if r := s.report(rep.Index); r != nil {
+		*r = rep
+		return
+	}
+	s.Reports = append(s.Reports, rep)
+	sort.Slice(s.Reports, func(i, j int) bool {
+		return s.Reports[i].Index < s.Reports[j].Index
+	})
+}
+
+func newImportID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errgo.Notef(err, "cannot generate import id")
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+type importSession struct {
+	ID        string        `json:"id"`
+	Chunks    int           `json:"chunks"`
+	Completed bool          `json:"completed"`
+	Reports   []chunkReport `json:"reports"`
+}
+
+type chunkReport struct {
+	Index    int    `json:"index"`
+	Digest   string `json:"digest"`
+	Records  int    `json:"records"`
+	Imported int    `json:"imported"`
+	Errors   []struct {
+		Line     int    `json:"line"`
+		Username string `json:"username"`
+		Message  string `json:"message"`
+	} `json:"errors"`
+}
+
+const importChunk0 = `
+{"username": "alice", "external-id": "test:alice", "email": "alice@example.com", "groups": ["g1"], "ssh-keys": ["ssh-rsa AAAA alice"]}
+{"username": "bob", "external-id": "test:bob", "name": "Bob"}
+{"username": "admin", "external-id": "test:admin"}
+not json
+{"username": "carol", "external-id": "carol"}
+`
+
+const importChunk1 = `{"username": "dave", "external-id": "test:dave"}
+`
+
+func (s *usersSuite) TestImport(c *qt.C) {
+	var sess importSession
+	resp := s.doAdminBody(c, "POST", "/v1/import", `{"chunks": 2}`)
+	s.unmarshal(c, resp, http.StatusOK, &sess)
+	c.Assert(sess.ID, qt.Not(qt.Equals), "")
+	c.Assert(sess.Chunks, qt.Equals, 2)
+
+	var rep chunkReport
+	resp = s.doAdminBody(c, "PUT", "/v1/import/"+sess.ID+"/chunks/0", importChunk0)
+	s.unmarshal(c, resp, http.StatusOK, &rep)
+	c.Assert(rep.Index, qt.Equals, 0)
+	c.Assert(rep.Records, qt.Equals, 5)
+	c.Assert(rep.Imported, qt.Equals, 2)
+	c.Assert(rep.Errors, qt.HasLen, 3)
+	c.Assert(rep.Errors[0].Line, qt.Equals, 4)
+	c.Assert(rep.Errors[0].Message, qt.Equals, `username "admin" is reserved`)
+	c.Assert(rep.Errors[1].Line, qt.Equals, 5)
+	c.Assert(rep.Errors[1].Message, qt.Matches, `cannot parse record: .*`)
+	c.Assert(rep.Errors[2].Line, qt.Equals, 6)
+	c.Assert(rep.Errors[2].Message, qt.Equals, `invalid external-id "carol"`)
+
+	id := s.store.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+	})
+	c.Assert(id.Username, qt.Equals, "alice")
+	c.Assert(id.Email, qt.Equals, "alice@example.com")
+	c.Assert(id.Groups, qt.DeepEquals, []string{"g1"})
+	c.Assert(id.ExtraInfo["sshkeys"], qt.DeepEquals, []string{"ssh-rsa AAAA alice"})
+
+	// Uploading the same chunk again returns the same report.
+	var rep2 chunkReport
+	resp = s.doAdminBody(c, "PUT", "/v1/import/"+sess.ID+"/chunks/0", importChunk0)
+	s.unmarshal(c, resp, http.StatusOK, &rep2)
+	c.Assert(rep2, qt.DeepEquals, rep)
+
+	// The import cannot be completed until all the chunks have been
+	// uploaded.
+	resp = s.doAdminBody(c, "POST", "/v1/import/"+sess.ID+"/complete", "")
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+
+	// The status of the import shows which chunks have been uploaded.
+	resp = s.doAdminBody(c, "GET", "/v1/import/"+sess.ID, "")
+	s.unmarshal(c, resp, http.StatusOK, &sess)
+	c.Assert(sess.Reports, qt.HasLen, 1)
+	c.Assert(sess.Reports[0].Digest, qt.Equals, rep.Digest)
+
+	resp = s.doAdminBody(c, "PUT", "/v1/import/"+sess.ID+"/chunks/1", importChunk1)
+	s.unmarshal(c, resp, http.StatusOK, &rep)
+	c.Assert(rep.Imported, qt.Equals, 1)
+
+	resp = s.doAdminBody(c, "POST", "/v1/import/"+sess.ID+"/complete", "")
+	s.unmarshal(c, resp, http.StatusOK, &sess)
+	c.Assert(sess.Completed, qt.Equals, true)
+	c.Assert(sess.Reports, qt.HasLen, 2)
+
+	// No more chunks can be uploaded.
+	resp = s.doAdminBody(c, "PUT", "/v1/import/"+sess.ID+"/chunks/1", importChunk1)
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+func (s *usersSuite) TestImportChunkOutOfRange(c *qt.C) {
+	var sess importSession
+	resp := s.doAdminBody(c, "POST", "/v1/import", `{"chunks": 1}`)
+	s.unmarshal(c, resp, http.StatusOK, &sess)
+	resp = s.doAdminBody(c, "PUT", "/v1/import/"+sess.ID+"/chunks/1", importChunk1)
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+func (s *usersSuite) TestImportNotFound(c *qt.C) {
+	resp := s.doAdminBody(c, "GET", "/v1/import/123456", "")
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusNotFound)
+	resp = s.doAdminBody(c, "PUT", "/v1/import/123456/chunks/0", importChunk1)
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusNotFound)
+}
+
+func (s *usersSuite) TestImportUnauthorized(c *qt.C) {
+	req, err := http.NewRequest("POST", s.srv.URL+"/v1/import", strings.NewReader("{}"))
+	c.Assert(err, qt.Equals, nil)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, qt.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Not(qt.Equals), http.StatusOK)
+}
+
+func (s *usersSuite) doAdminBody(c *qt.C, method, path, body string) *http.Response {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, s.srv.URL+path, r)
+	c.Assert(err, qt.Equals, nil)
+	if method == "POST" && body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := s.srv.AdminClient().Do(req)
+	c.Assert(err, qt.Equals, nil)
+	c.Defer(func() { resp.Body.Close() })
+	return resp
+}
+
+func (s *usersSuite) unmarshal(c *qt.C, resp *http.Response, status int, v interface{}) {
+	c.Assert(resp.StatusCode, qt.Equals, status)
+	err := httprequest.UnmarshalJSONResponse(resp, v)
+	c.Assert(err, qt.Equals, nil)
+}
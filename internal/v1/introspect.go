@@ -0,0 +1,141 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"time"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
+	macaroon "gopkg.in/macaroon.v2"
+
+	"github.com/CanonicalLtd/candid/internal/auth"
+)
+
+// introspectRequest is a request for the details of a discharge token
+// or other macaroon issued by candid.
+type introspectRequest struct {
+	httprequest.Route `httprequest:"POST /v1/introspect"`
+	Body              introspectBody `httprequest:",body"`
+}
+
+// introspectBody holds the body of an introspectRequest.
+type introspectBody struct {
+	// Macaroons holds the macaroon to inspect, followed by any
+	// discharges.
+	Macaroons macaroon.Slice `json:"macaroons"`
+}
+
+// introspectResponse holds the response from an introspectRequest.
+type introspectResponse struct {
+	// ID holds the ID of the first macaroon, which may be used to
+	// revoke it.
+	ID string `json:"id"`
+
+	// Valid holds whether the macaroons authenticate a user.
+	Valid bool `json:"valid"`
+
+	// Revoked holds whether any of the macaroons has been revoked.
+	Revoked bool `json:"revoked,omitempty"`
+
+	// Error holds the reason that the macaroons are not valid.
+	Error string `json:"error,omitempty"`
+
+	// Username holds the username of the authenticated user.
+	Username string `json:"username,omitempty"`
+
+	// ImpersonatedBy holds the username of the user that is
+	// impersonating the authenticated user, if any.
+	ImpersonatedBy string `json:"impersonated-by,omitempty"`
+
+	// Groups holds the groups of the authenticated user.
+	Groups []string `json:"groups,omitempty"`
+
+	// Expires holds the earliest time-before caveat found in the
+	// macaroons, if any.
+	Expires *time.Time `json:"expires,omitempty"`
+
+	// Caveats holds the caveats in the macaroons.
+	Caveats []introspectCaveat `json:"caveats"`
+}
+
+// introspectCaveat holds the details of a single caveat.
+type introspectCaveat struct {
+	// Macaroon holds the index of the macaroon that contains the
+	// caveat: 0 for the primary macaroon and greater for
+	// discharges.
+	Macaroon int `json:"macaroon"`
+
+	// Condition holds the condition of a first-party caveat.
+	Condition string `json:"condition,omitempty"`
+
+	// Location holds the location of a third-party caveat.
+	Location string `json:"location,omitempty"`
+}
+
+// Introspect reports whether the given macaroons are valid and the
+// details of the identity they authenticate and the caveats they
+// contain. It is intended to help diagnose why a macaroon is rejected,
+// so invalid macaroons do not cause an error response.
+func (h *handler) Introspect(p httprequest.Params, r *introspectRequest) (*introspectResponse, error) {
+	ms := r.Body.Macaroons
+	if len(ms) == 0 {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "macaroons not specified")
+	}
+	resp := introspectResponse{
+		ID:      macaroonID(ms[0].Id()),
+		Caveats: []introspectCaveat{},
+	}
+	for i, m := range ms {
+		for _, cav := range m.Caveats() {
+			if len(cav.VerificationId) == 0 {
+				resp.Caveats = append(resp.Caveats, introspectCaveat{
+					Macaroon:  i,
+					Condition: string(cav.Id),
+				})
+				continue
+			}
+			resp.Caveats = append(resp.Caveats, introspectCaveat{
+				Macaroon: i,
+				Location: cav.Location,
+			})
+		}
+	}
+	if t, ok := checkers.MacaroonsExpiryTime(auth.Namespace, ms); ok {
+		resp.Expires = &t
+	}
+	s, err := h.revocationStore(p)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	for _, m := range ms {
+		revoked, err := s.Revoked(p.Context, m.Id())
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if revoked {
+			resp.Revoked = true
+			resp.Error = "macaroon has been revoked"
+			return &resp, nil
+		}
+	}
+	authInfo, err := h.params.Authorizer.Auth(p.Context, []macaroon.Slice{ms}, identchecker.LoginOp)
+	if err != nil {
+		resp.Error = err.Error()
+		return &resp, nil
+	}
+	resp.Valid = true
+	resp.Username = authInfo.Identity.Id()
+	if id, ok := authInfo.Identity.(*auth.Identity); ok {
+		resp.ImpersonatedBy = id.Impersonator()
+		resp.Groups, err = id.Groups(p.Context)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	return &resp, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"encoding/json"
+	"net/http"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+type introspectResponse struct {
+	Valid    bool     `json:"valid"`
+	Error    string   `json:"error"`
+	Username string   `json:"username"`
+	Groups   []string `json:"groups"`
+	Caveats  []struct {
+		Macaroon  int    `json:"macaroon"`
+		Condition string `json:"condition"`
+		Location  string `json:"location"`
+	} `json:"caveats"`
+}
+
+func (s *usersSuite) TestIntrospect(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+		IDPGroups:  []string{"g1"},
+	})
+	m, err := s.adminClient.UserToken(s.srv.Ctx, &params.UserTokenRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	var resp introspectResponse
+	s.unmarshal(c, s.introspect(c, macaroon.Slice{m.M()}), http.StatusOK, &resp)
+	c.Assert(resp.Valid, qt.Equals, true)
+	c.Assert(resp.Username, qt.Equals, "jbloggs")
+	c.Assert(resp.Groups, qt.DeepEquals, []string{"g1"})
+	c.Assert(resp.Caveats, qt.Not(qt.HasLen), 0)
+}
+
+func (s *usersSuite) TestIntrospectInvalid(c *qt.C) {
+	badm, err := macaroon.New([]byte{}, []byte("no such macaroon"), "loc", macaroon.LatestVersion)
+	c.Assert(err, qt.Equals, nil)
+	err = badm.AddFirstPartyCaveat([]byte("time-before 2000-01-01T00:00:00Z"))
+	c.Assert(err, qt.Equals, nil)
+
+	var resp introspectResponse
+	s.unmarshal(c, s.introspect(c, macaroon.Slice{badm}), http.StatusOK, &resp)
+	c.Assert(resp.Valid, qt.Equals, false)
+	c.Assert(resp.Error, qt.Not(qt.Equals), "")
+	c.Assert(resp.Caveats, qt.HasLen, 1)
+	c.Assert(resp.Caveats[0].Condition, qt.Equals, "time-before 2000-01-01T00:00:00Z")
+}
+
+func (s *usersSuite) TestIntrospectNoMacaroons(c *qt.C) {
+	r := s.doAdminBody(c, "POST", "/v1/introspect", `{}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+func (s *usersSuite) introspect(c *qt.C, ms macaroon.Slice) *http.Response {
+	body, err := json.Marshal(map[string]interface{}{
+		"macaroons": ms,
+	})
+	c.Assert(err, qt.Equals, nil)
+	return s.doAdminBody(c, "POST", "/v1/introspect", string(body))
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"time"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/candid/internal/keyring"
+)
+
+// keysRequest is a request for the bakery key pairs accepted by the
+// server.
+type keysRequest struct {
+	httprequest.Route `httprequest:"GET /v1/keys"`
+}
+
+// rotateKeysRequest is a request to replace the current bakery key
+// pair.
+type rotateKeysRequest struct {
+	httprequest.Route `httprequest:"POST /v1/keys/rotate"`
+}
+
+// keysResponse holds the response from a keysRequest or a
+// rotateKeysRequest.
+type keysResponse struct {
+	Keys []keyInfo `json:"keys"`
+}
+
+// keyInfo holds information about a bakery key pair. The private key is
+// never returned.
+type keyInfo struct {
+	PublicKey *bakery.PublicKey `json:"public-key"`
+	Created   time.Time         `json:"created"`
+	Retired   *time.Time        `json:"retired,omitempty"`
+	Age       string            `json:"age"`
+	Current   bool              `json:"current"`
+}
+
+// Keys returns the public keys of the bakery key pairs currently
+// accepted by the server, the current key first.
+func (h *handler) Keys(p httprequest.Params, r *keysRequest) (*keysResponse, error) {
+	return keysInfo(h.params.KeyRing.Keys(), time.Now()), nil
+}
+
+// RotateKeys replaces the current bakery key pair with a new one. The
+// replaced key pair continues to be accepted for the configured
+// overlap period.
+func (h *handler) RotateKeys(p httprequest.Params, r *rotateKeysRequest) (*keysResponse, error) {
+	if err := h.params.KeyRing.Rotate(p.Context); err != nil {
+		if errgo.Cause(err) == keyring.ErrRotationNotEnabled {
+			return nil, errgo.WithCausef(nil, params.ErrBadRequest, "%s", err)
+		}
+		return nil, errgo.Notef(err, "cannot rotate keys")
+	}
+	return keysInfo(h.params.KeyRing.Keys(), time.Now()), nil
+}
+
+func keysInfo(keys []keyring.Key, now time.Time) *keysResponse {
+	resp := &keysResponse{
+		Keys: make([]keyInfo, len(keys)),
+	}
+	for i, k := range keys {
+		pk := k.KeyPair.Public
+		resp.Keys[i] = keyInfo{
+			PublicKey: &pk,
+			Created:   k.Created,
+			Age:       now.Sub(k.Created).Round(time.Second).String(),
+			Current:   i == 0,
+		}
+		if !k.Retired.IsZero() {
+			retired := k.Retired
+			resp.Keys[i].Retired = &retired
+		}
+	}
+	return resp
+}
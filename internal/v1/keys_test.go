@@ -0,0 +1,53 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"net/http"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+)
+
+type keysResponse struct {
+	Keys []struct {
+		PublicKey *bakery.PublicKey `json:"public-key"`
+		Current   bool              `json:"current"`
+	} `json:"keys"`
+}
+
+func (s *usersSuite) TestKeys(c *qt.C) {
+	resp := s.doAdmin(c, "GET", "/v1/keys")
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	var kresp keysResponse
+	err := httprequest.UnmarshalJSONResponse(resp, &kresp)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(kresp.Keys, qt.HasLen, 1)
+	c.Assert(*kresp.Keys[0].PublicKey, qt.Equals, s.srv.Key.Public)
+	c.Assert(kresp.Keys[0].Current, qt.Equals, true)
+}
+
+func (s *usersSuite) TestRotateKeysNotEnabled(c *qt.C) {
+	resp := s.doAdmin(c, "POST", "/v1/keys/rotate")
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+func (s *usersSuite) TestKeysUnauthorized(c *qt.C) {
+	req, err := http.NewRequest("GET", s.srv.URL+"/v1/keys", nil)
+	c.Assert(err, qt.Equals, nil)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, qt.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Not(qt.Equals), http.StatusOK)
+}
+
+func (s *usersSuite) doAdmin(c *qt.C, method, path string) *http.Response {
+	req, err := http.NewRequest(method, s.srv.URL+path, nil)
+	c.Assert(err, qt.Equals, nil)
+	resp, err := s.srv.AdminClient().Do(req)
+	c.Assert(err, qt.Equals, nil)
+	c.Defer(func() { resp.Body.Close() })
+	return resp
+}
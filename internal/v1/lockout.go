@@ -0,0 +1,79 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/idp/idputil/lockout"
+	"github.com/CanonicalLtd/candid/internal/logging"
+)
+
+// lockoutRequest is a request for the lockout status of a username in
+// an identity provider. The username is the one entered when logging
+// in, which need not be the username of an existing identity.
+type lockoutRequest struct {
+	httprequest.Route `httprequest:"GET /v1/lockouts/:idp/:username"`
+	IDP               string `httprequest:"idp,path"`
+	Username          string `httprequest:"username,path"`
+}
+
+// unlockRequest is a request to remove the lockout of a username in an
+// identity provider.
+type unlockRequest struct {
+	httprequest.Route `httprequest:"DELETE /v1/lockouts/:idp/:username"`
+	IDP               string `httprequest:"idp,path"`
+	Username          string `httprequest:"username,path"`
+}
+
+// Lockout returns the lockout status of the given username.
+func (h *handler) Lockout(p httprequest.Params, r *lockoutRequest) (*lockout.Status, error) {
+	l, err := h.lockoutStore(p, r.IDP)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	st, err := l.Status(p.Context, r.IDP, r.Username)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &st, nil
+}
+
+// Unlock removes any lockout of the given username and resets its
+// count of failed logins.
+func (h *handler) Unlock(p httprequest.Params, r *unlockRequest) error {
+	l, err := h.lockoutStore(p, r.IDP)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if err := l.Unlock(p.Context, r.IDP, r.Username); err != nil {
+		return errgo.Mask(err)
+	}
+	var unlockedBy string
+	if id := identityFromContext(p.Context); id != nil {
+		unlockedBy = id.Id()
+	}
+	logging.FromContext(p.Context, auditLogger).Infof("%s unlocked %q in %s", unlockedBy, r.Username, r.IDP)
+	return nil
+}
+
+func (h *handler) lockoutStore(p httprequest.Params, idpName string) (*lockout.Locker, error) {
+	found := false
+	for _, idp := range h.params.IdentityProviders {
+		if idp.Name() == idpName {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "identity provider %q not found", idpName)
+	}
+	kv, err := h.params.ProviderDataStore.KeyValueStore(p.Context, lockout.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return lockout.NewStore(kv), nil
+}
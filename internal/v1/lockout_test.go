@@ -0,0 +1,41 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"context"
+	"net/http"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/idp/idputil/lockout"
+)
+
+func (s *usersSuite) TestLockout(c *qt.C) {
+	ctx := context.Background()
+	kv, err := s.store.ProviderDataStore.KeyValueStore(ctx, lockout.StoreName)
+	c.Assert(err, qt.Equals, nil)
+	l, err := lockout.New(lockout.Params{MaxFailures: 1}, kv)
+	c.Assert(err, qt.Equals, nil)
+	l.Failed(ctx, "test", "bob")
+	c.Assert(l.Check(ctx, "test", "bob"), qt.Equals, lockout.ErrLockedOut)
+
+	var st lockout.Status
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/lockouts/test/bob", ""), http.StatusOK, &st)
+	c.Assert(st.LockedUntil.IsZero(), qt.Equals, false)
+
+	r := s.doAdminBody(c, "DELETE", "/v1/lockouts/test/bob", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(l.Check(ctx, "test", "bob"), qt.Equals, nil)
+
+	var st1 lockout.Status
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/lockouts/test/bob", ""), http.StatusOK, &st1)
+	c.Assert(st1.Failures, qt.Equals, 0)
+	c.Assert(st1.LockedUntil.IsZero(), qt.Equals, true)
+}
+
+func (s *usersSuite) TestLockoutUnknownIDP(c *qt.C) {
+	r := s.doAdminBody(c, "DELETE", "/v1/lockouts/nope/bob", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusNotFound)
+}
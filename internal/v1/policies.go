@@ -0,0 +1,147 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/internal/policy"
+)
+
+// policiesRequest is a request for all the discharge policies.
+type policiesRequest struct {
+	httprequest.Route `httprequest:"GET /v1/policies"`
+}
+
+// policyRequest is a request for a single discharge policy.
+type policyRequest struct {
+	httprequest.Route `httprequest:"GET /v1/policies/:name"`
+	Name              string `httprequest:"name,path"`
+}
+
+// setPolicyRequest is a request to create or replace a discharge
+// policy.
+type setPolicyRequest struct {
+	httprequest.Route `httprequest:"PUT /v1/policies/:name"`
+	Name              string     `httprequest:"name,path"`
+	Body              policyBody `httprequest:",body"`
+}
+
+// policyBody holds the body of a setPolicyRequest.
+type policyBody struct {
+	// PublicKey holds the public key of the relying service that
+	// the policy applies to.
+	PublicKey *bakery.PublicKey `json:"public-key,omitempty"`
+
+	// Origin holds the origin of the discharge requests that the
+	// policy applies to.
+	Origin string `json:"origin,omitempty"`
+
+	// Groups holds the groups whose members may obtain discharges.
+	Groups []string `json:"groups,omitempty"`
+
+	// Restrictions holds restrictions on the times and addresses
+	// at which discharges may be obtained and used.
+	Restrictions []policy.Restriction `json:"restrictions,omitempty"`
+}
+
+// removePolicyRequest is a request to remove a discharge policy.
+type removePolicyRequest struct {
+	httprequest.Route `httprequest:"DELETE /v1/policies/:name"`
+	Name              string `httprequest:"name,path"`
+}
+
+// Policies returns all the discharge policies.
+func (h *handler) Policies(p httprequest.Params, _ *policiesRequest) ([]policy.Policy, error) {
+	s, err := h.policyStore(p)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	ps, err := s.List(p.Context)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if ps == nil {
+		ps = []policy.Policy{}
+	}
+	return ps, nil
+}
+
+// Policy returns the discharge policy with the given name.
+func (h *handler) Policy(p httprequest.Params, r *policyRequest) (*policy.Policy, error) {
+	s, err := h.policyStore(p)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	pol, err := s.Get(p.Context, r.Name)
+	if err != nil {
+		return nil, policyError(err)
+	}
+	return &pol, nil
+}
+
+// SetPolicy creates or replaces the discharge policy with the given
+// name. Once a policy exists, discharges for the relying services it
+// matches are only given to members of its groups.
+func (h *handler) SetPolicy(p httprequest.Params, r *setPolicyRequest) error {
+	pol := policy.Policy{
+		Name:         r.Name,
+		PublicKey:    r.Body.PublicKey,
+		Origin:       r.Body.Origin,
+		Groups:       r.Body.Groups,
+		Restrictions: r.Body.Restrictions,
+	}
+	if err := pol.Validate(); err != nil {
+		return errgo.WithCausef(err, params.ErrBadRequest, "")
+	}
+	s, err := h.policyStore(p)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.Set(p.Context, pol); err != nil {
+		return errgo.Mask(err)
+	}
+	var setBy string
+	if id := identityFromContext(p.Context); id != nil {
+		setBy = id.Id()
+	}
+	logging.FromContext(p.Context, auditLogger).Infof("%s set policy %q", setBy, r.Name)
+	return nil
+}
+
+// RemovePolicy removes the discharge policy with the given name.
+func (h *handler) RemovePolicy(p httprequest.Params, r *removePolicyRequest) error {
+	s, err := h.policyStore(p)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.Remove(p.Context, r.Name); err != nil {
+		return policyError(err)
+	}
+	var removedBy string
+	if id := identityFromContext(p.Context); id != nil {
+		removedBy = id.Id()
+	}
+	logging.FromContext(p.Context, auditLogger).Infof("%s removed policy %q", removedBy, r.Name)
+	return nil
+}
+
+func (h *handler) policyStore(p httprequest.Params) (*policy.Store, error) {
+	kv, err := h.params.ProviderDataStore.KeyValueStore(p.Context, policy.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return policy.NewStore(kv), nil
+}
+
+func policyError(err error) error {
+	if errgo.Cause(err) == policy.ErrNotFound {
+		return errgo.WithCausef(err, params.ErrNotFound, "")
+	}
+	return errgo.Mask(err)
+}
@@ -0,0 +1,62 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"net/http"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/internal/policy"
+)
+
+func (s *usersSuite) TestPolicies(c *qt.C) {
+	var ps []policy.Policy
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/policies", ""), http.StatusOK, &ps)
+	c.Assert(ps, qt.HasLen, 0)
+
+	r := s.doBody(c, s.srv.AdminClient(), "PUT", "/v1/policies/prod", `{"public-key":"CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=","groups":["ops"]}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+
+	var p policy.Policy
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/policies/prod", ""), http.StatusOK, &p)
+	c.Assert(p.Name, qt.Equals, "prod")
+	c.Assert(p.PublicKey.String(), qt.Equals, "CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=")
+	c.Assert(p.Groups, qt.DeepEquals, []string{"ops"})
+
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/policies", ""), http.StatusOK, &ps)
+	c.Assert(ps, qt.HasLen, 1)
+
+	r = s.doAdminBody(c, "DELETE", "/v1/policies/prod", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+	r = s.doAdminBody(c, "GET", "/v1/policies/prod", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusNotFound)
+	r = s.doAdminBody(c, "DELETE", "/v1/policies/prod", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusNotFound)
+}
+
+func (s *usersSuite) TestSetPolicyBadRequest(c *qt.C) {
+	r := s.doBody(c, s.srv.AdminClient(), "PUT", "/v1/policies/prod", `{"groups":["ops"]}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+func (s *usersSuite) TestSetPolicyRestrictions(c *qt.C) {
+	r := s.doBody(c, s.srv.AdminClient(), "PUT", "/v1/policies/office", `{"origin":"https://example.com","restrictions":[{"groups":["contractors"],"hours":{"from":"09:00","until":"17:00","time-zone":"Europe/London"},"networks":["10.0.0.0/8"]}]}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+
+	var p policy.Policy
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/policies/office", ""), http.StatusOK, &p)
+	c.Assert(p.Restrictions, qt.DeepEquals, []policy.Restriction{{
+		Groups: []string{"contractors"},
+		Hours: &policy.Hours{
+			From:     "09:00",
+			Until:    "17:00",
+			TimeZone: "Europe/London",
+		},
+		Networks: []string{"10.0.0.0/8"},
+	}})
+
+	r = s.doBody(c, s.srv.AdminClient(), "PUT", "/v1/policies/office", `{"origin":"https://example.com","restrictions":[{"networks":["bad"]}]}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusBadRequest)
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// maxFullNameLength holds the maximum length of a name set by a user.
+const maxFullNameLength = 256
+
+// profileRequest is a request for the profile of the authenticated
+// user.
+type profileRequest struct {
+	httprequest.Route `httprequest:"GET /v1/me"`
+}
+
+// profileResponse holds the profile of the authenticated user.
+type profileResponse struct {
+	params.User
+
+	// EditableFields holds the fields of the profile that the user
+	// may change.
+	EditableFields []string `json:"editable-fields"`
+}
+
+// setProfileRequest is a request to change the profile of the
+// authenticated user.
+type setProfileRequest struct {
+	httprequest.Route `httprequest:"PUT /v1/me"`
+	Body              profileUpdate `httprequest:",body"`
+}
+
+// profileUpdate holds the changes to make to a user's profile. Fields
+// that are nil are left unchanged.
+type profileUpdate struct {
+	FullName *string `json:"fullname,omitempty"`
+	Email    *string `json:"email,omitempty"`
+}
+
+// Profile returns the identity record of the authenticated user.
+func (h *handler) Profile(p httprequest.Params, _ *profileRequest) (*profileResponse, error) {
+	identity, err := h.authenticatedIdentity(p)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	u, err := h.userFromIdentity(p.Context, identity)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &profileResponse{
+		User:           *u,
+		EditableFields: h.params.EditableProfileFields,
+	}, nil
+}
+
+// SetProfile changes the name or email address of the authenticated
+// user. Only the fields allowed by the server configuration may be
+// changed.
+func (h *handler) SetProfile(p httprequest.Params, r *setProfileRequest) error {
+	identity, err := h.authenticatedIdentity(p)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	var update store.Update
+	var changes []string
+	if r.Body.FullName != nil {
+		if !h.profileFieldEditable("name") {
+			return errgo.WithCausef(nil, params.ErrForbidden, "name cannot be changed")
+		}
+		name := strings.TrimSpace(*r.Body.FullName)
+		if name == "" || len(name) > maxFullNameLength {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "invalid name")
+		}
+		changes = append(changes, fmt.Sprintf("name from %q to %q", identity.Name, name))
+		identity.Name = name
+		update[store.Name] = store.Set
+	}
+	if r.Body.Email != nil {
+		if !h.profileFieldEditable("email") {
+			return errgo.WithCausef(nil, params.ErrForbidden, "email cannot be changed")
+		}
+		addr, err := mail.ParseAddress(*r.Body.Email)
+		if err != nil || addr.Address != *r.Body.Email {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "invalid email address")
+		}
+		changes = append(changes, fmt.Sprintf("email from %q to %q", identity.Email, addr.Address))
+		identity.Email = addr.Address
+		update[store.Email] = store.Set
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	if err := h.params.Store.UpdateIdentity(p.Context, identity, update); err != nil {
+		return errgo.Mask(err)
+	}
+	logging.FromContext(p.Context, auditLogger).Infof("%s changed their %s", identity.Username, strings.Join(changes, " and "))
+	return nil
+}
+
+// authenticatedIdentity returns the stored identity of the user that
+// made the request.
+func (h *handler) authenticatedIdentity(p httprequest.Params) (*store.Identity, error) {
+	id := identityFromContext(p.Context)
+	if id == nil || id.Id() == "" {
+		// Should never happen, as the endpoint should require authentication.
+		return nil, errgo.Newf("no identity")
+	}
+	identity := store.Identity{
+		Username: id.Id(),
+	}
+	if err := h.params.Store.Identity(p.Context, &identity); err != nil {
+		return nil, translateStoreError(err)
+	}
+	return &identity, nil
+}
+
+// profileFieldEditable reports whether users may change the given
+// field of their own profile.
+func (h *handler) profileFieldEditable(field string) bool {
+	for _, f := range h.params.EditableProfileFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
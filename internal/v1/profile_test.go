@@ -0,0 +1,60 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"net/http"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+)
+
+type profile struct {
+	params.User
+	EditableFields []string `json:"editable-fields"`
+}
+
+func (s *usersSuite) TestProfile(c *qt.C) {
+	client := s.srv.Client(s.interactor)
+	var p profile
+	s.unmarshal(c, s.doBody(c, client, "GET", "/v1/me", ""), http.StatusOK, &p)
+	c.Assert(p.Username, qt.Equals, params.Username("bob"))
+	c.Assert(p.IDPGroups, qt.DeepEquals, []string{"g1", "g2", "testgroup"})
+	c.Assert(p.EditableFields, qt.DeepEquals, []string{"name", "email"})
+
+	r := s.doBody(c, client, "PUT", "/v1/me", `{"fullname":"Robert","email":"robert@example.com"}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+
+	s.unmarshal(c, s.doBody(c, client, "GET", "/v1/me", ""), http.StatusOK, &p)
+	c.Assert(p.FullName, qt.Equals, "Robert")
+	c.Assert(p.Email, qt.Equals, "robert@example.com")
+}
+
+var setProfileErrorTests = []struct {
+	about  string
+	body   string
+	status int
+}{{
+	about:  "empty name",
+	body:   `{"fullname":" "}`,
+	status: http.StatusBadRequest,
+}, {
+	about:  "invalid email",
+	body:   `{"email":"not an email"}`,
+	status: http.StatusBadRequest,
+}, {
+	about:  "email with display name",
+	body:   `{"email":"Bob <bob@example.com>"}`,
+	status: http.StatusBadRequest,
+}}
+
+func (s *usersSuite) TestSetProfileErrors(c *qt.C) {
+	client := s.srv.Client(s.interactor)
+	for _, test := range setProfileErrorTests {
+		c.Run(test.about, func(c *qt.C) {
+			r := s.doBody(c, client, "PUT", "/v1/me", test.body)
+			c.Assert(r.StatusCode, qt.Equals, test.status)
+		})
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+const (
+	// defaultQueryLimit holds the number of users returned by
+	// a query that specifies a cursor but no limit.
+	defaultQueryLimit = 100
+
+	// maxQueryLimit holds the maximum number of users returned by a
+	// single paginated query.
+	maxQueryLimit = 1000
+
+	// nextCursorHeader holds the name of the response header in
+	// which the cursor for the next page of a query is returned.
+	nextCursorHeader = "Candid-Next-Cursor"
+)
+
+// sortFields holds the fields that users may be sorted by.
+var sortFields = map[string]store.Field{
+	"username":       store.Username,
+	"name":           store.Name,
+	"email":          store.Email,
+	"last-login":     store.LastLogin,
+	"last-discharge": store.LastDischarge,
+}
+
+// A userQuery holds the parameters of a user query beyond those in
+// params.QueryUsersRequest.
+type userQuery struct {
+	// conditions holds the additional conditions that the users
+	// must match.
+	conditions []store.Condition
+
+	// sort holds the sort order of the users.
+	sort []store.Sort
+
+	// sortParam holds the sort parameter the query was made with.
+	sortParam string
+
+	// limit holds the maximum number of users to return. If this
+	// is zero all users are returned.
+	limit int
+
+	// cursor holds the position of the page to return.
+	cursor userCursor
+}
+
+// A userCursor records the position of the next page of a user query
+// or search.
+type userCursor struct {
+	// Sort holds the sort parameter of the query, which must not
+	// change between pages.
+	Sort string `json:"s"`
+
+	// After holds the username of the last user returned by a
+	// query. Along with the values of the other sort fields of that
+	// user, which are held below, it allows the next page to be
+	// found without skipping over the earlier pages.
+	After string `json:"a,omitempty"`
+
+	Name          string     `json:"n,omitempty"`
+	Email         string     `json:"e,omitempty"`
+	LastLogin     *time.Time `json:"l,omitempty"`
+	LastDischarge *time.Time `json:"d,omitempty"`
+
+	// Skip holds the number of results to skip in a search.
+	Skip int `json:"k,omitempty"`
+}
+
+// parseUserQuery parses the additional user query parameters from the
+// given form. The following parameters are recognised:
+//
+//	provider         users from the identity provider with this name
+//	group            users that are members of the group (may be repeated)
+//	email-domain     users whose email address is in this domain
+//	last-login-since users that last logged in at or after this time
+//	last-login-until users that last logged in before this time
+//	sort             comma separated list of fields to sort by, each
+//	                 optionally prefixed with "-" for descending order
+//	limit            maximum number of users to return
+//	cursor           cursor returned from a previous query
+func parseUserQuery(form url.Values) (*userQuery, error) {
+	var q userQuery
+	if provider := form.Get("provider"); provider != "" {
+		q.conditions = append(q.conditions, store.Condition{
+			Field:      store.ProviderID,
+			Comparison: store.HasPrefix,
+			Ref:        store.Identity{ProviderID: store.ProviderIdentity(provider + ":")},
+		})
+	}
+	if groups := form["group"]; len(groups) > 0 {
+		q.conditions = append(q.conditions, store.Condition{
+			Field:      store.Groups,
+			Comparison: store.Contains,
+			Ref:        store.Identity{Groups: groups},
+		})
+	}
+	if domain := form.Get("email-domain"); domain != "" {
+		q.conditions = append(q.conditions, store.Condition{
+			Field:      store.Email,
+			Comparison: store.HasSuffix,
+			Ref:        store.Identity{Email: "@" + domain},
+		})
+	}
+	if since := form.Get("last-login-since"); since != "" {
+		var t time.Time
+		if err := t.UnmarshalText([]byte(since)); err != nil {
+			return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid last-login-since")
+		}
+		q.conditions = append(q.conditions, store.Condition{
+			Field:      store.LastLogin,
+			Comparison: store.GreaterThanOrEqual,
+			Ref:        store.Identity{LastLogin: t},
+		})
+	}
+	if until := form.Get("last-login-until"); until != "" {
+		var t time.Time
+		if err := t.UnmarshalText([]byte(until)); err != nil {
+			return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid last-login-until")
+		}
+		q.conditions = append(q.conditions, store.Condition{
+			Field:      store.LastLogin,
+			Comparison: store.LessThan,
+			Ref:        store.Identity{LastLogin: t},
+		})
+	}
+	q.sortParam = form.Get("sort")
+	sortedByUsername := false
+	if q.sortParam != "" {
+		for _, f := range strings.Split(q.sortParam, ",") {
+			var s store.Sort
+			if strings.HasPrefix(f, "-") {
+				s.Descending = true
+				f = f[1:]
+			}
+			field, ok := sortFields[f]
+			if !ok {
+				return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid sort field %q", f)
+			}
+			s.Field = field
+			sortedByUsername = sortedByUsername || field == store.Username
+			q.sort = append(q.sort, s)
+		}
+	}
+	if !sortedByUsername {
+		// Always finish with the username so that the order is
+		// well defined.
+		q.sort = append(q.sort, store.Sort{Field: store.Username})
+	}
+	if v := form.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid limit %q", v)
+		}
+		q.limit = n
+	}
+	if v := form.Get("cursor"); v != "" {
+		var err error
+		q.cursor, err = decodeCursor(v)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+		if q.cursor.Sort != q.sortParam {
+			return nil, errgo.WithCausef(nil, params.ErrBadRequest, "cursor does not match sort %q", q.sortParam)
+		}
+		if q.limit == 0 {
+			q.limit = defaultQueryLimit
+		}
+		if q.cursor.After != "" {
+			q.conditions = append(q.conditions, store.Condition{
+				Comparison: store.After,
+				Ref:        q.cursor.identity(),
+				Sort:       q.sort,
+			})
+		}
+	}
+	if q.limit > maxQueryLimit {
+		q.limit = maxQueryLimit
+	}
+	return &q, nil
+}
+
+// next returns the cursor for the page following the given page of
+// identities.
+func (q *userQuery) next(page []store.Identity) string {
+	last := &page[len(page)-1]
+	c := userCursor{
+		Sort:  q.sortParam,
+		After: last.Username,
+	}
+	for _, s := range q.sort {
+		switch s.Field {
+		case store.Name:
+			c.Name = last.Name
+		case store.Email:
+			c.Email = last.Email
+		case store.LastLogin:
+			t := last.LastLogin
+			c.LastLogin = &t
+		case store.LastDischarge:
+			t := last.LastDischarge
+			c.LastDischarge = &t
+		}
+	}
+	return c.String()
+}
+
+// decodeCursor decodes a cursor previously encoded with
+// userCursor.String.
+func decodeCursor(s string) (userCursor, error) {
+	var c userCursor
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return userCursor{}, errgo.WithCausef(nil, params.ErrBadRequest, "invalid cursor")
+	}
+	if err := json.Unmarshal(buf, &c); err != nil || c.Skip < 0 {
+		return userCursor{}, errgo.WithCausef(nil, params.ErrBadRequest, "invalid cursor")
+	}
+	return c, nil
+}
+
+// String returns the opaque encoding of the cursor.
+func (c userCursor) String() string {
+	buf, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// identity returns an identity holding the sort field values recorded
+// in the cursor.
+func (c userCursor) identity() store.Identity {
+	id := store.Identity{
+		Username: c.After,
+		Name:     c.Name,
+		Email:    c.Email,
+	}
+	if c.LastLogin != nil {
+		id.LastLogin = *c.LastLogin
+	}
+	if c.LastDischarge != nil {
+		id.LastDischarge = *c.LastDischarge
+	}
+	return id
+}
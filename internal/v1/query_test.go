@@ -0,0 +1,141 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+func (s *usersSuite) addQueryUsers(c *qt.C) {
+	for _, u := range []params.User{{
+		Username:   "alice",
+		ExternalID: "test:alice",
+		FullName:   "Alice",
+		Email:      "alice@example.com",
+		IDPGroups:  []string{"ops", "dev"},
+	}, {
+		Username:   "bob",
+		ExternalID: "test:bob",
+		FullName:   "Bob",
+		Email:      "bob@example.org",
+		IDPGroups:  []string{"dev"},
+	}, {
+		Username:   "carol",
+		ExternalID: "other:carol",
+		FullName:   "Carol",
+		Email:      "carol@example.com",
+		IDPGroups:  []string{"ops"},
+	}} {
+		s.addUser(c, u)
+	}
+	// Carol has never logged in.
+	for username, t := range map[string]time.Time{
+		"alice": time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC),
+		"bob":   time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		err := s.store.Store.UpdateIdentity(s.srv.Ctx, &store.Identity{
+			Username:  username,
+			LastLogin: t,
+		}, store.Update{
+			store.LastLogin: store.Set,
+		})
+		c.Assert(err, qt.Equals, nil)
+	}
+}
+
+var queryUsersFilterTests = []struct {
+	about  string
+	query  url.Values
+	expect []string
+}{{
+	about:  "provider",
+	query:  url.Values{"provider": {"other"}},
+	expect: []string{"carol"},
+}, {
+	about:  "email domain",
+	query:  url.Values{"email-domain": {"example.com"}},
+	expect: []string{"alice", "carol"},
+}, {
+	about:  "single group",
+	query:  url.Values{"group": {"dev"}},
+	expect: []string{"alice", "bob"},
+}, {
+	about:  "multiple groups",
+	query:  url.Values{"group": {"dev", "ops"}},
+	expect: []string{"alice"},
+}, {
+	about:  "last login since",
+	query:  url.Values{"last-login-since": {"2019-06-01T00:00:00Z"}},
+	expect: []string{"alice"},
+}, {
+	about:  "last login range",
+	query:  url.Values{"last-login-since": {"2019-01-01T00:00:00Z"}, "last-login-until": {"2019-06-01T00:00:00Z"}},
+	expect: []string{"bob"},
+}, {
+	about:  "sort descending",
+	query:  url.Values{"email-domain": {"example.com"}, "sort": {"-name"}},
+	expect: []string{"carol", "alice"},
+}}
+
+func (s *usersSuite) TestQueryUsersFilters(c *qt.C) {
+	s.addQueryUsers(c)
+	for _, test := range queryUsersFilterTests {
+		c.Run(test.about, func(c *qt.C) {
+			var usernames []string
+			s.unmarshal(c, s.doAdmin(c, "GET", "/v1/u?"+test.query.Encode()), http.StatusOK, &usernames)
+			c.Assert(usernames, qt.DeepEquals, test.expect)
+		})
+	}
+}
+
+func (s *usersSuite) TestQueryUsersPagination(c *qt.C) {
+	s.addQueryUsers(c)
+	for _, sort := range []string{"", "-username", "-email", "last-login", "-last-login", "-last-login,name"} {
+		c.Run("sort="+sort, func(c *qt.C) {
+			var all []string
+			s.unmarshal(c, s.doAdmin(c, "GET", "/v1/u?"+url.Values{"sort": {sort}}.Encode()), http.StatusOK, &all)
+			var paged []string
+			cursor := ""
+			for i := 0; i < len(all); i++ {
+				q := url.Values{"limit": {"1"}, "sort": {sort}}
+				if cursor != "" {
+					q.Set("cursor", cursor)
+				}
+				resp := s.doAdmin(c, "GET", "/v1/u?"+q.Encode())
+				cursor = resp.Header.Get("Candid-Next-Cursor")
+				var page []string
+				s.unmarshal(c, resp, http.StatusOK, &page)
+				c.Assert(page, qt.HasLen, 1)
+				paged = append(paged, page...)
+				if cursor == "" {
+					break
+				}
+			}
+			c.Assert(cursor, qt.Equals, "")
+			c.Assert(paged, qt.DeepEquals, all)
+		})
+	}
+}
+
+func (s *usersSuite) TestQueryUsersBadSort(c *qt.C) {
+	resp := s.doAdmin(c, "GET", "/v1/u?sort=password")
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+func (s *usersSuite) TestQueryUsersBadLastLoginSince(c *qt.C) {
+	resp := s.doAdmin(c, "GET", "/v1/u?last-login-since=yesterday")
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+func (s *usersSuite) TestQueryUsersBadCursor(c *qt.C) {
+	resp := s.doAdmin(c, "GET", "/v1/u?cursor=not-a-cursor")
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+}
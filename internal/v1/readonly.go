@@ -0,0 +1,46 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+)
+
+// readOnlyRequest is a request for whether the server is read-only.
+type readOnlyRequest struct {
+	httprequest.Route `httprequest:"GET /v1/read-only"`
+}
+
+// setReadOnlyRequest is a request to change whether the server is
+// read-only.
+type setReadOnlyRequest struct {
+	httprequest.Route `httprequest:"PUT /v1/read-only"`
+	Body              readOnlyBody `httprequest:",body"`
+}
+
+// readOnlyBody holds the body of a setReadOnlyRequest and the response
+// from a readOnlyRequest.
+type readOnlyBody struct {
+	// ReadOnly holds whether identities can be created or changed.
+	ReadOnly bool `json:"read-only"`
+}
+
+// ReadOnly returns whether the server is read-only.
+func (h *handler) ReadOnly(p httprequest.Params, r *readOnlyRequest) (*readOnlyBody, error) {
+	return &readOnlyBody{
+		ReadOnly: h.params.ReadOnly.ReadOnly(),
+	}, nil
+}
+
+// SetReadOnly changes whether the server is read-only. While the server
+// is read-only existing users can log in and obtain discharges, but
+// identities cannot be created or changed. The change is seen by the
+// other servers sharing the store within a few seconds.
+func (h *handler) SetReadOnly(p httprequest.Params, r *setReadOnlyRequest) error {
+	if err := h.params.ReadOnly.SetReadOnly(p.Context, r.Body.ReadOnly); err != nil {
+		return errgo.Notef(err, "cannot set read-only mode")
+	}
+	return nil
+}
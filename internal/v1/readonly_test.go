@@ -0,0 +1,49 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"context"
+	"net/http"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+type readOnlyBody struct {
+	ReadOnly bool `json:"read-only"`
+}
+
+func (s *usersSuite) TestReadOnly(c *qt.C) {
+	err := s.store.Store.UpdateIdentity(context.Background(), &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	var ro readOnlyBody
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/read-only", ""), http.StatusOK, &ro)
+	c.Assert(ro.ReadOnly, qt.Equals, false)
+
+	r := s.doBody(c, s.srv.AdminClient(), "PUT", "/v1/read-only", `{"read-only":true}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/read-only", ""), http.StatusOK, &ro)
+	c.Assert(ro.ReadOnly, qt.Equals, true)
+
+	r = s.doBody(c, s.srv.AdminClient(), "PUT", "/v1/u/bob/extra-info", `{"item":"value"}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusServiceUnavailable)
+
+	r = s.doBody(c, s.srv.AdminClient(), "PUT", "/v1/read-only", `{"read-only":false}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+	r = s.doBody(c, s.srv.AdminClient(), "PUT", "/v1/u/bob/extra-info", `{"item":"value"}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+}
+
+func (s *usersSuite) TestSetReadOnlyUnauthorized(c *qt.C) {
+	r := s.doBody(c, s.srv.Client(s.interactor), "PUT", "/v1/read-only", `{"read-only":true}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusUnauthorized)
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"time"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/internal/rpaccess"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// relyingPartiesRequest is a request for the relying parties that a
+// user has recently signed in to.
+type relyingPartiesRequest struct {
+	httprequest.Route `httprequest:"GET /v1/u/:username/relying-parties"`
+	Username          params.Username `httprequest:"username,path"`
+}
+
+// relyingPartiesResponse holds the relying parties that a user has
+// recently signed in to, most recent first.
+type relyingPartiesResponse struct {
+	RelyingParties []rpaccess.Access `json:"relying-parties"`
+}
+
+// revokeRelyingPartyRequest is a request to revoke a user's access to
+// a relying party. The relying party is specified by its ID, which is
+// its public key, as a form value because it may contain characters
+// that are not allowed in a path element.
+type revokeRelyingPartyRequest struct {
+	httprequest.Route `httprequest:"DELETE /v1/u/:username/relying-parties"`
+	Username          params.Username `httprequest:"username,path"`
+	ID                string          `httprequest:"id,form"`
+}
+
+// RelyingParties returns the relying parties that the given user has
+// recently obtained discharges for.
+func (h *handler) RelyingParties(p httprequest.Params, r *relyingPartiesRequest) (*relyingPartiesResponse, error) {
+	if err := h.checkUserExists(p, r.Username); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	s, err := h.rpAccessStore(p)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	access, err := s.List(p.Context, string(r.Username))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if access == nil {
+		access = []rpaccess.Access{}
+	}
+	return &relyingPartiesResponse{
+		RelyingParties: access,
+	}, nil
+}
+
+// RevokeRelyingParty removes the given relying party from the list of
+// relying parties that the given user has signed in to, and records
+// the revocation so that any sessions the user has with the relying
+// party can be ended. If the relying party is a registered service
+// with a logout URI, it is sent a back-channel logout notification.
+func (h *handler) RevokeRelyingParty(p httprequest.Params, r *revokeRelyingPartyRequest) error {
+	if r.ID == "" {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "relying party id not specified")
+	}
+	if err := h.checkUserExists(p, r.Username); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	s, err := h.rpAccessStore(p)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.Revoke(p.Context, string(r.Username), r.ID, time.Now()); err != nil {
+		return errgo.Mask(err)
+	}
+	h.params.LogoutNotifier.AccessRevoked(p.Context, string(r.Username), r.ID)
+	return nil
+}
+
+func (h *handler) checkUserExists(p httprequest.Params, username params.Username) error {
+	id := store.Identity{
+		Username: string(username),
+	}
+	if err := h.params.Store.Identity(p.Context, &id); err != nil {
+		return translateStoreError(err)
+	}
+	return nil
+}
+
+func (h *handler) rpAccessStore(p httprequest.Params) (*rpaccess.Store, error) {
+	kv, err := h.params.ProviderDataStore.KeyValueStore(p.Context, rpaccess.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return rpaccess.NewStore(kv), nil
+}
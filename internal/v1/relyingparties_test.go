@@ -0,0 +1,75 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/candid/internal/rpaccess"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+func (s *usersSuite) TestRelyingParties(c *qt.C) {
+	ctx := context.Background()
+	s.addRelyingPartyUser(c, "bob")
+	kv, err := s.store.ProviderDataStore.KeyValueStore(ctx, rpaccess.StoreName)
+	c.Assert(err, qt.Equals, nil)
+	rps := rpaccess.NewStore(kv)
+	rp1 := bakery.MustGenerateKey().Public.String()
+	rp2 := bakery.MustGenerateKey().Public.String()
+	now := time.Now().UTC().Truncate(time.Second)
+	err = rps.Record(ctx, "bob", rp1, now.Add(-time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	err = rps.Record(ctx, "bob", rp2, now)
+	c.Assert(err, qt.Equals, nil)
+
+	var resp struct {
+		RelyingParties []rpaccess.Access `json:"relying-parties"`
+	}
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/u/bob/relying-parties", ""), http.StatusOK, &resp)
+	c.Assert(resp.RelyingParties, qt.HasLen, 2)
+	c.Assert(resp.RelyingParties[0].ID, qt.Equals, rp2)
+	c.Assert(resp.RelyingParties[0].Count, qt.Equals, 1)
+	c.Assert(resp.RelyingParties[1].ID, qt.Equals, rp1)
+
+	r := s.doAdminBody(c, "DELETE", "/v1/u/bob/relying-parties?id="+url.QueryEscape(rp1), "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/u/bob/relying-parties", ""), http.StatusOK, &resp)
+	c.Assert(resp.RelyingParties, qt.HasLen, 1)
+	c.Assert(resp.RelyingParties[0].ID, qt.Equals, rp2)
+
+	revoked, err := rps.Revoked(ctx, "bob", rp1)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(revoked.IsZero(), qt.Equals, false)
+}
+
+func (s *usersSuite) TestRelyingPartiesNoUser(c *qt.C) {
+	r := s.doAdminBody(c, "GET", "/v1/u/nobody/relying-parties", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusNotFound)
+	r = s.doAdminBody(c, "DELETE", "/v1/u/nobody/relying-parties?id=x", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusNotFound)
+}
+
+func (s *usersSuite) TestRevokeRelyingPartyNoID(c *qt.C) {
+	s.addRelyingPartyUser(c, "bob")
+	r := s.doAdminBody(c, "DELETE", "/v1/u/bob/relying-parties", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+func (s *usersSuite) addRelyingPartyUser(c *qt.C, username string) {
+	err := s.store.Store.UpdateIdentity(context.Background(), &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", username),
+		Username:   username,
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+}
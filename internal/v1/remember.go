@@ -0,0 +1,81 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/internal/remember"
+)
+
+// rememberedBrowsersRequest is a request for the browsers remembered
+// for a user.
+type rememberedBrowsersRequest struct {
+	httprequest.Route `httprequest:"GET /v1/u/:username/remembered-browsers"`
+	Username          params.Username `httprequest:"username,path"`
+}
+
+// rememberedBrowsersResponse holds the browsers remembered for a user,
+// most recent first.
+type rememberedBrowsersResponse struct {
+	Browsers []remember.Browser `json:"browsers"`
+}
+
+// forgetBrowserRequest is a request to forget one of the browsers
+// remembered for a user.
+type forgetBrowserRequest struct {
+	httprequest.Route `httprequest:"DELETE /v1/u/:username/remembered-browsers/:id"`
+	Username          params.Username `httprequest:"username,path"`
+	ID                string          `httprequest:"id,path"`
+}
+
+// RememberedBrowsers returns the browsers that the given user has asked
+// to be remembered and that have not expired.
+func (h *handler) RememberedBrowsers(p httprequest.Params, r *rememberedBrowsersRequest) (*rememberedBrowsersResponse, error) {
+	if err := h.checkUserExists(p, r.Username); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	s, err := h.rememberStore(p)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	bs, err := s.List(p.Context, string(r.Username))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if bs == nil {
+		bs = []remember.Browser{}
+	}
+	return &rememberedBrowsersResponse{
+		Browsers: bs,
+	}, nil
+}
+
+// ForgetBrowser forgets the given remembered browser, so that the next
+// login from it must visit an identity provider.
+func (h *handler) ForgetBrowser(p httprequest.Params, r *forgetBrowserRequest) error {
+	s, err := h.rememberStore(p)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.Remove(p.Context, string(r.Username), r.ID); err != nil {
+		if errgo.Cause(err) == remember.ErrNotFound {
+			return errgo.WithCausef(err, params.ErrNotFound, "")
+		}
+		return errgo.Mask(err)
+	}
+	logging.FromContext(p.Context, auditLogger).Infof("remembered browser %s of %s forgotten", r.ID, r.Username)
+	return nil
+}
+
+func (h *handler) rememberStore(p httprequest.Params) (*remember.Store, error) {
+	kv, err := h.params.ProviderDataStore.KeyValueStore(p.Context, remember.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return remember.NewStore(kv), nil
+}
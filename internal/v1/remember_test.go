@@ -0,0 +1,40 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/internal/remember"
+)
+
+func (s *usersSuite) TestRememberedBrowsers(c *qt.C) {
+	ctx := context.Background()
+	s.addRelyingPartyUser(c, "bob")
+	kv, err := s.store.ProviderDataStore.KeyValueStore(ctx, remember.StoreName)
+	c.Assert(err, qt.Equals, nil)
+	b, err := remember.NewStore(kv).Add(ctx, "bob", "test-browser", "192.0.2.1", time.Now().Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+
+	var resp struct {
+		Browsers []remember.Browser `json:"browsers"`
+	}
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/u/bob/remembered-browsers", ""), http.StatusOK, &resp)
+	c.Assert(resp.Browsers, qt.HasLen, 1)
+	c.Assert(resp.Browsers[0].ID, qt.Equals, b.ID)
+	c.Assert(resp.Browsers[0].UserAgent, qt.Equals, "test-browser")
+
+	r := s.doAdminBody(c, "DELETE", "/v1/u/bob/remembered-browsers/"+b.ID, "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/u/bob/remembered-browsers", ""), http.StatusOK, &resp)
+	c.Assert(resp.Browsers, qt.HasLen, 0)
+
+	r = s.doAdminBody(c, "DELETE", "/v1/u/bob/remembered-browsers/"+b.ID, "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusNotFound)
+}
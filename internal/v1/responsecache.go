@@ -0,0 +1,145 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+)
+
+// maxCachedResponses holds the number of cached responses above which
+// expired responses are removed from the cache.
+const maxCachedResponses = 10000
+
+// A responseCache holds the responses to frequently polled requests
+// for a short time, so that they do not all go to the store.
+type responseCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	responses map[responseKey]cachedResponse
+}
+
+// responseKey identifies a cached response.
+type responseKey struct {
+	username string
+	kind     string
+}
+
+// cachedResponse holds a JSON encoded response and its entity tag.
+type cachedResponse struct {
+	body    []byte
+	etag    string
+	expires time.Time
+}
+
+// newResponseCache returns a cache that holds responses for the given
+// length of time. If ttl is zero responses are not cached.
+func newResponseCache(ttl time.Duration) *responseCache {
+	return &responseCache{
+		ttl:       ttl,
+		responses: make(map[responseKey]cachedResponse),
+	}
+}
+
+// get returns the response to the request of the given kind for the
+// given user, calling f to get the response if it is not cached.
+func (c *responseCache) get(username, kind string, f func() (interface{}, error)) (cachedResponse, error) {
+	key := responseKey{username, kind}
+	now := time.Now()
+	c.mu.Lock()
+	resp, ok := c.responses[key]
+	c.mu.Unlock()
+	if ok && now.Before(resp.expires) {
+		return resp, nil
+	}
+	v, err := f()
+	if err != nil {
+		return cachedResponse{}, errgo.Mask(err, errgo.Any)
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		return cachedResponse{}, errgo.Mask(err)
+	}
+	h := sha256.Sum256(body)
+	resp = cachedResponse{
+		body:    body,
+		etag:    fmt.Sprintf(`"%x"`, h[:16]),
+		expires: now.Add(c.ttl),
+	}
+	if c.ttl > 0 {
+		c.mu.Lock()
+		c.removeExpired(now)
+		c.responses[key] = resp
+		c.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// invalidate removes all cached responses for the given user. It is
+// called when the user is changed through this server; changes made
+// through other servers are seen once the cached responses expire.
+func (c *responseCache) invalidate(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.responses {
+		if key.username == username {
+			delete(c.responses, key)
+		}
+	}
+}
+
+// removeExpired removes the expired responses if the cache is full. It
+// must be called with c.mu held.
+func (c *responseCache) removeExpired(now time.Time) {
+	if len(c.responses) < maxCachedResponses {
+		return
+	}
+	for key, resp := range c.responses {
+		if !now.Before(resp.expires) {
+			delete(c.responses, key)
+		}
+	}
+	if len(c.responses) >= maxCachedResponses {
+		// All of the responses are fresh, which should be rare,
+		// so make room by starting again.
+		c.responses = make(map[responseKey]cachedResponse)
+	}
+}
+
+// writeCachedResponse writes the given response with its entity tag.
+// Clients must revalidate the response before using a copy they have
+// stored, and receive a 304 (Not Modified) response if their copy is
+// current.
+func writeCachedResponse(p httprequest.Params, resp cachedResponse) {
+	p.Response.Header().Set("ETag", resp.etag)
+	p.Response.Header().Set("Cache-Control", "private, no-cache")
+	if etagMatches(p.Request.Header.Get("If-None-Match"), resp.etag) {
+		p.Response.WriteHeader(http.StatusNotModified)
+		return
+	}
+	p.Response.Header().Set("Content-Type", "application/json")
+	p.Response.WriteHeader(http.StatusOK)
+	p.Response.Write(resp.body)
+}
+
+// etagMatches reports whether the given If-None-Match header value
+// matches the given entity tag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag || t == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+
+	v1 "github.com/CanonicalLtd/candid/internal/v1"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+func TestResponseCache(t *testing.T) {
+	c := qt.New(t)
+	cache := v1.NewResponseCache(time.Minute)
+	n := 0
+	f := func() (interface{}, error) {
+		n++
+		return []string{"g1"}, nil
+	}
+	body, etag, err := cache.Get("bob", "groups", f)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(body), qt.Equals, `["g1"]`)
+	c.Assert(n, qt.Equals, 1)
+
+	body, etag1, err := cache.Get("bob", "groups", f)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(body), qt.Equals, `["g1"]`)
+	c.Assert(etag1, qt.Equals, etag)
+	c.Assert(n, qt.Equals, 1)
+
+	cache.Invalidate("bob")
+	_, etag2, err := cache.Get("bob", "groups", f)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(etag2, qt.Equals, etag)
+	c.Assert(n, qt.Equals, 2)
+}
+
+func TestResponseCacheDisabled(t *testing.T) {
+	c := qt.New(t)
+	cache := v1.NewResponseCache(0)
+	n := 0
+	f := func() (interface{}, error) {
+		n++
+		return n, nil
+	}
+	_, etag1, err := cache.Get("bob", "user", f)
+	c.Assert(err, qt.Equals, nil)
+	_, etag2, err := cache.Get("bob", "user", f)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, 2)
+	c.Assert(etag2, qt.Not(qt.Equals), etag1)
+}
+
+func (s *usersSuite) TestUserGroupsETag(c *qt.C) {
+	err := s.store.Store.UpdateIdentity(context.Background(), &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	r := s.doAdmin(c, "GET", "/v1/u/bob/groups")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+	etag := r.Header.Get("ETag")
+	c.Assert(etag, qt.Not(qt.Equals), "")
+
+	req, err := http.NewRequest("GET", s.srv.URL+"/v1/u/bob/groups", nil)
+	c.Assert(err, qt.Equals, nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, err := s.srv.AdminClient().Do(req)
+	c.Assert(err, qt.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusNotModified)
+
+	// Changing the groups changes the entity tag.
+	err = s.adminClient.ModifyUserGroups(s.srv.Ctx, &params.ModifyUserGroupsRequest{
+		Username: "bob",
+		Groups: params.ModifyGroups{
+			Add: []string{"extra"},
+		},
+	})
+	c.Assert(err, qt.Equals, nil)
+	r = s.doAdmin(c, "GET", "/v1/u/bob/groups")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(r.Header.Get("ETag"), qt.Not(qt.Equals), etag)
+}
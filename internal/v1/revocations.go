@@ -0,0 +1,100 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"encoding/base64"
+	"time"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+	macaroon "gopkg.in/macaroon.v2"
+
+	"github.com/CanonicalLtd/candid/internal/auth"
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/internal/revocation"
+)
+
+// revokeRequest is a request to revoke macaroons issued by candid,
+// such as discharge tokens, before they expire.
+type revokeRequest struct {
+	httprequest.Route `httprequest:"POST /v1/revocations"`
+	Body              revokeBody `httprequest:",body"`
+}
+
+// revokeBody holds the body of a revokeRequest.
+type revokeBody struct {
+	// Macaroons holds a macaroon to revoke, followed by any
+	// discharges. Only the first macaroon is revoked.
+	Macaroons macaroon.Slice `json:"macaroons,omitempty"`
+
+	// IDs holds the IDs of macaroons to revoke, encoded as
+	// base64url, as returned by the introspect endpoint.
+	IDs []string `json:"ids,omitempty"`
+
+	// Expires holds the time after which the revoked macaroons are
+	// no longer valid anyway, so that the revocation records can
+	// be removed. If this is zero the expiry time of a macaroon in
+	// Macaroons is used, otherwise the records are kept forever.
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// Revoke revokes the requested macaroons. Revoked macaroons are
+// ignored when authenticating requests, so a leaked discharge token
+// cannot be used to obtain further discharges.
+func (h *handler) Revoke(p httprequest.Params, r *revokeRequest) error {
+	type revoked struct {
+		id      []byte
+		expires time.Time
+	}
+	var rs []revoked
+	if len(r.Body.Macaroons) > 0 {
+		expires := r.Body.Expires
+		if expires.IsZero() {
+			expires, _ = checkers.MacaroonsExpiryTime(auth.Namespace, r.Body.Macaroons)
+		}
+		rs = append(rs, revoked{r.Body.Macaroons[0].Id(), expires})
+	}
+	for _, id := range r.Body.IDs {
+		bid, err := base64.RawURLEncoding.DecodeString(id)
+		if err != nil || len(bid) == 0 {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "invalid macaroon id %q", id)
+		}
+		rs = append(rs, revoked{bid, r.Body.Expires})
+	}
+	if len(rs) == 0 {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "no macaroons specified")
+	}
+	s, err := h.revocationStore(p)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var revokedBy string
+	if id := identityFromContext(p.Context); id != nil {
+		revokedBy = id.Id()
+	}
+	for _, rv := range rs {
+		if err := s.Revoke(p.Context, rv.id, rv.expires); err != nil {
+			return errgo.Mask(err)
+		}
+		logging.FromContext(p.Context, auditLogger).Infof("%s revoked macaroon %s", revokedBy, macaroonID(rv.id))
+	}
+	return nil
+}
+
+func (h *handler) revocationStore(p httprequest.Params) (*revocation.Store, error) {
+	kv, err := h.params.ProviderDataStore.KeyValueStore(p.Context, revocation.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return revocation.NewStore(kv), nil
+}
+
+// macaroonID returns the encoding of the given macaroon ID used in the
+// API.
+func macaroonID(id []byte) string {
+	return base64.RawURLEncoding.EncodeToString(id)
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"encoding/json"
+	"net/http"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+func (s *usersSuite) TestRevoke(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+	})
+	m, err := s.adminClient.UserToken(s.srv.Ctx, &params.UserTokenRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.Equals, nil)
+	ms := macaroon.Slice{m.M()}
+	_, err = s.adminClient.VerifyToken(s.srv.Ctx, &params.VerifyTokenRequest{
+		Macaroons: ms,
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	body, err := json.Marshal(map[string]interface{}{
+		"macaroons": ms,
+	})
+	c.Assert(err, qt.Equals, nil)
+	r := s.doAdminBody(c, "POST", "/v1/revocations", string(body))
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+
+	_, err = s.adminClient.VerifyToken(s.srv.Ctx, &params.VerifyTokenRequest{
+		Macaroons: ms,
+	})
+	c.Assert(err, qt.ErrorMatches, `Post .*/v1/verify: verification failure: .*`)
+
+	var resp struct {
+		Valid   bool `json:"valid"`
+		Revoked bool `json:"revoked"`
+	}
+	s.unmarshal(c, s.introspect(c, ms), http.StatusOK, &resp)
+	c.Assert(resp.Valid, qt.Equals, false)
+	c.Assert(resp.Revoked, qt.Equals, true)
+}
+
+func (s *usersSuite) TestRevokeByID(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+	})
+	m, err := s.adminClient.UserToken(s.srv.Ctx, &params.UserTokenRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.Equals, nil)
+	ms := macaroon.Slice{m.M()}
+	var iresp struct {
+		ID string `json:"id"`
+	}
+	s.unmarshal(c, s.introspect(c, ms), http.StatusOK, &iresp)
+
+	r := s.doAdminBody(c, "POST", "/v1/revocations", `{"ids":["`+iresp.ID+`"]}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+
+	_, err = s.adminClient.VerifyToken(s.srv.Ctx, &params.VerifyTokenRequest{
+		Macaroons: ms,
+	})
+	c.Assert(err, qt.ErrorMatches, `Post .*/v1/verify: verification failure: .*`)
+}
+
+func (s *usersSuite) TestRevokeBadRequest(c *qt.C) {
+	r := s.doAdminBody(c, "POST", "/v1/revocations", `{}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusBadRequest)
+	r = s.doAdminBody(c, "POST", "/v1/revocations", `{"ids":["!!"]}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusBadRequest)
+}
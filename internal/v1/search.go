@@ -0,0 +1,79 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+)
+
+// searchUsersRequest is a request to search for users.
+type searchUsersRequest struct {
+	httprequest.Route `httprequest:"GET /v1/search"`
+
+	// Query holds the text to search for. Users whose username,
+	// email address or full name contain the text, ignoring case,
+	// are returned.
+	Query string `httprequest:"q,form"`
+
+	// Limit holds the maximum number of users to return.
+	Limit int `httprequest:"limit,form"`
+
+	// Cursor holds the cursor returned in the Candid-Next-Cursor
+	// header of a previous search.
+	Cursor string `httprequest:"cursor,form"`
+}
+
+// searchResult holds a single user found by a search.
+type searchResult struct {
+	Username params.Username `json:"username"`
+	FullName string          `json:"fullname,omitempty"`
+	Email    string          `json:"email,omitempty"`
+}
+
+// SearchUsers searches for users whose username, email address or full
+// name contain the requested text. The results are sorted by username.
+// If there are more results than the limit then the cursor for the next
+// page is set in the Candid-Next-Cursor response header.
+func (h *handler) SearchUsers(p httprequest.Params, r *searchUsersRequest) ([]searchResult, error) {
+	if r.Query == "" {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "search text not specified")
+	}
+	limit := r.Limit
+	switch {
+	case limit < 0:
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid limit %d", limit)
+	case limit == 0:
+		limit = defaultQueryLimit
+	case limit > maxQueryLimit:
+		limit = maxQueryLimit
+	}
+	var cursor userCursor
+	if r.Cursor != "" {
+		var err error
+		cursor, err = decodeCursor(r.Cursor)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+	}
+	identities, err := h.params.Store.SearchIdentities(p.Context, r.Query, cursor.Skip, limit+1)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(identities) > limit {
+		identities = identities[:limit]
+		cursor.Skip += limit
+		p.Response.Header().Set(nextCursorHeader, cursor.String())
+	}
+	results := make([]searchResult, len(identities))
+	for i, id := range identities {
+		results[i] = searchResult{
+			Username: params.Username(id.Username),
+			FullName: id.Name,
+			Email:    id.Email,
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"net/http"
+
+	qt "github.com/frankban/quicktest"
+)
+
+type searchResult struct {
+	Username string `json:"username"`
+	FullName string `json:"fullname"`
+	Email    string `json:"email"`
+}
+
+func (s *usersSuite) TestSearchUsers(c *qt.C) {
+	s.addQueryUsers(c)
+
+	var results []searchResult
+	s.unmarshal(c, s.doAdmin(c, "GET", "/v1/search?q=EXAMPLE.COM"), http.StatusOK, &results)
+	c.Assert(results, qt.DeepEquals, []searchResult{{
+		Username: "alice",
+		FullName: "Alice",
+		Email:    "alice@example.com",
+	}, {
+		Username: "carol",
+		FullName: "Carol",
+		Email:    "carol@example.com",
+	}})
+
+	resp := s.doAdmin(c, "GET", "/v1/search?q=example&limit=2")
+	cursor := resp.Header.Get("Candid-Next-Cursor")
+	c.Assert(cursor, qt.Not(qt.Equals), "")
+	s.unmarshal(c, resp, http.StatusOK, &results)
+	c.Assert(results, qt.HasLen, 2)
+	c.Assert(results[1].Username, qt.Equals, "bob")
+
+	resp = s.doAdmin(c, "GET", "/v1/search?q=example&limit=2&cursor="+cursor)
+	c.Assert(resp.Header.Get("Candid-Next-Cursor"), qt.Equals, "")
+	s.unmarshal(c, resp, http.StatusOK, &results)
+	c.Assert(results, qt.HasLen, 1)
+	c.Assert(results[0].Username, qt.Equals, "carol")
+}
+
+func (s *usersSuite) TestSearchUsersNoQuery(c *qt.C) {
+	resp := s.doAdmin(c, "GET", "/v1/search")
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+func (s *usersSuite) TestSearchUsersUnauthorized(c *qt.C) {
+	r := s.doBody(c, s.srv.Client(s.interactor), "GET", "/v1/search?q=alice", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusUnauthorized)
+}
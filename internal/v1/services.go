@@ -0,0 +1,204 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/internal/services"
+)
+
+// servicesRequest is a request for all the registered relying
+// services.
+type servicesRequest struct {
+	httprequest.Route `httprequest:"GET /v1/services"`
+}
+
+// serviceRequest is a request for a single registered relying service.
+type serviceRequest struct {
+	httprequest.Route `httprequest:"GET /v1/services/:name"`
+	Name              string `httprequest:"name,path"`
+}
+
+// setServiceRequest is a request to register a relying service, or
+// to replace its registration.
+type setServiceRequest struct {
+	httprequest.Route `httprequest:"PUT /v1/services/:name"`
+	Name              string      `httprequest:"name,path"`
+	Body              serviceBody `httprequest:",body"`
+}
+
+// serviceBody holds the body of a setServiceRequest.
+type serviceBody struct {
+	// Origins holds the origins that users may be returned to
+	// after a redirect-based login for the service.
+	Origins []string `json:"origins,omitempty"`
+
+	// PublicKey holds the public key the service uses in the
+	// third-party caveats it creates.
+	PublicKey *bakery.PublicKey `json:"public-key,omitempty"`
+
+	// Attributes holds the names of the identity attributes that
+	// may be released to the service.
+	Attributes []string `json:"attributes,omitempty"`
+
+	// Contact holds the contact details of the people responsible
+	// for the service.
+	Contact string `json:"contact,omitempty"`
+
+	// LogoutURI holds the address to which back-channel logout
+	// notifications are sent.
+	LogoutURI string `json:"logout-uri,omitempty"`
+}
+
+// removeServiceRequest is a request to remove the registration of a
+// relying service.
+type removeServiceRequest struct {
+	httprequest.Route `httprequest:"DELETE /v1/services/:name"`
+	Name              string `httprequest:"name,path"`
+}
+
+// newServiceSecretRequest is a request to generate a new client secret
+// for a registered relying service.
+type newServiceSecretRequest struct {
+	httprequest.Route `httprequest:"POST /v1/services/:name/secret"`
+	Name              string `httprequest:"name,path"`
+}
+
+// serviceSecret holds the client secret of a relying service.
+type serviceSecret struct {
+	Secret string `json:"secret"`
+}
+
+// standardAttributes holds the identity attributes, other than the
+// custom attributes in the schema, that may be released to services.
+var standardAttributes = map[string]bool{
+	"username":  true,
+	"email":     true,
+	"full-name": true,
+	"groups":    true,
+}
+
+// Services returns all the registered relying services.
+func (h *handler) Services(p httprequest.Params, _ *servicesRequest) ([]services.Service, error) {
+	s, err := h.serviceStore(p)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	svcs, err := s.List(p.Context)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if svcs == nil {
+		svcs = []services.Service{}
+	}
+	return svcs, nil
+}
+
+// Service returns the registered relying service with the given name.
+func (h *handler) Service(p httprequest.Params, r *serviceRequest) (*services.Service, error) {
+	s, err := h.serviceStore(p)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	svc, err := s.Get(p.Context, r.Name)
+	if err != nil {
+		return nil, serviceError(err)
+	}
+	return &svc, nil
+}
+
+// SetService registers the relying service with the given name,
+// replacing any existing registration. Users may be returned to the
+// origins of registered services after a redirect-based login.
+func (h *handler) SetService(p httprequest.Params, r *setServiceRequest) error {
+	svc := services.Service{
+		Name:       r.Name,
+		Origins:    r.Body.Origins,
+		PublicKey:  r.Body.PublicKey,
+		Attributes: r.Body.Attributes,
+		Contact:    r.Body.Contact,
+		LogoutURI:  r.Body.LogoutURI,
+	}
+	if err := svc.Validate(); err != nil {
+		return errgo.WithCausef(err, params.ErrBadRequest, "")
+	}
+	for _, a := range svc.Attributes {
+		if _, ok := h.params.AttributeSchema.Attribute(a); !ok && !standardAttributes[a] {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "unknown attribute %q", a)
+		}
+	}
+	s, err := h.serviceStore(p)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.Set(p.Context, svc); err != nil {
+		return errgo.Mask(err)
+	}
+	var setBy string
+	if id := identityFromContext(p.Context); id != nil {
+		setBy = id.Id()
+	}
+	logging.FromContext(p.Context, auditLogger).Infof("%s registered service %q with origins %v", setBy, r.Name, svc.Origins)
+	return nil
+}
+
+// RemoveService removes the registration of the relying service with
+// the given name.
+func (h *handler) RemoveService(p httprequest.Params, r *removeServiceRequest) error {
+	s, err := h.serviceStore(p)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.Remove(p.Context, r.Name); err != nil {
+		return serviceError(err)
+	}
+	var removedBy string
+	if id := identityFromContext(p.Context); id != nil {
+		removedBy = id.Id()
+	}
+	logging.FromContext(p.Context, auditLogger).Infof("%s removed service %q", removedBy, r.Name)
+	return nil
+}
+
+// NewServiceSecret generates a new client secret for the relying
+// service with the given name, replacing any previous one. The service
+// uses the secret to exchange the authorization codes issued to it at
+// the end of redirect-based logins. The secret is only returned by
+// this request.
+func (h *handler) NewServiceSecret(p httprequest.Params, r *newServiceSecretRequest) (*serviceSecret, error) {
+	s, err := h.serviceStore(p)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	secret, err := s.NewSecret(p.Context, r.Name)
+	if err != nil {
+		return nil, serviceError(err)
+	}
+	var setBy string
+	if id := identityFromContext(p.Context); id != nil {
+		setBy = id.Id()
+	}
+	logging.FromContext(p.Context, auditLogger).Infof("%s generated a new secret for service %q", setBy, r.Name)
+	return &serviceSecret{Secret: secret}, nil
+}
+
+func (h *handler) serviceStore(p httprequest.Params) (*services.Store, error) {
+	kv, err := h.params.ProviderDataStore.KeyValueStore(p.Context, services.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return services.NewStore(kv), nil
+}
+
+func serviceError(err error) error {
+	if errgo.Cause(err) == services.ErrNotFound {
+		return errgo.WithCausef(err, params.ErrNotFound, "")
+	}
+	return errgo.Mask(err)
+}
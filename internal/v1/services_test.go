@@ -0,0 +1,66 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"net/http"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/internal/services"
+)
+
+func (s *usersSuite) TestServices(c *qt.C) {
+	var svcs []services.Service
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/services", ""), http.StatusOK, &svcs)
+	c.Assert(svcs, qt.HasLen, 0)
+
+	r := s.doBody(c, s.srv.AdminClient(), "PUT", "/v1/services/dashboard", `{"origins":["https://dashboard.example.com"],"public-key":"CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=","attributes":["email","groups"],"contact":"ops@example.com"}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+
+	var svc services.Service
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/services/dashboard", ""), http.StatusOK, &svc)
+	c.Assert(svc.Name, qt.Equals, "dashboard")
+	c.Assert(svc.Origins, qt.DeepEquals, []string{"https://dashboard.example.com"})
+	c.Assert(svc.PublicKey.String(), qt.Equals, "CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=")
+	c.Assert(svc.Attributes, qt.DeepEquals, []string{"email", "groups"})
+	c.Assert(svc.Contact, qt.Equals, "ops@example.com")
+
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/services", ""), http.StatusOK, &svcs)
+	c.Assert(svcs, qt.HasLen, 1)
+
+	// Only administrators can register services.
+	r = s.doBody(c, s.srv.Client(s.interactor), "PUT", "/v1/services/evil", `{"origins":["https://evil.example.com"]}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusUnauthorized)
+
+	r = s.doAdminBody(c, "DELETE", "/v1/services/dashboard", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+	r = s.doAdminBody(c, "GET", "/v1/services/dashboard", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusNotFound)
+	r = s.doAdminBody(c, "DELETE", "/v1/services/dashboard", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusNotFound)
+}
+
+func (s *usersSuite) TestSetServiceBadRequest(c *qt.C) {
+	r := s.doBody(c, s.srv.AdminClient(), "PUT", "/v1/services/dashboard", `{"origins":["https://dashboard.example.com/callback"]}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusBadRequest)
+	r = s.doBody(c, s.srv.AdminClient(), "PUT", "/v1/services/dashboard", `{"attributes":["shoe-size"]}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+func (s *usersSuite) TestNewServiceSecret(c *qt.C) {
+	r := s.doAdminBody(c, "POST", "/v1/services/dashboard/secret", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusNotFound)
+
+	r = s.doBody(c, s.srv.AdminClient(), "PUT", "/v1/services/dashboard", `{"origins":["https://dashboard.example.com"]}`)
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+	var secret struct {
+		Secret string `json:"secret"`
+	}
+	s.unmarshal(c, s.doAdminBody(c, "POST", "/v1/services/dashboard/secret", ""), http.StatusOK, &secret)
+	c.Assert(secret.Secret, qt.Not(qt.Equals), "")
+
+	r = s.doBody(c, s.srv.Client(s.interactor), "POST", "/v1/services/dashboard/secret", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusUnauthorized)
+}
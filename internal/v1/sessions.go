@@ -0,0 +1,94 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"encoding/base64"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/internal/sessions"
+)
+
+// sessionsRequest is a request for the sessions of a user.
+type sessionsRequest struct {
+	httprequest.Route `httprequest:"GET /v1/u/:username/sessions"`
+	Username          params.Username `httprequest:"username,path"`
+}
+
+// sessionsResponse holds the active sessions of a user, most recent
+// first.
+type sessionsResponse struct {
+	Sessions []sessions.Session `json:"sessions"`
+}
+
+// endSessionRequest is a request to end one of a user's sessions.
+type endSessionRequest struct {
+	httprequest.Route `httprequest:"DELETE /v1/u/:username/sessions/:id"`
+	Username          params.Username `httprequest:"username,path"`
+	ID                string          `httprequest:"id,path"`
+}
+
+// Sessions returns the sessions of the given user that have not
+// expired. Each session corresponds to a discharge token issued when
+// the user logged in.
+func (h *handler) Sessions(p httprequest.Params, r *sessionsRequest) (*sessionsResponse, error) {
+	if err := h.checkUserExists(p, r.Username); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	s, err := h.sessionStore(p)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	ss, err := s.List(p.Context, string(r.Username))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if ss == nil {
+		ss = []sessions.Session{}
+	}
+	return &sessionsResponse{
+		Sessions: ss,
+	}, nil
+}
+
+// EndSession ends the given session by revoking its discharge token.
+// If the session was created for a registered relying service with a
+// logout URI, the service is sent a back-channel logout notification.
+func (h *handler) EndSession(p httprequest.Params, r *endSessionRequest) error {
+	id, err := base64.RawURLEncoding.DecodeString(r.ID)
+	if err != nil {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "invalid session id %q", r.ID)
+	}
+	s, err := h.sessionStore(p)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	session, err := s.Remove(p.Context, string(r.Username), r.ID)
+	if err != nil {
+		if errgo.Cause(err) == sessions.ErrNotFound {
+			return errgo.WithCausef(err, params.ErrNotFound, "")
+		}
+		return errgo.Mask(err)
+	}
+	rs, err := h.revocationStore(p)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := rs.Revoke(p.Context, id, session.Expires); err != nil {
+		return errgo.Mask(err)
+	}
+	h.params.LogoutNotifier.SessionEnded(p.Context, string(r.Username), *session)
+	return nil
+}
+
+func (h *handler) sessionStore(p httprequest.Params) (*sessions.Store, error) {
+	kv, err := h.params.ProviderDataStore.KeyValueStore(p.Context, sessions.StoreName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return sessions.NewStore(kv), nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid/internal/revocation"
+	"github.com/CanonicalLtd/candid/internal/services"
+	"github.com/CanonicalLtd/candid/internal/sessions"
+)
+
+func (s *usersSuite) TestSessions(c *qt.C) {
+	ctx := context.Background()
+	s.addRelyingPartyUser(c, "bob")
+	kv, err := s.store.ProviderDataStore.KeyValueStore(ctx, sessions.StoreName)
+	c.Assert(err, qt.Equals, nil)
+	now := time.Now().UTC().Truncate(time.Second)
+	id := base64.RawURLEncoding.EncodeToString([]byte("session-1"))
+	_, err = sessions.NewStore(kv).Add(ctx, "bob", sessions.Session{
+		ID:      id,
+		Client:  "test-client",
+		Address: "192.0.2.1",
+		Issued:  now,
+		Expires: now.Add(time.Hour),
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	var resp struct {
+		Sessions []sessions.Session `json:"sessions"`
+	}
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/u/bob/sessions", ""), http.StatusOK, &resp)
+	c.Assert(resp.Sessions, qt.HasLen, 1)
+	c.Assert(resp.Sessions[0].ID, qt.Equals, id)
+	c.Assert(resp.Sessions[0].Client, qt.Equals, "test-client")
+
+	r := s.doAdminBody(c, "DELETE", "/v1/u/bob/sessions/"+id, "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/u/bob/sessions", ""), http.StatusOK, &resp)
+	c.Assert(resp.Sessions, qt.HasLen, 0)
+
+	rkv, err := s.store.ProviderDataStore.KeyValueStore(ctx, revocation.StoreName)
+	c.Assert(err, qt.Equals, nil)
+	revoked, err := revocation.NewStore(rkv).Revoked(ctx, []byte("session-1"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(revoked, qt.Equals, true)
+
+	r = s.doAdminBody(c, "DELETE", "/v1/u/bob/sessions/"+id, "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusNotFound)
+}
+
+func (s *usersSuite) TestSessionsNoUser(c *qt.C) {
+	r := s.doAdminBody(c, "GET", "/v1/u/nobody/sessions", "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusNotFound)
+}
+
+func (s *usersSuite) TestEndSessionLogoutNotification(c *qt.C) {
+	ctx := context.Background()
+	tokens := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tokens <- req.PostFormValue("logout_token")
+	}))
+	defer srv.Close()
+	skv, err := s.store.ProviderDataStore.KeyValueStore(ctx, services.StoreName)
+	c.Assert(err, qt.Equals, nil)
+	err = services.NewStore(skv).Set(ctx, services.Service{
+		Name:      "dashboard",
+		Origins:   []string{"https://dashboard.example.com"},
+		LogoutURI: srv.URL,
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	s.addRelyingPartyUser(c, "bob")
+	kv, err := s.store.ProviderDataStore.KeyValueStore(ctx, sessions.StoreName)
+	c.Assert(err, qt.Equals, nil)
+	now := time.Now().UTC().Truncate(time.Second)
+	id := base64.RawURLEncoding.EncodeToString([]byte("session-1"))
+	_, err = sessions.NewStore(kv).Add(ctx, "bob", sessions.Session{
+		ID:      id,
+		Service: "dashboard.example.com",
+		Issued:  now,
+		Expires: now.Add(time.Hour),
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	r := s.doAdminBody(c, "DELETE", "/v1/u/bob/sessions/"+id, "")
+	c.Assert(r.StatusCode, qt.Equals, http.StatusOK)
+
+	var tok string
+	select {
+	case tok = <-tokens:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for logout notification")
+	}
+	parts := strings.Split(tok, ".")
+	c.Assert(parts, qt.HasLen, 3)
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	c.Assert(err, qt.Equals, nil)
+	var claims map[string]interface{}
+	err = json.Unmarshal(data, &claims)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(claims["aud"], qt.Equals, "dashboard")
+	c.Assert(claims["sub"], qt.Equals, "bob")
+	c.Assert(claims["sid"], qt.Equals, id)
+}
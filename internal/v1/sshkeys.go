@@ -0,0 +1,155 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// sshKeysExtraInfo holds the extra-info item in which a user's SSH keys
+// are stored.
+const sshKeysExtraInfo = "sshkeys"
+
+// authorizedKeysRequest is a request for a user's SSH keys in the
+// format of an OpenSSH authorized_keys file.
+type authorizedKeysRequest struct {
+	httprequest.Route `httprequest:"GET /v1/u/:username/ssh-keys/authorized_keys"`
+	Username          params.Username `httprequest:"username,path"`
+}
+
+// groupAuthorizedKeysRequest is a request for the SSH keys of all the
+// members of a group in the format of an OpenSSH authorized_keys file.
+type groupAuthorizedKeysRequest struct {
+	httprequest.Route `httprequest:"GET /v1/g/:group/ssh-keys/authorized_keys"`
+	Group             string `httprequest:"group,path"`
+}
+
+// AuthorizedKeys writes the SSH keys stored for the given user as an
+// OpenSSH authorized_keys file. Stored keys that cannot be parsed, for
+// example those added before keys were validated, are omitted.
+func (h *handler) AuthorizedKeys(p httprequest.Params, r *authorizedKeysRequest) error {
+	id := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &id); err != nil {
+		return translateStoreError(err)
+	}
+	writeAuthorizedKeys(p, []store.Identity{id})
+	return nil
+}
+
+// GroupAuthorizedKeys writes the SSH keys stored for all the members of
+// the given group as an OpenSSH authorized_keys file. Only the groups
+// stored with each identity are considered, so members of groups that
+// are only known to an identity provider, such as an LDAP server, are
+// not included.
+func (h *handler) GroupAuthorizedKeys(p httprequest.Params, r *groupAuthorizedKeysRequest) error {
+	identities, err := h.params.Store.FindIdentities(p.Context, &store.Identity{}, store.Filter{}, []store.Sort{{Field: store.Username}}, 0, 0, store.Condition{
+		Field:      store.Groups,
+		Comparison: store.Contains,
+		Ref:        store.Identity{Groups: []string{r.Group}},
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	writeAuthorizedKeys(p, identities)
+	return nil
+}
+
+// writeAuthorizedKeys writes the SSH keys of the given identities to
+// the response as an OpenSSH authorized_keys file. Stored keys that
+// cannot be parsed, for example those added before keys were
+// validated, are omitted.
+func writeAuthorizedKeys(p httprequest.Params, identities []store.Identity) {
+	var buf bytes.Buffer
+	for _, id := range identities {
+		for _, k := range id.ExtraInfo[sshKeysExtraInfo] {
+			key, err := parseSSHKey(k)
+			if err != nil {
+				logger.Warningf("ignoring invalid SSH key for %s: %s", id.Username, err)
+				continue
+			}
+			buf.WriteString(key)
+			buf.WriteByte('\n')
+		}
+	}
+	p.Response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	p.Response.Write(buf.Bytes())
+}
+
+// parseSSHKey parses a public key in the authorized_keys format and
+// returns it in a normalised form, holding only the key type, key and
+// comment. Keys with options are rejected as the options would be
+// passed on to the consumers of the keys.
+func parseSSHKey(s string) (string, error) {
+	pk, comment, options, rest, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		return "", errgo.Newf("invalid SSH key %q", s)
+	}
+	if len(options) > 0 {
+		return "", errgo.Newf("SSH key %q has options", s)
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return "", errgo.Newf("invalid SSH key %q: more than one key", s)
+	}
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pk)))
+	if comment != "" {
+		key += " " + comment
+	}
+	return key, nil
+}
+
+// parseSSHKeys parses all the given keys using parseSSHKey. The
+// returned error has a cause of params.ErrBadRequest if any key is
+// invalid.
+func parseSSHKeys(keys []string) ([]string, error) {
+	parsed := make([]string, len(keys))
+	for i, k := range keys {
+		var err error
+		parsed[i], err = parseSSHKey(k)
+		if err != nil {
+			return nil, errgo.WithCausef(nil, params.ErrBadRequest, "%s", err)
+		}
+	}
+	return parsed, nil
+}
+
+// matchingSSHKeys returns the keys in stored that are specified by one
+// of the given keys or fingerprints. Keys match if they have the same
+// key type and key, irrespective of comment. Fingerprints are in the
+// SHA256 format shown by ssh-keygen -l.
+func matchingSSHKeys(stored, remove []string) []string {
+	match := make(map[string]bool)
+	for _, r := range remove {
+		if strings.HasPrefix(r, "SHA256:") {
+			match[r] = true
+			continue
+		}
+		if pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(r)); err == nil {
+			match[ssh.FingerprintSHA256(pk)] = true
+		}
+		// Keys stored before validation may not be parseable, so
+		// also match the text exactly.
+		match[r] = true
+	}
+	var matched []string
+	for _, s := range stored {
+		if match[s] {
+			matched = append(matched, s)
+			continue
+		}
+		if pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s)); err == nil && match[ssh.FingerprintSHA256(pk)] {
+			matched = append(matched, s)
+		}
+	}
+	return matched
+}
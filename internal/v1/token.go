@@ -0,0 +1,133 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/internal/logging"
+)
+
+// tokenRequest is a request for a JSON Web Token asserting the
+// identity of the authenticated user.
+type tokenRequest struct {
+	httprequest.Route `httprequest:"POST /v1/token"`
+	Body              tokenRequestBody `httprequest:",body"`
+}
+
+// tokenRequestBody holds the body of a token request.
+type tokenRequestBody struct {
+	// Audience holds the audience of the requested token. If this
+	// is empty the first configured audience is used.
+	Audience string `json:"audience,omitempty"`
+}
+
+// tokenResponse holds a token issued to the authenticated user.
+type tokenResponse struct {
+	// Token holds the signed token.
+	Token string `json:"token"`
+
+	// Expires holds the time at which the token expires.
+	Expires time.Time `json:"expires"`
+}
+
+// Token returns a short-lived JSON Web Token asserting the identity
+// of the authenticated user, for use with services that cannot verify
+// macaroons. The token is signed with the key published in the
+// server's JWKS document. If the user is being impersonated, the
+// impersonating user is identified in an "act" claim (see RFC 8693).
+func (h *handler) Token(p httprequest.Params, r *tokenRequest) (*tokenResponse, error) {
+	if h.params.JWTIssuer == nil {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "tokens are not issued by this server")
+	}
+	aud := r.Body.Audience
+	if aud == "" {
+		aud = h.params.JWT.Audiences[0]
+	} else if !h.validAudience(aud) {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid audience %q", aud)
+	}
+	identity, err := h.authenticatedIdentity(p)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	jti, err := newTokenID()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	now := time.Now()
+	expires := now.Add(h.params.JWT.Lifetime)
+	claims := map[string]interface{}{
+		"iss": h.params.Location,
+		"sub": identity.Username,
+		"aud": aud,
+		"iat": now.Unix(),
+		"exp": expires.Unix(),
+		"jti": jti,
+	}
+	impersonator := identityFromContext(p.Context).Impersonator()
+	if impersonator != "" {
+		claims["act"] = map[string]interface{}{
+			"sub": impersonator,
+		}
+	}
+	for _, c := range h.params.JWT.Claims {
+		switch c {
+		case "name":
+			if identity.Name != "" {
+				claims["name"] = identity.Name
+			}
+		case "email":
+			if identity.Email != "" {
+				claims["email"] = identity.Email
+			}
+		case "groups":
+			groups, err := identityFromContext(p.Context).Groups(p.Context)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			if groups == nil {
+				groups = []string{}
+			}
+			claims["groups"] = groups
+		}
+	}
+	token, err := h.params.JWTIssuer.Sign(claims)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot sign token")
+	}
+	if impersonator != "" {
+		logging.FromContext(p.Context, auditLogger).Infof("issued token %s for %s to %s impersonated by %s", jti, aud, identity.Username, impersonator)
+	} else {
+		logging.FromContext(p.Context, auditLogger).Infof("issued token %s for %s to %s", jti, aud, identity.Username)
+	}
+	return &tokenResponse{
+		Token:   token,
+		Expires: time.Unix(expires.Unix(), 0).UTC(),
+	}, nil
+}
+
+// validAudience reports whether tokens may be issued for the given
+// audience.
+func (h *handler) validAudience(aud string) bool {
+	for _, a := range h.params.JWT.Audiences {
+		if a == aud {
+			return true
+		}
+	}
+	return false
+}
+
+func newTokenID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return fmt.Sprintf("%x", buf), nil
+}
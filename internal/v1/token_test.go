@@ -0,0 +1,94 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+type tokenResponse struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+func (s *usersSuite) TestToken(c *qt.C) {
+	client := s.srv.Client(s.interactor)
+	var resp tokenResponse
+	s.unmarshal(c, s.doBody(c, client, "POST", "/v1/token", `{}`), http.StatusOK, &resp)
+	c.Assert(resp.Expires.After(time.Now()), qt.Equals, true)
+	c.Assert(resp.Expires.Before(time.Now().Add(6*time.Minute)), qt.Equals, true)
+
+	claims := tokenClaims(c, resp.Token)
+	c.Assert(claims["iss"], qt.Equals, s.srv.URL)
+	c.Assert(claims["sub"], qt.Equals, "bob")
+	c.Assert(claims["aud"], qt.Equals, "https://service1.example.com")
+	c.Assert(claims["groups"], qt.DeepEquals, []interface{}{"g1", "g2", "testgroup"})
+	c.Assert(claims["exp"], qt.Equals, float64(resp.Expires.Unix()))
+	c.Assert(claims["jti"], qt.Not(qt.Equals), "")
+	c.Assert(claims["act"], qt.IsNil)
+
+	s.unmarshal(c, s.doBody(c, client, "POST", "/v1/token", `{"audience":"https://service2.example.com"}`), http.StatusOK, &resp)
+	claims = tokenClaims(c, resp.Token)
+	c.Assert(claims["aud"], qt.Equals, "https://service2.example.com")
+}
+
+func (s *usersSuite) TestTokenImpersonated(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+	})
+	req := &impersonateRequest{
+		Username: "jbloggs",
+	}
+	req.Body.Reason = "investigating support ticket"
+	var iresp impersonateResponse
+	err := (&httprequest.Client{
+		BaseURL: s.srv.URL,
+		Doer:    s.srv.AdminClient(),
+	}).Call(s.srv.Ctx, req, &iresp)
+	c.Assert(err, qt.Equals, nil)
+
+	client := httpbakery.NewClient()
+	u, err := url.Parse(s.srv.URL)
+	c.Assert(err, qt.Equals, nil)
+	err = httpbakery.SetCookie(client.Jar, u, nil, macaroon.Slice{iresp.DischargeToken.M()})
+	c.Assert(err, qt.Equals, nil)
+	var resp tokenResponse
+	s.unmarshal(c, s.doBody(c, client, "POST", "/v1/token", `{}`), http.StatusOK, &resp)
+	claims := tokenClaims(c, resp.Token)
+	c.Assert(claims["sub"], qt.Equals, "jbloggs")
+	c.Assert(claims["act"], qt.DeepEquals, map[string]interface{}{
+		"sub": "admin@candid",
+	})
+}
+
+func (s *usersSuite) TestTokenInvalidAudience(c *qt.C) {
+	client := s.srv.Client(s.interactor)
+	resp := s.doBody(c, client, "POST", "/v1/token", `{"audience":"https://other.example.com"}`)
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+// tokenClaims returns the claims in the given token, without
+// verifying its signature.
+func tokenClaims(c *qt.C, token string) map[string]interface{} {
+	parts := strings.Split(token, ".")
+	c.Assert(parts, qt.HasLen, 3)
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	c.Assert(err, qt.Equals, nil)
+	var claims map[string]interface{}
+	err = json.Unmarshal(data, &claims)
+	c.Assert(err, qt.Equals, nil)
+	return claims
+}
@@ -23,6 +23,7 @@ import (
 	macaroon "gopkg.in/macaroon.v2"
 
 	"github.com/CanonicalLtd/candid/internal/auth"
+	"github.com/CanonicalLtd/candid/internal/logging"
 	"github.com/CanonicalLtd/candid/store"
 )
 
@@ -34,8 +35,19 @@ var blacklistUsernames = map[params.Username]bool{
 
 // QueryUsers filters the user database for users that match the given
 // request. If no filters are requested all usernames will be returned.
+// The additional query parameters understood by parseUserQuery may be
+// used to further filter, sort and paginate the results. When a page
+// of results is returned the cursor for the next page is set in the
+// Candid-Next-Cursor response header.
 func (h *handler) QueryUsers(p httprequest.Params, r *params.QueryUsersRequest) ([]string, error) {
 	logger.Tracef("QueryUsers %#v", r)
+	if err := p.Request.ParseForm(); err != nil {
+		return nil, errgo.WithCausef(err, params.ErrBadRequest, "")
+	}
+	q, err := parseUserQuery(p.Request.Form)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
 	var identity store.Identity
 	var filter store.Filter
 	if r.ExternalID != "" {
@@ -78,12 +90,20 @@ func (h *handler) QueryUsers(p httprequest.Params, r *params.QueryUsersRequest)
 		filter[store.Owner] = store.Equal
 	}
 
-	// TODO(mhilton) make sure this endpoint can be queried as a
-	// subset once there are more users.
-	identities, err := h.params.Store.FindIdentities(p.Context, &identity, filter, []store.Sort{{Field: store.Username}}, 0, 0)
+	limit := 0
+	if q.limit > 0 {
+		// Request one more than required so that we can tell
+		// if there is another page.
+		limit = q.limit + 1
+	}
+	identities, err := h.params.Store.FindIdentities(p.Context, &identity, filter, q.sort, 0, limit, q.conditions...)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	if q.limit > 0 && len(identities) > q.limit {
+		identities = identities[:q.limit]
+		p.Response.Header().Set(nextCursorHeader, q.next(identities))
+	}
 	usernames := make([]string, len(identities))
 	for i, id := range identities {
 		usernames[i] = id.Username
@@ -93,21 +113,28 @@ func (h *handler) QueryUsers(p httprequest.Params, r *params.QueryUsersRequest)
 }
 
 // User returns the user information for the request user.
-func (h *handler) User(p httprequest.Params, r *params.UserRequest) (*params.User, error) {
+func (h *handler) User(p httprequest.Params, r *params.UserRequest) error {
 	logger.Tracef("User %#v", r)
-	id := store.Identity{
-		Username: string(r.Username),
-	}
-	err := h.params.Store.Identity(p.Context, &id)
-	if err != nil {
-		return nil, translateStoreError(err)
-	}
-	u, err := h.userFromIdentity(p.Context, &id)
+	resp, err := h.responses.get(string(r.Username), "user", func() (interface{}, error) {
+		id := store.Identity{
+			Username: string(r.Username),
+		}
+		err := h.params.Store.Identity(p.Context, &id)
+		if err != nil {
+			return nil, translateStoreError(err)
+		}
+		u, err := h.userFromIdentity(p.Context, &id)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return u, nil
+	})
 	if err != nil {
-		return nil, errgo.Mask(err)
+		return errgo.Mask(err, errgo.Any)
 	}
-	logger.Tracef("User response %#v", u)
-	return u, nil
+	logger.Tracef("User response %s", resp.body)
+	writeCachedResponse(p, resp)
+	return nil
 }
 
 // CreateAgent creates a new agent and returns the newly chosen username
@@ -213,26 +240,33 @@ func (h *handler) WhoAmI(p httprequest.Params, arg *params.WhoAmIRequest) (param
 
 // UserGroups returns the list of groups associated with the requested
 // user.
-func (h *handler) UserGroups(p httprequest.Params, r *params.UserGroupsRequest) ([]string, error) {
+func (h *handler) UserGroups(p httprequest.Params, r *params.UserGroupsRequest) error {
 	logger.Tracef("UserGroups %#v", r)
-	id, err := h.params.Authorizer.Identity(p.Context, string(r.Username))
-	if err != nil {
-		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
-	}
-	groups, err := id.Groups(p.Context)
+	resp, err := h.responses.get(string(r.Username), "groups", func() (interface{}, error) {
+		id, err := h.params.Authorizer.Identity(p.Context, string(r.Username))
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		groups, err := id.Groups(p.Context)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if groups == nil {
+			groups = []string{}
+		}
+		return groups, nil
+	})
 	if err != nil {
-		return nil, errgo.Mask(err)
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
-	if groups == nil {
-		groups = []string{}
-	}
-	logger.Tracef("UserGroups response %#v", groups)
-	return groups, nil
+	logger.Tracef("UserGroups response %s", resp.body)
+	writeCachedResponse(p, resp)
+	return nil
 }
 
 // UserIDPGroups returns the list of groups associated with the requested
 // user. This is deprected and UserGroups should be used in preference.
-func (h *handler) UserIDPGroups(p httprequest.Params, r *params.UserIDPGroupsRequest) ([]string, error) {
+func (h *handler) UserIDPGroups(p httprequest.Params, r *params.UserIDPGroupsRequest) error {
 	return h.UserGroups(p, &params.UserGroupsRequest{
 		Username: r.Username,
 	})
@@ -250,6 +284,7 @@ func (h *handler) SetUserGroups(p httprequest.Params, r *params.SetUserGroupsReq
 	if err != nil {
 		return translateStoreError(err)
 	}
+	h.responses.invalidate(string(r.Username))
 	logger.Tracef("SetUserGroups complete")
 	return nil
 }
@@ -277,6 +312,7 @@ func (h *handler) ModifyUserGroups(p httprequest.Params, r *params.ModifyUserGro
 	if err != nil {
 		return translateStoreError(err)
 	}
+	h.responses.invalidate(string(r.Username))
 	logger.Tracef("SetUserGroups complete")
 	return nil
 }
@@ -291,7 +327,7 @@ func (h *handler) GetSSHKeys(p httprequest.Params, r *params.SSHKeysRequest) (pa
 		return params.SSHKeysResponse{}, translateStoreError(err)
 	}
 	resp := params.SSHKeysResponse{
-		SSHKeys: id.ExtraInfo["sshkeys"],
+		SSHKeys: id.ExtraInfo[sshKeysExtraInfo],
 	}
 	logger.Tracef("GetSSHKeys response %#v", resp)
 	return resp, nil
@@ -299,36 +335,53 @@ func (h *handler) GetSSHKeys(p httprequest.Params, r *params.SSHKeysRequest) (pa
 
 // PutSSHKeys updates the set of SSH keys stored for the given user. If
 // the add parameter is set to true then keys that are already stored
-// will be added to, otherwise they will be replaced.
+// will be added to, otherwise they will be replaced. Keys must be in
+// the OpenSSH authorized_keys format, without options.
 func (h *handler) PutSSHKeys(p httprequest.Params, r *params.PutSSHKeysRequest) error {
 	logger.Tracef("PutSSHKeys %#v", r)
+	keys, err := parseSSHKeys(r.Body.SSHKeys)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
 	id := store.Identity{
 		Username: string(r.Username),
 		ExtraInfo: map[string][]string{
-			"sshkeys": r.Body.SSHKeys,
+			sshKeysExtraInfo: keys,
 		},
 	}
 	update := store.Update{
 		store.ExtraInfo: store.Push,
 	}
-	err := h.params.Store.UpdateIdentity(p.Context, &id, update)
+	if !r.Body.Add {
+		update[store.ExtraInfo] = store.Set
+	}
+	err = h.params.Store.UpdateIdentity(p.Context, &id, update)
 	if err != nil {
 		return translateStoreError(err)
 	}
+	h.responses.invalidate(string(r.Username))
 	logger.Tracef("PutSSHKeys complete")
 	return nil
 }
 
 // DeleteSSHKeys removes all of the ssh keys specified from the keys
-// stored for the given user. It is not an error to attempt to remove a
-// key that is not associated with the user.
+// stored for the given user. Keys may be specified either as keys or
+// by their SHA256 fingerprint. It is not an error to attempt to remove
+// a key that is not associated with the user.
 func (h *handler) DeleteSSHKeys(p httprequest.Params, r *params.DeleteSSHKeysRequest) error {
 	logger.Tracef("DeleteSSHKeys %#v", r)
 	id := store.Identity{
 		Username: string(r.Username),
-		ExtraInfo: map[string][]string{
-			"sshkeys": r.Body.SSHKeys,
-		},
+	}
+	if err := h.params.Store.Identity(p.Context, &id); err != nil {
+		return translateStoreError(err)
+	}
+	keys := matchingSSHKeys(id.ExtraInfo[sshKeysExtraInfo], r.Body.SSHKeys)
+	if len(keys) == 0 {
+		return nil
+	}
+	id.ExtraInfo = map[string][]string{
+		sshKeysExtraInfo: keys,
 	}
 	update := store.Update{
 		store.ExtraInfo: store.Pull,
@@ -337,6 +390,7 @@ func (h *handler) DeleteSSHKeys(p httprequest.Params, r *params.DeleteSSHKeysReq
 	if err != nil {
 		return translateStoreError(err)
 	}
+	h.responses.invalidate(string(r.Username))
 	logger.Tracef("DeleteSSHKeys complete")
 	return nil
 }
@@ -377,6 +431,9 @@ func (h *handler) VerifyToken(p httprequest.Params, r *params.VerifyTokenRequest
 	resp := map[string]string{
 		"username": authInfo.Identity.Id(),
 	}
+	if id, ok := authInfo.Identity.(*auth.Identity); ok && id.Impersonator() != "" {
+		resp[auth.ImpersonatedByAttribute] = id.Impersonator()
+	}
 	logger.Tracef("VerifyToken response %#v", resp)
 	return resp, nil
 }
@@ -390,12 +447,20 @@ func (h *handler) UserExtraInfo(p httprequest.Params, r *params.UserExtraInfoReq
 	if err := h.params.Store.Identity(p.Context, &id); err != nil {
 		return nil, translateStoreError(err)
 	}
+	canRead := h.params.Authorizer.SensitiveAllowed(p.Context, identityFromContext(p.Context), r.Username, auth.ActionReadSensitive)
 	res := make(map[string]interface{}, len(id.ExtraInfo))
 	for k, v := range id.ExtraInfo {
 		if k == "sshkeys" {
 			continue
 		}
-		jmsg := json.RawMessage(v[0])
+		if (h.params.ExtraInfoEncryption.IsSensitive(k) || h.params.AttributeSchema.IsPrivate(k)) && !canRead() {
+			continue
+		}
+		data, err := h.params.ExtraInfoEncryption.Decode(v[0])
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot decode extra-info %q", k)
+		}
+		jmsg := json.RawMessage(data)
 		res[k] = &jmsg
 	}
 	logger.Tracef("UserExtraInfo response %#v", res)
@@ -411,16 +476,27 @@ func (h *handler) SetUserExtraInfo(p httprequest.Params, r *params.SetUserExtraI
 		Username:  string(r.Username),
 		ExtraInfo: make(map[string][]string, len(r.ExtraInfo)),
 	}
+	canWrite := h.params.Authorizer.SensitiveAllowed(p.Context, identityFromContext(p.Context), r.Username, auth.ActionWriteSensitive)
 	for k, v := range r.ExtraInfo {
 		if err := checkExtraInfoKey(k); err != nil {
 			return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
 		}
+		if h.params.ExtraInfoEncryption.IsSensitive(k) && !canWrite() {
+			return errgo.WithCausef(nil, params.ErrForbidden, "cannot write sensitive extra-info %q", k)
+		}
 		buf, err := json.Marshal(v)
 		if err != nil {
 			// This should not be possible as it was only just unmarshalled.
 			panic(err)
 		}
-		id.ExtraInfo[k] = []string{string(buf)}
+		if err := h.params.AttributeSchema.Validate(k, buf); err != nil {
+			return errgo.WithCausef(err, params.ErrBadRequest, "")
+		}
+		value, err := h.params.ExtraInfoEncryption.Encode(k, buf)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		id.ExtraInfo[k] = []string{value}
 	}
 	err := h.params.Store.UpdateIdentity(p.Context, &id, store.Update{store.ExtraInfo: store.Set})
 	if err != nil {
@@ -443,8 +519,18 @@ func (h *handler) UserExtraInfoItem(p httprequest.Params, r *params.UserExtraInf
 	if len(id.ExtraInfo[r.Item]) != 1 {
 		return nil, nil
 	}
+	value := id.ExtraInfo[r.Item][0]
+	if h.params.ExtraInfoEncryption.IsSensitive(r.Item) || h.params.AttributeSchema.IsPrivate(r.Item) {
+		if !h.params.Authorizer.SensitiveAllowed(p.Context, identityFromContext(p.Context), r.Username, auth.ActionReadSensitive)() {
+			return nil, errgo.WithCausef(nil, params.ErrForbidden, "cannot read sensitive extra-info %q", r.Item)
+		}
+	}
+	data, err := h.params.ExtraInfoEncryption.Decode(value)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot decode extra-info %q", r.Item)
+	}
 	var v interface{}
-	if err := json.Unmarshal([]byte(id.ExtraInfo[r.Item][0]), &v); err != nil {
+	if err := json.Unmarshal(data, &v); err != nil {
 		// if it doesn't unmarshal its probably wasn't json in
 		// the first place, so it probably doesn't matter.
 		return nil, nil
@@ -463,12 +549,22 @@ func (h *handler) SetUserExtraInfoItem(p httprequest.Params, r *params.SetUserEx
 	if err := checkExtraInfoKey(r.Item); err != nil {
 		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
 	}
+	if h.params.ExtraInfoEncryption.IsSensitive(r.Item) && !h.params.Authorizer.SensitiveAllowed(p.Context, identityFromContext(p.Context), r.Username, auth.ActionWriteSensitive)() {
+		return errgo.WithCausef(nil, params.ErrForbidden, "cannot write sensitive extra-info %q", r.Item)
+	}
 	buf, err := json.Marshal(r.Data)
 	if err != nil {
 		// This should not be possible as it was only just unmarshalled.
 		panic(err)
 	}
-	id.ExtraInfo = map[string][]string{r.Item: {string(buf)}}
+	if err := h.params.AttributeSchema.Validate(r.Item, buf); err != nil {
+		return errgo.WithCausef(err, params.ErrBadRequest, "")
+	}
+	value, err := h.params.ExtraInfoEncryption.Encode(r.Item, buf)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	id.ExtraInfo = map[string][]string{r.Item: {value}}
 	err = h.params.Store.UpdateIdentity(p.Context, &id, store.Update{store.ExtraInfo: store.Set})
 	if err != nil {
 		return translateStoreError(err)
@@ -582,6 +678,8 @@ func translateStoreError(err error) error {
 		cause = params.ErrNotFound
 	case store.ErrDuplicateUsername:
 		cause = params.ErrAlreadyExists
+	case store.ErrReadOnly:
+		cause = params.ErrServiceUnavailable
 	case nil:
 		return nil
 	}
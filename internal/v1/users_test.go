@@ -5,6 +5,8 @@ package v1_test
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"strings"
 	"testing"
 	"time"
@@ -18,12 +20,15 @@ import (
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 	macaroon "gopkg.in/macaroon.v2"
 
+	"github.com/CanonicalLtd/candid/attrcrypt"
 	"github.com/CanonicalLtd/candid/idp"
 	"github.com/CanonicalLtd/candid/idp/static"
+	"github.com/CanonicalLtd/candid/internal/attrschema"
 	"github.com/CanonicalLtd/candid/internal/auth"
 	"github.com/CanonicalLtd/candid/internal/candidtest"
 	"github.com/CanonicalLtd/candid/internal/discharger"
 	"github.com/CanonicalLtd/candid/internal/identity"
+	"github.com/CanonicalLtd/candid/internal/jwt"
 	"github.com/CanonicalLtd/candid/internal/v1"
 	"github.com/CanonicalLtd/candid/store"
 )
@@ -55,6 +60,20 @@ func (s *usersSuite) Init(c *qt.C) {
 			},
 		}),
 	}
+	keyRing, err := attrcrypt.NewKeyRing(attrcrypt.Key{ID: "test", Key: [32]byte{1}})
+	c.Assert(err, qt.Equals, nil)
+	sp.ExtraInfoEncryption = attrcrypt.Params{
+		Attributes: []string{"national-id"},
+		Encrypter:  keyRing,
+	}
+	sp.Attributes = []attrschema.Attribute{{
+		Name:    "employee-id",
+		Pattern: `E[0-9]+`,
+	}}
+	sp.JWT = jwt.Params{
+		Audiences: []string{"https://service1.example.com", "https://service2.example.com"},
+		Claims:    []string{"email", "groups"},
+	}
 	s.srv = candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
 		"discharger": discharger.NewAPIHandler,
 		"v1":         v1.NewAPIHandler,
@@ -551,6 +570,15 @@ func (s *usersSuite) TestQueryAgentUsersOwnerNotFound(c *qt.C) {
 	c.Assert(users, qt.DeepEquals, []string{})
 }
 
+const (
+	sshKey1 = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIC9LIb7tl9If7q2QSxFzS+SZzadJMxXaYiGNDKay74Ag key1"
+	sshKey2 = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHUUfFsH4w1rFQRgm4tBcCPj/uIS4wkg6hYDv5B9K1Sw key2"
+	sshKey3 = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAINpjOmUKibzt6B55TusQVH3Pk4VmPnEU83zGXy9ecdkM key3"
+	sshKey4 = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAqrlLdbJRu79pk6WUNjQvQRnjf1zAQzNSocJ8RPyhrb key4"
+
+	sshKey2Fingerprint = "SHA256:W14NNr4d8JfeB/x7G21N2GOFOKcMR/Kc1GUPai7N0/o"
+)
+
 func (s *usersSuite) TestSSHKeys(c *qt.C) {
 	s.addUser(c, params.User{
 		Username:   "jbloggs",
@@ -573,7 +601,7 @@ func (s *usersSuite) TestSSHKeys(c *qt.C) {
 	err = s.adminClient.PutSSHKeys(s.srv.Ctx, &params.PutSSHKeysRequest{
 		Username: "jbloggs",
 		Body: params.PutSSHKeysBody{
-			SSHKeys: []string{"36ASDER56", "22ERT56DG", "56ASDFASDF32"},
+			SSHKeys: []string{sshKey1, sshKey2, sshKey3},
 			Add:     false,
 		},
 	})
@@ -585,16 +613,16 @@ func (s *usersSuite) TestSSHKeys(c *qt.C) {
 	})
 	c.Assert(err, qt.Equals, nil)
 	c.Assert(sshKeys.SSHKeys, qt.DeepEquals, []string{
-		"36ASDER56",
-		"22ERT56DG",
-		"56ASDFASDF32",
+		sshKey1,
+		sshKey2,
+		sshKey3,
 	})
 
 	// Remove some ssh keys.
 	err = s.adminClient.DeleteSSHKeys(s.srv.Ctx, &params.DeleteSSHKeysRequest{
 		Username: "jbloggs",
 		Body: params.DeleteSSHKeysBody{
-			SSHKeys: []string{"22ERT56DG", "56ASDFASDF32"},
+			SSHKeys: []string{sshKey2, sshKey3},
 		},
 	})
 	c.Assert(err, qt.Equals, nil)
@@ -605,14 +633,14 @@ func (s *usersSuite) TestSSHKeys(c *qt.C) {
 	})
 	c.Assert(err, qt.Equals, nil)
 	c.Assert(sshKeys.SSHKeys, qt.DeepEquals, []string{
-		"36ASDER56",
+		sshKey1,
 	})
 
 	// Delete an unknown ssh key just do nothing silently.
 	err = s.adminClient.DeleteSSHKeys(s.srv.Ctx, &params.DeleteSSHKeysRequest{
 		Username: "jbloggs",
 		Body: params.DeleteSSHKeysBody{
-			SSHKeys: []string{"22ERT56DG"},
+			SSHKeys: []string{sshKey2},
 		},
 	})
 	c.Assert(err, qt.Equals, nil)
@@ -623,14 +651,14 @@ func (s *usersSuite) TestSSHKeys(c *qt.C) {
 	})
 	c.Assert(err, qt.Equals, nil)
 	c.Assert(sshKeys.SSHKeys, qt.DeepEquals, []string{
-		"36ASDER56",
+		sshKey1,
 	})
 
 	// Append one ssh key.
 	err = s.adminClient.PutSSHKeys(s.srv.Ctx, &params.PutSSHKeysRequest{
 		Username: "jbloggs",
 		Body: params.PutSSHKeysBody{
-			SSHKeys: []string{"90SDFGS45"},
+			SSHKeys: []string{sshKey4},
 			Add:     true,
 		},
 	})
@@ -642,9 +670,124 @@ func (s *usersSuite) TestSSHKeys(c *qt.C) {
 	})
 	c.Assert(err, qt.Equals, nil)
 	c.Assert(sshKeys.SSHKeys, qt.DeepEquals, []string{
-		"36ASDER56",
-		"90SDFGS45",
+		sshKey1,
+		sshKey4,
+	})
+}
+
+func (s *usersSuite) TestPutSSHKeysReplaces(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+	})
+	for _, keys := range [][]string{{sshKey1, sshKey2}, {sshKey3}} {
+		err := s.adminClient.PutSSHKeys(s.srv.Ctx, &params.PutSSHKeysRequest{
+			Username: "jbloggs",
+			Body: params.PutSSHKeysBody{
+				SSHKeys: keys,
+			},
+		})
+		c.Assert(err, qt.Equals, nil)
+	}
+	sshKeys, err := s.adminClient.GetSSHKeys(s.srv.Ctx, &params.SSHKeysRequest{
+		Username: "jbloggs",
 	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(sshKeys.SSHKeys, qt.DeepEquals, []string{sshKey3})
+}
+
+var putInvalidSSHKeysTests = []struct {
+	about       string
+	key         string
+	expectError string
+}{{
+	about:       "not a key",
+	key:         "36ASDER56",
+	expectError: `.*invalid SSH key "36ASDER56"`,
+}, {
+	about:       "options",
+	key:         `command="rm -rf /" ` + sshKey1,
+	expectError: `.*SSH key .* has options`,
+}, {
+	about:       "more than one key",
+	key:         sshKey1 + "\n" + sshKey2,
+	expectError: `.*more than one key`,
+}}
+
+func (s *usersSuite) TestPutInvalidSSHKeys(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+	})
+	for _, test := range putInvalidSSHKeysTests {
+		c.Run(test.about, func(c *qt.C) {
+			err := s.adminClient.PutSSHKeys(s.srv.Ctx, &params.PutSSHKeysRequest{
+				Username: "jbloggs",
+				Body: params.PutSSHKeysBody{
+					SSHKeys: []string{test.key},
+				},
+			})
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+		})
+	}
+}
+
+func (s *usersSuite) TestDeleteSSHKeysByFingerprint(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+	})
+	err := s.adminClient.PutSSHKeys(s.srv.Ctx, &params.PutSSHKeysRequest{
+		Username: "jbloggs",
+		Body: params.PutSSHKeysBody{
+			SSHKeys: []string{sshKey1, sshKey2},
+		},
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = s.adminClient.DeleteSSHKeys(s.srv.Ctx, &params.DeleteSSHKeysRequest{
+		Username: "jbloggs",
+		Body: params.DeleteSSHKeysBody{
+			SSHKeys: []string{sshKey2Fingerprint},
+		},
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	resp := s.doAdmin(c, "GET", "/v1/u/jbloggs/ssh-keys/authorized_keys")
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("Content-Type"), qt.Equals, "text/plain; charset=utf-8")
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(body), qt.Equals, sshKey1+"\n")
+}
+
+func (s *usersSuite) TestGroupAuthorizedKeys(c *qt.C) {
+	for i, u := range []params.User{{
+		Username:   "alice",
+		ExternalID: "test:alice",
+		IDPGroups:  []string{"ops"},
+	}, {
+		Username:   "bob",
+		ExternalID: "test:bob",
+		IDPGroups:  []string{"dev"},
+	}, {
+		Username:   "carol",
+		ExternalID: "test:carol",
+		IDPGroups:  []string{"dev", "ops"},
+	}} {
+		s.addUser(c, u)
+		err := s.adminClient.PutSSHKeys(s.srv.Ctx, &params.PutSSHKeysRequest{
+			Username: u.Username,
+			Body: params.PutSSHKeysBody{
+				SSHKeys: []string{[]string{sshKey1, sshKey2, sshKey3}[i]},
+			},
+		})
+		c.Assert(err, qt.Equals, nil)
+	}
+	resp := s.doAdmin(c, "GET", "/v1/g/ops/ssh-keys/authorized_keys")
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(body), qt.Equals, sshKey1+"\n"+sshKey3+"\n")
 }
 
 func (s *usersSuite) TestVerifyUserToken(c *qt.C) {
@@ -972,6 +1115,148 @@ func (s *usersSuite) TestExtraInfo(c *qt.C) {
 	})
 }
 
+func (s *usersSuite) TestSensitiveExtraInfo(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+	})
+	err := s.adminClient.SetUserExtraInfo(s.srv.Ctx, &params.SetUserExtraInfoRequest{
+		Username: "jbloggs",
+		ExtraInfo: map[string]interface{}{
+			"national-id": "AB123456C",
+			"team":        "blue",
+		},
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	// The sensitive item is encrypted in the store.
+	id := store.Identity{Username: "jbloggs"}
+	err = s.store.Store.Identity(s.srv.Ctx, &id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(attrcrypt.IsEncrypted(id.ExtraInfo["national-id"][0]), qt.Equals, true)
+	c.Assert(id.ExtraInfo["team"], qt.DeepEquals, []string{`"blue"`})
+
+	ei, err := s.adminClient.UserExtraInfo(s.srv.Ctx, &params.UserExtraInfoRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ei, qt.DeepEquals, map[string]interface{}{
+		"national-id": "AB123456C",
+		"team":        "blue",
+	})
+
+	err = s.adminClient.SetUserExtraInfoItem(s.srv.Ctx, &params.SetUserExtraInfoItemRequest{
+		Username: "jbloggs",
+		Item:     "national-id",
+		Data:     "ZZ999999Z",
+	})
+	c.Assert(err, qt.Equals, nil)
+	item, err := s.adminClient.UserExtraInfoItem(s.srv.Ctx, &params.UserExtraInfoItemRequest{
+		Username: "jbloggs",
+		Item:     "national-id",
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(item, qt.Equals, "ZZ999999Z")
+}
+
+func (s *usersSuite) TestSensitiveExtraInfoStoredUnencrypted(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+	})
+	// Items written before the attribute was made sensitive are
+	// still stored in plain text.
+	err := s.store.Store.UpdateIdentity(s.srv.Ctx, &store.Identity{
+		Username: "jbloggs",
+		ExtraInfo: map[string][]string{
+			"national-id": {`"AB123456C"`},
+			"team":        {`"blue"`},
+		},
+	}, store.Update{
+		store.ExtraInfo: store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	err = s.store.ACLStore.Add(s.srv.Ctx, "read-user", []string{"bob"})
+	c.Assert(err, qt.Equals, nil)
+	client, err := candidclient.New(candidclient.NewParams{
+		BaseURL: s.srv.URL,
+		Client:  s.srv.Client(s.interactor),
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	ei, err := client.UserExtraInfo(s.srv.Ctx, &params.UserExtraInfoRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ei, qt.DeepEquals, map[string]interface{}{
+		"team": "blue",
+	})
+
+	_, err = client.UserExtraInfoItem(s.srv.Ctx, &params.UserExtraInfoItemRequest{
+		Username: "jbloggs",
+		Item:     "national-id",
+	})
+	c.Assert(err, qt.ErrorMatches, `Get .*/v1/u/jbloggs/extra-info/national-id: cannot read sensitive extra-info "national-id"`)
+
+	ei, err = s.adminClient.UserExtraInfo(s.srv.Ctx, &params.UserExtraInfoRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ei, qt.DeepEquals, map[string]interface{}{
+		"national-id": "AB123456C",
+		"team":        "blue",
+	})
+}
+
+func (s *usersSuite) TestExtraInfoSchema(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+	})
+	err := s.adminClient.SetUserExtraInfoItem(s.srv.Ctx, &params.SetUserExtraInfoItemRequest{
+		Username: "jbloggs",
+		Item:     "employee-id",
+		Data:     "E1234",
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	err = s.adminClient.SetUserExtraInfoItem(s.srv.Ctx, &params.SetUserExtraInfoItemRequest{
+		Username: "jbloggs",
+		Item:     "employee-id",
+		Data:     1234,
+	})
+	c.Assert(err, qt.ErrorMatches, `Put .*/v1/u/jbloggs/extra-info/employee-id: attribute "employee-id" must be a string`)
+
+	err = s.adminClient.SetUserExtraInfo(s.srv.Ctx, &params.SetUserExtraInfoRequest{
+		Username: "jbloggs",
+		ExtraInfo: map[string]interface{}{
+			"employee-id": "X1",
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `Put .*/v1/u/jbloggs/extra-info: attribute "employee-id" does not match pattern "E\[0-9\]\+"`)
+
+	item, err := s.adminClient.UserExtraInfoItem(s.srv.Ctx, &params.UserExtraInfoItemRequest{
+		Username: "jbloggs",
+		Item:     "employee-id",
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(item, qt.Equals, "E1234")
+}
+
+func (s *usersSuite) TestAttributes(c *qt.C) {
+	var resp struct {
+		Attributes []attrschema.Attribute `json:"attributes"`
+	}
+	s.unmarshal(c, s.doAdminBody(c, "GET", "/v1/attributes", ""), http.StatusOK, &resp)
+	c.Assert(resp.Attributes, qt.DeepEquals, []attrschema.Attribute{{
+		Name:       "employee-id",
+		Type:       attrschema.TypeString,
+		Pattern:    `E[0-9]+`,
+		Visibility: attrschema.VisibilityPublic,
+	}})
+}
+
 func (s *usersSuite) TestExtraInfoNotFound(c *qt.C) {
 	err := s.adminClient.SetUserExtraInfo(s.srv.Ctx, &params.SetUserExtraInfoRequest{
 		Username: "not-there",
@@ -0,0 +1,111 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/internal/auth"
+)
+
+// membershipMaxAge holds the length of time for which clients may
+// cache the result of a membership verification.
+const membershipMaxAge = time.Minute
+
+// verifyMembershipRequest is a request to check whether a user is a
+// member of a group.
+type verifyMembershipRequest struct {
+	httprequest.Route `httprequest:"GET /v1/verify"`
+	Username          params.Username `httprequest:"username,form"`
+	Group             string          `httprequest:"group,form"`
+	Explain           bool            `httprequest:"explain,form"`
+}
+
+// verifyMembershipResponse holds the response from a
+// verifyMembershipRequest.
+type verifyMembershipResponse struct {
+	Username params.Username `json:"username"`
+	Group    string          `json:"group"`
+	Member   bool            `json:"member"`
+
+	// Explanation holds the reason for the result. It is only
+	// present when requested by a user that is allowed to see it.
+	Explanation *auth.Explanation `json:"explanation,omitempty"`
+}
+
+// VerifyMembership reports whether the requested user is a member of
+// the requested group. This allows a relying service to check group
+// membership without obtaining a new discharge. The response includes
+// an ETag and a short max-age so that clients can cache the result; a
+// request with a matching If-None-Match header receives a 304 (Not
+// Modified) response. If explain is set, the response also explains
+// the result; this is only allowed for the user themselves and members
+// of the explain-authorization ACL.
+func (h *handler) VerifyMembership(p httprequest.Params, r *verifyMembershipRequest) error {
+	logger.Tracef("VerifyMembership %#v", r)
+	if r.Username == "" {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "username not specified")
+	}
+	if r.Group == "" {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "group not specified")
+	}
+	id, err := h.params.Authorizer.Identity(p.Context, string(r.Username))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	groups, err := id.Groups(p.Context)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	resp := verifyMembershipResponse{
+		Username: r.Username,
+		Group:    r.Group,
+	}
+	for _, g := range groups {
+		if g == r.Group {
+			resp.Member = true
+			break
+		}
+	}
+	if r.Explain {
+		allowed, err := h.params.Authorizer.Allow(p.Context, identityFromContext(p.Context), auth.UserOp(r.Username, auth.ActionExplain))
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if !allowed {
+			return errgo.WithCausef(nil, params.ErrForbidden, "not allowed to explain membership of %s", r.Username)
+		}
+		resp.Explanation, err = id.Explain(p.Context, []string{r.Group})
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		// Explanations are for debugging and are never cached.
+		p.Response.Header().Set("Cache-Control", "no-store")
+		httprequest.WriteJSON(p.Response, http.StatusOK, resp)
+		return nil
+	}
+	etag := membershipETag(resp)
+	p.Response.Header().Set("ETag", etag)
+	p.Response.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(membershipMaxAge/time.Second)))
+	if p.Request.Header.Get("If-None-Match") == etag {
+		p.Response.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	httprequest.WriteJSON(p.Response, http.StatusOK, resp)
+	return nil
+}
+
+// membershipETag returns the entity tag for the given membership
+// verification result.
+func membershipETag(resp verifyMembershipResponse) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%t", resp.Username, resp.Group, resp.Member)))
+	return fmt.Sprintf(`"%x"`, h[:16])
+}
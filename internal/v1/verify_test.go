@@ -0,0 +1,112 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"net/http"
+	"net/url"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/httprequest.v1"
+)
+
+type verifyMembershipResponse struct {
+	Username params.Username `json:"username"`
+	Group    string          `json:"group"`
+	Member   bool            `json:"member"`
+}
+
+func (s *usersSuite) TestVerifyMembership(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+		IDPGroups:  []string{"g1"},
+	})
+	resp := s.verifyMembership(c, "jbloggs", "g1", "")
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("Cache-Control"), qt.Equals, "private, max-age=60")
+	etag := resp.Header.Get("ETag")
+	c.Assert(etag, qt.Not(qt.Equals), "")
+	var vresp verifyMembershipResponse
+	err := httprequest.UnmarshalJSONResponse(resp, &vresp)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(vresp, qt.DeepEquals, verifyMembershipResponse{
+		Username: "jbloggs",
+		Group:    "g1",
+		Member:   true,
+	})
+
+	resp = s.verifyMembership(c, "jbloggs", "g1", etag)
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusNotModified)
+
+	resp = s.verifyMembership(c, "jbloggs", "g2", etag)
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("ETag"), qt.Not(qt.Equals), etag)
+	err = httprequest.UnmarshalJSONResponse(resp, &vresp)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(vresp.Member, qt.Equals, false)
+}
+
+func (s *usersSuite) TestVerifyMembershipExplain(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+		IDPGroups:  []string{"g1", "g2"},
+	})
+	req, err := http.NewRequest("GET", s.srv.URL+"/v1/verify?"+url.Values{
+		"username": {"jbloggs"},
+		"group":    {"g2"},
+		"explain":  {"true"},
+	}.Encode(), nil)
+	c.Assert(err, qt.Equals, nil)
+	resp, err := s.srv.AdminClient().Do(req)
+	c.Assert(err, qt.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("Cache-Control"), qt.Equals, "no-store")
+	var vresp struct {
+		Member      bool `json:"member"`
+		Explanation struct {
+			Allowed     bool     `json:"allowed"`
+			Rule        string   `json:"rule"`
+			Match       string   `json:"match"`
+			Groups      []string `json:"groups"`
+			GroupSource string   `json:"group-source"`
+		} `json:"explanation"`
+	}
+	err = httprequest.UnmarshalJSONResponse(resp, &vresp)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(vresp.Member, qt.Equals, true)
+	c.Assert(vresp.Explanation.Allowed, qt.Equals, true)
+	c.Assert(vresp.Explanation.Rule, qt.Equals, "group")
+	c.Assert(vresp.Explanation.Match, qt.Equals, "g2")
+	c.Assert(vresp.Explanation.Groups, qt.DeepEquals, []string{"g1", "g2"})
+	c.Assert(vresp.Explanation.GroupSource, qt.Equals, "the identity database")
+}
+
+func (s *usersSuite) TestVerifyMembershipNotFound(c *qt.C) {
+	resp := s.verifyMembership(c, "not-there", "g1", "")
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusNotFound)
+}
+
+func (s *usersSuite) TestVerifyMembershipNoGroup(c *qt.C) {
+	resp := s.verifyMembership(c, "jbloggs", "", "")
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+func (s *usersSuite) verifyMembership(c *qt.C, username, group, etag string) *http.Response {
+	req, err := http.NewRequest("GET", s.srv.URL+"/v1/verify?"+url.Values{
+		"username": {username},
+		"group":    {group},
+	}.Encode(), nil)
+	c.Assert(err, qt.Equals, nil)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := s.srv.AdminClient().Do(req)
+	c.Assert(err, qt.Equals, nil)
+	c.Defer(func() { resp.Body.Close() })
+	return resp
+}
@@ -0,0 +1,151 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package v2 implements the /v2 API endpoints. The v2 API provides the
+// same functionality as the v1 API but with consistent resource naming,
+// paginated list responses and a consistent error envelope.
+package v2
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/juju/loggo"
+	"golang.org/x/net/trace"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/internal/accesslog"
+	"github.com/CanonicalLtd/candid/internal/auth"
+	"github.com/CanonicalLtd/candid/internal/auth/httpauth"
+	"github.com/CanonicalLtd/candid/internal/identity"
+	"github.com/CanonicalLtd/candid/internal/logging"
+	"github.com/CanonicalLtd/candid/internal/monitoring"
+)
+
+var logger = loggo.GetLogger("candid.internal.v2")
+
+// reqServer is the httprequest.Server used for all v2 endpoints. It
+// reports errors using the v2 error envelope.
+var reqServer = httprequest.Server{
+	ErrorMapper: errToResp,
+}
+
+// NewAPIHandler is an identity.NewAPIHandlerFunc.
+func NewAPIHandler(params identity.HandlerParams) ([]httprequest.Handler, error) {
+	return reqServer.Handlers(new(params)), nil
+}
+
+// new returns a function that will generate a new instance of the v2 API
+// handler for a request.
+func new(hParams identity.HandlerParams) func(p httprequest.Params, arg interface{}) (*handler, context.Context, error) {
+	reqAuth := httpauth.New(hParams.Oven, hParams.Authorizer, hParams.APIMacaroonTimeout)
+	return func(p httprequest.Params, arg interface{}) (*handler, context.Context, error) {
+		t := trace.New("identity.internal.v2", p.PathPattern)
+		accesslog.SetRoute(p.Context, p.PathPattern)
+		ctx := trace.NewContext(p.Context, t)
+		ctx, close1 := hParams.Store.Context(ctx)
+		ctx, close2 := hParams.MeetingStore.Context(ctx)
+		hnd := &handler{
+			params: hParams,
+			trace:  t,
+			monReq: hParams.RequestMetrics.NewRequest(&p),
+			close: func() {
+				close2()
+				close1()
+			},
+		}
+		op := opForRequest(arg)
+		logger.Debugf("opForRequest %#v -> %#v", arg, op)
+		if op.Entity == "" {
+			hnd.Close()
+			return nil, nil, params.ErrUnauthorized
+		}
+		authInfo, err := reqAuth.Auth(ctx, p.Request, op)
+		if err != nil {
+			hnd.Close()
+			return nil, nil, errgo.Mask(err, errgo.Any)
+		}
+		if authInfo.Identity != nil {
+			id, ok := authInfo.Identity.(*auth.Identity)
+			if !ok {
+				hnd.Close()
+				return nil, nil, errgo.Newf("unexpected identity type %T", authInfo.Identity)
+			}
+			ctx = contextWithIdentity(ctx, id)
+			ctx = logging.ContextWithUser(ctx, id.Id())
+			accesslog.SetUser(ctx, id.Id())
+		}
+		return hnd, ctx, nil
+	}
+}
+
+// A handler is a handler for a request to a /v2 endpoint.
+type handler struct {
+	params identity.HandlerParams
+
+	trace  trace.Trace
+	monReq monitoring.Request
+	close  func()
+}
+
+// Close implements io.Closer. httprequest will automatically call this
+// once a request is complete.
+func (h *handler) Close() error {
+	if h.close != nil {
+		h.close()
+		h.close = nil
+	}
+	h.monReq.ObserveMetric()
+	if h.trace != nil {
+		h.trace.Finish()
+		h.trace = nil
+	}
+	return nil
+}
+
+type identityKey struct{}
+
+func contextWithIdentity(ctx context.Context, identity *auth.Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+func identityFromContext(ctx context.Context) *auth.Identity {
+	id, _ := ctx.Value(identityKey{}).(*auth.Identity)
+	return id
+}
+
+// errToResp maps errors to the v2 error envelope. The status code is
+// determined in the same way as for the other APIs, and errors that the
+// bakery needs to see (such as discharge-required errors) are returned
+// unchanged so that bakery clients continue to work.
+func errToResp(ctx context.Context, err error) (int, interface{}) {
+	status, body := identity.ReqServer.ErrorMapper(ctx, err)
+	perr, ok := body.(errorCoder)
+	if !ok {
+		return status, body
+	}
+	env := &ErrorResponse{
+		Error: Error{
+			Code:    perr.ErrorCode(),
+			Message: perr.Error(),
+		},
+	}
+	if hs, ok := body.(httprequest.HeaderSetter); ok {
+		env.header = hs
+	}
+	return status, env
+}
+
+type errorCoder interface {
+	error
+	ErrorCode() params.ErrorCode
+}
+
+// SetHeader implements httprequest.HeaderSetter.
+func (e *ErrorResponse) SetHeader(h http.Header) {
+	if e.header != nil {
+		e.header.SetHeader(h)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v2
+
+import (
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
+
+	"github.com/CanonicalLtd/candid/internal/auth"
+)
+
+// opForRequest returns the operation that will be performed
+// by the API handler method which takes the given argument r.
+// See aclForOp in ../auth/auth.go for the mapping from
+// operation to ACLs.
+func opForRequest(r interface{}) bakery.Op {
+	switch r := r.(type) {
+	case *ListUsersRequest:
+		if r.Owner != "" {
+			return auth.UserOp(params.Username(r.Owner), auth.ActionRead)
+		}
+		return auth.GlobalOp(auth.ActionRead)
+	case *UserRequest:
+		return auth.UserOp(r.Username, auth.ActionRead)
+	case *GroupsRequest:
+		return auth.UserOp(r.Username, auth.ActionReadGroups)
+	case *SetGroupsRequest:
+		return auth.UserOp(r.Username, auth.ActionWriteGroups)
+	case *ModifyGroupsRequest:
+		return auth.UserOp(r.Username, auth.ActionWriteGroups)
+	case *SSHKeysRequest:
+		return auth.UserOp(r.Username, auth.ActionReadSSHKeys)
+	case *AddSSHKeysRequest:
+		return auth.UserOp(r.Username, auth.ActionWriteSSHKeys)
+	case *RemoveSSHKeysRequest:
+		return auth.UserOp(r.Username, auth.ActionWriteSSHKeys)
+	case *ExtraInfoRequest:
+		return auth.UserOp(r.Username, auth.ActionReadAdmin)
+	case *SetExtraInfoRequest:
+		return auth.UserOp(r.Username, auth.ActionWriteAdmin)
+	case *CreateAgentRequest:
+		if r.Body.Parent {
+			return auth.GlobalOp(auth.ActionCreateParentAgent)
+		}
+		return auth.GlobalOp(auth.ActionCreateAgent)
+	case *CreatePersonalAgentRequest:
+		return auth.GlobalOp(auth.ActionCreateAgent)
+	case *WhoAmIRequest:
+		return identchecker.LoginOp
+	case *DischargeTokenRequest:
+		return auth.GlobalOp(auth.ActionDischargeFor)
+	case *VerifyTokenRequest:
+		return auth.GlobalOp(auth.ActionVerify)
+	default:
+		logger.Infof("unknown API argument type %#v", r)
+	}
+	return bakery.Op{}
+}
@@ -0,0 +1,259 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v2
+
+import (
+	"encoding/json"
+	"time"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+// ErrorResponse is the body of all error responses from the v2 API.
+type ErrorResponse struct {
+	// Error holds the details of the error.
+	Error Error `json:"error"`
+
+	header httprequest.HeaderSetter
+}
+
+// Error holds the details of an error returned from the v2 API.
+type Error struct {
+	// Code holds the error code, if any.
+	Code params.ErrorCode `json:"code,omitempty"`
+
+	// Message holds a human readable description of the error.
+	Message string `json:"message"`
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ErrorCode returns the error code of the error.
+func (e *Error) ErrorCode() params.ErrorCode {
+	return e.Code
+}
+
+// User holds the details of a user.
+type User struct {
+	Username      params.Username     `json:"username"`
+	ExternalID    string              `json:"external-id,omitempty"`
+	FullName      string              `json:"full-name,omitempty"`
+	Email         string              `json:"email,omitempty"`
+	GravatarID    string              `json:"gravatar-id,omitempty"`
+	Groups        []string            `json:"groups"`
+	Owner         params.Username     `json:"owner,omitempty"`
+	PublicKeys    []*bakery.PublicKey `json:"public-keys,omitempty"`
+	SSHKeys       []string            `json:"ssh-keys,omitempty"`
+	LastLogin     *time.Time          `json:"last-login,omitempty"`
+	LastDischarge *time.Time          `json:"last-discharge,omitempty"`
+}
+
+// ListUsersRequest is a request to list the users that match the given
+// filters. Results are returned in username order.
+type ListUsersRequest struct {
+	httprequest.Route  `httprequest:"GET /v2/users"`
+	ExternalID         string `httprequest:"external-id,form"`
+	Email              string `httprequest:"email,form"`
+	Owner              string `httprequest:"owner,form"`
+	LastLoginSince     string `httprequest:"last-login-since,form"`
+	LastDischargeSince string `httprequest:"last-discharge-since,form"`
+
+	// Limit holds the maximum number of users to return. If this
+	// is zero then a default limit is used.
+	Limit int `httprequest:"limit,form"`
+
+	// PageToken holds the NextPageToken returned from a previous
+	// request, to continue that listing.
+	PageToken string `httprequest:"page-token,form"`
+}
+
+// ListUsersResponse holds the response to a ListUsersRequest.
+type ListUsersResponse struct {
+	Users []User `json:"users"`
+
+	// NextPageToken holds the token that should be sent to
+	// retrieve the next page of results. It is empty when there are
+	// no more results.
+	NextPageToken string `json:"next-page-token,omitempty"`
+}
+
+// UserRequest is a request for the details of a user.
+type UserRequest struct {
+	httprequest.Route `httprequest:"GET /v2/users/:username"`
+	Username          params.Username `httprequest:"username,path"`
+}
+
+// GroupsRequest is a request for the groups of a user.
+type GroupsRequest struct {
+	httprequest.Route `httprequest:"GET /v2/users/:username/groups"`
+	Username          params.Username `httprequest:"username,path"`
+}
+
+// Groups holds a list of groups.
+type Groups struct {
+	Groups []string `json:"groups"`
+}
+
+// SetGroupsRequest is a request to replace the groups stored for a
+// user.
+type SetGroupsRequest struct {
+	httprequest.Route `httprequest:"PUT /v2/users/:username/groups"`
+	Username          params.Username `httprequest:"username,path"`
+	Body              Groups          `httprequest:",body"`
+}
+
+// ModifyGroupsRequest is a request to add groups to, and remove groups
+// from, the groups stored for a user.
+type ModifyGroupsRequest struct {
+	httprequest.Route `httprequest:"PATCH /v2/users/:username/groups"`
+	Username          params.Username  `httprequest:"username,path"`
+	Body              ModifyGroupsBody `httprequest:",body"`
+}
+
+// ModifyGroupsBody holds the body of a ModifyGroupsRequest.
+type ModifyGroupsBody struct {
+	Add    []string `json:"add,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+}
+
+// SSHKeysRequest is a request for the SSH keys of a user.
+type SSHKeysRequest struct {
+	httprequest.Route `httprequest:"GET /v2/users/:username/ssh-keys"`
+	Username          params.Username `httprequest:"username,path"`
+}
+
+// SSHKeys holds a list of SSH keys.
+type SSHKeys struct {
+	SSHKeys []string `json:"ssh-keys"`
+}
+
+// AddSSHKeysRequest is a request to add SSH keys to a user.
+type AddSSHKeysRequest struct {
+	httprequest.Route `httprequest:"POST /v2/users/:username/ssh-keys"`
+	Username          params.Username `httprequest:"username,path"`
+	Body              SSHKeys         `httprequest:",body"`
+}
+
+// RemoveSSHKeysRequest is a request to remove SSH keys from a user.
+type RemoveSSHKeysRequest struct {
+	httprequest.Route `httprequest:"DELETE /v2/users/:username/ssh-keys"`
+	Username          params.Username `httprequest:"username,path"`
+	Body              SSHKeys         `httprequest:",body"`
+}
+
+// ExtraInfoRequest is a request for the extra-info of a user.
+type ExtraInfoRequest struct {
+	httprequest.Route `httprequest:"GET /v2/users/:username/extra-info"`
+	Username          params.Username `httprequest:"username,path"`
+}
+
+// ExtraInfo holds the extra-info of a user.
+type ExtraInfo struct {
+	ExtraInfo map[string]json.RawMessage `json:"extra-info"`
+}
+
+// SetExtraInfoRequest is a request to update extra-info items for a
+// user. Items not mentioned in the request are unchanged.
+type SetExtraInfoRequest struct {
+	httprequest.Route `httprequest:"PUT /v2/users/:username/extra-info"`
+	Username          params.Username `httprequest:"username,path"`
+	Body              ExtraInfo       `httprequest:",body"`
+}
+
+// CreateAgentRequest is a request to create a new agent.
+type CreateAgentRequest struct {
+	httprequest.Route `httprequest:"POST /v2/agents"`
+	Body              CreateAgentBody `httprequest:",body"`
+}
+
+// CreateAgentBody holds the body of a CreateAgentRequest.
+type CreateAgentBody struct {
+	FullName   string              `json:"full-name,omitempty"`
+	Groups     []string            `json:"groups,omitempty"`
+	PublicKeys []*bakery.PublicKey `json:"public-keys"`
+	Parent     bool                `json:"parent,omitempty"`
+}
+
+// CreateAgentResponse holds the response to a CreateAgentRequest.
+type CreateAgentResponse struct {
+	Username params.Username `json:"username"`
+}
+
+// MaxPersonalAgentLifetime is the longest time for which a personal
+// agent may be created.
+const MaxPersonalAgentLifetime = 30 * 24 * time.Hour
+
+// CreatePersonalAgentRequest is a request to create a short-lived agent
+// owned by the authenticated user.
+type CreatePersonalAgentRequest struct {
+	httprequest.Route `httprequest:"POST /v2/personal-agents"`
+	Body              CreatePersonalAgentBody `httprequest:",body"`
+}
+
+// CreatePersonalAgentBody holds the body of a
+// CreatePersonalAgentRequest.
+type CreatePersonalAgentBody struct {
+	FullName string `json:"full-name,omitempty"`
+
+	// Groups holds the groups that the agent will be a member of.
+	// The authenticated user must be a member of all of them.
+	Groups []string `json:"groups,omitempty"`
+
+	PublicKeys []*bakery.PublicKey `json:"public-keys"`
+
+	// Expires holds the time at which the agent expires. It must be
+	// no more than MaxPersonalAgentLifetime in the future.
+	Expires time.Time `json:"expires"`
+}
+
+// CreatePersonalAgentResponse holds the response to a
+// CreatePersonalAgentRequest.
+type CreatePersonalAgentResponse struct {
+	Username params.Username `json:"username"`
+	Expires  time.Time       `json:"expires"`
+}
+
+// WhoAmIRequest is a request for the authenticated user.
+type WhoAmIRequest struct {
+	httprequest.Route `httprequest:"GET /v2/whoami"`
+}
+
+// WhoAmIResponse holds the response to a WhoAmIRequest.
+type WhoAmIResponse struct {
+	Username string `json:"username"`
+}
+
+// DischargeTokenRequest is a request for a discharge token for a user.
+type DischargeTokenRequest struct {
+	httprequest.Route `httprequest:"POST /v2/users/:username/discharge-token"`
+	Username          params.Username `httprequest:"username,path"`
+}
+
+// DischargeTokenResponse holds the response to a DischargeTokenRequest.
+type DischargeTokenResponse struct {
+	DischargeToken *bakery.Macaroon `json:"discharge-token"`
+}
+
+// VerifyTokenRequest is a request to verify a token issued by the
+// identity service.
+type VerifyTokenRequest struct {
+	httprequest.Route `httprequest:"POST /v2/tokens/verify"`
+	Body              VerifyTokenBody `httprequest:",body"`
+}
+
+// VerifyTokenBody holds the body of a VerifyTokenRequest.
+type VerifyTokenBody struct {
+	Macaroons macaroon.Slice `json:"macaroons"`
+}
+
+// VerifyTokenResponse holds the response to a VerifyTokenRequest.
+type VerifyTokenResponse struct {
+	Declared map[string]string `json:"declared"`
+}
@@ -0,0 +1,581 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v2
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+	macaroon "gopkg.in/macaroon.v2"
+
+	"github.com/CanonicalLtd/candid/internal/auth"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+const (
+	// defaultLimit is the number of items returned in a page when
+	// the request does not specify a limit.
+	defaultLimit = 100
+
+	// maxLimit is the maximum number of items that will be returned
+	// in a single page.
+	maxLimit = 1000
+)
+
+// ListUsers returns the users that match the given request, one page at
+// a time.
+func (h *handler) ListUsers(p httprequest.Params, r *ListUsersRequest) (*ListUsersResponse, error) {
+	logger.Tracef("ListUsers %#v", r)
+	limit, skip, err := pageParams(r.Limit, r.PageToken)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	var identity store.Identity
+	var filter store.Filter
+	if r.ExternalID != "" {
+		identity.ProviderID = store.ProviderIdentity(r.ExternalID)
+		filter[store.ProviderID] = store.Equal
+	}
+	if r.Email != "" {
+		identity.Email = r.Email
+		filter[store.Email] = store.Equal
+	}
+	if r.LastLoginSince != "" {
+		if err := identity.LastLogin.UnmarshalText([]byte(r.LastLoginSince)); err != nil {
+			return nil, errgo.WithCausef(err, params.ErrBadRequest, "invalid last-login-since")
+		}
+		filter[store.LastLogin] = store.GreaterThanOrEqual
+	}
+	if r.LastDischargeSince != "" {
+		if err := identity.LastDischarge.UnmarshalText([]byte(r.LastDischargeSince)); err != nil {
+			return nil, errgo.WithCausef(err, params.ErrBadRequest, "invalid last-discharge-since")
+		}
+		filter[store.LastDischarge] = store.GreaterThanOrEqual
+	}
+	if r.Owner != "" {
+		ownerIdentity := store.Identity{
+			Username: r.Owner,
+		}
+		err := h.params.Store.Identity(p.Context, &ownerIdentity)
+		if errgo.Cause(err) == store.ErrNotFound {
+			// If the owner doesn't exist then it has no agents.
+			return &ListUsersResponse{Users: []User{}}, nil
+		}
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		identity.Owner = ownerIdentity.ProviderID
+		filter[store.Owner] = store.Equal
+	}
+	// Request one more identity than required so that we can tell
+	// whether there is another page.
+	identities, err := h.params.Store.FindIdentities(p.Context, &identity, filter, []store.Sort{{Field: store.Username}}, skip, limit+1)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var resp ListUsersResponse
+	if len(identities) > limit {
+		identities = identities[:limit]
+		resp.NextPageToken = pageToken(skip + limit)
+	}
+	resp.Users = make([]User, len(identities))
+	for i := range identities {
+		u, err := h.userFromIdentity(p.Context, &identities[i])
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		resp.Users[i] = *u
+	}
+	logger.Tracef("ListUsers response %#v", resp)
+	return &resp, nil
+}
+
+// User returns the details of the requested user.
+func (h *handler) User(p httprequest.Params, r *UserRequest) (*User, error) {
+	logger.Tracef("User %#v", r)
+	id := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &id); err != nil {
+		return nil, translateStoreError(err)
+	}
+	u, err := h.userFromIdentity(p.Context, &id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	logger.Tracef("User response %#v", u)
+	return u, nil
+}
+
+// Groups returns the groups associated with the requested user.
+func (h *handler) Groups(p httprequest.Params, r *GroupsRequest) (*Groups, error) {
+	logger.Tracef("Groups %#v", r)
+	id, err := h.params.Authorizer.Identity(p.Context, string(r.Username))
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	groups, err := id.Groups(p.Context)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if groups == nil {
+		groups = []string{}
+	}
+	return &Groups{Groups: groups}, nil
+}
+
+// SetGroups replaces the groups stored for the given user.
+func (h *handler) SetGroups(p httprequest.Params, r *SetGroupsRequest) error {
+	logger.Tracef("SetGroups %#v", r)
+	identity := store.Identity{
+		Username: string(r.Username),
+		Groups:   r.Body.Groups,
+	}
+	if err := h.params.Store.UpdateIdentity(p.Context, &identity, store.Update{store.Groups: store.Set}); err != nil {
+		return translateStoreError(err)
+	}
+	return nil
+}
+
+// ModifyGroups adds groups to, and removes groups from, the groups
+// stored for the given user. Groups are added before any are removed.
+func (h *handler) ModifyGroups(p httprequest.Params, r *ModifyGroupsRequest) error {
+	logger.Tracef("ModifyGroups %#v", r)
+	if len(r.Body.Add) > 0 {
+		identity := store.Identity{
+			Username: string(r.Username),
+			Groups:   r.Body.Add,
+		}
+		if err := h.params.Store.UpdateIdentity(p.Context, &identity, store.Update{store.Groups: store.Push}); err != nil {
+			return translateStoreError(err)
+		}
+	}
+	if len(r.Body.Remove) > 0 {
+		identity := store.Identity{
+			Username: string(r.Username),
+			Groups:   r.Body.Remove,
+		}
+		if err := h.params.Store.UpdateIdentity(p.Context, &identity, store.Update{store.Groups: store.Pull}); err != nil {
+			return translateStoreError(err)
+		}
+	}
+	return nil
+}
+
+// SSHKeys returns the SSH keys stored for the given user.
+func (h *handler) SSHKeys(p httprequest.Params, r *SSHKeysRequest) (*SSHKeys, error) {
+	logger.Tracef("SSHKeys %#v", r)
+	id := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &id); err != nil {
+		return nil, translateStoreError(err)
+	}
+	keys := id.ExtraInfo["sshkeys"]
+	if keys == nil {
+		keys = []string{}
+	}
+	return &SSHKeys{SSHKeys: keys}, nil
+}
+
+// AddSSHKeys adds the given SSH keys to those stored for the given
+// user.
+func (h *handler) AddSSHKeys(p httprequest.Params, r *AddSSHKeysRequest) error {
+	logger.Tracef("AddSSHKeys %#v", r)
+	return h.updateSSHKeys(p.Context, r.Username, r.Body.SSHKeys, store.Push)
+}
+
+// RemoveSSHKeys removes the given SSH keys from those stored for the
+// given user. It is not an error to remove a key that is not stored.
+func (h *handler) RemoveSSHKeys(p httprequest.Params, r *RemoveSSHKeysRequest) error {
+	logger.Tracef("RemoveSSHKeys %#v", r)
+	return h.updateSSHKeys(p.Context, r.Username, r.Body.SSHKeys, store.Pull)
+}
+
+func (h *handler) updateSSHKeys(ctx context.Context, username params.Username, keys []string, op store.Operation) error {
+	id := store.Identity{
+		Username: string(username),
+		ExtraInfo: map[string][]string{
+			"sshkeys": keys,
+		},
+	}
+	if err := h.params.Store.UpdateIdentity(ctx, &id, store.Update{store.ExtraInfo: op}); err != nil {
+		return translateStoreError(err)
+	}
+	return nil
+}
+
+// ExtraInfo returns the extra-info stored for the given user.
+func (h *handler) ExtraInfo(p httprequest.Params, r *ExtraInfoRequest) (*ExtraInfo, error) {
+	logger.Tracef("ExtraInfo %#v", r)
+	id := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &id); err != nil {
+		return nil, translateStoreError(err)
+	}
+	canRead := h.params.Authorizer.SensitiveAllowed(p.Context, identityFromContext(p.Context), r.Username, auth.ActionReadSensitive)
+	info := make(map[string]json.RawMessage, len(id.ExtraInfo))
+	for k, v := range id.ExtraInfo {
+		if k == "sshkeys" || len(v) == 0 {
+			continue
+		}
+		if (h.params.ExtraInfoEncryption.IsSensitive(k) || h.params.AttributeSchema.IsPrivate(k)) && !canRead() {
+			continue
+		}
+		data, err := h.params.ExtraInfoEncryption.Decode(v[0])
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot decode extra-info %q", k)
+		}
+		info[k] = json.RawMessage(data)
+	}
+	return &ExtraInfo{ExtraInfo: info}, nil
+}
+
+// SetExtraInfo updates the given extra-info items for the given user.
+// All other items remain unchanged.
+func (h *handler) SetExtraInfo(p httprequest.Params, r *SetExtraInfoRequest) error {
+	logger.Tracef("SetExtraInfo %#v", r)
+	id := store.Identity{
+		Username:  string(r.Username),
+		ExtraInfo: make(map[string][]string, len(r.Body.ExtraInfo)),
+	}
+	canWrite := h.params.Authorizer.SensitiveAllowed(p.Context, identityFromContext(p.Context), r.Username, auth.ActionWriteSensitive)
+	for k, v := range r.Body.ExtraInfo {
+		if k == "sshkeys" || strings.ContainsAny(k, "./$") {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "%q bad key for extra-info", k)
+		}
+		if h.params.ExtraInfoEncryption.IsSensitive(k) && !canWrite() {
+			return errgo.WithCausef(nil, params.ErrForbidden, "cannot write sensitive extra-info %q", k)
+		}
+		if err := h.params.AttributeSchema.Validate(k, v); err != nil {
+			return errgo.WithCausef(err, params.ErrBadRequest, "")
+		}
+		value, err := h.params.ExtraInfoEncryption.Encode(k, v)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		id.ExtraInfo[k] = []string{value}
+	}
+	if err := h.params.Store.UpdateIdentity(p.Context, &id, store.Update{store.ExtraInfo: store.Set}); err != nil {
+		return translateStoreError(err)
+	}
+	return nil
+}
+
+// CreateAgent creates a new agent owned by the authenticated user (or
+// a parent agent with no owner) and returns its username.
+func (h *handler) CreateAgent(p httprequest.Params, r *CreateAgentRequest) (*CreateAgentResponse, error) {
+	logger.Tracef("CreateAgent %#v", r)
+	username, err := h.createAgent(p.Context, r.Body, time.Time{})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest), errgo.Is(params.ErrForbidden), errgo.Is(params.ErrAlreadyExists))
+	}
+	return &CreateAgentResponse{
+		Username: username,
+	}, nil
+}
+
+// CreatePersonalAgent creates a short-lived agent owned by the
+// authenticated user. The agent is a member of the requested subset of
+// the user's groups for as long as the user remains a member of them,
+// and it can no longer log in once it has expired.
+func (h *handler) CreatePersonalAgent(p httprequest.Params, r *CreatePersonalAgentRequest) (*CreatePersonalAgentResponse, error) {
+	logger.Tracef("CreatePersonalAgent %#v", r)
+	now := time.Now()
+	if !r.Body.Expires.After(now) {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "expiry time must be in the future")
+	}
+	if r.Body.Expires.After(now.Add(MaxPersonalAgentLifetime)) {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "expiry time must be within %v", MaxPersonalAgentLifetime)
+	}
+	username, err := h.createAgent(p.Context, CreateAgentBody{
+		FullName:   r.Body.FullName,
+		Groups:     r.Body.Groups,
+		PublicKeys: r.Body.PublicKeys,
+	}, r.Body.Expires)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest), errgo.Is(params.ErrForbidden), errgo.Is(params.ErrAlreadyExists))
+	}
+	return &CreatePersonalAgentResponse{
+		Username: username,
+		Expires:  r.Body.Expires.UTC(),
+	}, nil
+}
+
+// createAgent creates a new agent as specified by the given body. If
+// expires is non-zero the agent expires at that time.
+func (h *handler) createAgent(ctx context.Context, body CreateAgentBody, expires time.Time) (params.Username, error) {
+	pks := make([]bakery.PublicKey, len(body.PublicKeys))
+	for i, pk := range body.PublicKeys {
+		if pk == nil {
+			return "", errgo.WithCausef(nil, params.ErrBadRequest, "null public key provided")
+		}
+		pks[i] = *pk
+	}
+	if len(pks) == 0 {
+		return "", errgo.WithCausef(nil, params.ErrBadRequest, "no public keys specified")
+	}
+	ownerAuthIdentity := identityFromContext(ctx)
+	if ownerAuthIdentity == nil {
+		return "", errgo.Newf("no identity found (should not happen)")
+	}
+	if err := checkIsMemberOf(ctx, ownerAuthIdentity, body.Groups); err != nil {
+		return "", errgo.Mask(err, errgo.Is(params.ErrForbidden))
+	}
+	owner, err := ownerAuthIdentity.StoreIdentity(ctx)
+	if err != nil {
+		return "", errgo.Notef(err, "cannot find identity for authenticated user")
+	}
+	if owner.ProviderID.Provider() == "idm" && owner.Owner != "" && !body.Parent {
+		// Agent users, that are not parent agents, are not
+		// allowed to create their own agents.
+		return "", errgo.WithCausef(nil, params.ErrForbidden, "cannot create an agent using an agent account")
+	}
+	agentName, err := newAgentName()
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	identity := &store.Identity{
+		Username:   agentName + "@candid",
+		ProviderID: store.MakeProviderIdentity("idm", agentName),
+		Name:       body.FullName,
+		Groups:     body.Groups,
+		PublicKeys: pks,
+		ProviderInfo: map[string][]string{
+			"creator": {string(owner.ProviderID)},
+		},
+	}
+	if !expires.IsZero() {
+		identity.ProviderInfo[auth.AgentExpiresInfo] = []string{expires.UTC().Format(time.RFC3339)}
+	}
+	update := store.Update{
+		store.Username:     store.Set,
+		store.PublicKeys:   store.Set,
+		store.Groups:       store.Set,
+		store.Name:         store.Set,
+		store.ProviderInfo: store.Set,
+	}
+	if !body.Parent {
+		identity.Owner = owner.ProviderID
+		update[store.Owner] = store.Set
+	}
+	if err := h.params.Store.UpdateIdentity(ctx, identity, update); err != nil {
+		return "", translateStoreError(err)
+	}
+	return params.Username(identity.Username), nil
+}
+
+// WhoAmI returns the username of the authenticated user.
+func (h *handler) WhoAmI(p httprequest.Params, r *WhoAmIRequest) (*WhoAmIResponse, error) {
+	id := identityFromContext(p.Context)
+	if id == nil || id.Id() == "" {
+		// Should never happen, as the endpoint should require authentication.
+		return nil, errgo.Newf("no identity")
+	}
+	return &WhoAmIResponse{
+		Username: id.Id(),
+	}, nil
+}
+
+// DischargeToken allows an administrator to create a discharge token
+// for the specified user.
+func (h *handler) DischargeToken(p httprequest.Params, r *DischargeTokenRequest) (*DischargeTokenResponse, error) {
+	logger.Tracef("DischargeToken %#v", r)
+	err := h.params.Store.Identity(p.Context, &store.Identity{
+		Username: string(r.Username),
+	})
+	if err != nil {
+		return nil, translateStoreError(err)
+	}
+	m, err := h.params.Oven.NewMacaroon(
+		p.Context,
+		httpbakery.RequestVersion(p.Request),
+		[]checkers.Caveat{
+			checkers.TimeBeforeCaveat(time.Now().Add(h.params.DischargeTokenTimeout)),
+			candidclient.UserDeclaration(string(r.Username)),
+		},
+		identchecker.LoginOp,
+	)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot create discharge token")
+	}
+	return &DischargeTokenResponse{
+		DischargeToken: m,
+	}, nil
+}
+
+// VerifyToken verifies that the given macaroons were generated by this
+// service and returns any declared values.
+func (h *handler) VerifyToken(p httprequest.Params, r *VerifyTokenRequest) (*VerifyTokenResponse, error) {
+	logger.Tracef("VerifyToken %#v", r)
+	authInfo, err := h.params.Authorizer.Auth(p.Context, []macaroon.Slice{r.Body.Macaroons}, identchecker.LoginOp)
+	if err != nil {
+		return nil, errgo.WithCausef(err, params.ErrForbidden, "verification failure")
+	}
+	declared := map[string]string{
+		"username": authInfo.Identity.Id(),
+	}
+	if id, ok := authInfo.Identity.(*auth.Identity); ok && id.Impersonator() != "" {
+		declared[auth.ImpersonatedByAttribute] = id.Impersonator()
+	}
+	return &VerifyTokenResponse{
+		Declared: declared,
+	}, nil
+}
+
+func (h *handler) userFromIdentity(ctx context.Context, id *store.Identity) (*User, error) {
+	publicKeys := make([]*bakery.PublicKey, len(id.PublicKeys))
+	for i, key := range id.PublicKeys {
+		pk := key
+		publicKeys[i] = &pk
+	}
+	authID, err := h.params.Authorizer.Identity(ctx, id.Username)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	groups, err := authID.Groups(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if groups == nil {
+		// Ensure that a null list of groups is never sent.
+		groups = []string{}
+	}
+	u := User{
+		Username:   params.Username(id.Username),
+		FullName:   id.Name,
+		Email:      id.Email,
+		GravatarID: gravatarHash(id.Email),
+		Groups:     groups,
+		PublicKeys: publicKeys,
+		SSHKeys:    id.ExtraInfo["sshkeys"],
+	}
+	if id.Owner != "" {
+		ownerIdentity := store.Identity{
+			ProviderID: id.Owner,
+		}
+		if err := h.params.Store.Identity(ctx, &ownerIdentity); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		u.Owner = params.Username(ownerIdentity.Username)
+	} else {
+		u.ExternalID = string(id.ProviderID)
+	}
+	if !id.LastLogin.IsZero() {
+		u.LastLogin = &id.LastLogin
+	}
+	if !id.LastDischarge.IsZero() {
+		u.LastDischarge = &id.LastDischarge
+	}
+	return &u, nil
+}
+
+// pageParams determines the limit and number of items to skip from the
+// limit and page token of a paginated request.
+func pageParams(limit int, token string) (int, int, error) {
+	switch {
+	case limit < 0:
+		return 0, 0, errgo.WithCausef(nil, params.ErrBadRequest, "invalid limit %d", limit)
+	case limit == 0:
+		limit = defaultLimit
+	case limit > maxLimit:
+		limit = maxLimit
+	}
+	if token == "" {
+		return limit, 0, nil
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, 0, errgo.WithCausef(nil, params.ErrBadRequest, "invalid page-token")
+	}
+	skip, err := strconv.Atoi(string(buf))
+	if err != nil || skip < 0 {
+		return 0, 0, errgo.WithCausef(nil, params.ErrBadRequest, "invalid page-token")
+	}
+	return limit, skip, nil
+}
+
+// pageToken returns the page token for the page starting at the given
+// offset.
+func pageToken(skip int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(skip)))
+}
+
+// checkIsMemberOf checks that the given identity is a member of all the
+// given groups.
+func checkIsMemberOf(ctx context.Context, identity *auth.Identity, groups []string) error {
+	if identity.Id() == auth.AdminUsername {
+		// Admin is a member of all groups by definition.
+		return nil
+	}
+	identityGroups, err := identity.Groups(ctx)
+	if err != nil {
+		return errgo.Notef(err, "cannot get groups for authenticated user")
+	}
+	for _, g := range groups {
+		found := false
+		for _, idg := range identityGroups {
+			if idg == g {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errgo.WithCausef(nil, params.ErrForbidden, "cannot add agent to groups that you are not a member of")
+		}
+	}
+	return nil
+}
+
+func translateStoreError(err error) error {
+	var cause error
+	switch errgo.Cause(err) {
+	case store.ErrNotFound:
+		cause = params.ErrNotFound
+	case store.ErrDuplicateUsername:
+		cause = params.ErrAlreadyExists
+	case store.ErrReadOnly:
+		cause = params.ErrServiceUnavailable
+	case nil:
+		return nil
+	}
+	err1 := errgo.WithCausef(err, cause, "").(*errgo.Err)
+	err1.SetLocation(1)
+	return err1
+}
+
+func newAgentName() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return fmt.Sprintf("a-%x", buf), nil
+}
+
+// gravatarHash calculates the gravatar hash based on the following
+// specification : https://en.gravatar.com/site/implement/hash
+func gravatarHash(s string) string {
+	if s == "" {
+		return ""
+	}
+	hasher := md5.New()
+	hasher.Write([]byte(strings.ToLower(strings.TrimSpace(s))))
+	return fmt.Sprintf("%x", hasher.Sum(nil))
+}
@@ -0,0 +1,296 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v2_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+	macaroon "gopkg.in/macaroon.v2"
+
+	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/idp/static"
+	"github.com/CanonicalLtd/candid/internal/auth"
+	"github.com/CanonicalLtd/candid/internal/candidtest"
+	"github.com/CanonicalLtd/candid/internal/discharger"
+	"github.com/CanonicalLtd/candid/internal/identity"
+	"github.com/CanonicalLtd/candid/internal/v2"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+func TestUsersAPI(t *testing.T) {
+	qtsuite.Run(qt.New(t), &usersSuite{})
+}
+
+type usersSuite struct {
+	store       *candidtest.Store
+	srv         *candidtest.Server
+	adminClient *httprequest.Client
+	interactor  httpbakery.WebBrowserInteractor
+}
+
+func (s *usersSuite) Init(c *qt.C) {
+	s.store = candidtest.NewStore()
+	sp := s.store.ServerParams()
+	sp.IdentityProviders = []idp.IdentityProvider{
+		static.NewIdentityProvider(static.Params{
+			Name: "test",
+			Users: map[string]static.UserInfo{
+				"bob": {
+					Password: "bobpassword",
+					Groups:   []string{"g1", "g2"},
+				},
+			},
+		}),
+	}
+	s.srv = candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v2":         v2.NewAPIHandler,
+	})
+	s.adminClient = &httprequest.Client{
+		BaseURL:        s.srv.URL,
+		Doer:           s.srv.AdminClient(),
+		UnmarshalError: unmarshalError,
+	}
+	s.interactor = httpbakery.WebBrowserInteractor{
+		OpenWebBrowser: candidtest.PasswordLogin(c, "bob", "bobpassword"),
+	}
+}
+
+func (s *usersSuite) TestListUsersPagination(c *qt.C) {
+	for i := 0; i < 5; i++ {
+		s.addUser(c, fmt.Sprintf("user%d", i), "g1")
+	}
+	var resp v2.ListUsersResponse
+	err := s.adminClient.Call(s.srv.Ctx, &v2.ListUsersRequest{Limit: 2}, &resp)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(usernames(resp.Users), qt.DeepEquals, []string{"user0", "user1"})
+	c.Assert(resp.NextPageToken, qt.Not(qt.Equals), "")
+
+	err = s.adminClient.Call(s.srv.Ctx, &v2.ListUsersRequest{Limit: 2, PageToken: resp.NextPageToken}, &resp)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(usernames(resp.Users), qt.DeepEquals, []string{"user2", "user3"})
+	c.Assert(resp.NextPageToken, qt.Not(qt.Equals), "")
+
+	var resp2 v2.ListUsersResponse
+	err = s.adminClient.Call(s.srv.Ctx, &v2.ListUsersRequest{Limit: 2, PageToken: resp.NextPageToken}, &resp2)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(usernames(resp2.Users), qt.DeepEquals, []string{"user4"})
+	c.Assert(resp2.NextPageToken, qt.Equals, "")
+	c.Assert(resp2.Users[0].Groups, qt.DeepEquals, []string{"g1"})
+}
+
+func (s *usersSuite) TestListUsersInvalidPageToken(c *qt.C) {
+	err := s.adminClient.Call(s.srv.Ctx, &v2.ListUsersRequest{PageToken: "!!!"}, nil)
+	c.Assert(err, qt.ErrorMatches, `Get http://.*/v2/users\?page-token=.*: invalid page-token`)
+}
+
+func (s *usersSuite) TestErrorEnvelope(c *qt.C) {
+	req, err := http.NewRequest("GET", s.srv.URL+"/v2/users/not-there", nil)
+	c.Assert(err, qt.Equals, nil)
+	resp, err := s.srv.AdminClient().Do(req)
+	c.Assert(err, qt.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusNotFound)
+	var body v2.ErrorResponse
+	err = httprequest.UnmarshalJSONResponse(resp, &body)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(body.Error, qt.DeepEquals, v2.Error{
+		Code:    params.ErrNotFound,
+		Message: "user not-there not found",
+	})
+}
+
+func (s *usersSuite) TestGroups(c *qt.C) {
+	s.addUser(c, "jbloggs", "g1")
+	err := s.adminClient.Call(s.srv.Ctx, &v2.ModifyGroupsRequest{
+		Username: "jbloggs",
+		Body: v2.ModifyGroupsBody{
+			Add:    []string{"g2", "g3"},
+			Remove: []string{"g1"},
+		},
+	}, nil)
+	c.Assert(err, qt.Equals, nil)
+	var groups v2.Groups
+	err = s.adminClient.Call(s.srv.Ctx, &v2.GroupsRequest{Username: "jbloggs"}, &groups)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups.Groups, qt.DeepEquals, []string{"g2", "g3"})
+
+	err = s.adminClient.Call(s.srv.Ctx, &v2.SetGroupsRequest{
+		Username: "jbloggs",
+		Body:     v2.Groups{Groups: []string{"g4"}},
+	}, nil)
+	c.Assert(err, qt.Equals, nil)
+	err = s.adminClient.Call(s.srv.Ctx, &v2.GroupsRequest{Username: "jbloggs"}, &groups)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups.Groups, qt.DeepEquals, []string{"g4"})
+}
+
+func (s *usersSuite) TestSSHKeys(c *qt.C) {
+	s.addUser(c, "jbloggs")
+	err := s.adminClient.Call(s.srv.Ctx, &v2.AddSSHKeysRequest{
+		Username: "jbloggs",
+		Body:     v2.SSHKeys{SSHKeys: []string{"key1", "key2"}},
+	}, nil)
+	c.Assert(err, qt.Equals, nil)
+	err = s.adminClient.Call(s.srv.Ctx, &v2.RemoveSSHKeysRequest{
+		Username: "jbloggs",
+		Body:     v2.SSHKeys{SSHKeys: []string{"key1"}},
+	}, nil)
+	c.Assert(err, qt.Equals, nil)
+	var keys v2.SSHKeys
+	err = s.adminClient.Call(s.srv.Ctx, &v2.SSHKeysRequest{Username: "jbloggs"}, &keys)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(keys.SSHKeys, qt.DeepEquals, []string{"key2"})
+}
+
+func (s *usersSuite) TestWhoAmI(c *qt.C) {
+	client := &httprequest.Client{
+		BaseURL:        s.srv.URL,
+		Doer:           s.srv.Client(s.interactor),
+		UnmarshalError: unmarshalError,
+	}
+	var resp v2.WhoAmIResponse
+	err := client.Call(s.srv.Ctx, &v2.WhoAmIRequest{}, &resp)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(resp.Username, qt.Equals, "bob")
+}
+
+func (s *usersSuite) TestDischargeToken(c *qt.C) {
+	s.addUser(c, "jbloggs")
+	var resp v2.DischargeTokenResponse
+	err := s.adminClient.Call(s.srv.Ctx, &v2.DischargeTokenRequest{Username: "jbloggs"}, &resp)
+	c.Assert(err, qt.Equals, nil)
+
+	var vresp v2.VerifyTokenResponse
+	err = s.adminClient.Call(s.srv.Ctx, &v2.VerifyTokenRequest{
+		Body: v2.VerifyTokenBody{
+			Macaroons: macaroon.Slice{resp.DischargeToken.M()},
+		},
+	}, &vresp)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(vresp.Declared, qt.DeepEquals, map[string]string{
+		"username": "jbloggs",
+	})
+}
+
+func (s *usersSuite) TestCreatePersonalAgent(c *qt.C) {
+	client := &httprequest.Client{
+		BaseURL:        s.srv.URL,
+		Doer:           s.srv.Client(s.interactor),
+		UnmarshalError: unmarshalError,
+	}
+	pk := bakery.MustGenerateKey().Public
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	var resp v2.CreatePersonalAgentResponse
+	err := client.Call(s.srv.Ctx, &v2.CreatePersonalAgentRequest{
+		Body: v2.CreatePersonalAgentBody{
+			FullName:   "ci job",
+			Groups:     []string{"g1"},
+			PublicKeys: []*bakery.PublicKey{&pk},
+			Expires:    expires,
+		},
+	}, &resp)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(resp.Expires.Equal(expires), qt.Equals, true)
+
+	var groups v2.Groups
+	err = s.adminClient.Call(s.srv.Ctx, &v2.GroupsRequest{Username: resp.Username}, &groups)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups.Groups, qt.DeepEquals, []string{"g1"})
+
+	// Once the agent has expired it is no longer a member of any
+	// groups.
+	err = s.store.Store.UpdateIdentity(s.srv.Ctx, &store.Identity{
+		Username: string(resp.Username),
+		ProviderInfo: map[string][]string{
+			auth.AgentExpiresInfo: {time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)},
+		},
+	}, store.Update{
+		store.ProviderInfo: store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = s.adminClient.Call(s.srv.Ctx, &v2.GroupsRequest{Username: resp.Username}, &groups)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(groups.Groups, qt.DeepEquals, []string{})
+}
+
+var createPersonalAgentErrorTests = []struct {
+	about       string
+	groups      []string
+	expires     time.Duration
+	expectError string
+}{{
+	about:       "expiry in the past",
+	expires:     -time.Hour,
+	expectError: `expiry time must be in the future`,
+}, {
+	about:       "expiry too far in the future",
+	expires:     v2.MaxPersonalAgentLifetime + time.Hour,
+	expectError: `expiry time must be within .*`,
+}, {
+	about:       "not a member of group",
+	groups:      []string{"g3"},
+	expires:     time.Hour,
+	expectError: `cannot add agent to groups that you are not a member of`,
+}}
+
+func (s *usersSuite) TestCreatePersonalAgentErrors(c *qt.C) {
+	client := &httprequest.Client{
+		BaseURL:        s.srv.URL,
+		Doer:           s.srv.Client(s.interactor),
+		UnmarshalError: unmarshalError,
+	}
+	pk := bakery.MustGenerateKey().Public
+	for _, test := range createPersonalAgentErrorTests {
+		c.Run(test.about, func(c *qt.C) {
+			err := client.Call(s.srv.Ctx, &v2.CreatePersonalAgentRequest{
+				Body: v2.CreatePersonalAgentBody{
+					Groups:     test.groups,
+					PublicKeys: []*bakery.PublicKey{&pk},
+					Expires:    time.Now().Add(test.expires),
+				},
+			}, nil)
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+		})
+	}
+}
+
+func (s *usersSuite) addUser(c *qt.C, username string, groups ...string) {
+	err := s.store.Store.UpdateIdentity(context.Background(), &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", username),
+		Username:   username,
+		Groups:     groups,
+	}, store.Update{
+		store.Username: store.Set,
+		store.Groups:   store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+}
+
+// unmarshalError unmarshals an error from a v2 error envelope.
+func unmarshalError(resp *http.Response) error {
+	var body v2.ErrorResponse
+	if err := httprequest.UnmarshalJSONResponse(resp, &body); err != nil {
+		return err
+	}
+	return &body.Error
+}
+
+func usernames(users []v2.User) []string {
+	names := make([]string, len(users))
+	for i, u := range users {
+		names[i] = string(u.Username)
+	}
+	return names
+}
@@ -0,0 +1,221 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package waitlimit limits the requests that wait for interactive
+// logins to complete. Each wait is given a deadline, the number of
+// concurrent waits for a single login is bounded, and clients whose
+// waits are rejected or time out are told how long to back off before
+// waiting again, with the delay doubling on each successive failure.
+package waitlimit
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+)
+
+const (
+	// ErrTooManyWaiters is the error code returned when a wait is
+	// rejected because too many requests are already waiting for
+	// the same login.
+	ErrTooManyWaiters params.ErrorCode = "too many waiters"
+
+	// ErrWaitTimeout is the error code returned when a wait times
+	// out before the login completes. The login may still complete,
+	// so the client should wait again after the delay given in the
+	// Retry-After header.
+	ErrWaitTimeout params.ErrorCode = "wait timeout"
+)
+
+// ErrTimeout is the error cause that the function passed to
+// Limiter.Wait should return when it times out.
+var ErrTimeout = errgo.New("wait timed out")
+
+const (
+	defaultRetryAfter    = time.Second
+	defaultMaxRetryAfter = time.Minute
+
+	// idleExpiry holds the length of time after which the state of
+	// a login that nobody is waiting for is forgotten.
+	idleExpiry = time.Hour
+
+	// maxLogins holds the number of logins above which the states
+	// of idle logins are checked for expiry.
+	maxLogins = 10000
+)
+
+// Params holds the configuration of a Limiter.
+type Params struct {
+	// Timeout holds the maximum time that a single request waits
+	// for a login to complete. If this is zero the wait is only
+	// limited by the rendezvous timeout.
+	Timeout time.Duration
+
+	// MaxWaiters holds the maximum number of requests that may
+	// wait for a single login at the same time. If this is zero the
+	// number is not limited.
+	MaxWaiters int
+
+	// RetryAfter holds the delay suggested to a client the first
+	// time its wait is rejected or times out. The delay doubles on
+	// each subsequent failure. If this is zero, one second is used.
+	RetryAfter time.Duration
+
+	// MaxRetryAfter holds the maximum delay suggested to a client.
+	// If this is zero, one minute is used.
+	MaxRetryAfter time.Duration
+}
+
+// A Limiter limits the requests that wait for logins.
+type Limiter struct {
+	p Params
+
+	mu     sync.Mutex
+	logins map[string]*login
+}
+
+// login holds the state of the waits for a single login.
+type login struct {
+	waiting  int
+	failures int
+	updated  time.Time
+}
+
+// New returns a new Limiter with the given parameters.
+func New(p Params) *Limiter {
+	if p.RetryAfter <= 0 {
+		p.RetryAfter = defaultRetryAfter
+	}
+	if p.MaxRetryAfter <= 0 {
+		p.MaxRetryAfter = defaultMaxRetryAfter
+	}
+	if p.MaxRetryAfter < p.RetryAfter {
+		p.MaxRetryAfter = p.RetryAfter
+	}
+	return &Limiter{
+		p:      p,
+		logins: make(map[string]*login),
+	}
+}
+
+// Wait calls f to wait for the login with the given id, passing it a
+// context that is done when the wait times out. If too many requests
+// are already waiting for the login, f is not called and an error with
+// a cause of type *Error is returned. If f returns an error with a
+// cause of ErrTimeout, or the wait times out, an error with a cause of
+// type *Error is also returned. Any other error from f is returned
+// unchanged.
+func (l *Limiter) Wait(ctx context.Context, id string, f func(ctx context.Context) error) error {
+	now := time.Now()
+	l.mu.Lock()
+	lg := l.logins[id]
+	if lg == nil {
+		l.removeIdle(now)
+		lg = new(login)
+		l.logins[id] = lg
+	}
+	lg.updated = now
+	if l.p.MaxWaiters > 0 && lg.waiting >= l.p.MaxWaiters {
+		retryAfter := l.fail(lg)
+		l.mu.Unlock()
+		return &Error{
+			Code:       ErrTooManyWaiters,
+			Message:    "too many requests waiting for login",
+			RetryAfter: retryAfter,
+		}
+	}
+	lg.waiting++
+	l.mu.Unlock()
+
+	waitCtx := ctx
+	if l.p.Timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, l.p.Timeout)
+		defer cancel()
+	}
+	err := f(waitCtx)
+	timedOut := errgo.Cause(err) == ErrTimeout || (err != nil && waitCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lg.waiting--
+	lg.updated = time.Now()
+	if timedOut {
+		return &Error{
+			Code:       ErrWaitTimeout,
+			Message:    "login not complete, wait again",
+			RetryAfter: l.fail(lg),
+		}
+	}
+	if lg.waiting == 0 {
+		// The login has completed or failed, so it won't be
+		// waited for again.
+		delete(l.logins, id)
+	}
+	return errgo.Mask(err, errgo.Any)
+}
+
+// fail records a failed wait for the given login and returns the delay
+// to suggest to the client. It must be called with l.mu held.
+func (l *Limiter) fail(lg *login) time.Duration {
+	d := l.p.RetryAfter
+	for i := 0; i < lg.failures && d < l.p.MaxRetryAfter; i++ {
+		d *= 2
+	}
+	if d > l.p.MaxRetryAfter {
+		d = l.p.MaxRetryAfter
+	}
+	lg.failures++
+	return d
+}
+
+// removeIdle removes the state of logins that have not been waited for
+// recently if there are many logins. It must be called with l.mu held.
+func (l *Limiter) removeIdle(now time.Time) {
+	if len(l.logins) < maxLogins {
+		return
+	}
+	for id, lg := range l.logins {
+		if lg.waiting == 0 && now.Sub(lg.updated) > idleExpiry {
+			delete(l.logins, id)
+		}
+	}
+}
+
+// Error is the type of the errors returned when a wait is rejected or
+// times out.
+type Error struct {
+	// Code holds the error code, either ErrTooManyWaiters or
+	// ErrWaitTimeout.
+	Code params.ErrorCode
+
+	// Message holds the error message.
+	Message string
+
+	// RetryAfter holds the length of time that the client should
+	// wait before trying again.
+	RetryAfter time.Duration
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ErrorCode returns the code used when the error is returned from the
+// API.
+func (e *Error) ErrorCode() params.ErrorCode {
+	return e.Code
+}
+
+// SetHeader implements httprequest.HeaderSetter by telling the client
+// when to retry.
+func (e *Error) SetHeader(h http.Header) {
+	secs := int64((e.RetryAfter + time.Second - 1) / time.Second)
+	h.Set("Retry-After", strconv.FormatInt(secs, 10))
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package waitlimit_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/internal/waitlimit"
+)
+
+func TestTooManyWaiters(t *testing.T) {
+	c := qt.New(t)
+	l := waitlimit.New(waitlimit.Params{
+		MaxWaiters: 1,
+		RetryAfter: 2 * time.Second,
+	})
+	release := make(chan struct{})
+	done := make(chan error)
+	started := make(chan struct{})
+	go func() {
+		done <- l.Wait(context.Background(), "id", func(context.Context) error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	err := l.Wait(context.Background(), "id", func(context.Context) error {
+		c.Fatalf("unexpected call")
+		return nil
+	})
+	werr, ok := errgo.Cause(err).(*waitlimit.Error)
+	c.Assert(ok, qt.Equals, true, qt.Commentf("%#v", err))
+	c.Assert(werr.Code, qt.Equals, waitlimit.ErrTooManyWaiters)
+	c.Assert(werr.RetryAfter, qt.Equals, 2*time.Second)
+	h := make(http.Header)
+	werr.SetHeader(h)
+	c.Assert(h.Get("Retry-After"), qt.Equals, "2")
+
+	// Waits for other logins are not affected.
+	err = l.Wait(context.Background(), "other", func(context.Context) error {
+		return nil
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	close(release)
+	c.Assert(<-done, qt.Equals, nil)
+}
+
+func TestTimeout(t *testing.T) {
+	c := qt.New(t)
+	l := waitlimit.New(waitlimit.Params{
+		Timeout:       time.Millisecond,
+		RetryAfter:    time.Second,
+		MaxRetryAfter: 3 * time.Second,
+	})
+	wait := func(context.Context) error {
+		return errgo.WithCausef(nil, waitlimit.ErrTimeout, "")
+	}
+	for _, expect := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		err := l.Wait(context.Background(), "id", wait)
+		werr, ok := errgo.Cause(err).(*waitlimit.Error)
+		c.Assert(ok, qt.Equals, true, qt.Commentf("%#v", err))
+		c.Assert(werr.Code, qt.Equals, waitlimit.ErrWaitTimeout)
+		c.Assert(werr.RetryAfter, qt.Equals, expect)
+	}
+
+	// A wait that returns an error when its context times out is
+	// also treated as a timeout.
+	err := l.Wait(context.Background(), "id2", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	werr, ok := errgo.Cause(err).(*waitlimit.Error)
+	c.Assert(ok, qt.Equals, true, qt.Commentf("%#v", err))
+	c.Assert(werr.Code, qt.Equals, waitlimit.ErrWaitTimeout)
+	c.Assert(werr.RetryAfter, qt.Equals, time.Second)
+}
+
+func TestStateRemovedAfterCompletion(t *testing.T) {
+	c := qt.New(t)
+	l := waitlimit.New(waitlimit.Params{})
+	timeout := func(context.Context) error {
+		return errgo.WithCausef(nil, waitlimit.ErrTimeout, "")
+	}
+	err := l.Wait(context.Background(), "id", timeout)
+	c.Assert(errgo.Cause(err).(*waitlimit.Error).RetryAfter, qt.Equals, time.Second)
+	err = l.Wait(context.Background(), "id", timeout)
+	c.Assert(errgo.Cause(err).(*waitlimit.Error).RetryAfter, qt.Equals, 2*time.Second)
+
+	// Other errors are returned unchanged.
+	testErr := errgo.New("test error")
+	err = l.Wait(context.Background(), "id", func(context.Context) error {
+		return testErr
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, testErr)
+
+	// The login has completed, so its failures are forgotten.
+	err = l.Wait(context.Background(), "id", timeout)
+	c.Assert(errgo.Cause(err).(*waitlimit.Error).RetryAfter, qt.Equals, time.Second)
+}
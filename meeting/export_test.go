@@ -13,4 +13,12 @@ func ItemCount(p *Place) int {
 var (
 	ReallyOldExpiryDuration = &reallyOldExpiryDuration
 	RunGC                   = (*Place).runGC
+	RunHeartbeat            = (*Place).runHeartbeat
+	Signature               = signature
+	CheckSignature          = checkSignature
 )
+
+// LocalAddr returns the address that other places use to contact p.
+func LocalAddr(p *Place) string {
+	return p.localAddr
+}
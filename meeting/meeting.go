@@ -7,6 +7,7 @@ package meeting
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 	"net/http"
 	"sync"
@@ -25,6 +26,27 @@ import (
 
 var logger = loggo.GetLogger("candid.meeting")
 
+// ErrDraining is the error cause returned by NewRendezvous when the
+// place is being drained.
+var ErrDraining = errgo.New("meeting place is draining")
+
+// ErrExpired is the error cause returned by Wait when the rendezvous
+// has been removed by the garbage collector.
+var ErrExpired = errgo.New("rendezvous expired")
+
+// ErrTimeout is the error cause returned by Wait when the wait timeout
+// passes before the rendezvous is complete. The rendezvous may still
+// be completed, so the client may wait again.
+var ErrTimeout = errgo.New("rendezvous wait timed out")
+
+// expiredCode holds the error code used to report ErrExpired in
+// requests between places.
+const expiredCode = "rendezvous expired"
+
+// timeoutCode holds the error code used to report ErrTimeout in
+// requests between places.
+const timeoutCode = "rendezvous wait timed out"
+
 var (
 	// pollInterval holds the interval at which the
 	// garbage collector goroutine polls for expired
@@ -48,6 +70,21 @@ var (
 	// without removing its existing entries.
 	reallyOldExpiryDuration = 7 * 24 * time.Hour
 
+	// defaultHeartbeatInterval holds the default interval at which
+	// replicas record that they are alive when discovery is
+	// enabled.
+	defaultHeartbeatInterval = 10 * time.Second
+
+	// deadHeartbeats holds the number of heartbeat intervals after
+	// which a replica that has not recorded that it is alive is
+	// considered dead.
+	deadHeartbeats = 3
+
+	// defaultPollInterval holds the default interval at which
+	// waiting places check the store for completed rendezvous
+	// when polling is enabled.
+	defaultPollInterval = time.Second
+
 	// Clock holds the clock implementation used by the meeting package.
 	// This is exported so it can be changed for testing purposes.
 	Clock clock.Clock = clock.WallClock
@@ -87,19 +124,128 @@ type Store interface {
 	RemoveOld(ctx context.Context, address string, olderThan time.Time) (ids []string, err error)
 }
 
+// A ReplicaStore is a Store that also records which replicas of the
+// identity server are running, so that the rendezvous held by replicas
+// that have stopped without cleaning up can be removed promptly.
+type ReplicaStore interface {
+	Store
+
+	// Heartbeat records that the replica with the given address was
+	// alive at the given time.
+	Heartbeat(ctx context.Context, address string, now time.Time) error
+
+	// RemoveReplica removes the record of the replica with the given
+	// address. It should not return an error if there is no such
+	// record.
+	RemoveReplica(ctx context.Context, address string) error
+
+	// RemoveDeadReplicas removes the records of replicas whose last
+	// heartbeat was earlier than the given time and returns their
+	// addresses.
+	RemoveDeadReplicas(ctx context.Context, olderThan time.Time) (addresses []string, err error)
+}
+
+// DiscoveryParams holds the configuration of the discovery of other
+// places through the store.
+type DiscoveryParams struct {
+	// Enabled holds whether the place records that it is alive in
+	// the store, and removes the rendezvous held by places that
+	// have stopped doing so. If it is set, the store must implement
+	// ReplicaStore.
+	Enabled bool
+
+	// AdvertiseAddr holds the host name that other servers use to
+	// contact this one. This should not have a port number. If it
+	// is empty, ListenAddr is used, unless that is empty or
+	// unspecified, in which case the address of the first
+	// non-loopback network interface is used.
+	AdvertiseAddr string
+
+	// HeartbeatInterval holds the interval at which the place
+	// records that it is alive. A place is considered dead when it
+	// has not done so for three intervals. If it is zero, a default
+	// interval is used.
+	HeartbeatInterval time.Duration
+}
+
+// A PollStore is a Store that also holds the data for each rendezvous,
+// so that places that cannot contact one another directly can complete
+// rendezvous through the store.
+type PollStore interface {
+	Store
+
+	// PutData is like Put except that it also stores the data
+	// provided to NewRendezvous, so that any place can return it
+	// from Wait.
+	PutData(ctx context.Context, id, address string, data0 []byte) error
+
+	// Complete records that the rendezvous with the given id is
+	// done, holding the given data. It returns an error if there
+	// is no such rendezvous or it has already been completed.
+	Complete(ctx context.Context, id string, data1 []byte) error
+
+	// GetData returns the data for the rendezvous with the given
+	// id and whether it has been completed. If it has not been
+	// completed, data1 is nil.
+	GetData(ctx context.Context, id string) (data0, data1 []byte, complete bool, err error)
+}
+
+// A Notifier is a PollStore that can tell places when rendezvous are
+// completed, so that waiting places need not rely on polling the store.
+type Notifier interface {
+	PollStore
+
+	// Notify sends the ids of rendezvous completed by any place on
+	// the given channel until the context is done. It must not
+	// block sending on the channel once the context is done.
+	Notify(ctx context.Context, ids chan<- string) error
+}
+
+// PollParams holds the configuration of the completion of rendezvous
+// through the store rather than by places contacting one another.
+type PollParams struct {
+	// Enabled holds whether rendezvous are completed through the
+	// store. If it is set, the store must implement PollStore.
+	Enabled bool
+
+	// Interval holds the interval at which waiting places check
+	// the store for completed rendezvous. If the store implements
+	// Notifier, this is only a fallback for missed notifications.
+	// If it is zero, a default interval is used.
+	Interval time.Duration
+}
+
 // Place represents a rendezvous place.
 type Place struct {
-	tomb           tomb.Tomb
-	store          Store
-	localAddr      string
-	listener       net.Listener
-	handler        *handler
-	metrics        Metrics
-	waitTimeout    time.Duration
-	expiryDuration time.Duration
+	tomb              tomb.Tomb
+	store             Store
+	replicas          ReplicaStore
+	heartbeatInterval time.Duration
+	localAddr         string
+	listener          net.Listener
+	handler           *handler
+	metrics           Metrics
+	waitTimeout       time.Duration
+	expiryDuration    time.Duration
+	gcInterval        time.Duration
+	polls             PollStore
+	notifier          Notifier
+	pollInterval      time.Duration
+	rpc               RPCParams
+	doer              httprequest.Doer
 
-	mu    sync.Mutex
-	items map[string]*item
+	mu       sync.Mutex
+	items    map[string]*item
+	draining bool
+	// expired holds the time at which each rendezvous recently
+	// removed by the garbage collector was removed.
+	expired map[string]time.Time
+	// waiters holds a channel for each rendezvous being waited
+	// for when polling, which is closed when the rendezvous may
+	// have been completed.
+	waiters map[string]chan struct{}
+	// idle, if not nil, is closed when there are no items left.
+	idle chan struct{}
 }
 
 type item struct {
@@ -121,6 +267,11 @@ type Metrics interface {
 	// have been garbage collected with the number
 	// of GC'd requests.
 	RequestsExpired(count int)
+
+	// RequestsAbandoned is called when some requests held by
+	// places that stopped without removing them have been garbage
+	// collected, with the number of GC'd requests.
+	RequestsAbandoned(count int)
 }
 
 // Params holds parameters for the NewServer function.
@@ -135,9 +286,23 @@ type Params struct {
 	// ListenAddr holds the host name to listen on. This
 	// should not have a port number.
 	// Note that ListenAddr must also be sufficient for other
-	// servers to use to contact this one.
+	// servers to use to contact this one, unless
+	// Discovery.AdvertiseAddr is set. If it is empty, all
+	// interfaces are listened on.
 	ListenAddr string
 
+	// Discovery holds the configuration of the discovery of other
+	// places through the store.
+	Discovery DiscoveryParams
+
+	// Poll holds the configuration of the completion of rendezvous
+	// through the store.
+	Poll PollParams
+
+	// RPC holds the configuration of the security of the requests
+	// that places make to one another.
+	RPC RPCParams
+
 	// DisableGC holds whether the garbage collector is disabled.
 	DisableGC bool
 
@@ -150,15 +315,50 @@ type Params struct {
 	// a rendezvous will be kept around for. If it is zero, a default
 	// duration will be used.
 	ExpiryDuration time.Duration
+
+	// GCInterval holds the interval at which the garbage collector
+	// removes expired rendezvous. If it is zero, a default interval
+	// will be used.
+	GCInterval time.Duration
 }
 
 // NewServer returns a new rendezvous place using the given
 // parameters.
 func NewPlace(params Params) (*Place, error) {
+	var replicas ReplicaStore
+	if params.Discovery.Enabled {
+		var ok bool
+		replicas, ok = params.Store.(ReplicaStore)
+		if !ok {
+			return nil, errgo.Newf("store does not support replica discovery")
+		}
+	}
+	if err := params.RPC.validate(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var polls PollStore
+	if params.Poll.Enabled {
+		var ok bool
+		polls, ok = params.Store.(PollStore)
+		if !ok {
+			return nil, errgo.Newf("store does not support polling")
+		}
+	}
+	if params.Poll.Interval == 0 {
+		params.Poll.Interval = defaultPollInterval
+	}
+	if params.Discovery.HeartbeatInterval == 0 {
+		params.Discovery.HeartbeatInterval = defaultHeartbeatInterval
+	}
 	listener, err := net.Listen("tcp", net.JoinHostPort(params.ListenAddr, "0"))
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot start listener")
 	}
+	localAddr, err := advertisedAddr(params, listener.Addr())
+	if err != nil {
+		listener.Close()
+		return nil, errgo.Mask(err)
+	}
 	if params.Metrics == nil {
 		params.Metrics = noMetrics{}
 	}
@@ -168,14 +368,29 @@ func NewPlace(params Params) (*Place, error) {
 	if params.ExpiryDuration == 0 {
 		params.ExpiryDuration = defaultExpiryDuration
 	}
+	if params.GCInterval == 0 {
+		params.GCInterval = pollInterval
+	}
 	p := &Place{
-		store:          params.Store,
-		listener:       listener,
-		localAddr:      listener.Addr().String(),
-		items:          make(map[string]*item),
-		metrics:        params.Metrics,
-		waitTimeout:    params.WaitTimeout,
-		expiryDuration: params.ExpiryDuration,
+		store:             params.Store,
+		replicas:          replicas,
+		heartbeatInterval: params.Discovery.HeartbeatInterval,
+		listener:          listener,
+		localAddr:         localAddr,
+		items:             make(map[string]*item),
+		metrics:           params.Metrics,
+		waitTimeout:       params.WaitTimeout,
+		expiryDuration:    params.ExpiryDuration,
+		gcInterval:        params.GCInterval,
+		expired:           make(map[string]time.Time),
+		polls:             polls,
+		pollInterval:      params.Poll.Interval,
+		waiters:           make(map[string]chan struct{}),
+		rpc:               params.RPC,
+		doer:              newDoer(params.RPC),
+	}
+	if n, ok := polls.(Notifier); ok {
+		p.notifier = n
 	}
 	p.handler = &handler{
 		place: p,
@@ -184,16 +399,96 @@ func NewPlace(params Params) (*Place, error) {
 	for _, h := range reqServer.Handlers(p.newHandler) {
 		router.Handle(h.Method, h.Path, h.Handle)
 	}
+	var handler http.Handler = router
+	if len(params.RPC.Secret) > 0 {
+		handler = authHandler(params.RPC.Secret, handler)
+	}
+	serveListener := p.listener
+	if params.RPC.ServerTLSConfig != nil {
+		serveListener = tls.NewListener(serveListener, params.RPC.ServerTLSConfig)
+	}
 	if !params.DisableGC {
 		p.tomb.Go(p.gc)
 	}
+	if p.replicas != nil {
+		p.tomb.Go(p.heartbeat)
+	}
+	if p.notifier != nil {
+		p.tomb.Go(p.notifyLoop)
+	}
 	p.tomb.Go(func() error {
-		http.Serve(p.listener, router)
+		http.Serve(serveListener, handler)
 		return nil
 	})
 	return p, nil
 }
 
+// CheckHealth checks that the rendezvous place is running and that its
+// listener, used by other identity servers to complete rendezvous, is
+// accepting connections.
+func (p *Place) CheckHealth(ctx context.Context) error {
+	if !p.tomb.Alive() {
+		return errgo.Newf("meeting place is not running")
+	}
+	p.mu.Lock()
+	draining := p.draining
+	p.mu.Unlock()
+	if draining {
+		return ErrDraining
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.listener.Addr().String())
+	if err != nil {
+		return errgo.Notef(err, "cannot connect to meeting place listener")
+	}
+	conn.Close()
+	return nil
+}
+
+// Drain stops the place from accepting new rendezvous and waits for
+// the rendezvous already in progress to complete, so that the place
+// can be closed without failing logins that are part way through. The
+// listener used by other identity servers remains open while draining,
+// so rendezvous that complete on other servers are delivered here.
+//
+// If the context is done before all rendezvous have completed, Drain
+// returns an error; any remaining rendezvous fail when the place is
+// closed.
+func (p *Place) Drain(ctx context.Context) error {
+	p.mu.Lock()
+	p.draining = true
+	if len(p.items) == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	if p.idle == nil {
+		p.idle = make(chan struct{})
+	}
+	idle := p.idle
+	n := len(p.items)
+	p.mu.Unlock()
+	logger.Infof("waiting for %d rendezvous to complete", n)
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		n := len(p.items)
+		p.mu.Unlock()
+		return errgo.Notef(ctx.Err(), "%d rendezvous still in progress", n)
+	}
+}
+
+// delete removes the item with the given id, notifying any Drain call
+// if no items remain. It must be called with p.mu held.
+func (p *Place) delete(id string) {
+	delete(p.items, id)
+	if len(p.items) == 0 && p.idle != nil {
+		close(p.idle)
+		p.idle = nil
+	}
+}
+
 // Close shuts down the rendezvous place.
 func (p *Place) Close() {
 	p.listener.Close()
@@ -218,31 +513,100 @@ func (p *Place) gc() error {
 		// so we are always guaranteed a GC when the server starts
 		// up.
 		select {
-		case <-Clock.After(pollInterval):
+		case <-Clock.After(p.gcInterval):
 		case <-p.tomb.Dying():
 			dying = true
 		}
 	}
 }
 
+// heartbeat records that the place is alive at regular intervals and
+// removes the rendezvous held by places that are not.
+func (p *Place) heartbeat() error {
+	for {
+		ctx, close := p.replicas.Context(context.Background())
+		err := p.runHeartbeat(ctx, Clock.Now())
+		close()
+		if err != nil {
+			logger.Errorf("meeting heartbeat: %v", err)
+		}
+		select {
+		case <-Clock.After(p.heartbeatInterval):
+		case <-p.tomb.Dying():
+			ctx, close := p.replicas.Context(context.Background())
+			defer close()
+			if err := p.replicas.RemoveReplica(ctx, p.localAddr); err != nil {
+				logger.Errorf("cannot remove replica %q: %v", p.localAddr, err)
+			}
+			return nil
+		}
+	}
+}
+
+// runHeartbeat records that the place is alive at the given time and
+// removes the rendezvous held by any places that are dead.
+func (p *Place) runHeartbeat(ctx context.Context, now time.Time) error {
+	if err := p.replicas.Heartbeat(ctx, p.localAddr, now); err != nil {
+		return errgo.Notef(err, "cannot record heartbeat")
+	}
+	dead, err := p.replicas.RemoveDeadReplicas(ctx, now.Add(-time.Duration(deadHeartbeats)*p.heartbeatInterval))
+	if err != nil {
+		return errgo.Notef(err, "cannot remove dead replicas")
+	}
+	if p.polls != nil {
+		// The rendezvous held by dead places can still be
+		// completed through the store.
+		return nil
+	}
+	for _, addr := range dead {
+		if addr == p.localAddr {
+			continue
+		}
+		logger.Infof("removing rendezvous held by dead replica %q", addr)
+		// A little bit in the future so that we're sure to find
+		// all entries.
+		ids, err := p.replicas.RemoveOld(ctx, addr, now.Add(time.Millisecond))
+		if len(ids) > 0 {
+			p.setExpired(ids, now)
+			p.metrics.RequestsAbandoned(len(ids))
+		}
+		if err != nil {
+			return errgo.Notef(err, "cannot remove entries for %q", addr)
+		}
+	}
+	return nil
+}
+
 // runGC runs a single garbage collection at the given time.
 // If dying is true, it removes all entries in the server.
 func (p *Place) runGC(ctx context.Context, dying bool, now time.Time) error {
 	var expiryTime time.Time
-	if dying {
+	addr := p.localAddr
+	switch {
+	case p.polls != nil:
+		// The rendezvous are held in the store, so they can
+		// be completed by any place and don't need to be
+		// removed when this place shuts down, but this place
+		// might not be around to expire them when they're
+		// old.
+		addr = ""
+		expiryTime = now.Add(-p.expiryDuration)
+	case dying:
 		// A little bit in the future so that we're sure to
 		// find all entries.
 		expiryTime = now.Add(time.Millisecond)
-	} else {
+	default:
 		expiryTime = now.Add(-p.expiryDuration)
 	}
-	ids, err := p.store.RemoveOld(ctx, p.localAddr, expiryTime)
+	p.pruneExpired(now)
+	ids, err := p.store.RemoveOld(ctx, addr, expiryTime)
 	if len(ids) > 0 {
 		p.mu.Lock()
 		for _, id := range ids {
-			delete(p.items, id)
+			p.delete(id)
 		}
 		p.mu.Unlock()
+		p.setExpired(ids, now)
 		p.metrics.RequestsExpired(len(ids))
 	}
 	if err != nil {
@@ -253,11 +617,53 @@ func (p *Place) runGC(ctx context.Context, dying bool, now time.Time) error {
 		return errgo.Notef(err, "cannot remove really old entries")
 	}
 	if len(ids) > 0 {
-		p.metrics.RequestsExpired(len(ids))
+		p.setExpired(ids, now)
+		p.metrics.RequestsAbandoned(len(ids))
 	}
 	return nil
 }
 
+// setExpired records that the rendezvous with the given ids were
+// removed by the garbage collector at the given time.
+func (p *Place) setExpired(ids []string, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, id := range ids {
+		p.expired[id] = now
+	}
+}
+
+// pruneExpired forgets rendezvous removed by the garbage collector
+// more than the expiry duration before the given time, by which time
+// any client should have stopped waiting for them.
+func (p *Place) pruneExpired(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, t := range p.expired {
+		if t.Before(now.Add(-p.expiryDuration)) {
+			delete(p.expired, id)
+		}
+	}
+}
+
+// isExpired reports whether the rendezvous with the given id was
+// recently removed by the garbage collector.
+func (p *Place) isExpired(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.expired[id]
+	return ok
+}
+
+// notFoundError returns the error returned when the rendezvous with
+// the given id cannot be found.
+func (p *Place) notFoundError(id string) error {
+	if p.isExpired(id) {
+		return errgo.WithCausef(nil, ErrExpired, "rendezvous %q expired", id)
+	}
+	return errgo.Newf("rendezvous %q not found", id)
+}
+
 // localWait is the internal version of Place.Wait.
 // It only works if the given id is stored locally.
 func (p *Place) localWait(ctx context.Context, id string) (data0, data1 []byte, err error) {
@@ -266,7 +672,7 @@ func (p *Place) localWait(ctx context.Context, id string) (data0, data1 []byte,
 	item := p.items[id]
 	p.mu.Unlock()
 	if item == nil {
-		return nil, nil, errgo.Newf("rendezvous %q not found", id)
+		return nil, nil, p.notFoundError(id)
 	}
 	now := Clock.Now()
 	expiryDeadline := item.created.Add(p.expiryDuration)
@@ -295,18 +701,25 @@ func (p *Place) localWait(ctx context.Context, id string) (data0, data1 []byte,
 		defer close()
 		p.mu.Lock()
 		defer p.mu.Unlock()
-		delete(p.items, id)
+		p.delete(id)
 		_, err := p.store.Remove(ctx, id)
 		if err != nil {
 			logger.Errorf("cannot remove rendezvous %q: %v", id, err)
 		}
 		removed = true
+		if expiredErr != nil {
+			p.expired[id] = Clock.Now()
+			p.metrics.RequestsExpired(1)
+		}
 	}
 	if expiredErr != nil {
 		if removed {
-			return nil, nil, errgo.Newf("rendezvous expired after %v", p.expiryDuration)
+			return nil, nil, errgo.WithCausef(nil, ErrExpired, "rendezvous expired after %v", p.expiryDuration)
+		}
+		if expiredErr == context.DeadlineExceeded {
+			return nil, nil, errgo.WithCausef(nil, ErrTimeout, "rendezvous wait timed out")
 		}
-		return nil, nil, errgo.Notef(err, "rendezvous wait timed out")
+		return nil, nil, errgo.Notef(expiredErr, "rendezvous wait abandoned")
 	}
 	// TODO what do we actually want RequestCompleted to signify?
 	p.metrics.RequestCompleted(item.created)
@@ -345,6 +758,18 @@ func (p *Place) newHandler(params httprequest.Params) (*handler, context.Context
 
 var reqServer = httprequest.Server{
 	ErrorMapper: func(ctx context.Context, err error) (httpStatus int, errorBody interface{}) {
+		if errgo.Cause(err) == ErrExpired {
+			return http.StatusGone, &httprequest.RemoteError{
+				Message: err.Error(),
+				Code:    expiredCode,
+			}
+		}
+		if errgo.Cause(err) == ErrTimeout {
+			return http.StatusRequestTimeout, &httprequest.RemoteError{
+				Message: err.Error(),
+				Code:    timeoutCode,
+			}
+		}
 		return http.StatusInternalServerError, &httprequest.RemoteError{
 			Message: err.Error(),
 		}
@@ -355,6 +780,19 @@ var reqServer = httprequest.Server{
 // the given data. The rendezvous id is returned.
 func (p *Place) NewRendezvous(ctx context.Context, id string, data []byte) error {
 	p.mu.Lock()
+	if p.draining {
+		p.mu.Unlock()
+		return errgo.WithCausef(nil, ErrDraining, "cannot create rendezvous")
+	}
+	if p.polls != nil {
+		// When polling, the rendezvous is held only in the
+		// store so that it can be completed by any place.
+		p.mu.Unlock()
+		if err := p.polls.PutData(ctx, id, p.localAddr, data); err != nil {
+			return errgo.Notef(err, "cannot create entry for rendezvous")
+		}
+		return nil
+	}
 	p.items[id] = &item{
 		created: Clock.Now(),
 		c:       make(chan struct{}),
@@ -364,7 +802,7 @@ func (p *Place) NewRendezvous(ctx context.Context, id string, data []byte) error
 	if err := p.store.Put(ctx, id, p.localAddr); err != nil {
 		p.mu.Lock()
 		defer p.mu.Unlock()
-		delete(p.items, id)
+		p.delete(id)
 		return errgo.Notef(err, "cannot create entry for rendezvous")
 	}
 	return nil
@@ -375,10 +813,16 @@ func (p *Place) NewRendezvous(ctx context.Context, id string, data []byte) error
 // and the data provided to Done.
 func (p *Place) Wait(ctx context.Context, id string) (data0, data1 []byte, err error) {
 	logger.Infof("Wait %q", id)
+	if p.polls != nil {
+		return p.pollWait(ctx, id)
+	}
 	if p.isLocal(id) {
 		return p.localWait(ctx, id)
 	}
 	logger.Infof("not local wait")
+	if p.isExpired(id) {
+		return nil, nil, p.notFoundError(id)
+	}
 	client, err := p.clientForId(ctx, id)
 	if err != nil {
 		return nil, nil, errgo.Mask(err)
@@ -387,6 +831,14 @@ func (p *Place) Wait(ctx context.Context, id string) (data0, data1 []byte, err e
 		Id: id,
 	})
 	if err != nil {
+		if re, ok := errgo.Cause(err).(*httprequest.RemoteError); ok {
+			switch re.Code {
+			case expiredCode:
+				return nil, nil, errgo.WithCausef(err, ErrExpired, "")
+			case timeoutCode:
+				return nil, nil, errgo.WithCausef(err, ErrTimeout, "")
+			}
+		}
 		return nil, nil, errgo.Mask(err)
 	}
 	return resp.Data0, resp.Data1, nil
@@ -396,6 +848,13 @@ func (p *Place) Wait(ctx context.Context, id string) (data0, data1 []byte, err e
 // and provides it with the given data which will be
 // returned from Wait.
 func (p *Place) Done(ctx context.Context, id string, data []byte) error {
+	if p.polls != nil {
+		if err := p.polls.Complete(ctx, id, data); err != nil {
+			return errgo.Mask(err)
+		}
+		p.notify(id)
+		return nil
+	}
 	if p.isLocal(id) {
 		return p.localDone(id, data)
 	}
@@ -414,6 +873,104 @@ func (p *Place) Done(ctx context.Context, id string, data []byte) error {
 	return nil
 }
 
+// pollWait is the version of Place.Wait used when rendezvous are
+// completed through the store.
+func (p *Place) pollWait(ctx context.Context, id string) (data0, data1 []byte, err error) {
+	ctx, cancel := utils.ContextWithTimeout(ctx, Clock, p.waitTimeout)
+	defer cancel()
+	for {
+		// Register the waiter before checking the store so that
+		// we can't miss a notification.
+		c := p.waiter(id)
+		var complete bool
+		data0, data1, complete, err = p.polls.GetData(ctx, id)
+		if err != nil {
+			p.notify(id)
+			if p.isExpired(id) {
+				return nil, nil, p.notFoundError(id)
+			}
+			return nil, nil, errgo.Mask(err)
+		}
+		if complete {
+			break
+		}
+		select {
+		case <-c:
+		case <-Clock.After(p.pollInterval):
+		case <-ctx.Done():
+			p.notify(id)
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, nil, errgo.WithCausef(nil, ErrTimeout, "rendezvous wait timed out")
+			}
+			return nil, nil, errgo.Notef(ctx.Err(), "rendezvous wait abandoned")
+		}
+	}
+	created, err := p.store.Remove(ctx, id)
+	if err != nil {
+		logger.Errorf("cannot remove rendezvous %q: %v", id, err)
+	}
+	if !created.IsZero() {
+		p.metrics.RequestCompleted(created)
+	}
+	return data0, data1, nil
+}
+
+// waiter returns a channel that is closed when the rendezvous with the
+// given id may have been completed.
+func (p *Place) waiter(id string) <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c := p.waiters[id]
+	if c == nil {
+		c = make(chan struct{})
+		p.waiters[id] = c
+	}
+	return c
+}
+
+// notify wakes any waiters for the rendezvous with the given id.
+func (p *Place) notify(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c := p.waiters[id]; c != nil {
+		close(c)
+		delete(p.waiters, id)
+	}
+}
+
+// notifyLoop wakes waiters when the store reports that rendezvous have
+// been completed.
+func (p *Place) notifyLoop() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ids := make(chan string)
+	for {
+		done := make(chan error, 1)
+		go func() {
+			done <- p.notifier.Notify(ctx, ids)
+		}()
+	loop:
+		for {
+			select {
+			case id := <-ids:
+				p.notify(id)
+			case err := <-done:
+				logger.Errorf("meeting notifications: %v", err)
+				break loop
+			case <-p.tomb.Dying():
+				cancel()
+				<-done
+				return nil
+			}
+		}
+		select {
+		case <-Clock.After(p.pollInterval):
+		case <-p.tomb.Dying():
+			return nil
+		}
+	}
+}
+
 func (p *Place) clientForId(ctx context.Context, id string) (*client, error) {
 	addr, err := p.store.Get(ctx, id)
 	if err != nil {
@@ -421,14 +978,64 @@ func (p *Place) clientForId(ctx context.Context, id string) (*client, error) {
 	}
 	return &client{
 		Client: httprequest.Client{
-			BaseURL: "http://" + addr,
+			BaseURL: p.rpc.scheme() + "://" + addr,
+			Doer:    p.doer,
 		},
 	}, nil
 }
 
+// advertisedAddr returns the address that other servers should use to
+// contact a place with the given parameters listening on the given
+// address.
+func advertisedAddr(params Params, listenAddr net.Addr) (string, error) {
+	_, port, err := net.SplitHostPort(listenAddr.String())
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	host := params.Discovery.AdvertiseAddr
+	if host == "" {
+		if ip := net.ParseIP(params.ListenAddr); params.ListenAddr != "" && (ip == nil || !ip.IsUnspecified()) {
+			return listenAddr.String(), nil
+		}
+		host, err = interfaceAddr()
+		if err != nil {
+			return "", errgo.Mask(err)
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// interfaceAddr returns the address of the first non-loopback network
+// interface, preferring IPv4 addresses.
+func interfaceAddr() (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", errgo.Notef(err, "cannot get interface addresses")
+	}
+	var ipv6 string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP.String(), nil
+		}
+		if ipv6 == "" {
+			ipv6 = ipnet.IP.String()
+		}
+	}
+	if ipv6 == "" {
+		return "", errgo.Newf("no address found to advertise")
+	}
+	return ipv6, nil
+}
+
 // noMetrics implements Metrics by doing nothing.
 type noMetrics struct{}
 
 func (noMetrics) RequestCompleted(startTime time.Time) {}
 
 func (noMetrics) RequestsExpired(count int) {}
+
+func (noMetrics) RequestsAbandoned(count int) {}
@@ -6,7 +6,11 @@ package meeting_test
 import (
 	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -34,6 +38,7 @@ type nilMetrics struct{}
 
 func (nilMetrics) RequestCompleted(startTime time.Time) {}
 func (nilMetrics) RequestsExpired(count int)            {}
+func (nilMetrics) RequestsAbandoned(count int)          {}
 
 func TestRendezvousWaitBeforeDone(t *testing.T) {
 	c := qt.New(t)
@@ -193,6 +198,144 @@ func TestRendezvousDifferentPlaces(t *testing.T) {
 	c.Assert(atomic.LoadInt32(&count), qt.Equals, int32(0))
 }
 
+func TestRPCSecurity(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	// Use the test certificate from httptest, which is valid for
+	// 127.0.0.1.
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	srv.Close()
+	serverTLS := srv.TLS
+	clientTLS := srv.Client().Transport.(*http.Transport).TLSClientConfig
+
+	tests := []struct {
+		about       string
+		rpc1        meeting.RPCParams
+		rpc2        meeting.RPCParams
+		expectError string
+	}{{
+		about: "shared secret",
+		rpc1: meeting.RPCParams{
+			Secret: []byte("secret"),
+		},
+		rpc2: meeting.RPCParams{
+			Secret: []byte("secret"),
+		},
+	}, {
+		about: "wrong secret",
+		rpc1: meeting.RPCParams{
+			Secret: []byte("secret"),
+		},
+		rpc2: meeting.RPCParams{
+			Secret: []byte("other secret"),
+		},
+		expectError: `.*invalid request signature`,
+	}, {
+		about: "no secret",
+		rpc1: meeting.RPCParams{
+			Secret: []byte("secret"),
+		},
+		expectError: `.*invalid Candid-Meeting-Auth header`,
+	}, {
+		about: "tls",
+		rpc1: meeting.RPCParams{
+			ServerTLSConfig: serverTLS,
+			ClientTLSConfig: clientTLS,
+			Secret:          []byte("secret"),
+		},
+		rpc2: meeting.RPCParams{
+			ServerTLSConfig: serverTLS,
+			ClientTLSConfig: clientTLS,
+			Secret:          []byte("secret"),
+		},
+	}, {
+		about: "tls server only",
+		rpc1: meeting.RPCParams{
+			ServerTLSConfig: serverTLS,
+			ClientTLSConfig: clientTLS,
+		},
+		expectError: `.+`,
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			store := newFakeStore(nil, nil)
+			m1, err := meeting.NewPlace(meeting.Params{
+				Store:      store,
+				ListenAddr: "localhost",
+				DisableGC:  true,
+				RPC:        test.rpc1,
+			})
+			c.Assert(err, qt.Equals, nil)
+			defer m1.Close()
+			m2, err := meeting.NewPlace(meeting.Params{
+				Store:      store,
+				ListenAddr: "localhost",
+				DisableGC:  true,
+				RPC:        test.rpc2,
+			})
+			c.Assert(err, qt.Equals, nil)
+			defer m2.Close()
+
+			ctx := context.Background()
+			err = m1.NewRendezvous(ctx, "x", []byte("first data"))
+			c.Assert(err, qt.Equals, nil)
+			err = m2.Done(ctx, "x", []byte("second data"))
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			data0, data1, err := m1.Wait(ctx, "x")
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(string(data0), qt.Equals, "first data")
+			c.Assert(string(data1), qt.Equals, "second data")
+		})
+	}
+}
+
+func TestRPCTLSConfigMismatch(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	_, err := meeting.NewPlace(meeting.Params{
+		Store:      newFakeStore(nil, nil),
+		ListenAddr: "localhost",
+		RPC: meeting.RPCParams{
+			ServerTLSConfig: &tls.Config{},
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `server and client TLS configurations must both be set`)
+}
+
+func TestCheckSignature(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	secret := []byte("secret")
+	u, err := url.Parse("http://127.0.0.1/rendezvous?b=2&a=1")
+	c.Assert(err, qt.Equals, nil)
+	sig := meeting.Signature(secret, "POST", u, []byte("data"), epoch)
+
+	err = meeting.CheckSignature(secret, "POST", u, []byte("data"), sig, epoch.Add(time.Second))
+	c.Assert(err, qt.Equals, nil)
+
+	// The order of the query parameters does not matter.
+	u1, err := url.Parse("http://127.0.0.1/rendezvous?a=1&b=2")
+	c.Assert(err, qt.Equals, nil)
+	err = meeting.CheckSignature(secret, "POST", u1, []byte("data"), sig, epoch)
+	c.Assert(err, qt.Equals, nil)
+
+	u2, err := url.Parse("http://127.0.0.1/rendezvous?a=1&b=3")
+	c.Assert(err, qt.Equals, nil)
+	err = meeting.CheckSignature(secret, "POST", u2, []byte("data"), sig, epoch)
+	c.Assert(err, qt.ErrorMatches, `invalid request signature`)
+
+	err = meeting.CheckSignature(secret, "POST", u, []byte("other data"), sig, epoch)
+	c.Assert(err, qt.ErrorMatches, `invalid request signature`)
+
+	err = meeting.CheckSignature(secret, "POST", u, []byte("data"), sig, epoch.Add(2*time.Minute))
+	c.Assert(err, qt.ErrorMatches, `request signature expired`)
+}
+
 func TestEntriesRemovedOnClose(t *testing.T) {
 	c := qt.New(t)
 	defer c.Done()
@@ -408,6 +551,7 @@ func TestWaitTimeout(t *testing.T) {
 		c.Logf("starting wait %q", id)
 		_, _, err := m.Wait(ctx, id)
 		c.Check(err, qt.ErrorMatches, "rendezvous wait timed out")
+		c.Check(errgo.Cause(err), qt.Equals, meeting.ErrTimeout)
 		done <- struct{}{}
 	}()
 	err = clock.WaitAdvance(params.WaitTimeout+1, time.Second, 1)
@@ -535,6 +679,7 @@ type testMetrics struct {
 	completedCallCount int
 	expiredCallCount   int
 	expiredCallValues  []int
+	abandonedCount     int
 }
 
 func newTestMetrics() *testMetrics {
@@ -552,6 +697,103 @@ func (m *testMetrics) RequestsExpired(count int) {
 	m.expiredCallValues = append(m.expiredCallValues, count)
 }
 
+func (m *testMetrics) RequestsAbandoned(count int) {
+	m.abandonedCount += count
+}
+
+func TestWaitAfterGC(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	const expiryDuration = time.Hour
+	clock := testclock.NewClock(epoch)
+	store := newFakeStore(nil, clock)
+	tm := newTestMetrics()
+	m1, err := meeting.NewPlace(meeting.Params{
+		Store:          store,
+		Metrics:        tm,
+		ListenAddr:     "localhost",
+		ExpiryDuration: expiryDuration,
+		DisableGC:      true,
+	})
+	c.Assert(err, qt.Equals, nil)
+	defer m1.Close()
+	m2, err := meeting.NewPlace(meeting.Params{
+		Store:          store,
+		ListenAddr:     "localhost",
+		ExpiryDuration: expiryDuration,
+		DisableGC:      true,
+	})
+	c.Assert(err, qt.Equals, nil)
+	defer m2.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	err = m1.NewRendezvous(ctx, "expired", nil)
+	c.Assert(err, qt.Equals, nil)
+	store.setCreationTime("expired", now.Add(-expiryDuration-time.Millisecond))
+	err = m2.NewRendezvous(ctx, "abandoned", nil)
+	c.Assert(err, qt.Equals, nil)
+	store.setCreationTime("abandoned", now.Add(-8*24*time.Hour))
+
+	err = meeting.RunGC(m1, ctx, false, now)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(tm.expiredCallValues, qt.DeepEquals, []int{1})
+	c.Assert(tm.abandonedCount, qt.Equals, 1)
+
+	_, _, err = m1.Wait(ctx, "expired")
+	c.Assert(err, qt.ErrorMatches, `rendezvous "expired" expired`)
+	c.Assert(errgo.Cause(err), qt.Equals, meeting.ErrExpired)
+
+	_, _, err = m1.Wait(ctx, "abandoned")
+	c.Assert(err, qt.ErrorMatches, `rendezvous "abandoned" expired`)
+	c.Assert(errgo.Cause(err), qt.Equals, meeting.ErrExpired)
+
+	// A rendezvous that never existed is not reported as expired.
+	_, _, err = m1.Wait(ctx, "other")
+	c.Assert(err, qt.ErrorMatches, `rendezvous "other" not found`)
+	c.Assert(errgo.Cause(err), qt.Not(qt.Equals), meeting.ErrExpired)
+}
+
+func TestWaitExpiredOnOtherPlace(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	clock := testclock.NewClock(epoch)
+	c.Patch(&meeting.Clock, clock)
+	store := newFakeStore(nil, clock)
+	params := meeting.Params{
+		Store:          store,
+		ListenAddr:     "localhost",
+		ExpiryDuration: 5 * time.Second,
+		WaitTimeout:    time.Minute,
+		DisableGC:      true,
+	}
+	m1, err := meeting.NewPlace(params)
+	c.Assert(err, qt.Equals, nil)
+	defer m1.Close()
+	m2, err := meeting.NewPlace(params)
+	c.Assert(err, qt.Equals, nil)
+	defer m2.Close()
+
+	ctx := context.Background()
+	err = m1.NewRendezvous(ctx, "x", nil)
+	c.Assert(err, qt.Equals, nil)
+
+	done := make(chan error)
+	go func() {
+		_, _, err := m2.Wait(ctx, "x")
+		done <- err
+	}()
+	err = clock.WaitAdvance(params.ExpiryDuration+1, time.Second, 1)
+	c.Assert(err, qt.Equals, nil)
+	select {
+	case err := <-done:
+		c.Assert(err, qt.ErrorMatches, `.*rendezvous expired after 5s`)
+		c.Assert(errgo.Cause(err), qt.Equals, meeting.ErrExpired)
+	case <-time.After(2 * time.Second):
+		c.Fatalf("timed out waiting for Wait to return")
+	}
+}
+
 type putErrorStore struct {
 	meeting.Store
 }
@@ -574,6 +816,9 @@ type fakeStore struct {
 type fakeStoreEntry struct {
 	addr         string
 	creationTime time.Time
+	data0        []byte
+	data1        []byte
+	complete     bool
 }
 
 // newFakeStore returns an in memory store implementation.
@@ -653,6 +898,331 @@ func (s *fakeStore) RemoveOld(_ context.Context, addr string, olderThan time.Tim
 	return ids, nil
 }
 
+type fakeReplicaStore struct {
+	*fakeStore
+	replicas map[string]time.Time
+}
+
+func newFakeReplicaStore(clck clock.Clock) *fakeReplicaStore {
+	return &fakeReplicaStore{
+		fakeStore: newFakeStore(nil, clck),
+		replicas:  make(map[string]time.Time),
+	}
+}
+
+// Heartbeat implements ReplicaStore.Heartbeat.
+func (s *fakeReplicaStore) Heartbeat(_ context.Context, addr string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replicas[addr] = now
+	return nil
+}
+
+// RemoveReplica implements ReplicaStore.RemoveReplica.
+func (s *fakeReplicaStore) RemoveReplica(_ context.Context, addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.replicas, addr)
+	return nil
+}
+
+// RemoveDeadReplicas implements ReplicaStore.RemoveDeadReplicas.
+func (s *fakeReplicaStore) RemoveDeadReplicas(_ context.Context, olderThan time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var addrs []string
+	for addr, t := range s.replicas {
+		if t.Before(olderThan) {
+			delete(s.replicas, addr)
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+func (s *fakeReplicaStore) replicaCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.replicas)
+}
+
+func TestDiscoveryRequiresReplicaStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	_, err := meeting.NewPlace(meeting.Params{
+		Store:      newFakeStore(nil, nil),
+		ListenAddr: "localhost",
+		Discovery: meeting.DiscoveryParams{
+			Enabled: true,
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `store does not support replica discovery`)
+}
+
+func TestAdvertiseAddr(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	m, err := meeting.NewPlace(meeting.Params{
+		Store:      newFakeStore(nil, nil),
+		ListenAddr: "localhost",
+		Discovery: meeting.DiscoveryParams{
+			AdvertiseAddr: "candid-0.candid",
+		},
+	})
+	c.Assert(err, qt.Equals, nil)
+	defer m.Close()
+	c.Assert(meeting.LocalAddr(m), qt.Matches, `candid-0\.candid:[0-9]+`)
+}
+
+func TestDeadReplicaEntriesRemoved(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	const heartbeatInterval = 10 * time.Second
+	clock := testclock.NewClock(epoch)
+	c.Patch(&meeting.Clock, clock)
+	store := newFakeReplicaStore(clock)
+	m1, err := meeting.NewPlace(meeting.Params{
+		Store:      store,
+		ListenAddr: "localhost",
+		DisableGC:  true,
+		Discovery: meeting.DiscoveryParams{
+			Enabled:           true,
+			HeartbeatInterval: heartbeatInterval,
+		},
+	})
+	c.Assert(err, qt.Equals, nil)
+	defer m1.Close()
+
+	// Simulate another replica that has stopped without cleaning
+	// up its rendezvous.
+	ctx := context.Background()
+	err = store.Heartbeat(ctx, "10.0.0.2:1234", epoch)
+	c.Assert(err, qt.Equals, nil)
+	err = store.Put(ctx, "dead1", "10.0.0.2:1234")
+	c.Assert(err, qt.Equals, nil)
+	err = m1.NewRendezvous(ctx, "live1", []byte("something"))
+	c.Assert(err, qt.Equals, nil)
+
+	// The dead replica is still within its grace period.
+	err = meeting.RunHeartbeat(m1, ctx, epoch.Add(2*heartbeatInterval))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(store.itemCount(), qt.Equals, 2)
+
+	err = meeting.RunHeartbeat(m1, ctx, epoch.Add(4*heartbeatInterval))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(store.itemCount(), qt.Equals, 1)
+	_, err = store.Get(ctx, "live1")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(store.replicaCount(), qt.Equals, 1)
+
+	m1.Close()
+	c.Assert(store.replicaCount(), qt.Equals, 0)
+}
+
+// fakePollStore is a fakeStore that implements meeting.Notifier.
+type fakePollStore struct {
+	*fakeStore
+	subscribers map[chan<- string]context.Context
+}
+
+func newFakePollStore(clck clock.Clock) *fakePollStore {
+	return &fakePollStore{
+		fakeStore:   newFakeStore(nil, clck),
+		subscribers: make(map[chan<- string]context.Context),
+	}
+}
+
+// PutData implements meeting.PollStore.PutData.
+func (s *fakePollStore) PutData(_ context.Context, id, addr string, data0 []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[id] = &fakeStoreEntry{
+		addr:         addr,
+		creationTime: s.clock.Now(),
+		data0:        data0,
+	}
+	return nil
+}
+
+// Complete implements meeting.PollStore.Complete.
+func (s *fakePollStore) Complete(_ context.Context, id string, data1 []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := s.entries[id]
+	if entry == nil {
+		return errgo.Newf("rendezvous %q not found", id)
+	}
+	if entry.complete {
+		return errgo.Newf("rendezvous %q done twice", id)
+	}
+	entry.data1 = data1
+	entry.complete = true
+	for c, ctx := range s.subscribers {
+		go func(c chan<- string, ctx context.Context) {
+			select {
+			case c <- id:
+			case <-ctx.Done():
+			}
+		}(c, ctx)
+	}
+	return nil
+}
+
+// GetData implements meeting.PollStore.GetData.
+func (s *fakePollStore) GetData(_ context.Context, id string) (data0, data1 []byte, complete bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := s.entries[id]
+	if entry == nil {
+		return nil, nil, false, errgo.Newf("rendezvous %q not found", id)
+	}
+	return entry.data0, entry.data1, entry.complete, nil
+}
+
+// waitSubscribers waits until there are n subscribers to
+// notifications.
+func (s *fakePollStore) waitSubscribers(c *qt.C, n int) {
+	for i := 0; i < 200; i++ {
+		s.mu.Lock()
+		got := len(s.subscribers)
+		s.mu.Unlock()
+		if got >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("timed out waiting for %d subscribers", n)
+}
+
+// Notify implements meeting.Notifier.Notify.
+func (s *fakePollStore) Notify(ctx context.Context, ids chan<- string) error {
+	s.mu.Lock()
+	s.subscribers[ids] = ctx
+	s.mu.Unlock()
+	<-ctx.Done()
+	s.mu.Lock()
+	delete(s.subscribers, ids)
+	s.mu.Unlock()
+	return ctx.Err()
+}
+
+func TestPollRequiresPollStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	_, err := meeting.NewPlace(meeting.Params{
+		Store:      newFakeStore(nil, nil),
+		ListenAddr: "localhost",
+		Poll: meeting.PollParams{
+			Enabled: true,
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `store does not support polling`)
+}
+
+func TestPollRendezvousDifferentPlaces(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	clock := testclock.NewClock(epoch)
+	c.Patch(&meeting.Clock, clock)
+	store := newFakePollStore(clock)
+	params := meeting.Params{
+		Store:      store,
+		ListenAddr: "localhost",
+		Poll: meeting.PollParams{
+			Enabled: true,
+		},
+	}
+	m1, err := meeting.NewPlace(params)
+	c.Assert(err, qt.Equals, nil)
+	defer m1.Close()
+	params.DisableGC = true
+	m2, err := meeting.NewPlace(params)
+	c.Assert(err, qt.Equals, nil)
+	defer m2.Close()
+
+	ctx := context.Background()
+	err = m1.NewRendezvous(ctx, "x", []byte("first data"))
+	c.Assert(err, qt.Equals, nil)
+
+	waitDone := make(chan struct{})
+	go func() {
+		defer close(waitDone)
+		data0, data1, err := m2.Wait(ctx, "x")
+		c.Check(err, qt.Equals, nil)
+		c.Check(string(data0), qt.Equals, "first data")
+		c.Check(string(data1), qt.Equals, "second data")
+	}()
+
+	// Closing the place that created the rendezvous does not
+	// prevent it from completing.
+	m1.Close()
+	c.Assert(store.itemCount(), qt.Equals, 1)
+
+	err = m2.Done(ctx, "x", []byte("second data"))
+	c.Assert(err, qt.Equals, nil)
+	err = m2.Done(ctx, "x", []byte("other second data"))
+	c.Assert(err, qt.ErrorMatches, `rendezvous "x" done twice`)
+	select {
+	case <-waitDone:
+	case <-time.After(2 * time.Second):
+		c.Errorf("timed out waiting for rendezvous")
+	}
+	c.Assert(store.itemCount(), qt.Equals, 0)
+
+	_, _, err = m2.Wait(ctx, "x")
+	c.Assert(err, qt.ErrorMatches, `rendezvous "x" not found`)
+}
+
+func TestPollRendezvousNotified(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	clock := testclock.NewClock(epoch)
+	c.Patch(&meeting.Clock, clock)
+	store := newFakePollStore(clock)
+	params := meeting.Params{
+		Store:      store,
+		ListenAddr: "localhost",
+		DisableGC:  true,
+		Poll: meeting.PollParams{
+			Enabled: true,
+		},
+	}
+	m1, err := meeting.NewPlace(params)
+	c.Assert(err, qt.Equals, nil)
+	defer m1.Close()
+	m2, err := meeting.NewPlace(params)
+	c.Assert(err, qt.Equals, nil)
+	defer m2.Close()
+
+	ctx := context.Background()
+	err = m1.NewRendezvous(ctx, "x", []byte("first data"))
+	c.Assert(err, qt.Equals, nil)
+
+	waitDone := make(chan struct{})
+	go func() {
+		defer close(waitDone)
+		data0, data1, err := m1.Wait(ctx, "x")
+		c.Check(err, qt.Equals, nil)
+		c.Check(string(data0), qt.Equals, "first data")
+		c.Check(string(data1), qt.Equals, "second data")
+	}()
+
+	store.waitSubscribers(c, 2)
+	// Wait for the waiter to check the store before completing
+	// the rendezvous on the other place. The clock is not
+	// advanced past the poll interval, so the waiter can only be
+	// woken by a notification.
+	err = clock.WaitAdvance(0, time.Second, 2)
+	c.Assert(err, qt.Equals, nil)
+	err = m2.Done(ctx, "x", []byte("second data"))
+	c.Assert(err, qt.Equals, nil)
+	select {
+	case <-waitDone:
+	case <-time.After(2 * time.Second):
+		c.Errorf("timed out waiting for rendezvous")
+	}
+}
+
 func newId() (string, error) {
 	var id [16]byte
 	if _, err := rand.Read(id[:]); err != nil {
@@ -660,3 +1230,88 @@ func newId() (string, error) {
 	}
 	return fmt.Sprintf("%x", id[:]), nil
 }
+
+func TestDrain(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	clock := testclock.NewClock(epoch)
+	c.Patch(&meeting.Clock, clock)
+	count := int32(0)
+	store := newFakeStore(&count, clock)
+	m, err := meeting.NewPlace(meeting.Params{
+		Store:      store,
+		ListenAddr: "localhost",
+		DisableGC:  true,
+	})
+	c.Assert(err, qt.Equals, nil)
+	defer m.Close()
+
+	ctx := context.Background()
+	id, err := newId()
+	c.Assert(err, qt.Equals, nil)
+	err = m.NewRendezvous(ctx, id, []byte("first data"))
+	c.Assert(err, qt.Equals, nil)
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- m.Drain(ctx)
+	}()
+
+	// Wait for the place to start draining.
+	for i := 0; m.CheckHealth(ctx) == nil; i++ {
+		if i > 200 {
+			c.Fatalf("place did not start draining")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(errgo.Cause(m.CheckHealth(ctx)), qt.Equals, meeting.ErrDraining)
+
+	// New rendezvous are refused.
+	id2, err := newId()
+	c.Assert(err, qt.Equals, nil)
+	err = m.NewRendezvous(ctx, id2, []byte("data"))
+	c.Assert(errgo.Cause(err), qt.Equals, meeting.ErrDraining)
+
+	// The rendezvous in progress can still complete.
+	err = m.Done(ctx, id, []byte("second data"))
+	c.Assert(err, qt.Equals, nil)
+	select {
+	case <-drained:
+		c.Fatalf("drain completed before rendezvous")
+	default:
+	}
+	data0, data1, err := m.Wait(ctx, id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(data0), qt.Equals, "first data")
+	c.Assert(string(data1), qt.Equals, "second data")
+	select {
+	case err := <-drained:
+		c.Assert(err, qt.Equals, nil)
+	case <-time.After(2 * time.Second):
+		c.Fatalf("timed out waiting for drain")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	count := int32(0)
+	store := newFakeStore(&count, meeting.Clock)
+	m, err := meeting.NewPlace(meeting.Params{
+		Store:      store,
+		ListenAddr: "localhost",
+		DisableGC:  true,
+	})
+	c.Assert(err, qt.Equals, nil)
+	defer m.Close()
+
+	id, err := newId()
+	c.Assert(err, qt.Equals, nil)
+	err = m.NewRendezvous(context.Background(), id, []byte("data"))
+	c.Assert(err, qt.Equals, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = m.Drain(ctx)
+	c.Assert(err, qt.ErrorMatches, `1 rendezvous still in progress: context deadline exceeded`)
+}
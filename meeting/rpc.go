@@ -0,0 +1,184 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package meeting
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+)
+
+// authHeader holds the name of the header used to authenticate
+// requests between places.
+const authHeader = "Candid-Meeting-Auth"
+
+// maxClockSkew holds the maximum difference between the time at
+// which a request was signed and the time at which it is received.
+const maxClockSkew = time.Minute
+
+// maxBodySize holds the maximum size of the body of a request between
+// places.
+const maxBodySize = 1 << 20
+
+// RPCParams holds the configuration of the security of the requests
+// that places make to one another to complete rendezvous. All places
+// that share a store must be configured the same way.
+type RPCParams struct {
+	// ServerTLSConfig holds the TLS configuration used to serve
+	// requests from other places. If it is nil, requests are
+	// served without TLS. To require mutual TLS set ClientAuth to
+	// tls.RequireAndVerifyClientCert and ClientCAs to the pool of
+	// certificate authorities that issue client certificates.
+	ServerTLSConfig *tls.Config
+
+	// ClientTLSConfig holds the TLS configuration used to make
+	// requests to other places. It must be set if ServerTLSConfig
+	// is set. For mutual TLS it should hold the client certificate.
+	ClientTLSConfig *tls.Config
+
+	// Secret holds a secret shared by all places that is used to
+	// authenticate requests between them. If it is empty, requests
+	// are not authenticated.
+	Secret []byte
+}
+
+func (p RPCParams) validate() error {
+	if (p.ServerTLSConfig == nil) != (p.ClientTLSConfig == nil) {
+		return errgo.Newf("server and client TLS configurations must both be set")
+	}
+	return nil
+}
+
+// scheme returns the URL scheme used to contact other places.
+func (p RPCParams) scheme() string {
+	if p.ClientTLSConfig != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// signature returns the value of the authentication header for a
+// request with the given method, URL and body made at the given time.
+// The signature covers the path, the query parameters in canonical
+// form and a SHA-256 hash of the body.
+func signature(secret []byte, method string, u *url.URL, body []byte, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	sum := sha256.Sum256(body)
+	h := hmac.New(sha256.New, secret)
+	fmt.Fprintf(h, "%s %s %s %s %x", method, u.Path, u.Query().Encode(), ts, sum)
+	return ts + " " + base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// checkSignature checks that the given authentication header value is
+// valid for a request with the given method, URL and body received at
+// the given time.
+func checkSignature(secret []byte, method string, u *url.URL, body []byte, value string, now time.Time) error {
+	parts := strings.SplitN(value, " ", 2)
+	if len(parts) != 2 {
+		return errgo.Newf("invalid %s header", authHeader)
+	}
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return errgo.Newf("invalid %s header", authHeader)
+	}
+	t := time.Unix(ts, 0)
+	if d := now.Sub(t); d > maxClockSkew || d < -maxClockSkew {
+		return errgo.Newf("request signature expired")
+	}
+	if !hmac.Equal([]byte(signature(secret, method, u, body, t)), []byte(value)) {
+		return errgo.Newf("invalid request signature")
+	}
+	return nil
+}
+
+// authHandler returns a handler that checks that requests are signed
+// with the given secret before passing them to h.
+func authHandler(secret []byte, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := readBody(req)
+		if err != nil {
+			httprequest.WriteJSON(w, http.StatusBadRequest, &httprequest.RemoteError{
+				Message: err.Error(),
+			})
+			return
+		}
+		if err := checkSignature(secret, req.Method, req.URL, body, req.Header.Get(authHeader), Clock.Now()); err != nil {
+			logger.Infof("unauthorized meeting request from %s: %v", req.RemoteAddr, err)
+			httprequest.WriteJSON(w, http.StatusUnauthorized, &httprequest.RemoteError{
+				Message: err.Error(),
+			})
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// doer implements httprequest.Doer by signing requests to other places
+// when a secret is configured.
+type doer struct {
+	client *http.Client
+	secret []byte
+}
+
+// Do implements httprequest.Doer.Do.
+func (d doer) Do(req *http.Request) (*http.Response, error) {
+	if len(d.secret) > 0 {
+		body, err := readBody(req)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		req.Header.Set(authHeader, signature(d.secret, req.Method, req.URL, body, Clock.Now()))
+	}
+	return d.client.Do(req)
+}
+
+// readBody reads the whole body of the given request and replaces it
+// so that it can be read again.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBodySize+1))
+	req.Body.Close()
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read request body")
+	}
+	if len(body) > maxBodySize {
+		return nil, errgo.Newf("request body too large")
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// newDoer returns the httprequest.Doer used to make requests to other
+// places.
+func newDoer(p RPCParams) httprequest.Doer {
+	client := http.DefaultClient
+	if p.ClientTLSConfig != nil {
+		client = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig:     p.ClientTLSConfig,
+				TLSHandshakeTimeout: 10 * time.Second,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		}
+	}
+	return doer{
+		client: client,
+		secret: p.Secret,
+	}
+}
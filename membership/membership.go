@@ -0,0 +1,139 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package membership provides a client that relying services can use
+// to check whether a user is a member of a group without obtaining a
+// new discharge macaroon. Results are cached according to the caching
+// headers returned by the identity server.
+package membership
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+)
+
+// A Client checks group membership with an identity server.
+type Client struct {
+	// BaseURL holds the URL of the identity server.
+	BaseURL string
+
+	// Doer is used to make HTTP requests to the identity server. It
+	// must authenticate as a user that is allowed to read the groups
+	// of the users being checked. Typically this is an
+	// *httpbakery.Client using agent authentication.
+	Doer httprequest.Doer
+
+	// Now, if set, is used to obtain the current time. This is
+	// intended for testing.
+	Now func() time.Time
+
+	mu    sync.Mutex
+	cache map[cacheKey]*cacheEntry
+}
+
+type cacheKey struct {
+	username string
+	group    string
+}
+
+type cacheEntry struct {
+	member  bool
+	etag    string
+	expires time.Time
+}
+
+type verifyResponse struct {
+	Member bool `json:"member"`
+}
+
+// IsMember reports whether the given user is a member of the given
+// group.
+func (c *Client) IsMember(ctx context.Context, username, group string) (bool, error) {
+	key := cacheKey{username, group}
+	now := c.now()
+	c.mu.Lock()
+	e := c.cache[key]
+	c.mu.Unlock()
+	if e != nil && now.Before(e.expires) {
+		return e.member, nil
+	}
+
+	u := strings.TrimSuffix(c.BaseURL, "/") + "/v1/verify?" + url.Values{
+		"username": {username},
+		"group":    {group},
+	}.Encode()
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	req = req.WithContext(ctx)
+	if e != nil && e.etag != "" {
+		req.Header.Set("If-None-Match", e.etag)
+	}
+	resp, err := c.Doer.Do(req)
+	if err != nil {
+		return false, errgo.Notef(err, "cannot verify membership")
+	}
+	defer resp.Body.Close()
+	var ne cacheEntry
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		if e == nil {
+			return false, errgo.Newf("cannot verify membership: unexpected %s response", resp.Status)
+		}
+		ne.member = e.member
+	case http.StatusOK:
+		var vr verifyResponse
+		if err := httprequest.UnmarshalJSONResponse(resp, &vr); err != nil {
+			return false, errgo.Notef(err, "cannot verify membership")
+		}
+		ne.member = vr.Member
+	default:
+		var perr httprequest.RemoteError
+		if err := httprequest.UnmarshalJSONResponse(resp, &perr); err != nil {
+			return false, errgo.Notef(err, "cannot verify membership: %s", resp.Status)
+		}
+		return false, errgo.Notef(&perr, "cannot verify membership")
+	}
+	ne.etag = resp.Header.Get("ETag")
+	ne.expires = now.Add(maxAge(resp.Header.Get("Cache-Control")))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cache == nil {
+		c.cache = make(map[cacheKey]*cacheEntry)
+	}
+	c.cache[key] = &ne
+	return ne.member, nil
+}
+
+func (c *Client) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+// maxAge returns the max-age specified in the given Cache-Control
+// header value, or zero if there is none.
+func maxAge(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+		if err != nil || n < 0 {
+			return 0
+		}
+		return time.Duration(n) * time.Second
+	}
+	return 0
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package membership_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/internal/candidtest"
+	"github.com/CanonicalLtd/candid/internal/discharger"
+	"github.com/CanonicalLtd/candid/internal/identity"
+	"github.com/CanonicalLtd/candid/internal/v1"
+	"github.com/CanonicalLtd/candid/membership"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+func TestIsMember(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	st := candidtest.NewStore()
+	srv := candidtest.NewServer(c, st.ServerParams(), map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v1":         v1.NewAPIHandler,
+	})
+	err := st.Store.UpdateIdentity(context.Background(), &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "jbloggs"),
+		Username:   "jbloggs",
+		Groups:     []string{"g1"},
+	}, store.Update{
+		store.Username: store.Set,
+		store.Groups:   store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	doer := &countingDoer{doer: srv.AdminClient()}
+	now := time.Now()
+	client := &membership.Client{
+		BaseURL: srv.URL,
+		Doer:    doer,
+		Now:     func() time.Time { return now },
+	}
+	ok, err := client.IsMember(context.Background(), "jbloggs", "g1")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ok, qt.Equals, true)
+	ok, err = client.IsMember(context.Background(), "jbloggs", "g2")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ok, qt.Equals, false)
+	c.Assert(doer.statuses, qt.DeepEquals, []int{http.StatusOK, http.StatusOK})
+
+	// Cached results are used until they expire.
+	ok, err = client.IsMember(context.Background(), "jbloggs", "g1")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(doer.statuses, qt.HasLen, 2)
+
+	// Expired results are revalidated.
+	now = now.Add(2 * time.Minute)
+	ok, err = client.IsMember(context.Background(), "jbloggs", "g1")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(doer.statuses, qt.DeepEquals, []int{http.StatusOK, http.StatusOK, http.StatusNotModified})
+}
+
+func TestIsMemberNotFound(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	st := candidtest.NewStore()
+	srv := candidtest.NewServer(c, st.ServerParams(), map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v1":         v1.NewAPIHandler,
+	})
+	client := &membership.Client{
+		BaseURL: srv.URL,
+		Doer:    srv.AdminClient(),
+	}
+	_, err := client.IsMember(context.Background(), "not-there", "g1")
+	c.Assert(err, qt.ErrorMatches, `cannot verify membership: user not-there not found`)
+}
+
+type countingDoer struct {
+	doer     httprequest.Doer
+	statuses []int
+}
+
+func (d *countingDoer) Do(req *http.Request) (*http.Response, error) {
+	resp, err := d.doer.Do(req)
+	if err == nil {
+		d.statuses = append(d.statuses, resp.StatusCode)
+	}
+	return resp, err
+}
@@ -0,0 +1,266 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package notify sends notifications, such as email verification and
+// password reset messages, to users and administrators of the identity
+// server. Messages are rendered from templates and sent with one or
+// more Senders, for example by SMTP or to a webhook.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"text/template"
+
+	"github.com/juju/loggo"
+	"gopkg.in/errgo.v1"
+)
+
+var logger = loggo.GetLogger("candid.notify")
+
+// The kinds of notification sent by the identity server. The kind of a
+// notification selects the templates used to render it.
+const (
+	// KindEmailVerification is sent to ask a user to verify their
+	// email address. The template data has Name and URL fields,
+	// where URL holds the address of the verification page.
+	KindEmailVerification = "email-verification"
+
+	// KindPasswordReset is sent to allow a user to reset their
+	// password. The template data has Name and URL fields, where URL
+	// holds the address of the password reset page.
+	KindPasswordReset = "password-reset"
+
+	// KindNewDeviceLogin is sent to tell a user that their account
+	// has been used to log in from a new device. The template data
+	// has Name, Username, Time, Address and UserAgent fields.
+	KindNewDeviceLogin = "new-device-login"
+
+	// KindAccessRequest is sent to the owners of a group when a
+	// user requests membership of it. The template data has
+	// Username, Group, Reason and URL fields, where URL holds the
+	// address of the page on which the request can be approved.
+	KindAccessRequest = "access-request"
+
+	// KindAccessRequestDecision is sent to tell a user that their
+	// request for membership of a group has been approved or
+	// denied. The template data has Name, Group, Approved, DecidedBy
+	// and Expires fields, where Expires is empty unless the
+	// membership is time-limited.
+	KindAccessRequestDecision = "access-request-decision"
+
+	// KindAdmin is sent to the administrators of the identity
+	// server. The template data has Subject and Text fields.
+	KindAdmin = "admin"
+)
+
+// ErrNotConfigured is the error cause returned when a notification is
+// sent with a nil Notifier.
+var ErrNotConfigured = errgo.New("notifications not configured")
+
+// A Message is a notification rendered from its templates.
+type Message struct {
+	// Kind holds the kind of the notification.
+	Kind string
+
+	// To holds the email addresses of the recipients.
+	To []string
+
+	// Subject holds the subject of the message.
+	Subject string
+
+	// Body holds the plain text body of the message.
+	Body string
+}
+
+// A Sender sends messages.
+type Sender interface {
+	// Send sends the given message.
+	Send(ctx context.Context, m *Message) error
+}
+
+// Params holds the parameters of a Notifier.
+type Params struct {
+	// Senders holds the senders that are used to send every
+	// message.
+	Senders []Sender
+
+	// Templates holds the templates used to render messages. For
+	// each kind of notification there must be a template named
+	// kind+".subject" and one named kind+".body". If this is nil the
+	// templates returned by DefaultTemplates are used.
+	Templates *template.Template
+
+	// AdminAddresses holds the email addresses of the
+	// administrators of the identity server.
+	AdminAddresses []string
+}
+
+// A Notifier renders and sends notifications. A nil Notifier returns
+// an error with a cause of ErrNotConfigured from all its methods, so
+// that features that require notifications can be disabled when none
+// are configured.
+type Notifier struct {
+	p Params
+}
+
+// New returns a new Notifier with the given parameters. If no senders
+// are specified New returns nil.
+func New(p Params) *Notifier {
+	if len(p.Senders) == 0 {
+		return nil
+	}
+	if p.Templates == nil {
+		p.Templates = DefaultTemplates()
+	}
+	return &Notifier{p: p}
+}
+
+// Notify renders the notification of the given kind with the given
+// template data and sends it to the given email addresses. If there is
+// more than one sender the message is sent with all of them, and the
+// first error, if any, is returned.
+func (n *Notifier) Notify(ctx context.Context, kind string, to []string, data interface{}) error {
+	if n == nil {
+		return errgo.WithCausef(nil, ErrNotConfigured, "cannot send %s notification", kind)
+	}
+	m, err := n.render(kind, to, data)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var firstErr error
+	for _, s := range n.p.Senders {
+		if err := s.Send(ctx, m); err != nil {
+			logger.Errorf("cannot send %s notification: %s", kind, err)
+			if firstErr == nil {
+				firstErr = errgo.Notef(err, "cannot send %s notification", kind)
+			}
+		}
+	}
+	return firstErr
+}
+
+// NotifyAdmins sends the given text to the administrators of the
+// identity server, using the KindAdmin templates.
+func (n *Notifier) NotifyAdmins(ctx context.Context, subject, text string) error {
+	if n == nil {
+		return errgo.WithCausef(nil, ErrNotConfigured, "cannot send admin notification")
+	}
+	if len(n.p.AdminAddresses) == 0 {
+		return nil
+	}
+	data := struct {
+		Subject string
+		Text    string
+	}{subject, text}
+	return errgo.Mask(n.Notify(ctx, KindAdmin, n.p.AdminAddresses, data))
+}
+
+// render renders the message of the given kind.
+func (n *Notifier) render(kind string, to []string, data interface{}) (*Message, error) {
+	if len(to) == 0 {
+		return nil, errgo.Newf("no recipients for %s notification", kind)
+	}
+	for _, addr := range to {
+		if strings.ContainsAny(addr, "\r\n") {
+			return nil, errgo.Newf("invalid recipient %q", addr)
+		}
+	}
+	var subject, body bytes.Buffer
+	if err := n.p.Templates.ExecuteTemplate(&subject, kind+".subject", data); err != nil {
+		return nil, errgo.Notef(err, "cannot render %s notification", kind)
+	}
+	if err := n.p.Templates.ExecuteTemplate(&body, kind+".body", data); err != nil {
+		return nil, errgo.Notef(err, "cannot render %s notification", kind)
+	}
+	return &Message{
+		Kind: kind,
+		To:   to,
+		// The subject is used as a header so it must be a
+		// single line.
+		Subject: strings.Join(strings.Fields(subject.String()), " "),
+		Body:    strings.TrimSpace(body.String()) + "\n",
+	}, nil
+}
+
+// DefaultTemplates returns the default templates for all the kinds of
+// notification.
+func DefaultTemplates() *template.Template {
+	return template.Must(template.New("").Parse(defaultTemplates))
+}
+
+// ParseTemplates returns the default templates overridden by the
+// templates in the files matching the given pattern. Each file should
+// define templates with the {{define}} action.
+func ParseTemplates(pattern string) (*template.Template, error) {
+	t, err := DefaultTemplates().ParseGlob(pattern)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot parse notification templates")
+	}
+	return t, nil
+}
+
+const defaultTemplates = `
+{{define "email-verification.subject"}}Verify your email address{{end}}
+{{define "email-verification.body"}}
+Hello {{.Name}},
+
+Please verify your email address by visiting the following link:
+
+{{.URL}}
+
+If you did not request this, you can ignore this message.
+{{end}}
+
+{{define "password-reset.subject"}}Reset your password{{end}}
+{{define "password-reset.body"}}
+Hello {{.Name}},
+
+A password reset has been requested for your account. To choose a new
+password visit the following link:
+
+{{.URL}}
+
+If you did not request this, you can ignore this message and your
+password will not be changed.
+{{end}}
+
+{{define "new-device-login.subject"}}New login to your account{{end}}
+{{define "new-device-login.body"}}
+Hello {{.Name}},
+
+Your account {{.Username}} was used to log in from a new device.
+
+Time: {{.Time}}
+Address: {{.Address}}
+Browser: {{.UserAgent}}
+
+If this was not you, please change your password and contact your
+administrator.
+{{end}}
+
+{{define "access-request.subject"}}{{.Username}} requests membership of {{.Group}}{{end}}
+{{define "access-request.body"}}
+{{.Username}} has requested membership of the group {{.Group}}, which
+you own.
+
+Reason: {{.Reason}}
+
+Approve or deny the request at {{.URL}}
+{{end}}
+
+{{define "access-request-decision.subject"}}Your request to join {{.Group}} has been {{if .Approved}}approved{{else}}denied{{end}}{{end}}
+{{define "access-request-decision.body"}}
+Hello {{.Name}},
+
+Your request for membership of the group {{.Group}} has been
+{{if .Approved}}approved{{else}}denied{{end}} by {{.DecidedBy}}.
+{{if and .Approved .Expires}}
+Your membership expires at {{.Expires}}.
+{{end}}
+{{end}}
+
+{{define "admin.subject"}}[candid] {{.Subject}}{{end}}
+{{define "admin.body"}}{{.Text}}{{end}}
+`
@@ -0,0 +1,204 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package notify_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/notify"
+)
+
+type recordingSender struct {
+	messages []*notify.Message
+	err      error
+}
+
+func (s *recordingSender) Send(ctx context.Context, m *notify.Message) error {
+	s.messages = append(s.messages, m)
+	return s.err
+}
+
+func TestNotify(t *testing.T) {
+	c := qt.New(t)
+	s1 := new(recordingSender)
+	s2 := new(recordingSender)
+	n := notify.New(notify.Params{
+		Senders: []notify.Sender{s1, s2},
+	})
+	err := n.Notify(context.Background(), notify.KindPasswordReset, []string{"bob@example.com"}, map[string]string{
+		"Name": "Bob",
+		"URL":  "https://candid.example.com/reset?token=1234",
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(s1.messages, qt.HasLen, 1)
+	c.Assert(s2.messages, qt.DeepEquals, s1.messages)
+	m := s1.messages[0]
+	c.Assert(m.Kind, qt.Equals, notify.KindPasswordReset)
+	c.Assert(m.To, qt.DeepEquals, []string{"bob@example.com"})
+	c.Assert(m.Subject, qt.Equals, "Reset your password")
+	c.Assert(strings.HasPrefix(m.Body, "Hello Bob,\n"), qt.Equals, true, qt.Commentf("%q", m.Body))
+	c.Assert(strings.Contains(m.Body, "https://candid.example.com/reset?token=1234"), qt.Equals, true)
+}
+
+func TestNotifySendError(t *testing.T) {
+	c := qt.New(t)
+	s1 := &recordingSender{err: errgo.New("bad wolf")}
+	s2 := new(recordingSender)
+	n := notify.New(notify.Params{
+		Senders: []notify.Sender{s1, s2},
+	})
+	err := n.NotifyAdmins(context.Background(), "test", "test message")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(s2.messages, qt.HasLen, 0)
+
+	n = notify.New(notify.Params{
+		Senders:        []notify.Sender{s1, s2},
+		AdminAddresses: []string{"admin@example.com"},
+	})
+	err = n.NotifyAdmins(context.Background(), "test", "test message")
+	c.Assert(err, qt.ErrorMatches, `cannot send admin notification: bad wolf`)
+	// The message is still sent with the other senders.
+	c.Assert(s2.messages, qt.HasLen, 1)
+	c.Assert(s2.messages[0].Subject, qt.Equals, "[candid] test")
+	c.Assert(s2.messages[0].Body, qt.Equals, "test message\n")
+}
+
+func TestNilNotifier(t *testing.T) {
+	c := qt.New(t)
+	n := notify.New(notify.Params{})
+	c.Assert(n, qt.IsNil)
+	err := n.Notify(context.Background(), notify.KindEmailVerification, []string{"bob@example.com"}, nil)
+	c.Assert(errgo.Cause(err), qt.Equals, notify.ErrNotConfigured)
+}
+
+func TestInvalidRecipient(t *testing.T) {
+	c := qt.New(t)
+	s := new(recordingSender)
+	n := notify.New(notify.Params{
+		Senders: []notify.Sender{s},
+	})
+	err := n.Notify(context.Background(), notify.KindAdmin, []string{"bob@example.com\r\nBcc: eve@example.com"}, nil)
+	c.Assert(err, qt.ErrorMatches, `invalid recipient .*`)
+	c.Assert(s.messages, qt.HasLen, 0)
+}
+
+func TestParseTemplates(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	err := ioutil.WriteFile(filepath.Join(dir, "reset"), []byte(`{{define "password-reset.subject"}}
+	Your   {{.Name}}
+	password{{end}}`), 0666)
+	c.Assert(err, qt.Equals, nil)
+	tmpl, err := notify.ParseTemplates(filepath.Join(dir, "*"))
+	c.Assert(err, qt.Equals, nil)
+	s := new(recordingSender)
+	n := notify.New(notify.Params{
+		Senders:   []notify.Sender{s},
+		Templates: tmpl,
+	})
+	err = n.Notify(context.Background(), notify.KindPasswordReset, []string{"bob@example.com"}, map[string]string{
+		"Name": "Bob",
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(s.messages[0].Subject, qt.Equals, "Your Bob password")
+	// Templates that are not overridden are unchanged.
+	c.Assert(strings.Contains(s.messages[0].Body, "A password reset has been requested"), qt.Equals, true)
+}
+
+func TestWebhook(t *testing.T) {
+	c := qt.New(t)
+	var got notify.WebhookMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		c.Check(err, qt.Equals, nil)
+		c.Check(req.Header.Get(notify.SignatureHeader), qt.Equals, notify.Signature("secret", body))
+		c.Check(json.Unmarshal(body, &got), qt.Equals, nil)
+		if got.Subject == "fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	s, err := notify.NewWebhookSender(notify.WebhookParams{
+		URL:    srv.URL,
+		Secret: "secret",
+	})
+	c.Assert(err, qt.Equals, nil)
+	m := &notify.Message{
+		Kind:    notify.KindAdmin,
+		To:      []string{"admin@example.com"},
+		Subject: "test",
+		Body:    "test message\n",
+	}
+	err = s.Send(context.Background(), m)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(got, qt.DeepEquals, notify.WebhookMessage{
+		Kind:    notify.KindAdmin,
+		To:      []string{"admin@example.com"},
+		Subject: "test",
+		Body:    "test message\n",
+	})
+
+	m.Subject = "fail"
+	err = s.Send(context.Background(), m)
+	c.Assert(err, qt.ErrorMatches, `webhook returned 500 Internal Server Error`)
+}
+
+func TestInvalidWebhookURL(t *testing.T) {
+	c := qt.New(t)
+	_, err := notify.NewWebhookSender(notify.WebhookParams{
+		URL: "ftp://example.com",
+	})
+	c.Assert(err, qt.ErrorMatches, `invalid webhook URL "ftp://example.com"`)
+}
+
+func TestFormatMessage(t *testing.T) {
+	c := qt.New(t)
+	from := &mail.Address{Name: "Candid", Address: "candid@example.com"}
+	msg, err := notify.FormatMessage(from, &notify.Message{
+		To:      []string{"bob@example.com"},
+		Subject: "Café",
+		Body:    "Hello,\nworld\n",
+	}, time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(msg), qt.Equals, "From: \"Candid\" <candid@example.com>\r\n"+
+		"To: <bob@example.com>\r\n"+
+		"Subject: =?utf-8?q?Caf=C3=A9?=\r\n"+
+		"Date: Tue, 01 Oct 2019 12:00:00 +0000\r\n"+
+		"MIME-Version: 1.0\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"Content-Transfer-Encoding: quoted-printable\r\n"+
+		"\r\n"+
+		"Hello,\r\nworld\r\n")
+
+	_, err = notify.FormatMessage(from, &notify.Message{
+		To: []string{"not an address"},
+	}, time.Now())
+	c.Assert(err, qt.ErrorMatches, `invalid recipient "not an address": .*`)
+}
+
+func TestInvalidSMTPParams(t *testing.T) {
+	c := qt.New(t)
+	_, err := notify.NewSMTPSender(notify.SMTPParams{
+		Address: "smtp.example.com",
+		From:    "candid@example.com",
+	})
+	c.Assert(err, qt.ErrorMatches, `invalid SMTP address: .*`)
+	_, err = notify.NewSMTPSender(notify.SMTPParams{
+		Address: "smtp.example.com:25",
+		From:    "candid",
+	})
+	c.Assert(err, qt.ErrorMatches, `invalid SMTP from address: .*`)
+}
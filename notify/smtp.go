@@ -0,0 +1,149 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// SMTPParams holds the parameters of an SMTP sender.
+type SMTPParams struct {
+	// Address holds the host:port address of the SMTP server.
+	Address string
+
+	// From holds the address that messages are sent from.
+	From string
+
+	// Username and Password hold the credentials used to
+	// authenticate to the server. If Username is empty no
+	// authentication is performed.
+	Username string
+	Password string
+
+	// InsecureSkipVerify disables the verification of the server's
+	// certificate when STARTTLS is used. It should only be used for
+	// testing.
+	InsecureSkipVerify bool
+}
+
+// NewSMTPSender returns a Sender that sends messages as email through
+// the SMTP server with the given parameters. STARTTLS is used if the
+// server supports it.
+func NewSMTPSender(p SMTPParams) (Sender, error) {
+	host, _, err := net.SplitHostPort(p.Address)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid SMTP address")
+	}
+	from, err := mail.ParseAddress(p.From)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid SMTP from address")
+	}
+	return &smtpSender{
+		p:    p,
+		host: host,
+		from: from,
+	}, nil
+}
+
+type smtpSender struct {
+	p    SMTPParams
+	host string
+	from *mail.Address
+}
+
+// Send implements Sender.Send.
+func (s *smtpSender) Send(ctx context.Context, m *Message) error {
+	msg, err := formatMessage(s.from, m, time.Now())
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.p.Address)
+	if err != nil {
+		return errgo.Notef(err, "cannot connect to SMTP server")
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return errgo.Notef(err, "cannot connect to SMTP server")
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{
+			ServerName:         s.host,
+			InsecureSkipVerify: s.p.InsecureSkipVerify,
+		}); err != nil {
+			return errgo.Notef(err, "cannot start TLS")
+		}
+	}
+	if s.p.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.p.Username, s.p.Password, s.host)); err != nil {
+			return errgo.Notef(err, "cannot authenticate to SMTP server")
+		}
+	}
+	if err := c.Mail(s.from.Address); err != nil {
+		return errgo.Mask(err)
+	}
+	for _, to := range m.To {
+		if err := c.Rcpt(to); err != nil {
+			return errgo.Notef(err, "cannot send to %q", to)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := w.Close(); err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(c.Quit())
+}
+
+// formatMessage returns the given message formatted as a plain text
+// email.
+func formatMessage(from *mail.Address, m *Message, now time.Time) ([]byte, error) {
+	to := make([]string, len(m.To))
+	for i, addr := range m.To {
+		a, err := mail.ParseAddress(addr)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid recipient %q", addr)
+		}
+		to[i] = a.String()
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+	buf.WriteString("\r\n")
+	w := quotedprintable.NewWriter(&buf)
+	if _, err := w.Write([]byte(m.Body)); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"gopkg.in/errgo.v1"
+)
+
+// SignatureHeader is the header holding the signature of the body of
+// webhook requests, in the form "sha256=" followed by the hex encoded
+// HMAC-SHA256 of the body keyed with the webhook secret.
+const SignatureHeader = "X-Candid-Signature"
+
+// WebhookParams holds the parameters of a webhook sender.
+type WebhookParams struct {
+	// URL holds the URL that messages are posted to.
+	URL string
+
+	// Secret holds the key used to sign requests. If it is empty
+	// requests are not signed.
+	Secret string
+
+	// Client holds the client used to make requests. If this is nil
+	// http.DefaultClient is used.
+	Client *http.Client
+}
+
+// WebhookMessage is the body of the requests made by a webhook sender.
+type WebhookMessage struct {
+	Kind    string   `json:"kind"`
+	To      []string `json:"to"`
+	Subject string   `json:"subject"`
+	Body    string   `json:"body"`
+}
+
+// NewWebhookSender returns a Sender that sends messages by posting
+// them as JSON encoded WebhookMessages to a URL.
+func NewWebhookSender(p WebhookParams) (Sender, error) {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid webhook URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errgo.Newf("invalid webhook URL %q", p.URL)
+	}
+	if p.Client == nil {
+		p.Client = http.DefaultClient
+	}
+	return &webhookSender{p}, nil
+}
+
+type webhookSender struct {
+	p WebhookParams
+}
+
+// Send implements Sender.Send.
+func (s *webhookSender) Send(ctx context.Context, m *Message) error {
+	body, err := json.Marshal(WebhookMessage{
+		Kind:    m.Kind,
+		To:      m.To,
+		Subject: m.Subject,
+		Body:    m.Body,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req, err := http.NewRequest("POST", s.p.URL, bytes.NewReader(body))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if s.p.Secret != "" {
+		req.Header.Set(SignatureHeader, Signature(s.p.Secret, body))
+	}
+	resp, err := s.p.Client.Do(req)
+	if err != nil {
+		return errgo.Notef(err, "cannot post to webhook")
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errgo.Newf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Signature returns the value of the SignatureHeader for a request with
+// the given body signed with the given secret.
+func Signature(secret string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
@@ -4,6 +4,7 @@
 package candid
 
 import (
+	"context"
 	"html/template"
 	"net/http"
 	"sort"
@@ -14,14 +15,30 @@ import (
 	"gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 
+	"github.com/CanonicalLtd/candid/attrcrypt"
 	"github.com/CanonicalLtd/candid/idp"
 	"github.com/CanonicalLtd/candid/idp/agent"
+	"github.com/CanonicalLtd/candid/idp/idputil/challenge"
+	"github.com/CanonicalLtd/candid/idp/idputil/lockout"
+	"github.com/CanonicalLtd/candid/internal/attrschema"
+	"github.com/CanonicalLtd/candid/internal/canary"
+	"github.com/CanonicalLtd/candid/internal/consent"
+	"github.com/CanonicalLtd/candid/internal/cors"
 	"github.com/CanonicalLtd/candid/internal/debug"
 	"github.com/CanonicalLtd/candid/internal/discharger"
 	"github.com/CanonicalLtd/candid/internal/identity"
+	"github.com/CanonicalLtd/candid/internal/jwt"
+	"github.com/CanonicalLtd/candid/internal/keyring"
+	"github.com/CanonicalLtd/candid/internal/remember"
+	"github.com/CanonicalLtd/candid/internal/secheaders"
+	"github.com/CanonicalLtd/candid/internal/throttle"
 	"github.com/CanonicalLtd/candid/internal/v1"
+	"github.com/CanonicalLtd/candid/internal/v2"
+	"github.com/CanonicalLtd/candid/internal/waitlimit"
 	"github.com/CanonicalLtd/candid/meeting"
+	"github.com/CanonicalLtd/candid/notify"
 	"github.com/CanonicalLtd/candid/store"
+	"github.com/CanonicalLtd/candid/store/cachestore"
 )
 
 // Versions of the API that can be served.
@@ -29,12 +46,14 @@ const (
 	Debug      = "debug"
 	Discharger = "discharger"
 	V1         = "v1"
+	V2         = "v2"
 )
 
 var versions = map[string]identity.NewAPIHandlerFunc{
 	Debug:      debug.NewAPIHandler,
 	Discharger: discharger.NewAPIHandler,
 	V1:         v1.NewAPIHandler,
+	V2:         v2.NewAPIHandler,
 }
 
 // Versions returns all known API version strings in alphabetical order.
@@ -47,6 +66,71 @@ func Versions() []string {
 	return vs
 }
 
+// CanaryParams holds the configuration of the synthetic login monitor.
+type CanaryParams = canary.Params
+
+// ThrottleParams holds the configuration of the discharge request
+// limiter.
+type ThrottleParams = throttle.Params
+
+// LoginChallengeParams holds the configuration of the challenge
+// required after repeated failed logins.
+type LoginChallengeParams = challenge.Params
+
+// LoginLockoutParams holds the configuration of the lockout of
+// usernames after repeated failed logins.
+type LoginLockoutParams = lockout.Params
+
+// ConsentParams holds the configuration of the consent users must give
+// before their attributes are released to relying services.
+type ConsentParams = consent.Params
+
+// ConsentService holds the consent configuration of a relying service.
+type ConsentService = consent.Service
+
+// KeyRotationParams holds the configuration of bakery key rotation.
+type KeyRotationParams = keyring.RotationParams
+
+// JWTParams holds the configuration of the JSON Web Tokens issued in
+// exchange for Candid macaroons.
+type JWTParams = jwt.Params
+
+// MeetingDiscoveryParams holds the configuration of the discovery of
+// other identity servers through the meeting store.
+type MeetingDiscoveryParams = meeting.DiscoveryParams
+
+// MeetingPollParams holds the configuration of the completion of
+// interactive logins through the meeting store.
+type MeetingPollParams = meeting.PollParams
+
+// MeetingRPCParams holds the configuration of the security of the
+// requests that identity servers make to one another to complete
+// interactive logins.
+type MeetingRPCParams = meeting.RPCParams
+
+// IdentityCacheParams holds the configuration of the cache of
+// identities fetched from the store.
+type IdentityCacheParams = cachestore.Params
+
+// CORSParams holds the cross-origin resource sharing policy of the
+// server.
+type CORSParams = cors.Params
+
+// SecurityHeadersParams holds the security headers of the HTML pages
+// served by the server.
+type SecurityHeadersParams = secheaders.Params
+
+// WaitLimitParams holds the limits on requests that wait for
+// interactive logins to complete.
+type WaitLimitParams = waitlimit.Params
+
+// RememberBrowserParams holds the policy for remembering browsers.
+type RememberBrowserParams = remember.Params
+
+// IdentityAttribute holds the definition of a custom identity
+// attribute.
+type IdentityAttribute = attrschema.Attribute
+
 // ServerParams contains configuration parameters for a server.
 type ServerParams struct {
 	// MeetingStore holds the storage that will be used to store
@@ -89,6 +173,10 @@ type ServerParams struct {
 	// TODO remove this.
 	DebugTeams []string
 
+	// DebugEndpoints enables the runtime debug endpoints, and allows
+	// users in the debug ACL to use the pprof endpoints.
+	DebugEndpoints bool
+
 	// AdminAgentPublicKey contains the public key of the admin agent.
 	AdminAgentPublicKey *bakery.PublicKey
 
@@ -104,6 +192,11 @@ type ServerParams struct {
 	// executed as part of a /debug/status check.
 	DebugStatusCheckerFuncs []debugstatus.CheckerFunc
 
+	// HealthCheckTimeout holds the maximum time that each readiness
+	// check run by the /readyz endpoint may take. If this is zero, a
+	// default of five seconds is used.
+	HealthCheckTimeout time.Duration
+
 	// RendezvousTimeout holds the time after which an interactive discharge wait
 	// request will time out.
 	RendezvousTimeout time.Duration
@@ -113,9 +206,17 @@ type ServerParams struct {
 
 	// RedirectLoginWhitelist contains a list of URLs that are
 	// trusted to be used as return_to URLs during an interactive
-	// login.
+	// login. URLs with the origin of a registered relying service
+	// are also trusted.
 	RedirectLoginWhitelist []string
 
+	// RedirectLoginPatterns contains patterns, of the form
+	// scheme://host[:port][/path], that match further URLs that are
+	// trusted to be used as return_to URLs. The host may start with
+	// "*." to match all its subdomains, and URLs match if their path
+	// is at or below the pattern's path.
+	RedirectLoginPatterns []string
+
 	// APIMacaroonTimeout is the maximum life of an API macaroon.
 	APIMacaroonTimeout time.Duration
 
@@ -126,6 +227,202 @@ type ServerParams struct {
 	// DischargeTokenTimeout is the maximum life of a Discharge
 	// token.
 	DischargeTokenTimeout time.Duration
+
+	// RequestDurationBuckets holds the buckets, in seconds, of the
+	// histogram used to record the duration of web requests. If
+	// this is empty then a default set of buckets will be used.
+	RequestDurationBuckets []float64
+
+	// MeetingCompletedBuckets holds the buckets, in microseconds, of
+	// the histogram used to record the time taken to complete
+	// interactive login rendezvous. If this is empty then a default
+	// set of buckets will be used.
+	MeetingCompletedBuckets []float64
+
+	// MetricExemplars holds whether the ID of each web request is
+	// recorded as an exemplar in the request duration histogram. If
+	// this is set the metrics are served in the OpenMetrics format
+	// to clients that request it, as exemplars cannot be served in
+	// any other format.
+	MetricExemplars bool
+
+	// Canary holds the configuration of the synthetic login monitor.
+	// If Canary.Interval is zero then the monitor is not run.
+	Canary canary.Params
+
+	// DeclaredAttributes holds, for each relying service identified
+	// by its public key, the identity attributes that are declared
+	// in discharge macaroons issued to that service. Valid
+	// attributes are "email", "groups" and "full-name". The username
+	// is always declared. Services not listed only receive the
+	// username.
+	DeclaredAttributes map[bakery.PublicKey][]string
+
+	// Consent holds the configuration of the consent users must
+	// give before the first discharge for a relying service.
+	Consent consent.Params
+
+	// ExtraInfoEncryption holds the configuration of the extra-info
+	// items that are encrypted at rest. Access to these items is
+	// restricted to members of the read-sensitive-extra-info and
+	// write-sensitive-extra-info ACLs.
+	ExtraInfoEncryption attrcrypt.Params
+
+	// ProviderDataEncrypter, if set, is used to encrypt all values
+	// written to the ProviderDataStore, such as OAuth refresh tokens
+	// held by identity providers.
+	ProviderDataEncrypter attrcrypt.Encrypter
+
+	// DischargeThrottle holds the configuration of the limit on
+	// concurrent discharge requests. When the limit is reached,
+	// requests are queued per relying service, identified by the
+	// string form of its public key, and admitted fairly according
+	// to the configured weights.
+	DischargeThrottle throttle.Params
+
+	// LoginChallenge holds the configuration of the challenge that
+	// users of login forms must complete after repeated failed
+	// logins, from a single address or for a single username. If
+	// LoginChallenge.Type is empty no challenge is required.
+	LoginChallenge challenge.Params
+
+	// LoginLockout holds the configuration of the lockout of
+	// usernames after repeated failed password logins. If
+	// LoginLockout.MaxFailures is zero usernames are never locked
+	// out.
+	LoginLockout lockout.Params
+
+	// KeyRotation holds the configuration of rotation of the bakery
+	// key pair. When enabled, Key is only used if no key pairs have
+	// been stored.
+	KeyRotation keyring.RotationParams
+
+	// CookieDomains holds the domains that cookies set by the server
+	// may be scoped to. When the server is reached by more than one
+	// host name, a cookie is scoped to the longest of these domains
+	// that contains the request host, or to the request host alone
+	// if there is none.
+	CookieDomains []string
+
+	// RequestIDHeader holds the name of the HTTP header used to
+	// carry request IDs. A valid ID in this header of an incoming
+	// request, for example one set by a load balancer, is used as
+	// the ID of the request; otherwise a new ID is generated. The ID
+	// is returned in the same header of the response and is included
+	// in log messages about the request. If this is empty,
+	// "X-Request-Id" is used.
+	RequestIDHeader string
+
+	// IDPBranding holds the branding, such as replacement templates
+	// and static assets, used on the pages shown when logging in
+	// through an identity provider, keyed by identity provider name.
+	// Identity providers without an entry use Template and
+	// StaticFileSystem unchanged.
+	IDPBranding map[string]idp.Branding
+
+	// EmailDomainIDPs maps email domains to the names of the
+	// identity providers that users with email addresses in those
+	// domains log in with. When a browser login is started with a
+	// login hint holding such an email address, the user is sent
+	// straight to the identity provider instead of being asked to
+	// choose one.
+	EmailDomainIDPs map[string]string
+
+	// EditableProfileFields holds the fields of their own identity
+	// that users may change on their profile page, any of "name"
+	// and "email". If this is nil, both fields may be changed.
+	EditableProfileFields []string
+
+	// JWT holds the configuration of the JSON Web Tokens issued in
+	// exchange for Candid macaroons. If JWT.Audiences is empty no
+	// tokens are issued.
+	JWT jwt.Params
+
+	// MeetingDiscovery holds the configuration of the discovery of
+	// other identity servers through the meeting store. When it is
+	// enabled PrivateAddr may be empty.
+	MeetingDiscovery meeting.DiscoveryParams
+
+	// MeetingPoll holds the configuration of the completion of
+	// interactive logins through the meeting store, for
+	// deployments where identity servers cannot contact one
+	// another directly. When it is enabled PrivateAddr may be
+	// empty.
+	MeetingPoll meeting.PollParams
+
+	// MeetingRPC holds the configuration of the security of the
+	// requests that identity servers make to one another to
+	// complete interactive logins.
+	MeetingRPC meeting.RPCParams
+
+	// RendezvousExpiry holds the time after which an interactive
+	// login that has not completed is removed. If it is zero, a
+	// default of one hour is used.
+	RendezvousExpiry time.Duration
+
+	// RendezvousGCInterval holds the interval at which interactive
+	// logins that have expired are removed. If it is zero, a
+	// default of 30 seconds is used.
+	RendezvousGCInterval time.Duration
+
+	// IdentityCache holds the configuration of the cache of
+	// identities fetched from Store. If its Size is zero,
+	// identities are not cached.
+	IdentityCache cachestore.Params
+
+	// ResponseCacheTTL holds the length of time for which responses
+	// to requests for a user and their groups are cached. If it is
+	// zero, responses are not cached.
+	ResponseCacheTTL time.Duration
+
+	// CORS holds the cross-origin resource sharing policy of the
+	// server.
+	CORS cors.Params
+
+	// CookieSameSite holds the SameSite attribute of the cookies set
+	// by the server during login.
+	CookieSameSite http.SameSite
+
+	// CookieSecure holds whether the cookies set by the server
+	// during login are only sent over HTTPS.
+	CookieSecure bool
+
+	// SecurityHeaders holds the security headers, such as the
+	// content security policy, of HTML pages served by the server.
+	SecurityHeaders secheaders.Params
+
+	// WaitLimit holds the limits on requests that wait for
+	// interactive logins to complete.
+	WaitLimit waitlimit.Params
+
+	// DisableLegacyInteraction holds whether clients are prevented
+	// from using the legacy visit-wait interaction protocol.
+	DisableLegacyInteraction bool
+
+	// RememberBrowser holds the policy for remembering the browsers
+	// of users that ask for it, so that they can log in again
+	// without visiting their identity provider.
+	RememberBrowser remember.Params
+
+	// Notifier holds the notifier used to send notifications, such
+	// as email verification and password reset messages. If it is
+	// nil no notifications are sent.
+	Notifier *notify.Notifier
+
+	// GeoIPDatabase holds the path of a MaxMind database used to
+	// find the country of clients. If it is empty the country of
+	// clients is not known.
+	GeoIPDatabase string
+
+	// TrustedProxies holds the addresses, in CIDR notation, of
+	// reverse proxies whose X-Forwarded-For headers are trusted when
+	// determining the address of a client.
+	TrustedProxies []string
+
+	// Attributes holds the definitions of the custom identity
+	// attributes, which are stored as extra-info items and may be
+	// declared in discharge macaroons.
+	Attributes []attrschema.Attribute
 }
 
 // NewServer returns a new handler that handles identity service requests and
@@ -154,5 +451,12 @@ func NewServer(params ServerParams, serveVersions ...string) (HandlerCloser, err
 
 type HandlerCloser interface {
 	http.Handler
+
+	// Shutdown stops the handler accepting new logins and waits,
+	// until the context is done, for logins in progress to
+	// complete. It should be called before the HTTP server is shut
+	// down.
+	Shutdown(ctx context.Context) error
+
 	Close()
 }
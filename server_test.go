@@ -54,7 +54,7 @@ type versionResponse struct {
 }
 
 func (s *serverSuite) TestVersions(c *qt.C) {
-	c.Assert(candid.Versions(), qt.DeepEquals, []string{"debug", "discharger", "v1"})
+	c.Assert(candid.Versions(), qt.DeepEquals, []string{"debug", "discharger", "v1", "v2"})
 }
 
 func (s *serverSuite) TestNewServerWithVersions(c *qt.C) {
@@ -0,0 +1,67 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// access-requests.js makes, approves and denies requests for group
+// membership from the access requests page. Requests are authenticated
+// with the identity cookie set when the user logged in.
+(function() {
+  var form = document.getElementById('request-access');
+  if (!form) {
+    return;
+  }
+
+  function api(method, path, body) {
+    return fetch(path, {
+      method: method,
+      credentials: 'same-origin',
+      headers: {
+        'Bakery-Protocol-Version': '2',
+        'Content-Type': 'application/json'
+      },
+      body: JSON.stringify(body)
+    }).then(function(resp) {
+      if (!resp.ok) {
+        return resp.json().catch(function() {
+          return {message: resp.statusText};
+        }).then(function(err) {
+          throw new Error(err.message || resp.statusText);
+        });
+      }
+    });
+  }
+
+  function requestPath(username, group) {
+    return 'v1/u/' + encodeURIComponent(username) + '/access-requests/' + encodeURIComponent(group);
+  }
+
+  form.addEventListener('submit', function(ev) {
+    ev.preventDefault();
+    var username = form.getAttribute('data-username');
+    var group = document.getElementById('request-group').value.trim();
+    var reason = document.getElementById('request-reason').value;
+    api('PUT', requestPath(username, group), {reason: reason}).then(function() {
+      window.location.reload();
+    }).catch(function(err) {
+      window.alert('Cannot request membership: ' + err.message);
+    });
+  });
+
+  var pending = document.getElementById('pending');
+  if (!pending) {
+    return;
+  }
+  var buttons = pending.querySelectorAll('button[data-decision]');
+  Array.prototype.forEach.call(buttons, function(button) {
+    button.addEventListener('click', function() {
+      var path = requestPath(button.getAttribute('data-username'), button.getAttribute('data-group'));
+      button.disabled = true;
+      api('POST', path + '/' + button.getAttribute('data-decision'), {}).then(function() {
+        var row = button.closest('tr');
+        row.parentNode.removeChild(row);
+      }).catch(function(err) {
+        button.disabled = false;
+        window.alert('Cannot ' + button.getAttribute('data-decision') + ' request: ' + err.message);
+      });
+    });
+  });
+})();
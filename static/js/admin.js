@@ -0,0 +1,247 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// admin.js drives the administration dashboard. All requests are made
+// to the /v1 API and are authenticated with the identity cookie set
+// when the user logged in.
+(function() {
+  var root = document.getElementById('admin');
+  if (!root) {
+    return;
+  }
+
+  // api makes a request to the given API path and returns a promise
+  // for the response.
+  function api(method, path, body) {
+    var init = {
+      method: method,
+      credentials: 'same-origin',
+      headers: {'Bakery-Protocol-Version': '2'}
+    };
+    if (body !== undefined) {
+      init.headers['Content-Type'] = 'application/json';
+      init.body = JSON.stringify(body);
+    }
+    return fetch(path, init).then(function(resp) {
+      if (!resp.ok) {
+        return resp.json().catch(function() {
+          return {message: resp.statusText};
+        }).then(function(err) {
+          throw new Error(err.message || resp.statusText);
+        });
+      }
+      return resp;
+    });
+  }
+
+  function json(resp) {
+    return resp.json();
+  }
+
+  function userPath(username) {
+    return 'v1/u/' + encodeURIComponent(username);
+  }
+
+  function fail(what) {
+    return function(err) {
+      window.alert(what + ': ' + err.message);
+    };
+  }
+
+  function el(tag, text) {
+    var e = document.createElement(tag);
+    if (text !== undefined) {
+      e.textContent = text;
+    }
+    return e;
+  }
+
+  function clear(e) {
+    while (e.firstChild) {
+      e.removeChild(e.firstChild);
+    }
+  }
+
+  function byId(id) {
+    return document.getElementById(id);
+  }
+
+  // Tabs.
+  var tabs = root.querySelectorAll('.p-tabs__link');
+  Array.prototype.forEach.call(tabs, function(tab) {
+    tab.addEventListener('click', function(ev) {
+      ev.preventDefault();
+      Array.prototype.forEach.call(tabs, function(t) {
+        var selected = t === tab;
+        t.setAttribute('aria-selected', selected ? 'true' : 'false');
+        byId(t.getAttribute('href').slice(1)).hidden = !selected;
+      });
+      if (tab.getAttribute('href') === '#audit') {
+        loadAudit();
+      }
+    });
+  });
+
+  // Users.
+  var cursor = '';
+  var query = '';
+
+  function search(more) {
+    var path = 'v1/search?q=' + encodeURIComponent(query);
+    if (more) {
+      path += '&cursor=' + encodeURIComponent(cursor);
+    }
+    api('GET', path).then(function(resp) {
+      cursor = resp.headers.get('Candid-Next-Cursor') || '';
+      byId('search-more').hidden = !cursor;
+      return resp.json();
+    }).then(function(users) {
+      var list = byId('search-results');
+      if (!more) {
+        clear(list);
+      }
+      users.forEach(function(u) {
+        var item = el('li');
+        item.className = 'p-list__item';
+        var link = el('a', u.username);
+        link.href = '#';
+        link.addEventListener('click', function(ev) {
+          ev.preventDefault();
+          showUser(u.username);
+        });
+        item.appendChild(link);
+        if (u.fullname || u.email) {
+          item.appendChild(el('span', ' ' + [u.fullname, u.email].filter(Boolean).join(' - ')));
+        }
+        list.appendChild(item);
+      });
+    }).catch(fail('Cannot search users'));
+  }
+
+  byId('search').addEventListener('submit', function(ev) {
+    ev.preventDefault();
+    query = byId('search-text').value;
+    search(false);
+  });
+  byId('search-more').addEventListener('click', function() {
+    search(true);
+  });
+
+  var current = '';
+
+  function showUser(username) {
+    api('GET', userPath(username)).then(json).then(function(u) {
+      current = username;
+      byId('user').hidden = false;
+      byId('user-username').textContent = u.username;
+      byId('user-fullname').textContent = u.fullname || '';
+      byId('user-email').textContent = u.email || '';
+      byId('user-external-id').textContent = u.external_id || '';
+      byId('user-owner').textContent = u.owner || '';
+      byId('user-last-login').textContent = u.last_login || '';
+      byId('user-last-discharge').textContent = u.last_discharge || '';
+      byId('groups-text').value = (u.idpgroups || []).join('\n');
+      byId('agent').hidden = true;
+      return api('GET', 'v1/u?owner=' + encodeURIComponent(username)).then(json);
+    }).then(function(agents) {
+      var list = byId('agents');
+      clear(list);
+      if (agents.length === 0) {
+        list.appendChild(el('li', 'None'));
+      }
+      agents.forEach(function(agent) {
+        var item = el('li');
+        item.className = 'p-list__item';
+        var link = el('a', agent);
+        link.href = '#';
+        link.addEventListener('click', function(ev) {
+          ev.preventDefault();
+          showAgent(agent);
+        });
+        item.appendChild(link);
+        list.appendChild(item);
+      });
+    }).catch(fail('Cannot show user'));
+  }
+
+  byId('groups').addEventListener('submit', function(ev) {
+    ev.preventDefault();
+    var groups = byId('groups-text').value.split('\n').map(function(g) {
+      return g.trim();
+    }).filter(Boolean);
+    api('PUT', userPath(current) + '/groups', {groups: groups}).then(function() {
+      showUser(current);
+    }).catch(fail('Cannot set groups'));
+  });
+
+  function showAgent(username) {
+    api('GET', userPath(username) + '/agent-keys').then(json).then(function(resp) {
+      byId('agent').hidden = false;
+      byId('agent-username').textContent = username;
+      var body = byId('agent-keys');
+      clear(body);
+      (resp.keys || []).forEach(function(k) {
+        var row = el('tr');
+        row.appendChild(el('td', k['public-key']));
+        row.appendChild(el('td', k.expires || 'Never'));
+        var cell = el('td');
+        var button = el('button', 'Remove');
+        button.className = 'p-button--negative u-no-margin--bottom';
+        button.addEventListener('click', function() {
+          button.disabled = true;
+          api('DELETE', userPath(username) + '/agent-keys?public-key=' + encodeURIComponent(k['public-key'])).then(function() {
+            showAgent(username);
+          }).catch(function(err) {
+            button.disabled = false;
+            fail('Cannot remove key')(err);
+          });
+        });
+        cell.appendChild(button);
+        row.appendChild(cell);
+        body.appendChild(row);
+      });
+    }).catch(fail('Cannot show agent'));
+  }
+
+  // Audit events.
+  function loadAudit() {
+    api('GET', 'v1/audit?limit=200').then(json).then(function(entries) {
+      var body = byId('audit-events');
+      clear(body);
+      entries.forEach(function(e) {
+        var row = el('tr');
+        row.appendChild(el('td', e.time));
+        row.appendChild(el('td', e.level));
+        row.appendChild(el('td', e.message));
+        body.appendChild(row);
+      });
+    }).catch(fail('Cannot load audit events'));
+  }
+  byId('audit-refresh').addEventListener('click', loadAudit);
+
+  // Metrics. Only the candid metrics are shown, the Go runtime and
+  // process metrics are left to a proper monitoring system.
+  function loadMetrics() {
+    if (byId('metrics').hidden) {
+      return;
+    }
+    fetch('metrics', {credentials: 'same-origin'}).then(function(resp) {
+      return resp.text();
+    }).then(function(text) {
+      var body = byId('metrics-values');
+      clear(body);
+      text.split('\n').forEach(function(line) {
+        if (line.indexOf('candid_') !== 0) {
+          return;
+        }
+        var i = line.lastIndexOf(' ');
+        var row = el('tr');
+        row.appendChild(el('td', line.slice(0, i)));
+        row.appendChild(el('td', line.slice(i + 1)));
+        body.appendChild(row);
+      });
+    });
+  }
+  window.setInterval(loadMetrics, 10000);
+  root.querySelector('a[href="#metrics"]').addEventListener('click', loadMetrics);
+})();
@@ -0,0 +1,46 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// me.js saves the changes made on the profile page. The request is
+// authenticated with the identity cookie set when the user logged in.
+(function() {
+  var form = document.getElementById('profile');
+  if (!form) {
+    return;
+  }
+  form.addEventListener('submit', function(ev) {
+    ev.preventDefault();
+    var body = {};
+    Array.prototype.forEach.call(form.querySelectorAll('input'), function(input) {
+      if (!input.disabled && input.value !== input.defaultValue) {
+        body[input.name] = input.value;
+      }
+    });
+    var button = form.querySelector('button');
+    button.disabled = true;
+    fetch('v1/me', {
+      method: 'PUT',
+      credentials: 'same-origin',
+      headers: {
+        'Bakery-Protocol-Version': '2',
+        'Content-Type': 'application/json'
+      },
+      body: JSON.stringify(body)
+    }).then(function(resp) {
+      if (!resp.ok) {
+        return resp.json().catch(function() {
+          return {message: resp.statusText};
+        }).then(function(err) {
+          throw new Error(err.message || resp.statusText);
+        });
+      }
+      Array.prototype.forEach.call(form.querySelectorAll('input'), function(input) {
+        input.defaultValue = input.value;
+      });
+    }).catch(function(err) {
+      window.alert('Cannot save profile: ' + err.message);
+    }).then(function() {
+      button.disabled = false;
+    });
+  });
+})();
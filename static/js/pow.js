@@ -0,0 +1,57 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// pow.js solves the proof of work challenge in the login form before it
+// is submitted. A solution is a counter such that the SHA-256 hash of
+// nonce + ":" + counter has the required number of leading zero bits.
+(function() {
+  var nonce = document.getElementById('pow-nonce');
+  var solution = document.getElementById('pow-solution');
+  if (!nonce || !solution || !window.crypto || !window.crypto.subtle) {
+    return;
+  }
+  var form = nonce.form;
+  var difficulty = parseInt(nonce.getAttribute('data-difficulty'), 10);
+  var encoder = new TextEncoder();
+
+  function leadingZeros(buf) {
+    var bytes = new Uint8Array(buf);
+    var n = 0;
+    for (var i = 0; i < bytes.length; i++) {
+      if (bytes[i] === 0) {
+        n += 8;
+        continue;
+      }
+      var b = bytes[i];
+      while ((b & 0x80) === 0) {
+        n++;
+        b <<= 1;
+      }
+      break;
+    }
+    return n;
+  }
+
+  async function solve() {
+    for (var counter = 0; ; counter++) {
+      var data = encoder.encode(nonce.value + ':' + counter);
+      var sum = await window.crypto.subtle.digest('SHA-256', data);
+      if (leadingZeros(sum) >= difficulty) {
+        return String(counter);
+      }
+    }
+  }
+
+  var solved = false;
+  form.addEventListener('submit', function(ev) {
+    if (solved) {
+      return;
+    }
+    ev.preventDefault();
+    solve().then(function(s) {
+      solution.value = s;
+      solved = true;
+      form.submit();
+    });
+  });
+})();
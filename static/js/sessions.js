@@ -0,0 +1,33 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// sessions.js ends sessions listed on the sessions page. The request is
+// authenticated with the identity cookie set when the user logged in.
+(function() {
+  var table = document.getElementById('sessions');
+  if (!table) {
+    return;
+  }
+  var username = table.getAttribute('data-username');
+  var buttons = table.querySelectorAll('button[data-session]');
+  Array.prototype.forEach.call(buttons, function(button) {
+    button.addEventListener('click', function() {
+      var id = button.getAttribute('data-session');
+      button.disabled = true;
+      fetch('v1/u/' + encodeURIComponent(username) + '/sessions/' + encodeURIComponent(id), {
+        method: 'DELETE',
+        credentials: 'same-origin',
+        headers: {'Bakery-Protocol-Version': '2'}
+      }).then(function(resp) {
+        if (!resp.ok) {
+          throw new Error(resp.statusText);
+        }
+        var row = button.closest('tr');
+        row.parentNode.removeChild(row);
+      }).catch(function(err) {
+        button.disabled = false;
+        window.alert('Cannot end session: ' + err.message);
+      });
+    });
+  });
+})();
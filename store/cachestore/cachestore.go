@@ -0,0 +1,339 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package cachestore provides a store.Store implementation that caches
+// the results of identity lookups made on another store.Store.
+package cachestore
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/juju/clock"
+	"github.com/juju/loggo"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+var logger = loggo.GetLogger("candid.store.cachestore")
+
+// Clock holds the clock used to determine when cache entries expire.
+// It is a variable so that it can be replaced in tests.
+var Clock clock.Clock = clock.WallClock
+
+// retryInterval holds the time to wait before listening for change
+// notifications again after the listener has failed.
+var retryInterval = 10 * time.Second
+
+// Params holds the configuration of an identity cache.
+type Params struct {
+	// Size holds the maximum number of identities held in the
+	// cache. If it is zero no cache is used.
+	Size int
+
+	// TTL holds the maximum length of time that an identity is held
+	// in the cache. If it is zero, identities are held until they
+	// are evicted or invalidated.
+	TTL time.Duration
+}
+
+// Store is a store.Store that caches the identities returned from the
+// Identity method of another store.Store. Cached identities are
+// invalidated when they are updated through the Store and, if the
+// underlying store implements store.IdentityNotifier, when they are
+// updated by any other server using the same storage.
+type Store struct {
+	store.Store
+	params Params
+	cancel func()
+	done   chan struct{}
+
+	// mu protects the fields below it.
+	mu sync.Mutex
+
+	// entries holds the cached identities, most recently used
+	// first. The value of each element is an *entry.
+	entries *list.List
+
+	// keys holds the elements of entries indexed by each of the
+	// keys that identify them.
+	keys map[string]*list.Element
+
+	// generation is incremented every time an identity is
+	// invalidated. It is used to avoid caching an identity that
+	// was changed while it was being fetched.
+	generation uint64
+}
+
+type entry struct {
+	identity store.Identity
+	expires  time.Time
+	keys     []string
+}
+
+// New returns a new Store that caches identities fetched from the
+// given store. The returned Store must be closed after use.
+func New(st store.Store, p Params) *Store {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Store{
+		Store:   st,
+		params:  p,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		entries: list.New(),
+		keys:    make(map[string]*list.Element),
+	}
+	if n, ok := st.(store.IdentityNotifier); ok {
+		go s.notifyLoop(ctx, n)
+	} else {
+		close(s.done)
+	}
+	return s
+}
+
+// Close stops the Store listening for changes to identities.
+func (s *Store) Close() {
+	s.cancel()
+	<-s.done
+}
+
+// Identity implements store.Store.Identity by returning a cached copy
+// of the identity if there is one and otherwise fetching it from the
+// underlying store.
+func (s *Store) Identity(ctx context.Context, identity *store.Identity) error {
+	key := lookupKey(identity)
+	if key == "" {
+		return errgo.Mask(s.Store.Identity(ctx, identity), errgo.Any)
+	}
+	s.mu.Lock()
+	e := s.get(key)
+	if e != nil {
+		copyIdentity(identity, &e.identity)
+	}
+	generation := s.generation
+	s.mu.Unlock()
+	if e != nil {
+		return nil
+	}
+	if err := s.Store.Identity(ctx, identity); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.generation == generation {
+		s.add(identity)
+	}
+	return nil
+}
+
+// UpdateIdentity implements store.Store.UpdateIdentity by updating the
+// identity in the underlying store and invalidating any cached copy.
+func (s *Store) UpdateIdentity(ctx context.Context, identity *store.Identity, update store.Update) error {
+	if store.IsDischargeUpdate(update) {
+		// The discharge time is updated every time a user
+		// obtains a discharge, so rather than discarding the
+		// cached identity just update it.
+		if err := s.Store.UpdateIdentity(ctx, identity, update); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		s.setLastDischarge(identity)
+		return nil
+	}
+	defer s.invalidate(identity)
+	return errgo.Mask(s.Store.UpdateIdentity(ctx, identity, update), errgo.Any)
+}
+
+// UpdateIdentities implements store.Store.UpdateIdentities by updating
+// the identities in the underlying store and invalidating any cached
+// copies.
+func (s *Store) UpdateIdentities(ctx context.Context, identities []*store.Identity, update store.Update) error {
+	defer func() {
+		for _, identity := range identities {
+			s.invalidate(identity)
+		}
+	}()
+	return errgo.Mask(s.Store.UpdateIdentities(ctx, identities, update), errgo.Any)
+}
+
+// notifyLoop invalidates cached identities as they are changed in the
+// underlying store until the given context is canceled.
+func (s *Store) notifyLoop(ctx context.Context, n store.IdentityNotifier) {
+	defer close(s.done)
+	ids := make(chan string)
+	go func() {
+		for {
+			err := n.NotifyIdentityChanges(ctx, ids)
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Errorf("cannot receive identity change notifications: %s", err)
+			// Changes will have been missed.
+			s.invalidateAll()
+			select {
+			case <-Clock.After(retryInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case id := <-ids:
+			if id == "" {
+				s.invalidateAll()
+			} else {
+				s.invalidate(&store.Identity{ID: id})
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// get returns the unexpired cache entry with the given key, if there
+// is one. It must be called with s.mu held.
+func (s *Store) get(key string) *entry {
+	elem := s.keys[key]
+	if elem == nil {
+		return nil
+	}
+	e := elem.Value.(*entry)
+	if !e.expires.IsZero() && !Clock.Now().Before(e.expires) {
+		s.remove(elem)
+		return nil
+	}
+	s.entries.MoveToFront(elem)
+	return e
+}
+
+// add adds a copy of the given identity to the cache, evicting the
+// least recently used identity if the cache is full. It must be called
+// with s.mu held.
+func (s *Store) add(identity *store.Identity) {
+	if s.params.Size <= 0 {
+		return
+	}
+	e := &entry{
+		keys: identityKeys(identity),
+	}
+	copyIdentity(&e.identity, identity)
+	if s.params.TTL > 0 {
+		e.expires = Clock.Now().Add(s.params.TTL)
+	}
+	for _, key := range e.keys {
+		if elem := s.keys[key]; elem != nil {
+			s.remove(elem)
+		}
+	}
+	for s.entries.Len() >= s.params.Size {
+		s.remove(s.entries.Back())
+	}
+	elem := s.entries.PushFront(e)
+	for _, key := range e.keys {
+		s.keys[key] = elem
+	}
+}
+
+// remove removes the given element from the cache. It must be called
+// with s.mu held.
+func (s *Store) remove(elem *list.Element) {
+	s.entries.Remove(elem)
+	for _, key := range elem.Value.(*entry).keys {
+		if s.keys[key] == elem {
+			delete(s.keys, key)
+		}
+	}
+}
+
+// invalidate removes any cached copy of the given identity.
+func (s *Store) invalidate(identity *store.Identity) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+	for _, key := range identityKeys(identity) {
+		if elem := s.keys[key]; elem != nil {
+			s.remove(elem)
+		}
+	}
+}
+
+// setLastDischarge updates the LastDischarge time of any cached copy
+// of the given identity.
+func (s *Store) setLastDischarge(identity *store.Identity) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range identityKeys(identity) {
+		if elem := s.keys[key]; elem != nil {
+			elem.Value.(*entry).identity.LastDischarge = identity.LastDischarge
+			return
+		}
+	}
+}
+
+// invalidateAll removes all cached identities.
+func (s *Store) invalidateAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+	s.entries.Init()
+	s.keys = make(map[string]*list.Element)
+}
+
+// lookupKey returns the key that the store uses to find the given
+// identity, or "" if the identity is not specified.
+func lookupKey(identity *store.Identity) string {
+	switch {
+	case identity.ID != "":
+		return "id:" + identity.ID
+	case identity.ProviderID != "":
+		return "providerid:" + string(identity.ProviderID)
+	case identity.Username != "":
+		return "username:" + identity.Username
+	}
+	return ""
+}
+
+// identityKeys returns all the keys that can be used to find the given
+// identity.
+func identityKeys(identity *store.Identity) []string {
+	var keys []string
+	if identity.ID != "" {
+		keys = append(keys, "id:"+identity.ID)
+	}
+	if identity.ProviderID != "" {
+		keys = append(keys, "providerid:"+string(identity.ProviderID))
+	}
+	if identity.Username != "" {
+		keys = append(keys, "username:"+identity.Username)
+	}
+	return keys
+}
+
+// copyIdentity makes dst a copy of src that shares no mutable data with
+// it.
+func copyIdentity(dst, src *store.Identity) {
+	*dst = *src
+	if src.Groups != nil {
+		dst.Groups = append([]string{}, src.Groups...)
+	}
+	if src.PublicKeys != nil {
+		dst.PublicKeys = append([]bakery.PublicKey{}, src.PublicKeys...)
+	}
+	dst.ProviderInfo = copyMap(src.ProviderInfo)
+	dst.ExtraInfo = copyMap(src.ExtraInfo)
+}
+
+func copyMap(m map[string][]string) map[string][]string {
+	if m == nil {
+		return nil
+	}
+	m1 := make(map[string][]string, len(m))
+	for k, v := range m {
+		m1[k] = append([]string{}, v...)
+	}
+	return m1
+}
@@ -0,0 +1,311 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cachestore_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/clock/testclock"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/store"
+	"github.com/CanonicalLtd/candid/store/cachestore"
+	"github.com/CanonicalLtd/candid/store/memstore"
+	"github.com/CanonicalLtd/candid/store/storetest"
+)
+
+func TestStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestStore(c, func(c *qt.C) store.Store {
+		s := cachestore.New(memstore.NewStore(), cachestore.Params{
+			Size: 10,
+		})
+		c.Defer(s.Close)
+		return s
+	})
+}
+
+func TestIdentityCached(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	ctx := context.Background()
+	st := newCountingStore(c)
+	s := cachestore.New(st, cachestore.Params{
+		Size: 10,
+	})
+	defer s.Close()
+
+	for i := 0; i < 3; i++ {
+		identity := store.Identity{
+			Username: "bob",
+		}
+		err := s.Identity(ctx, &identity)
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(identity.Name, qt.Equals, "Bob")
+	}
+	c.Assert(st.count, qt.Equals, 1)
+
+	// The cached identity can be found by any of its keys.
+	identity := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+	}
+	err := s.Identity(ctx, &identity)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(identity.Username, qt.Equals, "bob")
+	c.Assert(st.count, qt.Equals, 1)
+
+	// Modifying the returned identity does not change the cache.
+	identity.Groups[0] = "changed"
+	identity = store.Identity{
+		Username: "bob",
+	}
+	err = s.Identity(ctx, &identity)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(identity.Groups, qt.DeepEquals, []string{"group1"})
+}
+
+func TestIdentityNotFoundNotCached(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	ctx := context.Background()
+	st := newCountingStore(c)
+	s := cachestore.New(st, cachestore.Params{
+		Size: 10,
+	})
+	defer s.Close()
+
+	for i := 0; i < 2; i++ {
+		err := s.Identity(ctx, &store.Identity{Username: "alice"})
+		c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	}
+	c.Assert(st.count, qt.Equals, 2)
+}
+
+func TestUpdateIdentityInvalidates(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	ctx := context.Background()
+	st := newCountingStore(c)
+	s := cachestore.New(st, cachestore.Params{
+		Size: 10,
+	})
+	defer s.Close()
+
+	err := s.Identity(ctx, &store.Identity{Username: "bob"})
+	c.Assert(err, qt.Equals, nil)
+
+	err = s.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Name:       "Robert",
+	}, store.Update{
+		store.Name: store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	identity := store.Identity{
+		Username: "bob",
+	}
+	err = s.Identity(ctx, &identity)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(identity.Name, qt.Equals, "Robert")
+	c.Assert(st.count, qt.Equals, 2)
+}
+
+func TestDischargeUpdateKeepsCachedIdentity(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	ctx := context.Background()
+	st := newCountingStore(c)
+	s := cachestore.New(st, cachestore.Params{
+		Size: 10,
+	})
+	defer s.Close()
+
+	err := s.Identity(ctx, &store.Identity{Username: "bob"})
+	c.Assert(err, qt.Equals, nil)
+
+	t0 := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	err = s.UpdateIdentity(ctx, &store.Identity{
+		Username:      "bob",
+		LastDischarge: t0,
+	}, store.Update{
+		store.LastDischarge: store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	identity := store.Identity{
+		Username: "bob",
+	}
+	err = s.Identity(ctx, &identity)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(identity.LastDischarge.Equal(t0), qt.Equals, true)
+	c.Assert(st.count, qt.Equals, 1)
+}
+
+func TestTTL(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	clock := testclock.NewClock(time.Now())
+	c.Patch(&cachestore.Clock, clock)
+
+	ctx := context.Background()
+	st := newCountingStore(c)
+	s := cachestore.New(st, cachestore.Params{
+		Size: 10,
+		TTL:  time.Minute,
+	})
+	defer s.Close()
+
+	err := s.Identity(ctx, &store.Identity{Username: "bob"})
+	c.Assert(err, qt.Equals, nil)
+	clock.Advance(30 * time.Second)
+	err = s.Identity(ctx, &store.Identity{Username: "bob"})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(st.count, qt.Equals, 1)
+
+	clock.Advance(30 * time.Second)
+	err = s.Identity(ctx, &store.Identity{Username: "bob"})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(st.count, qt.Equals, 2)
+}
+
+func TestLRUEviction(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	ctx := context.Background()
+	st := newCountingStore(c)
+	for _, name := range []string{"alice", "charlie"} {
+		err := st.Store.UpdateIdentity(ctx, &store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", name),
+			Username:   name,
+		}, store.Update{
+			store.Username: store.Set,
+		})
+		c.Assert(err, qt.Equals, nil)
+	}
+	s := cachestore.New(st, cachestore.Params{
+		Size: 2,
+	})
+	defer s.Close()
+
+	lookup := func(username string) {
+		err := s.Identity(ctx, &store.Identity{Username: username})
+		c.Assert(err, qt.Equals, nil)
+	}
+	lookup("alice")
+	lookup("bob")
+	lookup("alice")
+	c.Assert(st.count, qt.Equals, 2)
+	// bob is the least recently used identity so is evicted.
+	lookup("charlie")
+	lookup("alice")
+	c.Assert(st.count, qt.Equals, 3)
+	lookup("bob")
+	c.Assert(st.count, qt.Equals, 4)
+}
+
+func TestNotifiedChangesInvalidate(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	ctx := context.Background()
+	st := &notifyingStore{
+		countingStore: newCountingStore(c),
+		ids:           make(chan string),
+	}
+	s := cachestore.New(st, cachestore.Params{
+		Size: 10,
+	})
+	defer s.Close()
+
+	identity := store.Identity{
+		Username: "bob",
+	}
+	err := s.Identity(ctx, &identity)
+	c.Assert(err, qt.Equals, nil)
+
+	// Change the identity without going through the cache, as
+	// another server would.
+	err = st.Store.UpdateIdentity(ctx, &store.Identity{
+		Username: "bob",
+		Name:     "Robert",
+	}, store.Update{
+		store.Name: store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+	// Send the notification three times to ensure that the first
+	// one has been processed.
+	for i := 0; i < 3; i++ {
+		st.ids <- identity.ID
+	}
+
+	identity = store.Identity{
+		Username: "bob",
+	}
+	err = s.Identity(ctx, &identity)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(identity.Name, qt.Equals, "Robert")
+	c.Assert(st.count, qt.Equals, 2)
+}
+
+// countingStore is a store.Store that counts the number of calls to
+// Identity.
+type countingStore struct {
+	store.Store
+	count int
+}
+
+func newCountingStore(c *qt.C) *countingStore {
+	st := memstore.NewStore()
+	err := st.UpdateIdentity(context.Background(), &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Name:       "Bob",
+		Groups:     []string{"group1"},
+	}, store.Update{
+		store.Username: store.Set,
+		store.Name:     store.Set,
+		store.Groups:   store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+	return &countingStore{Store: st}
+}
+
+func (s *countingStore) Identity(ctx context.Context, identity *store.Identity) error {
+	s.count++
+	return s.Store.Identity(ctx, identity)
+}
+
+// notifyingStore is a countingStore that implements
+// store.IdentityNotifier by sending the IDs it receives on ids.
+type notifyingStore struct {
+	*countingStore
+	ids chan string
+}
+
+func (s *notifyingStore) NotifyIdentityChanges(ctx context.Context, ids chan<- string) error {
+	for {
+		select {
+		case id := <-s.ids:
+			select {
+			case ids <- id:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
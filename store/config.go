@@ -1,11 +1,14 @@
 package store
 
 import (
+	"time"
+
 	"github.com/juju/aclstore/v2"
 	"github.com/juju/utils/debugstatus"
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 
+	"github.com/CanonicalLtd/candid/internal/typedyaml"
 	"github.com/CanonicalLtd/candid/meeting"
 )
 
@@ -43,12 +46,51 @@ type Backend interface {
 	Close()
 }
 
+// RootKeyPolicy holds the policy used to generate and expire the
+// root keys of bakery macaroons.
+type RootKeyPolicy struct {
+	// GenerateInterval holds the length of time for which a root key
+	// is used to mint new macaroons. If this is zero, ExpiryDuration
+	// is used.
+	GenerateInterval time.Duration
+
+	// ExpiryDuration holds the length of time for which a root key
+	// remains valid after it is created. Macaroons minted with a root
+	// key cannot be verified once it has expired, so the difference
+	// between ExpiryDuration and GenerateInterval is the overlap
+	// during which macaroons minted with an old root key continue to
+	// be accepted.
+	ExpiryDuration time.Duration
+}
+
+// A RootKeyPolicyBackend is a Backend that can create bakery root key
+// stores with a specific policy.
+type RootKeyPolicyBackend interface {
+	Backend
+
+	// BakeryRootKeyStoreWithPolicy returns a new
+	// bakery.RootKeyStore implementation that uses the backend and
+	// the given policy.
+	BakeryRootKeyStoreWithPolicy(p RootKeyPolicy) bakery.RootKeyStore
+}
+
 // BackendFactory represents a value that can create new storage
 // backend instances.
 type BackendFactory interface {
 	NewBackend() (Backend, error)
 }
 
+// Migrator is implemented by a BackendFactory whose storage has a
+// versioned schema that can be migrated without creating a backend.
+type Migrator interface {
+	BackendFactory
+
+	// Migrate applies or reverts schema migrations so that the
+	// storage schema is at the given version. If version is
+	// negative all known migrations are applied.
+	Migrate(version int) error
+}
+
 // Register is used by storage backends to register a function
 // that can be used to unmarshal parameters for a storage backend. When
 // a storage backend with the given type is used, f will be called to
@@ -69,19 +111,17 @@ type Config struct {
 }
 
 func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	var t struct {
-		Type string
-	}
-	if err := unmarshal(&t); err != nil {
+	m, err := typedyaml.Unmarshal(unmarshal)
+	if err != nil {
 		return errgo.Notef(err, "cannot unmarshal storage")
 	}
-	if storageUnmarshaler, ok := backends[t.Type]; ok {
-		bf, err := storageUnmarshaler(unmarshal)
+	if storageUnmarshaler, ok := backends[m.Type]; ok {
+		bf, err := storageUnmarshaler(m.Unmarshal)
 		if err != nil {
-			return errgo.Notef(err, "cannot unmarshal %s configuration", t.Type)
+			return errgo.Notef(err, "cannot unmarshal %s configuration", m.Type)
 		}
 		c.BackendFactory = bf
-		return err
+		return m.Err()
 	}
-	return errgo.Newf("unrecognised storage backend type %q", t.Type)
+	return errgo.Newf("unrecognised storage backend type %q", m.Type)
 }
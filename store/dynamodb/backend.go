@@ -0,0 +1,293 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package dynamodb
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/juju/aclstore/v2"
+	"github.com/juju/utils/debugstatus"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/dbrootkeystore"
+
+	"github.com/CanonicalLtd/candid/meeting"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// The names of the tables used by the backend, without the configured
+// prefix. Every table has a single string hash key named "key".
+const (
+	identitiesTable = "identities"
+	keyValueTable   = "keyvalue"
+	meetingsTable   = "meetings"
+	replicasTable   = "replicas"
+	rootKeysTable   = "rootkeys"
+)
+
+// tableTTLs holds the attribute that DynamoDB uses to remove expired
+// items from each table that has one.
+var tableTTLs = map[string]string{
+	identitiesTable: "",
+	keyValueTable:   "ttl",
+	meetingsTable:   "",
+	replicasTable:   "",
+	rootKeysTable:   "ttl",
+}
+
+// tableCreateTimeout holds the maximum length of time to wait for a
+// newly created table to become active.
+const tableCreateTimeout = 5 * time.Minute
+
+// backend provides a wrapper around a set of DynamoDB tables that can
+// be used as the persistent storage for the various types of store
+// required by the identity service.
+type backend struct {
+	c *client
+
+	// prefix holds the prefix of the table names.
+	prefix string
+
+	rootKeys *dbrootkeystore.RootKeys
+	aclStore aclstore.ACLStore
+}
+
+// newBackend creates a new backend using the tables with the given
+// prefix. If create is true, any missing tables are created.
+func newBackend(c *client, prefix string, create bool) (*backend, error) {
+	b := &backend{
+		c:        c,
+		prefix:   prefix,
+		rootKeys: dbrootkeystore.NewRootKeys(1000, nil),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tableCreateTimeout)
+	defer cancel()
+	for name, ttl := range tableTTLs {
+		if err := b.ensureTable(ctx, name, ttl, create); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	b.aclStore = aclstore.NewACLStore(&kvStore{b: b, name: "acls"})
+	return b, nil
+}
+
+// table returns the full name of the given table.
+func (b *backend) table(name string) string {
+	return b.prefix + name
+}
+
+// ensureTable waits for the given table to become active. If it does
+// not exist and create is true, the table is created and, if ttl is not
+// empty, expiry is enabled on the named attribute.
+func (b *backend) ensureTable(ctx context.Context, name, ttl string, create bool) error {
+	table := b.table(name)
+	status, err := b.tableStatus(ctx, table)
+	created := false
+	if errgo.Cause(err) == errTableNotFound && create {
+		logger.Infof("creating dynamodb table %s", table)
+		err = b.c.call(ctx, "CreateTable", createTableRequest{
+			TableName: table,
+			AttributeDefinitions: []attributeDefinition{{
+				AttributeName: "key",
+				AttributeType: "S",
+			}},
+			KeySchema: []keySchemaElement{{
+				AttributeName: "key",
+				KeyType:       "HASH",
+			}},
+			BillingMode: "PAY_PER_REQUEST",
+		}, nil)
+		if err != nil {
+			return errgo.Notef(err, "cannot create table %s", table)
+		}
+		status, created = "CREATING", true
+	} else if err != nil {
+		return errgo.Notef(err, "cannot get status of table %s", table)
+	}
+	for status != "ACTIVE" {
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return errgo.Newf("table %s not active after %v", table, tableCreateTimeout)
+		}
+		if status, err = b.tableStatus(ctx, table); err != nil {
+			return errgo.Notef(err, "cannot get status of table %s", table)
+		}
+	}
+	if !created || ttl == "" {
+		return nil
+	}
+	req := updateTimeToLiveRequest{
+		TableName: table,
+	}
+	req.TimeToLiveSpecification.AttributeName = ttl
+	req.TimeToLiveSpecification.Enabled = true
+	if err := b.c.call(ctx, "UpdateTimeToLive", req, nil); err != nil {
+		return errgo.Notef(err, "cannot enable expiry on table %s", table)
+	}
+	return nil
+}
+
+// tableStatus returns the status of the given table.
+func (b *backend) tableStatus(ctx context.Context, table string) (string, error) {
+	var resp describeTableResponse
+	if err := b.c.call(ctx, "DescribeTable", describeTableRequest{TableName: table}, &resp); err != nil {
+		return "", errgo.Mask(err, errgo.Is(errTableNotFound))
+	}
+	return resp.Table.TableStatus, nil
+}
+
+// Close implements store.Backend.Close.
+func (b *backend) Close() {
+}
+
+// Store implements store.Backend.Store.
+func (b *backend) Store() store.Store {
+	return &identityStore{b}
+}
+
+// BakeryRootKeyStore implements store.Backend.BakeryRootKeyStore.
+func (b *backend) BakeryRootKeyStore() bakery.RootKeyStore {
+	return b.BakeryRootKeyStoreWithPolicy(store.RootKeyPolicy{
+		ExpiryDuration: 365 * 24 * time.Hour,
+	})
+}
+
+// BakeryRootKeyStoreWithPolicy implements
+// store.RootKeyPolicyBackend.BakeryRootKeyStoreWithPolicy.
+func (b *backend) BakeryRootKeyStoreWithPolicy(p store.RootKeyPolicy) bakery.RootKeyStore {
+	return b.rootKeys.NewStore(rootKeyBacking{b}, dbrootkeystore.Policy{
+		GenerateInterval: p.GenerateInterval,
+		ExpiryDuration:   p.ExpiryDuration,
+	})
+}
+
+// ProviderDataStore implements store.Backend.ProviderDataStore.
+func (b *backend) ProviderDataStore() store.ProviderDataStore {
+	return &providerDataStore{b}
+}
+
+// MeetingStore implements store.Backend.MeetingStore.
+func (b *backend) MeetingStore() meeting.Store {
+	return &meetingStore{b}
+}
+
+// ACLStore implements store.Backend.ACLStore.
+func (b *backend) ACLStore() aclstore.ACLStore {
+	return b.aclStore
+}
+
+// DebugStatusCheckerFuncs implements store.Backend.DebugStatusCheckerFuncs.
+func (b *backend) DebugStatusCheckerFuncs() []debugstatus.CheckerFunc {
+	return []debugstatus.CheckerFunc{
+		b.tablesStatus,
+	}
+}
+
+// tablesStatus is a debugstatus.CheckerFunc that checks that all the
+// tables used by the backend are active.
+func (b *backend) tablesStatus(ctx context.Context) (key string, result debugstatus.CheckResult) {
+	result.Name = "DynamoDB tables"
+	var inactive []string
+	for name := range tableTTLs {
+		table := b.table(name)
+		status, err := b.tableStatus(ctx, table)
+		if err != nil {
+			result.Value = fmt.Sprintf("Cannot get status of table %s: %s", table, err)
+			return "dynamodb_tables", result
+		}
+		if status != "ACTIVE" {
+			inactive = append(inactive, table)
+		}
+	}
+	if len(inactive) > 0 {
+		result.Value = fmt.Sprintf("Inactive tables: %s", inactive)
+		return "dynamodb_tables", result
+	}
+	result.Value = "All tables active"
+	result.Passed = true
+	return "dynamodb_tables", result
+}
+
+// rootKeyBacking implements dbrootkeystore.Backing using the rootkeys
+// table. Expired keys are removed by DynamoDB.
+type rootKeyBacking struct {
+	b *backend
+}
+
+// GetKey implements dbrootkeystore.Backing.GetKey.
+func (r rootKeyBacking) GetKey(id []byte) (dbrootkeystore.RootKey, error) {
+	it, err := r.b.c.getItem(context.Background(), r.b.table(rootKeysTable), item{
+		"key": stringValue(hex.EncodeToString(id)),
+	})
+	if err != nil {
+		return dbrootkeystore.RootKey{}, errgo.Notef(err, "cannot get key from database")
+	}
+	if it == nil {
+		return dbrootkeystore.RootKey{}, bakery.ErrNotFound
+	}
+	return rootKeyFromItem(id, it), nil
+}
+
+// FindLatestKey implements dbrootkeystore.Backing.FindLatestKey.
+func (r rootKeyBacking) FindLatestKey(createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
+	var key dbrootkeystore.RootKey
+	err := r.b.c.scan(context.Background(), scanRequest{
+		TableName:        r.b.table(rootKeysTable),
+		FilterExpression: "#created >= :created AND #expires >= :after AND #expires <= :before",
+		ExpressionAttributeNames: map[string]string{
+			"#created": "created",
+			"#expires": "expires",
+		},
+		ExpressionAttributeValues: item{
+			":created": timeValue(createdAfter),
+			":after":   timeValue(expiresAfter),
+			":before":  timeValue(expiresBefore),
+		},
+	}, func(it item) error {
+		if created := it.time("created"); key.Id == nil || created.After(key.Created) {
+			id, err := hex.DecodeString(it.string("key"))
+			if err != nil {
+				logger.Warningf("invalid root key id %q", it.string("key"))
+				return nil
+			}
+			key = rootKeyFromItem(id, it)
+		}
+		return nil
+	})
+	if err != nil {
+		return dbrootkeystore.RootKey{}, errgo.Notef(err, "cannot query existing keys")
+	}
+	return key, nil
+}
+
+// InsertKey implements dbrootkeystore.Backing.InsertKey.
+func (r rootKeyBacking) InsertKey(key dbrootkeystore.RootKey) error {
+	err := r.b.c.putItem(context.Background(), putItemRequest{
+		TableName: r.b.table(rootKeysTable),
+		Item: item{
+			"key":     stringValue(hex.EncodeToString(key.Id)),
+			"rootkey": bytesValue(key.RootKey),
+			"created": timeValue(key.Created),
+			"expires": timeValue(key.Expires),
+			"ttl":     ttlValue(key.Expires),
+		},
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot insert key")
+	}
+	return nil
+}
+
+func rootKeyFromItem(id []byte, it item) dbrootkeystore.RootKey {
+	return dbrootkeystore.RootKey{
+		Id:      id,
+		RootKey: it.bytes("rootkey"),
+		Created: it.time("created"),
+		Expires: it.time("expires"),
+	}
+}
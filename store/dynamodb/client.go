@@ -0,0 +1,381 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package dynamodb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/internal/awssig"
+)
+
+var (
+	// errConditionFailed is the cause of the error returned when the
+	// condition of a write is not met.
+	errConditionFailed = errgo.New("condition failed")
+
+	// errTableNotFound is the cause of the error returned when an
+	// operation refers to a table that does not exist.
+	errTableNotFound = errgo.New("table not found")
+)
+
+// client makes requests to the DynamoDB API.
+type client struct {
+	// region holds the AWS region of the tables.
+	region string
+
+	// endpoint holds the URL of the DynamoDB endpoint.
+	endpoint string
+
+	// credentials holds the credentials used to authenticate to
+	// AWS.
+	credentials awssig.Credentials
+
+	// httpClient holds the HTTP client used to contact AWS.
+	httpClient *http.Client
+}
+
+// attributeValue holds a DynamoDB attribute value. Exactly one of the
+// fields should be set.
+type attributeValue struct {
+	S    *string `json:",omitempty"`
+	N    *string `json:",omitempty"`
+	B    []byte  `json:",omitempty"`
+	BOOL *bool   `json:",omitempty"`
+}
+
+// item holds the attributes of a DynamoDB item.
+type item map[string]attributeValue
+
+func stringValue(s string) attributeValue {
+	return attributeValue{S: &s}
+}
+
+func intValue(n int64) attributeValue {
+	s := strconv.FormatInt(n, 10)
+	return attributeValue{N: &s}
+}
+
+func boolValue(b bool) attributeValue {
+	return attributeValue{BOOL: &b}
+}
+
+// bytesValue returns an attribute value holding b. DynamoDB does not
+// allow empty binary values, so b must not be empty.
+func bytesValue(b []byte) attributeValue {
+	return attributeValue{B: b}
+}
+
+// timeValue returns an attribute value holding t as a number of
+// nanoseconds since the epoch, so that times can be compared in
+// condition and filter expressions.
+func timeValue(t time.Time) attributeValue {
+	if t.IsZero() {
+		return intValue(0)
+	}
+	return intValue(t.UnixNano())
+}
+
+// ttlValue returns an attribute value holding t as a number of seconds
+// since the epoch, rounded up, as used by the DynamoDB time to live
+// feature.
+func ttlValue(t time.Time) attributeValue {
+	secs := t.Unix()
+	if t.Nanosecond() > 0 {
+		secs++
+	}
+	return intValue(secs)
+}
+
+func (it item) string(name string) string {
+	if v := it[name].S; v != nil {
+		return *v
+	}
+	return ""
+}
+
+func (it item) int(name string) int64 {
+	if v := it[name].N; v != nil {
+		n, _ := strconv.ParseInt(*v, 10, 64)
+		return n
+	}
+	return 0
+}
+
+func (it item) bool(name string) bool {
+	if v := it[name].BOOL; v != nil {
+		return *v
+	}
+	return false
+}
+
+func (it item) bytes(name string) []byte {
+	return it[name].B
+}
+
+func (it item) time(name string) time.Time {
+	n := it.int(name)
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+type getItemRequest struct {
+	TableName      string
+	Key            item
+	ConsistentRead bool
+}
+
+type getItemResponse struct {
+	Item item
+}
+
+type putItemRequest struct {
+	TableName                 string
+	Item                      item
+	ConditionExpression       string            `json:",omitempty"`
+	ExpressionAttributeNames  map[string]string `json:",omitempty"`
+	ExpressionAttributeValues item              `json:",omitempty"`
+}
+
+type deleteItemRequest struct {
+	TableName                 string
+	Key                       item
+	ConditionExpression       string            `json:",omitempty"`
+	ExpressionAttributeNames  map[string]string `json:",omitempty"`
+	ExpressionAttributeValues item              `json:",omitempty"`
+	ReturnValues              string            `json:",omitempty"`
+}
+
+type deleteItemResponse struct {
+	Attributes item
+}
+
+type updateItemRequest struct {
+	TableName                 string
+	Key                       item
+	UpdateExpression          string
+	ConditionExpression       string            `json:",omitempty"`
+	ExpressionAttributeNames  map[string]string `json:",omitempty"`
+	ExpressionAttributeValues item              `json:",omitempty"`
+}
+
+type scanRequest struct {
+	TableName                 string
+	ConsistentRead            bool
+	FilterExpression          string            `json:",omitempty"`
+	ExpressionAttributeNames  map[string]string `json:",omitempty"`
+	ExpressionAttributeValues item              `json:",omitempty"`
+	ExclusiveStartKey         item              `json:",omitempty"`
+}
+
+type scanResponse struct {
+	Items            []item
+	LastEvaluatedKey item
+}
+
+type transactWriteItemsRequest struct {
+	TransactItems []transactWriteItem
+}
+
+// transactWriteItem holds a single write in a TransactWriteItems
+// request. Exactly one of the fields should be set.
+type transactWriteItem struct {
+	Put    *putItemRequest    `json:",omitempty"`
+	Delete *deleteItemRequest `json:",omitempty"`
+}
+
+type createTableRequest struct {
+	TableName            string
+	AttributeDefinitions []attributeDefinition
+	KeySchema            []keySchemaElement
+	BillingMode          string
+}
+
+type attributeDefinition struct {
+	AttributeName string
+	AttributeType string
+}
+
+type keySchemaElement struct {
+	AttributeName string
+	KeyType       string
+}
+
+type describeTableRequest struct {
+	TableName string
+}
+
+type describeTableResponse struct {
+	Table struct {
+		TableStatus string
+	}
+}
+
+type updateTimeToLiveRequest struct {
+	TableName               string
+	TimeToLiveSpecification struct {
+		AttributeName string
+		Enabled       bool
+	}
+}
+
+// awsError holds an error response from DynamoDB.
+type awsError struct {
+	Type                string `json:"__type"`
+	Message             string `json:"message"`
+	Message_            string `json:"Message"`
+	CancellationReasons []struct {
+		Code string
+	}
+}
+
+// code returns the error code without the service prefix.
+func (e *awsError) code() string {
+	if i := strings.LastIndexByte(e.Type, '#'); i >= 0 {
+		return e.Type[i+1:]
+	}
+	return e.Type
+}
+
+func (e *awsError) message() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	return e.Message_
+}
+
+// transactionCanceledError is returned when a TransactWriteItems
+// request is canceled.
+type transactionCanceledError struct {
+	// reasons holds the reason code for each write in the
+	// transaction. Writes that did not cause the cancellation
+	// have the code "None".
+	reasons []string
+}
+
+func (e *transactionCanceledError) Error() string {
+	return "transaction canceled: " + strings.Join(e.reasons, ", ")
+}
+
+// conditionFailed reports whether the i'th write in the transaction
+// failed its condition.
+func (e *transactionCanceledError) conditionFailed(i int) bool {
+	return i < len(e.reasons) && e.reasons[i] == "ConditionalCheckFailed"
+}
+
+func (c *client) getItem(ctx context.Context, table string, key item) (item, error) {
+	var resp getItemResponse
+	if err := c.call(ctx, "GetItem", getItemRequest{
+		TableName:      table,
+		Key:            key,
+		ConsistentRead: true,
+	}, &resp); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return resp.Item, nil
+}
+
+func (c *client) putItem(ctx context.Context, req putItemRequest) error {
+	return errgo.Mask(c.call(ctx, "PutItem", req, nil), errgo.Is(errConditionFailed))
+}
+
+func (c *client) deleteItem(ctx context.Context, req deleteItemRequest) (item, error) {
+	var resp deleteItemResponse
+	if err := c.call(ctx, "DeleteItem", req, &resp); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(errConditionFailed))
+	}
+	return resp.Attributes, nil
+}
+
+func (c *client) updateItem(ctx context.Context, req updateItemRequest) error {
+	return errgo.Mask(c.call(ctx, "UpdateItem", req, nil), errgo.Is(errConditionFailed))
+}
+
+func (c *client) transactWriteItems(ctx context.Context, items ...transactWriteItem) error {
+	return errgo.Mask(c.call(ctx, "TransactWriteItems", transactWriteItemsRequest{
+		TransactItems: items,
+	}, nil), errgo.Any)
+}
+
+// scan calls f with each item in the given table that matches the
+// filter in req. The table is read using consistent reads.
+func (c *client) scan(ctx context.Context, req scanRequest, f func(item) error) error {
+	req.ConsistentRead = true
+	for {
+		var resp scanResponse
+		if err := c.call(ctx, "Scan", req, &resp); err != nil {
+			return errgo.Mask(err)
+		}
+		for _, it := range resp.Items {
+			if err := f(it); err != nil {
+				return errgo.Mask(err, errgo.Any)
+			}
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		req.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// call calls the given DynamoDB operation with the given request body
+// and unmarshals the response into resp, if it is not nil.
+func (c *client) call(ctx context.Context, op string, body, resp interface{}) error {
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req, err := http.NewRequest("POST", c.endpoint, bytes.NewReader(buf))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "DynamoDB_20120810."+op)
+	awssig.Sign(req, buf, "dynamodb", c.region, c.credentials, time.Now())
+	client := c.httpClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	hresp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errgo.Notef(err, "cannot contact DynamoDB")
+	}
+	defer hresp.Body.Close()
+	if hresp.StatusCode != http.StatusOK {
+		var aerr awsError
+		if err := httprequest.UnmarshalJSONResponse(hresp, &aerr); err != nil {
+			return errgo.Notef(err, "%s: %s", op, hresp.Status)
+		}
+		switch aerr.code() {
+		case "ConditionalCheckFailedException":
+			return errgo.WithCausef(nil, errConditionFailed, "%s: %s", op, aerr.message())
+		case "ResourceNotFoundException":
+			return errgo.WithCausef(nil, errTableNotFound, "%s: %s", op, aerr.message())
+		case "TransactionCanceledException":
+			terr := &transactionCanceledError{}
+			for _, r := range aerr.CancellationReasons {
+				terr.reasons = append(terr.reasons, r.Code)
+			}
+			return terr
+		}
+		return errgo.Newf("%s: %s: %s", op, aerr.code(), aerr.message())
+	}
+	if resp == nil {
+		return nil
+	}
+	if err := httprequest.UnmarshalJSONResponse(hresp, resp); err != nil {
+		return errgo.Notef(err, "%s", op)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package dynamodb provides a storage backend that keeps identities,
+// provider data and rendezvous in Amazon DynamoDB tables.
+package dynamodb
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/juju/loggo"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/internal/awssig"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+var logger = loggo.GetLogger("candid.store.dynamodb")
+
+// defaultTablePrefix holds the prefix of the table names used when
+// none is configured.
+const defaultTablePrefix = "candid-"
+
+// Params holds the specification for the parameters used in the config
+// file. The AWS credentials are taken from the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables.
+type Params struct {
+	// Region holds the AWS region of the tables.
+	Region string `yaml:"region"`
+
+	// Endpoint optionally holds the URL of the DynamoDB endpoint.
+	// If this is empty, the standard endpoint for the region is
+	// used. It may be set to use DynamoDB Local.
+	Endpoint string `yaml:"endpoint"`
+
+	// TablePrefix holds the prefix added to the name of each table
+	// used by the backend, so that several instances of Candid can
+	// share an AWS account. If this is empty "candid-" is used.
+	TablePrefix string `yaml:"table-prefix"`
+
+	// CreateTables holds whether missing tables are created when
+	// the backend is created. If it is false, the tables must
+	// already exist.
+	CreateTables bool `yaml:"create-tables"`
+}
+
+func init() {
+	store.Register("dynamodb", unmarshalBackend)
+}
+
+func unmarshalBackend(unmarshal func(interface{}) error) (store.BackendFactory, error) {
+	var p Params
+	if err := unmarshal(&p); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if p.Region == "" {
+		return nil, errgo.Newf("no region field in dynamodb storage configuration")
+	}
+	if p.TablePrefix == "" {
+		p.TablePrefix = defaultTablePrefix
+	}
+	return p, nil
+}
+
+// NewBackend implements store.BackendFactory.
+func (p Params) NewBackend() (store.Backend, error) {
+	logger.Infof("connecting to dynamodb in %s", p.Region)
+	b, err := newBackend(p.client(nil), p.TablePrefix, p.CreateTables)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot initialise dynamodb")
+	}
+	return b, nil
+}
+
+// client returns a client for the DynamoDB API using the given HTTP
+// client. If httpClient is nil, http.DefaultClient is used.
+func (p Params) client(httpClient *http.Client) *client {
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = "https://dynamodb." + p.Region + ".amazonaws.com/"
+	}
+	return &client{
+		region:   p.Region,
+		endpoint: endpoint,
+		credentials: awssig.Credentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		},
+		httpClient: httpClient,
+	}
+}
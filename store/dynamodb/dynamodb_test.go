@@ -0,0 +1,214 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package dynamodb_test
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/aclstore/v2"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/yaml.v2"
+
+	"github.com/CanonicalLtd/candid/meeting"
+	"github.com/CanonicalLtd/candid/store"
+	"github.com/CanonicalLtd/candid/store/dynamodb"
+	"github.com/CanonicalLtd/candid/store/storetest"
+)
+
+func TestKeyValueStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestKeyValueStore(c, func(c *qt.C) store.ProviderDataStore {
+		return newBackend(c).ProviderDataStore()
+	})
+}
+
+func TestStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestStore(c, func(c *qt.C) store.Store {
+		return newBackend(c).Store()
+	})
+}
+
+func TestMeetingStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestMeetingStore(c, func(c *qt.C) meeting.Store {
+		return newBackend(c).MeetingStore()
+	}, dynamodb.PutAtTime)
+}
+
+func TestACLStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestACLStore(c, func(c *qt.C) aclstore.ACLStore {
+		return newBackend(c).ACLStore()
+	})
+}
+
+func TestRootKeyStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	b := newBackend(c)
+	rks := b.BakeryRootKeyStore()
+	ctx := context.Background()
+	key, id, err := rks.RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+
+	key1, err := rks.Get(ctx, id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(key1, qt.DeepEquals, key)
+
+	// A new store shares the same keys.
+	key2, id2, err := b.BakeryRootKeyStore().RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id2, qt.DeepEquals, id)
+	c.Assert(key2, qt.DeepEquals, key)
+
+	_, err = rks.Get(ctx, []byte("no-such-key"))
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+}
+
+func TestUnmarshal(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	endpoint := testEndpoint(c)
+	prefix := randomPrefix()
+	storetest.TestUnmarshal(c, `
+storage:
+    type: dynamodb
+    region: us-east-1
+    endpoint: `+endpoint+`
+    table-prefix: `+prefix+`
+    create-tables: true
+`)
+	b, err := dynamodb.Params{
+		Region:      "us-east-1",
+		Endpoint:    endpoint,
+		TablePrefix: prefix,
+	}.NewBackend()
+	c.Assert(err, qt.Equals, nil)
+	err = dynamodb.DeleteTables(b)
+	c.Assert(err, qt.Equals, nil)
+}
+
+func TestUnmarshalWithNoRegion(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	var cfg struct {
+		Storage *store.Config `yaml:"storage"`
+	}
+	err := yaml.Unmarshal([]byte(`
+storage:
+    type: dynamodb
+`), &cfg)
+	c.Assert(err, qt.ErrorMatches, `cannot unmarshal dynamodb configuration: no region field in dynamodb storage configuration`)
+}
+
+func TestUnmarshalDefaultTablePrefix(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	var cfg struct {
+		Storage *store.Config `yaml:"storage"`
+	}
+	err := yaml.Unmarshal([]byte(`
+storage:
+    type: dynamodb
+    region: eu-west-2
+`), &cfg)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cfg.Storage.BackendFactory, qt.DeepEquals, dynamodb.Params{
+		Region:      "eu-west-2",
+		TablePrefix: "candid-",
+	})
+}
+
+func TestNewBackendSignsRequests(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	c.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	c.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	c.Setenv("AWS_SESSION_TOKEN", "")
+	var reqs []*http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		reqs = append(reqs, req)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"__type":"com.amazonaws.dynamodb.v20120810#ResourceNotFoundException","message":"Requested resource not found"}`)
+	}))
+	defer srv.Close()
+
+	_, err := dynamodb.Params{
+		Region:      "us-east-1",
+		Endpoint:    srv.URL,
+		TablePrefix: "test-",
+	}.NewBackend()
+	c.Assert(err, qt.ErrorMatches, `cannot initialise dynamodb: cannot get status of table test-[a-z]+: DescribeTable: Requested resource not found`)
+	c.Assert(reqs, qt.HasLen, 1)
+	c.Assert(reqs[0].Header.Get("X-Amz-Target"), qt.Equals, "DynamoDB_20120810.DescribeTable")
+	auth := reqs[0].Header.Get("Authorization")
+	c.Assert(strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/"), qt.Equals, true, qt.Commentf("%s", auth))
+	c.Assert(auth, qt.Contains, "/us-east-1/dynamodb/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-target, Signature=")
+}
+
+// newBackend returns a backend using newly created tables, which are
+// removed at the end of the test.
+func newBackend(c *qt.C) store.Backend {
+	b, err := dynamodb.Params{
+		Region:       "us-east-1",
+		Endpoint:     testEndpoint(c),
+		TablePrefix:  randomPrefix(),
+		CreateTables: true,
+	}.NewBackend()
+	c.Assert(err, qt.Equals, nil)
+	c.Defer(func() {
+		if err := dynamodb.DeleteTables(b); err != nil {
+			c.Logf("cannot delete tables: %s", err)
+		}
+		b.Close()
+	})
+	return b
+}
+
+// testEndpoint returns the DynamoDB endpoint to use for tests, which is
+// taken from the DYNAMODB_TEST_ENDPOINT environment variable. DynamoDB
+// Local can be used. The test is skipped if no endpoint is set.
+func testEndpoint(c *qt.C) string {
+	endpoint := os.Getenv("DYNAMODB_TEST_ENDPOINT")
+	if endpoint == "" {
+		c.Skip("DYNAMODB_TEST_ENDPOINT not set")
+	}
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		// DynamoDB Local accepts any credentials.
+		c.Setenv("AWS_ACCESS_KEY_ID", "test")
+		c.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	}
+	return endpoint
+}
+
+func randomPrefix() string {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("candidtest-%x-", buf)
+}
@@ -0,0 +1,32 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package dynamodb
+
+import (
+	"context"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/meeting"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+var PutAtTime = func(ctx context.Context, s meeting.Store, id, address string, now time.Time) error {
+	return s.(*meetingStore).put(ctx, id, address, nil, now)
+}
+
+// DeleteTables deletes all the tables used by the given backend.
+func DeleteTables(b store.Backend) error {
+	b1 := b.(*backend)
+	for name := range tableTTLs {
+		err := b1.c.call(context.Background(), "DeleteTable", describeTableRequest{
+			TableName: b1.table(name),
+		}, nil)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package dynamodb
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "gopkg.in/errgo.v1"
+)
+
+// maxUpdateAttempts holds the maximum number of times that an
+// optimistic read-modify-write update is attempted when it conflicts
+// with a concurrent update.
+const maxUpdateAttempts = 10
+
+// A providerDataStore implements store.ProviderDataStore.
+type providerDataStore struct {
+	b *backend
+}
+
+// KeyValueStore implements store.ProviderDataStore.KeyValueStore.
+func (s *providerDataStore) KeyValueStore(_ context.Context, idp string) (simplekv.Store, error) {
+	return &kvStore{b: s.b, name: "idpkv_" + idp}, nil
+}
+
+// kvStore implements simplekv.Store using items in the keyvalue table.
+// The key of each item is the name of the store followed by the key
+// within the store. Each item holds a version number that is used to
+// detect concurrent updates.
+type kvStore struct {
+	b *backend
+
+	// name holds the name of the store.
+	name string
+}
+
+// Context implements simplekv.Store.Context.
+func (s *kvStore) Context(ctx context.Context) (context.Context, func()) {
+	return ctx, func() {}
+}
+
+// Get implements simplekv.Store.Get.
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
+	it, err := s.get(ctx, key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if it == nil {
+		return nil, errgo.WithCausef(nil, simplekv.ErrNotFound, "key %s not found", key)
+	}
+	return it.bytes("value"), nil
+}
+
+// get gets the item holding the given key. It returns a nil item if the
+// key is not found or has expired.
+func (s *kvStore) get(ctx context.Context, key string) (item, error) {
+	it, err := s.b.c.getItem(ctx, s.b.table(keyValueTable), item{
+		"key": stringValue(s.name + "/" + key),
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	// DynamoDB removes expired items some time after they
+	// expire, so they may still be returned.
+	if expire := it.time("expire"); !expire.IsZero() && !expire.After(time.Now()) {
+		return nil, nil
+	}
+	return it, nil
+}
+
+// Set implements simplekv.Store.Set.
+func (s *kvStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	return errgo.Mask(s.b.c.putItem(ctx, putItemRequest{
+		TableName: s.b.table(keyValueTable),
+		Item:      s.item(key, value, expire, 1),
+	}))
+}
+
+// Update implements simplekv.Store.Update.
+func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	for i := 0; i < maxUpdateAttempts; i++ {
+		old, err := s.b.c.getItem(ctx, s.b.table(keyValueTable), item{
+			"key": stringValue(s.name + "/" + key),
+		})
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		var oldValue []byte
+		if expire := old.time("expire"); expire.IsZero() || expire.After(time.Now()) {
+			oldValue = old.bytes("value")
+		}
+		value, err := getVal(oldValue)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		req := putItemRequest{
+			TableName: s.b.table(keyValueTable),
+			Item:      s.item(key, value, expire, old.int("version")+1),
+		}
+		if old == nil {
+			req.ConditionExpression = "attribute_not_exists(#key)"
+			req.ExpressionAttributeNames = map[string]string{"#key": "key"}
+		} else {
+			req.ConditionExpression = "#version = :version"
+			req.ExpressionAttributeNames = map[string]string{"#version": "version"}
+			req.ExpressionAttributeValues = item{":version": intValue(old.int("version"))}
+		}
+		err = s.b.c.putItem(ctx, req)
+		if errgo.Cause(err) != errConditionFailed {
+			return errgo.Mask(err)
+		}
+	}
+	return errgo.Newf("cannot update key %s: too many concurrent updates", key)
+}
+
+// item returns the item that stores the given value.
+func (s *kvStore) item(key string, value []byte, expire time.Time, version int64) item {
+	it := item{
+		"key":     stringValue(s.name + "/" + key),
+		"version": intValue(version),
+	}
+	if len(value) > 0 {
+		it["value"] = bytesValue(value)
+	}
+	if !expire.IsZero() {
+		it["expire"] = timeValue(expire)
+		it["ttl"] = ttlValue(expire)
+	}
+	return it
+}
@@ -0,0 +1,227 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package dynamodb
+
+import (
+	"context"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// meetingStore is an implementation of meeting.Store, meeting.PollStore
+// and meeting.ReplicaStore that uses the meetings and replicas tables.
+type meetingStore struct {
+	b *backend
+}
+
+// Context implements meeting.Store.Context.
+func (s *meetingStore) Context(ctx context.Context) (_ context.Context, close func()) {
+	return ctx, func() {}
+}
+
+// Put implements meeting.Store.Put.
+func (s *meetingStore) Put(ctx context.Context, id, address string) error {
+	return errgo.Mask(s.put(ctx, id, address, nil, time.Now()))
+}
+
+// PutData implements meeting.PollStore.PutData.
+func (s *meetingStore) PutData(ctx context.Context, id, address string, data0 []byte) error {
+	return errgo.Mask(s.put(ctx, id, address, data0, time.Now()))
+}
+
+// put is the internal version of Put and PutData which takes a time
+// for testing purposes.
+func (s *meetingStore) put(ctx context.Context, id, address string, data0 []byte, now time.Time) error {
+	it := item{
+		"key":      stringValue(id),
+		"address":  stringValue(address),
+		"created":  timeValue(now),
+		"complete": boolValue(false),
+	}
+	if len(data0) > 0 {
+		it["data0"] = bytesValue(data0)
+	}
+	err := s.b.c.putItem(ctx, putItemRequest{
+		TableName:                s.b.table(meetingsTable),
+		Item:                     it,
+		ConditionExpression:      "attribute_not_exists(#key)",
+		ExpressionAttributeNames: map[string]string{"#key": "key"},
+	})
+	if errgo.Cause(err) == errConditionFailed {
+		return errgo.Newf("duplicate id %q in meeting store", id)
+	}
+	return errgo.Mask(err)
+}
+
+// Get implements meeting.Store.Get.
+func (s *meetingStore) Get(ctx context.Context, id string) (address string, _ error) {
+	it, err := s.get(ctx, id)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	return it.string("address"), nil
+}
+
+// GetData implements meeting.PollStore.GetData.
+func (s *meetingStore) GetData(ctx context.Context, id string) (data0, data1 []byte, complete bool, _ error) {
+	it, err := s.get(ctx, id)
+	if err != nil {
+		return nil, nil, false, errgo.Mask(err)
+	}
+	return it.bytes("data0"), it.bytes("data1"), it.bool("complete"), nil
+}
+
+// get returns the item holding the rendezvous with the given id.
+func (s *meetingStore) get(ctx context.Context, id string) (item, error) {
+	it, err := s.b.c.getItem(ctx, s.b.table(meetingsTable), item{
+		"key": stringValue(id),
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if it == nil {
+		return nil, errgo.New("rendezvous not found, probably expired")
+	}
+	return it, nil
+}
+
+// Complete implements meeting.PollStore.Complete.
+func (s *meetingStore) Complete(ctx context.Context, id string, data1 []byte) error {
+	req := updateItemRequest{
+		TableName:           s.b.table(meetingsTable),
+		Key:                 item{"key": stringValue(id)},
+		UpdateExpression:    "SET #complete = :true",
+		ConditionExpression: "attribute_exists(#key) AND #complete = :false",
+		ExpressionAttributeNames: map[string]string{
+			"#key":      "key",
+			"#complete": "complete",
+		},
+		ExpressionAttributeValues: item{
+			":true":  boolValue(true),
+			":false": boolValue(false),
+		},
+	}
+	if len(data1) > 0 {
+		req.UpdateExpression += ", #data1 = :data1"
+		req.ExpressionAttributeNames["#data1"] = "data1"
+		req.ExpressionAttributeValues[":data1"] = bytesValue(data1)
+	}
+	err := s.b.c.updateItem(ctx, req)
+	if errgo.Cause(err) != errConditionFailed {
+		return errgo.Mask(err)
+	}
+	// Find out why the condition failed.
+	if _, err := s.get(ctx, id); err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Newf("rendezvous %q done twice", id)
+}
+
+// Remove implements meeting.Store.Remove.
+func (s *meetingStore) Remove(ctx context.Context, id string) (time.Time, error) {
+	it, err := s.b.c.deleteItem(ctx, deleteItemRequest{
+		TableName:    s.b.table(meetingsTable),
+		Key:          item{"key": stringValue(id)},
+		ReturnValues: "ALL_OLD",
+	})
+	if err != nil {
+		return time.Time{}, errgo.Mask(err)
+	}
+	return it.time("created"), nil
+}
+
+// RemoveOld implements meeting.Store.RemoveOld.
+func (s *meetingStore) RemoveOld(ctx context.Context, addr string, olderThan time.Time) (ids []string, err error) {
+	req := scanRequest{
+		TableName:        s.b.table(meetingsTable),
+		FilterExpression: "#created < :created",
+		ExpressionAttributeNames: map[string]string{
+			"#created": "created",
+		},
+		ExpressionAttributeValues: item{
+			":created": timeValue(olderThan),
+		},
+	}
+	if addr != "" {
+		req.FilterExpression += " AND #address = :address"
+		req.ExpressionAttributeNames["#address"] = "address"
+		req.ExpressionAttributeValues[":address"] = stringValue(addr)
+	}
+	var found []string
+	if err := s.b.c.scan(ctx, req, func(it item) error {
+		found = append(found, it.string("key"))
+		return nil
+	}); err != nil {
+		return nil, errgo.Notef(err, "cannot find old rendezvous")
+	}
+	for _, id := range found {
+		if _, err := s.Remove(ctx, id); err != nil {
+			return ids, errgo.Notef(err, "cannot remove rendezvous %q", id)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Heartbeat implements meeting.ReplicaStore.Heartbeat.
+func (s *meetingStore) Heartbeat(ctx context.Context, address string, now time.Time) error {
+	return errgo.Mask(s.b.c.putItem(ctx, putItemRequest{
+		TableName: s.b.table(replicasTable),
+		Item: item{
+			"key":       stringValue(address),
+			"heartbeat": timeValue(now),
+		},
+	}))
+}
+
+// RemoveReplica implements meeting.ReplicaStore.RemoveReplica.
+func (s *meetingStore) RemoveReplica(ctx context.Context, address string) error {
+	_, err := s.b.c.deleteItem(ctx, deleteItemRequest{
+		TableName: s.b.table(replicasTable),
+		Key:       item{"key": stringValue(address)},
+	})
+	return errgo.Mask(err)
+}
+
+// RemoveDeadReplicas implements meeting.ReplicaStore.RemoveDeadReplicas.
+func (s *meetingStore) RemoveDeadReplicas(ctx context.Context, olderThan time.Time) (addresses []string, err error) {
+	names := map[string]string{
+		"#heartbeat": "heartbeat",
+	}
+	values := item{
+		":heartbeat": timeValue(olderThan),
+	}
+	var found []string
+	if err := s.b.c.scan(ctx, scanRequest{
+		TableName:                 s.b.table(replicasTable),
+		FilterExpression:          "#heartbeat < :heartbeat",
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}, func(it item) error {
+		found = append(found, it.string("key"))
+		return nil
+	}); err != nil {
+		return nil, errgo.Notef(err, "cannot find dead replicas")
+	}
+	for _, address := range found {
+		// Only remove the replica if it has not sent a heartbeat
+		// since it was found.
+		_, err := s.b.c.deleteItem(ctx, deleteItemRequest{
+			TableName:                 s.b.table(replicasTable),
+			Key:                       item{"key": stringValue(address)},
+			ConditionExpression:       "#heartbeat < :heartbeat",
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+		})
+		if errgo.Cause(err) == errConditionFailed {
+			continue
+		}
+		if err != nil {
+			return addresses, errgo.Notef(err, "cannot remove replica %q", address)
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
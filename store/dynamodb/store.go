@@ -0,0 +1,519 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package dynamodb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// The identities table holds three kinds of item, distinguished by the
+// prefix of their key. Identity items hold the identity encoded as JSON
+// along with a version number that is used to detect concurrent
+// updates. Username and provider ID items hold the ID of the identity
+// with that username or provider ID, and ensure that they are unique.
+const (
+	identityPrefix   = "id/"
+	usernamePrefix   = "username/"
+	providerIDPrefix = "providerid/"
+)
+
+// identityStore is a store.Store implementation that uses the
+// identities table.
+//
+// DynamoDB cannot sort or filter items by arbitrary fields, so
+// FindIdentities, SearchIdentities and IdentityCounts scan the whole
+// table.
+type identityStore struct {
+	b *backend
+}
+
+// Context implements store.Store.Context by returning the given context
+// and a NOP close function.
+func (s *identityStore) Context(ctx context.Context) (_ context.Context, close func()) {
+	return ctx, func() {}
+}
+
+// Identity implements store.Store.Identity.
+func (s *identityStore) Identity(ctx context.Context, identity *store.Identity) error {
+	id, _, err := s.identity(ctx, identity)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(store.ErrNotFound))
+	}
+	*identity = *id
+	return nil
+}
+
+// identity finds the identity matching the first non-zero value of the
+// ID, ProviderID or Username in the given identity. It returns the
+// identity along with the version of the item that holds it.
+func (s *identityStore) identity(ctx context.Context, identity *store.Identity) (*store.Identity, int64, error) {
+	var id string
+	switch {
+	case identity.ID != "":
+		id = identity.ID
+	case identity.ProviderID != "":
+		var err error
+		id, err = s.indexedID(ctx, providerIDPrefix+string(identity.ProviderID))
+		if err != nil {
+			return nil, 0, errgo.Mask(err)
+		}
+		if id == "" {
+			return nil, 0, store.NotFoundError("", identity.ProviderID, "")
+		}
+	case identity.Username != "":
+		var err error
+		id, err = s.indexedID(ctx, usernamePrefix+identity.Username)
+		if err != nil {
+			return nil, 0, errgo.Mask(err)
+		}
+		if id == "" {
+			return nil, 0, store.NotFoundError("", "", identity.Username)
+		}
+	default:
+		return nil, 0, store.NotFoundError("", "", "")
+	}
+	it, err := s.b.c.getItem(ctx, s.b.table(identitiesTable), item{
+		"key": stringValue(identityPrefix + id),
+	})
+	if err != nil {
+		return nil, 0, errgo.Mask(err)
+	}
+	if it == nil {
+		// The identity may have been found through a username
+		// or provider ID item, but this is only possible if
+		// the identity has been removed by hand.
+		switch {
+		case identity.ID != "":
+			return nil, 0, store.NotFoundError(identity.ID, "", "")
+		case identity.ProviderID != "":
+			return nil, 0, store.NotFoundError("", identity.ProviderID, "")
+		default:
+			return nil, 0, store.NotFoundError("", "", identity.Username)
+		}
+	}
+	result, err := identityFromItem(it)
+	if err != nil {
+		return nil, 0, errgo.Mask(err)
+	}
+	return result, it.int("version"), nil
+}
+
+// indexedID returns the identity ID held in the username or provider
+// ID item with the given key. It returns an empty ID if there is no
+// such item.
+func (s *identityStore) indexedID(ctx context.Context, key string) (string, error) {
+	it, err := s.b.c.getItem(ctx, s.b.table(identitiesTable), item{
+		"key": stringValue(key),
+	})
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	return it.string("id"), nil
+}
+
+// FindIdentities implements store.Store.FindIdentities.
+func (s *identityStore) FindIdentities(ctx context.Context, ref *store.Identity, filter store.Filter, sortFields []store.Sort, skip, limit int, conditions ...store.Condition) ([]store.Identity, error) {
+	identities, err := s.scan(ctx, func(id *store.Identity) bool {
+		return store.MatchIdentity(id, ref, filter) && store.MatchConditions(id, conditions)
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(sortFields) > 0 {
+		store.SortIdentities(identities, sortFields)
+	}
+	return page(identities, skip, limit), nil
+}
+
+// SearchIdentities implements store.Store.SearchIdentities.
+func (s *identityStore) SearchIdentities(ctx context.Context, text string, skip, limit int) ([]store.Identity, error) {
+	text = strings.ToLower(text)
+	identities, err := s.scan(ctx, func(id *store.Identity) bool {
+		return strings.Contains(strings.ToLower(id.Username), text) ||
+			strings.Contains(strings.ToLower(id.Email), text) ||
+			strings.Contains(strings.ToLower(id.Name), text)
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	store.SortIdentities(identities, []store.Sort{{Field: store.Username}})
+	return page(identities, skip, limit), nil
+}
+
+// IdentityCounts implements store.Store.IdentityCounts.
+func (s *identityStore) IdentityCounts(ctx context.Context) (map[string]int, error) {
+	counts := make(map[string]int)
+	_, err := s.scan(ctx, func(id *store.Identity) bool {
+		counts[id.ProviderID.Provider()]++
+		return false
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return counts, nil
+}
+
+// scan returns all the identities for which match returns true.
+func (s *identityStore) scan(ctx context.Context, match func(*store.Identity) bool) ([]store.Identity, error) {
+	var identities []store.Identity
+	err := s.b.c.scan(ctx, scanRequest{
+		TableName:        s.b.table(identitiesTable),
+		FilterExpression: "begins_with(#key, :prefix)",
+		ExpressionAttributeNames: map[string]string{
+			"#key": "key",
+		},
+		ExpressionAttributeValues: item{
+			":prefix": stringValue(identityPrefix),
+		},
+	}, func(it item) error {
+		id, err := identityFromItem(it)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if match(id) {
+			identities = append(identities, *id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot scan identities")
+	}
+	return identities, nil
+}
+
+// page returns the given page of identities.
+func page(identities []store.Identity, skip, limit int) []store.Identity {
+	if skip > len(identities) {
+		return nil
+	}
+	identities = identities[skip:]
+	if limit > 0 && limit < len(identities) {
+		identities = identities[:limit]
+	}
+	return identities
+}
+
+// UpdateIdentity implements store.Store.UpdateIdentity.
+func (s *identityStore) UpdateIdentity(ctx context.Context, identity *store.Identity, update store.Update) error {
+	for i := 0; i < maxUpdateAttempts; i++ {
+		err := s.updateIdentity(ctx, identity, update)
+		if errgo.Cause(err) != errConditionFailed {
+			return errgo.Mask(err, errgo.Is(store.ErrNotFound), errgo.Is(store.ErrDuplicateUsername))
+		}
+	}
+	return errgo.Newf("cannot update identity: too many concurrent updates")
+}
+
+// UpdateIdentities implements store.Store.UpdateIdentities. The
+// identities are updated one at a time, so if an update fails the
+// earlier updates will already have been made.
+func (s *identityStore) UpdateIdentities(ctx context.Context, identities []*store.Identity, update store.Update) error {
+	for _, identity := range identities {
+		if err := s.UpdateIdentity(ctx, identity, update); err != nil {
+			return errgo.Mask(err, errgo.Is(store.ErrNotFound), errgo.Is(store.ErrDuplicateUsername))
+		}
+	}
+	return nil
+}
+
+// updateIdentity makes a single attempt to update the given identity.
+// If the update conflicts with a concurrent update an error with a
+// cause of errConditionFailed is returned.
+func (s *identityStore) updateIdentity(ctx context.Context, identity *store.Identity, update store.Update) error {
+	if update[store.ProviderID] != store.NoUpdate {
+		panic(errgo.Newf("unsupported operation %v requested on ProviderID field", update[store.ProviderID]))
+	}
+	if update[store.Username] != store.NoUpdate && update[store.Username] != store.Set {
+		panic("unsupported operation requested on Username field")
+	}
+	old, version, err := s.identity(ctx, identity)
+	if errgo.Cause(err) == store.ErrNotFound && identity.ID == "" && identity.ProviderID != "" && identity.Username != "" && update[store.Username] == store.Set {
+		return errgo.Mask(s.insertIdentity(ctx, identity, update), errgo.Is(errConditionFailed), errgo.Is(store.ErrDuplicateUsername))
+	}
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(store.ErrNotFound))
+	}
+	id := *old
+	applyUpdate(&id, identity, update)
+	it, err := identityItem(&id, version+1)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	put := &putItemRequest{
+		TableName:                s.b.table(identitiesTable),
+		Item:                     it,
+		ConditionExpression:      "#version = :version",
+		ExpressionAttributeNames: map[string]string{"#version": "version"},
+		ExpressionAttributeValues: item{
+			":version": intValue(version),
+		},
+	}
+	if id.Username == old.Username {
+		return errgo.Mask(s.b.c.putItem(ctx, *put), errgo.Is(errConditionFailed))
+	}
+	writes := []transactWriteItem{{
+		Put: put,
+	}, {
+		Put: s.indexPut(usernamePrefix+id.Username, id.ID),
+	}}
+	if old.Username != "" {
+		writes = append(writes, transactWriteItem{
+			Delete: &deleteItemRequest{
+				TableName: s.b.table(identitiesTable),
+				Key: item{
+					"key": stringValue(usernamePrefix + old.Username),
+				},
+			},
+		})
+	}
+	err = s.b.c.transactWriteItems(ctx, writes...)
+	if terr, ok := errgo.Cause(err).(*transactionCanceledError); ok {
+		if terr.conditionFailed(1) {
+			return store.DuplicateUsernameError(id.Username)
+		}
+		if terr.conditionFailed(0) {
+			return errgo.WithCausef(nil, errConditionFailed, "identity %q changed", id.ID)
+		}
+	}
+	return errgo.Mask(err)
+}
+
+// insertIdentity creates a new identity from the given identity and
+// update. The ID of the new identity is written back into identity.
+func (s *identityStore) insertIdentity(ctx context.Context, identity *store.Identity, update store.Update) error {
+	id := store.Identity{
+		ID:           newID(),
+		ProviderID:   identity.ProviderID,
+		ProviderInfo: make(map[string][]string),
+		ExtraInfo:    make(map[string][]string),
+	}
+	applyUpdate(&id, identity, update)
+	it, err := identityItem(&id, 1)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	err = s.b.c.transactWriteItems(ctx, transactWriteItem{
+		Put: &putItemRequest{
+			TableName:                s.b.table(identitiesTable),
+			Item:                     it,
+			ConditionExpression:      "attribute_not_exists(#key)",
+			ExpressionAttributeNames: map[string]string{"#key": "key"},
+		},
+	}, transactWriteItem{
+		Put: s.indexPut(providerIDPrefix+string(id.ProviderID), id.ID),
+	}, transactWriteItem{
+		Put: s.indexPut(usernamePrefix+id.Username, id.ID),
+	})
+	if terr, ok := errgo.Cause(err).(*transactionCanceledError); ok {
+		if terr.conditionFailed(2) {
+			return store.DuplicateUsernameError(id.Username)
+		}
+		if terr.conditionFailed(0) || terr.conditionFailed(1) {
+			// The identity has been created concurrently.
+			return errgo.WithCausef(nil, errConditionFailed, "identity %q created concurrently", id.ProviderID)
+		}
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	identity.ID = id.ID
+	return nil
+}
+
+// indexPut returns a request that creates the username or provider ID
+// item with the given key referring to the given identity ID, unless
+// the key already refers to another identity.
+func (s *identityStore) indexPut(key, id string) *putItemRequest {
+	return &putItemRequest{
+		TableName: s.b.table(identitiesTable),
+		Item: item{
+			"key": stringValue(key),
+			"id":  stringValue(id),
+		},
+		ConditionExpression: "attribute_not_exists(#key) OR #id = :id",
+		ExpressionAttributeNames: map[string]string{
+			"#key": "key",
+			"#id":  "id",
+		},
+		ExpressionAttributeValues: item{
+			":id": stringValue(id),
+		},
+	}
+}
+
+// newID returns a new random identity ID.
+func newID() string {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// identityItem returns the item that stores the given identity.
+func identityItem(id *store.Identity, version int64) (item, error) {
+	data, err := json.Marshal(id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return item{
+		"key":     stringValue(identityPrefix + id.ID),
+		"data":    stringValue(string(data)),
+		"version": intValue(version),
+	}, nil
+}
+
+// identityFromItem returns the identity stored in the given item.
+func identityFromItem(it item) (*store.Identity, error) {
+	var id store.Identity
+	if err := json.Unmarshal([]byte(it.string("data")), &id); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal identity")
+	}
+	id.ID = strings.TrimPrefix(it.string("key"), identityPrefix)
+	if id.ProviderInfo == nil {
+		id.ProviderInfo = make(map[string][]string)
+	}
+	if id.ExtraInfo == nil {
+		id.ExtraInfo = make(map[string][]string)
+	}
+	return &id, nil
+}
+
+// applyUpdate applies the given update to dst using the values in src.
+func applyUpdate(dst, src *store.Identity, update store.Update) {
+	if update[store.Username] == store.Set {
+		dst.Username = src.Username
+	}
+	dst.Name = updateString(dst.Name, src.Name, update[store.Name])
+	dst.Email = updateString(dst.Email, src.Email, update[store.Email])
+	dst.Groups = updateStrings(dst.Groups, src.Groups, update[store.Groups])
+	dst.PublicKeys = updateKeys(dst.PublicKeys, src.PublicKeys, update[store.PublicKeys])
+	dst.LastDischarge = updateTime(dst.LastDischarge, src.LastDischarge, update[store.LastDischarge])
+	dst.LastLogin = updateTime(dst.LastLogin, src.LastLogin, update[store.LastLogin])
+	dst.ProviderInfo = updateMap(dst.ProviderInfo, src.ProviderInfo, update[store.ProviderInfo])
+	dst.ExtraInfo = updateMap(dst.ExtraInfo, src.ExtraInfo, update[store.ExtraInfo])
+	dst.Owner = store.ProviderIdentity(updateString(string(dst.Owner), string(src.Owner), update[store.Owner]))
+}
+
+func updateString(dst, src string, op store.Operation) string {
+	switch op {
+	case store.NoUpdate:
+		return dst
+	case store.Set:
+		return src
+	case store.Clear:
+		return ""
+	default:
+		panic("unsupported operation requested on string field")
+	}
+}
+
+func updateTime(dst, src time.Time, op store.Operation) time.Time {
+	switch op {
+	case store.NoUpdate:
+		return dst
+	case store.Set:
+		return src
+	case store.Clear:
+		return time.Time{}
+	default:
+		panic("unsupported operation requested on time field")
+	}
+}
+
+func updateStrings(dst, src []string, op store.Operation) []string {
+	switch op {
+	case store.NoUpdate:
+		return dst
+	case store.Set:
+		return append([]string(nil), src...)
+	case store.Clear:
+		return nil
+	case store.Push:
+		for _, s := range src {
+			if !containsString(dst, s) {
+				dst = append(dst, s)
+			}
+		}
+		return dst
+	case store.Pull:
+		var ndst []string
+		for _, s := range dst {
+			if !containsString(src, s) {
+				ndst = append(ndst, s)
+			}
+		}
+		return ndst
+	default:
+		panic("unsupported operation requested on []string field")
+	}
+}
+
+func containsString(ss []string, s string) bool {
+	for _, t := range ss {
+		if s == t {
+			return true
+		}
+	}
+	return false
+}
+
+func updateKeys(dst, src []bakery.PublicKey, op store.Operation) []bakery.PublicKey {
+	switch op {
+	case store.NoUpdate:
+		return dst
+	case store.Set:
+		return append([]bakery.PublicKey(nil), src...)
+	case store.Clear:
+		return nil
+	case store.Push:
+		for _, k := range src {
+			if !containsKey(dst, k) {
+				dst = append(dst, k)
+			}
+		}
+		return dst
+	case store.Pull:
+		var ndst []bakery.PublicKey
+		for _, k := range dst {
+			if !containsKey(src, k) {
+				ndst = append(ndst, k)
+			}
+		}
+		return ndst
+	default:
+		panic("unsupported operation requested on []bakery.PublicKey field")
+	}
+}
+
+func containsKey(ks []bakery.PublicKey, k bakery.PublicKey) bool {
+	for _, k1 := range ks {
+		if k == k1 {
+			return true
+		}
+	}
+	return false
+}
+
+func updateMap(dst, src map[string][]string, op store.Operation) map[string][]string {
+	for k, v := range src {
+		ss := updateStrings(dst[k], v, op)
+		if len(ss) == 0 {
+			delete(dst, k)
+		} else {
+			dst[k] = ss
+		}
+	}
+	return dst
+}
@@ -17,6 +17,10 @@ var (
 	// ErrDuplicateUsername is the error cause used when an update
 	// attempts to set a username that is already in use.
 	ErrDuplicateUsername = errgo.New("duplicate username")
+
+	// ErrReadOnly is the error cause used when an update is rejected
+	// because the identity server is read-only.
+	ErrReadOnly = errgo.New("read only")
 )
 
 // NotFoundError creates a new error with a cause of ErrNotFound and an
@@ -0,0 +1,393 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package etcd provides a store.ProviderDataStore that keeps the data
+// of identity providers, such as login state, in an etcd cluster. This
+// allows deployments that already run etcd to avoid a separate
+// database just for that data. The store uses the JSON gateway of the
+// etcd v3 API.
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+)
+
+// maxUpdateAttempts holds the maximum number of times that an
+// optimistic read-modify-write update is attempted when it conflicts
+// with a concurrent update.
+const maxUpdateAttempts = 10
+
+// codeUnauthenticated holds the gRPC status code returned when an
+// authentication token is invalid or has expired.
+const codeUnauthenticated = 16
+
+// errUnauthenticated is the error cause returned by do when etcd
+// rejects the authentication token.
+var errUnauthenticated = errgo.New("unauthenticated")
+
+// Params holds the parameters for a ProviderDataStore.
+type Params struct {
+	// Endpoints holds the URLs of the etcd servers. Each request is
+	// sent to the servers in turn until one can be contacted.
+	Endpoints []string
+
+	// Prefix holds the prefix of all the keys written to etcd. If
+	// this is empty, "candid/" is used.
+	Prefix string
+
+	// Username and Password, if set, hold the credentials used to
+	// authenticate to etcd.
+	Username string
+	Password string
+
+	// Client holds the HTTP client used to contact etcd. If this is
+	// nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// Now returns the current time. If this is nil, time.Now is
+	// used.
+	Now func() time.Time
+}
+
+// ProviderDataStore is a store.ProviderDataStore that keeps the data
+// of each identity provider under "<prefix>idpkv/<idp>/" in etcd.
+// Expiring keys are attached to etcd leases, so that etcd removes them
+// when they expire.
+type ProviderDataStore struct {
+	p Params
+
+	mu    sync.Mutex
+	token string
+}
+
+// NewProviderDataStore returns a new ProviderDataStore using the given
+// parameters.
+func NewProviderDataStore(p Params) *ProviderDataStore {
+	if p.Prefix == "" {
+		p.Prefix = "candid/"
+	}
+	if p.Client == nil {
+		p.Client = http.DefaultClient
+	}
+	if p.Now == nil {
+		p.Now = time.Now
+	}
+	return &ProviderDataStore{
+		p: p,
+	}
+}
+
+// KeyValueStore implements store.ProviderDataStore.KeyValueStore.
+func (s *ProviderDataStore) KeyValueStore(_ context.Context, idp string) (simplekv.Store, error) {
+	return &kvStore{
+		s:      s,
+		prefix: s.p.Prefix + "idpkv/" + idp + "/",
+	}, nil
+}
+
+// kvStore implements simplekv.Store using the keys in etcd that start
+// with prefix.
+type kvStore struct {
+	s      *ProviderDataStore
+	prefix string
+}
+
+// Context implements simplekv.Store.Context.
+func (s *kvStore) Context(ctx context.Context) (context.Context, func()) {
+	return ctx, func() {}
+}
+
+// Get implements simplekv.Store.Get.
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
+	kv, err := s.s.get(ctx, s.prefix+key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if kv == nil {
+		return nil, errgo.WithCausef(nil, simplekv.ErrNotFound, "key %s not found", key)
+	}
+	return kv.value(), nil
+}
+
+// Set implements simplekv.Store.Set.
+func (s *kvStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	op, err := s.s.writeOp(ctx, s.prefix+key, value, expire)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	_, err = s.s.txn(ctx, nil, op)
+	return errgo.Mask(err)
+}
+
+// Update implements simplekv.Store.Update.
+func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	for i := 0; i < maxUpdateAttempts; i++ {
+		kv, err := s.s.get(ctx, s.prefix+key)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		var old []byte
+		cmp := compare{
+			Key:    []byte(s.prefix + key),
+			Target: "CREATE",
+		}
+		if kv != nil {
+			old = kv.value()
+			cmp = compare{
+				Key:         []byte(s.prefix + key),
+				Target:      "MOD",
+				ModRevision: kv.ModRevision,
+			}
+		}
+		value, err := getVal(old)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		op, err := s.s.writeOp(ctx, s.prefix+key, value, expire)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		ok, err := s.s.txn(ctx, &cmp, op)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if ok {
+			return nil
+		}
+	}
+	return errgo.Newf("cannot update key %s: too many concurrent updates", key)
+}
+
+// keyValue holds a key and its value as returned by etcd.
+type keyValue struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value"`
+	ModRevision int64  `json:"mod_revision,string"`
+}
+
+// value returns the value of the key. An empty value is returned as an
+// empty, rather than nil, slice so that it can be distinguished from a
+// key that is not found.
+func (kv *keyValue) value() []byte {
+	if kv.Value == nil {
+		return []byte{}
+	}
+	return kv.Value
+}
+
+type rangeRequest struct {
+	Key []byte `json:"key"`
+}
+
+type rangeResponse struct {
+	KVs []keyValue `json:"kvs"`
+}
+
+// compare holds a comparison made by a transaction. A CREATE
+// comparison with a zero revision succeeds if the key does not exist.
+type compare struct {
+	Key         []byte `json:"key"`
+	Target      string `json:"target"`
+	ModRevision int64  `json:"mod_revision,string,omitempty"`
+}
+
+type putRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value,omitempty"`
+	Lease int64  `json:"lease,string,omitempty"`
+}
+
+type deleteRangeRequest struct {
+	Key []byte `json:"key"`
+}
+
+// requestOp holds one operation of a transaction.
+type requestOp struct {
+	Put         *putRequest         `json:"request_put,omitempty"`
+	DeleteRange *deleteRangeRequest `json:"request_delete_range,omitempty"`
+}
+
+type txnRequest struct {
+	Compare []compare   `json:"compare,omitempty"`
+	Success []requestOp `json:"success"`
+}
+
+type txnResponse struct {
+	Succeeded bool `json:"succeeded"`
+}
+
+type leaseGrantRequest struct {
+	TTL int64 `json:"TTL,string"`
+}
+
+type leaseGrantResponse struct {
+	ID int64 `json:"ID,string"`
+}
+
+type authenticateRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type authenticateResponse struct {
+	Token string `json:"token"`
+}
+
+type errorResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+// get returns the given key, or nil if it does not exist.
+func (s *ProviderDataStore) get(ctx context.Context, key string) (*keyValue, error) {
+	var resp rangeResponse
+	if err := s.call(ctx, "/v3/kv/range", rangeRequest{Key: []byte(key)}, &resp); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(resp.KVs) == 0 {
+		return nil, nil
+	}
+	return &resp.KVs[0], nil
+}
+
+// writeOp returns the operation that sets the given key to the given
+// value until the given time. Keys that have already expired are
+// deleted.
+func (s *ProviderDataStore) writeOp(ctx context.Context, key string, value []byte, expire time.Time) (requestOp, error) {
+	if expire.IsZero() {
+		return requestOp{Put: &putRequest{Key: []byte(key), Value: value}}, nil
+	}
+	ttl := expire.Sub(s.p.Now())
+	if ttl <= 0 {
+		return requestOp{DeleteRange: &deleteRangeRequest{Key: []byte(key)}}, nil
+	}
+	var resp leaseGrantResponse
+	// Lease TTLs are in whole seconds, so round up to make sure that
+	// the key does not expire early.
+	req := leaseGrantRequest{TTL: int64((ttl + time.Second - 1) / time.Second)}
+	if err := s.call(ctx, "/v3/lease/grant", req, &resp); err != nil {
+		return requestOp{}, errgo.Notef(err, "cannot grant lease")
+	}
+	return requestOp{Put: &putRequest{Key: []byte(key), Value: value, Lease: resp.ID}}, nil
+}
+
+// txn runs the given operation, if cmp is nil or the comparison
+// succeeds. It reports whether the operation was run.
+func (s *ProviderDataStore) txn(ctx context.Context, cmp *compare, op requestOp) (bool, error) {
+	req := txnRequest{
+		Success: []requestOp{op},
+	}
+	if cmp != nil {
+		req.Compare = []compare{*cmp}
+	}
+	var resp txnResponse
+	if err := s.call(ctx, "/v3/kv/txn", req, &resp); err != nil {
+		return false, errgo.Mask(err)
+	}
+	return resp.Succeeded, nil
+}
+
+// call makes a request to the given etcd API path, authenticating
+// first if credentials are configured.
+func (s *ProviderDataStore) call(ctx context.Context, path string, req, resp interface{}) error {
+	if s.p.Username == "" {
+		return errgo.Mask(s.do(ctx, path, "", req, resp))
+	}
+	token, err := s.authToken(ctx, false)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	err = s.do(ctx, path, token, req, resp)
+	if errgo.Cause(err) != errUnauthenticated {
+		return errgo.Mask(err)
+	}
+	// The token has expired, get a new one and try again.
+	token, err = s.authToken(ctx, true)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(s.do(ctx, path, token, req, resp))
+}
+
+// authToken returns the token used to authenticate to etcd. If renew
+// is true, or there is no token, a new token is obtained.
+func (s *ProviderDataStore) authToken(ctx context.Context, renew bool) (string, error) {
+	s.mu.Lock()
+	token := s.token
+	s.mu.Unlock()
+	if token != "" && !renew {
+		return token, nil
+	}
+	var resp authenticateResponse
+	req := authenticateRequest{
+		Name:     s.p.Username,
+		Password: s.p.Password,
+	}
+	if err := s.do(ctx, "/v3/auth/authenticate", "", req, &resp); err != nil {
+		return "", errgo.Notef(err, "cannot authenticate to etcd")
+	}
+	s.mu.Lock()
+	s.token = resp.Token
+	s.mu.Unlock()
+	return resp.Token, nil
+}
+
+// do posts the given request to the given etcd API path and
+// unmarshals the response into resp. The servers are tried in turn
+// until one can be contacted.
+func (s *ProviderDataStore) do(ctx context.Context, path, token string, req, resp interface{}) error {
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var lastErr error
+	for _, ep := range s.p.Endpoints {
+		hreq, err := http.NewRequest("POST", strings.TrimSuffix(ep, "/")+path, bytes.NewReader(buf))
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		hreq.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			hreq.Header.Set("Authorization", token)
+		}
+		hresp, err := s.p.Client.Do(hreq.WithContext(ctx))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		defer hresp.Body.Close()
+		if hresp.StatusCode != http.StatusOK {
+			var eresp errorResponse
+			if err := httprequest.UnmarshalJSONResponse(hresp, &eresp); err != nil {
+				return errgo.Notef(err, "etcd request failed: %s", hresp.Status)
+			}
+			msg := eresp.Message
+			if msg == "" {
+				msg = eresp.Error
+			}
+			if eresp.Code == codeUnauthenticated {
+				return errgo.WithCausef(nil, errUnauthenticated, "etcd request failed: %s", msg)
+			}
+			return errgo.Newf("etcd request failed: %s", msg)
+		}
+		if err := httprequest.UnmarshalJSONResponse(hresp, resp); err != nil {
+			return errgo.Notef(err, "cannot unmarshal etcd response")
+		}
+		return nil
+	}
+	if lastErr == nil {
+		return errgo.Newf("no etcd endpoints configured")
+	}
+	return errgo.Notef(lastErr, "cannot contact etcd")
+}
@@ -0,0 +1,323 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package etcd_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/store"
+	"github.com/CanonicalLtd/candid/store/etcd"
+	"github.com/CanonicalLtd/candid/store/storetest"
+)
+
+func TestKeyValueStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestKeyValueStore(c, func(c *qt.C) store.ProviderDataStore {
+		kv := newFakeEtcd(c)
+		return etcd.NewProviderDataStore(etcd.Params{
+			Endpoints: []string{kv.srv.URL},
+		})
+	})
+}
+
+func TestExpiry(t *testing.T) {
+	c := qt.New(t)
+	kv := newFakeEtcd(c)
+	s := etcd.NewProviderDataStore(etcd.Params{
+		Endpoints: []string{kv.srv.URL},
+		Now:       kv.now,
+	})
+	ctx := context.Background()
+	st, err := s.KeyValueStore(ctx, "test")
+	c.Assert(err, qt.Equals, nil)
+
+	err = st.Set(ctx, "key", []byte("value"), kv.now().Add(90*time.Second))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(kv.has("candid/idpkv/test/key"), qt.Equals, true)
+
+	kv.advance(time.Minute)
+	v, err := st.Get(ctx, "key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "value")
+
+	kv.advance(time.Minute)
+	_, err = st.Get(ctx, "key")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+	// A key set with an expiry time in the past is removed.
+	err = st.Set(ctx, "key2", []byte("value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = st.Set(ctx, "key2", []byte("value"), kv.now().Add(-time.Second))
+	c.Assert(err, qt.Equals, nil)
+	_, err = st.Get(ctx, "key2")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+}
+
+func TestAuthentication(t *testing.T) {
+	c := qt.New(t)
+	kv := newFakeEtcd(c)
+	kv.password = "secret"
+	s := etcd.NewProviderDataStore(etcd.Params{
+		Endpoints: []string{kv.srv.URL},
+		Prefix:    "test/",
+		Username:  "candid",
+		Password:  "secret",
+	})
+	ctx := context.Background()
+	st, err := s.KeyValueStore(ctx, "test")
+	c.Assert(err, qt.Equals, nil)
+	err = st.Set(ctx, "key", []byte("value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(kv.has("test/idpkv/test/key"), qt.Equals, true)
+
+	// An expired token is renewed.
+	kv.revokeTokens()
+	v, err := st.Get(ctx, "key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "value")
+
+	s = etcd.NewProviderDataStore(etcd.Params{
+		Endpoints: []string{kv.srv.URL},
+		Username:  "candid",
+		Password:  "wrong",
+	})
+	st, err = s.KeyValueStore(ctx, "test")
+	c.Assert(err, qt.Equals, nil)
+	_, err = st.Get(ctx, "key")
+	c.Assert(err, qt.ErrorMatches, `cannot authenticate to etcd: etcd request failed: authentication failed, invalid user ID or password`)
+}
+
+func TestEndpointFailover(t *testing.T) {
+	c := qt.New(t)
+	kv := newFakeEtcd(c)
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	s := etcd.NewProviderDataStore(etcd.Params{
+		Endpoints: []string{dead.URL, kv.srv.URL},
+	})
+	ctx := context.Background()
+	st, err := s.KeyValueStore(ctx, "test")
+	c.Assert(err, qt.Equals, nil)
+	err = st.Set(ctx, "key", []byte("value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	s = etcd.NewProviderDataStore(etcd.Params{
+		Endpoints: []string{dead.URL},
+	})
+	st, err = s.KeyValueStore(ctx, "test")
+	c.Assert(err, qt.Equals, nil)
+	_, err = st.Get(ctx, "key")
+	c.Assert(err, qt.ErrorMatches, `cannot contact etcd: .*`)
+}
+
+// fakeEtcd is a minimal implementation of the etcd v3 JSON gateway.
+type fakeEtcd struct {
+	c   *qt.C
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	t        time.Time
+	revision int64
+	kvs      map[string]*fakeKeyValue
+	leases   map[int64]time.Time
+	password string
+	tokens   map[string]bool
+}
+
+type fakeKeyValue struct {
+	value       []byte
+	modRevision int64
+	lease       int64
+}
+
+func newFakeEtcd(c *qt.C) *fakeEtcd {
+	kv := &fakeEtcd{
+		c:      c,
+		t:      time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC),
+		kvs:    make(map[string]*fakeKeyValue),
+		leases: make(map[int64]time.Time),
+		tokens: make(map[string]bool),
+	}
+	kv.srv = httptest.NewServer(http.HandlerFunc(kv.serveHTTP))
+	c.Defer(kv.srv.Close)
+	return kv
+}
+
+func (kv *fakeEtcd) now() time.Time {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.t
+}
+
+func (kv *fakeEtcd) advance(d time.Duration) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.t = kv.t.Add(d)
+}
+
+func (kv *fakeEtcd) revokeTokens() {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.tokens = make(map[string]bool)
+}
+
+func (kv *fakeEtcd) has(key string) bool {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.get(key) != nil
+}
+
+// get returns the given key, removing it if its lease has expired.
+// It must be called with kv.mu held.
+func (kv *fakeEtcd) get(key string) *fakeKeyValue {
+	v := kv.kvs[key]
+	if v == nil {
+		return nil
+	}
+	if v.lease != 0 && !kv.leases[v.lease].After(kv.t) {
+		delete(kv.kvs, key)
+		return nil
+	}
+	return v
+}
+
+type fakeOp struct {
+	Put *struct {
+		Key   []byte `json:"key"`
+		Value []byte `json:"value"`
+		Lease string `json:"lease"`
+	} `json:"request_put"`
+	DeleteRange *struct {
+		Key []byte `json:"key"`
+	} `json:"request_delete_range"`
+}
+
+func (kv *fakeEtcd) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if kv.password != "" && req.URL.Path != "/v3/auth/authenticate" && !kv.tokens[req.Header.Get("Authorization")] {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   "etcdserver: invalid auth token",
+			"message": "etcdserver: invalid auth token",
+			"code":    16,
+		})
+		return
+	}
+	switch req.URL.Path {
+	case "/v3/auth/authenticate":
+		var areq struct {
+			Name     string `json:"name"`
+			Password string `json:"password"`
+		}
+		kv.decode(req, &areq)
+		if areq.Password != kv.password {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error": "authentication failed, invalid user ID or password",
+				"code":  3,
+			})
+			return
+		}
+		kv.revision++
+		token := "token-" + strconv.FormatInt(kv.revision, 10)
+		kv.tokens[token] = true
+		json.NewEncoder(w).Encode(map[string]string{"token": token})
+	case "/v3/kv/range":
+		var rreq struct {
+			Key []byte `json:"key"`
+		}
+		kv.decode(req, &rreq)
+		resp := map[string]interface{}{}
+		if v := kv.get(string(rreq.Key)); v != nil {
+			resp["kvs"] = []map[string]interface{}{{
+				"key":          rreq.Key,
+				"value":        v.value,
+				"mod_revision": strconv.FormatInt(v.modRevision, 10),
+			}}
+		}
+		json.NewEncoder(w).Encode(resp)
+	case "/v3/lease/grant":
+		var lreq struct {
+			TTL string `json:"TTL"`
+		}
+		kv.decode(req, &lreq)
+		ttl, err := strconv.ParseInt(lreq.TTL, 10, 64)
+		kv.c.Check(err, qt.Equals, nil)
+		kv.revision++
+		kv.leases[kv.revision] = kv.t.Add(time.Duration(ttl) * time.Second)
+		json.NewEncoder(w).Encode(map[string]string{
+			"ID":  strconv.FormatInt(kv.revision, 10),
+			"TTL": lreq.TTL,
+		})
+	case "/v3/kv/txn":
+		var treq struct {
+			Compare []struct {
+				Key         []byte `json:"key"`
+				Target      string `json:"target"`
+				ModRevision string `json:"mod_revision"`
+			} `json:"compare"`
+			Success []fakeOp `json:"success"`
+		}
+		kv.decode(req, &treq)
+		for _, cmp := range treq.Compare {
+			v := kv.get(string(cmp.Key))
+			var ok bool
+			switch cmp.Target {
+			case "CREATE":
+				ok = v == nil
+			case "MOD":
+				ok = v != nil && strconv.FormatInt(v.modRevision, 10) == cmp.ModRevision
+			default:
+				kv.c.Errorf("unexpected compare target %q", cmp.Target)
+			}
+			if !ok {
+				json.NewEncoder(w).Encode(map[string]interface{}{"succeeded": false})
+				return
+			}
+		}
+		kv.revision++
+		for _, op := range treq.Success {
+			switch {
+			case op.Put != nil:
+				var lease int64
+				if op.Put.Lease != "" {
+					var err error
+					lease, err = strconv.ParseInt(op.Put.Lease, 10, 64)
+					kv.c.Check(err, qt.Equals, nil)
+				}
+				kv.kvs[string(op.Put.Key)] = &fakeKeyValue{
+					value:       op.Put.Value,
+					modRevision: kv.revision,
+					lease:       lease,
+				}
+			case op.DeleteRange != nil:
+				delete(kv.kvs, string(op.DeleteRange.Key))
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"succeeded": true})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "not found", "code": 5})
+	}
+}
+
+func (kv *fakeEtcd) decode(req *http.Request, v interface{}) {
+	err := json.NewDecoder(req.Body).Decode(v)
+	kv.c.Check(err, qt.Equals, nil)
+}
@@ -0,0 +1,158 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// The functions in this file implement the FindIdentities filters,
+// conditions and sort orders for stores that evaluate them in memory.
+
+// MatchIdentity reports whether identity a matches the reference
+// identity ref when the given filter is applied.
+func MatchIdentity(a, ref *Identity, filter Filter) bool {
+	for f, c := range filter {
+		if c == NoComparison {
+			continue
+		}
+		if !matchField(a, ref, Field(f), c) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchConditions reports whether identity a meets all of the given
+// conditions.
+func MatchConditions(a *Identity, conditions []Condition) bool {
+	for _, cond := range conditions {
+		if cond.Comparison == After {
+			if !SortsAfter(a, &cond.Ref, cond.Sort) {
+				return false
+			}
+			continue
+		}
+		if !matchField(a, &cond.Ref, cond.Field, cond.Comparison) {
+			return false
+		}
+	}
+	return true
+}
+
+// SortsAfter reports whether identity a comes after identity b in the
+// given sort order.
+func SortsAfter(a, b *Identity, sort []Sort) bool {
+	return cmpIdentities(a, b, sort) > 0
+}
+
+// SortIdentities sorts the given identities into the given sort order.
+func SortIdentities(identities []Identity, sortFields []Sort) {
+	sort.SliceStable(identities, func(i, j int) bool {
+		return cmpIdentities(&identities[i], &identities[j], sortFields) < 0
+	})
+}
+
+// cmpIdentities compares identities a and b in the given sort order,
+// returning -1, 0 or 1 in the same way as strings.Compare.
+func cmpIdentities(a, b *Identity, sort []Sort) int {
+	for _, s := range sort {
+		n := cmpField(a, b, s.Field)
+		if s.Descending {
+			n = -n
+		}
+		if n != 0 {
+			return n
+		}
+	}
+	return 0
+}
+
+// matchField determines whether the given field of identity a has the
+// relationship specified by the given Comparison with the same field of
+// identity b.
+func matchField(a, b *Identity, f Field, c Comparison) bool {
+	switch c {
+	case HasPrefix:
+		return strings.HasPrefix(stringField(a, f), stringField(b, f))
+	case HasSuffix:
+		return strings.HasSuffix(stringField(a, f), stringField(b, f))
+	case Contains:
+		if f != Groups {
+			panic("unsupported filter field")
+		}
+		for _, g := range b.Groups {
+			if !containsString(a.Groups, g) {
+				return false
+			}
+		}
+		return true
+	}
+	n := cmpField(a, b, f)
+	switch c {
+	case Equal:
+		return n == 0
+	case NotEqual:
+		return n != 0
+	case GreaterThan:
+		return n > 0
+	case LessThan:
+		return n < 0
+	case GreaterThanOrEqual:
+		return n >= 0
+	case LessThanOrEqual:
+		return n <= 0
+	default:
+		panic("unsupported comparison")
+	}
+}
+
+func stringField(id *Identity, f Field) string {
+	switch f {
+	case ProviderID:
+		return string(id.ProviderID)
+	case Username:
+		return id.Username
+	case Name:
+		return id.Name
+	case Email:
+		return id.Email
+	case Owner:
+		return string(id.Owner)
+	}
+	panic("unsupported filter field")
+}
+
+// cmpField compares the given field of identities a and b, returning
+// -1, 0 or 1 in the same way as strings.Compare.
+func cmpField(a, b *Identity, f Field) int {
+	switch f {
+	case LastLogin:
+		return cmpTime(a.LastLogin, b.LastLogin)
+	case LastDischarge:
+		return cmpTime(a.LastDischarge, b.LastDischarge)
+	}
+	return strings.Compare(stringField(a, f), stringField(b, f))
+}
+
+func cmpTime(t, u time.Time) int {
+	if t.After(u) {
+		return 1
+	}
+	if t.Before(u) {
+		return -1
+	}
+	return 0
+}
+
+func containsString(ss []string, s string) bool {
+	for _, t := range ss {
+		if s == t {
+			return true
+		}
+	}
+	return false
+}
@@ -8,8 +8,16 @@ import (
 	"time"
 
 	"github.com/CanonicalLtd/candid/meeting"
+	"github.com/CanonicalLtd/candid/store"
 )
 
 var PutAtTime = func(ctx context.Context, s meeting.Store, id, address string, now time.Time) error {
 	return s.(*meetingStore).put(ctx, id, address, now)
 }
+
+func HasWatchers(s store.Store) bool {
+	st := s.(*memStore)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.watchers) > 0
+}
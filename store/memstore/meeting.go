@@ -16,18 +16,23 @@ import (
 // NewMeetingStore creates a new in-memory meeting.Store implementation.
 func NewMeetingStore() meeting.Store {
 	return &meetingStore{
-		data: make(map[string]meetingStoreEntry),
+		data:     make(map[string]meetingStoreEntry),
+		replicas: make(map[string]time.Time),
 	}
 }
 
 type meetingStore struct {
-	mu   sync.Mutex
-	data map[string]meetingStoreEntry
+	mu       sync.Mutex
+	data     map[string]meetingStoreEntry
+	replicas map[string]time.Time
 }
 
 type meetingStoreEntry struct {
-	address string
-	time    time.Time
+	address  string
+	time     time.Time
+	data0    []byte
+	data1    []byte
+	complete bool
 }
 
 // Context implements meeting.Store.Context by returning the given
@@ -56,6 +61,48 @@ func (s *meetingStore) put(_ context.Context, id, address string, now time.Time)
 	return nil
 }
 
+// PutData implements meeting.PollStore.PutData.
+func (s *meetingStore) PutData(_ context.Context, id, address string, data0 []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data[id]; ok {
+		return errgo.Newf("duplicate id %q in meeting store", id)
+	}
+	s.data[id] = meetingStoreEntry{
+		address: address,
+		time:    time.Now(),
+		data0:   data0,
+	}
+	return nil
+}
+
+// Complete implements meeting.PollStore.Complete.
+func (s *meetingStore) Complete(_ context.Context, id string, data1 []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.data[id]
+	if !ok {
+		return errgo.New("rendezvous not found, probably expired")
+	}
+	if e.complete {
+		return errgo.Newf("rendezvous %q done twice", id)
+	}
+	e.data1 = data1
+	e.complete = true
+	s.data[id] = e
+	return nil
+}
+
+// GetData implements meeting.PollStore.GetData.
+func (s *meetingStore) GetData(_ context.Context, id string) (data0, data1 []byte, complete bool, _ error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.data[id]; ok {
+		return e.data0, e.data1, e.complete, nil
+	}
+	return nil, nil, false, errgo.New("rendezvous not found, probably expired")
+}
+
 // Get implements meeting.Store.Get.
 func (s *meetingStore) Get(_ context.Context, id string) (address string, _ error) {
 	s.mu.Lock()
@@ -90,3 +137,32 @@ func (s *meetingStore) RemoveOld(_ context.Context, addr string, olderThan time.
 	}
 	return ids, nil
 }
+
+// Heartbeat implements meeting.ReplicaStore.Heartbeat.
+func (s *meetingStore) Heartbeat(_ context.Context, address string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replicas[address] = now
+	return nil
+}
+
+// RemoveReplica implements meeting.ReplicaStore.RemoveReplica.
+func (s *meetingStore) RemoveReplica(_ context.Context, address string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.replicas, address)
+	return nil
+}
+
+// RemoveDeadReplicas implements meeting.ReplicaStore.RemoveDeadReplicas.
+func (s *meetingStore) RemoveDeadReplicas(_ context.Context, olderThan time.Time) (addresses []string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr, t := range s.replicas {
+		if t.Before(olderThan) {
+			delete(s.replicas, addr)
+			addresses = append(addresses, addr)
+		}
+	}
+	return addresses, nil
+}
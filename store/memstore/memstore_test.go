@@ -1,7 +1,9 @@
 package memstore_test
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/juju/aclstore/v2"
@@ -31,6 +33,108 @@ func TestStore(t *testing.T) {
 	})
 }
 
+func TestUpdateIdentitiesAtomic(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	ctx := context.Background()
+	s := memstore.NewStore()
+	existing := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "existing"),
+		Username:   "existing",
+		Name:       "Existing User",
+	}
+	err := s.UpdateIdentity(ctx, &existing, store.Update{
+		store.Username: store.Set,
+		store.Name:     store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	identities := []*store.Identity{{
+		ProviderID: store.MakeProviderIdentity("test", "existing"),
+		Username:   "existing",
+		Name:       "Changed Name",
+	}, {
+		ProviderID: store.MakeProviderIdentity("test", "new"),
+		Username:   "new",
+	}, {
+		ProviderID: store.MakeProviderIdentity("test", "duplicate"),
+		Username:   "new",
+	}}
+	err = s.UpdateIdentities(ctx, identities, store.Update{
+		store.Username: store.Set,
+		store.Name:     store.Set,
+	})
+	c.Assert(err, qt.ErrorMatches, `username new already in use`)
+	c.Assert(identities[1].ID, qt.Equals, "")
+
+	identity := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "existing"),
+	}
+	err = s.Identity(ctx, &identity)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(identity.Name, qt.Equals, "Existing User")
+
+	identity = store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "new"),
+	}
+	err = s.Identity(ctx, &identity)
+	c.Assert(err, qt.ErrorMatches, `identity "test:new" not found`)
+}
+
+func TestWatchIdentities(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := memstore.NewStore()
+	events := make(chan store.IdentityEvent)
+	done := make(chan error)
+	go func() {
+		done <- s.(store.Watcher).WatchIdentities(ctx, events)
+	}()
+	// Wait for the watcher to be registered.
+	for !memstore.HasWatchers(s) {
+		time.Sleep(time.Millisecond)
+	}
+
+	identity := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+	}
+	err := s.UpdateIdentity(ctx, &identity, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+	// Discharges are not reported.
+	err = s.UpdateIdentity(ctx, &store.Identity{
+		Username:      "bob",
+		LastDischarge: time.Now(),
+	}, store.Update{
+		store.LastDischarge: store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = s.UpdateIdentity(ctx, &store.Identity{
+		Username: "bob",
+		Name:     "Bob",
+	}, store.Update{
+		store.Name: store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	c.Assert(<-events, qt.DeepEquals, store.IdentityEvent{
+		Type: store.IdentityCreated,
+		ID:   identity.ID,
+	})
+	c.Assert(<-events, qt.DeepEquals, store.IdentityEvent{
+		Type: store.IdentityUpdated,
+		ID:   identity.ID,
+	})
+	cancel()
+	c.Assert(<-done, qt.Equals, context.Canceled)
+}
+
 func TestMeetingStore(t *testing.T) {
 	c := qt.New(t)
 	defer c.Done()
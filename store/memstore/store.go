@@ -8,7 +8,6 @@ package memstore
 import (
 	"context"
 	"fmt"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -23,6 +22,9 @@ import (
 type memStore struct {
 	mu         sync.Mutex
 	identities []*store.Identity
+
+	// watchers holds the watchers that are sent identity events.
+	watchers map[*watcher]bool
 }
 
 // NewStore creates a new in-memory store.Store instance.
@@ -50,7 +52,9 @@ func (s *memStore) RemoveAll() {
 	for _, identity := range s.identities {
 		if identity.ProviderID == adminID {
 			identities = append(identities, identity)
+			continue
 		}
+		s.notify(store.IdentityEvent{Type: store.IdentityDeleted, ID: identity.ID})
 	}
 	s.identities = identities
 }
@@ -107,12 +111,12 @@ func (s *memStore) identityFromUsername(username string) *store.Identity {
 }
 
 // FindIdentities implements store.Store.FindIdentities.
-func (s *memStore) FindIdentities(ctx context.Context, ref *store.Identity, filter store.Filter, sortFields []store.Sort, skip, limit int) ([]store.Identity, error) {
+func (s *memStore) FindIdentities(ctx context.Context, ref *store.Identity, filter store.Filter, sortFields []store.Sort, skip, limit int, conditions ...store.Condition) ([]store.Identity, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	identities := make([]store.Identity, 0, len(s.identities))
 	for _, identity := range s.identities {
-		if !matchIdentity(identity, ref, filter) {
+		if !store.MatchIdentity(identity, ref, filter) || !store.MatchConditions(identity, conditions) {
 			continue
 		}
 		var identity1 store.Identity
@@ -123,10 +127,7 @@ func (s *memStore) FindIdentities(ctx context.Context, ref *store.Identity, filt
 		return nil, nil
 	}
 	if len(sortFields) > 0 {
-		sort.Sort(identitySort{
-			identities: identities,
-			sort:       sortFields,
-		})
+		store.SortIdentities(identities, sortFields)
 	}
 	identities = identities[skip:]
 	if limit > 0 && limit < len(identities) {
@@ -135,137 +136,99 @@ func (s *memStore) FindIdentities(ctx context.Context, ref *store.Identity, filt
 	return identities, nil
 }
 
-func matchIdentity(a, b *store.Identity, filter store.Filter) bool {
-	for f, c := range filter {
-		if c == store.NoComparison {
+// SearchIdentities implements store.Store.SearchIdentities.
+func (s *memStore) SearchIdentities(ctx context.Context, text string, skip, limit int) ([]store.Identity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	text = strings.ToLower(text)
+	identities := make([]store.Identity, 0, len(s.identities))
+	for _, identity := range s.identities {
+		if !strings.Contains(strings.ToLower(identity.Username), text) &&
+			!strings.Contains(strings.ToLower(identity.Email), text) &&
+			!strings.Contains(strings.ToLower(identity.Name), text) {
 			continue
 		}
-		var r int
-		switch store.Field(f) {
-		case store.ProviderID:
-			r = strings.Compare(string(a.ProviderID), string(b.ProviderID))
-		case store.Username:
-			r = strings.Compare(a.Username, b.Username)
-		case store.Name:
-			r = strings.Compare(a.Name, b.Name)
-		case store.Email:
-			r = strings.Compare(a.Email, b.Email)
-		case store.LastLogin:
-			r = cmpTime(a.LastLogin, b.LastLogin)
-		case store.LastDischarge:
-			r = cmpTime(a.LastDischarge, b.LastDischarge)
-		case store.Owner:
-			r = strings.Compare(string(a.Owner), string(b.Owner))
-		default:
-			panic("unsupported filter field")
-		}
-		if !matchCmp(r, c) {
-			return false
-		}
+		var identity1 store.Identity
+		copyIdentity(&identity1, identity)
+		identities = append(identities, identity1)
 	}
-	return true
-}
-
-// matchCmp determines whether the given value n which is a result of a
-// "cmp" function such as strings.Compare indicates that the compared
-// values have the relationship specified by the given store.Comparison.
-func matchCmp(n int, c store.Comparison) bool {
-	switch c {
-	case store.Equal:
-		return n == 0
-	case store.NotEqual:
-		return n != 0
-	case store.GreaterThan:
-		return n > 0
-	case store.LessThan:
-		return n < 0
-	case store.GreaterThanOrEqual:
-		return n >= 0
-	case store.LessThanOrEqual:
-		return n <= 0
-	default:
-		panic("unsupported comparison")
+	if skip > len(identities) {
+		return nil, nil
+	}
+	store.SortIdentities(identities, []store.Sort{{Field: store.Username}})
+	identities = identities[skip:]
+	if limit > 0 && limit < len(identities) {
+		identities = identities[:limit]
 	}
+	return identities, nil
 }
 
-func cmpTime(t, u time.Time) int {
-	if t.After(u) {
-		return 1
+// UpdateIdentity implements store.Store.UpdateIdentity.
+func (s *memStore) UpdateIdentity(_ context.Context, identity *store.Identity, update store.Update) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	event, err := s.update(identity, update)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(store.ErrNotFound), errgo.Is(store.ErrDuplicateUsername))
 	}
-	if t.Before(u) {
-		return -1
+	if !store.IsDischargeUpdate(update) {
+		s.notify(event)
 	}
-	return 0
-}
-
-type identitySort struct {
-	identities []store.Identity
-	sort       []store.Sort
-}
-
-func (s identitySort) Len() int {
-	return len(s.identities)
-}
-
-func (s identitySort) Swap(i, j int) {
-	s.identities[i], s.identities[j] = s.identities[j], s.identities[i]
+	return nil
 }
 
-func (s identitySort) Less(i, j int) bool {
-	a := &s.identities[i]
-	b := &s.identities[j]
-	for _, sort := range s.sort {
-		switch s.cmp(a, b, sort.Field, sort.Descending) {
-		case 1:
-			return false
-		case -1:
-			return true
-		}
+// UpdateIdentities implements store.Store.UpdateIdentities. If any
+// update fails the store is restored to its state before the call.
+func (s *memStore) UpdateIdentities(_ context.Context, identities []*store.Identity, update store.Update) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := make([]store.Identity, len(s.identities))
+	for i, id := range s.identities {
+		copyIdentity(&saved[i], id)
 	}
-	return false
-}
-
-func (s identitySort) cmp(a, b *store.Identity, f store.Field, desc bool) int {
-	cmp := 0
-	switch f {
-	case store.ProviderID:
-		cmp = strings.Compare(string(a.ProviderID), string(b.ProviderID))
-	case store.Username:
-		cmp = strings.Compare(a.Username, b.Username)
-	case store.Name:
-		cmp = strings.Compare(a.Name, b.Name)
-	case store.Email:
-		cmp = strings.Compare(a.Email, b.Email)
-	case store.LastLogin:
-		cmp = cmpTime(a.LastLogin, b.LastLogin)
-	case store.LastDischarge:
-		cmp = cmpTime(a.LastDischarge, b.LastDischarge)
-	default:
-		panic("unsupported sort field")
+	ids := make([]string, len(identities))
+	for i, identity := range identities {
+		ids[i] = identity.ID
+	}
+	events := make([]store.IdentityEvent, len(identities))
+	for i, identity := range identities {
+		var err error
+		events[i], err = s.update(identity, update)
+		if err != nil {
+			for i := range saved {
+				*s.identities[i] = saved[i]
+			}
+			s.identities = s.identities[:len(saved)]
+			for i, identity := range identities {
+				identity.ID = ids[i]
+			}
+			return errgo.Mask(err, errgo.Is(store.ErrNotFound), errgo.Is(store.ErrDuplicateUsername))
+		}
 	}
-	if desc {
-		return 0 - cmp
+	if !store.IsDischargeUpdate(update) {
+		for _, ev := range events {
+			s.notify(ev)
+		}
 	}
-	return cmp
+	return nil
 }
 
-// UpdateIdentity implements store.Store.UpdateIdentity.
-func (s *memStore) UpdateIdentity(_ context.Context, identity *store.Identity, update store.Update) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// update performs a single identity update, returning the event that
+// reports it. It must be called with s.mu held.
+func (s *memStore) update(identity *store.Identity, update store.Update) (store.IdentityEvent, error) {
 	var id *store.Identity
 	switch {
 	case identity.ID != "":
 		n, err := strconv.Atoi(identity.ID)
 		if err != nil || n >= len(s.identities) {
-			return store.NotFoundError(identity.ID, "", "")
+			return store.IdentityEvent{}, store.NotFoundError(identity.ID, "", "")
 		}
 		id = s.identities[n]
 	case identity.ProviderID != "":
 		id = s.identityFromProviderID(identity.ProviderID)
 		if id == nil {
 			if identity.Username == "" || update[store.Username] == store.NoUpdate {
-				return store.NotFoundError("", identity.ProviderID, "")
+				return store.IdentityEvent{}, store.NotFoundError("", identity.ProviderID, "")
 			}
 			n := len(s.identities)
 			id = &store.Identity{
@@ -275,21 +238,24 @@ func (s *memStore) UpdateIdentity(_ context.Context, identity *store.Identity, u
 				ExtraInfo:    make(map[string][]string),
 			}
 			if err := s.updateIdentity(id, identity, update); err != nil {
-				return errgo.Mask(err, errgo.Is(store.ErrDuplicateUsername))
+				return store.IdentityEvent{}, errgo.Mask(err, errgo.Is(store.ErrDuplicateUsername))
 			}
 			s.identities = append(s.identities, id)
 			identity.ID = id.ID
-			return nil
+			return store.IdentityEvent{Type: store.IdentityCreated, ID: id.ID}, nil
 		}
 	case identity.Username != "":
 		id = s.identityFromUsername(identity.Username)
 		if id == nil {
-			return store.NotFoundError("", "", identity.Username)
+			return store.IdentityEvent{}, store.NotFoundError("", "", identity.Username)
 		}
 	default:
-		return store.NotFoundError("", "", "")
+		return store.IdentityEvent{}, store.NotFoundError("", "", "")
 	}
-	return errgo.Mask(s.updateIdentity(id, identity, update), errgo.Is(store.ErrDuplicateUsername))
+	if err := s.updateIdentity(id, identity, update); err != nil {
+		return store.IdentityEvent{}, errgo.Mask(err, errgo.Is(store.ErrDuplicateUsername))
+	}
+	return store.IdentityEvent{Type: store.IdentityUpdated, ID: id.ID}, nil
 }
 
 func (s *memStore) updateIdentity(dst, src *store.Identity, update store.Update) error {
@@ -452,6 +418,76 @@ func copyIdentity(dst, src *store.Identity) {
 	dst.ExtraInfo = updateMap(make(map[string][]string), src.ExtraInfo, store.Set)
 }
 
+// WatchIdentities implements store.Watcher.WatchIdentities.
+func (s *memStore) WatchIdentities(ctx context.Context, events chan<- store.IdentityEvent) error {
+	w := &watcher{
+		ready: make(chan struct{}, 1),
+	}
+	s.mu.Lock()
+	if s.watchers == nil {
+		s.watchers = make(map[*watcher]bool)
+	}
+	s.watchers[w] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.watchers, w)
+		s.mu.Unlock()
+	}()
+	for {
+		select {
+		case <-w.ready:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		for _, ev := range w.take() {
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// notify sends the given event to all watchers. It must be called
+// with s.mu held.
+func (s *memStore) notify(ev store.IdentityEvent) {
+	for w := range s.watchers {
+		w.add(ev)
+	}
+}
+
+// A watcher queues the events for a call to WatchIdentities, so that
+// updates are not blocked by a slow receiver.
+type watcher struct {
+	// ready receives a value when events are added.
+	ready chan struct{}
+
+	mu     sync.Mutex
+	events []store.IdentityEvent
+}
+
+// add adds the given event to the queue.
+func (w *watcher) add(ev store.IdentityEvent) {
+	w.mu.Lock()
+	w.events = append(w.events, ev)
+	w.mu.Unlock()
+	select {
+	case w.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take removes and returns all queued events.
+func (w *watcher) take() []store.IdentityEvent {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	events := w.events
+	w.events = nil
+	return events
+}
+
 // IdentityCounts implements store.Store.IdentityCounts.
 func (s *memStore) IdentityCounts(_ context.Context) (map[string]int, error) {
 	s.mu.Lock()
@@ -5,15 +5,16 @@ package mgostore
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/juju/aclstore/v2"
-	"github.com/juju/simplekv/mgosimplekv"
 	"github.com/juju/utils/debugstatus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
-	"gopkg.in/macaroon-bakery.v2/bakery/mgorootkeystore"
-	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/macaroon-bakery.v2/bakery/dbrootkeystore"
 
 	"github.com/CanonicalLtd/candid/meeting"
 	"github.com/CanonicalLtd/candid/store"
@@ -25,78 +26,68 @@ const aclsCollection = "acls"
 // can be used as the persistent storage for the various types of store
 // required by the identity service.
 type backend struct {
-	db       *mgo.Database
-	rootKeys *mgorootkeystore.RootKeys
+	db       *mongo.Database
+	rootKeys *dbrootkeystore.RootKeys
 	aclStore aclstore.ACLStore
+
+	// client holds the client that is disconnected when the
+	// backend is closed, if the backend owns it.
+	client *mongo.Client
 }
 
 // NewBackend creates a new Backend instance using the given
-// *mgo.Database. The given Database's underlying session will be
-// copied. The Backend must be closed when finished with.
-func NewBackend(db *mgo.Database) (_ store.Backend, err error) {
-	db = db.With(db.Session.Copy())
-	defer func() {
-		if err != nil {
-			db.Session.Close()
-		}
-	}()
+// *mongo.Database. The database's client remains owned by the caller
+// and must not be disconnected until the Backend has been closed.
+func NewBackend(db *mongo.Database) (store.Backend, error) {
+	return newBackend(db, nil)
+}
 
-	if err := ensureIdentityIndexes(db); err != nil {
+// newBackend is the internal version of NewBackend. If client is not
+// nil it will be disconnected when the backend is closed.
+func newBackend(db *mongo.Database, client *mongo.Client) (store.Backend, error) {
+	ctx := context.Background()
+	if err := ensureIdentityIndexes(ctx, db); err != nil {
 		return nil, errgo.Mask(err)
 	}
-	if err := ensureMeetingIndexes(db); err != nil {
+	if err := ensureMeetingIndexes(ctx, db); err != nil {
 		return nil, errgo.Mask(err)
 	}
-	rk := mgorootkeystore.NewRootKeys(1000) // TODO(mhilton) make this configurable?
-	if err := ensureBakeryIndexes(rk, db); err != nil {
+	if err := ensureBakeryIndexes(ctx, db); err != nil {
 		return nil, errgo.Mask(err)
 	}
-	aclStore, err := mgosimplekv.NewStore(db.C(aclsCollection))
+	aclStore, err := newKeyValueStore(ctx, db.Collection(aclsCollection))
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
 	return &backend{
 		db:       db,
-		rootKeys: rk,
+		rootKeys: dbrootkeystore.NewRootKeys(1000, nil), // TODO(mhilton) make this configurable?
 		aclStore: aclstore.NewACLStore(aclStore),
+		client:   client,
 	}, nil
 }
 
 // Close cleans up resources associated with the database.
 func (b *backend) Close() {
-	b.db.Session.Close()
-}
-
-// context returns a context with session information attached such that
-// subsequent operations that use the context will be consistent. This
-// function may return the context it was passed if suitable session
-// information is already available. The return close function should
-// always be called once the context is not longer needed.
-func (b *backend) context(ctx context.Context) (_ context.Context, close func()) {
-	if s, _ := ctx.Value(sessionKey{}).(*mgo.Session); s != nil {
-		return ctx, func() {}
+	if b.client == nil {
+		return
+	}
+	if err := b.client.Disconnect(context.Background()); err != nil {
+		logger.Errorf("cannot disconnect from mongodb: %s", err)
 	}
-	// TODO (mhilton) add some more advanced session pooling.
-	s := b.db.Session.Copy()
-	return context.WithValue(ctx, sessionKey{}, s), s.Close
 }
 
-type sessionKey struct{}
-
-// s returns a *mgo.Session for use in subsequent queries. The returned
-// session must be closed once finished with.
-func (b *backend) s(ctx context.Context) *mgo.Session {
-	if s, _ := ctx.Value(sessionKey{}).(*mgo.Session); s != nil {
-		return s.Clone()
-	}
-	return b.db.Session.Copy()
+// context implements the Context method of the various stores. The
+// mongodb driver manages its own connection pool, so there is no
+// per-request state to attach to the context.
+func (b *backend) context(ctx context.Context) (_ context.Context, close func()) {
+	return ctx, func() {}
 }
 
-// c returns a *mgo.Collection with the given name in the current
-// database. The collection's underlying session must be closed when the
-// query is complete.
-func (b *backend) c(ctx context.Context, name string) *mgo.Collection {
-	return b.db.C(name).With(b.s(ctx))
+// c returns the collection with the given name in the current
+// database.
+func (b *backend) c(name string) *mongo.Collection {
+	return b.db.Collection(name)
 }
 
 // Store implements store.Backend.Store.
@@ -111,10 +102,19 @@ func (b *backend) MeetingStore() meeting.Store {
 
 // BakeryRootKeyStore implements store.Backend.BakeryRootKeyStore.
 func (b *backend) BakeryRootKeyStore() bakery.RootKeyStore {
+	return b.BakeryRootKeyStoreWithPolicy(store.RootKeyPolicy{
+		ExpiryDuration: 365 * 24 * time.Hour,
+	})
+}
+
+// BakeryRootKeyStoreWithPolicy implements
+// store.RootKeyPolicyBackend.BakeryRootKeyStoreWithPolicy.
+func (b *backend) BakeryRootKeyStoreWithPolicy(p store.RootKeyPolicy) bakery.RootKeyStore {
 	return &rootKeyStore{
 		b: b,
-		policy: mgorootkeystore.Policy{
-			ExpiryDuration: 365 * 24 * time.Hour,
+		policy: dbrootkeystore.Policy{
+			GenerateInterval: p.GenerateInterval,
+			ExpiryDuration:   p.ExpiryDuration,
 		},
 	}
 }
@@ -127,7 +127,7 @@ func (b *backend) ProviderDataStore() store.ProviderDataStore {
 // DebugStatusCheckerFuncs implements store.Backend.DebugStatusCheckerFuncs.
 func (b *backend) DebugStatusCheckerFuncs() []debugstatus.CheckerFunc {
 	return []debugstatus.CheckerFunc{
-		debugstatus.MongoCollections(collector{b.db}),
+		b.collectionsStatus,
 		b.meetingStatus,
 	}
 }
@@ -137,25 +137,68 @@ func (b *backend) ACLStore() aclstore.ACLStore {
 	return b.aclStore
 }
 
-type collector struct {
-	db *mgo.Database
+// requiredCollections holds the collections that must exist for the
+// store to be working.
+var requiredCollections = []string{
+	macaroonCollection,
+	meetingCollection,
+	identitiesCollection,
+	aclsCollection,
 }
 
-// Collections implements debugstatus.Collector.Collections.
-func (c collector) Collections() []*mgo.Collection {
-	return []*mgo.Collection{
-		c.db.C(macaroonCollection),
-		c.db.C(meetingCollection),
-		c.db.C(identitiesCollection),
-		c.db.C(aclsCollection),
+// collectionsStatus is a debugstatus.CheckerFunc that checks that all
+// the required collections exist in the database.
+func (b *backend) collectionsStatus(ctx context.Context) (key string, result debugstatus.CheckResult) {
+	result.Name = "MongoDB collections"
+	cur, err := b.db.ListCollections(ctx, bson.D{})
+	if err != nil {
+		result.Value = "Cannot get collections: " + err.Error()
+		return "mongo_collections", result
+	}
+	defer cur.Close(ctx)
+	exists := make(map[string]bool)
+	for cur.Next(ctx) {
+		var coll struct {
+			Name string `bson:"name"`
+		}
+		if err := cur.Decode(&coll); err != nil {
+			result.Value = "Cannot get collections: " + err.Error()
+			return "mongo_collections", result
+		}
+		exists[coll.Name] = true
+	}
+	if err := cur.Err(); err != nil {
+		result.Value = "Cannot get collections: " + err.Error()
+		return "mongo_collections", result
 	}
+	var missing []string
+	for _, name := range requiredCollections {
+		if !exists[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		result.Value = fmt.Sprintf("Missing collections: %s", missing)
+		return "mongo_collections", result
+	}
+	result.Value = "All required collections exist"
+	result.Passed = true
+	return "mongo_collections", result
 }
 
-// CollectionNames implements debugstatus.Collector.CollectionNames by
-// wrapping the CollectionNames method of mgo.Database with some session
-// handling code.
-func (c collector) CollectionNames() ([]string, error) {
-	s := c.db.Session.Copy()
-	defer s.Close()
-	return c.db.With(s).CollectionNames()
+// isDuplicate reports whether the given error was caused by a
+// duplicate key.
+func isDuplicate(err error) bool {
+	const duplicateKey = 11000
+	switch err := errgo.Cause(err).(type) {
+	case mongo.WriteException:
+		for _, we := range err.WriteErrors {
+			if we.Code == duplicateKey {
+				return true
+			}
+		}
+	case mongo.CommandError:
+		return err.Code == duplicateKey
+	}
+	return false
 }
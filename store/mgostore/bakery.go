@@ -5,40 +5,98 @@ package mgostore
 
 import (
 	"context"
+	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	errgo "gopkg.in/errgo.v1"
-	"gopkg.in/macaroon-bakery.v2/bakery/mgorootkeystore"
-	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/dbrootkeystore"
 )
 
 const macaroonCollection = "macaroons"
 
 type rootKeyStore struct {
 	b      *backend
-	policy mgorootkeystore.Policy
+	policy dbrootkeystore.Policy
 }
 
-// Get implements bakery.RootKeyStore.Get by wrapping mgorootkeystore
+// Get implements bakery.RootKeyStore.Get by wrapping dbrootkeystore
 // implementation with code to determine the collection.
 func (s rootKeyStore) Get(ctx context.Context, id []byte) ([]byte, error) {
-	coll := s.b.c(ctx, macaroonCollection)
-	defer coll.Database.Session.Close()
-	store := s.b.rootKeys.NewStore(coll, s.policy)
-	return store.Get(ctx, id)
+	return s.store(ctx).Get(ctx, id)
 }
 
 // RootKey implements bakery.RootKeyStore.RootKey by wrapping
-// mgorootkeystore implementation with code to determine the collection.
+// dbrootkeystore implementation with code to determine the collection.
 func (s rootKeyStore) RootKey(ctx context.Context) ([]byte, []byte, error) {
-	coll := s.b.c(ctx, macaroonCollection)
-	defer coll.Database.Session.Close()
-	store := s.b.rootKeys.NewStore(coll, s.policy)
-	return store.RootKey(ctx)
+	return s.store(ctx).RootKey(ctx)
 }
 
-func ensureBakeryIndexes(rk *mgorootkeystore.RootKeys, db *mgo.Database) error {
-	if err := rk.EnsureIndex(db.C(macaroonCollection)); err != nil {
-		return errgo.Mask(err)
+func (s rootKeyStore) store(ctx context.Context) bakery.RootKeyStore {
+	return s.b.rootKeys.NewStore(backing{
+		ctx:  ctx,
+		coll: s.b.c(macaroonCollection),
+	}, s.policy)
+}
+
+// backing implements dbrootkeystore.Backing using a mongodb
+// collection.
+type backing struct {
+	ctx  context.Context
+	coll *mongo.Collection
+}
+
+// GetKey implements dbrootkeystore.Backing.GetKey.
+func (b backing) GetKey(id []byte) (dbrootkeystore.RootKey, error) {
+	var key dbrootkeystore.RootKey
+	err := b.coll.FindOne(b.ctx, bson.D{{"_id", id}}).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		return dbrootkeystore.RootKey{}, bakery.ErrNotFound
+	}
+	if err != nil {
+		return dbrootkeystore.RootKey{}, errgo.Notef(err, "cannot get key from database")
+	}
+	return key, nil
+}
+
+// FindLatestKey implements dbrootkeystore.Backing.FindLatestKey.
+func (b backing) FindLatestKey(createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
+	var key dbrootkeystore.RootKey
+	err := b.coll.FindOne(b.ctx, bson.D{
+		{"created", bson.D{{"$gte", createdAfter}}},
+		{"expires", bson.D{
+			{"$gte", expiresAfter},
+			{"$lte", expiresBefore},
+		}},
+	}, options.FindOne().SetSort(bson.D{{"created", -1}})).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		return dbrootkeystore.RootKey{}, nil
+	}
+	if err != nil {
+		return dbrootkeystore.RootKey{}, errgo.Notef(err, "cannot query existing keys")
+	}
+	return key, nil
+}
+
+// InsertKey implements dbrootkeystore.Backing.InsertKey.
+func (b backing) InsertKey(key dbrootkeystore.RootKey) error {
+	if _, err := b.coll.InsertOne(b.ctx, key); err != nil {
+		return errgo.Notef(err, "mongo insert failed")
+	}
+	return nil
+}
+
+func ensureBakeryIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(macaroonCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{{
+		Keys: bson.D{{"created", -1}},
+	}, {
+		Keys:    bson.D{{"expires", 1}},
+		Options: options.Index().SetExpireAfterSeconds(1),
+	}})
+	if err != nil {
+		return errgo.Notef(err, "cannot ensure indexes on %s", macaroonCollection)
 	}
 	return nil
 }
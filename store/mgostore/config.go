@@ -1,8 +1,16 @@
 package mgostore
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 	errgo "gopkg.in/errgo.v1"
-	mgo "gopkg.in/mgo.v2"
 
 	"github.com/CanonicalLtd/candid/store"
 )
@@ -10,15 +18,55 @@ import (
 // Params holds the specification for the parameters
 // used in the config file.
 type Params struct {
-	// Address holds the address of the MongoDB
-	// server to connect to, in host:port form.
+	// Address holds the address of the MongoDB server to connect
+	// to. This may be in host:port form, a comma separated list of
+	// host:port addresses, or a full mongodb:// or mongodb+srv://
+	// connection URI.
 	Address string `yaml:"address"`
 
 	// Database holds the database name to use.
 	// If this is empty, "candid" will be used.
 	Database string `yaml:"database"`
+
+	// Username and Password hold the credentials used to
+	// authenticate to the MongoDB server. If Username is empty, any
+	// credentials in the Address URI are used.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// AuthMechanism holds the authentication mechanism to use, for
+	// example "SCRAM-SHA-256". If this is empty the mechanism is
+	// negotiated with the server.
+	AuthMechanism string `yaml:"auth-mechanism"`
+
+	// AuthSource holds the name of the database that holds the
+	// user's credentials. If this is empty, "admin" is used.
+	AuthSource string `yaml:"auth-source"`
+
+	// TLS holds whether to connect to the server using TLS. TLS is
+	// also used if any of the TLS fields below are set.
+	TLS bool `yaml:"tls"`
+
+	// TLSCACert holds a PEM encoded CA certificate used to verify
+	// the server's certificate. If this is empty the system
+	// certificate pool is used.
+	TLSCACert string `yaml:"tls-ca-cert"`
+
+	// TLSCert and TLSKey hold a PEM encoded client certificate and
+	// key to present to the server.
+	TLSCert string `yaml:"tls-cert"`
+	TLSKey  string `yaml:"tls-key"`
+
+	// RetryWrites holds whether writes that fail because of a
+	// transient error are retried once. If this is not set, the
+	// driver default (enabled) is used.
+	RetryWrites *bool `yaml:"retry-writes"`
 }
 
+// dialTimeout holds the maximum time to wait for the MongoDB server
+// to become available when creating a backend.
+const dialTimeout = 10 * time.Second
+
 func init() {
 	store.Register("mongodb", unmarshalBackend)
 }
@@ -34,17 +82,105 @@ func unmarshalBackend(unmarshal func(interface{}) error) (store.BackendFactory,
 	if p.Database == "" {
 		p.Database = "candid"
 	}
+	if p.useTLS() {
+		// Check the TLS configuration now so that errors are
+		// reported when the configuration is read. The address
+		// is not checked because resolving a mongodb+srv URI
+		// requires a DNS lookup.
+		if _, err := p.tlsConfig(); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
 	return p, nil
 }
 
 // NewBackend implements store.BackendFactory.
 func (p Params) NewBackend() (store.Backend, error) {
 	logger.Infof("connecting to mongo")
-	session, err := mgo.Dial(p.Address)
+	opts, err := p.clientOptions()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot connect to mongo at %q", p.Address)
+	}
+	// Connect does not wait for the server to be available, so
+	// check that it can be reached before using it.
+	pingCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	if err := client.Ping(pingCtx, readpref.PrimaryPreferred()); err != nil {
+		client.Disconnect(ctx)
+		return nil, errgo.Notef(err, "cannot connect to mongo at %q", p.Address)
+	}
+	b, err := newBackend(client.Database(p.Database), client)
 	if err != nil {
-		return nil, errgo.Notef(err, "cannot dial mongo at %q", p.Address)
+		client.Disconnect(ctx)
+		return nil, errgo.Mask(err)
+	}
+	return b, nil
+}
+
+// clientOptions returns the options used to connect to the MongoDB
+// server.
+func (p Params) clientOptions() (*options.ClientOptions, error) {
+	opts := options.Client().ApplyURI(connectionURI(p.Address))
+	if p.Username != "" || p.AuthMechanism != "" {
+		opts.SetAuth(options.Credential{
+			AuthMechanism: p.AuthMechanism,
+			AuthSource:    p.AuthSource,
+			Username:      p.Username,
+			Password:      p.Password,
+			PasswordSet:   p.Password != "",
+		})
+	}
+	if p.useTLS() {
+		tlsConfig, err := p.tlsConfig()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	if p.RetryWrites != nil {
+		opts.SetRetryWrites(*p.RetryWrites)
+	}
+	return opts, nil
+}
+
+// useTLS reports whether TLS should be used to connect to the MongoDB
+// server.
+func (p Params) useTLS() bool {
+	return p.TLS || p.TLSCACert != "" || p.TLSCert != "" || p.TLSKey != ""
+}
+
+// tlsConfig returns the TLS configuration to use when connecting to the
+// MongoDB server.
+func (p Params) tlsConfig() (*tls.Config, error) {
+	conf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if p.TLSCACert != "" {
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM([]byte(p.TLSCACert)) {
+			return nil, errgo.Newf("no certificates found in mongodb tls-ca-cert")
+		}
+	}
+	if p.TLSCert != "" || p.TLSKey != "" {
+		cert, err := tls.X509KeyPair([]byte(p.TLSCert), []byte(p.TLSKey))
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid mongodb tls-cert or tls-key")
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// connectionURI returns the connection URI for the given address,
+// which may either be a URI or a list of host:port addresses.
+func connectionURI(addr string) string {
+	if strings.HasPrefix(addr, "mongodb://") || strings.HasPrefix(addr, "mongodb+srv://") {
+		return addr
 	}
-	defer session.Close()
-	db := session.DB(p.Database)
-	return NewBackend(db)
+	return "mongodb://" + addr
 }
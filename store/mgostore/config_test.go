@@ -19,8 +19,8 @@ func TestUnmarshal(t *testing.T) {
 	storetest.TestUnmarshal(c, `
 storage:
     type: mongodb
-    address: `+f.connStr+`
-    database: `+f.db.Name+`
+    address: `+f.db.URI+`
+    database: `+f.db.Name()+`
 `)
 }
 
@@ -47,7 +47,7 @@ func TestUnmarshalWithoutDatabase(t *testing.T) {
 	configData := `
 storage:
     type: mongodb
-    address: ` + f.connStr + `
+    address: ` + f.db.URI + `
 `
 	var cfg struct {
 		Storage *store.Config `yaml:"storage"`
@@ -59,3 +59,54 @@ storage:
 	c.Assert(ok, qt.Equals, true)
 	c.Assert(p.Database, qt.Equals, "candid")
 }
+
+func TestUnmarshalWithInvalidTLSCACert(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	configData := `
+storage:
+    type: mongodb
+    address: mongodb+srv://mongodb.example.com
+    tls-ca-cert: not a certificate
+`
+	var cfg struct {
+		Storage *store.Config `yaml:"storage"`
+	}
+	err := yaml.Unmarshal([]byte(configData), &cfg)
+	c.Assert(err, qt.ErrorMatches, `cannot unmarshal mongodb configuration: no certificates found in mongodb tls-ca-cert`)
+}
+
+func TestUnmarshalWithOptions(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	configData := `
+storage:
+    type: mongodb
+    address: mongodb+srv://mongodb.example.com
+    username: candid
+    password: secret
+    auth-mechanism: SCRAM-SHA-256
+    auth-source: admin
+    tls: true
+    retry-writes: false
+`
+	var cfg struct {
+		Storage *store.Config `yaml:"storage"`
+	}
+	err := yaml.Unmarshal([]byte(configData), &cfg)
+	c.Assert(err, qt.Equals, nil)
+
+	retryWrites := false
+	c.Assert(cfg.Storage.BackendFactory, qt.DeepEquals, mgostore.Params{
+		Address:       "mongodb+srv://mongodb.example.com",
+		Database:      "candid",
+		Username:      "candid",
+		Password:      "secret",
+		AuthMechanism: "SCRAM-SHA-256",
+		AuthSource:    "admin",
+		TLS:           true,
+		RetryWrites:   &retryWrites,
+	})
+}
@@ -7,8 +7,9 @@ import (
 	"time"
 
 	"github.com/juju/loggo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"gopkg.in/macaroon-bakery.v2/bakery"
-	"gopkg.in/mgo.v2/bson"
 
 	"github.com/CanonicalLtd/candid/store"
 )
@@ -35,7 +36,7 @@ var fieldNames = []string{
 // Mongo collection.
 type identityDocument struct {
 	// ID is the internal mongodb id for the identity.
-	ID bson.ObjectId `bson:"_id"`
+	ID primitive.ObjectID `bson:"_id"`
 
 	// ProviderID holds the identity provider specific id for the user.
 	ProviderID string
@@ -102,13 +103,13 @@ func (d *updateDocument) addUpdate(op store.Operation, name string, v interface{
 	switch op {
 	case store.NoUpdate:
 	case store.Set:
-		d.Set = append(d.Set, bson.DocElem{name, v})
+		d.Set = append(d.Set, bson.E{name, v})
 	case store.Clear:
-		d.Unset = append(d.Unset, bson.DocElem{name, ""})
+		d.Unset = append(d.Unset, bson.E{name, ""})
 	case store.Push:
-		d.AddToSet = append(d.AddToSet, bson.DocElem{name, bson.D{{"$each", v}}})
+		d.AddToSet = append(d.AddToSet, bson.E{name, bson.D{{"$each", v}}})
 	case store.Pull:
-		d.PullAll = append(d.PullAll, bson.DocElem{name, v})
+		d.PullAll = append(d.PullAll, bson.E{name, v})
 	default:
 		panic("invalid update operation")
 	}
@@ -4,10 +4,15 @@
 package mgostore
 
 import (
+	"bytes"
 	"context"
+	"time"
 
 	"github.com/juju/simplekv"
-	"github.com/juju/simplekv/mgosimplekv"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	errgo "gopkg.in/errgo.v1"
 )
 
 // an providerDataStore implements store.ProviderDataStore.
@@ -16,5 +21,143 @@ type providerDataStore struct {
 }
 
 func (s *providerDataStore) KeyValueStore(ctx context.Context, idp string) (simplekv.Store, error) {
-	return mgosimplekv.NewStore(s.backend.db.C("kv" + idp))
+	return newKeyValueStore(ctx, s.backend.c("kv"+idp))
+}
+
+// keyValueStore implements simplekv.Store using a mongodb collection.
+type keyValueStore struct {
+	coll *mongo.Collection
+}
+
+// keyValueDocument holds the in-database representation of a
+// key-value pair.
+type keyValueDocument struct {
+	Key    string    `bson:"_id"`
+	Value  []byte    `bson:"value"`
+	Expire time.Time `bson:"expire,omitempty"`
+}
+
+// newKeyValueStore returns a simplekv.Store that stores its values in
+// the given collection.
+func newKeyValueStore(ctx context.Context, coll *mongo.Collection) (*keyValueStore, error) {
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"expire", 1}},
+		Options: options.Index().SetExpireAfterSeconds(1),
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot ensure index on %s", coll.Name())
+	}
+	return &keyValueStore{coll: coll}, nil
+}
+
+// Context implements simplekv.Store.Context.
+func (s *keyValueStore) Context(ctx context.Context) (_ context.Context, close func()) {
+	return ctx, func() {}
+}
+
+// Get implements simplekv.Store.Get.
+func (s *keyValueStore) Get(ctx context.Context, key string) ([]byte, error) {
+	doc, err := s.get(ctx, key)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrNotFound))
+	}
+	return doc.Value, nil
+}
+
+// get returns the unexpired document with the given key.
+func (s *keyValueStore) get(ctx context.Context, key string) (*keyValueDocument, error) {
+	var doc keyValueDocument
+	err := s.coll.FindOne(ctx, bson.D{{"_id", key}}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, errgo.WithCausef(nil, simplekv.ErrNotFound, "key %s not found", key)
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if !doc.Expire.IsZero() && doc.Expire.Before(time.Now()) {
+		// The document has expired but has not yet been
+		// removed by mongodb.
+		return nil, errgo.WithCausef(nil, simplekv.ErrNotFound, "key %s not found", key)
+	}
+	return &doc, nil
+}
+
+// Set implements simplekv.Store.Set.
+func (s *keyValueStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	_, err := s.coll.ReplaceOne(ctx, bson.D{{"_id", key}}, keyValueDocument{
+		Key:    key,
+		Value:  value,
+		Expire: expire,
+	}, options.Replace().SetUpsert(true))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// Update implements simplekv.Store.Update.
+func (s *keyValueStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	for {
+		var old []byte
+		var oldDoc *keyValueDocument
+		doc, err := s.get(ctx, key)
+		switch errgo.Cause(err) {
+		case nil:
+			old = doc.Value
+			oldDoc = doc
+		case simplekv.ErrNotFound:
+		default:
+			return errgo.Mask(err)
+		}
+		val, err := getVal(old)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		newDoc := keyValueDocument{
+			Key:    key,
+			Value:  val,
+			Expire: expire,
+		}
+		if oldDoc == nil {
+			// There is no current value, so only replace a
+			// document if it has expired.
+			_, err := s.coll.ReplaceOne(ctx, bson.D{
+				{"_id", key},
+				{"expire", bson.D{{"$lt", time.Now()}}},
+			}, newDoc, options.Replace().SetUpsert(true))
+			if isDuplicate(err) {
+				// Another client has set the value
+				// concurrently; try again.
+				continue
+			}
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			return nil
+		}
+		if bytes.Equal(oldDoc.Value, val) && oldDoc.Expire.Equal(expire) {
+			return nil
+		}
+		// Only replace the document if it has not changed since we
+		// read it.
+		filter := bson.D{
+			{"_id", key},
+			{"value", oldDoc.Value},
+		}
+		if oldDoc.Expire.IsZero() {
+			filter = append(filter, bson.E{"expire", bson.D{{"$exists", false}}})
+		} else {
+			filter = append(filter, bson.E{"expire", oldDoc.Expire})
+		}
+		res, err := s.coll.ReplaceOne(ctx, filter, newDoc)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if res.MatchedCount == 0 {
+			// The value has been changed concurrently; try
+			// again.
+			continue
+		}
+		return nil
+	}
 }
@@ -9,15 +9,19 @@ import (
 	"time"
 
 	"github.com/juju/utils/debugstatus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"gopkg.in/errgo.v1"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
 )
 
 type doc struct {
-	Id      string `bson:"_id"`
-	Addr    string
-	Created time.Time
+	Id        string `bson:"_id"`
+	Addr      string
+	Created   time.Time
+	Data0     []byte `bson:",omitempty"`
+	Data1     []byte `bson:",omitempty"`
+	Completed bool   `bson:",omitempty"`
 }
 
 const meetingCollection = "meeting"
@@ -41,10 +45,8 @@ func (s *meetingStore) Put(ctx context.Context, id, address string) error {
 // put is the internal version of Put which takes a time
 // for testing purposes.
 func (s *meetingStore) put(ctx context.Context, id, address string, now time.Time) error {
-	coll := s.b.c(ctx, meetingCollection)
-	defer coll.Database.Session.Close()
-
-	err := coll.Insert(&doc{
+	coll := s.b.c(meetingCollection)
+	_, err := coll.InsertOne(ctx, &doc{
 		Id:      id,
 		Addr:    address,
 		Created: now,
@@ -55,14 +57,64 @@ func (s *meetingStore) put(ctx context.Context, id, address string, now time.Tim
 	return nil
 }
 
+// PutData implements meeting.PollStore.PutData.
+func (s *meetingStore) PutData(ctx context.Context, id, address string, data0 []byte) error {
+	coll := s.b.c(meetingCollection)
+	_, err := coll.InsertOne(ctx, &doc{
+		Id:      id,
+		Addr:    address,
+		Created: time.Now(),
+		Data0:   data0,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// Complete implements meeting.PollStore.Complete.
+func (s *meetingStore) Complete(ctx context.Context, id string, data1 []byte) error {
+	coll := s.b.c(meetingCollection)
+	res, err := coll.UpdateOne(ctx,
+		bson.D{{"_id", id}, {"completed", bson.D{{"$ne", true}}}},
+		bson.D{{"$set", bson.D{{"data1", data1}, {"completed", true}}}},
+	)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if res.MatchedCount > 0 {
+		return nil
+	}
+	n, err := coll.CountDocuments(ctx, bson.D{{"_id", id}})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if n == 0 {
+		return errgo.Newf("rendezvous not found, probably expired")
+	}
+	return errgo.Newf("rendezvous %q done twice", id)
+}
+
+// GetData implements meeting.PollStore.GetData.
+func (s *meetingStore) GetData(ctx context.Context, id string) (data0, data1 []byte, complete bool, err error) {
+	coll := s.b.c(meetingCollection)
+	var entry doc
+	err = coll.FindOne(ctx, bson.D{{"_id", id}}).Decode(&entry)
+	if err == mongo.ErrNoDocuments {
+		err = errgo.Newf("rendezvous not found, probably expired")
+	}
+	if err != nil {
+		return nil, nil, false, errgo.Mask(err)
+	}
+	return entry.Data0, entry.Data1, entry.Completed, nil
+}
+
 // Get implements meeting.Store.Get.
 func (s *meetingStore) Get(ctx context.Context, id string) (address string, err error) {
-	coll := s.b.c(ctx, meetingCollection)
-	defer coll.Database.Session.Close()
-
+	coll := s.b.c(meetingCollection)
 	var entry doc
-	err = coll.FindId(id).One(&entry)
-	if err == mgo.ErrNotFound {
+	err = coll.FindOne(ctx, bson.D{{"_id", id}}).Decode(&entry)
+	if err == mongo.ErrNoDocuments {
 		err = errgo.Newf("rendezvous not found, probably expired")
 	}
 	if err != nil {
@@ -73,18 +125,13 @@ func (s *meetingStore) Get(ctx context.Context, id string) (address string, err
 
 // Remove implements meeting.Store.Remove.
 func (s *meetingStore) Remove(ctx context.Context, id string) (time.Time, error) {
-	coll := s.b.c(ctx, meetingCollection)
-	defer coll.Database.Session.Close()
-
+	coll := s.b.c(meetingCollection)
 	var entry doc
-	change := mgo.Change{
-		Remove: true,
-	}
-	_, err := coll.FindId(id).Apply(change, &entry)
-	if err == mgo.ErrNotFound {
+	err := coll.FindOneAndDelete(ctx, bson.D{{"_id", id}}).Decode(&entry)
+	if err == mongo.ErrNoDocuments {
 		return time.Time{}, nil
 	}
-	if err != nil && err != mgo.ErrNotFound {
+	if err != nil {
 		return time.Time{}, errgo.Mask(err)
 	}
 	return entry.Created, nil
@@ -92,40 +139,105 @@ func (s *meetingStore) Remove(ctx context.Context, id string) (time.Time, error)
 
 // RemoveOld implements meeting.Store.RemoveOld.
 func (s *meetingStore) RemoveOld(ctx context.Context, addr string, olderThan time.Time) (ids []string, err error) {
-	coll := s.b.c(ctx, meetingCollection)
-	defer coll.Database.Session.Close()
-
+	coll := s.b.c(meetingCollection)
 	query := bson.D{{"created", bson.D{{"$lt", olderThan}}}}
 	if addr != "" {
-		query = append(query, bson.DocElem{"addr", addr})
+		query = append(query, bson.E{"addr", addr})
 	}
-	iter := coll.Find(query).Select(nil).Iter()
-	var entry doc
-	for iter.Next(&entry) {
-		err := coll.RemoveId(entry.Id)
-		if err != nil {
+	cur, err := coll.Find(ctx, query, options.Find().SetProjection(bson.D{{"_id", 1}}))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var entry doc
+		if err := cur.Decode(&entry); err != nil {
+			return ids, errgo.Mask(err)
+		}
+		if _, err := coll.DeleteOne(ctx, bson.D{{"_id", entry.Id}}); err != nil {
 			return ids, errgo.Notef(err, "cannot remove %q", entry.Id)
 		}
 		ids = append(ids, entry.Id)
 	}
-	if err := iter.Err(); err != nil {
+	if err := cur.Err(); err != nil {
 		return ids, errgo.Mask(err)
 	}
 	return ids, nil
 }
 
-var indexes = []mgo.Index{{
-	Key: []string{"addr", "created"},
+type replicaDoc struct {
+	Addr      string `bson:"_id"`
+	Heartbeat time.Time
+}
+
+const replicaCollection = "meeting_replicas"
+
+// Heartbeat implements meeting.ReplicaStore.Heartbeat.
+func (s *meetingStore) Heartbeat(ctx context.Context, address string, now time.Time) error {
+	coll := s.b.c(replicaCollection)
+	_, err := coll.UpdateOne(ctx,
+		bson.D{{"_id", address}},
+		bson.D{{"$set", bson.D{{"heartbeat", now}}}},
+		options.Update().SetUpsert(true),
+	)
+	return errgo.Mask(err)
+}
+
+// RemoveReplica implements meeting.ReplicaStore.RemoveReplica.
+func (s *meetingStore) RemoveReplica(ctx context.Context, address string) error {
+	coll := s.b.c(replicaCollection)
+	_, err := coll.DeleteOne(ctx, bson.D{{"_id", address}})
+	return errgo.Mask(err)
+}
+
+// RemoveDeadReplicas implements meeting.ReplicaStore.RemoveDeadReplicas.
+func (s *meetingStore) RemoveDeadReplicas(ctx context.Context, olderThan time.Time) (addresses []string, err error) {
+	coll := s.b.c(replicaCollection)
+	cur, err := coll.Find(ctx, bson.D{{"heartbeat", bson.D{{"$lt", olderThan}}}})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var entry replicaDoc
+		if err := cur.Decode(&entry); err != nil {
+			return addresses, errgo.Mask(err)
+		}
+		// Only remove the replica if it hasn't recorded a
+		// heartbeat since we found it.
+		res, err := coll.DeleteOne(ctx, bson.D{
+			{"_id", entry.Addr},
+			{"heartbeat", bson.D{{"$lt", olderThan}}},
+		})
+		if err != nil {
+			return addresses, errgo.Notef(err, "cannot remove replica %q", entry.Addr)
+		}
+		if res.DeletedCount == 0 {
+			continue
+		}
+		addresses = append(addresses, entry.Addr)
+	}
+	if err := cur.Err(); err != nil {
+		return addresses, errgo.Mask(err)
+	}
+	return addresses, nil
+}
+
+var indexes = []mongo.IndexModel{{
+	Keys: bson.D{{"addr", 1}, {"created", 1}},
 }, {
-	Key: []string{"created"},
+	Keys: bson.D{{"created", 1}},
 }}
 
-func ensureMeetingIndexes(db *mgo.Database) error {
-	coll := db.C(meetingCollection)
-	for _, idx := range indexes {
-		if err := coll.EnsureIndex(idx); err != nil {
-			return errgo.Mask(err)
-		}
+func ensureMeetingIndexes(ctx context.Context, db *mongo.Database) error {
+	if _, err := db.Collection(meetingCollection).Indexes().CreateMany(ctx, indexes); err != nil {
+		return errgo.Notef(err, "cannot ensure indexes on %s", meetingCollection)
+	}
+	_, err := db.Collection(replicaCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{"heartbeat", 1}},
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot ensure indexes on %s", replicaCollection)
 	}
 	return nil
 }
@@ -133,10 +245,8 @@ func ensureMeetingIndexes(db *mgo.Database) error {
 func (b *backend) meetingStatus(ctx context.Context) (key string, result debugstatus.CheckResult) {
 	result.Name = "count of meeting collection"
 	result.Passed = true
-	coll := b.c(ctx, meetingCollection)
-	defer coll.Database.Session.Close()
-	c, err := coll.Count()
-	result.Value = strconv.Itoa(c)
+	c, err := b.c(meetingCollection).CountDocuments(ctx, bson.D{})
+	result.Value = strconv.FormatInt(c, 10)
 	if err != nil {
 		result.Value = err.Error()
 		result.Passed = false
@@ -2,15 +2,13 @@ package mgostore_test
 
 import (
 	"context"
-	"os"
 	"testing"
-	"time"
 
 	qt "github.com/frankban/quicktest"
 	aclstore "github.com/juju/aclstore/v2"
-	"github.com/juju/mgotest"
 	errgo "gopkg.in/errgo.v1"
 
+	"github.com/CanonicalLtd/candid/internal/mongotest"
 	"github.com/CanonicalLtd/candid/meeting"
 	"github.com/CanonicalLtd/candid/store"
 	"github.com/CanonicalLtd/candid/store/mgostore"
@@ -74,35 +72,23 @@ func TestRootKeyStore(t *testing.T) {
 
 type fixture struct {
 	backend store.Backend
-	db      *mgotest.Database
-	connStr string
+	db      *mongotest.Database
 }
 
 func newFixture(c *qt.C) *fixture {
-	db, err := mgotest.New()
-	if errgo.Cause(err) == mgotest.ErrDisabled {
-		c.Skip("mgotest disabled")
+	db, err := mongotest.New()
+	if errgo.Cause(err) == mongotest.ErrDisabled {
+		c.Skip("mongotest disabled")
 	}
 	c.Assert(err, qt.Equals, nil)
-	// mgotest sets the SocketTimout to 1s. Restore it back to the
-	// default value.
-	db.Session.SetSocketTimeout(time.Minute)
+	c.Defer(db.Close)
 
 	backend, err := mgostore.NewBackend(db.Database)
-	if err != nil {
-		db.Close()
-		c.Fatal(err)
-	}
 	c.Assert(err, qt.Equals, nil)
 	c.Defer(backend.Close)
 
-	connStr := os.Getenv("MGOCONNECTIONSTRING")
-	if connStr == "" {
-		connStr = "localhost"
-	}
 	return &fixture{
 		db:      db,
 		backend: backend,
-		connStr: connStr,
 	}
 }
@@ -6,11 +6,14 @@ package mgostore
 import (
 	"context"
 	"fmt"
+	"regexp"
 
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
-	mgo "gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
 
 	"github.com/CanonicalLtd/candid/store"
 )
@@ -28,15 +31,11 @@ func (s *identityStore) Context(ctx context.Context) (_ context.Context, cancel
 }
 
 // Identity implements store.Store.Identity by retrieving the specified
-// identity from the mongodb database. The given context must have a
-// mgo.Session added using ContextWithSession.
+// identity from the mongodb database.
 func (s *identityStore) Identity(ctx context.Context, identity *store.Identity) error {
-	coll := s.b.c(ctx, identitiesCollection)
-	defer coll.Database.Session.Close()
-
 	var doc identityDocument
-	if err := coll.Find(identityQuery(identity)).One(&doc); err != nil {
-		if errgo.Cause(err) == mgo.ErrNotFound {
+	if err := s.b.c(identitiesCollection).FindOne(ctx, identityQuery(identity)).Decode(&doc); err != nil {
+		if err == mongo.ErrNoDocuments {
 			return store.NotFoundError(identity.ID, identity.ProviderID, identity.Username)
 		}
 		return errgo.Mask(err)
@@ -59,10 +58,11 @@ func (s *identityStore) Identity(ctx context.Context, identity *store.Identity)
 func identityQuery(identity *store.Identity) bson.D {
 	switch {
 	case identity.ID != "":
-		if !bson.IsObjectIdHex(identity.ID) {
+		id, err := primitive.ObjectIDFromHex(identity.ID)
+		if err != nil {
 			break
 		}
-		return bson.D{{"_id", bson.ObjectIdHex(identity.ID)}}
+		return bson.D{{"_id", id}}
 	case identity.ProviderID != "":
 		return bson.D{{"providerid", identity.ProviderID}}
 	case identity.Username != "":
@@ -75,34 +75,71 @@ func identityQuery(identity *store.Identity) bson.D {
 }
 
 // FindIdentities implements store.Store.FindIdentities by querying the
-// mongodb database. The given context must have a mgo.Session added
-// using ContextWithSession.
-func (s *identityStore) FindIdentities(ctx context.Context, ref *store.Identity, filter store.Filter, sort []store.Sort, skip, limit int) ([]store.Identity, error) {
-	coll := s.b.c(ctx, identitiesCollection)
-	defer coll.Database.Session.Close()
+// mongodb database.
+func (s *identityStore) FindIdentities(ctx context.Context, ref *store.Identity, filter store.Filter, sort []store.Sort, skip, limit int, conditions ...store.Condition) ([]store.Identity, error) {
+	query := makeQuery(ref, filter)
+	if len(conditions) > 0 {
+		// Conditions may compare the same field more than once,
+		// so combine them with $and rather than as separate
+		// elements of the query document.
+		and := []bson.D{query}
+		for _, cond := range conditions {
+			if cond.Comparison == store.After {
+				and = append(and, afterQuery(cond.Sort, &cond.Ref))
+				continue
+			}
+			and = append(and, appendComparison(nil, fieldNames[cond.Field], cond.Comparison, fieldValue(cond.Field, &cond.Ref)))
+		}
+		query = bson.D{{"$and", and}}
+	}
+	return s.findIdentities(ctx, query, sort, skip, limit)
+}
+
+// SearchIdentities implements store.Store.SearchIdentities by querying
+// the mongodb database. MongoDB text indexes only match whole words,
+// so the search is performed with a case-insensitive regular
+// expression on each of the searched fields.
+func (s *identityStore) SearchIdentities(ctx context.Context, text string, skip, limit int) ([]store.Identity, error) {
+	re := primitive.Regex{Pattern: regexp.QuoteMeta(text), Options: "i"}
+	query := bson.D{{"$or", []bson.D{
+		{{fieldNames[store.Username], re}},
+		{{fieldNames[store.Email], re}},
+		{{fieldNames[store.Name], re}},
+	}}}
+	return s.findIdentities(ctx, query, []store.Sort{{Field: store.Username}}, skip, limit)
+}
 
-	q := coll.Find(makeQuery(ref, filter))
+// findIdentities returns the identities matching the given query.
+func (s *identityStore) findIdentities(ctx context.Context, query bson.D, sort []store.Sort, skip, limit int) ([]store.Identity, error) {
+	opts := options.Find()
 	if len(sort) > 0 {
-		ssort := make([]string, len(sort))
+		ssort := make(bson.D, len(sort))
 		for i, s := range sort {
 			if s.Descending {
-				ssort[i] = fmt.Sprintf("-%s", fieldNames[s.Field])
+				ssort[i] = bson.E{fieldNames[s.Field], -1}
 			} else {
-				ssort[i] = fieldNames[s.Field]
+				ssort[i] = bson.E{fieldNames[s.Field], 1}
 			}
 		}
-		q = q.Sort(ssort...)
+		opts.SetSort(ssort)
 	}
 	if skip > 0 {
-		q = q.Skip(skip)
+		opts.SetSkip(int64(skip))
 	}
 	if limit > 0 {
-		q = q.Limit(limit)
+		opts.SetLimit(int64(limit))
 	}
-	it := q.Iter()
+	cur, err := s.b.c(identitiesCollection).Find(ctx, query, opts)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer cur.Close(ctx)
 	identities := make([]store.Identity, 0, limit)
-	var doc identityDocument
-	for it.Next(&doc) {
+	for cur.Next(ctx) {
+		var doc identityDocument
+		if err := cur.Decode(&doc); err != nil {
+			return nil, errgo.Mask(err)
+		}
 		identities = append(identities, store.Identity{
 			ID:            doc.ID.Hex(),
 			ProviderID:    store.ProviderIdentity(doc.ProviderID),
@@ -118,7 +155,7 @@ func (s *identityStore) FindIdentities(ctx context.Context, ref *store.Identity,
 			Owner:         store.ProviderIdentity(doc.Owner),
 		})
 	}
-	if err := it.Err(); err != nil {
+	if err := cur.Err(); err != nil {
 		return nil, errgo.Mask(err)
 	}
 	return identities, nil
@@ -130,12 +167,37 @@ func makeQuery(ref *store.Identity, filter store.Filter) bson.D {
 	query = appendComparison(query, fieldNames[store.Username], filter[store.Username], ref.Username)
 	query = appendComparison(query, fieldNames[store.Name], filter[store.Name], ref.Name)
 	query = appendComparison(query, fieldNames[store.Email], filter[store.Email], ref.Email)
+	query = appendComparison(query, fieldNames[store.Groups], filter[store.Groups], ref.Groups)
 	query = appendComparison(query, fieldNames[store.LastLogin], filter[store.LastLogin], ref.LastLogin)
 	query = appendComparison(query, fieldNames[store.LastDischarge], filter[store.LastDischarge], ref.LastDischarge)
 	query = appendComparison(query, fieldNames[store.Owner], filter[store.Owner], ref.Owner)
 	return query
 }
 
+// fieldValue returns the value of the given field of the given
+// identity for use in a query.
+func fieldValue(f store.Field, id *store.Identity) interface{} {
+	switch f {
+	case store.ProviderID:
+		return id.ProviderID
+	case store.Username:
+		return id.Username
+	case store.Name:
+		return id.Name
+	case store.Email:
+		return id.Email
+	case store.Groups:
+		return id.Groups
+	case store.LastLogin:
+		return id.LastLogin
+	case store.LastDischarge:
+		return id.LastDischarge
+	case store.Owner:
+		return id.Owner
+	}
+	return nil
+}
+
 func appendComparison(query bson.D, fieldName string, p store.Comparison, value interface{}) bson.D {
 	switch p {
 	case store.NoComparison:
@@ -143,10 +205,33 @@ func appendComparison(query bson.D, fieldName string, p store.Comparison, value
 	case store.Equal:
 		// TODO with Mongo 3.0, we could remove this special case
 		// and use $eq instead.
-		return append(query, bson.DocElem{fieldName, value})
+		return append(query, bson.E{fieldName, value})
+	case store.HasPrefix:
+		return append(query, bson.E{fieldName, primitive.Regex{Pattern: "^" + regexp.QuoteMeta(fmt.Sprint(value))}})
+	case store.HasSuffix:
+		return append(query, bson.E{fieldName, primitive.Regex{Pattern: regexp.QuoteMeta(fmt.Sprint(value)) + "$"}})
+	case store.Contains:
+		return append(query, bson.E{fieldName, bson.D{{"$all", value}}})
 	default:
-		return append(query, bson.DocElem{fieldName, bson.D{{comparisonOps[p], value}}})
+		return append(query, bson.E{fieldName, bson.D{{comparisonOps[p], value}}})
+	}
+}
+
+// afterQuery returns a query that matches the identities that come
+// after the given identity in the given sort order.
+func afterQuery(sort []store.Sort, ref *store.Identity) bson.D {
+	or := make([]bson.D, len(sort))
+	for i, s := range sort {
+		for _, s1 := range sort[:i] {
+			or[i] = append(or[i], bson.E{fieldNames[s1.Field], fieldValue(s1.Field, ref)})
+		}
+		op := "$gt"
+		if s.Descending {
+			op = "$lt"
+		}
+		or[i] = append(or[i], bson.E{fieldNames[s.Field], bson.D{{op, fieldValue(s.Field, ref)}}})
 	}
+	return bson.D{{"$or", or}}
 }
 
 var comparisonOps = []string{
@@ -158,14 +243,11 @@ var comparisonOps = []string{
 }
 
 // UpdateIdentity implements store.Store.UpdateIdentity by writing the
-// identity update to the mongodb database. The given context must have a
-// mgo.Session added using ContextWithSession.
+// identity update to the mongodb database.
 func (s *identityStore) UpdateIdentity(ctx context.Context, identity *store.Identity, update store.Update) error {
-	coll := s.b.c(ctx, identitiesCollection)
-	defer coll.Database.Session.Close()
-
+	coll := s.b.c(identitiesCollection)
 	if identity.ID == "" && identity.ProviderID != "" && identity.Username != "" && update[store.Username] == store.Set {
-		return errgo.Mask(s.upsertIdentity(coll, identity, update), errgo.Is(store.ErrDuplicateUsername))
+		return errgo.Mask(s.upsertIdentity(ctx, coll, identity, update), errgo.Is(store.ErrDuplicateUsername))
 	}
 	updateDoc := identityUpdate(identity, update)
 	if updateDoc.IsZero() {
@@ -176,28 +258,40 @@ func (s *identityStore) UpdateIdentity(ctx context.Context, identity *store.Iden
 		}
 		return errgo.Mask(s.Identity(ctx, &identity), errgo.Is(store.ErrNotFound))
 	}
-	err := coll.Update(identityQuery(identity), updateDoc)
-	if err == nil {
-		return nil
+	res, err := coll.UpdateOne(ctx, identityQuery(identity), updateDoc)
+	if isDuplicate(err) {
+		return store.DuplicateUsernameError(identity.Username)
 	}
-	if err == mgo.ErrNotFound {
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if res.MatchedCount == 0 {
 		return store.NotFoundError(identity.ID, identity.ProviderID, identity.Username)
 	}
-	if mgo.IsDup(err) {
-		return store.DuplicateUsernameError(identity.Username)
+	return nil
+}
+
+// UpdateIdentities implements store.Store.UpdateIdentities. MongoDB
+// does not support multi-document transactions, so the updates are
+// made in order and any made before a failure are kept.
+func (s *identityStore) UpdateIdentities(ctx context.Context, identities []*store.Identity, update store.Update) error {
+	for _, identity := range identities {
+		if err := s.UpdateIdentity(ctx, identity, update); err != nil {
+			return errgo.Mask(err, errgo.Is(store.ErrDuplicateUsername), errgo.Is(store.ErrNotFound))
+		}
 	}
-	return errgo.Mask(err)
+	return nil
 }
 
-func (s *identityStore) upsertIdentity(coll *mgo.Collection, identity *store.Identity, update store.Update) error {
-	changeInfo, err := coll.Upsert(bson.D{{"providerid", identity.ProviderID}}, identityUpdate(identity, update))
+func (s *identityStore) upsertIdentity(ctx context.Context, coll *mongo.Collection, identity *store.Identity, update store.Update) error {
+	res, err := coll.UpdateOne(ctx, bson.D{{"providerid", identity.ProviderID}}, identityUpdate(identity, update), options.Update().SetUpsert(true))
 	if err != nil {
-		if mgo.IsDup(err) {
+		if isDuplicate(err) {
 			return store.DuplicateUsernameError(identity.Username)
 		}
 		return errgo.Mask(err)
 	}
-	id, ok := changeInfo.UpsertedId.(bson.ObjectId)
+	id, ok := res.UpsertedID.(primitive.ObjectID)
 	if ok {
 		identity.ID = id.Hex()
 	}
@@ -232,43 +326,124 @@ func encodePublicKeys(pks []bakery.PublicKey) [][]byte {
 	return data
 }
 
-func ensureIdentityIndexes(db *mgo.Database) error {
-	coll := db.C(identitiesCollection)
-	indexes := []mgo.Index{{
-		Key:    []string{"username"},
-		Unique: true,
+func ensureIdentityIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(identitiesCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{{
+		Keys:    bson.D{{"username", 1}},
+		Options: options.Index().SetUnique(true),
 	}, {
-		Key:    []string{"providerid"},
-		Unique: true,
-	}}
-	for _, index := range indexes {
-		if err := coll.EnsureIndex(index); err != nil {
-			return errgo.Mask(err)
-		}
+		Keys:    bson.D{{"providerid", 1}},
+		Options: options.Index().SetUnique(true),
+	}})
+	if err != nil {
+		return errgo.Notef(err, "cannot ensure indexes on %s", identitiesCollection)
 	}
 	return nil
 }
 
-var identityCountMapReduce = mgo.MapReduce{
-	Map:    `function() {p = this.providerid.split(':', 1); emit(p[0], 1)}`,
-	Reduce: `function(key, values){ return Array.sum(values) }`,
+// identityCountPipeline is an aggregation pipeline that counts the
+// identities from each identity provider, as determined by the prefix
+// of the provider ID.
+var identityCountPipeline = mongo.Pipeline{
+	{{"$group", bson.D{
+		{"_id", bson.D{{"$arrayElemAt", bson.A{
+			bson.D{{"$split", bson.A{"$providerid", ":"}}},
+			0,
+		}}}},
+		{"count", bson.D{{"$sum", 1}}},
+	}}},
 }
 
 // IdentityCounts implements store.Store.IdentityCounts.
 func (s *identityStore) IdentityCounts(ctx context.Context) (map[string]int, error) {
-	coll := s.b.c(ctx, identitiesCollection)
-	defer coll.Database.Session.Close()
-
+	cur, err := s.b.c(identitiesCollection).Aggregate(ctx, identityCountPipeline)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer cur.Close(ctx)
 	counts := make(map[string]int)
-	var result []struct {
-		ID    string `bson:"_id"`
-		Value int
+	for cur.Next(ctx) {
+		var result struct {
+			ID    string `bson:"_id"`
+			Count int    `bson:"count"`
+		}
+		if err := cur.Decode(&result); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		counts[result.ID] = result.Count
 	}
-	if _, err := coll.Find(nil).MapReduce(&identityCountMapReduce, &result); err != nil {
+	if err := cur.Err(); err != nil {
 		return nil, errgo.Mask(err)
 	}
-	for _, res := range result {
-		counts[res.ID] = res.Value
-	}
 	return counts, nil
 }
+
+// changeEvent holds the fields of a change stream event used by
+// WatchIdentities.
+type changeEvent struct {
+	OperationType string `bson:"operationType"`
+	DocumentKey   struct {
+		ID primitive.ObjectID `bson:"_id"`
+	} `bson:"documentKey"`
+	UpdateDescription struct {
+		UpdatedFields bson.M   `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+// WatchIdentities implements store.Watcher.WatchIdentities using a
+// change stream on the identities collection. Change streams are only
+// available when MongoDB is run as a replica set.
+func (s *identityStore) WatchIdentities(ctx context.Context, events chan<- store.IdentityEvent) error {
+	pipeline := mongo.Pipeline{{{"$match", bson.D{{"operationType", bson.D{{"$in", bson.A{"insert", "update", "replace", "delete"}}}}}}}}
+	cs, err := s.b.c(identitiesCollection).Watch(ctx, pipeline)
+	if err != nil {
+		return errgo.Notef(err, "cannot watch identities")
+	}
+	defer cs.Close(context.Background())
+	for cs.Next(ctx) {
+		var ce changeEvent
+		if err := cs.Decode(&ce); err != nil {
+			return errgo.Notef(err, "cannot decode change event")
+		}
+		ev := store.IdentityEvent{
+			ID: ce.DocumentKey.ID.Hex(),
+		}
+		switch ce.OperationType {
+		case "insert":
+			ev.Type = store.IdentityCreated
+		case "delete":
+			ev.Type = store.IdentityDeleted
+		default:
+			if isDischargeChange(&ce) {
+				continue
+			}
+			ev.Type = store.IdentityUpdated
+		}
+		select {
+		case events <- ev:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := cs.Err(); err != nil {
+		return errgo.Notef(err, "cannot watch identities")
+	}
+	return errgo.New("identity change stream closed")
+}
+
+// isDischargeChange reports whether the given change event only
+// records a discharge, which are not reported as identity updates.
+func isDischargeChange(ce *changeEvent) bool {
+	if ce.OperationType != "update" || len(ce.UpdateDescription.RemovedFields) > 0 {
+		return false
+	}
+	for f := range ce.UpdateDescription.UpdatedFields {
+		if f != fieldNames[store.LastDischarge] {
+			return false
+		}
+	}
+	return len(ce.UpdateDescription.UpdatedFields) > 0
+}
@@ -3,7 +3,9 @@ package sqlstore
 import (
 	"bytes"
 	"database/sql"
+	"fmt"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -12,6 +14,7 @@ import (
 	"github.com/juju/utils/debugstatus"
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/dbrootkeystore"
 	"gopkg.in/macaroon-bakery.v2/bakery/postgresrootkeystore"
 
 	"github.com/CanonicalLtd/candid/meeting"
@@ -26,6 +29,20 @@ type backend struct {
 	driver   *driver
 	rootKeys *postgresrootkeystore.RootKeys
 	aclStore aclstore.ACLStore
+
+	// dbRootKeys holds the root key cache used when the database
+	// does not support postgresrootkeystore. If it is set,
+	// rootKeys is nil.
+	dbRootKeys *dbrootkeystore.RootKeys
+
+	// connectionString holds the connection string used to open
+	// db, if known. It is used to listen for notifications.
+	connectionString string
+
+	// listStaleness holds how far in the past queries that list
+	// identities read their data. If it is zero the current data
+	// is read.
+	listStaleness time.Duration
 }
 
 // NewBackend creates a new store.Backend implementation using the
@@ -34,10 +51,20 @@ type backend struct {
 //
 // Closing the returned Backend will also close db.
 func NewBackend(driverName string, db *sql.DB) (store.Backend, error) {
+	return newBackend(driverName, db, Params{})
+}
+
+// newBackend is the internal version of NewBackend. If
+// p.ConnectionString is not empty, the stores will use it to listen
+// for notifications of completed rendezvous and changed identities.
+func newBackend(driverName string, db *sql.DB, p Params) (store.Backend, error) {
 	if driverName != "postgres" {
 		return nil, errgo.Newf("unsupported database driver %q", driverName)
 	}
-	driver, err := newPostgresDriver(db)
+	if err := updateSchema(db, postgresSchema, p.DisableMigrations); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	driver, err := newPostgresDriver(db, !p.DisablePreparedStatements)
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot initialise database")
 	}
@@ -52,26 +79,49 @@ func NewBackend(driverName string, db *sql.DB) (store.Backend, error) {
 		driver:   driver,
 		rootKeys: postgresrootkeystore.NewRootKeys(db, "rootkeys", 1000),
 		aclStore: aclstore.NewACLStore(aclStore),
+
+		connectionString: p.ConnectionString,
 	}, nil
 }
 
 func (b *backend) Close() {
-	b.rootKeys.Close()
+	if b.rootKeys != nil {
+		b.rootKeys.Close()
+	}
+	b.driver.closeStatements()
 	b.db.Close()
 }
 
 // Store returns a new store.Store implementation using this database for
 // persistent storage.
 func (b *backend) Store() store.Store {
+	if b.connectionString != "" {
+		return &notifyingIdentityStore{identityStore{b}}
+	}
 	return &identityStore{b}
 }
 
 func (b *backend) BakeryRootKeyStore() bakery.RootKeyStore {
-	return b.rootKeys.NewStore(postgresrootkeystore.Policy{
+	return b.BakeryRootKeyStoreWithPolicy(store.RootKeyPolicy{
 		ExpiryDuration: 365 * 24 * time.Hour,
 	})
 }
 
+// BakeryRootKeyStoreWithPolicy implements
+// store.RootKeyPolicyBackend.BakeryRootKeyStoreWithPolicy.
+func (b *backend) BakeryRootKeyStoreWithPolicy(p store.RootKeyPolicy) bakery.RootKeyStore {
+	if b.dbRootKeys != nil {
+		return b.dbRootKeys.NewStore(rootKeyBacking{b}, dbrootkeystore.Policy{
+			GenerateInterval: p.GenerateInterval,
+			ExpiryDuration:   p.ExpiryDuration,
+		})
+	}
+	return b.rootKeys.NewStore(postgresrootkeystore.Policy{
+		GenerateInterval: p.GenerateInterval,
+		ExpiryDuration:   p.ExpiryDuration,
+	})
+}
+
 // ProviderDataStore returns a new store.ProviderDataStore implementation
 // using this database for persistent storage.
 func (b *backend) ProviderDataStore() store.ProviderDataStore {
@@ -81,6 +131,9 @@ func (b *backend) ProviderDataStore() store.ProviderDataStore {
 // MeetingStore returns a new meeting.Stor implementation using this
 // database for persistent storage.
 func (b *backend) MeetingStore() meeting.Store {
+	if b.connectionString != "" {
+		return &notifyingMeetingStore{meetingStore{b}}
+	}
 	return &meetingStore{b}
 }
 
@@ -93,9 +146,28 @@ func (b *backend) DebugStatusCheckerFuncs() []debugstatus.CheckerFunc {
 	return nil
 }
 
+// maxTxAttempts holds the maximum number of times that withTx will
+// attempt a transaction that fails with a retryable error.
+const maxTxAttempts = 10
+
 // withTx runs f in a new transaction. any error returned by f will not
 // have it's cause masked.
+//
+// If the driver reports that the transaction failed with an error that
+// can be retried, such as a serialization failure, the transaction is
+// run again, so f must be safe to call more than once.
 func (b *backend) withTx(f func(*sql.Tx) error) error {
+	for i := 1; ; i++ {
+		err := b.runTx(f)
+		if err == nil || b.driver.isRetryableFunc == nil || !b.driver.isRetryableFunc(err) || i == maxTxAttempts {
+			return errgo.Mask(err, errgo.Any)
+		}
+		logger.Debugf("retrying transaction (attempt %d): %s", i, err)
+	}
+}
+
+// runTx runs f in a new transaction.
+func (b *backend) runTx(f func(*sql.Tx) error) error {
 	tx, err := b.db.Begin()
 	if err != nil {
 		return errgo.Mask(err)
@@ -109,6 +181,34 @@ func (b *backend) withTx(f func(*sql.Tx) error) error {
 	return errgo.Mask(tx.Commit())
 }
 
+// withListTx runs f in a new transaction used for queries that list
+// identities. If the backend has a list staleness, the transaction
+// reads data from that long ago, which avoids contention with
+// concurrent writes.
+func (b *backend) withListTx(f func(*sql.Tx) error) error {
+	if b.listStaleness <= 0 {
+		return errgo.Mask(b.withTx(f), errgo.Any)
+	}
+	return errgo.Mask(b.withTx(func(tx *sql.Tx) error {
+		_, err := b.driver.exec(tx, tmplAsOfSystemTime, &asOfSystemTimeParams{
+			argBuilder: b.driver.argBuilderFunc(),
+			Interval:   fmt.Sprintf("-%dms", b.listStaleness/time.Millisecond),
+		})
+		if err != nil {
+			return errgo.Notef(err, "cannot set transaction time")
+		}
+		return errgo.Mask(f(tx), errgo.Any)
+	}), errgo.Any)
+}
+
+type asOfSystemTimeParams struct {
+	argBuilder
+
+	// Interval holds the interval, relative to the current time,
+	// at which the transaction reads data.
+	Interval string
+}
+
 type tmplID int
 
 const (
@@ -129,6 +229,16 @@ const (
 	tmplFindMeetings
 	tmplRemoveMeetings
 	tmplIdentityCounts
+	tmplSearchIdentities
+	tmplReplicaHeartbeat
+	tmplRemoveReplica
+	tmplRemoveDeadReplicas
+	tmplPutMeetingData
+	tmplGetMeetingData
+	tmplCompleteMeeting
+	tmplNotifyMeeting
+	tmplNotifyIdentity
+	tmplAsOfSystemTime
 	numTmpl
 )
 
@@ -157,6 +267,36 @@ type driver struct {
 	tmpls           [numTmpl]*template.Template
 	argBuilderFunc  func() argBuilder
 	isDuplicateFunc func(error) bool
+
+	// isRetryableFunc reports whether a transaction that failed
+	// with the given error should be retried. If it is nil,
+	// transactions are never retried.
+	isRetryableFunc func(error) bool
+
+	// notifications holds whether the database supports sending
+	// notifications with the tmplNotifyMeeting and
+	// tmplNotifyIdentity templates.
+	notifications bool
+
+	// nullsFirst holds whether NULL values sort before all other
+	// values in ascending order.
+	nullsFirst bool
+
+	// db holds the database on which statements are prepared. If
+	// it is nil, statements are not prepared.
+	db *sql.DB
+
+	// prepared holds the templates that produce queries that are
+	// run as prepared statements. These should only be templates
+	// that are used frequently and produce a small number of
+	// distinct queries.
+	prepared [numTmpl]bool
+
+	// mu protects stmts.
+	mu sync.Mutex
+
+	// stmts holds the prepared statements indexed by query.
+	stmts map[string]*sql.Stmt
 }
 
 // exec performs the Exec method on the given queryer by processing the
@@ -167,6 +307,14 @@ func (d *driver) exec(q queryer, tmplID tmplID, params argBuilder) (sql.Result,
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot build query")
 	}
+	stmt, err := d.stmt(q, tmplID, query)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if stmt != nil {
+		res, err := stmt.Exec(params.args()...)
+		return res, errgo.Mask(err, errgo.Any)
+	}
 	res, err := q.Exec(query, params.args()...)
 	return res, errgo.Mask(err, errgo.Any)
 }
@@ -179,6 +327,14 @@ func (d *driver) query(q queryer, tmplID tmplID, params argBuilder) (*sql.Rows,
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot build query")
 	}
+	stmt, err := d.stmt(q, tmplID, query)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if stmt != nil {
+		rows, err := stmt.Query(params.args()...)
+		return rows, errgo.Mask(err, errgo.Any)
+	}
 	rows, err := q.Query(query, params.args()...)
 	return rows, errgo.Mask(err, errgo.Any)
 }
@@ -191,9 +347,53 @@ func (d *driver) queryRow(q queryer, tmplID tmplID, params argBuilder) (*sql.Row
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot build query")
 	}
+	stmt, err := d.stmt(q, tmplID, query)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if stmt != nil {
+		return stmt.QueryRow(params.args()...), nil
+	}
 	return q.QueryRow(query, params.args()...), nil
 }
 
+// stmt returns the prepared statement to use to run the given query,
+// produced by the given template, on q. If the query should not be
+// prepared, stmt returns nil.
+func (d *driver) stmt(q queryer, tmplID tmplID, query string) (*sql.Stmt, error) {
+	if d.db == nil || !d.prepared[tmplID] {
+		return nil, nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stmt := d.stmts[query]
+	if stmt == nil {
+		var err error
+		stmt, err = d.db.Prepare(query)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot prepare query")
+		}
+		if d.stmts == nil {
+			d.stmts = make(map[string]*sql.Stmt)
+		}
+		d.stmts[query] = stmt
+	}
+	if tx, ok := q.(*sql.Tx); ok {
+		return tx.Stmt(stmt), nil
+	}
+	return stmt, nil
+}
+
+// closeStatements closes all the prepared statements.
+func (d *driver) closeStatements() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for query, stmt := range d.stmts {
+		stmt.Close()
+		delete(d.stmts, query)
+	}
+}
+
 func (d *driver) parseTemplate(tmplID tmplID, tmpl string) error {
 	var err error
 	d.tmpls[tmplID], err = template.New("").Funcs(template.FuncMap{
@@ -0,0 +1,374 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/juju/aclstore/v2"
+	"github.com/juju/simplekv"
+	"github.com/lib/pq"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/dbrootkeystore"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// cockroachDriverName holds the name of the CockroachDB driver. The
+// database is accessed using the postgres wire protocol.
+const cockroachDriverName = "cockroachdb"
+
+// cockroachInit holds the statements that create the initial
+// CockroachDB schema. CockroachDB does not support stored procedures or
+// triggers, and schema changes cannot safely be mixed in a single
+// implicit transaction, so each statement is run separately. Expired
+// key-value pairs and root keys are removed by the store instead.
+var cockroachInit = []string{`
+CREATE TABLE IF NOT EXISTS identities (
+	id SERIAL PRIMARY KEY,
+	providerid TEXT UNIQUE NOT NULL,
+	username TEXT UNIQUE NOT NULL,
+	name TEXT,
+	email TEXT,
+	lastlogin TIMESTAMP WITH TIME ZONE,
+	lastdischarge TIMESTAMP WITH TIME ZONE,
+	owner TEXT
+)`, `
+CREATE TABLE IF NOT EXISTS identity_groups (
+	identity INTEGER REFERENCES identities NOT NULL,
+	value TEXT NOT NULL,
+	UNIQUE (identity, value)
+)`, `
+CREATE TABLE IF NOT EXISTS identity_publickeys (
+	identity INTEGER REFERENCES identities NOT NULL,
+	value BYTEA NOT NULL,
+	UNIQUE (identity, value)
+)`, `
+CREATE TABLE IF NOT EXISTS identity_providerinfo (
+	identity INTEGER REFERENCES identities NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	UNIQUE (identity, key, value)
+)`, `
+CREATE TABLE IF NOT EXISTS identity_extrainfo (
+	identity INTEGER REFERENCES identities NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	UNIQUE (identity, key, value)
+)`, `
+CREATE TABLE IF NOT EXISTS provider_data (
+	provider TEXT NOT NULL,
+	key TEXT NOT NULL,
+	value BYTEA NOT NULL,
+	expire TIMESTAMP WITH TIME ZONE,
+	UNIQUE (provider, key)
+)`, `
+CREATE INDEX IF NOT EXISTS provider_data_expire ON provider_data (expire)
+`, `
+CREATE TABLE IF NOT EXISTS meetings (
+	id TEXT NOT NULL PRIMARY KEY,
+	address TEXT NOT NULL,
+	created TIMESTAMP WITH TIME ZONE NOT NULL,
+	data0 BYTEA,
+	data1 BYTEA,
+	completed BOOLEAN NOT NULL DEFAULT FALSE
+)`, `
+CREATE TABLE IF NOT EXISTS meeting_replicas (
+	address TEXT NOT NULL PRIMARY KEY,
+	heartbeat TIMESTAMP WITH TIME ZONE NOT NULL
+)`, `
+CREATE TABLE IF NOT EXISTS rootkeys (
+	id BYTEA NOT NULL PRIMARY KEY,
+	rootkey BYTEA NOT NULL,
+	created TIMESTAMP WITH TIME ZONE NOT NULL,
+	expires TIMESTAMP WITH TIME ZONE NOT NULL
+)`, `
+CREATE INDEX IF NOT EXISTS rootkeys_created ON rootkeys (created)
+`, `
+CREATE INDEX IF NOT EXISTS rootkeys_expires ON rootkeys (expires)
+`}
+
+// cockroachSchema holds the versioned CockroachDB schema. Schema
+// changes are not transactional in CockroachDB so the schema is marked
+// as dirty while each migration is applied, and a lock is held so that
+// only one server applies them.
+var cockroachSchema = schema{
+	migrations: []migration{{
+		up: cockroachInit,
+		down: []string{
+			`DROP TABLE IF EXISTS rootkeys`,
+			`DROP TABLE IF EXISTS meeting_replicas`,
+			`DROP TABLE IF EXISTS meetings`,
+			`DROP TABLE IF EXISTS provider_data`,
+			`DROP TABLE IF EXISTS identity_extrainfo`,
+			`DROP TABLE IF EXISTS identity_providerinfo`,
+			`DROP TABLE IF EXISTS identity_publickeys`,
+			`DROP TABLE IF EXISTS identity_groups`,
+			`DROP TABLE IF EXISTS identities`,
+		},
+	}},
+	lock: cockroachLock,
+}
+
+// cockroachLockInit holds the statements that create the row that is
+// locked while the schema is migrated. The row is kept in its own
+// table, rather than in schema_migrations, because the version is
+// updated outside the locking transaction during a migration.
+var cockroachLockInit = []string{`
+CREATE TABLE IF NOT EXISTS schema_migrations_lock (
+	id INTEGER NOT NULL PRIMARY KEY
+)`, `
+INSERT INTO schema_migrations_lock (id) VALUES (1) ON CONFLICT (id) DO NOTHING
+`}
+
+// cockroachLock takes a row lock with SELECT ... FOR UPDATE so that
+// only one server migrates the schema at a time. CockroachDB does not
+// support advisory locks, so the lock is held by a transaction that
+// remains open until the migration is complete. Other servers wait
+// for the lock and then find the schema up to date.
+func cockroachLock(ctx context.Context, db *sql.DB) (func(), error) {
+	for _, stmt := range cockroachLockInit {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var id int
+	if err := tx.QueryRowContext(ctx, `SELECT id FROM schema_migrations_lock WHERE id = 1 FOR UPDATE`).Scan(&id); err != nil {
+		if err := tx.Rollback(); err != nil {
+			logger.Errorf("failed to rollback transaction: %s", err)
+		}
+		return nil, errgo.Mask(err)
+	}
+	return func() {
+		if err := tx.Rollback(); err != nil {
+			logger.Errorf("cannot release migration lock: %s", err)
+		}
+	}, nil
+}
+
+// cockroachTmpls holds the query templates for CockroachDB. These are
+// the same as the postgres templates except that notifications are not
+// supported and list queries may read historical data.
+var cockroachTmpls = func() [numTmpl]string {
+	tmpls := postgresTmpls
+	tmpls[tmplNotifyMeeting] = ""
+	tmpls[tmplNotifyIdentity] = ""
+	tmpls[tmplAsOfSystemTime] = `SET TRANSACTION AS OF SYSTEM TIME '{{.Interval}}'`
+	return tmpls
+}()
+
+// newCockroachBackend creates a new store.Backend using the given
+// CockroachDB database.
+func newCockroachBackend(db *sql.DB, p CockroachParams) (store.Backend, error) {
+	if err := updateSchema(db, cockroachSchema, p.DisableMigrations); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	driver, err := newCockroachDriver(db, !p.DisablePreparedStatements)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot initialise database")
+	}
+	b := &backend{
+		db:            db,
+		driver:        driver,
+		dbRootKeys:    dbrootkeystore.NewRootKeys(1000, nil),
+		listStaleness: p.ListStaleness,
+	}
+	aclStore, err := newKVStore(b, "acls")
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	b.aclStore = aclstore.NewACLStore(aclStore)
+	return b, nil
+}
+
+// newCockroachDriver creates a CockroachDB driver using the given DB.
+// If prepare is true, frequently used queries are run as prepared
+// statements. The database schema must already be up to date.
+func newCockroachDriver(db *sql.DB, prepare bool) (*driver, error) {
+	d := &driver{
+		name: cockroachDriverName,
+		argBuilderFunc: func() argBuilder {
+			return &postgresArgBuilder{}
+		},
+		isDuplicateFunc: postgresIsDuplicate,
+		isRetryableFunc: cockroachIsRetryable,
+		nullsFirst:      true,
+	}
+	for i, t := range cockroachTmpls {
+		if err := d.parseTemplate(tmplID(i), t); err != nil {
+			return nil, errgo.Notef(err, "cannot parse template %v", t)
+		}
+	}
+	if prepare {
+		d.db = db
+		for _, id := range postgresPrepared {
+			d.prepared[id] = true
+		}
+	}
+	return d, nil
+}
+
+// cockroachIsRetryable reports whether the given error, or any error
+// it wraps, is a serialization failure. CockroachDB runs all
+// transactions with serializable isolation and reports conflicting
+// transactions with this error, which means that the client should
+// retry the transaction.
+func cockroachIsRetryable(err error) bool {
+	for err != nil {
+		if pqerr, ok := err.(*pq.Error); ok {
+			return pqerr.Code == "40001"
+		}
+		u, ok := err.(interface {
+			Underlying() error
+		})
+		if !ok {
+			return false
+		}
+		err = u.Underlying()
+	}
+	return false
+}
+
+// kvStore implements simplekv.Store using a table in a database that
+// does not support the triggers used by sqlsimplekv.
+type kvStore struct {
+	b *backend
+
+	// table holds the quoted name of the table.
+	table string
+}
+
+// newKVStore returns a kvStore that uses the table with the given
+// name, creating it if necessary.
+func newKVStore(b *backend, table string) (*kvStore, error) {
+	s := &kvStore{
+		b:     b,
+		table: pq.QuoteIdentifier(table),
+	}
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS ` + s.table + ` (
+			key TEXT NOT NULL PRIMARY KEY,
+			value BYTEA NOT NULL,
+			expire TIMESTAMP WITH TIME ZONE
+		)`,
+		`CREATE INDEX IF NOT EXISTS ` + pq.QuoteIdentifier(table+"_expire") + ` ON ` + s.table + ` (expire)`,
+	}
+	for _, stmt := range stmts {
+		if _, err := b.db.Exec(stmt); err != nil {
+			return nil, errgo.Notef(err, "cannot create key-value table %q", table)
+		}
+	}
+	return s, nil
+}
+
+// Context implements simplekv.Store.Context.
+func (s *kvStore) Context(ctx context.Context) (context.Context, func()) {
+	return ctx, func() {}
+}
+
+// Get implements simplekv.Store.Get.
+func (s *kvStore) Get(_ context.Context, key string) ([]byte, error) {
+	var value []byte
+	err := s.b.db.QueryRow(`SELECT value FROM `+s.table+` WHERE key=$1 AND (expire IS NULL OR expire > now())`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, errgo.WithCausef(nil, simplekv.ErrNotFound, "key %s not found", key)
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return value, nil
+}
+
+// Set implements simplekv.Store.Set.
+func (s *kvStore) Set(_ context.Context, key string, value []byte, expire time.Time) error {
+	return errgo.Mask(s.b.withTx(func(tx *sql.Tx) error {
+		return s.set(tx, key, value, expire)
+	}))
+}
+
+// Update implements simplekv.Store.Update.
+func (s *kvStore) Update(_ context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	err := s.b.withTx(func(tx *sql.Tx) error {
+		var old []byte
+		err := tx.QueryRow(`SELECT value FROM `+s.table+` WHERE key=$1 AND (expire IS NULL OR expire > now()) FOR UPDATE`, key).Scan(&old)
+		if err != nil && err != sql.ErrNoRows {
+			return errgo.Mask(err)
+		}
+		value, err := getVal(old)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		return s.set(tx, key, value, expire)
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+// set sets the value of the given key in the given transaction,
+// removing any expired keys.
+func (s *kvStore) set(tx *sql.Tx, key string, value []byte, expire time.Time) error {
+	if _, err := tx.Exec(`DELETE FROM ` + s.table + ` WHERE expire < now()`); err != nil {
+		return errgo.Mask(err)
+	}
+	_, err := tx.Exec(`UPSERT INTO `+s.table+` (key, value, expire) VALUES ($1, $2, $3)`, key, value, nullTime{expire, !expire.IsZero()})
+	return errgo.Mask(err)
+}
+
+// rootKeyBacking implements dbrootkeystore.Backing using the rootkeys
+// table.
+type rootKeyBacking struct {
+	b *backend
+}
+
+// GetKey implements dbrootkeystore.Backing.GetKey.
+func (r rootKeyBacking) GetKey(id []byte) (dbrootkeystore.RootKey, error) {
+	key := dbrootkeystore.RootKey{
+		Id: id,
+	}
+	err := r.b.db.QueryRow(`SELECT rootkey, created, expires FROM rootkeys WHERE id=$1`, id).Scan(&key.RootKey, &key.Created, &key.Expires)
+	if err == sql.ErrNoRows {
+		return dbrootkeystore.RootKey{}, bakery.ErrNotFound
+	}
+	if err != nil {
+		return dbrootkeystore.RootKey{}, errgo.Notef(err, "cannot get key from database")
+	}
+	return key, nil
+}
+
+// FindLatestKey implements dbrootkeystore.Backing.FindLatestKey.
+func (r rootKeyBacking) FindLatestKey(createdAfter, expiresAfter, expiresBefore time.Time) (dbrootkeystore.RootKey, error) {
+	var key dbrootkeystore.RootKey
+	err := r.b.db.QueryRow(`
+		SELECT id, rootkey, created, expires FROM rootkeys
+		WHERE created >= $1 AND expires >= $2 AND expires <= $3
+		ORDER BY created DESC
+		LIMIT 1`, createdAfter, expiresAfter, expiresBefore).Scan(&key.Id, &key.RootKey, &key.Created, &key.Expires)
+	if err == sql.ErrNoRows {
+		return dbrootkeystore.RootKey{}, nil
+	}
+	if err != nil {
+		return dbrootkeystore.RootKey{}, errgo.Notef(err, "cannot query existing keys")
+	}
+	return key, nil
+}
+
+// InsertKey implements dbrootkeystore.Backing.InsertKey.
+func (r rootKeyBacking) InsertKey(key dbrootkeystore.RootKey) error {
+	return errgo.Mask(r.b.withTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM rootkeys WHERE expires < now()`); err != nil {
+			return errgo.Notef(err, "cannot remove expired keys")
+		}
+		_, err := tx.Exec(`INSERT INTO rootkeys (id, rootkey, created, expires) VALUES ($1, $2, $3, $4)`, key.Id, key.RootKey, key.Created, key.Expires)
+		if err != nil {
+			return errgo.Notef(err, "cannot insert key")
+		}
+		return nil
+	}))
+}
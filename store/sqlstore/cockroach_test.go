@@ -0,0 +1,167 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package sqlstore_test
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	aclstore "github.com/juju/aclstore/v2"
+	"github.com/lib/pq"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/meeting"
+	"github.com/CanonicalLtd/candid/store"
+	"github.com/CanonicalLtd/candid/store/sqlstore"
+	"github.com/CanonicalLtd/candid/store/storetest"
+)
+
+func TestCockroachIsRetryable(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	serializationFailure := &pq.Error{Code: "40001"}
+	c.Assert(sqlstore.CockroachIsRetryable(serializationFailure), qt.Equals, true)
+	c.Assert(sqlstore.CockroachIsRetryable(errgo.Notef(errgo.Mask(serializationFailure), "cannot update identity")), qt.Equals, true)
+	c.Assert(sqlstore.CockroachIsRetryable(&pq.Error{Code: "23505"}), qt.Equals, false)
+	c.Assert(sqlstore.CockroachIsRetryable(errgo.New("test")), qt.Equals, false)
+	c.Assert(sqlstore.CockroachIsRetryable(nil), qt.Equals, false)
+}
+
+func TestCockroachKeyValueStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestKeyValueStore(c, func(c *qt.C) store.ProviderDataStore {
+		return newCockroachBackend(c).ProviderDataStore()
+	})
+}
+
+func TestCockroachStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestStore(c, func(c *qt.C) store.Store {
+		return newCockroachBackend(c).Store()
+	})
+}
+
+func TestCockroachMeetingStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestMeetingStore(c, func(c *qt.C) meeting.Store {
+		return newCockroachBackend(c).MeetingStore()
+	}, sqlstore.PutAtTime)
+}
+
+func TestCockroachACLStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestACLStore(c, func(c *qt.C) aclstore.ACLStore {
+		return newCockroachBackend(c).ACLStore()
+	})
+}
+
+func TestCockroachRootKeyStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	ctx := context.Background()
+	rks := newCockroachBackend(c).BakeryRootKeyStore()
+	key, id, err := rks.RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+
+	key2, err := rks.Get(ctx, id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(key2, qt.DeepEquals, key)
+}
+
+func TestCockroachMigrationLock(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	db := newCockroachDB(c)
+	c.Defer(func() { db.Close() })
+	ctx := context.Background()
+	unlock, err := sqlstore.CockroachLock(ctx, db)
+	c.Assert(err, qt.Equals, nil)
+
+	locked := make(chan func())
+	go func() {
+		unlock, err := sqlstore.CockroachLock(ctx, db)
+		c.Check(err, qt.Equals, nil)
+		locked <- unlock
+	}()
+	select {
+	case <-locked:
+		c.Fatalf("lock acquired twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case unlock := <-locked:
+		unlock()
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for lock")
+	}
+}
+
+// newCockroachBackend returns a backend using a new database on the
+// CockroachDB server at the URL in the COCKROACHDB_URL environment
+// variable. If that is not set, the test is skipped.
+func newCockroachBackend(c *qt.C) store.Backend {
+	testDB := newCockroachDB(c)
+	backend, err := sqlstore.NewCockroachBackend(testDB)
+	if err != nil {
+		testDB.Close()
+	}
+	c.Assert(err, qt.Equals, nil)
+	// Note: closing backend also closes the db.
+	c.Defer(backend.Close)
+	return backend
+}
+
+// newCockroachDB returns a connection to a new database on the
+// CockroachDB server at the URL in the COCKROACHDB_URL environment
+// variable. If that is not set, the test is skipped.
+func newCockroachDB(c *qt.C) *sql.DB {
+	serverURL := os.Getenv("COCKROACHDB_URL")
+	if serverURL == "" {
+		c.Skip("COCKROACHDB_URL not set")
+	}
+	u, err := url.Parse(serverURL)
+	c.Assert(err, qt.Equals, nil)
+
+	buf := make([]byte, 8)
+	_, err = rand.Read(buf)
+	c.Assert(err, qt.Equals, nil)
+	dbName := fmt.Sprintf("candid_test_%x", buf)
+
+	db, err := sql.Open("postgres", serverURL)
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	_, err = db.Exec("CREATE DATABASE " + dbName)
+	c.Assert(err, qt.Equals, nil)
+	c.Defer(func() {
+		db, err := sql.Open("postgres", serverURL)
+		c.Check(err, qt.Equals, nil)
+		defer db.Close()
+		_, err = db.Exec("DROP DATABASE " + dbName + " CASCADE")
+		c.Check(err, qt.Equals, nil)
+	})
+
+	u.Path = "/" + dbName
+	testDB, err := sql.Open("postgres", u.String())
+	c.Assert(err, qt.Equals, nil)
+	return testDB
+}
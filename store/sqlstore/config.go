@@ -2,6 +2,10 @@ package sqlstore
 
 import (
 	"database/sql"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	errgo "gopkg.in/errgo.v1"
 
@@ -12,10 +16,56 @@ import (
 // used in the config file.
 type Params struct {
 	ConnectionString string `yaml:"connection-string"`
+
+	// MaxOpenConnections holds the maximum number of connections
+	// open to the database. If it is zero there is no limit.
+	MaxOpenConnections int `yaml:"max-open-connections"`
+
+	// MaxIdleConnections holds the maximum number of idle
+	// connections kept open to the database. If it is zero the
+	// database/sql default of 2 is used; if it is negative idle
+	// connections are not kept.
+	MaxIdleConnections int `yaml:"max-idle-connections"`
+
+	// ConnectionMaxLifetime holds the maximum length of time for
+	// which a connection is reused. If it is zero connections are
+	// reused for ever.
+	ConnectionMaxLifetime time.Duration `yaml:"connection-max-lifetime"`
+
+	// StatementTimeout holds the maximum length of time that any
+	// statement may run for before it is canceled by the database
+	// server. If it is zero the server default is used.
+	StatementTimeout time.Duration `yaml:"statement-timeout"`
+
+	// DisablePreparedStatements stops frequently used queries
+	// being run as prepared statements. This is needed when
+	// connecting through a proxy that does not support them, such
+	// as PgBouncer in transaction pooling mode.
+	DisablePreparedStatements bool `yaml:"disable-prepared-statements"`
+
+	// DisableMigrations stops the server applying schema migrations
+	// when it starts. Instead the server refuses to start unless the
+	// schema is already at the latest version. Migrations can then
+	// be applied separately using candidsrv -migrate-only.
+	DisableMigrations bool `yaml:"disable-migrations"`
+}
+
+// CockroachParams holds the specification for the parameters used in
+// the config file for a CockroachDB backend.
+type CockroachParams struct {
+	Params `yaml:",inline"`
+
+	// ListStaleness holds how far in the past queries that list,
+	// search and count identities read their data. Reading slightly
+	// stale data avoids these queries contending with concurrent
+	// writes and allows them to be served by the nearest replica.
+	// If it is zero the current data is read.
+	ListStaleness time.Duration `yaml:"list-staleness"`
 }
 
 func init() {
 	store.Register("postgres", unmarshalBackend)
+	store.Register("cockroachdb", unmarshalCockroachBackend)
 }
 
 func unmarshalBackend(unmarshal func(interface{}) error) (store.BackendFactory, error) {
@@ -23,19 +73,126 @@ func unmarshalBackend(unmarshal func(interface{}) error) (store.BackendFactory,
 	if err := unmarshal(&p); err != nil {
 		return nil, errgo.Mask(err)
 	}
+	if err := p.validate("postgres"); err != nil {
+		return nil, errgo.Mask(err)
+	}
 	return p, nil
 }
 
+func unmarshalCockroachBackend(unmarshal func(interface{}) error) (store.BackendFactory, error) {
+	var p CockroachParams
+	if err := unmarshal(&p); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := p.validate("cockroachdb"); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if p.ListStaleness < 0 {
+		return nil, errgo.Newf("negative list-staleness in cockroachdb storage configuration")
+	}
+	return p, nil
+}
+
+// validate checks the parameters for the given storage type.
+func (p Params) validate(storageType string) error {
+	if p.MaxOpenConnections < 0 {
+		return errgo.Newf("negative max-open-connections in %s storage configuration", storageType)
+	}
+	if p.ConnectionMaxLifetime < 0 {
+		return errgo.Newf("negative connection-max-lifetime in %s storage configuration", storageType)
+	}
+	if p.StatementTimeout < 0 {
+		return errgo.Newf("negative statement-timeout in %s storage configuration", storageType)
+	}
+	return nil
+}
+
 // NewBackend implements store.BackendFactory.
 func (p Params) NewBackend() (store.Backend, error) {
 	logger.Infof("connecting to postgresql")
-	db, err := sql.Open("postgres", p.ConnectionString)
+	db, err := p.open()
 	if err != nil {
-		return nil, errgo.Notef(err, "cannot connect to database")
+		return nil, errgo.Mask(err)
 	}
-	backend, err := NewBackend("postgres", db)
+	backend, err := newBackend("postgres", db, p)
 	if err != nil {
+		db.Close()
 		return nil, errgo.Notef(err, "cannot initialise database")
 	}
 	return backend, nil
 }
+
+// NewBackend implements store.BackendFactory.
+func (p CockroachParams) NewBackend() (store.Backend, error) {
+	logger.Infof("connecting to cockroachdb")
+	db, err := p.open()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	backend, err := newCockroachBackend(db, p)
+	if err != nil {
+		db.Close()
+		return nil, errgo.Notef(err, "cannot initialise database")
+	}
+	return backend, nil
+}
+
+// Migrate implements store.Migrator.
+func (p Params) Migrate(version int) error {
+	db, err := p.open()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer db.Close()
+	return errgo.Mask(migrate(db, postgresSchema, version))
+}
+
+// Migrate implements store.Migrator.
+func (p CockroachParams) Migrate(version int) error {
+	db, err := p.open()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer db.Close()
+	return errgo.Mask(migrate(db, cockroachSchema, version))
+}
+
+// open opens the database specified by the parameters using the
+// postgres driver.
+func (p Params) open() (*sql.DB, error) {
+	if p.StatementTimeout > 0 {
+		var err error
+		p.ConnectionString, err = withStatementTimeout(p.ConnectionString, p.StatementTimeout)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	db, err := sql.Open("postgres", p.ConnectionString)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot connect to database")
+	}
+	db.SetMaxOpenConns(p.MaxOpenConnections)
+	if p.MaxIdleConnections != 0 {
+		db.SetMaxIdleConns(p.MaxIdleConnections)
+	}
+	db.SetConnMaxLifetime(p.ConnectionMaxLifetime)
+	return db, nil
+}
+
+// withStatementTimeout returns the given connection string with the
+// statement_timeout run-time parameter set to the given duration. Both
+// URL and keyword/value connection strings are supported.
+func withStatementTimeout(connectionString string, d time.Duration) (string, error) {
+	ms := strconv.FormatInt(int64(d/time.Millisecond), 10)
+	if strings.HasPrefix(connectionString, "postgres://") || strings.HasPrefix(connectionString, "postgresql://") {
+		u, err := url.Parse(connectionString)
+		if err != nil {
+			return "", errgo.Notef(err, "invalid connection-string")
+		}
+		q := u.Query()
+		q.Set("statement_timeout", ms)
+		u.RawQuery = q.Encode()
+		return u.String(), nil
+	}
+	return strings.TrimSpace(connectionString + " statement_timeout=" + ms), nil
+}
@@ -2,9 +2,13 @@ package sqlstore_test
 
 import (
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
+	"gopkg.in/yaml.v2"
 
+	"github.com/CanonicalLtd/candid/store"
+	"github.com/CanonicalLtd/candid/store/sqlstore"
 	"github.com/CanonicalLtd/candid/store/storetest"
 )
 
@@ -19,3 +23,74 @@ storage:
     connection-string: 'search_path=`+f.pg.Schema()+`'
 `)
 }
+
+var withStatementTimeoutTests = []struct {
+	about            string
+	connectionString string
+	expect           string
+}{{
+	about:  "empty",
+	expect: "statement_timeout=5000",
+}, {
+	about:            "keyword value",
+	connectionString: "host=localhost dbname=candid",
+	expect:           "host=localhost dbname=candid statement_timeout=5000",
+}, {
+	about:            "url",
+	connectionString: "postgres://localhost/candid?sslmode=disable",
+	expect:           "postgres://localhost/candid?sslmode=disable&statement_timeout=5000",
+}}
+
+func TestWithStatementTimeout(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	for _, test := range withStatementTimeoutTests {
+		c.Run(test.about, func(c *qt.C) {
+			s, err := sqlstore.WithStatementTimeout(test.connectionString, 5*time.Second)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(s, qt.Equals, test.expect)
+		})
+	}
+}
+
+func TestCockroachConfigUnmarshal(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	configData := `
+storage:
+    type: cockroachdb
+    connection-string: postgresql://root@localhost:26257/candid?sslmode=disable
+    max-open-connections: 10
+    list-staleness: 10s
+`
+	var cfg struct {
+		Storage *store.Config `yaml:"storage"`
+	}
+	err := yaml.Unmarshal([]byte(configData), &cfg)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cfg.Storage.BackendFactory, qt.DeepEquals, sqlstore.CockroachParams{
+		Params: sqlstore.Params{
+			ConnectionString:   "postgresql://root@localhost:26257/candid?sslmode=disable",
+			MaxOpenConnections: 10,
+		},
+		ListStaleness: 10 * time.Second,
+	})
+}
+
+func TestCockroachConfigUnmarshalNegativeListStaleness(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	configData := `
+storage:
+    type: cockroachdb
+    list-staleness: -1s
+`
+	var cfg struct {
+		Storage *store.Config `yaml:"storage"`
+	}
+	err := yaml.Unmarshal([]byte(configData), &cfg)
+	c.Assert(err, qt.ErrorMatches, `cannot unmarshal cockroachdb configuration: negative list-staleness in cockroachdb storage configuration`)
+}
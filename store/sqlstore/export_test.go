@@ -5,11 +5,45 @@ package sqlstore
 
 import (
 	"context"
+	"database/sql"
 	"time"
 
 	"github.com/CanonicalLtd/candid/meeting"
+	"github.com/CanonicalLtd/candid/store"
 )
 
 var PutAtTime = func(ctx context.Context, s meeting.Store, id, address string, now time.Time) error {
 	return s.(*meetingStore).put(id, address, now)
 }
+
+var WithStatementTimeout = withStatementTimeout
+
+var CockroachIsRetryable = cockroachIsRetryable
+
+var CockroachLock = cockroachLock
+
+func NewCockroachBackend(db *sql.DB) (store.Backend, error) {
+	return newCockroachBackend(db, CockroachParams{})
+}
+
+type Migration struct {
+	Up, Down []string
+}
+
+// MigrateSchema migrates db using a schema made from the given
+// migrations.
+func MigrateSchema(db *sql.DB, migrations []Migration, transactionalDDL bool, version int) error {
+	s := schema{
+		transactionalDDL: transactionalDDL,
+	}
+	for _, m := range migrations {
+		s.migrations = append(s.migrations, migration{up: m.Up, down: m.Down})
+	}
+	return migrate(db, s, version)
+}
+
+var PostgresSchemaVersion = postgresSchema.latest()
+
+func NewBackendWithMigrationsDisabled(db *sql.DB) (store.Backend, error) {
+	return newBackend("postgres", db, Params{DisableMigrations: true})
+}
@@ -16,5 +16,8 @@ type providerDataStore struct {
 }
 
 func (s *providerDataStore) KeyValueStore(_ context.Context, idp string) (simplekv.Store, error) {
+	if s.b.driver.name == cockroachDriverName {
+		return newKVStore(s.b, "idpkv_"+idp)
+	}
 	return sqlsimplekv.NewStore(s.b.driver.name, s.b.db, "idpkv_"+idp)
 }
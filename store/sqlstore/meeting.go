@@ -8,9 +8,14 @@ import (
 	"database/sql"
 	"time"
 
+	"github.com/lib/pq"
 	"gopkg.in/errgo.v1"
 )
 
+// meetingChannel holds the name of the channel on which notifications of
+// completed rendezvous are sent.
+const meetingChannel = "candid_meeting_complete"
+
 // meetingStore is an implementation of meeting.Store that uses an sql
 // table.
 type meetingStore struct {
@@ -32,6 +37,8 @@ type meetingParams struct {
 	ID      string
 	Address string
 	Time    time.Time
+	Data0   []byte
+	Data1   []byte
 }
 
 // put is the internal version of Put which takes a time
@@ -116,6 +123,7 @@ func (s *meetingStore) RemoveOld(_ context.Context, addr string, olderThan time.
 		if err != nil {
 			return errgo.Mask(err)
 		}
+		ids = nil
 		for rows.Next() {
 			var id string
 			if err := rows.Scan(&id); err != nil {
@@ -141,3 +149,163 @@ func (s *meetingStore) RemoveOld(_ context.Context, addr string, olderThan time.
 	}
 	return ids, nil
 }
+
+// Heartbeat implements meeting.ReplicaStore.Heartbeat.
+func (s *meetingStore) Heartbeat(_ context.Context, address string, now time.Time) error {
+	params := &meetingParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		Address:    address,
+		Time:       now,
+	}
+	_, err := s.driver.exec(s.db, tmplReplicaHeartbeat, params)
+	return errgo.Mask(err)
+}
+
+// RemoveReplica implements meeting.ReplicaStore.RemoveReplica.
+func (s *meetingStore) RemoveReplica(_ context.Context, address string) error {
+	params := &meetingParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		Address:    address,
+	}
+	_, err := s.driver.exec(s.db, tmplRemoveReplica, params)
+	return errgo.Mask(err)
+}
+
+// RemoveDeadReplicas implements meeting.ReplicaStore.RemoveDeadReplicas.
+func (s *meetingStore) RemoveDeadReplicas(_ context.Context, olderThan time.Time) (addresses []string, err error) {
+	params := &meetingParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		Time:       olderThan,
+	}
+	rows, err := s.driver.query(s.db, tmplRemoveDeadReplicas, params)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var address string
+		if err := rows.Scan(&address); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		addresses = append(addresses, address)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return addresses, nil
+}
+
+// PutData implements meeting.PollStore.PutData.
+func (s *meetingStore) PutData(_ context.Context, id, address string, data0 []byte) error {
+	params := &meetingParams{
+		argBuilder: s.driver.argBuilderFunc(),
+
+		ID:      id,
+		Address: address,
+		Time:    time.Now(),
+		Data0:   data0,
+	}
+	_, err := s.driver.exec(s.db, tmplPutMeetingData, params)
+	return errgo.Mask(err)
+}
+
+// Complete implements meeting.PollStore.Complete.
+func (s *meetingStore) Complete(_ context.Context, id string, data1 []byte) error {
+	err := s.withTx(func(tx *sql.Tx) error {
+		params := &meetingParams{
+			argBuilder: s.driver.argBuilderFunc(),
+			ID:         id,
+			Data1:      data1,
+		}
+		res, err := s.driver.exec(tx, tmplCompleteMeeting, params)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if n == 0 {
+			params.argBuilder = s.driver.argBuilderFunc()
+			row, err := s.driver.queryRow(tx, tmplGetMeeting, params)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			var address string
+			var created time.Time
+			if err := row.Scan(&address, &created); err != nil {
+				return errgo.Mask(err, errgo.Is(sql.ErrNoRows))
+			}
+			return errgo.Newf("rendezvous %q done twice", id)
+		}
+		if !s.driver.notifications {
+			return nil
+		}
+		// The notification is only delivered when the
+		// transaction commits.
+		params.argBuilder = s.driver.argBuilderFunc()
+		_, err = s.driver.exec(tx, tmplNotifyMeeting, params)
+		return errgo.Mask(err)
+	})
+	if errgo.Cause(err) == sql.ErrNoRows {
+		return errgo.Newf("rendezvous not found, probably expired")
+	}
+	return errgo.Mask(err)
+}
+
+// GetData implements meeting.PollStore.GetData.
+func (s *meetingStore) GetData(_ context.Context, id string) (data0, data1 []byte, complete bool, err error) {
+	params := &meetingParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		ID:         id,
+	}
+	row, err := s.driver.queryRow(s.db, tmplGetMeetingData, params)
+	if err != nil {
+		return nil, nil, false, errgo.Mask(err)
+	}
+	err = row.Scan(&data0, &data1, &complete)
+	if errgo.Cause(err) == sql.ErrNoRows {
+		return nil, nil, false, errgo.Newf("rendezvous not found, probably expired")
+	}
+	if err != nil {
+		return nil, nil, false, errgo.Mask(err)
+	}
+	return data0, data1, complete, nil
+}
+
+// notifyingMeetingStore is a meetingStore that also implements
+// meeting.Notifier using PostgreSQL LISTEN/NOTIFY.
+type notifyingMeetingStore struct {
+	meetingStore
+}
+
+// Notify implements meeting.Notifier.Notify.
+func (s *notifyingMeetingStore) Notify(ctx context.Context, ids chan<- string) error {
+	l := pq.NewListener(s.connectionString, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			logger.Errorf("meeting notification listener: %v", err)
+		}
+	})
+	defer l.Close()
+	if err := l.Listen(meetingChannel); err != nil {
+		return errgo.Notef(err, "cannot listen for meeting notifications")
+	}
+	for {
+		select {
+		case n := <-l.Notify:
+			if n == nil {
+				// The connection has been re-established, so
+				// notifications may have been missed. Waiting
+				// places will find out when they next poll.
+				continue
+			}
+			select {
+			case ids <- n.Extra:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// A migration is a single versioned change to a database schema. The
+// version of a migration is its index in the schema's migrations plus
+// one, so version 0 is an empty database.
+type migration struct {
+	// up holds the statements that apply the migration.
+	up []string
+
+	// down holds the statements that revert the migration.
+	down []string
+}
+
+// A schema describes how to migrate the schema of a database.
+type schema struct {
+	// migrations holds the migrations in version order. Once a
+	// version of candid containing a migration has been released,
+	// that migration must not be changed; further changes must be
+	// added as new migrations.
+	migrations []migration
+
+	// transactionalDDL holds whether schema changes can be made in
+	// a transaction. If they can, each migration is applied
+	// atomically. Otherwise the schema is marked as dirty while a
+	// migration is applied, so that a failure part way through a
+	// migration can be detected.
+	transactionalDDL bool
+
+	// lock, if not nil, is called to stop other servers migrating
+	// the database at the same time. The returned function releases
+	// the lock.
+	lock func(ctx context.Context, db *sql.DB) (unlock func(), err error)
+}
+
+// latest returns the latest version of the schema.
+func (s schema) latest() int {
+	return len(s.migrations)
+}
+
+const migrationsTableInit = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER NOT NULL,
+	dirty BOOLEAN NOT NULL
+)`
+
+// migrate applies or reverts migrations to bring the schema of the
+// given database to the given version. If version is negative the
+// latest version is used.
+func migrate(db *sql.DB, s schema, version int) error {
+	if version < 0 {
+		version = s.latest()
+	}
+	if version > s.latest() {
+		return errgo.Newf("cannot migrate to unknown schema version %d (latest is %d)", version, s.latest())
+	}
+	ctx := context.Background()
+	if _, err := db.Exec(migrationsTableInit); err != nil {
+		return errgo.Notef(err, "cannot create schema_migrations table")
+	}
+	if s.lock != nil {
+		unlock, err := s.lock(ctx, db)
+		if err != nil {
+			return errgo.Notef(err, "cannot lock database for migration")
+		}
+		defer unlock()
+	}
+	current, err := currentVersion(db)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if current > s.latest() {
+		return errgo.Newf("database schema version %d is newer than the latest version known to this server (%d)", current, s.latest())
+	}
+	for current < version {
+		current++
+		logger.Infof("applying database migration %d", current)
+		if err := s.apply(db, current, s.migrations[current-1].up); err != nil {
+			return errgo.Notef(err, "cannot apply migration %d", current)
+		}
+	}
+	for current > version {
+		logger.Infof("reverting database migration %d", current)
+		if err := s.apply(db, current-1, s.migrations[current-1].down); err != nil {
+			return errgo.Notef(err, "cannot revert migration %d", current)
+		}
+		current--
+	}
+	return nil
+}
+
+// updateSchema brings the schema of the given database to the latest
+// version. If disableMigrations is true the schema is not changed and
+// an error is returned if it is not already at the latest version.
+func updateSchema(db *sql.DB, s schema, disableMigrations bool) error {
+	if disableMigrations {
+		return errgo.Mask(checkVersion(db, s))
+	}
+	return errgo.Mask(migrate(db, s, -1))
+}
+
+// checkVersion checks that the schema of the given database is at the
+// latest version without changing it.
+func checkVersion(db *sql.DB, s schema) error {
+	if _, err := db.Exec(migrationsTableInit); err != nil {
+		return errgo.Notef(err, "cannot create schema_migrations table")
+	}
+	current, err := currentVersion(db)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if current != s.latest() {
+		return errgo.Newf("database schema is at version %d but version %d is required; migrations must be applied using candidsrv -migrate-only", current, s.latest())
+	}
+	return nil
+}
+
+// currentVersion returns the current schema version of the given
+// database. It returns an error if the schema is dirty.
+func currentVersion(db *sql.DB) (int, error) {
+	var version int
+	var dirty bool
+	err := db.QueryRow(`SELECT version, dirty FROM schema_migrations`).Scan(&version, &dirty)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot get schema version")
+	}
+	if dirty {
+		return 0, errgo.Newf("database schema is dirty: a migration to version %d failed part way through; the schema must be repaired by hand before setting schema_migrations.dirty to false", version)
+	}
+	return version, nil
+}
+
+// apply runs the given statements to bring the database to the given
+// version.
+func (s schema) apply(db *sql.DB, version int, stmts []string) error {
+	if s.transactionalDDL {
+		tx, err := db.Begin()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if err := runMigration(tx, version, stmts); err != nil {
+			if err := tx.Rollback(); err != nil {
+				logger.Errorf("failed to rollback transaction: %s", err)
+			}
+			return errgo.Mask(err)
+		}
+		return errgo.Mask(tx.Commit())
+	}
+	if err := setVersion(db, version, true); err != nil {
+		return errgo.Mask(err)
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return errgo.Mask(setVersion(db, version, false))
+}
+
+// runMigration runs the given statements in the given transaction and
+// records the new version.
+func runMigration(tx *sql.Tx, version int, stmts []string) error {
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return errgo.Mask(setVersion(tx, version, false))
+}
+
+// setVersion records the schema version of the database.
+func setVersion(q queryer, version int, dirty bool) error {
+	if _, err := q.Exec(`DELETE FROM schema_migrations`); err != nil {
+		return errgo.Notef(err, "cannot set schema version")
+	}
+	if _, err := q.Exec(`INSERT INTO schema_migrations (version, dirty) VALUES ($1, $2)`, version, dirty); err != nil {
+		return errgo.Notef(err, "cannot set schema version")
+	}
+	return nil
+}
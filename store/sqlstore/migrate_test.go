@@ -0,0 +1,156 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package sqlstore_test
+
+import (
+	"database/sql"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/store/sqlstore"
+)
+
+var testMigrations = []sqlstore.Migration{{
+	Up:   []string{`CREATE TABLE t1 (id INTEGER)`},
+	Down: []string{`DROP TABLE t1`},
+}, {
+	Up:   []string{`CREATE TABLE t2 (id INTEGER)`},
+	Down: []string{`DROP TABLE t2`},
+}}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	db := newTestDB(c)
+	err := sqlstore.MigrateSchema(db, testMigrations, true, -1)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(schemaVersion(c, db), qt.Equals, 2)
+	c.Assert(tableExists(c, db, "t1"), qt.Equals, true)
+	c.Assert(tableExists(c, db, "t2"), qt.Equals, true)
+
+	// Migrating again is a no-op.
+	err = sqlstore.MigrateSchema(db, testMigrations, true, -1)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(schemaVersion(c, db), qt.Equals, 2)
+
+	err = sqlstore.MigrateSchema(db, testMigrations, true, 1)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(schemaVersion(c, db), qt.Equals, 1)
+	c.Assert(tableExists(c, db, "t1"), qt.Equals, true)
+	c.Assert(tableExists(c, db, "t2"), qt.Equals, false)
+
+	err = sqlstore.MigrateSchema(db, testMigrations, true, 0)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(schemaVersion(c, db), qt.Equals, 0)
+	c.Assert(tableExists(c, db, "t1"), qt.Equals, false)
+}
+
+func TestMigrateUnknownVersion(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	db := newTestDB(c)
+	err := sqlstore.MigrateSchema(db, testMigrations, true, 3)
+	c.Assert(err, qt.ErrorMatches, `cannot migrate to unknown schema version 3 \(latest is 2\)`)
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	db := newTestDB(c)
+	err := sqlstore.MigrateSchema(db, testMigrations, true, -1)
+	c.Assert(err, qt.Equals, nil)
+	err = sqlstore.MigrateSchema(db, testMigrations[:1], true, -1)
+	c.Assert(err, qt.ErrorMatches, `database schema version 2 is newer than the latest version known to this server \(1\)`)
+}
+
+func TestMigrateTransactionalFailure(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	db := newTestDB(c)
+	migrations := append(testMigrations[:1:1], sqlstore.Migration{
+		Up: []string{`CREATE TABLE t2 (id INTEGER)`, `INVALID SQL`},
+	})
+	err := sqlstore.MigrateSchema(db, migrations, true, -1)
+	c.Assert(err, qt.ErrorMatches, `cannot apply migration 2: .*`)
+
+	// The failed migration has been rolled back so the schema is
+	// left clean at the previous version.
+	c.Assert(schemaVersion(c, db), qt.Equals, 1)
+	c.Assert(tableExists(c, db, "t2"), qt.Equals, false)
+	err = sqlstore.MigrateSchema(db, testMigrations, true, -1)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(schemaVersion(c, db), qt.Equals, 2)
+}
+
+func TestMigrateDirty(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	db := newTestDB(c)
+	migrations := append(testMigrations[:1:1], sqlstore.Migration{
+		Up: []string{`CREATE TABLE t2 (id INTEGER)`, `INVALID SQL`},
+	})
+	err := sqlstore.MigrateSchema(db, migrations, false, -1)
+	c.Assert(err, qt.ErrorMatches, `cannot apply migration 2: .*`)
+
+	// The failed migration could not be rolled back so the schema
+	// is dirty and further migrations are refused.
+	c.Assert(tableExists(c, db, "t2"), qt.Equals, true)
+	err = sqlstore.MigrateSchema(db, testMigrations, false, -1)
+	c.Assert(err, qt.ErrorMatches, `database schema is dirty: a migration to version 2 failed part way through; .*`)
+}
+
+func TestNewBackendMigratesSchema(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	f := newFixture(c)
+	c.Assert(schemaVersion(c, f.pg.DB), qt.Equals, sqlstore.PostgresSchemaVersion)
+}
+
+func TestNewBackendWithMigrationsDisabled(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	db := newTestDB(c)
+	_, err := sqlstore.NewBackendWithMigrationsDisabled(db)
+	c.Assert(err, qt.ErrorMatches, `database schema is at version 0 but version [0-9]+ is required; migrations must be applied using candidsrv -migrate-only`)
+
+	backend, err := sqlstore.NewBackend("postgres", db)
+	c.Assert(err, qt.Equals, nil)
+	backend.Close()
+}
+
+func newTestDB(c *qt.C) *sql.DB {
+	pg, err := postgrestest.New()
+	if errgo.Cause(err) == postgrestest.ErrDisabled {
+		c.Skip(err.Error())
+	}
+	c.Assert(err, qt.Equals, nil)
+	c.Defer(func() {
+		pg.DB.Close()
+	})
+	return pg.DB
+}
+
+func schemaVersion(c *qt.C, db *sql.DB) int {
+	var version int
+	err := db.QueryRow(`SELECT version FROM schema_migrations`).Scan(&version)
+	c.Assert(err, qt.Equals, nil)
+	return version
+}
+
+func tableExists(c *qt.C, db *sql.DB, table string) bool {
+	var exists bool
+	err := db.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, table).Scan(&exists)
+	c.Assert(err, qt.Equals, nil)
+	return exists
+}
@@ -1,6 +1,7 @@
 package sqlstore
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
@@ -8,6 +9,9 @@ import (
 	errgo "gopkg.in/errgo.v1"
 )
 
+// postgresInit holds the statements that create the initial postgres
+// schema. The statements are idempotent so that databases created
+// before schema versioning was introduced can be migrated.
 const postgresInit = `
 CREATE TABLE IF NOT EXISTS identities ( 
 	id SERIAL PRIMARY KEY,
@@ -85,8 +89,109 @@ CREATE TABLE IF NOT EXISTS meetings (
 	address TEXT NOT NULL,
 	created TIMESTAMP WITH TIME ZONE NOT NULL
 );
+
+ALTER TABLE meetings
+	ADD COLUMN IF NOT EXISTS data0 BYTEA,
+	ADD COLUMN IF NOT EXISTS data1 BYTEA,
+	ADD COLUMN IF NOT EXISTS completed BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS meeting_replicas (
+	address TEXT NOT NULL PRIMARY KEY,
+	heartbeat TIMESTAMP WITH TIME ZONE NOT NULL
+);
+`
+
+// postgresSearchIndexes holds the statements that add indexes for
+// identity searches.
+const postgresSearchIndexes = `
+-- Identity searches match substrings, which can only use an index if
+-- the pg_trgm extension is available. Creating the extension may
+-- require privileges that the database user does not have, in which
+-- case searches still work but will not be indexed.
+DO $$
+    BEGIN
+        CREATE EXTENSION IF NOT EXISTS pg_trgm;
+        CREATE INDEX IF NOT EXISTS identities_username_trgm ON identities USING gin (username gin_trgm_ops);
+        CREATE INDEX IF NOT EXISTS identities_email_trgm ON identities USING gin (email gin_trgm_ops);
+        CREATE INDEX IF NOT EXISTS identities_name_trgm ON identities USING gin (name gin_trgm_ops);
+    EXCEPTION
+        WHEN insufficient_privilege OR undefined_file THEN
+            RAISE NOTICE 'pg_trgm is not available, identity searches will not be indexed';
+    END;
+$$;
 `
 
+// postgresIdentityDeleteNotify holds the statements that add a trigger
+// that sends notifications of deleted identities. Candid never deletes
+// identities itself, but administrators may remove them from the
+// database directly.
+const postgresIdentityDeleteNotify = `
+CREATE OR REPLACE FUNCTION identity_delete_notify_fn() RETURNS trigger
+LANGUAGE plpgsql
+AS $$
+	BEGIN
+		PERFORM pg_notify('` + identityChannel + `', OLD.id::text);
+		PERFORM pg_notify('` + identityEventChannel + `', 'delete ' || OLD.id::text);
+		RETURN OLD;
+	END;
+$$;
+
+DROP TRIGGER IF EXISTS identity_delete_notify_tr ON identities;
+CREATE TRIGGER identity_delete_notify_tr
+   AFTER DELETE ON identities
+   FOR EACH ROW
+   EXECUTE PROCEDURE identity_delete_notify_fn();
+`
+
+// postgresSchema holds the versioned postgres schema.
+var postgresSchema = schema{
+	migrations: []migration{{
+		up: []string{postgresInit},
+		down: []string{`
+			DROP TABLE IF EXISTS meeting_replicas, meetings, provider_data, identity_extrainfo, identity_providerinfo, identity_publickeys, identity_groups, identities;
+			DROP FUNCTION IF EXISTS provider_data_expire_fn();
+		`},
+	}, {
+		up: []string{postgresSearchIndexes},
+		down: []string{`
+			DROP INDEX IF EXISTS identities_username_trgm;
+			DROP INDEX IF EXISTS identities_email_trgm;
+			DROP INDEX IF EXISTS identities_name_trgm;
+		`},
+	}, {
+		up: []string{postgresIdentityDeleteNotify},
+		down: []string{`
+			DROP TRIGGER IF EXISTS identity_delete_notify_tr ON identities;
+			DROP FUNCTION IF EXISTS identity_delete_notify_fn();
+		`},
+	}},
+	transactionalDDL: true,
+	lock:             postgresLock,
+}
+
+// postgresMigrationLock holds the key of the advisory lock that is held
+// while the schema is migrated.
+const postgresMigrationLock = 0x63616e646964
+
+// postgresLock takes an advisory lock on the database so that only one
+// server migrates the schema at a time.
+func postgresLock(ctx context.Context, db *sql.DB) (func(), error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, postgresMigrationLock); err != nil {
+		conn.Close()
+		return nil, errgo.Mask(err)
+	}
+	return func() {
+		if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, postgresMigrationLock); err != nil {
+			logger.Errorf("cannot release migration lock: %s", err)
+		}
+		conn.Close()
+	}, nil
+}
+
 var postgresTmpls = [numTmpl]string{
 	tmplIdentityFrom: `
 		SELECT id, providerid, username, name, email, lastlogin, lastdischarge, owner
@@ -97,7 +202,7 @@ var postgresTmpls = [numTmpl]string{
 		WHERE identity={{.Identity | .Arg}}`,
 	tmplFindIdentities: `
 		SELECT id, providerid, username, name, email, lastlogin, lastdischarge, owner FROM identities
-		{{if .Where}}WHERE{{range $i, $w := .Where}}{{if gt $i 0}} AND{{end}} {{$w.Column}}{{$w.Comparison}}{{$w.Value | $.Arg}}{{end}}{{end}}
+		{{if .Where}}WHERE{{range $i, $w := .Where}}{{if gt $i 0}}{{if $w.Or}} OR{{else}} AND{{end}}{{end}} {{$w.Open}}{{$w.Column}}{{$w.Comparison}}{{if not $w.NoValue}}{{$w.Value | $.Arg}}{{end}}{{$w.Close}}{{end}}{{end}}
 		{{if .Sort}}ORDER BY {{join .Sort ", "}}{{end}}
 		{{if gt .Limit 0}}LIMIT {{.Limit}}{{end}}
 		{{if gt .Skip 0}}OFFSET {{.Skip}}{{end}}`,
@@ -154,26 +259,74 @@ var postgresTmpls = [numTmpl]string{
 	tmplIdentityCounts: `
 		SELECT substring(providerid, '^[^:]*') as idp, COUNT(1) 
 		FROM identities GROUP BY idp`,
+	tmplSearchIdentities: `
+		SELECT id, providerid, username, name, email, lastlogin, lastdischarge, owner FROM identities
+		WHERE username ILIKE {{.Pattern | .Arg}} OR email ILIKE {{.Pattern | .Arg}} OR name ILIKE {{.Pattern | .Arg}}
+		ORDER BY username
+		{{if gt .Limit 0}}LIMIT {{.Limit}}{{end}}
+		{{if gt .Skip 0}}OFFSET {{.Skip}}{{end}}`,
+	tmplReplicaHeartbeat: `
+		INSERT INTO meeting_replicas (address, heartbeat)
+		VALUES ({{.Address | .Arg}}, {{.Time | .Arg}})
+		ON CONFLICT (address) DO UPDATE
+		SET heartbeat={{.Time | .Arg}}`,
+	tmplRemoveReplica: `
+		DELETE FROM meeting_replicas
+		WHERE address={{.Address | .Arg}}`,
+	tmplRemoveDeadReplicas: `
+		DELETE FROM meeting_replicas
+		WHERE heartbeat < {{.Time | .Arg}}
+		RETURNING address`,
+	tmplPutMeetingData: `
+		INSERT INTO meetings (id, address, created, data0)
+		VALUES ({{.ID | .Arg}}, {{.Address | .Arg}}, {{.Time | .Arg}}, {{.Data0 | .Arg}})`,
+	tmplGetMeetingData: `
+		SELECT data0, data1, completed FROM meetings
+		WHERE id={{.ID | .Arg}}`,
+	tmplCompleteMeeting: `
+		UPDATE meetings SET data1={{.Data1 | .Arg}}, completed=TRUE
+		WHERE id={{.ID | .Arg}} AND NOT completed`,
+	tmplNotifyMeeting: `
+		SELECT pg_notify('` + meetingChannel + `', {{.ID | .Arg}})`,
+	tmplNotifyIdentity: `
+		SELECT pg_notify('` + identityChannel + `', {{.ID | .Arg}}),
+			pg_notify('` + identityEventChannel + `', {{.Event | .Arg}})`,
 }
 
-// newPostgresDriver creates a postgres driver using the given DB.
-func newPostgresDriver(db *sql.DB) (*driver, error) {
-	_, err := db.Exec(postgresInit)
-	if err != nil {
-		return nil, errgo.Mask(err)
-	}
+// postgresPrepared holds the templates whose queries are run as
+// prepared statements. These are the queries made when users log in
+// and obtain discharges.
+var postgresPrepared = []tmplID{
+	tmplIdentityFrom,
+	tmplSelectIdentitySet,
+	tmplUpdateIdentity,
+	tmplGetMeeting,
+	tmplPutMeeting,
+}
+
+// newPostgresDriver creates a postgres driver using the given DB. If
+// prepare is true, frequently used queries are run as prepared
+// statements. The database schema must already be up to date.
+func newPostgresDriver(db *sql.DB, prepare bool) (*driver, error) {
 	d := &driver{
 		name: "postgres",
 		argBuilderFunc: func() argBuilder {
 			return &postgresArgBuilder{}
 		},
 		isDuplicateFunc: postgresIsDuplicate,
+		notifications:   true,
 	}
 	for i, t := range postgresTmpls {
 		if err := d.parseTemplate(tmplID(i), t); err != nil {
 			return nil, errgo.Notef(err, "cannot parse template %v", t)
 		}
 	}
+	if prepare {
+		d.db = db
+		for _, id := range postgresPrepared {
+			d.prepared[id] = true
+		}
+	}
 	return d, nil
 }
 
@@ -5,9 +5,11 @@ import (
 	"database/sql"
 	sqldriver "database/sql/driver"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/juju/loggo"
+	"github.com/lib/pq"
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 
@@ -26,6 +28,15 @@ var identityColumns = [store.NumFields]string{
 	store.Owner:         "owner",
 }
 
+// identityChannel holds the name of the channel on which notifications
+// of changed identities are sent.
+const identityChannel = "candid_identity_changed"
+
+// identityEventChannel holds the name of the channel on which
+// store.IdentityEvents are sent. The payload of each notification
+// holds the event type and the identity ID separated by a space.
+const identityEventChannel = "candid_identity_events"
+
 type identityStore struct {
 	*backend
 }
@@ -84,11 +95,11 @@ func (s *identityStore) identity(tx *sql.Tx, identity *store.Identity) error {
 }
 
 // FindIdentities implements store.FindIdentities.
-func (s *identityStore) FindIdentities(ctx context.Context, ref *store.Identity, filter store.Filter, sort []store.Sort, skip, limit int) ([]store.Identity, error) {
+func (s *identityStore) FindIdentities(ctx context.Context, ref *store.Identity, filter store.Filter, sort []store.Sort, skip, limit int, conditions ...store.Condition) ([]store.Identity, error) {
 	var identities []store.Identity
-	err := s.withTx(func(tx *sql.Tx) error {
+	err := s.withListTx(func(tx *sql.Tx) error {
 		var err error
-		identities, err = s.findIdentities(tx, ref, filter, sort, skip, limit)
+		identities, err = s.findIdentities(tx, ref, filter, sort, skip, limit, conditions)
 		return err
 	})
 	if err != nil {
@@ -101,6 +112,22 @@ type where struct {
 	Column     string
 	Comparison string
 	Value      interface{}
+
+	// NoValue is set if the comparison does not take a value, for
+	// example " IS NULL".
+	NoValue bool
+
+	// Open holds any text needed before the column, such as an
+	// opening parenthesis.
+	Open string
+
+	// Close holds any text needed after the value to complete the
+	// condition.
+	Close string
+
+	// Or is set if the condition is joined to the previous one
+	// with OR rather than AND.
+	Or bool
 }
 
 type findIdentitiesParams struct {
@@ -111,16 +138,17 @@ type findIdentitiesParams struct {
 	Skip  int
 }
 
-func (s *identityStore) findIdentities(tx *sql.Tx, ref *store.Identity, filter store.Filter, sort []store.Sort, skip, limit int) ([]store.Identity, error) {
+func (s *identityStore) findIdentities(tx *sql.Tx, ref *store.Identity, filter store.Filter, sort []store.Sort, skip, limit int, conditions []store.Condition) ([]store.Identity, error) {
 	var wheres []where
 	for f, op := range filter {
-		col := identityColumns[f]
-		cond := comparisons[op]
-		if col == "" || cond == "" {
+		wheres = appendWhere(wheres, store.Field(f), op, ref)
+	}
+	for _, cond := range conditions {
+		if cond.Comparison == store.After {
+			wheres = appendAfter(wheres, cond.Sort, &cond.Ref, s.driver.nullsFirst)
 			continue
 		}
-
-		wheres = append(wheres, where{col, cond, fieldValue(store.Field(f), ref)})
+		wheres = appendWhere(wheres, cond.Field, cond.Comparison, &cond.Ref)
 	}
 
 	sorts := make([]string, 0, len(sort))
@@ -142,7 +170,39 @@ func (s *identityStore) findIdentities(tx *sql.Tx, ref *store.Identity, filter s
 		Limit:      limit,
 		Skip:       skip,
 	}
-	rows, err := s.driver.query(tx, tmplFindIdentities, params)
+	return s.queryIdentities(tx, tmplFindIdentities, params)
+}
+
+// SearchIdentities implements store.Store.SearchIdentities.
+func (s *identityStore) SearchIdentities(ctx context.Context, text string, skip, limit int) ([]store.Identity, error) {
+	var identities []store.Identity
+	err := s.withListTx(func(tx *sql.Tx) error {
+		var err error
+		identities, err = s.queryIdentities(tx, tmplSearchIdentities, &searchIdentitiesParams{
+			argBuilder: s.driver.argBuilderFunc(),
+			Pattern:    "%" + likeEscaper.Replace(text) + "%",
+			Limit:      limit,
+			Skip:       skip,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot search identities")
+	}
+	return identities, nil
+}
+
+type searchIdentitiesParams struct {
+	argBuilder
+	Pattern string
+	Limit   int
+	Skip    int
+}
+
+// queryIdentities returns the complete identities found by executing
+// the given template.
+func (s *identityStore) queryIdentities(tx *sql.Tx, tmplID tmplID, params argBuilder) ([]store.Identity, error) {
+	rows, err := s.driver.query(tx, tmplID, params)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -166,6 +226,138 @@ func (s *identityStore) findIdentities(tx *sql.Tx, ref *store.Identity, filter s
 	return identities, nil
 }
 
+// appendWhere appends the conditions that compare the given field with
+// the same field of the given identity.
+func appendWhere(wheres []where, f store.Field, op store.Comparison, ref *store.Identity) []where {
+	switch op {
+	case store.HasPrefix, store.HasSuffix:
+		col := identityColumns[f]
+		if col == "" {
+			return wheres
+		}
+		v := likeEscaper.Replace(stringValue(f, ref))
+		if op == store.HasPrefix {
+			v += "%"
+		} else {
+			v = "%" + v
+		}
+		return append(wheres, where{Column: col, Comparison: " LIKE ", Value: v})
+	case store.Contains:
+		if f != store.Groups {
+			return wheres
+		}
+		for _, g := range ref.Groups {
+			wheres = append(wheres, where{
+				Column:     "id",
+				Comparison: " IN (SELECT identity FROM identity_groups WHERE value=",
+				Value:      g,
+				Close:      ")",
+			})
+		}
+		return wheres
+	}
+	col := identityColumns[f]
+	cond := comparisons[op]
+	if col == "" || cond == "" {
+		return wheres
+	}
+	return append(wheres, where{Column: col, Comparison: cond, Value: fieldValue(f, ref)})
+}
+
+// appendAfter appends the conditions that match the identities that
+// come after the given identity in the given sort order. Empty names,
+// email addresses and times are stored as NULL, so nullsFirst must
+// hold whether the database sorts NULL values before all others.
+func appendAfter(wheres []where, sort []store.Sort, ref *store.Identity, nullsFirst bool) []where {
+	var terms [][]where
+	for i, s := range sort {
+		col := identityColumns[s.Field]
+		if col == "" {
+			continue
+		}
+		// Each term matches identities that are equal in all
+		// the preceding sort fields and follow in this one.
+		var term []where
+		for _, s1 := range sort[:i] {
+			if col1 := identityColumns[s1.Field]; col1 != "" {
+				term = append(term, equalWhere(col1, fieldValue(s1.Field, ref)))
+			}
+		}
+		cmp := ">"
+		if s.Descending {
+			cmp = "<"
+		}
+		v := fieldValue(s.Field, ref)
+		_, nullable := v.(sqldriver.Valuer)
+		nullsAfter := nullable && nullsFirst == s.Descending
+		switch {
+		case isNull(v) && nullsAfter:
+			// Nothing follows a NULL value.
+			continue
+		case isNull(v):
+			term = append(term, where{Column: col, Comparison: " IS NOT NULL", NoValue: true})
+		case nullsAfter:
+			term = append(term,
+				where{Open: "(", Column: col, Comparison: cmp, Value: v},
+				where{Or: true, Column: col, Comparison: " IS NULL", NoValue: true, Close: ")"},
+			)
+		default:
+			term = append(term, where{Column: col, Comparison: cmp, Value: v})
+		}
+		term[0].Open = "(" + term[0].Open
+		term[len(term)-1].Close += ")"
+		term[0].Or = len(terms) > 0
+		terms = append(terms, term)
+	}
+	if len(terms) == 0 {
+		return append(wheres, where{Column: "FALSE", NoValue: true})
+	}
+	terms[0][0].Open = "(" + terms[0][0].Open
+	last := terms[len(terms)-1]
+	last[len(last)-1].Close += ")"
+	for _, term := range terms {
+		wheres = append(wheres, term...)
+	}
+	return wheres
+}
+
+// equalWhere returns a condition that matches rows where the given
+// column holds the given value, which may be NULL.
+func equalWhere(col string, v interface{}) where {
+	if isNull(v) {
+		return where{Column: col, Comparison: " IS NULL", NoValue: true}
+	}
+	return where{Column: col, Comparison: "=", Value: v}
+}
+
+// isNull reports whether the given value is stored as NULL.
+func isNull(v interface{}) bool {
+	if v, ok := v.(sqldriver.Valuer); ok {
+		dv, err := v.Value()
+		return err == nil && dv == nil
+	}
+	return v == nil
+}
+
+// likeEscaper escapes the special characters in a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func stringValue(f store.Field, id *store.Identity) string {
+	switch f {
+	case store.ProviderID:
+		return string(id.ProviderID)
+	case store.Username:
+		return id.Username
+	case store.Name:
+		return id.Name
+	case store.Email:
+		return id.Email
+	case store.Owner:
+		return string(id.Owner)
+	}
+	return ""
+}
+
 func fieldValue(f store.Field, id *store.Identity) interface{} {
 	switch f {
 	case store.ProviderID:
@@ -289,9 +481,47 @@ func (s *identityStore) getInfoMap(tx *sql.Tx, table string, id string) (map[str
 
 // UpdateIdentity implements store.Store.UpdateIdentity.
 func (s *identityStore) UpdateIdentity(_ context.Context, identity *store.Identity, update store.Update) (err error) {
-	return errgo.Mask(s.withTx(func(tx *sql.Tx) error {
+	id := identity.ID
+	err = s.withTx(func(tx *sql.Tx) error {
+		// Reset any ID assigned by a previous attempt.
+		identity.ID = id
 		return s.updateIdentity(tx, identity, update)
-	}), errgo.Is(store.ErrDuplicateUsername), errgo.Is(store.ErrNotFound))
+	})
+	if err != nil {
+		identity.ID = id
+		return errgo.Mask(err, errgo.Is(store.ErrDuplicateUsername), errgo.Is(store.ErrNotFound))
+	}
+	return nil
+}
+
+// UpdateIdentities implements store.Store.UpdateIdentities by
+// performing all the updates in a single transaction.
+func (s *identityStore) UpdateIdentities(_ context.Context, identities []*store.Identity, update store.Update) error {
+	ids := make([]string, len(identities))
+	for i, identity := range identities {
+		ids[i] = identity.ID
+	}
+	err := s.withTx(func(tx *sql.Tx) error {
+		for i, identity := range identities {
+			// Reset any ID assigned by a previous attempt.
+			identity.ID = ids[i]
+		}
+		for _, identity := range identities {
+			if err := s.updateIdentity(tx, identity, update); err != nil {
+				return errgo.Mask(err, errgo.Any)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// The transaction has been rolled back so any IDs
+		// assigned to new identities are no longer valid.
+		for i, identity := range identities {
+			identity.ID = ids[i]
+		}
+		return errgo.Mask(err, errgo.Is(store.ErrDuplicateUsername), errgo.Is(store.ErrNotFound))
+	}
+	return nil
 }
 
 type update struct {
@@ -366,6 +596,26 @@ func (s *identityStore) updateIdentity(tx *sql.Tx, identity *store.Identity, upd
 	if len(params.Updates) == 0 {
 		tmpl = tmplIdentityID
 	}
+	event := store.IdentityUpdated
+	if tmpl == tmplUpsertIdentity && s.driver.notifications {
+		// Find out whether the upsert will create the identity
+		// so that the correct event can be sent.
+		row, err := s.driver.queryRow(tx, tmplIdentityID, updateIdentityParams{
+			argBuilder: s.driver.argBuilderFunc(),
+			Column:     params.Column,
+			Identity:   params.Identity,
+		})
+		if err != nil {
+			return errgo.Notef(err, "cannot update identity")
+		}
+		var id string
+		if err := row.Scan(&id); err != nil {
+			if errgo.Cause(err) != sql.ErrNoRows {
+				return errgo.Notef(err, "cannot update identity")
+			}
+			event = store.IdentityCreated
+		}
+	}
 	row, err := s.driver.queryRow(tx, tmpl, params)
 	if err != nil {
 		return errgo.Notef(err, "cannot update identity")
@@ -396,10 +646,32 @@ func (s *identityStore) updateIdentity(tx *sql.Tx, identity *store.Identity, upd
 			return errgo.Notef(err, "cannot update identity")
 		}
 	}
-
+	if !s.driver.notifications || store.IsDischargeUpdate(upd) {
+		return nil
+	}
+	// The notification is only delivered when the transaction
+	// commits.
+	if _, err := s.driver.exec(tx, tmplNotifyIdentity, notifyIdentityParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		ID:         identity.ID,
+		Event:      string(event) + " " + identity.ID,
+	}); err != nil {
+		return errgo.Notef(err, "cannot update identity")
+	}
 	return nil
 }
 
+type notifyIdentityParams struct {
+	argBuilder
+
+	// ID contains the ID of the identity that has changed.
+	ID string
+
+	// Event contains the payload of the notification sent on
+	// identityEventChannel.
+	Event string
+}
+
 type updateSetParams struct {
 	argBuilder
 	Table  string
@@ -483,21 +755,28 @@ func (s *identityStore) updateExtraInfo(tx *sql.Tx, id, key string, op store.Ope
 
 // IdentityCounts implements store.IdentityCounts.
 func (s *identityStore) IdentityCounts(ctx context.Context) (map[string]int, error) {
-	counts := make(map[string]int)
-	rows, err := s.driver.query(s.db, tmplIdentityCounts, s.driver.argBuilderFunc())
+	var counts map[string]int
+	err := s.withListTx(func(tx *sql.Tx) error {
+		counts = make(map[string]int)
+		rows, err := s.driver.query(tx, tmplIdentityCounts, s.driver.argBuilderFunc())
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var idp string
+			var count int
+			if err := rows.Scan(&idp, &count); err != nil {
+				return errgo.Mask(err)
+			}
+			counts[idp] = count
+		}
+		return errgo.Mask(rows.Err())
+	})
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var idp string
-		var count int
-		if err := rows.Scan(&idp, &count); err != nil {
-			return nil, errgo.Mask(err)
-		}
-		counts[idp] = count
-	}
-	return counts, errgo.Mask(rows.Err())
+	return counts, nil
 }
 
 type nullTime struct {
@@ -565,3 +844,90 @@ func scanIdentity(s scanner, identity *store.Identity) error {
 	identity.Owner = store.ProviderIdentity(owner.String)
 	return nil
 }
+
+// notifyingIdentityStore is an identityStore that also implements
+// store.IdentityNotifier using PostgreSQL LISTEN/NOTIFY.
+type notifyingIdentityStore struct {
+	identityStore
+}
+
+// NotifyIdentityChanges implements
+// store.IdentityNotifier.NotifyIdentityChanges.
+func (s *notifyingIdentityStore) NotifyIdentityChanges(ctx context.Context, ids chan<- string) error {
+	l := pq.NewListener(s.connectionString, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			logger.Errorf("identity notification listener: %v", err)
+		}
+	})
+	defer l.Close()
+	if err := l.Listen(identityChannel); err != nil {
+		return errgo.Notef(err, "cannot listen for identity notifications")
+	}
+	for {
+		var id string
+		select {
+		case n := <-l.Notify:
+			if n != nil {
+				id = n.Extra
+			}
+			// A nil notification means that the connection has
+			// been re-established, so notifications may have been
+			// missed. This is reported with an empty ID.
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case ids <- id:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// WatchIdentities implements store.Watcher.WatchIdentities.
+func (s *notifyingIdentityStore) WatchIdentities(ctx context.Context, events chan<- store.IdentityEvent) error {
+	l := pq.NewListener(s.connectionString, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			logger.Errorf("identity event listener: %v", err)
+		}
+	})
+	defer l.Close()
+	if err := l.Listen(identityEventChannel); err != nil {
+		return errgo.Notef(err, "cannot listen for identity events")
+	}
+	for {
+		var ev store.IdentityEvent
+		select {
+		case n := <-l.Notify:
+			if n == nil {
+				// The connection has been re-established, so
+				// events may have been missed.
+				ev.Type = store.IdentityEventsMissed
+				break
+			}
+			ev = parseIdentityEvent(n.Extra)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case events <- ev:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// parseIdentityEvent parses the payload of a notification sent on
+// identityEventChannel.
+func parseIdentityEvent(payload string) store.IdentityEvent {
+	parts := strings.SplitN(payload, " ", 2)
+	if len(parts) != 2 {
+		// This shouldn't happen, but if it does the event
+		// cannot be identified.
+		return store.IdentityEvent{Type: store.IdentityEventsMissed}
+	}
+	return store.IdentityEvent{
+		Type: store.IdentityEventType(parts[0]),
+		ID:   parts[1],
+	}
+}
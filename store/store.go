@@ -83,12 +83,49 @@ const (
 	LessThan
 	GreaterThanOrEqual
 	LessThanOrEqual
+
+	// HasPrefix and HasSuffix match string fields that start or end
+	// with the reference value.
+	HasPrefix
+	HasSuffix
+
+	// Contains matches identities whose Groups include all of the
+	// reference groups. It may only be used with the Groups field.
+	Contains
+
+	// After matches identities that come after the reference
+	// identity in the sort order given by Condition.Sort, which
+	// should end with a unique field such as Username. It may only
+	// be used in a Condition, and allows the identities following
+	// an earlier page of results to be found without skipping
+	// over all the earlier results.
+	After
 )
 
 // A Filter is used in a Store.FindEntities call to specify how the
 // identities should be filtered.
 type Filter [NumFields]Comparison
 
+// A Condition is an additional restriction on the identities returned
+// from Store.FindIdentities. Unlike a Filter, conditions allow a field
+// to be compared more than once, for example to select a range of
+// values.
+type Condition struct {
+	// Field holds the field to compare.
+	Field Field
+
+	// Comparison holds the comparison to make.
+	Comparison Comparison
+
+	// Ref holds the identity holding the value of Field to compare
+	// with.
+	Ref Identity
+
+	// Sort holds the sort order used by the After comparison. The
+	// Field of a condition using After is ignored.
+	Sort []Sort
+}
+
 // A Sort specifies the sort order of returned identities in a call to
 // Store.FindIdenties.
 type Sort struct {
@@ -122,8 +159,16 @@ type Store interface {
 	// will be sorted in the order specified by sort. If limit is
 	// greater than 0 then the results will contain at most that many
 	// identities. If skip is greater than 0 then that many results
-	// will be skipped before those that are returned.
-	FindIdentities(ctx context.Context, ref *Identity, filter Filter, sort []Sort, skip, limit int) ([]Identity, error)
+	// will be skipped before those that are returned. Only
+	// identities that also match all of the given conditions are
+	// returned.
+	FindIdentities(ctx context.Context, ref *Identity, filter Filter, sort []Sort, skip, limit int, conditions ...Condition) ([]Identity, error)
+
+	// SearchIdentities searches for identities whose username, email
+	// address or full name contains the given text, ignoring case.
+	// The results will be sorted by username. The skip and limit
+	// parameters behave as they do in FindIdentities.
+	SearchIdentities(ctx context.Context, text string, skip, limit int) ([]Identity, error)
 
 	// UpdateIdentity stores the data from the given identity in
 	// persistant storage. The identity that is updated will be the
@@ -143,11 +188,89 @@ type Store interface {
 	// will be returned.
 	UpdateIdentity(ctx context.Context, identity *Identity, update Update) error
 
+	// UpdateIdentities performs the given update on each of the
+	// given identities as if by UpdateIdentity. Stores that support
+	// transactions apply the whole batch atomically: if any update
+	// fails then none of them will have been made. Stores that do
+	// not support transactions may have made some of the updates
+	// before the failure. Any error will have the same cause as the
+	// equivalent UpdateIdentity error.
+	UpdateIdentities(ctx context.Context, identities []*Identity, update Update) error
+
 	// IdentityCounts returns the number of identities stored in the
 	// store split by provider ID.
 	IdentityCounts(ctx context.Context) (map[string]int, error)
 }
 
+// IsDischargeUpdate reports whether the given update only sets the
+// LastDischarge field. Such updates are made every time a user obtains
+// a discharge, so stores do not report them to an IdentityNotifier.
+func IsDischargeUpdate(update Update) bool {
+	for f, op := range update {
+		if op != NoUpdate && Field(f) != LastDischarge {
+			return false
+		}
+	}
+	return update[LastDischarge] == Set
+}
+
+// An IdentityNotifier is implemented by a Store that can report changes
+// made to identities by any server sharing the same storage.
+type IdentityNotifier interface {
+	// NotifyIdentityChanges sends the ID of each identity that is
+	// changed on the given channel until the given context is
+	// canceled or an error occurs. If changes might have been missed,
+	// for example because a connection to the database was lost, an
+	// empty ID is sent to indicate that any identity may have
+	// changed.
+	NotifyIdentityChanges(ctx context.Context, ids chan<- string) error
+}
+
+// An IdentityEventType is the type of change reported by an
+// IdentityEvent.
+type IdentityEventType string
+
+const (
+	// IdentityCreated is the type of event sent when an identity is
+	// created.
+	IdentityCreated IdentityEventType = "create"
+
+	// IdentityUpdated is the type of event sent when an existing
+	// identity is updated.
+	IdentityUpdated IdentityEventType = "update"
+
+	// IdentityDeleted is the type of event sent when an identity is
+	// removed from the storage.
+	IdentityDeleted IdentityEventType = "delete"
+
+	// IdentityEventsMissed is the type of event sent when events
+	// might have been missed, for example because a connection to
+	// the database was lost. Any identity may have changed.
+	IdentityEventsMissed IdentityEventType = "missed"
+)
+
+// An IdentityEvent describes a change made to an identity.
+type IdentityEvent struct {
+	// Type holds the type of change.
+	Type IdentityEventType `json:"type"`
+
+	// ID holds the ID of the identity that changed. It is empty for
+	// IdentityEventsMissed events.
+	ID string `json:"id,omitempty"`
+}
+
+// A Watcher is implemented by a Store that can report the identities
+// that are created, updated and deleted by any server sharing the same
+// storage, so that other systems can mirror identity data. As with
+// IdentityNotifier, updates that only record a discharge are not
+// reported.
+type Watcher interface {
+	// WatchIdentities sends an event for each identity that is
+	// changed on the given channel until the given context is
+	// canceled or an error occurs.
+	WatchIdentities(ctx context.Context, events chan<- IdentityEvent) error
+}
+
 // A ProviderIdentity is a provider-specific unique identity.
 type ProviderIdentity string
 
@@ -5,6 +5,7 @@ package store_test
 
 import (
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 
@@ -19,3 +20,44 @@ func TestProviderIdentity(t *testing.T) {
 	c.Assert(prov, qt.Equals, "test")
 	c.Assert(id, qt.Equals, "test-id")
 }
+
+func TestIsDischargeUpdate(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(store.IsDischargeUpdate(store.Update{store.LastDischarge: store.Set}), qt.Equals, true)
+	c.Assert(store.IsDischargeUpdate(store.Update{}), qt.Equals, false)
+	c.Assert(store.IsDischargeUpdate(store.Update{store.LastDischarge: store.Clear}), qt.Equals, false)
+	c.Assert(store.IsDischargeUpdate(store.Update{
+		store.LastDischarge: store.Set,
+		store.LastLogin:     store.Set,
+	}), qt.Equals, false)
+}
+
+func TestSortIdentities(t *testing.T) {
+	c := qt.New(t)
+	t0 := time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)
+	identities := []store.Identity{
+		{Username: "carol", LastLogin: t0},
+		{Username: "alice", LastLogin: t0.Add(time.Hour)},
+		{Username: "bob", LastLogin: t0},
+	}
+	sort := []store.Sort{{Field: store.LastLogin, Descending: true}, {Field: store.Username}}
+	store.SortIdentities(identities, sort)
+	var usernames []string
+	for _, id := range identities {
+		usernames = append(usernames, id.Username)
+	}
+	c.Assert(usernames, qt.DeepEquals, []string{"alice", "bob", "carol"})
+
+	c.Assert(store.SortsAfter(&identities[2], &identities[1], sort), qt.Equals, true)
+	c.Assert(store.SortsAfter(&identities[1], &identities[2], sort), qt.Equals, false)
+	c.Assert(store.SortsAfter(&identities[1], &identities[1], sort), qt.Equals, false)
+	c.Assert(store.MatchConditions(&identities[2], []store.Condition{{
+		Comparison: store.After,
+		Ref:        identities[0],
+		Sort:       sort,
+	}, {
+		Field:      store.Username,
+		Comparison: store.HasPrefix,
+		Ref:        store.Identity{Username: "car"},
+	}}), qt.Equals, true)
+}
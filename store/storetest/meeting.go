@@ -155,3 +155,79 @@ func (s *meetingSuite) TestContext(c *qt.C) {
 	defer close()
 	c.Assert(ctx, qt.Equals, s.ctx)
 }
+
+func (s *meetingSuite) TestReplicas(c *qt.C) {
+	store, ok := s.Store.(meeting.ReplicaStore)
+	if !ok {
+		c.Skip("store does not implement meeting.ReplicaStore")
+	}
+	now := time.Now().Truncate(time.Millisecond)
+	err := store.Heartbeat(s.ctx, "a:1", now.Add(-time.Minute))
+	c.Assert(err, qt.Equals, nil)
+	err = store.Heartbeat(s.ctx, "b:1", now.Add(-time.Minute))
+	c.Assert(err, qt.Equals, nil)
+	err = store.Heartbeat(s.ctx, "c:1", now.Add(-time.Minute))
+	c.Assert(err, qt.Equals, nil)
+
+	// A later heartbeat replaces an earlier one.
+	err = store.Heartbeat(s.ctx, "b:1", now)
+	c.Assert(err, qt.Equals, nil)
+
+	err = store.RemoveReplica(s.ctx, "c:1")
+	c.Assert(err, qt.Equals, nil)
+	// Removing a replica that doesn't exist is not an error.
+	err = store.RemoveReplica(s.ctx, "c:1")
+	c.Assert(err, qt.Equals, nil)
+
+	addrs, err := store.RemoveDeadReplicas(s.ctx, now.Add(-time.Second))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(addrs, qt.DeepEquals, []string{"a:1"})
+
+	addrs, err = store.RemoveDeadReplicas(s.ctx, now.Add(-time.Second))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(addrs, qt.HasLen, 0)
+
+	addrs, err = store.RemoveDeadReplicas(s.ctx, now.Add(time.Second))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(addrs, qt.DeepEquals, []string{"b:1"})
+}
+
+func (s *meetingSuite) TestPollData(c *qt.C) {
+	store, ok := s.Store.(meeting.PollStore)
+	if !ok {
+		c.Skip("store does not implement meeting.PollStore")
+	}
+	err := store.PutData(s.ctx, "x", "xaddr", []byte("first data"))
+	c.Assert(err, qt.Equals, nil)
+
+	addr, err := store.Get(s.ctx, "x")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(addr, qt.Equals, "xaddr")
+
+	data0, data1, complete, err := store.GetData(s.ctx, "x")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(data0), qt.Equals, "first data")
+	c.Assert(data1, qt.IsNil)
+	c.Assert(complete, qt.Equals, false)
+
+	err = store.Complete(s.ctx, "x", []byte("second data"))
+	c.Assert(err, qt.Equals, nil)
+
+	err = store.Complete(s.ctx, "x", []byte("other second data"))
+	c.Assert(err, qt.ErrorMatches, `rendezvous "x" done twice`)
+
+	data0, data1, complete, err = store.GetData(s.ctx, "x")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(data0), qt.Equals, "first data")
+	c.Assert(string(data1), qt.Equals, "second data")
+	c.Assert(complete, qt.Equals, true)
+
+	_, err = store.Remove(s.ctx, "x")
+	c.Assert(err, qt.Equals, nil)
+
+	_, _, _, err = store.GetData(s.ctx, "x")
+	c.Assert(err, qt.ErrorMatches, `rendezvous not found, probably expired`)
+
+	err = store.Complete(s.ctx, "x", []byte("second data"))
+	c.Assert(err, qt.ErrorMatches, `rendezvous not found, probably expired`)
+}
@@ -866,6 +866,75 @@ func (s *storeSuite) TestInsertDuplicateUsername(c *qt.C) {
 	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
 }
 
+func (s *storeSuite) TestUpdateIdentities(c *qt.C) {
+	identities := []*store.Identity{{
+		ProviderID: store.MakeProviderIdentity("test", "user1"),
+		Username:   "user1",
+		Name:       "User One",
+	}, {
+		ProviderID: store.MakeProviderIdentity("test", "user2"),
+		Username:   "user2",
+		Name:       "User Two",
+	}}
+	update := store.Update{
+		store.Username: store.Set,
+		store.Name:     store.Set,
+	}
+	err := s.Store.UpdateIdentities(s.ctx, identities, update)
+	c.Assert(err, qt.Equals, nil)
+	for _, identity := range identities {
+		c.Assert(identity.ID, qt.Not(qt.Equals), "")
+		identity1 := store.Identity{
+			ProviderID: identity.ProviderID,
+		}
+		err := s.Store.Identity(s.ctx, &identity1)
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(identity1.ID, qt.Equals, identity.ID)
+		c.Assert(identity1.Username, qt.Equals, identity.Username)
+		c.Assert(identity1.Name, qt.Equals, identity.Name)
+	}
+
+	identities[0].Name = "User 1"
+	identities[1].Name = "User 2"
+	err = s.Store.UpdateIdentities(s.ctx, identities, update)
+	c.Assert(err, qt.Equals, nil)
+	for _, identity := range identities {
+		identity1 := store.Identity{
+			ID: identity.ID,
+		}
+		err := s.Store.Identity(s.ctx, &identity1)
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(identity1.Name, qt.Equals, identity.Name)
+	}
+}
+
+func (s *storeSuite) TestUpdateIdentitiesEmpty(c *qt.C) {
+	err := s.Store.UpdateIdentities(s.ctx, nil, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+}
+
+func (s *storeSuite) TestUpdateIdentitiesDuplicateUsername(c *qt.C) {
+	err := s.Store.UpdateIdentities(s.ctx, []*store.Identity{{
+		ProviderID: store.MakeProviderIdentity("test", "user1"),
+		Username:   "user1",
+	}, {
+		ProviderID: store.MakeProviderIdentity("test", "user2"),
+		Username:   "user1",
+	}}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.ErrorMatches, `username user1 already in use`)
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrDuplicateUsername)
+
+	identity := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "user2"),
+	}
+	err = s.Store.Identity(s.ctx, &identity)
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+}
+
 func (s *storeSuite) TestUpdateIDDuplicateUsername(c *qt.C) {
 	err := s.Store.UpdateIdentity(
 		s.ctx,
@@ -1089,13 +1158,14 @@ var testIdentities = []store.Identity{{
 }}
 
 var findIdentitiesTests = []struct {
-	about  string
-	ref    store.Identity
-	filter store.Filter
-	sort   []store.Sort
-	skip   int
-	limit  int
-	expect []int
+	about      string
+	ref        store.Identity
+	filter     store.Filter
+	conditions []store.Condition
+	sort       []store.Sort
+	skip       int
+	limit      int
+	expect     []int
 }{{
 	about: "no matches",
 	ref: store.Identity{
@@ -1384,6 +1454,100 @@ var findIdentitiesTests = []struct {
 		store.Owner: store.Equal,
 	},
 	expect: []int{5},
+}, {
+	about: "provider ID has prefix",
+	ref: store.Identity{
+		ProviderID: "test:test1",
+	},
+	filter: store.Filter{
+		store.ProviderID: store.HasPrefix,
+	},
+	expect: []int{0},
+}, {
+	about: "email has suffix",
+	ref: store.Identity{
+		Email: "9@example.com",
+	},
+	filter: store.Filter{
+		store.Email: store.HasSuffix,
+	},
+	sort:   []store.Sort{{Field: store.Username}},
+	expect: []int{6, 8},
+}, {
+	about: "suffix containing pattern characters",
+	ref: store.Identity{
+		Email: "_@example.com",
+	},
+	filter: store.Filter{
+		store.Email: store.HasSuffix,
+	},
+}, {
+	about: "groups contains",
+	ref: store.Identity{
+		Groups: []string{"g2", "g1"},
+	},
+	filter: store.Filter{
+		store.Groups: store.Contains,
+	},
+	expect: []int{0},
+}, {
+	about: "last login range",
+	conditions: []store.Condition{{
+		Field:      store.LastLogin,
+		Comparison: store.GreaterThanOrEqual,
+		Ref: store.Identity{
+			LastLogin: time.Date(2017, 1, 3, 0, 0, 0, 0, time.UTC),
+		},
+	}, {
+		Field:      store.LastLogin,
+		Comparison: store.LessThan,
+		Ref: store.Identity{
+			LastLogin: time.Date(2017, 1, 6, 0, 0, 0, 0, time.UTC),
+		},
+	}},
+	sort:   []store.Sort{{Field: store.Username}},
+	expect: []int{2, 3, 4},
+}, {
+	about: "conditions with filter",
+	ref: store.Identity{
+		Email: "test9@example.com",
+	},
+	filter: store.Filter{
+		store.Email: store.Equal,
+	},
+	conditions: []store.Condition{{
+		Field:      store.Username,
+		Comparison: store.GreaterThan,
+		Ref: store.Identity{
+			Username: "test7",
+		},
+	}},
+	expect: []int{8},
+}, {
+	about: "after in mixed sort order",
+	conditions: []store.Condition{{
+		Comparison: store.After,
+		Ref: store.Identity{
+			Username: "test7",
+			Email:    "test9@example.com",
+		},
+		Sort: []store.Sort{{Field: store.Email, Descending: true}, {Field: store.Username}},
+	}},
+	sort:   []store.Sort{{Field: store.Email, Descending: true}, {Field: store.Username}},
+	limit:  3,
+	expect: []int{8, 7, 5},
+}, {
+	about: "after last login",
+	conditions: []store.Condition{{
+		Comparison: store.After,
+		Ref: store.Identity{
+			Username:  "test7",
+			LastLogin: time.Date(2017, 1, 7, 0, 0, 0, 0, time.UTC),
+		},
+		Sort: []store.Sort{{Field: store.LastLogin}, {Field: store.Username}},
+	}},
+	sort:   []store.Sort{{Field: store.LastLogin}, {Field: store.Username}},
+	expect: []int{7, 8},
 }}
 
 func (s *storeSuite) TestFindIdentities(c *qt.C) {
@@ -1425,7 +1589,7 @@ func (s *storeSuite) TestFindIdentities(c *qt.C) {
 
 	for i, test := range findIdentitiesTests {
 		c.Logf("%d. %s", i, test.about)
-		identities, err := s.Store.FindIdentities(s.ctx, &test.ref, test.filter, test.sort, test.skip, test.limit)
+		identities, err := s.Store.FindIdentities(s.ctx, &test.ref, test.filter, test.sort, test.skip, test.limit, test.conditions...)
 		c.Assert(err, qt.Equals, nil)
 		c.Assert(len(identities), qt.Equals, len(test.expect))
 		for i, identity := range identities {
@@ -1434,6 +1598,77 @@ func (s *storeSuite) TestFindIdentities(c *qt.C) {
 	}
 }
 
+var searchIdentitiesTests = []struct {
+	about  string
+	text   string
+	skip   int
+	limit  int
+	expect []string
+}{{
+	about:  "username",
+	text:   "ali",
+	expect: []string{"alice", "malik"},
+}, {
+	about:  "email",
+	text:   "example.org",
+	expect: []string{"bob"},
+}, {
+	about:  "name ignoring case",
+	text:   "SMITH",
+	expect: []string{"alice", "bob"},
+}, {
+	about:  "pattern characters",
+	text:   "100%",
+	expect: []string{"malik"},
+}, {
+	about:  "skip and limit",
+	text:   "example",
+	skip:   1,
+	limit:  1,
+	expect: []string{"bob"},
+}, {
+	about: "no match",
+	text:  "nobody",
+}}
+
+func (s *storeSuite) TestSearchIdentities(c *qt.C) {
+	for _, id := range []store.Identity{{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Username:   "alice",
+		Name:       "Alice Smith",
+		Email:      "alice@example.com",
+	}, {
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Name:       "Bob Smith",
+		Email:      "bob@example.org",
+	}, {
+		ProviderID: store.MakeProviderIdentity("test", "malik"),
+		Username:   "malik",
+		Name:       "Malik 100%",
+		Email:      "malik@example.net",
+	}} {
+		err := s.Store.UpdateIdentity(s.ctx, &id, store.Update{
+			store.Username: store.Set,
+			store.Name:     store.Set,
+			store.Email:    store.Set,
+		})
+		c.Assert(err, qt.Equals, nil)
+	}
+
+	for _, test := range searchIdentitiesTests {
+		c.Run(test.about, func(c *qt.C) {
+			identities, err := s.Store.SearchIdentities(s.ctx, test.text, test.skip, test.limit)
+			c.Assert(err, qt.Equals, nil)
+			var usernames []string
+			for _, id := range identities {
+				usernames = append(usernames, id.Username)
+			}
+			c.Assert(usernames, qt.DeepEquals, test.expect)
+		})
+	}
+}
+
 func (s *storeSuite) TestIdentityCounts(c *qt.C) {
 	idps := []string{"a", "b", "c", "a", "b", "a"}
 	for i, idp := range idps {
@@ -0,0 +1,176 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package tenantstore
+
+import (
+	"context"
+	"regexp"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// tenantName matches the start of a name that belongs to a tenant.
+var tenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*/`)
+
+// NewDefaultStore returns a store.Store that holds the identities in st
+// that do not belong to any tenant. It is used by the server of the
+// default organisation when the tenants are kept in the same backend.
+// If st implements store.IdentityNotifier then so does the returned
+// store.
+func NewDefaultStore(st store.Store) store.Store {
+	s := &defaultStore{
+		st: st,
+	}
+	if n, ok := st.(store.IdentityNotifier); ok {
+		return &notifyingDefaultStore{
+			defaultStore:     s,
+			IdentityNotifier: n,
+		}
+	}
+	return s
+}
+
+type defaultStore struct {
+	st store.Store
+}
+
+// notifyingDefaultStore is a defaultStore that passes on the change
+// notifications of the underlying store.
+type notifyingDefaultStore struct {
+	*defaultStore
+	store.IdentityNotifier
+}
+
+// Context implements store.Store.Context.
+func (s *defaultStore) Context(ctx context.Context) (context.Context, func()) {
+	return s.st.Context(ctx)
+}
+
+// Identity implements store.Store.Identity.
+func (s *defaultStore) Identity(ctx context.Context, identity *store.Identity) error {
+	if namesTenant(identity) {
+		return store.NotFoundError(identity.ID, identity.ProviderID, identity.Username)
+	}
+	id := *identity
+	if err := s.st.Identity(ctx, &id); err != nil {
+		return errgo.Mask(err, errgo.Is(store.ErrNotFound))
+	}
+	if namesTenant(&id) {
+		return store.NotFoundError(identity.ID, identity.ProviderID, identity.Username)
+	}
+	*identity = id
+	return nil
+}
+
+// FindIdentities implements store.Store.FindIdentities. The underlying
+// store cannot exclude the identities of the tenants, so identities
+// are fetched in batches until enough that do not belong to a tenant
+// have been found.
+func (s *defaultStore) FindIdentities(ctx context.Context, ref *store.Identity, filter store.Filter, sort []store.Sort, skip, limit int, conditions ...store.Condition) ([]store.Identity, error) {
+	var identities []store.Identity
+	for offset := 0; ; offset += batchSize {
+		batch, err := s.st.FindIdentities(ctx, ref, filter, sort, offset, batchSize, conditions...)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		identities, skip = appendDefault(identities, batch, skip)
+		if limit > 0 && len(identities) >= limit {
+			return identities[:limit], nil
+		}
+		if len(batch) < batchSize {
+			return identities, nil
+		}
+	}
+}
+
+// SearchIdentities implements store.Store.SearchIdentities in the same
+// way as FindIdentities.
+func (s *defaultStore) SearchIdentities(ctx context.Context, text string, skip, limit int) ([]store.Identity, error) {
+	var identities []store.Identity
+	for offset := 0; ; offset += batchSize {
+		batch, err := s.st.SearchIdentities(ctx, text, offset, batchSize)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		identities, skip = appendDefault(identities, batch, skip)
+		if limit > 0 && len(identities) >= limit {
+			return identities[:limit], nil
+		}
+		if len(batch) < batchSize {
+			return identities, nil
+		}
+	}
+}
+
+// appendDefault appends the identities in batch that do not belong to
+// a tenant to identities, after skipping the first skip of them. It
+// returns the new identities and the number still to be skipped.
+func appendDefault(identities, batch []store.Identity, skip int) ([]store.Identity, int) {
+	for _, id := range batch {
+		if namesTenant(&id) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		identities = append(identities, id)
+	}
+	return identities, skip
+}
+
+// UpdateIdentity implements store.Store.UpdateIdentity.
+func (s *defaultStore) UpdateIdentity(ctx context.Context, identity *store.Identity, update store.Update) error {
+	if err := s.check(ctx, identity); err != nil {
+		return errgo.Mask(err, errgo.Is(store.ErrNotFound))
+	}
+	return errgo.Mask(s.st.UpdateIdentity(ctx, identity, update), errgo.Any)
+}
+
+// UpdateIdentities implements store.Store.UpdateIdentities.
+func (s *defaultStore) UpdateIdentities(ctx context.Context, identities []*store.Identity, update store.Update) error {
+	for _, identity := range identities {
+		if err := s.check(ctx, identity); err != nil {
+			return errgo.Mask(err, errgo.Is(store.ErrNotFound))
+		}
+	}
+	return errgo.Mask(s.st.UpdateIdentities(ctx, identities, update), errgo.Any)
+}
+
+// IdentityCounts implements store.Store.IdentityCounts.
+func (s *defaultStore) IdentityCounts(ctx context.Context) (map[string]int, error) {
+	counts, err := s.st.IdentityCounts(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	for provider := range counts {
+		if tenantName.MatchString(provider) {
+			delete(counts, provider)
+		}
+	}
+	return counts, nil
+}
+
+// check checks that the given identity, which is about to be updated,
+// does not belong to a tenant.
+func (s *defaultStore) check(ctx context.Context, identity *store.Identity) error {
+	if namesTenant(identity) {
+		return store.NotFoundError(identity.ID, identity.ProviderID, identity.Username)
+	}
+	if identity.ID == "" {
+		return nil
+	}
+	id := store.Identity{
+		ID: identity.ID,
+	}
+	return errgo.Mask(s.Identity(ctx, &id), errgo.Is(store.ErrNotFound))
+}
+
+// namesTenant reports whether the provider ID or username of the given
+// identity, as held in the underlying store, belongs to a tenant.
+func namesTenant(identity *store.Identity) bool {
+	return tenantName.MatchString(string(identity.ProviderID)) || tenantName.MatchString(identity.Username)
+}
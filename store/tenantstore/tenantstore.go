@@ -0,0 +1,379 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package tenantstore keeps the data of several tenants in the same
+// storage backend. Each tenant sees only its own identities, identity
+// provider data, ACLs and macaroon root keys.
+//
+// The stores are wrappers around the stores of an existing backend, so
+// no changes are needed to the backends. The tenant of an identity is
+// recorded by prefixing its provider ID, username and owner with the
+// tenant name followed by a "/", which cannot appear in usernames
+// created through the API. The server of the default organisation
+// uses the store returned by NewDefaultStore, which hides the
+// identities of every tenant.
+package tenantstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"strings"
+
+	"github.com/juju/aclstore/v2"
+	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// batchSize holds the number of identities fetched from the underlying
+// store at a time when the identities returned by the underlying store
+// must be filtered.
+const batchSize = 100
+
+// prefix returns the prefix added to the names that belong to the
+// given tenant.
+func prefix(tenant string) string {
+	return tenant + "/"
+}
+
+// NewStore returns a store.Store that keeps the identities of the
+// given tenant in st. If st implements store.IdentityNotifier then so
+// does the returned store.
+func NewStore(st store.Store, tenant string) store.Store {
+	s := &identityStore{
+		st:     st,
+		prefix: prefix(tenant),
+	}
+	if n, ok := st.(store.IdentityNotifier); ok {
+		return &notifyingIdentityStore{
+			identityStore:    s,
+			IdentityNotifier: n,
+		}
+	}
+	return s
+}
+
+type identityStore struct {
+	st     store.Store
+	prefix string
+}
+
+// notifyingIdentityStore is an identityStore that passes on the
+// change notifications of the underlying store. Identity IDs are
+// unique across all tenants, so the notifications of other tenants
+// only cause unnecessary cache invalidations.
+type notifyingIdentityStore struct {
+	*identityStore
+	store.IdentityNotifier
+}
+
+// Context implements store.Store.Context.
+func (s *identityStore) Context(ctx context.Context) (context.Context, func()) {
+	return s.st.Context(ctx)
+}
+
+// Identity implements store.Store.Identity.
+func (s *identityStore) Identity(ctx context.Context, identity *store.Identity) error {
+	id := s.encode(identity)
+	if err := s.st.Identity(ctx, &id); err != nil {
+		if errgo.Cause(err) == store.ErrNotFound {
+			return store.NotFoundError(identity.ID, identity.ProviderID, identity.Username)
+		}
+		return errgo.Mask(err)
+	}
+	if !s.owns(&id) {
+		return store.NotFoundError(identity.ID, identity.ProviderID, identity.Username)
+	}
+	*identity = s.decode(&id)
+	return nil
+}
+
+// FindIdentities implements store.Store.FindIdentities.
+func (s *identityStore) FindIdentities(ctx context.Context, ref *store.Identity, filter store.Filter, sort []store.Sort, skip, limit int, conditions ...store.Condition) ([]store.Identity, error) {
+	eref := s.encode(ref)
+	econditions := make([]store.Condition, len(conditions), len(conditions)+1)
+	for i, c := range conditions {
+		c.Ref = s.encode(&c.Ref)
+		econditions[i] = c
+	}
+	econditions = append(econditions, store.Condition{
+		Field:      store.ProviderID,
+		Comparison: store.HasPrefix,
+		Ref: store.Identity{
+			ProviderID: store.ProviderIdentity(s.prefix),
+		},
+	})
+	identities, err := s.st.FindIdentities(ctx, &eref, filter, sort, skip, limit, econditions...)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	for i := range identities {
+		identities[i] = s.decode(&identities[i])
+	}
+	return identities, nil
+}
+
+// SearchIdentities implements store.Store.SearchIdentities. The
+// underlying store cannot restrict its search to the tenant, so
+// identities are fetched in batches until enough that belong to the
+// tenant have been found.
+func (s *identityStore) SearchIdentities(ctx context.Context, text string, skip, limit int) ([]store.Identity, error) {
+	var identities []store.Identity
+	lower := strings.ToLower(text)
+	for offset := 0; ; offset += batchSize {
+		batch, err := s.st.SearchIdentities(ctx, text, offset, batchSize)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		for i := range batch {
+			if !s.owns(&batch[i]) {
+				continue
+			}
+			id := s.decode(&batch[i])
+			// The text may only have matched the tenant
+			// prefix.
+			if !strings.Contains(strings.ToLower(id.Username), lower) &&
+				!strings.Contains(strings.ToLower(id.Email), lower) &&
+				!strings.Contains(strings.ToLower(id.Name), lower) {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			identities = append(identities, id)
+			if limit > 0 && len(identities) == limit {
+				return identities, nil
+			}
+		}
+		if len(batch) < batchSize {
+			return identities, nil
+		}
+	}
+}
+
+// UpdateIdentity implements store.Store.UpdateIdentity.
+func (s *identityStore) UpdateIdentity(ctx context.Context, identity *store.Identity, update store.Update) error {
+	if err := s.checkID(ctx, identity); err != nil {
+		return errgo.Mask(err, errgo.Is(store.ErrNotFound))
+	}
+	id := s.encode(identity)
+	if err := s.st.UpdateIdentity(ctx, &id, update); err != nil {
+		return s.updateError(err, identity)
+	}
+	identity.ID = id.ID
+	return nil
+}
+
+// UpdateIdentities implements store.Store.UpdateIdentities.
+func (s *identityStore) UpdateIdentities(ctx context.Context, identities []*store.Identity, update store.Update) error {
+	ids := make([]*store.Identity, len(identities))
+	for i, identity := range identities {
+		if err := s.checkID(ctx, identity); err != nil {
+			return errgo.Mask(err, errgo.Is(store.ErrNotFound))
+		}
+		id := s.encode(identity)
+		ids[i] = &id
+	}
+	if err := s.st.UpdateIdentities(ctx, ids, update); err != nil {
+		switch cause := errgo.Cause(err); cause {
+		case store.ErrNotFound, store.ErrDuplicateUsername:
+			// Report the names known to the tenant.
+			return errgo.WithCausef(nil, cause, "%s", strings.Replace(err.Error(), s.prefix, "", -1))
+		}
+		return errgo.Mask(err)
+	}
+	for i, id := range ids {
+		identities[i].ID = id.ID
+	}
+	return nil
+}
+
+// IdentityCounts implements store.Store.IdentityCounts.
+func (s *identityStore) IdentityCounts(ctx context.Context) (map[string]int, error) {
+	counts, err := s.st.IdentityCounts(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	tcounts := make(map[string]int)
+	for provider, n := range counts {
+		if strings.HasPrefix(provider, s.prefix) {
+			tcounts[strings.TrimPrefix(provider, s.prefix)] = n
+		}
+	}
+	return tcounts, nil
+}
+
+// checkID checks that, if the given identity is specified by ID, the
+// identity with that ID belongs to the tenant. IDs are allocated by
+// the underlying store, so they are not prefixed.
+func (s *identityStore) checkID(ctx context.Context, identity *store.Identity) error {
+	if identity.ID == "" {
+		return nil
+	}
+	id := store.Identity{
+		ID: identity.ID,
+	}
+	return errgo.Mask(s.Identity(ctx, &id), errgo.Is(store.ErrNotFound))
+}
+
+// updateError returns the error to return from a failed update of the
+// given identity.
+func (s *identityStore) updateError(err error, identity *store.Identity) error {
+	switch errgo.Cause(err) {
+	case store.ErrNotFound:
+		return store.NotFoundError(identity.ID, identity.ProviderID, identity.Username)
+	case store.ErrDuplicateUsername:
+		return store.DuplicateUsernameError(identity.Username)
+	}
+	return errgo.Mask(err)
+}
+
+// owns reports whether the given identity, as stored in the underlying
+// store, belongs to the tenant.
+func (s *identityStore) owns(identity *store.Identity) bool {
+	return strings.HasPrefix(string(identity.ProviderID), s.prefix)
+}
+
+// encode returns a copy of the given identity with the names that
+// belong to the tenant prefixed as they are in the underlying store.
+// Empty names are left empty so that comparisons with them keep their
+// meaning.
+func (s *identityStore) encode(identity *store.Identity) store.Identity {
+	id := *identity
+	if id.ProviderID != "" {
+		id.ProviderID = store.ProviderIdentity(s.prefix) + id.ProviderID
+	}
+	if id.Username != "" {
+		id.Username = s.prefix + id.Username
+	}
+	if id.Owner != "" {
+		id.Owner = store.ProviderIdentity(s.prefix) + id.Owner
+	}
+	return id
+}
+
+// decode returns a copy of the given identity from the underlying
+// store with the tenant prefixes removed.
+func (s *identityStore) decode(identity *store.Identity) store.Identity {
+	id := *identity
+	id.ProviderID = store.ProviderIdentity(strings.TrimPrefix(string(id.ProviderID), s.prefix))
+	id.Username = strings.TrimPrefix(id.Username, s.prefix)
+	id.Owner = store.ProviderIdentity(strings.TrimPrefix(string(id.Owner), s.prefix))
+	return id
+}
+
+// NewProviderDataStore returns a store.ProviderDataStore that keeps the
+// identity provider data of the given tenant in st.
+func NewProviderDataStore(st store.ProviderDataStore, tenant string) store.ProviderDataStore {
+	return &providerDataStore{
+		st:     st,
+		prefix: prefix(tenant),
+	}
+}
+
+type providerDataStore struct {
+	st     store.ProviderDataStore
+	prefix string
+}
+
+// KeyValueStore implements store.ProviderDataStore.KeyValueStore.
+func (s *providerDataStore) KeyValueStore(ctx context.Context, idp string) (simplekv.Store, error) {
+	kv, err := s.st.KeyValueStore(ctx, s.prefix+idp)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return kv, nil
+}
+
+// NewACLStore returns an aclstore.ACLStore that keeps the ACLs of the
+// given tenant in st.
+func NewACLStore(st aclstore.ACLStore, tenant string) aclstore.ACLStore {
+	return &aclStore{
+		ACLStore: st,
+		prefix:   prefix(tenant),
+	}
+}
+
+type aclStore struct {
+	aclstore.ACLStore
+	prefix string
+}
+
+// CreateACL implements aclstore.ACLStore.CreateACL.
+func (s *aclStore) CreateACL(ctx context.Context, aclName string, initialUsers []string) error {
+	return errgo.Mask(s.ACLStore.CreateACL(ctx, s.prefix+aclName, initialUsers), errgo.Any)
+}
+
+// Add implements aclstore.ACLStore.Add.
+func (s *aclStore) Add(ctx context.Context, aclName string, users []string) error {
+	return errgo.Mask(s.ACLStore.Add(ctx, s.prefix+aclName, users), errgo.Any)
+}
+
+// Remove implements aclstore.ACLStore.Remove.
+func (s *aclStore) Remove(ctx context.Context, aclName string, users []string) error {
+	return errgo.Mask(s.ACLStore.Remove(ctx, s.prefix+aclName, users), errgo.Any)
+}
+
+// Set implements aclstore.ACLStore.Set.
+func (s *aclStore) Set(ctx context.Context, aclName string, users []string) error {
+	return errgo.Mask(s.ACLStore.Set(ctx, s.prefix+aclName, users), errgo.Any)
+}
+
+// Get implements aclstore.ACLStore.Get.
+func (s *aclStore) Get(ctx context.Context, aclName string) ([]string, error) {
+	acl, err := s.ACLStore.Get(ctx, s.prefix+aclName)
+	return acl, errgo.Mask(err, errgo.Any)
+}
+
+// NewRootKeyStore returns a bakery.RootKeyStore that gives the given
+// tenant its own macaroon root keys, derived from the root keys in st.
+// Each root key of the tenant is the HMAC of the tenant name keyed by
+// a root key in st, so a key of one tenant reveals nothing about the
+// keys of any other tenant, or of a server using st directly. The IDs
+// of the root keys are prefixed with the tenant name so that the
+// original key can be found.
+func NewRootKeyStore(st bakery.RootKeyStore, tenant string) bakery.RootKeyStore {
+	return &rootKeyStore{
+		st:     st,
+		prefix: []byte(prefix(tenant)),
+	}
+}
+
+type rootKeyStore struct {
+	st     bakery.RootKeyStore
+	prefix []byte
+}
+
+// Get implements bakery.RootKeyStore.Get.
+func (s *rootKeyStore) Get(ctx context.Context, id []byte) ([]byte, error) {
+	if !bytes.HasPrefix(id, s.prefix) {
+		return nil, bakery.ErrNotFound
+	}
+	key, err := s.st.Get(ctx, id[len(s.prefix):])
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(bakery.ErrNotFound))
+	}
+	return s.deriveKey(key), nil
+}
+
+// RootKey implements bakery.RootKeyStore.RootKey.
+func (s *rootKeyStore) RootKey(ctx context.Context) ([]byte, []byte, error) {
+	key, id, err := s.st.RootKey(ctx)
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	return s.deriveKey(key), append(append([]byte(nil), s.prefix...), id...), nil
+}
+
+// deriveKey returns the root key of the tenant derived from the given
+// root key of the underlying store.
+func (s *rootKeyStore) deriveKey(key []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(s.prefix)
+	return h.Sum(nil)
+}
@@ -0,0 +1,253 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package tenantstore_test
+
+import (
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/aclstore/v2"
+	"github.com/juju/simplekv/memsimplekv"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/candid/store"
+	"github.com/CanonicalLtd/candid/store/memstore"
+	"github.com/CanonicalLtd/candid/store/storetest"
+	"github.com/CanonicalLtd/candid/store/tenantstore"
+)
+
+func TestStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestStore(c, func(c *qt.C) store.Store {
+		st := memstore.NewStore()
+		// Add an identity for another tenant, which should not
+		// be visible.
+		err := tenantstore.NewStore(st, "other").UpdateIdentity(context.Background(), &store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", "other"),
+			Username:   "other",
+			Name:       "Other Tenant",
+		}, store.Update{
+			store.Username: store.Set,
+			store.Name:     store.Set,
+		})
+		c.Assert(err, qt.Equals, nil)
+		return tenantstore.NewStore(st, "acme")
+	})
+}
+
+func TestKeyValueStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestKeyValueStore(c, func(c *qt.C) store.ProviderDataStore {
+		return tenantstore.NewProviderDataStore(memstore.NewProviderDataStore(), "acme")
+	})
+}
+
+func TestACLStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestACLStore(c, func(c *qt.C) aclstore.ACLStore {
+		return tenantstore.NewACLStore(aclstore.NewACLStore(memsimplekv.NewStore()), "acme")
+	})
+}
+
+func TestIdentityIsolation(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := memstore.NewStore()
+	acme := tenantstore.NewStore(st, "acme")
+	other := tenantstore.NewStore(st, "other")
+
+	// The same username can be used by each tenant.
+	id1 := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Name:       "Acme Bob",
+	}
+	err := acme.UpdateIdentity(ctx, &id1, store.Update{
+		store.Username: store.Set,
+		store.Name:     store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+	id2 := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Name:       "Other Bob",
+	}
+	err = other.UpdateIdentity(ctx, &id2, store.Update{
+		store.Username: store.Set,
+		store.Name:     store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id2.ID, qt.Not(qt.Equals), id1.ID)
+
+	id := store.Identity{Username: "bob"}
+	err = acme.Identity(ctx, &id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id.Name, qt.Equals, "Acme Bob")
+	c.Assert(id.ProviderID, qt.Equals, store.MakeProviderIdentity("test", "bob"))
+
+	// The underlying store holds the tenant in the names.
+	id = store.Identity{ID: id2.ID}
+	err = st.Identity(ctx, &id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id.Username, qt.Equals, "other/bob")
+	c.Assert(id.ProviderID, qt.Equals, store.ProviderIdentity("other/test:bob"))
+
+	// Identities of other tenants cannot be read or updated by ID.
+	id = store.Identity{ID: id2.ID}
+	err = acme.Identity(ctx, &id)
+	c.Assert(err, qt.ErrorMatches, `identity ".*" not found`)
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	err = acme.UpdateIdentity(ctx, &store.Identity{
+		ID:   id2.ID,
+		Name: "Changed",
+	}, store.Update{
+		store.Name: store.Set,
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+
+	ids, err := acme.FindIdentities(ctx, &store.Identity{}, store.Filter{}, nil, 0, 0)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ids, qt.HasLen, 1)
+	c.Assert(ids[0].Name, qt.Equals, "Acme Bob")
+
+	// Searching for the tenant name does not match every identity.
+	ids, err = acme.SearchIdentities(ctx, "acme", 0, 0)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ids, qt.HasLen, 1)
+	ids, err = other.SearchIdentities(ctx, "bob", 0, 0)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ids, qt.HasLen, 1)
+	c.Assert(ids[0].Name, qt.Equals, "Other Bob")
+
+	counts, err := acme.IdentityCounts(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(counts, qt.DeepEquals, map[string]int{"test": 1})
+}
+
+func TestRootKeyStore(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := bakery.NewMemRootKeyStore()
+	acme := tenantstore.NewRootKeyStore(st, "acme")
+	other := tenantstore.NewRootKeyStore(st, "other")
+
+	key, id, err := acme.RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	key1, err := acme.Get(ctx, id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(key1, qt.DeepEquals, key)
+
+	// A root key of one tenant cannot be used by another.
+	_, err = other.Get(ctx, id)
+	c.Assert(errgo.Cause(err), qt.Equals, bakery.ErrNotFound)
+
+	// Each tenant has its own keys, which differ from the keys in
+	// the underlying store.
+	key2, _, err := other.RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(key2, qt.Not(qt.DeepEquals), key)
+	stKey, _, err := st.RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(key, qt.Not(qt.DeepEquals), stKey)
+	c.Assert(key2, qt.Not(qt.DeepEquals), stKey)
+}
+
+func TestDefaultStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestStore(c, func(c *qt.C) store.Store {
+		st := memstore.NewStore()
+		// Add an identity for a tenant, which should not be
+		// visible.
+		err := tenantstore.NewStore(st, "acme").UpdateIdentity(context.Background(), &store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", "acme"),
+			Username:   "acme",
+			Name:       "Acme Tenant",
+		}, store.Update{
+			store.Username: store.Set,
+			store.Name:     store.Set,
+		})
+		c.Assert(err, qt.Equals, nil)
+		return tenantstore.NewDefaultStore(st)
+	})
+}
+
+func TestDefaultStoreIsolation(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := memstore.NewStore()
+	def := tenantstore.NewDefaultStore(st)
+	acme := tenantstore.NewStore(st, "acme")
+
+	id1 := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Name:       "Default Bob",
+	}
+	err := def.UpdateIdentity(ctx, &id1, store.Update{
+		store.Username: store.Set,
+		store.Name:     store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+	id2 := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Name:       "Acme Bob",
+	}
+	err = acme.UpdateIdentity(ctx, &id2, store.Update{
+		store.Username: store.Set,
+		store.Name:     store.Set,
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	// Identities of tenants cannot be read or updated, by ID or by
+	// their names in the underlying store.
+	id := store.Identity{ID: id2.ID}
+	err = def.Identity(ctx, &id)
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	id = store.Identity{Username: "acme/bob"}
+	err = def.Identity(ctx, &id)
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	err = def.UpdateIdentity(ctx, &store.Identity{
+		ID:   id2.ID,
+		Name: "Changed",
+	}, store.Update{
+		store.Name: store.Set,
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	err = def.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.ProviderIdentity("acme/test:bob"),
+		Name:       "Changed",
+	}, store.Update{
+		store.Name: store.Set,
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	id = store.Identity{ID: id2.ID}
+	err = acme.Identity(ctx, &id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id.Name, qt.Equals, "Acme Bob")
+
+	ids, err := def.FindIdentities(ctx, &store.Identity{}, store.Filter{}, nil, 0, 0)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ids, qt.HasLen, 1)
+	c.Assert(ids[0].Name, qt.Equals, "Default Bob")
+
+	ids, err = def.SearchIdentities(ctx, "bob", 0, 0)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ids, qt.HasLen, 1)
+	c.Assert(ids[0].Name, qt.Equals, "Default Bob")
+
+	counts, err := def.IdentityCounts(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(counts, qt.DeepEquals, map[string]int{"test": 1})
+}
@@ -0,0 +1,323 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package vault provides a bakery.RootKeyStore that keeps macaroon root
+// keys in the KV (version 2) secrets engine of a HashiCorp Vault
+// server, so that root keys are never stored in the identity database.
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// defaultExpiryDuration is the expiry duration used when no policy is
+// specified, matching the database backed root key stores.
+const defaultExpiryDuration = 365 * 24 * time.Hour
+
+// errCASMismatch is the error cause returned by write when the
+// check-and-set version does not match.
+var errCASMismatch = errgo.New("check-and-set mismatch")
+
+// Params holds the parameters for a RootKeyStore.
+type Params struct {
+	// Address holds the URL of the Vault server.
+	Address string
+
+	// Token holds the token used to authenticate to Vault.
+	Token string
+
+	// Mount holds the path at which the KV version 2 secrets engine
+	// is mounted. If this is empty, "secret" is used.
+	Mount string
+
+	// Path holds the path within the secrets engine under which the
+	// root keys are stored. If this is empty, "candid/rootkeys" is
+	// used.
+	Path string
+
+	// Policy holds the policy used to generate and expire root keys.
+	// If the ExpiryDuration is zero, root keys expire after a year.
+	Policy store.RootKeyPolicy
+
+	// Client holds the HTTP client used to contact Vault. If this is
+	// nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// Now returns the current time. If this is nil, time.Now is
+	// used.
+	Now func() time.Time
+}
+
+// RootKeyStore is a bakery.RootKeyStore that keeps root keys in
+// Vault. The current root key is recorded at "<path>/current"; deleting
+// this entry from Vault causes a new root key to be generated.
+type RootKeyStore struct {
+	p Params
+
+	mu      sync.Mutex
+	current *rootKey
+	keys    map[string]*rootKey
+}
+
+// rootKey is a root key as stored in Vault.
+type rootKey struct {
+	ID      string    `json:"id"`
+	Key     []byte    `json:"key"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// currentKey is the value stored at "<path>/current".
+type currentKey struct {
+	ID string `json:"id"`
+}
+
+// NewRootKeyStore returns a new RootKeyStore using the given
+// parameters.
+func NewRootKeyStore(p Params) *RootKeyStore {
+	if p.Mount == "" {
+		p.Mount = "secret"
+	}
+	if p.Path == "" {
+		p.Path = "candid/rootkeys"
+	}
+	if p.Policy.ExpiryDuration == 0 {
+		p.Policy.ExpiryDuration = defaultExpiryDuration
+	}
+	if p.Policy.GenerateInterval == 0 {
+		p.Policy.GenerateInterval = p.Policy.ExpiryDuration
+	}
+	if p.Client == nil {
+		p.Client = http.DefaultClient
+	}
+	if p.Now == nil {
+		p.Now = time.Now
+	}
+	return &RootKeyStore{
+		p:    p,
+		keys: make(map[string]*rootKey),
+	}
+}
+
+// Get implements bakery.RootKeyStore.Get.
+func (s *RootKeyStore) Get(ctx context.Context, id []byte) ([]byte, error) {
+	if _, err := hex.DecodeString(string(id)); err != nil || len(id) == 0 {
+		return nil, bakery.ErrNotFound
+	}
+	s.mu.Lock()
+	k := s.keys[string(id)]
+	s.mu.Unlock()
+	if k == nil {
+		var err error
+		k, err = s.getKey(ctx, string(id))
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(bakery.ErrNotFound))
+		}
+		s.mu.Lock()
+		s.keys[k.ID] = k
+		s.mu.Unlock()
+	}
+	if !s.p.Now().Before(k.Expires) {
+		s.mu.Lock()
+		delete(s.keys, k.ID)
+		s.mu.Unlock()
+		return nil, bakery.ErrNotFound
+	}
+	return k.Key, nil
+}
+
+// RootKey implements bakery.RootKeyStore.RootKey.
+func (s *RootKeyStore) RootKey(ctx context.Context) (rootKey []byte, id []byte, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current != nil && s.usable(s.current) {
+		return s.current.Key, []byte(s.current.ID), nil
+	}
+	k, err := s.currentKey(ctx)
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	s.current = k
+	s.keys[k.ID] = k
+	return k.Key, []byte(k.ID), nil
+}
+
+// usable reports whether the given key may be used to mint new
+// macaroons.
+func (s *RootKeyStore) usable(k *rootKey) bool {
+	now := s.p.Now()
+	return now.Before(k.Created.Add(s.p.Policy.GenerateInterval)) && now.Before(k.Expires)
+}
+
+// currentKey returns the current root key held in Vault, generating a
+// new one if necessary.
+func (s *RootKeyStore) currentKey(ctx context.Context) (*rootKey, error) {
+	for i := 0; i < 3; i++ {
+		var cur currentKey
+		version, err := s.read(ctx, "current", &cur)
+		if err != nil && errgo.Cause(err) != bakery.ErrNotFound {
+			return nil, errgo.Mask(err)
+		}
+		if err == nil {
+			k, err := s.getKey(ctx, cur.ID)
+			if err == nil && s.usable(k) {
+				return k, nil
+			}
+			if err != nil && errgo.Cause(err) != bakery.ErrNotFound {
+				return nil, errgo.Mask(err)
+			}
+		}
+		k, err := s.newKey()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if err := s.write(ctx, "keys/"+k.ID, k, -1); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		err = s.write(ctx, "current", currentKey{ID: k.ID}, version)
+		if errgo.Cause(err) == errCASMismatch {
+			// Another server has generated a new key, use that
+			// one instead.
+			continue
+		}
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return k, nil
+	}
+	return nil, errgo.Newf("cannot update current root key")
+}
+
+func (s *RootKeyStore) newKey() (*rootKey, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	key := make([]byte, 24)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	now := s.p.Now()
+	return &rootKey{
+		ID:      hex.EncodeToString(id),
+		Key:     key,
+		Created: now,
+		Expires: now.Add(s.p.Policy.ExpiryDuration),
+	}, nil
+}
+
+func (s *RootKeyStore) getKey(ctx context.Context, id string) (*rootKey, error) {
+	var k rootKey
+	if _, err := s.read(ctx, "keys/"+id, &k); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(bakery.ErrNotFound))
+	}
+	return &k, nil
+}
+
+type kvReadResponse struct {
+	Data struct {
+		Data     json.RawMessage `json:"data"`
+		Metadata struct {
+			Version int `json:"version"`
+		} `json:"metadata"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// read reads the secret at the given path relative to the root key
+// path into v, returning its version. If there is no secret, an error
+// with a cause of bakery.ErrNotFound is returned.
+func (s *RootKeyStore) read(ctx context.Context, path string, v interface{}) (int, error) {
+	resp, err := s.do(ctx, "GET", path, nil)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, bakery.ErrNotFound
+	}
+	var kvresp kvReadResponse
+	if err := httprequest.UnmarshalJSONResponse(resp, &kvresp); err != nil {
+		return 0, errgo.Notef(err, "cannot read from vault")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, errgo.Newf("cannot read from vault: %s", strings.Join(kvresp.Errors, "; "))
+	}
+	if len(kvresp.Data.Data) == 0 || string(kvresp.Data.Data) == "null" {
+		// The secret has been deleted.
+		return kvresp.Data.Metadata.Version, bakery.ErrNotFound
+	}
+	if err := json.Unmarshal(kvresp.Data.Data, v); err != nil {
+		return 0, errgo.Notef(err, "invalid value in vault")
+	}
+	return kvresp.Data.Metadata.Version, nil
+}
+
+// write writes v as the secret at the given path relative to the root
+// key path. If cas is not negative then the write only succeeds if the
+// current version of the secret is cas, otherwise an error with a cause
+// of errCASMismatch is returned.
+func (s *RootKeyStore) write(ctx context.Context, path string, v interface{}, cas int) error {
+	body := map[string]interface{}{
+		"data": v,
+	}
+	if cas >= 0 {
+		body["options"] = map[string]int{"cas": cas}
+	}
+	resp, err := s.do(ctx, "POST", path, body)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	var kvresp kvReadResponse
+	if err := httprequest.UnmarshalJSONResponse(resp, &kvresp); err != nil {
+		return errgo.Notef(err, "cannot write to vault")
+	}
+	msg := strings.Join(kvresp.Errors, "; ")
+	if cas >= 0 && resp.StatusCode == http.StatusBadRequest && strings.Contains(msg, "check-and-set") {
+		return errgo.WithCausef(nil, errCASMismatch, "%s", msg)
+	}
+	return errgo.Newf("cannot write to vault: %s", msg)
+}
+
+func (s *RootKeyStore) do(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	var buf []byte
+	if body != nil {
+		var err error
+		buf, err = json.Marshal(body)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	u := strings.TrimSuffix(s.p.Address, "/") + "/v1/" + s.p.Mount + "/data/" + s.p.Path + "/" + path
+	req, err := http.NewRequest(method, u, bytes.NewReader(buf))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("X-Vault-Token", s.p.Token)
+	resp, err := s.p.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot contact vault")
+	}
+	return resp, nil
+}
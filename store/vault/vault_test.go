@@ -0,0 +1,226 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package vault_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/candid/store"
+	"github.com/CanonicalLtd/candid/store/vault"
+)
+
+func TestRootKeyStore(t *testing.T) {
+	c := qt.New(t)
+	kv := newFakeKV(c)
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := vault.NewRootKeyStore(vault.Params{
+		Address: kv.srv.URL,
+		Token:   "test-token",
+		Policy: store.RootKeyPolicy{
+			GenerateInterval: time.Hour,
+			ExpiryDuration:   24 * time.Hour,
+		},
+		Now: func() time.Time { return now },
+	})
+	ctx := context.Background()
+	key1, id1, err := s.RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(key1, qt.HasLen, 24)
+	c.Assert(kv.has("secret/data/candid/rootkeys/current"), qt.Equals, true)
+	c.Assert(kv.has("secret/data/candid/rootkeys/keys/"+string(id1)), qt.Equals, true)
+
+	// The same key is used until the generate interval passes.
+	now = now.Add(30 * time.Minute)
+	key, id, err := s.RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(key, qt.DeepEquals, key1)
+	c.Assert(id, qt.DeepEquals, id1)
+
+	now = now.Add(time.Hour)
+	key2, id2, err := s.RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id2, qt.Not(qt.DeepEquals), id1)
+
+	// A different server sharing the vault sees the same keys.
+	s2 := vault.NewRootKeyStore(vault.Params{
+		Address: kv.srv.URL,
+		Token:   "test-token",
+		Now:     func() time.Time { return now },
+	})
+	key, err = s2.Get(ctx, id1)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(key, qt.DeepEquals, key1)
+	key, err = s2.Get(ctx, id2)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(key, qt.DeepEquals, key2)
+
+	// Keys are not found once they have expired.
+	now = now.Add(23 * time.Hour)
+	_, err = s.Get(ctx, id1)
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+	_, err = s.Get(ctx, id2)
+	c.Assert(err, qt.Equals, nil)
+}
+
+func TestRootKeyStoreRotateByDeletingCurrent(t *testing.T) {
+	c := qt.New(t)
+	kv := newFakeKV(c)
+	s1 := vault.NewRootKeyStore(vault.Params{
+		Address: kv.srv.URL,
+		Mount:   "kv",
+		Path:    "candid",
+	})
+	ctx := context.Background()
+	_, id1, err := s1.RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+
+	kv.delete("kv/data/candid/current")
+	s2 := vault.NewRootKeyStore(vault.Params{
+		Address: kv.srv.URL,
+		Mount:   "kv",
+		Path:    "candid",
+	})
+	_, id2, err := s2.RootKey(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id2, qt.Not(qt.DeepEquals), id1)
+
+	// The old key is still valid.
+	_, err = s2.Get(ctx, id1)
+	c.Assert(err, qt.Equals, nil)
+}
+
+func TestRootKeyStoreNotFound(t *testing.T) {
+	c := qt.New(t)
+	kv := newFakeKV(c)
+	s := vault.NewRootKeyStore(vault.Params{
+		Address: kv.srv.URL,
+	})
+	ctx := context.Background()
+	_, err := s.Get(ctx, []byte("0123456789abcdef"))
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+	_, err = s.Get(ctx, []byte("../current"))
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+	_, err = s.Get(ctx, nil)
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+}
+
+func TestRootKeyStoreVaultError(t *testing.T) {
+	c := qt.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"errors":["permission denied"]}`))
+	}))
+	c.Defer(srv.Close)
+	s := vault.NewRootKeyStore(vault.Params{
+		Address: srv.URL,
+	})
+	_, _, err := s.RootKey(context.Background())
+	c.Assert(err, qt.ErrorMatches, `cannot read from vault: permission denied`)
+}
+
+// fakeKV is a minimal implementation of the Vault KV version 2 secrets
+// engine API.
+type fakeKV struct {
+	c   *qt.C
+	srv *httptest.Server
+
+	mu      sync.Mutex
+	secrets map[string]*secret
+}
+
+type secret struct {
+	data    json.RawMessage
+	version int
+}
+
+func newFakeKV(c *qt.C) *fakeKV {
+	kv := &fakeKV{
+		c:       c,
+		secrets: make(map[string]*secret),
+	}
+	kv.srv = httptest.NewServer(http.HandlerFunc(kv.serveHTTP))
+	c.Defer(kv.srv.Close)
+	return kv
+}
+
+func (kv *fakeKV) has(path string) bool {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	s := kv.secrets[path]
+	return s != nil && s.data != nil
+}
+
+func (kv *fakeKV) delete(path string) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if s := kv.secrets[path]; s != nil {
+		s.data = nil
+		s.version++
+	}
+}
+
+func (kv *fakeKV) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	kv.c.Check(req.Header.Get("X-Vault-Token"), qt.Not(qt.Equals), "")
+	path := strings.TrimPrefix(req.URL.Path, "/v1/")
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	s := kv.secrets[path]
+	switch req.Method {
+	case "GET":
+		if s == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		data := s.data
+		if data == nil {
+			data = json.RawMessage("null")
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"data": data,
+				"metadata": map[string]int{
+					"version": s.version,
+				},
+			},
+		})
+	case "POST":
+		var body struct {
+			Data    json.RawMessage `json:"data"`
+			Options *struct {
+				CAS int `json:"cas"`
+			} `json:"options"`
+		}
+		err := json.NewDecoder(req.Body).Decode(&body)
+		kv.c.Assert(err, qt.Equals, nil)
+		version := 0
+		if s != nil {
+			version = s.version
+		}
+		if body.Options != nil && body.Options.CAS != version {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":["check-and-set parameter did not match the current version"]}`))
+			return
+		}
+		kv.secrets[path] = &secret{
+			data:    body.Data,
+			version: version + 1,
+		}
+		w.Write([]byte(`{"data":{}}`))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package candid
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/CanonicalLtd/candid/store/tenantstore"
+)
+
+// A Tenant is an organisation served by a handler returned from
+// NewTenantHandler, with its own identities, identity providers and
+// administrators.
+type Tenant struct {
+	// Name holds the name of the tenant.
+	Name string
+
+	// Hostnames holds the host names of the requests served for the
+	// tenant.
+	Hostnames []string
+
+	// PathPrefix, if set, holds the path prefix of the requests
+	// served for the tenant, for requests whose host name does not
+	// select a tenant. The prefix is removed before the request is
+	// passed to Handler.
+	PathPrefix string
+
+	// Handler holds the handler that serves the tenant. This is
+	// usually created by NewServer with parameters returned from
+	// TenantParams.
+	Handler HandlerCloser
+}
+
+// TenantParams returns a copy of the given parameters in which the
+// stores keep the data of the given tenant separate from that of all
+// other tenants. The caller should also set the identity providers,
+// location, key pair and admin credentials of the tenant.
+func TenantParams(p ServerParams, tenant string) ServerParams {
+	p.Store = tenantstore.NewStore(p.Store, tenant)
+	p.ProviderDataStore = tenantstore.NewProviderDataStore(p.ProviderDataStore, tenant)
+	p.RootKeyStore = tenantstore.NewRootKeyStore(p.RootKeyStore, tenant)
+	p.ACLStore = tenantstore.NewACLStore(p.ACLStore, tenant)
+	return p
+}
+
+// DefaultTenantParams returns a copy of the given parameters for the
+// server of the default organisation when tenants share its stores. The
+// identities of the tenants are hidden from the default server. The
+// parameters of the tenants should be derived from the original
+// parameters using TenantParams.
+func DefaultTenantParams(p ServerParams) ServerParams {
+	p.Store = tenantstore.NewDefaultStore(p.Store)
+	return p
+}
+
+// NewTenantHandler returns a handler that serves the requests for each
+// of the given tenants with the tenant's handler, and all other
+// requests with def. Closing the returned handler closes all of the
+// handlers.
+func NewTenantHandler(def HandlerCloser, tenants []Tenant) HandlerCloser {
+	h := &tenantHandler{
+		def:     def,
+		tenants: tenants,
+		hosts:   make(map[string]HandlerCloser),
+	}
+	for _, t := range tenants {
+		for _, host := range t.Hostnames {
+			h.hosts[strings.ToLower(host)] = t.Handler
+		}
+	}
+	return h
+}
+
+type tenantHandler struct {
+	def     HandlerCloser
+	tenants []Tenant
+	hosts   map[string]HandlerCloser
+}
+
+// ServeHTTP implements http.Handler.
+func (h *tenantHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	if th, ok := h.hosts[strings.ToLower(host)]; ok {
+		th.ServeHTTP(w, req)
+		return
+	}
+	for _, t := range h.tenants {
+		if t.PathPrefix == "" {
+			continue
+		}
+		if req.URL.Path != t.PathPrefix && !strings.HasPrefix(req.URL.Path, t.PathPrefix+"/") {
+			continue
+		}
+		req1 := new(http.Request)
+		*req1 = *req
+		u := *req.URL
+		u.Path = strings.TrimPrefix(req.URL.Path, t.PathPrefix)
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		u.RawPath = ""
+		req1.URL = &u
+		t.Handler.ServeHTTP(w, req1)
+		return
+	}
+	h.def.ServeHTTP(w, req)
+}
+
+// Shutdown implements HandlerCloser.Shutdown by shutting down all of
+// the handlers.
+func (h *tenantHandler) Shutdown(ctx context.Context) error {
+	var firstErr error
+	for _, hc := range h.handlers() {
+		if err := hc.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close implements HandlerCloser.Close by closing all of the handlers.
+func (h *tenantHandler) Close() {
+	for _, hc := range h.handlers() {
+		hc.Close()
+	}
+}
+
+func (h *tenantHandler) handlers() []HandlerCloser {
+	hcs := []HandlerCloser{h.def}
+	for _, t := range h.tenants {
+		hcs = append(hcs, t.Handler)
+	}
+	return hcs
+}
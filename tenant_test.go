@@ -0,0 +1,109 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package candid_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/CanonicalLtd/candid"
+)
+
+var tenantHandlerTests = []struct {
+	about      string
+	host       string
+	path       string
+	expectBody string
+}{{
+	about:      "default",
+	host:       "candid.example.com",
+	path:       "/v1/u/bob",
+	expectBody: "default /v1/u/bob",
+}, {
+	about:      "hostname",
+	host:       "acme.example.com",
+	path:       "/v1/u/bob",
+	expectBody: "acme /v1/u/bob",
+}, {
+	about:      "hostname with port",
+	host:       "ACME.example.com:8081",
+	path:       "/v1/u/bob",
+	expectBody: "acme /v1/u/bob",
+}, {
+	about:      "path prefix",
+	host:       "candid.example.com",
+	path:       "/other/v1/u/bob",
+	expectBody: "other /v1/u/bob",
+}, {
+	about:      "path prefix only",
+	host:       "candid.example.com",
+	path:       "/other",
+	expectBody: "other /",
+}, {
+	about:      "partial path prefix",
+	host:       "candid.example.com",
+	path:       "/otherwise",
+	expectBody: "default /otherwise",
+}, {
+	about:      "hostname takes precedence",
+	host:       "acme.example.com",
+	path:       "/other/v1/u/bob",
+	expectBody: "acme /other/v1/u/bob",
+}}
+
+func TestTenantHandler(t *testing.T) {
+	c := qt.New(t)
+	def := newTestHandler("default")
+	acme := newTestHandler("acme")
+	other := newTestHandler("other")
+	h := candid.NewTenantHandler(def, []candid.Tenant{{
+		Name:      "acme",
+		Hostnames: []string{"acme.example.com"},
+		Handler:   acme,
+	}, {
+		Name:       "other",
+		PathPrefix: "/other",
+		Handler:    other,
+	}})
+	for _, test := range tenantHandlerTests {
+		c.Run(test.about, func(c *qt.C) {
+			req := httptest.NewRequest("GET", test.path, nil)
+			req.Host = test.host
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			c.Assert(rr.Body.String(), qt.Equals, test.expectBody)
+		})
+	}
+	h.Close()
+	c.Assert(def.closed, qt.Equals, true)
+	c.Assert(acme.closed, qt.Equals, true)
+	c.Assert(other.closed, qt.Equals, true)
+}
+
+type testHandler struct {
+	name   string
+	closed bool
+}
+
+func newTestHandler(name string) *testHandler {
+	return &testHandler{name: name}
+}
+
+func (h *testHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	fmt.Fprintf(w, "%s %s", h.name, req.URL.Path)
+}
+
+func (h *testHandler) Shutdown(context.Context) error {
+	h.closed = true
+	return nil
+}
+
+func (h *testHandler) Close() {
+	h.closed = true
+}